@@ -1,27 +1,49 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/gocardless/draupnir/pkg/client/completion"
 	"github.com/gocardless/draupnir/pkg/client/config"
+	"github.com/gocardless/draupnir/pkg/client/doctor"
+	"github.com/gocardless/draupnir/pkg/client/output"
+	"github.com/gocardless/draupnir/pkg/client/picker"
+	"github.com/gocardless/draupnir/pkg/manifest"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server"
 	clientPkg "github.com/gocardless/draupnir/pkg/server/api/client"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
 	"github.com/gocardless/draupnir/pkg/version"
 	"github.com/prometheus/common/log"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/oauth2"
 )
 
+// profileNamePattern matches the names of profiles that we create, which are
+// used in file names
+var profileNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
 const quickStart string = `
 QUICK START:
 		draupnir authenticate
@@ -38,6 +60,7 @@ func main() {
 	app.Version = version.Version
 	app.Usage = "A client for draupnir"
 	app.CustomAppHelpTemplate = fmt.Sprintf("%s%s", cli.AppHelpTemplate, quickStart)
+	app.EnableBashCompletion = true
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
 			Name:  "skip-verify",
@@ -47,13 +70,96 @@ func main() {
 			Name:  "insecure",
 			Usage: "don't validate certificates when connecting to draupnir",
 		},
+		cli.StringFlag{
+			Name:   "profile",
+			EnvVar: "DRAUPNIR_PROFILE",
+			Usage:  "the profile of the config file to use, rather than the default config",
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Value: output.Table,
+			Usage: fmt.Sprintf("how to print instances and images: %s", strings.Join(output.Formats, ", ")),
+		},
+		cli.StringFlag{
+			Name:  "columns",
+			Usage: "the comma separated fields to print from list commands, e.g. id,image_id,port,expires_at",
+		},
+		cli.StringFlag{
+			Name:  "sort",
+			Usage: "the field to sort the output of list commands by, e.g. expires_at, or -expires_at for descending order",
+		},
+		cli.BoolFlag{
+			Name:   "verbose",
+			EnvVar: "DRAUPNIR_VERBOSE",
+			Usage:  "log each request made to draupnir, with its status and duration",
+		},
+		cli.BoolFlag{
+			Name:   "debug",
+			EnvVar: "DRAUPNIR_DEBUG",
+			Usage:  "as --verbose, also logging the headers of each request and response, with credentials redacted",
+		},
+		cli.BoolFlag{
+			Name:   "strict",
+			EnvVar: "DRAUPNIR_STRICT",
+			Usage:  "fail if draupnir's responses don't match the schemas that this version expects, e.g. when testing new server builds",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			EnvVar: "DRAUPNIR_LOG_FORMAT",
+			Value:  logFormatText,
+			Usage:  fmt.Sprintf("how to format logs: %s", strings.Join(logFormats, ", ")),
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if err := configureLogging(c.GlobalString("log-format"), c.GlobalBool("verbose") || c.GlobalBool("debug")); err != nil {
+			logger.With("error", err).Fatal("Invalid --log-format")
+		}
+
+		if err := output.Check(c.GlobalString("output")); err != nil {
+			logger.With("error", err).Fatal("Invalid --output")
+		}
+
+		// The config package, and any draupnir commands that we run, read the
+		// profile from the environment
+		if err := os.Setenv("DRAUPNIR_PROFILE", c.GlobalString("profile")); err != nil {
+			logger.With("error", err).Fatal("Could not set profile")
+		}
+
+		// Tokens are encrypted with a passphrase on machines without a keychain,
+		// which can only be asked for if there's someone to ask
+		if picker.Interactive() {
+			config.PromptPassphrase = promptPassphrase
+		}
+		return nil
 	}
 
 	app.Commands = []cli.Command{
 		{
 			Name:  "server",
 			Usage: "start the draupnir server",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "selftest", Usage: "Create, clone and destroy images and instances, then report how long it took, instead of serving"},
+				cli.IntFlag{Name: "selftest-images", Value: 1, Usage: "Number of images to create in the self-test"},
+				cli.IntFlag{Name: "selftest-instances", Value: 10, Usage: "Number of instances to clone from each image in the self-test"},
+				cli.IntFlag{Name: "selftest-concurrency", Value: 4, Usage: "Number of instances to clone at once in the self-test"},
+				cli.IntFlag{Name: "selftest-rows", Value: 100000, Usage: "Number of rows of synthetic data to fill each image with in the self-test"},
+				cli.StringFlag{Name: "selftest-dataset", Usage: "Tarball of a data directory to upload in the self-test, rather than an empty cluster"},
+			},
 			Action: func(c *cli.Context) error {
+				if c.Bool("selftest") {
+					err := server.RunSelftest(logger, server.SelftestOptions{
+						Images:      c.Int("selftest-images"),
+						Instances:   c.Int("selftest-instances"),
+						Concurrency: c.Int("selftest-concurrency"),
+						Rows:        c.Int("selftest-rows"),
+						Dataset:     c.String("selftest-dataset"),
+					})
+					if err != nil {
+						logger.With("error", err.Error()).Fatal("Self-test failed")
+					}
+					return nil
+				}
+
 				err := server.Run(logger)
 				if err != nil {
 					logger.With("error", err.Error()).Fatal("Failed to start server")
@@ -85,7 +191,18 @@ func main() {
 						} else {
 							fmt.Printf("Access Token: %s****\n", accessToken[0:10])
 						}
+						if cfg.KeyFile != "" {
+							fmt.Printf("Key File: %s\n", cfg.KeyFile)
+						} else {
+							fmt.Printf("Token Storage: %s\n", config.TokenStorage())
+						}
 						fmt.Printf("Database: %s\n", database)
+						if cfg.Insecure {
+							fmt.Println("Insecure: true")
+						}
+						if cfg.SkipVerify {
+							fmt.Println("Skip Verify: true")
+						}
 						return nil
 					},
 				},
@@ -96,7 +213,11 @@ func main() {
 
 [key] can take the following values:
     domain: The domain of the draupnir server.
-    database: The default database to connect to. If not set, defaults to the PGDATABASE environment variable.`,
+    database: The default database to connect to. If not set, defaults to the PGDATABASE environment variable.
+    insecure: Whether to connect to the server over plain HTTP, as if --insecure were always given.
+    skip-verify: Whether to skip verifying the server's certificate, as if --skip-verify were always given.
+
+Use --profile to set the value for a profile.`,
 					Action: func(c *cli.Context) error {
 						if len(c.Args()) != 2 {
 							cli.ShowCommandHelp(c, c.Command.Name)
@@ -113,6 +234,17 @@ func main() {
 						case "database":
 							cfg.Database = val
 							storeConfig(cfg, logger)
+						case "insecure", "skip-verify":
+							enabled, err := strconv.ParseBool(val)
+							if err != nil {
+								logger.With("key", key).With("value", val).Fatal("Invalid value, must be true or false")
+							}
+							if strings.ToLower(key) == "insecure" {
+								cfg.Insecure = enabled
+							} else {
+								cfg.SkipVerify = enabled
+							}
+							storeConfig(cfg, logger)
 						default:
 							logger.With("key", key).Fatal("Invalid key")
 						}
@@ -125,36 +257,274 @@ func main() {
 			Name:    "authenticate",
 			Aliases: []string{},
 			Usage:   "authenticate with google",
-			Flags:   []cli.Flag{cli.BoolFlag{Name: "force", Usage: "Force reauthentication"}},
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "force", Usage: "Force reauthentication"},
+				cli.StringFlag{
+					Name:  "key-file",
+					Usage: "authenticate as a service account with its key file, rather than in a browser",
+				},
+				cli.BoolFlag{
+					Name:  "device",
+					Usage: "authenticate by entering a code in a browser on another device, e.g. over SSH",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				cfg := loadConfig(logger)
-				client := NewClient(c, logger)
+
+				if path := c.String("key-file"); path != "" {
+					authenticateWithKeyFile(c, cfg, path, logger)
+					return nil
+				}
+
+				// Authenticating in a browser replaces any key file
+				cfg.KeyFile = ""
+				client := NewClientWithConfig(c, cfg, logger)
 
 				if cfg.Token.RefreshToken != "" && !c.Bool("force") {
 					logger.Info("You're already authenticated. Pass --force to reauthenticate.")
 					return nil
 				}
 
-				state := fmt.Sprintf("%d", rand.Int31())
+				var token oauth2.Token
+				if c.Bool("device") {
+					token = authenticateWithDeviceCode(client, logger)
+				} else {
+					state := fmt.Sprintf("%d", rand.Int31())
+
+					url := fmt.Sprintf("%s/authenticate?state=%s", getServerURL(c, cfg), state)
+					err := exec.Command("open", url).Run()
+					if err != nil {
+						fmt.Printf("Visit this link in your browser: %s\n", url)
+					}
+
+					token, err = client.CreateAccessToken(state)
+					if err != nil {
+						logger.With("error", err).Fatal("Could not create access token")
+					}
+				}
+
+				cfg.Token = token
+				storeConfig(cfg, logger)
+
+				if config.TokenStorage() == config.TokenStoragePlaintext {
+					logger.Warn("Your token is stored in plaintext in your config file. Set DRAUPNIR_TOKEN_PASSPHRASE to encrypt it.")
+				}
+				logger.Info("Successfully authenticated.")
+				return nil
+			},
+		},
+		{
+			Name:  "whoami",
+			Usage: "show who you're authenticated as, your roles and your quota usage",
+			Action: func(c *cli.Context) error {
+				client := NewClient(c, logger)
 
-				url := fmt.Sprintf("%s/authenticate?state=%s", getServerURL(c, cfg), state)
-				err := exec.Command("open", url).Run()
+				user, err := client.Whoami()
 				if err != nil {
-					fmt.Printf("Visit this link in your browser: %s\n", url)
+					logger.With("error", err).Fatal("Could not fetch user")
+				}
+
+				printRecord(c, logger, user, func() {
+					fmt.Printf("user:      %s\n", user.ID)
+					fmt.Printf("roles:     %s\n", strings.Join(user.Roles, ", "))
+					if user.MaxInstances > 0 {
+						fmt.Printf("instances: %d of %d\n", user.Instances, user.MaxInstances)
+					} else {
+						fmt.Printf("instances: %d\n", user.Instances)
+					}
+					if user.MaxImagesInProgress > 0 {
+						fmt.Printf("images:    %d of %d in progress\n", user.ImagesInProgress, user.MaxImagesInProgress)
+					} else {
+						fmt.Printf("images:    %d in progress\n", user.ImagesInProgress)
+					}
+					if user.ImageCooldown != "0s" {
+						fmt.Printf("cooldown:  %s until the next image can be created\n", user.ImageCooldown)
+					}
+				})
+				return nil
+			},
+		},
+		{
+			Name:  "exchange-token",
+			Usage: "exchange this machine's AWS or GCP identity for a service account token",
+			Description: "Prints a token for the service account that the identity is mapped\n" +
+				"   to, for use as DRAUPNIR_TOKEN. AWS credentials are read from\n" +
+				"   AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, and GCP\n" +
+				"   ID tokens from the metadata server.",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "provider", Usage: "the identity's cloud provider: aws or gcp"},
+				cli.StringFlag{
+					Name:  "audience",
+					Usage: "the server's aws_audience or gcp_audience (default: the server's URL)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg := loadConfig(logger)
+				client := NewClientWithConfig(c, cfg, logger)
+
+				audience := c.String("audience")
+				if audience == "" {
+					audience = getServerURL(c, cfg)
 				}
 
-				token, err := client.CreateAccessToken(state)
+				var identity string
+				var err error
+				switch provider := c.String("provider"); provider {
+				case models.IdentityProviderAWS:
+					creds, credsErr := clientPkg.AWSCredentialsFromEnvironment()
+					if credsErr != nil {
+						logger.With("error", credsErr).Fatal("Could not read AWS credentials")
+					}
+					identity, err = clientPkg.AWSIdentityToken(creds, audience, time.Now())
+				case models.IdentityProviderGCP:
+					identity, err = clientPkg.GCPIdentityToken(context.Background(), audience)
+				default:
+					logger.Fatal("--provider must be aws or gcp")
+				}
 				if err != nil {
-					logger.With("error", err).Fatal("Could not create access token")
+					logger.With("error", err).Fatal("Could not obtain identity token")
 				}
 
-				cfg.Token = token
-				storeConfig(cfg, logger)
+				token, err := client.ExchangeToken(c.String("provider"), identity)
+				if err != nil {
+					logger.With("error", err).Fatal("Could not exchange identity token")
+				}
 
-				logger.Info("Successfully authenticated.")
+				logger.With("expiry", token.Expiry.Format(time.RFC3339)).Info("Exchanged identity for token")
+				fmt.Println(token.RefreshToken)
 				return nil
 			},
 		},
+		{
+			Name:  "service-accounts",
+			Usage: "manage keys for service accounts",
+			Subcommands: []cli.Command{
+				{
+					Name:      "create-key",
+					Usage:     "generate a key file for a service account, and the server config that accepts it",
+					UsageText: "draupnir service-accounts create-key [--out key.json] [name]",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "out",
+							Usage: "the file to write the key to, rather than stdout",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						name := c.Args().First()
+						if name == "" {
+							logger.Fatal("Usage: draupnir service-accounts create-key [--out key.json] [name]")
+						}
+
+						key, err := models.NewServiceAccountKey(name)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not generate key")
+						}
+						contents, err := json.MarshalIndent(key, "", "  ")
+						if err != nil {
+							logger.With("error", err).Fatal("Could not encode key")
+						}
+						contents = append(contents, '\n')
+
+						if path := c.String("out"); path != "" {
+							if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+								logger.With("error", err).Fatal("Could not write key file")
+							}
+						} else {
+							os.Stdout.Write(contents)
+						}
+
+						// The key itself never needs to reach the server
+						fmt.Fprintf(os.Stderr, "Add this to the server's config to accept the key:\n\n")
+						fmt.Fprintf(os.Stderr, "[[service_accounts]]\nname = %q\nkey_sha256 = %q\n", key.ServiceAccount, key.Hash())
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:        "profiles",
+			Usage:       "list and discover profiles",
+			Description: "List profiles, and create profiles for federated servers",
+			Subcommands: []cli.Command{
+				{
+					Name:      "list",
+					Usage:     "list the configured profiles",
+					UsageText: "draupnir profiles list",
+					Action: func(c *cli.Context) error {
+						profiles, err := config.Profiles()
+						if err != nil {
+							logger.With("error", err).Fatal("Could not list profiles")
+						}
+
+						for _, profile := range profiles {
+							cfg, err := config.ReadProfile(profile)
+							if err != nil {
+								logger.With("profile", profile).With("error", err).Warn("Could not read profile")
+								continue
+							}
+							fmt.Printf("%-16s %s\n", profile, cfg.Domain)
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "discover",
+					Usage: "create a profile for each server federated with this one",
+					UsageText: `draupnir profiles discover [domain]
+
+[domain] the domain of any server in the federation. Defaults to the domain of the current profile.
+
+A profile named after each federated server is created, or updated, with the current profile's credentials,
+which every federated server accepts. Use one with --profile <name>.`,
+					Action: func(c *cli.Context) error {
+						cfg := loadConfig(logger)
+
+						// Discovery doesn't require authentication, so we don't send our
+						// credentials to servers that we haven't configured
+						discoveryCfg := cfg
+						discoveryCfg.Token = oauth2.Token{}
+						discoveryCfg.KeyFile = ""
+						if domain := c.Args().First(); domain != "" {
+							discoveryCfg.Domain = domain
+						}
+
+						servers, err := NewClientWithConfig(c, discoveryCfg, logger).ListFederatedServers()
+						if err != nil {
+							logger.With("error", err).Fatal("Could not discover federated servers")
+						}
+						if len(servers) == 0 {
+							logger.With("domain", discoveryCfg.Domain).Fatal("The server isn't federated with any others")
+						}
+
+						for _, server := range servers {
+							if !profileNamePattern.MatchString(server.Name) {
+								logger.With("name", server.Name).Warn("Skipping federated server with invalid name")
+								continue
+							}
+
+							profileCfg, err := config.ReadProfile(server.Name)
+							if err != nil && !os.IsNotExist(err) {
+								logger.With("profile", server.Name).With("error", err).Fatal("Could not read profile")
+							}
+
+							profileCfg.Domain = server.Domain
+							profileCfg.Token = cfg.Token
+							profileCfg.KeyFile = cfg.KeyFile
+							if profileCfg.ClientCertificate == "" {
+								profileCfg.ClientCertificate = cfg.ClientCertificate
+								profileCfg.ClientKey = cfg.ClientKey
+							}
+
+							if err := config.StoreProfile(server.Name, profileCfg); err != nil {
+								logger.With("profile", server.Name).With("error", err).Fatal("Could not store profile")
+							}
+							fmt.Printf("%-16s %s\n", server.Name, server.Domain)
+						}
+						return nil
+					},
+				},
+			},
+		},
 		{
 			Name:    "instances",
 			Aliases: []string{},
@@ -163,26 +533,87 @@ func main() {
 				{
 					Name:  "list",
 					Usage: "list your instances",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "image",
+							Usage: "only list instances of this image",
+						},
+						cli.StringFlag{
+							Name:  "status",
+							Usage: "only list instances with one of these comma separated statuses: running, standby, expired or destroying",
+						},
+						cli.StringSliceFlag{
+							Name:  "label",
+							Usage: "only list instances with this key=value label (may be repeated)",
+						},
+						cli.BoolFlag{
+							Name:  "static",
+							Usage: "list the static instances, which are shared by everyone, rather than your own",
+						},
+					},
 					Action: func(c *cli.Context) error {
+						labels, err := parseLabelSelector(c.StringSlice("label"))
+						if err != nil {
+							logger.With("error", err).Fatal("Invalid labels")
+						}
+
 						client := NewClient(c, logger)
 
-						instances, err := client.ListInstances()
+						filter := clientPkg.Filter{ImageID: c.Int("image"), Labels: labels, Static: c.Bool("static")}
+						if status := c.String("status"); status != "" {
+							filter.Statuses = strings.Split(status, ",")
+						}
+						instances, err := client.ListInstances(clientPkg.ListOptions{Filter: filter})
 						if err != nil {
 							logger.With("error", err).Fatal("Could not fetch instances")
 						}
-						for _, instance := range instances {
-							fmt.Println(InstanceToString(instance))
+						printRecords(c, logger, instances, func() {
+							for _, instance := range instances {
+								fmt.Println(InstanceToString(instance))
+							}
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "summary",
+					Usage: "count your instances by status and owner (everyone's, for the upload user)",
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						counts, err := client.GetInstanceSummary()
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch instance summary")
 						}
+						printRecords(c, logger, counts, func() {
+							for _, count := range counts {
+								fmt.Println(InstanceCountToString(count))
+							}
+						})
 						return nil
 					},
 				},
 				{
-					Name:  "create",
-					Usage: "create a new instance",
+					Name:         "create",
+					Usage:        "create a new instance",
+					BashComplete: completeImageIDs(logger),
+					Flags: append([]cli.Flag{
+						cli.BoolFlag{
+							Name:  "standby",
+							Usage: "create a standby that replays WAL from the source until it is promoted",
+						},
+						cli.BoolFlag{
+							Name:  "schema-only",
+							Usage: "create an instance with empty tables, for testing migrations against the schema",
+						},
+					}, waitFlags...),
 					Action: func(c *cli.Context) error {
 						var image models.Image
 						client := NewClient(c, logger)
 
+						ctx, cancel := waitContext(c)
+						defer cancel()
+
 						if c.NArg() == 0 {
 							image, err = client.GetLatestImage()
 						} else {
@@ -193,271 +624,2508 @@ func main() {
 							logger.With("error", err).Fatal("Could not fetch image")
 						}
 
-						instance, err := client.CreateInstance(image)
+						if c.Bool("wait") && !image.Ready {
+							logger.With("image", image.ID).Info("Waiting for image to be ready")
+							image = waitForImage(ctx, client, logger, image.ID)
+						}
+
+						var instance models.Instance
+						switch {
+						case c.Bool("standby") && c.Bool("schema-only"):
+							logger.Fatal("Standby instances can't be schema-only")
+						case c.Bool("standby"):
+							instance, err = client.CreateStandbyInstance(image)
+						case c.Bool("schema-only"):
+							instance, err = client.CreateSchemaOnlyInstance(image)
+						default:
+							instance, err = client.CreateInstance(image)
+						}
 						if err != nil {
 							logger.With("error", err).Fatal("Could not create instance")
 						}
 
 						logger.With("id", instance.ID).With("image", image.ID).Info("Created instance")
-						fmt.Println(InstanceToString(instance))
+
+						// Standbys only accept local connections until they're promoted,
+						// and instances that need the proxy only accept the server's
+						if c.Bool("wait") && !instance.Standby && !instance.ProxyRequired {
+							err = clientPkg.WaitForInstanceReachable(ctx, instance, clientPkg.DefaultWaitPolicy)
+							if err != nil {
+								logger.With("id", instance.ID).With("error", err).Fatal("Timed out waiting for instance to accept connections")
+							}
+						}
+
+						printRecord(c, logger, instance, func() {
+							fmt.Println(InstanceToString(instance))
+						})
 						return nil
 					},
 				},
 				{
-					Name:  "destroy",
-					Usage: "destroy an instance",
+					Name:         "promote",
+					Usage:        "promote a standby instance, anonymising it and making it available",
+					BashComplete: completeInstanceIDs(logger),
 					Action: func(c *cli.Context) error {
-						id := c.Args().First()
-						if id == "" {
-							logger.Fatal("Must supply an instance id")
-						}
-
 						client := NewClient(c, logger)
 
-						instance, err := client.GetInstance(id)
+						instance, err := client.GetInstance(instanceID(c, client, logger))
 						if err != nil {
 							logger.With("error", err).Fatal("Could not fetch instance")
 						}
 
-						err = client.DestroyInstance(instance)
+						instance, err = client.PromoteInstance(instance)
 						if err != nil {
-							logger.With("error", err).Fatal("Could not destroy instance")
+							logger.With("error", err).Fatal("Could not promote instance")
 						}
 
-						logger.With("id", instance.ID).Info("Destroyed instance")
+						logger.With("id", instance.ID).Info("Promoted instance")
+						printRecord(c, logger, instance, func() {
+							fmt.Println(InstanceToString(instance))
+						})
 						return nil
 					},
 				},
-			},
-		},
-		{
-			Name:    "images",
-			Aliases: []string{},
-			Usage:   "manage images",
-			Subcommands: []cli.Command{
 				{
-					Name:  "list",
-					Usage: "list available images",
+					Name:         "diagnose",
+					Usage:        "list the likely causes of an instance being slow",
+					BashComplete: completeInstanceIDs(logger),
 					Action: func(c *cli.Context) error {
 						client := NewClient(c, logger)
 
-						images, err := client.ListImages()
+						diagnostics, err := client.GetInstanceDiagnostics(instanceID(c, client, logger))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not diagnose instance")
+						}
+
+						printRecord(c, logger, diagnostics, func() {
+							fmt.Printf("Active queries: %d\n", diagnostics.ActiveQueries)
+							fmt.Printf("Lock waits: %d\n", diagnostics.LockWaits)
+							if diagnostics.IOPressure >= 0 {
+								fmt.Printf("IO pressure: %.1f%%\n", diagnostics.IOPressure)
+							}
+							fmt.Printf("Concurrent bakes: %d\n", diagnostics.ConcurrentBakes)
+
+							if len(diagnostics.Causes) == 0 {
+								fmt.Println("Nothing stands out as slowing the instance down")
+								return
+							}
+							fmt.Println("Likely causes:")
+							for i, cause := range diagnostics.Causes {
+								fmt.Printf("  %d. %s\n", i+1, cause)
+							}
+						})
+						return nil
+					},
+				},
+				{
+					Name:         "extend",
+					Usage:        "push back when an instance expires",
+					BashComplete: completeInstanceIDs(logger),
+					UsageText: `draupnir instances extend [id] --by 4h
+
+The instance expires after the given duration from its current expiry, or from
+now if that's later`,
+					Flags: []cli.Flag{
+						cli.DurationFlag{Name: "by", Value: 24 * time.Hour, Usage: "How long to extend the instance by, e.g. 4h"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
 
+						instance, err := client.GetInstance(instanceID(c, client, logger))
 						if err != nil {
-							logger.With("error", err).Fatal("Could not fetch images")
+							logger.With("error", err).Fatal("Could not fetch instance")
 						}
-						for _, image := range images {
-							fmt.Println(ImageToString(image))
+
+						instance, err = client.ExtendInstance(instance, c.Duration("by"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not extend instance")
 						}
+
+						logger.With("id", instance.ID).With("expires_at", instance.ExpiresAt.Format(time.RFC3339)).Info("Extended instance")
+						printRecord(c, logger, instance, func() {
+							fmt.Println(InstanceToString(instance))
+						})
 						return nil
 					},
 				},
 				{
-					Name:  "create",
-					Usage: "create a new image",
-					UsageText: `draupnir images create [backedUpAt] [anon.sql]
+					Name:         "exec",
+					Usage:        "run a maintenance operation against one of an instance's databases",
+					BashComplete: completeInstanceIDs(logger),
+					UsageText: `draupnir instances exec [id] [database] [operation] [key=value]...
 
-[backedUpAt] an iso8601 timestamp defining when this backup was completed
-[anonyimse.sql] path to an anonymisation script that will be run on image finalisation`,
+The operations are analyze [table=name], vacuum_full table=name,
+reindex table=name and reset_sequences. They're run as a superuser.`,
 					Action: func(c *cli.Context) error {
-						var image models.Image
-						client := NewClient(c, logger)
-
-						if len(c.Args()) != 2 {
+						if c.NArg() < 3 {
 							cli.ShowCommandHelp(c, c.Command.Name)
 							logger.Fatal("Invalid command arguments")
 						}
 
-						backedUpAt, err := time.Parse(time.RFC3339, c.Args().Get(0))
-						if err != nil {
-							cli.ShowCommandHelp(c, c.Command.Name)
-							logger.Fatal("Invalid backedUpAt timestamp")
+						args := make(map[string]string)
+						for _, arg := range c.Args()[3:] {
+							parts := strings.SplitN(arg, "=", 2)
+							if len(parts) != 2 {
+								logger.With("argument", arg).Fatal("Arguments must be given as key=value")
+							}
+							args[parts[0]] = parts[1]
 						}
 
-						anonPath := c.Args().Get(1)
-						anon, err := ioutil.ReadFile(anonPath)
+						client := NewClient(c, logger)
+
+						instance, err := client.GetInstance(c.Args().First())
 						if err != nil {
-							cli.ShowCommandHelp(c, c.Command.Name)
-							logger.Fatal("Invalid anon script")
+							logger.With("error", err).Fatal("Could not fetch instance")
 						}
 
-						image, err = client.CreateImage(backedUpAt, anon)
+						result, err := client.RunMaintenance(instance, c.Args().Get(1), c.Args().Get(2), args)
 						if err != nil {
-							logger.With("error", err).Fatal("Could not create image")
+							logger.With("error", err).Fatal("Could not run maintenance operation")
 						}
 
-						fmt.Println(ImageToString(image))
+						fmt.Print(result.Output)
 						return nil
 					},
 				},
 				{
-					Name:  "finalise",
-					Usage: "finalises an image (makes it ready)",
-					UsageText: `draupnir images finalise [id]
+					Name:         "annotate",
+					Usage:        "set or remove an instance's annotations",
+					BashComplete: completeInstanceIDs(logger),
+					UsageText: `draupnir instances annotate [id] [key=value | key-]...
 
-[id] the image ID to finalise`,
+Annotations given as key=value are set, and those given as key- are removed`,
 					Action: func(c *cli.Context) error {
-						var image models.Image
-						client := NewClient(c, logger)
-
-						if len(c.Args()) != 1 {
+						if c.NArg() < 2 {
 							cli.ShowCommandHelp(c, c.Command.Name)
 							logger.Fatal("Invalid command arguments")
 						}
 
-						imageID, err := strconv.Atoi(c.Args().First())
+						patch, err := parseAnnotations(c.Args().Tail())
 						if err != nil {
-							cli.ShowCommandHelp(c, c.Command.Name)
-							logger.With("error", err).Fatal("Invalid image ID")
+							logger.With("error", err).Fatal("Invalid annotations")
+						}
+
+						client := NewClient(c, logger)
+
+						instance, err := client.GetInstance(c.Args().First())
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch instance")
 						}
 
-						image, err = client.FinaliseImage(imageID)
+						instance, err = client.AnnotateInstance(instance, patch)
 						if err != nil {
-							logger.With("error", err).Fatal("Could not finalise image")
+							logger.With("error", err).Fatal("Could not annotate instance")
 						}
 
-						fmt.Println(ImageToString(image))
+						fmt.Println(AnnotationsToString(instance.Annotations))
 						return nil
 					},
 				},
 				{
-					Name:  "destroy",
-					Usage: "destroy an image",
+					Name:         "label",
+					Usage:        "set or remove an instance's labels",
+					BashComplete: completeInstanceIDs(logger),
+					UsageText: `draupnir instances label [id] [key=value | key-]...
+
+Labels given as key=value are set, and those given as key- are removed`,
 					Action: func(c *cli.Context) error {
-						id := c.Args().First()
-						if id == "" {
+						if c.NArg() < 2 {
 							cli.ShowCommandHelp(c, c.Command.Name)
-							logger.Fatal("Must supply an image id")
+							logger.Fatal("Invalid command arguments")
+						}
+
+						patch, err := parseLabels(c.Args().Tail())
+						if err != nil {
+							logger.With("error", err).Fatal("Invalid labels")
 						}
 
 						client := NewClient(c, logger)
 
-						image, err := client.GetImage(id)
+						instance, err := client.GetInstance(c.Args().First())
 						if err != nil {
-							logger.With("error", err).Fatal("Could not fetch image")
+							logger.With("error", err).Fatal("Could not fetch instance")
 						}
 
-						err = client.DestroyImage(image)
+						instance, err = client.LabelInstance(instance, patch)
 						if err != nil {
-							logger.With("error", err).Fatal("Could not destroy image")
+							logger.With("error", err).Fatal("Could not label instance")
 						}
 
-						logger.With("id", image.ID).Info("Destroyed image")
+						fmt.Println(AnnotationsToString(models.Annotations(instance.Labels)))
 						return nil
 					},
 				},
-			},
-		},
-		{
-			Name:  "env",
-			Usage: "show the environment variables to connect to an instance",
-			UsageText: `draupnir env [id]
+				{
+					Name:         "destroy",
+					Usage:        "destroy an instance, or all of yours",
+					BashComplete: completeInstanceIDs(logger),
+					UsageText: `draupnir instances destroy [id]
+   draupnir instances destroy --all-mine [--concurrency 8] [--dry-run]
+
+With --all-mine, every instance that belongs to you is destroyed, several at a
+time, and each is reported as it succeeds or fails. The command fails if any of
+them couldn't be destroyed.`,
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "all-mine", Usage: "destroy every instance that belongs to you"},
+						cli.IntFlag{Name: "concurrency", Value: 8, Usage: "how many instances to destroy at once, with --all-mine"},
+						cli.BoolFlag{Name: "dry-run", Usage: "list the instances that --all-mine would destroy without destroying them"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
 
-[id] the instance ID to connect to`,
-			Action: func(c *cli.Context) error {
-				id := c.Args().First()
-				if id == "" {
-					cli.ShowCommandHelp(c, c.Command.Name)
-					logger.Fatal("Must supply an instance id")
-				}
+						if c.Bool("all-mine") {
+							destroyAllMyInstances(c, client, logger)
+							return nil
+						}
 
-				client := NewClient(c, logger)
+						instance, err := client.GetInstance(instanceID(c, client, logger))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch instance")
+						}
 
-				instance, err := client.GetInstance(id)
-				if err != nil {
-					logger.With("error", err).Fatal("Could not fetch instance")
-				}
+						err = client.DestroyInstance(instance)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not destroy instance")
+						}
 
-				return setupClientEnvironment(loadConfig(logger), instance)
+						logger.With("id", instance.ID).Info("Destroyed instance")
+						return nil
+					},
+				},
 			},
 		},
 		{
-			Name:    "new",
-			Aliases: []string{},
-			Usage:   "create a new instance",
-			Action: func(c *cli.Context) error {
-				client := NewClient(c, logger)
+			Name:  "cleanup-tokens",
+			Usage: "hand out the destruction of instances, e.g. to a CI teardown step",
+			Subcommands: []cli.Command{
+				{
+					Name:  "create",
+					Usage: "create a token that destroys the given instances",
+					UsageText: `draupnir cleanup-tokens create [--valid-for 24h] <id>...
+
+Prints a token that destroys the instances when it's used, once, by anyone who
+holds it, with 'draupnir cleanup-tokens use'. Only your own instances can be
+given.`,
+					Flags: []cli.Flag{
+						cli.DurationFlag{Name: "valid-for", Value: 24 * time.Hour, Usage: "How long the token lasts, up to 168h"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
 
-				image, err := client.GetLatestImage()
-				if err != nil {
-					logger.With("error", err).Fatal("Could not fetch image")
-				}
+						if len(c.Args()) == 0 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply at least one instance id")
+						}
+						ids := make([]int, 0, len(c.Args()))
+						for _, arg := range c.Args() {
+							id, err := strconv.Atoi(arg)
+							if err != nil {
+								logger.With("id", arg).Fatal("Invalid instance id")
+							}
+							ids = append(ids, id)
+						}
 
-				instance, err := client.CreateInstance(image)
-				if err != nil {
-					logger.With("error", err).Fatal("Could not create instance")
+						token, err := client.CreateCleanupToken(ids, c.Duration("valid-for"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not create cleanup token")
+						}
+
+						printRecord(c, logger, token, func() {
+							fmt.Println(token.Token)
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "use",
+					Usage: "destroy the instances of a cleanup token",
+					UsageText: `draupnir cleanup-tokens use <token>
+
+The token can also be given in DRAUPNIR_CLEANUP_TOKEN. No credentials are needed
+other than the token, which can only be used once.`,
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						secret := c.Args().First()
+						if secret == "" {
+							secret = os.Getenv("DRAUPNIR_CLEANUP_TOKEN")
+						}
+						if secret == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply a cleanup token")
+						}
+
+						token, err := client.UseCleanupToken(secret)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not use cleanup token")
+						}
+
+						logger.With("destroyed", strings.Join(token.DestroyedInstanceIDs, ",")).Info("Destroyed instances")
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "instance-groups",
+			Usage: "create and destroy several instances together",
+			Subcommands: []cli.Command{
+				{
+					Name:  "create",
+					Usage: "create an instance from each of the given images",
+					UsageText: `draupnir instance-groups create [--image id...] [--family name...]
+
+An instance is created from each image, and from the latest ready image of each
+family. If any of them can't be created, none of them are. The instances share
+an expiry, and can be extended and destroyed together.`,
+					Flags: []cli.Flag{
+						cli.IntSliceFlag{Name: "image", Usage: "create an instance of this image (may be repeated)"},
+						cli.StringSliceFlag{Name: "family", Usage: "create an instance of this family's latest ready image (may be repeated)"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						if len(c.IntSlice("image"))+len(c.StringSlice("family")) == 0 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply at least one image or family")
+						}
+
+						group, err := client.CreateInstanceGroup(c.IntSlice("image"), c.StringSlice("family"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not create instance group")
+						}
+
+						printRecord(c, logger, group, func() {
+							fmt.Println(InstanceGroupToString(group))
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "list your instance groups",
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						groups, err := client.ListInstanceGroups()
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch instance groups")
+						}
+
+						printRecords(c, logger, groups, func() {
+							for _, group := range groups {
+								fmt.Println(InstanceGroupToString(group))
+							}
+						})
+						return nil
+					},
+				},
+				{
+					Name:      "get",
+					Usage:     "show an instance group and how to connect to its instances",
+					UsageText: "draupnir instance-groups get <id>",
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						group, err := client.GetInstanceGroup(instanceGroupID(c, logger))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch instance group")
+						}
+
+						printRecord(c, logger, group, func() {
+							fmt.Println(InstanceGroupToString(group))
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "extend",
+					Usage: "push back when every instance in a group expires",
+					UsageText: `draupnir instance-groups extend <id> --by 4h
+
+Every instance expires after the given duration from the group's current
+expiry, or from now if that's later`,
+					Flags: []cli.Flag{
+						cli.DurationFlag{Name: "by", Value: 24 * time.Hour, Usage: "How long to extend the group by, e.g. 4h"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						group, err := client.GetInstanceGroup(instanceGroupID(c, logger))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch instance group")
+						}
+
+						group, err = client.ExtendInstanceGroup(group, c.Duration("by"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not extend instance group")
+						}
+
+						printRecord(c, logger, group, func() {
+							fmt.Println(InstanceGroupToString(group))
+						})
+						return nil
+					},
+				},
+				{
+					Name:      "destroy",
+					Usage:     "destroy every instance in a group",
+					UsageText: "draupnir instance-groups destroy <id>",
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						group, err := client.GetInstanceGroup(instanceGroupID(c, logger))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch instance group")
+						}
+
+						if err := client.DestroyInstanceGroup(group); err != nil {
+							logger.With("error", err).Fatal("Could not destroy instance group")
+						}
+
+						logger.With("id", group.ID).Info("Destroyed instance group")
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "break-glass",
+			Usage: "grant and use time-boxed access to uploads that haven't been anonymised",
+			Subcommands: []cli.Command{
+				{
+					Name:  "grant",
+					Usage: "grant a user access to the upload of an image that isn't ready",
+					UsageText: `draupnir break-glass grant --user email --reason text [--valid-for 1h] <image id>
+
+The user can read any file of the image's upload with 'draupnir break-glass
+read' until the grant expires or is revoked, or the image is finalised. Every
+grant, and every file read with it, is recorded in the server's audit log. Only
+the upload user can grant access.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "user", Usage: "the email address of the user to grant access to"},
+						cli.StringFlag{Name: "reason", Usage: "why access is needed, e.g. a link to an incident"},
+						cli.DurationFlag{Name: "valid-for", Value: time.Hour, Usage: "How long the grant lasts, up to 8h"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						id, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an image id")
+						}
+						if c.String("user") == "" || c.String("reason") == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply a user and a reason")
+						}
+
+						grant, err := client.CreateBreakGlassGrant(c.String("user"), id, c.String("reason"), c.Duration("valid-for"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not grant break-glass access")
+						}
+
+						printRecord(c, logger, grant, func() {
+							fmt.Println(BreakGlassGrantToString(grant))
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "list every break-glass grant, including revoked and expired ones",
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						grants, err := client.ListBreakGlassGrants()
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch break-glass grants")
+						}
+
+						printRecords(c, logger, grants, func() {
+							for _, grant := range grants {
+								fmt.Println(BreakGlassGrantToString(grant))
+							}
+						})
+						return nil
+					},
+				},
+				{
+					Name:      "revoke",
+					Usage:     "revoke a break-glass grant before it expires",
+					UsageText: "draupnir break-glass revoke <id>",
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						id, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply a grant id")
+						}
+
+						grant, err := client.RevokeBreakGlassGrant(id)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not revoke break-glass grant")
+						}
+
+						logger.With("id", grant.ID).With("user", grant.UserEmail).Info("Revoked break-glass grant")
+						return nil
+					},
+				},
+				{
+					Name:         "read",
+					Usage:        "print a file from the upload of an image that you've been granted access to",
+					BashComplete: completeImageIDs(logger),
+					UsageText: `draupnir break-glass read <image id> <path>
+
+The path is relative to the root of the upload, e.g. global/pg_control. Reads
+are recorded in the server's audit log.`,
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid command arguments")
+						}
+
+						id, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an image id")
+						}
+
+						client := NewClient(c, logger)
+
+						file, err := client.GetImageUploadFile(id, c.Args().Get(1))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not read upload file")
+						}
+
+						fmt.Print(file.Content)
+						if file.Truncated {
+							logger.With("size", models.MaxImageFileSize).Warn("File was truncated")
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "access-requests",
+			Usage: "request, approve and deny time-boxed access to restricted image families",
+			Subcommands: []cli.Command{
+				{
+					Name:  "create",
+					Usage: "request access to a restricted image family",
+					UsageText: `draupnir access-requests create --reason text [--valid-for 8h] <family>
+
+The family's approvers are notified of the request. Once one of them approves
+it, you can create instances of the family until the access expires. Every
+request, and its approval or denial, is recorded in the server's audit log.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "reason", Usage: "why access is needed, e.g. a link to a ticket"},
+						cli.DurationFlag{Name: "valid-for", Value: 8 * time.Hour, Usage: "How long access lasts once it's approved, up to 168h"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						family := c.Args().First()
+						if family == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply a family")
+						}
+						if c.String("reason") == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply a reason")
+						}
+
+						request, err := client.CreateAccessRequest(family, c.String("reason"), c.Duration("valid-for"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not request access")
+						}
+
+						printRecord(c, logger, request, func() {
+							fmt.Println(AccessRequestToString(request))
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "list your access requests, and those that you can approve",
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						requests, err := client.ListAccessRequests()
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch access requests")
+						}
+
+						printRecords(c, logger, requests, func() {
+							for _, request := range requests {
+								fmt.Println(AccessRequestToString(request))
+							}
+						})
+						return nil
+					},
+				},
+				{
+					Name:      "approve",
+					Usage:     "approve a pending access request to a family that you're an approver of",
+					UsageText: "draupnir access-requests approve <id>",
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						id, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an access request id")
+						}
+
+						request, err := client.ApproveAccessRequest(id)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not approve access request")
+						}
+
+						approvedLogger := logger.With("id", request.ID).With("user", request.UserEmail)
+						if request.ExpiresAt != nil {
+							approvedLogger = approvedLogger.With("expires_at", request.ExpiresAt.Format(time.RFC3339))
+						}
+						approvedLogger.Info("Approved access request")
+						return nil
+					},
+				},
+				{
+					Name:      "deny",
+					Usage:     "deny a pending access request to a family that you're an approver of",
+					UsageText: "draupnir access-requests deny <id>",
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						id, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an access request id")
+						}
+
+						request, err := client.DenyAccessRequest(id)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not deny access request")
+						}
+
+						logger.With("id", request.ID).With("user", request.UserEmail).Info("Denied access request")
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "runbook",
+			Usage: "take on-call runbook actions against instances and operations",
+			Subcommands: []cli.Command{
+				{
+					Name:  "restart-instance",
+					Usage: "restart an instance's postgres, or start it if it has crashed",
+					UsageText: `draupnir runbook restart-instance --reason text [--confirm phrase] <instance id>
+
+Runbook actions must be confirmed by repeating the phrase that the server asks
+for, e.g. "restart instance 12". Run the command without --confirm to be told
+the phrase. Every action, and its reason, is recorded in the server's audit
+log. Only admins can take runbook actions.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "reason", Usage: "why the action is being taken, e.g. a link to an incident"},
+						cli.StringFlag{Name: "confirm", Usage: "the phrase that confirms the action"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						id, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an instance id")
+						}
+						if c.String("reason") == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply a reason")
+						}
+
+						instance, err := client.RestartInstance(id, c.String("reason"), c.String("confirm"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not restart instance")
+						}
+
+						logger.With("id", instance.ID).Info("Restarted instance")
+						return nil
+					},
+				},
+				{
+					Name:  "rotate-credentials",
+					Usage: "replace an instance's certificates, e.g. once its client key has leaked",
+					UsageText: `draupnir runbook rotate-credentials --reason text [--confirm phrase] <instance id>
+
+The instance's owner must fetch its credentials again to connect to it. The
+action is confirmed as 'draupnir runbook restart-instance' is.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "reason", Usage: "why the action is being taken, e.g. a link to an incident"},
+						cli.StringFlag{Name: "confirm", Usage: "the phrase that confirms the action"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						id, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an instance id")
+						}
+						if c.String("reason") == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply a reason")
+						}
+
+						instance, err := client.RotateInstanceCredentials(id, c.String("reason"), c.String("confirm"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not rotate instance credentials")
+						}
+
+						logger.With("id", instance.ID).Info("Rotated instance credentials")
+						return nil
+					},
+				},
+				{
+					Name:  "requeue-operation",
+					Usage: "run a failed finalisation or destroy again",
+					UsageText: `draupnir runbook requeue-operation --reason text [--confirm phrase] <operation id>
+
+Only the latest operation for its image or instance can be requeued, and
+finalisations that were interrupted can't be, as their upload may have been
+partially anonymised. The action is confirmed as 'draupnir runbook
+restart-instance' is. Follow the new operation with 'draupnir operations get
+--wait'.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{Name: "reason", Usage: "why the action is being taken, e.g. a link to an incident"},
+						cli.StringFlag{Name: "confirm", Usage: "the phrase that confirms the action"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						id, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an operation id")
+						}
+						if c.String("reason") == "" {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply a reason")
+						}
+
+						operation, err := client.RequeueOperation(id, c.String("reason"), c.String("confirm"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not requeue operation")
+						}
+
+						printRecord(c, logger, operation, func() {
+							fmt.Println(OperationToString(operation))
+						})
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "operations",
+			Usage: "follow finalisations and destroys that run in the background",
+			Subcommands: []cli.Command{
+				{
+					Name:  "get",
+					Usage: "show an operation's status",
+					UsageText: `draupnir operations get [--wait] <id>
+
+<id> the operation ID, as printed by images finalise --async
+
+With --wait, the operation is polled until it has succeeded or failed.`,
+					Flags: waitFlags,
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						id, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an operation id")
+						}
+
+						var operation models.Operation
+						if c.Bool("wait") {
+							ctx, cancel := waitContext(c)
+							defer cancel()
+							operation, err = client.WaitForOperation(ctx, id, clientPkg.DefaultWaitPolicy)
+						} else {
+							operation, err = client.GetOperation(id)
+						}
+						if err == context.DeadlineExceeded {
+							logger.With("id", id).Fatal("Timed out waiting for operation")
+						}
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch operation")
+						}
+
+						printRecord(c, logger, operation, func() {
+							fmt.Println(OperationToString(operation))
+						})
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:      "search",
+			Usage:     "find images and your instances by label, owner, annotation, shard name or ID",
+			ArgsUsage: "<query>",
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "limit", Usage: "the most results to show, or the server's default page size if 0"},
+			},
+			Action: func(c *cli.Context) error {
+				query := strings.Join(c.Args(), " ")
+				if strings.TrimSpace(query) == "" {
+					logger.Fatal("Usage: draupnir search [--limit n] <query>")
+				}
+
+				client := NewClient(c, logger)
+
+				results, err := client.Search(query, c.Int("limit"))
+				if err != nil {
+					logger.With("error", err).Fatal("Could not search")
+				}
+				printRecords(c, logger, results, func() {
+					for _, result := range results {
+						fmt.Println(SearchResultToString(result))
+					}
+				})
+				return nil
+			},
+		},
+		{
+			Name:    "images",
+			Aliases: []string{},
+			Usage:   "manage images",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list available images",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "ready",
+							Usage: "only list images that are ready",
+						},
+						cli.StringSliceFlag{
+							Name:  "label",
+							Usage: "only list images with this key=value label (may be repeated)",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						labels, err := parseLabelSelector(c.StringSlice("label"))
+						if err != nil {
+							logger.With("error", err).Fatal("Invalid labels")
+						}
+
+						client := NewClient(c, logger)
+
+						filter := clientPkg.Filter{Ready: c.Bool("ready"), Labels: labels}
+						images, err := client.ListImages(clientPkg.ListOptions{Filter: filter})
+
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch images")
+						}
+						printRecords(c, logger, images, func() {
+							for _, image := range images {
+								fmt.Println(ImageToString(image))
+							}
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "create",
+					Usage: "create a new image",
+					UsageText: `draupnir images create [--wait] [--shard name... | --worker name=host:port...] [--drop-database name...] [--rename-database old=new...] [backedUpAt] [anon.sql]
+
+[backedUpAt] an iso8601 timestamp defining when this backup was completed
+[anonyimse.sql] path to an anonymisation script that will be run on image finalisation`,
+					Flags: append(append([]cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "shard",
+							Usage: "create a sharded image, with an upload slot for this shard (may be repeated)",
+						},
+						cli.StringSliceFlag{
+							Name:  "worker",
+							Usage: "create a distributed image, with an upload slot for this worker, given as name=host:port where host:port is the worker's address in the coordinator's pg_dist_node (may be repeated)",
+						},
+					}, imageOptionFlags...), waitFlags...),
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						if len(c.Args()) != 2 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid command arguments")
+						}
+
+						backedUpAt, err := time.Parse(time.RFC3339, c.Args().Get(0))
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid backedUpAt timestamp")
+						}
+
+						request := createImageRequest(c, logger, backedUpAt, c.Args().Get(1))
+						request.Shards = c.StringSlice("shard")
+						if (request.BackupChecksum != "" || request.BackupLSN != "") && len(request.Shards) > 0 {
+							logger.Fatal("Sharded images can't be checked against a base backup")
+						}
+						if workers := c.StringSlice("worker"); len(workers) > 0 {
+							request.Workers = models.WorkerNodes{}
+							for _, worker := range workers {
+								parts := strings.SplitN(worker, "=", 2)
+								if len(parts) != 2 {
+									logger.With("worker", worker).Fatal("Workers must be given as name=host:port")
+								}
+								request.Workers[parts[0]] = parts[1]
+							}
+						}
+
+						image, err := client.CreateImageWithOptions(request)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not create image")
+						}
+
+						// The image is uploaded and finalised by something else, e.g. the
+						// pipeline's next step, which needs its ID
+						if c.Bool("wait") {
+							logger.With("id", image.ID).Info("Created image, waiting for it to be ready")
+
+							ctx, cancel := waitContext(c)
+							defer cancel()
+							image = waitForImage(ctx, client, logger, image.ID)
+						}
+
+						printRecord(c, logger, image, func() {
+							fmt.Println(ImageToString(image))
+						})
+						return nil
+					},
+				},
+				{
+					Name:         "verify",
+					Usage:        "check an image's snapshot against the checksum taken when it was finalised",
+					BashComplete: completeImageIDs(logger),
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+						id := imageID(c, client, logger)
+
+						verification, err := client.VerifyImage(id)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not verify image")
+						}
+
+						fmt.Printf(
+							"expected checksum: %s\nchecksum:          %s\nread only:         %t\n",
+							verification.ExpectedChecksum, verification.Checksum, verification.ReadOnly,
+						)
+						if !verification.Verified {
+							logger.With("id", id).Fatal("Image failed verification")
+						}
+
+						logger.With("id", id).Info("Image verified")
+						return nil
+					},
+				},
+				{
+					Name:         "timeline",
+					Usage:        "show when each phase of an image's finalisation started and finished",
+					BashComplete: completeImageIDs(logger),
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+						id := imageID(c, client, logger)
+
+						spans, err := client.GetImageTimeline(id)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not get image timeline")
+						}
+
+						printRecords(c, logger, spans, func() {
+							for _, span := range spans {
+								fmt.Println(BakeSpanToString(span))
+							}
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "freshness",
+					Usage: "show whether each image family has a recent enough ready image",
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						statuses, err := client.ListFreshness()
+						if err != nil {
+							logger.With("error", err).Fatal("Could not get image freshness")
+						}
+
+						printRecords(c, logger, statuses, func() {
+							for _, status := range statuses {
+								fmt.Println(FreshnessStatusToString(status))
+							}
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "stale",
+					Usage: "list the images that weren't anonymised with their family's current anonymisation spec",
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						images, err := client.ListStaleImages()
+						if err != nil {
+							logger.With("error", err).Fatal("Could not get stale images")
+						}
+
+						printRecords(c, logger, images, func() {
+							for _, image := range images {
+								fmt.Println(StaleImageToString(image))
+							}
+						})
+						return nil
+					},
+				},
+				{
+					Name:         "file",
+					Usage:        "print a file from a ready image, e.g. PG_VERSION or pg_hba.conf",
+					BashComplete: completeImageIDs(logger),
+					UsageText: fmt.Sprintf(`draupnir images file [id] [name]
+
+These files can be read: %s`, strings.Join(models.ImageFileNames, ", ")),
+					Action: func(c *cli.Context) error {
+						if len(c.Args()) != 2 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid command arguments")
+						}
+
+						id, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Must supply an image id")
+						}
+
+						client := NewClient(c, logger)
+
+						file, err := client.GetImageFile(id, c.Args().Get(1))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not get image file")
+						}
+
+						fmt.Print(file.Content)
+						if file.Truncated {
+							logger.With("size", models.MaxImageFileSize).Warn("File was truncated")
+						}
+						return nil
+					},
+				},
+				{
+					Name:         "send",
+					Usage:        "write a ready image as a btrfs send stream, to replicate it to another host",
+					BashComplete: completeImageIDs(logger),
+					UsageText: `draupnir images send [--parent id...] [--out path] [id]
+
+The stream is written to stdout, or to --out, for btrfs receive to recreate the
+image's snapshot from. Give the images that the receiving host already has as
+--parent, and if one of them is an earlier image of the same family, only the
+differences from it are sent. Only the upload user can send images.`,
+					Flags: []cli.Flag{
+						cli.IntSliceFlag{Name: "parent", Usage: "an image that the receiver already has (may be repeated)"},
+						cli.StringFlag{Name: "out", Usage: "write the stream to this file rather than stdout"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+						id := imageID(c, client, logger)
+
+						out := os.Stdout
+						if path := c.String("out"); path != "" {
+							file, err := os.Create(path)
+							if err != nil {
+								logger.With("error", err).Fatal("Could not create output file")
+							}
+							defer file.Close()
+							out = file
+						}
+
+						parentID, err := client.SendImage(context.Background(), id, c.IntSlice("parent"), out)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not send image")
+						}
+
+						if parentID != 0 {
+							logger.With("id", id).With("parent", parentID).Info("Sent the differences from the parent image")
+						} else {
+							logger.With("id", id).Info("Sent the whole image")
+						}
+						return nil
+					},
+				},
+				{
+					Name:         "manifest",
+					Usage:        "show the manifest signed when an image was finalised",
+					BashComplete: completeImageIDs(logger),
+					UsageText: `draupnir images manifest [--public-key path] [id]
+
+With --public-key, the manifest's signature is checked against the signer's
+PEM-encoded Ed25519 public key, and the command fails if it doesn't match.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "public-key",
+							Usage: "verify the manifest against this public key",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+						id := imageID(c, client, logger)
+
+						var imageManifest models.ImageManifest
+						if path := c.String("public-key"); path != "" {
+							key, err := manifest.LoadPublicKey(path)
+							if err != nil {
+								logger.With("error", err).Fatal("Could not load public key")
+							}
+
+							imageManifest, err = client.VerifyImageManifest(id, key)
+							if err != nil {
+								logger.With("error", err).Fatal("Could not verify image manifest")
+							}
+						} else {
+							imageManifest, err = client.GetImageManifest(id)
+							if err != nil {
+								logger.With("error", err).Fatal("Could not get image manifest")
+							}
+						}
+
+						fmt.Println(ImageManifestToString(imageManifest))
+						if c.String("public-key") != "" {
+							logger.With("id", id).Info("Image manifest verified")
+						}
+						return nil
+					},
+				},
+				{
+					Name:         "upload",
+					Usage:        "upload a tarball of an image's data directory",
+					BashComplete: completeImageIDs(logger),
+					UsageText: `draupnir images upload [--btrfs-stream] [id] [path]
+
+[id] the image ID to upload to
+[path] the tarball to upload, as created by pg_basebackup -Ft, or - for stdin
+
+Uploads that are interrupted can be resumed by running this again. Only the
+upload user can upload images.
+
+With --btrfs-stream, [path] is instead a btrfs send stream of a subvolume
+holding the data directory, e.g.
+
+    btrfs send /backups/latest | draupnir images upload --btrfs-stream 12 -
+
+which the server receives as it is, keeping its reflinks and compression. The
+stream must be of a whole subvolume, sent without -p, and can't be resumed.`,
+					Flags: []cli.Flag{
+						cli.BoolFlag{Name: "btrfs-stream", Usage: "upload a btrfs send stream rather than a tarball"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						if len(c.Args()) != 2 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid command arguments")
+						}
+
+						imageID, err := strconv.Atoi(c.Args().First())
+						if err != nil {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.With("error", err).Fatal("Invalid image ID")
+						}
+
+						// Stdin is usually a pipe, which can't seek, so its Seek method is
+						// hidden to stop uploads from trying to resume from it
+						var upload io.Reader = ioutil.NopCloser(os.Stdin)
+						if path := c.Args().Get(1); path != "-" {
+							file, err := os.Open(path)
+							if err != nil {
+								logger.With("error", err).Fatal("Could not open upload")
+							}
+							defer file.Close()
+							upload = file
+						}
+
+						if c.Bool("btrfs-stream") {
+							err = client.UploadImageStream(context.Background(), imageID, upload)
+						} else {
+							err = client.UploadImage(context.Background(), imageID, upload)
+						}
+						if err != nil {
+							logger.With("error", err).Fatal("Could not upload image")
+						}
+
+						logger.With("id", imageID).Info("Image uploaded")
+						return nil
+					},
+				},
+				{
+					Name:         "finalise",
+					Usage:        "finalises an image (makes it ready)",
+					BashComplete: completeImageIDs(logger),
+					UsageText: `draupnir images finalise [--wait | --async] [id]
+
+[id] the image ID to finalise
+
+The image is finalised before this returns. With --wait, if the request is cut
+off before the server responds, e.g. by a proxy's timeout, the image is polled
+until it's ready or its finalisation fails. With --async, the image is
+finalised in the background, and the operation that finalises it is printed
+for draupnir operations get to follow.`,
+					Flags: append([]cli.Flag{
+						cli.BoolFlag{Name: "async", Usage: "finalise the image in the background, printing the operation"},
+					}, waitFlags...),
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						if c.NArg() > 1 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid command arguments")
+						}
+
+						id := imageID(c, client, logger)
+						if c.Bool("async") {
+							operation, err := client.FinaliseImageAsync(id)
+							if err != nil {
+								logger.With("error", err).Fatal("Could not finalise image")
+							}
+
+							printRecord(c, logger, operation, func() {
+								fmt.Println(OperationToString(operation))
+							})
+							return nil
+						}
+
+						image, err := client.FinaliseImage(id)
+						if _, cutOff := err.(*url.Error); cutOff && c.Bool("wait") {
+							logger.With("error", err).Warn("Lost the finalisation request, waiting for the image to be ready")
+
+							ctx, cancel := waitContext(c)
+							defer cancel()
+							image, err = waitForImage(ctx, client, logger, id), nil
+						}
+						if err != nil {
+							logger.With("error", err).Fatal("Could not finalise image")
+						}
+
+						printRecord(c, logger, image, func() {
+							fmt.Println(ImageToString(image))
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "publish",
+					Usage: "create, upload and finalise an image from a base backup",
+					UsageText: `draupnir images publish [--backed-up-at time] [path] [anon.sql]
+
+[path] the base backup, as created by pg_basebackup -Ft: either base.tar or
+       the directory that contains it
+[anon.sql] path to an anonymisation script that will be run on image finalisation
+
+Waits for the image to be ready. If the upload or finalisation fails, the image
+is left behind, and can be completed with images upload and images finalise.`,
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "backed-up-at",
+							Usage: "an iso8601 timestamp of when the backup was completed (default: the tarball's modification time)",
+						},
+						cli.DurationFlag{
+							Name:  "wait-timeout",
+							Value: time.Hour,
+							Usage: "fail if waiting takes longer than this",
+						},
+					}, imageOptionFlags...),
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						if len(c.Args()) != 2 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid command arguments")
+						}
+
+						file, err := openBaseBackup(c.Args().Get(0))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not open base backup")
+						}
+						defer file.Close()
+
+						backedUpAt := time.Now()
+						if info, err := file.Stat(); err == nil {
+							backedUpAt = info.ModTime()
+						}
+						if c.String("backed-up-at") != "" {
+							backedUpAt, err = time.Parse(time.RFC3339, c.String("backed-up-at"))
+							if err != nil {
+								cli.ShowCommandHelp(c, c.Command.Name)
+								logger.Fatal("Invalid backed-up-at timestamp")
+							}
+						}
+
+						request := createImageRequest(c, logger, backedUpAt, c.Args().Get(1))
+
+						ctx, cancel := waitContext(c)
+						defer cancel()
+
+						image, err := client.PublishImage(ctx, request, file, clientPkg.DefaultWaitPolicy)
+						if err != nil && image.ID != 0 {
+							logger.With("id", image.ID).With("error", err).With("path", file.Name()).Fatal(
+								"Could not publish image, resume with images upload and images finalise --wait",
+							)
+						}
+						if err != nil {
+							logger.With("error", err).Fatal("Could not create image")
+						}
+
+						printRecord(c, logger, image, func() {
+							fmt.Println(ImageToString(image))
+						})
+						return nil
+					},
+				},
+				{
+					Name:         "annotate",
+					Usage:        "set or remove an image's annotations",
+					BashComplete: completeImageIDs(logger),
+					UsageText: `draupnir images annotate [id] [key=value | key-]...
+
+Annotations given as key=value are set, and those given as key- are removed`,
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 2 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid command arguments")
+						}
+
+						patch, err := parseAnnotations(c.Args().Tail())
+						if err != nil {
+							logger.With("error", err).Fatal("Invalid annotations")
+						}
+
+						client := NewClient(c, logger)
+
+						image, err := client.GetImage(c.Args().First())
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch image")
+						}
+
+						image, err = client.AnnotateImage(image, patch)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not annotate image")
+						}
+
+						fmt.Println(AnnotationsToString(image.Annotations))
+						return nil
+					},
+				},
+				{
+					Name:         "label",
+					Usage:        "set or remove an image's labels",
+					BashComplete: completeImageIDs(logger),
+					UsageText: `draupnir images label [id] [key=value | key-]...
+
+Labels given as key=value are set, and those given as key- are removed`,
+					Action: func(c *cli.Context) error {
+						if c.NArg() < 2 {
+							cli.ShowCommandHelp(c, c.Command.Name)
+							logger.Fatal("Invalid command arguments")
+						}
+
+						patch, err := parseLabels(c.Args().Tail())
+						if err != nil {
+							logger.With("error", err).Fatal("Invalid labels")
+						}
+
+						client := NewClient(c, logger)
+
+						image, err := client.GetImage(c.Args().First())
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch image")
+						}
+
+						image, err = client.LabelImage(image, patch)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not label image")
+						}
+
+						fmt.Println(AnnotationsToString(models.Annotations(image.Labels)))
+						return nil
+					},
+				},
+				{
+					Name:         "destroy",
+					Usage:        "destroy an image",
+					BashComplete: completeImageIDs(logger),
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						image, err := client.GetImage(strconv.Itoa(imageID(c, client, logger)))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not fetch image")
+						}
+
+						err = client.DestroyImage(image)
+						if err != nil {
+							logger.With("error", err).Fatal("Could not destroy image")
+						}
+
+						logger.With("id", image.ID).Info("Destroyed image")
+						return nil
+					},
+				},
+				{
+					Name:  "prune",
+					Usage: "destroy old images that have no instances",
+					UsageText: `draupnir images prune [--older-than 720h] [--keep-last 5] [--dry-run]
+
+Images backed up longer ago than --older-than, that aren't among the newest
+--keep-last ready images, are destroyed. At least one of them must be given.
+Images that are pinned or still have instances are skipped, and the newest
+ready image of each family is always kept. Only the upload user can prune
+images.`,
+					Flags: []cli.Flag{
+						cli.DurationFlag{Name: "older-than", Usage: "Prune images backed up longer ago than this, e.g. 720h"},
+						cli.IntFlag{Name: "keep-last", Usage: "Keep this many of the newest ready images"},
+						cli.BoolFlag{Name: "dry-run", Usage: "List the images that would be pruned without destroying them"},
+					},
+					Action: func(c *cli.Context) error {
+						client := NewClient(c, logger)
+
+						images, err := client.PruneImages(c.Duration("older-than"), c.Int("keep-last"), c.Bool("dry-run"))
+						if err != nil {
+							logger.With("error", err).Fatal("Could not prune images")
+						}
+
+						if c.Bool("dry-run") {
+							logger.With("count", len(images)).Info("Would prune images")
+						} else {
+							logger.With("count", len(images)).Info("Pruned images")
+						}
+						printRecords(c, logger, images, func() {
+							for _, image := range images {
+								fmt.Println(ImageToString(image))
+							}
+						})
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "server-version",
+			Usage: "show the server's version and the features it supports",
+			Action: func(c *cli.Context) error {
+				client := NewClient(c, logger)
+
+				serverVersion, err := client.ServerVersion()
+				if err != nil {
+					logger.With("error", err).Fatal("Could not get server version")
+				}
+
+				fmt.Printf("client:   %s\n", version.Version)
+				fmt.Printf("server:   %s\n", serverVersion.ID)
+				fmt.Printf("features: %s\n", strings.Join(serverVersion.Features, ", "))
+				return nil
+			},
+		},
+		{
+			Name:  "doctor",
+			Usage: "check that the client can reach the server and authenticate, and how to fix it if it can't",
+			UsageText: `draupnir doctor [--ssh-key path]
+
+Checks that the server can be reached, that it accepts your token, and that
+this client's version is compatible with it. With --ssh-key, also checks that
+the key can authenticate to the host that images are uploaded to with scp.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "ssh-key",
+					Usage: "the key that you upload images with",
+				},
+				cli.StringFlag{
+					Name:  "ssh-user",
+					Value: "upload",
+					Usage: "the user that you upload images as",
+				},
+				cli.StringFlag{
+					Name:  "ssh-host",
+					Usage: "the host that you upload images to, if it isn't the server's",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg := loadConfig(logger)
+
+				d := doctor.Doctor{
+					ClientVersion: version.Version,
+					Authenticated: cfg.Token.RefreshToken != "" || cfg.KeyFile != "",
+				}
+				if cfg.Domain != "" && cfg.Domain != config.PlaceholderDomain {
+					d.ServerURL = getServerURL(c, cfg)
+				}
+
+				// The client can't be created with a key file that can't be read
+				if cfg.KeyFile != "" {
+					if _, err := clientPkg.ReadServiceAccountKey(cfg.KeyFile); err != nil {
+						d.CredentialsErr = err
+						cfg.KeyFile = ""
+					}
+				}
+				d.Client = NewClientWithConfig(c, cfg, logger)
+
+				if key := c.String("ssh-key"); key != "" {
+					host := c.String("ssh-host")
+					if host == "" {
+						host = uploadHost(cfg.Domain)
+					}
+					d.SSH = &doctor.SSHTarget{User: c.String("ssh-user"), Host: host, KeyFile: key}
+				}
+
+				results := d.Run(context.Background())
+				for _, result := range results {
+					fmt.Printf("[%-4s] %s: %s\n", result.Status, result.Check, result.Detail)
+					if result.Fix != "" {
+						fmt.Printf("       %s\n", result.Fix)
+					}
+				}
+
+				if doctor.AnyFailed(results) {
+					os.Exit(1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:         "env",
+			Usage:        "show the environment variables to connect to an instance",
+			BashComplete: completeInstanceIDs(logger),
+			UsageText: `draupnir env [--shell sh|fish|json] [id]
+
+[id] the instance ID to connect to
+
+Use it with eval $(draupnir env [id]) in sh, or
+draupnir env --shell fish [id] | source in fish`,
+			Flags: []cli.Flag{shellFlag},
+			Action: func(c *cli.Context) error {
+				if err := checkShell(c.String("shell")); err != nil {
+					logger.Fatal(err)
+				}
+
+				client := NewClient(c, logger)
+
+				instance, err := client.GetInstance(instanceID(c, client, logger))
+				if err != nil {
+					logger.With("error", err).Fatal("Could not fetch instance")
+				}
+
+				return setupClientEnvironment(loadConfig(logger), instance, c.String("shell"))
+			},
+		},
+		{
+			Name:         "connect",
+			Usage:        "connect to an instance with psql",
+			BashComplete: completeConnect(logger),
+			UsageText: `draupnir connect [id] [psql arguments]...
+   draupnir connect --latest-image [psql arguments]...
+
+[id] the instance ID to connect to
+
+With --latest-image, connects to your most recent instance of the latest ready
+image, creating one if you don't have any. Arguments after the instance are
+passed to psql, e.g. draupnir connect 42 -- -c 'SELECT 1'`,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "latest-image",
+					Usage: "connect to an instance of the latest image",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				client := NewClient(c, logger)
+
+				var instance models.Instance
+				args := c.Args()
+				if c.Bool("latest-image") {
+					instance, err = latestImageInstance(client, logger)
+					if err != nil {
+						logger.With("error", err).Fatal("Could not find an instance")
+					}
+				} else {
+					if args.First() == "" && !picker.Interactive() {
+						cli.ShowCommandHelp(c, c.Command.Name)
+						logger.Fatal("Must supply an instance id or --latest-image")
+					}
+
+					instance, err = client.GetInstance(instanceID(c, client, logger))
+					if err != nil {
+						logger.With("error", err).Fatal("Could not fetch instance")
+					}
+					args = args.Tail()
+				}
+
+				if len(args) > 0 && args[0] == "--" {
+					args = args[1:]
+				}
+
+				err = connectInstance(loadConfig(logger), client, instance, args)
+				logger.With("error", err).Fatal("Could not connect to instance")
+				return nil
+			},
+		},
+		{
+			Name:         "logs",
+			Usage:        "print the end of an instance's Postgres server log",
+			BashComplete: completeInstanceIDs(logger),
+			UsageText: `draupnir logs [--lines n] [--follow] [id]
+
+[id] the instance ID whose log to print
+
+With --follow, lines are printed as they're added to the log, until
+interrupted.`,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "lines, n",
+					Value: 100,
+					Usage: "how many lines from the end of the log to print",
+				},
+				cli.BoolFlag{
+					Name:  "follow, f",
+					Usage: "keep printing lines as they're added to the log",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				client := NewClient(c, logger)
+
+				id, err := strconv.Atoi(instanceID(c, client, logger))
+				if err != nil {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					logger.Fatal("Must supply an instance id")
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				interrupts := make(chan os.Signal, 1)
+				signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+				go func() {
+					<-interrupts
+					cancel()
+				}()
+
+				err = client.StreamInstanceLog(ctx, id, c.Int("lines"), c.Bool("follow"), os.Stdout)
+				if err != nil {
+					logger.With("error", err).Fatal("Could not fetch instance log")
+				}
+				return nil
+			},
+		},
+		{
+			Name:         "tunnel",
+			Usage:        "forward a local port to an instance, for when its port can't be reached directly",
+			BashComplete: completeInstanceIDs(logger),
+			UsageText: `draupnir tunnel [--local-port port] [--via proxy|ssh] [id]
+
+[id] the instance ID to forward to
+
+Forwards connections to the local port until interrupted. With --via proxy,
+the default, connections go through the server's proxy over HTTPS. With
+--via ssh, they go through an SSH tunnel to the server's host, which you must
+be able to log in to.`,
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "local-port",
+					Usage: "the local port to listen on, or 0 for any free port",
+				},
+				cli.StringFlag{
+					Name:  "via",
+					Value: "proxy",
+					Usage: "how to reach the instance: proxy or ssh",
+				},
+				cli.StringFlag{
+					Name:  "ssh-user",
+					Usage: "the user to log in to the server's host as with --via ssh",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				cfg := loadConfig(logger)
+				client := NewClientWithConfig(c, cfg, logger)
+
+				instance, err := client.GetInstance(instanceID(c, client, logger))
+				if err != nil {
+					logger.With("error", err).Fatal("Could not fetch instance")
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				interrupts := make(chan os.Signal, 1)
+				signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+				go func() {
+					<-interrupts
+					cancel()
+				}()
+
+				switch c.String("via") {
+				case "proxy":
+					err = tunnelThroughProxy(ctx, cfg, client, instance, c.Int("local-port"), logger)
+				case "ssh":
+					err = tunnelThroughSSH(ctx, cfg, instance, c.Int("local-port"), c.String("ssh-user"), logger)
+				default:
+					logger.Fatal("--via must be proxy or ssh")
+				}
+				if err != nil {
+					logger.With("error", err).Fatal("Could not tunnel to instance")
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "completion",
+			Usage: "print a script that completes commands, and instance and image IDs, in your shell",
+			UsageText: `draupnir completion bash|zsh|fish
+
+Load it with source <(draupnir completion bash) in bash,
+source <(draupnir completion zsh) in zsh, or
+draupnir completion fish | source in fish`,
+			BashComplete: func(c *cli.Context) {
+				if c.NArg() == 0 {
+					fmt.Println(strings.Join(completion.Shells, "\n"))
+				}
+			},
+			Action: func(c *cli.Context) error {
+				script, err := completion.Script(c.Args().First(), app.Name)
+				if err != nil {
+					cli.ShowCommandHelp(c, c.Command.Name)
+					logger.Fatal(err)
+				}
+
+				fmt.Print(script)
+				return nil
+			},
+		},
+		{
+			Name:    "new",
+			Aliases: []string{},
+			Usage:   "create a new instance",
+			Flags:   []cli.Flag{shellFlag},
+			Action: func(c *cli.Context) error {
+				if err := checkShell(c.String("shell")); err != nil {
+					logger.Fatal(err)
+				}
+
+				client := NewClient(c, logger)
+
+				image, err := client.GetLatestImage()
+				if err != nil {
+					logger.With("error", err).Fatal("Could not fetch image")
+				}
+
+				instance, err := client.CreateInstance(image)
+				if err != nil {
+					logger.With("error", err).Fatal("Could not create instance")
 				}
 
-				return setupClientEnvironment(loadConfig(logger), instance)
-			},
-		},
+				return setupClientEnvironment(loadConfig(logger), instance, c.String("shell"))
+			},
+		},
+	}
+
+	app.Run(os.Args)
+}
+
+// connection is how to connect to an instance with libpq, once its credentials
+// have been written to disk
+type connection struct {
+	Instance models.Instance
+	Database string
+	Paths    models.CredentialPaths
+}
+
+// Environment returns the environment variables that libpq reads:
+// https://www.postgresql.org/docs/current/libpq-envars.html
+func (c connection) Environment() []string {
+	return []string{
+		"PGHOST=" + c.Instance.Hostname,
+		fmt.Sprintf("PGPORT=%d", c.Instance.Port),
+		"PGUSER=draupnir",
+		"PGPASSWORD=",
+		"PGDATABASE=" + c.Database,
+		"PGSSLMODE=verify-ca",
+		"PGSSLROOTCERT=" + c.Paths.CACertificate,
+		"PGSSLCERT=" + c.Paths.ClientCertificate,
+		"PGSSLKEY=" + c.Paths.ClientKey,
+	}
+}
+
+func prepareConnection(config config.Config, instance models.Instance) (connection, error) {
+	if instance.ProxyRequired {
+		return connection{}, errors.New("instances of regulated images can only be connected to with draupnir connect or draupnir tunnel --via proxy")
+	}
+	if instance.Credentials == nil {
+		return connection{}, errors.New("database credentials are not available")
+	}
+
+	// We use an OS-defined private temporary directory for storing the
+	// certficates and keys, rather than creating a directory such as:
+	// `~/.draupnir.d/$INSTANCE_ID/`.
+	// The advantage of this is that we do not have to write custom logic to
+	// clean-up old key data, instead we can rely on the OS to do this for us.
+	// On MacOS, where this client will be primarily run, the temp files are
+	// cleaned up if they have not been accessed in 3 days, which is perfect for
+	// this use case: https://superuser.com/a/187105
+	dir, err := ioutil.TempDir("", fmt.Sprintf("draupnir-%d-", instance.ID))
+	if err != nil {
+		return connection{}, errors.Wrap(err, "failed to create temporary directory")
+	}
+
+	paths, err := clientPkg.WriteInstanceCredentials(instance, dir)
+	if err != nil {
+		return connection{}, err
+	}
+
+	return connection{Instance: instance, Database: connectionDatabase(config), Paths: paths}, nil
+}
+
+// connectionDatabase is the database to connect to, which is taken from the
+// config, then the environment, and is otherwise 'postgres'
+func connectionDatabase(config config.Config) string {
+	if config.Database != "" {
+		return config.Database
+	}
+	if database := os.Getenv("PGDATABASE"); database != "" {
+		return database
+	}
+	return "postgres"
+}
+
+// shells are the formats that setupClientEnvironment can print environment
+// variables in
+var shells = []string{"sh", "fish", "json"}
+
+var shellFlag = cli.StringFlag{
+	Name:  "shell",
+	Value: "sh",
+	Usage: fmt.Sprintf("print the environment variables for this shell (%s)", strings.Join(shells, ", ")),
+}
+
+// imageOptionFlags are the options that images are created with, other than
+// their shards, which can only be given to images create
+var imageOptionFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "backup-checksum",
+		Usage: "check the upload against this checksum of the base backup before finalising it",
+	},
+	cli.StringFlag{
+		Name:  "backup-lsn",
+		Usage: "check the upload's backup_label against this start LSN before finalising it",
+	},
+	cli.StringSliceFlag{
+		Name:  "drop-database",
+		Usage: "drop this database before anonymisation (may be repeated)",
+	},
+	cli.StringSliceFlag{
+		Name:  "rename-database",
+		Usage: "rename a database after anonymisation, given as old=new (may be repeated)",
+	},
+	cli.StringFlag{
+		Name:  "encoding",
+		Usage: "convert every database to this encoding when finalising, e.g. UTF8",
+	},
+	cli.StringFlag{
+		Name:  "locale",
+		Usage: "convert every database to this locale when finalising, e.g. en_GB.UTF-8",
+	},
+}
+
+// createImageRequest builds the request to create an image from the command's
+// imageOptionFlags, exiting if the anonymisation script can't be read
+func createImageRequest(c *cli.Context, logger log.Logger, backedUpAt time.Time, anonPath string) routes.CreateImageRequest {
+	anon, err := ioutil.ReadFile(anonPath)
+	if err != nil {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		logger.Fatal("Invalid anon script")
+	}
+
+	request := routes.CreateImageRequest{
+		BackedUpAt:     backedUpAt,
+		Anon:           string(anon),
+		BackupChecksum: c.String("backup-checksum"),
+		BackupLSN:      c.String("backup-lsn"),
+		DropDatabases:  c.StringSlice("drop-database"),
+		Encoding:       c.String("encoding"),
+		Locale:         c.String("locale"),
+	}
+
+	if renames := c.StringSlice("rename-database"); len(renames) > 0 {
+		request.RenameDatabases = models.DatabaseRenames{}
+		for _, rename := range renames {
+			parts := strings.SplitN(rename, "=", 2)
+			if len(parts) != 2 {
+				logger.With("rename", rename).Fatal("Database renames must be given as old=new")
+			}
+			request.RenameDatabases[parts[0]] = parts[1]
+		}
+	}
+
+	return request
+}
+
+// openBaseBackup opens the tarball of a base backup, given either the tarball
+// or the directory that pg_basebackup -Ft wrote it to. Plain data directories
+// can't be uploaded, so they're rejected.
+func openBaseBackup(path string) (*os.File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		tarball := filepath.Join(path, "base.tar")
+		if _, err := os.Stat(tarball); err != nil {
+			return nil, fmt.Errorf("%s has no base.tar, take the backup with pg_basebackup -Ft", path)
+		}
+		path = tarball
+	}
+
+	return os.Open(path)
+}
+
+// waitFlags let commands wait for the images and instances that they create or
+// finalise to be usable, so that CI pipelines needn't poll for them
+var waitFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "wait",
+		Usage: "wait until the image is ready, or the instance accepts connections",
+	},
+	cli.DurationFlag{
+		Name:  "wait-timeout",
+		Value: time.Hour,
+		Usage: "fail if waiting takes longer than this",
+	},
+}
+
+// waitContext returns the context within which a command waits, which ends
+// after --wait-timeout
+func waitContext(c *cli.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.Duration("wait-timeout"))
+}
+
+// waitForImage waits for the image to be ready, exiting if its finalisation
+// fails or the context ends first
+func waitForImage(ctx context.Context, client clientPkg.Client, logger log.Logger, id int) models.Image {
+	image, err := client.WaitForImageFinalised(ctx, id, clientPkg.DefaultWaitPolicy)
+	if err == context.DeadlineExceeded {
+		logger.With("id", id).Fatal("Timed out waiting for image to be ready")
+	}
+	if err != nil {
+		logger.With("id", id).With("error", err).Fatal("Image did not become ready")
+	}
+	return image
+}
+
+// checkShell returns an error if setupClientEnvironment can't print
+// environment variables for the shell, so that commands can fail before they
+// create anything
+func checkShell(shell string) error {
+	for _, s := range shells {
+		if s == shell {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown shell %q, must be one of %s", shell, strings.Join(shells, ", "))
+}
+
+func setupClientEnvironment(config config.Config, instance models.Instance, shell string) error {
+	conn, err := prepareConnection(config, instance)
+	if err != nil {
+		return err
+	}
+
+	formatted, err := formatEnvironment(conn.Environment(), shell)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(formatted)
+	return nil
+}
+
+// formatEnvironment formats NAME=value environment variables as commands that
+// set them in the given shell, or as a JSON object
+func formatEnvironment(env []string, shell string) (string, error) {
+	names := make([]string, 0, len(env))
+	values := make(map[string]string, len(env))
+	for _, variable := range env {
+		parts := strings.SplitN(variable, "=", 2)
+		names = append(names, parts[0])
+		values[parts[0]] = parts[1]
+	}
+
+	switch shell {
+	case "sh":
+		assignments := make([]string, 0, len(names))
+		for _, name := range names {
+			assignments = append(assignments, name+"="+shellQuote(values[name]))
+		}
+		return "export " + strings.Join(assignments, " "), nil
+	case "fish":
+		commands := make([]string, 0, len(names))
+		for _, name := range names {
+			commands = append(commands, fmt.Sprintf("set -gx %s %s;", name, shellQuote(values[name])))
+		}
+		return strings.Join(commands, "\n"), nil
+	case "json":
+		encoded, err := json.MarshalIndent(values, "", "  ")
+		return string(encoded), err
+	default:
+		return "", checkShell(shell)
+	}
+}
+
+// shellQuote single quotes a value, so that it's taken literally by sh and fish
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// connectInstance replaces this process with psql, connected to the instance.
+// args are passed on to psql.
+func connectInstance(config config.Config, client clientPkg.DraupnirClient, instance models.Instance, args []string) error {
+	psql, err := exec.LookPath("psql")
+	if err != nil {
+		return errors.Wrap(err, "psql must be installed to connect")
 	}
 
-	app.Run(os.Args)
+	if instance.ProxyRequired {
+		return connectThroughProxy(config, client, instance, psql, args)
+	}
+
+	conn, err := prepareConnection(config, instance)
+	if err != nil {
+		return err
+	}
+
+	env := append(os.Environ(), conn.Environment()...)
+	return syscall.Exec(psql, append([]string{"psql"}, args...), env)
 }
 
-func setupClientEnvironment(config config.Config, instance models.Instance) error {
-	if instance.Credentials == nil {
-		return errors.New("database credentials are not available")
+// connectThroughProxy runs psql connected to the instance through the server's
+// proxy, which records the session, and exits with psql's status once it's
+// done. psql connects to a local relay, as it can't speak to the proxy itself,
+// so this process has to outlive it rather than be replaced by it.
+func connectThroughProxy(config config.Config, client clientPkg.DraupnirClient, instance models.Instance, psql string, args []string) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return errors.Wrap(err, "failed to listen for psql's connections")
 	}
 
-	// We use an OS-defined private temporary directory for storing the
-	// certficates and keys, rather than creating a directory such as:
-	// `~/.draupnir.d/$INSTANCE_ID/`.
-	// The advantage of this is that we do not have to write custom logic to
-	// clean-up old key data, instead we can rely on the OS to do this for us.
-	// On MacOS, where this client will be primarily run, the temp files are
-	// cleaned up if they have not been accessed in 3 days, which is perfect for
-	// this use case: https://superuser.com/a/187105
-	dir, err := ioutil.TempDir("", fmt.Sprintf("draupnir-%d-", instance.ID))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proxy := clientPkg.InstanceProxy{
+		Client:     client,
+		InstanceID: instance.ID,
+		OnError: func(err error) {
+			fmt.Fprintf(os.Stderr, "draupnir: could not connect through the proxy: %s\n", err)
+		},
+	}
+	go proxy.Serve(ctx, listener)
+
+	cmd := exec.Command(psql, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(),
+		"PGHOST=127.0.0.1",
+		fmt.Sprintf("PGPORT=%d", listener.Addr().(*net.TCPAddr).Port),
+		"PGUSER=draupnir",
+		"PGPASSWORD=",
+		"PGDATABASE="+connectionDatabase(config),
+		// The relay's connection to the server is already encrypted
+		"PGSSLMODE=disable",
+	)
+
+	// psql cancels its query when interrupted, which mustn't stop the relay
+	signal.Ignore(os.Interrupt)
+
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to run psql")
+	}
+	os.Exit(0)
+	return nil
+}
+
+// tunnelThroughProxy relays connections to the local port to the instance
+// through the server's proxy, until the context is done. Like connect, this
+// works for instances of regulated images, and for servers whose instance
+// ports are firewalled, as it only needs the API to be reachable.
+func tunnelThroughProxy(ctx context.Context, config config.Config, client clientPkg.DraupnirClient, instance models.Instance, localPort int, logger log.Logger) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
 	if err != nil {
-		return errors.Wrap(err, "failed to create temporary directory")
+		return errors.Wrap(err, "failed to listen for connections")
+	}
+
+	proxy := clientPkg.InstanceProxy{
+		Client:     client,
+		InstanceID: instance.ID,
+		OnError: func(err error) {
+			logger.With("error", err).Warn("Could not connect through the proxy")
+		},
+	}
+
+	// The proxy encrypts and authenticates the connection to the instance, so
+	// clients connect without SSL or credentials
+	dsn := url.URL{
+		Scheme:   "postgresql",
+		User:     url.User("draupnir"),
+		Host:     listener.Addr().String(),
+		Path:     "/" + connectionDatabase(config),
+		RawQuery: "sslmode=disable",
 	}
+	logger.With("instance", instance.ID).With("address", listener.Addr().String()).Info("Tunnelling through the proxy. Press Ctrl-C to stop.")
+	fmt.Println(dsn.String())
 
-	caCertPath := filepath.Join(dir, "ca.crt")
-	clientCertPath := filepath.Join(dir, "client.crt")
-	clientKeyPath := filepath.Join(dir, "client.key")
+	return proxy.Serve(ctx, listener)
+}
 
-	if err := ioutil.WriteFile(caCertPath, []byte(instance.Credentials.CACertificate), 0644); err != nil {
-		return errors.Wrapf(err, "failed to write content for %s", caCertPath)
+// tunnelThroughSSH forwards the local port to the instance through an SSH
+// tunnel to the server's host, until the context is done. Clients connect with
+// the instance's credentials, as they would directly.
+func tunnelThroughSSH(ctx context.Context, config config.Config, instance models.Instance, localPort int, user string, logger log.Logger) error {
+	ssh, err := exec.LookPath("ssh")
+	if err != nil {
+		return errors.Wrap(err, "ssh must be installed to tunnel with it")
 	}
-	if err := ioutil.WriteFile(clientCertPath, []byte(instance.Credentials.ClientCertificate), 0644); err != nil {
-		return errors.Wrapf(err, "failed to write content for %s", clientCertPath)
+
+	conn, err := prepareConnection(config, instance)
+	if err != nil {
+		return err
 	}
-	if err := ioutil.WriteFile(clientKeyPath, []byte(instance.Credentials.ClientKey), 0600); err != nil {
-		return errors.Wrapf(err, "failed to write content for %s", clientKeyPath)
+
+	// ssh can't pick a free port and tell us which it picked, so we find one
+	if localPort == 0 {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return errors.Wrap(err, "failed to find a free port")
+		}
+		localPort = listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
 	}
 
-	// The database precedence is config -> environment variable -> 'postgres'
-	database := config.Database
-	if database == "" {
-		database = os.Getenv("PGDATABASE")
+	// Instances with their own address listen on it, and the rest listen on
+	// every address of the server's host
+	target := "127.0.0.1"
+	if instance.Address != "" {
+		target = instance.Address
 	}
-	if database == "" {
-		database = "postgres"
+
+	host := uploadHost(config.Domain)
+	if user != "" {
+		host = user + "@" + host
 	}
 
-	// Output enviroment variables that can be read by libpq:
-	// https://www.postgresql.org/docs/current/libpq-envars.html
-	fmt.Printf(
-		"export PGHOST=%s PGPORT=%d PGUSER=draupnir PGPASSWORD='' PGDATABASE=%s PGSSLMODE=verify-ca PGSSLROOTCERT='%s' PGSSLCERT='%s' PGSSLKEY='%s'\n",
-		instance.Hostname,
-		instance.Port,
-		database,
-		caCertPath,
-		clientCertPath,
-		clientKeyPath,
+	cmd := exec.CommandContext(ctx, ssh,
+		"-N",
+		"-o", "ExitOnForwardFailure=yes",
+		"-L", fmt.Sprintf("127.0.0.1:%d:%s", localPort, net.JoinHostPort(target, strconv.Itoa(int(instance.Port)))),
+		host,
 	)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+
+	// The instance's certificate is verified against its CA, not its hostname,
+	// so it's still verified through the tunnel
+	local := conn.Instance
+	local.Hostname = "127.0.0.1"
+	local.Port = uint16(localPort)
+	logger.With("instance", instance.ID).With("address", fmt.Sprintf("127.0.0.1:%d", localPort)).Info("Tunnelling through SSH. Press Ctrl-C to stop.")
+	fmt.Println(local.DSN(conn.Database, conn.Paths))
+
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return errors.Wrap(err, "ssh failed")
+}
 
-	return nil
+// uploadHost is the host that images are uploaded to with scp, which is the
+// server's, without the path that it may be served from
+func uploadHost(domain string) string {
+	host := strings.SplitN(domain, "/", 2)[0]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// latestImageInstance returns your most recent instance of the latest ready
+// image, creating one if you don't have any
+func latestImageInstance(client clientPkg.DraupnirClient, logger log.Logger) (models.Instance, error) {
+	image, err := client.GetLatestImage()
+	if err != nil {
+		return models.Instance{}, errors.Wrap(err, "could not fetch latest image")
+	}
+
+	filter := clientPkg.Filter{ImageID: image.ID, User: "me"}
+	instances, err := client.ListInstances(clientPkg.ListOptions{Filter: filter})
+	if err != nil {
+		return models.Instance{}, errors.Wrap(err, "could not fetch instances")
+	}
+
+	var latest *models.Instance
+	for i := range instances {
+		if instances[i].Standby || instances[i].SchemaOnly {
+			continue
+		}
+		if latest == nil || instances[i].CreatedAt.After(latest.CreatedAt) {
+			latest = &instances[i]
+		}
+	}
+
+	if latest == nil {
+		instance, err := client.CreateInstance(image)
+		if err != nil {
+			return instance, errors.Wrap(err, "could not create instance")
+		}
+		logger.With("id", instance.ID).With("image", image.ID).Info("Created instance")
+		return instance, nil
+	}
+
+	// Instances are listed without their credentials
+	return client.GetInstance(strconv.Itoa(latest.ID))
 }
 
 func ImageToString(i models.Image) string {
+	if i.IsSharded() {
+		return fmt.Sprintf(
+			"%2d [ %s - READY: %5t - SHARDS: %s ]",
+			i.ID, i.BackedUpAt.Format(time.RFC3339), i.Ready, strings.Join(i.Shards, ","),
+		)
+	}
+	if i.IsDistributed() {
+		return fmt.Sprintf(
+			"%2d [ %s - READY: %5t - WORKERS: %s ]",
+			i.ID, i.BackedUpAt.Format(time.RFC3339), i.Ready, strings.Join(i.Workers.Names(), ","),
+		)
+	}
 	return fmt.Sprintf("%2d [ %s - READY: %5t ]", i.ID, i.BackedUpAt.Format(time.RFC3339), i.Ready)
 }
 
+// ImageManifestToString formats each field of an image's manifest, other than
+// its signature, on its own line
+func ImageManifestToString(m models.ImageManifest) string {
+	return fmt.Sprintf(
+		"image:         %d\nversion:       %d\ncontent hash:  %s\nanon hash:     %s\nbaker version: %s\nsigner:        %s\nkey id:        %s\nsigned at:     %s",
+		m.ImageID, m.Version, m.ContentHash, m.AnonHash, m.BakerVersion, m.Signer, m.KeyID,
+		m.SignedAt.Format(time.RFC3339),
+	)
+}
+
+// BakeSpanToString formats a phase of an image's bake with its duration, or
+// marks it as unfinished
+func BakeSpanToString(s models.BakeSpan) string {
+	if s.FinishedAt == nil {
+		return fmt.Sprintf("%-16s %s - UNFINISHED", s.Phase, s.StartedAt.Format(time.RFC3339))
+	}
+
+	line := fmt.Sprintf(
+		"%-16s %s - %s (%s)",
+		s.Phase, s.StartedAt.Format(time.RFC3339), s.FinishedAt.Format(time.RFC3339),
+		s.FinishedAt.Sub(s.StartedAt).Round(time.Second),
+	)
+	if s.ErrorClass != "" {
+		line += fmt.Sprintf(" FAILED (%s): %s", s.ErrorClass, s.Error)
+	} else if s.Error != "" {
+		line += " FAILED: " + s.Error
+	}
+	return line
+}
+
+// FreshnessStatusToString formats whether an image family meets its freshness
+// SLA, along with its latest ready image
+func FreshnessStatusToString(s models.FreshnessStatus) string {
+	met := "MET"
+	if !s.Met {
+		met = "VIOLATED"
+	}
+
+	if s.LatestBackedUpAt == nil {
+		return fmt.Sprintf("%-16s MAX AGE: %s - %s - NO READY IMAGES", s.ID, s.MaxAge, met)
+	}
+	return fmt.Sprintf(
+		"%-16s MAX AGE: %s - %s - LATEST: %d (%s)",
+		s.ID, s.MaxAge, met, s.LatestImageID, s.LatestBackedUpAt.Format(time.RFC3339),
+	)
+}
+
+func StaleImageToString(i models.StaleImage) string {
+	return fmt.Sprintf(
+		"%2d [ %s - FAMILY: %s - POLICY: %s ]",
+		i.ID, i.BackedUpAt.Format(time.RFC3339), i.Family, i.Policy,
+	)
+}
+
 func InstanceToString(i models.Instance) string {
-	return fmt.Sprintf("%2d [ PORT: %d - %s ]", i.ID, i.Port, i.CreatedAt.Format(time.RFC3339))
+	details := fmt.Sprintf("PORT: %d - %s", i.Port, i.CreatedAt.Format(time.RFC3339))
+	// Older servers don't send the status
+	switch {
+	case i.Status != "" && i.Status != models.InstanceRunning:
+		details += " - " + strings.ToUpper(i.Status)
+	case i.Standby:
+		details += " - STANDBY"
+	}
+	if i.SchemaOnly {
+		details += " - SCHEMA ONLY"
+	}
+	if i.StaticName != "" {
+		details += " - STATIC: " + i.StaticName
+	}
+	if i.ExpiresAt != nil {
+		details += fmt.Sprintf(" - EXPIRES: %s", i.ExpiresAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%2d [ %s ]", i.ID, details)
+}
+
+// SearchResultToString formats a search result as the image or instance that
+// it refers to, prefixed by its type
+func SearchResultToString(r models.SearchResult) string {
+	switch {
+	case r.Image != nil:
+		return "image    " + ImageToString(*r.Image)
+	case r.Instance != nil:
+		return "instance " + InstanceToString(*r.Instance)
+	default:
+		return r.ID
+	}
+}
+
+// InstanceCountToString formats an instance count as its dimension, value and
+// count, e.g. "status running 3"
+func InstanceCountToString(c models.InstanceCount) string {
+	return fmt.Sprintf("%-6s %-30s %d", c.Dimension, c.Value, c.Count)
+}
+
+// InstanceGroupToString formats an instance group, followed by a line for each
+// of its instances with the image it was created from and where to connect to
+// it
+func InstanceGroupToString(g models.InstanceGroup) string {
+	details := fmt.Sprintf("INSTANCES: %d - %s", len(g.Instances), g.CreatedAt.Format(time.RFC3339))
+	if g.ExpiresAt != nil {
+		details += fmt.Sprintf(" - EXPIRES: %s", g.ExpiresAt.Format(time.RFC3339))
+	}
+
+	lines := []string{fmt.Sprintf("%2d [ %s ]", g.ID, details)}
+	for _, i := range g.Instances {
+		lines = append(lines, fmt.Sprintf("   %2d [ IMAGE: %d - %s:%d ]", i.ID, i.ImageID, i.Hostname, i.Port))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// OperationToString formats an operation as what it acts on and how far it's
+// got, e.g. "7 [ finalise_image images/3 - running: finalise ]"
+func OperationToString(o models.Operation) string {
+	status := o.Status
+	if o.Phase != "" {
+		status += ": " + o.Phase
+	}
+	if o.Error != "" {
+		status += ": " + o.Error
+	}
+	return fmt.Sprintf("%2d [ %s %s/%d - %s ]", o.ID, o.Kind, o.ResourceType, o.ResourceID, status)
+}
+
+func BreakGlassGrantToString(g models.BreakGlassGrant) string {
+	status := fmt.Sprintf("EXPIRES: %s", g.ExpiresAt.Format(time.RFC3339))
+	if g.RevokedAt != nil {
+		status = fmt.Sprintf("REVOKED: %s by %s", g.RevokedAt.Format(time.RFC3339), g.RevokedBy)
+	}
+	return fmt.Sprintf("%2d [ %s - IMAGE: %d - %s ] %s", g.ID, g.UserEmail, g.ImageID, status, g.Reason)
+}
+
+func AccessRequestToString(r models.AccessRequest) string {
+	status := strings.ToUpper(r.Status)
+	if r.DecidedBy != "" {
+		status += " by " + r.DecidedBy
+	}
+	if r.ExpiresAt != nil {
+		status += fmt.Sprintf(" - EXPIRES: %s", r.ExpiresAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%2d [ %s - FAMILY: %s - %s - %s ] %s", r.ID, r.UserEmail, r.Family, r.ValidFor, status, r.Reason)
+}
+
+// AnnotationsToString formats annotations as key=value lines, sorted by key
+func AnnotationsToString(annotations models.Annotations) string {
+	lines := make([]string, 0, len(annotations))
+	for key, value := range annotations {
+		lines = append(lines, fmt.Sprintf("%s=%v", key, value))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// parseAnnotations parses command line arguments of the form key=value, which
+// set an annotation, and key-, which removes it
+func parseAnnotations(args []string) (models.Annotations, error) {
+	patch, err := parsePatch(args)
+	if err != nil {
+		return nil, err
+	}
+	annotations := models.Annotations(patch)
+	return annotations, annotations.ValidatePatch()
+}
+
+// parseLabels parses command line arguments of the form key=value, which set a
+// label, and key-, which removes it
+func parseLabels(args []string) (models.Labels, error) {
+	patch, err := parsePatch(args)
+	if err != nil {
+		return nil, err
+	}
+	labels := models.Labels(patch)
+	return labels, labels.ValidatePatch()
+}
+
+func parsePatch(args []string) (map[string]interface{}, error) {
+	patch := map[string]interface{}{}
+	for _, arg := range args {
+		if strings.HasSuffix(arg, "-") && !strings.Contains(arg, "=") {
+			patch[strings.TrimSuffix(arg, "-")] = nil
+			continue
+		}
+
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected key=value or key-, got %q", arg)
+		}
+		patch[parts[0]] = parts[1]
+	}
+
+	return patch, nil
+}
+
+// parseLabelSelector parses the key=value labels that a list is filtered by
+func parseLabelSelector(args []string) (map[string]string, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	selector := make(map[string]string, len(args))
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected key=value, got %q", arg)
+		}
+		selector[parts[0]] = parts[1]
+	}
+	return selector, nil
 }
 
 func loadConfig(logger log.Logger) config.Config {
@@ -468,6 +3136,69 @@ func loadConfig(logger log.Logger) config.Config {
 	return cfg
 }
 
+// authenticateWithKeyFile configures the current profile to authenticate as a
+// service account with its key file, once the server has accepted the key. The
+// key is read from the file each time, so that CI systems can rotate it.
+func authenticateWithKeyFile(c *cli.Context, cfg config.Config, path string, logger log.Logger) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		logger.With("error", err).Fatal("Could not find key file")
+	}
+	key, err := clientPkg.ReadServiceAccountKey(path)
+	if err != nil {
+		logger.With("error", err).Fatal("Could not read key file")
+	}
+
+	cfg.KeyFile = path
+	cfg.Token = oauth2.Token{}
+	client := NewClientWithConfig(c, cfg, logger)
+
+	mine := clientPkg.ListOptions{Filter: clientPkg.Filter{User: "me"}}
+	if _, err := client.ListInstances(mine); err != nil {
+		logger.With("error", err).Fatal("The server didn't accept the key")
+	}
+
+	storeConfig(cfg, logger)
+	logger.With("service_account", key.ServiceAccount).Info("Successfully authenticated.")
+}
+
+// authenticateWithDeviceCode shows the user a code to enter in a browser on
+// another device, and waits for them to sign in there
+func authenticateWithDeviceCode(client clientPkg.Client, logger log.Logger) oauth2.Token {
+	authorization, err := client.CreateDeviceAuthorization()
+	if err != nil {
+		logger.With("error", err).Fatal("Could not start device authorization")
+	}
+
+	fmt.Printf("On another device, visit %s and enter the code %s\n", authorization.VerificationURI, authorization.UserCode)
+	fmt.Printf("Or visit this link: %s\n", authorization.VerificationURIComplete)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupts
+		cancel()
+	}()
+
+	token, err := client.WaitForDeviceToken(ctx, authorization)
+	if err != nil {
+		logger.With("error", err).Fatal("Could not create access token")
+	}
+	return token
+}
+
+// promptPassphrase asks for the passphrase that the token file is encrypted
+// with, on stderr so that stdout can still be captured
+func promptPassphrase() (string, error) {
+	fmt.Fprint(os.Stderr, "Passphrase for your draupnir token: ")
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(passphrase), err
+}
+
 func storeConfig(cfg config.Config, logger log.Logger) {
 	err := config.Store(cfg)
 	if err != nil {
@@ -475,17 +3206,397 @@ func storeConfig(cfg config.Config, logger log.Logger) {
 	}
 }
 
-func NewClient(c *cli.Context, logger log.Logger) clientPkg.Client {
-	cfg := loadConfig(logger)
-	return clientPkg.NewClient(
-		getServerURL(c, cfg),
-		cfg.Token,
-		c.GlobalBool("skip-verify"),
+// printRecords prints the models in the format given by --output, sorted by
+// --sort, calling table to print them in the human format unless --columns
+// picks the fields to print instead
+func printRecords(c *cli.Context, logger log.Logger, models interface{}, table func()) {
+	// The models are sorted in place, so that the table that the command prints
+	// is sorted too
+	if field := c.GlobalString("sort"); field != "" {
+		if err := output.Sort(models, field); err != nil {
+			logger.With("error", err).Fatal("Invalid --sort")
+		}
+	}
+
+	format := c.GlobalString("output")
+	columns := output.ParseColumns(c.GlobalString("columns"))
+	if format == output.Table && columns == nil {
+		table()
+		return
+	}
+
+	records, err := output.Records(models)
+	if err != nil {
+		logger.With("error", err).Fatal("Could not format output")
+	}
+
+	if columns != nil {
+		records, err = output.Select(records, columns)
+		if err != nil {
+			logger.With("error", err).Fatal("Invalid --columns")
+		}
+	}
+
+	if format == output.Table {
+		err = output.WriteTable(os.Stdout, records, columns)
+	} else {
+		err = output.Write(os.Stdout, format, records)
+	}
+	if err != nil {
+		logger.With("error", err).Fatal("Could not write output")
+	}
+}
+
+// printRecord is printRecords for a single model
+func printRecord(c *cli.Context, logger log.Logger, model interface{}, table func()) {
+	format := c.GlobalString("output")
+	if format == output.Table {
+		table()
+		return
+	}
+
+	record, err := output.Record(model)
+	if err != nil {
+		logger.With("error", err).Fatal("Could not format output")
+	}
+	if err := output.Write(os.Stdout, format, record); err != nil {
+		logger.With("error", err).Fatal("Could not write output")
+	}
+}
+
+// completionTimeout bounds how long completing IDs can hold up the shell
+const completionTimeout = 3 * time.Second
+
+// completionClient returns a client with which to list IDs to complete, or
+// false if the user hasn't authenticated
+func completionClient(c *cli.Context, logger log.Logger) (clientPkg.Client, bool) {
+	// Completing mustn't prompt for the passphrase of the token file
+	config.PromptPassphrase = nil
+
+	cfg, err := config.Load()
+	if err != nil || (cfg.Token.RefreshToken == "" && cfg.KeyFile == "") {
+		return clientPkg.Client{}, false
+	}
+
+	return NewClientWithConfig(
+		c, cfg, logger,
+		clientPkg.WithTimeout(completionTimeout),
+		clientPkg.WithRetryPolicy(clientPkg.NoRetries),
+		// Warnings would be printed in the middle of the user's command line
+		clientPkg.WithClockSkewWarning(nil),
+	), true
+}
+
+// completeInstanceIDs completes the first argument of a command with the IDs of
+// the user's instances. Nothing is completed if they can't be listed.
+func completeInstanceIDs(logger log.Logger) cli.BashCompleteFunc {
+	return func(c *cli.Context) {
+		if c.NArg() > 0 {
+			return
+		}
+
+		client, ok := completionClient(c, logger)
+		if !ok {
+			return
+		}
+
+		instances, err := client.ListInstances(clientPkg.ListOptions{})
+		if err != nil {
+			return
+		}
+		for _, instance := range instances {
+			fmt.Println(instance.ID)
+		}
+	}
+}
+
+// completeImageIDs completes the first argument of a command with the IDs of
+// the images. Nothing is completed if they can't be listed.
+func completeImageIDs(logger log.Logger) cli.BashCompleteFunc {
+	return func(c *cli.Context) {
+		if c.NArg() > 0 {
+			return
+		}
+
+		client, ok := completionClient(c, logger)
+		if !ok {
+			return
+		}
+
+		images, err := client.ListImages(clientPkg.ListOptions{})
+		if err != nil {
+			return
+		}
+		for _, image := range images {
+			fmt.Println(image.ID)
+		}
+	}
+}
+
+// completeConnect completes the instance to connect to, unless it's chosen by
+// --latest-image
+func completeConnect(logger log.Logger) cli.BashCompleteFunc {
+	complete := completeInstanceIDs(logger)
+	return func(c *cli.Context) {
+		if !c.Bool("latest-image") {
+			complete(c)
+		}
+	}
+}
+
+// instanceID returns the instance ID given as the command's first argument.
+// Without one, the user picks from their instances, newest first, if the CLI
+// is being used interactively.
+func instanceID(c *cli.Context, client clientPkg.Client, logger log.Logger) string {
+	if id := c.Args().First(); id != "" {
+		return id
+	}
+	if !picker.Interactive() {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		logger.Fatal("Must supply an instance id")
+	}
+
+	instances, err := client.ListInstances(clientPkg.ListOptions{})
+	if err != nil {
+		logger.With("error", err).Fatal("Could not fetch instances")
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].CreatedAt.After(instances[j].CreatedAt)
+	})
+
+	items := make([]picker.Item, len(instances))
+	for i, instance := range instances {
+		items[i] = picker.Item{ID: strconv.Itoa(instance.ID), Label: InstanceToString(instance)}
+	}
+	return pick(logger, "instance>", items)
+}
+
+// destroyAllMyInstances destroys every instance that belongs to the user,
+// logging each as it's destroyed or fails, and exits if any of them fail
+func destroyAllMyInstances(c *cli.Context, client clientPkg.Client, logger log.Logger) {
+	// The server only lists the user's own instances
+	instances, err := client.ListInstances(clientPkg.ListOptions{})
+	if err != nil {
+		logger.With("error", err).Fatal("Could not fetch instances")
+	}
+
+	if c.Bool("dry-run") {
+		printRecords(c, logger, instances, func() {
+			for _, instance := range instances {
+				fmt.Println(InstanceToString(instance))
+			}
+		})
+		return
+	}
+
+	if len(instances) == 0 {
+		logger.Info("You have no instances to destroy")
+		return
+	}
+
+	ids := make([]int, 0, len(instances))
+	for _, instance := range instances {
+		ids = append(ids, instance.ID)
+	}
+
+	err = client.DestroyInstances(context.Background(), ids,
+		clientPkg.WithBulkConcurrency(c.Int("concurrency")),
+		clientPkg.WithBulkProgress(func(p clientPkg.BulkProgress) {
+			progress := logger.With("id", p.ID).With("progress", fmt.Sprintf("%d/%d", p.Completed, p.Total))
+			if p.Err != nil {
+				progress.With("error", p.Err).Error("Could not destroy instance")
+			} else {
+				progress.Info("Destroyed instance")
+			}
+		}),
 	)
+	if bulkErr, ok := err.(*clientPkg.BulkError); ok {
+		logger.With("failed", len(bulkErr.Errors)).With("destroyed", len(ids)-len(bulkErr.Errors)).Fatal("Could not destroy every instance")
+	}
+	if err != nil {
+		logger.With("error", err).Fatal("Could not destroy instances")
+	}
+
+	logger.With("destroyed", len(ids)).Info("Destroyed all of your instances")
+}
+
+// instanceGroupID returns the instance group ID given as the command's first
+// argument
+func instanceGroupID(c *cli.Context, logger log.Logger) int {
+	id, err := strconv.Atoi(c.Args().First())
+	if err != nil {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		logger.Fatal("Must supply an instance group id")
+	}
+	return id
+}
+
+// imageID returns the image ID given as the command's first argument. Without
+// one, the user picks from the images, most recently backed up first, if the
+// CLI is being used interactively.
+func imageID(c *cli.Context, client clientPkg.Client, logger log.Logger) int {
+	if c.NArg() == 0 && picker.Interactive() {
+		images, err := client.ListImages(clientPkg.ListOptions{})
+		if err != nil {
+			logger.With("error", err).Fatal("Could not fetch images")
+		}
+		sort.Slice(images, func(i, j int) bool {
+			return images[i].BackedUpAt.After(images[j].BackedUpAt)
+		})
+
+		items := make([]picker.Item, len(images))
+		for i, image := range images {
+			items[i] = picker.Item{ID: strconv.Itoa(image.ID), Label: ImageToString(image)}
+		}
+		id, _ := strconv.Atoi(pick(logger, "image>", items))
+		return id
+	}
+
+	id, err := strconv.Atoi(c.Args().First())
+	if err != nil {
+		cli.ShowCommandHelp(c, c.Command.Name)
+		logger.Fatal("Must supply an image id")
+	}
+	return id
+}
+
+// pick returns the ID of the item that the user picks, exiting if they cancel
+func pick(logger log.Logger, prompt string, items []picker.Item) string {
+	item, err := picker.Pick(prompt, items)
+	if err == picker.ErrCancelled {
+		os.Exit(1)
+	}
+	if err != nil {
+		logger.With("error", err).Fatal("Could not pick an ID")
+	}
+	return item.ID
+}
+
+func NewClient(c *cli.Context, logger log.Logger) clientPkg.Client {
+	return NewClientWithConfig(c, loadConfig(logger), logger)
+}
+
+// NewClientWithConfig constructs a client from the given config, rather than
+// the current profile's
+func NewClientWithConfig(c *cli.Context, cfg config.Config, logger log.Logger, extra ...clientPkg.Option) clientPkg.Client {
+	token := cfg.Token
+	if cfg.KeyFile != "" {
+		key, err := clientPkg.ReadServiceAccountKey(cfg.KeyFile)
+		if err != nil {
+			logger.With("error", err.Error()).Fatal("Could not read service account key")
+		}
+		token = oauth2.Token{RefreshToken: key.Key}
+	}
+	opts := []clientPkg.Option{clientPkg.WithToken(token)}
+
+	if c.GlobalBool("skip-verify") || cfg.SkipVerify {
+		opts = append(opts, clientPkg.WithInsecureSkipVerify())
+	}
+
+	if cfg.ClientCertificate != "" {
+		cert, err := ioutil.ReadFile(cfg.ClientCertificate)
+		if err != nil {
+			logger.With("error", err.Error()).Fatal("Could not read client certificate")
+		}
+
+		key, err := ioutil.ReadFile(cfg.ClientKey)
+		if err != nil {
+			logger.With("error", err.Error()).Fatal("Could not read client key")
+		}
+
+		opts = append(opts, clientPkg.WithClientCertificate(cert, key))
+	}
+
+	if c.GlobalBool("strict") {
+		opts = append(opts, clientPkg.WithStrictValidation())
+	}
+
+	opts = append(opts, requestLogging(c, logger)...)
+
+	// Token expiry is adjusted for the skew, but a wrong clock can still confuse
+	// anything else on the machine that compares its times with the server's
+	opts = append(opts, clientPkg.WithClockSkewWarning(func(skew time.Duration) {
+		logger.With("skew", skew.Round(time.Second)).
+			Warn("Your clock differs from the server's; check that NTP is running on this machine")
+	}))
+
+	return clientPkg.NewClient(getServerURL(c, cfg), append(opts, extra...)...)
+}
+
+// The formats that logs can be written in, to stderr
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+var logFormats = []string{logFormatText, logFormatJSON}
+
+// configureLogging sets the format of every log line, so that runs in
+// automation can be parsed, and logs debug messages if verbose is set
+func configureLogging(format string, verbose bool) error {
+	switch format {
+	case logFormatText:
+	case logFormatJSON:
+		if err := log.Base().SetFormat("logger:stderr?json=true"); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown log format %q, must be one of %s", format, strings.Join(logFormats, ", "))
+	}
+
+	if verbose {
+		return log.Base().SetLevel("debug")
+	}
+	return nil
+}
+
+// requestLogging returns the client options that log each request with
+// --verbose, and their headers with --debug. Credentials are redacted from the
+// headers, and bodies are never logged, as they can hold instance credentials.
+func requestLogging(c *cli.Context, logger log.Logger) []clientPkg.Option {
+	debug := c.GlobalBool("debug")
+	if !debug && !c.GlobalBool("verbose") {
+		return nil
+	}
+
+	return []clientPkg.Option{
+		clientPkg.WithResponseHook(func(req *http.Request, resp *http.Response, err error, duration time.Duration) {
+			entry := logger.
+				With("method", req.Method).
+				With("url", req.URL.String()).
+				With("duration", duration.Round(time.Millisecond).String())
+			if debug {
+				entry = entry.With("request_headers", clientPkg.RedactHeaders(req.Header))
+			}
+
+			if err != nil {
+				entry.With("error", err).Debug("HTTP request failed")
+				return
+			}
+
+			entry = entry.With("status", resp.StatusCode)
+			if timing, ok := clientPkg.ParseServerTiming(resp); ok {
+				// Tells a slow server apart from a slow network
+				entry = entry.
+					With("server_duration", timing.Total.Round(time.Millisecond).String()).
+					With("network_duration", timing.Network(duration).Round(time.Millisecond).String())
+				if debug {
+					entry = entry.
+						With("server_db_duration", timing.DB.Round(time.Millisecond).String()).
+						With("server_exec_duration", timing.Executor.Round(time.Millisecond).String()).
+						With("server_render_duration", timing.Render.Round(time.Millisecond).String())
+				}
+			}
+			if debug {
+				entry = entry.With("response_headers", clientPkg.RedactHeaders(resp.Header))
+			}
+			entry.Debug("HTTP request")
+		}),
+	}
 }
 
 func getServerURL(c *cli.Context, cfg config.Config) string {
-	if c.GlobalBool("insecure") {
+	if c.GlobalBool("insecure") || cfg.Insecure {
 		return fmt.Sprintf("http://%s", cfg.Domain)
 	}
 
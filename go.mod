@@ -10,7 +10,7 @@ require (
 	github.com/coreos/go-iptables v0.4.2
 	github.com/davecgh/go-spew v1.1.0
 	github.com/getsentry/raven-go v0.2.1-0.20190619092523-5c24d5110e0e
-	github.com/golang/protobuf v0.0.0-20171021043952-1643683e1b54
+	github.com/golang/protobuf v1.2.0
 	github.com/google/jsonapi v0.0.0-20160922220230-925ebf213646
 	github.com/gorilla/context v0.0.0-20160226214623-1ea25387ff6f
 	github.com/gorilla/mux v1.5.0
@@ -18,12 +18,13 @@ require (
 	github.com/oklog/run v1.0.0
 	github.com/pkg/errors v0.8.0
 	github.com/pmezard/go-difflib v1.0.0
-	github.com/prometheus/common v0.0.0-20180110214958-89604d197083
+	github.com/prometheus/client_golang v0.9.2
+	github.com/prometheus/common v0.0.0-20181126121408-4724e9255275
 	github.com/sirupsen/logrus v1.0.4
 	github.com/stretchr/testify v1.1.4
 	github.com/urfave/cli v1.20.0
 	golang.org/x/crypto v0.0.0-20180123095555-3d37316aaa6b
-	golang.org/x/net v0.0.0-20171020204401-cd69bc3fc700
+	golang.org/x/net v0.0.0-20181201002055-351d144fa1fc
 	golang.org/x/oauth2 v0.0.0-20170928010508-bb50c06baba3
 	golang.org/x/sys v0.0.0-20180125080817-ef802241c90f
 	google.golang.org/api v0.0.0-20171021000356-7afc123cf726
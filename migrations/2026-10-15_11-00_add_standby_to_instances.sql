@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE instances ADD COLUMN standby boolean DEFAULT false NOT NULL;
+
+-- +migrate Down
+ALTER TABLE instances DROP COLUMN standby;
@@ -0,0 +1,12 @@
+-- +migrate Up
+ALTER TABLE images ADD COLUMN annotations jsonb DEFAULT '{}' NOT NULL;
+ALTER TABLE images ADD CONSTRAINT images_annotations_size
+  CHECK (jsonb_typeof(annotations) = 'object' AND octet_length(annotations::text) <= 16384);
+
+ALTER TABLE instances ADD COLUMN annotations jsonb DEFAULT '{}' NOT NULL;
+ALTER TABLE instances ADD CONSTRAINT instances_annotations_size
+  CHECK (jsonb_typeof(annotations) = 'object' AND octet_length(annotations::text) <= 16384);
+
+-- +migrate Down
+ALTER TABLE instances DROP COLUMN annotations;
+ALTER TABLE images DROP COLUMN annotations;
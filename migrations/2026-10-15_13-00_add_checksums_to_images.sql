@@ -0,0 +1,9 @@
+-- +migrate Up
+ALTER TABLE images ADD COLUMN backup_checksum text DEFAULT '' NOT NULL;
+ALTER TABLE images ADD COLUMN backup_lsn text DEFAULT '' NOT NULL;
+ALTER TABLE images ADD COLUMN snapshot_checksum text DEFAULT '' NOT NULL;
+
+-- +migrate Down
+ALTER TABLE images DROP COLUMN snapshot_checksum;
+ALTER TABLE images DROP COLUMN backup_lsn;
+ALTER TABLE images DROP COLUMN backup_checksum;
@@ -0,0 +1,11 @@
+-- +migrate Up
+ALTER TABLE images ADD COLUMN drop_databases text[] DEFAULT '{}' NOT NULL;
+ALTER TABLE images ADD COLUMN rename_databases jsonb DEFAULT '{}' NOT NULL;
+ALTER TABLE images ADD COLUMN encoding text DEFAULT '' NOT NULL;
+ALTER TABLE images ADD COLUMN locale text DEFAULT '' NOT NULL;
+
+-- +migrate Down
+ALTER TABLE images DROP COLUMN locale;
+ALTER TABLE images DROP COLUMN encoding;
+ALTER TABLE images DROP COLUMN rename_databases;
+ALTER TABLE images DROP COLUMN drop_databases;
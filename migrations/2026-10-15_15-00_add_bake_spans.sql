@@ -0,0 +1,14 @@
+-- +migrate Up
+CREATE TABLE bake_spans (
+  id serial PRIMARY KEY,
+  image_id integer NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+  phase text NOT NULL,
+  started_at timestamptz NOT NULL,
+  finished_at timestamptz,
+  error text DEFAULT '' NOT NULL
+);
+
+CREATE INDEX bake_spans_image_id_idx ON bake_spans (image_id);
+
+-- +migrate Down
+DROP TABLE bake_spans;
@@ -0,0 +1,16 @@
+-- +migrate Up
+CREATE TABLE jobs (
+  id serial PRIMARY KEY,
+  kind text NOT NULL,
+  resource_id integer NOT NULL,
+  status text NOT NULL,
+  error text DEFAULT '' NOT NULL,
+  started_at timestamptz NOT NULL,
+  finished_at timestamptz
+);
+
+CREATE INDEX jobs_status_idx ON jobs (status);
+CREATE INDEX jobs_kind_resource_id_idx ON jobs (kind, resource_id);
+
+-- +migrate Down
+DROP TABLE jobs;
@@ -0,0 +1,15 @@
+-- +migrate Up
+CREATE TABLE image_manifests (
+  image_id integer PRIMARY KEY REFERENCES images (id) ON DELETE CASCADE,
+  version integer NOT NULL,
+  content_hash text NOT NULL,
+  anon_hash text NOT NULL,
+  baker_version text NOT NULL,
+  signer text NOT NULL,
+  key_id text NOT NULL,
+  signed_at timestamptz NOT NULL,
+  signature text NOT NULL
+);
+
+-- +migrate Down
+DROP TABLE image_manifests;
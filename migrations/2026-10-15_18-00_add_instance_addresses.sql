@@ -0,0 +1,6 @@
+-- +migrate Up
+ALTER TABLE instances ADD COLUMN address text;
+ALTER TABLE instances ADD CONSTRAINT instances_address_key UNIQUE (address);
+
+-- +migrate Down
+ALTER TABLE instances DROP COLUMN address;
@@ -0,0 +1,7 @@
+-- +migrate Up
+ALTER TABLE bake_spans ADD COLUMN error_class text DEFAULT '' NOT NULL;
+ALTER TABLE jobs ADD COLUMN error_class text DEFAULT '' NOT NULL;
+
+-- +migrate Down
+ALTER TABLE bake_spans DROP COLUMN error_class;
+ALTER TABLE jobs DROP COLUMN error_class;
@@ -0,0 +1,27 @@
+-- +migrate Up
+CREATE TABLE resource_leases (
+  kind text NOT NULL,
+  value text NOT NULL,
+  owner text NOT NULL,
+  instance_id integer REFERENCES instances (id) ON DELETE CASCADE,
+  expires_at timestamptz,
+  heartbeat_at timestamptz NOT NULL,
+  created_at timestamptz NOT NULL,
+  PRIMARY KEY (kind, value)
+);
+
+CREATE INDEX resource_leases_owner_idx ON resource_leases (owner);
+
+INSERT INTO resource_leases (kind, value, owner, instance_id, heartbeat_at, created_at)
+SELECT 'port', port::text, 'migration', id, now(), now()
+FROM instances
+WHERE address IS NULL
+ON CONFLICT DO NOTHING;
+
+INSERT INTO resource_leases (kind, value, owner, instance_id, heartbeat_at, created_at)
+SELECT 'address', address, 'migration', id, now(), now()
+FROM instances
+WHERE address IS NOT NULL;
+
+-- +migrate Down
+DROP TABLE resource_leases;
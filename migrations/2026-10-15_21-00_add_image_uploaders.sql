@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE images ADD COLUMN uploader text DEFAULT '' NOT NULL;
+
+-- +migrate Down
+ALTER TABLE images DROP COLUMN uploader;
@@ -0,0 +1,21 @@
+-- +migrate Up
+-- Sessions are an audit record, so they outlive the instances that they were
+-- connected to, and don't reference them
+CREATE TABLE proxy_sessions (
+  id serial PRIMARY KEY,
+  instance_id integer NOT NULL,
+  image_id integer NOT NULL,
+  family text NOT NULL,
+  user_email text NOT NULL,
+  client_ip_address text NOT NULL,
+  database text DEFAULT '' NOT NULL,
+  queries integer DEFAULT 0 NOT NULL,
+  started_at timestamptz NOT NULL,
+  ended_at timestamptz,
+  error text DEFAULT '' NOT NULL
+);
+
+CREATE INDEX proxy_sessions_instance_id_idx ON proxy_sessions (instance_id);
+
+-- +migrate Down
+DROP TABLE proxy_sessions;
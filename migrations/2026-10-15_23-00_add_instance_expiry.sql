@@ -0,0 +1,7 @@
+-- +migrate Up
+-- Instances without an expiry, including those created before it was
+-- configured, are never destroyed for being too old
+ALTER TABLE instances ADD COLUMN expires_at timestamptz;
+
+-- +migrate Down
+ALTER TABLE instances DROP COLUMN expires_at;
@@ -0,0 +1,16 @@
+-- +migrate Up
+-- Only the hash of each token is stored, as with service account keys. The
+-- instances aren't referenced, because they're expected to be destroyed before
+-- the token is used.
+CREATE TABLE cleanup_tokens (
+  id serial PRIMARY KEY,
+  token_hash text NOT NULL UNIQUE,
+  user_email text NOT NULL,
+  instance_ids integer[] NOT NULL,
+  created_at timestamptz NOT NULL,
+  expires_at timestamptz NOT NULL,
+  used_at timestamptz
+);
+
+-- +migrate Down
+DROP TABLE cleanup_tokens;
@@ -0,0 +1,13 @@
+-- +migrate Up
+-- Groups list their instances rather than the instances referencing them, as
+-- instances may expire and be destroyed on their own
+CREATE TABLE instance_groups (
+  id serial PRIMARY KEY,
+  user_email text NOT NULL,
+  instance_ids integer[] NOT NULL,
+  created_at timestamptz NOT NULL,
+  expires_at timestamptz
+);
+
+-- +migrate Down
+DROP TABLE instance_groups;
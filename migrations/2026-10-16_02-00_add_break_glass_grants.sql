@@ -0,0 +1,20 @@
+-- +migrate Up
+-- Grants are kept after they're revoked and after their image is destroyed, as
+-- the record of who was given access to raw data, so the image isn't
+-- referenced.
+CREATE TABLE break_glass_grants (
+  id serial PRIMARY KEY,
+  user_email text NOT NULL,
+  image_id integer NOT NULL,
+  reason text NOT NULL CHECK (reason <> ''),
+  granted_by text NOT NULL,
+  created_at timestamptz NOT NULL,
+  expires_at timestamptz NOT NULL,
+  revoked_at timestamptz,
+  revoked_by text NOT NULL DEFAULT ''
+);
+
+CREATE INDEX break_glass_grants_user_email_image_id_idx ON break_glass_grants (user_email, image_id);
+
+-- +migrate Down
+DROP TABLE break_glass_grants;
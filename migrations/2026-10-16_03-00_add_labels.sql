@@ -0,0 +1,15 @@
+-- +migrate Up
+-- Labels are filtered on with @>, which the jsonb_path_ops indexes support
+ALTER TABLE images ADD COLUMN labels jsonb DEFAULT '{}' NOT NULL;
+ALTER TABLE images ADD CONSTRAINT images_labels_size
+  CHECK (jsonb_typeof(labels) = 'object' AND octet_length(labels::text) <= 16384);
+CREATE INDEX images_labels_idx ON images USING gin (labels jsonb_path_ops);
+
+ALTER TABLE instances ADD COLUMN labels jsonb DEFAULT '{}' NOT NULL;
+ALTER TABLE instances ADD CONSTRAINT instances_labels_size
+  CHECK (jsonb_typeof(labels) = 'object' AND octet_length(labels::text) <= 16384);
+CREATE INDEX instances_labels_idx ON instances USING gin (labels jsonb_path_ops);
+
+-- +migrate Down
+ALTER TABLE instances DROP COLUMN labels;
+ALTER TABLE images DROP COLUMN labels;
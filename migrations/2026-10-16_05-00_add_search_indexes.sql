@@ -0,0 +1,33 @@
+-- +migrate Up
+-- GET /search matches these vectors, which weight labels and shard names above
+-- owners, and owners above annotations. They're built by functions so that the
+-- queries use exactly the expressions that are indexed.
+-- +migrate StatementBegin
+CREATE FUNCTION image_search_vector(shards text[], uploader text, labels jsonb, annotations jsonb)
+RETURNS tsvector LANGUAGE sql IMMUTABLE AS $$
+  SELECT setweight(array_to_tsvector(shards), 'A')
+    || setweight(to_tsvector('simple', labels::text), 'A')
+    || setweight(to_tsvector('simple', coalesce(uploader, '')), 'B')
+    || setweight(to_tsvector('simple', annotations::text), 'C')
+$$;
+-- +migrate StatementEnd
+
+-- +migrate StatementBegin
+CREATE FUNCTION instance_search_vector(user_email text, labels jsonb, annotations jsonb)
+RETURNS tsvector LANGUAGE sql IMMUTABLE AS $$
+  SELECT setweight(to_tsvector('simple', labels::text), 'A')
+    || setweight(to_tsvector('simple', coalesce(user_email, '')), 'B')
+    || setweight(to_tsvector('simple', annotations::text), 'C')
+$$;
+-- +migrate StatementEnd
+
+CREATE INDEX images_search_idx ON images
+  USING gin (image_search_vector(shards, uploader, labels, annotations));
+CREATE INDEX instances_search_idx ON instances
+  USING gin (instance_search_vector(user_email, labels, annotations));
+
+-- +migrate Down
+DROP INDEX instances_search_idx;
+DROP INDEX images_search_idx;
+DROP FUNCTION instance_search_vector(text, jsonb, jsonb);
+DROP FUNCTION image_search_vector(text[], text, jsonb, jsonb);
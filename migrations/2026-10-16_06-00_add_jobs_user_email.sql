@@ -0,0 +1,6 @@
+-- +migrate Up
+-- Jobs run as operations record who started them, so that they can poll them
+ALTER TABLE jobs ADD COLUMN user_email text DEFAULT ''::text NOT NULL;
+
+-- +migrate Down
+ALTER TABLE jobs DROP COLUMN user_email;
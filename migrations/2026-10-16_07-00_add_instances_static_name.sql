@@ -0,0 +1,7 @@
+-- +migrate Up
+-- Static instances are declared in the server's config, and named there
+ALTER TABLE instances ADD COLUMN static_name text;
+ALTER TABLE instances ADD CONSTRAINT instances_static_name_key UNIQUE (static_name);
+
+-- +migrate Down
+ALTER TABLE instances DROP COLUMN static_name;
@@ -0,0 +1,7 @@
+-- +migrate Up
+-- The workers of distributed images, by name, and the host:port that the
+-- coordinator knows each of them by
+ALTER TABLE images ADD COLUMN workers jsonb DEFAULT '{}' NOT NULL;
+
+-- +migrate Down
+ALTER TABLE images DROP COLUMN workers;
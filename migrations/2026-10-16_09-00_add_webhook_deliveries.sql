@@ -0,0 +1,24 @@
+-- +migrate Up
+-- Deliveries are kept after their image or instance is destroyed, as the log
+-- of what each webhook was sent, so the resource isn't referenced. The body is
+-- kept so that deliveries that were pending when the server stopped can be
+-- resumed.
+CREATE TABLE webhook_deliveries (
+  id serial PRIMARY KEY,
+  webhook text NOT NULL,
+  event text NOT NULL,
+  resource_type text NOT NULL,
+  resource_id integer NOT NULL,
+  status text NOT NULL,
+  attempts integer NOT NULL DEFAULT 0,
+  response_status integer NOT NULL DEFAULT 0,
+  error text NOT NULL DEFAULT '',
+  body bytea NOT NULL,
+  created_at timestamptz NOT NULL,
+  updated_at timestamptz NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_status_idx ON webhook_deliveries (status);
+
+-- +migrate Down
+DROP TABLE webhook_deliveries;
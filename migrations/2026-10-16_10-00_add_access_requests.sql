@@ -0,0 +1,20 @@
+-- +migrate Up
+-- Requests are kept after they're decided and after the access they give
+-- expires, as the record of who had access to each restricted family and why.
+CREATE TABLE access_requests (
+  id serial PRIMARY KEY,
+  user_email text NOT NULL,
+  family text NOT NULL,
+  reason text NOT NULL CHECK (reason <> ''),
+  valid_for text NOT NULL,
+  status text NOT NULL,
+  decided_by text NOT NULL DEFAULT '',
+  decided_at timestamptz,
+  expires_at timestamptz,
+  created_at timestamptz NOT NULL
+);
+
+CREATE INDEX access_requests_user_email_family_idx ON access_requests (user_email, family);
+
+-- +migrate Down
+DROP TABLE access_requests;
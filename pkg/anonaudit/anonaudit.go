@@ -0,0 +1,272 @@
+// Package anonaudit finds the ready images that weren't anonymised with the
+// current version of their family's anonymisation spec. Without it, images
+// baked before a spec was tightened keep serving under-masked data until
+// they're destroyed.
+//
+// Stale images are flagged in their annotations, and counted in metrics. Each
+// family's policy decides whether anything more is done about them.
+package anonaudit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// StatusAnnotation is set to StatusStale on each image that's found to be
+// stale, and removed if it stops being stale, e.g. because the spec was
+// reverted
+const (
+	StatusAnnotation = "draupnir/anon-status"
+	StatusStale      = "stale"
+)
+
+// The policies that a family can have for its stale images. PolicyReport only
+// flags them. PolicyRebake also asks for the family to be rebaked, and
+// PolicyBlock stops instances being created from them.
+const (
+	PolicyReport = "report"
+	PolicyRebake = "rebake"
+	PolicyBlock  = "block"
+)
+
+var staleImages = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "draupnir_anon_stale_images",
+		Help: "Number of the image family's ready images that weren't anonymised with its current spec",
+	},
+	[]string{"family"},
+)
+
+func init() {
+	prometheus.MustRegister(staleImages)
+}
+
+// Hash returns the SHA-256 of an anonymisation script, in the same form as
+// image manifests' anon_hash
+func Hash(anon string) string {
+	sum := sha256.Sum256([]byte(anon))
+	return hex.EncodeToString(sum[:])
+}
+
+// Spec is the current anonymisation spec of an image family: the script that
+// its images should be anonymised with. It's read from Path each time it's
+// needed, so that updating the file takes effect without restarting the
+// server.
+type Spec struct {
+	Family string
+	Path   string
+	Policy string
+}
+
+// ReadHash returns the hash of the spec's current contents
+func (s Spec) ReadHash() (string, error) {
+	anon, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read anonymisation spec of family %s", s.Family)
+	}
+	return Hash(string(anon)), nil
+}
+
+// Specs holds the spec of each family, by family. Images of families without a
+// spec aren't audited.
+type Specs map[string]Spec
+
+// For returns the spec of the image's family, and whether it has one
+func (s Specs) For(image models.Image) (Spec, bool) {
+	spec, ok := s[freshness.Family(image)]
+	return spec, ok
+}
+
+// ReadHashes returns the hash of each family's current spec, by family
+func (s Specs) ReadHashes() (map[string]string, error) {
+	hashes := map[string]string{}
+	for family, spec := range s {
+		hash, err := spec.ReadHash()
+		if err != nil {
+			return nil, err
+		}
+		hashes[family] = hash
+	}
+	return hashes, nil
+}
+
+// Blocks reports whether instances of the image can't be created, because it's
+// stale and its family's policy is PolicyBlock
+func (s Specs) Blocks(image models.Image) (bool, error) {
+	spec, ok := s.For(image)
+	if !ok || spec.Policy != PolicyBlock {
+		return false, nil
+	}
+
+	hash, err := spec.ReadHash()
+	if err != nil {
+		return false, err
+	}
+	return Hash(image.Anon) != hash, nil
+}
+
+// Evaluate returns the ready images that weren't anonymised with their
+// family's spec, given the hash of each spec, in order of ID
+func Evaluate(specs Specs, hashes map[string]string, images []models.Image) []models.StaleImage {
+	stale := []models.StaleImage{}
+	for _, image := range images {
+		if !image.Ready {
+			continue
+		}
+		spec, ok := specs.For(image)
+		if !ok {
+			continue
+		}
+
+		anonHash := Hash(image.Anon)
+		if anonHash == hashes[spec.Family] {
+			continue
+		}
+
+		stale = append(stale, models.StaleImage{
+			ID:         image.ID,
+			Family:     spec.Family,
+			BackedUpAt: image.BackedUpAt,
+			AnonHash:   anonHash,
+			SpecHash:   hashes[spec.Family],
+			Policy:     spec.Policy,
+		})
+	}
+
+	sort.Slice(stale, func(i, j int) bool { return stale[i].ID < stale[j].ID })
+	return stale
+}
+
+// Rebaker is asked to rebake an image's family, with its current spec, once
+// the image is found to be stale
+type Rebaker func(ctx context.Context, stale models.StaleImage) error
+
+// Auditor checks the images periodically, flagging those that are stale and
+// exporting how many there are as metrics
+type Auditor struct {
+	Logger     log.Logger
+	Specs      Specs
+	ImageStore store.ImageStore
+	// Rebake, if set, is called for each image of a family with PolicyRebake as
+	// it's flagged. As the flag is kept in the image's annotations, it's only
+	// called once per image, even across restarts.
+	Rebake Rebaker
+}
+
+// Start audits the images immediately, and then every interval until the
+// context is done
+func (a *Auditor) Start(ctx context.Context, interval time.Duration) error {
+	for {
+		if _, err := a.Check(ctx); err != nil {
+			a.Logger.With("error", err).Error("failed to audit image anonymisation")
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Check flags the images that have become stale since they were last checked,
+// and unflags those that are no longer stale
+func (a *Auditor) Check(ctx context.Context) ([]models.StaleImage, error) {
+	hashes, err := a.Specs.ReadHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := a.ImageStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	stale := Evaluate(a.Specs, hashes, images)
+
+	counts := map[string]int{}
+	byID := map[int]models.StaleImage{}
+	for _, image := range stale {
+		counts[image.Family]++
+		byID[image.ID] = image
+	}
+	for family := range a.Specs {
+		staleImages.WithLabelValues(family).Set(float64(counts[family]))
+	}
+
+	for _, image := range images {
+		flagged := image.Annotations[StatusAnnotation] == StatusStale
+		found, isStale := byID[image.ID]
+		logger := a.Logger.With("image", image.ID).With("family", freshness.Family(image))
+
+		switch {
+		case isStale && !flagged:
+			if _, err := a.ImageStore.Annotate(image, models.Annotations{StatusAnnotation: StatusStale}); err != nil {
+				logger.With("error", err).Warn("failed to flag image as stale")
+				continue
+			}
+			logger.With("spec_hash", found.SpecHash).Warn("image wasn't anonymised with its family's current spec")
+			a.rebake(ctx, logger, found)
+		case !isStale && flagged:
+			if _, err := a.ImageStore.Annotate(image, models.Annotations{StatusAnnotation: nil}); err != nil {
+				logger.With("error", err).Warn("failed to unflag image")
+				continue
+			}
+			logger.Info("image is no longer stale")
+		}
+	}
+
+	return stale, nil
+}
+
+// rebake calls the rebaker if the image's family has PolicyRebake. Failing to
+// ask for a rebake is logged, but doesn't stop the other images being checked.
+func (a *Auditor) rebake(ctx context.Context, logger log.Logger, stale models.StaleImage) {
+	if a.Rebake == nil || stale.Policy != PolicyRebake {
+		return
+	}
+	if err := a.Rebake(ctx, stale); err != nil {
+		logger.With("error", err).Warn("failed to request rebake of stale image")
+		return
+	}
+	logger.Info("requested rebake of stale image")
+}
+
+// CommandRebaker rebakes by running command with sh, passing the stale image in
+// the environment as DRAUPNIR_ANON_FAMILY, DRAUPNIR_ANON_IMAGE_ID,
+// DRAUPNIR_ANON_BACKED_UP_AT and DRAUPNIR_ANON_SPEC_HASH. Images are finalised
+// in place, so the command has to upload a new image of the family, e.g. by
+// triggering the pipeline that backs it up.
+func CommandRebaker(command string) Rebaker {
+	return func(ctx context.Context, stale models.StaleImage) error {
+		cmd := osexec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = append(
+			os.Environ(),
+			"DRAUPNIR_ANON_FAMILY="+stale.Family,
+			"DRAUPNIR_ANON_IMAGE_ID="+strconv.Itoa(stale.ID),
+			"DRAUPNIR_ANON_BACKED_UP_AT="+stale.BackedUpAt.UTC().Format(time.RFC3339),
+			"DRAUPNIR_ANON_SPEC_HASH="+stale.SpecHash,
+		)
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, output)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,171 @@
+package anonaudit
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+type fakeImageStore struct {
+	store.ImageStore
+	images *[]models.Image
+}
+
+func (s fakeImageStore) List() ([]models.Image, error) {
+	return append([]models.Image{}, *s.images...), nil
+}
+
+func (s fakeImageStore) Annotate(image models.Image, patch models.Annotations) (models.Image, error) {
+	for i := range *s.images {
+		if (*s.images)[i].ID != image.ID {
+			continue
+		}
+		annotations := models.Annotations{}
+		for key, value := range (*s.images)[i].Annotations {
+			annotations[key] = value
+		}
+		for key, value := range patch {
+			if value == nil {
+				delete(annotations, key)
+			} else {
+				annotations[key] = value
+			}
+		}
+		(*s.images)[i].Annotations = annotations
+		return (*s.images)[i], nil
+	}
+	return image, nil
+}
+
+func writeSpec(t *testing.T, dir, family, anon string) Spec {
+	path := filepath.Join(dir, family+".sql")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(anon), 0644))
+	return Spec{Family: family, Path: path, Policy: PolicyRebake}
+}
+
+func TestEvaluate(t *testing.T) {
+	backedUpAt := time.Date(2017, 5, 2, 12, 0, 0, 0, time.UTC)
+	images := []models.Image{
+		{ID: 3, Ready: true, Anon: "UPDATE users SET email = 'x';", BackedUpAt: backedUpAt},
+		{ID: 1, Ready: true, Anon: "UPDATE users SET email = NULL;", BackedUpAt: backedUpAt},
+		// Unready images haven't been anonymised yet
+		{ID: 2, Ready: false, Anon: "UPDATE users SET email = 'x';"},
+		// Families without a spec aren't audited
+		{
+			ID: 4, Ready: true, Anon: "",
+			Annotations: models.Annotations{freshness.FamilyAnnotation: "reporting"},
+		},
+	}
+
+	specs := Specs{freshness.DefaultFamily: {Family: freshness.DefaultFamily, Policy: PolicyBlock}}
+	hashes := map[string]string{freshness.DefaultFamily: Hash("UPDATE users SET email = NULL;")}
+
+	assert.Equal(t, []models.StaleImage{
+		{
+			ID:         3,
+			Family:     freshness.DefaultFamily,
+			BackedUpAt: backedUpAt,
+			AnonHash:   Hash("UPDATE users SET email = 'x';"),
+			SpecHash:   Hash("UPDATE users SET email = NULL;"),
+			Policy:     PolicyBlock,
+		},
+	}, Evaluate(specs, hashes, images))
+}
+
+func TestSpecsBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir-anonaudit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	spec := writeSpec(t, dir, freshness.DefaultFamily, "UPDATE users SET email = NULL;")
+	spec.Policy = PolicyBlock
+	specs := Specs{spec.Family: spec}
+
+	blocked, err := specs.Blocks(models.Image{Anon: "UPDATE users SET email = NULL;"})
+	assert.Nil(t, err)
+	assert.False(t, blocked)
+
+	blocked, err = specs.Blocks(models.Image{Anon: ""})
+	assert.Nil(t, err)
+	assert.True(t, blocked)
+
+	// Other policies only report stale images
+	spec.Policy = PolicyReport
+	specs[spec.Family] = spec
+	blocked, err = specs.Blocks(models.Image{Anon: ""})
+	assert.Nil(t, err)
+	assert.False(t, blocked)
+}
+
+func TestAuditorCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir-anonaudit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	spec := writeSpec(t, dir, freshness.DefaultFamily, "v1")
+	images := []models.Image{
+		{ID: 1, Ready: true, Anon: "v1"},
+		{ID: 2, Ready: true, Anon: "v1"},
+	}
+
+	var rebaked []int
+	auditor := &Auditor{
+		Logger:     log.Base(),
+		Specs:      Specs{spec.Family: spec},
+		ImageStore: fakeImageStore{images: &images},
+		Rebake: func(ctx context.Context, stale models.StaleImage) error {
+			rebaked = append(rebaked, stale.ID)
+			return nil
+		},
+	}
+
+	stale, err := auditor.Check(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, stale)
+
+	// Updating the spec makes every existing image stale, and each is only
+	// rebaked once
+	writeSpec(t, dir, freshness.DefaultFamily, "v2")
+	for i := 0; i < 2; i++ {
+		stale, err = auditor.Check(context.Background())
+		assert.Nil(t, err)
+		assert.Len(t, stale, 2)
+	}
+	assert.Equal(t, []int{1, 2}, rebaked)
+	assert.Equal(t, StatusStale, images[0].Annotations[StatusAnnotation])
+	assert.Equal(t, StatusStale, images[1].Annotations[StatusAnnotation])
+
+	// Reverting the spec unflags them
+	writeSpec(t, dir, freshness.DefaultFamily, "v1")
+	stale, err = auditor.Check(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, stale)
+	assert.NotContains(t, images[0].Annotations, StatusAnnotation)
+	assert.NotContains(t, images[1].Annotations, StatusAnnotation)
+}
+
+func TestCommandRebaker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir-anonaudit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rebaked")
+	rebake := CommandRebaker(`echo "$DRAUPNIR_ANON_FAMILY $DRAUPNIR_ANON_IMAGE_ID $DRAUPNIR_ANON_SPEC_HASH" > ` + path)
+
+	err = rebake(context.Background(), models.StaleImage{ID: 3, Family: "payments", SpecHash: "abc"})
+	assert.Nil(t, err)
+
+	output, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "payments 3 abc\n", string(output))
+}
@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// AccessRequests records requests for access to restricted families, and their
+// approval or denial, in the store and the log. Each change is published as an
+// event, so that webhooks can notify approvers of new requests, and users of
+// their decisions, without them having to watch a ticket queue.
+type AccessRequests struct {
+	Logger log.Logger
+	Store  store.AccessRequestStore
+	Events *events.Broker
+}
+
+// Request records a new, pending request
+func (a AccessRequests) Request(request models.AccessRequest) (models.AccessRequest, error) {
+	request.Status = models.AccessRequestPending
+	request, err := a.Store.Create(request)
+	if err != nil {
+		return request, errors.Wrap(err, "failed to record access request")
+	}
+
+	a.logger(request).
+		With("reason", request.Reason).
+		With("valid_for", request.ValidFor).
+		Info("Access requested")
+	a.Events.Publish(events.AccessRequestEvent(events.Created, request))
+	return request, nil
+}
+
+// Approve approves the request at now, giving access until its ValidFor has
+// passed. It returns sql.ErrNoRows if the request has already been decided.
+func (a AccessRequests) Approve(request models.AccessRequest, approver string, now time.Time) (models.AccessRequest, error) {
+	validFor, err := time.ParseDuration(request.ValidFor)
+	if err != nil {
+		return request, errors.Wrap(err, "invalid duration of access request")
+	}
+
+	expiresAt := now.Add(validFor)
+	return a.decide(request.ID, models.AccessRequestApproved, approver, now, &expiresAt)
+}
+
+// Deny denies the request at now. It returns sql.ErrNoRows if the request has
+// already been decided.
+func (a AccessRequests) Deny(request models.AccessRequest, approver string, now time.Time) (models.AccessRequest, error) {
+	return a.decide(request.ID, models.AccessRequestDenied, approver, now, nil)
+}
+
+func (a AccessRequests) decide(id int, status, approver string, now time.Time, expiresAt *time.Time) (models.AccessRequest, error) {
+	request, err := a.Store.Decide(id, status, approver, now, expiresAt)
+	if err != nil {
+		return request, err
+	}
+
+	logger := a.logger(request).With("decided_by", approver)
+	if request.ExpiresAt != nil {
+		logger = logger.With("expires_at", *request.ExpiresAt)
+	}
+	logger.Infof("Access request %s", status)
+	a.Events.Publish(events.AccessRequestEvent(events.Updated, request))
+	return request, nil
+}
+
+// Authorise returns the user's approved request for the family that gives
+// access at now. It returns sql.ErrNoRows if the user has no such request.
+func (a AccessRequests) Authorise(userEmail, family string, now time.Time) (models.AccessRequest, error) {
+	return a.Store.Active(userEmail, family, now)
+}
+
+func (a AccessRequests) logger(request models.AccessRequest) log.Logger {
+	return a.Logger.
+		With("access_request", request.ID).
+		With("user", request.UserEmail).
+		With("family", request.Family)
+}
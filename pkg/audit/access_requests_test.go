@@ -0,0 +1,108 @@
+package audit
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+type fakeAccessRequestStore struct {
+	store.AccessRequestStore
+	requests map[int]models.AccessRequest
+}
+
+func (s fakeAccessRequestStore) Create(request models.AccessRequest) (models.AccessRequest, error) {
+	request.ID = len(s.requests) + 1
+	s.requests[request.ID] = request
+	return request, nil
+}
+
+func (s fakeAccessRequestStore) Decide(id int, status, decidedBy string, decidedAt time.Time, expiresAt *time.Time) (models.AccessRequest, error) {
+	request, ok := s.requests[id]
+	if !ok || request.Status != models.AccessRequestPending {
+		return request, sql.ErrNoRows
+	}
+	request.Status = status
+	request.DecidedBy = decidedBy
+	request.DecidedAt = &decidedAt
+	request.ExpiresAt = expiresAt
+	s.requests[id] = request
+	return request, nil
+}
+
+func (s fakeAccessRequestStore) Active(userEmail, family string, now time.Time) (models.AccessRequest, error) {
+	for _, request := range s.requests {
+		if request.UserEmail == userEmail && request.Family == family && request.Active(now) {
+			return request, nil
+		}
+	}
+	return models.AccessRequest{}, sql.ErrNoRows
+}
+
+func TestAccessRequests(t *testing.T) {
+	var logs bytes.Buffer
+	broker := events.NewBroker()
+	published, unsubscribe := broker.Subscribe()
+	defer unsubscribe()
+
+	accessRequests := AccessRequests{
+		Logger: log.NewLogger(&logs),
+		Store:  fakeAccessRequestStore{requests: map[int]models.AccessRequest{}},
+		Events: broker,
+	}
+
+	now := time.Date(2017, 5, 2, 12, 0, 0, 0, time.UTC)
+	request, err := accessRequests.Request(models.AccessRequest{
+		UserEmail: "alice@example.com",
+		Family:    "payments",
+		Reason:    "INC-123: reconcile a payout",
+		ValidFor:  "8h0m0s",
+		CreatedAt: now,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, request.ID)
+	assert.Equal(t, models.AccessRequestPending, request.Status)
+	assert.Contains(t, logs.String(), "Access requested")
+	assert.Contains(t, logs.String(), "INC-123")
+	assert.Equal(t, events.Created, (<-published).Type)
+
+	_, err = accessRequests.Authorise("alice@example.com", "payments", now)
+	assert.Equal(t, sql.ErrNoRows, err, "pending requests shouldn't give access")
+
+	request, err = accessRequests.Approve(request, "bob@example.com", now)
+	assert.Nil(t, err)
+	assert.Equal(t, models.AccessRequestApproved, request.Status)
+	assert.Equal(t, "bob@example.com", request.DecidedBy)
+	assert.Equal(t, now.Add(8*time.Hour), *request.ExpiresAt)
+	assert.Contains(t, logs.String(), "Access request approved")
+	assert.Equal(t, models.AccessRequestApproved, (<-published).AccessRequest.Status)
+
+	authorised, err := accessRequests.Authorise("alice@example.com", "payments", now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, request.ID, authorised.ID)
+
+	_, err = accessRequests.Authorise("alice@example.com", "payments", now.Add(8*time.Hour))
+	assert.Equal(t, sql.ErrNoRows, err, "access should end once it expires")
+
+	_, err = accessRequests.Deny(request, "bob@example.com", now)
+	assert.Equal(t, sql.ErrNoRows, err, "decided requests can't be decided again")
+}
+
+func TestPolicyApprovers(t *testing.T) {
+	policy := Policy{Family: "payments"}
+	assert.False(t, policy.Restricted())
+	assert.False(t, policy.Approves("bob@example.com"))
+
+	policy.Approvers = []string{"bob@example.com"}
+	assert.True(t, policy.Restricted())
+	assert.True(t, policy.Approves("bob@example.com"))
+	assert.False(t, policy.Approves("alice@example.com"))
+}
@@ -0,0 +1,106 @@
+// Package audit records who connects to instances of regulated images, and
+// what they do there. Instances of a regulated family can only be connected to
+// through the server's Postgres proxy, which records each session.
+package audit
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/redact"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// Policy is how access to instances of a regulated family is controlled
+type Policy struct {
+	Family string
+	// MaxSessionDuration, if non-zero, ends sessions that last longer than it
+	MaxSessionDuration time.Duration
+	// Approvers, if set, restrict the family to the users whose access
+	// requests one of them has approved
+	Approvers []string
+}
+
+// Restricted reports whether instances of the family can only be created by
+// users whose access requests have been approved
+func (p Policy) Restricted() bool {
+	return len(p.Approvers) > 0
+}
+
+// Approves reports whether the user can decide access requests for the family
+func (p Policy) Approves(email string) bool {
+	for _, approver := range p.Approvers {
+		if approver == email {
+			return true
+		}
+	}
+	return false
+}
+
+// Policies holds the policy of each regulated family, by family. Families
+// without a policy aren't regulated.
+type Policies map[string]Policy
+
+// For returns the policy of the image's family, and whether the family is
+// regulated
+func (p Policies) For(image models.Image) (Policy, bool) {
+	policy, ok := p[freshness.Family(image)]
+	return policy, ok
+}
+
+// Recorder records sessions in the store, and logs them, so that they're kept
+// even if the store is unavailable
+type Recorder struct {
+	Logger log.Logger
+	Store  store.ProxySessionStore
+	// Redaction is applied to the errors that sessions end with, which can
+	// include what the client sent
+	Redaction redact.Policy
+}
+
+// Start records the start of a session. Sessions mustn't go ahead unless they
+// were recorded.
+func (r Recorder) Start(session models.ProxySession) (models.ProxySession, error) {
+	session, err := r.Store.Create(session)
+	if err != nil {
+		return session, errors.Wrap(err, "failed to record session")
+	}
+
+	r.logger(session).Info("Proxy session started")
+	return session, nil
+}
+
+// End records the end of a session at now, and the error that it ended with,
+// if any
+func (r Recorder) End(session models.ProxySession, now time.Time, sessionErr error) (models.ProxySession, error) {
+	session.EndedAt = &now
+	if sessionErr != nil {
+		session.Error = r.Redaction.String(sessionErr.Error())
+	}
+
+	logger := r.logger(session).
+		With("queries", session.Queries).
+		With("duration", session.Duration(now).Seconds())
+	if session.Error != "" {
+		logger = logger.With("error", session.Error)
+	}
+	logger.Info("Proxy session ended")
+
+	session, err := r.Store.End(session)
+	return session, errors.Wrap(err, "failed to record end of session")
+}
+
+func (r Recorder) logger(session models.ProxySession) log.Logger {
+	return r.Logger.
+		With("session", session.ID).
+		With("instance", session.InstanceID).
+		With("image", session.ImageID).
+		With("family", session.Family).
+		With("user", session.UserEmail).
+		With("client_ip_address", session.ClientIPAddress).
+		With("database", session.Database)
+}
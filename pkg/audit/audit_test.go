@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+type fakeProxySessionStore struct {
+	store.ProxySessionStore
+	sessions map[int]models.ProxySession
+}
+
+func (s fakeProxySessionStore) Create(session models.ProxySession) (models.ProxySession, error) {
+	session.ID = len(s.sessions) + 1
+	s.sessions[session.ID] = session
+	return session, nil
+}
+
+func (s fakeProxySessionStore) End(session models.ProxySession) (models.ProxySession, error) {
+	s.sessions[session.ID] = session
+	return session, nil
+}
+
+func TestPoliciesFor(t *testing.T) {
+	policies := Policies{"pci": {Family: "pci", MaxSessionDuration: time.Hour}}
+
+	policy, ok := policies.For(models.Image{Annotations: models.Annotations{freshness.FamilyAnnotation: "pci"}})
+	assert.True(t, ok)
+	assert.Equal(t, time.Hour, policy.MaxSessionDuration)
+
+	_, ok = policies.For(models.Image{Annotations: models.Annotations{freshness.FamilyAnnotation: "analytics"}})
+	assert.False(t, ok)
+
+	_, ok = policies.For(models.Image{})
+	assert.False(t, ok)
+}
+
+func TestRecorder(t *testing.T) {
+	var logs bytes.Buffer
+	sessions := fakeProxySessionStore{sessions: map[int]models.ProxySession{}}
+	recorder := Recorder{Logger: log.NewLogger(&logs), Store: sessions}
+
+	startedAt := time.Date(2017, 5, 2, 12, 0, 0, 0, time.UTC)
+	session, err := recorder.Start(models.ProxySession{
+		InstanceID: 4,
+		ImageID:    3,
+		Family:     "pci",
+		UserEmail:  "test@draupnir",
+		Database:   "payments",
+		StartedAt:  startedAt,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, session.ID)
+	assert.Contains(t, logs.String(), "Proxy session started")
+
+	session.Queries = 12
+	session, err = recorder.End(session, startedAt.Add(time.Minute), errors.New("session lasted too long"))
+	assert.Nil(t, err)
+
+	recorded := sessions.sessions[1]
+	assert.Equal(t, 12, recorded.Queries)
+	assert.Equal(t, startedAt.Add(time.Minute), *recorded.EndedAt)
+	assert.Equal(t, "session lasted too long", recorded.Error)
+	assert.Equal(t, time.Minute, recorded.Duration(time.Now()))
+	assert.Contains(t, logs.String(), "Proxy session ended")
+	assert.Contains(t, logs.String(), "queries=12")
+}
+
+func TestRecorderRedactsErrors(t *testing.T) {
+	sessions := fakeProxySessionStore{sessions: map[int]models.ProxySession{}}
+	recorder := Recorder{Logger: log.NewNopLogger(), Store: sessions}
+
+	session, err := recorder.Start(models.ProxySession{InstanceID: 4, StartedAt: time.Now()})
+	assert.Nil(t, err)
+
+	_, err = recorder.End(session, time.Now(), errors.New("upstream rejected startup: password=hunter2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "upstream rejected startup: password=[REDACTED]", sessions.sessions[1].Error)
+}
@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// BreakGlass records break-glass grants, and each use of them, in the store and
+// the log. Grants replace SSHing to the storage host as root to look at an
+// upload, so everything that's done with them is recorded, and they're revoked
+// automatically once they expire.
+type BreakGlass struct {
+	Logger log.Logger
+	Store  store.BreakGlassGrantStore
+}
+
+// Grant records a new grant. Access mustn't be given unless it was recorded.
+func (b BreakGlass) Grant(grant models.BreakGlassGrant) (models.BreakGlassGrant, error) {
+	grant, err := b.Store.Create(grant)
+	if err != nil {
+		return grant, errors.Wrap(err, "failed to record break-glass grant")
+	}
+
+	b.logger(grant).
+		With("reason", grant.Reason).
+		With("granted_by", grant.GrantedBy).
+		With("expires_at", grant.ExpiresAt).
+		Info("Break-glass access granted")
+	return grant, nil
+}
+
+// Revoke revokes the grant at now. It returns sql.ErrNoRows if there's no such
+// grant, or it's already been revoked or has expired.
+func (b BreakGlass) Revoke(id int, revokedBy string, now time.Time) (models.BreakGlassGrant, error) {
+	grant, err := b.Store.Revoke(id, revokedBy, now)
+	if err != nil {
+		return grant, err
+	}
+
+	b.logger(grant).With("revoked_by", revokedBy).Info("Break-glass access revoked")
+	return grant, nil
+}
+
+// Authorise returns the user's active grant for the image. It returns
+// sql.ErrNoRows if the user has no such grant.
+func (b BreakGlass) Authorise(userEmail string, imageID int, now time.Time) (models.BreakGlassGrant, error) {
+	return b.Store.Active(userEmail, imageID, now)
+}
+
+// Accessed records that the grant was used to read the file
+func (b BreakGlass) Accessed(grant models.BreakGlassGrant, file string, clientIPAddress string) {
+	b.logger(grant).
+		With("file", file).
+		With("client_ip_address", clientIPAddress).
+		Info("Break-glass access used")
+}
+
+// Start revokes grants as they expire, every interval, until the context is
+// done. Grants stop giving access as soon as they expire regardless, but are
+// only recorded as revoked, and logged, when this finds them.
+func (b BreakGlass) Start(ctx context.Context, interval time.Duration) error {
+	for {
+		if _, err := b.RevokeExpired(time.Now()); err != nil {
+			b.Logger.With("error", err).Error("failed to revoke expired break-glass grants")
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// RevokeExpired revokes the grants that expired before now, and returns them
+func (b BreakGlass) RevokeExpired(now time.Time) ([]models.BreakGlassGrant, error) {
+	grants, err := b.Store.RevokeExpired(now)
+	if err != nil {
+		return grants, err
+	}
+
+	for _, grant := range grants {
+		b.logger(grant).With("revoked_by", grant.RevokedBy).Info("Break-glass access expired")
+	}
+	return grants, nil
+}
+
+func (b BreakGlass) logger(grant models.BreakGlassGrant) log.Logger {
+	return b.Logger.
+		With("break_glass_grant", grant.ID).
+		With("user", grant.UserEmail).
+		With("image", grant.ImageID)
+}
@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+type fakeBreakGlassGrantStore struct {
+	store.BreakGlassGrantStore
+	grants map[int]models.BreakGlassGrant
+}
+
+func (s fakeBreakGlassGrantStore) Create(grant models.BreakGlassGrant) (models.BreakGlassGrant, error) {
+	grant.ID = len(s.grants) + 1
+	s.grants[grant.ID] = grant
+	return grant, nil
+}
+
+func (s fakeBreakGlassGrantStore) Active(userEmail string, imageID int, now time.Time) (models.BreakGlassGrant, error) {
+	for _, grant := range s.grants {
+		if grant.UserEmail == userEmail && grant.ImageID == imageID && grant.Active(now) {
+			return grant, nil
+		}
+	}
+	return models.BreakGlassGrant{}, sql.ErrNoRows
+}
+
+func (s fakeBreakGlassGrantStore) Revoke(id int, revokedBy string, now time.Time) (models.BreakGlassGrant, error) {
+	grant, ok := s.grants[id]
+	if !ok || !grant.Active(now) {
+		return grant, sql.ErrNoRows
+	}
+	grant.RevokedAt = &now
+	grant.RevokedBy = revokedBy
+	s.grants[id] = grant
+	return grant, nil
+}
+
+func (s fakeBreakGlassGrantStore) RevokeExpired(now time.Time) ([]models.BreakGlassGrant, error) {
+	var revoked []models.BreakGlassGrant
+	for id, grant := range s.grants {
+		if grant.RevokedAt == nil && !now.Before(grant.ExpiresAt) {
+			expiresAt := grant.ExpiresAt
+			grant.RevokedAt = &expiresAt
+			grant.RevokedBy = models.BreakGlassExpiry
+			s.grants[id] = grant
+			revoked = append(revoked, grant)
+		}
+	}
+	return revoked, nil
+}
+
+func TestBreakGlass(t *testing.T) {
+	var logs bytes.Buffer
+	grants := fakeBreakGlassGrantStore{grants: map[int]models.BreakGlassGrant{}}
+	breakGlass := BreakGlass{Logger: log.NewLogger(&logs), Store: grants}
+
+	now := time.Date(2017, 5, 2, 12, 0, 0, 0, time.UTC)
+	grant, err := breakGlass.Grant(models.BreakGlassGrant{
+		UserEmail: "test@draupnir",
+		ImageID:   3,
+		Reason:    "INC-123: backup fails to start",
+		GrantedBy: "upload",
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, grant.ID)
+	assert.Contains(t, logs.String(), "Break-glass access granted")
+	assert.Contains(t, logs.String(), "INC-123")
+
+	authorised, err := breakGlass.Authorise("test@draupnir", 3, now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, grant.ID, authorised.ID)
+
+	_, err = breakGlass.Authorise("test@draupnir", 4, now.Add(time.Minute))
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	_, err = breakGlass.Authorise("other@draupnir", 3, now.Add(time.Minute))
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	breakGlass.Accessed(authorised, "backup_label", "1.2.3.4")
+	assert.Contains(t, logs.String(), "Break-glass access used")
+	assert.Contains(t, logs.String(), "file=backup_label")
+
+	revoked, err := breakGlass.Revoke(grant.ID, "upload", now.Add(2*time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, "upload", revoked.RevokedBy)
+	assert.Contains(t, logs.String(), "Break-glass access revoked")
+
+	_, err = breakGlass.Authorise("test@draupnir", 3, now.Add(3*time.Minute))
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	_, err = breakGlass.Revoke(grant.ID, "upload", now.Add(3*time.Minute))
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestBreakGlassRevokeExpired(t *testing.T) {
+	var logs bytes.Buffer
+	grants := fakeBreakGlassGrantStore{grants: map[int]models.BreakGlassGrant{}}
+	breakGlass := BreakGlass{Logger: log.NewLogger(&logs), Store: grants}
+
+	now := time.Date(2017, 5, 2, 12, 0, 0, 0, time.UTC)
+	grant, err := breakGlass.Grant(models.BreakGlassGrant{
+		UserEmail: "test@draupnir",
+		ImageID:   3,
+		Reason:    "INC-123",
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	})
+	assert.Nil(t, err)
+
+	expired, err := breakGlass.RevokeExpired(now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Empty(t, expired)
+
+	expired, err = breakGlass.RevokeExpired(now.Add(2 * time.Hour))
+	assert.Nil(t, err)
+	if assert.Len(t, expired, 1) {
+		assert.Equal(t, grant.ID, expired[0].ID)
+		assert.Equal(t, models.BreakGlassExpiry, expired[0].RevokedBy)
+		assert.Equal(t, grant.ExpiresAt, *expired[0].RevokedAt)
+	}
+	assert.Contains(t, logs.String(), "Break-glass access expired")
+}
@@ -0,0 +1,45 @@
+package audit
+
+import (
+	"github.com/prometheus/common/log"
+)
+
+// RunbookAction is an action from the on-call runbook, such as restarting an
+// instance's postgres, taken by an admin through the API rather than on the
+// host
+type RunbookAction struct {
+	// Name is the action taken, e.g. restart
+	Name         string
+	ResourceType string
+	ResourceID   int
+	// PerformedBy is the admin who took the action
+	PerformedBy string
+	// Reason is why the action was taken, e.g. a link to an incident
+	Reason string
+}
+
+// Runbook logs each runbook action, who took it and why, before it runs and
+// once it has finished, so that there's a record of it even if it never
+// finishes, e.g. because the server dies part way through
+type Runbook struct {
+	Logger log.Logger
+}
+
+// Run takes the action, by calling run, and logs it
+func (r Runbook) Run(action RunbookAction, run func() error) error {
+	logger := r.Logger.
+		With("runbook_action", action.Name).
+		With("resource_type", action.ResourceType).
+		With("resource", action.ResourceID).
+		With("performed_by", action.PerformedBy)
+
+	logger.With("reason", action.Reason).Info("Runbook action started")
+
+	if err := run(); err != nil {
+		logger.With("error", err).Warn("Runbook action failed")
+		return err
+	}
+
+	logger.Info("Runbook action succeeded")
+	return nil
+}
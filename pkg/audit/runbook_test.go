@@ -0,0 +1,43 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunbookRun(t *testing.T) {
+	var logs bytes.Buffer
+	runbook := Runbook{Logger: log.NewLogger(&logs)}
+
+	action := RunbookAction{
+		Name:         "restart",
+		ResourceType: "instances",
+		ResourceID:   12,
+		PerformedBy:  "upload",
+		Reason:       "INC-123",
+	}
+
+	ran := false
+	err := runbook.Run(action, func() error {
+		ran = true
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, ran)
+	assert.Contains(t, logs.String(), "Runbook action started")
+	assert.Contains(t, logs.String(), "INC-123")
+	assert.Contains(t, logs.String(), "Runbook action succeeded")
+
+	logs.Reset()
+	err = runbook.Run(action, func() error {
+		return errors.New("pg_ctl failed")
+	})
+	assert.EqualError(t, err, "pg_ctl failed")
+	assert.Contains(t, logs.String(), "Runbook action started")
+	assert.Contains(t, logs.String(), "Runbook action failed")
+	assert.NotContains(t, logs.String(), "Runbook action succeeded")
+}
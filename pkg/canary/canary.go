@@ -0,0 +1,374 @@
+// Package canary validates each image once it's ready, by creating a
+// short-lived "canary" instance of it and running an application's test suite
+// against the instance, so that a broken bake is flagged before anyone clones
+// the image.
+//
+// Images are marked as pending a canary as they're finalised. The result of
+// each canary is recorded in the image's annotations.
+package canary
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/jobs"
+	"github.com/gocardless/draupnir/pkg/ledger"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// The annotations in which each image's canary is recorded
+const (
+	StatusAnnotation     = "draupnir/canary-status"
+	InstanceAnnotation   = "draupnir/canary-instance"
+	StartedAtAnnotation  = "draupnir/canary-started-at"
+	FinishedAtAnnotation = "draupnir/canary-finished-at"
+	OutputAnnotation     = "draupnir/canary-output"
+)
+
+// The statuses of an image's canary
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusPassed  = "passed"
+	StatusFailed  = "failed"
+)
+
+// MaxOutputSize is how much of the end of a test's output is recorded, which
+// keeps the image's annotations well within models.MaxAnnotationsSize
+const MaxOutputSize = 4096
+
+// DefaultTimeout is how long a test can run for, unless configured otherwise
+const DefaultTimeout = 10 * time.Minute
+
+// interruptedOutput is recorded against canaries that were running when the
+// server stopped
+const interruptedOutput = "the server stopped while the canary was running"
+
+var runs = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "draupnir_canary_runs_total",
+		Help: "Canaries run against newly ready images, by whether they passed or failed",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(runs)
+}
+
+// Status returns the status of the image's canary, or an empty string if it
+// doesn't have one
+func Status(image models.Image) string {
+	status, _ := image.Annotations[StatusAnnotation].(string)
+	return status
+}
+
+// Connection describes how to connect to a canary instance
+type Connection struct {
+	ImageID    int
+	InstanceID int
+	Host       string
+	Port       uint16
+	Paths      models.CredentialPaths
+}
+
+// Environment returns the environment variables that libpq reads, along with
+// the IDs of the image and instance
+func (c Connection) Environment() []string {
+	return []string{
+		"DRAUPNIR_CANARY_IMAGE_ID=" + strconv.Itoa(c.ImageID),
+		"DRAUPNIR_CANARY_INSTANCE_ID=" + strconv.Itoa(c.InstanceID),
+		"PGHOST=" + c.Host,
+		fmt.Sprintf("PGPORT=%d", c.Port),
+		"PGUSER=draupnir",
+		"PGSSLMODE=verify-ca",
+		"PGSSLROOTCERT=" + c.Paths.CACertificate,
+		"PGSSLCERT=" + c.Paths.ClientCertificate,
+		"PGSSLKEY=" + c.Paths.ClientKey,
+	}
+}
+
+// Test runs a test suite against a canary instance, returning its output. The
+// canary fails if it returns an error.
+type Test func(ctx context.Context, conn Connection) (string, error)
+
+// CommandTest tests by running command with sh, with the connection's
+// environment variables set. The test fails if the command exits non-zero.
+func CommandTest(command string) Test {
+	return func(ctx context.Context, conn Connection) (string, error) {
+		cmd := osexec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = append(os.Environ(), conn.Environment()...)
+		output, err := cmd.CombinedOutput()
+		return string(output), err
+	}
+}
+
+// Runner runs the canaries of images that are pending one, one at a time
+type Runner struct {
+	Logger        log.Logger
+	ImageStore    store.ImageStore
+	InstanceStore store.InstanceStore
+	JobStore      store.JobStore
+	Executor      exec.Executor
+	// Ledger reserves the port of each canary instance, which is chosen between
+	// MinInstancePort and MaxInstancePort like those of other instances
+	Ledger          ledger.Ledger
+	MinInstancePort uint16
+	MaxInstancePort uint16
+	Events          *events.Broker
+	Test            Test
+	// Timeout is how long each test can run for before it fails
+	Timeout time.Duration
+}
+
+// Start recovers any canaries that were interrupted, and then checks for
+// pending canaries immediately and every interval until the context is done
+func (r Runner) Start(ctx context.Context, interval time.Duration) error {
+	// The exec package logs with the logger in the context
+	ctx = context.WithValue(ctx, middleware.LoggerKey, &r.Logger)
+
+	if err := r.Recover(ctx); err != nil {
+		r.Logger.With("error", err).Error("failed to recover interrupted canaries")
+	}
+
+	for {
+		if err := r.Check(ctx); err != nil {
+			r.Logger.With("error", err).Error("failed to check for pending canaries")
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Recover fails the canaries that were running when the server stopped, and
+// destroys their instances
+func (r Runner) Recover(ctx context.Context) error {
+	images, err := r.ImageStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list images")
+	}
+
+	for _, image := range images {
+		if Status(image) != StatusRunning {
+			continue
+		}
+
+		logger := r.Logger.With("image", image.ID)
+		logger.Warn("failing interrupted canary")
+
+		if id, err := strconv.Atoi(fmt.Sprint(image.Annotations[InstanceAnnotation])); err == nil {
+			instance, err := r.InstanceStore.Get(id)
+			if err == nil {
+				r.destroy(logger, instance)
+			}
+		}
+
+		if _, err := r.finish(image, StatusFailed, interruptedOutput); err != nil {
+			logger.With("error", err).Error("failed to record interrupted canary")
+		}
+	}
+
+	return nil
+}
+
+// Check runs the canary of each ready image that's pending one
+func (r Runner) Check(ctx context.Context) error {
+	images, err := r.ImageStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list images")
+	}
+
+	for _, image := range images {
+		if !image.Ready || Status(image) != StatusPending {
+			continue
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if _, err := r.Run(ctx, image); err != nil {
+			r.Logger.With("image", image.ID).With("error", err).Error("failed to run canary")
+		}
+	}
+
+	return nil
+}
+
+// Run creates a canary instance of the image, tests it and destroys it,
+// returning the image with the result recorded. An error is only returned if
+// the result couldn't be recorded: the canary fails if anything else does.
+func (r Runner) Run(ctx context.Context, image models.Image) (models.Image, error) {
+	logger := r.Logger.With("image", image.ID)
+	logger.Info("running canary")
+
+	running, err := r.ImageStore.Annotate(image, models.Annotations{
+		StatusAnnotation:     StatusRunning,
+		StartedAtAnnotation:  time.Now().UTC().Format(time.RFC3339),
+		InstanceAnnotation:   nil,
+		FinishedAtAnnotation: nil,
+		OutputAnnotation:     nil,
+	})
+	if err != nil {
+		return image, errors.Wrap(err, "failed to record start of canary")
+	}
+	image = running
+
+	status := StatusPassed
+	output, err := r.run(ctx, logger, &image)
+	if err != nil {
+		status = StatusFailed
+		output += fmt.Sprintf("\ncanary failed: %s", err)
+		logger.With("error", err).Warn("canary failed")
+	} else {
+		logger.Info("canary passed")
+	}
+
+	return r.finish(image, status, output)
+}
+
+// run creates the canary instance and runs the test against it. The instance's
+// ID is recorded against the image before the instance is created, so that it
+// can be destroyed if the server stops part way through.
+func (r Runner) run(ctx context.Context, logger log.Logger, image *models.Image) (string, error) {
+	port, err := r.Ledger.ReservePort(r.MinInstancePort, r.MaxInstancePort)
+	if err != nil {
+		return "", err
+	}
+
+	// Canary instances belong to the upload user and have no refresh token, so
+	// that they're never cleaned up while they're being tested
+	instance := models.NewInstance(image.ID, auth.UPLOAD_USER_EMAIL, "")
+	instance.Port = port
+
+	instance, err = r.InstanceStore.Create(instance)
+	if err != nil {
+		if releaseErr := r.Ledger.Release(models.LeasePort, strconv.Itoa(int(port))); releaseErr != nil {
+			logger.With("error", releaseErr).Warn("failed to release lease")
+		}
+		return "", errors.Wrap(err, "failed to create canary instance")
+	}
+	defer r.destroy(logger, instance)
+
+	annotated, err := r.ImageStore.Annotate(*image, models.Annotations{
+		InstanceAnnotation: strconv.Itoa(instance.ID),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to record canary instance")
+	}
+	*image = annotated
+
+	if err := r.Ledger.Bind(models.LeasePort, strconv.Itoa(int(port)), instance.ID); err != nil {
+		return "", err
+	}
+
+	if err := r.Executor.CreateInstance(ctx, image.ID, instance.ID, int(instance.Port), "", false); err != nil {
+		return "", errors.Wrap(err, "failed to create canary instance")
+	}
+	r.Events.Publish(events.InstanceEvent(events.Created, instance))
+
+	files, err := r.Executor.RetrieveInstanceCredentials(ctx, instance.ID)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to retrieve canary instance credentials")
+	}
+
+	dir, err := ioutil.TempDir("", "draupnir-canary")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	paths := models.CredentialPaths{
+		CACertificate:     filepath.Join(dir, "ca.crt"),
+		ClientCertificate: filepath.Join(dir, "client.crt"),
+		ClientKey:         filepath.Join(dir, "client.key"),
+	}
+	for path, name := range map[string]string{
+		paths.CACertificate:     "ca.crt",
+		paths.ClientCertificate: "client.crt",
+		paths.ClientKey:         "client.key",
+	} {
+		if err := ioutil.WriteFile(path, files[name], 0600); err != nil {
+			return "", err
+		}
+	}
+
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	testCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The test runs on this host, so it connects to the instance locally rather
+	// than through the whitelist
+	output, err := r.Test(testCtx, Connection{
+		ImageID:    image.ID,
+		InstanceID: instance.ID,
+		Host:       "localhost",
+		Port:       instance.Port,
+		Paths:      paths,
+	})
+	if testCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	return output, err
+}
+
+// destroy destroys the canary instance. It isn't cancelled with the context,
+// so that instances aren't left behind when the server stops.
+func (r Runner) destroy(logger log.Logger, instance models.Instance) {
+	ctx := context.WithValue(context.Background(), middleware.LoggerKey, &logger)
+
+	err := jobs.Run(logger, r.JobStore, models.JobDestroyInstance, instance.ID, func() error {
+		err := r.InstanceStore.Destroy(instance)
+		if err != nil {
+			return err
+		}
+		return r.Executor.DestroyInstance(ctx, instance.ID)
+	})
+	if err != nil {
+		logger.With("instance", instance.ID).With("error", err).Error("failed to destroy canary instance")
+		return
+	}
+
+	r.Events.Publish(events.InstanceEvent(events.Destroyed, instance))
+}
+
+// finish records the result of the image's canary
+func (r Runner) finish(image models.Image, status, output string) (models.Image, error) {
+	if len(output) > MaxOutputSize {
+		output = output[len(output)-MaxOutputSize:]
+	}
+
+	updated, err := r.ImageStore.Annotate(image, models.Annotations{
+		StatusAnnotation:     status,
+		FinishedAtAnnotation: time.Now().UTC().Format(time.RFC3339),
+		OutputAnnotation:     output,
+	})
+	if err != nil {
+		return image, errors.Wrap(err, "failed to record result of canary")
+	}
+
+	runs.WithLabelValues(status).Inc()
+	r.Events.Publish(events.ImageEvent(events.Updated, updated))
+	return updated, nil
+}
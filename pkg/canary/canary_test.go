@@ -0,0 +1,243 @@
+package canary
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/ledger"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// The stores and executor embed their interfaces, so that calling anything we
+// haven't faked panics
+type fakeImageStore struct {
+	store.ImageStore
+	images map[int]models.Image
+}
+
+func (s fakeImageStore) List() ([]models.Image, error) {
+	images := []models.Image{}
+	for _, image := range s.images {
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+func (s fakeImageStore) Annotate(image models.Image, patch models.Annotations) (models.Image, error) {
+	image = s.images[image.ID]
+	annotations := models.Annotations{}
+	for key, value := range image.Annotations {
+		annotations[key] = value
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(annotations, key)
+		} else {
+			annotations[key] = value
+		}
+	}
+	image.Annotations = annotations
+	s.images[image.ID] = image
+	return image, nil
+}
+
+type fakeInstanceStore struct {
+	store.InstanceStore
+	instances map[int]models.Instance
+}
+
+func (s fakeInstanceStore) Create(instance models.Instance) (models.Instance, error) {
+	instance.ID = len(s.instances) + 10
+	s.instances[instance.ID] = instance
+	return instance, nil
+}
+
+func (s fakeInstanceStore) Get(id int) (models.Instance, error) {
+	instance, ok := s.instances[id]
+	if !ok {
+		return instance, sql.ErrNoRows
+	}
+	return instance, nil
+}
+
+func (s fakeInstanceStore) Destroy(instance models.Instance) error {
+	delete(s.instances, instance.ID)
+	return nil
+}
+
+type fakeJobStore struct {
+	store.JobStore
+}
+
+func (s fakeJobStore) Create(job models.Job) (models.Job, error) {
+	return job, nil
+}
+
+type fakeLeaseStore struct {
+	store.LeaseStore
+}
+
+func (s fakeLeaseStore) Acquire(models.Lease) (bool, error)                   { return true, nil }
+func (s fakeLeaseStore) Bind(kind, value, owner string, instanceID int) error { return nil }
+func (s fakeLeaseStore) List(kind string) ([]models.Lease, error)             { return nil, nil }
+
+type fakeExecutor struct {
+	exec.Executor
+	created   *[]int
+	destroyed *[]int
+}
+
+func (e fakeExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int, address string, schemaOnly bool) error {
+	*e.created = append(*e.created, instanceID)
+	return nil
+}
+
+func (e fakeExecutor) RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error) {
+	return map[string][]byte{"ca.crt": []byte("ca"), "client.crt": []byte("cert"), "client.key": []byte("key")}, nil
+}
+
+func (e fakeExecutor) DestroyInstance(ctx context.Context, id int) error {
+	*e.destroyed = append(*e.destroyed, id)
+	return nil
+}
+
+func newRunner(images map[int]models.Image, instances map[int]models.Instance, test Test) (Runner, *[]int, *[]int, *bytes.Buffer) {
+	var logs bytes.Buffer
+	logger := log.NewLogger(&logs)
+
+	created, destroyed := []int{}, []int{}
+	return Runner{
+		Logger:          logger,
+		ImageStore:      fakeImageStore{images: images},
+		InstanceStore:   fakeInstanceStore{instances: instances},
+		JobStore:        fakeJobStore{},
+		Executor:        fakeExecutor{created: &created, destroyed: &destroyed},
+		Ledger:          ledger.Ledger{Logger: logger, Store: fakeLeaseStore{}, Owner: "test", TTL: time.Minute},
+		MinInstancePort: 6000,
+		MaxInstancePort: 7000,
+		Test:            test,
+	}, &created, &destroyed, &logs
+}
+
+func pendingImage(id int) models.Image {
+	return models.Image{ID: id, Ready: true, Annotations: models.Annotations{StatusAnnotation: StatusPending}}
+}
+
+func TestCheckRunsPendingCanaries(t *testing.T) {
+	images := map[int]models.Image{
+		1: pendingImage(1),
+		2: {ID: 2, Ready: true, Annotations: models.Annotations{}},
+		3: {ID: 3, Ready: false, Annotations: models.Annotations{StatusAnnotation: StatusPending}},
+	}
+	instances := map[int]models.Instance{}
+
+	var tested []Connection
+	runner, created, destroyed, _ := newRunner(images, instances, func(ctx context.Context, conn Connection) (string, error) {
+		assert.Equal(t, StatusRunning, Status(images[1]), "the canary is marked as running while it's tested")
+
+		ca, err := ioutil.ReadFile(conn.Paths.CACertificate)
+		assert.Nil(t, err)
+		assert.Equal(t, "ca", string(ca))
+
+		tested = append(tested, conn)
+		return "3 tests passed", nil
+	})
+
+	assert.Nil(t, runner.Check(context.Background()))
+
+	if assert.Equal(t, 1, len(tested)) {
+		assert.Equal(t, 1, tested[0].ImageID)
+		assert.Equal(t, "localhost", tested[0].Host)
+		assert.Contains(t, tested[0].Environment(), "DRAUPNIR_CANARY_IMAGE_ID=1")
+	}
+	assert.Equal(t, []int{10}, *created)
+	assert.Equal(t, []int{10}, *destroyed)
+	assert.Empty(t, instances)
+
+	annotations := images[1].Annotations
+	assert.Equal(t, StatusPassed, annotations[StatusAnnotation])
+	assert.Equal(t, "10", annotations[InstanceAnnotation])
+	assert.Equal(t, "3 tests passed", annotations[OutputAnnotation])
+	assert.NotEmpty(t, annotations[StartedAtAnnotation])
+	assert.NotEmpty(t, annotations[FinishedAtAnnotation])
+
+	assert.Equal(t, "", Status(images[2]))
+	assert.Equal(t, StatusPending, Status(images[3]), "canaries wait for the image to be ready")
+}
+
+func TestRunRecordsFailure(t *testing.T) {
+	images := map[int]models.Image{1: pendingImage(1)}
+	instances := map[int]models.Instance{}
+
+	runner, _, destroyed, _ := newRunner(images, instances, func(ctx context.Context, conn Connection) (string, error) {
+		return strings.Repeat("x", MaxOutputSize) + "relation \"payments\" does not exist", errors.New("exit status 1")
+	})
+
+	image, err := runner.Run(context.Background(), images[1])
+
+	assert.Nil(t, err)
+	assert.Equal(t, StatusFailed, Status(image))
+	output := image.Annotations[OutputAnnotation].(string)
+	assert.Equal(t, MaxOutputSize, len(output))
+	assert.True(t, strings.HasSuffix(output, "relation \"payments\" does not exist\ncanary failed: exit status 1"))
+	assert.Equal(t, []int{10}, *destroyed, "the instance is destroyed even though the test failed")
+}
+
+func TestRunTimesOut(t *testing.T) {
+	images := map[int]models.Image{1: pendingImage(1)}
+
+	runner, _, _, _ := newRunner(images, map[int]models.Instance{}, func(ctx context.Context, conn Connection) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	runner.Timeout = time.Millisecond
+
+	image, err := runner.Run(context.Background(), images[1])
+
+	assert.Nil(t, err)
+	assert.Equal(t, StatusFailed, Status(image))
+	assert.Contains(t, image.Annotations[OutputAnnotation], "canary failed: timed out after 1ms")
+}
+
+func TestRecoverFailsInterruptedCanaries(t *testing.T) {
+	images := map[int]models.Image{
+		1: {ID: 1, Ready: true, Annotations: models.Annotations{StatusAnnotation: StatusRunning, InstanceAnnotation: "10"}},
+		2: pendingImage(2),
+	}
+	instances := map[int]models.Instance{10: {ID: 10, ImageID: 1, UserEmail: auth.UPLOAD_USER_EMAIL}}
+
+	runner, _, destroyed, logs := newRunner(images, instances, nil)
+
+	assert.Nil(t, runner.Recover(context.Background()))
+
+	assert.Equal(t, []int{10}, *destroyed)
+	assert.Empty(t, instances)
+	assert.Equal(t, StatusFailed, Status(images[1]))
+	assert.Equal(t, interruptedOutput, images[1].Annotations[OutputAnnotation])
+	assert.Equal(t, StatusPending, Status(images[2]))
+	assert.Contains(t, logs.String(), "failing interrupted canary")
+}
+
+func TestCommandTest(t *testing.T) {
+	conn := Connection{ImageID: 1, InstanceID: 10, Host: "localhost", Port: 6543}
+
+	output, err := CommandTest(`echo "$PGHOST:$PGPORT $DRAUPNIR_CANARY_INSTANCE_ID"`)(context.Background(), conn)
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost:6543 10\n", output)
+
+	output, err = CommandTest("echo broken; exit 1")(context.Background(), conn)
+	assert.NotNil(t, err)
+	assert.Equal(t, "broken\n", output)
+}
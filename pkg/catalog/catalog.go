@@ -0,0 +1,195 @@
+// Package catalog registers each available instance as a service in a service
+// catalog, such as Consul or etcd, and deregisters it when it's destroyed, so
+// that tooling built on service discovery can find instances without calling
+// the draupnir API.
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// DefaultServiceName is the name that instances are registered under, unless
+// configured otherwise
+const DefaultServiceName = "draupnir-instance"
+
+// Entry is an instance's entry in a service catalog
+type Entry struct {
+	// ID is unique to the instance, and the same each time it's registered
+	ID      string
+	Name    string
+	Address string
+	Port    uint16
+	// Tags are the instance's annotations, as key=value
+	Tags []string
+	// Meta holds the IDs of the instance and its image, its owner and a DSN
+	// without credentials
+	Meta map[string]string
+}
+
+// NewEntry returns the instance's entry under the service name
+func NewEntry(name string, instance models.Instance) Entry {
+	tags := []string{}
+	for key, value := range instance.Annotations {
+		tags = append(tags, fmt.Sprintf("%s=%v", key, value))
+	}
+	sort.Strings(tags)
+
+	address := net.JoinHostPort(instance.Hostname, strconv.Itoa(int(instance.Port)))
+
+	return Entry{
+		ID:      fmt.Sprintf("%s-%d", name, instance.ID),
+		Name:    name,
+		Address: instance.Hostname,
+		Port:    instance.Port,
+		Tags:    tags,
+		Meta: map[string]string{
+			"instance_id": strconv.Itoa(instance.ID),
+			"image_id":    strconv.Itoa(instance.ImageID),
+			"owner":       instance.UserEmail,
+			"dsn":         fmt.Sprintf("postgres://draupnir@%s/?sslmode=verify-ca", address),
+		},
+	}
+}
+
+// Available reports whether the instance should be in the catalog. Standby
+// instances only accept local connections until they're promoted.
+func Available(instance models.Instance) bool {
+	return !instance.Standby
+}
+
+// Catalog is a service catalog
+type Catalog interface {
+	// Register adds the entry, or replaces it if it's already registered
+	Register(ctx context.Context, entry Entry) error
+	// Deregister removes the entry with the ID from under the service name, if
+	// it's registered
+	Deregister(ctx context.Context, name, id string) error
+	// List returns the IDs of the entries registered under the service name
+	List(ctx context.Context, name string) ([]string, error)
+}
+
+// Registrar keeps the catalog in sync with the instances. It follows changes to
+// them as they're published, and periodically reconciles the whole catalog, to
+// catch up with changes made while it wasn't following them.
+type Registrar struct {
+	Logger        log.Logger
+	Catalog       Catalog
+	ServiceName   string
+	InstanceStore store.InstanceStore
+	Events        *events.Broker
+}
+
+// Start reconciles the catalog, and then follows changes to instances until the
+// context is done, reconciling again every interval. If it falls behind the
+// changes, it reconciles before following them again.
+func (r Registrar) Start(ctx context.Context, interval time.Duration) error {
+	for {
+		// Subscribing before reconciling means that no change is missed
+		changes, unsubscribe := r.Events.Subscribe()
+
+		if err := r.Reconcile(ctx); err != nil {
+			r.Logger.With("error", err).Error("failed to reconcile service catalog")
+		}
+
+		r.follow(ctx, changes, interval)
+		unsubscribe()
+
+		if ctx.Err() != nil {
+			return nil
+		}
+		r.Logger.Warn("fell behind changes to instances, reconciling service catalog")
+	}
+}
+
+// follow applies each change to the catalog until the context is done or the
+// changes stop
+func (r Registrar) follow(ctx context.Context, changes <-chan events.Event, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-changes:
+			if !ok {
+				return
+			}
+			if event.Instance != nil {
+				r.apply(ctx, event.Type, *event.Instance)
+			}
+		case <-ticker.C:
+			if err := r.Reconcile(ctx); err != nil {
+				r.Logger.With("error", err).Error("failed to reconcile service catalog")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// apply registers or deregisters the instance after a change to it. Failures
+// are logged, and corrected when the catalog is next reconciled.
+func (r Registrar) apply(ctx context.Context, eventType string, instance models.Instance) {
+	logger := r.Logger.With("instance", instance.ID)
+	entry := NewEntry(r.ServiceName, instance)
+
+	if eventType != events.Destroyed && Available(instance) {
+		if err := r.Catalog.Register(ctx, entry); err != nil {
+			logger.With("error", err).Warn("failed to register instance in service catalog")
+		}
+		return
+	}
+
+	if err := r.Catalog.Deregister(ctx, r.ServiceName, entry.ID); err != nil {
+		logger.With("error", err).Warn("failed to deregister instance from service catalog")
+	}
+}
+
+// Reconcile registers every available instance, and deregisters every entry
+// that isn't one of them
+func (r Registrar) Reconcile(ctx context.Context) error {
+	instances, err := r.InstanceStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list instances")
+	}
+
+	registered, err := r.Catalog.List(ctx, r.ServiceName)
+	if err != nil {
+		return errors.Wrap(err, "failed to list service catalog")
+	}
+
+	wanted := map[string]bool{}
+	for _, instance := range instances {
+		if !Available(instance) {
+			continue
+		}
+
+		entry := NewEntry(r.ServiceName, instance)
+		wanted[entry.ID] = true
+		if err := r.Catalog.Register(ctx, entry); err != nil {
+			return errors.Wrapf(err, "failed to register instance %d", instance.ID)
+		}
+	}
+
+	for _, id := range registered {
+		if wanted[id] {
+			continue
+		}
+		if err := r.Catalog.Deregister(ctx, r.ServiceName, id); err != nil {
+			return errors.Wrapf(err, "failed to deregister %s", id)
+		}
+	}
+
+	return nil
+}
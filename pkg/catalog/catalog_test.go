@@ -0,0 +1,156 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// fakeCatalog holds the entries registered with it in memory
+type fakeCatalog struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+func (c *fakeCatalog) Register(ctx context.Context, entry Entry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[entry.ID] = entry
+	return nil
+}
+
+func (c *fakeCatalog) Deregister(ctx context.Context, name, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+	return nil
+}
+
+func (c *fakeCatalog) List(ctx context.Context, name string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := []string{}
+	for id, entry := range c.entries {
+		if entry.Name == name {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (c *fakeCatalog) ids() []string {
+	ids, _ := c.List(context.Background(), DefaultServiceName)
+	sort.Strings(ids)
+	return ids
+}
+
+type fakeInstanceStore struct {
+	store.InstanceStore
+	instances []models.Instance
+}
+
+func (s fakeInstanceStore) List() ([]models.Instance, error) {
+	return s.instances, nil
+}
+
+// eventually waits up to a second for the condition to hold
+func eventually(t *testing.T, condition func() bool, msgAndArgs ...interface{}) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if condition() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Fail(t, "condition never held", msgAndArgs...)
+}
+
+func newRegistrar(instances []models.Instance, entries map[string]Entry) (Registrar, *fakeCatalog) {
+	catalog := &fakeCatalog{entries: entries}
+	return Registrar{
+		Logger:        log.NewLogger(&bytes.Buffer{}),
+		Catalog:       catalog,
+		ServiceName:   DefaultServiceName,
+		InstanceStore: fakeInstanceStore{instances: instances},
+		Events:        events.NewBroker(),
+	}, catalog
+}
+
+func TestNewEntry(t *testing.T) {
+	instance := models.Instance{
+		ID:          4,
+		ImageID:     3,
+		Hostname:    "draupnir.example.com",
+		Port:        6543,
+		UserEmail:   "jane@example.com",
+		Annotations: models.Annotations{"team": "payments", "ci": "true"},
+	}
+
+	assert.Equal(t, Entry{
+		ID:      "draupnir-instance-4",
+		Name:    "draupnir-instance",
+		Address: "draupnir.example.com",
+		Port:    6543,
+		Tags:    []string{"ci=true", "team=payments"},
+		Meta: map[string]string{
+			"instance_id": "4",
+			"image_id":    "3",
+			"owner":       "jane@example.com",
+			"dsn":         "postgres://draupnir@draupnir.example.com:6543/?sslmode=verify-ca",
+		},
+	}, NewEntry(DefaultServiceName, instance))
+}
+
+func TestReconcile(t *testing.T) {
+	instances := []models.Instance{
+		{ID: 1, Hostname: "draupnir.example.com", Port: 6001},
+		{ID: 2, Hostname: "draupnir.example.com", Port: 6002, Standby: true},
+	}
+	registrar, catalog := newRegistrar(instances, map[string]Entry{
+		"draupnir-instance-3": {ID: "draupnir-instance-3", Name: DefaultServiceName},
+		"other-service-1":     {ID: "other-service-1", Name: "other-service"},
+	})
+
+	assert.Nil(t, registrar.Reconcile(context.Background()))
+
+	assert.Equal(t, []string{"draupnir-instance-1"}, catalog.ids(), "standby and destroyed instances aren't registered")
+	assert.Contains(t, catalog.entries, "other-service-1", "other services are left alone")
+}
+
+func TestStartFollowsChanges(t *testing.T) {
+	registrar, catalog := newRegistrar(nil, map[string]Entry{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- registrar.Start(ctx, time.Hour) }()
+
+	// Wait until the registrar is following changes
+	eventually(t, func() bool {
+		registrar.Events.Publish(events.InstanceEvent(events.Created, models.Instance{ID: 1, Port: 6001}))
+		return len(catalog.ids()) == 1
+	})
+
+	registrar.Events.Publish(events.InstanceEvent(events.Created, models.Instance{ID: 2, Port: 6002, Standby: true}))
+	registrar.Events.Publish(events.InstanceEvent(events.Updated, models.Instance{ID: 2, Port: 6002}))
+	eventually(t, func() bool {
+		return len(catalog.ids()) == 2
+	}, "standby instances are registered once they're promoted")
+
+	registrar.Events.Publish(events.InstanceEvent(events.Destroyed, models.Instance{ID: 1, Port: 6001}))
+	eventually(t, func() bool {
+		ids := catalog.ids()
+		return len(ids) == 1 && ids[0] == "draupnir-instance-2"
+	})
+
+	cancel()
+	assert.Nil(t, <-done)
+}
@@ -0,0 +1,110 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Consul registers entries as services with a Consul agent, using its HTTP API:
+// https://www.consul.io/api-docs/agent/service
+type Consul struct {
+	// URL is the agent's address, e.g. http://localhost:8500
+	URL string
+	// Token, if set, is the ACL token that requests are made with
+	Token  string
+	Client *http.Client
+}
+
+func NewConsul(url, token string) Consul {
+	return Consul{
+		URL:    strings.TrimSuffix(url, "/"),
+		Token:  token,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type consulService struct {
+	ID      string            `json:"ID"`
+	Service string            `json:"Service,omitempty"`
+	Name    string            `json:"Name,omitempty"`
+	Address string            `json:"Address"`
+	Port    uint16            `json:"Port"`
+	Tags    []string          `json:"Tags"`
+	Meta    map[string]string `json:"Meta"`
+}
+
+func (c Consul) Register(ctx context.Context, entry Entry) error {
+	return c.do(ctx, http.MethodPut, "/v1/agent/service/register", consulService{
+		ID:      entry.ID,
+		Name:    entry.Name,
+		Address: entry.Address,
+		Port:    entry.Port,
+		Tags:    entry.Tags,
+		Meta:    entry.Meta,
+	}, nil)
+}
+
+// Deregister removes the service with the ID, as IDs are unique within an agent
+func (c Consul) Deregister(ctx context.Context, name, id string) error {
+	return c.do(ctx, http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(id), nil, nil)
+}
+
+func (c Consul) List(ctx context.Context, name string) ([]string, error) {
+	var services map[string]consulService
+	if err := c.do(ctx, http.MethodGet, "/v1/agent/services", nil, &services); err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, service := range services {
+		if service.Service == name {
+			ids = append(ids, service.ID)
+		}
+	}
+	return ids, nil
+}
+
+// do sends the body, if there is one, as JSON, and decodes the response into
+// out, if it's given
+func (c Consul) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+		payload = &buf
+	}
+
+	req, err := http.NewRequest(method, c.URL+path, payload)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Consul responded to %s %s with %s", method, path, resp.Status)
+	}
+
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsul(t *testing.T) {
+	var registered consulService
+	var deregistered string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.Header.Get("X-Consul-Token"))
+
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/v1/agent/service/register":
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&registered))
+		case r.Method == http.MethodPut && r.URL.Path == "/v1/agent/service/deregister/draupnir-instance-4":
+			deregistered = "draupnir-instance-4"
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/agent/services":
+			fmt.Fprint(w, `{
+				"draupnir-instance-4": {"ID": "draupnir-instance-4", "Service": "draupnir-instance"},
+				"web-1": {"ID": "web-1", "Service": "web"}
+			}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	consul := NewConsul(server.URL+"/", "secret")
+	ctx := context.Background()
+
+	err := consul.Register(ctx, Entry{
+		ID:      "draupnir-instance-4",
+		Name:    "draupnir-instance",
+		Address: "draupnir.example.com",
+		Port:    6543,
+		Tags:    []string{"team=payments"},
+		Meta:    map[string]string{"instance_id": "4"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, consulService{
+		ID:      "draupnir-instance-4",
+		Name:    "draupnir-instance",
+		Address: "draupnir.example.com",
+		Port:    6543,
+		Tags:    []string{"team=payments"},
+		Meta:    map[string]string{"instance_id": "4"},
+	}, registered)
+
+	ids, err := consul.List(ctx, "draupnir-instance")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"draupnir-instance-4"}, ids)
+
+	assert.Nil(t, consul.Deregister(ctx, "draupnir-instance", "draupnir-instance-4"))
+	assert.Equal(t, "draupnir-instance-4", deregistered)
+
+	assert.EqualError(t, consul.Deregister(ctx, "draupnir-instance", "unknown"),
+		"Consul responded to PUT /v1/agent/service/deregister/unknown with 404 Not Found")
+}
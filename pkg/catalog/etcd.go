@@ -0,0 +1,173 @@
+package catalog
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultEtcdPrefix is the prefix of the keys that entries are stored under in
+// etcd, unless configured otherwise
+const DefaultEtcdPrefix = "/draupnir/services/"
+
+// Etcd stores each entry as JSON under the key <prefix><name>/<id>, using the
+// JSON gateway of etcd's v3 API:
+// https://etcd.io/docs/latest/dev-guide/api_grpc_gateway/
+type Etcd struct {
+	// URL is the address of an etcd member, e.g. http://localhost:2379
+	URL    string
+	Prefix string
+	Client *http.Client
+}
+
+func NewEtcd(url, prefix string) Etcd {
+	return Etcd{
+		URL:    strings.TrimSuffix(url, "/"),
+		Prefix: prefix,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// etcdEntry is the value stored for each entry
+type etcdEntry struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Address string            `json:"address"`
+	Port    uint16            `json:"port"`
+	Tags    []string          `json:"tags"`
+	Meta    map[string]string `json:"meta"`
+}
+
+// etcdKeyValue is a key and value in the gateway's encoding, in which both are
+// base64 encoded
+type etcdKeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+type etcdRangeRequest struct {
+	Key      string `json:"key"`
+	RangeEnd string `json:"range_end,omitempty"`
+	KeysOnly bool   `json:"keys_only,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+func (e Etcd) Register(ctx context.Context, entry Entry) error {
+	value, err := json.Marshal(etcdEntry{
+		ID:      entry.ID,
+		Name:    entry.Name,
+		Address: entry.Address,
+		Port:    entry.Port,
+		Tags:    entry.Tags,
+		Meta:    entry.Meta,
+	})
+	if err != nil {
+		return err
+	}
+
+	return e.do(ctx, "/v3/kv/put", etcdKeyValue{
+		Key:   encode(e.key(entry.Name, entry.ID)),
+		Value: base64.StdEncoding.EncodeToString(value),
+	}, nil)
+}
+
+func (e Etcd) Deregister(ctx context.Context, name, id string) error {
+	return e.do(ctx, "/v3/kv/deleterange", etcdRangeRequest{Key: encode(e.key(name, id))}, nil)
+}
+
+func (e Etcd) List(ctx context.Context, name string) ([]string, error) {
+	prefix := e.key(name, "")
+	keys, err := e.keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, key := range keys {
+		ids = append(ids, strings.TrimPrefix(key, prefix))
+	}
+	return ids, nil
+}
+
+func (e Etcd) key(name, id string) string {
+	return e.Prefix + name + "/" + id
+}
+
+// keys returns every key with the prefix
+func (e Etcd) keys(ctx context.Context, prefix string) ([]string, error) {
+	var resp etcdRangeResponse
+	err := e.do(ctx, "/v3/kv/range", etcdRangeRequest{
+		Key:      encode(prefix),
+		RangeEnd: encode(prefixEnd(prefix)),
+		KeysOnly: true,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, kv := range resp.Kvs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, string(key))
+	}
+	return keys, nil
+}
+
+// do posts the body as JSON, and decodes the response into out, if it's given
+func (e Etcd) do(ctx context.Context, path string, body, out interface{}) error {
+	var payload bytes.Buffer
+	if err := json.NewEncoder(&payload).Encode(body); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.URL+path, &payload)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("etcd responded to %s with %s", path, resp.Status)
+	}
+
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// prefixEnd returns the end of the range of keys with the prefix, which is the
+// prefix with its last byte incremented
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// Every byte is 0xff, so the range extends to the end of the keys
+	return "\x00"
+}
@@ -0,0 +1,100 @@
+package catalog
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEtcd implements the parts of etcd's JSON gateway that we use
+type fakeEtcd struct {
+	mu  sync.Mutex
+	kvs map[string]string
+}
+
+func (e *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var req struct {
+		Key      string `json:"key"`
+		Value    string `json:"value"`
+		RangeEnd string `json:"range_end"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	key, _ := base64.StdEncoding.DecodeString(req.Key)
+	value, _ := base64.StdEncoding.DecodeString(req.Value)
+	end, _ := base64.StdEncoding.DecodeString(req.RangeEnd)
+
+	switch r.URL.Path {
+	case "/v3/kv/put":
+		e.kvs[string(key)] = string(value)
+	case "/v3/kv/deleterange":
+		delete(e.kvs, string(key))
+	case "/v3/kv/range":
+		keys := []string{}
+		for k := range e.kvs {
+			if k >= string(key) && k < string(end) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		resp := etcdRangeResponse{Kvs: []etcdKeyValue{}}
+		for _, k := range keys {
+			resp.Kvs = append(resp.Kvs, etcdKeyValue{Key: encode(k)})
+		}
+		json.NewEncoder(w).Encode(resp)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestEtcd(t *testing.T) {
+	fake := &fakeEtcd{kvs: map[string]string{
+		"/draupnir/services/draupnir-instance-other/1": "{}",
+		"/draupnir/services/other/1":                   "{}",
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	etcd := NewEtcd(server.URL, DefaultEtcdPrefix)
+	ctx := context.Background()
+
+	for _, id := range []string{"draupnir-instance-4", "draupnir-instance-5"} {
+		err := etcd.Register(ctx, Entry{ID: id, Name: "draupnir-instance", Address: "draupnir.example.com", Port: 6543})
+		assert.Nil(t, err)
+	}
+
+	var stored etcdEntry
+	assert.Nil(t, json.Unmarshal([]byte(fake.kvs["/draupnir/services/draupnir-instance/draupnir-instance-4"]), &stored))
+	assert.Equal(t, "draupnir.example.com", stored.Address)
+	assert.Equal(t, uint16(6543), stored.Port)
+
+	ids, err := etcd.List(ctx, "draupnir-instance")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"draupnir-instance-4", "draupnir-instance-5"}, ids, "other services aren't listed")
+
+	assert.Nil(t, etcd.Deregister(ctx, "draupnir-instance", "draupnir-instance-4"))
+
+	ids, err = etcd.List(ctx, "draupnir-instance")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"draupnir-instance-5"}, ids)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, "/draupnir0", prefixEnd("/draupnir/"))
+	assert.Equal(t, "b", prefixEnd("a\xff"))
+	assert.Equal(t, "\x00", prefixEnd(strings.Repeat("\xff", 2)))
+}
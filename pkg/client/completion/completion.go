@@ -0,0 +1,90 @@
+// Package completion generates scripts that complete the CLI's commands in
+// shells. The scripts ask the CLI itself for completions, by running the
+// command line so far with --generate-bash-completion, so that they can
+// complete the IDs of the user's instances and images as well as commands.
+package completion
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Shells are the shells that scripts can be generated for
+var Shells = []string{"bash", "zsh", "fish"}
+
+// flag is the flag with which the CLI prints completions rather than running
+// the command, as named by urfave/cli
+const flag = "--generate-bash-completion"
+
+const bashScript = `# bash completion for {{program}}
+# Add to ~/.bashrc: source <({{program}} completion bash)
+
+_{{name}}_complete() {
+    local cur opts
+    COMPREPLY=()
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    opts=$("${COMP_WORDS[0]}" "${COMP_WORDS[@]:1:$((COMP_CWORD - 1))}" {{flag}} 2>/dev/null)
+    COMPREPLY=( $(compgen -W "${opts}" -- "${cur}") )
+    return 0
+}
+
+complete -o default -F _{{name}}_complete {{program}}
+`
+
+const zshScript = `#compdef {{program}}
+# zsh completion for {{program}}
+# Add to ~/.zshrc: source <({{program}} completion zsh)
+
+_{{name}}() {
+    local -a opts
+    opts=("${(@f)$("${words[1]}" "${(@)words[2,CURRENT-1]}" {{flag}} 2>/dev/null)}")
+    opts=(${opts:#})
+    if (( ${#opts} )); then
+        compadd -a opts
+    else
+        _files
+    fi
+}
+
+compdef _{{name}} {{program}}
+`
+
+const fishScript = `# fish completion for {{program}}
+# Add to ~/.config/fish/config.fish: {{program}} completion fish | source
+
+function __{{name}}_complete
+    set -l args (commandline -opc)
+    $args[1] $args[2..-1] {{flag}} 2>/dev/null
+end
+
+complete -c {{program}} -f -a '(__{{name}}_complete)'
+`
+
+// Script returns the completion script of the program for the shell
+func Script(shell, program string) (string, error) {
+	var script string
+	switch shell {
+	case "bash":
+		script = bashScript
+	case "zsh":
+		script = zshScript
+	case "fish":
+		script = fishScript
+	default:
+		return "", fmt.Errorf("unknown shell %q, must be one of %s", shell, strings.Join(Shells, ", "))
+	}
+
+	// Shell function names can't contain every character that program names can
+	name := strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, program)
+
+	return strings.NewReplacer(
+		"{{program}}", program,
+		"{{name}}", name,
+		"{{flag}}", flag,
+	).Replace(script), nil
+}
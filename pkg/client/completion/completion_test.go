@@ -0,0 +1,32 @@
+package completion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScript(t *testing.T) {
+	for _, shell := range Shells {
+		script, err := Script(shell, "draupnir")
+
+		assert.Nil(t, err, shell)
+		assert.Contains(t, script, "draupnir", shell)
+		assert.Contains(t, script, "--generate-bash-completion", shell)
+		assert.NotContains(t, script, "{{", shell)
+	}
+}
+
+func TestScriptNamesFunctionsAfterProgram(t *testing.T) {
+	script, err := Script("bash", "draupnir-dev")
+
+	assert.Nil(t, err)
+	assert.Contains(t, script, "_draupnir_dev_complete() {")
+	assert.Contains(t, script, "complete -o default -F _draupnir_dev_complete draupnir-dev")
+}
+
+func TestScriptForUnknownShell(t *testing.T) {
+	_, err := Script("powershell", "draupnir")
+
+	assert.EqualError(t, err, `unknown shell "powershell", must be one of bash, zsh, fish`)
+}
@@ -3,6 +3,9 @@ package config
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/burntsushi/toml"
 	"golang.org/x/oauth2"
@@ -13,40 +16,183 @@ type Config struct {
 	Domain   string
 	Token    oauth2.Token
 	Database string
+	// KeyFile is the path of a service account key file to authenticate with,
+	// in place of Token, as set by `draupnir authenticate --key-file`
+	KeyFile string
+	// ClientCertificate and ClientKey are the paths of a PEM certificate and key
+	// to present to servers that require mutual TLS
+	ClientCertificate string
+	ClientKey         string
+	// Insecure connects to the server over plain HTTP, and SkipVerify doesn't
+	// verify its certificate, as the --insecure and --skip-verify flags do
+	Insecure   bool
+	SkipVerify bool
 }
 
-// Load parses the client config file
+// file is the layout of the config file: the default config, followed by the
+// config of each named profile
+type file struct {
+	Config
+	Profiles map[string]Config
+}
+
+// PlaceholderDomain is the domain of the config file that Load creates, until
+// it's set to the server's
+const PlaceholderDomain = "set-me-to-a-real-domain"
+
+// Load parses the client config file, creating it if it doesn't exist
 func Load() (Config, error) {
-	config := Config{Domain: "set-me-to-a-real-domain"}
-	file, err := os.Open(configFilePath())
+	config, err := Read()
+	if os.IsNotExist(err) {
+		config = Config{Domain: PlaceholderDomain}
+		err = Store(config)
+	}
+	return config, err
+}
+
+// Read parses the client config file, returning an error satisfying
+// os.IsNotExist if it doesn't exist
+func Read() (Config, error) {
+	return ReadProfile(os.Getenv("DRAUPNIR_PROFILE"))
+}
+
+// ReadProfile parses the config of the given profile, or the default config if
+// the profile is empty, returning an error satisfying os.IsNotExist if it
+// doesn't exist. Its token is loaded from wherever it was stored. Profiles are read from the [Profiles.<profile>] table of the
+// config file, unless the profile has a config file of its own, as they did
+// before profiles were kept together.
+func ReadProfile(profile string) (Config, error) {
+	config, err := readProfile(profile)
 	if err != nil {
-		if os.IsNotExist(err) {
-			err = nil
-			err = Store(config)
-			return config, err
-		}
 		return config, err
 	}
-	_, err = toml.DecodeReader(file, &config)
+	return loadToken(profile, config)
+}
+
+func readProfile(profile string) (Config, error) {
+	if profile != "" {
+		f, err := readFile(profileFilePath(profile))
+		if !os.IsNotExist(err) {
+			return f.Config, err
+		}
+	}
+
+	path := profileFilePath("")
+	f, err := readFile(path)
+	if profile == "" || err != nil {
+		return f.Config, err
+	}
+
+	config, ok := f.Profiles[profile]
+	if !ok {
+		return config, &os.PathError{Op: "read profile " + profile, Path: path, Err: os.ErrNotExist}
+	}
+	return config, nil
+}
+
+func readFile(path string) (file, error) {
+	var f file
+	fh, err := os.Open(path)
+	if err != nil {
+		return f, err
+	}
+	defer fh.Close()
+
+	_, err = toml.DecodeReader(fh, &f)
 	if err != nil {
 		// Older versions of .draupnir were JSON formatted
 		// TODO: remove this in a future major version
-		file.Seek(0, 0)
-		err = json.NewDecoder(file).Decode(&config)
+		fh.Seek(0, 0)
+		f = file{}
+		err = json.NewDecoder(fh).Decode(&f.Config)
 	}
-	return config, err
+	return f, err
 }
 
 // Store serialises the given config struct as TOML and saves it to disk
 func Store(config Config) error {
-	file, err := os.Create(configFilePath())
+	return StoreProfile(os.Getenv("DRAUPNIR_PROFILE"), config)
+}
+
+// StoreProfile saves the config of the given profile, or the default config if
+// the profile is empty, leaving the other profiles in the config file as they
+// are. The token is stored wherever TokenStorage says, rather than in the
+// config file.
+func StoreProfile(profile string, config Config) error {
+	config, err := storeToken(profile, config)
 	if err != nil {
 		return err
 	}
-	err = toml.NewEncoder(file).Encode(config)
-	return err
+
+	if profile != "" {
+		path := profileFilePath(profile)
+		if _, err := os.Stat(path); err == nil {
+			return writeFile(path, file{Config: config})
+		}
+	}
+
+	path := profileFilePath("")
+	f, err := readFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if profile == "" {
+		f.Config = config
+	} else {
+		if f.Profiles == nil {
+			f.Profiles = map[string]Config{}
+		}
+		f.Profiles[profile] = config
+	}
+	return writeFile(path, f)
+}
+
+func writeFile(path string, f file) error {
+	fh, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	return toml.NewEncoder(fh).Encode(f)
 }
 
-func configFilePath() string {
-	return os.Getenv("HOME") + "/.draupnir"
+// Profiles returns the names of every configured profile, sorted
+func Profiles() ([]string, error) {
+	names := map[string]bool{}
+
+	prefix := profileFilePath("") + "."
+	paths, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		names[strings.TrimPrefix(path, prefix)] = true
+	}
+
+	f, err := readFile(profileFilePath(""))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for name := range f.Profiles {
+		names[name] = true
+	}
+
+	profiles := []string{}
+	for name := range names {
+		profiles = append(profiles, name)
+	}
+	sort.Strings(profiles)
+	return profiles, nil
+}
+
+// profileFilePath returns the path of the config file, or of the config file of
+// its own that a profile may have
+func profileFilePath(profile string) string {
+	path := os.Getenv("HOME") + "/.draupnir"
+	if profile != "" {
+		path += "." + profile
+	}
+	return path
 }
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/client/keychain"
+)
+
+func withHome(t *testing.T) (string, func()) {
+	home, err := ioutil.TempDir("", "draupnir-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep tests away from the real keychain
+	previousKeychain := systemKeychain
+	systemKeychain = func() (keychain.Keychain, error) { return nil, keychain.ErrUnavailable }
+
+	previous := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	return home, func() {
+		systemKeychain = previousKeychain
+		os.Setenv("HOME", previous)
+		os.RemoveAll(home)
+	}
+}
+
+func TestProfilesShareTheConfigFile(t *testing.T) {
+	home, cleanup := withHome(t)
+	defer cleanup()
+
+	defaultCfg := Config{Domain: "draupnir.example.com", Token: oauth2.Token{RefreshToken: "default"}}
+	stagingCfg := Config{Domain: "localhost:8443", Token: oauth2.Token{RefreshToken: "staging"}, SkipVerify: true}
+
+	assert.Nil(t, StoreProfile("", defaultCfg))
+	assert.Nil(t, StoreProfile("staging", stagingCfg))
+
+	cfg, err := ReadProfile("")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultCfg, cfg)
+
+	cfg, err = ReadProfile("staging")
+	assert.Nil(t, err)
+	assert.Equal(t, stagingCfg, cfg)
+
+	// Storing the default config keeps the profiles
+	defaultCfg.Database = "payments"
+	assert.Nil(t, StoreProfile("", defaultCfg))
+
+	cfg, err = ReadProfile("staging")
+	assert.Nil(t, err)
+	assert.Equal(t, stagingCfg, cfg)
+
+	contents, err := ioutil.ReadFile(filepath.Join(home, ".draupnir"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(contents), "[Profiles.staging]")
+
+	paths, _ := filepath.Glob(filepath.Join(home, ".draupnir.*"))
+	assert.Empty(t, paths, "profiles don't get files of their own")
+}
+
+func TestProfileWithItsOwnFile(t *testing.T) {
+	home, cleanup := withHome(t)
+	defer cleanup()
+
+	err := ioutil.WriteFile(filepath.Join(home, ".draupnir.production"), []byte(`Domain = "draupnir.example.com"`), 0600)
+	assert.Nil(t, err)
+
+	cfg, err := ReadProfile("production")
+	assert.Nil(t, err)
+	assert.Equal(t, "draupnir.example.com", cfg.Domain)
+
+	cfg.Database = "payments"
+	assert.Nil(t, StoreProfile("production", cfg))
+
+	cfg, err = ReadProfile("production")
+	assert.Nil(t, err)
+	assert.Equal(t, "payments", cfg.Database)
+
+	_, err = os.Stat(filepath.Join(home, ".draupnir"))
+	assert.True(t, os.IsNotExist(err), "the profile is stored in its own file")
+}
+
+func TestReadMissingProfile(t *testing.T) {
+	_, cleanup := withHome(t)
+	defer cleanup()
+
+	_, err := ReadProfile("staging")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, StoreProfile("", Config{Domain: "draupnir.example.com"}))
+
+	_, err = ReadProfile("staging")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestProfiles(t *testing.T) {
+	home, cleanup := withHome(t)
+	defer cleanup()
+
+	profiles, err := Profiles()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, profiles)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(home, ".draupnir.production"), []byte(""), 0600))
+	assert.Nil(t, StoreProfile("staging", Config{}))
+	assert.Nil(t, StoreProfile("production", Config{}))
+
+	profiles, err = Profiles()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"production", "staging"}, profiles)
+}
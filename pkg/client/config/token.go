@@ -0,0 +1,164 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/client/keychain"
+)
+
+// Where tokens can be stored, as set by DRAUPNIR_TOKEN_STORAGE
+const (
+	TokenStorageKeychain  = "keychain"
+	TokenStorageFile      = "file"
+	TokenStoragePlaintext = "plaintext"
+)
+
+// PromptPassphrase, if set, is called for the passphrase of the encrypted token
+// file when DRAUPNIR_TOKEN_PASSPHRASE isn't set
+var PromptPassphrase func() (string, error)
+
+// systemKeychain is replaced in tests, so that they don't touch the real one
+var systemKeychain = keychain.System
+
+// TokenStorage returns where tokens are stored: wherever DRAUPNIR_TOKEN_STORAGE
+// says, or otherwise the system keychain if there is one, or otherwise a file
+// encrypted with a passphrase if it exists or a passphrase can be had. Failing
+// all of those, tokens are kept in plaintext in the config file, as they were
+// before.
+func TokenStorage() string {
+	if storage := os.Getenv("DRAUPNIR_TOKEN_STORAGE"); storage != "" {
+		return storage
+	}
+	if _, err := systemKeychain(); err == nil {
+		return TokenStorageKeychain
+	}
+	if _, err := os.Stat(tokenFile().Path); err == nil {
+		return TokenStorageFile
+	}
+	if os.Getenv("DRAUPNIR_TOKEN_PASSPHRASE") != "" || PromptPassphrase != nil {
+		return TokenStorageFile
+	}
+	return TokenStoragePlaintext
+}
+
+// tokenFile returns the encrypted file that tokens are stored in when there's
+// no keychain. Its name doesn't start with .draupnir., which would make it a
+// profile.
+func tokenFile() keychain.File {
+	return keychain.File{Path: profileFilePath("") + "-tokens", Passphrase: passphrase}
+}
+
+// passphrase is only asked for once, even if the token file is read and then
+// written
+var cachedPassphrase string
+
+func passphrase() (string, error) {
+	if p := os.Getenv("DRAUPNIR_TOKEN_PASSPHRASE"); p != "" {
+		return p, nil
+	}
+	if cachedPassphrase != "" {
+		return cachedPassphrase, nil
+	}
+	if PromptPassphrase == nil {
+		return "", errors.New("set DRAUPNIR_TOKEN_PASSPHRASE to decrypt the stored token")
+	}
+
+	p, err := PromptPassphrase()
+	if err != nil {
+		return "", err
+	}
+	if p == "" {
+		return "", errors.New("the passphrase can't be empty")
+	}
+	cachedPassphrase = p
+	return p, nil
+}
+
+// tokenAccount is the account that the profile's token is stored under. It
+// includes the path of the config file, so that a token is only used with the
+// config it was stored with.
+func tokenAccount(profile string) string {
+	account := profileFilePath("")
+	if profile != "" {
+		account += "[" + profile + "]"
+	}
+	return account
+}
+
+func hasToken(token oauth2.Token) bool {
+	return token.AccessToken != "" || token.RefreshToken != ""
+}
+
+// loadToken fills in the profile's token from the keychain or the token file,
+// unless the config file has a plaintext token
+func loadToken(profile string, config Config) (Config, error) {
+	if hasToken(config.Token) {
+		return config, nil
+	}
+
+	account := tokenAccount(profile)
+	secret, err := "", keychain.ErrNotFound
+	if kc, kcErr := systemKeychain(); kcErr == nil {
+		secret, err = kc.Get(account)
+	}
+	if err == keychain.ErrNotFound {
+		secret, err = tokenFile().Get(account)
+	}
+	if err == keychain.ErrNotFound {
+		return config, nil
+	}
+	if err != nil {
+		return config, fmt.Errorf("could not load token: %s", err)
+	}
+
+	if err := json.Unmarshal([]byte(secret), &config.Token); err != nil {
+		return config, fmt.Errorf("could not parse stored token: %s", err)
+	}
+	return config, nil
+}
+
+// storeToken moves the profile's token to wherever TokenStorage says, returning
+// the config to write to the config file
+func storeToken(profile string, config Config) (Config, error) {
+	account := tokenAccount(profile)
+	storage := TokenStorage()
+
+	var store keychain.Keychain
+	switch storage {
+	case TokenStoragePlaintext:
+		return config, nil
+	case TokenStorageFile:
+		store = tokenFile()
+	case TokenStorageKeychain:
+		var err error
+		if store, err = systemKeychain(); err != nil {
+			return config, fmt.Errorf("could not store token: %s; set DRAUPNIR_TOKEN_STORAGE=%s to use an encrypted file instead", err, TokenStorageFile)
+		}
+	default:
+		return config, fmt.Errorf("unknown DRAUPNIR_TOKEN_STORAGE %q: use %s, %s or %s", storage, TokenStorageKeychain, TokenStorageFile, TokenStoragePlaintext)
+	}
+
+	// A config without a token, e.g. a new one, mustn't pick up an old token
+	if !hasToken(config.Token) {
+		if err := store.Delete(account); err != nil {
+			return config, fmt.Errorf("could not remove stored token: %s", err)
+		}
+		return config, nil
+	}
+
+	secret, err := json.Marshal(config.Token)
+	if err != nil {
+		return config, err
+	}
+	if err := store.Set(account, string(secret)); err != nil {
+		return config, fmt.Errorf("could not store token: %s", err)
+	}
+
+	config.Token = oauth2.Token{}
+	return config, nil
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/client/keychain"
+)
+
+type fakeKeychain map[string]string
+
+func (k fakeKeychain) Get(account string) (string, error) {
+	secret, ok := k[account]
+	if !ok {
+		return "", keychain.ErrNotFound
+	}
+	return secret, nil
+}
+
+func (k fakeKeychain) Set(account, secret string) error {
+	k[account] = secret
+	return nil
+}
+
+func (k fakeKeychain) Delete(account string) error {
+	delete(k, account)
+	return nil
+}
+
+func withKeychain(k keychain.Keychain) {
+	systemKeychain = func() (keychain.Keychain, error) { return k, nil }
+}
+
+func withEnv(key, value string) func() {
+	previous := os.Getenv(key)
+	os.Setenv(key, value)
+	return func() { os.Setenv(key, previous) }
+}
+
+func TestTokenStorage(t *testing.T) {
+	_, cleanup := withHome(t)
+	defer cleanup()
+	defer withEnv("DRAUPNIR_TOKEN_STORAGE", "")()
+	defer withEnv("DRAUPNIR_TOKEN_PASSPHRASE", "")()
+
+	assert.Equal(t, TokenStoragePlaintext, TokenStorage())
+
+	PromptPassphrase = func() (string, error) { return "passphrase", nil }
+	defer func() { PromptPassphrase = nil }()
+	assert.Equal(t, TokenStorageFile, TokenStorage())
+
+	withKeychain(fakeKeychain{})
+	assert.Equal(t, TokenStorageKeychain, TokenStorage())
+
+	os.Setenv("DRAUPNIR_TOKEN_STORAGE", TokenStoragePlaintext)
+	assert.Equal(t, TokenStoragePlaintext, TokenStorage())
+}
+
+func TestTokensAreStoredInTheKeychain(t *testing.T) {
+	home, cleanup := withHome(t)
+	defer cleanup()
+	defer withEnv("DRAUPNIR_TOKEN_STORAGE", "")()
+
+	kc := fakeKeychain{}
+	withKeychain(kc)
+
+	defaultCfg := Config{Domain: "draupnir.example.com", Token: oauth2.Token{RefreshToken: "default-secret"}}
+	stagingCfg := Config{Domain: "localhost:8443", Token: oauth2.Token{RefreshToken: "staging-secret"}}
+	assert.Nil(t, StoreProfile("", defaultCfg))
+	assert.Nil(t, StoreProfile("staging", stagingCfg))
+
+	contents, err := ioutil.ReadFile(filepath.Join(home, ".draupnir"))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(contents), "secret")
+	assert.Contains(t, kc[filepath.Join(home, ".draupnir")], "default-secret")
+	assert.Contains(t, kc[filepath.Join(home, ".draupnir")+"[staging]"], "staging-secret")
+
+	cfg, err := ReadProfile("")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultCfg, cfg)
+
+	cfg, err = ReadProfile("staging")
+	assert.Nil(t, err)
+	assert.Equal(t, stagingCfg, cfg)
+
+	// Configs without tokens don't pick up old ones
+	assert.Nil(t, StoreProfile("staging", Config{Domain: "localhost:8443"}))
+	cfg, err = ReadProfile("staging")
+	assert.Nil(t, err)
+	assert.Equal(t, oauth2.Token{}, cfg.Token)
+}
+
+func TestPlaintextTokensAreMovedWhenStored(t *testing.T) {
+	home, cleanup := withHome(t)
+	defer cleanup()
+	defer withEnv("DRAUPNIR_TOKEN_STORAGE", "")()
+
+	err := ioutil.WriteFile(filepath.Join(home, ".draupnir"), []byte("Domain = \"draupnir.example.com\"\n[Token]\nRefreshToken = \"plaintext-secret\"\n"), 0600)
+	assert.Nil(t, err)
+
+	kc := fakeKeychain{}
+	withKeychain(kc)
+
+	cfg, err := ReadProfile("")
+	assert.Nil(t, err)
+	assert.Equal(t, "plaintext-secret", cfg.Token.RefreshToken)
+
+	assert.Nil(t, StoreProfile("", cfg))
+
+	contents, err := ioutil.ReadFile(filepath.Join(home, ".draupnir"))
+	assert.Nil(t, err)
+	assert.NotContains(t, string(contents), "plaintext-secret")
+
+	cfg, err = ReadProfile("")
+	assert.Nil(t, err)
+	assert.Equal(t, "plaintext-secret", cfg.Token.RefreshToken)
+}
+
+func TestTokensAreStoredInAnEncryptedFile(t *testing.T) {
+	home, cleanup := withHome(t)
+	defer cleanup()
+	defer withEnv("DRAUPNIR_TOKEN_STORAGE", "")()
+	defer withEnv("DRAUPNIR_TOKEN_PASSPHRASE", "")()
+
+	prompts := 0
+	PromptPassphrase = func() (string, error) {
+		prompts++
+		return "correct horse", nil
+	}
+	defer func() {
+		PromptPassphrase = nil
+		cachedPassphrase = ""
+	}()
+
+	cfg := Config{Domain: "draupnir.example.com", Token: oauth2.Token{RefreshToken: "default-secret"}}
+	assert.Nil(t, StoreProfile("", cfg))
+
+	for _, name := range []string{".draupnir", ".draupnir-tokens"} {
+		contents, err := ioutil.ReadFile(filepath.Join(home, name))
+		assert.Nil(t, err)
+		assert.NotContains(t, string(contents), "default-secret", name)
+	}
+
+	read, err := ReadProfile("")
+	assert.Nil(t, err)
+	assert.Equal(t, cfg, read)
+	assert.Equal(t, 1, prompts, "the passphrase is only asked for once")
+
+	profiles, err := Profiles()
+	assert.Nil(t, err)
+	assert.Empty(t, profiles, "the token file isn't a profile")
+
+	// Without the passphrase, the token can't be read, nor is it stored in
+	// plaintext
+	PromptPassphrase, cachedPassphrase = nil, ""
+	assert.Equal(t, TokenStorageFile, TokenStorage())
+	assert.EqualError(t, StoreProfile("", cfg), "could not store token: set DRAUPNIR_TOKEN_PASSPHRASE to decrypt the stored token")
+	_, err = ReadProfile("")
+	assert.EqualError(t, err, "could not load token: set DRAUPNIR_TOKEN_PASSPHRASE to decrypt the stored token")
+
+	os.Setenv("DRAUPNIR_TOKEN_PASSPHRASE", "correct horse")
+	read, err = ReadProfile("")
+	assert.Nil(t, err)
+	assert.Equal(t, cfg, read)
+}
+
+func TestStoringInAnUnavailableKeychain(t *testing.T) {
+	_, cleanup := withHome(t)
+	defer cleanup()
+	defer withEnv("DRAUPNIR_TOKEN_STORAGE", TokenStorageKeychain)()
+
+	err := StoreProfile("", Config{Token: oauth2.Token{RefreshToken: "secret"}})
+	assert.EqualError(t, err, "could not store token: no system keychain is available; set DRAUPNIR_TOKEN_STORAGE=file to use an encrypted file instead")
+}
@@ -0,0 +1,325 @@
+// Package doctor diagnoses the problems that most often stop the CLI from
+// working: the server being unreachable, the token being missing or rejected,
+// the client being incompatible with the server, and uploads over ssh being
+// refused. Each problem that it finds comes with what to do about it.
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/client"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+// Status is the outcome of a check
+type Status string
+
+const (
+	OK      Status = "ok"
+	Warning Status = "warn"
+	Failed  Status = "fail"
+	Skipped Status = "skip"
+)
+
+// The names of the checks, in the order that they're run
+const (
+	CheckServer  = "server"
+	CheckVersion = "version"
+	CheckToken   = "token"
+	CheckSSH     = "ssh upload"
+)
+
+// sshTimeout bounds how long connecting to the upload host can take
+const sshTimeout = 10 * time.Second
+
+// Result is the outcome of a check, and what to do about it
+type Result struct {
+	Check  string
+	Status Status
+	Detail string
+	// Fix is what the user should do about a warning or failure, if there's
+	// anything they can do
+	Fix string
+}
+
+// SSHTarget is where images are uploaded to over ssh
+type SSHTarget struct {
+	User    string
+	Host    string
+	KeyFile string
+}
+
+// Doctor runs the checks against a server
+type Doctor struct {
+	Client client.DraupnirClient
+	// ServerURL is the URL that Client connects to, or is empty if no server is
+	// configured
+	ServerURL     string
+	ClientVersion string
+	// Authenticated is whether there's a token or service account key to
+	// authenticate with
+	Authenticated bool
+	// CredentialsErr is why the token or key couldn't be loaded, if it couldn't
+	CredentialsErr error
+	// SSH, if set, is checked as the path that images are uploaded over
+	SSH *SSHTarget
+
+	// runSSH runs ssh, returning its exit code and what it wrote to stderr.
+	// It's replaced in tests.
+	runSSH func(ctx context.Context, args []string) (int, string, error)
+}
+
+// Run runs each of the checks in turn. Checks that need the server are skipped
+// if it can't be reached.
+func (d Doctor) Run(ctx context.Context) []Result {
+	server, reachable := d.checkServer()
+	results := []Result{server}
+
+	if reachable {
+		results = append(results, d.checkVersion(), d.checkToken())
+	} else {
+		for _, check := range []string{CheckVersion, CheckToken} {
+			results = append(results, Result{Check: check, Status: Skipped, Detail: "the server couldn't be reached"})
+		}
+	}
+
+	return append(results, d.checkSSH(ctx))
+}
+
+// AnyFailed reports whether any of the results is a failure
+func AnyFailed(results []Result) bool {
+	for _, result := range results {
+		if result.Status == Failed {
+			return true
+		}
+	}
+	return false
+}
+
+func (d Doctor) checkServer() (Result, bool) {
+	result := Result{Check: CheckServer}
+	if d.ServerURL == "" {
+		result.Status = Failed
+		result.Detail = "no server is configured"
+		result.Fix = "Set the server's domain with `draupnir config set domain <domain>`"
+		return result, false
+	}
+
+	_, err := d.Client.ServerVersion()
+	var incompatible *client.ErrIncompatibleServer
+	if err == nil || err == client.ErrVersionUnavailable || errors.As(err, &incompatible) {
+		result.Status = OK
+		result.Detail = fmt.Sprintf("reached %s", d.ServerURL)
+		return result, true
+	}
+
+	result.Status = Failed
+	result.Detail = fmt.Sprintf("couldn't reach %s: %s", d.ServerURL, err)
+	result.Fix = connectionFix(err)
+	return result, false
+}
+
+// connectionFix suggests what to do about an error connecting to the server
+func connectionFix(err error) string {
+	var dnsErr *net.DNSError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &dnsErr):
+		return "Check the domain with `draupnir config show`, and that you're on a network that can resolve it, e.g. the VPN"
+	case errors.As(err, &unknownAuthority), errors.As(err, &hostname), errors.As(err, &invalid):
+		return "The server's certificate isn't trusted. Check the domain with `draupnir config show`, and whether your network intercepts TLS"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "Check that you're on a network that can reach the server, e.g. the VPN"
+	default:
+		return "Check the domain with `draupnir config show`, and that the server is running"
+	}
+}
+
+func (d Doctor) checkVersion() Result {
+	result := Result{Check: CheckVersion}
+
+	serverVersion, err := d.Client.ServerVersion()
+	var incompatible *client.ErrIncompatibleServer
+	switch {
+	case errors.As(err, &incompatible):
+		serverVersion.ID = incompatible.ServerVersion
+	case err == client.ErrVersionUnavailable:
+		result.Status = Warning
+		result.Detail = fmt.Sprintf("client is %s, but the server doesn't report its version", d.ClientVersion)
+		result.Fix = "Ask the server's administrators to upgrade it"
+		return result
+	case err != nil:
+		result.Status = Failed
+		result.Detail = err.Error()
+		return result
+	}
+
+	clientMajor, clientMinor, clientPatch, clientErr := version.ParseSemver(d.ClientVersion)
+	serverMajor, serverMinor, serverPatch, serverErr := version.ParseSemver(serverVersion.ID)
+	if clientErr != nil || serverErr != nil {
+		result.Status = OK
+		result.Detail = fmt.Sprintf("client is %s and server is %s, which are development builds that can't be compared", d.ClientVersion, serverVersion.ID)
+		return result
+	}
+
+	result.Detail = fmt.Sprintf("client is %s and server is %s", d.ClientVersion, serverVersion.ID)
+	switch {
+	case clientMajor != serverMajor:
+		result.Status = Failed
+		result.Detail += ", which are incompatible"
+		if clientMajor < serverMajor {
+			result.Fix = fmt.Sprintf("Upgrade your client to %s", serverVersion.ID)
+		} else {
+			result.Fix = fmt.Sprintf("Use a %d.x client with this server", serverMajor)
+		}
+	case clientMinor > serverMinor:
+		result.Status = Warning
+		result.Detail += ", so features added since the server's version are unavailable"
+	case clientMinor < serverMinor || (clientMinor == serverMinor && clientPatch < serverPatch):
+		result.Status = Warning
+		result.Detail += ", so the client is out of date"
+		result.Fix = fmt.Sprintf("Upgrade your client to %s", serverVersion.ID)
+	default:
+		result.Status = OK
+	}
+	return result
+}
+
+func (d Doctor) checkToken() Result {
+	result := Result{Check: CheckToken}
+
+	if d.CredentialsErr != nil {
+		result.Status = Failed
+		result.Detail = fmt.Sprintf("couldn't load your credentials: %s", d.CredentialsErr)
+		result.Fix = "Run `draupnir authenticate --force`, or `draupnir authenticate --key-file` with a service account's key"
+		return result
+	}
+
+	if !d.Authenticated {
+		result.Status = Failed
+		result.Detail = "you haven't authenticated"
+		result.Fix = "Run `draupnir authenticate`"
+		return result
+	}
+
+	// Listing instances is the cheapest request that needs a valid token
+	_, err := d.Client.ListInstances(client.ListOptions{Limit: 1})
+	switch {
+	case err == nil:
+		result.Status = OK
+		result.Detail = "the server accepted your token"
+	case strings.HasPrefix(err.Error(), api.UnauthorizedError.Title):
+		result.Status = Failed
+		result.Detail = fmt.Sprintf("the server rejected your token: %s", err)
+		result.Fix = "Run `draupnir authenticate --force`"
+	default:
+		result.Status = Failed
+		result.Detail = fmt.Sprintf("couldn't check your token: %s", err)
+	}
+	return result
+}
+
+func (d Doctor) checkSSH(ctx context.Context) Result {
+	result := Result{Check: CheckSSH}
+
+	if d.SSH == nil {
+		result.Status = Skipped
+		result.Detail = "pass --ssh-key to check uploading images over ssh"
+		return result
+	}
+
+	target := fmt.Sprintf("%s@%s", d.SSH.User, d.SSH.Host)
+	if _, err := os.Stat(d.SSH.KeyFile); err != nil {
+		result.Status = Failed
+		result.Detail = fmt.Sprintf("can't read the key: %s", err)
+		result.Fix = "Pass the path of the key that you upload with to --ssh-key"
+		return result
+	}
+
+	run := d.runSSH
+	if run == nil {
+		run = runSSH
+	}
+
+	// The upload account may not be allowed to run commands, but it can only
+	// refuse to once we've authenticated, which is what's being checked
+	code, stderr, err := run(ctx, []string{
+		"-i", d.SSH.KeyFile,
+		"-o", "BatchMode=yes",
+		"-o", "IdentitiesOnly=yes",
+		"-o", fmt.Sprintf("ConnectTimeout=%d", int(sshTimeout.Seconds())),
+		target, "true",
+	})
+	if err != nil {
+		result.Status = Failed
+		result.Detail = fmt.Sprintf("couldn't run ssh: %s", err)
+		result.Fix = "Install OpenSSH's ssh client"
+		return result
+	}
+
+	// ssh exits with 255 if it couldn't connect or authenticate, and otherwise
+	// with the command's status
+	if code != 255 {
+		result.Status = OK
+		result.Detail = fmt.Sprintf("authenticated to %s", target)
+		return result
+	}
+
+	result.Status = Failed
+	result.Detail = fmt.Sprintf("couldn't connect to %s: %s", target, strings.TrimSpace(stderr))
+	result.Fix = sshFix(stderr)
+	return result
+}
+
+// sshFix suggests what to do about ssh failing, from what it wrote to stderr
+func sshFix(stderr string) string {
+	switch {
+	case strings.Contains(stderr, "Permission denied"):
+		return "Ask the server's administrators to authorise your key for uploads"
+	case strings.Contains(stderr, "Host key verification failed"):
+		return "Check the host's key, and add it to ~/.ssh/known_hosts by connecting once with ssh"
+	case strings.Contains(stderr, "Could not resolve hostname"):
+		return "Check the host, and that you're on a network that can resolve it, e.g. the VPN"
+	case strings.Contains(stderr, "timed out"), strings.Contains(stderr, "Connection refused"):
+		return "Check that you're on a network that can reach the host on port 22, e.g. the VPN"
+	default:
+		return ""
+	}
+}
+
+func runSSH(ctx context.Context, args []string) (int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*sshTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return 255, "ssh timed out", nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), stderr.String(), nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	return 0, stderr.String(), nil
+}
@@ -0,0 +1,152 @@
+package doctor
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/server/api/client/clientfakes"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+// withServerVersion sets the version that fake clients report for the duration
+// of the test
+func withServerVersion(t *testing.T, serverVersion string) {
+	previous := version.Version
+	version.Version = serverVersion
+	t.Cleanup(func() { version.Version = previous })
+}
+
+func TestRunHealthy(t *testing.T) {
+	withServerVersion(t, "5.2.0")
+
+	doctor := Doctor{
+		Client:        clientfakes.NewFakeClient("test@draupnir"),
+		ServerURL:     "https://draupnir.example.com",
+		ClientVersion: "5.2.0",
+		Authenticated: true,
+	}
+
+	results := doctor.Run(context.Background())
+	assert.Equal(t, []Result{
+		{Check: CheckServer, Status: OK, Detail: "reached https://draupnir.example.com"},
+		{Check: CheckVersion, Status: OK, Detail: "client is 5.2.0 and server is 5.2.0"},
+		{Check: CheckToken, Status: OK, Detail: "the server accepted your token"},
+		{Check: CheckSSH, Status: Skipped, Detail: "pass --ssh-key to check uploading images over ssh"},
+	}, results)
+	assert.False(t, AnyFailed(results))
+}
+
+func TestRunUnreachableServer(t *testing.T) {
+	fake := clientfakes.NewFakeClient("test@draupnir")
+	fake.Err = &net.DNSError{Err: "no such host", Name: "draupnir.example.com", IsNotFound: true}
+
+	doctor := Doctor{Client: fake, ServerURL: "https://draupnir.example.com", Authenticated: true}
+
+	results := doctor.Run(context.Background())
+	assert.Equal(t, Failed, results[0].Status)
+	assert.Contains(t, results[0].Fix, "resolve")
+	assert.Equal(t, Skipped, results[1].Status)
+	assert.Equal(t, Skipped, results[2].Status)
+	assert.True(t, AnyFailed(results))
+}
+
+func TestRunWithoutServer(t *testing.T) {
+	results := Doctor{}.Run(context.Background())
+	assert.Equal(t, Failed, results[0].Status)
+	assert.Equal(t, "Set the server's domain with `draupnir config set domain <domain>`", results[0].Fix)
+}
+
+func TestCheckVersion(t *testing.T) {
+	withServerVersion(t, "5.2.1")
+
+	for _, tc := range []struct {
+		clientVersion string
+		status        Status
+		fix           string
+	}{
+		{"5.2.1", OK, ""},
+		{"5.3.0", Warning, ""},
+		{"5.2.0", Warning, "Upgrade your client to 5.2.1"},
+		{"5.1.9", Warning, "Upgrade your client to 5.2.1"},
+		{"4.9.0", Failed, "Upgrade your client to 5.2.1"},
+		{"6.0.0", Failed, "Use a 5.x client with this server"},
+		{"dev", OK, ""},
+	} {
+		doctor := Doctor{Client: clientfakes.NewFakeClient("test@draupnir"), ClientVersion: tc.clientVersion}
+
+		result := doctor.checkVersion()
+		assert.Equal(t, tc.status, result.Status, tc.clientVersion)
+		assert.Equal(t, tc.fix, result.Fix, tc.clientVersion)
+	}
+}
+
+func TestCheckTokenUnauthenticated(t *testing.T) {
+	doctor := Doctor{Client: clientfakes.NewFakeClient("test@draupnir")}
+
+	result := doctor.checkToken()
+	assert.Equal(t, Failed, result.Status)
+	assert.Equal(t, "Run `draupnir authenticate`", result.Fix)
+}
+
+func TestCheckTokenRejected(t *testing.T) {
+	fake := clientfakes.NewFakeClient("test@draupnir")
+	fake.Err = errors.New("Unauthorized (refresh token is invalid)")
+
+	doctor := Doctor{Client: fake, Authenticated: true}
+
+	result := doctor.checkToken()
+	assert.Equal(t, Failed, result.Status)
+	assert.Equal(t, "Run `draupnir authenticate --force`", result.Fix)
+}
+
+func TestCheckSSH(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctor")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte("key"), 0600))
+
+	for _, tc := range []struct {
+		name   string
+		code   int
+		stderr string
+		status Status
+		fix    string
+	}{
+		{"authenticated", 0, "", OK, ""},
+		{"commands refused", 1, "This service allows sftp connections only.", OK, ""},
+		{"key refused", 255, "upload@draupnir.example.com: Permission denied (publickey).", Failed, "Ask the server's administrators to authorise your key for uploads"},
+		{"unknown host", 255, "Host key verification failed.", Failed, "Check the host's key, and add it to ~/.ssh/known_hosts by connecting once with ssh"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			doctor := Doctor{
+				SSH: &SSHTarget{User: "upload", Host: "draupnir.example.com", KeyFile: keyFile},
+				runSSH: func(ctx context.Context, args []string) (int, string, error) {
+					assert.Equal(t, keyFile, args[1])
+					assert.Equal(t, "upload@draupnir.example.com", args[len(args)-2])
+					return tc.code, tc.stderr, nil
+				},
+			}
+
+			result := doctor.checkSSH(context.Background())
+			assert.Equal(t, tc.status, result.Status)
+			assert.Equal(t, tc.fix, result.Fix)
+		})
+	}
+}
+
+func TestCheckSSHMissingKey(t *testing.T) {
+	doctor := Doctor{SSH: &SSHTarget{User: "upload", Host: "draupnir.example.com", KeyFile: "/nonexistent/key.pem"}}
+
+	result := doctor.checkSSH(context.Background())
+	assert.Equal(t, Failed, result.Status)
+	assert.Equal(t, "Pass the path of the key that you upload with to --ssh-key", result.Fix)
+}
@@ -0,0 +1,35 @@
+//go:build darwin || linux || freebsd || netbsd || openbsd
+// +build darwin linux freebsd netbsd openbsd
+
+package keychain
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// run runs the command with the given stdin, returning its stdout and, if it
+// failed, its exit code, which is -1 if it couldn't be run. Secrets are passed
+// on stdin rather than as arguments, which other users could see.
+func run(cmd *exec.Cmd, stdin string) (string, int, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return stdout.String(), 0, nil
+	}
+
+	code := -1
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		err = fmt.Errorf("%s: %s", err, msg)
+	}
+	return stdout.String(), code, err
+}
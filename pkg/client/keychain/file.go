@@ -0,0 +1,192 @@
+package keychain
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// check is encrypted alongside the secrets, so that a wrong passphrase is
+// noticed before a secret is stored with it
+var check = []byte(Service)
+
+// File stores secrets in a file encrypted with a passphrase, for machines
+// without a keychain. The key is derived from the passphrase with scrypt, and
+// each secret is encrypted with AES-256-GCM.
+type File struct {
+	Path string
+	// Passphrase returns the passphrase, e.g. by prompting the user for it. It's
+	// only called when a secret is encrypted or decrypted.
+	Passphrase func() (string, error)
+}
+
+// fileContents is the layout of the file. Accounts aren't secret, so that
+// looking up an account without a secret doesn't need the passphrase.
+type fileContents struct {
+	Salt    []byte            `json:"salt"`
+	Check   []byte            `json:"check"`
+	Secrets map[string][]byte `json:"secrets"`
+}
+
+func (f File) Get(account string) (string, error) {
+	contents, err := f.read()
+	if err != nil {
+		return "", err
+	}
+	sealed, ok := contents.Secrets[account]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	aead, err := f.cipher(contents)
+	if err != nil {
+		return "", err
+	}
+	secret, err := open(aead, sealed)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt secret in %s: %s", f.Path, err)
+	}
+	return string(secret), nil
+}
+
+func (f File) Set(account, secret string) error {
+	contents, err := f.read()
+	if err != nil {
+		return err
+	}
+
+	if contents.Salt == nil {
+		contents.Salt = make([]byte, 32)
+		if _, err := rand.Read(contents.Salt); err != nil {
+			return err
+		}
+	}
+	aead, err := f.cipher(contents)
+	if err != nil {
+		return err
+	}
+	if contents.Check == nil {
+		if contents.Check, err = seal(aead, check); err != nil {
+			return err
+		}
+	}
+
+	if contents.Secrets[account], err = seal(aead, []byte(secret)); err != nil {
+		return err
+	}
+	return f.write(contents)
+}
+
+func (f File) Delete(account string) error {
+	contents, err := f.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := contents.Secrets[account]; !ok {
+		return nil
+	}
+
+	delete(contents.Secrets, account)
+	return f.write(contents)
+}
+
+func (f File) read() (fileContents, error) {
+	contents := fileContents{Secrets: map[string][]byte{}}
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return contents, nil
+	}
+	if err != nil {
+		return contents, err
+	}
+
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return contents, fmt.Errorf("could not parse %s: %s", f.Path, err)
+	}
+	if contents.Secrets == nil {
+		contents.Secrets = map[string][]byte{}
+	}
+	return contents, nil
+}
+
+// write replaces the file atomically, so that it's never left half written
+func (f File) write(contents fileContents) error {
+	data, err := json.Marshal(contents)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), filepath.Base(f.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// TempFile creates files that only the user can read
+	return os.Rename(tmp.Name(), f.Path)
+}
+
+// cipher derives the key from the passphrase, checking it against the file's
+// check value if it has one
+func (f File) cipher(contents fileContents) (cipher.AEAD, error) {
+	if f.Passphrase == nil {
+		return nil, errors.New("no passphrase for " + f.Path)
+	}
+	passphrase, err := f.Passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), contents.Salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if contents.Check != nil {
+		if plaintext, err := open(aead, contents.Check); err != nil || !bytes.Equal(plaintext, check) {
+			return nil, fmt.Errorf("wrong passphrase for %s", f.Path)
+		}
+	}
+	return aead, nil
+}
+
+// seal encrypts the plaintext with a random nonce, which it's prefixed with
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
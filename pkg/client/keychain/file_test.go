@@ -0,0 +1,67 @@
+package keychain
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func passphrase(p string) func() (string, error) {
+	return func() (string, error) { return p, nil }
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir-keychain")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens")
+	file := File{Path: path, Passphrase: passphrase("correct horse")}
+
+	_, err = file.Get("alice")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, file.Set("alice", "alice's secret"))
+	assert.Nil(t, file.Set("bob", "bob's secret"))
+
+	secret, err := file.Get("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, "alice's secret", secret)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	contents, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(contents), "alice's secret")
+
+	wrong := File{Path: path, Passphrase: passphrase("battery staple")}
+	_, err = wrong.Get("alice")
+	assert.EqualError(t, err, "wrong passphrase for "+path)
+	assert.EqualError(t, wrong.Set("carol", "carol's secret"), "wrong passphrase for "+path)
+
+	assert.Nil(t, file.Delete("alice"))
+	_, err = file.Get("alice")
+	assert.Equal(t, ErrNotFound, err)
+
+	secret, err = file.Get("bob")
+	assert.Nil(t, err)
+	assert.Equal(t, "bob's secret", secret)
+}
+
+func TestFileOnlyAsksForThePassphraseWhenNeeded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir-keychain")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	file := File{Path: filepath.Join(dir, "tokens")}
+
+	_, err = file.Get("alice")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, file.Delete("alice"))
+	assert.EqualError(t, file.Set("alice", "secret"), "no passphrase for "+file.Path)
+}
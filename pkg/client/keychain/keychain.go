@@ -0,0 +1,32 @@
+// Package keychain stores secrets, such as the client's OAuth tokens, outside
+// of plaintext config files: in the operating system's keychain where there is
+// one, and otherwise in a file encrypted with a passphrase
+package keychain
+
+import "errors"
+
+// Service is the name that secrets are stored under in the system keychain
+const Service = "draupnir"
+
+// ErrNotFound is returned when an account has no secret
+var ErrNotFound = errors.New("secret not found")
+
+// ErrUnavailable is returned by System if there's no keychain that we can use
+var ErrUnavailable = errors.New("no system keychain is available")
+
+// Keychain stores a secret for each account
+type Keychain interface {
+	// Get returns the account's secret, or ErrNotFound if it has none
+	Get(account string) (string, error)
+	// Set stores the account's secret, replacing any that it had
+	Set(account, secret string) error
+	// Delete removes the account's secret, if it has one
+	Delete(account string) error
+}
+
+// System returns the operating system's keychain: the macOS Keychain, the
+// Secret Service (e.g. GNOME Keyring or KWallet) or the Windows Credential
+// Manager. It returns ErrUnavailable if there isn't one that we can use.
+func System() (Keychain, error) {
+	return system()
+}
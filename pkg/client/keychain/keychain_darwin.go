@@ -0,0 +1,68 @@
+package keychain
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// errSecItemNotFound is the exit code of security(1) when there's no item
+const errSecItemNotFound = 44
+
+// macOSKeychain stores secrets as generic passwords in the user's default
+// keychain, with security(1)
+type macOSKeychain struct {
+	path string
+}
+
+func system() (Keychain, error) {
+	path, err := exec.LookPath("security")
+	if err != nil {
+		return nil, ErrUnavailable
+	}
+	return macOSKeychain{path: path}, nil
+}
+
+func (k macOSKeychain) Get(account string) (string, error) {
+	out, code, err := run(exec.Command(k.path, "find-generic-password", "-s", Service, "-a", account, "-w"), "")
+	if code == errSecItemNotFound {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(out, "\n"), nil
+}
+
+func (k macOSKeychain) Set(account, secret string) error {
+	if strings.ContainsAny(account, "\"\\\n") {
+		return fmt.Errorf("invalid keychain account %q", account)
+	}
+
+	// security only reads passwords from stdin when prompting for them, so the
+	// command is given on stdin in interactive mode, keeping the secret off its
+	// arguments. It exits successfully even if the command fails, but reports
+	// the failure on stderr.
+	command := fmt.Sprintf("add-generic-password -U -s %s -a \"%s\" -X %s\n", Service, account, hex.EncodeToString([]byte(secret)))
+	cmd := exec.Command(k.path, "-i")
+	var stderr strings.Builder
+	cmd.Stdin = strings.NewReader(command)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("could not store secret in keychain: %s", msg)
+	}
+	return nil
+}
+
+func (k macOSKeychain) Delete(account string) error {
+	_, code, err := run(exec.Command(k.path, "delete-generic-password", "-s", Service, "-a", account), "")
+	if code == errSecItemNotFound {
+		return nil
+	}
+	return err
+}
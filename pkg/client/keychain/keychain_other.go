@@ -0,0 +1,8 @@
+//go:build !darwin && !linux && !freebsd && !netbsd && !openbsd && !windows
+// +build !darwin,!linux,!freebsd,!netbsd,!openbsd,!windows
+
+package keychain
+
+func system() (Keychain, error) {
+	return nil, ErrUnavailable
+}
@@ -0,0 +1,72 @@
+//go:build linux || freebsd || netbsd || openbsd
+// +build linux freebsd netbsd openbsd
+
+package keychain
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSecretTool behaves like secret-tool, storing each secret in a file named
+// after its account
+const fakeSecretTool = `#!/bin/sh
+store="$(dirname "$0")/secrets"
+mkdir -p "$store"
+case "$1" in
+  store) shift 3; cat > "$store/$4" ;;
+  lookup) [ -f "$store/$5" ] || exit 1; cat "$store/$5" ;;
+  clear) [ -f "$store/$5" ] || exit 1; rm "$store/$5" ;;
+esac
+`
+
+func withFakeSecretTool(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "draupnir-keychain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret-tool"), []byte(fakeSecretTool), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	path, bus := os.Getenv("PATH"), os.Getenv("DBUS_SESSION_BUS_ADDRESS")
+	os.Setenv("PATH", dir+":"+path)
+	os.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path=/dev/null")
+	return func() {
+		os.Setenv("PATH", path)
+		os.Setenv("DBUS_SESSION_BUS_ADDRESS", bus)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSecretService(t *testing.T) {
+	defer withFakeSecretTool(t)()
+
+	keychain, err := System()
+	assert.Nil(t, err)
+
+	_, err = keychain.Get("alice")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, keychain.Set("alice", "secret\nwith a newline"))
+	secret, err := keychain.Get("alice")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret\nwith a newline", secret)
+
+	assert.Nil(t, keychain.Delete("alice"))
+	assert.Nil(t, keychain.Delete("alice"), "deleting a missing secret succeeds")
+	_, err = keychain.Get("alice")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSecretServiceWithoutSessionBus(t *testing.T) {
+	defer withFakeSecretTool(t)()
+	os.Setenv("DBUS_SESSION_BUS_ADDRESS", "")
+
+	_, err := System()
+	assert.Equal(t, ErrUnavailable, err)
+}
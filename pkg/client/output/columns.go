@@ -0,0 +1,187 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ParseColumns splits a comma separated list of columns, such as the value of
+// --columns, ignoring spaces and empty columns
+func ParseColumns(value string) []string {
+	var columns []string
+	for _, column := range strings.Split(value, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// Select returns the records with only the given columns, in that order when
+// they're written as a table. Columns that no record has are an error, so that
+// typos aren't silently printed as empty columns.
+func Select(records []map[string]interface{}, columns []string) ([]map[string]interface{}, error) {
+	if err := checkColumns(records, columns); err != nil {
+		return nil, err
+	}
+
+	selected := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		row := make(map[string]interface{}, len(columns))
+		for _, column := range columns {
+			row[column] = record[column]
+		}
+		selected = append(selected, row)
+	}
+	return selected, nil
+}
+
+// Sort sorts a slice of models in place by one of the fields of their
+// records, such as expires_at. The order is reversed if the field starts with
+// a -, e.g. -created_at. Models without the field, or with it null, come last
+// either way, and models with equal fields keep their order.
+func Sort(models interface{}, field string) error {
+	records, err := Records(models)
+	if err != nil {
+		return err
+	}
+
+	descending := strings.HasPrefix(field, "-")
+	field = strings.TrimPrefix(field, "-")
+	if err := checkColumns(records, []string{field}); err != nil {
+		return err
+	}
+
+	order := make([]int, len(records))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := records[order[i]][field], records[order[j]][field]
+		if a == nil || b == nil {
+			return a != nil && b == nil
+		}
+		if descending {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+
+	value := reflect.ValueOf(models)
+	sorted := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+	for i, index := range order {
+		sorted.Index(i).Set(value.Index(index))
+	}
+	reflect.Copy(value, sorted)
+
+	return nil
+}
+
+// less compares two non-null values of a record's field. Numbers are compared
+// as numbers, and everything else, including timestamps, which are formatted
+// as RFC 3339, as it's formatted in a table.
+func less(a, b interface{}) bool {
+	x, xNumeric := number(a)
+	y, yNumeric := number(b)
+	if xNumeric && yNumeric {
+		return x < y
+	}
+	return cell(a) < cell(b)
+}
+
+func number(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+// WriteTable writes the records as a table with a column for each of the given
+// columns, headed by the column's name in upper case
+func WriteTable(w io.Writer, records []map[string]interface{}, columns []string) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = strings.ToUpper(column)
+	}
+	fmt.Fprintln(table, strings.Join(header, "\t"))
+
+	for _, record := range records {
+		row := make([]string, len(columns))
+		for i, column := range columns {
+			row[i] = cell(record[column])
+		}
+		fmt.Fprintln(table, strings.Join(row, "\t"))
+	}
+
+	return table.Flush()
+}
+
+// cell formats a value for a table. Nulls are empty, and lists are joined with
+// commas. Anything else that isn't a string or a number, such as annotations,
+// is written as JSON.
+func cell(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	case []interface{}:
+		cells := make([]string, len(v))
+		for i, item := range v {
+			cells[i] = cell(item)
+		}
+		return strings.Join(cells, ",")
+	}
+
+	if _, ok := number(value); ok {
+		return fmt.Sprint(value)
+	}
+	if encoded, err := json.Marshal(value); err == nil {
+		return string(encoded)
+	}
+	return fmt.Sprint(value)
+}
+
+// checkColumns returns an error if any of the columns is missing from every
+// record. Any column is allowed if there are no records, as there's nothing to
+// check it against.
+func checkColumns(records []map[string]interface{}, columns []string) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	known := map[string]bool{}
+	for _, record := range records {
+		for column := range record {
+			known[column] = true
+		}
+	}
+
+	for _, column := range columns {
+		if !known[column] {
+			names := make([]string, 0, len(known))
+			for name := range known {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown column %q, must be one of %s", column, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
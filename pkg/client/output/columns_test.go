@@ -0,0 +1,77 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestParseColumns(t *testing.T) {
+	assert.Equal(t, []string{"id", "image_id", "port"}, ParseColumns("id, image_id,,port"))
+	assert.Nil(t, ParseColumns(""))
+}
+
+func TestSelect(t *testing.T) {
+	records := []map[string]interface{}{
+		{"id": 1, "image_id": 2, "port": 5432},
+		{"id": 2, "image_id": 3, "port": 5433},
+	}
+
+	selected, err := Select(records, []string{"port", "id"})
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{{"port": 5432, "id": 1}, {"port": 5433, "id": 2}}, selected)
+
+	_, err = Select(records, []string{"prot"})
+	assert.EqualError(t, err, `unknown column "prot", must be one of id, image_id, port`)
+}
+
+func TestSort(t *testing.T) {
+	soon := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	later := soon.Add(time.Hour)
+	instances := []models.Instance{
+		{ID: 1, Port: 5434, ExpiresAt: &later},
+		{ID: 2, Port: 5432},
+		{ID: 3, Port: 10000, ExpiresAt: &soon},
+	}
+
+	ids := func() []int {
+		var ids []int
+		for _, instance := range instances {
+			ids = append(ids, instance.ID)
+		}
+		return ids
+	}
+
+	assert.Nil(t, Sort(instances, "port"))
+	assert.Equal(t, []int{2, 1, 3}, ids(), "ports are compared as numbers")
+
+	assert.Nil(t, Sort(instances, "-port"))
+	assert.Equal(t, []int{3, 1, 2}, ids())
+
+	assert.Nil(t, Sort(instances, "expires_at"))
+	assert.Equal(t, []int{3, 1, 2}, ids(), "instances that never expire come last")
+
+	assert.Nil(t, Sort(instances, "-expires_at"))
+	assert.Equal(t, []int{1, 3, 2}, ids())
+
+	err := Sort(instances, "age")
+	assert.Contains(t, err.Error(), `unknown column "age"`)
+}
+
+func TestWriteTableColumns(t *testing.T) {
+	records := []map[string]interface{}{
+		{"id": 1, "image_id": 2, "expires_at": nil, "shard_dsns": []string{"a", "b"}},
+		{"id": 12, "image_id": 3, "expires_at": "2016-01-01T12:00:00Z", "shard_dsns": []string{}},
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, WriteTable(&out, records, []string{"id", "image_id", "expires_at", "shard_dsns"}))
+	assert.Equal(t, `ID  IMAGE_ID  EXPIRES_AT            SHARD_DSNS
+1   2                               a,b
+12  3         2016-01-01T12:00:00Z  
+`, out.String())
+}
@@ -0,0 +1,226 @@
+// Package output formats the resources that the CLI prints as JSON or YAML,
+// so that scripts can parse them rather than scraping the human format
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/jsonapi"
+
+	"github.com/gocardless/draupnir/pkg/models/extras"
+)
+
+// The formats that the CLI prints resources in. Table is the human format,
+// which each command prints itself.
+const (
+	Table = "table"
+	JSON  = "json"
+	YAML  = "yaml"
+)
+
+// Formats are all the formats, in the order they're listed in help
+var Formats = []string{Table, JSON, YAML}
+
+// Check returns an error if the format isn't one of Formats
+func Check(format string) error {
+	for _, f := range Formats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format %q, must be one of %s", format, strings.Join(Formats, ", "))
+}
+
+// Record converts a model, such as a *models.Image, to an object with the
+// model's ID and each of its attributes, named as they are in the API. Numeric
+// IDs are numbers, as they are in the human format. Relationships, such as an
+// instance's credentials, are left out. Attributes that the model doesn't know
+// about, because they were added by a newer server, are kept.
+func Record(model interface{}) (map[string]interface{}, error) {
+	// jsonapi only marshals pointers to models
+	if value := reflect.ValueOf(model); value.Kind() == reflect.Struct {
+		pointer := reflect.New(value.Type())
+		pointer.Elem().Set(value)
+		model = pointer.Interface()
+	}
+
+	payload, err := extras.MarshalOne(model)
+	if err != nil {
+		return nil, err
+	}
+	return record(payload.Data), nil
+}
+
+// Records converts a slice of models, or of pointers to them, in the same way
+// as Record
+func Records(models interface{}) ([]map[string]interface{}, error) {
+	value := reflect.ValueOf(models)
+	if value.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("expected a slice of models, got %T", models)
+	}
+
+	records := make([]map[string]interface{}, 0, value.Len())
+	for i := 0; i < value.Len(); i++ {
+		record, err := Record(value.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+func record(node *jsonapi.Node) map[string]interface{} {
+	record := make(map[string]interface{}, len(node.Attributes)+1)
+	for name, value := range node.Attributes {
+		record[name] = value
+	}
+
+	if id, err := strconv.Atoi(node.ID); err == nil {
+		record["id"] = id
+	} else {
+		record["id"] = node.ID
+	}
+
+	return record
+}
+
+// Write writes the value, which is usually a record or a slice of them, in the
+// format. Table isn't supported, as each command prints its own.
+func Write(w io.Writer, format string, value interface{}) error {
+	switch format {
+	case JSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case YAML:
+		// Round trip through JSON, so that we only have to handle the types that
+		// it decodes to, and so that values are formatted in the same way
+		var buffer bytes.Buffer
+		if err := json.NewEncoder(&buffer).Encode(value); err != nil {
+			return err
+		}
+
+		decoder := json.NewDecoder(&buffer)
+		decoder.UseNumber()
+
+		var generic interface{}
+		if err := decoder.Decode(&generic); err != nil {
+			return err
+		}
+
+		var out strings.Builder
+		writeYAML(&out, generic, 0)
+		_, err := io.WriteString(w, out.String())
+		return err
+	default:
+		return fmt.Errorf("can't write %q output", format)
+	}
+}
+
+// writeYAML writes a value decoded from JSON as block style YAML, starting on
+// the current line. Strings are always double quoted, which YAML reads in the
+// same way as JSON.
+func writeYAML(out *strings.Builder, value interface{}, indent int) {
+	prefix := strings.Repeat("  ", indent)
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			out.WriteString("{}\n")
+			return
+		}
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for i, key := range keys {
+			if i > 0 {
+				out.WriteString(prefix)
+			}
+			out.WriteString(keyYAML(key) + ":")
+			writeNestedYAML(out, v[key], indent)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			out.WriteString("[]\n")
+			return
+		}
+
+		for i, item := range v {
+			if i > 0 {
+				out.WriteString(prefix)
+			}
+			out.WriteString("- ")
+			writeYAML(out, item, indent+1)
+		}
+	default:
+		out.WriteString(scalarYAML(v) + "\n")
+	}
+}
+
+// writeNestedYAML writes the value of a mapping's key, which follows the key
+// on the same line if it's a scalar or empty
+func writeNestedYAML(out *strings.Builder, value interface{}, indent int) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) > 0 {
+			out.WriteString("\n" + strings.Repeat("  ", indent+1))
+			writeYAML(out, v, indent+1)
+			return
+		}
+	case []interface{}:
+		if len(v) > 0 {
+			out.WriteString("\n" + strings.Repeat("  ", indent+1))
+			writeYAML(out, v, indent+1)
+			return
+		}
+	}
+
+	out.WriteString(" ")
+	writeYAML(out, value, indent+1)
+}
+
+// plainKey matches keys that YAML reads as strings without quoting them
+var plainKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// keyYAML returns the key as is if it can't be mistaken for anything other
+// than a string, or quoted otherwise
+func keyYAML(key string) string {
+	switch strings.ToLower(key) {
+	case "true", "false", "yes", "no", "on", "off", "y", "n", "null":
+		return scalarYAML(key)
+	}
+	if plainKey.MatchString(key) {
+		return key
+	}
+	return scalarYAML(key)
+}
+
+func scalarYAML(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		quoted, _ := json.Marshal(v)
+		return string(quoted)
+	default:
+		return fmt.Sprintf("%q", fmt.Sprint(v))
+	}
+}
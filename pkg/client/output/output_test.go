@@ -0,0 +1,111 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/models/extras"
+)
+
+func TestRecords(t *testing.T) {
+	timestamp := time.Date(2016, 1, 1, 12, 33, 44, 0, time.UTC)
+	instances := []models.Instance{
+		{
+			ID:        1,
+			ImageID:   2,
+			Hostname:  "draupnir.example.com",
+			Port:      5432,
+			CreatedAt: timestamp,
+			UpdatedAt: timestamp,
+			Credentials: &models.InstanceCredentials{
+				ClientKey: "secret",
+			},
+		},
+	}
+
+	records, err := Records(instances)
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+
+	record := records[0]
+	assert.Equal(t, 1, record["id"])
+	assert.Equal(t, 2, record["image_id"])
+	assert.Equal(t, "draupnir.example.com", record["hostname"])
+	assert.Equal(t, "2016-01-01T12:33:44Z", record["created_at"])
+	assert.NotContains(t, record, "credentials")
+	assert.NotContains(t, record, "client_key")
+}
+
+func TestRecordKeepsUnknownAttributes(t *testing.T) {
+	image := models.Image{ID: 1, Extras: extras.Attributes{"tags": map[string]interface{}{"team": "payments"}}}
+
+	record, err := Record(image)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"team": "payments"}, record["tags"])
+}
+
+func TestRecordsOfNonSlice(t *testing.T) {
+	_, err := Records(models.Image{})
+	assert.EqualError(t, err, "expected a slice of models, got models.Image")
+}
+
+func TestCheck(t *testing.T) {
+	assert.Nil(t, Check("table"))
+	assert.Nil(t, Check("json"))
+	assert.Nil(t, Check("yaml"))
+	assert.EqualError(t, Check("xml"), `unknown output format "xml", must be one of table, json, yaml`)
+}
+
+func TestWriteJSON(t *testing.T) {
+	var out bytes.Buffer
+	err := Write(&out, JSON, []map[string]interface{}{{"id": 1, "ready": true}})
+	assert.Nil(t, err)
+	assert.Equal(t, "[\n  {\n    \"id\": 1,\n    \"ready\": true\n  }\n]\n", out.String())
+}
+
+func TestWriteYAML(t *testing.T) {
+	records := []map[string]interface{}{
+		{
+			"id":          1,
+			"ready":       true,
+			"anon":        nil,
+			"shards":      []string{"one", "two"},
+			"annotations": map[string]string{"on": "Team \"A\"", "team.name": "A"},
+			"labels":      map[string]string{},
+			"dsns":        []string{},
+		},
+		{"id": 2, "size": 1.5},
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, Write(&out, YAML, records))
+	assert.Equal(t, `- annotations:
+    "on": "Team \"A\""
+    "team.name": "A"
+  anon: null
+  dsns: []
+  id: 1
+  labels: {}
+  ready: true
+  shards:
+    - "one"
+    - "two"
+- id: 2
+  size: 1.5
+`, out.String())
+}
+
+func TestWriteYAMLEmpty(t *testing.T) {
+	var out bytes.Buffer
+	assert.Nil(t, Write(&out, YAML, []map[string]interface{}{}))
+	assert.Equal(t, "[]\n", out.String())
+}
+
+func TestWriteTable(t *testing.T) {
+	var out bytes.Buffer
+	assert.EqualError(t, Write(&out, Table, nil), `can't write "table" output`)
+}
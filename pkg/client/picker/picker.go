@@ -0,0 +1,247 @@
+// Package picker lets the user choose an image or instance from a list that's
+// filtered as they type, for commands that are run without an ID
+package picker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Height is the number of items shown at once
+const Height = 10
+
+// ErrCancelled is returned if the user cancels the picker, with Escape or
+// Ctrl-C
+var ErrCancelled = errors.New("cancelled")
+
+// Item is something that can be picked, such as an image
+type Item struct {
+	ID string
+	// Label is what's shown and searched, e.g. the output of ImageToString
+	Label string
+}
+
+// Interactive reports whether the user can pick, which requires both stdin and
+// stderr to be a terminal. The picker is drawn on stderr, so that stdout can
+// still be captured, e.g. by eval $(draupnir env).
+func Interactive() bool {
+	return terminal.IsTerminal(int(os.Stdin.Fd())) && terminal.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// Pick shows the items on stderr, in the order given, and returns the one the
+// user picks
+func Pick(prompt string, items []Item) (Item, error) {
+	state, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return Item{}, err
+	}
+	defer terminal.Restore(int(os.Stdin.Fd()), state)
+
+	return pick(os.Stdin, os.Stderr, prompt, items)
+}
+
+// Match reports whether each character of the query appears in the label, in
+// order and ignoring case. Spaces in the query are ignored, so "3 true"
+// matches "3 [ 2020-01-01T00:00:00Z - READY:  true ]".
+func Match(label, query string) bool {
+	label = strings.ToLower(label)
+	for _, r := range strings.ToLower(query) {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		i := strings.IndexRune(label, r)
+		if i < 0 {
+			return false
+		}
+		label = label[i+utf8.RuneLen(r):]
+	}
+	return true
+}
+
+// Filter returns the items whose labels match the query, in the order given
+func Filter(items []Item, query string) []Item {
+	matches := []Item{}
+	for _, item := range items {
+		if Match(item.Label, query) {
+			matches = append(matches, item)
+		}
+	}
+	return matches
+}
+
+// The keys that the picker handles, other than those that edit the query
+type key int
+
+const (
+	keyRune key = iota
+	keyUp
+	keyDown
+	keyBackspace
+	keyClear
+	keyEnter
+	keyCancel
+	keyIgnored
+)
+
+// readKey returns the first key in buf, and the number of bytes it takes up.
+// Terminals send escape sequences in a single write, so an escape at the end
+// of buf is the Escape key itself.
+func readKey(buf []byte) (key, rune, int) {
+	switch b := buf[0]; {
+	case b == 0x1b:
+		if len(buf) == 1 {
+			return keyCancel, 0, 1
+		}
+		// Arrows are sent as ESC [ A or, in application mode, ESC O A
+		if len(buf) >= 3 && (buf[1] == '[' || buf[1] == 'O') {
+			switch buf[2] {
+			case 'A':
+				return keyUp, 0, 3
+			case 'B':
+				return keyDown, 0, 3
+			}
+			return keyIgnored, 0, 3
+		}
+		return keyIgnored, 0, 2
+	case b == 0x03 || b == 0x04: // Ctrl-C, Ctrl-D
+		return keyCancel, 0, 1
+	case b == '\r' || b == '\n':
+		return keyEnter, 0, 1
+	case b == 0x7f || b == 0x08: // Backspace, Ctrl-H
+		return keyBackspace, 0, 1
+	case b == 0x10: // Ctrl-P
+		return keyUp, 0, 1
+	case b == 0x0e: // Ctrl-N
+		return keyDown, 0, 1
+	case b == 0x15: // Ctrl-U
+		return keyClear, 0, 1
+	case b < 0x20:
+		return keyIgnored, 0, 1
+	}
+
+	r, size := utf8.DecodeRune(buf)
+	if r == utf8.RuneError {
+		return keyIgnored, 0, size
+	}
+	return keyRune, r, size
+}
+
+type state struct {
+	items   []Item
+	query   []rune
+	matches []Item
+	// cursor is the index of the selected match, and offset the index of the
+	// first match shown
+	cursor, offset int
+}
+
+// handle updates the state after a key is pressed, returning true once the
+// user has picked an item or cancelled
+func (s *state) handle(k key, r rune) (done bool, err error) {
+	switch k {
+	case keyRune:
+		s.query = append(s.query, r)
+		s.filter()
+	case keyBackspace:
+		if len(s.query) > 0 {
+			s.query = s.query[:len(s.query)-1]
+			s.filter()
+		}
+	case keyClear:
+		s.query = nil
+		s.filter()
+	case keyUp:
+		if s.cursor > 0 {
+			s.cursor--
+		}
+	case keyDown:
+		if s.cursor < len(s.matches)-1 {
+			s.cursor++
+		}
+	case keyEnter:
+		return len(s.matches) > 0, nil
+	case keyCancel:
+		return true, ErrCancelled
+	}
+
+	// Scroll so that the cursor is shown
+	if s.cursor < s.offset {
+		s.offset = s.cursor
+	} else if s.cursor >= s.offset+Height {
+		s.offset = s.cursor - Height + 1
+	}
+	return false, nil
+}
+
+func (s *state) filter() {
+	s.matches = Filter(s.items, string(s.query))
+	s.cursor, s.offset = 0, 0
+}
+
+// render draws the prompt and the matches shown, with the selected match
+// marked, leaving the terminal's cursor at the end of the prompt
+func (s *state) render(w io.Writer, prompt string) {
+	var b strings.Builder
+	// Lines end with \r\n, as the terminal is in raw mode
+	fmt.Fprintf(&b, "\r\x1b[J%s %s\r\n", prompt, string(s.query))
+	fmt.Fprintf(&b, "  %d/%d", len(s.matches), len(s.items))
+
+	lines := 1
+	for i := s.offset; i < len(s.matches) && i < s.offset+Height; i++ {
+		marker := " "
+		if i == s.cursor {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "\r\n%s %s", marker, s.matches[i].Label)
+		lines++
+	}
+
+	fmt.Fprintf(&b, "\x1b[%dA\r\x1b[%dC", lines, utf8.RuneCountInString(prompt)+1+len(s.query))
+	io.WriteString(w, b.String())
+}
+
+// pick reads keys from r, which should be a terminal in raw mode, and draws the
+// picker on w
+func pick(r io.Reader, w io.Writer, prompt string, items []Item) (Item, error) {
+	if len(items) == 0 {
+		return Item{}, errors.New("there is nothing to pick from")
+	}
+
+	s := &state{items: items}
+	s.filter()
+	s.render(w, prompt)
+	// Clear the picker once it's done with
+	defer io.WriteString(w, "\r\x1b[J")
+
+	buf := make([]byte, 64)
+	for {
+		n, err := r.Read(buf)
+		if err == io.EOF && n == 0 {
+			return Item{}, ErrCancelled
+		}
+		if err != nil && err != io.EOF {
+			return Item{}, err
+		}
+
+		for chunk := buf[:n]; len(chunk) > 0; {
+			k, char, size := readKey(chunk)
+			chunk = chunk[size:]
+
+			done, err := s.handle(k, char)
+			if err != nil {
+				return Item{}, err
+			}
+			if done {
+				return s.matches[s.cursor], nil
+			}
+		}
+		s.render(w, prompt)
+	}
+}
@@ -0,0 +1,100 @@
+package picker
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var items = []Item{
+	{ID: "3", Label: " 3 [ 2020-03-01T00:00:00Z - READY:  true ]"},
+	{ID: "2", Label: " 2 [ 2020-02-01T00:00:00Z - READY: false ]"},
+	{ID: "1", Label: " 1 [ 2020-01-01T00:00:00Z - READY:  true ]"},
+}
+
+func TestMatch(t *testing.T) {
+	testCases := []struct {
+		query string
+		match bool
+	}{
+		{"", true},
+		{"3", true},
+		{"2020-03", true},
+		{"0201", true},
+		{"READY: TRUE", true},
+		{"3 true", true},
+		{"true 3", false},
+		{"2019", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.query, func(t *testing.T) {
+			assert.Equal(t, tc.match, Match(items[0].Label, tc.query))
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	assert.Equal(t, []Item{items[0], items[2]}, Filter(items, "true"))
+	assert.Equal(t, []Item{}, Filter(items, "2019"))
+}
+
+func TestPick(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		id    string
+		err   error
+	}{
+		{"first item", "\r", "3", nil},
+		{"arrow keys", "\x1b[B\x1b[B\x1b[A\r", "2", nil},
+		{"application mode arrow keys", "\x1bOB\r", "2", nil},
+		{"ctrl-n", "\x0e\x0e\x0e\x0e\r", "1", nil},
+		{"search", "true\x0e\r", "1", nil},
+		{"backspace", "false\x7f\x7f\x7f\x7f\x7f\x0e\r", "2", nil},
+		{"ctrl-u", "2019\x15\r", "3", nil},
+		{"enter without matches", "2019\r\x7f\x7f\x7f\x7f\r", "3", nil},
+		{"escape", "\x1b", "", ErrCancelled},
+		{"ctrl-c", "\x03", "", ErrCancelled},
+		{"end of input", "true", "", ErrCancelled},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			item, err := pick(strings.NewReader(tc.input), &out, "image>", items)
+
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.id, item.ID)
+			assert.True(t, strings.HasSuffix(out.String(), "\r\x1b[J"), "the picker is cleared")
+		})
+	}
+}
+
+func TestPickWithoutItems(t *testing.T) {
+	_, err := pick(strings.NewReader("\r"), &bytes.Buffer{}, "image>", []Item{})
+	assert.EqualError(t, err, "there is nothing to pick from")
+}
+
+func TestPickScrolls(t *testing.T) {
+	many := []Item{}
+	for i := 0; i < 2*Height; i++ {
+		many = append(many, Item{ID: fmt.Sprint(i), Label: fmt.Sprintf("item %d", i)})
+	}
+
+	s := &state{items: many}
+	s.filter()
+	for i := 0; i < Height; i++ {
+		s.handle(keyDown, 0)
+	}
+
+	var out bytes.Buffer
+	s.render(&out, ">")
+	assert.Contains(t, out.String(), "20/20")
+	assert.NotContains(t, out.String(), "  item 0\r")
+	assert.Contains(t, out.String(), "  item 1\r")
+	assert.Contains(t, out.String(), "> item 10")
+}
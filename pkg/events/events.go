@@ -0,0 +1,110 @@
+// Package events broadcasts changes to images and instances to the clients that
+// are watching them, so that they don't need to poll for changes, and changes to
+// access requests to the webhooks that notify their approvers.
+package events
+
+import (
+	"sync"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// The types of change that an event records
+const (
+	Created   = "created"
+	Updated   = "updated"
+	Destroyed = "destroyed"
+	// Finalised is an update to an image that made it ready
+	Finalised = "finalised"
+	// FinalisationFailed is an attempt to finalise an image that failed. The
+	// image is unchanged, and Error is why it couldn't be finalised.
+	FinalisationFailed = "finalisation_failed"
+)
+
+// subscriberBuffer is the number of events that a subscriber can fall behind by
+// before it's unsubscribed
+const subscriberBuffer = 64
+
+// Event records a change to an image, an instance or an access request. Exactly
+// one of Image, Instance and AccessRequest is set, to the resource as it was
+// after the change (or, when it was destroyed, as it was before).
+type Event struct {
+	Type          string
+	Image         *models.Image
+	Instance      *models.Instance
+	AccessRequest *models.AccessRequest
+	Error         string
+}
+
+func ImageEvent(eventType string, image models.Image) Event {
+	return Event{Type: eventType, Image: &image}
+}
+
+// FinalisationFailedEvent records that the image couldn't be finalised
+func FinalisationFailedEvent(image models.Image, err error) Event {
+	return Event{Type: FinalisationFailed, Image: &image, Error: err.Error()}
+}
+
+func InstanceEvent(eventType string, instance models.Instance) Event {
+	return Event{Type: eventType, Instance: &instance}
+}
+
+// AccessRequestEvent records that an access request was created, or updated
+// when it was approved or denied
+func AccessRequestEvent(eventType string, request models.AccessRequest) Event {
+	return Event{Type: eventType, AccessRequest: &request}
+}
+
+// Broker fans out each event that's published to every subscriber. A nil
+// *Broker discards the events that are published to it.
+type Broker struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{subscribers: make(map[chan Event]struct{})}
+}
+
+// Publish sends the event to every subscriber without blocking. Subscribers
+// that have fallen too far behind to receive it are unsubscribed, so that a
+// slow client can't hold up the server.
+func (b *Broker) Publish(event Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// Subscribe returns a channel of the events published from now on, and a
+// function that unsubscribes from them. The channel is closed once
+// unsubscribed, including when the subscriber falls behind, after which it
+// should list the resources again before resubscribing.
+func (b *Broker) Subscribe() (<-chan Event, func()) {
+	subscriber := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subscribers[subscriber] = struct{}{}
+	b.mu.Unlock()
+
+	return subscriber, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[subscriber]; ok {
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
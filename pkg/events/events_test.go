@@ -0,0 +1,51 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBroker(t *testing.T) {
+	broker := NewBroker()
+
+	first, unsubscribeFirst := broker.Subscribe()
+	second, unsubscribeSecond := broker.Subscribe()
+	defer unsubscribeSecond()
+
+	broker.Publish(ImageEvent(Created, models.Image{ID: 1}))
+	unsubscribeFirst()
+	broker.Publish(InstanceEvent(Destroyed, models.Instance{ID: 2}))
+
+	assert.Equal(t, ImageEvent(Created, models.Image{ID: 1}), <-first)
+	_, open := <-first
+	assert.False(t, open, "unsubscribing closes the channel")
+
+	assert.Equal(t, ImageEvent(Created, models.Image{ID: 1}), <-second)
+	assert.Equal(t, InstanceEvent(Destroyed, models.Instance{ID: 2}), <-second)
+
+	// Unsubscribing twice is harmless
+	unsubscribeFirst()
+}
+
+func TestBrokerUnsubscribesSlowSubscribers(t *testing.T) {
+	broker := NewBroker()
+	events, unsubscribe := broker.Subscribe()
+	defer unsubscribe()
+
+	for id := 0; id <= subscriberBuffer; id++ {
+		broker.Publish(ImageEvent(Updated, models.Image{ID: id}))
+	}
+
+	received := 0
+	for range events {
+		received++
+	}
+	assert.Equal(t, subscriberBuffer, received)
+}
+
+func TestNilBroker(t *testing.T) {
+	var broker *Broker
+	broker.Publish(ImageEvent(Created, models.Image{ID: 1}))
+}
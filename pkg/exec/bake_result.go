@@ -0,0 +1,71 @@
+package exec
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The classes of error that draupnir-finalise-image reports in its result
+// file. Anonymisation and finalise option errors are caused by what the user
+// asked for, and are worth reporting back to them; the rest, including errors
+// in the server's synthetic data configuration, are our problem.
+const (
+	ErrorClassAnonymisation   = "anonymisation"
+	ErrorClassFinaliseOptions = "finalise_options"
+	ErrorClassSyntheticData   = "synthetic_data"
+	ErrorClassPostgres        = "postgres"
+	ErrorClassStorage         = "storage"
+	ErrorClassInternal        = "internal"
+)
+
+// BakeResult is the result that draupnir-finalise-image writes to its result
+// file when it exits, describing the step that it ended in and why it failed
+type BakeResult struct {
+	Phase       string `json:"phase"`
+	ExitCode    int    `json:"exit_code"`
+	ErrorClass  string `json:"error_class"`
+	Diagnostics string `json:"diagnostics"`
+}
+
+// BakeError is returned when draupnir-finalise-image fails and reports why
+type BakeError struct {
+	Result BakeResult
+}
+
+func (e BakeError) Error() string {
+	message := fmt.Sprintf(
+		"%s error during %s (exit code %d)",
+		e.Result.ErrorClass, e.Result.Phase, e.Result.ExitCode,
+	)
+	if e.Result.Diagnostics != "" {
+		message += ": " + e.Result.Diagnostics
+	}
+	return message
+}
+
+// ErrorClass returns the class of the error, which is recorded against the bake
+// span and job that it failed
+func (e BakeError) ErrorClass() string {
+	return e.Result.ErrorClass
+}
+
+// IsUserError reports whether the error was caused by the image's anonymisation
+// script or finalise options, rather than by the server
+func (e BakeError) IsUserError() bool {
+	return e.Result.ErrorClass == ErrorClassAnonymisation ||
+		e.Result.ErrorClass == ErrorClassFinaliseOptions
+}
+
+// parseBakeResult parses a result file written by draupnir-finalise-image. It
+// fails if the file is empty, which happens if the script was killed before it
+// could write it.
+func parseBakeResult(contents []byte) (BakeResult, error) {
+	var result BakeResult
+	if err := json.Unmarshal(contents, &result); err != nil {
+		return result, fmt.Errorf("invalid bake result %q: %s", contents, err)
+	}
+	if result.Phase == "" {
+		return result, fmt.Errorf("bake result has no phase: %q", contents)
+	}
+	return result, nil
+}
@@ -8,24 +8,70 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/redact"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/synthetic"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/log"
 )
 
 type Executor interface {
 	CreateBtrfsSubvolume(ctx context.Context, id int) error
+	CreateShardUploadSlots(ctx context.Context, id int, shards []string) error
+	CreateWorkerUploadSlots(ctx context.Context, id int, workers []string) error
+	ImageUploadSize(ctx context.Context, id int) (int64, error)
+	AppendImageUpload(ctx context.Context, id int, offset int64, r io.Reader) (int64, error)
 	FinaliseImage(ctx context.Context, image models.Image) error
-	CreateInstance(ctx context.Context, imageID int, instanceID int, port int) error
+	ResetImage(ctx context.Context, id int) error
+	CreateInstance(ctx context.Context, imageID int, instanceID int, port int, address string, schemaOnly bool) error
+	SnapshotImageBase(ctx context.Context, id int) error
+	HasImageBase(ctx context.Context, id int) (bool, error)
+	CreateStandbyInstance(ctx context.Context, imageID int, instanceID int, port int) error
+	PromoteInstance(ctx context.Context, instance models.Instance, anon string) error
+	RestartInstance(ctx context.Context, instance models.Instance) error
+	RotateInstanceCredentials(ctx context.Context, instance models.Instance) error
+	RunMaintenance(ctx context.Context, instance models.Instance, operation MaintenanceOperation) (string, error)
 	RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error)
 	DestroyImage(ctx context.Context, id int) error
 	DestroyInstance(ctx context.Context, id int) error
+	RetrieveImageDiskUsage(ctx context.Context, id int) (models.DiskUsage, error)
+	InspectImageUpload(ctx context.Context, id int) (models.ImageInspection, error)
+	InspectImageSnapshot(ctx context.Context, id int) (models.ImageInspection, error)
+	RetrieveImageSettings(ctx context.Context, id int) ([]models.CloneSetting, error)
+	ReadImageFile(ctx context.Context, id int, name string) (models.ImageFile, error)
+	ReadImageUploadFile(ctx context.Context, id int, path string) (models.ImageFile, error)
+	SendImage(ctx context.Context, id int, parentID int, w io.Writer) error
+	ReceiveImageStream(ctx context.Context, id int, r io.Reader) error
+	RetrieveInstanceDiskUsage(ctx context.Context, id int) (models.DiskUsage, error)
+	RetrievePoolUsage(ctx context.Context) (models.PoolUsage, error)
+	InspectInstanceActivity(ctx context.Context, instance models.Instance) (models.InstanceActivity, error)
+	StreamInstanceLog(ctx context.Context, id int, lines int, follow bool, w io.Writer) error
 }
 
 type OSExecutor struct {
 	DataPath string
+	// StandbyRestoreCommand is the restore_command with which standby instances
+	// fetch WAL from the source database's archive
+	StandbyRestoreCommand string
+	// InstanceAddressInterface is the network interface that instances' address
+	// aliases are added to
+	InstanceAddressInterface string
+	// SyntheticHook, if set, returns a script that's run against each image
+	// after it has been anonymised, to pad its tables with synthetic rows
+	SyntheticHook synthetic.Hook
+	// SchemaOnlyKeepTables names the tables, in any schema, that keep their rows
+	// in schema-only instances, such as the table of applied migrations
+	SchemaOnlyKeepTables []string
+	// Redaction is applied to the diagnostics of failed finalisations, which
+	// are returned to clients and sent to webhooks
+	Redaction redact.Policy
 }
 
 func GetLogger(ctx context.Context) log.Logger {
@@ -39,6 +85,13 @@ func GetLogger(ctx context.Context) log.Logger {
 }
 
 func runCommandAndLog(logger log.Logger, message string, command *exec.Cmd) error {
+	_, err := runCommandAndLogOutput(logger, message, command)
+	return err
+}
+
+// runCommandAndLogOutput behaves like runCommandAndLog, but also returns the
+// stdout of the command so that it can be parsed by the caller
+func runCommandAndLogOutput(logger log.Logger, message string, command *exec.Cmd) ([]byte, error) {
 	// Execute our command, which gives us stdout and an exit error
 	outputBytes, err := command.Output()
 	// Always log stdout
@@ -57,7 +110,7 @@ func runCommandAndLog(logger log.Logger, message string, command *exec.Cmd) erro
 	}
 	logger.Info(message)
 
-	return err
+	return outputBytes, err
 }
 
 // CreateBtrfsSubvolume creates a BTRFS subvolume in $(DataPath)/image_uploads
@@ -84,18 +137,156 @@ func (e OSExecutor) CreateBtrfsSubvolume(ctx context.Context, id int) error {
 	return nil
 }
 
+// CreateShardUploadSlots creates a directory in the image's upload subvolume
+// for each shard, into which the shard's pg_dump should be uploaded. As with
+// the subvolume, the permissions are set to 775 so that 'upload' can write to
+// them.
+func (e OSExecutor) CreateShardUploadSlots(ctx context.Context, id int, shards []string) error {
+	if err := e.createUploadSlots(id, "shards", shards); err != nil {
+		return err
+	}
+
+	GetLogger(ctx).With("imageID", id).With("shards", strings.Join(shards, ",")).Info("Created shard upload slots")
+	return nil
+}
+
+// CreateWorkerUploadSlots creates a directory in the image's upload subvolume
+// for each worker of a distributed image, into which the worker's base backup
+// should be uploaded in the same way as the coordinator's is uploaded into
+// the subvolume itself
+func (e OSExecutor) CreateWorkerUploadSlots(ctx context.Context, id int, workers []string) error {
+	if err := e.createUploadSlots(id, "workers", workers); err != nil {
+		return err
+	}
+
+	GetLogger(ctx).With("imageID", id).With("workers", strings.Join(workers, ",")).Info("Created worker upload slots")
+	return nil
+}
+
+// createUploadSlots creates a directory named after each of the names beneath
+// parent in the image's upload subvolume
+func (e OSExecutor) createUploadSlots(id int, parent string, names []string) error {
+	path := filepath.Join(e.DataPath, "image_uploads", fmt.Sprintf("%d", id), parent)
+
+	for _, name := range names {
+		slot := filepath.Join(path, name)
+		if err := os.MkdirAll(slot, 0775); err != nil {
+			return err
+		}
+
+		// MkdirAll is subject to the umask, so set the permissions explicitly
+		for _, dir := range []string{path, slot} {
+			if err := os.Chmod(dir, os.ModeDir|0775); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ImageUploadArchive is the name of the tarball that images streamed through
+// the API are written to. draupnir-start-image extracts it, as it would a
+// tarball uploaded over SSH.
+const ImageUploadArchive = "base.tar"
+
+// ErrUploadOffsetMismatch is returned when appending to an image upload at an
+// offset other than its current size
+var ErrUploadOffsetMismatch = errors.New("upload offset doesn't match the size of the upload")
+
+// ErrUploadInProgress is returned when appending to an image upload that is
+// already being appended to by another request
+var ErrUploadInProgress = errors.New("upload is already in progress")
+
+// ErrImageStarted is returned when appending to an image upload once the image
+// has been started, at which point its tarball has already been extracted
+var ErrImageStarted = errors.New("image has already been started")
+
+// ImageUploadSize returns the number of bytes of the image's tarball that have
+// been streamed so far, which is the offset from which to resume the upload
+func (e OSExecutor) ImageUploadSize(ctx context.Context, id int) (int64, error) {
+	info, err := os.Stat(e.imageUploadArchivePath(id))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// AppendImageUpload writes the contents of r to the image's tarball, starting at
+// offset, which must be the current size of the upload. It returns the size of
+// the upload once it has finished writing, including when r fails part way
+// through, so that the upload can be resumed from there.
+func (e OSExecutor) AppendImageUpload(ctx context.Context, id int, offset int64, r io.Reader) (int64, error) {
+	path := e.imageUploadArchivePath(id)
+	logger := GetLogger(ctx).With("imageID", id).With("path", path)
+
+	_, err := os.Stat(filepath.Join(filepath.Dir(path), ".draupnir-start-image"))
+	if err == nil {
+		return 0, ErrImageStarted
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0664)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// The lock is released when the file is closed
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return 0, ErrUploadInProgress
+		}
+		return 0, err
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if size != offset {
+		return size, ErrUploadOffsetMismatch
+	}
+
+	written, err := io.Copy(file, r)
+	size += written
+	logger.With("offset", offset).With("written", written).Info("Appended to image upload")
+	if err != nil {
+		return size, err
+	}
+
+	return size, file.Close()
+}
+
+func (e OSExecutor) imageUploadArchivePath(id int) string {
+	return filepath.Join(e.DataPath, "image_uploads", fmt.Sprintf("%d", id), ImageUploadArchive)
+}
+
 // FinaliseImage runs draupnir-finalise_image against the image
 // This does the following things:
 // - Gives ownership of the image directory to postgres
 // - Sets the permissions to 700 so postgres will start
 // - Removes postmaster.* files
-// - Starts postgres
+// - Starts postgres, restoring each shard if the image is sharded
+// - Starts each worker and points the coordinator at it, if it's distributed
+// - Drops any unwanted databases
 // - Runs anonymisation function
+// - Pads tables with synthetic rows, if SyntheticHook generates a script
+// - Converts databases to the requested encoding and locale, and renames them
+// - Records foreign servers, user mappings and dblink calls for RetrieveImageSettings
 // - Stops postgres
 // - Creates a snapshot of the image directory
 // This snapshot is the finalised image
 //
 // draupnir-finalise-image is a separate script because it has to run with sudo.
+// If it fails, the error is a BakeError describing the step that failed, read
+// from the result file that it writes.
 func (e OSExecutor) FinaliseImage(ctx context.Context, image models.Image) error {
 	anonFile, err := ioutil.TempFile("/tmp", "draupnir")
 	if err != nil {
@@ -114,40 +305,319 @@ func (e OSExecutor) FinaliseImage(ctx context.Context, image models.Image) error
 
 	logger := GetLogger(ctx).With("imageID", image.ID)
 
-	cmd := exec.CommandContext(
-		ctx,
-		"sudo",
-		"draupnir-finalise-image",
+	// The script writes its result here, so that we can tell why it failed
+	// without parsing its output
+	resultFile, err := ioutil.TempFile("/tmp", "draupnir-result")
+	if err != nil {
+		return err
+	}
+	resultFile.Close()
+	defer os.Remove(resultFile.Name())
+
+	args := []string{"draupnir-finalise-image"}
+	args = append(args, finaliseOptionArgs(image)...)
+	args = append(args, "--result-file", resultFile.Name())
+
+	if e.SyntheticHook != nil {
+		script, err := e.SyntheticHook.Script(image)
+		if err != nil {
+			return errors.Wrap(err, "failed to generate synthetic data script")
+		}
+		if script != "" {
+			syntheticFile, err := writeTempFile("draupnir-synthetic", script)
+			if err != nil {
+				return err
+			}
+			defer os.Remove(syntheticFile)
+			args = append(args, "--synthetic-file", syntheticFile)
+		}
+	}
+
+	args = append(args,
 		e.DataPath,
 		fmt.Sprintf("%d", image.ID),
 		fmt.Sprintf("%d", 5432+image.ID),
 		anonFile.Name(),
 	)
+	args = append(args, image.Shards...)
+
+	cmd := exec.CommandContext(ctx, "sudo", args...)
 
 	err = runCommandAndLog(logger, "Finalised image", cmd)
 	if err != nil {
-		return err
+		return bakeError(logger, resultFile.Name(), err, e.Redaction)
 	}
 
 	logger.With("file", anonFile.Name()).Info("Removing anonymisation file")
 	return os.Remove(anonFile.Name())
 }
 
-func (e OSExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int) error {
-	logger := GetLogger(ctx).With("imageID", imageID).With("instanceID", instanceID).With("port", port)
+// RestartInstance restarts the instance's postgres, or starts it if it has
+// stopped, e.g. because it crashed
+func (e OSExecutor) RestartInstance(ctx context.Context, instance models.Instance) error {
+	logger := GetLogger(ctx).With("instanceID", instance.ID)
 
-	cmd := exec.Command(
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-restart-instance",
+		e.DataPath,
+		fmt.Sprintf("%d", instance.ID),
+		fmt.Sprintf("%d", instance.Port),
+	)
+
+	return runCommandAndLog(logger, "Restarted instance", cmd)
+}
+
+// RotateInstanceCredentials replaces the instance's certificate authority and
+// its server and client certificates, so that the old client certificate can
+// no longer be used to connect to it
+func (e OSExecutor) RotateInstanceCredentials(ctx context.Context, instance models.Instance) error {
+	logger := GetLogger(ctx).With("instanceID", instance.ID)
+
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-rotate-instance-credentials",
+		e.DataPath,
+		fmt.Sprintf("%d", instance.ID),
+	)
+
+	return runCommandAndLog(logger, "Rotated instance credentials", cmd)
+}
+
+// writeTempFile writes the contents to a new file in /tmp, and returns its path
+func writeTempFile(prefix string, contents string) (string, error) {
+	file, err := ioutil.TempFile("/tmp", prefix)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.WriteString(file, contents); err != nil {
+		return "", err
+	}
+	return file.Name(), file.Sync()
+}
+
+// bakeError returns a BakeError describing why draupnir-finalise-image failed,
+// read from its result file. If the script didn't write a result (e.g. because
+// it was killed), the error that it exited with is returned instead. The
+// diagnostics come from the anonymisation script, so they're redacted.
+func bakeError(logger log.Logger, resultPath string, err error, redaction redact.Policy) error {
+	contents, readErr := ioutil.ReadFile(resultPath)
+	if readErr != nil {
+		logger.With("error", readErr).Warn("failed to read bake result")
+		return err
+	}
+
+	result, parseErr := parseBakeResult(contents)
+	if parseErr != nil {
+		logger.With("error", parseErr).Warn("failed to parse bake result")
+		return err
+	}
+
+	result.Diagnostics = redaction.String(result.Diagnostics)
+	return BakeError{Result: result}
+}
+
+// ResetImage runs draupnir-reset-image, which cleans up after a finalisation
+// that was interrupted by stopping postgres and deleting any partial snapshot
+func (e OSExecutor) ResetImage(ctx context.Context, id int) error {
+	logger := GetLogger(ctx).With("imageID", id)
+
+	cmd := exec.CommandContext(
+		ctx,
 		"sudo",
-		"draupnir-create-instance",
+		"draupnir-reset-image",
+		e.DataPath,
+		fmt.Sprintf("%d", id),
+	)
+
+	return runCommandAndLog(logger, "Reset image", cmd)
+}
+
+// finaliseOptionArgs converts the image's finalisation options, and the
+// workers of a distributed image, into flags for draupnir-finalise-image.
+// Renames and workers are sorted so that the command is deterministic.
+func finaliseOptionArgs(image models.Image) []string {
+	args := []string{}
+
+	for _, name := range image.DropDatabases {
+		args = append(args, "--drop-database", name)
+	}
+
+	renames := make([]string, 0, len(image.RenameDatabases))
+	for from, to := range image.RenameDatabases {
+		renames = append(renames, fmt.Sprintf("%s=%v", from, to))
+	}
+	sort.Strings(renames)
+	for _, rename := range renames {
+		args = append(args, "--rename-database", rename)
+	}
+
+	if image.Encoding != "" {
+		args = append(args, "--encoding", image.Encoding)
+	}
+	if image.Locale != "" {
+		args = append(args, "--locale", image.Locale)
+	}
+
+	for _, name := range image.Workers.Names() {
+		args = append(args, "--worker", fmt.Sprintf("%s=%v", name, image.Workers[name]))
+	}
+
+	return args
+}
+
+// CreateInstance creates an instance listening on the given port. If address
+// is given, it's added to InstanceAddressInterface as an alias, and the
+// instance listens only on it. The alias is removed by DestroyInstance. If
+// schemaOnly is set, every table other than SchemaOnlyKeepTables is truncated
+// before the instance accepts remote connections.
+func (e OSExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int, address string, schemaOnly bool) error {
+	logger := GetLogger(ctx).With("imageID", imageID).With("instanceID", instanceID).With("port", port)
+
+	args := []string{"draupnir-create-instance"}
+	if schemaOnly {
+		logger = logger.With("schemaOnly", true)
+		args = append(args, "--schema-only", strings.Join(e.SchemaOnlyKeepTables, ","))
+	}
+	args = append(
+		args,
 		e.DataPath,
 		fmt.Sprintf("%d", imageID),
 		fmt.Sprintf("%d", instanceID),
 		fmt.Sprintf("%d", port),
 	)
+	if address != "" {
+		logger = logger.With("address", address)
+		args = append(args, address, e.InstanceAddressInterface)
+	}
+
+	cmd := exec.Command("sudo", args...)
 
 	return runCommandAndLog(logger, "Creating instance", cmd)
 }
 
+// SnapshotImageBase takes a read-only snapshot of the image's upload directory
+// in $(DataPath)/image_bases, before it is modified by finalisation. This
+// preserves the base backup in a state that WAL can be replayed onto.
+func (e OSExecutor) SnapshotImageBase(ctx context.Context, id int) error {
+	logger := GetLogger(ctx).With("imageID", id)
+
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-snapshot-image-base",
+		e.DataPath,
+		fmt.Sprintf("%d", id),
+	)
+
+	return runCommandAndLog(logger, "Snapshotted image base", cmd)
+}
+
+// HasImageBase reports whether a base backup was preserved for the image, which
+// isn't the case for images that were finalised before standby instances were
+// enabled
+func (e OSExecutor) HasImageBase(ctx context.Context, id int) (bool, error) {
+	path := filepath.Join(e.DataPath, "image_bases", fmt.Sprintf("%d", id))
+
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// CreateStandbyInstance creates an instance from the image's base backup,
+// which replays WAL from the source database's archive until it is promoted
+func (e OSExecutor) CreateStandbyInstance(ctx context.Context, imageID int, instanceID int, port int) error {
+	logger := GetLogger(ctx).With("imageID", imageID).With("instanceID", instanceID).With("port", port)
+
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-create-standby-instance",
+		e.DataPath,
+		fmt.Sprintf("%d", imageID),
+		fmt.Sprintf("%d", instanceID),
+		fmt.Sprintf("%d", port),
+		e.StandbyRestoreCommand,
+	)
+
+	return runCommandAndLog(logger, "Creating standby instance", cmd)
+}
+
+// PromoteInstance stops a standby instance from replaying WAL, anonymises it
+// with the image's anonymisation script and then allows remote connections to
+// it
+func (e OSExecutor) PromoteInstance(ctx context.Context, instance models.Instance, anon string) error {
+	anonFile, err := ioutil.TempFile("/tmp", "draupnir")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(anonFile.Name())
+	defer anonFile.Close()
+
+	_, err = io.WriteString(anonFile, anon)
+	if err != nil {
+		return err
+	}
+
+	err = anonFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	logger := GetLogger(ctx).With("instanceID", instance.ID)
+
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-promote-instance",
+		e.DataPath,
+		fmt.Sprintf("%d", instance.ID),
+		fmt.Sprintf("%d", instance.Port),
+		anonFile.Name(),
+	)
+
+	return runCommandAndLog(logger, "Promoted instance", cmd)
+}
+
+// RunMaintenance runs a maintenance operation against one of the instance's
+// databases, as a superuser, and returns its output. If the operation's SQL
+// fails, a MaintenanceFailedError is returned with the output so far.
+func (e OSExecutor) RunMaintenance(ctx context.Context, instance models.Instance, operation MaintenanceOperation) (string, error) {
+	logger := GetLogger(ctx).
+		With("instanceID", instance.ID).
+		With("database", operation.Database).
+		With("operation", operation.Name)
+
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-run-instance-maintenance",
+		e.DataPath,
+		fmt.Sprintf("%d", instance.ID),
+		fmt.Sprintf("%d", instance.Port),
+		operation.Database,
+	)
+	cmd.Stdin = strings.NewReader(operation.SQL())
+
+	output, err := runCommandAndLogOutput(logger, "Ran maintenance operation", cmd)
+	if err != nil {
+		// psql exits with 3 when an error occurs in the SQL it was given
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 3 {
+			return "", MaintenanceFailedError{Output: string(output)}
+		}
+		return "", err
+	}
+
+	return string(output), nil
+}
+
 // RetrieveInstanceCredentials reads the certificate and key files from the
 // instance directory and returns them in a map
 func (e OSExecutor) RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error) {
@@ -197,3 +667,491 @@ func (e OSExecutor) DestroyInstance(ctx context.Context, id int) error {
 
 	return runCommandAndLog(logger, "Destroyed instance", cmd)
 }
+
+func (e OSExecutor) RetrieveImageDiskUsage(ctx context.Context, id int) (models.DiskUsage, error) {
+	logger := GetLogger(ctx).With("imageID", id)
+	return e.retrieveDiskUsage(ctx, logger, "image", id)
+}
+
+func (e OSExecutor) RetrieveInstanceDiskUsage(ctx context.Context, id int) (models.DiskUsage, error) {
+	logger := GetLogger(ctx).With("instanceID", id)
+	return e.retrieveDiskUsage(ctx, logger, "instance", id)
+}
+
+// RetrievePoolUsage reports the size and free space of the filesystem that
+// holds every image and instance. This doesn't need root, so isn't a script.
+func (e OSExecutor) RetrievePoolUsage(ctx context.Context) (models.PoolUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(e.DataPath, &stat); err != nil {
+		return models.PoolUsage{}, err
+	}
+
+	return models.PoolUsage{
+		TotalBytes: int64(stat.Blocks) * int64(stat.Bsize),
+		FreeBytes:  int64(stat.Bavail) * int64(stat.Bsize),
+	}, nil
+}
+
+// ioPressurePath is where the kernel reports how long tasks have been stalled
+// waiting for IO, if it was built with pressure stall information
+var ioPressurePath = "/proc/pressure/io"
+
+// InspectInstanceActivity reports the sessions in the instance that aren't
+// idle, and the IO pressure on the host, which is shared by every instance
+func (e OSExecutor) InspectInstanceActivity(ctx context.Context, instance models.Instance) (models.InstanceActivity, error) {
+	logger := GetLogger(ctx).With("instanceID", instance.ID)
+
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-instance-activity",
+		e.DataPath,
+		fmt.Sprintf("%d", instance.ID),
+		fmt.Sprintf("%d", instance.Port),
+	)
+
+	// The sessions aren't logged, as their queries may contain personal data
+	output, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			logger = logger.With("stderr", string(ee.Stderr))
+		}
+		logger.With("error", err.Error()).Info("Failed to inspect instance activity")
+		return models.InstanceActivity{}, err
+	}
+	logger.Info("Inspected instance activity")
+
+	sessions, err := parseInstanceActivity(output)
+	if err != nil {
+		return models.InstanceActivity{}, err
+	}
+
+	activity := models.InstanceActivity{Sessions: sessions, IOPressure: -1}
+	if pressure, err := ioutil.ReadFile(ioPressurePath); err == nil {
+		if activity.IOPressure, err = parseIOPressure(pressure); err != nil {
+			return activity, err
+		}
+	}
+
+	return activity, nil
+}
+
+// parseInstanceActivity parses the output of draupnir-instance-activity, which
+// is a tab-separated line for each session:
+//
+//	4242	active	95	Lock	4240,4241	UPDATE payments SET status = $1
+//	4240	idle in transaction	310			SELECT * FROM payments FOR UPDATE
+func parseInstanceActivity(output []byte) ([]models.SessionActivity, error) {
+	sessions := []models.SessionActivity{}
+
+	for i, line := range strings.Split(string(output), "\n") {
+		if line == "" {
+			continue
+		}
+
+		// The line isn't included in the error, as its query may contain
+		// personal data
+		fields := strings.SplitN(line, "\t", 6)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("unexpected draupnir-instance-activity output on line %d", i+1)
+		}
+
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid in draupnir-instance-activity output on line %d", i+1)
+		}
+		seconds, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration in draupnir-instance-activity output on line %d", i+1)
+		}
+
+		session := models.SessionActivity{
+			PID:           pid,
+			State:         fields[1],
+			Duration:      time.Duration(seconds) * time.Second,
+			WaitEventType: fields[3],
+			Query:         fields[5],
+		}
+		if fields[4] != "" {
+			for _, blocker := range strings.Split(fields[4], ",") {
+				blockerPID, err := strconv.Atoi(blocker)
+				if err != nil {
+					return nil, fmt.Errorf("invalid blocking pid in draupnir-instance-activity output on line %d", i+1)
+				}
+				session.BlockedBy = append(session.BlockedBy, blockerPID)
+			}
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// parseIOPressure parses the avg10 of the "some" line of /proc/pressure/io,
+// which looks like this:
+//
+//	some avg10=1.53 avg60=0.87 avg300=0.21 total=4398233
+//	full avg10=0.98 avg60=0.52 avg300=0.13 total=2977011
+func parseIOPressure(output []byte) (float64, error) {
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" || !strings.HasPrefix(fields[1], "avg10=") {
+			continue
+		}
+		return strconv.ParseFloat(strings.TrimPrefix(fields[1], "avg10="), 64)
+	}
+
+	return 0, fmt.Errorf("no IO pressure in %q", output)
+}
+
+func (e OSExecutor) retrieveDiskUsage(ctx context.Context, logger log.Logger, kind string, id int) (models.DiskUsage, error) {
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-storage-usage",
+		e.DataPath,
+		kind,
+		fmt.Sprintf("%d", id),
+	)
+
+	output, err := runCommandAndLogOutput(logger, "Retrieved disk usage", cmd)
+	if err != nil {
+		return models.DiskUsage{}, err
+	}
+
+	return parseBtrfsDiskUsage(output)
+}
+
+// InspectImageUpload checksums the image's upload, and reads the start LSN of
+// the base backup if it has a backup_label. It fails once the image has been
+// started, as the upload no longer matches the source by then.
+func (e OSExecutor) InspectImageUpload(ctx context.Context, id int) (models.ImageInspection, error) {
+	logger := GetLogger(ctx).With("imageID", id)
+	return e.inspectImage(ctx, logger, "upload", id)
+}
+
+// InspectImageSnapshot checksums the image's snapshot, and checks whether it
+// is read-only
+func (e OSExecutor) InspectImageSnapshot(ctx context.Context, id int) (models.ImageInspection, error) {
+	logger := GetLogger(ctx).With("imageID", id)
+	return e.inspectImage(ctx, logger, "image", id)
+}
+
+func (e OSExecutor) inspectImage(ctx context.Context, logger log.Logger, kind string, id int) (models.ImageInspection, error) {
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-inspect-image",
+		e.DataPath,
+		kind,
+		fmt.Sprintf("%d", id),
+	)
+
+	output, err := runCommandAndLogOutput(logger, "Inspected image", cmd)
+	if err != nil {
+		return models.ImageInspection{}, err
+	}
+
+	return parseImageInspection(output)
+}
+
+// parseImageInspection parses the output of draupnir-inspect-image, which looks
+// like this:
+//
+//	checksum=21ad81746ccca84c908c1337a64fcd1e0b19ea04014b9745e44bc59080a5b5ba
+//	read_only=true
+func parseImageInspection(output []byte) (models.ImageInspection, error) {
+	var inspection models.ImageInspection
+
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return inspection, fmt.Errorf("unexpected draupnir-inspect-image output: %q", output)
+		}
+
+		switch parts[0] {
+		case "checksum":
+			inspection.Checksum = parts[1]
+		case "start_lsn":
+			inspection.StartLSN = parts[1]
+		case "read_only":
+			inspection.ReadOnly = parts[1] == "true"
+		}
+	}
+
+	if inspection.Checksum == "" {
+		return inspection, fmt.Errorf("no checksum in draupnir-inspect-image output: %q", output)
+	}
+
+	return inspection, nil
+}
+
+// RetrieveImageSettings lists the settings of a finalised image that could make
+// its clones connect to another server, so that they can be scanned for
+// references to production
+func (e OSExecutor) RetrieveImageSettings(ctx context.Context, id int) ([]models.CloneSetting, error) {
+	logger := GetLogger(ctx).With("imageID", id)
+
+	cmd := exec.CommandContext(
+		ctx,
+		"sudo",
+		"draupnir-image-settings",
+		e.DataPath,
+		fmt.Sprintf("%d", id),
+	)
+
+	// The settings aren't logged, as they may contain passwords
+	output, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			logger = logger.With("stderr", string(ee.Stderr))
+		}
+		logger.With("error", err.Error()).Info("Failed to retrieve image settings")
+		return nil, err
+	}
+	logger.Info("Retrieved image settings")
+
+	return parseImageSettings(output)
+}
+
+// parseImageSettings parses the output of draupnir-image-settings, which is a
+// tab-separated line for each setting:
+//
+//	postgresql.conf	primary_conninfo	'host=db port=5432'
+//	foreign_server	app.payments	host=db dbname=payments
+func parseImageSettings(output []byte) ([]models.CloneSetting, error) {
+	settings := []models.CloneSetting{}
+
+	for i, line := range strings.Split(string(output), "\n") {
+		if line == "" {
+			continue
+		}
+
+		// The line isn't included in the error, as it may contain a password
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected draupnir-image-settings output on line %d", i+1)
+		}
+
+		settings = append(settings, models.CloneSetting{Source: fields[0], Name: fields[1], Value: fields[2]})
+	}
+
+	return settings, nil
+}
+
+// ErrImageFileNotFound is returned when reading a file that the image's
+// snapshot or upload doesn't have
+var ErrImageFileNotFound = errors.New("image file not found")
+
+// ReadImageFile reads one of models.ImageFileNames from the image's snapshot,
+// which only root can read. At most models.MaxImageFileSize bytes of it are
+// returned.
+func (e OSExecutor) ReadImageFile(ctx context.Context, id int, name string) (models.ImageFile, error) {
+	logger := GetLogger(ctx).With("imageID", id).With("file", name)
+
+	file := models.ImageFile{ID: name, ImageID: id}
+	if !models.IsImageFileName(name) {
+		return file, fmt.Errorf("%s can't be read from images", name)
+	}
+
+	return readFile(ctx, logger, file, "draupnir-image-file", e.DataPath, fmt.Sprintf("%d", id), name)
+}
+
+// ReadImageUploadFile reads a file from the image's upload, by its path
+// relative to the root of the upload, before the image is finalised. Unlike
+// ReadImageFile, any file can be read, including the data itself, so the caller
+// must check that the user has been granted access. At most
+// models.MaxImageFileSize bytes of it are returned.
+func (e OSExecutor) ReadImageUploadFile(ctx context.Context, id int, path string) (models.ImageFile, error) {
+	logger := GetLogger(ctx).With("imageID", id).With("file", path)
+
+	file := models.ImageFile{ID: path, ImageID: id}
+	return readFile(ctx, logger, file, "draupnir-upload-file", e.DataPath, fmt.Sprintf("%d", id), path)
+}
+
+// readFile runs the script, which prints the file that's named by its
+// arguments, followed by the maximum number of bytes to print, to fill in the
+// file's contents
+func readFile(ctx context.Context, logger log.Logger, file models.ImageFile, args ...string) (models.ImageFile, error) {
+	// One more byte than the maximum is read, to tell whether it was truncated
+	args = append(args, fmt.Sprintf("%d", models.MaxImageFileSize+1))
+	cmd := exec.CommandContext(ctx, "sudo", args...)
+
+	// The contents aren't logged, as the files are returned to the user anyway
+	output, err := cmd.Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			if ee.ExitCode() == 3 {
+				return file, ErrImageFileNotFound
+			}
+			logger = logger.With("stderr", string(ee.Stderr))
+		}
+		logger.With("error", err.Error()).Info("Failed to read image file")
+		return file, err
+	}
+	logger.Info("Read image file")
+
+	if len(output) > models.MaxImageFileSize {
+		output = output[:models.MaxImageFileSize]
+		file.Truncated = true
+	}
+	file.Content = string(output)
+
+	return file, nil
+}
+
+// SendImage writes the image's snapshot to w as a btrfs send stream. Given a
+// parentID other than zero, only the differences from the parent image's
+// snapshot are written, which is much smaller for images of the same database
+// that were backed up a day apart.
+func (e OSExecutor) SendImage(ctx context.Context, id int, parentID int, w io.Writer) error {
+	logger := GetLogger(ctx).With("imageID", id).With("parentID", parentID)
+
+	args := []string{"draupnir-send-image", e.DataPath, fmt.Sprintf("%d", id)}
+	if parentID != 0 {
+		args = append(args, fmt.Sprintf("%d", parentID))
+	}
+
+	// The stream is too large to buffer, so it's written to w as it's produced,
+	// and only stderr is logged
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, "sudo", args...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	logger = logger.With("stderr", stderr.String())
+	if err != nil {
+		logger.With("error", err.Error()).Info("Failed to send image")
+		return err
+	}
+	logger.Info("Sent image")
+
+	return nil
+}
+
+// ErrUploadNotEmpty is returned when receiving a btrfs send stream into an
+// image upload that something has already been uploaded to
+var ErrUploadNotEmpty = errors.New("upload already has data in it")
+
+// ErrInvalidImageStream is returned when btrfs receive rejects a stream, e.g.
+// because it's cut short, or holds the differences from a parent that this
+// host doesn't have
+var ErrInvalidImageStream = errors.New("stream isn't a whole btrfs send stream of one subvolume")
+
+// ReceiveImageStream replaces the image's empty upload with the subvolume
+// received from r, a btrfs send stream. Unlike a tarball, which is extracted
+// into a new copy, the received subvolume keeps the sender's reflinks and
+// compression.
+func (e OSExecutor) ReceiveImageStream(ctx context.Context, id int, r io.Reader) error {
+	logger := GetLogger(ctx).With("imageID", id)
+
+	_, err := os.Stat(filepath.Join(e.DataPath, "image_uploads", fmt.Sprintf("%d", id), ".draupnir-start-image"))
+	if err == nil {
+		return ErrImageStarted
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	// The stream is too large to buffer, so it's read from r as it's received,
+	// and only stderr is logged
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, "sudo", "draupnir-receive-image", e.DataPath, fmt.Sprintf("%d", id))
+	cmd.Stdin = r
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	logger = logger.With("stderr", stderr.String())
+	if err != nil {
+		logger.With("error", err.Error()).Info("Failed to receive image stream")
+		if ee, ok := err.(*exec.ExitError); ok {
+			switch ee.ExitCode() {
+			case 3:
+				return ErrUploadNotEmpty
+			case 4:
+				return ErrUploadInProgress
+			case 5:
+				return ErrInvalidImageStream
+			}
+		}
+		return err
+	}
+	logger.Info("Received image stream")
+
+	return nil
+}
+
+// StreamInstanceLog writes the last lines of the instance's Postgres server log
+// to w. Given follow, it then writes each line as it's added to the log, until
+// the context is done.
+func (e OSExecutor) StreamInstanceLog(ctx context.Context, id int, lines int, follow bool, w io.Writer) error {
+	logger := GetLogger(ctx).With("instanceID", id).With("follow", follow)
+
+	args := []string{"draupnir-instance-log", fmt.Sprintf("%d", id), fmt.Sprintf("%d", lines)}
+	if follow {
+		args = append(args, "follow")
+	}
+
+	// The log may contain personal data from queries, so only stderr is logged
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, "sudo", args...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	logger = logger.With("stderr", stderr.String())
+	// Following only stops once the client has gone away, so being killed isn't
+	// a failure
+	if follow && ctx.Err() != nil {
+		logger.Info("Stopped streaming instance log")
+		return nil
+	}
+	if err != nil {
+		logger.With("error", err.Error()).Info("Failed to stream instance log")
+		return err
+	}
+	logger.Info("Streamed instance log")
+
+	return nil
+}
+
+// parseBtrfsDiskUsage parses the output of `btrfs filesystem du --summarize
+// --raw`, which looks like this:
+//
+//	   Total   Exclusive  Set shared  Filename
+//	36683776       86016    36597760  /draupnir/instances/1
+func parseBtrfsDiskUsage(output []byte) (models.DiskUsage, error) {
+	var usage models.DiskUsage
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != 2 {
+		return usage, fmt.Errorf("unexpected btrfs du output: %q", output)
+	}
+
+	fields := strings.Fields(lines[1])
+	if len(fields) < 4 {
+		return usage, fmt.Errorf("unexpected btrfs du output: %q", output)
+	}
+
+	values := make([]int64, 3)
+	for i := range values {
+		// Set shared is reported as a '-' when the subvolume shares nothing
+		if fields[i] == "-" {
+			continue
+		}
+
+		value, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return usage, errors.Wrap(err, "failed to parse btrfs du output")
+		}
+		values[i] = value
+	}
+
+	usage.TotalBytes = values[0]
+	usage.ExclusiveBytes = values[1]
+	usage.SharedBytes = values[2]
+
+	return usage, nil
+}
@@ -0,0 +1,347 @@
+package exec
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBtrfsDiskUsage(t *testing.T) {
+	testCases := []struct {
+		name          string
+		output        string
+		result        models.DiskUsage
+		expectedError string
+	}{
+		{
+			"diverged instance",
+			"     Total   Exclusive  Set shared  Filename\n  36683776       86016    36597760  /draupnir/instances/1\n",
+			models.DiskUsage{TotalBytes: 36683776, ExclusiveBytes: 86016, SharedBytes: 36597760},
+			"",
+		},
+		{
+			"nothing shared",
+			"     Total   Exclusive  Set shared  Filename\n      4096        4096           -  /draupnir/instances/1\n",
+			models.DiskUsage{TotalBytes: 4096, ExclusiveBytes: 4096, SharedBytes: 0},
+			"",
+		},
+		{
+			"missing summary line",
+			"     Total   Exclusive  Set shared  Filename\n",
+			models.DiskUsage{},
+			"unexpected btrfs du output: \"     Total   Exclusive  Set shared  Filename\\n\"",
+		},
+		{
+			"non-numeric value",
+			"     Total   Exclusive  Set shared  Filename\n  36.68MiB    84.00KiB    34.90MiB  /draupnir/instances/1\n",
+			models.DiskUsage{},
+			"failed to parse btrfs du output: strconv.ParseInt: parsing \"36.68MiB\": invalid syntax",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := parseBtrfsDiskUsage([]byte(tc.output))
+
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.result, result)
+			}
+		})
+	}
+}
+
+func TestParseImageSettings(t *testing.T) {
+	output := "postgresql.conf\tprimary_conninfo\t'host=db port=5432'\n" +
+		"foreign_server\tapp.payments\thost=db dbname=payments\n" +
+		"dblink\tapp.public.sync\t\n"
+
+	settings, err := parseImageSettings([]byte(output))
+	assert.Nil(t, err)
+	assert.Equal(t, []models.CloneSetting{
+		{Source: "postgresql.conf", Name: "primary_conninfo", Value: "'host=db port=5432'"},
+		{Source: "foreign_server", Name: "app.payments", Value: "host=db dbname=payments"},
+		{Source: "dblink", Name: "app.public.sync", Value: ""},
+	}, settings)
+
+	_, err = parseImageSettings([]byte("postgresql.conf\tshared_buffers\t128MB\nuser_mapping password=secret\n"))
+	assert.EqualError(t, err, "unexpected draupnir-image-settings output on line 2")
+}
+
+func TestParseImageInspection(t *testing.T) {
+	testCases := []struct {
+		name          string
+		output        string
+		result        models.ImageInspection
+		expectedError string
+	}{
+		{
+			"upload",
+			"checksum=21ad8174\nstart_lsn=0/9000028\n",
+			models.ImageInspection{Checksum: "21ad8174", StartLSN: "0/9000028"},
+			"",
+		},
+		{
+			"snapshot",
+			"checksum=21ad8174\nread_only=true\n",
+			models.ImageInspection{Checksum: "21ad8174", ReadOnly: true},
+			"",
+		},
+		{
+			"missing checksum",
+			"read_only=false\n",
+			models.ImageInspection{},
+			"no checksum in draupnir-inspect-image output: \"read_only=false\\n\"",
+		},
+		{
+			"unexpected line",
+			"checksum\n",
+			models.ImageInspection{},
+			"unexpected draupnir-inspect-image output: \"checksum\\n\"",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := parseImageInspection([]byte(tc.output))
+
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.result, result)
+			}
+		})
+	}
+}
+
+func TestParseInstanceActivity(t *testing.T) {
+	output := "4240\tidle in transaction\t310\tClient\t\tSELECT * FROM payments FOR UPDATE\n" +
+		"4242\tactive\t95\tLock\t4240,4241\tUPDATE payments SET status = $1\n"
+
+	sessions, err := parseInstanceActivity([]byte(output))
+	assert.Nil(t, err)
+	assert.Equal(t, []models.SessionActivity{
+		{
+			PID:           4240,
+			State:         "idle in transaction",
+			Duration:      310 * time.Second,
+			WaitEventType: "Client",
+			Query:         "SELECT * FROM payments FOR UPDATE",
+		},
+		{
+			PID:           4242,
+			State:         "active",
+			Duration:      95 * time.Second,
+			WaitEventType: "Lock",
+			BlockedBy:     []int{4240, 4241},
+			Query:         "UPDATE payments SET status = $1",
+		},
+	}, sessions)
+
+	_, err = parseInstanceActivity([]byte("4242\tactive\t95\n"))
+	assert.EqualError(t, err, "unexpected draupnir-instance-activity output on line 1")
+
+	_, err = parseInstanceActivity([]byte("4242\tactive\t95\tLock\tnone\tSELECT 1\n"))
+	assert.EqualError(t, err, "invalid blocking pid in draupnir-instance-activity output on line 1")
+}
+
+func TestParseIOPressure(t *testing.T) {
+	output := "some avg10=12.53 avg60=0.87 avg300=0.21 total=4398233\n" +
+		"full avg10=0.98 avg60=0.52 avg300=0.13 total=2977011\n"
+
+	pressure, err := parseIOPressure([]byte(output))
+	assert.Nil(t, err)
+	assert.Equal(t, 12.53, pressure)
+
+	_, err = parseIOPressure([]byte(""))
+	assert.EqualError(t, err, "no IO pressure in \"\"")
+}
+
+func TestFinaliseOptionArgs(t *testing.T) {
+	image := models.Image{
+		DropDatabases:   []string{"reporting", "scratch"},
+		RenameDatabases: models.DatabaseRenames{"payments_production": "payments", "app_production": "app"},
+		Encoding:        "UTF8",
+		Locale:          "en_GB.UTF-8",
+	}
+
+	assert.Equal(
+		t,
+		[]string{
+			"--drop-database", "reporting",
+			"--drop-database", "scratch",
+			"--rename-database", "app_production=app",
+			"--rename-database", "payments_production=payments",
+			"--encoding", "UTF8",
+			"--locale", "en_GB.UTF-8",
+		},
+		finaliseOptionArgs(image),
+	)
+
+	assert.Equal(t, []string{}, finaliseOptionArgs(models.Image{}))
+}
+
+func TestFinaliseOptionArgsForDistributedImage(t *testing.T) {
+	image := models.Image{
+		Workers: models.WorkerNodes{"worker_b": "citus-worker-2:5432", "worker_a": "citus-worker-1:5432"},
+	}
+
+	assert.Equal(
+		t,
+		[]string{
+			"--worker", "worker_a=citus-worker-1:5432",
+			"--worker", "worker_b=citus-worker-2:5432",
+		},
+		finaliseOptionArgs(image),
+	)
+}
+
+func TestAppendImageUpload(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "draupnir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataPath)
+
+	if err := os.MkdirAll(filepath.Join(dataPath, "image_uploads", "1"), 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	executor := OSExecutor{DataPath: dataPath}
+	logger := log.NewLogger(ioutil.Discard)
+	ctx := context.WithValue(context.Background(), middleware.LoggerKey, &logger)
+
+	size, err := executor.ImageUploadSize(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+
+	size, err = executor.AppendImageUpload(ctx, 1, 0, strings.NewReader("hello "))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), size)
+
+	size, err = executor.AppendImageUpload(ctx, 1, 0, strings.NewReader("world"))
+	assert.Equal(t, ErrUploadOffsetMismatch, err)
+	assert.Equal(t, int64(6), size)
+
+	size, err = executor.AppendImageUpload(ctx, 1, 6, strings.NewReader("world"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), size)
+
+	size, err = executor.ImageUploadSize(ctx, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), size)
+
+	contents, err := ioutil.ReadFile(filepath.Join(dataPath, "image_uploads", "1", ImageUploadArchive))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(contents))
+
+	// Once the image has been started its tarball has been extracted, so more
+	// data would never be used
+	err = ioutil.WriteFile(filepath.Join(dataPath, "image_uploads", "1", ".draupnir-start-image"), nil, 0644)
+	assert.Nil(t, err)
+
+	_, err = executor.AppendImageUpload(ctx, 1, 11, strings.NewReader("!"))
+	assert.Equal(t, ErrImageStarted, err)
+}
+
+// fakeBtrfs stands in for btrfs when running the receive script, with
+// subvolumes as plain directories. Streams are received into a subvolume that
+// exists for as long as the stream is being read.
+const fakeBtrfs = `#!/usr/bin/env bash
+set -e
+case "$1 $2" in
+  "receive -e")
+    mkdir "$3/received"
+    cat > "$3/received/stream"
+    ;;
+  "subvolume delete")
+    rm -r "$3"
+    ;;
+  "subvolume snapshot")
+    cp -r "$3" "$4"
+    ;;
+esac
+`
+
+func TestReceiveImageConcurrently(t *testing.T) {
+	if _, err := exec.LookPath("flock"); err != nil {
+		t.Skip("flock isn't installed")
+	}
+
+	script, err := filepath.Abs("../../cmd/draupnir-receive-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataPath, err := ioutil.TempDir("", "draupnir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dataPath)
+
+	binPath := filepath.Join(dataPath, "bin")
+	if err := os.MkdirAll(binPath, 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(binPath, "btrfs"), []byte(fakeBtrfs), 0775); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dataPath, "image_uploads", "1"), 0775); err != nil {
+		t.Fatal(err)
+	}
+
+	receive := func(stdin io.Reader) *exec.Cmd {
+		cmd := exec.Command(script, dataPath, "1")
+		cmd.Env = append(os.Environ(), "PATH="+binPath+":"+os.Getenv("PATH"))
+		cmd.Stdin = stdin
+		return cmd
+	}
+
+	// The first stream is held open until the second has been refused
+	stream, sender := io.Pipe()
+	first := receive(stream)
+	if err := first.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	received := filepath.Join(dataPath, "image_receives", "1", "received")
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(received); err == nil {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("timed out waiting for the first stream to be received")
+		}
+	}
+
+	err = receive(strings.NewReader("second")).Run()
+	if assert.IsType(t, &exec.ExitError{}, err) {
+		assert.Equal(t, 4, err.(*exec.ExitError).ExitCode())
+	}
+
+	// The second receive mustn't have touched the first's subvolume
+	_, err = os.Stat(received)
+	assert.Nil(t, err)
+
+	sender.Write([]byte("first"))
+	sender.Close()
+	assert.Nil(t, first.Wait())
+
+	contents, err := ioutil.ReadFile(filepath.Join(dataPath, "image_uploads", "1", "stream"))
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(contents))
+}
@@ -0,0 +1,154 @@
+package exec
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// MaintenanceOperation is a named maintenance operation, run as a superuser
+// against one of an instance's databases. Only the operations defined in
+// maintenanceOperations can be run, so users can perform common maintenance
+// without having superuser access to their instances.
+type MaintenanceOperation struct {
+	Name      string
+	Database  string
+	Arguments map[string]string
+}
+
+// MaintenanceFailedError is returned when a maintenance operation's SQL fails,
+// as opposed to the operation failing to run at all
+type MaintenanceFailedError struct {
+	Output string
+}
+
+func (e MaintenanceFailedError) Error() string {
+	return "maintenance operation failed"
+}
+
+type maintenanceOperation struct {
+	required []string
+	optional []string
+	sql      func(args map[string]string) string
+}
+
+var maintenanceOperations = map[string]maintenanceOperation{
+	"analyze": {
+		optional: []string{"table"},
+		sql: func(args map[string]string) string {
+			if table, ok := args["table"]; ok {
+				return fmt.Sprintf("ANALYZE VERBOSE %s;", quoteTableName(table))
+			}
+			return "ANALYZE VERBOSE;"
+		},
+	},
+	"vacuum_full": {
+		required: []string{"table"},
+		sql: func(args map[string]string) string {
+			return fmt.Sprintf("VACUUM (FULL, VERBOSE) %s;", quoteTableName(args["table"]))
+		},
+	},
+	"reindex": {
+		required: []string{"table"},
+		sql: func(args map[string]string) string {
+			return fmt.Sprintf("REINDEX (VERBOSE) TABLE %s;", quoteTableName(args["table"]))
+		},
+	},
+	"reset_sequences": {
+		sql: func(args map[string]string) string {
+			return resetSequencesSQL
+		},
+	},
+}
+
+// resetSequencesSQL sets each sequence that is owned by a column so that the
+// next value it generates is one greater than the column's maximum, which is
+// needed after rows have been copied into an instance with explicit IDs
+const resetSequencesSQL = `DO $$
+DECLARE
+  s record;
+BEGIN
+  FOR s IN
+    SELECT seq.oid::regclass AS sequence, dep.refobjid::regclass AS tbl, att.attname AS col
+    FROM pg_class seq
+    JOIN pg_depend dep ON dep.objid = seq.oid
+      AND dep.classid = 'pg_class'::regclass
+      AND dep.refclassid = 'pg_class'::regclass
+      AND dep.deptype IN ('a', 'i')
+    JOIN pg_attribute att ON att.attrelid = dep.refobjid AND att.attnum = dep.refobjsubid
+    WHERE seq.relkind = 'S'
+  LOOP
+    EXECUTE format(
+      'SELECT setval(%L, COALESCE((SELECT max(%I) FROM %s), 0) + 1, false)',
+      s.sequence, s.col, s.tbl
+    );
+    RAISE NOTICE 'reset % to follow %.%', s.sequence, s.tbl, s.col;
+  END LOOP;
+END
+$$;`
+
+var databaseNameRegex = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_$-]*$`)
+
+// MaintenanceOperationNames returns the names of the operations that can be
+// run, in alphabetical order
+func MaintenanceOperationNames() []string {
+	names := make([]string, 0, len(maintenanceOperations))
+	for name := range maintenanceOperations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Validate checks that the operation exists, that it's been given the
+// arguments that it requires and no others, and that the database name can't
+// be mistaken for a connection string by psql
+func (o MaintenanceOperation) Validate() error {
+	operation, ok := maintenanceOperations[o.Name]
+	if !ok {
+		return fmt.Errorf(
+			"unknown operation %q, expected one of: %s",
+			o.Name, strings.Join(MaintenanceOperationNames(), ", "),
+		)
+	}
+
+	if !databaseNameRegex.MatchString(o.Database) {
+		return fmt.Errorf("invalid database name: %q", o.Database)
+	}
+
+	for _, name := range operation.required {
+		if o.Arguments[name] == "" {
+			return fmt.Errorf("operation %s requires the %s argument", o.Name, name)
+		}
+	}
+
+	for name := range o.Arguments {
+		if !models.ContainsString(operation.required, name) && !models.ContainsString(operation.optional, name) {
+			return fmt.Errorf("operation %s does not accept the %s argument", o.Name, name)
+		}
+	}
+
+	return nil
+}
+
+// SQL returns the statements that perform the operation. The operation must
+// have been validated.
+func (o MaintenanceOperation) SQL() string {
+	return maintenanceOperations[o.Name].sql(o.Arguments)
+}
+
+// quoteTableName quotes a table name, which may be qualified with its schema
+func quoteTableName(name string) string {
+	parts := strings.SplitN(name, ".", 2)
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+
+	return strings.Join(parts, ".")
+}
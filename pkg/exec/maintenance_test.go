@@ -0,0 +1,88 @@
+package exec
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceOperationValidate(t *testing.T) {
+	testCases := []struct {
+		name          string
+		operation     MaintenanceOperation
+		expectedError string
+	}{
+		{
+			"analyze everything",
+			MaintenanceOperation{Name: "analyze", Database: "app"},
+			"",
+		},
+		{
+			"vacuum a table",
+			MaintenanceOperation{Name: "vacuum_full", Database: "app", Arguments: map[string]string{"table": "payments"}},
+			"",
+		},
+		{
+			"unknown operation",
+			MaintenanceOperation{Name: "drop_database", Database: "app"},
+			"unknown operation \"drop_database\", expected one of: analyze, reindex, reset_sequences, vacuum_full",
+		},
+		{
+			"missing argument",
+			MaintenanceOperation{Name: "vacuum_full", Database: "app"},
+			"operation vacuum_full requires the table argument",
+		},
+		{
+			"unexpected argument",
+			MaintenanceOperation{Name: "reset_sequences", Database: "app", Arguments: map[string]string{"table": "payments"}},
+			"operation reset_sequences does not accept the table argument",
+		},
+		{
+			"connection string as database",
+			MaintenanceOperation{Name: "analyze", Database: "dbname=app host=example.com"},
+			"invalid database name: \"dbname=app host=example.com\"",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.operation.Validate()
+
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func TestMaintenanceOperationSQL(t *testing.T) {
+	testCases := []struct {
+		name      string
+		operation MaintenanceOperation
+		sql       string
+	}{
+		{
+			"analyze everything",
+			MaintenanceOperation{Name: "analyze"},
+			"ANALYZE VERBOSE;",
+		},
+		{
+			"analyze a table in a schema",
+			MaintenanceOperation{Name: "analyze", Arguments: map[string]string{"table": "billing.payments"}},
+			`ANALYZE VERBOSE "billing"."payments";`,
+		},
+		{
+			"table name containing SQL",
+			MaintenanceOperation{Name: "vacuum_full", Arguments: map[string]string{"table": `x"; DROP TABLE y; --`}},
+			`VACUUM (FULL, VERBOSE) "x""; DROP TABLE y; --";`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.sql, tc.operation.SQL())
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package exec
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// TimedExecutor adds the time taken by each operation of the executor that it
+// wraps to the executor phase of the Server-Timing header of the request that
+// it's run for
+type TimedExecutor struct {
+	Executor
+}
+
+var _ Executor = TimedExecutor{}
+
+func (e TimedExecutor) CreateBtrfsSubvolume(ctx context.Context, id int) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.CreateBtrfsSubvolume(ctx, id)
+}
+
+func (e TimedExecutor) CreateShardUploadSlots(ctx context.Context, id int, shards []string) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.CreateShardUploadSlots(ctx, id, shards)
+}
+
+func (e TimedExecutor) CreateWorkerUploadSlots(ctx context.Context, id int, workers []string) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.CreateWorkerUploadSlots(ctx, id, workers)
+}
+
+func (e TimedExecutor) ImageUploadSize(ctx context.Context, id int) (int64, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.ImageUploadSize(ctx, id)
+}
+
+func (e TimedExecutor) AppendImageUpload(ctx context.Context, id int, offset int64, r io.Reader) (int64, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.AppendImageUpload(ctx, id, offset, r)
+}
+
+func (e TimedExecutor) FinaliseImage(ctx context.Context, image models.Image) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.FinaliseImage(ctx, image)
+}
+
+func (e TimedExecutor) ResetImage(ctx context.Context, id int) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.ResetImage(ctx, id)
+}
+
+func (e TimedExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int, address string, schemaOnly bool) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.CreateInstance(ctx, imageID, instanceID, port, address, schemaOnly)
+}
+
+func (e TimedExecutor) SnapshotImageBase(ctx context.Context, id int) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.SnapshotImageBase(ctx, id)
+}
+
+func (e TimedExecutor) HasImageBase(ctx context.Context, id int) (bool, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.HasImageBase(ctx, id)
+}
+
+func (e TimedExecutor) CreateStandbyInstance(ctx context.Context, imageID int, instanceID int, port int) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.CreateStandbyInstance(ctx, imageID, instanceID, port)
+}
+
+func (e TimedExecutor) PromoteInstance(ctx context.Context, instance models.Instance, anon string) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.PromoteInstance(ctx, instance, anon)
+}
+
+func (e TimedExecutor) RestartInstance(ctx context.Context, instance models.Instance) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.RestartInstance(ctx, instance)
+}
+
+func (e TimedExecutor) RotateInstanceCredentials(ctx context.Context, instance models.Instance) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.RotateInstanceCredentials(ctx, instance)
+}
+
+func (e TimedExecutor) RunMaintenance(ctx context.Context, instance models.Instance, operation MaintenanceOperation) (string, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.RunMaintenance(ctx, instance, operation)
+}
+
+func (e TimedExecutor) RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.RetrieveInstanceCredentials(ctx, id)
+}
+
+func (e TimedExecutor) DestroyImage(ctx context.Context, id int) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.DestroyImage(ctx, id)
+}
+
+func (e TimedExecutor) DestroyInstance(ctx context.Context, id int) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.DestroyInstance(ctx, id)
+}
+
+func (e TimedExecutor) RetrieveImageDiskUsage(ctx context.Context, id int) (models.DiskUsage, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.RetrieveImageDiskUsage(ctx, id)
+}
+
+func (e TimedExecutor) InspectImageUpload(ctx context.Context, id int) (models.ImageInspection, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.InspectImageUpload(ctx, id)
+}
+
+func (e TimedExecutor) InspectImageSnapshot(ctx context.Context, id int) (models.ImageInspection, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.InspectImageSnapshot(ctx, id)
+}
+
+func (e TimedExecutor) RetrieveImageSettings(ctx context.Context, id int) ([]models.CloneSetting, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.RetrieveImageSettings(ctx, id)
+}
+
+func (e TimedExecutor) ReadImageFile(ctx context.Context, id int, name string) (models.ImageFile, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.ReadImageFile(ctx, id, name)
+}
+
+func (e TimedExecutor) ReadImageUploadFile(ctx context.Context, id int, path string) (models.ImageFile, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.ReadImageUploadFile(ctx, id, path)
+}
+
+func (e TimedExecutor) SendImage(ctx context.Context, id int, parentID int, w io.Writer) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.SendImage(ctx, id, parentID, w)
+}
+
+func (e TimedExecutor) ReceiveImageStream(ctx context.Context, id int, r io.Reader) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.ReceiveImageStream(ctx, id, r)
+}
+
+func (e TimedExecutor) RetrieveInstanceDiskUsage(ctx context.Context, id int) (models.DiskUsage, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.RetrieveInstanceDiskUsage(ctx, id)
+}
+
+func (e TimedExecutor) RetrievePoolUsage(ctx context.Context) (models.PoolUsage, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.RetrievePoolUsage(ctx)
+}
+
+func (e TimedExecutor) InspectInstanceActivity(ctx context.Context, instance models.Instance) (models.InstanceActivity, error) {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.InspectInstanceActivity(ctx, instance)
+}
+
+func (e TimedExecutor) StreamInstanceLog(ctx context.Context, id int, lines int, follow bool, w io.Writer) error {
+	defer middleware.AddServerTiming(ctx, middleware.TimingExecutor, time.Now())
+	return e.Executor.StreamInstanceLog(ctx, id, lines, follow, w)
+}
@@ -0,0 +1,242 @@
+package faults
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// Executor injects executor faults into the operations of the executor that it
+// wraps, matching them by the name of the operation, e.g. CreateInstance.
+// Operations that a fault fails aren't run.
+type Executor struct {
+	exec.Executor
+	Injector *Injector
+}
+
+var _ exec.Executor = Executor{}
+
+func (e Executor) inject(ctx context.Context, operation string) error {
+	latency, failed := e.Injector.inject(models.FaultExecutor, operation, "")
+	if err := sleep(ctx, latency); err != nil {
+		return err
+	}
+	if failed != nil {
+		return errors.Wrap(ErrInjected, operation)
+	}
+	return nil
+}
+
+func (e Executor) CreateBtrfsSubvolume(ctx context.Context, id int) error {
+	if err := e.inject(ctx, "CreateBtrfsSubvolume"); err != nil {
+		return err
+	}
+	return e.Executor.CreateBtrfsSubvolume(ctx, id)
+}
+
+func (e Executor) CreateShardUploadSlots(ctx context.Context, id int, shards []string) error {
+	if err := e.inject(ctx, "CreateShardUploadSlots"); err != nil {
+		return err
+	}
+	return e.Executor.CreateShardUploadSlots(ctx, id, shards)
+}
+
+func (e Executor) CreateWorkerUploadSlots(ctx context.Context, id int, workers []string) error {
+	if err := e.inject(ctx, "CreateWorkerUploadSlots"); err != nil {
+		return err
+	}
+	return e.Executor.CreateWorkerUploadSlots(ctx, id, workers)
+}
+
+func (e Executor) ImageUploadSize(ctx context.Context, id int) (int64, error) {
+	if err := e.inject(ctx, "ImageUploadSize"); err != nil {
+		return 0, err
+	}
+	return e.Executor.ImageUploadSize(ctx, id)
+}
+
+func (e Executor) AppendImageUpload(ctx context.Context, id int, offset int64, r io.Reader) (int64, error) {
+	if err := e.inject(ctx, "AppendImageUpload"); err != nil {
+		return 0, err
+	}
+	return e.Executor.AppendImageUpload(ctx, id, offset, r)
+}
+
+func (e Executor) FinaliseImage(ctx context.Context, image models.Image) error {
+	if err := e.inject(ctx, "FinaliseImage"); err != nil {
+		return err
+	}
+	return e.Executor.FinaliseImage(ctx, image)
+}
+
+func (e Executor) ResetImage(ctx context.Context, id int) error {
+	if err := e.inject(ctx, "ResetImage"); err != nil {
+		return err
+	}
+	return e.Executor.ResetImage(ctx, id)
+}
+
+func (e Executor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int, address string, schemaOnly bool) error {
+	if err := e.inject(ctx, "CreateInstance"); err != nil {
+		return err
+	}
+	return e.Executor.CreateInstance(ctx, imageID, instanceID, port, address, schemaOnly)
+}
+
+func (e Executor) SnapshotImageBase(ctx context.Context, id int) error {
+	if err := e.inject(ctx, "SnapshotImageBase"); err != nil {
+		return err
+	}
+	return e.Executor.SnapshotImageBase(ctx, id)
+}
+
+func (e Executor) HasImageBase(ctx context.Context, id int) (bool, error) {
+	if err := e.inject(ctx, "HasImageBase"); err != nil {
+		return false, err
+	}
+	return e.Executor.HasImageBase(ctx, id)
+}
+
+func (e Executor) CreateStandbyInstance(ctx context.Context, imageID int, instanceID int, port int) error {
+	if err := e.inject(ctx, "CreateStandbyInstance"); err != nil {
+		return err
+	}
+	return e.Executor.CreateStandbyInstance(ctx, imageID, instanceID, port)
+}
+
+func (e Executor) PromoteInstance(ctx context.Context, instance models.Instance, anon string) error {
+	if err := e.inject(ctx, "PromoteInstance"); err != nil {
+		return err
+	}
+	return e.Executor.PromoteInstance(ctx, instance, anon)
+}
+
+func (e Executor) RestartInstance(ctx context.Context, instance models.Instance) error {
+	if err := e.inject(ctx, "RestartInstance"); err != nil {
+		return err
+	}
+	return e.Executor.RestartInstance(ctx, instance)
+}
+
+func (e Executor) RotateInstanceCredentials(ctx context.Context, instance models.Instance) error {
+	if err := e.inject(ctx, "RotateInstanceCredentials"); err != nil {
+		return err
+	}
+	return e.Executor.RotateInstanceCredentials(ctx, instance)
+}
+
+func (e Executor) RunMaintenance(ctx context.Context, instance models.Instance, operation exec.MaintenanceOperation) (string, error) {
+	if err := e.inject(ctx, "RunMaintenance"); err != nil {
+		return "", err
+	}
+	return e.Executor.RunMaintenance(ctx, instance, operation)
+}
+
+func (e Executor) RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error) {
+	if err := e.inject(ctx, "RetrieveInstanceCredentials"); err != nil {
+		return nil, err
+	}
+	return e.Executor.RetrieveInstanceCredentials(ctx, id)
+}
+
+func (e Executor) DestroyImage(ctx context.Context, id int) error {
+	if err := e.inject(ctx, "DestroyImage"); err != nil {
+		return err
+	}
+	return e.Executor.DestroyImage(ctx, id)
+}
+
+func (e Executor) DestroyInstance(ctx context.Context, id int) error {
+	if err := e.inject(ctx, "DestroyInstance"); err != nil {
+		return err
+	}
+	return e.Executor.DestroyInstance(ctx, id)
+}
+
+func (e Executor) RetrieveImageDiskUsage(ctx context.Context, id int) (models.DiskUsage, error) {
+	if err := e.inject(ctx, "RetrieveImageDiskUsage"); err != nil {
+		return models.DiskUsage{}, err
+	}
+	return e.Executor.RetrieveImageDiskUsage(ctx, id)
+}
+
+func (e Executor) InspectImageUpload(ctx context.Context, id int) (models.ImageInspection, error) {
+	if err := e.inject(ctx, "InspectImageUpload"); err != nil {
+		return models.ImageInspection{}, err
+	}
+	return e.Executor.InspectImageUpload(ctx, id)
+}
+
+func (e Executor) InspectImageSnapshot(ctx context.Context, id int) (models.ImageInspection, error) {
+	if err := e.inject(ctx, "InspectImageSnapshot"); err != nil {
+		return models.ImageInspection{}, err
+	}
+	return e.Executor.InspectImageSnapshot(ctx, id)
+}
+
+func (e Executor) RetrieveImageSettings(ctx context.Context, id int) ([]models.CloneSetting, error) {
+	if err := e.inject(ctx, "RetrieveImageSettings"); err != nil {
+		return nil, err
+	}
+	return e.Executor.RetrieveImageSettings(ctx, id)
+}
+
+func (e Executor) ReadImageFile(ctx context.Context, id int, name string) (models.ImageFile, error) {
+	if err := e.inject(ctx, "ReadImageFile"); err != nil {
+		return models.ImageFile{}, err
+	}
+	return e.Executor.ReadImageFile(ctx, id, name)
+}
+
+func (e Executor) ReadImageUploadFile(ctx context.Context, id int, path string) (models.ImageFile, error) {
+	if err := e.inject(ctx, "ReadImageUploadFile"); err != nil {
+		return models.ImageFile{}, err
+	}
+	return e.Executor.ReadImageUploadFile(ctx, id, path)
+}
+
+func (e Executor) SendImage(ctx context.Context, id int, parentID int, w io.Writer) error {
+	if err := e.inject(ctx, "SendImage"); err != nil {
+		return err
+	}
+	return e.Executor.SendImage(ctx, id, parentID, w)
+}
+
+func (e Executor) ReceiveImageStream(ctx context.Context, id int, r io.Reader) error {
+	if err := e.inject(ctx, "ReceiveImageStream"); err != nil {
+		return err
+	}
+	return e.Executor.ReceiveImageStream(ctx, id, r)
+}
+
+func (e Executor) RetrieveInstanceDiskUsage(ctx context.Context, id int) (models.DiskUsage, error) {
+	if err := e.inject(ctx, "RetrieveInstanceDiskUsage"); err != nil {
+		return models.DiskUsage{}, err
+	}
+	return e.Executor.RetrieveInstanceDiskUsage(ctx, id)
+}
+
+func (e Executor) RetrievePoolUsage(ctx context.Context) (models.PoolUsage, error) {
+	if err := e.inject(ctx, "RetrievePoolUsage"); err != nil {
+		return models.PoolUsage{}, err
+	}
+	return e.Executor.RetrievePoolUsage(ctx)
+}
+
+func (e Executor) InspectInstanceActivity(ctx context.Context, instance models.Instance) (models.InstanceActivity, error) {
+	if err := e.inject(ctx, "InspectInstanceActivity"); err != nil {
+		return models.InstanceActivity{}, err
+	}
+	return e.Executor.InspectInstanceActivity(ctx, instance)
+}
+
+func (e Executor) StreamInstanceLog(ctx context.Context, id int, lines int, follow bool, w io.Writer) error {
+	if err := e.inject(ctx, "StreamInstanceLog"); err != nil {
+		return err
+	}
+	return e.Executor.StreamInstanceLog(ctx, id, lines, follow, w)
+}
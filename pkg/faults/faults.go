@@ -0,0 +1,220 @@
+// Package faults injects failures into the server, for testing in staging that
+// clients, retry logic and CI automation cope with draupnir misbehaving. Faults
+// fail API requests or executor operations at a given rate, and add latency to
+// them, and are added and removed through the admin API while the server runs.
+//
+// Faults are only injected if they're enabled in the server's config, which
+// should never be the case in production.
+package faults
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+// ErrInjected is the cause of every executor operation that's failed by a
+// fault
+var ErrInjected = errors.New("injected fault")
+
+// DefaultStatus is the status that requests failed by a fault are responded
+// to with, unless it gives another. Clients retry requests that fail with it.
+const DefaultStatus = http.StatusServiceUnavailable
+
+// fault is a fault with its latency parsed
+type fault struct {
+	models.Fault
+	latency time.Duration
+}
+
+// Injector holds the faults that are being injected. It's safe for concurrent
+// use.
+type Injector struct {
+	mu     sync.Mutex
+	faults []fault
+	nextID int
+
+	// random returns a number in [0, 1), and now the current time. They're
+	// replaced in tests.
+	random func() float64
+	now    func() time.Time
+}
+
+// NewInjector returns an Injector with no faults
+func NewInjector() *Injector {
+	return &Injector{nextID: 1, random: rand.Float64, now: time.Now}
+}
+
+// Add validates the fault and starts injecting it, returning it with its ID
+// set. It's removed after duration, if that's positive.
+func (i *Injector) Add(f models.Fault, duration time.Duration) (models.Fault, error) {
+	var latency time.Duration
+	if f.Latency != "" {
+		var err error
+		latency, err = time.ParseDuration(f.Latency)
+		if err != nil || latency < 0 {
+			return f, fmt.Errorf("latency must be a duration, e.g. 2s")
+		}
+	}
+
+	switch {
+	case f.Target != models.FaultRoute && f.Target != models.FaultExecutor:
+		return f, fmt.Errorf("target must be %s or %s", models.FaultRoute, models.FaultExecutor)
+	case f.Match == "":
+		return f, fmt.Errorf("match must be a route's path template, an executor operation, or %s", models.FaultMatchAll)
+	case f.Target == models.FaultExecutor && f.Method != "":
+		return f, fmt.Errorf("method only applies to route faults")
+	case f.ErrorRate < 0 || f.ErrorRate > 1:
+		return f, fmt.Errorf("error_rate must be between 0 and 1")
+	case f.ErrorRate == 0 && latency == 0:
+		return f, fmt.Errorf("a fault must have an error_rate or a latency")
+	case f.Status != 0 && (f.Status < 400 || f.Status > 599):
+		return f, fmt.Errorf("status must be an error status")
+	}
+
+	if f.Target == models.FaultRoute && f.Status == 0 {
+		f.Status = DefaultStatus
+	}
+	f.Method = strings.ToUpper(f.Method)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	f.ID = i.nextID
+	i.nextID++
+	f.CreatedAt = i.now()
+	if duration > 0 {
+		expiresAt := f.CreatedAt.Add(duration)
+		f.ExpiresAt = &expiresAt
+	}
+
+	i.faults = append(i.faults, fault{Fault: f, latency: latency})
+	return f, nil
+}
+
+// List returns the faults that are being injected
+func (i *Injector) List() []models.Fault {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.removeExpired()
+	faults := make([]models.Fault, 0, len(i.faults))
+	for _, f := range i.faults {
+		faults = append(faults, f.Fault)
+	}
+	return faults
+}
+
+// Remove stops injecting the fault, returning whether it was being injected
+func (i *Injector) Remove(id int) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for idx, f := range i.faults {
+		if f.ID == id {
+			i.faults = append(i.faults[:idx], i.faults[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Clear stops injecting every fault
+func (i *Injector) Clear() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.faults = nil
+}
+
+// inject returns the latency to add to a request or operation, and the fault
+// that fails it, if any. Latency is added by every matching fault, and the
+// first matching fault to fire fails it.
+func (i *Injector) inject(target, match, method string) (time.Duration, *models.Fault) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.removeExpired()
+
+	var latency time.Duration
+	var failed *models.Fault
+	for _, f := range i.faults {
+		if !f.Matches(target, match, method) {
+			continue
+		}
+		latency += f.latency
+		if failed == nil && f.ErrorRate > 0 && i.random() < f.ErrorRate {
+			fault := f.Fault
+			failed = &fault
+		}
+	}
+	return latency, failed
+}
+
+func (i *Injector) removeExpired() {
+	now := i.now()
+	live := i.faults[:0]
+	for _, f := range i.faults {
+		if !f.Expired(now) {
+			live = append(live, f)
+		}
+	}
+	i.faults = live
+}
+
+// sleep waits for the duration, or until the context is done
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Middleware injects route faults into requests, matching them by the path
+// template of their route, without basePath
+func Middleware(injector *Injector, basePath string) chain.Middleware {
+	return func(next chain.Handler) chain.Handler {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			route := mux.CurrentRoute(r)
+			if route == nil {
+				return next(w, r)
+			}
+			template, err := route.GetPathTemplate()
+			if err != nil {
+				return next(w, r)
+			}
+			template = strings.TrimPrefix(template, basePath)
+
+			latency, failed := injector.inject(models.FaultRoute, template, r.Method)
+			if err := sleep(r.Context(), latency); err != nil {
+				return nil
+			}
+			if failed != nil {
+				api.InjectedFaultError(failed.Status).Render(w, failed.Status)
+				return nil
+			}
+
+			return next(w, r)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package faults
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+// newInjector returns an injector whose faults fire when random returns less
+// than their error rate
+func newInjector(random float64, now time.Time) *Injector {
+	injector := NewInjector()
+	injector.random = func() float64 { return random }
+	injector.now = func() time.Time { return now }
+	return injector
+}
+
+func TestAddValidates(t *testing.T) {
+	for _, tc := range []struct {
+		fault models.Fault
+		err   string
+	}{
+		{models.Fault{Target: "database", Match: "*", ErrorRate: 1}, "target must be route or executor"},
+		{models.Fault{Target: models.FaultRoute, ErrorRate: 1}, "match must be a route's path template, an executor operation, or *"},
+		{models.Fault{Target: models.FaultExecutor, Match: "CreateInstance", Method: "POST", ErrorRate: 1}, "method only applies to route faults"},
+		{models.Fault{Target: models.FaultRoute, Match: "*", ErrorRate: 1.5}, "error_rate must be between 0 and 1"},
+		{models.Fault{Target: models.FaultRoute, Match: "*"}, "a fault must have an error_rate or a latency"},
+		{models.Fault{Target: models.FaultRoute, Match: "*", Latency: "soon"}, "latency must be a duration, e.g. 2s"},
+		{models.Fault{Target: models.FaultRoute, Match: "*", ErrorRate: 1, Status: 200}, "status must be an error status"},
+	} {
+		_, err := NewInjector().Add(tc.fault, 0)
+		assert.EqualError(t, err, tc.err)
+	}
+}
+
+func TestAddDefaults(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	injector := newInjector(0, now)
+
+	fault, err := injector.Add(models.Fault{Target: models.FaultRoute, Match: "/instances", Method: "post", ErrorRate: 0.5}, 10*time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fault.ID)
+	assert.Equal(t, "POST", fault.Method)
+	assert.Equal(t, http.StatusServiceUnavailable, fault.Status)
+	assert.Equal(t, now, fault.CreatedAt)
+	assert.Equal(t, now.Add(10*time.Minute), *fault.ExpiresAt)
+
+	assert.Equal(t, []models.Fault{fault}, injector.List())
+}
+
+func TestInject(t *testing.T) {
+	injector := newInjector(0.3, time.Now())
+
+	_, err := injector.Add(models.Fault{Target: models.FaultRoute, Match: "/instances", Method: "POST", Latency: "1s"}, 0)
+	assert.Nil(t, err)
+	_, err = injector.Add(models.Fault{Target: models.FaultRoute, Match: "*", Latency: "2s", ErrorRate: 0.2}, 0)
+	assert.Nil(t, err)
+	unlikely, err := injector.Add(models.Fault{Target: models.FaultRoute, Match: "/instances", ErrorRate: 0.5, Status: 500}, 0)
+	assert.Nil(t, err)
+
+	latency, failed := injector.inject(models.FaultRoute, "/instances", "POST")
+	assert.Equal(t, 3*time.Second, latency)
+	assert.Equal(t, &unlikely, failed)
+
+	latency, failed = injector.inject(models.FaultRoute, "/instances", "GET")
+	assert.Equal(t, 2*time.Second, latency)
+	assert.Equal(t, &unlikely, failed)
+
+	latency, failed = injector.inject(models.FaultRoute, "/images", "GET")
+	assert.Equal(t, 2*time.Second, latency)
+	assert.Nil(t, failed)
+
+	latency, failed = injector.inject(models.FaultExecutor, "CreateInstance", "")
+	assert.Equal(t, time.Duration(0), latency)
+	assert.Nil(t, failed)
+}
+
+func TestInjectRemovesExpiredFaults(t *testing.T) {
+	now := time.Now()
+	injector := newInjector(0, now)
+
+	_, err := injector.Add(models.Fault{Target: models.FaultRoute, Match: "*", ErrorRate: 1}, time.Minute)
+	assert.Nil(t, err)
+
+	_, failed := injector.inject(models.FaultRoute, "/images", "GET")
+	assert.NotNil(t, failed)
+
+	injector.now = func() time.Time { return now.Add(time.Minute) }
+	_, failed = injector.inject(models.FaultRoute, "/images", "GET")
+	assert.Nil(t, failed)
+	assert.Empty(t, injector.List())
+}
+
+func TestRemoveAndClear(t *testing.T) {
+	injector := NewInjector()
+
+	first, _ := injector.Add(models.Fault{Target: models.FaultRoute, Match: "*", ErrorRate: 1}, 0)
+	second, _ := injector.Add(models.Fault{Target: models.FaultExecutor, Match: "*", ErrorRate: 1}, 0)
+
+	assert.True(t, injector.Remove(first.ID))
+	assert.False(t, injector.Remove(first.ID))
+	assert.Equal(t, []models.Fault{second}, injector.List())
+
+	injector.Clear()
+	assert.Empty(t, injector.List())
+}
+
+func TestMiddleware(t *testing.T) {
+	injector := newInjector(0, time.Now())
+	_, err := injector.Add(models.Fault{Target: models.FaultRoute, Match: "/instances/{id}", Method: "DELETE", ErrorRate: 1}, 0)
+	assert.Nil(t, err)
+
+	handler := chain.New(func(h chain.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { assert.Nil(t, h(w, r)) }
+	}).Add(Middleware(injector, "/draupnir")).Resolve(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+
+	router := mux.NewRouter().PathPrefix("/draupnir").Subrouter()
+	router.Methods("GET", "DELETE").Path("/instances/{id}").HandlerFunc(handler)
+
+	for _, tc := range []struct {
+		method string
+		status int
+	}{
+		{"DELETE", http.StatusServiceUnavailable},
+		{"GET", http.StatusNoContent},
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(tc.method, "/draupnir/instances/1", nil))
+
+		assert.Equal(t, tc.status, recorder.Code, tc.method)
+		if tc.status == http.StatusServiceUnavailable {
+			body, _ := ioutil.ReadAll(recorder.Body)
+			assert.Contains(t, string(body), "Injected Fault")
+		}
+	}
+}
+
+type fakeExecutor struct {
+	exec.Executor
+	destroyed []int
+}
+
+func (e *fakeExecutor) DestroyInstance(ctx context.Context, id int) error {
+	e.destroyed = append(e.destroyed, id)
+	return nil
+}
+
+func (e *fakeExecutor) DestroyImage(ctx context.Context, id int) error {
+	return nil
+}
+
+func TestExecutor(t *testing.T) {
+	injector := newInjector(0, time.Now())
+	_, err := injector.Add(models.Fault{Target: models.FaultExecutor, Match: "DestroyInstance", ErrorRate: 1}, 0)
+	assert.Nil(t, err)
+
+	inner := &fakeExecutor{}
+	executor := Executor{Executor: inner, Injector: injector}
+
+	err = executor.DestroyInstance(context.Background(), 1)
+	assert.EqualError(t, err, "DestroyInstance: injected fault")
+	assert.Equal(t, ErrInjected, errors.Cause(err))
+	assert.Empty(t, inner.destroyed, "failed operations aren't run")
+
+	assert.Nil(t, executor.DestroyImage(context.Background(), 1))
+
+	injector.Clear()
+	assert.Nil(t, executor.DestroyInstance(context.Background(), 1))
+	assert.Equal(t, []int{1}, inner.destroyed)
+}
+
+func TestExecutorLatencyRespectsContext(t *testing.T) {
+	injector := NewInjector()
+	_, err := injector.Add(models.Fault{Target: models.FaultExecutor, Match: "*", Latency: "1h"}, 0)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	executor := Executor{Executor: &fakeExecutor{}, Injector: injector}
+	assert.Equal(t, context.Canceled, executor.DestroyImage(ctx, 1))
+}
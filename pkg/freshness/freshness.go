@@ -0,0 +1,234 @@
+// Package freshness checks that each image family always has a recent enough
+// ready image, so that a failed nightly bake is noticed by us before it's
+// noticed by the developers using the images.
+package freshness
+
+import (
+	"context"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// Images are in the family named by their FamilyAnnotation, or DefaultFamily
+// if they don't have one
+const (
+	FamilyAnnotation = "draupnir/family"
+	DefaultFamily    = "default"
+)
+
+// The statuses passed to notifiers when an SLA's status changes
+const (
+	StatusViolated  = "violated"
+	StatusRecovered = "recovered"
+)
+
+var (
+	slaMet = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "draupnir_freshness_sla_met",
+			Help: "Whether the image family has a ready image within its freshness SLA (1) or not (0)",
+		},
+		[]string{"family"},
+	)
+	latestBackupAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "draupnir_freshness_latest_backup_age_seconds",
+			Help: "Age of the backup of the image family's most recently backed up ready image",
+		},
+		[]string{"family"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(slaMet, latestBackupAge)
+}
+
+// Family returns the name of the image's family
+func Family(image models.Image) string {
+	if family, ok := image.Annotations[FamilyAnnotation].(string); ok && family != "" {
+		return family
+	}
+	return DefaultFamily
+}
+
+// SLA requires a family to always have a ready image that was backed up less
+// than MaxAge ago
+type SLA struct {
+	Family string
+	MaxAge time.Duration
+}
+
+// Evaluate returns the status of each SLA, in the same order, given every image
+func Evaluate(slas []SLA, images []models.Image, now time.Time) []models.FreshnessStatus {
+	latest := Latest(images)
+
+	statuses := make([]models.FreshnessStatus, 0, len(slas))
+	for _, sla := range slas {
+		status := models.FreshnessStatus{
+			ID:        sla.Family,
+			MaxAge:    sla.MaxAge.String(),
+			CheckedAt: now,
+		}
+
+		if image, ok := latest[sla.Family]; ok {
+			backedUpAt := image.BackedUpAt
+			violatedSince := backedUpAt.Add(sla.MaxAge)
+
+			status.LatestImageID = image.ID
+			status.LatestBackedUpAt = &backedUpAt
+			status.Met = now.Before(violatedSince)
+			if !status.Met {
+				status.ViolatedSince = &violatedSince
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// Latest returns the most recently backed up ready image of each family
+func Latest(images []models.Image) map[string]models.Image {
+	latest := map[string]models.Image{}
+	for _, image := range images {
+		if !image.Ready {
+			continue
+		}
+		family := Family(image)
+		if current, ok := latest[family]; !ok || image.BackedUpAt.After(current.BackedUpAt) {
+			latest[family] = image
+		}
+	}
+	return latest
+}
+
+// Notifier is told when an SLA is violated, or recovers after being violated
+type Notifier func(ctx context.Context, status string, freshness models.FreshnessStatus) error
+
+// Monitor checks the SLAs periodically, exporting their status as metrics and
+// notifying when it changes
+type Monitor struct {
+	Logger     log.Logger
+	SLAs       []SLA
+	ImageStore store.ImageStore
+	// Notify, if set, is called each time an SLA is violated or recovers. SLAs
+	// that are violated when the server starts are notified too.
+	Notify Notifier
+
+	mu sync.Mutex
+	// met records whether each family met its SLA when it was last checked
+	met map[string]bool
+}
+
+// Start checks the SLAs immediately, and then every interval until the context
+// is done
+func (m *Monitor) Start(ctx context.Context, interval time.Duration) error {
+	for {
+		if _, err := m.Check(ctx); err != nil {
+			m.Logger.With("error", err).Error("failed to check freshness SLAs")
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Check evaluates the SLAs, and notifies for any whose status has changed
+// since they were last checked
+func (m *Monitor) Check(ctx context.Context) ([]models.FreshnessStatus, error) {
+	images, err := m.ImageStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	statuses := Evaluate(m.SLAs, images, now)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.met == nil {
+		m.met = map[string]bool{}
+	}
+
+	for _, status := range statuses {
+		if status.Met {
+			slaMet.WithLabelValues(status.ID).Set(1)
+		} else {
+			slaMet.WithLabelValues(status.ID).Set(0)
+		}
+		if status.LatestBackedUpAt != nil {
+			latestBackupAge.WithLabelValues(status.ID).Set(now.Sub(*status.LatestBackedUpAt).Seconds())
+		} else {
+			latestBackupAge.DeleteLabelValues(status.ID)
+		}
+
+		previouslyMet, checked := m.met[status.ID]
+		m.met[status.ID] = status.Met
+
+		switch {
+		case !status.Met && (!checked || previouslyMet):
+			m.Logger.With("family", status.ID).With("latest_image", status.LatestImageID).Warn("freshness SLA violated")
+			m.notify(ctx, StatusViolated, status)
+		case status.Met && checked && !previouslyMet:
+			m.Logger.With("family", status.ID).With("latest_image", status.LatestImageID).Info("freshness SLA recovered")
+			m.notify(ctx, StatusRecovered, status)
+		}
+	}
+
+	return statuses, nil
+}
+
+// notify calls the notifier. Failing to notify is logged, but doesn't stop the
+// other SLAs from being checked.
+func (m *Monitor) notify(ctx context.Context, status string, freshness models.FreshnessStatus) {
+	if m.Notify == nil {
+		return
+	}
+	if err := m.Notify(ctx, status, freshness); err != nil {
+		m.Logger.With("family", freshness.ID).With("error", err).Warn("failed to notify freshness SLA status")
+	}
+}
+
+// CommandNotifier notifies by running command with sh, passing the status in
+// the environment as DRAUPNIR_FRESHNESS_STATUS ("violated" or "recovered"),
+// DRAUPNIR_FRESHNESS_FAMILY, DRAUPNIR_FRESHNESS_MAX_AGE,
+// DRAUPNIR_FRESHNESS_LATEST_IMAGE_ID and DRAUPNIR_FRESHNESS_LATEST_BACKED_UP_AT
+// (empty if the family has no ready images)
+func CommandNotifier(command string) Notifier {
+	return func(ctx context.Context, status string, freshness models.FreshnessStatus) error {
+		backedUpAt := ""
+		if freshness.LatestBackedUpAt != nil {
+			backedUpAt = freshness.LatestBackedUpAt.UTC().Format(time.RFC3339)
+		}
+
+		cmd := osexec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = append(
+			os.Environ(),
+			"DRAUPNIR_FRESHNESS_STATUS="+status,
+			"DRAUPNIR_FRESHNESS_FAMILY="+freshness.ID,
+			"DRAUPNIR_FRESHNESS_MAX_AGE="+freshness.MaxAge,
+			"DRAUPNIR_FRESHNESS_LATEST_IMAGE_ID="+strconv.Itoa(freshness.LatestImageID),
+			"DRAUPNIR_FRESHNESS_LATEST_BACKED_UP_AT="+backedUpAt,
+		)
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, output)
+		}
+		return nil
+	}
+}
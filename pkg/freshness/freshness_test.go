@@ -0,0 +1,108 @@
+package freshness
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+type fakeImageStore struct {
+	store.ImageStore
+	images *[]models.Image
+}
+
+func (s fakeImageStore) List() ([]models.Image, error) {
+	return append([]models.Image{}, *s.images...), nil
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Date(2017, 5, 2, 12, 0, 0, 0, time.UTC)
+	images := []models.Image{
+		{ID: 1, Ready: true, BackedUpAt: now.Add(-48 * time.Hour)},
+		{ID: 2, Ready: true, BackedUpAt: now.Add(-24 * time.Hour)},
+		// Unready images don't count, however recent they are
+		{ID: 3, Ready: false, BackedUpAt: now.Add(-time.Hour)},
+		{
+			ID: 4, Ready: true, BackedUpAt: now.Add(-40 * time.Hour),
+			Annotations: models.Annotations{FamilyAnnotation: "payments"},
+		},
+	}
+
+	statuses := Evaluate([]SLA{
+		{Family: DefaultFamily, MaxAge: 36 * time.Hour},
+		{Family: "payments", MaxAge: 36 * time.Hour},
+		{Family: "reporting", MaxAge: 36 * time.Hour},
+	}, images, now)
+
+	defaultBackedUpAt := now.Add(-24 * time.Hour)
+	paymentsBackedUpAt := now.Add(-40 * time.Hour)
+	paymentsViolatedSince := now.Add(-4 * time.Hour)
+
+	assert.Equal(t, []models.FreshnessStatus{
+		{
+			ID: "default", MaxAge: "36h0m0s", Met: true, CheckedAt: now,
+			LatestImageID: 2, LatestBackedUpAt: &defaultBackedUpAt,
+		},
+		{
+			ID: "payments", MaxAge: "36h0m0s", Met: false, CheckedAt: now,
+			LatestImageID: 4, LatestBackedUpAt: &paymentsBackedUpAt, ViolatedSince: &paymentsViolatedSince,
+		},
+		{ID: "reporting", MaxAge: "36h0m0s", Met: false, CheckedAt: now},
+	}, statuses)
+}
+
+func TestMonitorCheck(t *testing.T) {
+	images := []models.Image{
+		{ID: 1, Ready: true, BackedUpAt: time.Now().Add(-48 * time.Hour)},
+	}
+
+	var notified []string
+	monitor := &Monitor{
+		Logger:     log.Base(),
+		SLAs:       []SLA{{Family: DefaultFamily, MaxAge: 36 * time.Hour}},
+		ImageStore: fakeImageStore{images: &images},
+		Notify: func(ctx context.Context, status string, freshness models.FreshnessStatus) error {
+			notified = append(notified, status)
+			return nil
+		},
+	}
+
+	// An SLA that's violated when first checked is notified, but only once
+	for i := 0; i < 2; i++ {
+		_, err := monitor.Check(context.Background())
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{StatusViolated}, notified)
+
+	images = append(images, models.Image{ID: 2, Ready: true, BackedUpAt: time.Now()})
+	statuses, err := monitor.Check(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, statuses[0].Met)
+	assert.Equal(t, 2, statuses[0].LatestImageID)
+	assert.Equal(t, []string{StatusViolated, StatusRecovered}, notified)
+}
+
+func TestCommandNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir-freshness")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notified")
+	notify := CommandNotifier(`echo "$DRAUPNIR_FRESHNESS_STATUS $DRAUPNIR_FRESHNESS_FAMILY $DRAUPNIR_FRESHNESS_LATEST_IMAGE_ID" > ` + path)
+
+	err = notify(context.Background(), StatusViolated, models.FreshnessStatus{ID: "payments", MaxAge: "36h0m0s"})
+	assert.Nil(t, err)
+
+	output, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "violated payments 0\n", string(output))
+}
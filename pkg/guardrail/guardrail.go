@@ -0,0 +1,145 @@
+// Package guardrail scans the settings of images for references to production,
+// such as a primary_conninfo or foreign server that points at a production
+// host, so that clones can't connect back to the databases they were taken
+// from.
+package guardrail
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+const (
+	// ModeWarn logs each finding, but lets images and instances be used
+	ModeWarn = "warn"
+	// ModeBlock fails finalisations and instance creations that have findings
+	ModeBlock = "block"
+)
+
+// Scanner finds production hosts and credentials in an image's settings
+type Scanner struct {
+	// Mode is ModeWarn or ModeBlock. Nothing is scanned if it's empty.
+	Mode string
+	// ProductionHosts are glob patterns, e.g. "*.prod.example.com" or "10.1.*",
+	// matched case-insensitively against every hostname or address in a setting
+	ProductionHosts []string
+}
+
+// Finding is a setting that refers to production. It doesn't include the
+// setting's value, which may contain a password, so that it can be logged.
+type Finding struct {
+	Source string
+	Name   string
+	Reason string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s %s %s", f.Source, f.Name, f.Reason)
+}
+
+// BlockedError is returned when an image has findings and the scanner's mode is
+// ModeBlock
+type BlockedError struct {
+	Findings []Finding
+}
+
+func (e BlockedError) Error() string {
+	findings := make([]string, len(e.Findings))
+	for i, finding := range e.Findings {
+		findings[i] = finding.String()
+	}
+	return "image refers to production: " + strings.Join(findings, "; ")
+}
+
+// Validate checks that the mode and patterns are valid
+func (s Scanner) Validate() error {
+	switch s.Mode {
+	case "", ModeWarn, ModeBlock:
+	default:
+		return fmt.Errorf("unknown guardrail mode %q: must be %q or %q", s.Mode, ModeWarn, ModeBlock)
+	}
+
+	for _, pattern := range s.ProductionHosts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid production host pattern %q: %s", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// Enabled reports whether images should be scanned
+func (s Scanner) Enabled() bool {
+	return s.Mode != ""
+}
+
+// Check scans the settings, returning a BlockedError if there are findings and
+// the mode is ModeBlock. Otherwise it returns the findings, which the caller
+// should log.
+func (s Scanner) Check(settings []models.CloneSetting) ([]Finding, error) {
+	findings := s.Scan(settings)
+	if len(findings) > 0 && s.Mode == ModeBlock {
+		return findings, BlockedError{Findings: findings}
+	}
+	return findings, nil
+}
+
+// hostPattern matches the hostnames and IPv4 addresses in a setting, along with
+// any other words, which won't match a production host pattern
+var hostPattern = regexp.MustCompile(`[A-Za-z0-9][A-Za-z0-9.\-]*`)
+
+// passwordPatterns match a password in a libpq connection string, either as a
+// keyword or within a URI
+var passwordPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bpassword\s*=\s*'?[^\s']`),
+	regexp.MustCompile(`://[^/\s:@]+:[^/\s@]+@`),
+}
+
+// Scan returns a finding for each setting that refers to a production host or
+// contains a password. Clones have their own credentials, so a password in an
+// image can only have come from the source.
+func (s Scanner) Scan(settings []models.CloneSetting) []Finding {
+	findings := []Finding{}
+
+	for _, setting := range settings {
+		if host := s.productionHost(setting.Value); host != "" {
+			findings = append(findings, Finding{
+				Source: setting.Source,
+				Name:   setting.Name,
+				Reason: fmt.Sprintf("refers to production host %s", host),
+			})
+		}
+
+		for _, pattern := range passwordPatterns {
+			if pattern.MatchString(setting.Value) {
+				findings = append(findings, Finding{
+					Source: setting.Source,
+					Name:   setting.Name,
+					Reason: "contains a password",
+				})
+				break
+			}
+		}
+	}
+
+	return findings
+}
+
+// productionHost returns the first host in the value that matches one of the
+// production host patterns, or an empty string if none do
+func (s Scanner) productionHost(value string) string {
+	for _, host := range hostPattern.FindAllString(value, -1) {
+		host = strings.ToLower(strings.TrimRight(host, ".-"))
+		for _, pattern := range s.ProductionHosts {
+			if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+				return host
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,179 @@
+// Package jobs records long-running operations, such as finalising an image,
+// so that the operations that were interrupted by the server dying can be
+// recovered when it next starts.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/prometheus/common/log"
+)
+
+// Run records a job of the given kind while run is running. Failing to record
+// the job is logged, but doesn't stop it from running: the job itself is more
+// important than our record of it.
+func Run(logger log.Logger, jobStore store.JobStore, kind string, resourceID int, run func() error) error {
+	logger = logger.With("job", kind).With("resource", resourceID)
+
+	job, err := jobStore.Create(models.NewJob(kind, resourceID))
+	if err != nil {
+		logger.With("error", err).Warn("failed to record start of job")
+	}
+
+	runErr := run()
+
+	if job.ID != 0 {
+		if _, err := jobStore.Finish(job.Finish(runErr)); err != nil {
+			logger.With("error", err).Warn("failed to record end of job")
+		}
+	}
+
+	return runErr
+}
+
+// InterruptedFinalisationReason is recorded against finalisations that were
+// interrupted. The anonymisation script may have partially run against the
+// upload, so it isn't safe to finalise it again.
+const InterruptedFinalisationReason = "the server stopped while the image was being finalised, " +
+	"so its upload may be partially anonymised: destroy the image and upload it again"
+
+// QueuedOperationReason is recorded against operations that hadn't started
+// when the server stopped
+const QueuedOperationReason = "the server stopped before the operation started: start it again"
+
+// Watchdog recovers the jobs that were running when the previous server process
+// died. It must run before the server starts serving requests, as it assumes
+// that every running job belongs to a previous process.
+type Watchdog struct {
+	Logger        log.Logger
+	JobStore      store.JobStore
+	ImageStore    store.ImageStore
+	InstanceStore store.InstanceStore
+	BakeSpanStore store.BakeSpanStore
+	Executor      exec.Executor
+}
+
+// Recover marks each running job as interrupted, and then cleans up after it.
+// Queued operations are failed.
+//
+// Finalisations are failed, after stopping postgres and deleting any partial
+// snapshot (which is retried if that was interrupted too). Destroys are retried
+// if the image or instance had already been removed from the database, as its
+// files may still be on disk. Otherwise nothing had been deleted yet, and the
+// destroy can be retried by the client.
+func (w Watchdog) Recover(ctx context.Context) error {
+	// We need to add a logger to the context, as the exec package depends on one
+	// being present in order to log
+	ctx = context.WithValue(ctx, middleware.LoggerKey, &w.Logger)
+
+	jobs, err := w.JobStore.ListRunning()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		logger := w.Logger.With("job", job.ID).With("kind", job.Kind).With("resource", job.ResourceID)
+
+		// Nothing has been done for operations that were still queued, so they
+		// can safely be started again
+		if job.Status == models.JobQueued {
+			logger.Warn("failing queued operation")
+			if _, err := w.JobStore.Finish(job.Finish(errors.New(QueuedOperationReason))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		logger.Warn("recovering interrupted job")
+
+		var recoverErr error
+		switch job.Kind {
+		case models.JobFinaliseImage:
+			job = job.Interrupt(InterruptedFinalisationReason)
+			recoverErr = w.recoverFinalisation(ctx, job)
+		case models.JobResetImage:
+			job = job.Interrupt("the server stopped while the image was being reset")
+			recoverErr = w.resetImage(ctx, job.ResourceID)
+		case models.JobDestroyImage:
+			job = job.Interrupt("the server stopped while the image was being destroyed")
+			recoverErr = w.recoverDestroy(job, w.imageExists, func() error {
+				return w.Executor.DestroyImage(ctx, job.ResourceID)
+			})
+		case models.JobDestroyInstance:
+			job = job.Interrupt("the server stopped while the instance was being destroyed")
+			recoverErr = w.recoverDestroy(job, w.instanceExists, func() error {
+				return w.Executor.DestroyInstance(ctx, job.ResourceID)
+			})
+		default:
+			job = job.Interrupt("the server stopped while the job was running")
+		}
+
+		if _, err := w.JobStore.Finish(job); err != nil {
+			return err
+		}
+
+		if recoverErr != nil {
+			logger.With("error", recoverErr).Error("failed to recover interrupted job")
+		}
+	}
+
+	return nil
+}
+
+func (w Watchdog) recoverFinalisation(ctx context.Context, job models.Job) error {
+	spans, err := w.BakeSpanStore.List(job.ResourceID)
+	if err != nil {
+		return err
+	}
+
+	for _, span := range spans {
+		if span.FinishedAt == nil {
+			if _, err := w.BakeSpanStore.Finish(span.Finish(fmt.Errorf("interrupted: %s", job.Error))); err != nil {
+				return err
+			}
+		}
+	}
+
+	return w.resetImage(ctx, job.ResourceID)
+}
+
+func (w Watchdog) resetImage(ctx context.Context, id int) error {
+	return Run(w.Logger, w.JobStore, models.JobResetImage, id, func() error {
+		return w.Executor.ResetImage(ctx, id)
+	})
+}
+
+// recoverDestroy retries an interrupted destroy, if the resource has already
+// been removed from the database
+func (w Watchdog) recoverDestroy(job models.Job, exists func(int) (bool, error), destroy func() error) error {
+	found, err := exists(job.ResourceID)
+	if err != nil || found {
+		return err
+	}
+
+	return Run(w.Logger, w.JobStore, job.Kind, job.ResourceID, destroy)
+}
+
+func (w Watchdog) imageExists(id int) (bool, error) {
+	_, err := w.ImageStore.Get(id)
+	return found(err)
+}
+
+func (w Watchdog) instanceExists(id int) (bool, error) {
+	_, err := w.InstanceStore.Get(id)
+	return found(err)
+}
+
+func found(err error) (bool, error) {
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,264 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeJobStore holds jobs in memory, so that we can see what the watchdog
+// records against them. It's locked, as workers record jobs concurrently.
+type fakeJobStore struct {
+	mu   sync.Mutex
+	jobs []models.Job
+}
+
+func (s *fakeJobStore) Create(job models.Job) (models.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.ID = len(s.jobs) + 1
+	s.jobs = append(s.jobs, job)
+	return job, nil
+}
+
+func (s *fakeJobStore) Start(job models.Job) (models.Job, error) {
+	return s.Finish(job)
+}
+
+func (s *fakeJobStore) Finish(job models.Job) (models.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID-1] = job
+	return job, nil
+}
+
+func (s *fakeJobStore) Get(id int) (models.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id < 1 || id > len(s.jobs) {
+		return models.Job{}, sql.ErrNoRows
+	}
+	return s.jobs[id-1], nil
+}
+
+func (s *fakeJobStore) ListRunning() ([]models.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	running := []models.Job{}
+	for _, job := range s.jobs {
+		if job.Status == models.JobQueued || job.Status == models.JobRunning {
+			running = append(running, job)
+		}
+	}
+	return running, nil
+}
+
+func (s *fakeJobStore) Latest(kind string, resourceID int) (models.Job, error) {
+	return models.Job{}, sql.ErrNoRows
+}
+
+// The stores and executor embed their interfaces, so that calling anything we
+// haven't faked panics
+type fakeImageStore struct {
+	store.ImageStore
+	images map[int]models.Image
+}
+
+func (s fakeImageStore) Get(id int) (models.Image, error) {
+	image, ok := s.images[id]
+	if !ok {
+		return image, sql.ErrNoRows
+	}
+	return image, nil
+}
+
+type fakeInstanceStore struct {
+	store.InstanceStore
+	instances map[int]models.Instance
+}
+
+func (s fakeInstanceStore) Get(id int) (models.Instance, error) {
+	instance, ok := s.instances[id]
+	if !ok {
+		return instance, sql.ErrNoRows
+	}
+	return instance, nil
+}
+
+type fakeBakeSpanStore struct {
+	store.BakeSpanStore
+	spans []models.BakeSpan
+}
+
+func (s *fakeBakeSpanStore) List(imageID int) ([]models.BakeSpan, error) {
+	return s.spans, nil
+}
+
+func (s *fakeBakeSpanStore) Finish(span models.BakeSpan) (models.BakeSpan, error) {
+	for idx := range s.spans {
+		if s.spans[idx].ID == span.ID {
+			s.spans[idx] = span
+		}
+	}
+	return span, nil
+}
+
+type fakeExecutor struct {
+	exec.Executor
+	resetErr           error
+	resetImages        []int
+	destroyedImages    []int
+	destroyedInstances []int
+}
+
+func (e *fakeExecutor) ResetImage(ctx context.Context, id int) error {
+	e.resetImages = append(e.resetImages, id)
+	return e.resetErr
+}
+
+func (e *fakeExecutor) DestroyImage(ctx context.Context, id int) error {
+	e.destroyedImages = append(e.destroyedImages, id)
+	return nil
+}
+
+func (e *fakeExecutor) DestroyInstance(ctx context.Context, id int) error {
+	e.destroyedInstances = append(e.destroyedInstances, id)
+	return nil
+}
+
+func newWatchdog(jobStore store.JobStore, executor exec.Executor) (Watchdog, *bytes.Buffer) {
+	var logs bytes.Buffer
+	return Watchdog{
+		Logger:        log.NewLogger(&logs),
+		JobStore:      jobStore,
+		ImageStore:    fakeImageStore{images: map[int]models.Image{1: {ID: 1}}},
+		InstanceStore: fakeInstanceStore{instances: map[int]models.Instance{1: {ID: 1}}},
+		BakeSpanStore: &fakeBakeSpanStore{},
+		Executor:      executor,
+	}, &logs
+}
+
+func TestRun(t *testing.T) {
+	jobStore := &fakeJobStore{}
+	logger := log.NewLogger(&bytes.Buffer{})
+
+	err := Run(logger, jobStore, models.JobDestroyImage, 1, func() error {
+		assert.Equal(t, models.JobRunning, jobStore.jobs[0].Status)
+		return errors.New("exit status 1")
+	})
+
+	assert.EqualError(t, err, "exit status 1")
+	assert.Equal(t, models.JobFailed, jobStore.jobs[0].Status)
+	assert.Equal(t, "exit status 1", jobStore.jobs[0].Error)
+	assert.NotNil(t, jobStore.jobs[0].FinishedAt)
+}
+
+func TestRecoverFinalisation(t *testing.T) {
+	jobStore := &fakeJobStore{}
+	jobStore.Create(models.NewJob(models.JobFinaliseImage, 2))
+
+	executor := &fakeExecutor{}
+	watchdog, _ := newWatchdog(jobStore, executor)
+	spanStore := &fakeBakeSpanStore{spans: []models.BakeSpan{
+		models.NewBakeSpan(2, models.BakePhaseSnapshotBase).Finish(nil),
+		models.NewBakeSpan(2, models.BakePhaseFinalise),
+	}}
+	spanStore.spans[0].ID = 1
+	spanStore.spans[1].ID = 2
+	watchdog.BakeSpanStore = spanStore
+
+	err := watchdog.Recover(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2}, executor.resetImages)
+
+	assert.Equal(t, models.JobInterrupted, jobStore.jobs[0].Status)
+	assert.Equal(t, InterruptedFinalisationReason, jobStore.jobs[0].Error)
+	assert.Equal(t, models.JobResetImage, jobStore.jobs[1].Kind)
+	assert.Equal(t, models.JobSucceeded, jobStore.jobs[1].Status)
+
+	assert.Equal(t, "", spanStore.spans[0].Error)
+	assert.Equal(t, "interrupted: "+InterruptedFinalisationReason, spanStore.spans[1].Error)
+	assert.NotNil(t, spanStore.spans[1].FinishedAt)
+}
+
+func TestRecoverFinalisationWhenResetFails(t *testing.T) {
+	jobStore := &fakeJobStore{}
+	jobStore.Create(models.NewJob(models.JobFinaliseImage, 2))
+
+	executor := &fakeExecutor{resetErr: errors.New("exit status 1")}
+	watchdog, logs := newWatchdog(jobStore, executor)
+
+	err := watchdog.Recover(context.Background())
+
+	assert.Nil(t, err, "failing to recover a job shouldn't stop the server starting")
+	assert.Equal(t, models.JobInterrupted, jobStore.jobs[0].Status)
+	assert.Equal(t, models.JobFailed, jobStore.jobs[1].Status)
+	assert.Contains(t, logs.String(), "failed to recover interrupted job")
+}
+
+func TestRecoverDestroy(t *testing.T) {
+	jobStore := &fakeJobStore{}
+	// Image and instance 1 exist, so hadn't been deleted before we were
+	// interrupted
+	jobStore.Create(models.NewJob(models.JobDestroyImage, 1))
+	jobStore.Create(models.NewJob(models.JobDestroyImage, 2))
+	jobStore.Create(models.NewJob(models.JobDestroyInstance, 1))
+	jobStore.Create(models.NewJob(models.JobDestroyInstance, 3))
+
+	executor := &fakeExecutor{}
+	watchdog, _ := newWatchdog(jobStore, executor)
+
+	err := watchdog.Recover(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2}, executor.destroyedImages)
+	assert.Equal(t, []int{3}, executor.destroyedInstances)
+
+	for _, job := range jobStore.jobs[:4] {
+		assert.Equal(t, models.JobInterrupted, job.Status)
+	}
+	assert.Len(t, jobStore.jobs, 6)
+	assert.Equal(t, models.JobSucceeded, jobStore.jobs[4].Status)
+	assert.Equal(t, models.JobSucceeded, jobStore.jobs[5].Status)
+}
+
+func TestRecoverIgnoresFinishedJobs(t *testing.T) {
+	jobStore := &fakeJobStore{}
+	job, _ := jobStore.Create(models.NewJob(models.JobDestroyImage, 2))
+	jobStore.Finish(job.Finish(nil))
+
+	executor := &fakeExecutor{}
+	watchdog, _ := newWatchdog(jobStore, executor)
+
+	err := watchdog.Recover(context.Background())
+
+	assert.Nil(t, err)
+	assert.Len(t, executor.destroyedImages, 0)
+	assert.Equal(t, models.JobSucceeded, jobStore.jobs[0].Status)
+}
+
+func TestRecoverQueuedOperation(t *testing.T) {
+	jobStore := &fakeJobStore{}
+	jobStore.Create(models.NewQueuedJob(models.JobFinaliseImage, 2, "test@draupnir"))
+
+	executor := &fakeExecutor{}
+	watchdog, _ := newWatchdog(jobStore, executor)
+
+	err := watchdog.Recover(context.Background())
+
+	assert.Nil(t, err)
+	assert.Empty(t, executor.resetImages, "nothing had been done to the image")
+	assert.Len(t, jobStore.jobs, 1)
+	assert.Equal(t, models.JobFailed, jobStore.jobs[0].Status)
+	assert.Equal(t, QueuedOperationReason, jobStore.jobs[0].Error)
+}
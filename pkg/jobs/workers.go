@@ -0,0 +1,121 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/prometheus/common/log"
+)
+
+// DefaultWorkers is how many operations run at once by default, and
+// DefaultQueueSize how many can be waiting for a worker
+const (
+	DefaultWorkers   = 4
+	DefaultQueueSize = 100
+)
+
+// ErrQueueFull is returned by Submit when too many operations are waiting for
+// a worker to accept another
+var ErrQueueFull = errors.New("too many operations are queued")
+
+// Workers run jobs in the background, as operations, so that the requests that
+// start them needn't wait for them to finish. Jobs are recorded as queued when
+// they're submitted, and run in the order they were submitted as workers become
+// free.
+type Workers struct {
+	Logger   log.Logger
+	JobStore store.JobStore
+
+	concurrency int
+	queue       chan operation
+}
+
+type operation struct {
+	logger log.Logger
+	job    models.Job
+	run    func(ctx context.Context) error
+}
+
+func NewWorkers(logger log.Logger, jobStore store.JobStore, concurrency, queueSize int) *Workers {
+	return &Workers{
+		Logger:      logger,
+		JobStore:    jobStore,
+		concurrency: concurrency,
+		queue:       make(chan operation, queueSize),
+	}
+}
+
+// Submit records the job as queued, and queues it to be run by a worker,
+// returning it so that its progress can be polled. The context that run is
+// given isn't cancelled when the request that submitted it finishes, and holds
+// the logger, as the exec package needs.
+func (w *Workers) Submit(logger log.Logger, job models.Job, run func(ctx context.Context) error) (models.Job, error) {
+	if len(w.queue) == cap(w.queue) {
+		return job, ErrQueueFull
+	}
+
+	job, err := w.JobStore.Create(job)
+	if err != nil {
+		return job, err
+	}
+
+	select {
+	case w.queue <- operation{logger: logger, job: job, run: run}:
+		return job, nil
+	default:
+		// Another operation took the last place in the queue since we checked
+		_, err := w.JobStore.Finish(job.Finish(ErrQueueFull))
+		if err != nil {
+			logger.With("error", err).Warn("failed to record end of job")
+		}
+		return job, ErrQueueFull
+	}
+}
+
+// Start runs the queued jobs until the context is done. Jobs that are still
+// queued then are failed by the Watchdog when the server next starts.
+func (w *Workers) Start(ctx context.Context) error {
+	done := make(chan struct{})
+	for i := 0; i < w.concurrency; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case op := <-w.queue:
+					w.run(ctx, op)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < w.concurrency; i++ {
+		<-done
+	}
+	return nil
+}
+
+// run records the job as running while it runs. As with Run, failing to record
+// it is logged, but doesn't stop it from running.
+func (w *Workers) run(ctx context.Context, op operation) {
+	logger := op.logger.With("job", op.job.Kind).With("resource", op.job.ResourceID)
+	ctx = context.WithValue(ctx, middleware.LoggerKey, &logger)
+
+	job, err := w.JobStore.Start(op.job.Start())
+	if err != nil {
+		logger.With("error", err).Warn("failed to record start of job")
+	}
+
+	runErr := op.run(ctx)
+	if runErr != nil {
+		logger.With("error", runErr).Error("operation failed")
+	}
+
+	if _, err := w.JobStore.Finish(job.Finish(runErr)); err != nil {
+		logger.With("error", err).Warn("failed to record end of job")
+	}
+}
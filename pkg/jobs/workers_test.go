@@ -0,0 +1,69 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestWorkers(t *testing.T) {
+	jobStore := &fakeJobStore{}
+	workers := NewWorkers(log.NewNopLogger(), jobStore, 1, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		workers.Start(ctx)
+		close(stopped)
+	}()
+
+	finished := make(chan struct{}, 2)
+	job, err := workers.Submit(log.NewNopLogger(), models.NewQueuedJob(models.JobDestroyImage, 1, "test@draupnir"), func(ctx context.Context) error {
+		defer func() { finished <- struct{}{} }()
+		current, _ := jobStore.Get(1)
+		assert.Equal(t, models.JobRunning, current.Status)
+		// The exec package needs a logger in the context
+		exec.GetLogger(ctx)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, job.ID)
+
+	_, err = workers.Submit(log.NewNopLogger(), models.NewQueuedJob(models.JobDestroyImage, 2, "test@draupnir"), func(ctx context.Context) error {
+		defer func() { finished <- struct{}{} }()
+		return errors.New("exit status 1")
+	})
+	assert.Nil(t, err)
+
+	<-finished
+	<-finished
+	cancel()
+	<-stopped
+
+	succeeded, _ := jobStore.Get(1)
+	assert.Equal(t, models.JobSucceeded, succeeded.Status)
+	assert.Equal(t, "test@draupnir", succeeded.UserEmail)
+	failed, _ := jobStore.Get(2)
+	assert.Equal(t, models.JobFailed, failed.Status)
+	assert.Equal(t, "exit status 1", failed.Error)
+}
+
+func TestWorkersWhenQueueIsFull(t *testing.T) {
+	jobStore := &fakeJobStore{}
+	// The workers aren't started, so nothing leaves the queue
+	workers := NewWorkers(log.NewNopLogger(), jobStore, 1, 1)
+	run := func(ctx context.Context) error { return nil }
+
+	_, err := workers.Submit(log.NewNopLogger(), models.NewQueuedJob(models.JobDestroyImage, 1, ""), run)
+	assert.Nil(t, err)
+
+	_, err = workers.Submit(log.NewNopLogger(), models.NewQueuedJob(models.JobDestroyImage, 2, ""), run)
+	assert.Equal(t, ErrQueueFull, err)
+	assert.Len(t, jobStore.jobs, 1, "the rejected operation isn't recorded")
+}
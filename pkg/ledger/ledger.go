@@ -0,0 +1,210 @@
+// Package ledger reserves per-host resources, such as ports, for instances by
+// taking leases on them in the database. Leases are taken atomically, so
+// servers sharing a database can't give two instances the same port, and a
+// lease taken by a server that dies part way through creating an instance
+// expires rather than leaking.
+package ledger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// DefaultTTL is how long a lease lasts without being renewed, unless configured
+// otherwise
+const DefaultTTL = time.Minute
+
+// portAttempts is how many random ports are tried before giving up
+const portAttempts = 100
+
+// Ledger takes leases on behalf of a single server
+type Ledger struct {
+	Logger log.Logger
+	Store  store.LeaseStore
+	// Owner identifies this server, and must differ from that of any other
+	// server sharing the database
+	Owner string
+	// TTL is how long the server's unbound leases last without being renewed
+	TTL time.Duration
+}
+
+// NewOwner returns an owner that identifies this process
+func NewOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+// Reserve takes a lease on the resource, returning whether it was free
+func (l Ledger) Reserve(kind, value string) (bool, error) {
+	now := time.Now()
+	expiresAt := now.Add(l.TTL)
+
+	return l.Store.Acquire(models.Lease{
+		Kind:        kind,
+		Value:       value,
+		Owner:       l.Owner,
+		ExpiresAt:   &expiresAt,
+		HeartbeatAt: now,
+		CreatedAt:   now,
+	})
+}
+
+// Bind binds a lease that we hold to the instance, so that it lasts until the
+// instance is destroyed
+func (l Ledger) Bind(kind, value string, instanceID int) error {
+	err := l.Store.Bind(kind, value, l.Owner, instanceID)
+	return errors.Wrapf(err, "failed to bind %s lease on %s to instance %d", kind, value, instanceID)
+}
+
+// Release gives up a lease that we hold, e.g. because the instance that it was
+// for couldn't be created
+func (l Ledger) Release(kind, value string) error {
+	err := l.Store.Release(kind, value, l.Owner)
+	return errors.Wrapf(err, "failed to release %s lease on %s", kind, value)
+}
+
+// held returns the values of the kind with leases that haven't expired
+func (l Ledger) held(kind string, now time.Time) (map[string]bool, error) {
+	leases, err := l.Store.List(kind)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list %s leases", kind)
+	}
+
+	held := map[string]bool{}
+	for _, lease := range leases {
+		if !lease.Expired(now) {
+			held[lease.Value] = true
+		}
+	}
+	return held, nil
+}
+
+// ReservePort leases a random port between minPort (inclusive) and maxPort
+// (exclusive)
+func (l Ledger) ReservePort(minPort, maxPort uint16) (uint16, error) {
+	if maxPort <= minPort {
+		return 0, errors.Errorf("No ports between %d and %d", minPort, maxPort)
+	}
+
+	held, err := l.held(models.LeasePort, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	for attempts := 1; attempts <= portAttempts; attempts++ {
+		port := minPort + uint16(mathrand.Intn(int(maxPort-minPort)))
+		value := strconv.Itoa(int(port))
+		if held[value] {
+			continue
+		}
+
+		// Another server may have taken it since we listed the leases
+		reserved, err := l.Reserve(models.LeasePort, value)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to reserve port")
+		}
+		if reserved {
+			return port, nil
+		}
+		held[value] = true
+	}
+
+	return 0, errors.Errorf("No free port found after %d attempts", portAttempts)
+}
+
+// ReserveAddress leases the lowest free address in the pool. The network and
+// broadcast addresses of IPv4 pools are never used, unless the pool is too
+// small to have them.
+func (l Ledger) ReserveAddress(pool *net.IPNet) (string, error) {
+	held, err := l.held(models.LeaseAddress, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	ones, bits := pool.Mask.Size()
+	reserved := pool.IP.To4() != nil && bits-ones > 1
+
+	address := pool.IP.Mask(pool.Mask)
+	if reserved {
+		address = nextIP(address)
+	}
+	for ; pool.Contains(address); address = nextIP(address) {
+		if reserved && !pool.Contains(nextIP(address)) {
+			break
+		}
+		if held[address.String()] {
+			continue
+		}
+
+		ok, err := l.Reserve(models.LeaseAddress, address.String())
+		if err != nil {
+			return "", errors.Wrap(err, "failed to reserve address")
+		}
+		if ok {
+			return address.String(), nil
+		}
+	}
+
+	return "", errors.Errorf("No free address found in %s", pool)
+}
+
+// nextIP returns the address after ip
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for idx := len(next) - 1; idx >= 0; idx-- {
+		next[idx]++
+		if next[idx] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// Start renews our unbound leases every third of their TTL until the context is
+// done, so that they don't expire while slow creates are in progress. Expired
+// leases, including those of servers that died, are removed at the same time.
+func (l Ledger) Start(ctx context.Context) error {
+	interval := l.TTL / 3
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil
+		}
+
+		now := time.Now()
+		if err := l.Store.Renew(l.Owner, now.Add(l.TTL)); err != nil {
+			l.Logger.With("error", err).Error("failed to renew leases")
+		}
+
+		removed, err := l.Store.DeleteExpired(now)
+		if err != nil {
+			l.Logger.With("error", err).Error("failed to remove expired leases")
+		} else if removed > 0 {
+			l.Logger.With("count", removed).Info("removed expired leases")
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package ledger
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// memoryStore keeps leases in memory, with the same semantics as the database
+type memoryStore struct {
+	mu     sync.Mutex
+	leases map[string]models.Lease
+}
+
+func newMemoryStore(leases ...models.Lease) *memoryStore {
+	s := &memoryStore{leases: map[string]models.Lease{}}
+	for _, lease := range leases {
+		s.leases[lease.Kind+"/"+lease.Value] = lease
+	}
+	return s
+}
+
+func (s *memoryStore) Acquire(lease models.Lease) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := lease.Kind + "/" + lease.Value
+	if existing, ok := s.leases[key]; ok && !existing.Expired(lease.HeartbeatAt) {
+		return false, nil
+	}
+	s.leases[key] = lease
+	return true, nil
+}
+
+func (s *memoryStore) Renew(owner string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, lease := range s.leases {
+		if lease.Owner == owner && lease.InstanceID == 0 {
+			lease.ExpiresAt = &expiresAt
+			s.leases[key] = lease
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Bind(kind, value, owner string, instanceID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lease := s.leases[kind+"/"+value]
+	lease.InstanceID = instanceID
+	lease.ExpiresAt = nil
+	s.leases[kind+"/"+value] = lease
+	return nil
+}
+
+func (s *memoryStore) Release(kind, value, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.leases[kind+"/"+value].Owner == owner {
+		delete(s.leases, kind+"/"+value)
+	}
+	return nil
+}
+
+func (s *memoryStore) List(kind string) ([]models.Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	leases := []models.Lease{}
+	for _, lease := range s.leases {
+		if lease.Kind == kind {
+			leases = append(leases, lease)
+		}
+	}
+	return leases, nil
+}
+
+func (s *memoryStore) DeleteExpired(now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed int64
+	for key, lease := range s.leases {
+		if lease.Expired(now) {
+			delete(s.leases, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func bound(kind, value string, instanceID int) models.Lease {
+	return models.Lease{Kind: kind, Value: value, Owner: "other", InstanceID: instanceID}
+}
+
+func expired(kind, value string) models.Lease {
+	expiresAt := time.Now().Add(-time.Second)
+	return models.Lease{Kind: kind, Value: value, Owner: "dead", ExpiresAt: &expiresAt}
+}
+
+func TestReservePort(t *testing.T) {
+	store := newMemoryStore(
+		bound(models.LeasePort, "5432", 1),
+		bound(models.LeasePort, "5433", 2),
+		expired(models.LeasePort, "5434"),
+	)
+	ledger := Ledger{Store: store, Owner: "test", TTL: time.Minute}
+
+	reserved := map[uint16]bool{}
+	for i := 0; i < 2; i++ {
+		port, err := ledger.ReservePort(5432, 5436)
+		assert.Nil(t, err)
+		reserved[port] = true
+	}
+
+	assert.Equal(t, map[uint16]bool{5434: true, 5435: true}, reserved, "the expired lease is taken over")
+
+	_, err := ledger.ReservePort(5432, 5436)
+	assert.EqualError(t, err, "No free port found after 100 attempts")
+}
+
+func TestReservePortWhenTakenByAnotherServer(t *testing.T) {
+	store := newMemoryStore()
+	ledger := Ledger{Store: store, Owner: "test", TTL: time.Minute}
+	other := Ledger{Store: store, Owner: "other", TTL: time.Minute}
+
+	port, err := ledger.ReservePort(5432, 5433)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(5432), port)
+
+	_, err = other.ReservePort(5432, 5433)
+	assert.NotNil(t, err)
+}
+
+func TestReserveAddress(t *testing.T) {
+	store := newMemoryStore(
+		bound(models.LeaseAddress, "10.0.100.1", 1),
+		bound(models.LeaseAddress, "10.0.100.3", 2),
+	)
+	ledger := Ledger{Store: store, Owner: "test", TTL: time.Minute}
+
+	_, pool, _ := net.ParseCIDR("10.0.100.0/24")
+	address, err := ledger.ReserveAddress(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.100.2", address, "the network address and 10.0.100.1 are skipped")
+
+	address, err = ledger.ReserveAddress(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.100.4", address)
+}
+
+func TestReserveAddressWhenPoolIsFull(t *testing.T) {
+	store := newMemoryStore(
+		bound(models.LeaseAddress, "10.0.100.1", 1),
+		bound(models.LeaseAddress, "10.0.100.2", 2),
+	)
+	ledger := Ledger{Store: store, Owner: "test", TTL: time.Minute}
+
+	// Only .1 and .2 are usable in a /30
+	_, pool, _ := net.ParseCIDR("10.0.100.0/30")
+	_, err := ledger.ReserveAddress(pool)
+	assert.EqualError(t, err, "No free address found in 10.0.100.0/30")
+
+	// Every address is usable in a /31
+	_, pool, _ = net.ParseCIDR("10.0.100.0/31")
+	address, err := ledger.ReserveAddress(pool)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.100.0", address)
+}
+
+func TestBindAndRelease(t *testing.T) {
+	store := newMemoryStore()
+	ledger := Ledger{Store: store, Owner: "test", TTL: time.Minute}
+
+	_, err := ledger.Reserve(models.LeasePort, "5432")
+	assert.Nil(t, err)
+	_, err = ledger.Reserve(models.LeasePort, "5433")
+	assert.Nil(t, err)
+
+	assert.Nil(t, ledger.Bind(models.LeasePort, "5432", 7))
+	assert.Nil(t, ledger.Release(models.LeasePort, "5433"))
+
+	leases, _ := store.List(models.LeasePort)
+	assert.Len(t, leases, 1)
+	assert.Equal(t, 7, leases[0].InstanceID)
+	assert.Nil(t, leases[0].ExpiresAt)
+	assert.False(t, leases[0].Expired(time.Now().Add(time.Hour)))
+}
+
+func TestStartRenewsLeases(t *testing.T) {
+	store := newMemoryStore(expired(models.LeasePort, "6000"))
+	ledger := Ledger{Logger: log.Base(), Store: store, Owner: "test", TTL: 60 * time.Millisecond}
+
+	_, err := ledger.Reserve(models.LeasePort, "5432")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, ledger.Start(ctx))
+
+	leases, _ := store.List(models.LeasePort)
+	assert.Len(t, leases, 1, "the expired lease is removed")
+	assert.Equal(t, "5432", leases[0].Value)
+	assert.False(t, leases[0].Expired(time.Now()), "our lease is renewed")
+}
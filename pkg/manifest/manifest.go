@@ -0,0 +1,173 @@
+// Package manifest signs and verifies image manifests, which record where an
+// image came from so that its consumers can trust it
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// Version is the version of the manifest format that we sign. Manifests of any
+// other version can't be verified.
+const Version = 1
+
+// Signer signs manifests with an Ed25519 key
+type Signer struct {
+	// Identity names the signer, e.g. the environment that finalises images
+	Identity string
+	Key      ed25519.PrivateKey
+}
+
+// LoadSigner reads a PEM-encoded PKCS #8 Ed25519 private key, as generated by
+// `openssl genpkey -algorithm ed25519`
+func LoadSigner(identity, keyPath string) (*Signer, error) {
+	block, err := readPEM(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse signing key")
+	}
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an Ed25519 key")
+	}
+
+	return &Signer{Identity: identity, Key: privateKey}, nil
+}
+
+// LoadPublicKey reads a PEM-encoded Ed25519 public key, as generated by
+// `openssl pkey -pubout`
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse public key")
+	}
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an Ed25519 key")
+	}
+
+	return publicKey, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read key")
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM-encoded key", path)
+	}
+
+	return block, nil
+}
+
+// KeyID identifies a public key, so that manifests signed with a rotated key
+// can be told apart from forged ones
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Sign produces a signed manifest for an image that has just been finalised
+func (s Signer) Sign(image models.Image, bakerVersion string, now time.Time) (models.ImageManifest, error) {
+	anonHash := sha256.Sum256([]byte(image.Anon))
+
+	manifest := models.ImageManifest{
+		ImageID:      image.ID,
+		Version:      Version,
+		ContentHash:  image.SnapshotChecksum,
+		AnonHash:     hex.EncodeToString(anonHash[:]),
+		BakerVersion: bakerVersion,
+		Signer:       s.Identity,
+		KeyID:        KeyID(s.Key.Public().(ed25519.PublicKey)),
+		// The signed_at attribute only has a precision of seconds
+		SignedAt: now.UTC().Truncate(time.Second),
+	}
+
+	payload, err := Payload(manifest)
+	if err != nil {
+		return manifest, err
+	}
+
+	manifest.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.Key, payload))
+	return manifest, nil
+}
+
+// payload is what's signed: every field of the manifest other than the
+// signature, in a fixed order
+type payload struct {
+	Version      int    `json:"version"`
+	ImageID      int    `json:"image_id"`
+	ContentHash  string `json:"content_hash"`
+	AnonHash     string `json:"anon_hash"`
+	BakerVersion string `json:"baker_version"`
+	Signer       string `json:"signer"`
+	KeyID        string `json:"key_id"`
+	SignedAt     string `json:"signed_at"`
+}
+
+// Payload returns the bytes that the manifest's signature is over
+func Payload(m models.ImageManifest) ([]byte, error) {
+	return json.Marshal(payload{
+		Version:      m.Version,
+		ImageID:      m.ImageID,
+		ContentHash:  m.ContentHash,
+		AnonHash:     m.AnonHash,
+		BakerVersion: m.BakerVersion,
+		Signer:       m.Signer,
+		KeyID:        m.KeyID,
+		SignedAt:     m.SignedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// Verify checks that the manifest was signed with the given key
+func Verify(m models.ImageManifest, key ed25519.PublicKey) error {
+	if m.Version != Version {
+		return fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+
+	if m.KeyID != KeyID(key) {
+		return fmt.Errorf("manifest was signed with key %s, not %s", m.KeyID, KeyID(key))
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode signature")
+	}
+
+	payload, err := Payload(m)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(key, payload, signature) {
+		return errors.New("manifest signature is invalid")
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func newSigner(t *testing.T) (Signer, ed25519.PublicKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Signer{Identity: "draupnir-test", Key: privateKey}, publicKey
+}
+
+func TestSignAndVerify(t *testing.T) {
+	signer, publicKey := newSigner(t)
+	image := models.Image{ID: 1, Anon: "SELECT 1;", SnapshotChecksum: "abc123"}
+	now := time.Date(2026, 10, 15, 17, 0, 0, 500, time.FixedZone("BST", 3600))
+
+	manifest, err := signer.Sign(image, "1.2.3", now)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, manifest.ImageID)
+	assert.Equal(t, Version, manifest.Version)
+	assert.Equal(t, "abc123", manifest.ContentHash)
+	assert.Equal(t, "17db4fd369edb9244b9f91d9aeed145c3d04ad8ba6e95d06247f07a63527d11a", manifest.AnonHash)
+	assert.Equal(t, "1.2.3", manifest.BakerVersion)
+	assert.Equal(t, "draupnir-test", manifest.Signer)
+	assert.Equal(t, KeyID(publicKey), manifest.KeyID)
+	assert.Equal(t, time.Date(2026, 10, 15, 16, 0, 0, 0, time.UTC), manifest.SignedAt)
+	assert.NotEmpty(t, manifest.Signature)
+
+	assert.Nil(t, Verify(manifest, publicKey))
+}
+
+func TestVerifyTamperedManifest(t *testing.T) {
+	signer, publicKey := newSigner(t)
+	manifest, err := signer.Sign(models.Image{ID: 1, SnapshotChecksum: "abc123"}, "1.2.3", time.Now())
+	assert.Nil(t, err)
+
+	manifest.ContentHash = "def456"
+	assert.EqualError(t, Verify(manifest, publicKey), "manifest signature is invalid")
+}
+
+func TestVerifyWithOtherKey(t *testing.T) {
+	signer, _ := newSigner(t)
+	_, otherKey := newSigner(t)
+
+	manifest, err := signer.Sign(models.Image{ID: 1}, "1.2.3", time.Now())
+	assert.Nil(t, err)
+
+	assert.Contains(t, Verify(manifest, otherKey).Error(), "manifest was signed with key")
+}
+
+func TestVerifyUnsupportedVersion(t *testing.T) {
+	signer, publicKey := newSigner(t)
+	manifest, err := signer.Sign(models.Image{ID: 1}, "1.2.3", time.Now())
+	assert.Nil(t, err)
+
+	manifest.Version = 2
+	assert.EqualError(t, Verify(manifest, publicKey), "unsupported manifest version 2")
+}
+
+func TestLoadKeys(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "draupnir-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	privateDER, _ := x509.MarshalPKCS8PrivateKey(privateKey)
+	publicDER, _ := x509.MarshalPKIXPublicKey(publicKey)
+	privatePath := filepath.Join(dir, "signing.pem")
+	publicPath := filepath.Join(dir, "signing.pub.pem")
+	ioutil.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+	ioutil.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644)
+
+	signer, err := LoadSigner("draupnir-test", privatePath)
+	assert.Nil(t, err)
+	assert.Equal(t, "draupnir-test", signer.Identity)
+	assert.Equal(t, privateKey, signer.Key)
+
+	loaded, err := LoadPublicKey(publicPath)
+	assert.Nil(t, err)
+	assert.Equal(t, publicKey, loaded)
+
+	_, err = LoadSigner("draupnir-test", publicPath)
+	assert.NotNil(t, err)
+}
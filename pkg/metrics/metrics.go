@@ -0,0 +1,136 @@
+// Package metrics periodically exports gauges of the state of the server that
+// aren't updated as requests are served: how many instances there are in each
+// status, and how much of the btrfs pool the images and instances take up.
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+var (
+	instances = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "draupnir_instances",
+			Help: "Number of instances, by status",
+		},
+		[]string{"status"},
+	)
+	poolSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "draupnir_pool_size_bytes",
+			Help: "Size of the btrfs filesystem that holds every image and instance",
+		},
+	)
+	poolFree = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "draupnir_pool_free_bytes",
+			Help: "Space available to Draupnir in the btrfs filesystem that holds every image and instance",
+		},
+	)
+	imageSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "draupnir_image_size_bytes",
+			Help: "Apparent size of each ready image's snapshot, as reported by btrfs filesystem du",
+		},
+		[]string{"image"},
+	)
+	imageExclusive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "draupnir_image_exclusive_bytes",
+			Help: "Space taken up only by each ready image's snapshot, and not shared with its instances or other images",
+		},
+		[]string{"image"},
+	)
+)
+
+// DefaultInterval is how often the gauges are updated by default
+const DefaultInterval = time.Minute
+
+func init() {
+	prometheus.MustRegister(instances, poolSize, poolFree, imageSize, imageExclusive)
+}
+
+// Collector updates the gauges periodically
+type Collector struct {
+	Logger        log.Logger
+	ImageStore    store.ImageStore
+	InstanceStore store.InstanceStore
+	Executor      exec.Executor
+}
+
+// Start collects the gauges immediately, and then every interval until the
+// context is done
+func (c Collector) Start(ctx context.Context, interval time.Duration) error {
+	for {
+		if err := c.Collect(ctx); err != nil {
+			c.Logger.With("error", err).Error("failed to collect metrics")
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Collect updates each gauge. The usage of an image that can't be retrieved,
+// e.g. because it was destroyed while the images were being checked, is logged
+// and left out, rather than failing the collection.
+func (c Collector) Collect(ctx context.Context) error {
+	// We need to add a logger to the context, as the exec package depends on one
+	// being present in order to log
+	ctx = context.WithValue(ctx, middleware.LoggerKey, &c.Logger)
+
+	counts, err := c.InstanceStore.Count("")
+	if err != nil {
+		return err
+	}
+	for _, count := range counts {
+		if count.Dimension == models.InstanceCountByStatus {
+			instances.WithLabelValues(count.Value).Set(float64(count.Count))
+		}
+	}
+
+	pool, err := c.Executor.RetrievePoolUsage(ctx)
+	if err != nil {
+		return err
+	}
+	poolSize.Set(float64(pool.TotalBytes))
+	poolFree.Set(float64(pool.FreeBytes))
+
+	images, err := c.ImageStore.List()
+	if err != nil {
+		return err
+	}
+
+	// Destroyed images are dropped, so that their series don't linger
+	imageSize.Reset()
+	imageExclusive.Reset()
+	for _, image := range images {
+		if !image.Ready {
+			continue
+		}
+
+		usage, err := c.Executor.RetrieveImageDiskUsage(ctx, image.ID)
+		if err != nil {
+			c.Logger.With("image", image.ID).With("error", err).Warn("failed to retrieve image disk usage")
+			continue
+		}
+		id := strconv.Itoa(image.ID)
+		imageSize.WithLabelValues(id).Set(float64(usage.TotalBytes))
+		imageExclusive.WithLabelValues(id).Set(float64(usage.ExclusiveBytes))
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+type fakeImageStore struct {
+	store.ImageStore
+	images []models.Image
+}
+
+func (s fakeImageStore) List() ([]models.Image, error) {
+	return s.images, nil
+}
+
+type fakeInstanceStore struct {
+	store.InstanceStore
+	counts []models.InstanceCount
+}
+
+func (s fakeInstanceStore) Count(userEmail string) ([]models.InstanceCount, error) {
+	return s.counts, nil
+}
+
+type fakeExecutor struct {
+	exec.Executor
+	usage map[int]models.DiskUsage
+}
+
+func (e fakeExecutor) RetrievePoolUsage(ctx context.Context) (models.PoolUsage, error) {
+	return models.PoolUsage{TotalBytes: 1000, FreeBytes: 250}, nil
+}
+
+func (e fakeExecutor) RetrieveImageDiskUsage(ctx context.Context, id int) (models.DiskUsage, error) {
+	usage, ok := e.usage[id]
+	if !ok {
+		return usage, errors.New("no such subvolume")
+	}
+	return usage, nil
+}
+
+func TestCollect(t *testing.T) {
+	collector := Collector{
+		Logger: log.NewNopLogger(),
+		ImageStore: fakeImageStore{images: []models.Image{
+			{ID: 1, Ready: true},
+			// Unready images don't have a snapshot yet
+			{ID: 2, Ready: false},
+			// Image 3 was destroyed after the images were listed
+			{ID: 3, Ready: true},
+		}},
+		InstanceStore: fakeInstanceStore{counts: []models.InstanceCount{
+			models.NewInstanceCount(models.InstanceCountByStatus, models.InstanceRunning, 3),
+			models.NewInstanceCount(models.InstanceCountByStatus, models.InstanceExpired, 1),
+			models.NewInstanceCount(models.InstanceCountByOwner, "test@draupnir", 4),
+		}},
+		Executor: fakeExecutor{usage: map[int]models.DiskUsage{
+			1: {TotalBytes: 400, ExclusiveBytes: 100, SharedBytes: 300},
+			2: {TotalBytes: 50},
+		}},
+	}
+
+	// A previous collection's image that has since been destroyed
+	imageSize.WithLabelValues("9").Set(1)
+
+	assert.Nil(t, collector.Collect(context.Background()))
+
+	assert.Equal(t, float64(3), testutil.ToFloat64(instances.WithLabelValues(models.InstanceRunning)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(instances.WithLabelValues(models.InstanceExpired)))
+	assert.Equal(t, float64(1000), testutil.ToFloat64(poolSize))
+	assert.Equal(t, float64(250), testutil.ToFloat64(poolFree))
+	assert.Equal(t, float64(400), testutil.ToFloat64(imageSize.WithLabelValues("1")))
+	assert.Equal(t, float64(100), testutil.ToFloat64(imageExclusive.WithLabelValues("1")))
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.Nil(t, err)
+	for _, family := range families {
+		if family.GetName() == "draupnir_image_size_bytes" {
+			assert.Len(t, family.GetMetric(), 1, "only image 1's usage is exported")
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// The statuses of access requests
+const (
+	AccessRequestPending  = "pending"
+	AccessRequestApproved = "approved"
+	AccessRequestDenied   = "denied"
+)
+
+// AccessRequest asks for access to a restricted image family, whose instances
+// can only be created by users whose requests one of the family's approvers
+// has approved. Approved access lasts for ValidFor. Requests are kept once
+// they're decided and once access expires, as the record of who had access to
+// the family and why.
+type AccessRequest struct {
+	ID        int    `jsonapi:"primary,access_requests"`
+	UserEmail string `jsonapi:"attr,user_email"`
+	Family    string `jsonapi:"attr,family"`
+	// Reason is why access is needed, e.g. a link to a ticket
+	Reason string `jsonapi:"attr,reason"`
+	// ValidFor is how long access lasts once it's approved, e.g. "8h0m0s"
+	ValidFor string `jsonapi:"attr,valid_for"`
+	// Status is pending, approved or denied
+	Status string `jsonapi:"attr,status"`
+	// DecidedBy is the approver who approved or denied the request, at
+	// DecidedAt
+	DecidedBy string     `jsonapi:"attr,decided_by"`
+	DecidedAt *time.Time `jsonapi:"attr,decided_at,iso8601"`
+	// ExpiresAt is when approved access ends
+	ExpiresAt *time.Time `jsonapi:"attr,expires_at,iso8601"`
+	CreatedAt time.Time  `jsonapi:"attr,created_at,iso8601"`
+}
+
+// Active reports whether the request gives access at now
+func (r AccessRequest) Active(now time.Time) bool {
+	return r.Status == AccessRequestApproved && r.ExpiresAt != nil && now.Before(*r.ExpiresAt)
+}
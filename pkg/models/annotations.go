@@ -0,0 +1,40 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// MaxAnnotationsSize is the maximum size of a resource's annotations, in bytes
+// of their JSON encoding. It's enforced by a check constraint in the database.
+const MaxAnnotationsSize = 16384
+
+// MaxAnnotationKeyLength is the maximum length of an annotation key
+const MaxAnnotationKeyLength = 128
+
+var annotationKeyRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_./-]*[A-Za-z0-9])?$`)
+
+// Annotations are free-form metadata that tooling can attach to a resource,
+// such as a refresh cursor or the hash of the last verified state. Unlike
+// labels, they can't be filtered on.
+//
+// Every value is a string. The map is typed this way because it's what jsonapi
+// unmarshals objects into.
+type Annotations map[string]interface{}
+
+// ValidatePatch checks that the annotations are a valid patch: keys must be
+// short identifiers, and each value must be a string (to set the annotation) or
+// null (to remove it).
+func (a Annotations) ValidatePatch() error {
+	for key, value := range a {
+		if len(key) > MaxAnnotationKeyLength || !annotationKeyRegex.MatchString(key) {
+			return fmt.Errorf("invalid annotation key: %q", key)
+		}
+
+		if _, ok := value.(string); !ok && value != nil {
+			return fmt.Errorf("annotation %q must be a string or null", key)
+		}
+	}
+
+	return nil
+}
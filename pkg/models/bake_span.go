@@ -0,0 +1,64 @@
+package models
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The phases of an image's bake, i.e. the work done to finalise it. Each is
+// recorded as a BakeSpan.
+const (
+	BakePhaseInspectUpload   = "inspect_upload"
+	BakePhaseSnapshotBase    = "snapshot_base"
+	BakePhaseFinalise        = "finalise"
+	BakePhaseScanSettings    = "scan_settings"
+	BakePhaseInspectSnapshot = "inspect_snapshot"
+	BakePhaseSignManifest    = "sign_manifest"
+	BakePhaseMarkAsReady     = "mark_as_ready"
+)
+
+// BakeSpan records when a phase of an image's bake started and finished, and
+// whether it failed. Spans are persisted as they start, so a bake that was
+// interrupted (e.g. by the server restarting) leaves a span with no FinishedAt.
+type BakeSpan struct {
+	ID         int        `jsonapi:"primary,bake_spans"`
+	ImageID    int        `jsonapi:"attr,image_id"`
+	Phase      string     `jsonapi:"attr,phase"`
+	StartedAt  time.Time  `jsonapi:"attr,started_at,iso8601"`
+	FinishedAt *time.Time `jsonapi:"attr,finished_at,iso8601"`
+	// Error is the error that the phase failed with, if any
+	Error string `jsonapi:"attr,error"`
+	// ErrorClass classifies the error, if the phase reported one (e.g.
+	// "anonymisation" if the image's anonymisation script failed)
+	ErrorClass string `jsonapi:"attr,error_class"`
+}
+
+func NewBakeSpan(imageID int, phase string) BakeSpan {
+	return BakeSpan{
+		ImageID:   imageID,
+		Phase:     phase,
+		StartedAt: time.Now(),
+	}
+}
+
+// Finish marks the span as finished now, with the error that the phase
+// failed with, if any
+func (s BakeSpan) Finish(err error) BakeSpan {
+	now := time.Now()
+	s.FinishedAt = &now
+	if err != nil {
+		s.Error = err.Error()
+		s.ErrorClass = ErrorClass(err)
+	}
+	return s
+}
+
+// ErrorClass returns the class of the error, if it (or the error that it wraps)
+// has one, and otherwise an empty string
+func ErrorClass(err error) string {
+	if classified, ok := errors.Cause(err).(interface{ ErrorClass() string }); ok {
+		return classified.ErrorClass()
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// BreakGlassGrant gives a user time-boxed access to the files of an image's
+// upload before the image is finalised, and so before it's anonymised, e.g. to
+// debug a corrupt backup. Only admins can grant access, and only with a reason.
+// Grants are kept once they're revoked or expire, as the record of who had
+// access to raw data and why.
+type BreakGlassGrant struct {
+	ID        int    `jsonapi:"primary,break_glass_grants"`
+	UserEmail string `jsonapi:"attr,user_email"`
+	ImageID   int    `jsonapi:"attr,image_id"`
+	// Reason is why access was needed, e.g. a link to an incident
+	Reason string `jsonapi:"attr,reason"`
+	// GrantedBy is the admin who granted access
+	GrantedBy string    `jsonapi:"attr,granted_by"`
+	CreatedAt time.Time `jsonapi:"attr,created_at,iso8601"`
+	ExpiresAt time.Time `jsonapi:"attr,expires_at,iso8601"`
+	// RevokedAt is when the grant was revoked, by RevokedBy, or when it was
+	// found to have expired, in which case RevokedBy is BreakGlassExpiry
+	RevokedAt *time.Time `jsonapi:"attr,revoked_at,iso8601"`
+	RevokedBy string     `jsonapi:"attr,revoked_by"`
+}
+
+// BreakGlassExpiry is who grants that expired were revoked by
+const BreakGlassExpiry = "expiry"
+
+// Active reports whether the grant gives access at now
+func (g BreakGlassGrant) Active(now time.Time) bool {
+	return g.RevokedAt == nil && now.Before(g.ExpiresAt)
+}
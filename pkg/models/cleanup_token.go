@@ -0,0 +1,52 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// CleanupTokenPrefix starts every cleanup token, so that they can't be mistaken
+// for OAuth tokens or service account keys
+const CleanupTokenPrefix = "dct_"
+
+// CleanupToken lets whoever holds it destroy a fixed set of instances, once. CI
+// jobs create them for the instances they create, and hand them to a teardown
+// step that may run as a different identity, or after the job's own
+// credentials have expired.
+type CleanupToken struct {
+	ID int `jsonapi:"primary,cleanup_tokens"`
+	// Token is the secret itself. Only its hash is stored, so it's only set in
+	// the response to creating it.
+	Token     string `jsonapi:"attr,token,omitempty"`
+	UserEmail string `jsonapi:"attr,user_email"`
+	// InstanceIDs are the instances that the token destroys. Like the IDs of
+	// resources, they're strings, which is also the only kind of list that
+	// jsonapi can decode.
+	InstanceIDs []string `jsonapi:"attr,instance_ids"`
+	// DestroyedInstanceIDs are the instances that using the token destroyed,
+	// leaving out those that had already been destroyed. They're only set in
+	// the response to using it.
+	DestroyedInstanceIDs []string   `jsonapi:"attr,destroyed_instance_ids"`
+	CreatedAt            time.Time  `jsonapi:"attr,created_at,iso8601"`
+	ExpiresAt            time.Time  `jsonapi:"attr,expires_at,iso8601"`
+	UsedAt               *time.Time `jsonapi:"attr,used_at,iso8601"`
+}
+
+// NewCleanupTokenSecret generates a random cleanup token
+func NewCleanupTokenSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return CleanupTokenPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// HashCleanupToken returns the hex encoded SHA-256 hash of a cleanup token,
+// which is what's stored
+func HashCleanupToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
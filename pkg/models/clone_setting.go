@@ -0,0 +1,14 @@
+package models
+
+// CloneSetting is a setting in an image that could make its clones connect to
+// another server, e.g. a postgresql.conf parameter or a foreign server's
+// options
+type CloneSetting struct {
+	// Source is where the setting was found, e.g. "postgresql.conf",
+	// "foreign_server", "user_mapping" or "dblink"
+	Source string
+	// Name identifies the setting within its source, e.g. "primary_conninfo",
+	// or "app.payments_server" for a foreign server in the app database
+	Name  string
+	Value string
+}
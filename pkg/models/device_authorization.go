@@ -0,0 +1,82 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+)
+
+// userCodeAlphabet is the characters that user codes are made of. It has no
+// vowels, so that codes can't spell words, and no digits, so that they can't be
+// mistaken for letters.
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// userCodeLength is the number of characters in a user code, not counting the
+// separator. 20^8 codes is plenty for the few that are pending at once, given
+// that they expire after minutes.
+const userCodeLength = 8
+
+// DeviceAuthorization lets a client that can't open a browser, such as one on
+// an SSH-only machine, authenticate by having the user enter a short code on
+// another device. It follows the OAuth device authorization grant (RFC 8628).
+type DeviceAuthorization struct {
+	// The ID is the device code, which the client polls for a token with. Only
+	// the client should know it: the user is shown the user code.
+	ID       string `jsonapi:"primary,device_authorizations"`
+	UserCode string `jsonapi:"attr,user_code"`
+	// VerificationURI is where the user enters the user code, and
+	// VerificationURIComplete the same page with the code already entered
+	VerificationURI         string `jsonapi:"attr,verification_uri"`
+	VerificationURIComplete string `jsonapi:"attr,verification_uri_complete"`
+	// ExpiresIn is the number of seconds until the codes expire, and Interval
+	// the number of seconds that the client should wait between polls
+	ExpiresIn int `jsonapi:"attr,expires_in"`
+	Interval  int `jsonapi:"attr,interval"`
+}
+
+// NewDeviceCode generates a random device code
+func NewDeviceCode() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// NewUserCode generates a random user code, in the form XXXX-XXXX
+func NewUserCode() (string, error) {
+	random := make([]byte, userCodeLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	code := make([]byte, userCodeLength)
+	for i, b := range random {
+		// 256 isn't a multiple of 20, so the first few characters are very
+		// slightly more likely than the rest, which doesn't matter here
+		code[i] = userCodeAlphabet[int(b)%len(userCodeAlphabet)]
+	}
+	return string(code[:userCodeLength/2]) + "-" + string(code[userCodeLength/2:]), nil
+}
+
+// NormaliseUserCode converts a user code as it was typed into the form that
+// NewUserCode generates, ignoring case, spaces and dashes. It returns an empty
+// string if the code can't be one that NewUserCode generated.
+func NormaliseUserCode(typed string) string {
+	var code strings.Builder
+	for _, r := range strings.ToUpper(typed) {
+		switch {
+		case r == '-' || r == ' ':
+			continue
+		case !strings.ContainsRune(userCodeAlphabet, r):
+			return ""
+		}
+		code.WriteRune(r)
+	}
+
+	if code.Len() != userCodeLength {
+		return ""
+	}
+	normalised := code.String()
+	return normalised[:userCodeLength/2] + "-" + normalised[userCodeLength/2:]
+}
@@ -0,0 +1,182 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SessionActivity describes one of the sessions connected to an instance that
+// isn't idle, as reported by pg_stat_activity
+type SessionActivity struct {
+	PID int
+	// State is pg_stat_activity's state, e.g. "active" or "idle in transaction"
+	State string
+	// Duration is how long the session's query has been running if it's active,
+	// or how long its transaction has been open otherwise
+	Duration time.Duration
+	// WaitEventType is what the session is waiting for, e.g. "Lock" or "IO", if
+	// it's waiting
+	WaitEventType string
+	// BlockedBy are the PIDs of the sessions holding locks that the session is
+	// waiting for
+	BlockedBy []int
+	// Query is the start of the session's latest query
+	Query string
+}
+
+// InstanceActivity is a snapshot of what's happening in an instance, and on
+// the host that it shares with other instances
+type InstanceActivity struct {
+	Sessions []SessionActivity
+	// IOPressure is the percentage of the last 10 seconds in which some tasks on
+	// the host were stalled waiting for IO, or -1 if the host doesn't report it
+	IOPressure float64
+}
+
+// InstanceDiagnostics lists the likely causes of an instance being slow
+type InstanceDiagnostics struct {
+	// The ID is the same as the ID of the instance that is being diagnosed
+	ID int `jsonapi:"primary,instance_diagnostics"`
+	// Causes are the likely causes, the most likely first. It's empty if nothing
+	// stands out.
+	Causes []string `jsonapi:"attr,causes"`
+	// ActiveQueries is the number of queries running in the instance
+	ActiveQueries int `jsonapi:"attr,active_queries"`
+	// LockWaits is the number of sessions waiting for locks held by others
+	LockWaits  int     `jsonapi:"attr,lock_waits"`
+	IOPressure float64 `jsonapi:"attr,io_pressure"`
+	// ConcurrentBakes is the number of images being finalised on the host
+	ConcurrentBakes int `jsonapi:"attr,concurrent_bakes"`
+}
+
+// Thresholds above which activity is considered a likely cause of slowness
+const (
+	slowQueryDuration       = 30 * time.Second
+	idleTransactionDuration = time.Minute
+	highIOPressure          = 10.0
+	manyActiveQueries       = 10
+)
+
+// cause is a likely cause of slowness, with a score by which it's ranked
+type cause struct {
+	score       float64
+	description string
+}
+
+// DiagnoseInstance ranks the likely causes of the instance being slow. Lock
+// waits are ranked first, as they stop queries completing at all, then the
+// other signals by how far they exceed what's normal.
+func DiagnoseInstance(instance Instance, activity InstanceActivity, concurrentBakes int) InstanceDiagnostics {
+	diagnostics := InstanceDiagnostics{
+		ID:              instance.ID,
+		Causes:          []string{},
+		IOPressure:      activity.IOPressure,
+		ConcurrentBakes: concurrentBakes,
+	}
+
+	var causes []cause
+	var waiting, slow []SessionActivity
+
+	for _, session := range activity.Sessions {
+		if len(session.BlockedBy) > 0 {
+			diagnostics.LockWaits++
+			waiting = append(waiting, session)
+		}
+
+		switch {
+		case session.State == "active":
+			diagnostics.ActiveQueries++
+			if session.Duration >= slowQueryDuration && len(session.BlockedBy) == 0 {
+				slow = append(slow, session)
+			}
+		case strings.HasPrefix(session.State, "idle in transaction") && session.Duration >= idleTransactionDuration:
+			causes = append(causes, cause{
+				score: 50 + session.Duration.Minutes(),
+				description: fmt.Sprintf(
+					"session %d has been idle in a transaction for %s, which holds its locks and stops vacuum cleaning up",
+					session.PID, session.Duration.Round(time.Second),
+				),
+			})
+		}
+	}
+
+	if len(waiting) > 0 {
+		sort.Slice(waiting, func(i, j int) bool { return waiting[i].Duration > waiting[j].Duration })
+		longest := waiting[0]
+		causes = append(causes, cause{
+			score: 100 + longest.Duration.Minutes(),
+			description: fmt.Sprintf(
+				"%d %s waiting for locks, the longest for %s, blocked by %s",
+				len(waiting), plural(len(waiting), "session is", "sessions are"),
+				longest.Duration.Round(time.Second), pids(longest.BlockedBy),
+			),
+		})
+	}
+
+	if len(slow) > 0 {
+		sort.Slice(slow, func(i, j int) bool { return slow[i].Duration > slow[j].Duration })
+		longest := slow[0]
+		causes = append(causes, cause{
+			score: 40 + longest.Duration.Minutes(),
+			description: fmt.Sprintf(
+				"%d %s been running for over %s, the longest for %s (session %d: %s)",
+				len(slow), plural(len(slow), "query has", "queries have"), slowQueryDuration,
+				longest.Duration.Round(time.Second), longest.PID, longest.Query,
+			),
+		})
+	}
+
+	if activity.IOPressure >= highIOPressure {
+		causes = append(causes, cause{
+			score: activity.IOPressure,
+			description: fmt.Sprintf(
+				"the host is saturated with IO: tasks were stalled waiting for it %.0f%% of the last 10 seconds",
+				activity.IOPressure,
+			),
+		})
+	}
+
+	if concurrentBakes > 0 {
+		causes = append(causes, cause{
+			score: 20 + 5*float64(concurrentBakes),
+			description: fmt.Sprintf(
+				"%d %s being finalised on the host, which competes with instances for IO and CPU",
+				concurrentBakes, plural(concurrentBakes, "image is", "images are"),
+			),
+		})
+	}
+
+	if diagnostics.ActiveQueries >= manyActiveQueries {
+		causes = append(causes, cause{
+			score: 10 + float64(diagnostics.ActiveQueries),
+			description: fmt.Sprintf(
+				"%d queries are running at once, which compete with each other for the instance's resources",
+				diagnostics.ActiveQueries,
+			),
+		})
+	}
+
+	sort.SliceStable(causes, func(i, j int) bool { return causes[i].score > causes[j].score })
+	for _, c := range causes {
+		diagnostics.Causes = append(diagnostics.Causes, c.description)
+	}
+
+	return diagnostics
+}
+
+func plural(n int, singular, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
+
+func pids(ids []int) string {
+	described := make([]string, len(ids))
+	for i, id := range ids {
+		described[i] = fmt.Sprintf("%d", id)
+	}
+	return plural(len(ids), "session ", "sessions ") + strings.Join(described, ", ")
+}
@@ -0,0 +1,197 @@
+// Package extras keeps the attributes of API resources that this version of
+// draupnir doesn't know about, so that a resource fetched from a newer server
+// can be encoded again, e.g. to be printed or sent back to the server, without
+// silently losing them.
+//
+// Its functions wrap those of jsonapi, which drops unknown attributes, for
+// models that implement Holder. Other models are unaffected.
+package extras
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"github.com/google/jsonapi"
+)
+
+// Attributes are the attributes of a resource that its model has no field
+// for, as they were decoded from JSON. Numbers are kept as json.Number, so
+// that they're encoded again exactly as they were.
+type Attributes map[string]interface{}
+
+// Holder is implemented by models that keep their unknown attributes, by
+// returning a pointer to where they're kept
+type Holder interface {
+	ExtraAttributes() *Attributes
+}
+
+// Known returns the names of the attributes and relationships of a model
+// type, a struct with jsonapi tags, or a pointer to one
+func Known(t reflect.Type) map[string]bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	known := map[string]bool{}
+	if t.Kind() != reflect.Struct {
+		return known
+	}
+	for i := 0; i < t.NumField(); i++ {
+		args := strings.Split(t.Field(i).Tag.Get("jsonapi"), ",")
+		if len(args) >= 2 && (args[0] == "attr" || args[0] == "relation") {
+			known[args[1]] = true
+		}
+	}
+	return known
+}
+
+// Collect keeps the attributes that the model doesn't know about, replacing
+// any that it kept before. It does nothing unless the model is a Holder.
+func Collect(model interface{}, attributes map[string]interface{}) {
+	holder, ok := model.(Holder)
+	if !ok {
+		return
+	}
+
+	known := Known(reflect.TypeOf(model))
+	var unknown Attributes
+	for name, value := range attributes {
+		if known[name] || name == "id" {
+			continue
+		}
+		if unknown == nil {
+			unknown = Attributes{}
+		}
+		unknown[name] = value
+	}
+	*holder.ExtraAttributes() = unknown
+}
+
+// Restore adds the model's unknown attributes to those that it was encoded
+// with. Attributes that the model knows about always win, so that a newer
+// field can't be overwritten by a stale copy of itself.
+func Restore(model interface{}, attributes map[string]interface{}) {
+	holder, ok := model.(Holder)
+	if !ok {
+		return
+	}
+
+	known := Known(reflect.TypeOf(model))
+	for name, value := range *holder.ExtraAttributes() {
+		if _, set := attributes[name]; set || known[name] || name == "id" {
+			continue
+		}
+		attributes[name] = value
+	}
+}
+
+// node is a resource as it's decoded to collect its attributes
+type node struct {
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// decode decodes JSON, keeping numbers as json.Number
+func decode(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// UnmarshalPayload behaves like jsonapi.UnmarshalPayload, but keeps the
+// model's unknown attributes
+func UnmarshalPayload(r io.Reader, model interface{}) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := jsonapi.UnmarshalPayload(bytes.NewReader(body), model); err != nil {
+		return err
+	}
+
+	if _, ok := model.(Holder); ok {
+		var payload struct {
+			Data node `json:"data"`
+		}
+		if err := decode(body, &payload); err != nil {
+			return err
+		}
+		Collect(model, payload.Data.Attributes)
+	}
+	return nil
+}
+
+// UnmarshalManyPayload behaves like jsonapi.UnmarshalManyPayload, but keeps
+// each model's unknown attributes
+func UnmarshalManyPayload(r io.Reader, t reflect.Type) ([]interface{}, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	models, err := jsonapi.UnmarshalManyPayload(bytes.NewReader(body), t)
+	if err != nil {
+		return nil, err
+	}
+
+	if !reflect.PtrTo(elem(t)).Implements(reflect.TypeOf((*Holder)(nil)).Elem()) {
+		return models, nil
+	}
+
+	var payload struct {
+		Data []node `json:"data"`
+	}
+	if err := decode(body, &payload); err != nil {
+		return nil, err
+	}
+	// jsonapi unmarshals the resources in the order they're listed
+	for i := range models {
+		if i < len(payload.Data) {
+			Collect(models[i], payload.Data[i].Attributes)
+		}
+	}
+	return models, nil
+}
+
+// MarshalOne behaves like jsonapi.MarshalOne, but includes the model's unknown
+// attributes
+func MarshalOne(model interface{}) (*jsonapi.OnePayload, error) {
+	payload, err := jsonapi.MarshalOne(model)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := model.(Holder); ok && payload.Data != nil {
+		if payload.Data.Attributes == nil {
+			payload.Data.Attributes = map[string]interface{}{}
+		}
+		Restore(model, payload.Data.Attributes)
+	}
+	return payload, nil
+}
+
+// MarshalOnePayloadWithoutIncluded behaves like
+// jsonapi.MarshalOnePayloadWithoutIncluded, but includes the model's unknown
+// attributes
+func MarshalOnePayloadWithoutIncluded(w io.Writer, model interface{}) error {
+	if _, ok := model.(Holder); !ok {
+		return jsonapi.MarshalOnePayloadWithoutIncluded(w, model)
+	}
+
+	payload, err := MarshalOne(model)
+	if err != nil {
+		return err
+	}
+	payload.Included = nil
+	return json.NewEncoder(w).Encode(payload)
+}
+
+// elem returns the struct type of a slice of models, or of pointers to them
+func elem(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Slice || t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,106 @@
+package extras
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type resource struct {
+	ID      int      `jsonapi:"primary,resources"`
+	Name    string   `jsonapi:"attr,name"`
+	Related *related `jsonapi:"relation,related"`
+	Local   string
+	Extras  Attributes
+}
+
+func (r *resource) ExtraAttributes() *Attributes {
+	return &r.Extras
+}
+
+type related struct {
+	ID int `jsonapi:"primary,related"`
+}
+
+// plainResource doesn't keep its unknown attributes
+type plainResource struct {
+	ID   int    `jsonapi:"primary,resources"`
+	Name string `jsonapi:"attr,name"`
+}
+
+const newerPayload = `{"data": {"type": "resources", "id": "1", "attributes": {
+	"name": "first",
+	"labels": {"team": "payments"},
+	"size_bytes": 12345678901234567890
+}}}`
+
+func TestKnown(t *testing.T) {
+	assert.Equal(t, map[string]bool{"name": true, "related": true}, Known(reflect.TypeOf(&resource{})))
+	assert.Equal(t, map[string]bool{}, Known(reflect.TypeOf("")))
+}
+
+func TestRoundTrip(t *testing.T) {
+	var r resource
+	assert.Nil(t, UnmarshalPayload(strings.NewReader(newerPayload), &r))
+
+	assert.Equal(t, "first", r.Name)
+	assert.Equal(t, Attributes{
+		"labels":     map[string]interface{}{"team": "payments"},
+		"size_bytes": json.Number("12345678901234567890"),
+	}, r.Extras)
+
+	r.Name = "renamed"
+	var encoded bytes.Buffer
+	assert.Nil(t, MarshalOnePayloadWithoutIncluded(&encoded, &r))
+
+	assert.Contains(t, encoded.String(), `"size_bytes":12345678901234567890`, "numbers are kept exactly")
+	assert.Contains(t, encoded.String(), `"labels":{"team":"payments"}`)
+	assert.Contains(t, encoded.String(), `"name":"renamed"`)
+}
+
+func TestKnownAttributesWin(t *testing.T) {
+	r := resource{ID: 1, Name: "current", Extras: Attributes{"name": "stale", "id": "2", "labels": "kept"}}
+
+	payload, err := MarshalOne(&r)
+	assert.Nil(t, err)
+	assert.Equal(t, "current", payload.Data.Attributes["name"])
+	assert.Equal(t, "kept", payload.Data.Attributes["labels"])
+	assert.Equal(t, "1", payload.Data.ID)
+	assert.NotContains(t, payload.Data.Attributes, "id")
+}
+
+func TestUnmarshalWithoutUnknownAttributes(t *testing.T) {
+	var r resource
+	payload := `{"data": {"type": "resources", "id": "1", "attributes": {"name": "first"}}}`
+	assert.Nil(t, UnmarshalPayload(strings.NewReader(payload), &r))
+	assert.Nil(t, r.Extras, "models without unknown attributes are as jsonapi leaves them")
+}
+
+func TestUnmarshalManyPayload(t *testing.T) {
+	payload := `{"data": [
+		{"type": "resources", "id": "1", "attributes": {"name": "first", "labels": "a"}},
+		{"type": "resources", "id": "2", "attributes": {"name": "second"}},
+		{"type": "resources", "id": "3", "attributes": {"name": "third", "labels": "c"}}
+	]}`
+
+	models, err := UnmarshalManyPayload(strings.NewReader(payload), reflect.TypeOf(&resource{}))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(models))
+	assert.Equal(t, Attributes{"labels": "a"}, models[0].(*resource).Extras)
+	assert.Nil(t, models[1].(*resource).Extras)
+	assert.Equal(t, Attributes{"labels": "c"}, models[2].(*resource).Extras)
+}
+
+func TestModelsThatArentHolders(t *testing.T) {
+	var r plainResource
+	assert.Nil(t, UnmarshalPayload(strings.NewReader(newerPayload), &r))
+	assert.Equal(t, "first", r.Name)
+
+	var encoded bytes.Buffer
+	assert.Nil(t, MarshalOnePayloadWithoutIncluded(&encoded, &r))
+	assert.NotContains(t, encoded.String(), "labels")
+}
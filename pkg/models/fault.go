@@ -0,0 +1,55 @@
+package models
+
+import "time"
+
+// The targets of faults
+const (
+	// FaultRoute faults apply to API requests, matched by the route's path
+	// template, e.g. /instances/{id}
+	FaultRoute = "route"
+	// FaultExecutor faults apply to executor operations, matched by the name of
+	// the operation, e.g. CreateInstance
+	FaultExecutor = "executor"
+)
+
+// FaultMatchAll matches every route or executor operation
+const FaultMatchAll = "*"
+
+// Fault is a failure that's injected into the server while it's enabled, for
+// testing how clients and automation cope with the server misbehaving
+type Fault struct {
+	ID     int    `jsonapi:"primary,faults"`
+	Target string `jsonapi:"attr,target"`
+	// Match is the path template of the route, or the name of the executor
+	// operation, that the fault applies to, or FaultMatchAll
+	Match string `jsonapi:"attr,match"`
+	// Method, if set, restricts a route fault to requests with that method
+	Method string `jsonapi:"attr,method"`
+	// ErrorRate is the fraction, between 0 and 1, of matching requests or
+	// operations that fail
+	ErrorRate float64 `jsonapi:"attr,error_rate"`
+	// Status is the status that failed requests are responded to with
+	Status int `jsonapi:"attr,status"`
+	// Latency, e.g. "2s", is added to every matching request or operation,
+	// before it fails or runs
+	Latency string `jsonapi:"attr,latency"`
+	// ExpiresAt, if set, is when the fault is removed
+	ExpiresAt *time.Time `jsonapi:"attr,expires_at,iso8601"`
+	CreatedAt time.Time  `jsonapi:"attr,created_at,iso8601"`
+}
+
+// Matches reports whether the fault applies to the route or executor operation
+func (f Fault) Matches(target, match, method string) bool {
+	if f.Target != target {
+		return false
+	}
+	if f.Method != "" && f.Method != method {
+		return false
+	}
+	return f.Match == FaultMatchAll || f.Match == match
+}
+
+// Expired returns whether the fault should no longer be injected
+func (f Fault) Expired(now time.Time) bool {
+	return f.ExpiresAt != nil && !now.Before(*f.ExpiresAt)
+}
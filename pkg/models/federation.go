@@ -0,0 +1,10 @@
+package models
+
+// FederatedServer is a draupnir server that accepts the same credentials as
+// the server that listed it, because they share an OAuth client
+type FederatedServer struct {
+	Name string `jsonapi:"primary,federated_servers"`
+	// Domain is the server's domain, including the path that it's served from,
+	// in the same form as the client's domain setting
+	Domain string `jsonapi:"attr,domain"`
+}
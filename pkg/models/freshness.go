@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// FreshnessStatus is whether an image family meets its freshness SLA, i.e.
+// whether it has a ready image that was backed up within the SLA's maximum age
+type FreshnessStatus struct {
+	// The ID is the name of the family
+	ID string `jsonapi:"primary,freshness_statuses"`
+	// MaxAge is the SLA's maximum age, e.g. "36h0m0s"
+	MaxAge string `jsonapi:"attr,max_age"`
+	Met    bool   `jsonapi:"attr,met"`
+	// LatestImageID is the family's most recently backed up ready image, or zero
+	// if it has no ready images
+	LatestImageID    int        `jsonapi:"attr,latest_image_id"`
+	LatestBackedUpAt *time.Time `jsonapi:"attr,latest_backed_up_at,iso8601"`
+	// ViolatedSince is when the latest image became too old, if the SLA isn't
+	// met. It's unknown if the family has no ready images.
+	ViolatedSince *time.Time `jsonapi:"attr,violated_since,iso8601"`
+	CheckedAt     time.Time  `jsonapi:"attr,checked_at,iso8601"`
+}
@@ -1,7 +1,10 @@
 package models
 
 import (
+	"sort"
 	"time"
+
+	"github.com/gocardless/draupnir/pkg/models/extras"
 )
 
 type Image struct {
@@ -11,14 +14,102 @@ type Image struct {
 	Anon       string
 	CreatedAt  time.Time `jsonapi:"attr,created_at,iso8601"`
 	UpdatedAt  time.Time `jsonapi:"attr,updated_at,iso8601"`
+	// Shards are the names of the source databases that the image is composed
+	// of. Each shard is uploaded separately and restored into a database of the
+	// same name. An image with no shards is a single uploaded data directory.
+	Shards []string `jsonapi:"attr,shards"`
+	// Workers, if set, make the image a distributed (Citus) cluster. The
+	// coordinator is uploaded as the image's data directory, and each worker is
+	// uploaded separately. Instances run a postgres for each of them.
+	Workers WorkerNodes `jsonapi:"attr,workers"`
+	// Annotations are free-form metadata attached to the image by tooling
+	Annotations Annotations `jsonapi:"attr,annotations"`
+	// Labels identify the image, e.g. by the cluster that it was backed up from,
+	// and lists of images can be filtered by them
+	Labels Labels `jsonapi:"attr,labels"`
+	// BackupChecksum and BackupLSN optionally describe the source's base backup.
+	// If they're given, the upload is checked against them before the image is
+	// finalised.
+	BackupChecksum string `jsonapi:"attr,backup_checksum"`
+	BackupLSN      string `jsonapi:"attr,backup_lsn"`
+	// SnapshotChecksum is the checksum of the image's snapshot, taken when it
+	// was finalised, against which the snapshot can later be verified
+	SnapshotChecksum string `jsonapi:"attr,snapshot_checksum"`
+	// DropDatabases are dropped from the image before it is anonymised, and
+	// RenameDatabases are renamed once it has been
+	DropDatabases   []string        `jsonapi:"attr,drop_databases"`
+	RenameDatabases DatabaseRenames `jsonapi:"attr,rename_databases"`
+	// Encoding and Locale, if set, are the encoding and locale (both LC_COLLATE
+	// and LC_CTYPE) that every database in the image is converted to when it is
+	// finalised
+	Encoding string `jsonapi:"attr,encoding"`
+	Locale   string `jsonapi:"attr,locale"`
+	// Uploader is the user who created the image, against whose quota it counts
+	// until it's ready
+	Uploader string
+
+	// Extras are the attributes that newer servers send, which this version
+	// doesn't know about. They're kept so that they're encoded again.
+	Extras extras.Attributes
+}
+
+// ExtraAttributes implements extras.Holder
+func (i *Image) ExtraAttributes() *extras.Attributes {
+	return &i.Extras
 }
 
-func NewImage(backedUpAt time.Time, anon string) Image {
+func NewImage(backedUpAt time.Time, anon string, shards []string) Image {
+	if shards == nil {
+		shards = []string{}
+	}
+
 	return Image{
-		BackedUpAt: backedUpAt,
-		Ready:      false,
-		Anon:       anon,
-		CreatedAt:  time.Now(),
-		UpdatedAt:  time.Now(),
+		BackedUpAt:      backedUpAt,
+		Ready:           false,
+		Anon:            anon,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+		Shards:          shards,
+		Annotations:     Annotations{},
+		Labels:          Labels{},
+		DropDatabases:   []string{},
+		RenameDatabases: DatabaseRenames{},
+		Workers:         WorkerNodes{},
 	}
 }
+
+// IsSharded returns true if the image is composed of multiple source databases
+func (i Image) IsSharded() bool {
+	return len(i.Shards) > 0
+}
+
+// IsDistributed returns true if the image is a coordinator and its workers
+func (i Image) IsDistributed() bool {
+	return len(i.Workers) > 0
+}
+
+// WorkerNodes maps the names of a distributed image's workers to the host:port
+// that the coordinator's pg_dist_node knows each of them by in the source
+// cluster, so that the coordinator can be pointed at the image's copies of
+// them.
+//
+// As with DatabaseRenames, every value is a string.
+type WorkerNodes map[string]interface{}
+
+// Names returns the names of the workers, sorted so that they're always
+// processed in the same order
+func (w WorkerNodes) Names() []string {
+	names := make([]string, 0, len(w))
+	for name := range w {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DatabaseRenames maps the names of databases in an image to the names that
+// they're given when it's finalised.
+//
+// Every value is a string. The map is typed this way because it's what jsonapi
+// unmarshals objects into.
+type DatabaseRenames map[string]interface{}
@@ -0,0 +1,40 @@
+package models
+
+// ImageFileNames are the files in an image's snapshot that users can read, so
+// that they can sanity-check its contents without access to the storage host.
+// They describe the cluster rather than its data, and don't contain passwords.
+// draupnir-image-file has its own copy of this list, which must be kept in sync.
+var ImageFileNames = []string{
+	"PG_VERSION",
+	"backup_label",
+	"backup_label.old",
+	"pg_hba.conf",
+	"pg_ident.conf",
+	"postgresql.auto.conf",
+	"postgresql.conf",
+}
+
+// MaxImageFileSize is the most of an image file that's returned. The files in
+// ImageFileNames are small, so this is only reached if something is wrong.
+const MaxImageFileSize = 1024 * 1024
+
+// IsImageFileName reports whether the file can be read from an image
+func IsImageFileName(name string) bool {
+	for _, allowed := range ImageFileNames {
+		if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ImageFile is the contents of a file in an image's snapshot
+type ImageFile struct {
+	// The ID is the file's name, which is unique within the image
+	ID      string `jsonapi:"primary,image_files"`
+	ImageID int    `jsonapi:"attr,image_id"`
+	Content string `jsonapi:"attr,content"`
+	// Truncated is true if the file was larger than MaxImageFileSize, and only
+	// that much of it was returned
+	Truncated bool `jsonapi:"attr,truncated"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// ImageManifest records where an image came from, and is signed by the server
+// that finalised it, so that the consumers of the image can check that it was
+// produced by an approved pipeline
+type ImageManifest struct {
+	ImageID int `jsonapi:"primary,image_manifests"`
+	// Version is the version of the manifest's format
+	Version int `jsonapi:"attr,version"`
+	// ContentHash is the checksum of the image's snapshot, which the snapshot
+	// can be verified against
+	ContentHash string `jsonapi:"attr,content_hash"`
+	// AnonHash is the SHA-256 of the anonymisation script that was run against
+	// the image
+	AnonHash string `jsonapi:"attr,anon_hash"`
+	// BakerVersion is the version of Draupnir that finalised the image
+	BakerVersion string `jsonapi:"attr,baker_version"`
+	// Signer identifies who signed the manifest, and KeyID the key that they
+	// signed it with
+	Signer    string    `jsonapi:"attr,signer"`
+	KeyID     string    `jsonapi:"attr,key_id"`
+	SignedAt  time.Time `jsonapi:"attr,signed_at,iso8601"`
+	Signature string    `jsonapi:"attr,signature"`
+}
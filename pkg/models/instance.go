@@ -1,30 +1,134 @@
 package models
 
 import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
 	"time"
+
+	"github.com/gocardless/draupnir/pkg/models/extras"
+	"github.com/gocardless/draupnir/pkg/redact"
+)
+
+// The statuses of an instance. An instance is destroying while a job is
+// destroying it, and expired once it's past its expiry but hasn't been
+// destroyed yet. Otherwise, it's a standby until it's promoted, and running
+// after.
+const (
+	InstanceRunning    = "running"
+	InstanceStandby    = "standby"
+	InstanceExpired    = "expired"
+	InstanceDestroying = "destroying"
 )
 
+// InstanceStatuses are all of the statuses that an instance can have
+var InstanceStatuses = []string{InstanceRunning, InstanceStandby, InstanceExpired, InstanceDestroying}
+
 type Instance struct {
-	ID           int    `jsonapi:"primary,instances"`
-	Hostname     string `jsonapi:"attr,hostname"`
-	ImageID      int    `jsonapi:"attr,image_id"`
-	UserEmail    string
-	RefreshToken string
+	ID        int    `jsonapi:"primary,instances"`
+	Hostname  string `jsonapi:"attr,hostname"`
+	ImageID   int    `jsonapi:"attr,image_id"`
+	UserEmail string
+	// RefreshToken is that of the user who created the instance, which is
+	// destroyed once it's no longer valid
+	RefreshToken redact.Secret
 	CreatedAt    time.Time `jsonapi:"attr,created_at,iso8601"`
 	UpdatedAt    time.Time `jsonapi:"attr,updated_at,iso8601"`
 	Port         uint16    `jsonapi:"attr,port"`
+	// Address is the instance's own IP address alias, if it was given one. Such
+	// instances listen on the standard Postgres port at this address, which is
+	// also their Hostname.
+	Address string `jsonapi:"attr,address"`
+	// ShardDSNs holds a connection string for each shard database of the image
+	// that the instance was created from, in the same order as the image's
+	// shards. It is empty for instances of unsharded images.
+	ShardDSNs []string `jsonapi:"attr,shard_dsns"`
+	// Standby instances continuously replay WAL from the source database's
+	// archive, and only accept local connections until they're promoted
+	Standby bool `jsonapi:"attr,standby"`
+	// SchemaOnly instances have every table emptied when they're created, other
+	// than those that the server is configured to keep, for testing migrations
+	// against the image's schema without its data
+	SchemaOnly bool `jsonapi:"attr,schema_only"`
+	// StaticName is the name of the static instance, declared in the server's
+	// config, that this is. Static instances are shared by everyone, and are
+	// created and replaced by the server as their family's images are refreshed,
+	// so can't be changed through the API. It's empty for other instances.
+	StaticName string `jsonapi:"attr,static_name"`
+	// ProxyRequired is set on instances of regulated images, which can only be
+	// connected to through the server's proxy, so are sent without credentials
+	ProxyRequired bool `jsonapi:"attr,proxy_required"`
+	// Annotations are free-form metadata attached to the instance by tooling
+	Annotations Annotations `jsonapi:"attr,annotations"`
+	// Labels identify the instance, and lists of instances can be filtered by
+	// them
+	Labels Labels `jsonapi:"attr,labels"`
+	// ExpiresAt is when the instance will be destroyed, unless it's extended.
+	// It's nil if the instance never expires.
+	ExpiresAt *time.Time `jsonapi:"attr,expires_at,iso8601"`
+	// Status is one of InstanceStatuses. It's derived from the instance's other
+	// fields and the jobs running against it when it's read, rather than stored.
+	Status string `jsonapi:"attr,status"`
 
 	Credentials *InstanceCredentials `jsonapi:"relation,credentials"`
+
+	// Extras are the attributes that newer servers send, which this version
+	// doesn't know about. They're kept so that they're encoded again.
+	Extras extras.Attributes
+}
+
+// ExtraAttributes implements extras.Holder
+func (i *Instance) ExtraAttributes() *extras.Attributes {
+	return &i.Extras
 }
 
 func NewInstance(imageID int, email, refreshToken string) Instance {
 	return Instance{
 		ImageID:      imageID,
 		UserEmail:    email,
-		RefreshToken: refreshToken,
+		RefreshToken: redact.Secret(refreshToken),
 		CreatedAt:    time.Now(),
 		UpdatedAt:    time.Now(),
+		Annotations:  Annotations{},
+		Labels:       Labels{},
+	}
+}
+
+// ShardDSN returns the connection string for one of the instance's shard
+// databases. The client certificates are not included, as their location
+// depends on where the client has stored them.
+func ShardDSN(hostname string, port uint16, shard string) string {
+	return fmt.Sprintf("postgresql://draupnir@%s:%d/%s?sslmode=verify-ca", hostname, port, shard)
+}
+
+// CredentialPaths are the locations of the files that an instance's
+// credentials have been written to
+type CredentialPaths struct {
+	CACertificate     string
+	ClientCertificate string
+	ClientKey         string
+}
+
+// DSN returns a libpq connection URL for one of the instance's databases,
+// authenticating with the credentials at paths. Unlike ShardDSN, the URL is
+// complete and can be passed straight to psql or a Postgres driver.
+func (i Instance) DSN(database string, paths CredentialPaths) string {
+	query := url.Values{}
+	query.Set("sslmode", "verify-ca")
+	query.Set("sslrootcert", paths.CACertificate)
+	query.Set("sslcert", paths.ClientCertificate)
+	query.Set("sslkey", paths.ClientKey)
+
+	dsn := url.URL{
+		Scheme:   "postgresql",
+		User:     url.User("draupnir"),
+		Host:     net.JoinHostPort(i.Hostname, strconv.Itoa(int(i.Port))),
+		Path:     "/" + database,
+		RawQuery: query.Encode(),
 	}
+
+	return dsn.String()
 }
 
 type InstanceCredentials struct {
@@ -0,0 +1,28 @@
+package models
+
+// The dimensions that instances are counted by
+const (
+	InstanceCountByStatus = "status"
+	InstanceCountByOwner  = "owner"
+)
+
+// InstanceCount is the number of instances that have the same value of one
+// dimension, e.g. the number whose status is running, or that belong to a
+// user. GET /instances/summary returns them, so that dashboards don't have to
+// list every instance to show how many there are.
+type InstanceCount struct {
+	// The ID is the dimension and value, e.g. "status:running"
+	ID        string `jsonapi:"primary,instance_counts"`
+	Dimension string `jsonapi:"attr,dimension"`
+	Value     string `jsonapi:"attr,value"`
+	Count     int    `jsonapi:"attr,count"`
+}
+
+func NewInstanceCount(dimension, value string, count int) InstanceCount {
+	return InstanceCount{
+		ID:        dimension + ":" + value,
+		Dimension: dimension,
+		Value:     value,
+		Count:     count,
+	}
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"strconv"
+	"time"
+)
+
+// InstanceGroup is a set of instances, usually of images from different
+// families, that are created together from the latest images of each, and
+// are extended and destroyed as one. Integration tests use them to clone
+// several databases in lockstep.
+type InstanceGroup struct {
+	ID        int `jsonapi:"primary,instance_groups"`
+	UserEmail string
+	// InstanceIDs are the instances that the group was created with. Like the
+	// IDs of resources, they're strings.
+	InstanceIDs []string   `jsonapi:"attr,instance_ids"`
+	CreatedAt   time.Time  `jsonapi:"attr,created_at,iso8601"`
+	ExpiresAt   *time.Time `jsonapi:"attr,expires_at,iso8601"`
+
+	// Instances are those of the group's instances that haven't been destroyed,
+	// with their credentials unless they're instances of regulated images
+	Instances []*Instance `jsonapi:"relation,instances"`
+}
+
+// NewInstanceGroup returns a group of the instances, created at the same time
+// and expiring at the same time as them
+func NewInstanceGroup(email string, instances []Instance) InstanceGroup {
+	group := InstanceGroup{
+		UserEmail:   email,
+		InstanceIDs: make([]string, 0, len(instances)),
+		Instances:   make([]*Instance, 0, len(instances)),
+		CreatedAt:   time.Now(),
+	}
+
+	for idx := range instances {
+		group.InstanceIDs = append(group.InstanceIDs, strconv.Itoa(instances[idx].ID))
+		group.Instances = append(group.Instances, &instances[idx])
+	}
+	if len(instances) > 0 {
+		group.CreatedAt = instances[0].CreatedAt
+		group.ExpiresAt = instances[0].ExpiresAt
+	}
+
+	return group
+}
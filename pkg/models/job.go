@@ -0,0 +1,91 @@
+package models
+
+import "time"
+
+// The kinds of job that are recorded while they run, so that they can be
+// recovered if the server dies part way through them
+const (
+	JobFinaliseImage   = "finalise_image"
+	JobResetImage      = "reset_image"
+	JobDestroyImage    = "destroy_image"
+	JobDestroyInstance = "destroy_instance"
+)
+
+// The statuses of a job. A job is running until it succeeds or fails. Jobs
+// that were running when the server died are marked as interrupted when it
+// next starts. Jobs run in the background, as operations, are queued until a
+// worker starts them.
+const (
+	JobQueued      = "queued"
+	JobRunning     = "running"
+	JobSucceeded   = "succeeded"
+	JobFailed      = "failed"
+	JobInterrupted = "interrupted"
+)
+
+// Job records a long-running operation on an image or instance
+type Job struct {
+	ID         int
+	Kind       string
+	ResourceID int
+	Status     string
+	// Error is why the job failed or was interrupted
+	Error string
+	// ErrorClass classifies the error that the job failed with, if it has a
+	// class (see ErrorClass)
+	ErrorClass string
+	// UserEmail is the user that started the job, if it was started as an
+	// operation
+	UserEmail string
+	// StartedAt is when the job was queued, until it starts running
+	StartedAt  time.Time
+	FinishedAt *time.Time
+}
+
+func NewJob(kind string, resourceID int) Job {
+	return Job{
+		Kind:       kind,
+		ResourceID: resourceID,
+		Status:     JobRunning,
+		StartedAt:  time.Now(),
+	}
+}
+
+// NewQueuedJob returns a job that the user has started as an operation, which
+// will run once a worker is free
+func NewQueuedJob(kind string, resourceID int, userEmail string) Job {
+	job := NewJob(kind, resourceID)
+	job.Status = JobQueued
+	job.UserEmail = userEmail
+	return job
+}
+
+// Start marks a queued job as running
+func (j Job) Start() Job {
+	j.Status = JobRunning
+	j.StartedAt = time.Now()
+	return j
+}
+
+// Finish marks the job as succeeded, or failed with the given error
+func (j Job) Finish(err error) Job {
+	if err != nil {
+		j = j.finish(JobFailed, err.Error())
+		j.ErrorClass = ErrorClass(err)
+		return j
+	}
+	return j.finish(JobSucceeded, "")
+}
+
+// Interrupt marks the job as interrupted, for the given reason
+func (j Job) Interrupt(reason string) Job {
+	return j.finish(JobInterrupted, reason)
+}
+
+func (j Job) finish(status, reason string) Job {
+	now := time.Now()
+	j.Status = status
+	j.Error = reason
+	j.FinishedAt = &now
+	return j
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// MaxLabelLength is the maximum length of a label's key, and of its value
+const MaxLabelLength = 63
+
+var labelValueRegex = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?)?$`)
+
+// Labels are short key/value pairs that identify a resource, such as the
+// cluster that an image was backed up from or the version of the anonymisation
+// that it was baked with. Unlike annotations, lists of images and instances can
+// be filtered by them, so their keys and values are restricted.
+//
+// Every value is a string. The map is typed this way because it's what jsonapi
+// unmarshals objects into.
+type Labels map[string]interface{}
+
+// ValidatePatch checks that the labels are a valid patch: keys must be short
+// identifiers, as for annotations, and each value must be a short identifier
+// (to set the label), possibly empty, or null (to remove it)
+func (l Labels) ValidatePatch() error {
+	for key, value := range l {
+		if len(key) > MaxLabelLength || !annotationKeyRegex.MatchString(key) {
+			return fmt.Errorf("invalid label key: %q", key)
+		}
+
+		if value == nil {
+			continue
+		}
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("label %q must be a string or null", key)
+		}
+		if len(s) > MaxLabelLength || !labelValueRegex.MatchString(s) {
+			return fmt.Errorf("invalid value for label %q: %q", key, s)
+		}
+	}
+
+	return nil
+}
+
+// Matches reports whether the resource with these labels has every one of the
+// selector's labels, with the same value
+func (l Labels) Matches(selector map[string]string) bool {
+	for key, value := range selector {
+		if actual, ok := l[key].(string); !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// The kinds of per-host resource that are leased to instances
+const (
+	LeasePort    = "port"
+	LeaseAddress = "address"
+)
+
+// Lease reserves a resource, such as a port, so that no two instances are
+// given it. A lease is held by the server that's creating an instance until it
+// expires, unless the server keeps renewing it. Once the instance has been
+// recorded, the lease is bound to it and no longer expires, and it's released
+// when the instance is destroyed.
+type Lease struct {
+	Kind  string
+	Value string
+	// Owner identifies the server that took the lease
+	Owner string
+	// InstanceID is the instance that the lease is bound to, or zero if it
+	// isn't bound yet
+	InstanceID int
+	// ExpiresAt is nil once the lease is bound to an instance
+	ExpiresAt   *time.Time
+	HeartbeatAt time.Time
+	CreatedAt   time.Time
+}
+
+// Expired returns whether the lease can be taken by another owner
+func (l Lease) Expired(now time.Time) bool {
+	return l.ExpiresAt != nil && !now.Before(*l.ExpiresAt)
+}
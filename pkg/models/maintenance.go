@@ -0,0 +1,14 @@
+package models
+
+// MaintenanceResult is the output of a maintenance operation that was run
+// against an instance
+type MaintenanceResult struct {
+	// The ID is the same as the ID of the instance that the operation was run
+	// against
+	ID        int    `jsonapi:"primary,maintenance_results"`
+	Operation string `jsonapi:"attr,operation"`
+	Database  string `jsonapi:"attr,database"`
+	// Output is everything that psql printed while running the operation,
+	// including the statements that were run and any notices
+	Output string `jsonapi:"attr,output"`
+}
@@ -0,0 +1,50 @@
+package models
+
+import "time"
+
+// Operation is a long-running job, such as finalising an image, that was started
+// in the background by a request with `Prefer: respond-async`. The request
+// returns the operation straight away, and clients poll GET /operations/:id
+// until it has succeeded or failed.
+type Operation struct {
+	ID   int    `jsonapi:"primary,operations"`
+	Kind string `jsonapi:"attr,kind"`
+	// ResourceType and ResourceID are the image or instance that the operation
+	// acts on
+	ResourceType string `jsonapi:"attr,resource_type"`
+	ResourceID   int    `jsonapi:"attr,resource_id"`
+	// Status is queued, running, succeeded, failed or interrupted
+	Status string `jsonapi:"attr,status"`
+	// Phase is the phase of the image's bake that's running, for finalisations
+	// that are running
+	Phase string `jsonapi:"attr,phase"`
+	// Error is why the operation failed or was interrupted
+	Error      string     `jsonapi:"attr,error"`
+	ErrorClass string     `jsonapi:"attr,error_class"`
+	StartedAt  time.Time  `jsonapi:"attr,started_at,iso8601"`
+	FinishedAt *time.Time `jsonapi:"attr,finished_at,iso8601"`
+}
+
+func NewOperation(job Job) Operation {
+	resourceType := "images"
+	if job.Kind == JobDestroyInstance {
+		resourceType = "instances"
+	}
+
+	return Operation{
+		ID:           job.ID,
+		Kind:         job.Kind,
+		ResourceType: resourceType,
+		ResourceID:   job.ResourceID,
+		Status:       job.Status,
+		Error:        job.Error,
+		ErrorClass:   job.ErrorClass,
+		StartedAt:    job.StartedAt,
+		FinishedAt:   job.FinishedAt,
+	}
+}
+
+// Done returns true if the operation has finished, whether or not it succeeded
+func (o Operation) Done() bool {
+	return o.Status != JobQueued && o.Status != JobRunning
+}
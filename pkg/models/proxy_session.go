@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// ProxySession records a connection to an instance through the server's
+// Postgres proxy, for auditing access to regulated images. Sessions are
+// recorded as they start, so a session that was interrupted (e.g. by the server
+// restarting) has no EndedAt.
+type ProxySession struct {
+	ID         int    `jsonapi:"primary,proxy_sessions"`
+	InstanceID int    `jsonapi:"attr,instance_id"`
+	ImageID    int    `jsonapi:"attr,image_id"`
+	Family     string `jsonapi:"attr,family"`
+	// UserEmail is the authenticated user who opened the session, and
+	// ClientIPAddress is where they connected from
+	UserEmail       string `jsonapi:"attr,user_email"`
+	ClientIPAddress string `jsonapi:"attr,client_ip_address"`
+	// Database is the database that the client asked to connect to
+	Database string `jsonapi:"attr,database"`
+	// Queries is how many queries the client sent, counting each simple query
+	// and each execution of a prepared statement
+	Queries   int        `jsonapi:"attr,queries"`
+	StartedAt time.Time  `jsonapi:"attr,started_at,iso8601"`
+	EndedAt   *time.Time `jsonapi:"attr,ended_at,iso8601"`
+	// Error is why the session ended, if it didn't end with the client
+	// disconnecting
+	Error string `jsonapi:"attr,error"`
+}
+
+// Duration returns how long the session lasted, or has lasted so far
+func (s ProxySession) Duration(now time.Time) time.Duration {
+	if s.EndedAt != nil {
+		return s.EndedAt.Sub(s.StartedAt)
+	}
+	return now.Sub(s.StartedAt)
+}
+
+// ProxyProtocol is the protocol that requests to an instance's proxy endpoint
+// upgrade their connection to. Once upgraded, the connection carries the
+// Postgres protocol, unencrypted, to the instance.
+const ProxyProtocol = "draupnir-postgres"
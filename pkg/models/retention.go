@@ -0,0 +1,23 @@
+package models
+
+// RetentionPreview describes what a retention policy would reclaim if the
+// pool's free space were checked now. Nothing is reclaimed by a preview.
+type RetentionPreview struct {
+	// Previews aren't stored, so have no meaningful ID
+	ID         int   `jsonapi:"primary,retention_previews"`
+	FreeBytes  int64 `jsonapi:"attr,free_bytes"`
+	TotalBytes int64 `jsonapi:"attr,total_bytes"`
+	// CriticallyLow is true if the pool's free space is below the policy's
+	// critical free space. Nothing would be reclaimed otherwise.
+	CriticallyLow bool `jsonapi:"attr,critically_low"`
+	// InstanceIDs and ImageIDs are the instances and images that would be
+	// destroyed, in the order that they would be destroyed. Instances are
+	// destroyed before images.
+	InstanceIDs []int `jsonapi:"attr,instance_ids"`
+	ImageIDs    []int `jsonapi:"attr,image_ids"`
+	// ReclaimedBytes is an estimate of the space that would be freed
+	ReclaimedBytes int64 `jsonapi:"attr,reclaimed_bytes"`
+	// TargetReached is false if destroying everything that the policy allows
+	// still wouldn't free enough space to reach its target
+	TargetReached bool `jsonapi:"attr,target_reached"`
+}
@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// SchemaReport describes the database in which the server stores images,
+// instances and the rest of its metadata, so that operators can check its
+// health through the API
+type SchemaReport struct {
+	// The ID is the schema's version: the ID of the latest migration that has
+	// been applied
+	ID                string `jsonapi:"primary,schemas"`
+	AppliedMigrations int    `jsonapi:"attr,applied_migrations"`
+	// PendingMigrations are the migrations in the server's migrations_path that
+	// haven't been applied. They're nil if migrations_path isn't configured, as
+	// the server can't tell then.
+	PendingMigrations []string     `jsonapi:"attr,pending_migrations"`
+	Tables            []TableStats `jsonapi:"attr,tables"`
+	Indexes           []IndexStats `jsonapi:"attr,indexes"`
+}
+
+// TableStats describes one of the tables in the metadata database
+type TableStats struct {
+	Name string `json:"name"`
+	// EstimatedRows is Postgres' estimate of the number of live rows, which
+	// avoids counting the rows of large tables
+	EstimatedRows int64 `json:"estimated_rows"`
+	// DeadRows is the estimated number of rows that have been updated or
+	// deleted, and are waiting to be vacuumed
+	DeadRows  int64 `json:"dead_rows"`
+	SizeBytes int64 `json:"size_bytes"`
+	// LastVacuum and LastAnalyze are the latest times that the table was
+	// vacuumed or analyzed, either manually or by autovacuum
+	LastVacuum  *time.Time `json:"last_vacuum"`
+	LastAnalyze *time.Time `json:"last_analyze"`
+}
+
+// IndexStats describes one of the indexes in the metadata database
+type IndexStats struct {
+	Name      string `json:"name"`
+	Table     string `json:"table"`
+	SizeBytes int64  `json:"size_bytes"`
+	// Scans is how many times the index has been used since statistics were
+	// last reset. Unused indexes only slow down writes.
+	Scans int64 `json:"scans"`
+	// Valid is false if the index was left behind by a failed CREATE INDEX
+	// CONCURRENTLY, in which case queries don't use it
+	Valid bool `json:"valid"`
+}
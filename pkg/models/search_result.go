@@ -0,0 +1,36 @@
+package models
+
+import "strconv"
+
+// The types of resource that GET /search returns
+const (
+	SearchResultImage    = "images"
+	SearchResultInstance = "instances"
+)
+
+// SearchResult is an image or instance that matched a search, with how well it
+// matched. GET /search returns them, most relevant first, for quick-open
+// prompts that find a resource by any of its labels, owner, annotations, shard
+// names or ID.
+type SearchResult struct {
+	// The ID is the type and ID of the resource, e.g. "images:3"
+	ID           string `jsonapi:"primary,search_results"`
+	ResourceType string `jsonapi:"attr,resource_type"`
+	ResourceID   int    `jsonapi:"attr,resource_id"`
+	// Score is how well the resource matched, relative to the other results.
+	// Resources whose ID is the whole query score above all others.
+	Score float64 `jsonapi:"attr,score"`
+
+	// Exactly one of Image and Instance is set, as ResourceType says
+	Image    *Image    `jsonapi:"relation,image"`
+	Instance *Instance `jsonapi:"relation,instance"`
+}
+
+func NewSearchResult(resourceType string, resourceID int, score float64) SearchResult {
+	return SearchResult{
+		ID:           resourceType + ":" + strconv.Itoa(resourceID),
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		Score:        score,
+	}
+}
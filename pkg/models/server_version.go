@@ -0,0 +1,63 @@
+package models
+
+// The features that a server can advertise in its ServerVersion. Clients check
+// for a feature before relying on it, so that they can fall back to what older
+// servers support rather than failing.
+const (
+	FeatureStandbyInstances    = "standby_instances"
+	FeatureResumableUploads    = "resumable_uploads"
+	FeatureBakeTimeline        = "bake_timeline"
+	FeatureBakeErrorClasses    = "bake_error_classes"
+	FeatureImageManifests      = "image_manifests"
+	FeatureImageFiles          = "image_files"
+	FeatureConditionalRequests = "conditional_requests"
+	FeatureEvents              = "events"
+	FeatureFederation          = "federation"
+	FeatureFreshness           = "freshness"
+	FeaturePlainJSON           = "plain_json"
+	FeatureInstanceProxy       = "instance_proxy"
+	FeatureInstanceExpiry      = "instance_expiry"
+	FeatureImagePrune          = "image_prune"
+	FeatureCleanupTokens       = "cleanup_tokens"
+	FeatureInstanceGroups      = "instance_groups"
+	FeatureWhoami              = "whoami"
+	FeatureImageSend           = "image_send"
+	FeatureTokenExchange       = "token_exchange"
+	FeatureInstanceDiagnostics = "instance_diagnostics"
+	FeatureAnonAudit           = "anon_audit"
+	FeatureInstanceLogs        = "instance_logs"
+	FeatureDeviceAuthorization = "device_authorization"
+	FeatureInstanceStatus      = "instance_status"
+	FeaturePagination          = "pagination"
+	FeatureSorting             = "sorting"
+	FeatureBreakGlass          = "break_glass"
+	FeatureLabels              = "labels"
+	FeatureSchemaOnlyInstances = "schema_only_instances"
+	FeatureSearch              = "search"
+	FeatureOperations          = "operations"
+	FeatureStaticInstances     = "static_instances"
+	FeatureDistributedImages   = "distributed_images"
+	FeatureWebhooks            = "webhooks"
+	FeatureAccessRequests      = "access_requests"
+	FeatureBtrfsStreamUpload   = "btrfs_stream_upload"
+	FeatureRunbook             = "runbook"
+	FeatureOpenAPI             = "openapi"
+)
+
+// ServerVersion describes a server's version and the features that it
+// supports, so that clients can negotiate the requests that they send to it
+type ServerVersion struct {
+	// The ID is the server's version, e.g. "1.4.0"
+	ID       string   `jsonapi:"primary,versions"`
+	Features []string `jsonapi:"attr,features"`
+}
+
+// Supports reports whether the server supports the feature
+func (v ServerVersion) Supports(feature string) bool {
+	for _, supported := range v.Features {
+		if supported == feature {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ServiceAccountKeyType identifies service account key files
+const ServiceAccountKeyType = "draupnir_service_account_key"
+
+// ServiceAccountKeyPrefix starts every service account key, so that servers can
+// tell them apart from OAuth tokens
+const ServiceAccountKeyPrefix = "dsa_"
+
+// ServiceAccountKey authenticates a service account, such as a CI job, that
+// can't go through the OAuth flow in a browser. Clients read it from a JSON key
+// file, and servers are configured with the hash of the key rather than the key
+// itself.
+type ServiceAccountKey struct {
+	Type           string `json:"type"`
+	ServiceAccount string `json:"service_account"`
+	Key            string `json:"key"`
+}
+
+// NewServiceAccountKey generates a random key for the named service account
+func NewServiceAccountKey(serviceAccount string) (ServiceAccountKey, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return ServiceAccountKey{}, err
+	}
+
+	return ServiceAccountKey{
+		Type:           ServiceAccountKeyType,
+		ServiceAccount: serviceAccount,
+		Key:            ServiceAccountKeyPrefix + base64.RawURLEncoding.EncodeToString(secret),
+	}, nil
+}
+
+// ParseServiceAccountKey parses the contents of a key file
+func ParseServiceAccountKey(data []byte) (ServiceAccountKey, error) {
+	var key ServiceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return key, fmt.Errorf("invalid service account key file: %s", err)
+	}
+
+	if key.Type != ServiceAccountKeyType {
+		return key, fmt.Errorf("not a service account key file: its type is %q rather than %q", key.Type, ServiceAccountKeyType)
+	}
+	if key.ServiceAccount == "" {
+		return key, errors.New("service account key file doesn't name its service account")
+	}
+	if !strings.HasPrefix(key.Key, ServiceAccountKeyPrefix) {
+		return key, errors.New("service account key file has no valid key")
+	}
+	return key, nil
+}
+
+// Hash returns the hash of the key that servers are configured with
+func (k ServiceAccountKey) Hash() string {
+	return HashServiceAccountKey(k.Key)
+}
+
+// HashServiceAccountKey returns the hex encoded SHA-256 hash of a key. Keys are
+// random, so they don't need a slow hash.
+func HashServiceAccountKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
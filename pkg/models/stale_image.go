@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// StaleImage is a ready image that wasn't anonymised with the current version
+// of its family's anonymisation spec, so may still hold data that the current
+// spec masks
+type StaleImage struct {
+	// The ID is the same as the ID of the image
+	ID         int       `jsonapi:"primary,stale_images"`
+	Family     string    `jsonapi:"attr,family"`
+	BackedUpAt time.Time `jsonapi:"attr,backed_up_at,iso8601"`
+	// AnonHash is the SHA-256 of the script that the image was anonymised with,
+	// and SpecHash that of the family's current spec
+	AnonHash string `jsonapi:"attr,anon_hash"`
+	SpecHash string `jsonapi:"attr,spec_hash"`
+	// Policy is what's done about the family's stale images: "report", "rebake"
+	// or "block"
+	Policy string `jsonapi:"attr,policy"`
+}
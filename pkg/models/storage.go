@@ -0,0 +1,95 @@
+package models
+
+// DiskUsage describes the space consumed by a btrfs subvolume, as reported by
+// `btrfs filesystem du`.
+type DiskUsage struct {
+	// TotalBytes is the apparent size of all the data in the subvolume
+	TotalBytes int64
+	// ExclusiveBytes is the amount of data that is not shared with any other
+	// subvolume. For an instance, this is the data that has diverged from its
+	// image.
+	ExclusiveBytes int64
+	// SharedBytes is the amount of data that is shared with other subvolumes
+	SharedBytes int64
+}
+
+// PoolUsage describes the filesystem that holds every image and instance
+type PoolUsage struct {
+	TotalBytes int64
+	// FreeBytes is the space available to Draupnir
+	FreeBytes int64
+}
+
+// FreeFraction is the fraction of the pool that is free
+func (u PoolUsage) FreeFraction() float64 {
+	if u.TotalBytes == 0 {
+		return 0
+	}
+	return float64(u.FreeBytes) / float64(u.TotalBytes)
+}
+
+// InstanceStorageReport describes how far an instance has diverged from the
+// image that it was created from.
+type InstanceStorageReport struct {
+	// The ID is the same as the ID of the instance that is being reported on
+	ID             int   `jsonapi:"primary,instance_storage_reports"`
+	ImageID        int   `jsonapi:"attr,image_id"`
+	TotalBytes     int64 `jsonapi:"attr,total_bytes"`
+	ExclusiveBytes int64 `jsonapi:"attr,exclusive_bytes"`
+	SharedBytes    int64 `jsonapi:"attr,shared_bytes"`
+	// Divergence is the fraction of the instance's data that is no longer
+	// shared with its image. Instances with a high divergence are wasting space,
+	// and are good candidates for being destroyed and recreated.
+	Divergence float64 `jsonapi:"attr,divergence"`
+}
+
+func NewInstanceStorageReport(instance Instance, usage DiskUsage) InstanceStorageReport {
+	return InstanceStorageReport{
+		ID:             instance.ID,
+		ImageID:        instance.ImageID,
+		TotalBytes:     usage.TotalBytes,
+		ExclusiveBytes: usage.ExclusiveBytes,
+		SharedBytes:    usage.SharedBytes,
+		Divergence:     divergence(usage.ExclusiveBytes, usage.TotalBytes),
+	}
+}
+
+// ImageStorageReport aggregates the storage reports of every instance of an
+// image.
+type ImageStorageReport struct {
+	// The ID is the same as the ID of the image that is being reported on
+	ID int `jsonapi:"primary,image_storage_reports"`
+	// ImageBytes is the size of the image snapshot itself
+	ImageBytes    int64 `jsonapi:"attr,image_bytes"`
+	InstanceCount int   `jsonapi:"attr,instance_count"`
+	// InstanceExclusiveBytes is the sum of the exclusive bytes of every
+	// instance, i.e. the space that the instances of this image are consuming
+	// on top of the image itself.
+	InstanceExclusiveBytes int64 `jsonapi:"attr,instance_exclusive_bytes"`
+	// MaxDivergence is the divergence of the most diverged instance
+	MaxDivergence float64 `jsonapi:"attr,max_divergence"`
+}
+
+func NewImageStorageReport(imageID int, imageUsage DiskUsage, instances []InstanceStorageReport) ImageStorageReport {
+	report := ImageStorageReport{
+		ID:            imageID,
+		ImageBytes:    imageUsage.TotalBytes,
+		InstanceCount: len(instances),
+	}
+
+	for _, instance := range instances {
+		report.InstanceExclusiveBytes += instance.ExclusiveBytes
+		if instance.Divergence > report.MaxDivergence {
+			report.MaxDivergence = instance.Divergence
+		}
+	}
+
+	return report
+}
+
+func divergence(exclusive, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(exclusive) / float64(total)
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// ExchangedTokenPrefix starts every token issued by POST
+// /access_tokens/exchange, so that servers can tell them apart from OAuth
+// tokens and service account keys
+const ExchangedTokenPrefix = "dxt_"
+
+// The cloud providers whose workload identities can be exchanged for draupnir
+// credentials
+const (
+	IdentityProviderAWS = "aws"
+	IdentityProviderGCP = "gcp"
+)
+
+// AWSServerIDHeader is included in signed AWS identity requests, and must be
+// signed, so that a request signed for one draupnir server can't be replayed
+// against another, or against any other service that verifies AWS identities
+const AWSServerIDHeader = "Draupnir-Server-ID"
+
+// AWSIdentityRequest is an sts:GetCallerIdentity request, signed with the
+// caller's AWS credentials. The caller doesn't send it to STS: the server does,
+// and STS tells it who signed the request.
+type AWSIdentityRequest struct {
+	Method  string              `json:"method"`
+	URL     string              `json:"url"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body"`
+}
+
+// Encode returns the request as the token that's exchanged
+func (r AWSIdentityRequest) Encode() (string, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// DecodeAWSIdentityRequest decodes a token produced by
+// AWSIdentityRequest.Encode
+func DecodeAWSIdentityRequest(token string) (AWSIdentityRequest, error) {
+	var request AWSIdentityRequest
+
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return request, fmt.Errorf("invalid AWS identity request: %s", err)
+	}
+	if err := json.Unmarshal(data, &request); err != nil {
+		return request, fmt.Errorf("invalid AWS identity request: %s", err)
+	}
+	return request, nil
+}
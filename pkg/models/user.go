@@ -0,0 +1,40 @@
+package models
+
+// The roles that a user can have. Everyone who authenticates has one of them,
+// which decides what they're allowed to do.
+const (
+	// RoleUser is a person, authenticated with OAuth, who can manage their own
+	// instances
+	RoleUser = "user"
+	// RoleServiceAccount is a service account, which can manage its own
+	// instances like a user, but whose instances aren't destroyed when a
+	// refresh token is revoked
+	RoleServiceAccount = "service_account"
+	// RoleAdmin is the upload user, authenticated with the shared secret, who
+	// can also create, finalise and prune images, destroy anyone's instances,
+	// and use the /admin routes
+	RoleAdmin = "admin"
+)
+
+// User is who a request is authenticated as, what they're allowed to do, and
+// how much of their quotas they've used. It's returned by GET /whoami, to
+// explain why a request was forbidden without having to read the server's
+// logs.
+type User struct {
+	// The ID is the user's email address, or the name that they're known by
+	// if they aren't a person, e.g. "upload"
+	ID    string   `jsonapi:"primary,users"`
+	Roles []string `jsonapi:"attr,roles"`
+	// Instances is how many instances the user has, of the MaxInstances that
+	// they can have, or zero for no limit
+	Instances    int `jsonapi:"attr,instances"`
+	MaxInstances int `jsonapi:"attr,max_instances"`
+	// ImagesInProgress is how many of the images that the user created aren't
+	// ready yet, of the MaxImagesInProgress that they can have, or zero for no
+	// limit
+	ImagesInProgress    int `jsonapi:"attr,images_in_progress"`
+	MaxImagesInProgress int `jsonapi:"attr,max_images_in_progress"`
+	// ImageCooldown is how long the user must wait before creating another
+	// image, e.g. "1m30s"
+	ImageCooldown string `jsonapi:"attr,image_cooldown"`
+}
@@ -0,0 +1,36 @@
+package models
+
+// ImageInspection describes the contents of an image's upload or snapshot, as
+// reported by draupnir-inspect-image
+type ImageInspection struct {
+	Checksum string
+	// StartLSN is the location in the source's WAL at which its base backup
+	// started. It's only known for uploads with a backup_label.
+	StartLSN string
+	ReadOnly bool
+}
+
+// ImageVerification is the result of checking an image's snapshot against the
+// checksum taken when it was finalised
+type ImageVerification struct {
+	// The ID is the same as the ID of the image that was verified
+	ID               int    `jsonapi:"primary,image_verifications"`
+	ExpectedChecksum string `jsonapi:"attr,expected_checksum"`
+	Checksum         string `jsonapi:"attr,checksum"`
+	ReadOnly         bool   `jsonapi:"attr,read_only"`
+	// Verified is true if the snapshot's checksum matches and it is read-only.
+	// Images finalised before checksums were taken can't be verified.
+	Verified bool `jsonapi:"attr,verified"`
+}
+
+func NewImageVerification(image Image, snapshot ImageInspection) ImageVerification {
+	return ImageVerification{
+		ID:               image.ID,
+		ExpectedChecksum: image.SnapshotChecksum,
+		Checksum:         snapshot.Checksum,
+		ReadOnly:         snapshot.ReadOnly,
+		Verified: image.SnapshotChecksum != "" &&
+			image.SnapshotChecksum == snapshot.Checksum &&
+			snapshot.ReadOnly,
+	}
+}
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// The statuses of webhook deliveries
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookDelivery records the sending of an event, such as an image becoming
+// ready, to one of the webhooks in the server's config. Deliveries are retried
+// until the webhook accepts them or they run out of attempts, and are kept as
+// the log of what each webhook was sent.
+type WebhookDelivery struct {
+	ID int `jsonapi:"primary,webhook_deliveries"`
+	// Webhook is the name of the webhook in the server's config
+	Webhook string `jsonapi:"attr,webhook"`
+	// Event is the event that was delivered, e.g. image.ready
+	Event string `jsonapi:"attr,event"`
+	// ResourceType and ResourceID are the image, instance or access request
+	// that the event is about
+	ResourceType string `jsonapi:"attr,resource_type"`
+	ResourceID   int    `jsonapi:"attr,resource_id"`
+	// Status is pending, succeeded or failed
+	Status   string `jsonapi:"attr,status"`
+	Attempts int    `jsonapi:"attr,attempts"`
+	// ResponseStatus is the HTTP status of the webhook's response to the last
+	// attempt, or zero if it didn't respond
+	ResponseStatus int `jsonapi:"attr,response_status"`
+	// Error is why the last attempt failed
+	Error     string    `jsonapi:"attr,error"`
+	CreatedAt time.Time `jsonapi:"attr,created_at,iso8601"`
+	UpdatedAt time.Time `jsonapi:"attr,updated_at,iso8601"`
+	// Body is the request body that's sent to the webhook. It isn't exposed
+	// through the API, as it's signed with the webhook's secret.
+	Body []byte
+}
@@ -0,0 +1,335 @@
+// Package pgproxy relays Postgres connections between clients of the server's
+// proxy and instances, counting the queries that the clients send.
+//
+// Clients reach the proxy over the server's own TLS connection, so they speak
+// unencrypted Postgres to it, and it connects to the instance over TLS with
+// the instance's client certificate. Clients never see the certificate, so
+// can't connect to the instance in any other way.
+package pgproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The codes that identify startup messages that aren't a protocol version
+const (
+	cancelRequestCode = 80877102
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+)
+
+// protocolVersion is version 3.0 of the protocol, the only one that's supported
+const protocolVersion = 3 << 16
+
+// maxStartupLength is the longest startup message that's accepted, as in
+// Postgres itself
+const maxStartupLength = 10000
+
+// The types of message that clients send that are counted as queries: simple
+// queries, and executions of prepared statements
+const (
+	queryMessage     = 'Q'
+	executeMessage   = 'E'
+	terminateMessage = 'X'
+)
+
+// Startup is the first message that a client sends, once it's been told that
+// it can't encrypt the connection
+type Startup struct {
+	raw []byte
+	// Cancel is whether the client is asking for the query running on another
+	// of its connections to be cancelled, rather than starting a session
+	Cancel bool
+	// Parameters are the session's parameters, such as user and database
+	Parameters map[string]string
+}
+
+// Database returns the database that the client asked to connect to, which
+// defaults to its user name
+func (s Startup) Database() string {
+	if database := s.Parameters["database"]; database != "" {
+		return database
+	}
+	return s.Parameters["user"]
+}
+
+// ReadStartup reads the client's startup message. Requests to encrypt the
+// connection are declined, as the connection to the proxy is already
+// encrypted.
+func ReadStartup(client io.ReadWriter) (Startup, error) {
+	for {
+		var length int32
+		if err := binary.Read(client, binary.BigEndian, &length); err != nil {
+			return Startup{}, errors.Wrap(err, "failed to read startup message")
+		}
+		if length < 8 || length > maxStartupLength {
+			return Startup{}, fmt.Errorf("invalid startup message length %d", length)
+		}
+
+		raw := make([]byte, length)
+		binary.BigEndian.PutUint32(raw, uint32(length))
+		if _, err := io.ReadFull(client, raw[4:]); err != nil {
+			return Startup{}, errors.Wrap(err, "failed to read startup message")
+		}
+
+		switch code := binary.BigEndian.Uint32(raw[4:8]); code {
+		case sslRequestCode, gssEncRequestCode:
+			if _, err := client.Write([]byte{'N'}); err != nil {
+				return Startup{}, errors.Wrap(err, "failed to decline encryption")
+			}
+		case cancelRequestCode:
+			return Startup{raw: raw, Cancel: true}, nil
+		case protocolVersion:
+			parameters, err := parseParameters(raw[8:])
+			if err != nil {
+				return Startup{}, err
+			}
+			return Startup{raw: raw, Parameters: parameters}, nil
+		default:
+			return Startup{}, fmt.Errorf("unsupported protocol version %d.%d", code>>16, code&0xffff)
+		}
+	}
+}
+
+// parseParameters parses the null-terminated names and values of a startup
+// message, which end with an empty name
+func parseParameters(data []byte) (map[string]string, error) {
+	fields := bytes.Split(data, []byte{0})
+	if len(fields) < 2 || len(fields[len(fields)-1]) != 0 || len(fields[len(fields)-2]) != 0 {
+		return nil, errors.New("malformed startup message")
+	}
+
+	fields = fields[:len(fields)-2]
+	if len(fields)%2 != 0 {
+		return nil, errors.New("malformed startup message")
+	}
+
+	parameters := make(map[string]string, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		parameters[string(fields[i])] = string(fields[i+1])
+	}
+	return parameters, nil
+}
+
+// TLSConfig returns the configuration for connecting to an instance with its
+// credentials. As with libpq's verify-ca mode, the instance's certificate must
+// be signed by its CA, but its name isn't checked.
+func TLSConfig(caCertificate, clientCertificate, clientKey []byte) (*tls.Config, error) {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caCertificate) {
+		return nil, errors.New("invalid CA certificate")
+	}
+
+	certificate, err := tls.X509KeyPair(clientCertificate, clientKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid client certificate")
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		// The certificate is verified below, without checking its name
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("instance sent no certificate")
+			}
+
+			intermediates := x509.NewCertPool()
+			var leaf *x509.Certificate
+			for i, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return errors.Wrap(err, "invalid instance certificate")
+				}
+				if i == 0 {
+					leaf = cert
+				} else {
+					intermediates.AddCert(cert)
+				}
+			}
+
+			_, err := leaf.Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			})
+			return errors.Wrap(err, "instance certificate isn't signed by its CA")
+		},
+	}, nil
+}
+
+// Dial connects to the Postgres server at address, encrypting the connection
+// with config
+func Dial(ctx context.Context, address string, config *tls.Config) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request, 8)
+	binary.BigEndian.PutUint32(request[4:], sslRequestCode)
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to request encryption")
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to request encryption")
+	}
+	if response[0] != 'S' {
+		conn.Close()
+		return nil, errors.New("instance doesn't accept encrypted connections")
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to encrypt connection")
+	}
+
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Cancel forwards a cancel request to the server, which closes the connection
+// once it's read it
+func Cancel(server io.WriteCloser, startup Startup) error {
+	defer server.Close()
+
+	if !startup.Cancel {
+		return errors.New("not a cancel request")
+	}
+	_, err := server.Write(startup.raw)
+	return err
+}
+
+// WriteError sends the client a fatal error, for when it can't be connected to
+// the server. Clients show the message to the user, then disconnect.
+func WriteError(client io.Writer, message string) error {
+	var body bytes.Buffer
+	for _, field := range []struct {
+		code  byte
+		value string
+	}{
+		{'S', "FATAL"},
+		{'V', "FATAL"},
+		// connection_failure
+		{'C', "08006"},
+		{'M', message},
+	} {
+		body.WriteByte(field.code)
+		body.WriteString(field.value)
+		body.WriteByte(0)
+	}
+	body.WriteByte(0)
+
+	header := []byte{'E', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[1:], uint32(body.Len()+4))
+	_, err := client.Write(append(header, body.Bytes()...))
+	return err
+}
+
+// Session relays a client's connection to the server
+type Session struct {
+	queries int64
+}
+
+// Queries returns how many queries the client has sent so far
+func (s *Session) Queries() int {
+	return int(atomic.LoadInt64(&s.queries))
+}
+
+// Relay sends the startup message to the server, and then relays messages
+// between the client and the server until either of them closes the
+// connection. Both connections are closed when it returns. It returns the
+// error that the first connection to close did, if any, so it returns nil
+// when the client disconnects.
+func (s *Session) Relay(client, server io.ReadWriteCloser, startup Startup) error {
+	defer client.Close()
+	defer server.Close()
+
+	if startup.Cancel {
+		return errors.New("can't start a session with a cancel request")
+	}
+	if _, err := server.Write(startup.raw); err != nil {
+		return errors.Wrap(err, "failed to send startup message")
+	}
+
+	clientDone := make(chan error, 1)
+	serverDone := make(chan error, 1)
+	go func() {
+		clientDone <- s.relayMessages(server, client)
+	}()
+	go func() {
+		_, err := io.Copy(client, server)
+		serverDone <- err
+	}()
+
+	// Once either side has closed, the other's connection is closed too, which
+	// makes its relay fail in a way that isn't interesting
+	var err error
+	select {
+	case err = <-clientDone:
+		server.Close()
+		<-serverDone
+	case err = <-serverDone:
+		client.Close()
+		<-clientDone
+	}
+	return err
+}
+
+// relayMessages copies messages from the client to the server, counting the
+// queries among them, until the client terminates the session or closes the
+// connection
+func (s *Session) relayMessages(server io.Writer, client io.Reader) error {
+	reader := bufio.NewReader(client)
+	header := make([]byte, 5)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "failed to read message from client")
+		}
+
+		length := int32(binary.BigEndian.Uint32(header[1:]))
+		if length < 4 {
+			return fmt.Errorf("invalid message length %d", length)
+		}
+
+		if _, err := server.Write(header); err != nil {
+			return errors.Wrap(err, "failed to send message to instance")
+		}
+		if _, err := io.CopyN(server, reader, int64(length-4)); err != nil {
+			return errors.Wrap(err, "failed to relay message to instance")
+		}
+
+		switch header[0] {
+		case queryMessage, executeMessage:
+			atomic.AddInt64(&s.queries, 1)
+		case terminateMessage:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package pgproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startupMessage(code uint32, parameters ...string) []byte {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, code)
+	for _, p := range parameters {
+		body = append(body, p...)
+		body = append(body, 0)
+	}
+	if len(parameters) > 0 {
+		body = append(body, 0)
+	}
+
+	message := make([]byte, 4)
+	binary.BigEndian.PutUint32(message, uint32(len(body)+4))
+	return append(message, body...)
+}
+
+func message(messageType byte, body string) []byte {
+	m := []byte{messageType, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(m[1:], uint32(len(body)+4))
+	return append(m, body...)
+}
+
+func TestReadStartup(t *testing.T) {
+	client, proxy := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		client.Write(startupMessage(sslRequestCode))
+		response := make([]byte, 1)
+		io.ReadFull(client, response)
+		if response[0] == 'N' {
+			client.Write(startupMessage(protocolVersion, "user", "draupnir", "database", "payments"))
+		}
+	}()
+
+	startup, err := ReadStartup(proxy)
+	assert.Nil(t, err)
+	assert.False(t, startup.Cancel)
+	assert.Equal(t, map[string]string{"user": "draupnir", "database": "payments"}, startup.Parameters)
+	assert.Equal(t, "payments", startup.Database())
+}
+
+func TestReadStartupCancelRequest(t *testing.T) {
+	client, proxy := net.Pipe()
+	defer client.Close()
+
+	go client.Write(append(startupMessage(cancelRequestCode), 0, 0, 0, 1, 0, 0, 0, 2))
+
+	startup, err := ReadStartup(proxy)
+	assert.Nil(t, err)
+	assert.True(t, startup.Cancel)
+}
+
+func TestReadStartupUnsupportedVersion(t *testing.T) {
+	client, proxy := net.Pipe()
+	defer client.Close()
+
+	go client.Write(startupMessage(2<<16, "user", "draupnir"))
+
+	_, err := ReadStartup(proxy)
+	assert.EqualError(t, err, "unsupported protocol version 2.0")
+}
+
+func TestDatabaseDefaultsToUser(t *testing.T) {
+	startup := Startup{Parameters: map[string]string{"user": "draupnir"}}
+	assert.Equal(t, "draupnir", startup.Database())
+}
+
+func TestWriteError(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, WriteError(&buf, "instance is unavailable"))
+	assert.Equal(t, message('E', "SFATAL\x00VFATAL\x00C08006\x00Minstance is unavailable\x00\x00"), buf.Bytes())
+}
+
+func TestRelay(t *testing.T) {
+	client, proxyClient := net.Pipe()
+	proxyServer, server := net.Pipe()
+
+	startup := Startup{
+		raw:        startupMessage(protocolVersion, "user", "draupnir"),
+		Parameters: map[string]string{"user": "draupnir"},
+	}
+
+	var session Session
+	relayed := make(chan error)
+	go func() {
+		relayed <- session.Relay(proxyClient, proxyServer, startup)
+	}()
+
+	received := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(server)
+		received <- data
+	}()
+
+	client.Write(message('Q', "SELECT 1\x00"))
+	client.Write(message('P', "\x00SELECT $1\x00\x00\x00"))
+	client.Write(message('E', "\x00\x00\x00\x00\x00"))
+	client.Write(message('X', ""))
+
+	assert.Nil(t, <-relayed)
+	assert.Equal(t, 2, session.Queries())
+
+	expected := startup.raw
+	expected = append(expected, message('Q', "SELECT 1\x00")...)
+	expected = append(expected, message('P', "\x00SELECT $1\x00\x00\x00")...)
+	expected = append(expected, message('E', "\x00\x00\x00\x00\x00")...)
+	expected = append(expected, message('X', "")...)
+	assert.Equal(t, expected, <-received)
+
+	// The client's connection is closed too
+	_, err := client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestRelayServerCloses(t *testing.T) {
+	client, proxyClient := net.Pipe()
+	proxyServer, server := net.Pipe()
+
+	var session Session
+	relayed := make(chan error)
+	go func() {
+		relayed <- session.Relay(proxyClient, proxyServer, Startup{raw: startupMessage(protocolVersion, "user", "draupnir")})
+	}()
+
+	go func() {
+		io.ReadFull(server, make([]byte, len(startupMessage(protocolVersion, "user", "draupnir"))))
+		server.Write(message('E', "SFATAL\x00\x00"))
+		server.Close()
+	}()
+
+	data, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, message('E', "SFATAL\x00\x00"), data)
+	assert.Nil(t, <-relayed)
+}
+
+func TestDial(t *testing.T) {
+	caPEM, serverCert := generateCertificates(t)
+	clientCertPEM, clientKeyPEM := generateClientCertificate(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.ReadFull(conn, make([]byte, 8))
+		conn.Write([]byte{'S'})
+
+		tlsConn := tls.Server(conn, &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAnyClientCert,
+		})
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(tlsConn, buf); err == nil {
+			tlsConn.Write(buf)
+		}
+	}()
+
+	config, err := TLSConfig(caPEM, clientCertPEM, clientKeyPEM)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, listener.Addr().String(), config)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestDialUntrustedInstance(t *testing.T) {
+	_, serverCert := generateCertificates(t)
+	otherCA, _ := generateCertificates(t)
+	clientCertPEM, clientKeyPEM := generateClientCertificate(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.ReadFull(conn, make([]byte, 8))
+		conn.Write([]byte{'S'})
+		tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{serverCert}}).Handshake()
+	}()
+
+	config, err := TLSConfig(otherCA, clientCertPEM, clientKeyPEM)
+	assert.Nil(t, err)
+
+	_, err = Dial(context.Background(), listener.Addr().String(), config)
+	assert.NotNil(t, err)
+}
+
+// generateCertificates returns a self-signed CA certificate, and the same
+// certificate with its key for the server to present
+func generateCertificates(t *testing.T) ([]byte, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "instance"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return certPEM, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func generateClientCertificate(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "draupnir"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -0,0 +1,472 @@
+// Package reclaim frees space in the pool when it's critically low, by
+// destroying the instances and images that a configured policy says are the
+// least valuable, rather than letting the host fill up and grind to a halt.
+package reclaim
+
+import (
+	"context"
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/jobs"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/prometheus/common/log"
+)
+
+// Instances annotated with ProtectedAnnotation, and images annotated with
+// PinnedAnnotation, set to "true" are never reclaimed
+const (
+	ProtectedAnnotation = "draupnir/protected"
+	PinnedAnnotation    = "draupnir/pinned"
+)
+
+// Policy decides when space is reclaimed, and what is reclaimed
+type Policy struct {
+	// CriticalFreeSpace is the fraction of the pool below which free space is
+	// critically low, e.g. 0.05. Nothing is reclaimed if it's zero.
+	CriticalFreeSpace float64
+	// TargetFreeSpace is the fraction of the pool that reclamation tries to
+	// free. It defaults to CriticalFreeSpace.
+	TargetFreeSpace float64
+	// CIUsers are the users whose instances are created by CI, and
+	// InstanceMaxAge is the age after which these are expired. Only expired CI
+	// instances are reclaimed.
+	CIUsers        []string
+	InstanceMaxAge time.Duration
+}
+
+// Action records something that was destroyed to reclaim space
+type Action struct {
+	// Kind is either "image" or "instance"
+	Kind string
+	ID   int
+	// Owner is the user that the instance belonged to, or the upload user for
+	// images
+	Owner  string
+	Reason string
+	// ReclaimedBytes is an estimate of the space that was freed
+	ReclaimedBytes int64
+}
+
+// Notifier tells the owner of an image or instance that it was reclaimed
+type Notifier func(ctx context.Context, action Action) error
+
+// Reclaimer checks the pool's free space, and reclaims space by the policy
+// when it's critically low. Images and instances are destroyed in this order,
+// until the target free space is reached:
+//
+//  1. Expired CI instances that aren't protected, oldest first
+//  2. Ready images that aren't pinned and have no instances, oldest first. The
+//     newest ready image of each family is always kept.
+//
+// Other users' instances are never reclaimed.
+type Reclaimer struct {
+	Logger        log.Logger
+	Policy        Policy
+	ImageStore    store.ImageStore
+	InstanceStore store.InstanceStore
+	JobStore      store.JobStore
+	Executor      exec.Executor
+	Events        *events.Broker
+	// Notify, if set, is called with each action after it's taken
+	Notify Notifier
+}
+
+// Start checks the pool's free space every interval until the context is done
+func (r Reclaimer) Start(ctx context.Context, interval time.Duration) error {
+	for {
+		select {
+		case <-time.After(interval):
+			if _, err := r.Reclaim(ctx); err != nil {
+				r.Logger.With("error", err).Error("failed to reclaim space")
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Plan is what reclamation would do by a policy, given the pool's usage
+type Plan struct {
+	Usage models.PoolUsage
+	// Critical is true if the pool's free space is critically low by the
+	// policy. Nothing is reclaimed otherwise.
+	Critical bool
+	// Actions are the images and instances that would be destroyed, in order
+	Actions []Action
+	// ReclaimedBytes is an estimate of the space that the actions would free
+	ReclaimedBytes int64
+	// Reached is false if the actions wouldn't free enough space to reach the
+	// policy's target
+	Reached bool
+}
+
+// candidate is an image or instance that the plan would destroy
+type candidate struct {
+	action   Action
+	instance models.Instance
+	image    models.Image
+}
+
+// Reclaim destroys images and instances by the policy if the pool's free space
+// is critically low, and returns what it destroyed
+func (r Reclaimer) Reclaim(ctx context.Context) ([]Action, error) {
+	// We need to add a logger to the context, as the exec package depends on one
+	// being present in order to log
+	ctx = context.WithValue(ctx, middleware.LoggerKey, &r.Logger)
+
+	if r.Policy.CriticalFreeSpace <= 0 {
+		return nil, nil
+	}
+
+	plan, candidates, err := r.plan(ctx, r.Policy)
+	if err != nil || !plan.Critical {
+		return nil, err
+	}
+
+	r.Logger.
+		With("free_bytes", plan.Usage.FreeBytes).
+		With("total_bytes", plan.Usage.TotalBytes).
+		With("target_free_fraction", r.Policy.target()).
+		Warn("pool free space is critically low: reclaiming space")
+
+	var actions []Action
+	for _, c := range candidates {
+		if c.action.Kind == "instance" {
+			err = r.destroyInstance(ctx, c.instance, c.action)
+		} else {
+			err = r.destroyImage(ctx, c.image, c.action)
+		}
+		if err != nil {
+			return actions, err
+		}
+		actions = append(actions, r.notify(ctx, c.action))
+	}
+
+	if !plan.Reached {
+		r.Logger.
+			With("free_bytes", plan.Usage.FreeBytes+plan.ReclaimedBytes).
+			With("total_bytes", plan.Usage.TotalBytes).
+			Error("nothing left to reclaim by policy, but pool free space is still critically low")
+	}
+
+	return actions, nil
+}
+
+// Preview returns what Reclaim would destroy if it ran now with the given
+// policy, without destroying anything, so that policies can be tried out
+func (r Reclaimer) Preview(ctx context.Context, policy Policy) (Plan, error) {
+	ctx = context.WithValue(ctx, middleware.LoggerKey, &r.Logger)
+
+	plan, _, err := r.plan(ctx, policy)
+	return plan, err
+}
+
+// plan decides what to destroy by the policy, based on the pool's current
+// usage
+func (r Reclaimer) plan(ctx context.Context, policy Policy) (Plan, []candidate, error) {
+	usage, err := r.Executor.RetrievePoolUsage(ctx)
+	if err != nil {
+		return Plan{}, nil, err
+	}
+
+	plan := Plan{Usage: usage, Reached: true}
+	if policy.CriticalFreeSpace <= 0 || usage.FreeFraction() >= policy.CriticalFreeSpace {
+		return plan, nil, nil
+	}
+	plan.Critical = true
+
+	// Space freed by deleting btrfs subvolumes is released in the background, so
+	// we estimate how much we'd free from each subvolume's exclusive data rather
+	// than waiting for the free space to change
+	reached := func() bool {
+		return models.PoolUsage{
+			TotalBytes: usage.TotalBytes,
+			FreeBytes:  usage.FreeBytes + plan.ReclaimedBytes,
+		}.FreeFraction() >= policy.target()
+	}
+	var candidates []candidate
+	add := func(c candidate) {
+		plan.ReclaimedBytes += c.action.ReclaimedBytes
+		plan.Actions = append(plan.Actions, c.action)
+		candidates = append(candidates, c)
+	}
+
+	instances, err := r.InstanceStore.List()
+	if err != nil {
+		return plan, nil, err
+	}
+
+	destroyed := map[int]bool{}
+	for _, instance := range expiredInstances(policy, instances) {
+		if reached() {
+			break
+		}
+
+		destroyed[instance.ID] = true
+		add(candidate{action: r.instanceAction(ctx, policy, instance), instance: instance})
+	}
+
+	if !reached() {
+		images, err := r.ImageStore.List()
+		if err != nil {
+			return plan, nil, err
+		}
+
+		// Images are unused once the instances above have been destroyed
+		remaining := []models.Instance{}
+		for _, instance := range instances {
+			if !destroyed[instance.ID] {
+				remaining = append(remaining, instance)
+			}
+		}
+
+		for _, image := range unusedImages(images, remaining) {
+			if reached() {
+				break
+			}
+
+			add(candidate{action: r.imageAction(ctx, image), image: image})
+		}
+	}
+
+	plan.Reached = reached()
+	return plan, candidates, nil
+}
+
+// target is the fraction of the pool that reclamation tries to free
+func (p Policy) target() float64 {
+	if p.TargetFreeSpace < p.CriticalFreeSpace {
+		return p.CriticalFreeSpace
+	}
+	return p.TargetFreeSpace
+}
+
+// expiredInstances returns the expired CI instances that aren't protected,
+// oldest first
+func expiredInstances(policy Policy, instances []models.Instance) []models.Instance {
+	ciUsers := map[string]bool{}
+	for _, user := range policy.CIUsers {
+		ciUsers[user] = true
+	}
+
+	expired := []models.Instance{}
+	for _, instance := range instances {
+		if !ciUsers[instance.UserEmail] || time.Since(instance.CreatedAt) < policy.InstanceMaxAge {
+			continue
+		}
+		if instance.Annotations[ProtectedAnnotation] == "true" {
+			continue
+		}
+		expired = append(expired, instance)
+	}
+
+	sort.SliceStable(expired, func(i, j int) bool {
+		return expired[i].CreatedAt.Before(expired[j].CreatedAt)
+	})
+	return expired
+}
+
+// unusedImages returns the ready images that aren't pinned and have no
+// instances, oldest first, other than the newest ready image of each family,
+// so that no family is left without an image to create instances from
+func unusedImages(images []models.Image, instances []models.Instance) []models.Image {
+	inUse := map[int]bool{}
+	for _, instance := range instances {
+		inUse[instance.ImageID] = true
+	}
+
+	ready := []models.Image{}
+	for _, image := range images {
+		if image.Ready {
+			ready = append(ready, image)
+		}
+	}
+
+	sort.SliceStable(ready, func(i, j int) bool {
+		return ready[i].BackedUpAt.Before(ready[j].BackedUpAt)
+	})
+
+	newest := map[string]int{}
+	for _, image := range ready {
+		newest[freshness.Family(image)] = image.ID
+	}
+
+	unused := []models.Image{}
+	for _, image := range ready {
+		if newest[freshness.Family(image)] == image.ID || inUse[image.ID] || image.Annotations[PinnedAnnotation] == "true" {
+			continue
+		}
+		unused = append(unused, image)
+	}
+	return unused
+}
+
+// PrunePolicy selects old images to prune, to stop them filling the pool
+// before it's critically low. Only ready images that aren't pinned and have no
+// instances are pruned, and the newest ready image of each family is always
+// kept.
+type PrunePolicy struct {
+	// OlderThan prunes images that were backed up longer ago than it, if it's
+	// positive
+	OlderThan time.Duration
+	// KeepLast keeps the newest KeepLast ready images, if it's positive. Given
+	// along with OlderThan, only images that are both old enough and not among
+	// the newest KeepLast are pruned.
+	KeepLast int
+}
+
+// Images returns the images that the policy prunes, oldest first. It prunes
+// nothing unless OlderThan or KeepLast is set.
+func (p PrunePolicy) Images(images []models.Image, instances []models.Instance, now time.Time) []models.Image {
+	if p.OlderThan <= 0 && p.KeepLast <= 0 {
+		return []models.Image{}
+	}
+
+	keepLast := p.KeepLast
+	if keepLast < 1 {
+		keepLast = 1
+	}
+
+	ready := []models.Image{}
+	for _, image := range images {
+		if image.Ready {
+			ready = append(ready, image)
+		}
+	}
+	sort.SliceStable(ready, func(i, j int) bool {
+		return ready[i].BackedUpAt.After(ready[j].BackedUpAt)
+	})
+	kept := map[int]bool{}
+	for idx := 0; idx < keepLast && idx < len(ready); idx++ {
+		kept[ready[idx].ID] = true
+	}
+
+	pruned := []models.Image{}
+	for _, image := range unusedImages(images, instances) {
+		if kept[image.ID] {
+			continue
+		}
+		if p.OlderThan > 0 && now.Sub(image.BackedUpAt) < p.OlderThan {
+			continue
+		}
+		pruned = append(pruned, image)
+	}
+	return pruned
+}
+
+func (r Reclaimer) instanceAction(ctx context.Context, policy Policy, instance models.Instance) Action {
+	action := Action{
+		Kind:   "instance",
+		ID:     instance.ID,
+		Owner:  instance.UserEmail,
+		Reason: fmt.Sprintf("CI instance older than %s", policy.InstanceMaxAge),
+	}
+
+	usage, err := r.Executor.RetrieveInstanceDiskUsage(ctx, instance.ID)
+	if err != nil {
+		r.Logger.With("instance", instance.ID).With("error", err).Warn("failed to retrieve disk usage of instance")
+	}
+	action.ReclaimedBytes = usage.ExclusiveBytes
+	return action
+}
+
+func (r Reclaimer) imageAction(ctx context.Context, image models.Image) Action {
+	action := Action{
+		Kind:   "image",
+		ID:     image.ID,
+		Owner:  auth.UPLOAD_USER_EMAIL,
+		Reason: "oldest unpinned image without instances",
+	}
+
+	usage, err := r.Executor.RetrieveImageDiskUsage(ctx, image.ID)
+	if err != nil {
+		r.Logger.With("image", image.ID).With("error", err).Warn("failed to retrieve disk usage of image")
+	}
+	action.ReclaimedBytes = usage.ExclusiveBytes
+	return action
+}
+
+func (r Reclaimer) destroyInstance(ctx context.Context, instance models.Instance, action Action) error {
+	logger := r.Logger.With("instance", instance.ID).With("user", instance.UserEmail)
+
+	err := jobs.Run(logger, r.JobStore, models.JobDestroyInstance, instance.ID, func() error {
+		err := r.Executor.DestroyInstance(ctx, instance.ID)
+		if err == nil {
+			err = r.InstanceStore.Destroy(instance)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to destroy instance %d: %s", instance.ID, err)
+	}
+
+	logger.With("reason", action.Reason).With("reclaimed_bytes", action.ReclaimedBytes).Warn("reclaimed instance")
+	r.Events.Publish(events.InstanceEvent(events.Destroyed, instance))
+	return nil
+}
+
+func (r Reclaimer) destroyImage(ctx context.Context, image models.Image, action Action) error {
+	logger := r.Logger.With("image", image.ID)
+
+	// As when destroying images through the API, the image is removed from the
+	// database before its files
+	err := jobs.Run(logger, r.JobStore, models.JobDestroyImage, image.ID, func() error {
+		err := r.ImageStore.Destroy(image)
+		if err == nil {
+			err = r.Executor.DestroyImage(ctx, image.ID)
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to destroy image %d: %s", image.ID, err)
+	}
+
+	logger.With("reason", action.Reason).With("reclaimed_bytes", action.ReclaimedBytes).Warn("reclaimed image")
+	r.Events.Publish(events.ImageEvent(events.Destroyed, image))
+	return nil
+}
+
+// notify tells the owner about the action. Failing to notify them doesn't stop
+// us reclaiming space.
+func (r Reclaimer) notify(ctx context.Context, action Action) Action {
+	if r.Notify != nil {
+		if err := r.Notify(ctx, action); err != nil {
+			r.Logger.With("kind", action.Kind).With("id", action.ID).With("error", err).Warn("failed to notify owner")
+		}
+	}
+	return action
+}
+
+// CommandNotifier notifies owners by running command with sh, passing the
+// action in the environment as DRAUPNIR_RECLAIMED_KIND, DRAUPNIR_RECLAIMED_ID,
+// DRAUPNIR_RECLAIMED_OWNER, DRAUPNIR_RECLAIMED_REASON and
+// DRAUPNIR_RECLAIMED_BYTES
+func CommandNotifier(command string) Notifier {
+	return func(ctx context.Context, action Action) error {
+		cmd := osexec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = append(
+			os.Environ(),
+			"DRAUPNIR_RECLAIMED_KIND="+action.Kind,
+			"DRAUPNIR_RECLAIMED_ID="+strconv.Itoa(action.ID),
+			"DRAUPNIR_RECLAIMED_OWNER="+action.Owner,
+			"DRAUPNIR_RECLAIMED_REASON="+action.Reason,
+			"DRAUPNIR_RECLAIMED_BYTES="+strconv.FormatInt(action.ReclaimedBytes, 10),
+		)
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, output)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,306 @@
+package reclaim
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// The stores and executor embed their interfaces, so that calling anything we
+// haven't faked panics
+type fakeImageStore struct {
+	store.ImageStore
+	images *[]models.Image
+}
+
+func (s fakeImageStore) List() ([]models.Image, error) {
+	return append([]models.Image{}, *s.images...), nil
+}
+
+func (s fakeImageStore) Destroy(image models.Image) error {
+	for idx, i := range *s.images {
+		if i.ID == image.ID {
+			*s.images = append((*s.images)[:idx], (*s.images)[idx+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+type fakeInstanceStore struct {
+	store.InstanceStore
+	instances *[]models.Instance
+}
+
+func (s fakeInstanceStore) List() ([]models.Instance, error) {
+	return append([]models.Instance{}, *s.instances...), nil
+}
+
+func (s fakeInstanceStore) Destroy(instance models.Instance) error {
+	for idx, i := range *s.instances {
+		if i.ID == instance.ID {
+			*s.instances = append((*s.instances)[:idx], (*s.instances)[idx+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+type fakeJobStore struct {
+	store.JobStore
+}
+
+func (s fakeJobStore) Create(job models.Job) (models.Job, error) {
+	return job, nil
+}
+
+// fakeExecutor reports the pool as 100 bytes, with free bytes free, and each
+// image and instance as having 10 bytes of exclusive data
+type fakeExecutor struct {
+	exec.Executor
+	free      int64
+	destroyed *[]string
+}
+
+func (e fakeExecutor) RetrievePoolUsage(ctx context.Context) (models.PoolUsage, error) {
+	return models.PoolUsage{TotalBytes: 100, FreeBytes: e.free}, nil
+}
+
+func (e fakeExecutor) RetrieveImageDiskUsage(ctx context.Context, id int) (models.DiskUsage, error) {
+	return models.DiskUsage{TotalBytes: 50, ExclusiveBytes: 10}, nil
+}
+
+func (e fakeExecutor) RetrieveInstanceDiskUsage(ctx context.Context, id int) (models.DiskUsage, error) {
+	return models.DiskUsage{TotalBytes: 50, ExclusiveBytes: 10}, nil
+}
+
+func (e fakeExecutor) DestroyImage(ctx context.Context, id int) error {
+	*e.destroyed = append(*e.destroyed, "image")
+	return nil
+}
+
+func (e fakeExecutor) DestroyInstance(ctx context.Context, id int) error {
+	*e.destroyed = append(*e.destroyed, "instance")
+	return nil
+}
+
+func newReclaimer(free int64, images *[]models.Image, instances *[]models.Instance, destroyed *[]string) Reclaimer {
+	return Reclaimer{
+		Logger: log.NewLogger(&bytes.Buffer{}),
+		Policy: Policy{
+			CriticalFreeSpace: 0.1,
+			TargetFreeSpace:   0.25,
+			CIUsers:           []string{"ci@draupnir"},
+			InstanceMaxAge:    time.Hour,
+		},
+		ImageStore:    fakeImageStore{images: images},
+		InstanceStore: fakeInstanceStore{instances: instances},
+		JobStore:      fakeJobStore{},
+		Executor:      fakeExecutor{free: free, destroyed: destroyed},
+	}
+}
+
+func ids(actions []Action) []int {
+	result := []int{}
+	for _, action := range actions {
+		result = append(result, action.ID)
+	}
+	return result
+}
+
+func TestReclaimWithEnoughFreeSpace(t *testing.T) {
+	images := []models.Image{{ID: 1, Ready: true}, {ID: 2, Ready: true}}
+	instances := []models.Instance{}
+	var destroyed []string
+
+	actions, err := newReclaimer(10, &images, &instances, &destroyed).Reclaim(context.Background())
+
+	assert.Nil(t, err)
+	assert.Empty(t, actions)
+	assert.Empty(t, destroyed)
+	assert.Len(t, images, 2)
+}
+
+func TestReclaimExpiredCIInstancesFirst(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	images := []models.Image{{ID: 1, Ready: true}}
+	instances := []models.Instance{
+		// Newer expired instances are reclaimed after older ones
+		{ID: 1, ImageID: 1, UserEmail: "ci@draupnir", CreatedAt: old.Add(time.Minute)},
+		{ID: 2, ImageID: 1, UserEmail: "ci@draupnir", CreatedAt: old},
+		// Not expired
+		{ID: 3, ImageID: 1, UserEmail: "ci@draupnir", CreatedAt: time.Now()},
+		// Not a CI instance
+		{ID: 4, ImageID: 1, UserEmail: "user@draupnir", CreatedAt: old},
+		// Protected
+		{
+			ID: 5, ImageID: 1, UserEmail: "ci@draupnir", CreatedAt: old.Add(-time.Hour),
+			Annotations: models.Annotations{ProtectedAnnotation: "true"},
+		},
+		{ID: 6, ImageID: 1, UserEmail: "ci@draupnir", CreatedAt: old.Add(time.Hour / 2)},
+	}
+	var destroyed []string
+
+	var notified []Action
+	reclaimer := newReclaimer(5, &images, &instances, &destroyed)
+	reclaimer.Notify = func(ctx context.Context, action Action) error {
+		notified = append(notified, action)
+		return errors.New("failing to notify doesn't stop reclamation")
+	}
+
+	// 5 bytes are free, so we need to reclaim 20 bytes, i.e. 2 instances
+	actions, err := reclaimer.Reclaim(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2, 1}, ids(actions))
+	assert.Equal(t, actions, notified)
+	assert.Equal(t, "ci@draupnir", actions[0].Owner)
+	assert.Equal(t, int64(10), actions[0].ReclaimedBytes)
+	assert.Equal(t, []string{"instance", "instance"}, destroyed)
+	assert.Len(t, instances, 4)
+}
+
+func TestReclaimOldestUnpinnedImages(t *testing.T) {
+	backedUpAt := time.Now().Add(-24 * time.Hour)
+	images := []models.Image{
+		{ID: 1, Ready: true, BackedUpAt: backedUpAt.Add(time.Hour)},
+		// In use
+		{ID: 2, Ready: true, BackedUpAt: backedUpAt},
+		// Pinned
+		{ID: 3, Ready: true, BackedUpAt: backedUpAt, Annotations: models.Annotations{PinnedAnnotation: "true"}},
+		// Not ready
+		{ID: 4, Ready: false, BackedUpAt: backedUpAt},
+		{ID: 5, Ready: true, BackedUpAt: backedUpAt.Add(2 * time.Hour)},
+		// The newest image is always kept
+		{ID: 6, Ready: true, BackedUpAt: backedUpAt.Add(3 * time.Hour)},
+		// As is the newest image of each other family
+		{ID: 7, Ready: true, BackedUpAt: backedUpAt, Annotations: models.Annotations{freshness.FamilyAnnotation: "payments"}},
+	}
+	instances := []models.Instance{
+		{ID: 1, ImageID: 2, UserEmail: "user@draupnir", CreatedAt: time.Now().Add(-48 * time.Hour)},
+	}
+	var destroyed []string
+
+	// Reclaiming everything that we're allowed to isn't enough
+	actions, err := newReclaimer(0, &images, &instances, &destroyed).Reclaim(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 5}, ids(actions))
+	assert.Equal(t, []string{"image", "image"}, destroyed)
+	assert.Len(t, images, 5)
+	assert.Len(t, instances, 1)
+}
+
+func TestReclaimDisabled(t *testing.T) {
+	images := []models.Image{{ID: 1, Ready: true}, {ID: 2, Ready: true}}
+	instances := []models.Instance{}
+	var destroyed []string
+
+	reclaimer := newReclaimer(0, &images, &instances, &destroyed)
+	reclaimer.Policy.CriticalFreeSpace = 0
+
+	actions, err := reclaimer.Reclaim(context.Background())
+
+	assert.Nil(t, err)
+	assert.Empty(t, actions)
+}
+
+func TestPreview(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	images := []models.Image{
+		{ID: 1, Ready: true, BackedUpAt: old},
+		{ID: 2, Ready: true, BackedUpAt: old.Add(time.Minute)},
+		{ID: 3, Ready: true, BackedUpAt: old.Add(time.Hour)},
+	}
+	instances := []models.Instance{
+		// Once this is destroyed, image 1 is unused
+		{ID: 1, ImageID: 1, UserEmail: "ci@draupnir", CreatedAt: old},
+		{ID: 2, ImageID: 3, UserEmail: "user@draupnir", CreatedAt: old},
+	}
+	var destroyed []string
+
+	reclaimer := newReclaimer(50, &images, &instances, &destroyed)
+	reclaimer.Policy.CriticalFreeSpace = 0
+
+	// A policy other than the reclaimer's is previewed, and nothing is destroyed
+	plan, err := reclaimer.Preview(context.Background(), Policy{
+		CriticalFreeSpace: 0.6,
+		TargetFreeSpace:   0.9,
+		CIUsers:           []string{"ci@draupnir"},
+		InstanceMaxAge:    time.Hour,
+	})
+
+	assert.Nil(t, err)
+	assert.True(t, plan.Critical)
+	assert.False(t, plan.Reached)
+	assert.Equal(t, []int{1, 1, 2}, ids(plan.Actions))
+	assert.Equal(t, []string{"instance", "image", "image"}, []string{
+		plan.Actions[0].Kind, plan.Actions[1].Kind, plan.Actions[2].Kind,
+	})
+	assert.Equal(t, int64(30), plan.ReclaimedBytes)
+	assert.Empty(t, destroyed)
+	assert.Len(t, images, 3)
+	assert.Len(t, instances, 2)
+
+	// Nothing would be reclaimed if free space isn't critically low
+	plan, err = reclaimer.Preview(context.Background(), Policy{CriticalFreeSpace: 0.1})
+
+	assert.Nil(t, err)
+	assert.False(t, plan.Critical)
+	assert.Empty(t, plan.Actions)
+}
+
+func TestPrunePolicy(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	images := []models.Image{
+		{ID: 1, Ready: true, BackedUpAt: now.Add(-40 * day)},
+		// In use
+		{ID: 2, Ready: true, BackedUpAt: now.Add(-35 * day)},
+		// Pinned
+		{ID: 3, Ready: true, BackedUpAt: now.Add(-35 * day), Annotations: models.Annotations{PinnedAnnotation: "true"}},
+		// Not ready
+		{ID: 4, Ready: false, BackedUpAt: now.Add(-50 * day)},
+		{ID: 5, Ready: true, BackedUpAt: now.Add(-10 * day)},
+		{ID: 6, Ready: true, BackedUpAt: now.Add(-2 * day)},
+		{ID: 7, Ready: true, BackedUpAt: now.Add(-1 * day)},
+		// The only image of its family
+		{ID: 8, Ready: true, BackedUpAt: now.Add(-60 * day), Annotations: models.Annotations{freshness.FamilyAnnotation: "payments"}},
+	}
+	instances := []models.Instance{{ID: 1, ImageID: 2}}
+
+	for _, tc := range []struct {
+		name   string
+		policy PrunePolicy
+		pruned []int
+	}{
+		{"nothing", PrunePolicy{}, []int{}},
+		{"older than", PrunePolicy{OlderThan: 30 * day}, []int{1}},
+		{"keep last", PrunePolicy{KeepLast: 2}, []int{1, 5}},
+		{"newest always kept", PrunePolicy{OlderThan: time.Hour}, []int{1, 5, 6}},
+		{"both", PrunePolicy{OlderThan: 5 * day, KeepLast: 5}, []int{1}},
+	} {
+		pruned := []int{}
+		for _, image := range tc.policy.Images(images, instances, now) {
+			pruned = append(pruned, image.ID)
+		}
+		assert.Equal(t, tc.pruned, pruned, tc.name)
+	}
+}
+
+func TestCommandNotifier(t *testing.T) {
+	notify := CommandNotifier(`test "$DRAUPNIR_RECLAIMED_KIND $DRAUPNIR_RECLAIMED_ID $DRAUPNIR_RECLAIMED_OWNER" = "instance 2 ci@draupnir"`)
+
+	assert.Nil(t, notify(context.Background(), Action{Kind: "instance", ID: 2, Owner: "ci@draupnir"}))
+	assert.NotNil(t, notify(context.Background(), Action{Kind: "image", ID: 2, Owner: "ci@draupnir"}))
+}
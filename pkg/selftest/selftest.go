@@ -0,0 +1,467 @@
+// Package selftest exercises the whole life of images on this host with the
+// server's configured executor: creating them, uploading and finalising them,
+// cloning instances of them and destroying it all again. Each step is timed,
+// so that operators can validate a new storage host, and see how it performs,
+// before pointing production traffic at it.
+//
+// The images and instances are real, and are recorded like any other, so that
+// they're cleaned up by the server's crash recovery if the test is killed. They
+// belong to the upload user, and images are annotated with ImageAnnotation.
+package selftest
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/jobs"
+	"github.com/gocardless/draupnir/pkg/ledger"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// ImageAnnotation marks the images that the self-test creates
+const ImageAnnotation = "draupnir/selftest"
+
+// The steps that are timed, in the order that they're run
+const (
+	StepCreateImage     = "create_image"
+	StepUploadImage     = "upload_image"
+	StepFinaliseImage   = "finalise_image"
+	StepCreateInstance  = "create_instance"
+	StepDestroyInstance = "destroy_instance"
+	StepDestroyImage    = "destroy_image"
+)
+
+var steps = []string{
+	StepCreateImage,
+	StepUploadImage,
+	StepFinaliseImage,
+	StepCreateInstance,
+	StepDestroyInstance,
+	StepDestroyImage,
+}
+
+// DefaultInitdb is where initdb is installed on storage hosts, alongside the
+// rest of the Postgres that the executor's scripts use
+const DefaultInitdb = "/usr/lib/postgresql/11/bin/initdb"
+
+// Dataset opens a tarball of a Postgres data directory to upload, as created by
+// pg_basebackup -Ft
+type Dataset func(ctx context.Context) (io.ReadCloser, error)
+
+// FileDataset uploads the tarball at path
+func FileDataset(path string) Dataset {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+}
+
+// InitdbDataset uploads an empty cluster, created with initdb. The anonymisation
+// script then fills it with synthetic data.
+func InitdbDataset(initdb string) Dataset {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		dir, err := ioutil.TempDir("", "draupnir-selftest")
+		if err != nil {
+			return nil, err
+		}
+
+		// The executor's scripts connect as postgres to create their own users
+		dataDir := filepath.Join(dir, "data")
+		cmd := osexec.CommandContext(ctx, initdb, "--pgdata", dataDir, "--username", "postgres", "--encoding", "UTF8", "--locale", "C.UTF-8")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			os.RemoveAll(dir)
+			return nil, errors.Wrapf(err, "failed to create dataset with initdb: %s", output)
+		}
+
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(writeTar(writer, dataDir))
+		}()
+		return cleanupReader{ReadCloser: reader, dir: dir}, nil
+	}
+}
+
+// cleanupReader removes the dataset's directory once it's been read
+type cleanupReader struct {
+	io.ReadCloser
+	dir string
+}
+
+func (r cleanupReader) Close() error {
+	err := r.ReadCloser.Close()
+	os.RemoveAll(r.dir)
+	return err
+}
+
+// writeTar writes a tarball of the directory's contents
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// syntheticData is the anonymisation script, which fills the database with
+// the given number of rows, so that there's something for instances to clone
+const syntheticData = `
+CREATE TABLE selftest (id bigint PRIMARY KEY, payload text NOT NULL, created_at timestamptz NOT NULL);
+INSERT INTO selftest
+  SELECT i, md5(i::text), now() - (i || ' seconds')::interval
+  FROM generate_series(1, %d) AS i;
+ANALYZE selftest;
+`
+
+// Runner runs the self-test
+type Runner struct {
+	Logger        log.Logger
+	ImageStore    store.ImageStore
+	InstanceStore store.InstanceStore
+	JobStore      store.JobStore
+	Executor      exec.Executor
+	// Ledger reserves the port of each instance, which is chosen between
+	// MinInstancePort and MaxInstancePort like those of other instances
+	Ledger          ledger.Ledger
+	MinInstancePort uint16
+	MaxInstancePort uint16
+	Dataset         Dataset
+	// Images is how many images are created, one after the other
+	Images int
+	// Instances is how many instances are cloned from each image, Concurrency
+	// at a time
+	Instances   int
+	Concurrency int
+	// Rows is how many rows of synthetic data each image is filled with
+	Rows int
+}
+
+// Run runs the self-test, destroying everything that it creates even if it
+// fails. It stops at the first step that fails.
+func (r Runner) Run(ctx context.Context) (*Report, error) {
+	// The exec package logs with the logger in the context
+	ctx = context.WithValue(ctx, middleware.LoggerKey, &r.Logger)
+
+	report := &Report{Steps: map[string]Latencies{}, Failures: map[string]int{}}
+	start := time.Now()
+	defer func() {
+		report.Duration = time.Since(start)
+	}()
+
+	for i := 0; i < r.Images; i++ {
+		if err := r.runImage(ctx, report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// runImage creates an image, clones instances from it and destroys them all
+func (r Runner) runImage(ctx context.Context, report *Report) error {
+	image := models.NewImage(time.Now(), fmt.Sprintf(syntheticData, r.Rows), nil)
+	image.Uploader = auth.UPLOAD_USER_EMAIL
+	image.Annotations = models.Annotations{ImageAnnotation: "true"}
+
+	err := report.time(StepCreateImage, func() error {
+		created, err := r.ImageStore.Create(image)
+		if err != nil {
+			return err
+		}
+		image = created
+		return r.Executor.CreateBtrfsSubvolume(ctx, image.ID)
+	})
+	if image.ID != 0 {
+		defer r.destroyImage(report, image)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to create image")
+	}
+
+	logger := r.Logger.With("image", image.ID)
+	logger.Info("Created self-test image")
+
+	err = report.time(StepUploadImage, func() error {
+		dataset, err := r.Dataset(ctx)
+		if err != nil {
+			return err
+		}
+		defer dataset.Close()
+
+		_, err = r.Executor.AppendImageUpload(ctx, image.ID, 0, dataset)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to upload image")
+	}
+
+	err = report.time(StepFinaliseImage, func() error {
+		return jobs.Run(logger, r.JobStore, models.JobFinaliseImage, image.ID, func() error {
+			if err := r.Executor.FinaliseImage(ctx, image); err != nil {
+				return err
+			}
+			ready, err := r.ImageStore.MarkAsReady(image)
+			image = ready
+			return err
+		})
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to finalise image")
+	}
+	logger.Info("Finalised self-test image")
+
+	return r.cloneInstances(ctx, report, image)
+}
+
+// cloneInstances creates and destroys the image's instances, Concurrency at a
+// time, returning the first error
+func (r Runner) cloneInstances(ctx context.Context, report *Report, image models.Image) error {
+	concurrency := r.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	semaphore := make(chan struct{}, concurrency)
+
+	for i := 0; i < r.Instances; i++ {
+		semaphore <- struct{}{}
+
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed || ctx.Err() != nil {
+			<-semaphore
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			if err := r.cloneInstance(ctx, report, image); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+func (r Runner) cloneInstance(ctx context.Context, report *Report, image models.Image) error {
+	var instance models.Instance
+	err := report.time(StepCreateInstance, func() error {
+		port, err := r.Ledger.ReservePort(r.MinInstancePort, r.MaxInstancePort)
+		if err != nil {
+			return err
+		}
+
+		// Like canaries, self-test instances have no refresh token, so that
+		// they're never cleaned up while they're in use
+		instance = models.NewInstance(image.ID, auth.UPLOAD_USER_EMAIL, "")
+		instance.Port = port
+
+		instance, err = r.InstanceStore.Create(instance)
+		if err != nil {
+			if releaseErr := r.Ledger.Release(models.LeasePort, strconv.Itoa(int(port))); releaseErr != nil {
+				r.Logger.With("error", releaseErr).Warn("failed to release lease")
+			}
+			return err
+		}
+
+		if err := r.Ledger.Bind(models.LeasePort, strconv.Itoa(int(port)), instance.ID); err != nil {
+			return err
+		}
+		return r.Executor.CreateInstance(ctx, image.ID, instance.ID, int(instance.Port), "", false)
+	})
+	if instance.ID != 0 {
+		r.destroyInstance(report, instance)
+	}
+	return errors.Wrap(err, "failed to create instance")
+}
+
+// destroyInstance destroys the instance. It isn't cancelled with the self-test,
+// so that instances aren't left behind when it's interrupted.
+func (r Runner) destroyInstance(report *Report, instance models.Instance) {
+	logger := r.Logger.With("instance", instance.ID)
+	ctx := context.WithValue(context.Background(), middleware.LoggerKey, &logger)
+
+	err := report.time(StepDestroyInstance, func() error {
+		return jobs.Run(logger, r.JobStore, models.JobDestroyInstance, instance.ID, func() error {
+			if err := r.InstanceStore.Destroy(instance); err != nil {
+				return err
+			}
+			return r.Executor.DestroyInstance(ctx, instance.ID)
+		})
+	})
+	if err != nil {
+		logger.With("error", err).Error("failed to destroy self-test instance")
+	}
+}
+
+// destroyImage destroys the image, which mustn't have any instances left
+func (r Runner) destroyImage(report *Report, image models.Image) {
+	logger := r.Logger.With("image", image.ID)
+	ctx := context.WithValue(context.Background(), middleware.LoggerKey, &logger)
+
+	err := report.time(StepDestroyImage, func() error {
+		return jobs.Run(logger, r.JobStore, models.JobDestroyImage, image.ID, func() error {
+			if err := r.ImageStore.Destroy(image); err != nil {
+				return err
+			}
+			return r.Executor.DestroyImage(ctx, image.ID)
+		})
+	})
+	if err != nil {
+		logger.With("error", err).Error("failed to destroy self-test image")
+	}
+}
+
+// Latencies are how long each run of a step took
+type Latencies []time.Duration
+
+// Percentile returns the latency that p percent of runs were at least as fast
+// as, using the nearest rank
+func (l Latencies) Percentile(p float64) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+
+	sorted := append(Latencies{}, l...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// Report is how long each step of the self-test took
+type Report struct {
+	mu sync.Mutex
+	// Steps are the latencies of each step that succeeded
+	Steps map[string]Latencies
+	// Failures are how many times each step failed
+	Failures map[string]int
+	Duration time.Duration
+}
+
+// time runs the step, recording how long it took if it succeeded
+func (r *Report) time(step string, run func() error) error {
+	start := time.Now()
+	err := run()
+	duration := time.Since(start)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.Failures[step]++
+		return err
+	}
+	r.Steps[step] = append(r.Steps[step], duration)
+	return nil
+}
+
+// Throughput returns how many times the step succeeded per minute of the
+// self-test
+func (r *Report) Throughput(step string) float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(len(r.Steps[step])) / r.Duration.Minutes()
+}
+
+// Write prints the report as a table of each step's latency percentiles,
+// followed by the throughput of images and instances
+func (r *Report) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tOK\tFAILED\tP50\tP90\tP99\tMAX")
+	for _, step := range steps {
+		latencies := r.Steps[step]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n",
+			step, len(latencies), r.Failures[step],
+			round(latencies.Percentile(50)),
+			round(latencies.Percentile(90)),
+			round(latencies.Percentile(99)),
+			round(latencies.Percentile(100)),
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\nfinished in %s: %.2f images/min, %.2f instances/min\n",
+		round(r.Duration), r.Throughput(StepFinaliseImage), r.Throughput(StepCreateInstance))
+	return err
+}
+
+// round rounds durations to be readable, while keeping the precision of short
+// steps
+func round(d time.Duration) time.Duration {
+	if d > time.Second {
+		return d.Round(10 * time.Millisecond)
+	}
+	return d.Round(100 * time.Microsecond)
+}
@@ -0,0 +1,305 @@
+package selftest
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/ledger"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// The stores and executor embed their interfaces, so that calling anything we
+// haven't faked panics. They're shared by the instances that are cloned
+// concurrently, so record what happens under a lock.
+type fakes struct {
+	mu                 sync.Mutex
+	nextID             int
+	images             map[int]models.Image
+	instances          map[int]models.Instance
+	uploads            map[int][]byte
+	destroyedImages    []int
+	destroyedInstances []int
+	finaliseErr        error
+}
+
+func newFakes() *fakes {
+	return &fakes{
+		nextID:    1,
+		images:    map[int]models.Image{},
+		instances: map[int]models.Instance{},
+		uploads:   map[int][]byte{},
+	}
+}
+
+func (f *fakes) id() int {
+	f.nextID++
+	return f.nextID
+}
+
+type fakeImageStore struct {
+	store.ImageStore
+	*fakes
+}
+
+func (s fakeImageStore) Create(image models.Image) (models.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	image.ID = s.id()
+	s.images[image.ID] = image
+	return image, nil
+}
+
+func (s fakeImageStore) MarkAsReady(image models.Image) (models.Image, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	image.Ready = true
+	s.images[image.ID] = image
+	return image, nil
+}
+
+func (s fakeImageStore) Destroy(image models.Image) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.images, image.ID)
+	return nil
+}
+
+type fakeInstanceStore struct {
+	store.InstanceStore
+	*fakes
+}
+
+func (s fakeInstanceStore) Create(instance models.Instance) (models.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	instance.ID = s.id()
+	s.instances[instance.ID] = instance
+	return instance, nil
+}
+
+func (s fakeInstanceStore) Destroy(instance models.Instance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.instances, instance.ID)
+	return nil
+}
+
+type fakeJobStore struct {
+	store.JobStore
+}
+
+func (s fakeJobStore) Create(job models.Job) (models.Job, error) {
+	return job, nil
+}
+
+type fakeLeaseStore struct {
+	store.LeaseStore
+}
+
+func (s fakeLeaseStore) Acquire(models.Lease) (bool, error)                   { return true, nil }
+func (s fakeLeaseStore) Bind(kind, value, owner string, instanceID int) error { return nil }
+func (s fakeLeaseStore) List(kind string) ([]models.Lease, error)             { return nil, nil }
+
+type fakeExecutor struct {
+	exec.Executor
+	*fakes
+}
+
+func (e fakeExecutor) CreateBtrfsSubvolume(ctx context.Context, id int) error {
+	return nil
+}
+
+func (e fakeExecutor) AppendImageUpload(ctx context.Context, id int, offset int64, r io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(r)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.uploads[id] = data
+	return int64(len(data)), err
+}
+
+func (e fakeExecutor) FinaliseImage(ctx context.Context, image models.Image) error {
+	return e.finaliseErr
+}
+
+func (e fakeExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int, address string, schemaOnly bool) error {
+	return nil
+}
+
+func (e fakeExecutor) DestroyInstance(ctx context.Context, id int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.destroyedInstances = append(e.destroyedInstances, id)
+	return nil
+}
+
+func (e fakeExecutor) DestroyImage(ctx context.Context, id int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.destroyedImages = append(e.destroyedImages, id)
+	return nil
+}
+
+func newRunner(f *fakes) Runner {
+	logger := log.NewLogger(ioutil.Discard)
+	return Runner{
+		Logger:          logger,
+		ImageStore:      fakeImageStore{fakes: f},
+		InstanceStore:   fakeInstanceStore{fakes: f},
+		JobStore:        fakeJobStore{},
+		Executor:        fakeExecutor{fakes: f},
+		Ledger:          ledger.Ledger{Logger: logger, Store: fakeLeaseStore{}, Owner: "test", TTL: time.Minute},
+		MinInstancePort: 6000,
+		MaxInstancePort: 7000,
+		Dataset: func(ctx context.Context) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("base backup")), nil
+		},
+		Images:      2,
+		Instances:   5,
+		Concurrency: 2,
+		Rows:        1000,
+	}
+}
+
+func TestRun(t *testing.T) {
+	f := newFakes()
+
+	report, err := newRunner(f).Run(context.Background())
+	assert.Nil(t, err)
+
+	assert.Len(t, report.Steps[StepCreateImage], 2)
+	assert.Len(t, report.Steps[StepUploadImage], 2)
+	assert.Len(t, report.Steps[StepFinaliseImage], 2)
+	assert.Len(t, report.Steps[StepCreateInstance], 10)
+	assert.Len(t, report.Steps[StepDestroyInstance], 10)
+	assert.Len(t, report.Steps[StepDestroyImage], 2)
+	assert.Empty(t, report.Failures)
+	assert.True(t, report.Duration > 0)
+
+	// Everything that was created is destroyed
+	assert.Empty(t, f.images)
+	assert.Empty(t, f.instances)
+	assert.Len(t, f.destroyedImages, 2)
+	assert.Len(t, f.destroyedInstances, 10)
+
+	for _, upload := range f.uploads {
+		assert.Equal(t, "base backup", string(upload))
+	}
+}
+
+func TestRunFillsImagesWithSyntheticData(t *testing.T) {
+	f := newFakes()
+	runner := newRunner(f)
+	runner.Images = 1
+	runner.Instances = 0
+
+	var created models.Image
+	runner.ImageStore = recordingImageStore{fakeImageStore{fakes: f}, &created}
+
+	_, err := runner.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Contains(t, created.Anon, "generate_series(1, 1000)")
+	assert.Equal(t, "true", created.Annotations[ImageAnnotation])
+	assert.Equal(t, "upload", created.Uploader)
+}
+
+type recordingImageStore struct {
+	fakeImageStore
+	created *models.Image
+}
+
+func (s recordingImageStore) Create(image models.Image) (models.Image, error) {
+	*s.created = image
+	return s.fakeImageStore.Create(image)
+}
+
+func TestRunDestroysImageWhenFinaliseFails(t *testing.T) {
+	f := newFakes()
+	f.finaliseErr = errors.New("anonymisation failed")
+
+	report, err := newRunner(f).Run(context.Background())
+	assert.EqualError(t, err, "failed to finalise image: anonymisation failed")
+
+	assert.Equal(t, 1, report.Failures[StepFinaliseImage])
+	assert.Empty(t, report.Steps[StepCreateInstance])
+	assert.Empty(t, f.images)
+	assert.Len(t, f.destroyedImages, 1)
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := Latencies{}
+	for i := 10; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Second)
+	}
+
+	assert.Equal(t, 5*time.Second, latencies.Percentile(50))
+	assert.Equal(t, 9*time.Second, latencies.Percentile(90))
+	assert.Equal(t, 10*time.Second, latencies.Percentile(99))
+	assert.Equal(t, 10*time.Second, latencies.Percentile(100))
+	assert.Equal(t, time.Duration(0), Latencies{}.Percentile(50))
+}
+
+func TestReportWrite(t *testing.T) {
+	report := Report{
+		Steps: map[string]Latencies{
+			StepFinaliseImage:  {30 * time.Second},
+			StepCreateInstance: {time.Second, 2 * time.Second},
+		},
+		Failures: map[string]int{StepCreateInstance: 1},
+		Duration: 30 * time.Second,
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, report.Write(&buf))
+
+	output := buf.String()
+	assert.Contains(t, output, "create_instance   2   1       1s")
+	assert.Contains(t, output, "finished in 30s: 2.00 images/min, 4.00 instances/min")
+}
+
+func TestWriteTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "selftest")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "base", "1"), 0700))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("11\n"), 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "base", "1", "1259"), []byte("heap"), 0600))
+
+	var buf bytes.Buffer
+	assert.Nil(t, writeTar(&buf, dir))
+
+	files := map[string]string{}
+	reader := tar.NewReader(&buf)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+
+		contents, _ := ioutil.ReadAll(reader)
+		files[header.Name] = string(contents)
+	}
+
+	assert.Equal(t, map[string]string{
+		"PG_VERSION":  "11\n",
+		"base":        "",
+		"base/1":      "",
+		"base/1/1259": "heap",
+	}, files)
+}
@@ -6,13 +6,40 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"golang.org/x/oauth2"
 	google "google.golang.org/api/oauth2/v1"
+
+	"github.com/gocardless/draupnir/pkg/models"
 )
 
 const UPLOAD_USER_EMAIL = "upload"
 
+// ServiceAccountUser returns the user that the named service account is
+// authenticated as. It can't be mistaken for a user's email address.
+func ServiceAccountUser(name string) string {
+	return "service-account:" + name
+}
+
+// Roles returns the roles of the user that a request was authenticated as
+func Roles(email string) []string {
+	switch {
+	case email == UPLOAD_USER_EMAIL:
+		return []string{models.RoleAdmin}
+	case strings.HasPrefix(email, ServiceAccountUser("")):
+		return []string{models.RoleServiceAccount}
+	default:
+		return []string{models.RoleUser}
+	}
+}
+
+// IsAdmin reports whether the user that a request was authenticated as has the
+// admin role
+func IsAdmin(email string) bool {
+	return models.ContainsString(Roles(email), models.RoleAdmin)
+}
+
 type Authenticator interface {
 	// AuthenticateRequest takes an HTTP request and
 	// attempts to authenticate it.
@@ -28,6 +55,11 @@ type GoogleAuthenticator struct {
 	OAuthClient            OAuthClient
 	SharedSecret           string
 	TrustedUserEmailDomain string
+	// ServiceAccounts maps the hash of each service account's key to its name
+	ServiceAccounts map[string]string
+	// ExchangedTokens verifies the tokens that workload identities are
+	// exchanged for
+	ExchangedTokens ExchangedTokens
 }
 
 func (g GoogleAuthenticator) AuthenticateRequest(r *http.Request) (string, string, error) {
@@ -42,6 +74,26 @@ func (g GoogleAuthenticator) AuthenticateRequest(r *http.Request) (string, strin
 		return UPLOAD_USER_EMAIL, "", nil
 	}
 
+	// Service accounts have no refresh token for the instance cleaner to check,
+	// so their instances are kept until they're destroyed
+	if strings.HasPrefix(refreshToken, models.ServiceAccountKeyPrefix) {
+		name, ok := g.ServiceAccounts[models.HashServiceAccountKey(refreshToken)]
+		if !ok {
+			return "", "", errors.New("Unknown service account key")
+		}
+		return ServiceAccountUser(name), "", nil
+	}
+
+	// Exchanged tokens authenticate service accounts too, but expire, so they're
+	// never kept on file
+	if strings.HasPrefix(refreshToken, models.ExchangedTokenPrefix) {
+		name, err := g.ExchangedTokens.Verify(refreshToken, time.Now())
+		if err != nil {
+			return "", "", err
+		}
+		return ServiceAccountUser(name), "", nil
+	}
+
 	email, err := g.OAuthClient.LookupAccessToken(refreshToken)
 	if err != nil {
 		return "", "", fmt.Errorf("Error looking up access token: %s", err.Error())
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+type fakeOAuthClient struct{}
+
+func (fakeOAuthClient) LookupAccessToken(string) (string, error) {
+	return "", errors.New("not a Google token")
+}
+
+func TestAuthenticateServiceAccount(t *testing.T) {
+	key, err := models.NewServiceAccountKey("image-builder")
+	assert.Nil(t, err)
+
+	authenticator := GoogleAuthenticator{
+		OAuthClient:     fakeOAuthClient{},
+		SharedSecret:    "shared-secret",
+		ServiceAccounts: map[string]string{key.Hash(): "image-builder"},
+	}
+
+	authenticate := func(token string) (string, string, error) {
+		req, _ := http.NewRequest(http.MethodGet, "/images", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return authenticator.AuthenticateRequest(req)
+	}
+
+	email, refreshToken, err := authenticate(key.Key)
+	assert.Nil(t, err)
+	assert.Equal(t, "service-account:image-builder", email)
+	assert.Equal(t, "", refreshToken, "the instance cleaner has nothing to check")
+
+	other, _ := models.NewServiceAccountKey("image-builder")
+	_, _, err = authenticate(other.Key)
+	assert.EqualError(t, err, "Unknown service account key")
+
+	email, _, err = authenticate("shared-secret")
+	assert.Nil(t, err)
+	assert.Equal(t, UPLOAD_USER_EMAIL, email)
+}
+
+func TestRoles(t *testing.T) {
+	assert.Equal(t, []string{models.RoleAdmin}, Roles(UPLOAD_USER_EMAIL))
+	assert.Equal(t, []string{models.RoleServiceAccount}, Roles(ServiceAccountUser("image-builder")))
+	assert.Equal(t, []string{models.RoleUser}, Roles("developer@example.com"))
+}
+
+func TestIsAdmin(t *testing.T) {
+	assert.True(t, IsAdmin(UPLOAD_USER_EMAIL))
+	assert.False(t, IsAdmin(ServiceAccountUser("image-builder")))
+	assert.False(t, IsAdmin("developer@example.com"))
+}
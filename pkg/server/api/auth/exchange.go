@@ -0,0 +1,277 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	google "google.golang.org/api/oauth2/v1"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// IdentityVerifier verifies a token proving a cloud workload's identity,
+// returning the principal that it identifies, e.g. an IAM role's ARN
+type IdentityVerifier interface {
+	Verify(ctx context.Context, token string) (string, error)
+}
+
+// ExchangedTokens issues and verifies the tokens that workload identities are
+// exchanged for. They're signed rather than stored, so every server with the
+// same shared secret accepts them.
+type ExchangedTokens struct {
+	key []byte
+}
+
+type exchangedTokenClaims struct {
+	ServiceAccount string `json:"sa"`
+	Expiry         int64  `json:"exp"`
+}
+
+// NewExchangedTokens signs tokens with a key derived from the shared secret,
+// so that a token can't be used to recover the secret
+func NewExchangedTokens(sharedSecret string) ExchangedTokens {
+	mac := hmac.New(sha256.New, []byte(sharedSecret))
+	mac.Write([]byte("draupnir exchanged token"))
+	return ExchangedTokens{key: mac.Sum(nil)}
+}
+
+// Issue returns a token authenticating the named service account until expiry
+func (t ExchangedTokens) Issue(serviceAccount string, expiry time.Time) (string, error) {
+	if t.key == nil {
+		return "", errors.New("token exchange is not configured")
+	}
+
+	claims, err := json.Marshal(exchangedTokenClaims{ServiceAccount: serviceAccount, Expiry: expiry.Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return models.ExchangedTokenPrefix + payload + "." + t.sign(payload), nil
+}
+
+// Verify returns the service account that the token authenticates, if it was
+// issued by us and hasn't expired
+func (t ExchangedTokens) Verify(token string, now time.Time) (string, error) {
+	if t.key == nil {
+		return "", errors.New("token exchange is not configured")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(token, models.ExchangedTokenPrefix), ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(t.sign(parts[0]))) {
+		return "", errors.New("Invalid exchanged token")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", errors.New("Invalid exchanged token")
+	}
+
+	var claims exchangedTokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return "", errors.New("Invalid exchanged token")
+	}
+
+	if !now.Before(time.Unix(claims.Expiry, 0)) {
+		return "", errors.New("Exchanged token has expired")
+	}
+
+	return claims.ServiceAccount, nil
+}
+
+func (t ExchangedTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// stsHost matches the global and regional STS endpoints. We only send identity
+// requests to STS, so that they can't be used to make the server send signed
+// requests elsewhere.
+var stsHost = regexp.MustCompile(`^sts(\.[a-z0-9-]+)?\.amazonaws\.com$`)
+
+// assumedRoleARN matches the ARN of an assumed role's session, capturing the
+// account and the role's name
+var assumedRoleARN = regexp.MustCompile(`^arn:aws:sts::(\d+):assumed-role/([^/]+)/.+$`)
+
+// AWSVerifier verifies AWS identities by sending the signed
+// sts:GetCallerIdentity request that they're exchanged with to STS
+type AWSVerifier struct {
+	// Audience, if set, must be the value of the request's signed
+	// Draupnir-Server-ID header
+	Audience string
+	Client   *http.Client
+}
+
+type getCallerIdentityResponse struct {
+	ARN string `xml:"GetCallerIdentityResult>Arn"`
+}
+
+// Verify returns the ARN of the identity that signed the request. The ARN of an
+// assumed role's session is returned as the ARN of the role, as sessions'
+// names are chosen by whoever assumes the role.
+func (v AWSVerifier) Verify(ctx context.Context, token string) (string, error) {
+	identityRequest, err := models.DecodeAWSIdentityRequest(token)
+	if err != nil {
+		return "", err
+	}
+
+	if err := v.check(identityRequest); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(identityRequest.Method, identityRequest.URL, strings.NewReader(identityRequest.Body))
+	if err != nil {
+		return "", err
+	}
+	for name, values := range identityRequest.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("Error sending identity request to STS: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// STS returns 403 if the signature is invalid or has expired
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("STS rejected identity request (%d): %s", resp.StatusCode, body)
+	}
+
+	var identity getCallerIdentityResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&identity); err != nil {
+		return "", fmt.Errorf("Error parsing STS response: %s", err.Error())
+	}
+	if identity.ARN == "" {
+		return "", errors.New("STS response has no ARN")
+	}
+
+	if match := assumedRoleARN.FindStringSubmatch(identity.ARN); match != nil {
+		return fmt.Sprintf("arn:aws:iam::%s:role/%s", match[1], match[2]), nil
+	}
+	return identity.ARN, nil
+}
+
+// check ensures that the request is a GetCallerIdentity request to STS, signed
+// for this server
+func (v AWSVerifier) check(r models.AWSIdentityRequest) error {
+	if r.Method != http.MethodPost {
+		return errors.New("AWS identity request must be a POST")
+	}
+
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return fmt.Errorf("invalid AWS identity request URL: %s", err)
+	}
+	if u.Scheme != "https" || !stsHost.MatchString(u.Host) || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return fmt.Errorf("AWS identity request must be sent to STS, not %s", r.URL)
+	}
+
+	form, err := url.ParseQuery(r.Body)
+	if err != nil || len(form) != 2 || form.Get("Action") != "GetCallerIdentity" || form.Get("Version") == "" {
+		return errors.New("AWS identity request must be a GetCallerIdentity request")
+	}
+
+	if v.Audience == "" {
+		return nil
+	}
+
+	// The headers' names aren't necessarily canonical
+	header := http.Header{}
+	for name, values := range r.Headers {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+	if header.Get(models.AWSServerIDHeader) != v.Audience {
+		return fmt.Errorf("AWS identity request must have a %s header of %s", models.AWSServerIDHeader, v.Audience)
+	}
+	if !signedHeaders(header.Get("Authorization"))[strings.ToLower(models.AWSServerIDHeader)] {
+		return fmt.Errorf("AWS identity request's %s header must be signed", models.AWSServerIDHeader)
+	}
+
+	return nil
+}
+
+// signedHeaders returns the headers that a SigV4 Authorization header lists as
+// signed, in lower case
+func signedHeaders(authorization string) map[string]bool {
+	signed := map[string]bool{}
+
+	for _, part := range strings.Split(authorization, ",") {
+		part = strings.TrimSpace(part)
+		if i := strings.Index(part, "SignedHeaders="); i >= 0 {
+			for _, name := range strings.Split(part[i+len("SignedHeaders="):], ";") {
+				signed[strings.ToLower(name)] = true
+			}
+		}
+	}
+
+	return signed
+}
+
+// GCPVerifier verifies the ID tokens of GCP service accounts through Google's
+// tokeninfo endpoint, returning the service account's email address
+type GCPVerifier struct {
+	// Audience must be the audience that the ID token was issued for, so that
+	// tokens issued for other services aren't accepted
+	Audience string
+	Client   *http.Client
+	// BasePath overrides the URL of Google's OAuth API, for tests
+	BasePath string
+}
+
+func (v GCPVerifier) Verify(ctx context.Context, token string) (string, error) {
+	if v.Audience == "" {
+		return "", errors.New("GCP identities can't be verified without an audience")
+	}
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	service, err := google.New(client)
+	if err != nil {
+		return "", fmt.Errorf("Error initialising google oauth client: %s", err.Error())
+	}
+	if v.BasePath != "" {
+		service.BasePath = v.BasePath
+	}
+
+	tokenInfo, err := service.Tokeninfo().IdToken(token).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("Error getting info from Google: %s", err.Error())
+	}
+
+	if tokenInfo.Audience != v.Audience {
+		return "", fmt.Errorf("ID token was issued for %s rather than %s", tokenInfo.Audience, v.Audience)
+	}
+	if tokenInfo.Email == "" || !tokenInfo.VerifiedEmail {
+		return "", errors.New("ID token has no verified email address")
+	}
+
+	return tokenInfo.Email, nil
+}
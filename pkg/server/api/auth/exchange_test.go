@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestExchangedTokens(t *testing.T) {
+	tokens := NewExchangedTokens("shared-secret")
+	now := time.Now()
+
+	token, err := tokens.Issue("image-builder", now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Regexp(t, "^"+models.ExchangedTokenPrefix, token)
+
+	name, err := tokens.Verify(token, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "image-builder", name)
+
+	_, err = tokens.Verify(token, now.Add(time.Hour))
+	assert.EqualError(t, err, "Exchanged token has expired")
+
+	_, err = NewExchangedTokens("other-secret").Verify(token, now)
+	assert.EqualError(t, err, "Invalid exchanged token")
+
+	_, err = tokens.Verify(token+"x", now)
+	assert.EqualError(t, err, "Invalid exchanged token")
+
+	_, err = ExchangedTokens{}.Verify(token, now)
+	assert.EqualError(t, err, "token exchange is not configured")
+}
+
+func TestAuthenticateExchangedToken(t *testing.T) {
+	authenticator := GoogleAuthenticator{
+		OAuthClient:     fakeOAuthClient{},
+		SharedSecret:    "shared-secret",
+		ExchangedTokens: NewExchangedTokens("shared-secret"),
+	}
+
+	token, err := authenticator.ExchangedTokens.Issue("image-builder", time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, "/images", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	email, refreshToken, err := authenticator.AuthenticateRequest(req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "service-account:image-builder", email)
+	assert.Equal(t, "", refreshToken)
+}
+
+// stsTransport sends every request to the test server, wherever it's addressed
+type stsTransport struct {
+	server   *httptest.Server
+	requests []*http.Request
+}
+
+func (t *stsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req)
+	target, _ := url.Parse(t.server.URL)
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func awsIdentityToken(t *testing.T, modify func(*models.AWSIdentityRequest)) string {
+	request := models.AWSIdentityRequest{
+		Method: "POST",
+		URL:    "https://sts.amazonaws.com/",
+		Headers: map[string][]string{
+			"Authorization":          {"AWS4-HMAC-SHA256 Credential=AKIA/20261015/us-east-1/sts/aws4_request, SignedHeaders=content-type;draupnir-server-id;host;x-amz-date, Signature=abc"},
+			"Content-Type":           {"application/x-www-form-urlencoded; charset=utf-8"},
+			models.AWSServerIDHeader: {"draupnir.example.com"},
+		},
+		Body: "Action=GetCallerIdentity&Version=2011-06-15",
+	}
+	if modify != nil {
+		modify(&request)
+	}
+
+	token, err := request.Encode()
+	assert.Nil(t, err)
+	return token
+}
+
+func TestAWSVerifier(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		body = string(data)
+		fmt.Fprint(w, `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>arn:aws:sts::123456789012:assumed-role/ci/i-0abc</Arn>
+    <UserId>AROA:i-0abc</UserId>
+    <Account>123456789012</Account>
+  </GetCallerIdentityResult>
+</GetCallerIdentityResponse>`)
+	}))
+	defer server.Close()
+
+	transport := &stsTransport{server: server}
+	verifier := AWSVerifier{
+		Audience: "draupnir.example.com",
+		Client:   &http.Client{Transport: transport},
+	}
+
+	principal, err := verifier.Verify(context.Background(), awsIdentityToken(t, nil))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/ci", principal)
+	assert.Equal(t, "Action=GetCallerIdentity&Version=2011-06-15", body)
+	assert.Equal(t, 1, len(transport.requests))
+	assert.Equal(t, "sts.amazonaws.com", transport.requests[0].Host)
+	assert.Equal(t, "draupnir.example.com", transport.requests[0].Header.Get(models.AWSServerIDHeader))
+}
+
+func TestAWSVerifierWhenSTSRejectsRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "SignatureDoesNotMatch")
+	}))
+	defer server.Close()
+
+	verifier := AWSVerifier{Client: &http.Client{Transport: &stsTransport{server: server}}}
+
+	_, err := verifier.Verify(context.Background(), awsIdentityToken(t, nil))
+
+	assert.EqualError(t, err, "STS rejected identity request (403): SignatureDoesNotMatch")
+}
+
+func TestAWSVerifierRejectsRequests(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(*models.AWSIdentityRequest)
+		error  string
+	}{
+		{
+			name:   "not STS",
+			modify: func(r *models.AWSIdentityRequest) { r.URL = "https://169.254.169.254/" },
+			error:  "AWS identity request must be sent to STS, not https://169.254.169.254/",
+		},
+		{
+			name:   "STS lookalike",
+			modify: func(r *models.AWSIdentityRequest) { r.URL = "https://sts.amazonaws.com.example.com/" },
+			error:  "AWS identity request must be sent to STS, not https://sts.amazonaws.com.example.com/",
+		},
+		{
+			name:   "plain HTTP",
+			modify: func(r *models.AWSIdentityRequest) { r.URL = "http://sts.eu-west-1.amazonaws.com/" },
+			error:  "AWS identity request must be sent to STS, not http://sts.eu-west-1.amazonaws.com/",
+		},
+		{
+			name:   "other action",
+			modify: func(r *models.AWSIdentityRequest) { r.Body = "Action=AssumeRole&Version=2011-06-15" },
+			error:  "AWS identity request must be a GetCallerIdentity request",
+		},
+		{
+			name:   "GET",
+			modify: func(r *models.AWSIdentityRequest) { r.Method = "GET" },
+			error:  "AWS identity request must be a POST",
+		},
+		{
+			name: "other audience",
+			modify: func(r *models.AWSIdentityRequest) {
+				r.Headers[models.AWSServerIDHeader] = []string{"vault.example.com"}
+			},
+			error: "AWS identity request must have a Draupnir-Server-ID header of draupnir.example.com",
+		},
+		{
+			name: "unsigned audience",
+			modify: func(r *models.AWSIdentityRequest) {
+				r.Headers["Authorization"] = []string{"AWS4-HMAC-SHA256 Credential=AKIA/20261015/us-east-1/sts/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=abc"}
+			},
+			error: "AWS identity request's Draupnir-Server-ID header must be signed",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			verifier := AWSVerifier{
+				Audience: "draupnir.example.com",
+				Client: &http.Client{Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+					t.Fatal("request was sent to STS")
+					return nil, nil
+				})},
+			}
+
+			_, err := verifier.Verify(context.Background(), awsIdentityToken(t, tc.modify))
+			assert.EqualError(t, err, tc.error)
+		})
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestGCPVerifier(t *testing.T) {
+	var idToken string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idToken = r.URL.Query().Get("id_token")
+		fmt.Fprint(w, `{
+			"audience": "https://draupnir.example.com",
+			"email": "ci@project.iam.gserviceaccount.com",
+			"verified_email": true,
+			"expires_in": 3000
+		}`)
+	}))
+	defer server.Close()
+
+	verifier := GCPVerifier{Audience: "https://draupnir.example.com", BasePath: server.URL + "/"}
+	principal, err := verifier.Verify(context.Background(), "the-id-token")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "ci@project.iam.gserviceaccount.com", principal)
+	assert.Equal(t, "the-id-token", idToken)
+
+	verifier.Audience = "https://other.example.com"
+	_, err = verifier.Verify(context.Background(), "the-id-token")
+	assert.EqualError(t, err, "ID token was issued for https://draupnir.example.com rather than https://other.example.com")
+}
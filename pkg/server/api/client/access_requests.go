@@ -0,0 +1,123 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+)
+
+// CreateAccessRequest requests access to a restricted image family for the
+// authenticated user, for validFor once it's approved, or the server's default
+// if it's zero. The reason is required.
+func (c Client) CreateAccessRequest(family, reason string, validFor time.Duration) (models.AccessRequest, error) {
+	var request models.AccessRequest
+	if err := c.negotiation.unsupported(models.FeatureAccessRequests); err != nil {
+		return request, err
+	}
+
+	body := routes.CreateAccessRequestRequest{
+		Family: family,
+		Reason: reason,
+	}
+	if validFor > 0 {
+		body.ValidFor = validFor.String()
+	}
+
+	var payload bytes.Buffer
+	err := c.marshal(&payload, &body)
+	if err != nil {
+		return request, err
+	}
+
+	resp, err := c.post("/access_requests", &payload)
+	if err != nil {
+		return request, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return request, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &request)
+	return request, err
+}
+
+// ListAccessRequests returns the access requests that the user can see, newest
+// first: their own, and those that they can approve
+func (c Client) ListAccessRequests() ([]models.AccessRequest, error) {
+	var requests []models.AccessRequest
+	if err := c.negotiation.unsupported(models.FeatureAccessRequests); err != nil {
+		return requests, err
+	}
+
+	body, err := c.getBody("/access_requests")
+	if err != nil {
+		return requests, err
+	}
+
+	maybeRequests, err := c.unmarshalMany(bytes.NewReader(body), reflect.TypeOf(requests))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []AccessRequest
+	requests = make([]models.AccessRequest, 0)
+	for _, request := range maybeRequests {
+		r := request.(*models.AccessRequest)
+		requests = append(requests, *r)
+	}
+
+	return requests, nil
+}
+
+// GetAccessRequest returns an access request that the user can see
+func (c Client) GetAccessRequest(id int) (models.AccessRequest, error) {
+	var request models.AccessRequest
+	if err := c.negotiation.unsupported(models.FeatureAccessRequests); err != nil {
+		return request, err
+	}
+
+	body, err := c.getBody(fmt.Sprintf("/access_requests/%d", id))
+	if err != nil {
+		return request, err
+	}
+
+	err = c.unmarshal(bytes.NewReader(body), &request)
+	return request, err
+}
+
+// ApproveAccessRequest approves a pending access request. Only the family's
+// approvers, and admins, can approve requests, and never their own.
+func (c Client) ApproveAccessRequest(id int) (models.AccessRequest, error) {
+	return c.decideAccessRequest(id, "approve")
+}
+
+// DenyAccessRequest denies a pending access request. Only the family's
+// approvers, and admins, can deny requests.
+func (c Client) DenyAccessRequest(id int) (models.AccessRequest, error) {
+	return c.decideAccessRequest(id, "deny")
+}
+
+func (c Client) decideAccessRequest(id int, decision string) (models.AccessRequest, error) {
+	var request models.AccessRequest
+	if err := c.negotiation.unsupported(models.FeatureAccessRequests); err != nil {
+		return request, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("/access_requests/%d/%s", id, decision), &bytes.Buffer{})
+	if err != nil {
+		return request, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return request, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &request)
+	return request, err
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestAccessRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /access_requests":
+			var body struct {
+				Data struct {
+					Attributes map[string]interface{} `json:"attributes"`
+				} `json:"data"`
+			}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "payments", body.Data.Attributes["family"])
+			assert.Equal(t, "INC-123", body.Data.Attributes["reason"])
+			assert.Equal(t, "2h0m0s", body.Data.Attributes["valid_for"])
+
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"data": {"type": "access_requests", "id": "1", "attributes": {
+				"user_email": "test@draupnir", "family": "payments", "reason": "INC-123", "valid_for": "2h0m0s",
+				"status": "pending", "decided_by": "", "decided_at": null, "expires_at": null, "created_at": "2026-10-15T12:00:00Z"
+			}}}`)
+		case "GET /access_requests":
+			fmt.Fprint(w, `{"data": [{"type": "access_requests", "id": "1", "attributes": {
+				"user_email": "test@draupnir", "family": "payments", "reason": "INC-123", "valid_for": "2h0m0s", "status": "pending"
+			}}]}`)
+		case "GET /access_requests/1":
+			fmt.Fprint(w, `{"data": {"type": "access_requests", "id": "1", "attributes": {
+				"user_email": "test@draupnir", "family": "payments", "reason": "INC-123", "valid_for": "2h0m0s", "status": "pending"
+			}}}`)
+		case "POST /access_requests/1/approve":
+			fmt.Fprint(w, `{"data": {"type": "access_requests", "id": "1", "attributes": {
+				"user_email": "test@draupnir", "family": "payments", "reason": "INC-123", "valid_for": "2h0m0s",
+				"status": "approved", "decided_by": "approver@draupnir", "decided_at": "2026-10-15T12:30:00Z",
+				"expires_at": "2026-10-15T14:30:00Z"
+			}}}`)
+		case "POST /access_requests/2/deny":
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"id": "conflict", "code": "conflict", "status": "409", "title": "Access Request Decided",
+				"detail": "The access request has already been approved or denied"}`)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries), WithStrictValidation())
+
+	request, err := client.CreateAccessRequest("payments", "INC-123", 2*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, request.ID)
+	assert.Equal(t, models.AccessRequestPending, request.Status)
+
+	requests, err := client.ListAccessRequests()
+	assert.Nil(t, err)
+	if assert.Len(t, requests, 1) {
+		assert.Equal(t, "payments", requests[0].Family)
+	}
+
+	request, err = client.GetAccessRequest(1)
+	assert.Nil(t, err)
+	assert.Equal(t, "INC-123", request.Reason)
+
+	approved, err := client.ApproveAccessRequest(1)
+	assert.Nil(t, err)
+	assert.Equal(t, models.AccessRequestApproved, approved.Status)
+	assert.Equal(t, "approver@draupnir", approved.DecidedBy)
+	if assert.NotNil(t, approved.ExpiresAt) {
+		assert.Equal(t, time.Date(2026, 10, 15, 14, 30, 0, 0, time.UTC), approved.ExpiresAt.UTC())
+	}
+
+	_, err = client.DenyAccessRequest(2)
+	assert.EqualError(t, err, "Access Request Decided (The access request has already been approved or denied)")
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+)
+
+// CreateBreakGlassGrant grants the user access to the upload of an image that
+// hasn't been finalised, for validFor, or the server's default if it's zero.
+// Only the upload user can grant access, and the reason is required.
+func (c Client) CreateBreakGlassGrant(userEmail string, imageID int, reason string, validFor time.Duration) (models.BreakGlassGrant, error) {
+	var grant models.BreakGlassGrant
+	if err := c.negotiation.unsupported(models.FeatureBreakGlass); err != nil {
+		return grant, err
+	}
+
+	request := routes.CreateBreakGlassGrantRequest{
+		UserEmail: userEmail,
+		ImageID:   imageID,
+		Reason:    reason,
+	}
+	if validFor > 0 {
+		request.ValidFor = validFor.String()
+	}
+
+	var payload bytes.Buffer
+	err := c.marshal(&payload, &request)
+	if err != nil {
+		return grant, err
+	}
+
+	resp, err := c.post("/admin/break_glass_grants", &payload)
+	if err != nil {
+		return grant, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return grant, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &grant)
+	return grant, err
+}
+
+// ListBreakGlassGrants returns every break-glass grant, newest first, including
+// those that have been revoked or have expired. Only the upload user can list
+// them.
+func (c Client) ListBreakGlassGrants() ([]models.BreakGlassGrant, error) {
+	var grants []models.BreakGlassGrant
+	if err := c.negotiation.unsupported(models.FeatureBreakGlass); err != nil {
+		return grants, err
+	}
+
+	body, err := c.getBody("/admin/break_glass_grants")
+	if err != nil {
+		return grants, err
+	}
+
+	maybeGrants, err := c.unmarshalMany(bytes.NewReader(body), reflect.TypeOf(grants))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []BreakGlassGrant
+	grants = make([]models.BreakGlassGrant, 0)
+	for _, grant := range maybeGrants {
+		g := grant.(*models.BreakGlassGrant)
+		grants = append(grants, *g)
+	}
+
+	return grants, nil
+}
+
+// RevokeBreakGlassGrant revokes a break-glass grant before it expires, and
+// returns it. Only the upload user can revoke grants.
+func (c Client) RevokeBreakGlassGrant(id int) (models.BreakGlassGrant, error) {
+	var grant models.BreakGlassGrant
+	if err := c.negotiation.unsupported(models.FeatureBreakGlass); err != nil {
+		return grant, err
+	}
+
+	resp, err := c.delete(fmt.Sprintf("/admin/break_glass_grants/%d", id))
+	if err != nil {
+		return grant, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return grant, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &grant)
+	return grant, err
+}
+
+// GetImageUploadFile returns a file from the upload of an image that hasn't
+// been finalised, by its path relative to the root of the upload, e.g.
+// "global/pg_control". The user must have an active break-glass grant for the
+// image.
+func (c Client) GetImageUploadFile(imageID int, path string) (models.ImageFile, error) {
+	var file models.ImageFile
+	if err := c.negotiation.unsupported(models.FeatureBreakGlass); err != nil {
+		return file, err
+	}
+
+	// Each segment is escaped on its own, as the slashes between them are part
+	// of the route
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+
+	body, err := c.getBody(fmt.Sprintf("/images/%d/upload/files/%s", imageID, strings.Join(segments, "/")))
+	if err != nil {
+		return file, err
+	}
+
+	err = c.unmarshal(bytes.NewReader(body), &file)
+	return file, err
+}
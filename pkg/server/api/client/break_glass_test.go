@@ -0,0 +1,79 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakGlassGrants(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /admin/break_glass_grants":
+			var body struct {
+				Data struct {
+					Attributes map[string]interface{} `json:"attributes"`
+				} `json:"data"`
+			}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "test@draupnir", body.Data.Attributes["user_email"])
+			assert.Equal(t, float64(3), body.Data.Attributes["image_id"])
+			assert.Equal(t, "INC-123", body.Data.Attributes["reason"])
+			assert.Equal(t, "2h0m0s", body.Data.Attributes["valid_for"])
+
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"data": {"type": "break_glass_grants", "id": "1", "attributes": {
+				"user_email": "test@draupnir", "image_id": 3, "reason": "INC-123", "granted_by": "upload",
+				"created_at": "2026-10-15T12:00:00Z", "expires_at": "2026-10-15T14:00:00Z", "revoked_at": null, "revoked_by": ""
+			}}}`)
+		case "GET /admin/break_glass_grants":
+			fmt.Fprint(w, `{"data": [{"type": "break_glass_grants", "id": "1", "attributes": {
+				"user_email": "test@draupnir", "image_id": 3, "reason": "INC-123", "expires_at": "2026-10-15T14:00:00Z"
+			}}]}`)
+		case "DELETE /admin/break_glass_grants/1":
+			fmt.Fprint(w, `{"data": {"type": "break_glass_grants", "id": "1", "attributes": {
+				"user_email": "test@draupnir", "image_id": 3, "reason": "INC-123", "expires_at": "2026-10-15T14:00:00Z",
+				"revoked_at": "2026-10-15T13:00:00Z", "revoked_by": "upload"
+			}}}`)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries), WithStrictValidation())
+
+	grant, err := client.CreateBreakGlassGrant("test@draupnir", 3, "INC-123", 2*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, grant.ID)
+	assert.Equal(t, "upload", grant.GrantedBy)
+
+	grants, err := client.ListBreakGlassGrants()
+	assert.Nil(t, err)
+	if assert.Len(t, grants, 1) {
+		assert.Equal(t, "INC-123", grants[0].Reason)
+	}
+
+	revoked, err := client.RevokeBreakGlassGrant(1)
+	assert.Nil(t, err)
+	if assert.NotNil(t, revoked.RevokedAt) {
+		assert.Equal(t, time.Date(2026, 10, 15, 13, 0, 0, 0, time.UTC), revoked.RevokedAt.UTC())
+	}
+}
+
+func TestGetImageUploadFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/images/3/upload/files/base/1/file%20name", r.URL.EscapedPath())
+		fmt.Fprint(w, `{"data": {"type": "image_files", "id": "base/1/file name", "attributes": {"image_id": 3, "content": "data", "truncated": false}}}`)
+	}))
+	defer server.Close()
+
+	file, err := NewClient(server.URL).GetImageUploadFile(3, "base/1/file name")
+	assert.Nil(t, err)
+	assert.Equal(t, "data", file.Content)
+}
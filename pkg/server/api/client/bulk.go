@@ -0,0 +1,314 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// bulkConcurrency is how many requests bulk operations make at once, unless
+// configured otherwise. It's bounded so that cleaning up after a load test
+// doesn't overwhelm the server.
+const bulkConcurrency = 8
+
+// bulkRateLimitAttempts is how many times bulk operations try each instance
+// while the server is rate limiting them
+const bulkRateLimitAttempts = 5
+
+// bulkRateLimitBackoff is how long bulk operations pause for when the server
+// rate limits them without saying how long to wait
+var bulkRateLimitBackoff = time.Second
+
+// BulkOption configures a bulk operation, such as DestroyInstances
+type BulkOption func(*bulkOptions)
+
+type bulkOptions struct {
+	concurrency int
+	progress    func(BulkProgress)
+}
+
+// WithBulkConcurrency sets how many requests the bulk operation makes at once
+func WithBulkConcurrency(concurrency int) BulkOption {
+	return func(o *bulkOptions) {
+		if concurrency > 0 {
+			o.concurrency = concurrency
+		}
+	}
+}
+
+// WithBulkProgress calls progress as each instance succeeds or fails. Calls are
+// never concurrent, so progress doesn't need to be safe for concurrent use, but
+// the bulk operation waits for each call to return.
+func WithBulkProgress(progress func(BulkProgress)) BulkOption {
+	return func(o *bulkOptions) {
+		o.progress = progress
+	}
+}
+
+// BulkProgressOf returns the callback set by WithBulkProgress, if any, so that
+// other implementations of DraupnirClient can report progress too
+func BulkProgressOf(opts []BulkOption) func(BulkProgress) {
+	var options bulkOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options.progress
+}
+
+// BulkProgress reports that a bulk operation has finished with an instance
+type BulkProgress struct {
+	ID int
+	// Err is why the instance failed, or nil if it succeeded
+	Err error
+	// Completed is how many instances have finished, including this one, out of
+	// Total
+	Completed int
+	Total     int
+}
+
+// BulkError records each instance that a bulk operation failed for, along with
+// why
+type BulkError struct {
+	// Operation is what was being done to the instances, e.g. "destroy"
+	Operation string
+	Errors    map[int]error
+}
+
+func (e *BulkError) Error() string {
+	ids := make([]int, 0, len(e.Errors))
+	for id := range e.Errors {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	failures := make([]string, 0, len(ids))
+	for _, id := range ids {
+		failures = append(failures, fmt.Sprintf("%d: %s", id, e.Errors[id]))
+	}
+
+	return fmt.Sprintf("failed to %s %d instance(s): %s", e.Operation, len(ids), strings.Join(failures, "; "))
+}
+
+// BulkDestroyError is returned by DestroyInstances. Its Operation is "destroy".
+type BulkDestroyError = BulkError
+
+// backpressure pauses every worker of a bulk operation while the server is
+// rate limiting it, rather than each of them discovering that separately
+type backpressure struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// pause holds back requests for the given duration, unless they're already held
+// back for longer
+func (b *backpressure) pause(wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if until := time.Now().Add(wait); until.After(b.until) {
+		b.until = until
+	}
+}
+
+// wait returns once requests are no longer held back, or the context is done
+func (b *backpressure) wait(ctx context.Context) error {
+	b.mu.Lock()
+	wait := time.Until(b.until)
+	b.mu.Unlock()
+
+	if wait <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// bulk calls fn for each of the instances, making several calls at once.
+// Every instance is attempted even if some fail. If the server rate limits a
+// call, every worker pauses for as long as the server asks before the call is
+// retried.
+//
+// If the context is cancelled, the instances that haven't been attempted yet
+// fail with the context's error.
+func (c Client) bulk(ctx context.Context, operation string, ids []int, opts []BulkOption, fn func(context.Context, int) error) error {
+	options := bulkOptions{concurrency: bulkConcurrency}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	var mu sync.Mutex
+	failures := map[int]error{}
+	completed := 0
+
+	finish := func(id int, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err != nil {
+			failures[id] = err
+		}
+		completed++
+		if options.progress != nil {
+			options.progress(BulkProgress{ID: id, Err: err, Completed: completed, Total: len(ids)})
+		}
+	}
+
+	var pressure backpressure
+	attempt := func(id int) error {
+		for attempts := 1; ; attempts++ {
+			if err := pressure.wait(ctx); err != nil {
+				return err
+			}
+
+			err := fn(ctx, id)
+			rateLimited, ok := err.(*ErrRateLimited)
+			if !ok || attempts >= bulkRateLimitAttempts {
+				return err
+			}
+
+			wait := rateLimited.RetryAfter
+			if wait <= 0 {
+				wait = bulkRateLimitBackoff
+			}
+			pressure.pause(wait)
+		}
+	}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < options.concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range queue {
+				finish(id, attempt(id))
+			}
+		}()
+	}
+
+	for _, id := range ids {
+		queue <- id
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(failures) > 0 {
+		return &BulkError{Operation: operation, Errors: failures}
+	}
+	return nil
+}
+
+// DestroyInstances destroys each of the instances, making several requests at
+// once. Instances that have already been destroyed are skipped. Every instance
+// is attempted even if some fail, in which case a *BulkDestroyError is
+// returned. If the server rate limits the requests, they're paused for as long
+// as it asks.
+//
+// If the context is cancelled, the instances that haven't been destroyed yet
+// fail with the context's error.
+func (c Client) DestroyInstances(ctx context.Context, ids []int, opts ...BulkOption) error {
+	return c.bulk(ctx, "destroy", ids, opts, c.destroyInstance)
+}
+
+// DestroyAllMyInstances destroys every instance belonging to the
+// authenticated user, in the same way as DestroyInstances
+func (c Client) DestroyAllMyInstances(ctx context.Context, opts ...BulkOption) error {
+	var ids []int
+
+	// The server only lists the user's own instances
+	iter := c.InstancesIterator(100)
+	for iter.Next() {
+		ids = append(ids, iter.Instance().ID)
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	return c.DestroyInstances(ctx, ids, opts...)
+}
+
+// RefreshInstances gets the current state of each of the instances, including
+// their credentials, in the same way as DestroyInstances. The instances are
+// returned in the order given, without those that failed, which are recorded
+// in a *BulkError.
+func (c Client) RefreshInstances(ctx context.Context, ids []int, opts ...BulkOption) ([]models.Instance, error) {
+	var mu sync.Mutex
+	refreshed := make(map[int]models.Instance, len(ids))
+
+	err := c.bulk(ctx, "refresh", ids, opts, func(ctx context.Context, id int) error {
+		instance, err := c.getInstance(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		refreshed[id] = instance
+		mu.Unlock()
+		return nil
+	})
+
+	instances := make([]models.Instance, 0, len(refreshed))
+	for _, id := range ids {
+		if instance, ok := refreshed[id]; ok {
+			instances = append(instances, instance)
+		}
+	}
+
+	return instances, err
+}
+
+// getInstance is GetInstance, cancelled with the context
+func (c Client) getInstance(ctx context.Context, id int) (models.Instance, error) {
+	var instance models.Instance
+	body, err := c.getBodyContext(ctx, fmt.Sprintf("/instances/%d", id))
+	if err != nil {
+		return instance, err
+	}
+
+	err = c.unmarshal(bytes.NewReader(body), &instance)
+	return instance, err
+}
+
+// destroyInstance destroys a single instance, treating one that has already
+// been destroyed as a success
+func (c Client) destroyInstance(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("%s/instances/%d", c.url, id), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotFound:
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	default:
+		return parseError(resp.Body)
+	}
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// destroyServer serves instance destroys, recording the ID of each instance
+// destroyed. Instance 404 has already been destroyed, and instance 500 fails.
+func destroyServer(t *testing.T, destroyed *[]string) *httptest.Server {
+	var mu sync.Mutex
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodDelete, r.Method)
+		id := strings.TrimPrefix(r.URL.Path, "/instances/")
+
+		switch id {
+		case "404":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"title": "Resource Not Found", "detail": "Not here"}`)
+		case "500":
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"title": "Internal Server Error", "detail": "Oops"}`)
+		default:
+			mu.Lock()
+			*destroyed = append(*destroyed, id)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func TestDestroyInstances(t *testing.T) {
+	var destroyed []string
+	server := destroyServer(t, &destroyed)
+
+	var ids []int
+	for id := 1; id <= 20; id++ {
+		ids = append(ids, id)
+	}
+	ids = append(ids, 404)
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	err := client.DestroyInstances(context.Background(), ids)
+	server.Close()
+
+	assert.Nil(t, err)
+	assert.Len(t, destroyed, 20)
+}
+
+func TestDestroyInstancesWithFailures(t *testing.T) {
+	var destroyed []string
+	server := destroyServer(t, &destroyed)
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	err := client.DestroyInstances(context.Background(), []int{1, 500, 2})
+	server.Close()
+
+	sort.Strings(destroyed)
+	assert.Equal(t, []string{"1", "2"}, destroyed)
+	assert.EqualError(t, err, "failed to destroy 1 instance(s): 500: Internal Server Error (Oops)")
+
+	bulkErr, ok := err.(*BulkDestroyError)
+	assert.True(t, ok)
+	assert.Contains(t, bulkErr.Errors, 500)
+}
+
+func TestDestroyInstancesWhenCancelled(t *testing.T) {
+	var destroyed []string
+	server := destroyServer(t, &destroyed)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	err := client.DestroyInstances(ctx, []int{1, 2})
+
+	assert.Empty(t, destroyed)
+	assert.EqualError(t, err, "failed to destroy 2 instance(s): 1: context canceled; 2: context canceled")
+}
+
+func TestDestroyInstancesReportsProgress(t *testing.T) {
+	var destroyed []string
+	server := destroyServer(t, &destroyed)
+
+	var progress []BulkProgress
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	err := client.DestroyInstances(
+		context.Background(), []int{1, 500, 2},
+		WithBulkConcurrency(1),
+		WithBulkProgress(func(p BulkProgress) { progress = append(progress, p) }),
+	)
+	server.Close()
+
+	assert.NotNil(t, err)
+	assert.Len(t, progress, 3)
+	for i, p := range progress {
+		assert.Equal(t, i+1, p.Completed)
+		assert.Equal(t, 3, p.Total)
+	}
+	assert.Equal(t, 500, progress[1].ID)
+	assert.EqualError(t, progress[1].Err, "Internal Server Error (Oops)")
+	assert.Nil(t, progress[2].Err)
+}
+
+func TestDestroyInstancesWhenRateLimited(t *testing.T) {
+	defer func(backoff time.Duration) { bulkRateLimitBackoff = backoff }(bulkRateLimitBackoff)
+	bulkRateLimitBackoff = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	var limited bool
+	var destroyed []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// The first request is rate limited, without saying for how long
+		if !limited {
+			limited = true
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		destroyed = append(destroyed, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	err := client.DestroyInstances(context.Background(), []int{1, 2, 3})
+	server.Close()
+
+	sort.Strings(destroyed)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/instances/1", "/instances/2", "/instances/3"}, destroyed)
+}
+
+func TestDestroyInstancesWhenAlwaysRateLimited(t *testing.T) {
+	defer func(backoff time.Duration) { bulkRateLimitBackoff = backoff }(bulkRateLimitBackoff)
+	bulkRateLimitBackoff = time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	err := client.DestroyInstances(context.Background(), []int{1})
+
+	assert.EqualError(t, err, "failed to destroy 1 instance(s): 1: rate limited by the server")
+}
+
+func TestRefreshInstances(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		id := strings.TrimPrefix(r.URL.Path, "/instances/")
+
+		if id == "404" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"title": "Resource Not Found", "detail": "Not here"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"data": {"type": "instances", "id": "%s", "attributes": {"port": 5432}}}`, id)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	instances, err := client.RefreshInstances(context.Background(), []int{3, 404, 1})
+
+	assert.EqualError(t, err, "failed to refresh 1 instance(s): 404: Resource Not Found (Not here)")
+	assert.Len(t, instances, 2)
+	assert.Equal(t, 3, instances[0].ID)
+	assert.Equal(t, 1, instances[1].ID)
+	assert.Equal(t, uint16(5432), instances[1].Port)
+}
+
+func TestDestroyAllMyInstances(t *testing.T) {
+	var mu sync.Mutex
+	var destroyed []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			assert.Equal(t, "/instances", r.URL.Path)
+			fmt.Fprint(w, `{"data": [{"type": "instances", "id": "3", "attributes": {}}, {"type": "instances", "id": "7", "attributes": {}}]}`)
+			return
+		}
+
+		mu.Lock()
+		destroyed = append(destroyed, r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	err := client.DestroyAllMyInstances(context.Background())
+	server.Close()
+
+	sort.Strings(destroyed)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/instances/3", "/instances/7"}, destroyed)
+}
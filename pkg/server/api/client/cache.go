@@ -0,0 +1,65 @@
+package client
+
+import "sync"
+
+// responseCache stores the bodies of responses that have an ETag, by path, so
+// that they can be revalidated with If-None-Match rather than downloaded again.
+// Its methods do nothing on a nil cache, so that callers needn't check whether
+// caching is enabled.
+type responseCache struct {
+	mu        sync.Mutex
+	responses map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	etag string
+	// link is the response's Link header, which holds the pagination links of
+	// plain JSON lists
+	link string
+	body []byte
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{responses: map[string]cachedResponse{}}
+}
+
+func (c *responseCache) get(path string) (cachedResponse, bool) {
+	if c == nil {
+		return cachedResponse{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	response, ok := c.responses[path]
+	return response, ok
+}
+
+// put caches the body, or removes any cached body if there's no ETag to
+// revalidate it with
+func (c *responseCache) put(path, etag, link string, body []byte) {
+	if c == nil {
+		return
+	}
+
+	if etag == "" {
+		c.remove(path)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.responses[path] = cachedResponse{etag: etag, link: link, body: body}
+}
+
+func (c *responseCache) remove(path string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.responses, path)
+}
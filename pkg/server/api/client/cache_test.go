@@ -0,0 +1,83 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseCache(t *testing.T) {
+	var ifNoneMatch []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, `{"data": [{"type": "images", "id": "1", "attributes": {"ready": true}}]}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithResponseCache(), WithRetryPolicy(NoRetries))
+
+	for i := 0; i < 2; i++ {
+		images, err := client.ListImages(ListOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(images))
+		assert.Equal(t, 1, images[0].ID)
+	}
+
+	assert.Equal(t, []string{"", `"v1"`}, ifNoneMatch)
+}
+
+func TestResponseCacheIsRemovedOnError(t *testing.T) {
+	status := http.StatusOK
+	var ifNoneMatch []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			fmt.Fprint(w, `{"data": {"type": "instances", "id": "1", "attributes": {}}}`)
+		} else {
+			fmt.Fprint(w, `{"title": "Resource Not Found", "detail": "Not here"}`)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithResponseCache(), WithRetryPolicy(NoRetries))
+
+	_, err := client.GetInstance("1")
+	assert.Nil(t, err)
+
+	status = http.StatusNotFound
+	_, err = client.GetInstance("1")
+	assert.EqualError(t, err, "Resource Not Found (Not here)")
+
+	status = http.StatusOK
+	_, err = client.GetInstance("1")
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"", `"v1"`, ""}, ifNoneMatch)
+}
+
+func TestWithoutResponseCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("If-None-Match"))
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, `{"data": {"type": "images", "id": "1", "attributes": {}}}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	for i := 0; i < 2; i++ {
+		_, err := client.GetImage("1")
+		assert.Nil(t, err)
+	}
+}
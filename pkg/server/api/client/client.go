@@ -2,12 +2,15 @@ package client
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"reflect"
 	"sort"
 	"strconv"
@@ -20,7 +23,6 @@ import (
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/routes"
 	"github.com/gocardless/draupnir/pkg/version"
-	"github.com/google/jsonapi"
 )
 
 // Client represents the client for a draupnir server
@@ -29,38 +31,177 @@ type Client struct {
 	// e.g. "https://draupnir-server.my-infra.com"
 	url string
 	// OAuth Access Token
-	token  oauth2.Token
-	client *http.Client
+	token       oauth2.Token
+	client      *http.Client
+	retryPolicy RetryPolicy
+	// cache, if set, stores responses so that they can be revalidated rather
+	// than downloaded again
+	cache *responseCache
+	// negotiation records the version negotiated with the server, if any
+	negotiation *versionNegotiation
+	// protocol is the format in which resources are exchanged with the server
+	protocol Protocol
+	// strict validates responses against the schemas of the resources that
+	// they're expected to contain
+	strict bool
+	// clock records how far the server's clock is ahead of ours
+	clock *clock
 }
 
-// NewClient constructs a new draupnir client, pointing at the given endpoint
-func NewClient(url string, token oauth2.Token, insecure bool) Client {
-	client := &http.Client{}
+// NewClient constructs a new draupnir client, pointing at the given endpoint.
+// The endpoint may include a path, if the server is deployed beneath one (e.g.
+// https://infra.example.com/draupnir).
+// Unless configured otherwise, requests that fail transiently are retried
+// according to the DefaultRetryPolicy.
+//
+//	client := NewClient(url, WithToken(token), WithTimeout(30*time.Second))
+func NewClient(url string, opts ...Option) Client {
+	options := clientOptions{
+		httpClient:  &http.Client{},
+		retryPolicy: DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
 
-	if insecure {
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+	// Copy the HTTP client, so that we don't modify one given to WithHTTPClient
+	httpClient := *options.httpClient
+	httpClient.Transport = options.transport()
+	if options.timeout > 0 {
+		httpClient.Timeout = options.timeout
+	}
+
+	client := Client{
+		url:         strings.TrimSuffix(url, "/") + options.protocol.prefix(),
+		token:       options.token,
+		client:      &httpClient,
+		retryPolicy: options.retryPolicy,
+		negotiation: &versionNegotiation{},
+		protocol:    options.protocol,
+		strict:      options.strict,
+		clock:       &clock{warn: options.clockSkewWarning},
+	}
+
+	if options.cache {
+		client.cache = newResponseCache()
 	}
 
-	return Client{url, token, client}
+	return client
 }
 
-// DraupnirClient defines the API that a draupnir client conforms to
+// DraupnirClient defines the API that a draupnir client conforms to. Client
+// implements it, as does clientfakes.FakeClient, which tools built on the
+// client can use in their tests. Iterators and token sources are built on top
+// of Client itself, so aren't part of it.
 type DraupnirClient interface {
+	// Images
+	GetLatestImage() (models.Image, error)
 	GetImage(id string) (models.Image, error)
+	ListImages(opts ListOptions) ([]models.Image, error)
+	CreateImage(backedUpAt time.Time, anon []byte) (models.Image, error)
+	CreateShardedImage(backedUpAt time.Time, anon []byte, shards []string) (models.Image, error)
+	CreateImageFromBackup(backedUpAt time.Time, anon []byte, checksum, lsn string) (models.Image, error)
+	CreateImageWithOptions(request routes.CreateImageRequest) (models.Image, error)
+	UploadImage(ctx context.Context, imageID int, r io.Reader) error
+	UploadImageStream(ctx context.Context, imageID int, r io.Reader) error
+	FinaliseImage(imageID int) (models.Image, error)
+	FinaliseImageAsync(imageID int) (models.Operation, error)
+	WaitForImageReady(ctx context.Context, imageID int, pollInterval time.Duration) (models.Image, error)
+	WaitForImageFinalised(ctx context.Context, imageID int, policy WaitPolicy) (models.Image, error)
+	PublishImage(ctx context.Context, request routes.CreateImageRequest, tarball io.Reader, policy WaitPolicy) (models.Image, error)
+	VerifyImage(imageID int) (models.ImageVerification, error)
+	GetImageTimeline(imageID int) ([]models.BakeSpan, error)
+	GetImageManifest(imageID int) (models.ImageManifest, error)
+	GetImageFile(imageID int, name string) (models.ImageFile, error)
+	VerifyImageManifest(imageID int, key ed25519.PublicKey) (models.ImageManifest, error)
+	AnnotateImage(image models.Image, patch models.Annotations) (models.Image, error)
+	LabelImage(image models.Image, patch models.Labels) (models.Image, error)
+	DestroyImage(image models.Image) error
+	DestroyImageAsync(image models.Image) (models.Operation, error)
+	PruneImages(olderThan time.Duration, keepLast int, dryRun bool) ([]models.Image, error)
+	SendImage(ctx context.Context, imageID int, parentIDs []int, w io.Writer) (int, error)
+	WatchImages(ctx context.Context) (<-chan ImageEvent, error)
+	ListFreshness() ([]models.FreshnessStatus, error)
+	ListStaleImages() ([]models.StaleImage, error)
+
+	// Instances
 	GetInstance(id string) (models.Instance, error)
-	ListImages() ([]models.Image, error)
-	ListInstances() ([]models.Instance, error)
+	GetInstanceDiagnostics(id string) (models.InstanceDiagnostics, error)
+	ListInstances(opts ListOptions) ([]models.Instance, error)
+	GetInstanceSummary() ([]models.InstanceCount, error)
 	CreateInstance(image models.Image) (models.Instance, error)
+	CreateStandbyInstance(image models.Image) (models.Instance, error)
+	CreateSchemaOnlyInstance(image models.Image) (models.Instance, error)
+	PromoteInstance(instance models.Instance) (models.Instance, error)
+	ExtendInstance(instance models.Instance, by time.Duration) (models.Instance, error)
+	RunMaintenance(instance models.Instance, database, operation string, args map[string]string) (models.MaintenanceResult, error)
+	AnnotateInstance(instance models.Instance, patch models.Annotations) (models.Instance, error)
+	LabelInstance(instance models.Instance, patch models.Labels) (models.Instance, error)
 	DestroyInstance(instance models.Instance) error
-	DestroyImage(image models.Image) error
-	CreateAccessToken(string) (string, error)
+	DestroyInstanceAsync(instance models.Instance) (models.Operation, error)
+	DestroyInstances(ctx context.Context, ids []int, opts ...BulkOption) error
+	DestroyAllMyInstances(ctx context.Context, opts ...BulkOption) error
+	CreateCleanupToken(instanceIDs []int, validFor time.Duration) (models.CleanupToken, error)
+	UseCleanupToken(secret string) (models.CleanupToken, error)
+	CreateInstanceGroup(imageIDs []int, families []string) (models.InstanceGroup, error)
+	ListInstanceGroups() ([]models.InstanceGroup, error)
+	GetInstanceGroup(id int) (models.InstanceGroup, error)
+	ExtendInstanceGroup(group models.InstanceGroup, by time.Duration) (models.InstanceGroup, error)
+	DestroyInstanceGroup(group models.InstanceGroup) error
+	Search(query string, limit int) ([]models.SearchResult, error)
+	RefreshInstances(ctx context.Context, ids []int, opts ...BulkOption) ([]models.Instance, error)
+	WatchInstances(ctx context.Context) (<-chan InstanceEvent, error)
+	ProxyInstance(ctx context.Context, instanceID int) (io.ReadWriteCloser, error)
+	StreamInstanceLog(ctx context.Context, instanceID int, lines int, follow bool, w io.Writer) error
+
+	// Users
+	Whoami() (models.User, error)
+
+	// Break-glass access
+	CreateBreakGlassGrant(userEmail string, imageID int, reason string, validFor time.Duration) (models.BreakGlassGrant, error)
+	ListBreakGlassGrants() ([]models.BreakGlassGrant, error)
+	RevokeBreakGlassGrant(id int) (models.BreakGlassGrant, error)
+	GetImageUploadFile(imageID int, path string) (models.ImageFile, error)
+
+	// Access requests
+	CreateAccessRequest(family, reason string, validFor time.Duration) (models.AccessRequest, error)
+	ListAccessRequests() ([]models.AccessRequest, error)
+	GetAccessRequest(id int) (models.AccessRequest, error)
+	ApproveAccessRequest(id int) (models.AccessRequest, error)
+	DenyAccessRequest(id int) (models.AccessRequest, error)
+
+	// Runbook
+	RestartInstance(id int, reason, confirm string) (models.Instance, error)
+	RotateInstanceCredentials(id int, reason, confirm string) (models.Instance, error)
+	RequeueOperation(id int, reason, confirm string) (models.Operation, error)
+
+	// Access tokens
+	CreateAccessToken(state string) (oauth2.Token, error)
+	ExchangeToken(provider, token string) (oauth2.Token, error)
+	CreateDeviceAuthorization() (models.DeviceAuthorization, error)
+	WaitForDeviceToken(ctx context.Context, authorization models.DeviceAuthorization) (oauth2.Token, error)
+
+	// Operations
+	GetOperation(id int) (models.Operation, error)
+	WaitForOperation(ctx context.Context, id int, policy WaitPolicy) (models.Operation, error)
+
+	// Federation
+	ListFederatedServers() ([]models.FederatedServer, error)
+
+	// Version negotiation
+	ServerVersion() (models.ServerVersion, error)
+	Supports(feature string) (bool, error)
 }
 
+// Client must keep implementing DraupnirClient, so that fakes and mocks built
+// against the interface behave like the real thing
+var _ DraupnirClient = Client{}
+
 func (c Client) GetLatestImage() (models.Image, error) {
 	var image models.Image
-	images, err := c.ListImages()
+	// Older servers ignore the filter, so we still check that the image is ready
+	// below
+	images, err := c.ListImages(ListOptions{Filter: Filter{Ready: true}})
 
 	if err != nil {
 		fmt.Printf("error: %s\n", err)
@@ -84,49 +225,86 @@ func (c Client) GetLatestImage() (models.Image, error) {
 
 func (c Client) GetImage(id string) (models.Image, error) {
 	var image models.Image
-	resp, err := c.get("/images/" + id)
+	body, err := c.getBody("/images/" + id)
 	if err != nil {
 		return image, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return image, parseError(resp.Body)
-	}
-
-	err = jsonapi.UnmarshalPayload(resp.Body, &image)
+	err = c.unmarshal(bytes.NewReader(body), &image)
 	return image, err
 }
 
 func (c Client) GetInstance(id string) (models.Instance, error) {
 	var instance models.Instance
-	resp, err := c.get("/instances/" + id)
+	body, err := c.getBody("/instances/" + id)
 	if err != nil {
 		return instance, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return instance, parseError(resp.Body)
-	}
-
-	err = jsonapi.UnmarshalPayload(resp.Body, &instance)
+	err = c.unmarshal(bytes.NewReader(body), &instance)
 	return instance, err
 }
 
-// ListImages returns a list of all images
-func (c Client) ListImages() ([]models.Image, error) {
-	var images []models.Image
-	resp, err := c.get("/images")
+// GetInstanceDiagnostics returns the likely causes of an instance being slow
+func (c Client) GetInstanceDiagnostics(id string) (models.InstanceDiagnostics, error) {
+	var diagnostics models.InstanceDiagnostics
+	if err := c.negotiation.unsupported(models.FeatureInstanceDiagnostics); err != nil {
+		return diagnostics, err
+	}
+
+	body, err := c.getBody("/instances/" + id + "/diagnostics")
 	if err != nil {
+		return diagnostics, err
+	}
+
+	err = c.unmarshal(bytes.NewReader(body), &diagnostics)
+	return diagnostics, err
+}
+
+// ListImages returns a page of images. If no page is selected, it returns every
+// image, following the links to any further pages.
+func (c Client) ListImages(opts ListOptions) ([]models.Image, error) {
+	if len(opts.Filter.Labels) > 0 {
+		if err := c.negotiation.unsupported(models.FeatureLabels); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Sort != "" {
+		if err := c.negotiation.unsupported(models.FeatureSorting); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Page > 0 || opts.Limit > 0 {
+		images, _, err := c.listImages("/images" + opts.query())
 		return images, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return images, parseError(resp.Body)
+	images := []models.Image{}
+	p := pager{client: c, next: "/images" + opts.query()}
+	fetchPage := func(path string) (PaginationLinks, error) {
+		page, links, err := c.listImages(path)
+		images = append(images, page...)
+		return links, err
+	}
+	for p.fetch(fetchPage) {
+	}
+
+	return images, p.err
+}
+
+func (c Client) listImages(path string) ([]models.Image, PaginationLinks, error) {
+	var images []models.Image
+	var links PaginationLinks
+
+	body, links, err := c.getPage(path)
+	if err != nil {
+		return images, links, err
 	}
 
-	maybeImages, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(images))
+	maybeImages, err := c.unmarshalMany(bytes.NewReader(body), reflect.TypeOf(images))
 	if err != nil {
-		return nil, err
+		return nil, links, err
 	}
 
 	// Convert from []interface{} to []Image
@@ -136,26 +314,93 @@ func (c Client) ListImages() ([]models.Image, error) {
 		images = append(images, *i)
 	}
 
-	return images, nil
+	return images, links, nil
 }
 
-// ListInstances returns a list of all instances
-func (c Client) ListInstances() ([]models.Instance, error) {
-	var instances []models.Instance
-	resp, err := c.get("/instances")
-	if err != nil {
+// ListInstances returns a page of instances. If no page is selected, it returns
+// every instance, following the links to any further pages.
+func (c Client) ListInstances(opts ListOptions) ([]models.Instance, error) {
+	if len(opts.Filter.Labels) > 0 {
+		if err := c.negotiation.unsupported(models.FeatureLabels); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.Filter.Statuses) > 0 {
+		if err := c.negotiation.unsupported(models.FeatureInstanceStatus); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Filter.Static {
+		if err := c.negotiation.unsupported(models.FeatureStaticInstances); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Sort != "" {
+		if err := c.negotiation.unsupported(models.FeatureSorting); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Page > 0 || opts.Limit > 0 {
+		instances, _, err := c.listInstances("/instances" + opts.query())
 		return instances, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return instances, parseError(resp.Body)
+	instances := []models.Instance{}
+	p := pager{client: c, next: "/instances" + opts.query()}
+	fetchPage := func(path string) (PaginationLinks, error) {
+		page, links, err := c.listInstances(path)
+		instances = append(instances, page...)
+		return links, err
+	}
+	for p.fetch(fetchPage) {
+	}
+
+	return instances, p.err
+}
+
+// GetInstanceSummary counts your instances by status and by owner, or
+// everyone's if you're the upload user
+func (c Client) GetInstanceSummary() ([]models.InstanceCount, error) {
+	var counts []models.InstanceCount
+	if err := c.negotiation.unsupported(models.FeatureInstanceStatus); err != nil {
+		return counts, err
+	}
+
+	body, err := c.getBody("/instances/summary")
+	if err != nil {
+		return counts, err
 	}
 
-	maybeInstances, err := jsonapi.UnmarshalManyPayload(resp.Body, reflect.TypeOf(instances))
+	maybeCounts, err := c.unmarshalMany(bytes.NewReader(body), reflect.TypeOf(counts))
 	if err != nil {
 		return nil, err
 	}
 
+	// Convert from []interface{} to []InstanceCount
+	counts = make([]models.InstanceCount, 0)
+	for _, count := range maybeCounts {
+		i := count.(*models.InstanceCount)
+		counts = append(counts, *i)
+	}
+
+	return counts, nil
+}
+
+func (c Client) listInstances(path string) ([]models.Instance, PaginationLinks, error) {
+	var instances []models.Instance
+	var links PaginationLinks
+
+	body, links, err := c.getPage(path)
+	if err != nil {
+		return instances, links, err
+	}
+
+	maybeInstances, err := c.unmarshalMany(bytes.NewReader(body), reflect.TypeOf(instances))
+	if err != nil {
+		return nil, links, err
+	}
+
 	// Convert from []interface{} to []Instance
 	instances = make([]models.Instance, 0)
 	for _, instance := range maybeInstances {
@@ -163,16 +408,101 @@ func (c Client) ListInstances() ([]models.Instance, error) {
 		instances = append(instances, *i)
 	}
 
-	return instances, nil
+	return instances, links, nil
+}
+
+// getBody fetches a resource, returning the body of the response so that lists
+// can be decoded both as a JSON:API payload and for their pagination links.
+// If the client has a cache, the cached body is revalidated with If-None-Match,
+// and returned if the server responds that it hasn't been modified.
+func (c Client) getBody(path string) ([]byte, error) {
+	return c.getBodyContext(context.Background(), path)
+}
+
+func (c Client) getBodyContext(ctx context.Context, path string) ([]byte, error) {
+	body, _, err := c.fetch(ctx, path)
+	return body, err
+}
+
+// getPage fetches a page of a list, returning its body and pagination links
+func (c Client) getPage(path string) ([]byte, PaginationLinks, error) {
+	body, link, err := c.fetch(context.Background(), path)
+	if err != nil {
+		return nil, PaginationLinks{}, err
+	}
+
+	links, err := c.paginationLinks(body, link)
+	return body, links, err
+}
+
+// fetch fetches a resource as getBody does, also returning the response's Link
+// header
+func (c Client) fetch(ctx context.Context, path string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+path, strings.NewReader(""))
+	if err != nil {
+		return nil, "", err
+	}
+
+	cached, isCached := c.cache.get(path)
+	if isCached {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && isCached {
+		return cached.body, cached.link, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		c.cache.remove(path)
+		return nil, "", parseError(resp.Body)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	link := resp.Header.Get("Link")
+	c.cache.put(path, resp.Header.Get("ETag"), link, body)
+	return body, link, nil
 }
 
 // CreateInstance creates a new instance
 func (c Client) CreateInstance(image models.Image) (models.Instance, error) {
+	return c.createInstance(routes.CreateInstanceRequest{ImageID: strconv.Itoa(image.ID)})
+}
+
+// CreateStandbyInstance creates a new instance that replays WAL from the
+// source database's archive until it is promoted. It only accepts local
+// connections until then.
+func (c Client) CreateStandbyInstance(image models.Image) (models.Instance, error) {
+	if err := c.negotiation.unsupported(models.FeatureStandbyInstances); err != nil {
+		return models.Instance{}, err
+	}
+	return c.createInstance(routes.CreateInstanceRequest{ImageID: strconv.Itoa(image.ID), Standby: true})
+}
+
+// CreateSchemaOnlyInstance creates a new instance whose tables are empty,
+// other than those that the server is configured to keep, such as the table
+// of applied migrations
+func (c Client) CreateSchemaOnlyInstance(image models.Image) (models.Instance, error) {
+	if err := c.negotiation.unsupported(models.FeatureSchemaOnlyInstances); err != nil {
+		return models.Instance{}, err
+	}
+	return c.createInstance(routes.CreateInstanceRequest{ImageID: strconv.Itoa(image.ID), SchemaOnly: true})
+}
+
+func (c Client) createInstance(request routes.CreateInstanceRequest) (models.Instance, error) {
 	var instance models.Instance
-	request := routes.CreateInstanceRequest{ImageID: strconv.Itoa(image.ID)}
 
 	var payload bytes.Buffer
-	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	err := c.marshal(&payload, &request)
 	if err != nil {
 		return instance, err
 	}
@@ -186,10 +516,91 @@ func (c Client) CreateInstance(image models.Image) (models.Instance, error) {
 		return instance, parseError(resp.Body)
 	}
 
-	err = jsonapi.UnmarshalPayload(resp.Body, &instance)
+	err = c.unmarshal(resp.Body, &instance)
 	return instance, err
 }
 
+// PromoteInstance stops a standby instance from replaying WAL and anonymises
+// it, after which it can be connected to
+func (c Client) PromoteInstance(instance models.Instance) (models.Instance, error) {
+	var promoted models.Instance
+	var emptyPayload bytes.Buffer
+
+	resp, err := c.post(fmt.Sprintf("/instances/%d/promote", instance.ID), &emptyPayload)
+	if err != nil {
+		return promoted, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return promoted, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &promoted)
+	return promoted, err
+}
+
+// ExtendInstance pushes back when the instance expires by the given duration,
+// from whichever is later of its current expiry and now
+func (c Client) ExtendInstance(instance models.Instance, by time.Duration) (models.Instance, error) {
+	var extended models.Instance
+	if err := c.negotiation.unsupported(models.FeatureInstanceExpiry); err != nil {
+		return extended, err
+	}
+
+	request := routes.ExtendInstanceRequest{By: by.String()}
+
+	var payload bytes.Buffer
+	err := c.marshal(&payload, &request)
+	if err != nil {
+		return extended, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("/instances/%d/extend", instance.ID), &payload)
+	if err != nil {
+		return extended, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return extended, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &extended)
+	return extended, err
+}
+
+// RunMaintenance runs one of the server's whitelisted maintenance operations,
+// such as analyze or vacuum_full, against one of the instance's databases
+func (c Client) RunMaintenance(instance models.Instance, database, operation string, args map[string]string) (models.MaintenanceResult, error) {
+	var result models.MaintenanceResult
+
+	request := routes.MaintenanceRequest{
+		Operation: operation,
+		Database:  database,
+		Arguments: make(map[string]interface{}, len(args)),
+	}
+	for name, value := range args {
+		request.Arguments[name] = value
+	}
+
+	var payload bytes.Buffer
+	err := c.marshal(&payload, &request)
+	if err != nil {
+		return result, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("/instances/%d/exec", instance.ID), &payload)
+	if err != nil {
+		return result, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return result, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &result)
+	return result, err
+}
+
 // DestroyInstance destroys an instance
 func (c Client) DestroyInstance(instance models.Instance) error {
 	url := fmt.Sprintf("/instances/%d", instance.ID)
@@ -205,14 +616,116 @@ func (c Client) DestroyInstance(instance models.Instance) error {
 	return nil
 }
 
+// CreateCleanupToken creates a token that destroys the given instances when
+// it's used, e.g. by a CI job's teardown step that can't authenticate as the
+// user who created them. The token lasts for validFor, or a day if it's zero.
+func (c Client) CreateCleanupToken(instanceIDs []int, validFor time.Duration) (models.CleanupToken, error) {
+	var token models.CleanupToken
+	if err := c.negotiation.unsupported(models.FeatureCleanupTokens); err != nil {
+		return token, err
+	}
+
+	request := routes.CreateCleanupTokenRequest{InstanceIDs: make([]string, 0, len(instanceIDs))}
+	for _, id := range instanceIDs {
+		request.InstanceIDs = append(request.InstanceIDs, strconv.Itoa(id))
+	}
+	if validFor > 0 {
+		request.ValidFor = validFor.String()
+	}
+
+	var payload bytes.Buffer
+	err := c.marshal(&payload, &request)
+	if err != nil {
+		return token, err
+	}
+
+	resp, err := c.post("/cleanup_tokens", &payload)
+	if err != nil {
+		return token, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return token, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &token)
+	return token, err
+}
+
+// UseCleanupToken destroys the instances of a cleanup token. It needs no
+// credentials other than the token, which can only be used once.
+func (c Client) UseCleanupToken(secret string) (models.CleanupToken, error) {
+	var token models.CleanupToken
+	if err := c.negotiation.unsupported(models.FeatureCleanupTokens); err != nil {
+		return token, err
+	}
+
+	request := routes.UseCleanupTokenRequest{Token: secret}
+
+	var payload bytes.Buffer
+	err := c.marshal(&payload, &request)
+	if err != nil {
+		return token, err
+	}
+
+	resp, err := c.post("/cleanup_tokens/use", &payload)
+	if err != nil {
+		return token, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return token, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &token)
+	return token, err
+}
+
 // CreateImage creates a new image. This does not complete the process of preparing an
 // image, subsequent upload and finalisation steps are required.
 func (c Client) CreateImage(backedUpAt time.Time, anon []byte) (models.Image, error) {
+	return c.CreateShardedImage(backedUpAt, anon, nil)
+}
+
+// CreateShardedImage creates a new image composed of the given shards. Each
+// shard must be uploaded as a directory-format pg_dump into its own slot in
+// the image's upload directory (shards/<name>) before the image is finalised.
+func (c Client) CreateShardedImage(backedUpAt time.Time, anon []byte, shards []string) (models.Image, error) {
+	return c.createImage(routes.CreateImageRequest{BackedUpAt: backedUpAt, Anon: string(anon), Shards: shards})
+}
+
+// CreateImageFromBackup creates a new image whose upload is checked against the
+// checksum and start LSN of the source's base backup before it is finalised.
+// Either may be empty. See draupnir-inspect-image for how the checksum is
+// calculated.
+func (c Client) CreateImageFromBackup(backedUpAt time.Time, anon []byte, checksum, lsn string) (models.Image, error) {
+	return c.createImage(routes.CreateImageRequest{
+		BackedUpAt:     backedUpAt,
+		Anon:           string(anon),
+		BackupChecksum: checksum,
+		BackupLSN:      lsn,
+	})
+}
+
+// CreateImageWithOptions creates a new image from a complete request, which
+// allows any combination of shards, base backup checks and finalisation
+// options such as databases to drop or rename, and the encoding and locale
+// that every database should be converted to. Distributed images are created
+// by giving their workers.
+func (c Client) CreateImageWithOptions(request routes.CreateImageRequest) (models.Image, error) {
+	return c.createImage(request)
+}
+
+func (c Client) createImage(request routes.CreateImageRequest) (models.Image, error) {
 	var image models.Image
-	request := routes.CreateImageRequest{BackedUpAt: backedUpAt, Anon: string(anon)}
+	if len(request.Workers) > 0 {
+		if err := c.negotiation.unsupported(models.FeatureDistributedImages); err != nil {
+			return image, err
+		}
+	}
 
 	var payload bytes.Buffer
-	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	err := c.marshal(&payload, &request)
 	if err != nil {
 		return image, err
 	}
@@ -226,10 +739,130 @@ func (c Client) CreateImage(backedUpAt time.Time, anon []byte) (models.Image, er
 		return image, parseError(resp.Body)
 	}
 
-	err = jsonapi.UnmarshalPayload(resp.Body, &image)
+	err = c.unmarshal(resp.Body, &image)
 	return image, err
 }
 
+// GetImageTimeline returns the phases of the image's bake, in the order they
+// started. A phase without a FinishedAt is either still running or was
+// interrupted.
+func (c Client) GetImageTimeline(imageID int) ([]models.BakeSpan, error) {
+	var spans []models.BakeSpan
+	if err := c.negotiation.unsupported(models.FeatureBakeTimeline); err != nil {
+		return spans, err
+	}
+
+	body, err := c.getBody(fmt.Sprintf("/images/%d/timeline", imageID))
+	if err != nil {
+		return spans, err
+	}
+
+	maybeSpans, err := c.unmarshalMany(bytes.NewReader(body), reflect.TypeOf(spans))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []BakeSpan
+	spans = make([]models.BakeSpan, 0)
+	for _, span := range maybeSpans {
+		s := span.(*models.BakeSpan)
+		spans = append(spans, *s)
+	}
+
+	return spans, nil
+}
+
+// ListFreshness returns whether each image family meets its freshness SLA
+func (c Client) ListFreshness() ([]models.FreshnessStatus, error) {
+	var statuses []models.FreshnessStatus
+	if err := c.negotiation.unsupported(models.FeatureFreshness); err != nil {
+		return statuses, err
+	}
+
+	body, err := c.getBody("/freshness")
+	if err != nil {
+		return statuses, err
+	}
+
+	maybeStatuses, err := c.unmarshalMany(bytes.NewReader(body), reflect.TypeOf(statuses))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []FreshnessStatus
+	statuses = make([]models.FreshnessStatus, 0)
+	for _, status := range maybeStatuses {
+		s := status.(*models.FreshnessStatus)
+		statuses = append(statuses, *s)
+	}
+
+	return statuses, nil
+}
+
+// ListStaleImages returns the ready images that weren't anonymised with the
+// current anonymisation spec of their family
+func (c Client) ListStaleImages() ([]models.StaleImage, error) {
+	var images []models.StaleImage
+	if err := c.negotiation.unsupported(models.FeatureAnonAudit); err != nil {
+		return images, err
+	}
+
+	body, err := c.getBody("/anon_audit")
+	if err != nil {
+		return images, err
+	}
+
+	maybeImages, err := c.unmarshalMany(bytes.NewReader(body), reflect.TypeOf(images))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []StaleImage
+	images = make([]models.StaleImage, 0)
+	for _, image := range maybeImages {
+		i := image.(*models.StaleImage)
+		images = append(images, *i)
+	}
+
+	return images, nil
+}
+
+// GetImageFile returns one of the files in a ready image's snapshot. Only
+// models.ImageFileNames can be read.
+func (c Client) GetImageFile(imageID int, name string) (models.ImageFile, error) {
+	var file models.ImageFile
+	if err := c.negotiation.unsupported(models.FeatureImageFiles); err != nil {
+		return file, err
+	}
+
+	body, err := c.getBody(fmt.Sprintf("/images/%d/files/%s", imageID, url.PathEscape(name)))
+	if err != nil {
+		return file, err
+	}
+
+	err = c.unmarshal(bytes.NewReader(body), &file)
+	return file, err
+}
+
+// VerifyImage checksums the image's snapshot on the server, and compares it to
+// the checksum taken when the image was finalised
+func (c Client) VerifyImage(imageID int) (models.ImageVerification, error) {
+	var verification models.ImageVerification
+	var emptyPayload bytes.Buffer
+
+	resp, err := c.post(fmt.Sprintf("/images/%d/verify", imageID), &emptyPayload)
+	if err != nil {
+		return verification, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return verification, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &verification)
+	return verification, err
+}
+
 // FinaliseImage posts to images/id/done, causing draupnir to run the finalisation process
 // to anonymise and prepare the image for usage.
 func (c Client) FinaliseImage(imageID int) (models.Image, error) {
@@ -245,10 +878,95 @@ func (c Client) FinaliseImage(imageID int) (models.Image, error) {
 		return image, parseError(resp.Body)
 	}
 
-	err = jsonapi.UnmarshalPayload(resp.Body, &image)
+	err = c.unmarshal(resp.Body, &image)
 	return image, err
 }
 
+// WaitForImageReady polls the image every pollInterval until it is ready,
+// returning the ready image. It returns the context's error if the context is
+// done first, or any error encountered whilst fetching the image.
+func (c Client) WaitForImageReady(ctx context.Context, imageID int, pollInterval time.Duration) (models.Image, error) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		image, err := c.GetImage(strconv.Itoa(imageID))
+		if err != nil {
+			return image, err
+		}
+
+		if image.Ready {
+			return image, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return image, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// AnnotateImage patches the image's annotations. Annotations with string values
+// are set, and those with nil values are removed.
+func (c Client) AnnotateImage(image models.Image, patch models.Annotations) (models.Image, error) {
+	var annotated models.Image
+	err := c.patchResource(fmt.Sprintf("/images/%d", image.ID), routes.AnnotateRequest{Annotations: patch}, &annotated)
+	return annotated, err
+}
+
+// LabelImage patches the image's labels. Labels with string values are set,
+// and those with nil values are removed.
+func (c Client) LabelImage(image models.Image, patch models.Labels) (models.Image, error) {
+	var labelled models.Image
+	if err := c.negotiation.unsupported(models.FeatureLabels); err != nil {
+		return labelled, err
+	}
+
+	err := c.patchResource(fmt.Sprintf("/images/%d", image.ID), routes.AnnotateRequest{Labels: patch}, &labelled)
+	return labelled, err
+}
+
+// AnnotateInstance patches the instance's annotations. Annotations with string
+// values are set, and those with nil values are removed.
+func (c Client) AnnotateInstance(instance models.Instance, patch models.Annotations) (models.Instance, error) {
+	var annotated models.Instance
+	err := c.patchResource(fmt.Sprintf("/instances/%d", instance.ID), routes.AnnotateRequest{Annotations: patch}, &annotated)
+	return annotated, err
+}
+
+// LabelInstance patches the instance's labels. Labels with string values are
+// set, and those with nil values are removed.
+func (c Client) LabelInstance(instance models.Instance, patch models.Labels) (models.Instance, error) {
+	var labelled models.Instance
+	if err := c.negotiation.unsupported(models.FeatureLabels); err != nil {
+		return labelled, err
+	}
+
+	err := c.patchResource(fmt.Sprintf("/instances/%d", instance.ID), routes.AnnotateRequest{Labels: patch}, &labelled)
+	return labelled, err
+}
+
+// patchResource patches the annotations and labels of the image or instance
+func (c Client) patchResource(path string, request routes.AnnotateRequest, resource interface{}) error {
+	var payload bytes.Buffer
+	err := c.marshal(&payload, &request)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.patch(path, &payload)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return parseError(resp.Body)
+	}
+
+	return c.unmarshal(resp.Body, resource)
+}
+
 // DestroyImage destroys an image
 func (c Client) DestroyImage(image models.Image) error {
 	url := fmt.Sprintf("/images/%d", image.ID)
@@ -264,6 +982,67 @@ func (c Client) DestroyImage(image models.Image) error {
 	return nil
 }
 
+// PruneImages destroys the images backed up longer ago than olderThan, if it's
+// positive, that aren't among the newest keepLast, if that's positive. Images
+// that are pinned or still have instances are skipped. It returns the images
+// that were pruned, or with dryRun, the images that would have been.
+func (c Client) PruneImages(olderThan time.Duration, keepLast int, dryRun bool) ([]models.Image, error) {
+	if err := c.negotiation.unsupported(models.FeatureImagePrune); err != nil {
+		return nil, err
+	}
+
+	request := routes.PruneImagesRequest{KeepLast: keepLast, DryRun: dryRun}
+	if olderThan > 0 {
+		request.OlderThan = olderThan.String()
+	}
+
+	var payload bytes.Buffer
+	err := c.marshal(&payload, &request)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.post("/images/prune", &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, parseError(resp.Body)
+	}
+
+	maybeImages, err := c.unmarshalMany(resp.Body, reflect.TypeOf([]models.Image{}))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []Image
+	images := make([]models.Image, 0)
+	for _, image := range maybeImages {
+		i := image.(*models.Image)
+		images = append(images, *i)
+	}
+
+	return images, nil
+}
+
+// Whoami returns the user that the client is authenticated as, their roles,
+// and how much of their quotas they've used
+func (c Client) Whoami() (models.User, error) {
+	var user models.User
+	if err := c.negotiation.unsupported(models.FeatureWhoami); err != nil {
+		return user, err
+	}
+
+	body, err := c.getBody("/whoami")
+	if err != nil {
+		return user, err
+	}
+
+	err = c.unmarshal(bytes.NewReader(body), &user)
+	return user, err
+}
+
 type createAccessTokenRequest struct {
 	State string `jsonapi:"attr,state"`
 }
@@ -274,7 +1053,7 @@ func (c Client) CreateAccessToken(state string) (oauth2.Token, error) {
 	request := createAccessTokenRequest{State: state}
 
 	var payload bytes.Buffer
-	err := jsonapi.MarshalOnePayloadWithoutIncluded(&payload, &request)
+	err := c.marshal(&payload, &request)
 	if err != nil {
 		return token, err
 	}
@@ -289,15 +1068,43 @@ func (c Client) CreateAccessToken(state string) (oauth2.Token, error) {
 	}
 
 	err = json.NewDecoder(resp.Body).Decode(&token)
-	return token, err
+	return c.localExpiry(token), err
 }
 
 func (c Client) do(req *http.Request) (*http.Response, error) {
-	req.Header.Set("Content-Type", "application/json")
+	return c.doWithClient(c.client, req)
+}
+
+// doWithClient behaves like do, but sends the request with the given HTTP
+// client
+func (c Client) doWithClient(client *http.Client, req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	req.Header.Set("Authorization", c.authorizationHeader())
-	req.Header.Set("Draupnir-Version", version.Version)
+	req.Header.Set("Draupnir-Version", c.negotiation.requestVersionOr(version.Version))
+
+	resp, err := c.retryPolicy.doWithRetries(client, req)
+	if err != nil {
+		return resp, err
+	}
+	c.clock.observe(resp, time.Now())
+
+	// Servers reject clients that are newer than them, so we fall back to a
+	// version that they accept
+	resp, err = c.renegotiate(client, req, resp)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter, _ := parseRetryAfter(resp, responseNow(resp))
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, &ErrRateLimited{RetryAfter: retryAfter}
+	}
 
-	return c.client.Do(req)
+	return resp, nil
 }
 
 func (c Client) get(path string) (*http.Response, error) {
@@ -318,6 +1125,15 @@ func (c Client) post(path string, payload *bytes.Buffer) (*http.Response, error)
 	return c.do(req)
 }
 
+func (c Client) patch(path string, payload *bytes.Buffer) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPatch, c.url+path, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
 func (c Client) delete(path string) (*http.Response, error) {
 	req, err := http.NewRequest(http.MethodDelete, c.url+path, strings.NewReader(""))
 	if err != nil {
@@ -327,6 +1143,9 @@ func (c Client) delete(path string) (*http.Response, error) {
 	return c.do(req)
 }
 
+// authorizationHeader returns the value of the Authorization header. The
+// server authenticates us with the refresh token, which it exchanges for an
+// access token itself, so there's no access token for us to refresh.
 func (c Client) authorizationHeader() string {
 	return fmt.Sprintf("Bearer %s", c.token.RefreshToken)
 }
@@ -0,0 +1,374 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitForImageReady(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/images/1", r.URL.Path)
+		requests++
+		fmt.Fprintf(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": %t}}}`, requests == 3)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	image, err := client.WaitForImageReady(context.Background(), 1, time.Millisecond)
+
+	assert.Nil(t, err)
+	assert.True(t, image.Ready)
+	assert.Equal(t, 3, requests)
+}
+
+func TestWaitForImageReadyWhenContextExpires(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": false}}}`)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	image, err := client.WaitForImageReady(ctx, 1, time.Millisecond)
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.False(t, image.Ready)
+}
+
+func TestWaitForImageReadyWhenImageIsMissing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"title": "Resource Not Found", "detail": "Not here"}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	_, err := client.WaitForImageReady(context.Background(), 1, time.Millisecond)
+
+	assert.EqualError(t, err, "Resource Not Found (Not here)")
+}
+
+func TestAnnotateInstance(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPatch, r.Method)
+		assert.Equal(t, "/instances/1", r.URL.Path)
+
+		var body struct {
+			Data struct {
+				Attributes map[string]map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, map[string]interface{}{"cursor": "42", "stale": nil}, body.Data.Attributes["annotations"])
+
+		fmt.Fprint(w, `{"data": {"type": "instances", "id": "1", "attributes": {"annotations": {"cursor": "42"}}}}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	instance, err := client.AnnotateInstance(
+		models.Instance{ID: 1},
+		models.Annotations{"cursor": "42", "stale": nil},
+	)
+
+	assert.Nil(t, err)
+	assert.Equal(t, models.Annotations{"cursor": "42"}, instance.Annotations)
+}
+
+func TestLabelImage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPatch, r.Method)
+		assert.Equal(t, "/images/1", r.URL.Path)
+
+		var body struct {
+			Data struct {
+				Attributes map[string]map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, map[string]interface{}{"cluster": "payments-eu", "anon_version": nil}, body.Data.Attributes["labels"])
+		assert.Empty(t, body.Data.Attributes["annotations"])
+
+		fmt.Fprint(w, `{"data": {"type": "images", "id": "1", "attributes": {"labels": {"cluster": "payments-eu"}}}}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	image, err := client.LabelImage(
+		models.Image{ID: 1},
+		models.Labels{"cluster": "payments-eu", "anon_version": nil},
+	)
+
+	assert.Nil(t, err)
+	assert.Equal(t, models.Labels{"cluster": "payments-eu"}, image.Labels)
+}
+
+func TestExtendInstance(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/instances/1/extend", r.URL.Path)
+
+		var body struct {
+			Data struct {
+				Attributes map[string]string `json:"attributes"`
+			} `json:"data"`
+		}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "4h0m0s", body.Data.Attributes["by"])
+
+		fmt.Fprint(w, `{"data": {"type": "instances", "id": "1", "attributes": {"expires_at": "2026-10-16T12:00:00Z"}}}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	instance, err := client.ExtendInstance(models.Instance{ID: 1}, 4*time.Hour)
+
+	assert.Nil(t, err)
+	if assert.NotNil(t, instance.ExpiresAt) {
+		assert.True(t, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC).Equal(*instance.ExpiresAt))
+	}
+}
+
+func TestPruneImages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/images/prune", r.URL.Path)
+
+		var body struct {
+			Data struct {
+				Attributes map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "720h0m0s", body.Data.Attributes["older_than"])
+		assert.Equal(t, float64(3), body.Data.Attributes["keep_last"])
+		assert.Equal(t, true, body.Data.Attributes["dry_run"])
+
+		fmt.Fprint(w, `{"data": [
+			{"type": "images", "id": "1", "attributes": {"ready": true}},
+			{"type": "images", "id": "2", "attributes": {"ready": true}}
+		]}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	images, err := client.PruneImages(720*time.Hour, 3, true)
+
+	assert.Nil(t, err)
+	if assert.Len(t, images, 2) {
+		assert.Equal(t, 1, images[0].ID)
+		assert.Equal(t, 2, images[1].ID)
+	}
+}
+
+func TestCleanupTokens(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Data struct {
+				Attributes map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+
+		switch r.URL.Path {
+		case "/cleanup_tokens":
+			assert.Equal(t, []interface{}{"1", "2"}, body.Data.Attributes["instance_ids"])
+			assert.Equal(t, "2h0m0s", body.Data.Attributes["valid_for"])
+
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"data": {"type": "cleanup_tokens", "id": "1", "attributes": {"token": "dct_secret", "instance_ids": ["1", "2"], "created_at": "2026-10-15T12:00:00Z", "expires_at": "2026-10-15T14:00:00Z", "used_at": null}}}`)
+		case "/cleanup_tokens/use":
+			assert.Equal(t, "dct_secret", body.Data.Attributes["token"])
+
+			fmt.Fprint(w, `{"data": {"type": "cleanup_tokens", "id": "1", "attributes": {"instance_ids": ["1", "2"], "destroyed_instance_ids": ["2"], "created_at": "2026-10-15T12:00:00Z", "expires_at": "2026-10-15T14:00:00Z", "used_at": "2026-10-15T13:00:00Z"}}}`)
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+
+	token, err := client.CreateCleanupToken([]int{1, 2}, 2*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, "dct_secret", token.Token)
+	assert.Equal(t, []string{"1", "2"}, token.InstanceIDs)
+
+	token, err = client.UseCleanupToken(token.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2"}, token.DestroyedInstanceIDs)
+	assert.NotNil(t, token.UsedAt)
+}
+
+func TestWhoami(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/whoami", r.URL.Path)
+		fmt.Fprint(w, `{"data": {"type": "users", "id": "developer@example.com", "attributes": {"roles": ["user"], "instances": 2, "images_in_progress": 0, "max_images_in_progress": 3, "image_cooldown": "0s"}}}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	user, err := client.Whoami()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "developer@example.com", user.ID)
+	assert.Equal(t, []string{models.RoleUser}, user.Roles)
+	assert.Equal(t, 2, user.Instances)
+	assert.Equal(t, 3, user.MaxImagesInProgress)
+}
+
+func TestRateLimitedRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	_, err := client.CreateInstance(models.Image{ID: 1})
+
+	rateLimited, ok := err.(*ErrRateLimited)
+	assert.True(t, ok, "expected an *ErrRateLimited, got %v", err)
+	assert.Equal(t, 2*time.Minute, rateLimited.RetryAfter)
+	assert.EqualError(t, err, "rate limited by the server, retry after 2m0s")
+}
+
+func TestGetImageTimeline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/images/1/timeline", r.URL.Path)
+		fmt.Fprint(w, `{"data": [
+			{"type": "bake_spans", "id": "1", "attributes": {"image_id": 1, "phase": "finalise", "started_at": "2017-05-01T12:00:00Z", "finished_at": "2017-05-01T14:00:00Z", "error": ""}},
+			{"type": "bake_spans", "id": "2", "attributes": {"image_id": 1, "phase": "inspect_snapshot", "started_at": "2017-05-01T14:00:00Z", "finished_at": null, "error": ""}}
+		]}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	spans, err := client.GetImageTimeline(1)
+
+	assert.Nil(t, err)
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "finalise", spans[0].Phase)
+	assert.Equal(t, 2*time.Hour, spans[0].FinishedAt.Sub(spans[0].StartedAt))
+	assert.Nil(t, spans[1].FinishedAt)
+}
+
+func TestListFreshness(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/freshness", r.URL.Path)
+		fmt.Fprint(w, `{"data": [
+			{"type": "freshness_statuses", "id": "default", "attributes": {"max_age": "36h0m0s", "met": true, "latest_image_id": 2, "latest_backed_up_at": "2017-05-01T12:00:00Z", "violated_since": null, "checked_at": "2017-05-01T14:00:00Z"}},
+			{"type": "freshness_statuses", "id": "analytics", "attributes": {"max_age": "24h0m0s", "met": false, "latest_image_id": 0, "latest_backed_up_at": null, "violated_since": null, "checked_at": "2017-05-01T14:00:00Z"}}
+		]}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	statuses, err := client.ListFreshness()
+
+	assert.Nil(t, err)
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, "default", statuses[0].ID)
+	assert.True(t, statuses[0].Met)
+	assert.Equal(t, 2, statuses[0].LatestImageID)
+	assert.Equal(t, "analytics", statuses[1].ID)
+	assert.False(t, statuses[1].Met)
+	assert.Nil(t, statuses[1].LatestBackedUpAt)
+}
+
+func TestListStaleImages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/anon_audit", r.URL.Path)
+		fmt.Fprint(w, `{"data": [
+			{"type": "stale_images", "id": "3", "attributes": {"family": "payments", "backed_up_at": "2017-05-01T12:00:00Z", "anon_hash": "9f86d081", "spec_hash": "60303ae2", "policy": "block"}}
+		]}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	images, err := client.ListStaleImages()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []models.StaleImage{
+		{
+			ID:         3,
+			Family:     "payments",
+			BackedUpAt: time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC),
+			AnonHash:   "9f86d081",
+			SpecHash:   "60303ae2",
+			Policy:     "block",
+		},
+	}, images)
+}
+
+func TestGetInstanceSummary(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/instances/summary", r.URL.Path)
+		fmt.Fprint(w, `{"data": [
+			{"type": "instance_counts", "id": "status:running", "attributes": {"dimension": "status", "value": "running", "count": 3}},
+			{"type": "instance_counts", "id": "owner:developer@example.com", "attributes": {"dimension": "owner", "value": "developer@example.com", "count": 3}}
+		]}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	counts, err := client.GetInstanceSummary()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []models.InstanceCount{
+		models.NewInstanceCount(models.InstanceCountByStatus, models.InstanceRunning, 3),
+		models.NewInstanceCount(models.InstanceCountByOwner, "developer@example.com", 3),
+	}, counts)
+}
+
+func TestGetImageFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/images/1/files/pg_hba.conf", r.URL.Path)
+		fmt.Fprint(w, `{"data": {"type": "image_files", "id": "pg_hba.conf", "attributes": {"image_id": 1, "content": "local all all trust\n", "truncated": false}}}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	file, err := client.GetImageFile(1, "pg_hba.conf")
+
+	assert.Nil(t, err)
+	assert.Equal(t, models.ImageFile{ID: "pg_hba.conf", ImageID: 1, Content: "local all all trust\n"}, file)
+}
+
+func TestCreateSchemaOnlyInstance(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/instances", r.URL.Path)
+
+		var body struct {
+			Data struct {
+				Attributes map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, true, body.Data.Attributes["schema_only"])
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"data": {"type": "instances", "id": "3", "attributes": {
+			"hostname": "localhost", "image_id": 2, "port": 5432, "status": "running", "schema_only": true
+		}}}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	instance, err := client.CreateSchemaOnlyInstance(models.Image{ID: 2})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, instance.ID)
+	assert.True(t, instance.SchemaOnly)
+}
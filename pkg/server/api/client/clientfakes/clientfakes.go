@@ -0,0 +1,2165 @@
+// Package clientfakes provides an in-memory implementation of
+// client.DraupnirClient, so that tools built on the client can be tested
+// without a running draupnir server.
+package clientfakes
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/reclaim"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/client"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+var _ client.DraupnirClient = &FakeClient{}
+
+// watchBuffer is how many events a watcher can fall behind by before its
+// channel is closed, as the server does when a client falls behind
+const watchBuffer = 16
+
+// FakeClient behaves like a draupnir server with no other users: images and
+// instances are kept in memory, and the same errors are returned as the real
+// client would return for e.g. missing images or unready images.
+//
+// Images are created unready, and become ready when they're finalised. Uploads
+// are kept in memory, and can be read back with Upload. Instances belong to
+// UserEmail, and listen on consecutive ports from MinInstancePort. Maintenance
+// operations always succeed without output, and images have no manifests, as
+// nothing is really run.
+//
+// Err, if set, is returned by every method instead of doing anything, so that
+// callers can test how they handle the server being unavailable.
+//
+// A FakeClient is safe for concurrent use.
+type FakeClient struct {
+	Hostname        string
+	UserEmail       string
+	MinInstancePort uint16
+	// FederatedServers are returned by ListFederatedServers
+	FederatedServers []models.FederatedServer
+	// InstanceProxy, if set, serves the connections that ProxyInstance opens,
+	// as an instance would behind the server's proxy
+	InstanceProxy func(instance models.Instance, conn io.ReadWriteCloser)
+	// InstanceTTL, if set, is how long after they're created instances expire.
+	// Expired instances aren't destroyed.
+	InstanceTTL time.Duration
+	// Features are the features that ServerVersion reports. NewFakeClient
+	// supports every feature.
+	Features []string
+	Err      error
+
+	mu               sync.Mutex
+	images           []models.Image
+	instances        []models.Instance
+	uploads          map[int][]byte
+	cleanupTokens    map[string]models.CleanupToken
+	instanceGroups   []models.InstanceGroup
+	breakGlassGrants []models.BreakGlassGrant
+	accessRequests   []models.AccessRequest
+	operations       []models.Operation
+	imageWatchers    []chan client.ImageEvent
+	instanceWatchers []chan client.InstanceEvent
+	nextID           int
+	nextPort         uint16
+}
+
+// NewFakeClient returns a FakeClient with no images or instances, whose
+// instances belong to the given user
+func NewFakeClient(userEmail string) *FakeClient {
+	return &FakeClient{
+		Hostname:        "localhost",
+		UserEmail:       userEmail,
+		MinInstancePort: 5432,
+		Features: []string{
+			models.FeatureStandbyInstances,
+			models.FeatureResumableUploads,
+			models.FeatureBakeTimeline,
+			models.FeatureBakeErrorClasses,
+			models.FeatureImageManifests,
+			models.FeatureImageFiles,
+			models.FeatureConditionalRequests,
+			models.FeatureEvents,
+			models.FeatureFederation,
+			models.FeatureFreshness,
+			models.FeaturePlainJSON,
+			models.FeatureInstanceProxy,
+			models.FeatureInstanceExpiry,
+			models.FeatureImagePrune,
+			models.FeatureCleanupTokens,
+			models.FeatureInstanceGroups,
+			models.FeatureWhoami,
+			models.FeatureImageSend,
+			models.FeatureTokenExchange,
+			models.FeatureInstanceDiagnostics,
+			models.FeatureAnonAudit,
+			models.FeatureInstanceLogs,
+			models.FeatureDeviceAuthorization,
+			models.FeatureInstanceStatus,
+			models.FeaturePagination,
+			models.FeatureSorting,
+			models.FeatureBreakGlass,
+			models.FeatureLabels,
+			models.FeatureSchemaOnlyInstances,
+			models.FeatureSearch,
+			models.FeatureOperations,
+			models.FeatureStaticInstances,
+			models.FeatureDistributedImages,
+			models.FeatureWebhooks,
+			models.FeatureAccessRequests,
+			models.FeatureBtrfsStreamUpload,
+			models.FeatureRunbook,
+			models.FeatureOpenAPI,
+		},
+	}
+}
+
+// AddImage stores an image as if it had been created on the server, giving it
+// an ID if it doesn't have one, and returns it
+func (c *FakeClient) AddImage(image models.Image) models.Image {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if image.ID == 0 {
+		image.ID = c.newID()
+	}
+	c.images = append(c.images, image)
+	c.publishImage(client.EventCreated, image)
+	return image
+}
+
+// Images returns every stored image, in the order they were created
+func (c *FakeClient) Images() []models.Image {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]models.Image{}, c.images...)
+}
+
+// Instances returns every stored instance, in the order they were created
+func (c *FakeClient) Instances() []models.Instance {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]models.Instance{}, c.instances...)
+}
+
+// Upload returns everything that has been uploaded to the image
+func (c *FakeClient) Upload(imageID int) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]byte{}, c.uploads[imageID]...)
+}
+
+func (c *FakeClient) GetLatestImage() (models.Image, error) {
+	images, err := c.ListImages(client.ListOptions{Filter: client.Filter{Ready: true}})
+	if err != nil {
+		return models.Image{}, err
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		return images[i].UpdatedAt.After(images[j].UpdatedAt)
+	})
+
+	if len(images) == 0 {
+		return models.Image{}, errors.New("no images available")
+	}
+	return images[0], nil
+}
+
+func (c *FakeClient) GetImage(id string) (models.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Image{}, c.Err
+	}
+
+	idx, err := c.findImage(id)
+	if err != nil {
+		return models.Image{}, err
+	}
+	return c.images[idx], nil
+}
+
+func (c *FakeClient) ListImages(opts client.ListOptions) ([]models.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+
+	images := []models.Image{}
+	for _, image := range c.images {
+		if opts.Filter.Ready && !image.Ready {
+			continue
+		}
+		if !image.Labels.Matches(opts.Filter.Labels) {
+			continue
+		}
+		images = append(images, image)
+	}
+
+	err := sortList(images, opts.Sort, store.ImageSortFields, func(field string, descending bool, i, j int) int {
+		a, b := images[i], images[j]
+		switch field {
+		case "backed_up_at":
+			return compareTimes(&a.BackedUpAt, &b.BackedUpAt, descending)
+		case "created_at":
+			return compareTimes(&a.CreatedAt, &b.CreatedAt, descending)
+		case "updated_at":
+			return compareTimes(&a.UpdatedAt, &b.UpdatedAt, descending)
+		default:
+			return compareInts(a.ID, b.ID, descending)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := page(opts, len(images))
+	return images[start:end], nil
+}
+
+func (c *FakeClient) CreateImage(backedUpAt time.Time, anon []byte) (models.Image, error) {
+	return c.CreateImageWithOptions(routes.CreateImageRequest{BackedUpAt: backedUpAt, Anon: string(anon)})
+}
+
+func (c *FakeClient) CreateShardedImage(backedUpAt time.Time, anon []byte, shards []string) (models.Image, error) {
+	return c.CreateImageWithOptions(routes.CreateImageRequest{BackedUpAt: backedUpAt, Anon: string(anon), Shards: shards})
+}
+
+func (c *FakeClient) CreateImageFromBackup(backedUpAt time.Time, anon []byte, checksum, lsn string) (models.Image, error) {
+	return c.CreateImageWithOptions(routes.CreateImageRequest{
+		BackedUpAt:     backedUpAt,
+		Anon:           string(anon),
+		BackupChecksum: checksum,
+		BackupLSN:      lsn,
+	})
+}
+
+func (c *FakeClient) CreateImageWithOptions(request routes.CreateImageRequest) (models.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Image{}, c.Err
+	}
+
+	image := models.NewImage(request.BackedUpAt, request.Anon, request.Shards)
+	image.ID = c.newID()
+	image.BackupChecksum = request.BackupChecksum
+	image.BackupLSN = request.BackupLSN
+	if request.DropDatabases != nil {
+		image.DropDatabases = request.DropDatabases
+	}
+	if request.RenameDatabases != nil {
+		image.RenameDatabases = request.RenameDatabases
+	}
+	if request.Workers != nil {
+		image.Workers = request.Workers
+	}
+	image.Encoding = request.Encoding
+	image.Locale = request.Locale
+
+	c.images = append(c.images, image)
+	c.publishImage(client.EventCreated, image)
+	return image, nil
+}
+
+// UploadImage appends everything read from r to the image's upload
+func (c *FakeClient) UploadImage(ctx context.Context, imageID int, r io.Reader) error {
+	var upload bytes.Buffer
+	if _, err := io.Copy(&upload, r); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return c.Err
+	}
+
+	idx, err := c.findImage(strconv.Itoa(imageID))
+	if err != nil {
+		return err
+	}
+	if c.images[idx].Ready || c.images[idx].IsSharded() || c.images[idx].IsDistributed() {
+		return apiError(api.ImageUploadUnavailableError)
+	}
+
+	if c.uploads == nil {
+		c.uploads = map[int][]byte{}
+	}
+	c.uploads[imageID] = append(c.uploads[imageID], upload.Bytes()...)
+	return nil
+}
+
+// UploadImageStream records everything read from r as the image's upload, which
+// must be empty, as the fake can't receive btrfs send streams
+func (c *FakeClient) UploadImageStream(ctx context.Context, imageID int, r io.Reader) error {
+	var stream bytes.Buffer
+	if _, err := io.Copy(&stream, r); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return c.Err
+	}
+
+	idx, err := c.findImage(strconv.Itoa(imageID))
+	if err != nil {
+		return err
+	}
+	if c.images[idx].Ready || c.images[idx].IsSharded() || c.images[idx].IsDistributed() {
+		return apiError(api.ImageUploadUnavailableError)
+	}
+	if len(c.uploads[imageID]) > 0 {
+		return apiError(api.UploadConflictError("upload already has data in it"))
+	}
+
+	if c.uploads == nil {
+		c.uploads = map[int][]byte{}
+	}
+	c.uploads[imageID] = stream.Bytes()
+	return nil
+}
+
+func (c *FakeClient) FinaliseImage(imageID int) (models.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Image{}, c.Err
+	}
+
+	idx, err := c.findImage(strconv.Itoa(imageID))
+	if err != nil {
+		return models.Image{}, err
+	}
+
+	c.images[idx].Ready = true
+	c.images[idx].UpdatedAt = time.Now()
+	c.publishImage(client.EventUpdated, c.images[idx])
+	return c.images[idx], nil
+}
+
+func (c *FakeClient) WaitForImageReady(ctx context.Context, imageID int, pollInterval time.Duration) (models.Image, error) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		image, err := c.GetImage(strconv.Itoa(imageID))
+		if err != nil || image.Ready {
+			return image, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return image, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForImageFinalised waits for the image to be ready, as the fake's
+// finalisations never fail
+func (c *FakeClient) WaitForImageFinalised(ctx context.Context, imageID int, policy client.WaitPolicy) (models.Image, error) {
+	var image models.Image
+	err := policy.Poll(ctx, func() (bool, error) {
+		var err error
+		image, err = c.GetImage(strconv.Itoa(imageID))
+		return image.Ready, err
+	})
+	return image, err
+}
+
+// PublishImage creates, uploads and finalises an image in turn, as the fake's
+// finalisations finish before FinaliseImage returns
+func (c *FakeClient) PublishImage(ctx context.Context, request routes.CreateImageRequest, tarball io.Reader, policy client.WaitPolicy) (models.Image, error) {
+	if len(request.Shards) > 0 {
+		return models.Image{}, errors.New("sharded images can't be published from a single tarball")
+	}
+	if len(request.Workers) > 0 {
+		return models.Image{}, errors.New("distributed images can't be published from a single tarball")
+	}
+
+	image, err := c.CreateImageWithOptions(request)
+	if err != nil {
+		return image, err
+	}
+	if err := c.UploadImage(ctx, image.ID, tarball); err != nil {
+		return image, err
+	}
+
+	finalised, err := c.FinaliseImage(image.ID)
+	if err != nil {
+		return image, err
+	}
+	return finalised, nil
+}
+
+// VerifyImage verifies any ready image that has a snapshot checksum, as the
+// fake's snapshots never change
+func (c *FakeClient) VerifyImage(imageID int) (models.ImageVerification, error) {
+	image, err := c.GetImage(strconv.Itoa(imageID))
+	if err != nil {
+		return models.ImageVerification{}, err
+	}
+	if !image.Ready {
+		return models.ImageVerification{}, apiError(api.UnreadyImageError)
+	}
+
+	snapshot := models.ImageInspection{Checksum: image.SnapshotChecksum, ReadOnly: true}
+	return models.NewImageVerification(image, snapshot), nil
+}
+
+// GetImageTimeline returns no phases, as images aren't really baked
+func (c *FakeClient) GetImageTimeline(imageID int) ([]models.BakeSpan, error) {
+	if _, err := c.GetImage(strconv.Itoa(imageID)); err != nil {
+		return nil, err
+	}
+	return []models.BakeSpan{}, nil
+}
+
+// ListFreshness returns no statuses, as the fake has no freshness SLAs
+func (c *FakeClient) ListFreshness() ([]models.FreshnessStatus, error) {
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	return []models.FreshnessStatus{}, nil
+}
+
+// ListStaleImages returns no images, as the fake has no anonymisation specs
+func (c *FakeClient) ListStaleImages() ([]models.StaleImage, error) {
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	return []models.StaleImage{}, nil
+}
+
+func (c *FakeClient) GetImageManifest(imageID int) (models.ImageManifest, error) {
+	if _, err := c.GetImage(strconv.Itoa(imageID)); err != nil {
+		return models.ImageManifest{}, err
+	}
+	return models.ImageManifest{}, apiError(api.ManifestNotFoundError)
+}
+
+// GetImageFile returns an empty file for each of models.ImageFileNames, as the
+// fake's images have no snapshots
+func (c *FakeClient) GetImageFile(imageID int, name string) (models.ImageFile, error) {
+	image, err := c.GetImage(strconv.Itoa(imageID))
+	if err != nil {
+		return models.ImageFile{}, err
+	}
+	if !models.IsImageFileName(name) {
+		return models.ImageFile{}, apiError(api.ImageFileNotAllowedError(
+			"only these files can be read from images: " + strings.Join(models.ImageFileNames, ", "),
+		))
+	}
+	if !image.Ready {
+		return models.ImageFile{}, apiError(api.UnreadyImageError)
+	}
+	return models.ImageFile{ID: name, ImageID: imageID}, nil
+}
+
+// SendImage writes the image's upload to w, as there's no snapshot to send.
+// The parent is chosen from parentIDs as the server would choose it.
+func (c *FakeClient) SendImage(ctx context.Context, imageID int, parentIDs []int, w io.Writer) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return 0, c.Err
+	}
+	idx, err := c.findImage(strconv.Itoa(imageID))
+	if err != nil {
+		return 0, err
+	}
+	image := c.images[idx]
+	if !image.Ready {
+		return 0, apiError(api.UnreadyImageError)
+	}
+
+	var candidates []models.Image
+	for _, parentID := range parentIDs {
+		if idx, err := c.findImage(strconv.Itoa(parentID)); err == nil {
+			candidates = append(candidates, c.images[idx])
+		}
+	}
+	parent, _ := routes.SendParent(image, candidates)
+
+	_, err = w.Write(c.uploads[imageID])
+	return parent.ID, err
+}
+
+func (c *FakeClient) VerifyImageManifest(imageID int, key ed25519.PublicKey) (models.ImageManifest, error) {
+	return c.GetImageManifest(imageID)
+}
+
+func (c *FakeClient) AnnotateImage(image models.Image, patch models.Annotations) (models.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Image{}, c.Err
+	}
+
+	idx, err := c.findImage(strconv.Itoa(image.ID))
+	if err != nil {
+		return models.Image{}, err
+	}
+
+	annotations, err := annotate(c.images[idx].Annotations, patch)
+	if err != nil {
+		return models.Image{}, err
+	}
+
+	c.images[idx].Annotations = annotations
+	c.images[idx].UpdatedAt = time.Now()
+	c.publishImage(client.EventUpdated, c.images[idx])
+	return c.images[idx], nil
+}
+
+func (c *FakeClient) LabelImage(image models.Image, patch models.Labels) (models.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Image{}, c.Err
+	}
+
+	idx, err := c.findImage(strconv.Itoa(image.ID))
+	if err != nil {
+		return models.Image{}, err
+	}
+
+	labels, err := label(c.images[idx].Labels, patch)
+	if err != nil {
+		return models.Image{}, err
+	}
+
+	c.images[idx].Labels = labels
+	c.images[idx].UpdatedAt = time.Now()
+	c.publishImage(client.EventUpdated, c.images[idx])
+	return c.images[idx], nil
+}
+
+func (c *FakeClient) DestroyImage(image models.Image) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return c.Err
+	}
+
+	idx, err := c.findImage(strconv.Itoa(image.ID))
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range c.instances {
+		if instance.ImageID == image.ID {
+			return apiError(api.CannotDeleteImageWithInstancesError)
+		}
+	}
+
+	destroyed := c.images[idx]
+	c.images = append(c.images[:idx], c.images[idx+1:]...)
+	delete(c.uploads, image.ID)
+	c.publishImage(client.EventDestroyed, destroyed)
+	return nil
+}
+
+func (c *FakeClient) PruneImages(olderThan time.Duration, keepLast int, dryRun bool) ([]models.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	if olderThan < 0 || keepLast < 0 || (olderThan == 0 && keepLast == 0) {
+		return nil, apiError(api.InvalidPruneError("older_than or keep_last must be given"))
+	}
+
+	policy := reclaim.PrunePolicy{OlderThan: olderThan, KeepLast: keepLast}
+	pruned := policy.Images(c.images, c.instances, time.Now())
+	if dryRun {
+		return pruned, nil
+	}
+
+	for _, image := range pruned {
+		idx, err := c.findImage(strconv.Itoa(image.ID))
+		if err != nil {
+			return nil, err
+		}
+		c.images = append(c.images[:idx], c.images[idx+1:]...)
+		delete(c.uploads, image.ID)
+		c.publishImage(client.EventDestroyed, image)
+	}
+	return pruned, nil
+}
+
+func (c *FakeClient) WatchImages(ctx context.Context) (<-chan client.ImageEvent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+
+	watcher := make(chan client.ImageEvent, watchBuffer)
+	c.imageWatchers = append(c.imageWatchers, watcher)
+
+	go func() {
+		<-ctx.Done()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.imageWatchers = closeImageWatcher(c.imageWatchers, watcher)
+	}()
+
+	return watcher, nil
+}
+
+func (c *FakeClient) GetInstance(id string) (models.Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Instance{}, c.Err
+	}
+
+	idx, err := c.findInstance(id)
+	if err != nil {
+		return models.Instance{}, err
+	}
+	return c.instances[idx], nil
+}
+
+// GetInstanceDiagnostics diagnoses the instance as though nothing is running in
+// it, as fake instances have no sessions
+func (c *FakeClient) GetInstanceDiagnostics(id string) (models.InstanceDiagnostics, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.InstanceDiagnostics{}, c.Err
+	}
+
+	idx, err := c.findInstance(id)
+	if err != nil {
+		return models.InstanceDiagnostics{}, err
+	}
+	return models.DiagnoseInstance(c.instances[idx], models.InstanceActivity{IOPressure: -1}, 0), nil
+}
+
+func (c *FakeClient) ListInstances(opts client.ListOptions) ([]models.Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+
+	instances := []models.Instance{}
+	for _, instance := range c.instances {
+		instance.Status = instanceStatus(instance, time.Now())
+		if opts.Filter.ImageID > 0 && instance.ImageID != opts.Filter.ImageID {
+			continue
+		}
+		if user := opts.Filter.User; user != "" && user != "me" && user != instance.UserEmail {
+			continue
+		}
+		if opts.Filter.Static && instance.StaticName == "" {
+			continue
+		}
+		if len(opts.Filter.Statuses) > 0 && !models.ContainsString(opts.Filter.Statuses, instance.Status) {
+			continue
+		}
+		if !instance.Labels.Matches(opts.Filter.Labels) {
+			continue
+		}
+		instances = append(instances, instance)
+	}
+
+	err := sortList(instances, opts.Sort, store.InstanceSortFields, func(field string, descending bool, i, j int) int {
+		a, b := instances[i], instances[j]
+		switch field {
+		case "image_id":
+			return compareInts(a.ImageID, b.ImageID, descending)
+		case "created_at":
+			return compareTimes(&a.CreatedAt, &b.CreatedAt, descending)
+		case "updated_at":
+			return compareTimes(&a.UpdatedAt, &b.UpdatedAt, descending)
+		case "expires_at":
+			return compareTimes(a.ExpiresAt, b.ExpiresAt, descending)
+		default:
+			return compareInts(a.ID, b.ID, descending)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := page(opts, len(instances))
+	return instances[start:end], nil
+}
+
+// GetInstanceSummary counts the instances like the server does for the upload
+// user, as the fake doesn't restrict instances to their owners
+func (c *FakeClient) GetInstanceSummary() ([]models.InstanceCount, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+
+	byStatus := map[string]int{}
+	byOwner := map[string]int{}
+	for _, instance := range c.instances {
+		byStatus[instanceStatus(instance, time.Now())]++
+		byOwner[instance.UserEmail]++
+	}
+
+	counts := []models.InstanceCount{}
+	for _, status := range models.InstanceStatuses {
+		counts = append(counts, models.NewInstanceCount(models.InstanceCountByStatus, status, byStatus[status]))
+	}
+
+	owners := make([]string, 0, len(byOwner))
+	for owner := range byOwner {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		counts = append(counts, models.NewInstanceCount(models.InstanceCountByOwner, owner, byOwner[owner]))
+	}
+	return counts, nil
+}
+
+func (c *FakeClient) CreateInstance(image models.Image) (models.Instance, error) {
+	return c.createInstance(image, false, false)
+}
+
+func (c *FakeClient) CreateStandbyInstance(image models.Image) (models.Instance, error) {
+	return c.createInstance(image, true, false)
+}
+
+func (c *FakeClient) CreateSchemaOnlyInstance(image models.Image) (models.Instance, error) {
+	return c.createInstance(image, false, true)
+}
+
+func (c *FakeClient) createInstance(image models.Image, standby bool, schemaOnly bool) (models.Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Instance{}, c.Err
+	}
+
+	idx, err := c.findImage(strconv.Itoa(image.ID))
+	if err != nil {
+		return models.Instance{}, apiError(api.ImageNotFoundError)
+	}
+	if !c.images[idx].Ready {
+		return models.Instance{}, apiError(api.UnreadyImageError)
+	}
+
+	return c.addInstance(image, standby, schemaOnly, time.Now()), nil
+}
+
+// addInstance creates an instance of the image, which must exist and be ready
+func (c *FakeClient) addInstance(image models.Image, standby bool, schemaOnly bool, now time.Time) models.Instance {
+	if c.nextPort < c.MinInstancePort {
+		c.nextPort = c.MinInstancePort
+	}
+
+	instance := models.Instance{
+		ID:          c.newID(),
+		Hostname:    c.Hostname,
+		ImageID:     image.ID,
+		UserEmail:   c.UserEmail,
+		Port:        c.nextPort,
+		Standby:     standby,
+		SchemaOnly:  schemaOnly,
+		Annotations: models.Annotations{},
+		Labels:      models.Labels{},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if c.InstanceTTL > 0 {
+		expiresAt := now.Add(c.InstanceTTL)
+		instance.ExpiresAt = &expiresAt
+	}
+	instance.Status = instanceStatus(instance, now)
+	c.nextPort++
+
+	c.instances = append(c.instances, instance)
+	c.publishInstance(client.EventCreated, instance)
+	return instance
+}
+
+func (c *FakeClient) PromoteInstance(instance models.Instance) (models.Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Instance{}, c.Err
+	}
+
+	idx, err := c.findInstance(strconv.Itoa(instance.ID))
+	if err != nil {
+		return models.Instance{}, err
+	}
+	if !c.instances[idx].Standby {
+		return models.Instance{}, apiError(api.InstanceNotStandbyError)
+	}
+
+	c.instances[idx].Standby = false
+	c.instances[idx].UpdatedAt = time.Now()
+	c.instances[idx].Status = instanceStatus(c.instances[idx], time.Now())
+	c.publishInstance(client.EventUpdated, c.instances[idx])
+	return c.instances[idx], nil
+}
+
+func (c *FakeClient) ExtendInstance(instance models.Instance, by time.Duration) (models.Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Instance{}, c.Err
+	}
+
+	idx, err := c.findInstance(strconv.Itoa(instance.ID))
+	if err != nil {
+		return models.Instance{}, err
+	}
+	if by <= 0 {
+		return models.Instance{}, apiError(api.InvalidExtensionError)
+	}
+
+	expiresAt := c.instances[idx].ExpiresAt
+	if expiresAt == nil {
+		return models.Instance{}, apiError(api.InstanceNeverExpiresError)
+	}
+
+	from := time.Now()
+	if expiresAt.After(from) {
+		from = *expiresAt
+	}
+	extended := from.Add(by)
+
+	c.instances[idx].ExpiresAt = &extended
+	c.instances[idx].UpdatedAt = time.Now()
+	c.publishInstance(client.EventUpdated, c.instances[idx])
+	return c.instances[idx], nil
+}
+
+// RunMaintenance always succeeds without any output, unless the instance is a
+// standby
+func (c *FakeClient) RunMaintenance(instance models.Instance, database, operation string, args map[string]string) (models.MaintenanceResult, error) {
+	found, err := c.GetInstance(strconv.Itoa(instance.ID))
+	if err != nil {
+		return models.MaintenanceResult{}, err
+	}
+	if found.Standby {
+		return models.MaintenanceResult{}, apiError(api.InstanceIsStandbyError)
+	}
+
+	return models.MaintenanceResult{ID: instance.ID, Operation: operation, Database: database}, nil
+}
+
+func (c *FakeClient) AnnotateInstance(instance models.Instance, patch models.Annotations) (models.Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Instance{}, c.Err
+	}
+
+	idx, err := c.findInstance(strconv.Itoa(instance.ID))
+	if err != nil {
+		return models.Instance{}, err
+	}
+
+	annotations, err := annotate(c.instances[idx].Annotations, patch)
+	if err != nil {
+		return models.Instance{}, err
+	}
+
+	c.instances[idx].Annotations = annotations
+	c.instances[idx].UpdatedAt = time.Now()
+	c.publishInstance(client.EventUpdated, c.instances[idx])
+	return c.instances[idx], nil
+}
+
+func (c *FakeClient) LabelInstance(instance models.Instance, patch models.Labels) (models.Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Instance{}, c.Err
+	}
+
+	idx, err := c.findInstance(strconv.Itoa(instance.ID))
+	if err != nil {
+		return models.Instance{}, err
+	}
+
+	labels, err := label(c.instances[idx].Labels, patch)
+	if err != nil {
+		return models.Instance{}, err
+	}
+
+	c.instances[idx].Labels = labels
+	c.instances[idx].UpdatedAt = time.Now()
+	c.publishInstance(client.EventUpdated, c.instances[idx])
+	return c.instances[idx], nil
+}
+
+func (c *FakeClient) DestroyInstance(instance models.Instance) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return c.Err
+	}
+
+	idx, err := c.findInstance(strconv.Itoa(instance.ID))
+	if err != nil {
+		return err
+	}
+
+	destroyed := c.instances[idx]
+	c.instances = append(c.instances[:idx], c.instances[idx+1:]...)
+	c.publishInstance(client.EventDestroyed, destroyed)
+	return nil
+}
+
+func (c *FakeClient) CreateCleanupToken(instanceIDs []int, validFor time.Duration) (models.CleanupToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.CleanupToken{}, c.Err
+	}
+	if len(instanceIDs) == 0 {
+		return models.CleanupToken{}, apiError(api.InvalidCleanupTokenRequestError("instance_ids must list at least one instance"))
+	}
+	if validFor == 0 {
+		validFor = routes.DefaultCleanupTokenLifetime
+	}
+
+	token := models.CleanupToken{UserEmail: c.UserEmail, CreatedAt: time.Now()}
+	token.ExpiresAt = token.CreatedAt.Add(validFor)
+	for _, id := range instanceIDs {
+		if _, err := c.findInstance(strconv.Itoa(id)); err != nil {
+			return models.CleanupToken{}, err
+		}
+		token.InstanceIDs = append(token.InstanceIDs, strconv.Itoa(id))
+	}
+
+	secret, err := models.NewCleanupTokenSecret()
+	if err != nil {
+		return models.CleanupToken{}, err
+	}
+
+	token.ID = c.newID()
+	if c.cleanupTokens == nil {
+		c.cleanupTokens = map[string]models.CleanupToken{}
+	}
+	c.cleanupTokens[secret] = token
+
+	token.Token = secret
+	return token, nil
+}
+
+// UseCleanupToken destroys the instances of a cleanup token created by
+// CreateCleanupToken, skipping those that have already been destroyed
+func (c *FakeClient) UseCleanupToken(secret string) (models.CleanupToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.CleanupToken{}, c.Err
+	}
+
+	token, ok := c.cleanupTokens[secret]
+	if !ok || token.UsedAt != nil || !time.Now().Before(token.ExpiresAt) {
+		return models.CleanupToken{}, apiError(api.InvalidCleanupTokenError)
+	}
+	now := time.Now()
+	token.UsedAt = &now
+	c.cleanupTokens[secret] = token
+
+	token.DestroyedInstanceIDs = []string{}
+	for _, id := range token.InstanceIDs {
+		idx, err := c.findInstance(id)
+		if err != nil {
+			continue
+		}
+		destroyed := c.instances[idx]
+		c.instances = append(c.instances[:idx], c.instances[idx+1:]...)
+		c.publishInstance(client.EventDestroyed, destroyed)
+		token.DestroyedInstanceIDs = append(token.DestroyedInstanceIDs, id)
+	}
+	return token, nil
+}
+
+// CreateInstanceGroup creates an instance of each image, and of the latest
+// ready image of each family, once every image has been checked
+func (c *FakeClient) CreateInstanceGroup(imageIDs []int, families []string) (models.InstanceGroup, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.InstanceGroup{}, c.Err
+	}
+	if len(imageIDs)+len(families) == 0 {
+		return models.InstanceGroup{}, apiError(api.InvalidInstanceGroupError("image_ids or families must list at least one image"))
+	}
+	if len(imageIDs)+len(families) > routes.MaxInstanceGroupSize {
+		return models.InstanceGroup{}, apiError(api.InvalidInstanceGroupError("groups can have at most 10 instances"))
+	}
+
+	images := make([]models.Image, 0, len(imageIDs)+len(families))
+	for _, id := range imageIDs {
+		idx, err := c.findImage(strconv.Itoa(id))
+		if err != nil {
+			return models.InstanceGroup{}, apiError(api.ImageNotFoundError)
+		}
+		images = append(images, c.images[idx])
+	}
+
+	latest := freshness.Latest(c.images)
+	for _, family := range families {
+		image, ok := latest[family]
+		if !ok {
+			return models.InstanceGroup{}, apiError(api.NoReadyImageError(family))
+		}
+		images = append(images, image)
+	}
+
+	for _, image := range images {
+		if !image.Ready {
+			return models.InstanceGroup{}, apiError(api.UnreadyImageError)
+		}
+	}
+
+	now := time.Now()
+	instances := make([]models.Instance, 0, len(images))
+	for _, image := range images {
+		instances = append(instances, c.addInstance(image, false, false, now))
+	}
+
+	group := models.NewInstanceGroup(c.UserEmail, instances)
+	group.ID = c.newID()
+
+	stored := group
+	stored.Instances = nil
+	c.instanceGroups = append(c.instanceGroups, stored)
+	return group, nil
+}
+
+// ListInstanceGroups returns the groups that still have instances
+func (c *FakeClient) ListInstanceGroups() ([]models.InstanceGroup, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+
+	groups := make([]models.InstanceGroup, 0, len(c.instanceGroups))
+	for _, group := range c.instanceGroups {
+		group.Instances = c.groupInstances(group)
+		if len(group.Instances) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+func (c *FakeClient) GetInstanceGroup(id int) (models.InstanceGroup, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.InstanceGroup{}, c.Err
+	}
+
+	idx, err := c.findInstanceGroup(id)
+	if err != nil {
+		return models.InstanceGroup{}, err
+	}
+
+	group := c.instanceGroups[idx]
+	group.Instances = c.groupInstances(group)
+	return group, nil
+}
+
+// ExtendInstanceGroup extends each of the group's instances, as ExtendInstance
+// does, to the same time
+func (c *FakeClient) ExtendInstanceGroup(group models.InstanceGroup, by time.Duration) (models.InstanceGroup, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.InstanceGroup{}, c.Err
+	}
+
+	idx, err := c.findInstanceGroup(group.ID)
+	if err != nil {
+		return models.InstanceGroup{}, err
+	}
+	if by <= 0 {
+		return models.InstanceGroup{}, apiError(api.InvalidExtensionError)
+	}
+
+	expiresAt := c.instanceGroups[idx].ExpiresAt
+	if expiresAt == nil {
+		return models.InstanceGroup{}, apiError(api.InstanceNeverExpiresError)
+	}
+
+	from := time.Now()
+	if expiresAt.After(from) {
+		from = *expiresAt
+	}
+	extended := from.Add(by)
+
+	c.instanceGroups[idx].ExpiresAt = &extended
+	for _, id := range c.instanceGroups[idx].InstanceIDs {
+		if instanceIdx, err := c.findInstance(id); err == nil {
+			c.instances[instanceIdx].ExpiresAt = &extended
+			c.instances[instanceIdx].UpdatedAt = time.Now()
+			c.publishInstance(client.EventUpdated, c.instances[instanceIdx])
+		}
+	}
+
+	group = c.instanceGroups[idx]
+	group.Instances = c.groupInstances(group)
+	return group, nil
+}
+
+func (c *FakeClient) DestroyInstanceGroup(group models.InstanceGroup) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return c.Err
+	}
+
+	idx, err := c.findInstanceGroup(group.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range c.instanceGroups[idx].InstanceIDs {
+		if instanceIdx, err := c.findInstance(id); err == nil {
+			destroyed := c.instances[instanceIdx]
+			c.instances = append(c.instances[:instanceIdx], c.instances[instanceIdx+1:]...)
+			c.publishInstance(client.EventDestroyed, destroyed)
+		}
+	}
+
+	c.instanceGroups = append(c.instanceGroups[:idx], c.instanceGroups[idx+1:]...)
+	return nil
+}
+
+// Search matches each word of the query as a case-insensitive prefix of a word
+// of the images' and the user's instances' labels, shard names, owners and
+// annotations, ranking them in that order, as the server does. Resources whose
+// ID is the whole query come first.
+func (c *FakeClient) Search(query string, limit int) ([]models.SearchResult, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	if strings.TrimSpace(query) == "" {
+		return nil, apiError(api.MissingSearchQueryError)
+	}
+
+	results := []models.SearchResult{}
+	for idx := range c.images {
+		image := c.images[idx]
+		fields := searchFields{
+			{1.0, append(keysAndValues(image.Labels), image.Shards...)},
+			{0.4, []string{image.Uploader}},
+			{0.2, keysAndValues(image.Annotations)},
+		}
+		if score, ok := fields.score(query, image.ID); ok {
+			result := models.NewSearchResult(models.SearchResultImage, image.ID, score)
+			result.Image = &image
+			results = append(results, result)
+		}
+	}
+	for idx := range c.instances {
+		instance := c.instances[idx]
+		if instance.UserEmail != c.UserEmail {
+			continue
+		}
+		instance.Status = instanceStatus(instance, time.Now())
+		fields := searchFields{
+			{1.0, keysAndValues(instance.Labels)},
+			{0.4, []string{instance.UserEmail}},
+			{0.2, keysAndValues(instance.Annotations)},
+		}
+		if score, ok := fields.score(query, instance.ID); ok {
+			result := models.NewSearchResult(models.SearchResultInstance, instance.ID, score)
+			result.Instance = &instance
+			results = append(results, result)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	if limit <= 0 {
+		limit = routes.DEFAULT_PAGE_SIZE
+	}
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// searchFields are the texts that a resource is searched by, each with the
+// weight that matches in it are ranked by
+type searchFields []struct {
+	weight float64
+	texts  []string
+}
+
+// score returns the sum, over the words of the query, of the greatest weight of
+// the fields that the word is a prefix of a word of, and whether every word is.
+// The ID matching the whole query adds more than any match of the words can.
+func (f searchFields) score(query string, id int) (float64, bool) {
+	var score float64
+	idMatches := strings.TrimSpace(query) == strconv.Itoa(id)
+	if idMatches {
+		score++
+	}
+
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		best := 0.0
+		for _, field := range f {
+			if field.weight > best && prefixesAny(word, field.texts) {
+				best = field.weight
+			}
+		}
+		if best == 0 && !idMatches {
+			return 0, false
+		}
+		score += best / 10
+	}
+	return score, true
+}
+
+// prefixesAny returns true if the word is a prefix of any word of the texts,
+// which are split into words at anything other than letters, digits, @, . and _
+// and at hyphens, as well as being words whole
+func prefixesAny(word string, texts []string) bool {
+	for _, text := range texts {
+		text = strings.ToLower(text)
+		words := strings.FieldsFunc(text, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("@._-", r))
+		})
+		words = append(words, strings.Split(text, "-")...)
+		for _, candidate := range words {
+			if strings.HasPrefix(candidate, word) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keysAndValues returns the keys of labels or annotations, and their values
+// that are strings
+func keysAndValues(m map[string]interface{}) []string {
+	texts := []string{}
+	for key, value := range m {
+		texts = append(texts, key)
+		if s, ok := value.(string); ok {
+			texts = append(texts, s)
+		}
+	}
+	return texts
+}
+
+// DestroyInstances destroys each of the instances one at a time, skipping
+// those that have already been destroyed, like Client.DestroyInstances. Only
+// WithBulkProgress has any effect.
+func (c *FakeClient) DestroyInstances(ctx context.Context, ids []int, opts ...client.BulkOption) error {
+	return fakeBulk(ctx, "destroy", ids, opts, func(id int) error {
+		instance, err := c.GetInstance(strconv.Itoa(id))
+		if err == nil {
+			err = c.DestroyInstance(instance)
+		}
+		if err == errNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+func (c *FakeClient) DestroyAllMyInstances(ctx context.Context, opts ...client.BulkOption) error {
+	instances, err := c.ListInstances(client.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int, 0, len(instances))
+	for _, instance := range instances {
+		ids = append(ids, instance.ID)
+	}
+	return c.DestroyInstances(ctx, ids, opts...)
+}
+
+// RefreshInstances gets each of the instances one at a time, like
+// Client.RefreshInstances
+func (c *FakeClient) RefreshInstances(ctx context.Context, ids []int, opts ...client.BulkOption) ([]models.Instance, error) {
+	instances := make([]models.Instance, 0, len(ids))
+	err := fakeBulk(ctx, "refresh", ids, opts, func(id int) error {
+		instance, err := c.GetInstance(strconv.Itoa(id))
+		if err == nil {
+			instances = append(instances, instance)
+		}
+		return err
+	})
+	return instances, err
+}
+
+// fakeBulk calls fn for each of the instances in turn, reporting progress and
+// collecting failures like the real client's bulk operations
+func fakeBulk(ctx context.Context, operation string, ids []int, opts []client.BulkOption, fn func(int) error) error {
+	progress := client.BulkProgressOf(opts)
+
+	failures := map[int]error{}
+	for i, id := range ids {
+		err := ctx.Err()
+		if err == nil {
+			err = fn(id)
+		}
+		if err != nil {
+			failures[id] = err
+		}
+		if progress != nil {
+			progress(client.BulkProgress{ID: id, Err: err, Completed: i + 1, Total: len(ids)})
+		}
+	}
+
+	if len(failures) > 0 {
+		return &client.BulkError{Operation: operation, Errors: failures}
+	}
+	return nil
+}
+
+func (c *FakeClient) WatchInstances(ctx context.Context) (<-chan client.InstanceEvent, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+
+	watcher := make(chan client.InstanceEvent, watchBuffer)
+	c.instanceWatchers = append(c.instanceWatchers, watcher)
+
+	go func() {
+		<-ctx.Done()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.instanceWatchers = closeInstanceWatcher(c.instanceWatchers, watcher)
+	}()
+
+	return watcher, nil
+}
+
+// ProxyInstance connects to InstanceProxy over an in-memory pipe. It fails if
+// InstanceProxy isn't set, as there's no instance to connect to.
+func (c *FakeClient) ProxyInstance(ctx context.Context, instanceID int) (io.ReadWriteCloser, error) {
+	instance, err := c.GetInstance(strconv.Itoa(instanceID))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.InstanceProxy == nil {
+		return nil, errors.New("fake client has no instance proxy")
+	}
+
+	conn, instanceConn := net.Pipe()
+	go c.InstanceProxy(instance, instanceConn)
+	return conn, nil
+}
+
+// StreamInstanceLog writes a single line for the instance, as the fake's
+// instances have no Postgres servers. Given follow, it then waits for the
+// context to be done.
+func (c *FakeClient) StreamInstanceLog(ctx context.Context, instanceID int, lines int, follow bool, w io.Writer) error {
+	if _, err := c.GetInstance(strconv.Itoa(instanceID)); err != nil {
+		return err
+	}
+
+	if lines > 0 {
+		if _, err := fmt.Fprintln(w, "LOG:  database system is ready to accept connections"); err != nil {
+			return err
+		}
+	}
+	if follow {
+		<-ctx.Done()
+	}
+	return nil
+}
+
+// Whoami returns UserEmail as a user with no image quota, and counts their
+// instances
+func (c *FakeClient) Whoami() (models.User, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.User{}, c.Err
+	}
+
+	user := models.User{
+		ID:            c.UserEmail,
+		Roles:         []string{models.RoleUser},
+		ImageCooldown: "0s",
+	}
+	for _, instance := range c.instances {
+		if instance.UserEmail == c.UserEmail {
+			user.Instances++
+		}
+	}
+	return user, nil
+}
+
+// CreateBreakGlassGrant grants the user access to the upload of an image that
+// isn't ready. As the fake has no other users, it's granted by UserEmail.
+func (c *FakeClient) CreateBreakGlassGrant(userEmail string, imageID int, reason string, validFor time.Duration) (models.BreakGlassGrant, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.BreakGlassGrant{}, c.Err
+	}
+	if userEmail == "" {
+		return models.BreakGlassGrant{}, apiError(api.InvalidBreakGlassGrantError("user_email must name the user to grant access to"))
+	}
+	if strings.TrimSpace(reason) == "" {
+		return models.BreakGlassGrant{}, apiError(api.InvalidBreakGlassGrantError("reason must say why access is needed"))
+	}
+	if validFor < 0 || validFor > routes.MaxBreakGlassGrantLifetime {
+		return models.BreakGlassGrant{}, apiError(api.InvalidBreakGlassGrantError("valid_for must be a positive duration of at most 8h"))
+	}
+	if validFor == 0 {
+		validFor = routes.DefaultBreakGlassGrantLifetime
+	}
+
+	idx, err := c.findImage(strconv.Itoa(imageID))
+	if err != nil {
+		return models.BreakGlassGrant{}, err
+	}
+	if c.images[idx].Ready {
+		return models.BreakGlassGrant{}, apiError(api.UploadFinalisedError)
+	}
+
+	grant := models.BreakGlassGrant{
+		ID:        c.newID(),
+		UserEmail: userEmail,
+		ImageID:   imageID,
+		Reason:    reason,
+		GrantedBy: c.UserEmail,
+		CreatedAt: time.Now(),
+	}
+	grant.ExpiresAt = grant.CreatedAt.Add(validFor)
+	c.breakGlassGrants = append(c.breakGlassGrants, grant)
+	return grant, nil
+}
+
+// ListBreakGlassGrants returns every grant, newest first. Grants that have
+// expired are returned as revoked by models.BreakGlassExpiry, as the server's
+// sweeper would eventually record them.
+func (c *FakeClient) ListBreakGlassGrants() ([]models.BreakGlassGrant, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+
+	now := time.Now()
+	grants := make([]models.BreakGlassGrant, 0, len(c.breakGlassGrants))
+	for i := len(c.breakGlassGrants) - 1; i >= 0; i-- {
+		grant := c.breakGlassGrants[i]
+		if grant.RevokedAt == nil && !grant.Active(now) {
+			expiresAt := grant.ExpiresAt
+			grant.RevokedAt = &expiresAt
+			grant.RevokedBy = models.BreakGlassExpiry
+		}
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
+
+// RevokeBreakGlassGrant revokes a grant that's still active
+func (c *FakeClient) RevokeBreakGlassGrant(id int) (models.BreakGlassGrant, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.BreakGlassGrant{}, c.Err
+	}
+
+	now := time.Now()
+	for idx, grant := range c.breakGlassGrants {
+		if grant.ID == id && grant.Active(now) {
+			grant.RevokedAt = &now
+			grant.RevokedBy = c.UserEmail
+			c.breakGlassGrants[idx] = grant
+			return grant, nil
+		}
+	}
+	return models.BreakGlassGrant{}, apiError(api.NotFoundError)
+}
+
+// GetImageUploadFile checks that UserEmail has an active grant for the image,
+// as the server would, but never finds the file, as the fake's uploads are
+// kept whole rather than unpacked
+func (c *FakeClient) GetImageUploadFile(imageID int, path string) (models.ImageFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.ImageFile{}, c.Err
+	}
+
+	now := time.Now()
+	granted := false
+	for _, grant := range c.breakGlassGrants {
+		if grant.UserEmail == c.UserEmail && grant.ImageID == imageID && grant.Active(now) {
+			granted = true
+		}
+	}
+	if !granted {
+		return models.ImageFile{}, apiError(api.BreakGlassGrantRequiredError)
+	}
+
+	idx, err := c.findImage(strconv.Itoa(imageID))
+	if err != nil {
+		return models.ImageFile{}, err
+	}
+	if c.images[idx].Ready {
+		return models.ImageFile{}, apiError(api.UploadFinalisedError)
+	}
+	return models.ImageFile{}, apiError(api.ImageFileNotFoundError)
+}
+
+// CreateAccessRequest requests access to a family for UserEmail. As the fake
+// has no config, every family is treated as restricted.
+func (c *FakeClient) CreateAccessRequest(family, reason string, validFor time.Duration) (models.AccessRequest, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.AccessRequest{}, c.Err
+	}
+	if family == "" {
+		return models.AccessRequest{}, apiError(api.InvalidAccessRequestError("family must name a restricted image family"))
+	}
+	if strings.TrimSpace(reason) == "" {
+		return models.AccessRequest{}, apiError(api.InvalidAccessRequestError("reason must say why access is needed"))
+	}
+	if validFor < 0 || validFor > routes.MaxAccessRequestLifetime {
+		return models.AccessRequest{}, apiError(api.InvalidAccessRequestError("valid_for must be a positive duration of at most 168h"))
+	}
+	if validFor == 0 {
+		validFor = routes.DefaultAccessRequestLifetime
+	}
+
+	request := models.AccessRequest{
+		ID:        c.newID(),
+		UserEmail: c.UserEmail,
+		Family:    family,
+		Reason:    reason,
+		ValidFor:  validFor.String(),
+		Status:    models.AccessRequestPending,
+		CreatedAt: time.Now(),
+	}
+	c.accessRequests = append(c.accessRequests, request)
+	return request, nil
+}
+
+// ListAccessRequests returns every request, newest first
+func (c *FakeClient) ListAccessRequests() ([]models.AccessRequest, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+
+	requests := make([]models.AccessRequest, 0, len(c.accessRequests))
+	for i := len(c.accessRequests) - 1; i >= 0; i-- {
+		requests = append(requests, c.accessRequests[i])
+	}
+	return requests, nil
+}
+
+func (c *FakeClient) GetAccessRequest(id int) (models.AccessRequest, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.AccessRequest{}, c.Err
+	}
+
+	for _, request := range c.accessRequests {
+		if request.ID == id {
+			return request, nil
+		}
+	}
+	return models.AccessRequest{}, apiError(api.NotFoundError)
+}
+
+// ApproveAccessRequest approves a pending request. As the fake has no other
+// users, it's approved by UserEmail, even though the server doesn't let users
+// approve their own requests.
+func (c *FakeClient) ApproveAccessRequest(id int) (models.AccessRequest, error) {
+	return c.decideAccessRequest(id, models.AccessRequestApproved)
+}
+
+// DenyAccessRequest denies a pending request, by UserEmail
+func (c *FakeClient) DenyAccessRequest(id int) (models.AccessRequest, error) {
+	return c.decideAccessRequest(id, models.AccessRequestDenied)
+}
+
+func (c *FakeClient) decideAccessRequest(id int, status string) (models.AccessRequest, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.AccessRequest{}, c.Err
+	}
+
+	for idx, request := range c.accessRequests {
+		if request.ID != id {
+			continue
+		}
+		if request.Status != models.AccessRequestPending {
+			return models.AccessRequest{}, apiError(api.AccessRequestDecidedError)
+		}
+
+		now := time.Now()
+		request.Status = status
+		request.DecidedBy = c.UserEmail
+		request.DecidedAt = &now
+		if status == models.AccessRequestApproved {
+			validFor, err := time.ParseDuration(request.ValidFor)
+			if err != nil {
+				return models.AccessRequest{}, err
+			}
+			expiresAt := now.Add(validFor)
+			request.ExpiresAt = &expiresAt
+		}
+		c.accessRequests[idx] = request
+		return request, nil
+	}
+	return models.AccessRequest{}, apiError(api.NotFoundError)
+}
+
+// RestartInstance checks the runbook action like the server does, then returns
+// the instance, as the fake's instances have no postgres to restart
+func (c *FakeClient) RestartInstance(id int, reason, confirm string) (models.Instance, error) {
+	return c.runbookInstanceAction(id, routes.RunbookRestart, reason, confirm)
+}
+
+// RotateInstanceCredentials checks the runbook action like the server does,
+// then returns the instance, as the fake's instances have no certificates
+func (c *FakeClient) RotateInstanceCredentials(id int, reason, confirm string) (models.Instance, error) {
+	return c.runbookInstanceAction(id, routes.RunbookRotateCredentials, reason, confirm)
+}
+
+func (c *FakeClient) runbookInstanceAction(id int, action, reason, confirm string) (models.Instance, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Instance{}, c.Err
+	}
+	if strings.TrimSpace(reason) == "" {
+		return models.Instance{}, apiError(api.InvalidRunbookActionError("reason must say why the action is being taken"))
+	}
+
+	idx, err := c.findInstance(strconv.Itoa(id))
+	if err != nil {
+		return models.Instance{}, err
+	}
+	if confirmation := routes.RunbookConfirmation(action, "instance", id); confirm != confirmation {
+		return models.Instance{}, apiError(api.ConfirmationRequiredError(confirmation))
+	}
+	return c.instances[idx], nil
+}
+
+// RequeueOperation checks the runbook action like the server does. As the
+// fake's operations always succeed, none of them can be requeued.
+func (c *FakeClient) RequeueOperation(id int, reason, confirm string) (models.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Operation{}, c.Err
+	}
+	if strings.TrimSpace(reason) == "" {
+		return models.Operation{}, apiError(api.InvalidRunbookActionError("reason must say why the action is being taken"))
+	}
+
+	for _, operation := range c.operations {
+		if operation.ID == id {
+			return models.Operation{}, apiError(api.RunbookActionUnavailableError(
+				fmt.Sprintf("operation %d is %s, and only failed operations can be requeued", id, operation.Status),
+			))
+		}
+	}
+	return models.Operation{}, apiError(api.NotFoundError)
+}
+
+// CreateAccessToken returns a token derived from the state, as there's no
+// OAuth provider to exchange it with
+func (c *FakeClient) CreateAccessToken(state string) (oauth2.Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return oauth2.Token{}, c.Err
+	}
+
+	return oauth2.Token{
+		AccessToken:  "fake-access-token-" + state,
+		RefreshToken: "fake-refresh-token-" + state,
+		TokenType:    "Bearer",
+		Expiry:       time.Now().Add(time.Hour),
+	}, nil
+}
+
+// ExchangeToken returns a token derived from the identity token, as there's no
+// cloud provider to verify it with
+func (c *FakeClient) ExchangeToken(provider, token string) (oauth2.Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return oauth2.Token{}, c.Err
+	}
+
+	exchanged := models.ExchangedTokenPrefix + provider + "-" + token
+	return oauth2.Token{
+		AccessToken:  exchanged,
+		RefreshToken: exchanged,
+		TokenType:    "Bearer",
+		Expiry:       time.Now().Add(time.Hour),
+	}, nil
+}
+
+// CreateDeviceAuthorization returns an authorization with fixed codes, as
+// there's no user to enter them
+func (c *FakeClient) CreateDeviceAuthorization() (models.DeviceAuthorization, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.DeviceAuthorization{}, c.Err
+	}
+
+	return models.DeviceAuthorization{
+		ID:                      "fake-device-code",
+		UserCode:                "BCDF-GHJK",
+		VerificationURI:         "https://draupnir.example.com/device",
+		VerificationURIComplete: "https://draupnir.example.com/device?user_code=BCDF-GHJK",
+		ExpiresIn:               600,
+		Interval:                5,
+	}, nil
+}
+
+// WaitForDeviceToken returns a token derived from the device code immediately,
+// as if the user had already signed in
+func (c *FakeClient) WaitForDeviceToken(ctx context.Context, authorization models.DeviceAuthorization) (oauth2.Token, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return oauth2.Token{}, c.Err
+	}
+
+	return oauth2.Token{
+		AccessToken:  "fake-access-token-" + authorization.ID,
+		RefreshToken: "fake-refresh-token-" + authorization.ID,
+		TokenType:    "Bearer",
+		Expiry:       time.Now().Add(time.Hour),
+	}, nil
+}
+
+// FinaliseImageAsync finalises the image before it returns, as FinaliseImage
+// does, returning an operation that has succeeded
+func (c *FakeClient) FinaliseImageAsync(imageID int) (models.Operation, error) {
+	if _, err := c.FinaliseImage(imageID); err != nil {
+		return models.Operation{}, err
+	}
+	return c.addOperation(models.JobFinaliseImage, "images", imageID), nil
+}
+
+// DestroyImageAsync destroys the image before it returns, as DestroyImage
+// does, returning an operation that has succeeded
+func (c *FakeClient) DestroyImageAsync(image models.Image) (models.Operation, error) {
+	if err := c.DestroyImage(image); err != nil {
+		return models.Operation{}, err
+	}
+	return c.addOperation(models.JobDestroyImage, "images", image.ID), nil
+}
+
+// DestroyInstanceAsync destroys the instance before it returns, as
+// DestroyInstance does, returning an operation that has succeeded
+func (c *FakeClient) DestroyInstanceAsync(instance models.Instance) (models.Operation, error) {
+	if err := c.DestroyInstance(instance); err != nil {
+		return models.Operation{}, err
+	}
+	return c.addOperation(models.JobDestroyInstance, "instances", instance.ID), nil
+}
+
+func (c *FakeClient) addOperation(kind, resourceType string, resourceID int) models.Operation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	operation := models.Operation{
+		ID:           len(c.operations) + 1,
+		Kind:         kind,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		Status:       models.JobSucceeded,
+		StartedAt:    now,
+		FinishedAt:   &now,
+	}
+	c.operations = append(c.operations, operation)
+	return operation
+}
+
+func (c *FakeClient) GetOperation(id int) (models.Operation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.Operation{}, c.Err
+	}
+	for _, operation := range c.operations {
+		if operation.ID == id {
+			return operation, nil
+		}
+	}
+	return models.Operation{}, apiError(api.NotFoundError)
+}
+
+// WaitForOperation returns the operation, as the fake's operations finish
+// before they're returned
+func (c *FakeClient) WaitForOperation(ctx context.Context, id int, policy client.WaitPolicy) (models.Operation, error) {
+	return c.GetOperation(id)
+}
+
+func (c *FakeClient) ListFederatedServers() ([]models.FederatedServer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	return append([]models.FederatedServer{}, c.FederatedServers...), nil
+}
+
+// ServerVersion reports the client's own version, with Features
+func (c *FakeClient) ServerVersion() (models.ServerVersion, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Err != nil {
+		return models.ServerVersion{}, c.Err
+	}
+	return models.ServerVersion{
+		ID:       version.Version,
+		Features: append([]string{}, c.Features...),
+	}, nil
+}
+
+func (c *FakeClient) Supports(feature string) (bool, error) {
+	serverVersion, err := c.ServerVersion()
+	if err != nil {
+		return false, err
+	}
+	return serverVersion.Supports(feature), nil
+}
+
+// newID returns the next ID. Images and instances share a sequence, so that
+// tests can't accidentally pass by confusing one with the other.
+func (c *FakeClient) newID() int {
+	c.nextID++
+	return c.nextID
+}
+
+// errNotFound is returned when an image or instance doesn't exist, as the real
+// client would return it
+var errNotFound = apiError(api.NotFoundError)
+
+func (c *FakeClient) findImage(id string) (int, error) {
+	for idx, image := range c.images {
+		if strconv.Itoa(image.ID) == id {
+			return idx, nil
+		}
+	}
+	return 0, errNotFound
+}
+
+func (c *FakeClient) findInstance(id string) (int, error) {
+	for idx, instance := range c.instances {
+		if strconv.Itoa(instance.ID) == id {
+			return idx, nil
+		}
+	}
+	return 0, errNotFound
+}
+
+func (c *FakeClient) findInstanceGroup(id int) (int, error) {
+	for idx, group := range c.instanceGroups {
+		if group.ID == id {
+			return idx, nil
+		}
+	}
+	return 0, errNotFound
+}
+
+// groupInstances returns the group's instances that haven't been destroyed
+func (c *FakeClient) groupInstances(group models.InstanceGroup) []*models.Instance {
+	instances := make([]*models.Instance, 0, len(group.InstanceIDs))
+	for _, id := range group.InstanceIDs {
+		if idx, err := c.findInstance(id); err == nil {
+			instance := c.instances[idx]
+			instances = append(instances, &instance)
+		}
+	}
+	return instances
+}
+
+// publishImage sends the event to every image watcher. Watchers that have
+// fallen behind are closed.
+func (c *FakeClient) publishImage(eventType string, image models.Image) {
+	for _, watcher := range c.imageWatchers {
+		select {
+		case watcher <- client.ImageEvent{Type: eventType, Image: image}:
+		default:
+			c.imageWatchers = closeImageWatcher(c.imageWatchers, watcher)
+		}
+	}
+}
+
+// publishInstance sends the event to every instance watcher, in the same way
+// as publishImage
+func (c *FakeClient) publishInstance(eventType string, instance models.Instance) {
+	for _, watcher := range c.instanceWatchers {
+		select {
+		case watcher <- client.InstanceEvent{Type: eventType, Instance: instance}:
+		default:
+			c.instanceWatchers = closeInstanceWatcher(c.instanceWatchers, watcher)
+		}
+	}
+}
+
+// closeImageWatcher closes the watcher and removes it from the watchers, if it
+// hasn't been already
+func closeImageWatcher(watchers []chan client.ImageEvent, watcher chan client.ImageEvent) []chan client.ImageEvent {
+	remaining := []chan client.ImageEvent{}
+	for _, w := range watchers {
+		if w == watcher {
+			close(w)
+			continue
+		}
+		remaining = append(remaining, w)
+	}
+	return remaining
+}
+
+// closeInstanceWatcher behaves like closeImageWatcher
+func closeInstanceWatcher(watchers []chan client.InstanceEvent, watcher chan client.InstanceEvent) []chan client.InstanceEvent {
+	remaining := []chan client.InstanceEvent{}
+	for _, w := range watchers {
+		if w == watcher {
+			close(w)
+			continue
+		}
+		remaining = append(remaining, w)
+	}
+	return remaining
+}
+
+// annotate returns the annotations with the patch applied, as the server does
+func annotate(annotations models.Annotations, patch models.Annotations) (models.Annotations, error) {
+	if err := patch.ValidatePatch(); err != nil {
+		return nil, apiError(api.InvalidAnnotationsError)
+	}
+
+	patched := models.Annotations{}
+	for key, value := range annotations {
+		patched[key] = value
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(patched, key)
+		} else {
+			patched[key] = value
+		}
+	}
+	return patched, nil
+}
+
+func label(labels models.Labels, patch models.Labels) (models.Labels, error) {
+	if err := patch.ValidatePatch(); err != nil {
+		return nil, apiError(api.InvalidLabelsError)
+	}
+
+	patched := models.Labels{}
+	for key, value := range labels {
+		patched[key] = value
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(patched, key)
+		} else {
+			patched[key] = value
+		}
+	}
+	return patched, nil
+}
+
+// apiError formats the error in the same way as the real client does when it
+// receives it from the server
+// instanceStatus derives the instance's status like the server does. The fake
+// destroys instances immediately, so they're never destroying.
+func instanceStatus(instance models.Instance, now time.Time) string {
+	switch {
+	case instance.ExpiresAt != nil && !now.Before(*instance.ExpiresAt):
+		return models.InstanceExpired
+	case instance.Standby:
+		return models.InstanceStandby
+	default:
+		return models.InstanceRunning
+	}
+}
+
+func apiError(err api.Error) error {
+	return fmt.Errorf("%s (%s)", err.Title, err.Detail)
+}
+
+// sortList sorts a list by the comma separated fields of order, each prefixed
+// with - for descending order, rejecting fields that aren't allowed like the
+// server does. compare compares a field of the ith and jth items of the list,
+// returning a negative number if the ith comes first in the given direction.
+func sortList(list interface{}, order string, allowed []string, compare func(field string, descending bool, i, j int) int) error {
+	if order == "" {
+		return nil
+	}
+
+	fields := strings.Split(order, ",")
+	for _, field := range fields {
+		if !models.ContainsString(allowed, strings.TrimPrefix(field, "-")) {
+			return apiError(api.InvalidSortError(fmt.Sprintf("cannot sort by %s", strings.TrimPrefix(field, "-"))))
+		}
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		for _, field := range fields {
+			if c := compare(strings.TrimPrefix(field, "-"), strings.HasPrefix(field, "-"), i, j); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+// compareInts and compareTimes compare values in ascending or descending order.
+// Missing times come last in either direction, like the server's.
+func compareInts(a, b int, descending bool) int {
+	c := a - b
+	if descending {
+		c = -c
+	}
+	return c
+}
+
+func compareTimes(a, b *time.Time, descending bool) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+
+	c := 0
+	if a.Before(*b) {
+		c = -1
+	} else if a.After(*b) {
+		c = 1
+	}
+	if descending {
+		c = -c
+	}
+	return c
+}
+
+// page returns the bounds of the requested page of a list of the given length
+func page(opts client.ListOptions, length int) (int, int) {
+	if opts.Limit <= 0 {
+		return 0, length
+	}
+
+	pageNumber := opts.Page
+	if pageNumber < 1 {
+		pageNumber = 1
+	}
+
+	start := (pageNumber - 1) * opts.Limit
+	if start > length {
+		start = length
+	}
+	end := start + opts.Limit
+	if end > length {
+		end = length
+	}
+	return start, end
+}
@@ -0,0 +1,540 @@
+package clientfakes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/client"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClientImageLifecycle(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+
+	_, err := fake.GetLatestImage()
+	assert.EqualError(t, err, "no images available")
+
+	image, err := fake.CreateImage(time.Now(), []byte("UPDATE users SET email = 'anon'"))
+	assert.Nil(t, err)
+	assert.False(t, image.Ready)
+
+	_, err = fake.CreateInstance(image)
+	assert.EqualError(t, err, "Image Not Ready (The specified image is not ready to be used)")
+
+	image, err = fake.FinaliseImage(image.ID)
+	assert.Nil(t, err)
+	assert.True(t, image.Ready)
+
+	latest, err := fake.GetLatestImage()
+	assert.Nil(t, err)
+	assert.Equal(t, image, latest)
+
+	instance, err := fake.CreateInstance(image)
+	assert.Nil(t, err)
+	assert.Equal(t, image.ID, instance.ImageID)
+	assert.Equal(t, "test@draupnir", instance.UserEmail)
+	assert.Equal(t, uint16(5432), instance.Port)
+
+	err = fake.DestroyImage(image)
+	assert.EqualError(t, err, "Image Has Instances (Cannot delete an image that has instances)")
+
+	assert.Nil(t, fake.DestroyInstance(instance))
+	assert.Nil(t, fake.DestroyImage(image))
+
+	_, err = fake.GetImage(strconv.Itoa(image.ID))
+	assert.EqualError(t, err, "Resource Not Found (The resource you requested could not be found)")
+}
+
+func TestFakeClientListInstances(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	image1 := fake.AddImage(models.Image{Ready: true})
+	image2 := fake.AddImage(models.Image{Ready: true})
+
+	for _, image := range []models.Image{image1, image2, image2} {
+		_, err := fake.CreateInstance(image)
+		assert.Nil(t, err)
+	}
+
+	instances, err := fake.ListInstances(client.ListOptions{Filter: client.Filter{ImageID: image2.ID}})
+	assert.Nil(t, err)
+	assert.Len(t, instances, 2)
+
+	instances, err = fake.ListInstances(client.ListOptions{Page: 2, Limit: 2})
+	assert.Nil(t, err)
+	assert.Len(t, instances, 1)
+	assert.Equal(t, uint16(5434), instances[0].Port)
+
+	instances, err = fake.ListInstances(client.ListOptions{Sort: "-image_id,id"})
+	assert.Nil(t, err)
+	if assert.Len(t, instances, 3) {
+		assert.Equal(t, []int{image2.ID, image2.ID, image1.ID}, []int{instances[0].ImageID, instances[1].ImageID, instances[2].ImageID})
+		assert.True(t, instances[0].ID < instances[1].ID)
+	}
+
+	_, err = fake.ListInstances(client.ListOptions{Sort: "hostname"})
+	assert.NotNil(t, err)
+}
+
+func TestFakeClientSchemaOnlyInstance(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	image := fake.AddImage(models.Image{Ready: true})
+
+	instance, err := fake.CreateSchemaOnlyInstance(image)
+	assert.Nil(t, err)
+	assert.True(t, instance.SchemaOnly)
+	assert.False(t, instance.Standby)
+
+	instance, err = fake.GetInstance(strconv.Itoa(instance.ID))
+	assert.Nil(t, err)
+	assert.True(t, instance.SchemaOnly)
+}
+
+func TestFakeClientPromoteInstance(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	image := fake.AddImage(models.Image{Ready: true})
+
+	instance, err := fake.CreateStandbyInstance(image)
+	assert.Nil(t, err)
+	assert.True(t, instance.Standby)
+
+	standbys, err := fake.ListInstances(client.ListOptions{Filter: client.Filter{Statuses: []string{models.InstanceStandby}}})
+	assert.Nil(t, err)
+	assert.Len(t, standbys, 1)
+
+	instance, err = fake.PromoteInstance(instance)
+	assert.Nil(t, err)
+	assert.False(t, instance.Standby)
+	assert.Equal(t, models.InstanceRunning, instance.Status)
+
+	counts, err := fake.GetInstanceSummary()
+	assert.Nil(t, err)
+	assert.Contains(t, counts, models.NewInstanceCount(models.InstanceCountByStatus, models.InstanceRunning, 1))
+	assert.Contains(t, counts, models.NewInstanceCount(models.InstanceCountByStatus, models.InstanceStandby, 0))
+	assert.Contains(t, counts, models.NewInstanceCount(models.InstanceCountByOwner, "test@draupnir", 1))
+
+	_, err = fake.PromoteInstance(instance)
+	assert.NotNil(t, err)
+}
+
+func TestFakeClientExtendInstance(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	image := fake.AddImage(models.Image{Ready: true})
+
+	instance, err := fake.CreateInstance(image)
+	assert.Nil(t, err)
+	assert.Nil(t, instance.ExpiresAt)
+
+	_, err = fake.ExtendInstance(instance, time.Hour)
+	assert.EqualError(t, err, "Instance Never Expires (The instance has no expiry to extend)")
+
+	fake.InstanceTTL = time.Hour
+	instance, err = fake.CreateInstance(image)
+	assert.Nil(t, err)
+	expiresAt := *instance.ExpiresAt
+
+	instance, err = fake.ExtendInstance(instance, 4*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, expiresAt.Add(4*time.Hour), *instance.ExpiresAt)
+
+	_, err = fake.ExtendInstance(instance, -time.Hour)
+	assert.NotNil(t, err)
+}
+
+func TestFakeClientPruneImages(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	old := fake.AddImage(models.Image{Ready: true, BackedUpAt: time.Now().Add(-60 * 24 * time.Hour)})
+	inUse := fake.AddImage(models.Image{Ready: true, BackedUpAt: time.Now().Add(-50 * 24 * time.Hour)})
+	fake.AddImage(models.Image{Ready: true, BackedUpAt: time.Now()})
+
+	_, err := fake.CreateInstance(inUse)
+	assert.Nil(t, err)
+
+	pruned, err := fake.PruneImages(30*24*time.Hour, 0, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []models.Image{old}, pruned)
+
+	images, _ := fake.ListImages(client.ListOptions{})
+	assert.Len(t, images, 3)
+
+	pruned, err = fake.PruneImages(30*24*time.Hour, 0, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []models.Image{old}, pruned)
+
+	images, _ = fake.ListImages(client.ListOptions{})
+	assert.Len(t, images, 2)
+
+	_, err = fake.PruneImages(0, 0, false)
+	assert.NotNil(t, err)
+}
+
+func TestFakeClientCleanupTokens(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	image := fake.AddImage(models.Image{Ready: true})
+
+	first, err := fake.CreateInstance(image)
+	assert.Nil(t, err)
+	second, err := fake.CreateInstance(image)
+	assert.Nil(t, err)
+	kept, err := fake.CreateInstance(image)
+	assert.Nil(t, err)
+
+	token, err := fake.CreateCleanupToken([]int{first.ID, second.ID}, time.Hour)
+	assert.Nil(t, err)
+	assert.Contains(t, token.Token, models.CleanupTokenPrefix)
+
+	assert.Nil(t, fake.DestroyInstance(second))
+
+	used, err := fake.UseCleanupToken(token.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{strconv.Itoa(first.ID)}, used.DestroyedInstanceIDs)
+
+	instances, _ := fake.ListInstances(client.ListOptions{})
+	assert.Equal(t, []models.Instance{kept}, instances)
+
+	_, err = fake.UseCleanupToken(token.Token)
+	assert.EqualError(t, err, "Invalid Cleanup Token (The cleanup token doesn't exist, has expired, or has already been used)")
+}
+
+func TestFakeClientBreakGlassGrants(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	upload := fake.AddImage(models.Image{})
+	ready := fake.AddImage(models.Image{Ready: true})
+
+	_, err := fake.GetImageUploadFile(upload.ID, "backup_label")
+	assert.EqualError(t, err, "Break-Glass Grant Required (Reading an image's upload requires an active break-glass grant for the image, which only an admin can give)")
+
+	_, err = fake.CreateBreakGlassGrant("test@draupnir", upload.ID, "", time.Hour)
+	assert.EqualError(t, err, "Invalid Break-Glass Grant (reason must say why access is needed)")
+
+	_, err = fake.CreateBreakGlassGrant("test@draupnir", ready.ID, "INC-123", time.Hour)
+	assert.EqualError(t, err, "Upload Finalised (The image has been finalised, so its upload has been anonymised and can no longer be read)")
+
+	grant, err := fake.CreateBreakGlassGrant("test@draupnir", upload.ID, "INC-123", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, routes.DefaultBreakGlassGrantLifetime, grant.ExpiresAt.Sub(grant.CreatedAt))
+
+	_, err = fake.GetImageUploadFile(upload.ID, "backup_label")
+	assert.EqualError(t, err, "Image File Not Found (The image has no such file)")
+
+	revoked, err := fake.RevokeBreakGlassGrant(grant.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "test@draupnir", revoked.RevokedBy)
+
+	_, err = fake.RevokeBreakGlassGrant(grant.ID)
+	assert.NotNil(t, err)
+
+	grants, err := fake.ListBreakGlassGrants()
+	assert.Nil(t, err)
+	if assert.Len(t, grants, 1) {
+		assert.NotNil(t, grants[0].RevokedAt)
+	}
+}
+
+func TestFakeClientAccessRequests(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+
+	_, err := fake.CreateAccessRequest("payments", "", time.Hour)
+	assert.EqualError(t, err, "Invalid Access Request (reason must say why access is needed)")
+
+	request, err := fake.CreateAccessRequest("payments", "INC-123", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, models.AccessRequestPending, request.Status)
+	assert.Equal(t, routes.DefaultAccessRequestLifetime.String(), request.ValidFor)
+
+	approved, err := fake.ApproveAccessRequest(request.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, models.AccessRequestApproved, approved.Status)
+	assert.True(t, approved.Active(time.Now()))
+
+	_, err = fake.DenyAccessRequest(request.ID)
+	assert.EqualError(t, err, "Access Request Decided (The access request has already been approved or denied)")
+
+	got, err := fake.GetAccessRequest(request.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, approved, got)
+
+	requests, err := fake.ListAccessRequests()
+	assert.Nil(t, err)
+	assert.Len(t, requests, 1)
+}
+
+func TestFakeClientRunbook(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+
+	image := fake.AddImage(models.Image{Ready: true})
+	instance, err := fake.CreateInstance(image)
+	assert.Nil(t, err)
+
+	_, err = fake.RestartInstance(instance.ID, "", "")
+	assert.EqualError(t, err, "Invalid Runbook Action (reason must say why the action is being taken)")
+
+	_, err = fake.RestartInstance(instance.ID, "INC-123", "")
+	assert.EqualError(t, err, fmt.Sprintf(
+		"Confirmation Required (To go ahead, send the request again with confirm set to \"restart instance %d\")", instance.ID,
+	))
+
+	restarted, err := fake.RestartInstance(instance.ID, "INC-123", fmt.Sprintf("restart instance %d", instance.ID))
+	assert.Nil(t, err)
+	assert.Equal(t, instance.ID, restarted.ID)
+
+	_, err = fake.RotateInstanceCredentials(instance.ID, "INC-123", fmt.Sprintf("rotate_credentials instance %d", instance.ID))
+	assert.Nil(t, err)
+
+	operation, err := fake.DestroyInstanceAsync(instance)
+	assert.Nil(t, err)
+
+	_, err = fake.RequeueOperation(operation.ID, "INC-123", fmt.Sprintf("requeue operation %d", operation.ID))
+	assert.EqualError(t, err, fmt.Sprintf(
+		"Runbook Action Unavailable (operation %d is succeeded, and only failed operations can be requeued)", operation.ID,
+	))
+}
+
+func TestFakeClientErr(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	fake.Err = errors.New("connection refused")
+
+	_, err := fake.ListImages(client.ListOptions{})
+	assert.EqualError(t, err, "connection refused")
+
+	_, err = fake.GetLatestImage()
+	assert.EqualError(t, err, "connection refused")
+}
+
+func TestFakeClientAnnotateInstance(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	image := fake.AddImage(models.Image{Ready: true})
+
+	instance, err := fake.CreateInstance(image)
+	assert.Nil(t, err)
+
+	instance, err = fake.AnnotateInstance(instance, models.Annotations{"owner": "payments"})
+	assert.Nil(t, err)
+	assert.Equal(t, "payments", instance.Annotations["owner"])
+
+	instance, err = fake.AnnotateInstance(instance, models.Annotations{"owner": nil})
+	assert.Nil(t, err)
+	assert.NotContains(t, instance.Annotations, "owner")
+}
+
+func TestFakeClientSearch(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	labelled := fake.AddImage(models.Image{Ready: true, Labels: models.Labels{"cluster": "payments-eu"}})
+	annotated := fake.AddImage(models.Image{Ready: true, Annotations: models.Annotations{"note": "copied from payments"}})
+	fake.AddImage(models.Image{Ready: true, Shards: []string{"reporting"}})
+
+	instance, err := fake.CreateInstance(labelled)
+	assert.Nil(t, err)
+
+	results, err := fake.Search("pay", 0)
+	assert.Nil(t, err)
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, labelled.ID, results[0].ResourceID, "labels rank above annotations")
+		assert.Equal(t, annotated.ID, results[1].ResourceID)
+		assert.NotNil(t, results[1].Image)
+	}
+
+	results, err = fake.Search(strconv.Itoa(instance.ID), 1)
+	assert.Nil(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, models.SearchResultInstance, results[0].ResourceType)
+		assert.Equal(t, instance.ID, results[0].Instance.ID)
+	}
+
+	results, err = fake.Search("payments reporting", 0)
+	assert.Nil(t, err)
+	assert.Empty(t, results, "every word must match")
+
+	_, err = fake.Search(" ", 0)
+	assert.NotNil(t, err)
+}
+
+func TestFakeClientLabels(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	image := fake.AddImage(models.Image{Ready: true})
+	fake.AddImage(models.Image{Ready: true})
+
+	image, err := fake.LabelImage(image, models.Labels{"cluster": "payments-eu"})
+	assert.Nil(t, err)
+	assert.Equal(t, "payments-eu", image.Labels["cluster"])
+
+	images, err := fake.ListImages(client.ListOptions{Filter: client.Filter{Labels: map[string]string{"cluster": "payments-eu"}}})
+	assert.Nil(t, err)
+	if assert.Len(t, images, 1) {
+		assert.Equal(t, image.ID, images[0].ID)
+	}
+
+	instance, err := fake.CreateInstance(image)
+	assert.Nil(t, err)
+
+	_, err = fake.LabelInstance(instance, models.Labels{"team": "payments team"})
+	assert.NotNil(t, err)
+
+	instance, err = fake.LabelInstance(instance, models.Labels{"team": "payments"})
+	assert.Nil(t, err)
+
+	instances, err := fake.ListInstances(client.ListOptions{Filter: client.Filter{Labels: map[string]string{"team": "reporting"}}})
+	assert.Nil(t, err)
+	assert.Empty(t, instances)
+
+	instance, err = fake.LabelInstance(instance, models.Labels{"team": nil})
+	assert.Nil(t, err)
+	assert.NotContains(t, instance.Labels, "team")
+}
+
+func TestFakeClientUploadImage(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+
+	image, err := fake.CreateImage(time.Now(), []byte{})
+	assert.Nil(t, err)
+
+	assert.Nil(t, fake.UploadImage(context.Background(), image.ID, strings.NewReader("base")))
+	assert.Nil(t, fake.UploadImage(context.Background(), image.ID, strings.NewReader("backup")))
+	assert.Equal(t, []byte("basebackup"), fake.Upload(image.ID))
+
+	_, err = fake.FinaliseImage(image.ID)
+	assert.Nil(t, err)
+
+	err = fake.UploadImage(context.Background(), image.ID, strings.NewReader("more"))
+	assert.NotNil(t, err)
+}
+
+func TestFakeClientUploadImageStream(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+
+	image, err := fake.CreateImage(time.Now(), []byte{})
+	assert.Nil(t, err)
+
+	assert.Nil(t, fake.UploadImageStream(context.Background(), image.ID, strings.NewReader("stream")))
+	assert.Equal(t, []byte("stream"), fake.Upload(image.ID))
+
+	err = fake.UploadImageStream(context.Background(), image.ID, strings.NewReader("stream"))
+	assert.NotNil(t, err, "streams can't be received into an upload that isn't empty")
+}
+
+func TestFakeClientPublishImage(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+
+	image, err := fake.PublishImage(context.Background(), routes.CreateImageRequest{BackedUpAt: time.Now()}, strings.NewReader("basebackup"), client.DefaultWaitPolicy)
+	assert.Nil(t, err)
+	assert.True(t, image.Ready)
+	assert.Equal(t, []byte("basebackup"), fake.Upload(image.ID))
+
+	_, err = fake.PublishImage(context.Background(), routes.CreateImageRequest{Shards: []string{"a"}}, strings.NewReader(""), client.DefaultWaitPolicy)
+	assert.NotNil(t, err)
+}
+
+func TestFakeClientSendImage(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+
+	previous, err := fake.PublishImage(context.Background(), routes.CreateImageRequest{BackedUpAt: time.Now().Add(-24 * time.Hour)}, strings.NewReader("monday"), client.DefaultWaitPolicy)
+	assert.Nil(t, err)
+	image, err := fake.PublishImage(context.Background(), routes.CreateImageRequest{BackedUpAt: time.Now()}, strings.NewReader("tuesday"), client.DefaultWaitPolicy)
+	assert.Nil(t, err)
+
+	var stream bytes.Buffer
+	parentID, err := fake.SendImage(context.Background(), image.ID, []int{previous.ID}, &stream)
+	assert.Nil(t, err)
+	assert.Equal(t, previous.ID, parentID)
+	assert.Equal(t, "tuesday", stream.String())
+
+	parentID, err = fake.SendImage(context.Background(), previous.ID, []int{image.ID}, &stream)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, parentID, "later images can't be parents")
+}
+
+func TestFakeClientInstanceGroups(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	fake.InstanceTTL = time.Hour
+	payments := fake.AddImage(models.Image{Ready: true, Annotations: models.Annotations{"draupnir/family": "payments"}})
+	ledger := fake.AddImage(models.Image{Ready: true, Annotations: models.Annotations{"draupnir/family": "ledger"}})
+	unready := fake.AddImage(models.Image{})
+
+	group, err := fake.CreateInstanceGroup([]int{payments.ID}, []string{"ledger"})
+	assert.Nil(t, err)
+	if assert.Len(t, group.Instances, 2) {
+		assert.Equal(t, ledger.ID, group.Instances[1].ImageID)
+		assert.Equal(t, group.Instances[0].ExpiresAt, group.Instances[1].ExpiresAt)
+	}
+
+	// Nothing is created unless everything can be
+	_, err = fake.CreateInstanceGroup([]int{payments.ID, unready.ID}, nil)
+	assert.NotNil(t, err)
+	_, err = fake.CreateInstanceGroup(nil, []string{"reporting"})
+	assert.NotNil(t, err)
+	assert.Len(t, fake.Instances(), 2)
+
+	extended, err := fake.ExtendInstanceGroup(group, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, group.ExpiresAt.Add(time.Hour), *extended.ExpiresAt)
+	for _, instance := range fake.Instances() {
+		assert.Equal(t, *extended.ExpiresAt, *instance.ExpiresAt)
+	}
+
+	groups, err := fake.ListInstanceGroups()
+	assert.Nil(t, err)
+	assert.Len(t, groups, 1)
+
+	assert.Nil(t, fake.DestroyInstanceGroup(group))
+	assert.Empty(t, fake.Instances())
+
+	_, err = fake.GetInstanceGroup(group.ID)
+	assert.NotNil(t, err)
+}
+
+func TestFakeClientWhoami(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	image := fake.AddImage(models.Image{Ready: true})
+	_, err := fake.CreateInstance(image)
+	assert.Nil(t, err)
+
+	user, err := fake.Whoami()
+	assert.Nil(t, err)
+	assert.Equal(t, "test@draupnir", user.ID)
+	assert.Equal(t, []string{models.RoleUser}, user.Roles)
+	assert.Equal(t, 1, user.Instances)
+}
+
+func TestFakeClientWatchInstances(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	image := fake.AddImage(models.Image{Ready: true})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := fake.WatchInstances(ctx)
+	assert.Nil(t, err)
+
+	instance, err := fake.CreateInstance(image)
+	assert.Nil(t, err)
+	assert.Nil(t, fake.DestroyInstance(instance))
+
+	assert.Equal(t, client.InstanceEvent{Type: client.EventCreated, Instance: instance}, <-events)
+	assert.Equal(t, client.EventDestroyed, (<-events).Type)
+
+	cancel()
+	_, open := <-events
+	assert.False(t, open)
+}
+
+func TestFakeClientDestroyInstances(t *testing.T) {
+	fake := NewFakeClient("test@draupnir")
+	image := fake.AddImage(models.Image{Ready: true})
+
+	for i := 0; i < 3; i++ {
+		_, err := fake.CreateInstance(image)
+		assert.Nil(t, err)
+	}
+
+	// Instances that don't exist have already been destroyed
+	assert.Nil(t, fake.DestroyInstances(context.Background(), []int{fake.Instances()[0].ID, 999}))
+	assert.Len(t, fake.Instances(), 2)
+
+	assert.Nil(t, fake.DestroyAllMyInstances(context.Background()))
+	assert.Len(t, fake.Instances(), 0)
+}
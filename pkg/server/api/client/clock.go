@@ -0,0 +1,122 @@
+package client
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// DefaultClockSkewThreshold is how far the client's clock may drift from the
+// server's before the warning given to WithClockSkewWarning is called
+const DefaultClockSkewThreshold = 30 * time.Second
+
+// clockSkewTolerance is the skew that's ignored. The Date header only has a
+// resolution of a second, and is set at some point whilst the server handles
+// the request, so smaller skews can't be told apart from noise.
+const clockSkewTolerance = 2 * time.Second
+
+// WithClockSkewWarning calls warn, once, if the server's clock is found to
+// differ from ours by more than DefaultClockSkewThreshold. The skew is how far
+// the server's clock is ahead, so it's negative if ours is ahead.
+func WithClockSkewWarning(warn func(skew time.Duration)) Option {
+	return func(o *clientOptions) {
+		o.clockSkewWarning = warn
+	}
+}
+
+// clock records how far the server's clock is ahead of ours, as measured from
+// the Date header of its most recent response. It's shared by copies of the
+// client. Its methods do nothing on a nil clock, so that the zero Client
+// behaves as if the clocks agreed.
+type clock struct {
+	mu       sync.Mutex
+	skew     time.Duration
+	measured bool
+	warn     func(skew time.Duration)
+	warned   bool
+}
+
+// observe measures the skew from a response that has just been received. The
+// server set its Date header whilst handling the request, which is close enough
+// given the tolerance.
+func (c *clock) observe(resp *http.Response, received time.Time) {
+	if c == nil {
+		return
+	}
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+	// The header is truncated to the second
+	date = date.Add(500 * time.Millisecond)
+	skew := date.Sub(received)
+	if abs(skew) <= clockSkewTolerance {
+		skew = 0
+	}
+
+	c.mu.Lock()
+	c.skew, c.measured = skew, true
+	warn := c.warn != nil && !c.warned && abs(skew) > DefaultClockSkewThreshold
+	if warn {
+		c.warned = true
+	}
+	c.mu.Unlock()
+
+	// Warn without holding the lock, in case the warning makes requests
+	if warn {
+		c.warn(skew)
+	}
+}
+
+func (c *clock) get() (time.Duration, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.skew, c.measured
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// ClockSkew returns how far the server's clock is ahead of ours, as measured
+// from its most recent response, or false if no response has been received
+// yet. Skews of a couple of seconds or less are reported as zero.
+func (c Client) ClockSkew() (time.Duration, bool) {
+	return c.clock.get()
+}
+
+// toLocalTime converts a time set by the server's clock to ours
+func (c Client) toLocalTime(t time.Time) time.Time {
+	skew, _ := c.clock.get()
+	return t.Add(-skew)
+}
+
+// localExpiry converts the expiry of a token issued by the server to our clock,
+// so that it expires when the server considers it to have expired even if our
+// clock is wrong
+func (c Client) localExpiry(token oauth2.Token) oauth2.Token {
+	if !token.Expiry.IsZero() {
+		token.Expiry = c.toLocalTime(token.Expiry)
+	}
+	return token
+}
+
+// responseNow returns the time that the response was sent by the server's
+// clock, for interpreting other times that it set in the response, or our own
+// time if it has no Date header
+func responseNow(resp *http.Response) time.Time {
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		return date
+	}
+	return time.Now()
+}
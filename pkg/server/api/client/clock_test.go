@@ -0,0 +1,108 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// skewedServer serves the handler with a clock that's skew ahead of ours
+func skewedServer(skew time.Duration, handler http.HandlerFunc) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(skew).UTC().Format(http.TimeFormat))
+		handler(w, r)
+	}))
+}
+
+func imageHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": true}}}`)
+}
+
+func TestClockSkew(t *testing.T) {
+	testCases := []struct {
+		name string
+		skew time.Duration
+		// measured is the skew that should be measured, to the nearest second
+		measured time.Duration
+		warned   bool
+	}{
+		{"in sync", 0, 0, false},
+		{"within tolerance", time.Second, 0, false},
+		{"server ahead", 10 * time.Minute, 10 * time.Minute, true},
+		{"server behind", -10 * time.Minute, -10 * time.Minute, true},
+		{"below the warning threshold", 10 * time.Second, 10 * time.Second, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := skewedServer(tc.skew, imageHandler)
+			defer server.Close()
+
+			warnings := []time.Duration{}
+			client := NewClient(server.URL, WithRetryPolicy(NoRetries), WithClockSkewWarning(func(skew time.Duration) {
+				warnings = append(warnings, skew)
+			}))
+
+			_, measured := client.ClockSkew()
+			assert.False(t, measured)
+
+			for i := 0; i < 2; i++ {
+				_, err := client.GetImage("1")
+				assert.Nil(t, err)
+			}
+
+			skew, measured := client.ClockSkew()
+			assert.True(t, measured)
+			assert.True(t, abs(skew-tc.measured) <= time.Second, "measured %s", skew)
+
+			if tc.warned {
+				assert.Equal(t, 1, len(warnings), "the warning is only given once")
+			} else {
+				assert.Empty(t, warnings)
+			}
+		})
+	}
+}
+
+func TestClockSkewOfTheZeroClient(t *testing.T) {
+	_, measured := Client{}.ClockSkew()
+	assert.False(t, measured)
+}
+
+func TestTokenExpiryIsAdjustedForClockSkew(t *testing.T) {
+	// The server's clock is behind ours, so its tokens would otherwise look
+	// like they'd expired as soon as they were issued
+	server := skewedServer(-10*time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/access_tokens", r.URL.Path)
+		expiry := time.Now().Add(-10 * time.Minute).Add(5 * time.Minute).Format(time.RFC3339)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"access_token": "access-token", "refresh_token": "refresh-token", "expiry": %q}`, expiry)
+	})
+	defer server.Close()
+
+	token, err := NewClient(server.URL, WithRetryPolicy(NoRetries)).CreateAccessToken("state")
+	assert.Nil(t, err)
+
+	remaining := time.Until(token.Expiry)
+	assert.True(t, remaining > 4*time.Minute && remaining <= 6*time.Minute, "expires in %s", remaining)
+}
+
+func TestRetryAfterDatesAreReadByTheServersClock(t *testing.T) {
+	server := skewedServer(-10*time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		retryAt := time.Now().Add(-10 * time.Minute).Add(time.Minute)
+		w.Header().Set("Retry-After", retryAt.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	defer server.Close()
+
+	_, err := NewClient(server.URL, WithRetryPolicy(NoRetries)).GetImage("1")
+
+	rateLimited, ok := err.(*ErrRateLimited)
+	if assert.True(t, ok, "expected an *ErrRateLimited, got %v", err) {
+		assert.True(t, rateLimited.RetryAfter > 55*time.Second, "retry after %s", rateLimited.RetryAfter)
+	}
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// WriteInstanceCredentials writes the instance's certificates and key to dir,
+// which should be private to the user, so that Postgres clients can read them
+func WriteInstanceCredentials(instance models.Instance, dir string) (models.CredentialPaths, error) {
+	if instance.Credentials == nil {
+		return models.CredentialPaths{}, errors.New("database credentials are not available")
+	}
+
+	paths := models.CredentialPaths{
+		CACertificate:     filepath.Join(dir, "ca.crt"),
+		ClientCertificate: filepath.Join(dir, "client.crt"),
+		ClientKey:         filepath.Join(dir, "client.key"),
+	}
+
+	if err := ioutil.WriteFile(paths.CACertificate, []byte(instance.Credentials.CACertificate), 0644); err != nil {
+		return paths, fmt.Errorf("failed to write content for %s: %w", paths.CACertificate, err)
+	}
+	if err := ioutil.WriteFile(paths.ClientCertificate, []byte(instance.Credentials.ClientCertificate), 0644); err != nil {
+		return paths, fmt.Errorf("failed to write content for %s: %w", paths.ClientCertificate, err)
+	}
+	if err := ioutil.WriteFile(paths.ClientKey, []byte(instance.Credentials.ClientKey), 0600); err != nil {
+		return paths, fmt.Errorf("failed to write content for %s: %w", paths.ClientKey, err)
+	}
+
+	return paths, nil
+}
+
+// InstanceDSN writes the instance's credentials to dir, and returns a
+// ready-to-use connection URL for one of its databases. The instance must have
+// been returned by CreateInstance, as only it includes the credentials.
+func InstanceDSN(instance models.Instance, database, dir string) (string, error) {
+	paths, err := WriteInstanceCredentials(instance, dir)
+	if err != nil {
+		return "", err
+	}
+
+	return instance.DSN(database, paths), nil
+}
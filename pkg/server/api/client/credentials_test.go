@@ -0,0 +1,60 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestInstanceDSN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	instance := models.Instance{
+		ID:       1,
+		Hostname: "draupnir.example.com",
+		Port:     6543,
+		Credentials: &models.InstanceCredentials{
+			CACertificate:     "ca cert",
+			ClientCertificate: "client cert",
+			ClientKey:         "client key",
+		},
+	}
+
+	dsn, err := InstanceDSN(instance, "my_db", dir)
+	assert.Nil(t, err)
+
+	// The paths contain a space, which must be escaped
+	escapedDir := filepath.ToSlash(dir)
+	assert.Equal(
+		t,
+		"postgresql://draupnir@draupnir.example.com:6543/my_db?"+
+			"sslcert="+url.QueryEscape(escapedDir+"/client.crt")+
+			"&sslkey="+url.QueryEscape(escapedDir+"/client.key")+
+			"&sslmode=verify-ca"+
+			"&sslrootcert="+url.QueryEscape(escapedDir+"/ca.crt"),
+		dsn,
+	)
+
+	key, err := ioutil.ReadFile(filepath.Join(dir, "client.key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "client key", string(key))
+
+	info, err := os.Stat(filepath.Join(dir, "client.key"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestInstanceDSNWithoutCredentials(t *testing.T) {
+	_, err := InstanceDSN(models.Instance{ID: 1}, "my_db", os.TempDir())
+	assert.EqualError(t, err, "database credentials are not available")
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+)
+
+// slowDownIncrement is how much longer to wait between polls each time the
+// server says that we're polling too often, as RFC 8628 requires
+const slowDownIncrement = 5 * time.Second
+
+// CreateDeviceAuthorization starts authenticating without a browser. Show the
+// user the authorization's user code and verification URI, then wait for the
+// token with WaitForDeviceToken while they sign in on another device.
+func (c Client) CreateDeviceAuthorization() (models.DeviceAuthorization, error) {
+	var authorization models.DeviceAuthorization
+	if err := c.negotiation.unsupported(models.FeatureDeviceAuthorization); err != nil {
+		return authorization, err
+	}
+
+	resp, err := c.post("/access_tokens/device", &bytes.Buffer{})
+	if err != nil {
+		return authorization, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return authorization, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &authorization)
+	return authorization, err
+}
+
+type createDeviceTokenRequest struct {
+	DeviceCode string `jsonapi:"attr,device_code"`
+}
+
+// WaitForDeviceToken polls for the token of the device authorization until the
+// user has signed in, the authorization expires or the context is done
+func (c Client) WaitForDeviceToken(ctx context.Context, authorization models.DeviceAuthorization) (oauth2.Token, error) {
+	interval := time.Duration(authorization.Interval) * time.Second
+	expired := time.After(time.Duration(authorization.ExpiresIn) * time.Second)
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-expired:
+			return oauth2.Token{}, fmt.Errorf("the code %s expired before it was entered", authorization.UserCode)
+		case <-ctx.Done():
+			return oauth2.Token{}, ctx.Err()
+		}
+
+		token, code, err := c.createDeviceToken(authorization.ID)
+		switch code {
+		case api.AuthorizationPendingError.Code:
+			continue
+		case api.SlowDownError.Code:
+			interval += slowDownIncrement
+			continue
+		}
+		return token, err
+	}
+}
+
+// createDeviceToken polls for the token once, returning the code of the error
+// if there was one
+func (c Client) createDeviceToken(deviceCode string) (oauth2.Token, string, error) {
+	var token oauth2.Token
+	request := createDeviceTokenRequest{DeviceCode: deviceCode}
+
+	var payload bytes.Buffer
+	err := c.marshal(&payload, &request)
+	if err != nil {
+		return token, "", err
+	}
+
+	resp, err := c.post("/access_tokens/device/token", &payload)
+	if err != nil {
+		return token, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return token, "", err
+		}
+
+		var apiError api.Error
+		if err := json.Unmarshal(body, &apiError); err != nil {
+			return token, "", err
+		}
+		return token, apiError.Code, fmt.Errorf("%s (%s)", apiError.Title, apiError.Detail)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	return c.localExpiry(token), "", err
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestCreateDeviceAuthorization(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/access_tokens/device", r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"data": {"type": "device_authorizations", "id": "the-device-code", "attributes": {
+			"user_code": "BCDF-GHJK",
+			"verification_uri": "https://draupnir.example.com/device",
+			"verification_uri_complete": "https://draupnir.example.com/device?user_code=BCDF-GHJK",
+			"expires_in": 600,
+			"interval": 5
+		}}}`)
+	}))
+	defer server.Close()
+
+	authorization, err := NewClient(server.URL).CreateDeviceAuthorization()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "the-device-code", authorization.ID)
+	assert.Equal(t, "BCDF-GHJK", authorization.UserCode)
+	assert.Equal(t, "https://draupnir.example.com/device", authorization.VerificationURI)
+	assert.Equal(t, 600, authorization.ExpiresIn)
+	assert.Equal(t, 5, authorization.Interval)
+}
+
+func TestWaitForDeviceToken(t *testing.T) {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/access_tokens/device/token", r.URL.Path)
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Contains(t, string(body), `"device_code":"the-device-code"`)
+
+		polls++
+		if polls < 3 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"id": "authorization_pending", "code": "authorization_pending", "status": "400", "title": "Authorization Pending"}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"access_token": "the-access-token", "refresh_token": "the-refresh-token"}`)
+	}))
+	defer server.Close()
+
+	authorization := models.DeviceAuthorization{ID: "the-device-code", ExpiresIn: 600}
+	token, err := NewClient(server.URL).WaitForDeviceToken(context.Background(), authorization)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, polls)
+	assert.Equal(t, "the-refresh-token", token.RefreshToken)
+}
+
+func TestWaitForDeviceTokenWhenAccessDenied(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"id": "access_denied", "code": "access_denied", "status": "400", "title": "Access Denied", "detail": "Signing in with the code failed"}`)
+	}))
+	defer server.Close()
+
+	authorization := models.DeviceAuthorization{ID: "the-device-code", ExpiresIn: 600}
+	_, err := NewClient(server.URL).WaitForDeviceToken(context.Background(), authorization)
+
+	assert.EqualError(t, err, "Access Denied (Signing in with the code failed)")
+}
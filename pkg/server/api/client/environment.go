@@ -0,0 +1,252 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/client/config"
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+const (
+	envURL       = "DRAUPNIR_URL"
+	envToken     = "DRAUPNIR_TOKEN"
+	envTokenFile = "DRAUPNIR_TOKEN_FILE"
+	envKeyFile   = "DRAUPNIR_KEY_FILE"
+	envCACert    = "DRAUPNIR_CA_CERT"
+	envCert      = "DRAUPNIR_CLIENT_CERT"
+	envKey       = "DRAUPNIR_CLIENT_KEY"
+	envTimeout   = "DRAUPNIR_TIMEOUT"
+	// envMaxIdleConns and envIdleConnTimeout tune connection reuse, for CI jobs
+	// that poll the server heavily
+	envMaxIdleConns    = "DRAUPNIR_MAX_IDLE_CONNS"
+	envIdleConnTimeout = "DRAUPNIR_IDLE_CONN_TIMEOUT"
+	// envStrict validates responses strictly, for CI jobs that run against new
+	// server builds
+	envStrict = "DRAUPNIR_STRICT"
+)
+
+// FromEnvironment constructs a client configured by the following environment
+// variables, so that scripts and CI jobs can configure it in the same way
+// everywhere:
+//
+//	DRAUPNIR_URL         The URL of the server, e.g. https://draupnir.example.com
+//	DRAUPNIR_TOKEN       The token to authenticate with
+//	DRAUPNIR_TOKEN_FILE  A file containing the token, as an alternative to
+//	                     DRAUPNIR_TOKEN
+//	DRAUPNIR_KEY_FILE    A service account key file to authenticate with, as
+//	                     an alternative to a token
+//	DRAUPNIR_CA_CERT     A PEM file of CA certificates to verify the server with
+//	DRAUPNIR_CLIENT_CERT A PEM certificate to present to servers that require
+//	                     mutual TLS
+//	DRAUPNIR_CLIENT_KEY  The PEM key of DRAUPNIR_CLIENT_CERT
+//	DRAUPNIR_TIMEOUT     The timeout of each request, e.g. 30s
+//	DRAUPNIR_MAX_IDLE_CONNS
+//	                     How many idle connections to keep open for reuse
+//	DRAUPNIR_IDLE_CONN_TIMEOUT
+//	                     How long to keep idle connections open, e.g. 90s
+//	DRAUPNIR_STRICT      Whether to validate responses against the schemas of
+//	                     the resources that they contain, e.g. true
+//	DRAUPNIR_PROFILE     The CLI profile to use if the URL or token are unset
+//
+// If DRAUPNIR_URL or the token are unset, they're taken from the CLI's config
+// file, as written by `draupnir authenticate`. Any options given are applied
+// after those derived from the environment.
+func FromEnvironment(opts ...Option) (Client, error) {
+	url := os.Getenv(envURL)
+
+	token, err := tokenFromEnvironment()
+	if err != nil {
+		return Client{}, err
+	}
+
+	var cfgOpts []Option
+	if url == "" || token == nil {
+		cfg, err := config.Read()
+		if err != nil {
+			return Client{}, fmt.Errorf("%s is not set, and the CLI config couldn't be read: %s", envURL, err)
+		}
+
+		if url == "" {
+			scheme := "https"
+			if cfg.Insecure {
+				scheme = "http"
+			}
+			url = fmt.Sprintf("%s://%s", scheme, cfg.Domain)
+
+			if cfg.SkipVerify {
+				cfgOpts = append(cfgOpts, WithInsecureSkipVerify())
+			}
+		}
+		if token == nil && cfg.KeyFile != "" {
+			key, err := ReadServiceAccountKey(cfg.KeyFile)
+			if err != nil {
+				return Client{}, err
+			}
+			token = &oauth2.Token{RefreshToken: key.Key}
+		}
+		if token == nil {
+			token = &cfg.Token
+		}
+	}
+
+	envOpts := append([]Option{WithToken(*token)}, cfgOpts...)
+
+	if path := os.Getenv(envCACert); path != "" {
+		pem, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Client{}, fmt.Errorf("failed to read %s: %s", envCACert, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return Client{}, fmt.Errorf("%s contains no PEM certificates: %s", envCACert, path)
+		}
+		envOpts = append(envOpts, WithRootCAs(pool))
+	}
+
+	certOpt, err := clientCertificateFromEnvironment()
+	if err != nil {
+		return Client{}, err
+	}
+	if certOpt != nil {
+		envOpts = append(envOpts, certOpt)
+	}
+
+	if value := os.Getenv(envTimeout); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return Client{}, fmt.Errorf("%s must be a positive duration, e.g. 30s: %q", envTimeout, value)
+		}
+		envOpts = append(envOpts, WithTimeout(timeout))
+	}
+
+	if value := os.Getenv(envMaxIdleConns); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return Client{}, fmt.Errorf("%s must be a positive integer: %q", envMaxIdleConns, value)
+		}
+		envOpts = append(envOpts, WithMaxIdleConns(n))
+	}
+
+	if value := os.Getenv(envIdleConnTimeout); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return Client{}, fmt.Errorf("%s must be a duration, e.g. 90s: %q", envIdleConnTimeout, value)
+		}
+		envOpts = append(envOpts, WithIdleConnTimeout(timeout))
+	}
+
+	if value := os.Getenv(envStrict); value != "" {
+		strict, err := strconv.ParseBool(value)
+		if err != nil {
+			return Client{}, fmt.Errorf("%s must be true or false: %q", envStrict, value)
+		}
+		if strict {
+			envOpts = append(envOpts, WithStrictValidation())
+		}
+	}
+
+	return NewClient(url, append(envOpts, opts...)...), nil
+}
+
+// tokenFromEnvironment returns the token given by DRAUPNIR_TOKEN,
+// DRAUPNIR_TOKEN_FILE or DRAUPNIR_KEY_FILE, or nil if none of them are set
+func tokenFromEnvironment() (*oauth2.Token, error) {
+	value := os.Getenv(envToken)
+	path := os.Getenv(envTokenFile)
+	keyPath := os.Getenv(envKeyFile)
+
+	set := 0
+	for _, v := range []string{value, path, keyPath} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("only one of %s, %s and %s may be set", envToken, envTokenFile, envKeyFile)
+	}
+
+	if path != "" {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s", envTokenFile, err)
+		}
+		value = strings.TrimSpace(string(contents))
+	}
+
+	if keyPath != "" {
+		key, err := ReadServiceAccountKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		value = key.Key
+	}
+
+	if value == "" {
+		return nil, nil
+	}
+
+	// The server exchanges the refresh token for an access token on each
+	// request, so it's what we authenticate with. Service account keys are
+	// sent in its place.
+	return &oauth2.Token{RefreshToken: value}, nil
+}
+
+// ReadServiceAccountKey reads a service account key file, as written by
+// `draupnir service-accounts create-key`. Clients authenticate with its key by
+// giving WithToken a token whose RefreshToken is the key.
+func ReadServiceAccountKey(path string) (models.ServiceAccountKey, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return models.ServiceAccountKey{}, fmt.Errorf("failed to read key file: %s", err)
+	}
+
+	key, err := models.ParseServiceAccountKey(contents)
+	if err != nil {
+		return key, fmt.Errorf("%s: %s", path, err)
+	}
+	return key, nil
+}
+
+// clientCertificateFromEnvironment returns an option that presents the client
+// certificate given by DRAUPNIR_CLIENT_CERT and DRAUPNIR_CLIENT_KEY, or nil if
+// neither is set
+func clientCertificateFromEnvironment() (Option, error) {
+	certPath := os.Getenv(envCert)
+	keyPath := os.Getenv(envKey)
+
+	if certPath == "" && keyPath == "" {
+		return nil, nil
+	}
+
+	if certPath == "" || keyPath == "" {
+		return nil, fmt.Errorf("%s and %s must be set together", envCert, envKey)
+	}
+
+	cert, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", envCert, err)
+	}
+
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", envKey, err)
+	}
+
+	// Check the pair here, so that a mistake is reported immediately rather
+	// than by the first request
+	if _, err := tls.X509KeyPair(cert, key); err != nil {
+		return nil, fmt.Errorf("invalid client certificate in %s: %s", envCert, err)
+	}
+
+	return WithClientCertificate(cert, key), nil
+}
@@ -0,0 +1,203 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestFromEnvironment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "token")
+	assert.Nil(t, ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600))
+
+	restore := setEnvironment(map[string]string{
+		envURL:             "https://draupnir.example.com",
+		envTokenFile:       tokenFile,
+		envTimeout:         "30s",
+		envMaxIdleConns:    "64",
+		envIdleConnTimeout: "5m",
+		envStrict:          "true",
+	})
+	defer restore()
+
+	client, err := FromEnvironment(WithRetryPolicy(NoRetries))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "https://draupnir.example.com", client.url)
+	assert.Equal(t, "secret", client.token.RefreshToken)
+	assert.Equal(t, 30*time.Second, client.client.Timeout)
+	transport := client.client.Transport.(*http.Transport)
+	assert.Equal(t, 64, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 5*time.Minute, transport.IdleConnTimeout)
+	assert.Equal(t, NoRetries, client.retryPolicy)
+	assert.True(t, client.strict)
+}
+
+func TestFromEnvironmentFallsBackToConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config := "Domain = \"draupnir.example.com\"\n\n[Token]\nRefreshToken = \"from-config\"\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".draupnir.staging"), []byte(config), 0600))
+
+	restore := setEnvironment(map[string]string{
+		"HOME":             dir,
+		"DRAUPNIR_PROFILE": "staging",
+	})
+	defer restore()
+
+	client, err := FromEnvironment()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "https://draupnir.example.com", client.url)
+	assert.Equal(t, "from-config", client.token.RefreshToken)
+}
+
+func TestFromEnvironmentFallsBackToProfileInConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	config := "Domain = \"draupnir.example.com\"\n\n[Profiles.dev]\nDomain = \"localhost:8080\"\nInsecure = true\n"
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".draupnir"), []byte(config), 0600))
+
+	restore := setEnvironment(map[string]string{
+		"HOME":             dir,
+		"DRAUPNIR_PROFILE": "dev",
+	})
+	defer restore()
+
+	client, err := FromEnvironment()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "http://localhost:8080", client.url)
+}
+
+func TestFromEnvironmentWithKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key.json")
+	key := `{"type": "draupnir_service_account_key", "service_account": "ci", "key": "dsa_secret"}`
+	assert.Nil(t, ioutil.WriteFile(keyFile, []byte(key), 0600))
+
+	restore := setEnvironment(map[string]string{envURL: "https://draupnir.example.com", envKeyFile: keyFile})
+	defer restore()
+
+	client, err := FromEnvironment()
+	assert.Nil(t, err)
+	assert.Equal(t, "dsa_secret", client.token.RefreshToken)
+
+	// The CLI's config may name the key file instead
+	config := fmt.Sprintf("Domain = \"draupnir.example.com\"\nKeyFile = %q\n", keyFile)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, ".draupnir"), []byte(config), 0600))
+
+	restore = setEnvironment(map[string]string{"HOME": dir})
+	defer restore()
+
+	client, err = FromEnvironment()
+	assert.Nil(t, err)
+	assert.Equal(t, "dsa_secret", client.token.RefreshToken)
+}
+
+func TestReadServiceAccountKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "key.json")
+	generated, err := models.NewServiceAccountKey("ci")
+	assert.Nil(t, err)
+	contents, _ := json.Marshal(generated)
+	assert.Nil(t, ioutil.WriteFile(path, contents, 0600))
+
+	key, err := ReadServiceAccountKey(path)
+	assert.Nil(t, err)
+	assert.Equal(t, generated, key)
+	assert.Equal(t, 64, len(key.Hash()))
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"type": "service_account", "client_email": "ci@example.iam.gserviceaccount.com"}`), 0600))
+	_, err = ReadServiceAccountKey(path)
+	assert.EqualError(t, err, path+`: not a service account key file: its type is "service_account" rather than "draupnir_service_account_key"`)
+}
+
+func TestFromEnvironmentErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "draupnir")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		name string
+		vars map[string]string
+	}{
+		{"no URL or config", map[string]string{envToken: "secret"}},
+		{"both token variables", map[string]string{envURL: "https://d", envToken: "a", envTokenFile: "b"}},
+		{"token and key file", map[string]string{envURL: "https://d", envToken: "a", envKeyFile: "b"}},
+		{"missing key file", map[string]string{envURL: "https://d", envKeyFile: filepath.Join(dir, "key.json")}},
+		{"invalid timeout", map[string]string{envURL: "https://d", envToken: "a", envTimeout: "soon"}},
+		{"invalid max idle connections", map[string]string{envURL: "https://d", envToken: "a", envMaxIdleConns: "0"}},
+		{"invalid idle connection timeout", map[string]string{envURL: "https://d", envToken: "a", envIdleConnTimeout: "-1s"}},
+		{"invalid strict", map[string]string{envURL: "https://d", envToken: "a", envStrict: "sometimes"}},
+		{"missing CA file", map[string]string{envURL: "https://d", envToken: "a", envCACert: filepath.Join(dir, "ca.pem")}},
+		{"client certificate without key", map[string]string{envURL: "https://d", envToken: "a", envCert: filepath.Join(dir, "client.crt")}},
+		{"missing client certificate", map[string]string{envURL: "https://d", envToken: "a", envCert: filepath.Join(dir, "client.crt"), envKey: filepath.Join(dir, "client.key")}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.vars["HOME"] = dir
+			restore := setEnvironment(tc.vars)
+			defer restore()
+
+			_, err := FromEnvironment()
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+// setEnvironment sets the given environment variables, unsetting any others
+// that FromEnvironment reads. It returns a function that restores the original
+// environment.
+func setEnvironment(vars map[string]string) func() {
+	names := []string{envURL, envToken, envTokenFile, envKeyFile, envCACert, envCert, envKey, envTimeout, envMaxIdleConns, envIdleConnTimeout, envStrict, "DRAUPNIR_PROFILE", "HOME"}
+	originals := make(map[string]*string)
+
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			originals[name] = &value
+		} else {
+			originals[name] = nil
+		}
+
+		if value, ok := vars[name]; ok {
+			os.Setenv(name, value)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+
+	return func() {
+		for name, value := range originals {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+type exchangeTokenRequest struct {
+	Provider string `jsonapi:"attr,provider"`
+	Token    string `jsonapi:"attr,token"`
+}
+
+// ExchangeToken exchanges a cloud identity token, from AWSIdentityToken or
+// GCPIdentityToken, for a token that authenticates the service account that
+// the identity is mapped to. The token can't be refreshed: exchange the
+// identity again once it expires.
+func (c Client) ExchangeToken(provider, token string) (oauth2.Token, error) {
+	var exchanged oauth2.Token
+	if err := c.negotiation.unsupported(models.FeatureTokenExchange); err != nil {
+		return exchanged, err
+	}
+
+	request := exchangeTokenRequest{Provider: provider, Token: token}
+
+	var payload bytes.Buffer
+	err := c.marshal(&payload, &request)
+	if err != nil {
+		return exchanged, err
+	}
+
+	resp, err := c.post("/access_tokens/exchange", &payload)
+	if err != nil {
+		return exchanged, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return exchanged, parseError(resp.Body)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&exchanged)
+	return c.localExpiry(exchanged), err
+}
+
+// AWSCredentials are the credentials that AWS identity requests are signed
+// with
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// AWSCredentialsFromEnvironment reads AWS credentials from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+func AWSCredentialsFromEnvironment() (AWSCredentials, error) {
+	creds := AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return creds, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return creds, nil
+}
+
+// AWSIdentityToken signs an sts:GetCallerIdentity request with the
+// credentials, for exchange with the server whose aws_audience is audience.
+// The server sends the request to STS, which only accepts it for 15 minutes.
+func AWSIdentityToken(creds AWSCredentials, audience string, now time.Time) (string, error) {
+	body := "Action=GetCallerIdentity&Version=2011-06-15"
+
+	req, err := http.NewRequest(http.MethodPost, "https://sts.amazonaws.com/", strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if audience != "" {
+		req.Header.Set(models.AWSServerIDHeader, audience)
+	}
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	signAWSRequest(req, []byte(body), creds, "us-east-1", "sts", now)
+
+	return models.AWSIdentityRequest{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Headers: req.Header,
+		Body:    body,
+	}.Encode()
+}
+
+// signAWSRequest signs the request with AWS Signature Version 4, setting its
+// Host, X-Amz-Date and Authorization headers. Every header that's already set
+// is signed.
+func signAWSRequest(req *http.Request, body []byte, creds AWSCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		values := req.Header[http.CanonicalHeaderKey(name)]
+		for i := range values {
+			values[i] = strings.TrimSpace(values[i])
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.Join(values, ","))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func canonicalQuery(query url.Values) string {
+	// Encode sorts by key, and escapes spaces as + where AWS expects %20
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// GCPIdentityToken fetches an ID token for the instance's service account from
+// the GCP metadata server, for exchange with the server whose gcp_audience is
+// audience. The metadata server's host can be overridden with
+// GCE_METADATA_HOST.
+func GCPIdentityToken(ctx context.Context, audience string) (string, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+
+	query := url.Values{"audience": {audience}, "format": {"full"}}
+	req, err := http.NewRequest(
+		http.MethodGet,
+		fmt.Sprintf("http://%s/computeMetadata/v1/instance/service-accounts/default/identity?%s", host, query.Encode()),
+		nil,
+	)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch ID token from the metadata server: %s", err)
+	}
+	defer resp.Body.Close()
+
+	token, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch ID token from the metadata server: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %d: %s", resp.StatusCode, strings.TrimSpace(string(token)))
+	}
+
+	return strings.TrimSpace(string(token)), nil
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestExchangeToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/access_tokens/exchange", r.URL.Path)
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Contains(t, string(body), `"provider":"gcp"`)
+		assert.Contains(t, string(body), `"token":"the-id-token"`)
+
+		expiry := time.Now().Add(time.Hour).Format(time.RFC3339)
+		fmt.Fprintf(w, `{"access_token": "dxt_abc", "refresh_token": "dxt_abc", "expiry": %q}`, expiry)
+	}))
+	defer server.Close()
+
+	token, err := NewClient(server.URL).ExchangeToken(models.IdentityProviderGCP, "the-id-token")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "dxt_abc", token.RefreshToken)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), token.Expiry, time.Minute)
+}
+
+func TestExchangeTokenWithUnmappedIdentity(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"id": "forbidden", "status": "403", "title": "Unmapped Identity", "detail": "arn:aws:iam::123456789012:role/ci isn't mapped to a service account"}`)
+	}))
+	defer server.Close()
+
+	_, err := NewClient(server.URL).ExchangeToken(models.IdentityProviderAWS, "a-signed-request")
+
+	assert.EqualError(t, err, "Unmapped Identity (arn:aws:iam::123456789012:role/ci isn't mapped to a service account)")
+}
+
+// TestSignAWSRequest checks the signature against the get-vanilla case of
+// AWS's Signature Version 4 test suite
+func TestSignAWSRequest(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	creds := AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+
+	signAWSRequest(req, []byte{}, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(
+		t,
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"),
+	)
+}
+
+func TestAWSIdentityToken(t *testing.T) {
+	creds := AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "secret",
+		SessionToken:    "session-token",
+	}
+
+	token, err := AWSIdentityToken(creds, "draupnir.example.com", time.Now())
+	assert.Nil(t, err)
+
+	request, err := models.DecodeAWSIdentityRequest(token)
+	assert.Nil(t, err)
+
+	headers := http.Header(request.Headers)
+	assert.Equal(t, "POST", request.Method)
+	assert.Equal(t, "https://sts.amazonaws.com/", request.URL)
+	assert.Equal(t, "Action=GetCallerIdentity&Version=2011-06-15", request.Body)
+	assert.Equal(t, "draupnir.example.com", headers.Get(models.AWSServerIDHeader))
+	assert.Equal(t, "session-token", headers.Get("X-Amz-Security-Token"))
+	assert.Contains(t, headers.Get("Authorization"), "SignedHeaders=content-type;draupnir-server-id;host;x-amz-date;x-amz-security-token,")
+}
+
+func TestGCPIdentityToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+		assert.Equal(t, "/computeMetadata/v1/instance/service-accounts/default/identity", r.URL.Path)
+		assert.Equal(t, "https://draupnir.example.com", r.URL.Query().Get("audience"))
+		fmt.Fprint(w, "the-id-token")
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	os.Setenv("GCE_METADATA_HOST", u.Host)
+	defer os.Unsetenv("GCE_METADATA_HOST")
+
+	token, err := GCPIdentityToken(context.Background(), "https://draupnir.example.com")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "the-id-token", token)
+}
+
+func TestAWSCredentialsFromEnvironment(t *testing.T) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	_, err := AWSCredentialsFromEnvironment()
+	assert.EqualError(t, err, "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	creds, err := AWSCredentialsFromEnvironment()
+	assert.Nil(t, err)
+	assert.Equal(t, AWSCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, creds)
+}
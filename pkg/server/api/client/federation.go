@@ -0,0 +1,34 @@
+package client
+
+import (
+	"bytes"
+	"reflect"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// ListFederatedServers returns the servers that accept the same credentials as
+// this one, which may include this server. It doesn't require authentication,
+// so can be used to discover servers before authenticating with any of them.
+func (c Client) ListFederatedServers() ([]models.FederatedServer, error) {
+	var servers []models.FederatedServer
+
+	body, err := c.getBody("/federation")
+	if err != nil {
+		return servers, err
+	}
+
+	maybeServers, err := c.unmarshalMany(bytes.NewReader(body), reflect.TypeOf(servers))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []FederatedServer
+	servers = make([]models.FederatedServer, 0)
+	for _, server := range maybeServers {
+		s := server.(*models.FederatedServer)
+		servers = append(servers, *s)
+	}
+
+	return servers, nil
+}
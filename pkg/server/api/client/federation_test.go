@@ -0,0 +1,31 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListFederatedServers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/draupnir/federation", r.URL.Path)
+
+		fmt.Fprint(w, `{"data": [
+			{"type": "federated_servers", "id": "staging", "attributes": {"domain": "draupnir-staging.example.com"}},
+			{"type": "federated_servers", "id": "production", "attributes": {"domain": "infra.example.com/draupnir"}}
+		]}`)
+	}))
+	defer server.Close()
+
+	servers, err := NewClient(server.URL + "/draupnir").ListFederatedServers()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []models.FederatedServer{
+		{Name: "staging", Domain: "draupnir-staging.example.com"},
+		{Name: "production", Domain: "infra.example.com/draupnir"},
+	}, servers)
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sensitiveHeaders carry credentials, so RedactHeaders hides their values
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// RedactHeaders returns a copy of the headers in which the values of those that
+// carry credentials are replaced, so that they can be logged. The scheme of an
+// Authorization header is kept, e.g. "Bearer [REDACTED]".
+func RedactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range sensitiveHeaders {
+		values := redacted.Values(name)
+		for i, value := range values {
+			scheme := ""
+			if name == "Authorization" || name == "Proxy-Authorization" {
+				if space := strings.Index(value, " "); space > 0 {
+					scheme = value[:space+1]
+				}
+			}
+			values[i] = scheme + "[REDACTED]"
+		}
+	}
+	return redacted
+}
+
+// RequestHook is called with each request before it is sent, and may modify
+// it, e.g. to add tracing headers
+type RequestHook func(req *http.Request)
+
+// ResponseHook is called once each request has completed, with its response or
+// error and the time it took to receive the response headers. It must not read
+// or close the response body.
+type ResponseHook func(req *http.Request, resp *http.Response, err error, duration time.Duration)
+
+// WithRequestHook calls the hook with each request before it is sent. Hooks
+// are called in the order they were given, once for every attempt at a
+// request, including retries.
+func WithRequestHook(hook RequestHook) Option {
+	return func(o *clientOptions) {
+		o.requestHooks = append(o.requestHooks, hook)
+	}
+}
+
+// WithResponseHook calls the hook once each request attempt has completed,
+// which can be used to log request durations or record metrics. Hooks are
+// called in the order they were given.
+func WithResponseHook(hook ResponseHook) Option {
+	return func(o *clientOptions) {
+		o.responseHooks = append(o.responseHooks, hook)
+	}
+}
+
+// hookTransport calls the request and response hooks around each round trip
+type hookTransport struct {
+	base          http.RoundTripper
+	requestHooks  []RequestHook
+	responseHooks []ResponseHook
+}
+
+func (t hookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.requestHooks) > 0 {
+		// RoundTrippers mustn't modify the request that they're given
+		req = req.Clone(req.Context())
+		for _, hook := range t.requestHooks {
+			hook(req)
+		}
+	}
+
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	duration := time.Since(start)
+
+	for _, hook := range t.responseHooks {
+		hook(req, resp, err, duration)
+	}
+
+	return resp, err
+}
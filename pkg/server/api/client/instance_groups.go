@@ -0,0 +1,142 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+)
+
+// CreateInstanceGroup creates an instance from each of the images, and from
+// the latest ready image of each of the families, all at once. If any of them
+// can't be created, none of them are. The group is returned with its
+// instances, and their credentials.
+func (c Client) CreateInstanceGroup(imageIDs []int, families []string) (models.InstanceGroup, error) {
+	var group models.InstanceGroup
+	if err := c.negotiation.unsupported(models.FeatureInstanceGroups); err != nil {
+		return group, err
+	}
+
+	request := routes.CreateInstanceGroupRequest{
+		ImageIDs: make([]string, 0, len(imageIDs)),
+		Families: families,
+	}
+	for _, id := range imageIDs {
+		request.ImageIDs = append(request.ImageIDs, strconv.Itoa(id))
+	}
+
+	var payload bytes.Buffer
+	err := c.marshal(&payload, &request)
+	if err != nil {
+		return group, err
+	}
+
+	resp, err := c.post("/instance_groups", &payload)
+	if err != nil {
+		return group, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return group, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &group)
+	return group, err
+}
+
+// ListInstanceGroups returns the user's instance groups that still have
+// instances. Their instances are returned without credentials.
+func (c Client) ListInstanceGroups() ([]models.InstanceGroup, error) {
+	var groups []models.InstanceGroup
+	if err := c.negotiation.unsupported(models.FeatureInstanceGroups); err != nil {
+		return groups, err
+	}
+
+	body, err := c.getBody("/instance_groups")
+	if err != nil {
+		return groups, err
+	}
+
+	maybeGroups, err := c.unmarshalMany(bytes.NewReader(body), reflect.TypeOf(groups))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []InstanceGroup
+	groups = make([]models.InstanceGroup, 0)
+	for _, group := range maybeGroups {
+		g := group.(*models.InstanceGroup)
+		groups = append(groups, *g)
+	}
+
+	return groups, nil
+}
+
+// GetInstanceGroup returns the instance group, with those of its instances
+// that haven't been destroyed and their credentials
+func (c Client) GetInstanceGroup(id int) (models.InstanceGroup, error) {
+	var group models.InstanceGroup
+	if err := c.negotiation.unsupported(models.FeatureInstanceGroups); err != nil {
+		return group, err
+	}
+
+	body, err := c.getBody(fmt.Sprintf("/instance_groups/%d", id))
+	if err != nil {
+		return group, err
+	}
+
+	err = c.unmarshal(bytes.NewReader(body), &group)
+	return group, err
+}
+
+// ExtendInstanceGroup pushes back when every instance in the group expires by
+// the given duration, as ExtendInstance does for one instance
+func (c Client) ExtendInstanceGroup(group models.InstanceGroup, by time.Duration) (models.InstanceGroup, error) {
+	var extended models.InstanceGroup
+	if err := c.negotiation.unsupported(models.FeatureInstanceGroups); err != nil {
+		return extended, err
+	}
+
+	request := routes.ExtendInstanceRequest{By: by.String()}
+
+	var payload bytes.Buffer
+	err := c.marshal(&payload, &request)
+	if err != nil {
+		return extended, err
+	}
+
+	resp, err := c.post(fmt.Sprintf("/instance_groups/%d/extend", group.ID), &payload)
+	if err != nil {
+		return extended, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return extended, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &extended)
+	return extended, err
+}
+
+// DestroyInstanceGroup destroys every instance in the group, and the group
+func (c Client) DestroyInstanceGroup(group models.InstanceGroup) error {
+	if err := c.negotiation.unsupported(models.FeatureInstanceGroups); err != nil {
+		return err
+	}
+
+	resp, err := c.delete(fmt.Sprintf("/instance_groups/%d", group.ID))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return parseError(resp.Body)
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const instanceGroupResponse = `{
+	"data": {
+		"type": "instance_groups", "id": "3",
+		"attributes": {"instance_ids": ["1", "2"], "created_at": "2026-10-15T12:00:00Z", "expires_at": "2026-10-16T12:00:00Z"},
+		"relationships": {"instances": {"data": [{"type": "instances", "id": "1"}, {"type": "instances", "id": "2"}]}}
+	},
+	"included": [
+		{"type": "instances", "id": "1", "attributes": {"image_id": 1, "hostname": "draupnir.example.com", "port": 5432}, "relationships": {"credentials": {"data": {"type": "credentials", "id": "1"}}}},
+		{"type": "credentials", "id": "1", "attributes": {"ca_certificate": "ca", "client_certificate": "cert", "client_key": "key"}},
+		{"type": "instances", "id": "2", "attributes": {"image_id": 2, "hostname": "draupnir.example.com", "port": 5433}}
+	]
+}`
+
+func TestInstanceGroups(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /instance_groups":
+			var body struct {
+				Data struct {
+					Attributes map[string]interface{} `json:"attributes"`
+				} `json:"data"`
+			}
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, []interface{}{"1"}, body.Data.Attributes["image_ids"])
+			assert.Equal(t, []interface{}{"ledger"}, body.Data.Attributes["families"])
+
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, instanceGroupResponse)
+		case "GET /instance_groups/3":
+			fmt.Fprint(w, instanceGroupResponse)
+		case "POST /instance_groups/3/extend":
+			fmt.Fprint(w, `{"data": {"type": "instance_groups", "id": "3", "attributes": {"instance_ids": ["1", "2"], "expires_at": "2026-10-16T16:00:00Z"}}}`)
+		case "DELETE /instance_groups/3":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+
+	group, err := client.CreateInstanceGroup([]int{1}, []string{"ledger"})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, group.ID)
+	if assert.Len(t, group.Instances, 2) {
+		assert.Equal(t, "cert", group.Instances[0].Credentials.ClientCertificate)
+		assert.Equal(t, uint16(5433), group.Instances[1].Port)
+	}
+
+	group, err = client.GetInstanceGroup(3)
+	assert.Nil(t, err)
+	assert.Len(t, group.Instances, 2)
+
+	extended, err := client.ExtendInstanceGroup(group, 4*time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2026, 10, 16, 16, 0, 0, 0, time.UTC), extended.ExpiresAt.UTC())
+
+	assert.Nil(t, client.DestroyInstanceGroup(group))
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// StreamInstanceLog writes the last lines of the instance's Postgres server log
+// to w. Given follow, it then writes each line as it's added to the log, until
+// the context is done, which isn't treated as an error.
+func (c Client) StreamInstanceLog(ctx context.Context, instanceID int, lines int, follow bool, w io.Writer) error {
+	if err := c.negotiation.unsupported(models.FeatureInstanceLogs); err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("/instances/%d/logs?lines=%d", instanceID, lines)
+	if follow {
+		path += "&follow=true"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+path, nil)
+	if err != nil {
+		return err
+	}
+
+	// Followed logs are streamed until the context is done, so mustn't be
+	// subject to the client's timeout
+	streamClient := *c.client
+	streamClient.Timeout = 0
+
+	resp, err := c.doWithClient(&streamClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return parseError(resp.Body)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	if follow && ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
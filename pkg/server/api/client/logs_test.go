@@ -0,0 +1,73 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamInstanceLog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/instances/4/logs", r.URL.Path)
+		assert.Equal(t, "20", r.URL.Query().Get("lines"))
+		assert.Equal(t, "", r.URL.Query().Get("follow"))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, "LOG:  database system is ready to accept connections\n")
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+
+	var log bytes.Buffer
+	err := client.StreamInstanceLog(context.Background(), 4, 20, false, &log)
+	assert.Nil(t, err)
+	assert.Equal(t, "LOG:  database system is ready to accept connections\n", log.String())
+}
+
+func TestStreamInstanceLogFollowUntilCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.URL.Query().Get("follow"))
+		fmt.Fprint(w, "LOG:  checkpoint starting: time\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	go func() {
+		// Stop following once the first line has arrived
+		line := make([]byte, 32)
+		io.ReadAtLeast(reader, line, len(line))
+		cancel()
+		io.Copy(ioutil.Discard, reader)
+	}()
+
+	err := client.StreamInstanceLog(ctx, 4, 100, true, writer)
+	writer.Close()
+	assert.Nil(t, err, "cancelling a followed log isn't an error")
+}
+
+func TestStreamInstanceLogWhenRegulated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"status": "403", "title": "Regulated Instance", "detail": "The logs of regulated instances can hold queries' data, so can't be read outside the proxy"}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+
+	var log bytes.Buffer
+	err := client.StreamInstanceLog(context.Background(), 4, 100, false, &log)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, log.Len())
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net/http"
+
+	"github.com/gocardless/draupnir/pkg/manifest"
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// GetImageManifest returns the manifest signed when the image was finalised.
+// Its signature isn't checked: use VerifyImageManifest for that.
+func (c Client) GetImageManifest(imageID int) (models.ImageManifest, error) {
+	var imageManifest models.ImageManifest
+	if err := c.negotiation.unsupported(models.FeatureImageManifests); err != nil {
+		return imageManifest, err
+	}
+
+	resp, err := c.get(fmt.Sprintf("/images/%d/manifest", imageID))
+	if err != nil {
+		return imageManifest, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return imageManifest, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &imageManifest)
+	return imageManifest, err
+}
+
+// VerifyImageManifest fetches the image's manifest and checks, locally, that
+// it was signed with the given key and describes this image. Unlike
+// VerifyImage, this doesn't require trusting the server.
+func (c Client) VerifyImageManifest(imageID int, key ed25519.PublicKey) (models.ImageManifest, error) {
+	imageManifest, err := c.GetImageManifest(imageID)
+	if err != nil {
+		return imageManifest, err
+	}
+
+	if err := manifest.Verify(imageManifest, key); err != nil {
+		return imageManifest, err
+	}
+
+	if imageManifest.ImageID != imageID {
+		return imageManifest, fmt.Errorf("manifest is for image %d, not image %d", imageManifest.ImageID, imageID)
+	}
+
+	return imageManifest, nil
+}
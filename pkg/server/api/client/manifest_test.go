@@ -0,0 +1,87 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/manifest"
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// serveManifest serves the manifest at /images/1/manifest
+func serveManifest(t *testing.T, imageManifest models.ImageManifest) *httptest.Server {
+	var payload bytes.Buffer
+	if err := jsonapi.MarshalOnePayload(&payload, &imageManifest); err != nil {
+		t.Fatal(err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/images/1/manifest", r.URL.Path)
+		w.Write(payload.Bytes())
+	}))
+}
+
+func signManifest(t *testing.T, imageID int) (models.ImageManifest, ed25519.PublicKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := manifest.Signer{Identity: "draupnir-test", Key: privateKey}
+	imageManifest, err := signer.Sign(models.Image{ID: imageID, SnapshotChecksum: "abc123"}, "1.0.0", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return imageManifest, publicKey
+}
+
+func TestVerifyImageManifest(t *testing.T) {
+	imageManifest, publicKey := signManifest(t, 1)
+	server := serveManifest(t, imageManifest)
+	defer server.Close()
+
+	verified, err := NewClient(server.URL).VerifyImageManifest(1, publicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc123", verified.ContentHash)
+	assert.Equal(t, "draupnir-test", verified.Signer)
+}
+
+func TestVerifyImageManifestWithTamperedManifest(t *testing.T) {
+	imageManifest, publicKey := signManifest(t, 1)
+	imageManifest.BakerVersion = "0.0.1"
+	server := serveManifest(t, imageManifest)
+	defer server.Close()
+
+	_, err := NewClient(server.URL).VerifyImageManifest(1, publicKey)
+	assert.EqualError(t, err, "manifest signature is invalid")
+}
+
+func TestVerifyImageManifestForOtherImage(t *testing.T) {
+	imageManifest, publicKey := signManifest(t, 2)
+	server := serveManifest(t, imageManifest)
+	defer server.Close()
+
+	_, err := NewClient(server.URL).VerifyImageManifest(1, publicKey)
+	assert.EqualError(t, err, "manifest is for image 2, not image 1")
+}
+
+func TestGetImageManifestNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"status": "404", "title": "Manifest Not Found", "detail": "no manifest"}`)
+	}))
+	defer server.Close()
+
+	_, err := NewClient(server.URL).GetImageManifest(1)
+	assert.EqualError(t, err, "Manifest Not Found (no manifest)")
+}
@@ -0,0 +1,255 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+// ErrVersionUnavailable is returned by ServerVersion for servers that predate
+// GET /version, and so can't tell us which features they support
+var ErrVersionUnavailable = errors.New("server doesn't report its version")
+
+// ErrIncompatibleServer is returned when the server's major version differs
+// from the client's, so no version can be negotiated
+type ErrIncompatibleServer struct {
+	ClientVersion string
+	ServerVersion string
+}
+
+func (e *ErrIncompatibleServer) Error() string {
+	return fmt.Sprintf("client version %s is incompatible with server version %s", e.ClientVersion, e.ServerVersion)
+}
+
+// ErrUnsupportedFeature is returned by requests that rely on a feature that the
+// server has told us it doesn't support, rather than sending them anyway
+type ErrUnsupportedFeature struct {
+	Feature       string
+	ServerVersion string
+}
+
+func (e *ErrUnsupportedFeature) Error() string {
+	return fmt.Sprintf("server version %s doesn't support %s", e.ServerVersion, e.Feature)
+}
+
+// versionNegotiation records the outcome of negotiating with the server, which
+// is shared by copies of the client. Its methods do nothing on a nil
+// negotiation, so that the zero Client behaves as if it hadn't negotiated.
+type versionNegotiation struct {
+	mu         sync.Mutex
+	negotiated bool
+	// server is nil if the server predates GET /version
+	server *models.ServerVersion
+	// requestVersion is the version sent in the Draupnir-Version header, if it
+	// differs from the client's own
+	requestVersion string
+}
+
+func (n *versionNegotiation) requestVersionOr(clientVersion string) string {
+	if n == nil {
+		return clientVersion
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.requestVersion == "" {
+		return clientVersion
+	}
+	return n.requestVersion
+}
+
+// unsupported returns an *ErrUnsupportedFeature if we've negotiated with a
+// server that doesn't support the feature. Servers that we haven't negotiated
+// with are assumed to support it, so that no extra request is made.
+func (n *versionNegotiation) unsupported(feature string) error {
+	if n == nil {
+		return nil
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.server == nil || n.server.Supports(feature) {
+		return nil
+	}
+	return &ErrUnsupportedFeature{Feature: feature, ServerVersion: n.server.ID}
+}
+
+// negotiateVersion returns the version that a client should send to a server
+// of the given version. Servers reject clients with a newer minor version than
+// their own, so those clients send the server's version instead and fall back
+// to what it supports. Unparseable versions (e.g. of development builds) are
+// likewise replaced by the server's.
+func negotiateVersion(clientVersion, serverVersion string) (string, error) {
+	serverMajor, serverMinor, _, err := version.ParseSemver(serverVersion)
+	if err != nil {
+		// The server doesn't check versions if it can't parse its own
+		return clientVersion, nil
+	}
+
+	clientMajor, clientMinor, _, err := version.ParseSemver(clientVersion)
+	if err != nil {
+		return serverVersion, nil
+	}
+
+	if clientMajor != serverMajor {
+		return "", &ErrIncompatibleServer{ClientVersion: clientVersion, ServerVersion: serverVersion}
+	}
+	if clientMinor > serverMinor {
+		return serverVersion, nil
+	}
+	return clientVersion, nil
+}
+
+// ServerVersion returns the server's version and the features it supports,
+// and negotiates the version that the client sends in future requests. The
+// result is cached, and shared by copies of the client.
+//
+// The client negotiates automatically if the server rejects its version, so
+// this only needs calling to check for features up front.
+func (c Client) ServerVersion() (models.ServerVersion, error) {
+	if c.negotiation == nil {
+		return c.fetchServerVersion()
+	}
+
+	c.negotiation.mu.Lock()
+	defer c.negotiation.mu.Unlock()
+
+	if c.negotiation.negotiated {
+		if c.negotiation.server == nil {
+			return models.ServerVersion{}, ErrVersionUnavailable
+		}
+		return *c.negotiation.server, nil
+	}
+
+	serverVersion, err := c.fetchServerVersion()
+	if err == ErrVersionUnavailable {
+		c.negotiation.negotiated = true
+	}
+	if err != nil {
+		return serverVersion, err
+	}
+
+	requestVersion, err := negotiateVersion(version.Version, serverVersion.ID)
+	if err != nil {
+		return serverVersion, err
+	}
+
+	c.negotiation.negotiated = true
+	c.negotiation.server = &serverVersion
+	if requestVersion != version.Version {
+		c.negotiation.requestVersion = requestVersion
+	}
+
+	return serverVersion, nil
+}
+
+// Supports reports whether the server supports the feature, which is one of
+// the models.Feature* constants. Servers that predate GET /version don't
+// report their features, so Supports returns false for them: callers should
+// fall back to what older servers support.
+func (c Client) Supports(feature string) (bool, error) {
+	serverVersion, err := c.ServerVersion()
+	if err == ErrVersionUnavailable {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return serverVersion.Supports(feature), nil
+}
+
+// fetchServerVersion gets GET /version. It's sent without renegotiating, as the
+// server doesn't check the version of these requests.
+func (c Client) fetchServerVersion() (models.ServerVersion, error) {
+	var serverVersion models.ServerVersion
+
+	req, err := http.NewRequest(http.MethodGet, c.url+"/version", strings.NewReader(""))
+	if err != nil {
+		return serverVersion, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Draupnir-Version", version.Version)
+
+	resp, err := c.retryPolicy.doWithRetries(c.client, req)
+	if err != nil {
+		return serverVersion, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return serverVersion, ErrVersionUnavailable
+	}
+	if resp.StatusCode != http.StatusOK {
+		return serverVersion, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &serverVersion)
+	return serverVersion, err
+}
+
+// renegotiate handles the server rejecting the version that we sent, by
+// negotiating one that it accepts and resending the request with it. If the
+// request can't be resent, the original response is returned.
+func (c Client) renegotiate(client *http.Client, req *http.Request, resp *http.Response) (*http.Response, error) {
+	if c.negotiation == nil || resp.StatusCode != http.StatusBadRequest {
+		return resp, nil
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// We have no way of replaying the body
+		return resp, nil
+	}
+
+	c.negotiation.mu.Lock()
+	negotiated := c.negotiation.negotiated
+	c.negotiation.mu.Unlock()
+	if negotiated {
+		return resp, nil
+	}
+
+	// The body is put back, so that callers can still parse the error
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var apiError api.Error
+	if err := json.Unmarshal(body, &apiError); err != nil || apiError.Code != "invalid_api_version" {
+		return resp, nil
+	}
+
+	if _, err := c.ServerVersion(); err != nil {
+		if _, incompatible := err.(*ErrIncompatibleServer); incompatible {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	requestVersion := c.negotiation.requestVersionOr(version.Version)
+	if requestVersion == req.Header.Get("Draupnir-Version") {
+		return resp, nil
+	}
+
+	if req.GetBody != nil {
+		replay, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = replay
+	}
+	req.Header.Set("Draupnir-Version", requestVersion)
+
+	return c.retryPolicy.doWithRetries(client, req)
+}
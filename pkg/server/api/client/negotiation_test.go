@@ -0,0 +1,128 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	testCases := []struct {
+		name          string
+		client        string
+		server        string
+		result        string
+		expectedError string
+	}{
+		{"same version", "1.4.0", "1.4.0", "1.4.0", ""},
+		{"older client", "1.3.2", "1.4.0", "1.3.2", ""},
+		{"newer client", "1.5.0", "1.4.0", "1.4.0", ""},
+		{"development client", "", "1.4.0", "1.4.0", ""},
+		{"development server", "1.5.0", "", "1.5.0", ""},
+		{"different major", "2.0.0", "1.4.0", "", "client version 2.0.0 is incompatible with server version 1.4.0"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := negotiateVersion(tc.client, tc.server)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.result, result)
+		})
+	}
+}
+
+// serveVersion serves GET /version as a server of the given version, and
+// rejects other requests from clients that are newer than it like
+// CheckAPIVersion does
+func serveVersion(serverVersion string, versionRequests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/version" {
+			atomic.AddInt32(versionRequests, 1)
+			fmt.Fprintf(w, `{"data": {"type": "versions", "id": "%s", "attributes": {"features": ["bake_timeline"]}}}`, serverVersion)
+			return
+		}
+
+		requested := r.Header.Get("Draupnir-Version")
+		if negotiated, err := negotiateVersion(requested, serverVersion); err != nil || negotiated != requested {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"code": "invalid_api_version", "status": "400", "title": "Invalid API Version", "detail": "%s"}`, requested)
+			return
+		}
+
+		fmt.Fprint(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": true}}}`)
+	}))
+}
+
+func TestRenegotiatesRejectedVersion(t *testing.T) {
+	clientVersion := version.Version
+	version.Version = "1.5.0"
+	defer func() { version.Version = clientVersion }()
+
+	var versionRequests int32
+	server := serveVersion("1.4.0", &versionRequests)
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+
+	for i := 0; i < 2; i++ {
+		image, err := client.GetImage("1")
+		assert.Nil(t, err)
+		assert.True(t, image.Ready)
+	}
+
+	// The negotiated version is reused, rather than negotiated for each request
+	assert.Equal(t, int32(1), atomic.LoadInt32(&versionRequests))
+
+	supported, err := client.Supports(models.FeatureBakeTimeline)
+	assert.Nil(t, err)
+	assert.True(t, supported)
+
+	_, err = client.GetImageFile(1, "PG_VERSION")
+	assert.EqualError(t, err, "server version 1.4.0 doesn't support image_files")
+}
+
+func TestRenegotiateWithIncompatibleServer(t *testing.T) {
+	clientVersion := version.Version
+	version.Version = "2.0.0"
+	defer func() { version.Version = clientVersion }()
+
+	var versionRequests int32
+	server := serveVersion("1.4.0", &versionRequests)
+	defer server.Close()
+
+	_, err := NewClient(server.URL, WithRetryPolicy(NoRetries)).GetImage("1")
+	assert.EqualError(t, err, "client version 2.0.0 is incompatible with server version 1.4.0")
+}
+
+func TestServerVersionUnavailable(t *testing.T) {
+	var versionRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&versionRequests, 1)
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"status": "404", "title": "Not Found"}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+
+	_, err := client.ServerVersion()
+	assert.Equal(t, ErrVersionUnavailable, err)
+
+	// Older servers are assumed not to support any features
+	supported, err := client.Supports(models.FeatureBakeTimeline)
+	assert.Nil(t, err)
+	assert.False(t, supported)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&versionRequests))
+}
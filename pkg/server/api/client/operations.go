@@ -0,0 +1,125 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// ErrOperationFailed is returned when waiting for an operation if it failed or
+// was interrupted
+type ErrOperationFailed struct {
+	Operation models.Operation
+}
+
+func (e *ErrOperationFailed) Error() string {
+	return fmt.Sprintf(
+		"operation %d to %s %s %d %s: %s",
+		e.Operation.ID, e.Operation.Kind, e.Operation.ResourceType, e.Operation.ResourceID,
+		e.Operation.Status, e.Operation.Error,
+	)
+}
+
+// FinaliseImageAsync starts finalising the image in the background, returning
+// the operation that finalises it. If the image is ready already, no operation
+// is started, and the operation returned has no ID and has succeeded.
+func (c Client) FinaliseImageAsync(imageID int) (models.Operation, error) {
+	return c.startOperation(http.MethodPost, fmt.Sprintf("/images/%d/done", imageID), models.Operation{
+		Kind:         models.JobFinaliseImage,
+		ResourceType: "images",
+		ResourceID:   imageID,
+		Status:       models.JobSucceeded,
+	})
+}
+
+// DestroyImageAsync starts destroying the image in the background, returning
+// the operation that destroys it
+func (c Client) DestroyImageAsync(image models.Image) (models.Operation, error) {
+	return c.startOperation(http.MethodDelete, fmt.Sprintf("/images/%d", image.ID), models.Operation{
+		Kind:         models.JobDestroyImage,
+		ResourceType: "images",
+		ResourceID:   image.ID,
+		Status:       models.JobSucceeded,
+	})
+}
+
+// DestroyInstanceAsync starts destroying the instance in the background,
+// returning the operation that destroys it
+func (c Client) DestroyInstanceAsync(instance models.Instance) (models.Operation, error) {
+	return c.startOperation(http.MethodDelete, fmt.Sprintf("/instances/%d", instance.ID), models.Operation{
+		Kind:         models.JobDestroyInstance,
+		ResourceType: "instances",
+		ResourceID:   instance.ID,
+		Status:       models.JobSucceeded,
+	})
+}
+
+// GetOperation returns the operation, which you can only see if you started it
+func (c Client) GetOperation(id int) (models.Operation, error) {
+	var operation models.Operation
+	if err := c.negotiation.unsupported(models.FeatureOperations); err != nil {
+		return operation, err
+	}
+
+	body, err := c.getBody(fmt.Sprintf("/operations/%d", id))
+	if err != nil {
+		return operation, err
+	}
+
+	err = c.unmarshal(bytes.NewReader(body), &operation)
+	return operation, err
+}
+
+// WaitForOperation polls the operation as the policy says until it's done,
+// returning an *ErrOperationFailed if it didn't succeed
+func (c Client) WaitForOperation(ctx context.Context, id int, policy WaitPolicy) (models.Operation, error) {
+	var operation models.Operation
+	err := policy.Poll(ctx, func() (bool, error) {
+		var err error
+		operation, err = c.GetOperation(id)
+		if err != nil || !operation.Done() {
+			return false, err
+		}
+		if operation.Status != models.JobSucceeded {
+			return false, &ErrOperationFailed{Operation: operation}
+		}
+		return true, nil
+	})
+	return operation, err
+}
+
+// startOperation sends the request with Prefer: respond-async, returning the
+// operation that the server started. Servers respond synchronously when
+// there's nothing to do in the background, in which case done is returned.
+func (c Client) startOperation(method, path string, done models.Operation) (models.Operation, error) {
+	var operation models.Operation
+	if err := c.negotiation.unsupported(models.FeatureOperations); err != nil {
+		return operation, err
+	}
+
+	req, err := http.NewRequest(method, c.url+path, strings.NewReader(""))
+	if err != nil {
+		return operation, err
+	}
+	req.Header.Set("Prefer", "respond-async")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return operation, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted:
+		err = c.unmarshal(resp.Body, &operation)
+		return operation, err
+	case http.StatusOK, http.StatusNoContent:
+		return done, nil
+	default:
+		return operation, parseError(resp.Body)
+	}
+}
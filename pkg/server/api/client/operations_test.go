@@ -0,0 +1,108 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+func TestFinaliseImageAsync(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/images/3/done", r.URL.Path)
+		assert.Equal(t, "respond-async", r.Header.Get("Prefer"))
+
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, `{"data": {"type": "operations", "id": "7", "attributes": {
+			"kind": "finalise_image", "resource_type": "images", "resource_id": 3, "status": "queued"
+		}}}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries), WithStrictValidation())
+	operation, err := client.FinaliseImageAsync(3)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 7, operation.ID)
+	assert.Equal(t, models.JobQueued, operation.Status)
+	assert.Equal(t, 3, operation.ResourceID)
+}
+
+func TestFinaliseImageAsyncWhenReady(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"type": "images", "id": "3", "attributes": {"ready": true}}}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	operation, err := client.FinaliseImageAsync(3)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 0, operation.ID)
+	assert.True(t, operation.Done())
+	assert.Equal(t, models.JobSucceeded, operation.Status)
+}
+
+func TestWaitForOperation(t *testing.T) {
+	var polls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/operations/7", r.URL.Path)
+
+		status := "running"
+		if atomic.AddInt32(&polls, 1) > 2 {
+			status = "succeeded"
+		}
+		fmt.Fprintf(w, `{"data": {"type": "operations", "id": "7", "attributes": {
+			"kind": "destroy_instance", "resource_type": "instances", "resource_id": 4, "status": "%s"
+		}}}`, status)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries), WithStrictValidation())
+	operation, err := client.WaitForOperation(context.Background(), 7, testWaitPolicy)
+
+	assert.Nil(t, err)
+	assert.Equal(t, models.JobSucceeded, operation.Status)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&polls))
+}
+
+func TestWaitForOperationThatFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"type": "operations", "id": "7", "attributes": {
+			"kind": "finalise_image", "resource_type": "images", "resource_id": 3, "status": "failed",
+			"error": "anonymisation failed"
+		}}}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	_, err := client.WaitForOperation(context.Background(), 7, testWaitPolicy)
+
+	failed, ok := err.(*ErrOperationFailed)
+	if assert.True(t, ok, "expected an *ErrOperationFailed, got %v", err) {
+		assert.Equal(t, "anonymisation failed", failed.Operation.Error)
+	}
+}
+
+func TestGetOperationFromOlderServer(t *testing.T) {
+	var versionRequests int32
+	server := serveVersion(version.Version, &versionRequests)
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	_, err := client.ServerVersion()
+	assert.Nil(t, err)
+
+	_, err = client.GetOperation(7)
+
+	_, ok := err.(*ErrUnsupportedFeature)
+	assert.True(t, ok, "expected an *ErrUnsupportedFeature, got %v", err)
+}
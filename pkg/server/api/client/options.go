@@ -0,0 +1,254 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Option configures a Client constructed by NewClient
+type Option func(*clientOptions)
+
+type clientOptions struct {
+	token            oauth2.Token
+	httpClient       *http.Client
+	timeout          time.Duration
+	retryPolicy      RetryPolicy
+	tlsOptions       []func(*tls.Config)
+	transportOptions []func(*http.Transport)
+	requestHooks     []RequestHook
+	responseHooks    []ResponseHook
+	cache            bool
+	protocol         Protocol
+	strict           bool
+	clockSkewWarning func(skew time.Duration)
+}
+
+// DefaultMaxIdleConns is how many idle connections to the server are kept open
+// for reuse, unless configured otherwise. http.DefaultTransport keeps only two
+// per host, so clients that poll concurrently would otherwise keep opening new
+// connections, each using up an ephemeral port until it times out.
+const DefaultMaxIdleConns = 32
+
+// defaultTransport is used by clients whose HTTP client has no transport of its
+// own. It's shared, so that those clients share idle connections too.
+var defaultTransport = newDefaultTransport()
+
+func newDefaultTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConns = DefaultMaxIdleConns
+	transport.MaxIdleConnsPerHost = DefaultMaxIdleConns
+	return transport
+}
+
+// transport returns the transport that the HTTP client should use, wrapped to
+// call any hooks
+func (o clientOptions) transport() http.RoundTripper {
+	transport := o.baseTransport()
+
+	if len(o.requestHooks) == 0 && len(o.responseHooks) == 0 {
+		return transport
+	}
+
+	return hookTransport{
+		base:          transport,
+		requestHooks:  o.requestHooks,
+		responseHooks: o.responseHooks,
+	}
+}
+
+// baseTransport applies any TLS and transport options to a copy of the
+// configured transport, or of the default transport if there isn't one. They
+// have no effect on transports that aren't an *http.Transport.
+func (o clientOptions) baseTransport() http.RoundTripper {
+	base := o.httpClient.Transport
+	if base == nil {
+		base = defaultTransport
+	}
+
+	if len(o.tlsOptions) == 0 && len(o.transportOptions) == 0 {
+		return base
+	}
+
+	transport, ok := base.(*http.Transport)
+	if !ok {
+		return base
+	}
+
+	transport = transport.Clone()
+	if len(o.tlsOptions) > 0 {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		for _, apply := range o.tlsOptions {
+			apply(transport.TLSClientConfig)
+		}
+	}
+	for _, apply := range o.transportOptions {
+		apply(transport)
+	}
+
+	return transport
+}
+
+// WithToken authenticates requests with the given OAuth token
+func WithToken(token oauth2.Token) Option {
+	return func(o *clientOptions) {
+		o.token = token
+	}
+}
+
+// WithHTTPClient sends requests using the given HTTP client, which allows
+// custom transports (e.g. for instrumentation, proxies or TLS configuration) to
+// be used
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *clientOptions) {
+		o.httpClient = client
+	}
+}
+
+// WithTimeout limits the time that each request attempt may take, including
+// reading the response body. It doesn't modify the client given to
+// WithHTTPClient.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *clientOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithRetryPolicy retries requests according to the given policy, rather than
+// the DefaultRetryPolicy
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *clientOptions) {
+		o.retryPolicy = policy
+	}
+}
+
+// WithRootCAs verifies the server's certificate against the given certificate
+// authorities, rather than the system's
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(o *clientOptions) {
+		o.tlsOptions = append(o.tlsOptions, func(config *tls.Config) {
+			config.RootCAs = pool
+		})
+	}
+}
+
+// WithInsecureSkipVerify doesn't verify the server's certificate, for servers
+// with self-signed certificates in development
+func WithInsecureSkipVerify() Option {
+	return func(o *clientOptions) {
+		o.tlsOptions = append(o.tlsOptions, func(config *tls.Config) {
+			config.InsecureSkipVerify = true
+		})
+	}
+}
+
+// WithClientCertificate presents the given PEM encoded certificate and key to
+// servers that require mutual TLS. If they can't be parsed, the TLS handshake
+// fails with the parsing error when the server asks for a certificate.
+func WithClientCertificate(cert, key []byte) Option {
+	certificate, err := tls.X509KeyPair(cert, key)
+
+	return func(o *clientOptions) {
+		o.tlsOptions = append(o.tlsOptions, func(config *tls.Config) {
+			if err != nil {
+				config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return nil, fmt.Errorf("invalid client certificate: %s", err)
+				}
+				return
+			}
+
+			config.Certificates = []tls.Certificate{certificate}
+		})
+	}
+}
+
+// WithMaxIdleConns keeps up to n idle connections to the server open for reuse,
+// rather than DefaultMaxIdleConns. Clients that make many concurrent requests
+// should keep at least as many as they make at once.
+//
+// This and the other connection options give the client its own connections,
+// rather than sharing them with other clients, so a client should be reused
+// rather than constructed for each request.
+func WithMaxIdleConns(n int) Option {
+	return func(o *clientOptions) {
+		o.transportOptions = append(o.transportOptions, func(transport *http.Transport) {
+			transport.MaxIdleConns = n
+			transport.MaxIdleConnsPerHost = n
+		})
+	}
+}
+
+// WithIdleConnTimeout closes connections that have been idle for longer than the
+// timeout. Zero keeps them open until the server closes them.
+func WithIdleConnTimeout(timeout time.Duration) Option {
+	return func(o *clientOptions) {
+		o.transportOptions = append(o.transportOptions, func(transport *http.Transport) {
+			transport.IdleConnTimeout = timeout
+		})
+	}
+}
+
+// WithoutHTTP2 sends requests over HTTP/1.1, for proxies that don't support
+// HTTP/2. Otherwise HTTP/2 is used with servers that support it, which sends
+// concurrent requests over a single connection.
+func WithoutHTTP2() Option {
+	return func(o *clientOptions) {
+		o.transportOptions = append(o.transportOptions, func(transport *http.Transport) {
+			transport.ForceAttemptHTTP2 = false
+			// A non-nil, empty map disables HTTP/2
+			transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+
+			// A transport that has already been used offers h2 in its TLS config,
+			// which Clone copies
+			if config := transport.TLSClientConfig; config != nil {
+				protos := []string{}
+				for _, proto := range config.NextProtos {
+					if proto != "h2" {
+						protos = append(protos, proto)
+					}
+				}
+				config.NextProtos = protos
+			}
+		})
+	}
+}
+
+// WithProtocol sets the format in which the client exchanges resources with the
+// server. Servers only serve ProtocolPlainJSON if they support
+// models.FeaturePlainJSON.
+func WithProtocol(protocol Protocol) Option {
+	return func(o *clientOptions) {
+		o.protocol = protocol
+	}
+}
+
+// WithResponseCache caches images and instances, and lists of them, in memory.
+// Each is revalidated with the server using its ETag, and the cached copy is
+// used if it hasn't changed, which saves downloading unchanged lists when
+// polling. The cache is shared by copies of the client.
+func WithResponseCache() Option {
+	return func(o *clientOptions) {
+		o.cache = true
+	}
+}
+
+// WithStrictValidation validates each response against the schema of the
+// resources that it's expected to contain, returning a *SchemaError that lists
+// every mismatch if it doesn't match. It's meant for catching changes to the
+// API early, e.g. by running against new server builds in staging: by default
+// the client is lenient, decoding whatever it can.
+//
+// Attributes that the schemas don't mention are allowed, as newer servers add
+// them without breaking older clients.
+func WithStrictValidation() Option {
+	return func(o *clientOptions) {
+		o.strict = true
+	}
+}
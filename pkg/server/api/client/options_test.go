@@ -0,0 +1,173 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestNewClientDefaults(t *testing.T) {
+	client := NewClient("https://draupnir.example.com/")
+
+	assert.Equal(t, "https://draupnir.example.com", client.url)
+	assert.Equal(t, DefaultRetryPolicy, client.retryPolicy)
+	assert.NotNil(t, client.client)
+}
+
+func TestNewClientWithOptions(t *testing.T) {
+	httpClient := &http.Client{}
+	token := oauth2.Token{AccessToken: "foo"}
+
+	client := NewClient(
+		"https://draupnir.example.com",
+		WithToken(token),
+		WithHTTPClient(httpClient),
+		WithTimeout(time.Minute),
+		WithRetryPolicy(NoRetries),
+	)
+
+	assert.Equal(t, token, client.token)
+	assert.Equal(t, NoRetries, client.retryPolicy)
+	assert.Equal(t, time.Minute, client.client.Timeout)
+	assert.Equal(t, time.Duration(0), httpClient.Timeout, "the given client isn't modified")
+}
+
+func TestNewClientSharesDefaultTransport(t *testing.T) {
+	first := NewClient("https://draupnir.example.com")
+	second := NewClient("https://draupnir.example.com")
+
+	assert.Equal(t, first.client.Transport, second.client.Transport)
+
+	transport := first.client.Transport.(*http.Transport)
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.Equal(t, DefaultMaxIdleConns, transport.MaxIdleConnsPerHost)
+}
+
+func TestWithConnectionOptions(t *testing.T) {
+	client := NewClient(
+		"https://draupnir.example.com",
+		WithMaxIdleConns(100),
+		WithIdleConnTimeout(time.Minute),
+	)
+
+	transport := client.client.Transport.(*http.Transport)
+	assert.Equal(t, 100, transport.MaxIdleConns)
+	assert.Equal(t, 100, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+	assert.Equal(t, DefaultMaxIdleConns, defaultTransport.MaxIdleConnsPerHost, "the default transport isn't modified")
+}
+
+func TestHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"data": {"type": "images", "id": "%d", "attributes": {"ready": true}}}`, r.ProtoMajor)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	client := NewClient(server.URL, WithRootCAs(pool), WithRetryPolicy(NoRetries))
+	image, err := client.GetImage("1")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, image.ID, "the request is sent over HTTP/2")
+
+	client = NewClient(server.URL, WithRootCAs(pool), WithoutHTTP2(), WithRetryPolicy(NoRetries))
+	image, err = client.GetImage("1")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, image.ID, "the request is sent over HTTP/1.1")
+}
+
+func TestWithInsecureSkipVerify(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": true}}}`)
+	}))
+	defer server.Close()
+
+	_, err := NewClient(server.URL, WithRetryPolicy(NoRetries)).GetImage("1")
+	assert.NotNil(t, err, "the server's certificate is self-signed")
+
+	client := NewClient(server.URL, WithInsecureSkipVerify(), WithRetryPolicy(NoRetries))
+	image, err := client.GetImage("1")
+	assert.Nil(t, err)
+	assert.True(t, image.Ready)
+}
+
+func TestWithClientCertificate(t *testing.T) {
+	cert, key := generateCertificate(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 1, len(r.TLS.PeerCertificates))
+		fmt.Fprint(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": true}}}`)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	client := NewClient(
+		server.URL,
+		WithHTTPClient(server.Client()),
+		WithClientCertificate(cert, key),
+		WithRetryPolicy(NoRetries),
+	)
+
+	image, err := client.GetImage("1")
+	assert.Nil(t, err)
+	assert.True(t, image.Ready)
+}
+
+func TestWithInvalidClientCertificate(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("the request should not reach the server")
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	client := NewClient(
+		server.URL,
+		WithHTTPClient(server.Client()),
+		WithClientCertificate([]byte("not a certificate"), []byte("not a key")),
+		WithRetryPolicy(NoRetries),
+	)
+
+	_, err := client.GetImage("1")
+	assert.Contains(t, err.Error(), "invalid client certificate")
+}
+
+// generateCertificate returns a PEM encoded self-signed certificate and key
+func generateCertificate(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "draupnir client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
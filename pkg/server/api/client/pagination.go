@@ -0,0 +1,264 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// ListOptions selects a page of a list, using the JSON:API page[number] and
+// page[size] query parameters. If neither is set, the whole list is returned,
+// following the links to any further pages.
+type ListOptions struct {
+	// Page is the 1-indexed page number
+	Page int
+	// Limit is the maximum number of resources on each page
+	Limit int
+	// Filter selects which resources are listed
+	Filter Filter
+	// Sort orders the list by comma separated fields, each prefixed with - for
+	// descending order, e.g. "-created_at". Lists are otherwise in order of ID.
+	// Servers that don't support models.FeatureSorting ignore it, so the list
+	// methods refuse to send it to them.
+	Sort string
+}
+
+// Filter selects the resources in a list, using the JSON:API filter[...] query
+// parameters. Filtering happens on the server, so only matching resources are
+// sent. Fields with their zero value don't filter the list.
+type Filter struct {
+	// Ready lists only images that are ready
+	Ready bool
+	// ImageID lists only instances of the image
+	ImageID int
+	// User lists only instances belonging to the user, given by email address
+	// or as "me". The server only ever lists your own instances.
+	User string
+	// Statuses lists only instances with one of the statuses, e.g.
+	// models.InstanceRunning. It isn't a filter[...] parameter, so servers that
+	// don't support it would ignore it: ListInstances refuses to send it to
+	// them.
+	Statuses []string
+	// Labels lists only images or instances that have each of the labels, with
+	// the same value
+	Labels map[string]string
+	// Static lists only static instances, which are shared by everyone, rather
+	// than your own instances
+	Static bool
+}
+
+func (f Filter) addTo(params url.Values) {
+	if f.Ready {
+		params.Set("filter[ready]", "true")
+	}
+	if f.ImageID > 0 {
+		params.Set("filter[image_id]", strconv.Itoa(f.ImageID))
+	}
+	if f.User != "" {
+		params.Set("filter[user]", f.User)
+	}
+	if len(f.Statuses) > 0 {
+		params.Set("status", strings.Join(f.Statuses, ","))
+	}
+	if f.Static {
+		params.Set("filter[static]", "true")
+	}
+	for key, value := range f.Labels {
+		params.Set("filter[labels."+key+"]", value)
+	}
+}
+
+func (o ListOptions) query() string {
+	params := url.Values{}
+	o.Filter.addTo(params)
+	if o.Sort != "" {
+		params.Set("sort", o.Sort)
+	}
+	if o.Page > 0 {
+		params.Set("page[number]", strconv.Itoa(o.Page))
+	}
+	if o.Limit > 0 {
+		params.Set("page[size]", strconv.Itoa(o.Limit))
+	}
+
+	if len(params) == 0 {
+		return ""
+	}
+	return "?" + params.Encode()
+}
+
+// PaginationLinks are the JSON:API links that accompany a page of a list. A
+// link is empty if there is no such page.
+type PaginationLinks struct {
+	First string `json:"first"`
+	Prev  string `json:"prev"`
+	Next  string `json:"next"`
+	Last  string `json:"last"`
+}
+
+func parsePaginationLinks(body []byte) (PaginationLinks, error) {
+	var payload struct {
+		Links PaginationLinks `json:"links"`
+	}
+	err := json.Unmarshal(body, &payload)
+	return payload.Links, err
+}
+
+// pathForLink converts a link returned by the server into a path that can be
+// requested relative to the client's URL. We refuse to follow links to other
+// servers, as we'd be sending them our token.
+func (c Client) pathForLink(link string) (string, error) {
+	base, err := url.Parse(c.url)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+
+	resolved := base.ResolveReference(ref).String()
+	if !strings.HasPrefix(resolved, c.url+"/") {
+		return "", fmt.Errorf("refusing to follow link to another server: %s", link)
+	}
+
+	return strings.TrimPrefix(resolved, c.url), nil
+}
+
+// pager follows the next links of a paginated list
+type pager struct {
+	client Client
+	next   string
+	done   bool
+	err    error
+}
+
+// fetch requests the next page using the given function, which returns the
+// pagination links of the page that it fetched. It returns false once there
+// are no more pages, or an error has occurred.
+func (p *pager) fetch(list func(path string) (PaginationLinks, error)) bool {
+	if p.done || p.err != nil {
+		return false
+	}
+
+	links, err := list(p.next)
+	if err != nil {
+		p.err = err
+		return false
+	}
+
+	if links.Next == "" {
+		p.done = true
+		return true
+	}
+
+	p.next, p.err = p.client.pathForLink(links.Next)
+	if p.err != nil {
+		return false
+	}
+
+	return true
+}
+
+// ImagesIterator iterates over every image, fetching one page at a time. Use
+// it like a bufio.Scanner:
+//
+//	iter := client.ImagesIterator(100)
+//	for iter.Next() {
+//		image := iter.Image()
+//	}
+//	if err := iter.Err(); err != nil {
+//		...
+//	}
+type ImagesIterator struct {
+	pager
+	page    []models.Image
+	current models.Image
+}
+
+// ImagesIterator returns an iterator over every image, fetching limit images at
+// a time
+func (c Client) ImagesIterator(limit int) *ImagesIterator {
+	return &ImagesIterator{
+		pager: pager{client: c, next: "/images" + ListOptions{Limit: limit}.query()},
+	}
+}
+
+// Next advances the iterator to the next image, returning false when there are
+// no more images or an error has occurred
+func (it *ImagesIterator) Next() bool {
+	for len(it.page) == 0 {
+		fetched := it.fetch(func(path string) (PaginationLinks, error) {
+			var links PaginationLinks
+			var err error
+			it.page, links, err = it.client.listImages(path)
+			return links, err
+		})
+		if !fetched && len(it.page) == 0 {
+			return false
+		}
+	}
+
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Image returns the image that the iterator is positioned at
+func (it *ImagesIterator) Image() models.Image {
+	return it.current
+}
+
+// Err returns the first error encountered whilst iterating
+func (it *ImagesIterator) Err() error {
+	return it.err
+}
+
+// InstancesIterator iterates over every instance, fetching one page at a time.
+// It is used in the same way as ImagesIterator.
+type InstancesIterator struct {
+	pager
+	page    []models.Instance
+	current models.Instance
+}
+
+// InstancesIterator returns an iterator over every instance, fetching limit
+// instances at a time
+func (c Client) InstancesIterator(limit int) *InstancesIterator {
+	return &InstancesIterator{
+		pager: pager{client: c, next: "/instances" + ListOptions{Limit: limit}.query()},
+	}
+}
+
+// Next advances the iterator to the next instance, returning false when there
+// are no more instances or an error has occurred
+func (it *InstancesIterator) Next() bool {
+	for len(it.page) == 0 {
+		fetched := it.fetch(func(path string) (PaginationLinks, error) {
+			var links PaginationLinks
+			var err error
+			it.page, links, err = it.client.listInstances(path)
+			return links, err
+		})
+		if !fetched && len(it.page) == 0 {
+			return false
+		}
+	}
+
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Instance returns the instance that the iterator is positioned at
+func (it *InstancesIterator) Instance() models.Instance {
+	return it.current
+}
+
+// Err returns the first error encountered whilst iterating
+func (it *InstancesIterator) Err() error {
+	return it.err
+}
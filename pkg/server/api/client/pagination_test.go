@@ -0,0 +1,177 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+func TestListOptionsQuery(t *testing.T) {
+	assert.Equal(t, "", ListOptions{}.query())
+	assert.Equal(t, "?page%5Bsize%5D=50", ListOptions{Limit: 50}.query())
+	assert.Equal(t, "?page%5Bnumber%5D=2&page%5Bsize%5D=50", ListOptions{Page: 2, Limit: 50}.query())
+	assert.Equal(t, "?filter%5Bready%5D=true", ListOptions{Filter: Filter{Ready: true}}.query())
+	assert.Equal(
+		t,
+		"?filter%5Bimage_id%5D=4&filter%5Buser%5D=me&page%5Bsize%5D=50",
+		ListOptions{Limit: 50, Filter: Filter{User: "me", ImageID: 4}}.query(),
+	)
+	assert.Equal(t, "?page%5Bsize%5D=50&sort=-created_at%2Cid", ListOptions{Limit: 50, Sort: "-created_at,id"}.query())
+	assert.Equal(
+		t,
+		"?status=running%2Cstandby",
+		ListOptions{Filter: Filter{Statuses: []string{models.InstanceRunning, models.InstanceStandby}}}.query(),
+	)
+	assert.Equal(
+		t,
+		"?filter%5Blabels.cluster%5D=payments-eu&filter%5Bready%5D=true",
+		ListOptions{Filter: Filter{Ready: true, Labels: map[string]string{"cluster": "payments-eu"}}}.query(),
+	)
+}
+
+func TestPathForLink(t *testing.T) {
+	client := NewClient("https://draupnir.example.com/draupnir")
+
+	path, err := client.pathForLink("/draupnir/images?page%5Bnumber%5D=2")
+	assert.Nil(t, err)
+	assert.Equal(t, "/images?page%5Bnumber%5D=2", path)
+
+	path, err = client.pathForLink("https://draupnir.example.com/draupnir/images?page%5Bnumber%5D=2")
+	assert.Nil(t, err)
+	assert.Equal(t, "/images?page%5Bnumber%5D=2", path)
+
+	_, err = client.pathForLink("https://evil.example.com/draupnir/images")
+	assert.NotNil(t, err)
+}
+
+func TestImagesIterator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/images", r.URL.Path)
+		assert.Equal(t, "1", r.URL.Query().Get("page[size]"))
+
+		switch r.URL.Query().Get("page[number]") {
+		case "":
+			fmt.Fprint(w, `{
+				"data": [{"type": "images", "id": "1", "attributes": {"ready": true}}],
+				"links": {"next": "/images?page%5Bnumber%5D=2&page%5Bsize%5D=1"}
+			}`)
+		case "2":
+			fmt.Fprint(w, `{
+				"data": [{"type": "images", "id": "2", "attributes": {"ready": false}}],
+				"links": {"next": "/images?page%5Bnumber%5D=3&page%5Bsize%5D=1"}
+			}`)
+		case "3":
+			fmt.Fprint(w, `{"data": [], "links": {}}`)
+		default:
+			t.Fatalf("unexpected request: %s", r.URL)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	iter := client.ImagesIterator(1)
+
+	var ids []int
+	for iter.Next() {
+		ids = append(ids, iter.Image().ID)
+	}
+
+	assert.Nil(t, iter.Err())
+	assert.Equal(t, []int{1, 2}, ids)
+}
+
+func TestImagesIteratorError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"title": "Resource Not Found", "detail": "Not here"}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	iter := client.ImagesIterator(1)
+
+	assert.False(t, iter.Next())
+	assert.EqualError(t, iter.Err(), "Resource Not Found (Not here)")
+}
+
+func TestListInstancesFollowsPages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/instances", r.URL.Path)
+		assert.Equal(t, "running", r.URL.Query().Get("status"))
+
+		switch r.URL.Query().Get("page[number]") {
+		case "":
+			fmt.Fprint(w, `{
+				"data": [{"type": "instances", "id": "1", "attributes": {"status": "running"}}],
+				"links": {"next": "/instances?page%5Bnumber%5D=2&page%5Bsize%5D=1&status=running"}
+			}`)
+		case "2":
+			fmt.Fprint(w, `{"data": [{"type": "instances", "id": "2", "attributes": {"status": "running"}}]}`)
+		default:
+			t.Errorf("unexpected page: %s", r.URL.RawQuery)
+		}
+	}))
+	defer server.Close()
+
+	instances, err := NewClient(server.URL).ListInstances(ListOptions{Filter: Filter{Statuses: []string{models.InstanceRunning}}})
+
+	assert.Nil(t, err)
+	if assert.Len(t, instances, 2) {
+		assert.Equal(t, 1, instances[0].ID)
+		assert.Equal(t, 2, instances[1].ID)
+	}
+}
+
+func TestListImagesWithLimitFetchesOnePage(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `{
+			"data": [{"type": "images", "id": "1", "attributes": {"ready": true}}],
+			"links": {"next": "/images?page%5Bnumber%5D=2&page%5Bsize%5D=1"}
+		}`)
+	}))
+	defer server.Close()
+
+	images, err := NewClient(server.URL).ListImages(ListOptions{Limit: 1})
+
+	assert.Nil(t, err)
+	assert.Len(t, images, 1)
+	assert.Equal(t, 1, requests)
+}
+
+func TestListImagesSortedByOlderServer(t *testing.T) {
+	var versionRequests int32
+	server := serveVersion(version.Version, &versionRequests)
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	_, err := client.ServerVersion()
+	assert.Nil(t, err)
+
+	_, err = client.ListImages(ListOptions{Sort: "-created_at"})
+
+	_, ok := err.(*ErrUnsupportedFeature)
+	assert.True(t, ok, "expected an *ErrUnsupportedFeature, got %v", err)
+}
+
+func TestListInstancesByLabelFromOlderServer(t *testing.T) {
+	var versionRequests int32
+	server := serveVersion(version.Version, &versionRequests)
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	_, err := client.ServerVersion()
+	assert.Nil(t, err)
+
+	_, err = client.ListInstances(ListOptions{Filter: Filter{Labels: map[string]string{"team": "payments"}}})
+
+	_, ok := err.(*ErrUnsupportedFeature)
+	assert.True(t, ok, "expected an *ErrUnsupportedFeature, got %v", err)
+}
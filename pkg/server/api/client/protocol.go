@@ -0,0 +1,114 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+
+	"github.com/gocardless/draupnir/pkg/models/extras"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/server/api/plain"
+)
+
+// Protocol is the format in which the client exchanges resources with the
+// server
+type Protocol int
+
+const (
+	// ProtocolJSONAPI exchanges JSON:API documents, which every server
+	// supports. It's the default.
+	ProtocolJSONAPI Protocol = iota
+	// ProtocolPlainJSON exchanges plain JSON with the server's /v2 facade,
+	// which servers advertise with models.FeaturePlainJSON
+	ProtocolPlainJSON
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolJSONAPI:
+		return "jsonapi"
+	case ProtocolPlainJSON:
+		return "plain_json"
+	default:
+		return fmt.Sprintf("Protocol(%d)", int(p))
+	}
+}
+
+// prefix returns the path beneath which the protocol is served
+func (p Protocol) prefix() string {
+	if p == ProtocolPlainJSON {
+		return middleware.PlainJSONPrefix
+	}
+	return ""
+}
+
+// marshal writes the model as a request body in the client's protocol. Models
+// that keep attributes that they don't know about, such as images, are written
+// with them, so that they aren't lost if the model is sent back to the server.
+func (c Client) marshal(w io.Writer, model interface{}) error {
+	if c.protocol == ProtocolPlainJSON {
+		return plain.Marshal(w, model)
+	}
+	return extras.MarshalOnePayloadWithoutIncluded(w, model)
+}
+
+// unmarshal reads a response body in the client's protocol into the model,
+// having validated it if the client validates responses strictly
+func (c Client) unmarshal(r io.Reader, model interface{}) error {
+	r, err := c.validateResponse(r, reflect.TypeOf(model), false)
+	if err != nil {
+		return err
+	}
+
+	if c.protocol == ProtocolPlainJSON {
+		return plain.Unmarshal(r, model)
+	}
+	return extras.UnmarshalPayload(r, model)
+}
+
+// unmarshalMany reads a response body in the client's protocol as a list of
+// models of the given type
+func (c Client) unmarshalMany(r io.Reader, t reflect.Type) ([]interface{}, error) {
+	r, err := c.validateResponse(r, t, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.protocol == ProtocolPlainJSON {
+		return plain.UnmarshalMany(r, t)
+	}
+	return extras.UnmarshalManyPayload(r, t)
+}
+
+// paginationLinks returns the links to the other pages of a list, which are in
+// the body of JSON:API responses, and the Link header of plain JSON ones
+func (c Client) paginationLinks(body []byte, linkHeader string) (PaginationLinks, error) {
+	if c.protocol == ProtocolPlainJSON {
+		return parseLinkHeader(linkHeader), nil
+	}
+	return parsePaginationLinks(body)
+}
+
+// linkPattern matches each link in an RFC 8288 Link header, capturing its URL
+// and relation type
+var linkPattern = regexp.MustCompile(`<([^>]*)>\s*;\s*rel="?([^",;]+)"?`)
+
+// parseLinkHeader returns the pagination links in a Link header, ignoring any
+// other links
+func parseLinkHeader(header string) PaginationLinks {
+	var links PaginationLinks
+	for _, match := range linkPattern.FindAllStringSubmatch(header, -1) {
+		switch match[2] {
+		case "first":
+			links.First = match[1]
+		case "prev":
+			links.Prev = match[1]
+		case "next":
+			links.Next = match[1]
+		case "last":
+			links.Last = match[1]
+		}
+	}
+	return links
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlainJSONGetInstance(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/instances/1", r.URL.Path)
+		fmt.Fprint(w, `{
+			"id": 1,
+			"image_id": 2,
+			"port": 5432,
+			"annotations": {"owner": "payments"},
+			"credentials": {"id": 1, "client_key": "key"}
+		}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries), WithProtocol(ProtocolPlainJSON))
+	instance, err := client.GetInstance("1")
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, instance.ID)
+	assert.Equal(t, 2, instance.ImageID)
+	assert.Equal(t, uint16(5432), instance.Port)
+	assert.Equal(t, models.Annotations{"owner": "payments"}, instance.Annotations)
+	if assert.NotNil(t, instance.Credentials) {
+		assert.Equal(t, "key", instance.Credentials.ClientKey)
+	}
+}
+
+func TestPlainJSONCreateInstance(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/v2/instances", r.URL.Path)
+
+		var body map[string]interface{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, map[string]interface{}{"image_id": "2", "standby": false}, body)
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id": 3, "image_id": 2}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries), WithProtocol(ProtocolPlainJSON))
+	instance, err := client.CreateInstance(models.Image{ID: 2})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, instance.ID)
+}
+
+func TestPlainJSONImagesIterator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/images", r.URL.Path)
+
+		switch r.URL.Query().Get("page[number]") {
+		case "":
+			w.Header().Set("Link", `</v2/images?page%5Bnumber%5D=2&page%5Bsize%5D=1>; rel="next"`)
+			fmt.Fprint(w, `[{"id": 1, "ready": true}]`)
+		case "2":
+			fmt.Fprint(w, `[{"id": 2, "ready": false}]`)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries), WithProtocol(ProtocolPlainJSON))
+
+	var ids []int
+	iter := client.ImagesIterator(1)
+	for iter.Next() {
+		ids = append(ids, iter.Image().ID)
+	}
+
+	assert.Nil(t, iter.Err())
+	assert.Equal(t, []int{1, 2}, ids)
+}
+
+func TestPlainJSONError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"title": "Resource Not Found", "detail": "Not here"}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries), WithProtocol(ProtocolPlainJSON))
+	_, err := client.GetImage("1")
+
+	assert.EqualError(t, err, "Resource Not Found (Not here)")
+}
+
+func TestParseLinkHeader(t *testing.T) {
+	links := parseLinkHeader(`</images?page=1>; rel="first", </images?page=3>; rel=next, <https://example.com>; rel="help"`)
+
+	assert.Equal(t, PaginationLinks{First: "/images?page=1", Next: "/images?page=3"}, links)
+	assert.Equal(t, PaginationLinks{}, parseLinkHeader(""))
+}
+
+func TestUnknownAttributesAreKept(t *testing.T) {
+	bodies := map[Protocol]string{
+		ProtocolJSONAPI:   `{"data": {"type": "images", "id": "1", "attributes": {"ready": true, "tags": {"team": "payments"}}}}`,
+		ProtocolPlainJSON: `{"id": 1, "ready": true, "tags": {"team": "payments"}}`,
+	}
+
+	for protocol, body := range bodies {
+		t.Run(protocol.String(), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, body)
+			}))
+			defer server.Close()
+
+			client := NewClient(server.URL, WithRetryPolicy(NoRetries), WithProtocol(protocol))
+			image, err := client.GetImage("1")
+
+			assert.Nil(t, err)
+			assert.True(t, image.Ready)
+			assert.Equal(t, map[string]interface{}{"team": "payments"}, image.Extras["tags"])
+
+			// An older client sending the image back doesn't drop them
+			var payload bytes.Buffer
+			assert.Nil(t, client.marshal(&payload, &image))
+			assert.Contains(t, payload.String(), `"tags":{"team":"payments"}`)
+		})
+	}
+}
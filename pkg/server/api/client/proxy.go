@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// ProxyInstance connects to the instance through the server's proxy, which
+// records the session. The connection carries the Postgres protocol to the
+// instance: it's unencrypted, as the connection to the server is already
+// encrypted, and needs no credentials. Instances of regulated images, whose
+// ProxyRequired is set, can only be connected to in this way.
+//
+// The context only bounds opening the connection. Callers must close it once
+// they're done with it.
+func (c Client) ProxyInstance(ctx context.Context, instanceID int) (io.ReadWriteCloser, error) {
+	if err := c.negotiation.unsupported(models.FeatureInstanceProxy); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/instances/%d/proxy", c.url, instanceID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", models.ProxyProtocol)
+
+	// HTTP/2 connections can't be upgraded, and the session lasts for as long as
+	// the caller wants, so mustn't be subject to the client's timeout
+	proxyClient := *c.client
+	proxyClient.Timeout = 0
+	proxyClient.Transport = http1Transport(c.client.Transport)
+
+	resp, err := c.doWithClient(&proxyClient, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		return nil, parseError(resp.Body)
+	}
+
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, errors.New("the server didn't upgrade the connection")
+	}
+	return conn, nil
+}
+
+// http1Transport returns a copy of the transport that only speaks HTTP/1.1.
+// Transports that aren't an *http.Transport, and that don't wrap one, are
+// returned as they are.
+func http1Transport(transport http.RoundTripper) http.RoundTripper {
+	switch t := transport.(type) {
+	case nil:
+		return http1Transport(defaultTransport)
+	case hookTransport:
+		t.base = http1Transport(t.base)
+		return t
+	case *http.Transport:
+		t = t.Clone()
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if t.TLSClientConfig != nil {
+			t.TLSClientConfig.NextProtos = []string{"http/1.1"}
+		}
+		return t
+	default:
+		return transport
+	}
+}
+
+// InstanceProxy relays local connections to an instance through the server's
+// proxy, so that Postgres clients such as psql can connect to instances of
+// regulated images
+type InstanceProxy struct {
+	Client     DraupnirClient
+	InstanceID int
+	// OnError, if set, is called with the error of each local connection that
+	// couldn't be relayed
+	OnError func(error)
+}
+
+// Serve relays each connection that the listener accepts, until the context
+// is done or the listener is closed. Clients must connect with SSL disabled
+// and without credentials, as the server's proxy encrypts and authenticates
+// the connection to the instance.
+func (p InstanceProxy) Serve(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer local.Close()
+
+			remote, err := p.Client.ProxyInstance(ctx, p.InstanceID)
+			if err != nil {
+				if p.OnError != nil {
+					p.OnError(err)
+				}
+				return
+			}
+			relay(local, remote)
+		}()
+	}
+}
+
+// relay copies between the connections until either closes, and then closes
+// both
+func relay(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	copy := func(dst, src io.ReadWriteCloser) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+
+	go copy(a, b)
+	go copy(b, a)
+
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// echoProxy upgrades proxy requests, and then echoes whatever it's sent
+func echoProxy(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/instances/1/proxy", r.URL.Path)
+		assert.Equal(t, models.ProxyProtocol, r.Header.Get("Upgrade"))
+		assert.Equal(t, 1, r.ProtoMajor, "upgrades need HTTP/1.1")
+
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", models.ProxyProtocol)
+		rw.Flush()
+		io.Copy(conn, rw)
+	})
+}
+
+func TestProxyInstance(t *testing.T) {
+	server := httptest.NewUnstartedServer(echoProxy(t))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRootCAs(server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs))
+
+	conn, err := client.ProxyInstance(context.Background(), 1)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestProxyInstanceNotUpgraded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"status": "404", "title": "Resource Not Found", "detail": "no such instance"}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+
+	_, err := client.ProxyInstance(context.Background(), 1)
+	assert.EqualError(t, err, "Resource Not Found (no such instance)")
+}
+
+func TestInstanceProxyServe(t *testing.T) {
+	server := httptest.NewServer(echoProxy(t))
+	defer server.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy := InstanceProxy{Client: NewClient(server.URL), InstanceID: 1}
+	served := make(chan error)
+	go func() {
+		served <- proxy.Serve(ctx, listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buf))
+	conn.Close()
+
+	cancel()
+	assert.Nil(t, <-served)
+}
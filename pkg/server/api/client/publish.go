@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+)
+
+// PublishImage creates an image, uploads the tarball of its data directory (as
+// created by pg_basebackup -Ft), finalises it, and waits for it to be ready,
+// polling as the policy says. It replaces calling CreateImageWithOptions,
+// UploadImage, FinaliseImage and WaitForImageFinalised in turn.
+//
+// If anything fails after the image is created, the image is returned with the
+// error, so that the caller can resume the upload or finalise it by its ID.
+func (c Client) PublishImage(ctx context.Context, request routes.CreateImageRequest, tarball io.Reader, policy WaitPolicy) (models.Image, error) {
+	if len(request.Shards) > 0 {
+		return models.Image{}, errors.New("sharded images can't be published from a single tarball")
+	}
+	if len(request.Workers) > 0 {
+		return models.Image{}, errors.New("distributed images can't be published from a single tarball")
+	}
+
+	image, err := c.CreateImageWithOptions(request)
+	if err != nil {
+		return image, err
+	}
+
+	if err := c.UploadImage(ctx, image.ID, tarball); err != nil {
+		return image, err
+	}
+
+	finalised, err := c.FinaliseImage(image.ID)
+	if _, cutOff := err.(*url.Error); err != nil && !cutOff {
+		return image, err
+	}
+
+	// Finalisation carries on if the request is cut off, e.g. by a proxy's
+	// timeout, so we wait for the image to be ready instead
+	if err != nil || !finalised.Ready {
+		finalised, err = c.WaitForImageFinalised(ctx, image.ID, policy)
+		if err != nil {
+			return image, err
+		}
+	}
+
+	return finalised, nil
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+// publishServer creates image 1, holds its upload in memory, and finalises it
+// with finalise
+type publishServer struct {
+	uploadServer
+	finalise func(w http.ResponseWriter)
+	ready    bool
+}
+
+func (s *publishServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/images":
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": false}}}`)
+	case "/images/1/upload":
+		s.uploadServer.ServeHTTP(w, r)
+	case "/images/1/done":
+		s.finalise(w)
+	case "/images/1":
+		fmt.Fprintf(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": %t}}}`, s.ready)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPublishImage(t *testing.T) {
+	handler := &publishServer{uploadServer: uploadServer{t: t}}
+	handler.finalise = func(w http.ResponseWriter) {
+		fmt.Fprint(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": true}}}`)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	request := routes.CreateImageRequest{BackedUpAt: time.Now(), Anon: "SELECT 1;"}
+	image, err := client.PublishImage(context.Background(), request, strings.NewReader("basebackup"), testWaitPolicy)
+
+	assert.Nil(t, err)
+	assert.True(t, image.Ready)
+	assert.Equal(t, "basebackup", handler.upload.String())
+}
+
+func TestPublishImageWhenFinalisationIsCutOff(t *testing.T) {
+	handler := &publishServer{uploadServer: uploadServer{t: t}, ready: true}
+	handler.finalise = func(w http.ResponseWriter) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		assert.Nil(t, err)
+		conn.Close()
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	request := routes.CreateImageRequest{BackedUpAt: time.Now(), Anon: "SELECT 1;"}
+	image, err := client.PublishImage(context.Background(), request, strings.NewReader("basebackup"), testWaitPolicy)
+
+	assert.Nil(t, err)
+	assert.True(t, image.Ready)
+}
+
+func TestPublishImageWhenUploadFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/images":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": false}}}`)
+		case r.Method == http.MethodHead:
+			w.Header().Set("Upload-Offset", "0")
+		default:
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprint(w, `{"status": "422", "title": "Upload Unavailable", "detail": "image is ready"}`)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	request := routes.CreateImageRequest{BackedUpAt: time.Now(), Anon: "SELECT 1;"}
+	image, err := client.PublishImage(context.Background(), request, strings.NewReader("basebackup"), testWaitPolicy)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, image.ID)
+	assert.False(t, image.Ready)
+}
+
+func TestPublishShardedImage(t *testing.T) {
+	client := NewClient("http://localhost:0", WithRetryPolicy(NoRetries))
+	request := routes.CreateImageRequest{BackedUpAt: time.Now(), Shards: []string{"a", "b"}}
+	_, err := client.PublishImage(context.Background(), request, strings.NewReader(""), testWaitPolicy)
+
+	assert.EqualError(t, err, "sharded images can't be published from a single tarball")
+}
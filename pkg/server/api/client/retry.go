@@ -0,0 +1,189 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy describes how the client retries requests that fail for
+// transient reasons, such as the server restarting or a load balancer being
+// unable to reach it.
+//
+// Requests are retried with exponential backoff and full jitter: before
+// attempt n+1 the client sleeps for a random duration between zero and
+// min(MaxBackoff, InitialBackoff * 2^(n-1)). If the server sends a
+// Retry-After header, the client waits for that long instead, unless it is
+// longer than MaxBackoff, in which case the response is returned without
+// retrying.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts made for a request, including
+	// the first. A value of 1 or less disables retries.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// RetryRateLimited retries requests that the server rejected with 429 Too
+	// Many Requests. These are safe to retry regardless of their method, as the
+	// server didn't act on them. Otherwise, the client returns an
+	// *ErrRateLimited.
+	RetryRateLimited bool
+}
+
+// ErrRateLimited is returned when the server rejects a request with 429 Too
+// Many Requests, and it either wasn't retried or was still rate limited after
+// every attempt. Callers such as batch jobs can wait for RetryAfter before
+// trying again.
+type ErrRateLimited struct {
+	// RetryAfter is how long the server asked us to wait, or zero if it didn't
+	// say
+	RetryAfter time.Duration
+}
+
+func (e *ErrRateLimited) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limited by the server, retry after %s", e.RetryAfter)
+	}
+	return "rate limited by the server"
+}
+
+// DefaultRetryPolicy is used by clients constructed with NewClient
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// NoRetries disables retrying failed requests
+var NoRetries = RetryPolicy{MaxAttempts: 1}
+
+// backoff returns the duration to wait after the given (1-indexed) attempt has
+// failed
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.InitialBackoff
+	for i := 1; i < attempt && ceiling < p.MaxBackoff; i++ {
+		ceiling *= 2
+	}
+	if ceiling > p.MaxBackoff {
+		ceiling = p.MaxBackoff
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// doWithRetries performs the request, retrying it according to the policy
+func (p RetryPolicy) doWithRetries(client *http.Client, req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		if attempt >= p.MaxAttempts || !p.isRetryable(req, resp, err) {
+			return resp, err
+		}
+
+		wait := p.backoff(attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp, responseNow(resp)); ok {
+				if retryAfter > p.MaxBackoff {
+					return resp, err
+				}
+				wait = retryAfter
+			}
+		}
+
+		// Drain the body so that the underlying connection can be reused
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		// The body of the previous attempt has been consumed, so we need a fresh
+		// copy of it
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// isRetryable determines whether the policy retries a failed request
+func (p RetryPolicy) isRetryable(req *http.Request, resp *http.Response, err error) bool {
+	if p.RetryRateLimited && err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return isRetryable(req, resp, err)
+}
+
+// isRetryable determines whether a failed request can be safely retried.
+//
+// Requests with idempotent methods are retried after any transient failure.
+// Other requests (i.e. POST) are only retried if we can be certain that the
+// server didn't act on them: either we failed to connect at all, or the server
+// told us that it is unavailable. Retrying a POST after a connection reset or a
+// gateway timeout could otherwise create a resource twice.
+func isRetryable(req *http.Request, resp *http.Response, err error) bool {
+	idempotent := req.Method == http.MethodGet ||
+		req.Method == http.MethodHead ||
+		req.Method == http.MethodPut ||
+		req.Method == http.MethodDelete
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// We have no way of replaying the body
+		return false
+	}
+
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		return idempotent
+	}
+
+	switch resp.StatusCode {
+	case http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+
+	return false
+}
+
+// parseRetryAfter returns the duration given by the response's Retry-After
+// header, which may be a number of seconds or an HTTP date. Dates are compared
+// with now, which should be by the server's clock, as the date is.
+func parseRetryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
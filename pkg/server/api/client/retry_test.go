@@ -0,0 +1,199 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     time.Millisecond,
+}
+
+func TestDoWithRetries(t *testing.T) {
+	testCases := []struct {
+		name             string
+		method           string
+		status           int
+		expectedAttempts int
+		expectedStatus   int
+	}{
+		{"GET is retried on 503", "GET", http.StatusServiceUnavailable, 2, http.StatusOK},
+		{"GET is retried on 502", "GET", http.StatusBadGateway, 2, http.StatusOK},
+		{"POST is retried on 503", "POST", http.StatusServiceUnavailable, 2, http.StatusOK},
+		{"POST is not retried on 502", "POST", http.StatusBadGateway, 1, http.StatusBadGateway},
+		{"GET is not retried on 500", "GET", http.StatusInternalServerError, 1, http.StatusInternalServerError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if attempts == 1 {
+					w.WriteHeader(tc.status)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			req, err := http.NewRequest(tc.method, server.URL, strings.NewReader("{}"))
+			assert.Nil(t, err)
+
+			resp, err := testRetryPolicy.doWithRetries(http.DefaultClient, req)
+			assert.Nil(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, tc.expectedAttempts, attempts)
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestDoWithRetriesGivesUp(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	assert.Nil(t, err)
+
+	resp, err := testRetryPolicy.doWithRetries(http.DefaultClient, req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestDoWithRetriesStopsWhenCancelledDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		// Cancel once the client is waiting to retry
+		time.AfterFunc(10*time.Millisecond, cancel)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	assert.Nil(t, err)
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Minute, MaxBackoff: time.Minute}
+
+	start := time.Now()
+	resp, err := policy.doWithRetries(http.DefaultClient, req.WithContext(ctx))
+
+	assert.Nil(t, resp)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, attempts)
+	assert.True(t, time.Since(start) < 10*time.Second)
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+	}
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		backoff := policy.backoff(attempt)
+		assert.True(t, backoff >= 0)
+		assert.True(t, backoff < time.Second)
+	}
+
+	assert.Equal(t, time.Duration(0), NoRetries.backoff(1))
+}
+
+func TestDoWithRetriesWhenRateLimited(t *testing.T) {
+	testCases := []struct {
+		name             string
+		retryRateLimited bool
+		retryAfter       string
+		expectedAttempts int
+		expectedStatus   int
+	}{
+		{"not retried by default", false, "0", 1, http.StatusTooManyRequests},
+		{"retried when enabled", true, "0", 2, http.StatusOK},
+		{"retried without Retry-After", true, "", 2, http.StatusOK},
+		{"not retried when Retry-After exceeds MaxBackoff", true, "60", 1, http.StatusTooManyRequests},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			attempts := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts++
+				if attempts == 1 {
+					if tc.retryAfter != "" {
+						w.Header().Set("Retry-After", tc.retryAfter)
+					}
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			policy := testRetryPolicy
+			policy.RetryRateLimited = tc.retryRateLimited
+
+			req, err := http.NewRequest("POST", server.URL, strings.NewReader("{}"))
+			assert.Nil(t, err)
+
+			resp, err := policy.doWithRetries(http.DefaultClient, req)
+			assert.Nil(t, err)
+			resp.Body.Close()
+
+			assert.Equal(t, tc.expectedAttempts, attempts)
+			assert.Equal(t, tc.expectedStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		header   string
+		expected time.Duration
+		ok       bool
+	}{
+		{"missing", "", 0, false},
+		{"seconds", "30", 30 * time.Second, true},
+		{"date", "Mon, 01 May 2017 12:01:00 GMT", time.Minute, true},
+		{"date in the past", "Mon, 01 May 2017 11:00:00 GMT", 0, true},
+		{"invalid", "soon", 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tc.header != "" {
+				resp.Header.Set("Retry-After", tc.header)
+			}
+
+			retryAfter, ok := parseRetryAfter(resp, now)
+
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.expected, retryAfter)
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+)
+
+// RestartInstance restarts the instance's postgres. Only admins can take
+// runbook actions, which must give a reason and be confirmed by repeating the
+// phrase that the server asks for, e.g. "restart instance 12". An
+// *api.Error with status 428 is returned if confirm isn't that phrase, whose
+// detail gives it.
+func (c Client) RestartInstance(id int, reason, confirm string) (models.Instance, error) {
+	return c.runbookInstanceAction(id, routes.RunbookRestart, reason, confirm)
+}
+
+// RotateInstanceCredentials replaces the instance's certificates. It's a
+// runbook action, confirmed as RestartInstance is.
+func (c Client) RotateInstanceCredentials(id int, reason, confirm string) (models.Instance, error) {
+	return c.runbookInstanceAction(id, routes.RunbookRotateCredentials, reason, confirm)
+}
+
+func (c Client) runbookInstanceAction(id int, action, reason, confirm string) (models.Instance, error) {
+	var instance models.Instance
+	resp, err := c.runbookAction(fmt.Sprintf("/admin/runbook/instances/%d/%s", id, action), reason, confirm)
+	if err != nil {
+		return instance, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return instance, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &instance)
+	return instance, err
+}
+
+// RequeueOperation runs a failed operation again, returning the new operation
+// that runs it. It's a runbook action, confirmed as RestartInstance is.
+func (c Client) RequeueOperation(id int, reason, confirm string) (models.Operation, error) {
+	var operation models.Operation
+	resp, err := c.runbookAction(fmt.Sprintf("/admin/runbook/operations/%d/%s", id, routes.RunbookRequeue), reason, confirm)
+	if err != nil {
+		return operation, err
+	}
+
+	if resp.StatusCode != http.StatusAccepted {
+		return operation, parseError(resp.Body)
+	}
+
+	err = c.unmarshal(resp.Body, &operation)
+	return operation, err
+}
+
+func (c Client) runbookAction(path, reason, confirm string) (*http.Response, error) {
+	if err := c.negotiation.unsupported(models.FeatureRunbook); err != nil {
+		return nil, err
+	}
+
+	request := routes.RunbookActionRequest{Reason: reason, Confirm: confirm}
+
+	var payload bytes.Buffer
+	if err := c.marshal(&payload, &request); err != nil {
+		return nil, err
+	}
+
+	return c.post(path, &payload)
+}
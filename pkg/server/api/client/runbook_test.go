@@ -0,0 +1,67 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestRunbook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Data struct {
+				Attributes map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "INC-123", body.Data.Attributes["reason"])
+
+		switch r.Method + " " + r.URL.Path {
+		case "POST /admin/runbook/instances/12/restart":
+			if body.Data.Attributes["confirm"] != "restart instance 12" {
+				w.WriteHeader(http.StatusPreconditionRequired)
+				fmt.Fprint(w, `{"id": "precondition_required", "code": "precondition_required", "status": "428",
+					"title": "Confirmation Required",
+					"detail": "To go ahead, send the request again with confirm set to \"restart instance 12\""}`)
+				return
+			}
+			fmt.Fprint(w, `{"data": {"type": "instances", "id": "12", "attributes": {"image_id": 3, "hostname": "draupnir", "port": 5433, "status": "running"}}}`)
+		case "POST /admin/runbook/instances/12/rotate_credentials":
+			assert.Equal(t, "rotate_credentials instance 12", body.Data.Attributes["confirm"])
+			fmt.Fprint(w, `{"data": {"type": "instances", "id": "12", "attributes": {"image_id": 3, "hostname": "draupnir", "port": 5433, "status": "running"}}}`)
+		case "POST /admin/runbook/operations/40/requeue":
+			assert.Equal(t, "requeue operation 40", body.Data.Attributes["confirm"])
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, `{"data": {"type": "operations", "id": "41", "attributes": {
+				"kind": "destroy_instance", "resource_type": "instances", "resource_id": 12, "status": "queued"
+			}}}`)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries), WithStrictValidation())
+
+	_, err := client.RestartInstance(12, "INC-123", "")
+	assert.EqualError(t, err, `Confirmation Required (To go ahead, send the request again with confirm set to "restart instance 12")`)
+
+	instance, err := client.RestartInstance(12, "INC-123", "restart instance 12")
+	assert.Nil(t, err)
+	assert.Equal(t, 12, instance.ID)
+
+	instance, err = client.RotateInstanceCredentials(12, "INC-123", "rotate_credentials instance 12")
+	assert.Nil(t, err)
+	assert.Equal(t, 12, instance.ID)
+
+	operation, err := client.RequeueOperation(40, "INC-123", "requeue operation 40")
+	assert.Nil(t, err)
+	assert.Equal(t, 41, operation.ID)
+	assert.Equal(t, models.JobDestroyInstance, operation.Kind)
+}
@@ -0,0 +1,329 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SchemaError is returned by clients constructed with WithStrictValidation when
+// a response doesn't match the schema of the resources that were expected.
+// Mismatches are each prefixed with the path to the offending value, e.g.
+// "data[0].attributes.port: expected integer, got string".
+type SchemaError struct {
+	// Type is the type of the resources that were expected, e.g. "instances"
+	Type       string
+	Mismatches []string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("response doesn't match the %s schema: %s", e.Type, strings.Join(e.Mismatches, "; "))
+}
+
+// jsonSchema is the subset of JSON Schema that responseSchemas use
+type jsonSchema struct {
+	Type       schemaTypes            `json:"type"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	Required   []string               `json:"required"`
+	Items      *jsonSchema            `json:"items"`
+	Enum       []string               `json:"enum"`
+	Format     string                 `json:"format"`
+}
+
+// schemaTypes are the types that a value may have, which are given in a schema
+// as either a single type or a list of them
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(t))
+}
+
+// compiledSchemas are the responseSchemas, by the type of resource that they
+// describe. They're parsed once, when the package is loaded.
+var compiledSchemas = compileSchemas(responseSchemas)
+
+func compileSchemas(sources map[string]string) map[string]*jsonSchema {
+	schemas := make(map[string]*jsonSchema, len(sources))
+	for resourceType, source := range sources {
+		var schema jsonSchema
+		if err := json.Unmarshal([]byte(source), &schema); err != nil {
+			panic(fmt.Sprintf("invalid schema for %s: %s", resourceType, err))
+		}
+		schemas[resourceType] = &schema
+	}
+	return schemas
+}
+
+// validate checks the value against the schema, appending any mismatches
+func (s *jsonSchema) validate(value interface{}, path string, mismatches *[]string) {
+	mismatch := func(format string, args ...interface{}) {
+		*mismatches = append(*mismatches, path+": "+fmt.Sprintf(format, args...))
+	}
+
+	actual := jsonType(value)
+	if len(s.Type) > 0 && !s.allows(actual) {
+		mismatch("expected %s, got %s", strings.Join(s.Type, " or "), actual)
+		return
+	}
+
+	switch v := value.(type) {
+	case string:
+		if len(s.Enum) > 0 && !s.enumerates(v) {
+			mismatch("expected one of %s, got %q", strings.Join(s.Enum, ", "), v)
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				mismatch("expected a date-time, got %q", v)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), mismatches)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				mismatch("missing required property %s", name)
+			}
+		}
+
+		// Properties are checked in order, so that mismatches are reported in
+		// the same order each time
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if property, ok := v[name]; ok {
+				s.Properties[name].validate(property, path+"."+name, mismatches)
+			}
+		}
+	}
+}
+
+// allows returns true if a value of the given type satisfies the schema's type.
+// Integers are also numbers.
+func (s *jsonSchema) allows(actual string) bool {
+	for _, allowed := range s.Type {
+		if allowed == actual || (allowed == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// enumerates returns true if the value is one of the schema's enum
+func (s *jsonSchema) enumerates(value string) bool {
+	for _, allowed := range s.Enum {
+		if allowed == value {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonType returns the JSON Schema type of a value decoded with UseNumber
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// validateResponse reads a response body and, if the client validates
+// responses strictly, checks it against the schema of the model type. It returns a reader of the body, as it has been consumed.
+func (c Client) validateResponse(r io.Reader, t reflect.Type, many bool) (io.Reader, error) {
+	if !c.strict {
+		return r, nil
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []string
+	resourceType := primaryType(t)
+	if c.protocol == ProtocolPlainJSON {
+		mismatches = validatePlain(body, resourceType, many)
+	} else {
+		mismatches = validateDocument(body, resourceType, many)
+	}
+
+	if len(mismatches) > 0 {
+		return nil, &SchemaError{Type: resourceType, Mismatches: mismatches}
+	}
+	return bytes.NewReader(body), nil
+}
+
+// validateDocument checks a JSON:API document, returning its mismatches. Its
+// primary data must be resources of the expected type, and they and any
+// included resources must match the schemas of their types.
+func validateDocument(body []byte, resourceType string, many bool) []string {
+	var mismatches []string
+
+	document, ok := decodeForValidation(body, &mismatches).(map[string]interface{})
+	if !ok {
+		if mismatches == nil {
+			mismatches = append(mismatches, "expected a JSON:API document")
+		}
+		return mismatches
+	}
+
+	data, ok := document["data"]
+	if !ok {
+		return append(mismatches, "missing required property data")
+	}
+
+	if many {
+		resources, ok := data.([]interface{})
+		if !ok {
+			return append(mismatches, fmt.Sprintf("data: expected array, got %s", jsonType(data)))
+		}
+		for i, resource := range resources {
+			validateResource(resource, resourceType, fmt.Sprintf("data[%d]", i), &mismatches)
+		}
+	} else {
+		validateResource(data, resourceType, "data", &mismatches)
+	}
+
+	if included, ok := document["included"].([]interface{}); ok {
+		for i, resource := range included {
+			validateResource(resource, "", fmt.Sprintf("included[%d]", i), &mismatches)
+		}
+	}
+
+	return mismatches
+}
+
+// validateResource checks a JSON:API resource object. If resourceType is empty,
+// it may be of any type.
+func validateResource(value interface{}, resourceType, path string, mismatches *[]string) {
+	resource, ok := value.(map[string]interface{})
+	if !ok {
+		*mismatches = append(*mismatches, fmt.Sprintf("%s: expected object, got %s", path, jsonType(value)))
+		return
+	}
+
+	actualType, ok := resource["type"].(string)
+	switch {
+	case !ok:
+		*mismatches = append(*mismatches, fmt.Sprintf("%s.type: expected string, got %s", path, jsonType(resource["type"])))
+		return
+	case resourceType != "" && actualType != resourceType:
+		*mismatches = append(*mismatches, fmt.Sprintf("%s.type: expected %q, got %q", path, resourceType, actualType))
+		return
+	}
+
+	// IDs are always strings in JSON:API, even when they're numbers
+	if id, ok := resource["id"]; ok && jsonType(id) != "string" {
+		*mismatches = append(*mismatches, fmt.Sprintf("%s.id: expected string, got %s", path, jsonType(id)))
+	}
+
+	schema, ok := compiledSchemas[actualType]
+	if !ok {
+		return
+	}
+
+	attributes, ok := resource["attributes"]
+	if !ok {
+		// Resources with no attributes may leave them out
+		attributes = map[string]interface{}{}
+	}
+	schema.validate(attributes, path+".attributes", mismatches)
+}
+
+// validatePlain checks a plain JSON response, in which each resource is an
+// object of its ID and attributes, returning its mismatches
+func validatePlain(body []byte, resourceType string, many bool) []string {
+	var mismatches []string
+
+	value := decodeForValidation(body, &mismatches)
+	if mismatches != nil {
+		return mismatches
+	}
+
+	schema, ok := compiledSchemas[resourceType]
+	if !ok {
+		schema = &jsonSchema{Type: schemaTypes{"object"}}
+	}
+
+	if !many {
+		schema.validate(value, "$", &mismatches)
+		return mismatches
+	}
+
+	records, ok := value.([]interface{})
+	if !ok {
+		return append(mismatches, fmt.Sprintf("$: expected array, got %s", jsonType(value)))
+	}
+	for i, record := range records {
+		schema.validate(record, fmt.Sprintf("$[%d]", i), &mismatches)
+	}
+	return mismatches
+}
+
+// decodeForValidation decodes the body, keeping numbers as json.Number so that
+// integers can be told apart from other numbers
+func decodeForValidation(body []byte, mismatches *[]string) interface{} {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		*mismatches = append(*mismatches, fmt.Sprintf("invalid JSON: %s", err))
+		return nil
+	}
+	return value
+}
+
+// primaryType returns the JSON:API type of a model type, or of a slice of them,
+// from the tag of its primary field, or an empty string if it has none
+func primaryType(t reflect.Type) string {
+	if t == nil {
+		return ""
+	}
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return ""
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("jsonapi"), ",")
+		if len(tag) >= 2 && tag[0] == "primary" {
+			return tag[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestStrictValidationAcceptsValidResponses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{
+			"data": {"type": "instances", "id": "1", "attributes": {
+				"hostname": "localhost", "image_id": 2, "port": 5432, "status": "running",
+				"created_at": "2016-01-01T12:33:44Z", "expires_at": null, "added_later": "ignored"
+			}, "relationships": {"credentials": {"data": {"type": "credentials", "id": "1"}}}},
+			"included": [{"type": "credentials", "id": "1", "attributes": {
+				"ca_certificate": "ca", "client_certificate": "cert", "client_key": "key"
+			}}]
+		}`)
+	}))
+	defer server.Close()
+
+	instance, err := NewClient(server.URL, WithStrictValidation()).GetInstance("1")
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(5432), instance.Port)
+	assert.Equal(t, "key", instance.Credentials.ClientKey)
+}
+
+func TestStrictValidationReportsMismatches(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": [
+			{"type": "instances", "id": "1", "attributes": {
+				"hostname": "localhost", "image_id": 2, "port": "5432", "status": "running"
+			}},
+			{"type": "instances", "id": 2, "attributes": {
+				"image_id": 2, "port": 5433, "status": "paused", "created_at": "yesterday"
+			}},
+			{"type": "images", "id": "3", "attributes": {"ready": true}}
+		]}`)
+	}))
+	defer server.Close()
+
+	_, err := NewClient(server.URL, WithStrictValidation()).ListInstances(ListOptions{})
+
+	schemaErr, ok := err.(*SchemaError)
+	if assert.True(t, ok, "expected a *SchemaError, got %v", err) {
+		assert.Equal(t, "instances", schemaErr.Type)
+		assert.Equal(t, []string{
+			`data[0].attributes.port: expected integer, got string`,
+			`data[1].id: expected string, got integer`,
+			`data[1].attributes: missing required property hostname`,
+			`data[1].attributes.created_at: expected a date-time, got "yesterday"`,
+			`data[1].attributes.status: expected one of running, standby, expired, destroying, got "paused"`,
+			`data[2].type: expected "instances", got "images"`,
+		}, schemaErr.Mismatches)
+	}
+}
+
+func TestLenientByDefault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"type": "instances", "id": "1", "attributes": {"port": 5432, "status": "paused"}}}`)
+	}))
+	defer server.Close()
+
+	instance, err := NewClient(server.URL).GetInstance("1")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "paused", instance.Status)
+}
+
+func TestStrictValidationOfPlainJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id": 1, "ready": "yes"}]`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithStrictValidation(), WithProtocol(ProtocolPlainJSON))
+	_, err := client.ListImages(ListOptions{})
+
+	assert.EqualError(t, err, `response doesn't match the images schema: $[0].ready: expected boolean, got string`)
+}
+
+func TestPrimaryType(t *testing.T) {
+	assert.Equal(t, "images", primaryType(reflect.TypeOf(&models.Image{})))
+	assert.Equal(t, "instance_counts", primaryType(reflect.TypeOf(models.InstanceCount{})))
+	assert.Equal(t, "instances", primaryType(reflect.TypeOf([]models.Instance{})))
+	assert.Equal(t, "", primaryType(reflect.TypeOf("string")))
+}
@@ -0,0 +1,199 @@
+package client
+
+// responseSchemas are the JSON schemas of the attributes of each type of
+// resource that the server returns, against which clients constructed with
+// WithStrictValidation validate responses. They describe what this version of
+// the client relies on, so attributes that they don't mention are allowed.
+//
+// They use the subset of JSON Schema that jsonSchema implements: type,
+// properties, required, items, enum and the date-time format. Attributes that
+// the server leaves out when they're zero, such as times, aren't required.
+var responseSchemas = map[string]string{
+	"images": `{
+		"type": "object",
+		"required": ["ready"],
+		"properties": {
+			"backed_up_at": {"type": "string", "format": "date-time"},
+			"ready": {"type": "boolean"},
+			"created_at": {"type": "string", "format": "date-time"},
+			"updated_at": {"type": "string", "format": "date-time"},
+			"shards": {"type": ["array", "null"], "items": {"type": "string"}},
+			"workers": {"type": ["object", "null"]},
+			"annotations": {"type": ["object", "null"]},
+			"labels": {"type": ["object", "null"]},
+			"backup_checksum": {"type": "string"},
+			"backup_lsn": {"type": "string"},
+			"snapshot_checksum": {"type": "string"},
+			"drop_databases": {"type": ["array", "null"], "items": {"type": "string"}},
+			"rename_databases": {"type": ["object", "null"]},
+			"encoding": {"type": "string"},
+			"locale": {"type": "string"}
+		}
+	}`,
+	"instances": `{
+		"type": "object",
+		"required": ["hostname", "image_id", "port", "status"],
+		"properties": {
+			"hostname": {"type": "string"},
+			"image_id": {"type": "integer"},
+			"created_at": {"type": "string", "format": "date-time"},
+			"updated_at": {"type": "string", "format": "date-time"},
+			"port": {"type": "integer"},
+			"address": {"type": "string"},
+			"shard_dsns": {"type": ["array", "null"], "items": {"type": "string"}},
+			"standby": {"type": "boolean"},
+			"schema_only": {"type": "boolean"},
+			"static_name": {"type": "string"},
+			"proxy_required": {"type": "boolean"},
+			"annotations": {"type": ["object", "null"]},
+			"labels": {"type": ["object", "null"]},
+			"expires_at": {"type": ["string", "null"], "format": "date-time"},
+			"status": {"type": "string", "enum": ["running", "standby", "expired", "destroying"]}
+		}
+	}`,
+	"credentials": `{
+		"type": "object",
+		"required": ["ca_certificate", "client_certificate", "client_key"],
+		"properties": {
+			"ca_certificate": {"type": "string"},
+			"client_certificate": {"type": "string"},
+			"client_key": {"type": "string"}
+		}
+	}`,
+	"instance_counts": `{
+		"type": "object",
+		"required": ["dimension", "value", "count"],
+		"properties": {
+			"dimension": {"type": "string", "enum": ["status", "owner"]},
+			"value": {"type": "string"},
+			"count": {"type": "integer"}
+		}
+	}`,
+	"instance_groups": `{
+		"type": "object",
+		"properties": {
+			"instance_ids": {"type": ["array", "null"], "items": {"type": "string"}},
+			"created_at": {"type": "string", "format": "date-time"},
+			"expires_at": {"type": ["string", "null"], "format": "date-time"}
+		}
+	}`,
+	"operations": `{
+		"type": "object",
+		"required": ["kind", "resource_type", "resource_id", "status"],
+		"properties": {
+			"kind": {"type": "string"},
+			"resource_type": {"type": "string", "enum": ["images", "instances"]},
+			"resource_id": {"type": "integer"},
+			"status": {"type": "string", "enum": ["queued", "running", "succeeded", "failed", "interrupted"]},
+			"phase": {"type": "string"},
+			"error": {"type": "string"},
+			"error_class": {"type": "string"},
+			"started_at": {"type": "string", "format": "date-time"},
+			"finished_at": {"type": ["string", "null"], "format": "date-time"}
+		}
+	}`,
+	"search_results": `{
+		"type": "object",
+		"required": ["resource_type", "resource_id", "score"],
+		"properties": {
+			"resource_type": {"type": "string", "enum": ["images", "instances"]},
+			"resource_id": {"type": "integer"},
+			"score": {"type": "number"}
+		}
+	}`,
+	"stale_images": `{
+		"type": "object",
+		"required": ["family", "anon_hash", "spec_hash", "policy"],
+		"properties": {
+			"family": {"type": "string"},
+			"backed_up_at": {"type": "string", "format": "date-time"},
+			"anon_hash": {"type": "string"},
+			"spec_hash": {"type": "string"},
+			"policy": {"type": "string", "enum": ["report", "rebake", "block"]}
+		}
+	}`,
+	"cleanup_tokens": `{
+		"type": "object",
+		"required": ["user_email"],
+		"properties": {
+			"token": {"type": "string"},
+			"user_email": {"type": "string"},
+			"instance_ids": {"type": ["array", "null"], "items": {"type": "string"}},
+			"destroyed_instance_ids": {"type": ["array", "null"], "items": {"type": "string"}},
+			"created_at": {"type": "string", "format": "date-time"},
+			"expires_at": {"type": "string", "format": "date-time"},
+			"used_at": {"type": ["string", "null"], "format": "date-time"}
+		}
+	}`,
+	"freshness_statuses": `{
+		"type": "object",
+		"required": ["max_age", "met"],
+		"properties": {
+			"max_age": {"type": "string"},
+			"met": {"type": "boolean"},
+			"latest_image_id": {"type": "integer"},
+			"latest_backed_up_at": {"type": ["string", "null"], "format": "date-time"},
+			"violated_since": {"type": ["string", "null"], "format": "date-time"},
+			"checked_at": {"type": "string", "format": "date-time"}
+		}
+	}`,
+	"users": `{
+		"type": "object",
+		"required": ["instances"],
+		"properties": {
+			"roles": {"type": ["array", "null"], "items": {"type": "string"}},
+			"instances": {"type": "integer"},
+			"max_instances": {"type": "integer"},
+			"images_in_progress": {"type": "integer"},
+			"max_images_in_progress": {"type": "integer"},
+			"image_cooldown": {"type": "string"}
+		}
+	}`,
+	"versions": `{
+		"type": "object",
+		"required": ["features"],
+		"properties": {
+			"features": {"type": ["array", "null"], "items": {"type": "string"}}
+		}
+	}`,
+	"break_glass_grants": `{
+		"type": "object",
+		"required": ["user_email", "image_id", "reason", "expires_at"],
+		"properties": {
+			"user_email": {"type": "string"},
+			"image_id": {"type": "integer"},
+			"reason": {"type": "string"},
+			"granted_by": {"type": "string"},
+			"created_at": {"type": "string", "format": "date-time"},
+			"expires_at": {"type": "string", "format": "date-time"},
+			"revoked_at": {"type": ["string", "null"], "format": "date-time"},
+			"revoked_by": {"type": "string"}
+		}
+	}`,
+	"access_requests": `{
+		"type": "object",
+		"required": ["user_email", "family", "reason", "valid_for", "status"],
+		"properties": {
+			"user_email": {"type": "string"},
+			"family": {"type": "string"},
+			"reason": {"type": "string"},
+			"valid_for": {"type": "string"},
+			"status": {"type": "string", "enum": ["pending", "approved", "denied"]},
+			"decided_by": {"type": "string"},
+			"decided_at": {"type": ["string", "null"], "format": "date-time"},
+			"expires_at": {"type": ["string", "null"], "format": "date-time"},
+			"created_at": {"type": "string", "format": "date-time"}
+		}
+	}`,
+	"device_authorizations": `{
+		"type": "object",
+		"required": ["user_code", "verification_uri", "expires_in", "interval"],
+		"properties": {
+			"user_code": {"type": "string"},
+			"verification_uri": {"type": "string"},
+			"verification_uri_complete": {"type": "string"},
+			"expires_in": {"type": "integer"},
+			"interval": {"type": "integer"}
+		}
+	}`,
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"bytes"
+	"net/url"
+	"reflect"
+	"strconv"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// Search returns the images, and your instances, whose labels, owner,
+// annotations, shard names or ID match the query, most relevant first. Each
+// result has the image or instance that it refers to. At most limit results
+// are returned, or a page of the server's default size if it's 0.
+func (c Client) Search(query string, limit int) ([]models.SearchResult, error) {
+	var results []models.SearchResult
+	if err := c.negotiation.unsupported(models.FeatureSearch); err != nil {
+		return results, err
+	}
+
+	params := url.Values{}
+	params.Set("q", query)
+	if limit > 0 {
+		params.Set("page[size]", strconv.Itoa(limit))
+	}
+
+	body, err := c.getBody("/search?" + params.Encode())
+	if err != nil {
+		return results, err
+	}
+
+	maybeResults, err := c.unmarshalMany(bytes.NewReader(body), reflect.TypeOf(results))
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert from []interface{} to []SearchResult
+	results = make([]models.SearchResult, 0, len(maybeResults))
+	for _, result := range maybeResults {
+		results = append(results, *result.(*models.SearchResult))
+	}
+
+	return results, nil
+}
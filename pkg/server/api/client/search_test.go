@@ -0,0 +1,70 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+func TestSearch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/search", r.URL.Path)
+		assert.Equal(t, "payments eu", r.URL.Query().Get("q"))
+		assert.Equal(t, "5", r.URL.Query().Get("page[size]"))
+
+		fmt.Fprint(w, `{
+			"data": [
+				{"type": "search_results", "id": "instances:4",
+				 "attributes": {"resource_type": "instances", "resource_id": 4, "score": 0.6},
+				 "relationships": {"instance": {"data": {"type": "instances", "id": "4"}}}},
+				{"type": "search_results", "id": "images:3",
+				 "attributes": {"resource_type": "images", "resource_id": 3, "score": 0.4},
+				 "relationships": {"image": {"data": {"type": "images", "id": "3"}}}}
+			],
+			"included": [
+				{"type": "instances", "id": "4", "attributes": {"image_id": 3, "hostname": "draupnir.example.com", "port": 5432, "status": "running"}},
+				{"type": "images", "id": "3", "attributes": {"ready": true, "labels": {"cluster": "payments-eu"}}}
+			]
+		}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries), WithStrictValidation())
+	results, err := client.Search("payments eu", 5)
+
+	assert.Nil(t, err)
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, models.SearchResultInstance, results[0].ResourceType)
+		assert.Equal(t, 0.6, results[0].Score)
+		if assert.NotNil(t, results[0].Instance) {
+			assert.Equal(t, 5432, int(results[0].Instance.Port))
+		}
+		assert.Nil(t, results[0].Image)
+
+		assert.Equal(t, 3, results[1].ResourceID)
+		if assert.NotNil(t, results[1].Image) {
+			assert.Equal(t, "payments-eu", results[1].Image.Labels["cluster"])
+		}
+	}
+}
+
+func TestSearchFromOlderServer(t *testing.T) {
+	var versionRequests int32
+	server := serveVersion(version.Version, &versionRequests)
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	_, err := client.ServerVersion()
+	assert.Nil(t, err)
+
+	_, err = client.Search("payments", 0)
+
+	_, ok := err.(*ErrUnsupportedFeature)
+	assert.True(t, ok, "expected an *ErrUnsupportedFeature, got %v", err)
+}
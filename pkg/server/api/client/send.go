@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+)
+
+// SendImage writes the image's snapshot to w as a btrfs send stream, which
+// btrfs receive recreates the snapshot from, e.g. to replicate images to
+// another region. Only the upload user can send images.
+//
+// parentIDs are the images that the receiver already has. If one of them is
+// an earlier image of the same family, the stream only holds the differences
+// from it, and its ID is returned. Otherwise the whole snapshot is sent, and
+// zero is returned.
+//
+// The stream is written as it arrives, so if it's cut short, w will have been
+// given part of it. btrfs receive rejects streams that are cut short.
+func (c Client) SendImage(ctx context.Context, imageID int, parentIDs []int, w io.Writer) (int, error) {
+	if err := c.negotiation.unsupported(models.FeatureImageSend); err != nil {
+		return 0, err
+	}
+
+	path := fmt.Sprintf("/images/%d/send", imageID)
+	if len(parentIDs) > 0 {
+		ids := make([]string, 0, len(parentIDs))
+		for _, id := range parentIDs {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		path += "?parents=" + strings.Join(ids, ",")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+path, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// Whole snapshots can take hours to send, so mustn't be subject to the
+	// client's timeout
+	streamClient := *c.client
+	streamClient.Timeout = 0
+
+	resp, err := c.doWithClient(&streamClient, req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, parseError(resp.Body)
+	}
+
+	parentID := 0
+	if header := resp.Header.Get(routes.SendParentHeader); header != "" {
+		parentID, err = strconv.Atoi(header)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s header: %q", routes.SendParentHeader, header)
+		}
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return parentID, err
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+)
+
+func TestSendImage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/images/5/send", r.URL.Path)
+		if r.URL.Query().Get("parents") == "3,4" {
+			w.Header().Set(routes.SendParentHeader, "4")
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		fmt.Fprint(w, "btrfs-stream")
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+
+	var stream bytes.Buffer
+	parentID, err := client.SendImage(context.Background(), 5, []int{3, 4}, &stream)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, parentID)
+	assert.Equal(t, "btrfs-stream", stream.String())
+
+	stream.Reset()
+	parentID, err = client.SendImage(context.Background(), 5, nil, &stream)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, parentID, "the whole snapshot is sent")
+	assert.Equal(t, "btrfs-stream", stream.String())
+}
+
+func TestSendImageWhenForbidden(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"status": "403", "title": "Forbidden", "detail": "Only the upload user can perform this action"}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+
+	var stream bytes.Buffer
+	_, err := client.SendImage(context.Background(), 5, nil, &stream)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, stream.Len())
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerTiming is the time that the server spent handling a request, as given
+// in the Server-Timing header of its response
+type ServerTiming struct {
+	// DB is the time spent outside of the executor and rendering the response,
+	// which is almost all spent querying the database
+	DB time.Duration
+	// Executor is the time spent in operations on images and instances
+	Executor time.Duration
+	// Render is the time spent writing the response
+	Render time.Duration
+	// Total is the time the server spent on the request, from when its handler
+	// received it until its response was ready to be sent
+	Total time.Duration
+}
+
+// ParseServerTiming parses the Server-Timing header of a response, returning
+// false if it hasn't got one, e.g. because it was streamed, or came from a
+// server that doesn't send it. Metrics that it doesn't recognise are ignored.
+func ParseServerTiming(resp *http.Response) (ServerTiming, bool) {
+	var timing ServerTiming
+	found := false
+
+	for _, header := range resp.Header.Values("Server-Timing") {
+		for _, metric := range strings.Split(header, ",") {
+			params := strings.Split(metric, ";")
+
+			var duration time.Duration
+			for _, param := range params[1:] {
+				parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(parts) != 2 || parts[0] != "dur" {
+					continue
+				}
+				if ms, err := strconv.ParseFloat(parts[1], 64); err == nil {
+					duration = time.Duration(ms * float64(time.Millisecond))
+				}
+			}
+
+			switch strings.TrimSpace(params[0]) {
+			case "db":
+				timing.DB = duration
+			case "exec":
+				timing.Executor = duration
+			case "render":
+				timing.Render = duration
+			case "total":
+				timing.Total = duration
+			default:
+				continue
+			}
+			found = true
+		}
+	}
+
+	return timing, found
+}
+
+// Network returns the part of a request's duration, as given to a ResponseHook,
+// that wasn't spent on the server, i.e. sending the request and receiving the
+// response headers, including any time spent queueing at a proxy
+func (t ServerTiming) Network(duration time.Duration) time.Duration {
+	if duration < t.Total {
+		return 0
+	}
+	return duration - t.Total
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseServerTiming(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Server-Timing", "db;dur=12.5, exec;dur=100, render;desc=\"Render\";dur=0.250, cache;dur=3, total;dur=113.75")
+
+	timing, ok := ParseServerTiming(resp)
+	assert.True(t, ok)
+	assert.Equal(t, ServerTiming{
+		DB:       12500 * time.Microsecond,
+		Executor: 100 * time.Millisecond,
+		Render:   250 * time.Microsecond,
+		Total:    113750 * time.Microsecond,
+	}, timing)
+
+	assert.Equal(t, 36250*time.Microsecond, timing.Network(150*time.Millisecond))
+	assert.Equal(t, time.Duration(0), timing.Network(100*time.Millisecond), "clocks may disagree")
+}
+
+func TestParseServerTimingWithoutHeader(t *testing.T) {
+	_, ok := ParseServerTiming(&http.Response{Header: http.Header{}})
+	assert.False(t, ok)
+
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Server-Timing", "cache;dur=3")
+	_, ok = ParseServerTiming(resp)
+	assert.False(t, ok, "only unrecognised metrics")
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/routes"
+)
+
+// UploadImage streams a tarball of the image's data directory (as created by
+// pg_basebackup -Ft) to the server, as an alternative to uploading it over SSH.
+// Once it's uploaded, the image can be finalised with FinaliseImage.
+//
+// The upload starts from however much of the tarball the server already has,
+// so an upload that was interrupted can be completed by calling UploadImage
+// again with the same tarball. If r is an io.Seeker, such as an *os.File,
+// interruptions are also resumed automatically according to the client's
+// retry policy.
+func (c Client) UploadImage(ctx context.Context, imageID int, r io.Reader) error {
+	seeker, seekable := r.(io.Seeker)
+
+	for attempt := 1; ; attempt++ {
+		offset, err := c.imageUploadOffset(ctx, imageID)
+		if err != nil {
+			return err
+		}
+
+		if seekable {
+			_, err = seeker.Seek(offset, io.SeekStart)
+		} else {
+			// We can only skip forwards through a reader that can't seek, which is
+			// why interruptions aren't resumed without one
+			_, err = io.CopyN(ioutil.Discard, r, offset)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to resume upload from byte %d: %s", offset, err)
+		}
+
+		resumable, err := c.appendImageUpload(ctx, imageID, offset, r)
+		if err == nil {
+			return nil
+		}
+		if !resumable || !seekable || attempt >= c.retryPolicy.MaxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.retryPolicy.backoff(attempt)):
+		}
+	}
+}
+
+// imageUploadOffset returns the number of bytes of the image's tarball that the
+// server has received
+func (c Client) imageUploadOffset(ctx context.Context, imageID int) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.imageUploadURL(imageID), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// HEAD responses have no body, so there's no error to parse
+		return 0, fmt.Errorf("failed to get image upload offset: %s", resp.Status)
+	}
+
+	return strconv.ParseInt(resp.Header.Get(routes.UploadOffsetHeader), 10, 64)
+}
+
+// appendImageUpload streams r to the server, starting at offset. It returns
+// whether the upload can be resumed if it fails: i.e. the request didn't
+// complete, or the server failed or was busy with a previous attempt, rather
+// than rejecting the upload.
+func (c Client) appendImageUpload(ctx context.Context, imageID int, offset int64, r io.Reader) (bool, error) {
+	// The transport closes request bodies once they've been sent, which would
+	// close any file that we were given before we could resume from it. Hiding
+	// the body's type also means that it's always sent with chunked encoding.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, c.imageUploadURL(imageID), ioutil.NopCloser(r))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(routes.UploadOffsetHeader, strconv.FormatInt(offset, 10))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return false, nil
+	case resp.StatusCode == http.StatusConflict, resp.StatusCode >= 500:
+		return true, parseError(resp.Body)
+	default:
+		return false, parseError(resp.Body)
+	}
+}
+
+// UploadImageStream streams the image's upload to the server as a btrfs send
+// stream of a subvolume holding its data directory, rather than as a tarball.
+// The server receives it with btrfs receive, so it keeps its reflinks and
+// compression, and isn't copied again when the image is finalised.
+//
+// The stream must be of a whole subvolume, i.e. sent without -p, and the
+// image's upload must be empty. Unlike UploadImage, streams can't be resumed,
+// but nothing is kept from one that's interrupted, so it can be sent again.
+func (c Client) UploadImageStream(ctx context.Context, imageID int, r io.Reader) error {
+	if err := c.negotiation.unsupported(models.FeatureBtrfsStreamUpload); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, fmt.Sprintf("%s/images/%d/btrfs_stream", c.url, imageID), ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	// Whole subvolumes can take hours to send, so mustn't be subject to the
+	// client's timeout
+	streamClient := *c.client
+	streamClient.Timeout = 0
+
+	resp, err := c.doWithClient(&streamClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return parseError(resp.Body)
+	}
+	return nil
+}
+
+func (c Client) imageUploadURL(imageID int) string {
+	return fmt.Sprintf("%s/images/%d/upload", c.url, imageID)
+}
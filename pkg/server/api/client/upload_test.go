@@ -0,0 +1,156 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// uploadServer holds an image upload in memory. If dropAfter is set, the first
+// upload request has its connection dropped after that many bytes.
+type uploadServer struct {
+	t         *testing.T
+	upload    bytes.Buffer
+	dropAfter int64
+	patches   int
+}
+
+func (s *uploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	assert.Equal(s.t, "/images/1/upload", r.URL.Path)
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.Itoa(s.upload.Len()))
+	case http.MethodPatch:
+		s.patches++
+		assert.Equal(s.t, "application/octet-stream", r.Header.Get("Content-Type"))
+		assert.Equal(s.t, strconv.Itoa(s.upload.Len()), r.Header.Get("Upload-Offset"))
+
+		if s.dropAfter > 0 && s.patches == 1 {
+			io.CopyN(&s.upload, r.Body, s.dropAfter)
+			conn, _, err := w.(http.Hijacker).Hijack()
+			assert.Nil(s.t, err)
+			conn.Close()
+			return
+		}
+
+		io.Copy(&s.upload, r.Body)
+		w.Header().Set("Upload-Offset", strconv.Itoa(s.upload.Len()))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestUploadImage(t *testing.T) {
+	handler := &uploadServer{t: t}
+	server := httptest.NewServer(handler)
+
+	client := NewClient(server.URL)
+	err := client.UploadImage(context.Background(), 1, strings.NewReader("hello world"))
+	// Closing the server waits for it to finish handling our requests
+	server.Close()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", handler.upload.String())
+}
+
+func TestUploadImageResumesAfterInterruption(t *testing.T) {
+	handler := &uploadServer{t: t, dropAfter: 6}
+	server := httptest.NewServer(handler)
+
+	client := NewClient(server.URL, WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	err := client.UploadImage(context.Background(), 1, strings.NewReader("hello world"))
+	server.Close()
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, handler.patches)
+	assert.Equal(t, "hello world", handler.upload.String())
+}
+
+func TestUploadImageWithoutSeekingAfterInterruption(t *testing.T) {
+	handler := &uploadServer{t: t, dropAfter: 6}
+	server := httptest.NewServer(handler)
+
+	client := NewClient(server.URL, WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	// Hide the reader's Seek method, so that we can't rewind it
+	err := client.UploadImage(context.Background(), 1, ioutil.NopCloser(strings.NewReader("hello world")))
+	server.Close()
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, handler.patches)
+}
+
+func TestUploadImageResumesPreviousUpload(t *testing.T) {
+	handler := &uploadServer{t: t}
+	handler.upload.WriteString("hello ")
+	server := httptest.NewServer(handler)
+
+	client := NewClient(server.URL)
+	err := client.UploadImage(context.Background(), 1, ioutil.NopCloser(strings.NewReader("hello world")))
+	server.Close()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", handler.upload.String())
+}
+
+func TestUploadImageWhenRejected(t *testing.T) {
+	patches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Upload-Offset", "0")
+			return
+		}
+
+		patches++
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprint(w, `{"status": "422", "title": "Upload Unavailable", "detail": "image is ready"}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	err := client.UploadImage(context.Background(), 1, strings.NewReader("hello world"))
+
+	assert.EqualError(t, err, "Upload Unavailable (image is ready)")
+	assert.Equal(t, 1, patches, "uploads that the server rejects aren't retried")
+}
+
+func TestUploadImageStream(t *testing.T) {
+	var stream bytes.Buffer
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/images/1/btrfs_stream", r.URL.Path)
+		assert.Equal(t, "application/octet-stream", r.Header.Get("Content-Type"))
+
+		io.Copy(&stream, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	client := NewClient(server.URL)
+	err := client.UploadImageStream(context.Background(), 1, strings.NewReader("btrfs-stream"))
+	server.Close()
+
+	assert.Nil(t, err)
+	assert.Equal(t, "btrfs-stream", stream.String())
+}
+
+func TestUploadImageStreamWhenRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"status": "409", "title": "Upload Conflict", "detail": "upload already has data in it"}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	err := client.UploadImageStream(context.Background(), 1, strings.NewReader("btrfs-stream"))
+
+	assert.EqualError(t, err, "Upload Conflict (upload already has data in it)")
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// WaitPolicy is how often a resource is polled whilst waiting for it to reach
+// a state: after InitialInterval at first, doubling each time up to
+// MaxInterval
+type WaitPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+}
+
+// DefaultWaitPolicy polls quickly at first, for operations that finish soon,
+// and then every 30s, for images that take hours to bake
+var DefaultWaitPolicy = WaitPolicy{
+	InitialInterval: time.Second,
+	MaxInterval:     30 * time.Second,
+}
+
+// Poll calls check until it reports that it's done or returns an error,
+// waiting between calls as the policy says. It returns the context's error if
+// the context is done first.
+func (p WaitPolicy) Poll(ctx context.Context, check func() (bool, error)) error {
+	interval := p.InitialInterval
+	for {
+		done, err := check()
+		if err != nil || done {
+			return err
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		if interval *= 2; interval > p.MaxInterval {
+			interval = p.MaxInterval
+		}
+	}
+}
+
+// ErrFinalisationFailed is returned when waiting for an image to be finalised
+// if its latest finalisation failed
+type ErrFinalisationFailed struct {
+	// Span is the phase of the finalisation that failed
+	Span models.BakeSpan
+}
+
+func (e *ErrFinalisationFailed) Error() string {
+	return fmt.Sprintf("image %d failed to finalise in phase %s: %s", e.Span.ImageID, e.Span.Phase, e.Span.Error)
+}
+
+// WaitForImageFinalised polls the image as the policy says until it's ready,
+// returning the ready image. Unlike WaitForImageReady, it returns an
+// *ErrFinalisationFailed as soon as the latest phase of the image's bake
+// timeline has failed, rather than waiting for it to be finalised again. If the
+// timeline can't be fetched, it only waits for the image to be ready.
+func (c Client) WaitForImageFinalised(ctx context.Context, imageID int, policy WaitPolicy) (models.Image, error) {
+	var image models.Image
+	err := policy.Poll(ctx, func() (bool, error) {
+		var err error
+		image, err = c.GetImage(strconv.Itoa(imageID))
+		if err != nil || image.Ready {
+			return image.Ready, err
+		}
+
+		// Servers without bake timelines can only tell us once the image is ready
+		spans, err := c.GetImageTimeline(imageID)
+		if err != nil {
+			return false, nil
+		}
+		if failed, ok := latestFailure(spans); ok {
+			return false, &ErrFinalisationFailed{Span: failed}
+		}
+		return false, nil
+	})
+	return image, err
+}
+
+// latestFailure returns the most recently started phase of a bake timeline, if
+// it failed. Phases run one at a time, and a failed phase ends the bake, so an
+// image whose latest phase failed isn't being finalised.
+func latestFailure(spans []models.BakeSpan) (models.BakeSpan, bool) {
+	if len(spans) == 0 {
+		return models.BakeSpan{}, false
+	}
+
+	latest := spans[0]
+	for _, span := range spans[1:] {
+		if span.StartedAt.After(latest.StartedAt) || (span.StartedAt.Equal(latest.StartedAt) && span.ID > latest.ID) {
+			latest = span
+		}
+	}
+	return latest, latest.FinishedAt != nil && latest.Error != ""
+}
+
+// WaitForInstanceReachable polls the instance as the policy says until it
+// accepts TCP connections. Instances are started before they're returned, but
+// their addresses may not have been whitelisted yet.
+func WaitForInstanceReachable(ctx context.Context, instance models.Instance, policy WaitPolicy) error {
+	address := net.JoinHostPort(instance.Hostname, strconv.Itoa(int(instance.Port)))
+
+	return policy.Poll(ctx, func() (bool, error) {
+		dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(dialCtx, "tcp", address)
+		if err != nil {
+			return false, nil
+		}
+		conn.Close()
+		return true, nil
+	})
+}
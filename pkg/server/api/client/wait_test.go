@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+var testWaitPolicy = WaitPolicy{InitialInterval: time.Millisecond, MaxInterval: 4 * time.Millisecond}
+
+func TestPollBacksOff(t *testing.T) {
+	var calls []time.Time
+	err := WaitPolicy{InitialInterval: 10 * time.Millisecond, MaxInterval: 20 * time.Millisecond}.Poll(
+		context.Background(),
+		func() (bool, error) {
+			calls = append(calls, time.Now())
+			return len(calls) == 4, nil
+		},
+	)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(calls))
+	for i, min := range []time.Duration{10, 20, 20} {
+		assert.True(t, calls[i+1].Sub(calls[i]) >= min*time.Millisecond, "interval %d was too short", i)
+	}
+}
+
+func TestPollWhenContextExpires(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := testWaitPolicy.Poll(ctx, func() (bool, error) { return false, nil })
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestWaitForImageFinalised(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/1":
+			requests++
+			fmt.Fprintf(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": %t}}}`, requests == 3)
+		case "/images/1/timeline":
+			fmt.Fprint(w, `{"data": [
+				{"type": "bake_spans", "id": "1", "attributes": {"phase": "anonymise", "started_at": "2020-01-01T00:00:00Z"}}
+			]}`)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	image, err := client.WaitForImageFinalised(context.Background(), 1, testWaitPolicy)
+
+	assert.Nil(t, err)
+	assert.True(t, image.Ready)
+	assert.Equal(t, 3, requests)
+}
+
+func TestWaitForImageFinalisedWhenFinalisationFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/1":
+			fmt.Fprint(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": false}}}`)
+		case "/images/1/timeline":
+			fmt.Fprint(w, `{"data": [
+				{"type": "bake_spans", "id": "1", "attributes": {"image_id": 1, "phase": "restore", "started_at": "2020-01-01T00:00:00Z", "finished_at": "2020-01-01T00:01:00Z"}},
+				{"type": "bake_spans", "id": "2", "attributes": {"image_id": 1, "phase": "anonymise", "started_at": "2020-01-01T00:01:00Z", "finished_at": "2020-01-01T00:02:00Z", "error": "syntax error"}}
+			]}`)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	_, err := client.WaitForImageFinalised(context.Background(), 1, testWaitPolicy)
+
+	assert.EqualError(t, err, "image 1 failed to finalise in phase anonymise: syntax error")
+	assert.IsType(t, &ErrFinalisationFailed{}, err)
+}
+
+func TestWaitForImageFinalisedWithoutTimeline(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		requests++
+		fmt.Fprintf(w, `{"data": {"type": "images", "id": "1", "attributes": {"ready": %t}}}`, requests == 2)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, WithRetryPolicy(NoRetries))
+	image, err := client.WaitForImageFinalised(context.Background(), 1, testWaitPolicy)
+
+	assert.Nil(t, err)
+	assert.True(t, image.Ready)
+}
+
+func TestLatestFailure(t *testing.T) {
+	at := func(minute int) time.Time { return time.Date(2020, 1, 1, 0, minute, 0, 0, time.UTC) }
+	finished := at(5)
+
+	failed := models.BakeSpan{ID: 1, StartedAt: at(0), FinishedAt: &finished, Error: "boom"}
+	retried := models.BakeSpan{ID: 2, StartedAt: at(10)}
+
+	_, ok := latestFailure(nil)
+	assert.False(t, ok)
+
+	span, ok := latestFailure([]models.BakeSpan{failed})
+	assert.True(t, ok)
+	assert.Equal(t, 1, span.ID)
+
+	_, ok = latestFailure([]models.BakeSpan{retried, failed})
+	assert.False(t, ok, "a later finalisation is still running")
+}
+
+func TestWaitForInstanceReachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	instance := models.Instance{Hostname: "127.0.0.1", Port: uint16(port)}
+
+	assert.Nil(t, WaitForInstanceReachable(context.Background(), instance, testWaitPolicy))
+
+	listener.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, WaitForInstanceReachable(ctx, instance, testWaitPolicy))
+}
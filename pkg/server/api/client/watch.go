@@ -0,0 +1,154 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/models/extras"
+)
+
+// The types of event sent when watching images and instances
+const (
+	EventCreated   = events.Created
+	EventUpdated   = events.Updated
+	EventDestroyed = events.Destroyed
+)
+
+// ImageEvent records a change to an image. Destroyed images are as they were
+// before they were destroyed.
+type ImageEvent struct {
+	Type  string
+	Image models.Image
+}
+
+// InstanceEvent records a change to one of the user's instances. Destroyed
+// instances are as they were before they were destroyed.
+type InstanceEvent struct {
+	Type     string
+	Instance models.Instance
+}
+
+// WatchImages streams changes to images as they happen, as an alternative to
+// polling ListImages.
+//
+// The channel is closed when the context is done, or if the stream ends, e.g.
+// because the server restarted or we fell behind. Events may have been missed
+// by then, so callers that want to keep watching should list the images again
+// before watching them again.
+func (c Client) WatchImages(ctx context.Context) (<-chan ImageEvent, error) {
+	watched := make(chan ImageEvent)
+
+	err := c.watch(ctx, "/events/images", func(eventType string, data []byte) bool {
+		var image models.Image
+		if err := extras.UnmarshalPayload(bytes.NewReader(data), &image); err != nil {
+			return false
+		}
+
+		select {
+		case watched <- ImageEvent{Type: eventType, Image: image}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}, func() { close(watched) })
+	if err != nil {
+		return nil, err
+	}
+
+	return watched, nil
+}
+
+// WatchInstances streams changes to the user's instances as they happen, as an
+// alternative to polling ListInstances. The channel is closed in the same
+// circumstances as WatchImages'.
+func (c Client) WatchInstances(ctx context.Context) (<-chan InstanceEvent, error) {
+	watched := make(chan InstanceEvent)
+
+	err := c.watch(ctx, "/events/instances", func(eventType string, data []byte) bool {
+		var instance models.Instance
+		if err := extras.UnmarshalPayload(bytes.NewReader(data), &instance); err != nil {
+			return false
+		}
+
+		select {
+		case watched <- InstanceEvent{Type: eventType, Instance: instance}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}, func() { close(watched) })
+	if err != nil {
+		return nil, err
+	}
+
+	return watched, nil
+}
+
+// watch opens the server-sent event stream at path, and then calls handle
+// with each event in the background until it returns false or the stream ends,
+// after which it calls done.
+func (c Client) watch(ctx context.Context, path string, handle func(eventType string, data []byte) bool, done func()) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// The stream lasts for as long as we're watching, so mustn't be subject to
+	// the client's timeout
+	streamClient := *c.client
+	streamClient.Timeout = 0
+
+	resp, err := c.doWithClient(&streamClient, req)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return parseError(resp.Body)
+	}
+
+	go func() {
+		defer done()
+		defer resp.Body.Close()
+		readEvents(resp.Body, handle)
+	}()
+
+	return nil
+}
+
+// readEvents parses a stream of server-sent events, calling handle with each
+// until it returns false
+func readEvents(r io.Reader, handle func(eventType string, data []byte) bool) {
+	scanner := bufio.NewScanner(r)
+	// Events hold a single image or instance, but allow for large annotations
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	eventType := ""
+	var data []string
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+
+		switch {
+		case line == "":
+			// A blank line dispatches the event
+			if len(data) > 0 && !handle(eventType, []byte(strings.Join(data, "\n"))) {
+				return
+			}
+			eventType, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// Comments keep the connection alive
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchImages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/events/images", r.URL.Path)
+		assert.Equal(t, "text/event-stream", r.Header.Get("Accept"))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": keep-alive\n\n")
+		fmt.Fprint(w, "event: created\n")
+		fmt.Fprint(w, `data: {"data": {"type": "images", "id": "1", "attributes": {"ready": false}}}`+"\n\n")
+		w.(http.Flusher).Flush()
+
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(w, "event: updated\r\n")
+		fmt.Fprint(w, `data: {"data": {"type": "images", "id": "1", "attributes": {"ready": true}}}`+"\r\n\r\n")
+	}))
+	defer server.Close()
+
+	// The stream shouldn't be cut off by the client's timeout
+	client := NewClient(server.URL, WithTimeout(50*time.Millisecond))
+
+	events, err := client.WatchImages(context.Background())
+	assert.Nil(t, err)
+
+	var received []ImageEvent
+	for event := range events {
+		received = append(received, event)
+	}
+
+	assert.Len(t, received, 2)
+	assert.Equal(t, EventCreated, received[0].Type)
+	assert.Equal(t, 1, received[0].Image.ID)
+	assert.False(t, received[0].Image.Ready)
+	assert.Equal(t, EventUpdated, received[1].Type)
+	assert.True(t, received[1].Image.Ready)
+}
+
+func TestWatchInstancesUntilCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/events/instances", r.URL.Path)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: destroyed\n")
+		fmt.Fprint(w, `data: {"data": {"type": "instances", "id": "2", "attributes": {"port": 5432}}}`+"\n\n")
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client := NewClient(server.URL)
+
+	events, err := client.WatchInstances(ctx)
+	assert.Nil(t, err)
+
+	event := <-events
+	assert.Equal(t, EventDestroyed, event.Type)
+	assert.Equal(t, 2, event.Instance.ID)
+
+	cancel()
+	_, open := <-events
+	assert.False(t, open, "the channel is closed once the context is cancelled")
+}
+
+func TestWatchImagesWithError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"status": "401", "title": "Unauthorized", "detail": "bad token"}`)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	events, err := client.WatchImages(context.Background())
+
+	assert.Nil(t, events)
+	assert.EqualError(t, err, "Unauthorized (bad token)")
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/gocardless/draupnir/pkg/version"
 )
@@ -122,3 +123,663 @@ var OauthError = Error{
 	Title:  "OAuth Error",
 	Detail: "There was some oauth error",
 }
+
+var InvalidShardsError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Shards",
+	Detail: "Shard names must be unique, lowercase PostgreSQL identifiers",
+	Source: ErrorSource{
+		Pointer: "/data/attributes/shards",
+	},
+}
+
+func InvalidWorkersError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Workers",
+		Detail: reason,
+		Source: ErrorSource{
+			Pointer: "/data/attributes/workers",
+		},
+	}
+}
+
+var StandbyUnavailableError = Error{
+	ID:     "unprocessable_entity",
+	Code:   "unprocessable_entity",
+	Status: "422",
+	Title:  "Standby Unavailable",
+	Detail: "Standby instances are not enabled, or the image has no base backup to replay WAL onto",
+	Source: ErrorSource{
+		Pointer: "/data/attributes/standby",
+	},
+}
+
+var SchemaOnlyStandbyError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Instance",
+	Detail: "Standby instances can't be schema-only, as they replay WAL from the source database",
+	Source: ErrorSource{
+		Pointer: "/data/attributes/schema_only",
+	},
+}
+
+var InstanceNotStandbyError = Error{
+	ID:     "unprocessable_entity",
+	Code:   "unprocessable_entity",
+	Status: "422",
+	Title:  "Instance Not Standby",
+	Detail: "Only standby instances can be promoted",
+}
+
+// InjectedFaultError is the response to a request that a fault failed
+func InjectedFaultError(status int) Error {
+	return Error{
+		ID:     "injected_fault",
+		Code:   "injected_fault",
+		Status: strconv.Itoa(status),
+		Title:  "Injected Fault",
+		Detail: "This request was failed by a fault injected for resilience testing",
+	}
+}
+
+func InvalidFaultError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Fault",
+		Detail: reason,
+	}
+}
+
+var InstanceNeverExpiresError = Error{
+	ID:     "unprocessable_entity",
+	Code:   "unprocessable_entity",
+	Status: "422",
+	Title:  "Instance Never Expires",
+	Detail: "The instance has no expiry to extend",
+}
+
+var InvalidExtensionError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Extension",
+	Detail: "by must be a positive duration, e.g. 4h",
+	Source: ErrorSource{
+		Pointer: "/data/attributes/by",
+	},
+}
+
+var InvalidAnnotationsError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Annotations",
+	Detail: "Annotation keys must be alphanumeric identifiers, and values must be strings, or null to remove the annotation",
+	Source: ErrorSource{
+		Pointer: "/data/attributes/annotations",
+	},
+}
+
+var AnnotationsTooLargeError = Error{
+	ID:     "unprocessable_entity",
+	Code:   "unprocessable_entity",
+	Status: "422",
+	Title:  "Annotations Too Large",
+	Detail: "A resource's annotations must be no larger than 16KiB",
+	Source: ErrorSource{
+		Pointer: "/data/attributes/annotations",
+	},
+}
+
+var InvalidLabelsError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Labels",
+	Detail: "Label keys must be alphanumeric identifiers, and values must be alphanumeric identifiers of up to 63 characters, or null to remove the label",
+	Source: ErrorSource{
+		Pointer: "/data/attributes/labels",
+	},
+}
+
+var LabelsTooLargeError = Error{
+	ID:     "unprocessable_entity",
+	Code:   "unprocessable_entity",
+	Status: "422",
+	Title:  "Labels Too Large",
+	Detail: "A resource's labels must be no larger than 16KiB",
+	Source: ErrorSource{
+		Pointer: "/data/attributes/labels",
+	},
+}
+
+func InvalidMaintenanceOperationError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Maintenance Operation",
+		Detail: reason,
+	}
+}
+
+var InstanceIsStandbyError = Error{
+	ID:     "unprocessable_entity",
+	Code:   "unprocessable_entity",
+	Status: "422",
+	Title:  "Instance Is Standby",
+	Detail: "Maintenance can only be run against an instance once it has been promoted",
+}
+
+func MaintenanceFailedError(output string) Error {
+	return Error{
+		ID:     "unprocessable_entity",
+		Code:   "unprocessable_entity",
+		Status: "422",
+		Title:  "Maintenance Failed",
+		Detail: output,
+	}
+}
+
+var InvalidBackupChecksumError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Backup Checksum",
+	Detail: "The backup checksum must be a hex encoded SHA-256",
+	Source: ErrorSource{
+		Pointer: "/data/attributes/backup_checksum",
+	},
+}
+
+var InvalidBackupLSNError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Backup LSN",
+	Detail: "The backup LSN must look like 0/9000028, and can't be given for sharded images",
+	Source: ErrorSource{
+		Pointer: "/data/attributes/backup_lsn",
+	},
+}
+
+var BackupMismatchError = Error{
+	ID:     "unprocessable_entity",
+	Code:   "unprocessable_entity",
+	Status: "422",
+	Title:  "Backup Mismatch",
+	Detail: "The uploaded image does not match the checksum or LSN of the base backup that it was created with",
+}
+
+func InvalidFinaliseOptionsError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Finalise Options",
+		Detail: reason,
+	}
+}
+
+func InvalidFilterError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Filter",
+		Detail: reason,
+	}
+}
+
+func InvalidPaginationError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Pagination",
+		Detail: reason,
+	}
+}
+
+func InvalidSortError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Sort",
+		Detail: reason,
+	}
+}
+
+func InvalidPruneError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Prune",
+		Detail: reason,
+	}
+}
+
+func InvalidCleanupTokenRequestError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Cleanup Token Request",
+		Detail: reason,
+	}
+}
+
+var InvalidCleanupTokenError = Error{
+	ID:     "unauthorized",
+	Code:   "unauthorized",
+	Status: "401",
+	Title:  "Invalid Cleanup Token",
+	Detail: "The cleanup token doesn't exist, has expired, or has already been used",
+}
+
+func InvalidInstanceGroupError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Instance Group",
+		Detail: reason,
+	}
+}
+
+func NoReadyImageError(family string) Error {
+	return Error{
+		ID:     "unprocessable_entity",
+		Code:   "unprocessable_entity",
+		Status: "422",
+		Title:  "No Ready Image",
+		Detail: fmt.Sprintf("The %s image family has no ready image", family),
+	}
+}
+
+func InterruptedFinalisationError(reason string) Error {
+	return Error{
+		ID:     "unprocessable_entity",
+		Code:   "unprocessable_entity",
+		Status: "422",
+		Title:  "Finalisation Interrupted",
+		Detail: reason,
+	}
+}
+
+var ImageUploadUnavailableError = Error{
+	ID:     "unprocessable_entity",
+	Code:   "unprocessable_entity",
+	Status: "422",
+	Title:  "Upload Unavailable",
+	Detail: "Images can only be uploaded through the API before they are finalised, and sharded and distributed images must be uploaded over SSH",
+}
+
+var InvalidUploadOffsetError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Upload Offset",
+	Detail: "The Upload-Offset header must be a non-negative integer",
+}
+
+var InvalidImageStreamError = Error{
+	ID:     "unprocessable_entity",
+	Code:   "unprocessable_entity",
+	Status: "422",
+	Title:  "Invalid Image Stream",
+	Detail: "The body must be a btrfs send stream of a whole subvolume, sent without -p, that wasn't cut short",
+}
+
+func UploadConflictError(reason string) Error {
+	return Error{
+		ID:     "conflict",
+		Code:   "conflict",
+		Status: "409",
+		Title:  "Upload Conflict",
+		Detail: reason,
+	}
+}
+
+var ManifestNotFoundError = Error{
+	ID:     "resource_not_found",
+	Code:   "resource_not_found",
+	Status: "404",
+	Title:  "Manifest Not Found",
+	Detail: "The image has no manifest, either because it hasn't been finalised or because manifest signing is disabled",
+}
+
+var ImageFileNotFoundError = Error{
+	ID:     "resource_not_found",
+	Code:   "resource_not_found",
+	Status: "404",
+	Title:  "Image File Not Found",
+	Detail: "The image has no such file",
+}
+
+func ImageFileNotAllowedError(reason string) Error {
+	return Error{
+		ID:     "forbidden",
+		Code:   "forbidden",
+		Status: "403",
+		Title:  "Image File Not Allowed",
+		Detail: reason,
+	}
+}
+
+func InvalidBreakGlassGrantError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Break-Glass Grant",
+		Detail: reason,
+	}
+}
+
+var BreakGlassGrantRequiredError = Error{
+	ID:     "forbidden",
+	Code:   "forbidden",
+	Status: "403",
+	Title:  "Break-Glass Grant Required",
+	Detail: "Reading an image's upload requires an active break-glass grant for the image, which only an admin can give",
+}
+
+var UploadFinalisedError = Error{
+	ID:     "unprocessable_entity",
+	Code:   "unprocessable_entity",
+	Status: "422",
+	Title:  "Upload Finalised",
+	Detail: "The image has been finalised, so its upload has been anonymised and can no longer be read",
+}
+
+func InvalidAccessRequestError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Access Request",
+		Detail: reason,
+	}
+}
+
+var AccessRequestDecidedError = Error{
+	ID:     "conflict",
+	Code:   "conflict",
+	Status: "409",
+	Title:  "Access Request Decided",
+	Detail: "The access request has already been approved or denied",
+}
+
+func AccessRequiredError(family string) Error {
+	return Error{
+		ID:     "forbidden",
+		Code:   "forbidden",
+		Status: "403",
+		Title:  "Access Required",
+		Detail: fmt.Sprintf("Instances of %s can only be created by users whose access has been approved. Request it with 'draupnir access-requests create %s --reason <reason>'.", family, family),
+	}
+}
+
+var ForbiddenError = Error{
+	ID:     "forbidden",
+	Code:   "forbidden",
+	Status: "403",
+	Title:  "Forbidden",
+	Detail: "Only the upload user can perform this action",
+}
+
+var InvalidRetentionPolicyError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Retention Policy",
+	Detail: "Free space fractions must be between 0 and 1, and instance_max_age must be a duration such as 24h",
+}
+
+func UnknownTableError(table string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Unknown Table",
+		Detail: fmt.Sprintf("%s is not a table in the metadata database", table),
+	}
+}
+
+func UnsupportedIdentityProviderError(provider string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Unsupported Identity Provider",
+		Detail: fmt.Sprintf("Identities from %q can't be exchanged with this server", provider),
+	}
+}
+
+func UnmappedIdentityError(principal string) Error {
+	return Error{
+		ID:     "forbidden",
+		Code:   "forbidden",
+		Status: "403",
+		Title:  "Unmapped Identity",
+		Detail: fmt.Sprintf("%s isn't mapped to a service account", principal),
+	}
+}
+
+func FinalisationFailedError(reason string) Error {
+	return Error{
+		ID:     "unprocessable_entity",
+		Code:   "unprocessable_entity",
+		Status: "422",
+		Title:  "Finalisation Failed",
+		Detail: reason,
+	}
+}
+
+func ImageQuotaExceededError(reason string) Error {
+	return Error{
+		ID:     "unprocessable_entity",
+		Code:   "unprocessable_entity",
+		Status: "422",
+		Title:  "Image Quota Exceeded",
+		Detail: reason,
+	}
+}
+
+func InstanceQuotaExceededError(reason string) Error {
+	return Error{
+		ID:     "forbidden",
+		Code:   "forbidden",
+		Status: "403",
+		Title:  "Instance Quota Exceeded",
+		Detail: reason,
+	}
+}
+
+func ImageCooldownError(reason string) Error {
+	return Error{
+		ID:     "too_many_requests",
+		Code:   "too_many_requests",
+		Status: "429",
+		Title:  "Image Creation Cooling Down",
+		Detail: reason,
+	}
+}
+
+func StaleAnonymisationError(family string) Error {
+	return Error{
+		ID:     "unprocessable_entity",
+		Code:   "unprocessable_entity",
+		Status: "422",
+		Title:  "Stale Anonymisation",
+		Detail: fmt.Sprintf("The image wasn't anonymised with the current anonymisation spec of the %s image family", family),
+	}
+}
+
+func ProductionReferencesError(reason string) Error {
+	return Error{
+		ID:     "unprocessable_entity",
+		Code:   "unprocessable_entity",
+		Status: "422",
+		Title:  "Image Refers To Production",
+		Detail: reason,
+	}
+}
+
+var ProxyUpgradeRequiredError = Error{
+	ID:     "upgrade_required",
+	Code:   "upgrade_required",
+	Status: "426",
+	Title:  "Upgrade Required",
+	Detail: "Connections to the proxy must upgrade to the draupnir-postgres protocol",
+}
+
+var ProxyStandbyError = Error{
+	ID:     "unprocessable_entity",
+	Code:   "unprocessable_entity",
+	Status: "422",
+	Title:  "Instance Is Standby",
+	Detail: "Standby instances can only be connected to through the proxy once they have been promoted",
+}
+
+var InvalidLogLinesError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Invalid Log Lines",
+	Detail: fmt.Sprintf("lines must be a number from 0 to %d", MaxLogLines),
+	Source: ErrorSource{
+		Parameter: "lines",
+	},
+}
+
+// MaxLogLines is the most lines of an instance's log that can be requested
+const MaxLogLines = 10000
+
+var MissingSearchQueryError = Error{
+	ID:     "bad_request",
+	Code:   "bad_request",
+	Status: "400",
+	Title:  "Missing Search Query",
+	Detail: "q must be given, with the text to search for",
+	Source: ErrorSource{
+		Parameter: "q",
+	},
+}
+
+var RegulatedInstanceLogsError = Error{
+	ID:     "forbidden",
+	Code:   "forbidden",
+	Status: "403",
+	Title:  "Regulated Instance",
+	Detail: "The logs of regulated instances can hold queries' data, so can't be read outside the proxy",
+}
+
+var RegulatedInstanceDiagnosticsError = Error{
+	ID:     "forbidden",
+	Code:   "forbidden",
+	Status: "403",
+	Title:  "Regulated Instance",
+	Detail: "The diagnostics of regulated instances include the text of their queries, so can't be read outside the proxy",
+}
+
+// The errors returned while polling for the token of a device authorization.
+// Their codes are those of the OAuth device authorization grant (RFC 8628), so
+// that clients can tell them apart.
+var AuthorizationPendingError = Error{
+	ID:     "authorization_pending",
+	Code:   "authorization_pending",
+	Status: "400",
+	Title:  "Authorization Pending",
+	Detail: "The user hasn't yet entered the code and signed in",
+}
+
+var SlowDownError = Error{
+	ID:     "slow_down",
+	Code:   "slow_down",
+	Status: "400",
+	Title:  "Slow Down",
+	Detail: "The device is polling too often, and should wait longer between polls",
+}
+
+var ExpiredDeviceCodeError = Error{
+	ID:     "expired_token",
+	Code:   "expired_token",
+	Status: "400",
+	Title:  "Expired Device Code",
+	Detail: "The device code has expired, or doesn't exist. Start authenticating again.",
+}
+
+var DeviceAccessDeniedError = Error{
+	ID:     "access_denied",
+	Code:   "access_denied",
+	Status: "400",
+	Title:  "Access Denied",
+	Detail: "Signing in with the code failed. Start authenticating again.",
+}
+
+var OperationQueueFullError = Error{
+	ID:     "service_unavailable",
+	Code:   "service_unavailable",
+	Status: "503",
+	Title:  "Operation Queue Full",
+	Detail: "Too many operations are waiting to run. Try again later, or without Prefer: respond-async.",
+}
+
+var OperationInProgressError = Error{
+	ID:     "conflict",
+	Code:   "conflict",
+	Status: "409",
+	Title:  "Operation In Progress",
+	Detail: "The image is already being finalised",
+}
+
+var StaticInstanceError = Error{
+	ID:     "unprocessable_entity",
+	Code:   "unprocessable_entity",
+	Status: "422",
+	Title:  "Static Instance",
+	Detail: "Static instances are managed by the server, and can't be changed",
+}
+
+func InvalidRunbookActionError(reason string) Error {
+	return Error{
+		ID:     "bad_request",
+		Code:   "bad_request",
+		Status: "400",
+		Title:  "Invalid Runbook Action",
+		Detail: reason,
+	}
+}
+
+func RunbookActionUnavailableError(reason string) Error {
+	return Error{
+		ID:     "unprocessable_entity",
+		Code:   "unprocessable_entity",
+		Status: "422",
+		Title:  "Runbook Action Unavailable",
+		Detail: reason,
+	}
+}
+
+func ConfirmationRequiredError(confirmation string) Error {
+	return Error{
+		ID:     "precondition_required",
+		Code:   "precondition_required",
+		Status: "428",
+		Title:  "Confirmation Required",
+		Detail: fmt.Sprintf("To go ahead, send the request again with confirm set to %q", confirmation),
+	}
+}
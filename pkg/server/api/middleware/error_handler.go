@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	raven "github.com/getsentry/raven-go"
+	"github.com/gocardless/draupnir/pkg/redact"
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
 	"github.com/prometheus/common/log"
@@ -30,12 +31,14 @@ func DefaultErrorRenderer(next chain.Handler) chain.Handler {
 	}
 }
 
-func NewSentryReporter(sentry *raven.Client) chain.Middleware {
+// NewSentryReporter reports the errors that handlers return to Sentry, with
+// their messages redacted by the policy
+func NewSentryReporter(sentry *raven.Client, redaction redact.Policy) chain.Middleware {
 	return func(next chain.Handler) chain.Handler {
 		return func(w http.ResponseWriter, r *http.Request) error {
 			err := next(w, r)
 			if err != nil {
-				sentry.CaptureError(err, map[string]string{})
+				sentry.CaptureError(redaction.Error(err), map[string]string{})
 			}
 			return err
 		}
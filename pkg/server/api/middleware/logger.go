@@ -1,9 +1,11 @@
 package middleware
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"time"
@@ -23,7 +25,7 @@ func NewRequestLogger(logger log.Logger) chain.Middleware {
 		return func(w http.ResponseWriter, r *http.Request) error {
 			// To capture the response, we replace the response writer with a response
 			// recorder.
-			recorder := httptest.NewRecorder()
+			recorder := &responseRecorder{ResponseRecorder: httptest.NewRecorder(), w: w}
 
 			// Add a collection of headers that might be useful to log
 			scopedLogger := logger.
@@ -67,17 +69,76 @@ func NewRequestLogger(logger log.Logger) chain.Middleware {
 				With("duration", duration.Seconds()).
 				Info(requestLine)
 
-			// Copy the headers and body from the recorder to the response writer
-			for k, v := range recorder.HeaderMap {
-				w.Header()[k] = v
+			// Copy the headers and body from the recorder to the response writer,
+			// unless they've already been streamed to it
+			if !recorder.streaming {
+				recorder.copyTo(w)
 			}
-			w.WriteHeader(recorder.Code)
-			recorder.Body.WriteTo(w)
 			return err
 		}
 	}
 }
 
+// responseRecorder buffers the response so that its status can be logged. If
+// the handler flushes the response, e.g. to stream events, the response so far
+// is copied to the underlying writer, and the rest is written straight to it.
+type responseRecorder struct {
+	*httptest.ResponseRecorder
+	w         http.ResponseWriter
+	streaming bool
+	hijacked  bool
+}
+
+func (r *responseRecorder) copyTo(w http.ResponseWriter) {
+	for k, v := range r.HeaderMap {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(r.Code)
+	r.Body.WriteTo(w)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if r.streaming {
+		return r.w.Write(b)
+	}
+	return r.ResponseRecorder.Write(b)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	return r.Write([]byte(s))
+}
+
+func (r *responseRecorder) Flush() {
+	if !r.streaming {
+		r.streaming = true
+		r.copyTo(r.w)
+	}
+	if flusher, ok := r.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection, e.g. to proxy it. The
+// response is logged as switching protocols, and anything written to it
+// afterwards, such as an error, is discarded.
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response can't be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		r.ResponseRecorder.WriteHeader(http.StatusSwitchingProtocols)
+		r.streaming = true
+		r.hijacked = true
+	}
+	return conn, rw, err
+}
+
 func GetLogger(r *http.Request) (log.Logger, error) {
 	logger, ok := r.Context().Value(LoggerKey).(*log.Logger)
 	if !ok {
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLogger(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "{}")
+		assert.Equal(t, 0, recorder.Body.Len(), "the response is buffered until the handler returns")
+		return nil
+	}
+
+	NewRequestLogger(log.NewNopLogger())(handler)(recorder, req)
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "{}", recorder.Body.String())
+}
+
+func TestRequestLoggerWhenStreaming(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "one\n")
+		w.(http.Flusher).Flush()
+		assert.Equal(t, "one\n", recorder.Body.String())
+		assert.True(t, recorder.Flushed)
+
+		fmt.Fprint(w, "two\n")
+		assert.Equal(t, "one\ntwo\n", recorder.Body.String(), "the response is written through once flushed")
+		return nil
+	}
+
+	NewRequestLogger(log.NewNopLogger())(handler)(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/event-stream", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "one\ntwo\n", recorder.Body.String())
+}
+
+func TestRequestLoggerWhenHijacked(t *testing.T) {
+	var logs bytes.Buffer
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\nhello")
+		return rw.Flush()
+	}
+
+	logged := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewRequestLogger(log.NewLogger(&logs))(handler)(w, r)
+		close(logged)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "hello", string(body))
+
+	<-logged
+	assert.Contains(t, logs.String(), "GET / 101")
+}
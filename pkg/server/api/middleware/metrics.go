@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "draupnir_http_requests_total",
+			Help: "Number of HTTP requests served, by method, route and status",
+		},
+		[]string{"method", "route", "status"},
+	)
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "draupnir_http_request_duration_seconds",
+			Help:    "Time taken to serve HTTP requests, by method, route and status",
+			Buckets: []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900},
+		},
+		[]string{"method", "route", "status"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpRequestDuration)
+}
+
+// RecordMetrics counts and times each request by its route, rather than its
+// path, so that the number of series doesn't grow with the number of images and
+// instances. It must come after NewRequestLogger in the chain, which records
+// the status of the response. Requests that return an error are recorded as
+// 500s, as that's how the error handler renders them.
+func RecordMetrics(next chain.Handler) chain.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		start := time.Now()
+		err := next(w, r)
+		duration := time.Since(start)
+
+		status := http.StatusOK
+		if recorder, ok := w.(*responseRecorder); ok {
+			status = recorder.Code
+		}
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+
+		labels := []string{r.Method, routeTemplate(r), strconv.Itoa(status)}
+		httpRequests.WithLabelValues(labels...).Inc()
+		httpRequestDuration.WithLabelValues(labels...).Observe(duration.Seconds())
+
+		return err
+	}
+}
+
+// routeTemplate returns the template of the route that matched the request,
+// e.g. /images/{id}, or "unknown" if it wasn't routed by a mux.Router
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unknown"
+	}
+
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return "unknown"
+	}
+	return template
+}
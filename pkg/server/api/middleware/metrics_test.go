@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordMetrics(t *testing.T) {
+	handler := NewRequestLogger(log.NewNopLogger())(RecordMetrics(
+		func(w http.ResponseWriter, r *http.Request) error {
+			if mux.Vars(r)["id"] == "2" {
+				return errors.New("failed")
+			}
+			w.WriteHeader(http.StatusNotFound)
+			return nil
+		},
+	))
+
+	router := mux.NewRouter()
+	router.Methods("GET").Path("/metrics_test/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r)
+	})
+
+	notFound := httpRequests.WithLabelValues("GET", "/metrics_test/{id}", "404")
+	failed := httpRequests.WithLabelValues("GET", "/metrics_test/{id}", "500")
+
+	for _, id := range []string{"1", "1", "2"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics_test/"+id, nil))
+	}
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(notFound), "requests are counted by route, not path")
+	assert.Equal(t, float64(1), testutil.ToFloat64(failed), "errors are counted as 500s")
+}
+
+func TestRecordMetricsWithoutRoute(t *testing.T) {
+	unknown := httpRequests.WithLabelValues("GET", "unknown", "200")
+	before := testutil.ToFloat64(unknown)
+
+	RecordMetrics(func(w http.ResponseWriter, r *http.Request) error {
+		return nil
+	})(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	assert.Equal(t, before+1, testutil.ToFloat64(unknown))
+}
@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/server/api/plain"
+)
+
+// PlainJSONPrefix is the path beneath which PlainJSON serves the API
+const PlainJSONPrefix = "/v2"
+
+// PlainJSON serves the API beneath basePath + PlainJSONPrefix as plain JSON, for
+// scripts that find JSON:API cumbersome. Each request is handled by router as
+// if it had been made without the prefix, so every route behaves in the same
+// way as it does in JSON:API, other than:
+//
+//   - JSON request bodies are flat objects, which are given to the route as a
+//     resource of the type named by the first segment of the path
+//   - JSON:API responses are converted to flat objects, or arrays of them, with
+//     links, such as those to the next page of a list, given in a Link header
+//
+// Uploads, event streams and errors are passed through as they are.
+func PlainJSON(basePath string, router http.Handler) http.Handler {
+	prefix := basePath + PlainJSONPrefix
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, prefix)
+		if path == r.URL.Path || !strings.HasPrefix(path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		inner := r.Clone(r.Context())
+		inner.URL.Path = basePath + path
+		inner.URL.RawPath = ""
+		inner.RequestURI = inner.URL.RequestURI()
+
+		if r.Body != nil && r.Body != http.NoBody && !isBinary(r.Header.Get("Content-Type")) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			resourceType := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+			if len(bytes.TrimSpace(body)) > 0 {
+				// Bodies that can't be converted are passed on, so that the route
+				// rejects them in the usual way
+				if converted, err := plain.ToJSONAPI(body, resourceType); err == nil {
+					body = converted
+				}
+			}
+
+			inner.Body = ioutil.NopCloser(bytes.NewReader(body))
+			inner.ContentLength = int64(len(body))
+			inner.Header.Set("Content-Type", "application/json")
+		}
+
+		// Event streams are flushed, after which they're written straight to w
+		recorder := &responseRecorder{ResponseRecorder: httptest.NewRecorder(), w: w}
+		router.ServeHTTP(recorder, inner)
+		if recorder.streaming {
+			return
+		}
+
+		if mediaType(recorder.HeaderMap.Get("Content-Type")) == "application/json" {
+			converted, links, ok, err := plain.FromJSONAPI(recorder.Body.Bytes())
+			if err != nil {
+				http.Error(w, "failed to convert response to plain JSON", http.StatusInternalServerError)
+				return
+			}
+
+			if ok {
+				recorder.Body = bytes.NewBuffer(converted)
+				recorder.HeaderMap.Del("Content-Length")
+				if link := linkHeader(links, basePath, prefix); link != "" {
+					recorder.HeaderMap.Set("Link", link)
+				}
+			}
+		}
+
+		recorder.copyTo(w)
+	})
+}
+
+// isBinary reports whether a request body of the content type is binary, such
+// as an image upload, and so mustn't be converted
+func isBinary(contentType string) bool {
+	return mediaType(contentType) == "application/octet-stream"
+}
+
+func mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// linkHeader formats JSON:API links as an RFC 8288 Link header, keeping links
+// to the API beneath the prefix
+func linkHeader(links map[string]string, basePath, prefix string) string {
+	rels := make([]string, 0, len(links))
+	for rel := range links {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	values := make([]string, 0, len(rels))
+	for _, rel := range rels {
+		link := links[rel]
+		if link == "" {
+			continue
+		}
+		if strings.HasPrefix(link, basePath+"/") && !strings.HasPrefix(link, prefix+"/") {
+			link = prefix + strings.TrimPrefix(link, basePath)
+		}
+		values = append(values, fmt.Sprintf(`<%s>; rel="%s"`, link, rel))
+	}
+
+	return strings.Join(values, ", ")
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+type createRequest struct {
+	ImageID string `jsonapi:"attr,image_id"`
+}
+
+func plainRouter(t *testing.T, basePath string) http.Handler {
+	router := mux.NewRouter()
+
+	router.Methods("GET").Path(basePath + "/images").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"data": [{"type": "images", "id": "1", "attributes": {"ready": true}}],
+			"links": {"next": "` + basePath + `/images?page%5Bnumber%5D=2", "prev": ""}
+		}`))
+	})
+
+	router.Methods("POST").Path(basePath + "/instances").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req createRequest
+		if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+			t.Fatal(err)
+		}
+
+		credentials := models.NewInstanceCredentials(4, "ca", "cert", "key")
+		instance := models.Instance{ID: 4, Hostname: req.ImageID, Credentials: &credentials}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		jsonapi.MarshalOnePayload(w, &instance)
+	})
+
+	router.Methods("PATCH").Path(basePath + "/images/{id}/upload").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+
+	router.Methods("GET").Path(basePath + "/images/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"id": "resource_not_found"}`))
+	})
+
+	router.PathPrefix(basePath + PlainJSONPrefix + "/").Handler(PlainJSON(basePath, router))
+	return router
+}
+
+func servePlain(router http.Handler, method, path, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestPlainJSONList(t *testing.T) {
+	recorder := servePlain(plainRouter(t, ""), "GET", "/v2/images", "", "")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `[{"id": 1, "ready": true}]`, recorder.Body.String())
+	assert.Equal(t, `</v2/images?page%5Bnumber%5D=2>; rel="next"`, recorder.Header().Get("Link"))
+}
+
+func TestPlainJSONWithBasePath(t *testing.T) {
+	recorder := servePlain(plainRouter(t, "/draupnir"), "GET", "/draupnir/v2/images", "", "")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.JSONEq(t, `[{"id": 1, "ready": true}]`, recorder.Body.String())
+	assert.Equal(t, `</draupnir/v2/images?page%5Bnumber%5D=2>; rel="next"`, recorder.Header().Get("Link"))
+}
+
+func TestPlainJSONCreate(t *testing.T) {
+	recorder := servePlain(plainRouter(t, ""), "POST", "/v2/instances", "application/json", `{"image_id": "3"}`)
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var instance map[string]interface{}
+	assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &instance))
+	assert.Equal(t, float64(4), instance["id"])
+	assert.Equal(t, "3", instance["hostname"], "the request was converted")
+	assert.Equal(t, map[string]interface{}{
+		"id":                 float64(4),
+		"ca_certificate":     "ca",
+		"client_certificate": "cert",
+		"client_key":         "key",
+	}, instance["credentials"])
+}
+
+func TestPlainJSONPassesThroughUploads(t *testing.T) {
+	recorder := servePlain(plainRouter(t, ""), "PATCH", "/v2/images/1/upload", "application/octet-stream", `{"a": 1}`)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `{"a": 1}`, recorder.Body.String())
+}
+
+func TestPlainJSONPassesThroughErrors(t *testing.T) {
+	recorder := servePlain(plainRouter(t, ""), "GET", "/v2/images/1", "", "")
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, `{"id": "resource_not_found"}`, recorder.Body.String())
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/server/api/chain"
+)
+
+const serverTimingKey key = 5
+
+// ServerTimingHeader breaks down the time the server spent handling a request,
+// so that clients can tell a slow server from a slow network
+const ServerTimingHeader = "Server-Timing"
+
+// The phases of a request that are given in its Server-Timing header
+const (
+	TimingDB       = "db"
+	TimingExecutor = "exec"
+	TimingRender   = "render"
+	TimingTotal    = "total"
+)
+
+// serverTiming accumulates the time spent in each phase of a request. Executor
+// operations may run concurrently, so it's guarded by a mutex.
+type serverTiming struct {
+	mu     sync.Mutex
+	phases map[string]time.Duration
+}
+
+// AddServerTiming adds the time since start to the phase of the request whose
+// context is given. It does nothing for contexts that don't belong to a request
+// passed through RecordServerTiming, such as those of periodic jobs, so it's
+// safe to call from code that's shared with them.
+func AddServerTiming(ctx context.Context, phase string, start time.Time) {
+	timing, ok := ctx.Value(serverTimingKey).(*serverTiming)
+	if !ok {
+		return
+	}
+
+	timing.mu.Lock()
+	defer timing.mu.Unlock()
+	timing.phases[phase] += time.Since(start)
+}
+
+// RecordServerTiming sets the Server-Timing header of each response, giving the
+// time spent in the executor and rendering the response, as recorded with
+// AddServerTiming, along with the total. The remainder is given as db, as
+// that's where almost all of it is spent, though it also includes the time
+// taken by the rest of the chain, e.g. to authenticate the request.
+//
+// The header is set once the handler returns, so this must come after
+// NewRequestLogger in the chain, which buffers the response. Streamed
+// responses, whose headers have already been sent, don't get it.
+func RecordServerTiming(next chain.Handler) chain.Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		timing := &serverTiming{phases: map[string]time.Duration{}}
+		r = r.WithContext(context.WithValue(r.Context(), serverTimingKey, timing))
+
+		start := time.Now()
+		err := next(w, r)
+		total := time.Since(start)
+
+		timing.mu.Lock()
+		defer timing.mu.Unlock()
+
+		db := total - timing.phases[TimingExecutor] - timing.phases[TimingRender]
+		if db < 0 {
+			db = 0
+		}
+
+		w.Header().Set(ServerTimingHeader, strings.Join([]string{
+			formatServerTiming(TimingDB, db),
+			formatServerTiming(TimingExecutor, timing.phases[TimingExecutor]),
+			formatServerTiming(TimingRender, timing.phases[TimingRender]),
+			formatServerTiming(TimingTotal, total),
+		}, ", "))
+
+		return err
+	}
+}
+
+// formatServerTiming formats a metric of the Server-Timing header, whose
+// durations are given in milliseconds
+func formatServerTiming(name string, duration time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(duration)/float64(time.Millisecond))
+}
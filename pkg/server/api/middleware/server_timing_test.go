@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordServerTiming(t *testing.T) {
+	handler := NewRequestLogger(log.NewNopLogger())(RecordServerTiming(
+		func(w http.ResponseWriter, r *http.Request) error {
+			AddServerTiming(r.Context(), TimingExecutor, time.Now().Add(-20*time.Millisecond))
+			AddServerTiming(r.Context(), TimingRender, time.Now().Add(-5*time.Millisecond))
+			w.WriteHeader(http.StatusCreated)
+			return nil
+		},
+	))
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/", nil))
+
+	header := recorder.Header().Get(ServerTimingHeader)
+	assert.Regexp(t, regexp.MustCompile(`^db;dur=[0-9.]+, exec;dur=2[0-9]\.[0-9]{3}, render;dur=[5-9]\.[0-9]{3}, total;dur=[0-9.]+$`), header)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+}
+
+func TestAddServerTimingOutsideRequest(t *testing.T) {
+	// e.g. the executor's operations in periodic jobs
+	assert.NotPanics(t, func() {
+		AddServerTiming(context.Background(), TimingExecutor, time.Now())
+	})
+}
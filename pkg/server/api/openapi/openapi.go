@@ -0,0 +1,313 @@
+// Package openapi builds an OpenAPI 3 document describing the API, so that
+// clients in other languages can be generated from it. Payloads are described
+// by reflecting on the models that the server marshals, so that the document
+// can't drift from what's actually sent.
+package openapi
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+)
+
+// Version is the version of the OpenAPI specification that documents follow
+const Version = "3.0.3"
+
+// The content types of request and response bodies
+const (
+	JSON        = "application/json"
+	OctetStream = "application/octet-stream"
+	EventStream = "text/event-stream"
+	PlainText   = "text/plain"
+	HTML        = "text/html"
+)
+
+// Document is an OpenAPI document. Only the parts of the specification that
+// describe this API are implemented.
+type Document struct {
+	OpenAPI    string                `json:"openapi"`
+	Info       Info                  `json:"info"`
+	Servers    []Server              `json:"servers,omitempty"`
+	Paths      map[string]PathItem   `json:"paths"`
+	Components Components            `json:"components"`
+	Security   []map[string][]string `json:"security"`
+	Tags       []Tag                 `json:"tags,omitempty"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+type Tag struct {
+	Name string `json:"name"`
+}
+
+// PathItem holds the operations on a path, keyed by their lower case method
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationID string                 `json:"operationId,omitempty"`
+	Summary     string                 `json:"summary,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Tags        []string               `json:"tags,omitempty"`
+	Parameters  []Parameter            `json:"parameters,omitempty"`
+	RequestBody *RequestBody           `json:"requestBody,omitempty"`
+	Responses   map[string]Response    `json:"responses"`
+	Security    *[]map[string][]string `json:"security,omitempty"`
+}
+
+// Parameter is a path, query or header parameter, or a reference to one of
+// the document's components
+type Parameter struct {
+	Ref         string  `json:"$ref,omitempty"`
+	Name        string  `json:"name,omitempty"`
+	In          string  `json:"in,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema,omitempty"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Headers     map[string]Header    `json:"headers,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Header struct {
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	Parameters      map[string]Parameter      `json:"parameters"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme"`
+	Description string `json:"description,omitempty"`
+}
+
+// Endpoint describes what a route accepts and returns. Routes accept and
+// render JSON:API documents unless the endpoint says otherwise.
+type Endpoint struct {
+	// ID names the operation, e.g. listImages, which generated clients usually
+	// name their methods after
+	ID          string
+	Summary     string
+	Description string
+	// Tag groups the endpoint with related ones, e.g. "Images"
+	Tag string
+	// Public endpoints don't require authentication, and Unversioned ones
+	// don't require a Draupnir-Version header
+	Public      bool
+	Unversioned bool
+	// Parameters are the query and header parameters that the endpoint
+	// accepts. Path parameters are taken from its path.
+	Parameters []Parameter
+	// Request is the model that the request's attributes are unmarshalled
+	// into. RequestType is the content type of requests whose body isn't a
+	// JSON:API document, such as uploads.
+	Request     interface{}
+	RequestType string
+	// Status is the endpoint's status when it succeeds, 200 by default.
+	// Response is the model rendered in its response, which is a list if List
+	// is set, or nil if it has no body. Plain responses are rendered as plain
+	// JSON, rather than as a JSON:API document, and ResponseType is the content
+	// type of responses that are neither, such as streams.
+	Status       int
+	Response     interface{}
+	List         bool
+	Plain        bool
+	ResponseType string
+	// Headers are the headers of the successful response
+	Headers map[string]Header
+	// Async endpoints start an operation, responding with 202, if they're sent
+	// a Prefer: respond-async header
+	Async bool
+}
+
+// Query returns an optional string query parameter
+func Query(name, description string) Parameter {
+	return Parameter{Name: name, In: "query", Description: description, Schema: &Schema{Type: "string"}}
+}
+
+// pathParameter matches the parameters of mux path templates, whose patterns,
+// e.g. {path:.+}, OpenAPI doesn't allow
+var pathParameter = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// PathTemplate returns a mux path template as an OpenAPI path, without the
+// patterns of its parameters
+func PathTemplate(template string) string {
+	return pathParameter.ReplaceAllString(template, "{$1}")
+}
+
+// New returns a document, with no paths, for the given version of the API
+func New(version string) *Document {
+	doc := &Document{
+		OpenAPI: Version,
+		Info: Info{
+			Title:   "Draupnir",
+			Version: version,
+			Description: "Draupnir provides Postgres databases containing (roughly) the latest " +
+				"production data, anonymised by each image's anonymisation script. Requests and " +
+				"responses are JSON:API documents, unless an operation says otherwise. Every path " +
+				"is also served beneath /v2 as plain JSON, whose resources are flat objects of " +
+				"their id and attributes.",
+		},
+		Paths: map[string]PathItem{},
+		Components: Components{
+			Schemas: map[string]*Schema{
+				"Error":              errorSchema(),
+				"ResourceIdentifier": resourceIdentifierSchema(),
+			},
+			Parameters: map[string]Parameter{
+				"DraupnirVersion": {
+					Name: "Draupnir-Version",
+					In:   "header",
+					Description: "The version of the API that the client speaks, which must have the " +
+						"server's major version and a minor version no newer than the server's",
+					Required: true,
+					Schema:   &Schema{Type: "string"},
+				},
+			},
+			SecuritySchemes: map[string]SecurityScheme{
+				"bearer": {
+					Type:        "http",
+					Scheme:      "bearer",
+					Description: "An OAuth access token, or the server's shared secret",
+				},
+			},
+		},
+		Security: []map[string][]string{{"bearer": {}}},
+	}
+	return doc
+}
+
+// Add documents the endpoint at the method and path. Paths may be mux path
+// templates. Endpoints without a description are still added, so that the
+// document lists every route, with only their path parameters and errors.
+func (d *Document) Add(method, path string, e Endpoint) {
+	path = PathTemplate(path)
+	item, ok := d.Paths[path]
+	if !ok {
+		item = PathItem{}
+		d.Paths[path] = item
+	}
+
+	method = strings.ToLower(method)
+	if _, ok := item[method]; ok {
+		return
+	}
+
+	op := &Operation{
+		OperationID: e.ID,
+		Summary:     e.Summary,
+		Description: e.Description,
+		Responses:   map[string]Response{},
+	}
+
+	if e.Tag != "" {
+		op.Tags = []string{e.Tag}
+		d.addTag(e.Tag)
+	}
+
+	if e.Public {
+		op.Security = &[]map[string][]string{}
+	}
+
+	for _, match := range pathParameter.FindAllStringSubmatch(path, -1) {
+		op.Parameters = append(op.Parameters, Parameter{
+			Name: match[1], In: "path", Required: true, Schema: &Schema{Type: "string"},
+		})
+	}
+	if !e.Unversioned {
+		op.Parameters = append(op.Parameters, Parameter{Ref: "#/components/parameters/DraupnirVersion"})
+	}
+	op.Parameters = append(op.Parameters, e.Parameters...)
+
+	switch {
+	case e.RequestType != "":
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]MediaType{e.RequestType: {Schema: &Schema{Type: "string", Format: "binary"}}},
+		}
+	case e.Request != nil:
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]MediaType{JSON: {Schema: d.requestDocument(e.Request)}},
+		}
+	}
+
+	status := e.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	response := Response{Description: http.StatusText(status), Headers: e.Headers}
+	switch {
+	case e.ResponseType != "":
+		response.Content = map[string]MediaType{e.ResponseType: {Schema: &Schema{Type: "string"}}}
+	case e.Response != nil && e.Plain:
+		response.Content = map[string]MediaType{JSON: {Schema: d.plain(e.Response)}}
+	case e.Response != nil:
+		response.Content = map[string]MediaType{JSON: {Schema: d.responseDocument(e.Response, e.List)}}
+	}
+	op.Responses[strconv.Itoa(status)] = response
+
+	if e.Async {
+		op.Parameters = append(op.Parameters, Parameter{
+			Name:        "Prefer",
+			In:          "header",
+			Description: "respond-async to do the work in the background, responding with the operation that does it",
+			Schema:      &Schema{Type: "string", Enum: []string{"respond-async"}},
+		})
+		op.Responses[strconv.Itoa(http.StatusAccepted)] = Response{
+			Description: http.StatusText(http.StatusAccepted),
+			Content:     map[string]MediaType{JSON: {Schema: d.responseDocument(operationModel, false)}},
+		}
+	}
+
+	op.Responses["default"] = Response{
+		Description: "An error",
+		Content:     map[string]MediaType{JSON: {Schema: &Schema{Ref: "#/components/schemas/Error"}}},
+	}
+
+	item[method] = op
+}
+
+func (d *Document) addTag(name string) {
+	for _, tag := range d.Tags {
+		if tag.Name == name {
+			return
+		}
+	}
+	d.Tags = append(d.Tags, Tag{Name: name})
+	sort.Slice(d.Tags, func(i, j int) bool { return d.Tags[i].Name < d.Tags[j].Name })
+}
+
+// errorSchema describes the errors that every route renders. They're flat
+// objects, rather than JSON:API error documents.
+func errorSchema() *Schema {
+	return describe(typeOf(api.Error{}))
+}
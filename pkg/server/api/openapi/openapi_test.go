@@ -0,0 +1,133 @@
+package openapi
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestPathTemplate(t *testing.T) {
+	assert.Equal(t, "/images/{id}", PathTemplate("/images/{id}"))
+	assert.Equal(t, "/images/{id}/upload/files/{path}", PathTemplate("/images/{id}/upload/files/{path:.+}"))
+	assert.Equal(t, "/version", PathTemplate("/version"))
+}
+
+func TestAddResource(t *testing.T) {
+	doc := New("1.0.0")
+	doc.Add("GET", "/instances/{id}", Endpoint{ID: "getInstance", Tag: "Instances", Response: models.Instance{}})
+
+	op := doc.Paths["/instances/{id}"]["get"]
+	if !assert.NotNil(t, op) {
+		return
+	}
+	assert.Equal(t, "getInstance", op.OperationID)
+	assert.Equal(t, []string{"Instances"}, op.Tags)
+	assert.Nil(t, op.Security)
+	assert.Equal(t, []Parameter{
+		{Name: "id", In: "path", Required: true, Schema: &Schema{Type: "string"}},
+		{Ref: "#/components/parameters/DraupnirVersion"},
+	}, op.Parameters)
+
+	response := op.Responses["200"].Content[JSON].Schema
+	assert.Equal(t, ref("instances"), response.Properties["data"])
+	assert.Equal(t, &Schema{Type: "array", Items: &Schema{OneOf: []*Schema{ref("credentials")}}}, response.Properties["included"])
+	assert.Equal(t, ref("Error"), op.Responses["default"].Content[JSON].Schema)
+
+	instance := doc.Components.Schemas["instances"]
+	if !assert.NotNil(t, instance) {
+		return
+	}
+	assert.Equal(t, []string{"instances"}, instance.Properties["type"].Enum)
+	assert.Equal(t, ref("ResourceIdentifier"), instance.Properties["relationships"].Properties["credentials"].Properties["data"])
+
+	attributes := instance.Properties["attributes"]
+	assert.Equal(t, &Schema{Type: "integer"}, attributes.Properties["image_id"])
+	assert.Equal(t, &Schema{Type: "string", Format: "date-time"}, attributes.Properties["created_at"])
+	assert.Equal(t, &Schema{Type: "string", Format: "date-time", Nullable: true}, attributes.Properties["expires_at"])
+	assert.Contains(t, attributes.Required, "image_id")
+	assert.Contains(t, attributes.Required, "expires_at")
+	assert.NotContains(t, attributes.Required, "created_at")
+
+	assert.NotNil(t, doc.Components.Schemas["credentials"])
+}
+
+type exampleRequest struct {
+	Reason  string            `jsonapi:"attr,reason"`
+	Labels  map[string]string `jsonapi:"attr,labels"`
+	Timeout time.Duration     `jsonapi:"attr,timeout"`
+}
+
+func TestAddRequest(t *testing.T) {
+	doc := New("1.0.0")
+	doc.Add("POST", "/examples", Endpoint{Request: exampleRequest{}, Status: http.StatusCreated, Response: models.Operation{}, List: true})
+
+	op := doc.Paths["/examples"]["post"]
+	assert.Equal(t, ref("ExampleRequest"), op.RequestBody.Content[JSON].Schema)
+
+	request := doc.Components.Schemas["ExampleRequest"]
+	attributes := request.Properties["data"].Properties["attributes"]
+	assert.Equal(t, &Schema{Type: "string"}, attributes.Properties["reason"])
+	assert.Equal(t, &Schema{Type: "object", AdditionalProperties: &Schema{Type: "string"}, Nullable: true}, attributes.Properties["labels"])
+	assert.Equal(t, &Schema{Type: "integer"}, attributes.Properties["timeout"])
+	assert.Empty(t, attributes.Required)
+
+	response := op.Responses["201"].Content[JSON].Schema
+	assert.Equal(t, &Schema{Type: "array", Items: ref("operations")}, response.Properties["data"])
+	assert.Contains(t, response.Properties["links"].Properties, "next")
+}
+
+func TestAddPublicAsyncEndpoint(t *testing.T) {
+	doc := New("1.0.0")
+	doc.Add("DELETE", "/images/{id}", Endpoint{Public: true, Unversioned: true, Status: http.StatusNoContent, Async: true})
+
+	op := doc.Paths["/images/{id}"]["delete"]
+	assert.Equal(t, &[]map[string][]string{}, op.Security)
+	assert.Len(t, op.Parameters, 2)
+	assert.Equal(t, "Prefer", op.Parameters[1].Name)
+
+	assert.Nil(t, op.Responses["204"].Content)
+	assert.Equal(t, ref("operations"), op.Responses["202"].Content[JSON].Schema.Properties["data"])
+}
+
+func TestAddPlainAndStreamedEndpoints(t *testing.T) {
+	type token struct {
+		AccessToken string    `json:"access_token"`
+		Expiry      time.Time `json:"expiry,omitempty"`
+		raw         interface{}
+	}
+
+	doc := New("1.0.0")
+	doc.Add("POST", "/tokens", Endpoint{Response: token{}, Plain: true})
+	doc.Add("PATCH", "/uploads", Endpoint{RequestType: OctetStream, ResponseType: EventStream})
+
+	assert.Equal(t, &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"access_token": {Type: "string"},
+			"expiry":       {Type: "string", Format: "date-time"},
+		},
+		Required: []string{"access_token"},
+	}, doc.Paths["/tokens"]["post"].Responses["200"].Content[JSON].Schema)
+
+	upload := doc.Paths["/uploads"]["patch"]
+	assert.Equal(t, &Schema{Type: "string", Format: "binary"}, upload.RequestBody.Content[OctetStream].Schema)
+	assert.Contains(t, upload.Responses["200"].Content, EventStream)
+}
+
+func TestAddUndescribedEndpoint(t *testing.T) {
+	doc := New("1.0.0")
+	doc.Add("GET", "/things/{name:[a-z]+}", Endpoint{})
+	// Routes registered twice are only described once
+	doc.Add("GET", "/things/{name}", Endpoint{ID: "again"})
+
+	op := doc.Paths["/things/{name}"]["get"]
+	if assert.NotNil(t, op) {
+		assert.Equal(t, "", op.OperationID)
+		assert.Contains(t, op.Responses, "200")
+		assert.Contains(t, op.Responses, "default")
+	}
+}
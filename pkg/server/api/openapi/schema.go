@@ -0,0 +1,366 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// Schema is an OpenAPI schema object. The zero value allows any value.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+// operationModel is rendered by endpoints that respond asynchronously
+var operationModel = models.Operation{}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+func typeOf(model interface{}) reflect.Type {
+	t := reflect.TypeOf(model)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+func ref(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// resourceIdentifierSchema describes the references to related resources in a
+// resource's relationships
+func resourceIdentifierSchema() *Schema {
+	return &Schema{
+		Type:     "object",
+		Required: []string{"type", "id"},
+		Properties: map[string]*Schema{
+			"type": {Type: "string"},
+			"id":   {Type: "string"},
+		},
+	}
+}
+
+// responseDocument describes the JSON:API document that the model is rendered
+// as, on its own or in a list. Lists that are paginated have links to their
+// other pages.
+func (d *Document) responseDocument(model interface{}, list bool) *Schema {
+	t := typeOf(model)
+	data := d.resource(t)
+	if list {
+		data = &Schema{Type: "array", Items: data}
+	}
+
+	doc := &Schema{
+		Type:       "object",
+		Required:   []string{"data"},
+		Properties: map[string]*Schema{"data": data},
+	}
+
+	if related := relatedTypes(t, map[reflect.Type]bool{}); len(related) > 0 {
+		var resources []*Schema
+		for _, name := range related {
+			resources = append(resources, ref(name))
+		}
+		doc.Properties["included"] = &Schema{Type: "array", Items: &Schema{OneOf: resources}}
+	}
+
+	if list {
+		doc.Properties["links"] = &Schema{
+			Type: "object",
+			Properties: map[string]*Schema{
+				"first": {Type: "string"},
+				"prev":  {Type: "string"},
+				"next":  {Type: "string"},
+			},
+		}
+	}
+
+	return doc
+}
+
+// requestDocument describes the JSON:API document that a request's attributes
+// are unmarshalled from. Its type isn't checked, so it's left unconstrained.
+func (d *Document) requestDocument(model interface{}) *Schema {
+	t := typeOf(model)
+	name := t.Name()
+	if name != "" {
+		name = strings.ToUpper(name[:1]) + name[1:]
+		if _, ok := d.Components.Schemas[name]; !ok {
+			d.Components.Schemas[name] = &Schema{
+				Type:     "object",
+				Required: []string{"data"},
+				Properties: map[string]*Schema{
+					"data": {
+						Type:     "object",
+						Required: []string{"attributes"},
+						Properties: map[string]*Schema{
+							"type":       {Type: "string"},
+							"attributes": attributes(t, false),
+						},
+					},
+				},
+			}
+		}
+		return ref(name)
+	}
+	return describe(t)
+}
+
+// plain describes a response that's rendered as plain JSON
+func (d *Document) plain(model interface{}) *Schema {
+	return describe(typeOf(model))
+}
+
+// resource adds the JSON:API resource that the model is rendered as to the
+// document's schemas, named by its type, e.g. images, and any resources that
+// it's related to. It returns a reference to the resource.
+func (d *Document) resource(t reflect.Type) *Schema {
+	name, ok := resourceType(t)
+	if !ok {
+		return describe(t)
+	}
+	if _, ok := d.Components.Schemas[name]; ok {
+		return ref(name)
+	}
+	// Claim the name first, in case the resource is related to itself
+	d.Components.Schemas[name] = &Schema{}
+
+	schema := &Schema{
+		Type:     "object",
+		Required: []string{"type", "id", "attributes"},
+		Properties: map[string]*Schema{
+			"type":       {Type: "string", Enum: []string{name}},
+			"id":         {Type: "string"},
+			"attributes": attributes(t, true),
+		},
+	}
+
+	relationships := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		args := strings.Split(field.Tag.Get("jsonapi"), ",")
+		if args[0] != "relation" || len(args) < 2 {
+			continue
+		}
+
+		related := field.Type
+		identifier := ref("ResourceIdentifier")
+		if related.Kind() == reflect.Slice {
+			related = related.Elem()
+			identifier = &Schema{Type: "array", Items: identifier}
+		}
+		d.resource(typeOfType(related))
+
+		relationships.Properties[args[1]] = &Schema{
+			Type:       "object",
+			Properties: map[string]*Schema{"data": identifier},
+		}
+	}
+	if len(relationships.Properties) > 0 {
+		schema.Properties["relationships"] = relationships
+	}
+
+	d.Components.Schemas[name] = schema
+	return ref(name)
+}
+
+func typeOfType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// resourceType returns the JSON:API type of a model, from its primary tag
+func resourceType(t reflect.Type) (string, bool) {
+	if t.Kind() != reflect.Struct {
+		return "", false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		args := strings.Split(t.Field(i).Tag.Get("jsonapi"), ",")
+		if args[0] == "primary" && len(args) > 1 {
+			return args[1], true
+		}
+	}
+	return "", false
+}
+
+// relatedTypes returns the JSON:API types of the resources that may be included
+// with a model, in order
+func relatedTypes(t reflect.Type, seen map[reflect.Type]bool) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		args := strings.Split(field.Tag.Get("jsonapi"), ",")
+		if args[0] != "relation" {
+			continue
+		}
+
+		related := field.Type
+		if related.Kind() == reflect.Slice {
+			related = related.Elem()
+		}
+		related = typeOfType(related)
+		if seen[related] {
+			continue
+		}
+		seen[related] = true
+
+		if name, ok := resourceType(related); ok {
+			names = append(names, name)
+		}
+		names = append(names, relatedTypes(related, seen)...)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// attributes describes the attributes of a model, as jsonapi marshals them.
+// Times are formatted as RFC 3339 if they're tagged iso8601, or otherwise as
+// Unix timestamps, and are left out when they're zero. Other attributes are
+// marshalled as encoding/json would, and are always present unless they're
+// tagged omitempty.
+func attributes(t reflect.Type, required bool) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		args := strings.Split(field.Tag.Get("jsonapi"), ",")
+		if args[0] != "attr" || len(args) < 2 {
+			continue
+		}
+
+		var omitEmpty, iso8601 bool
+		for _, arg := range args[2:] {
+			switch arg {
+			case "omitempty":
+				omitEmpty = true
+			case "iso8601":
+				iso8601 = true
+			}
+		}
+
+		var property *Schema
+		switch field.Type {
+		case timeType, reflect.PtrTo(timeType):
+			property = &Schema{Type: "integer", Format: "int64"}
+			if iso8601 {
+				property = &Schema{Type: "string", Format: "date-time"}
+			}
+			property.Nullable = field.Type.Kind() == reflect.Ptr
+			omitEmpty = omitEmpty || field.Type == timeType
+		default:
+			property = describe(field.Type)
+		}
+
+		schema.Properties[args[1]] = property
+		if required && !omitEmpty {
+			schema.Required = append(schema.Required, args[1])
+		}
+	}
+
+	return schema
+}
+
+// describe returns the schema of the values of a type, as encoding/json
+// marshals them. Types that marshal themselves are assumed to be strings if
+// they're strings underneath, and are otherwise left unconstrained.
+func describe(t reflect.Type) *Schema {
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+	if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType) {
+		if t.Kind() == reflect.String {
+			return &Schema{Type: "string"}
+		}
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := describe(t.Elem())
+		schema.Nullable = true
+		return schema
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: describe(t.Elem()), Nullable: true}
+	case reflect.Array:
+		return &Schema{Type: "array", Items: describe(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: describe(t.Elem()), Nullable: true}
+	case reflect.Struct:
+		schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		describeFields(t, schema)
+		return schema
+	default:
+		return &Schema{}
+	}
+}
+
+// describeFields adds the fields of a struct to its schema, as encoding/json
+// marshals them, including the fields of structs that it embeds
+func describeFields(t reflect.Type, schema *Schema) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		args := strings.Split(tag, ",")
+
+		if field.Anonymous && args[0] == "" && typeOfType(field.Type).Kind() == reflect.Struct {
+			describeFields(typeOfType(field.Type), schema)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := args[0]
+		if name == "" {
+			name = field.Name
+		}
+
+		schema.Properties[name] = describe(field.Type)
+
+		omitEmpty := false
+		for _, arg := range args[1:] {
+			omitEmpty = omitEmpty || arg == "omitempty"
+		}
+		if !omitEmpty {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
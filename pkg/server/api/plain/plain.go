@@ -0,0 +1,338 @@
+// Package plain converts between JSON:API documents and plain JSON, in which a
+// resource is a flat object of its ID and attributes, and a list of resources
+// is an array. Related resources, such as an instance's credentials, are nested
+// under the name of the relationship.
+//
+// It's used by the /v2 facade, which serves the API as plain JSON for scripts,
+// and by clients that use it.
+package plain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/google/jsonapi"
+
+	"github.com/gocardless/draupnir/pkg/models/extras"
+)
+
+// maxDepth bounds how deeply related resources are nested, so that resources
+// that relate to each other can't recurse forever
+const maxDepth = 4
+
+// document is a JSON:API document, with its data left undecoded because it may
+// be a single resource, a list or null
+type document struct {
+	Data     json.RawMessage   `json:"data"`
+	Included []*jsonapi.Node   `json:"included,omitempty"`
+	Links    map[string]string `json:"links,omitempty"`
+}
+
+// FromJSONAPI converts a JSON:API document to plain JSON, returning its links,
+// such as those to the next page of a list, separately. Bodies that aren't
+// JSON:API documents, such as errors, are returned as they are, with ok false.
+func FromJSONAPI(body []byte) (converted []byte, links map[string]string, ok bool, err error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body, nil, false, nil
+	}
+	if _, hasData := fields["data"]; !hasData {
+		return body, nil, false, nil
+	}
+
+	var doc document
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, nil, false, err
+	}
+
+	included := make(map[string]*jsonapi.Node, len(doc.Included))
+	for _, node := range doc.Included {
+		included[node.Type+","+node.ID] = node
+	}
+
+	var value interface{}
+	switch data := bytes.TrimSpace(doc.Data); {
+	case bytes.Equal(data, []byte("null")):
+		value = nil
+	case bytes.HasPrefix(data, []byte("[")):
+		var nodes []*jsonapi.Node
+		if err := json.Unmarshal(data, &nodes); err != nil {
+			return nil, nil, false, err
+		}
+
+		records := make([]map[string]interface{}, 0, len(nodes))
+		for _, node := range nodes {
+			records = append(records, flatten(node, included, 0))
+		}
+		value = records
+	default:
+		var node jsonapi.Node
+		if err := json.Unmarshal(data, &node); err != nil {
+			return nil, nil, false, err
+		}
+		value = flatten(&node, included, 0)
+	}
+
+	converted, err = json.Marshal(value)
+	return converted, doc.Links, true, err
+}
+
+// flatten converts a resource to an object of its ID, attributes and related
+// resources
+func flatten(node *jsonapi.Node, included map[string]*jsonapi.Node, depth int) map[string]interface{} {
+	record := make(map[string]interface{}, len(node.Attributes)+len(node.Relationships)+1)
+	for name, value := range node.Attributes {
+		record[name] = value
+	}
+
+	for name, relationship := range node.Relationships {
+		record[name] = flattenRelationship(relationship, included, depth+1)
+	}
+
+	// IDs are always strings in JSON:API, but scripts expect numeric IDs to be
+	// numbers. Resources that are yet to be created, such as those in requests,
+	// have no ID.
+	if id, err := strconv.Atoi(node.ID); err == nil && strconv.Itoa(id) == node.ID {
+		record["id"] = id
+	} else if node.ID != "" {
+		record["id"] = node.ID
+	}
+
+	return record
+}
+
+// flattenRelationship replaces the references to related resources with the
+// resources themselves, where they're included
+func flattenRelationship(relationship interface{}, included map[string]*jsonapi.Node, depth int) interface{} {
+	// Relationships are decoded generically, so we decode their data again
+	encoded, err := json.Marshal(relationship)
+	if err != nil {
+		return nil
+	}
+
+	var related struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(encoded, &related); err != nil {
+		return nil
+	}
+
+	resolve := func(ref *jsonapi.Node) interface{} {
+		if node, ok := included[ref.Type+","+ref.ID]; ok && depth < maxDepth {
+			return flatten(node, included, depth)
+		}
+		return flatten(ref, included, maxDepth)
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(related.Data), []byte("[")) {
+		var refs []*jsonapi.Node
+		if err := json.Unmarshal(related.Data, &refs); err != nil {
+			return nil
+		}
+
+		resources := make([]interface{}, 0, len(refs))
+		for _, ref := range refs {
+			resources = append(resources, resolve(ref))
+		}
+		return resources
+	}
+
+	var ref *jsonapi.Node
+	if err := json.Unmarshal(related.Data, &ref); err != nil || ref == nil {
+		return nil
+	}
+	return resolve(ref)
+}
+
+// ToJSONAPI converts a plain JSON object to the JSON:API document of a resource
+// of the given type. Any "id" becomes the resource's ID, and every other field
+// one of its attributes. Bodies that aren't JSON objects, or that are already
+// JSON:API documents, are returned as they are.
+func ToJSONAPI(body []byte, resourceType string) ([]byte, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body, nil
+	}
+	if _, hasData := fields["data"]; hasData {
+		return body, nil
+	}
+
+	node := &jsonapi.Node{Type: resourceType, Attributes: fields}
+	if id, ok := fields["id"]; ok {
+		node.ID = formatID(id)
+		delete(fields, "id")
+	}
+
+	return json.Marshal(jsonapi.OnePayload{Data: node})
+}
+
+// Marshal writes the model, which must be a pointer to a struct with jsonapi
+// tags, as plain JSON. Related resources aren't included.
+func Marshal(w io.Writer, model interface{}) error {
+	var payload bytes.Buffer
+	if err := extras.MarshalOnePayloadWithoutIncluded(&payload, model); err != nil {
+		return err
+	}
+
+	converted, _, _, err := FromJSONAPI(payload.Bytes())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(converted)
+	return err
+}
+
+// Unmarshal reads a plain JSON object into the model, which must be a pointer
+// to a struct with jsonapi tags, in the same way as jsonapi.UnmarshalPayload
+func Unmarshal(r io.Reader, model interface{}) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return err
+	}
+
+	t := reflect.TypeOf(model)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("expected a pointer to a model, got %T", model)
+	}
+
+	var included []*jsonapi.Node
+	node := resource(fields, t.Elem(), &included)
+
+	payload, err := json.Marshal(jsonapi.OnePayload{Data: node, Included: included})
+	if err != nil {
+		return err
+	}
+
+	return extras.UnmarshalPayload(bytes.NewReader(payload), model)
+}
+
+// UnmarshalMany reads a plain JSON array of models of the given type, which
+// must be a slice of structs with jsonapi tags, in the same way as
+// jsonapi.UnmarshalManyPayload
+func UnmarshalMany(r io.Reader, t reflect.Type) ([]interface{}, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []map[string]interface{}
+	if err := json.Unmarshal(body, &records); err != nil {
+		return nil, err
+	}
+
+	elem := t
+	for elem.Kind() == reflect.Slice || elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+
+	var included []*jsonapi.Node
+	nodes := make([]*jsonapi.Node, 0, len(records))
+	for _, fields := range records {
+		nodes = append(nodes, resource(fields, elem, &included))
+	}
+
+	payload, err := json.Marshal(jsonapi.ManyPayload{Data: nodes, Included: included})
+	if err != nil {
+		return nil, err
+	}
+
+	return extras.UnmarshalManyPayload(bytes.NewReader(payload), reflect.TypeOf(reflect.New(elem).Interface()))
+}
+
+// resource converts a plain JSON object to a resource of the model's type,
+// using the model's jsonapi tags to tell its related resources, which are
+// added to included, from its attributes
+func resource(fields map[string]interface{}, model reflect.Type, included *[]*jsonapi.Node) *jsonapi.Node {
+	node := &jsonapi.Node{Attributes: map[string]interface{}{}}
+	if id, ok := fields["id"]; ok {
+		node.ID = formatID(id)
+	}
+
+	relations := map[string]reflect.Type{}
+	for i := 0; i < model.NumField(); i++ {
+		args := strings.Split(model.Field(i).Tag.Get("jsonapi"), ",")
+		if len(args) < 2 {
+			continue
+		}
+
+		switch args[0] {
+		case "primary":
+			node.Type = args[1]
+		case "relation":
+			relations[args[1]] = model.Field(i).Type
+		}
+	}
+
+	for name, value := range fields {
+		if name == "id" {
+			continue
+		}
+
+		relation, isRelation := relations[name]
+		if !isRelation {
+			node.Attributes[name] = value
+			continue
+		}
+
+		if node.Relationships == nil {
+			node.Relationships = map[string]interface{}{}
+		}
+		node.Relationships[name] = relationship(value, relation, included)
+	}
+
+	return node
+}
+
+// relationship converts related resources to references, adding the resources
+// themselves to included
+func relationship(value interface{}, relation reflect.Type, included *[]*jsonapi.Node) interface{} {
+	elem := relation
+	for elem.Kind() == reflect.Slice || elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+
+	reference := func(fields map[string]interface{}) *jsonapi.Node {
+		node := resource(fields, elem, included)
+		*included = append(*included, node)
+		return &jsonapi.Node{Type: node.Type, ID: node.ID}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return jsonapi.RelationshipOneNode{Data: reference(v)}
+	case []interface{}:
+		refs := make([]*jsonapi.Node, 0, len(v))
+		for _, item := range v {
+			if fields, ok := item.(map[string]interface{}); ok {
+				refs = append(refs, reference(fields))
+			}
+		}
+		return jsonapi.RelationshipManyNode{Data: refs}
+	default:
+		return jsonapi.RelationshipOneNode{Data: nil}
+	}
+}
+
+// formatID formats an ID, which scripts may give as a number, as a string
+func formatID(id interface{}) string {
+	switch v := id.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,181 @@
+package plain
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func fixtureInstance() models.Instance {
+	timestamp := time.Date(2016, 1, 1, 12, 33, 44, 0, time.UTC)
+	credentials := models.NewInstanceCredentials(1, "ca", "cert", "key")
+	return models.Instance{
+		ID:          1,
+		ImageID:     2,
+		Hostname:    "draupnir.example.com",
+		Port:        5432,
+		ShardDSNs:   []string{},
+		Annotations: models.Annotations{"owner": "payments"},
+		CreatedAt:   timestamp,
+		UpdatedAt:   timestamp,
+		Credentials: &credentials,
+	}
+}
+
+func TestFromJSONAPI(t *testing.T) {
+	instance := fixtureInstance()
+
+	var payload bytes.Buffer
+	assert.Nil(t, jsonapi.MarshalOnePayload(&payload, &instance))
+
+	converted, links, ok, err := FromJSONAPI(payload.Bytes())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, links)
+
+	var record map[string]interface{}
+	assert.Nil(t, json.Unmarshal(converted, &record))
+
+	assert.Equal(t, float64(1), record["id"])
+	assert.Equal(t, float64(2), record["image_id"])
+	assert.Equal(t, "draupnir.example.com", record["hostname"])
+	assert.Equal(t, "2016-01-01T12:33:44Z", record["created_at"])
+	assert.Equal(t, map[string]interface{}{"owner": "payments"}, record["annotations"])
+	assert.Equal(t, map[string]interface{}{
+		"id":                 float64(1),
+		"ca_certificate":     "ca",
+		"client_certificate": "cert",
+		"client_key":         "key",
+	}, record["credentials"])
+}
+
+func TestFromJSONAPIList(t *testing.T) {
+	images := []*models.Image{{ID: 1, Ready: true}, {ID: 2}}
+
+	var payload bytes.Buffer
+	assert.Nil(t, jsonapi.MarshalManyPayload(&payload, images))
+
+	converted, _, ok, err := FromJSONAPI(payload.Bytes())
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	var records []map[string]interface{}
+	assert.Nil(t, json.Unmarshal(converted, &records))
+	assert.Len(t, records, 2)
+	assert.Equal(t, float64(1), records[0]["id"])
+	assert.Equal(t, true, records[0]["ready"])
+	assert.Equal(t, float64(2), records[1]["id"])
+}
+
+func TestFromJSONAPIWithLinks(t *testing.T) {
+	body := []byte(`{"data": [], "links": {"next": "/images?page%5Bnumber%5D=2"}}`)
+
+	converted, links, ok, err := FromJSONAPI(body)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "[]", string(converted))
+	assert.Equal(t, map[string]string{"next": "/images?page%5Bnumber%5D=2"}, links)
+}
+
+func TestFromJSONAPIWithStringID(t *testing.T) {
+	body := []byte(`{"data": {"type": "freshness_statuses", "id": "007", "attributes": {"fresh": true}}}`)
+
+	converted, _, _, err := FromJSONAPI(body)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"id": "007", "fresh": true}`, string(converted))
+}
+
+func TestFromJSONAPIWithNullData(t *testing.T) {
+	converted, _, ok, err := FromJSONAPI([]byte(`{"data": null}`))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "null", string(converted))
+}
+
+func TestFromJSONAPIWithError(t *testing.T) {
+	body := []byte(`{"id": "resource_not_found", "status": "404"}`)
+
+	converted, _, ok, err := FromJSONAPI(body)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, body, converted)
+}
+
+func TestToJSONAPI(t *testing.T) {
+	converted, err := ToJSONAPI([]byte(`{"image_id": "2", "standby": true}`), "instances")
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"data": {
+			"type": "instances",
+			"id": "",
+			"attributes": {"image_id": "2", "standby": true}
+		}
+	}`, string(converted))
+
+	converted, err = ToJSONAPI([]byte(`{"id": 3, "annotations": {}}`), "images")
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"data": {"type": "images", "id": "3", "attributes": {"annotations": {}}}
+	}`, string(converted))
+}
+
+func TestToJSONAPIPassesThroughOtherBodies(t *testing.T) {
+	for _, body := range []string{`{"data": {"type": "images"}}`, `[1, 2]`, `not json`} {
+		converted, err := ToJSONAPI([]byte(body), "images")
+		assert.Nil(t, err)
+		assert.Equal(t, body, string(converted))
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	instance := fixtureInstance()
+
+	var payload bytes.Buffer
+	assert.Nil(t, jsonapi.MarshalOnePayload(&payload, &instance))
+	converted, _, _, err := FromJSONAPI(payload.Bytes())
+	assert.Nil(t, err)
+
+	var decoded models.Instance
+	assert.Nil(t, Unmarshal(bytes.NewReader(converted), &decoded))
+	assert.Equal(t, instance, decoded)
+}
+
+func TestRoundTripMany(t *testing.T) {
+	instances := []*models.Instance{}
+	for id := 1; id <= 2; id++ {
+		instance := fixtureInstance()
+		instance.ID = id
+		instances = append(instances, &instance)
+	}
+
+	var payload bytes.Buffer
+	assert.Nil(t, jsonapi.MarshalManyPayload(&payload, instances))
+	converted, _, _, err := FromJSONAPI(payload.Bytes())
+	assert.Nil(t, err)
+
+	decoded, err := UnmarshalMany(bytes.NewReader(converted), reflect.TypeOf([]models.Instance{}))
+	assert.Nil(t, err)
+	if !assert.Len(t, decoded, 2) {
+		return
+	}
+	assert.Equal(t, 2, decoded[1].(*models.Instance).ID)
+	assert.Equal(t, "key", decoded[1].(*models.Instance).Credentials.ClientKey)
+}
+
+func TestMarshal(t *testing.T) {
+	request := struct {
+		ImageID string `jsonapi:"attr,image_id"`
+		Standby bool   `jsonapi:"attr,standby"`
+	}{ImageID: "2", Standby: true}
+
+	var body bytes.Buffer
+	assert.Nil(t, Marshal(&body, &request))
+	assert.JSONEq(t, `{"image_id": "2", "standby": true}`, body.String())
+}
@@ -0,0 +1,238 @@
+package routes
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/audit"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+const (
+	// DefaultAccessRequestLifetime is how long approved access lasts, unless
+	// it's requested for another duration
+	DefaultAccessRequestLifetime = 8 * time.Hour
+	// MaxAccessRequestLifetime is the longest that access can be requested for.
+	// Access that's needed for longer must be requested, and approved, again.
+	MaxAccessRequestLifetime = 7 * 24 * time.Hour
+)
+
+// AccessRequests lets users request time-boxed access to restricted image
+// families, and lets the families' approvers approve or deny them
+type AccessRequests struct {
+	Policies audit.Policies
+	Audit    audit.AccessRequests
+}
+
+// CreateAccessRequestRequest names the restricted family that access is needed
+// to, and why. ValidFor, e.g. "2h", is how long access lasts once it's
+// approved, which defaults to DefaultAccessRequestLifetime.
+type CreateAccessRequestRequest struct {
+	Family   string `jsonapi:"attr,family"`
+	Reason   string `jsonapi:"attr,reason"`
+	ValidFor string `jsonapi:"attr,valid_for"`
+}
+
+// approves reports whether the user can decide requests for access to the
+// family. Admins can decide requests for every restricted family.
+func (a AccessRequests) approves(family, email string) bool {
+	if auth.IsAdmin(email) {
+		return true
+	}
+	return a.Policies[family].Approves(email)
+}
+
+// visible reports whether the user can see the request, which they can if it's
+// theirs or they can decide it
+func (a AccessRequests) visible(request models.AccessRequest, email string) bool {
+	return request.UserEmail == email || a.approves(request.Family, email)
+}
+
+// Create requests access to a restricted family for the authenticated user.
+// The request is pending until one of the family's approvers decides it.
+func (a AccessRequests) Create(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	req := CreateAccessRequestRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if policy, ok := a.Policies[req.Family]; !ok || !policy.Restricted() {
+		api.InvalidAccessRequestError("family must name a restricted image family").Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if strings.TrimSpace(req.Reason) == "" {
+		api.InvalidAccessRequestError("reason must say why access is needed").Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	validFor := DefaultAccessRequestLifetime
+	if req.ValidFor != "" {
+		validFor, err = time.ParseDuration(req.ValidFor)
+		if err != nil || validFor <= 0 || validFor > MaxAccessRequestLifetime {
+			api.InvalidAccessRequestError("valid_for must be a positive duration of at most 168h").Render(w, http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	request, err := a.Audit.Request(models.AccessRequest{
+		UserEmail: email,
+		Family:    req.Family,
+		Reason:    req.Reason,
+		ValidFor:  validFor.String(),
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return errors.Wrap(
+		marshalOne(r, w, &request),
+		"failed to marshal access request",
+	)
+}
+
+// List returns the access requests that the user can see, newest first: their
+// own, and those that they can decide
+func (a AccessRequests) List(w http.ResponseWriter, r *http.Request) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	requests, err := a.Audit.Store.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list access requests")
+	}
+
+	payload := make([]*models.AccessRequest, 0, len(requests))
+	for i := range requests {
+		if a.visible(requests[i], email) {
+			payload = append(payload, &requests[i])
+		}
+	}
+
+	return errors.Wrap(
+		marshalMany(r, w, payload),
+		"failed to marshal access requests",
+	)
+}
+
+// Get returns an access request, if the user can see it
+func (a AccessRequests) Get(w http.ResponseWriter, r *http.Request) error {
+	request, ok, err := a.find(w, r)
+	if !ok {
+		return err
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &request),
+		"failed to marshal access request",
+	)
+}
+
+// Approve approves a pending access request, giving its user access to the
+// family until the duration that they asked for has passed
+func (a AccessRequests) Approve(w http.ResponseWriter, r *http.Request) error {
+	return a.decide(w, r, a.Audit.Approve)
+}
+
+// Deny denies a pending access request
+func (a AccessRequests) Deny(w http.ResponseWriter, r *http.Request) error {
+	return a.decide(w, r, a.Audit.Deny)
+}
+
+// decide approves or denies a request. Only the family's approvers, and admins,
+// can decide requests, and never their own.
+func (a AccessRequests) decide(w http.ResponseWriter, r *http.Request, decision func(models.AccessRequest, string, time.Time) (models.AccessRequest, error)) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	request, ok, err := a.find(w, r)
+	if !ok {
+		return err
+	}
+
+	if !a.approves(request.Family, email) || request.UserEmail == email {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	request, err = decision(request, email, time.Now())
+	if err == sql.ErrNoRows {
+		api.AccessRequestDecidedError.Render(w, http.StatusConflict)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to decide access request")
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &request),
+		"failed to marshal access request",
+	)
+}
+
+// find returns the request named by the route, rendering an error and returning
+// false if there's no such request or the user can't see it
+func (a AccessRequests) find(w http.ResponseWriter, r *http.Request) (models.AccessRequest, bool, error) {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return models.AccessRequest{}, false, err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return models.AccessRequest{}, false, err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return models.AccessRequest{}, false, nil
+	}
+
+	request, err := a.Audit.Store.Get(id)
+	if err == sql.ErrNoRows {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return request, false, nil
+	}
+	if err != nil {
+		return request, false, errors.Wrap(err, "failed to get access request")
+	}
+
+	// Requests that the user can't see are indistinguishable from those that
+	// don't exist
+	if !a.visible(request, email) {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return request, false, nil
+	}
+
+	return request, true, nil
+}
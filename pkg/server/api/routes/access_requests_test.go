@@ -0,0 +1,244 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/audit"
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+var restrictedPolicies = audit.Policies{
+	"payments": audit.Policy{Family: "payments", Approvers: []string{"approver@draupnir"}},
+	"events":   audit.Policy{Family: "events"},
+}
+
+func asUser(req *http.Request, email string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), middleware.AuthUserKey, email))
+}
+
+func TestCreateAccessRequest(t *testing.T) {
+	req, recorder, logs := createRequest(t, "POST", "/access_requests", bytes.NewBufferString(
+		`{"data": {"type": "access_requests", "attributes": {
+			"family": "payments", "reason": "INC-123: reconcile a payout", "valid_for": "2h"
+		}}}`,
+	))
+
+	broker := events.NewBroker()
+	published, unsubscribe := broker.Subscribe()
+	defer unsubscribe()
+
+	logger, _ := NewFakeLogger()
+	routeSet := AccessRequests{
+		Policies: restrictedPolicies,
+		Audit: audit.AccessRequests{
+			Logger: logger,
+			Events: broker,
+			Store: FakeAccessRequestStore{
+				_Create: func(request models.AccessRequest) (models.AccessRequest, error) {
+					assert.Equal(t, "test@draupnir", request.UserEmail)
+					assert.Equal(t, "payments", request.Family)
+					assert.Equal(t, "INC-123: reconcile a payout", request.Reason)
+					assert.Equal(t, "2h0m0s", request.ValidFor)
+					assert.Equal(t, models.AccessRequestPending, request.Status)
+					request.ID = 1
+					return request, nil
+				},
+			},
+		},
+	}
+
+	err := routeSet.Create(recorder, req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, "access_requests", response.Data.Type)
+	assert.Equal(t, "1", response.Data.ID)
+	assert.Equal(t, "pending", response.Data.Attributes["status"])
+	assert.Empty(t, logs.String(), "requests are logged by the audit logger")
+
+	event := <-published
+	assert.Equal(t, events.Created, event.Type)
+	assert.Equal(t, 1, event.AccessRequest.ID)
+}
+
+func TestCreateAccessRequestValidation(t *testing.T) {
+	testCases := []struct {
+		name       string
+		attributes string
+		reason     string
+	}{
+		{
+			"to an unrestricted family",
+			`"family": "events", "reason": "INC-123"`,
+			"family must name a restricted image family",
+		},
+		{
+			"to an unknown family",
+			`"family": "other", "reason": "INC-123"`,
+			"family must name a restricted image family",
+		},
+		{
+			"without a reason",
+			`"family": "payments", "reason": "  "`,
+			"reason must say why access is needed",
+		},
+		{
+			"for too long",
+			`"family": "payments", "reason": "INC-123", "valid_for": "200h"`,
+			"valid_for must be a positive duration of at most 168h",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "POST", "/access_requests", bytes.NewBufferString(
+				`{"data": {"type": "access_requests", "attributes": {`+tc.attributes+`}}}`,
+			))
+
+			routeSet := AccessRequests{Policies: restrictedPolicies}
+			err := routeSet.Create(recorder, req)
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+			assert.Equal(t, api.InvalidAccessRequestError(tc.reason), response)
+		})
+	}
+}
+
+func TestListAccessRequests(t *testing.T) {
+	requests := []models.AccessRequest{
+		{ID: 3, UserEmail: "other@draupnir", Family: "payments"},
+		{ID: 2, UserEmail: "test@draupnir", Family: "payments"},
+		{ID: 1, UserEmail: "other@draupnir", Family: "events"},
+	}
+
+	testCases := []struct {
+		name        string
+		email       string
+		expectedIDs []string
+	}{
+		{"as the requester", "test@draupnir", []string{"2"}},
+		{"as an approver", "approver@draupnir", []string{"3", "2"}},
+		{"as an admin", auth.UPLOAD_USER_EMAIL, []string{"3", "2", "1"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "GET", "/access_requests", nil)
+			req = asUser(req, tc.email)
+
+			routeSet := AccessRequests{
+				Policies: restrictedPolicies,
+				Audit: audit.AccessRequests{
+					Store: FakeAccessRequestStore{
+						_List: func() ([]models.AccessRequest, error) {
+							return requests, nil
+						},
+					},
+				},
+			}
+
+			err := routeSet.List(recorder, req)
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+
+			var response jsonapi.ManyPayload
+			decodeJSON(t, recorder.Body, &response)
+
+			ids := make([]string, 0)
+			for _, node := range response.Data {
+				ids = append(ids, node.ID)
+			}
+			assert.Equal(t, tc.expectedIDs, ids)
+		})
+	}
+}
+
+func TestDecideAccessRequest(t *testing.T) {
+	testCases := []struct {
+		name           string
+		path           string
+		email          string
+		requester      string
+		decideErr      error
+		expectedCode   int
+		expectedStatus string
+	}{
+		{"approved by an approver", "approve", "approver@draupnir", "test@draupnir", nil, http.StatusOK, models.AccessRequestApproved},
+		{"denied by an approver", "deny", "approver@draupnir", "test@draupnir", nil, http.StatusOK, models.AccessRequestDenied},
+		{"approved by an admin", "approve", auth.UPLOAD_USER_EMAIL, "test@draupnir", nil, http.StatusOK, models.AccessRequestApproved},
+		{"approved by its requester", "approve", "approver@draupnir", "approver@draupnir", nil, http.StatusForbidden, ""},
+		{"approved by someone else", "approve", "test@draupnir", "test@draupnir", nil, http.StatusForbidden, ""},
+		{"hidden from someone else", "approve", "other@draupnir", "test@draupnir", nil, http.StatusNotFound, ""},
+		{"already decided", "deny", "approver@draupnir", "test@draupnir", sql.ErrNoRows, http.StatusConflict, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "POST", "/access_requests/1/"+tc.path, nil)
+			req = asUser(req, tc.email)
+
+			logger, logs := NewFakeLogger()
+			routeSet := AccessRequests{
+				Policies: restrictedPolicies,
+				Audit: audit.AccessRequests{
+					Logger: logger,
+					Store: FakeAccessRequestStore{
+						_Get: func(id int) (models.AccessRequest, error) {
+							assert.Equal(t, 1, id)
+							return models.AccessRequest{
+								ID:        id,
+								UserEmail: tc.requester,
+								Family:    "payments",
+								ValidFor:  "2h0m0s",
+								Status:    models.AccessRequestPending,
+							}, nil
+						},
+						_Decide: func(id int, status, decidedBy string, decidedAt time.Time, expiresAt *time.Time) (models.AccessRequest, error) {
+							assert.Equal(t, tc.email, decidedBy)
+							if status == models.AccessRequestApproved {
+								assert.Equal(t, decidedAt.Add(2*time.Hour), *expiresAt)
+							} else {
+								assert.Nil(t, expiresAt)
+							}
+							return models.AccessRequest{ID: id, Status: status, DecidedBy: decidedBy, ExpiresAt: expiresAt}, tc.decideErr
+						},
+					},
+				},
+			}
+
+			errorHandler := FakeErrorHandler{}
+			router := mux.NewRouter()
+			router.HandleFunc("/access_requests/{id}/approve", errorHandler.Handle(routeSet.Approve))
+			router.HandleFunc("/access_requests/{id}/deny", errorHandler.Handle(routeSet.Deny))
+			router.ServeHTTP(recorder, req)
+
+			assert.Nil(t, errorHandler.Error)
+			assert.Equal(t, tc.expectedCode, recorder.Code)
+
+			if tc.expectedCode == http.StatusOK {
+				var response jsonapi.OnePayload
+				decodeJSON(t, recorder.Body, &response)
+				assert.Equal(t, tc.expectedStatus, response.Data.Attributes["status"])
+				assert.Contains(t, logs.String(), "Access request "+tc.expectedStatus)
+			}
+		})
+	}
+}
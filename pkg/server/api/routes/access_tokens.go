@@ -20,8 +20,12 @@ const TOKEN_EXCHANGE_TIMEOUT = time.Second * 5
 const OAUTH_CALLBACK_TIMEOUT = time.Minute
 
 type AccessTokens struct {
-	Callbacks map[string]chan OAuthCallback
+	Callbacks *OAuthCallbacks
 	Client    OAuthClient
+	// Devices tracks the device authorizations that are in progress, and
+	// VerificationURL is the page where their users enter their codes
+	Devices         *DeviceAuthorizations
+	VerificationURL string
 }
 
 type OAuthCallback struct {
@@ -55,10 +59,9 @@ type createAccessTokenRequest struct {
 // Create completes the OAuth flow and returns an access token
 //
 // The flow for this is a bit tricky, so it's worth going through.
-// When we receive a request to create an access token, we create a channel and
-// store it in the Callbacks map, keyed by the state parameter provided in the
-// request. We then block on the channel, waiting to receive an OAuthCallback
-// through it.
+// When we receive a request to create an access token, we register a channel in
+// Callbacks, keyed by the state parameter provided in the request. We then
+// block on the channel, waiting to receive an OAuthCallback through it.
 // The client will send the user through the OAuth flow, providing the same
 // state parameter. When the user finishes the flow, they'll be redirected to
 // the Callback handler, which is also in this route set.
@@ -66,7 +69,8 @@ type createAccessTokenRequest struct {
 // code for an access token if it was successful, and will send the outcome
 // through the same channel (looking it up by the state).
 // Create will then receive the result through the channel, remove the channel
-// from the map, and serialise a result back to the client.
+// from Callbacks, and serialise a result back to the client. If the client
+// disconnects before then, we stop waiting and consider the flow abandoned.
 func (a AccessTokens) Create(w http.ResponseWriter, r *http.Request) error {
 	var req createAccessTokenRequest
 
@@ -82,11 +86,9 @@ func (a AccessTokens) Create(w http.ResponseWriter, r *http.Request) error {
 
 	state := req.State
 
-	callback := make(chan OAuthCallback)
-	a.Callbacks[state] = callback
-
-	token, err := waitForCallback(callback)
-	delete(a.Callbacks, state)
+	callback := a.Callbacks.Register(state)
+	token, outcome, err := waitForCallback(r.Context(), callback)
+	a.Callbacks.Finish(state, outcome)
 
 	if err != nil {
 		logger.With("error", err.Error()).Info("oauth request failed")
@@ -102,15 +104,19 @@ func (a AccessTokens) Create(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-func waitForCallback(callbackChan chan OAuthCallback) (oauth2.Token, error) {
+// waitForCallback waits for the outcome of the flow to be delivered through
+// the channel, returning the token along with how the flow finished
+func waitForCallback(ctx context.Context, callbackChan chan OAuthCallback) (oauth2.Token, string, error) {
 	select {
 	case c := <-callbackChan:
 		if c.Error != nil {
-			return oauth2.Token{}, c.Error
+			return oauth2.Token{}, oauthFlowFailed, c.Error
 		}
-		return c.Token, nil
+		return c.Token, oauthFlowCompleted, nil
 	case <-time.After(OAUTH_CALLBACK_TIMEOUT):
-		return oauth2.Token{}, errors.New("Callback timed out")
+		return oauth2.Token{}, oauthFlowTimedOut, errors.New("Callback timed out")
+	case <-ctx.Done():
+		return oauth2.Token{}, oauthFlowAbandoned, errors.New("Client disconnected")
 	}
 }
 
@@ -126,7 +132,7 @@ func (a AccessTokens) Callback(w http.ResponseWriter, r *http.Request) error {
 	respCode := r.Form.Get("code")
 	state := r.Form.Get("state")
 
-	callback := a.Callbacks[state]
+	callback := a.Callbacks.Lookup(state)
 	if callback == nil {
 		logger.With("state", state).Info("cannot find oauth callback for state")
 		return nil
@@ -20,7 +20,7 @@ func TestAuthenticate(t *testing.T) {
 	req, recorder, _ := createRequest(t, "GET", "/authenticate?state=foo", nil)
 
 	routeSet := AccessTokens{
-		Callbacks: make(map[string]chan OAuthCallback),
+		Callbacks: NewOAuthCallbacks(),
 		Client:    auth.FakeOauthConfig(),
 	}
 
@@ -54,9 +54,8 @@ func TestCallback(t *testing.T) {
 
 	req, recorder, logs := createRequest(t, "GET", path, nil)
 
-	callback := make(chan OAuthCallback, 1)
-	callbacks := make(map[string]chan OAuthCallback)
-	callbacks[state] = callback
+	callbacks := NewOAuthCallbacks()
+	callback := callbacks.Register(state)
 
 	oauthClient := auth.FakeOAuthClient{
 		MockExchange: func(ctx context.Context, _code string) (*oauth2.Token, error) {
@@ -102,9 +101,8 @@ func TestCallbackWithResponseError(t *testing.T) {
 
 	req, recorder, _ := createRequest(t, "GET", path, nil)
 
-	callback := make(chan OAuthCallback, 1)
-	callbacks := make(map[string]chan OAuthCallback)
-	callbacks[state] = callback
+	callbacks := NewOAuthCallbacks()
+	callback := callbacks.Register(state)
 
 	errorHandler := FakeErrorHandler{}
 
@@ -141,9 +139,8 @@ func TestCallbackWithEmptyResponseCode(t *testing.T) {
 
 	req, recorder, logs := createRequest(t, "GET", path, nil)
 
-	callback := make(chan OAuthCallback, 1)
-	callbacks := make(map[string]chan OAuthCallback)
-	callbacks[state] = callback
+	callbacks := NewOAuthCallbacks()
+	callback := callbacks.Register(state)
 
 	errorHandler := FakeErrorHandler{}
 
@@ -181,9 +178,8 @@ func TestCallbackWithFailedTokenExchange(t *testing.T) {
 
 	req, recorder, logs := createRequest(t, "GET", path, nil)
 
-	callback := make(chan OAuthCallback, 1)
-	callbacks := make(map[string]chan OAuthCallback)
-	callbacks[state] = callback
+	callbacks := NewOAuthCallbacks()
+	callback := callbacks.Register(state)
 
 	oauthClient := auth.FakeOAuthClient{
 		MockExchange: func(ctx context.Context, _code string) (*oauth2.Token, error) {
@@ -232,9 +228,8 @@ func TestCallbackWithTimedOutTokenExchange(t *testing.T) {
 	ctx, _ := context.WithTimeout(req.Context(), 0)
 	req = req.WithContext(ctx)
 
-	callback := make(chan OAuthCallback, 1)
-	callbacks := make(map[string]chan OAuthCallback)
-	callbacks[state] = callback
+	callbacks := NewOAuthCallbacks()
+	callback := callbacks.Register(state)
 
 	oauthClient := auth.FakeOAuthClient{
 		MockExchange: func(ctx context.Context, _code string) (*oauth2.Token, error) {
@@ -0,0 +1,57 @@
+package routes
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/google/jsonapi"
+	"github.com/prometheus/common/log"
+)
+
+// AnnotateRequest is the body of a PATCH request to an image or instance.
+// Annotations and labels with string values are set, and those with null values
+// are removed. Other annotations and labels are left untouched.
+type AnnotateRequest struct {
+	Annotations models.Annotations `jsonapi:"attr,annotations"`
+	Labels      models.Labels      `jsonapi:"attr,labels"`
+}
+
+// parseAnnotationsPatch reads and validates the annotations and labels patch
+// from the request body. If it is invalid, an error is rendered and false is
+// returned.
+func parseAnnotationsPatch(w http.ResponseWriter, r *http.Request, logger log.Logger) (AnnotateRequest, bool) {
+	req := AnnotateRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return req, false
+	}
+
+	if err := req.Annotations.ValidatePatch(); err != nil {
+		logger.Info(err.Error())
+		api.InvalidAnnotationsError.Render(w, http.StatusBadRequest)
+		return req, false
+	}
+
+	if err := req.Labels.ValidatePatch(); err != nil {
+		logger.Info(err.Error())
+		api.InvalidLabelsError.Render(w, http.StatusBadRequest)
+		return req, false
+	}
+
+	return req, true
+}
+
+// isAnnotationsSizeError returns true if the error is a violation of the
+// constraint that limits the size of annotations
+func isAnnotationsSizeError(err error) bool {
+	return strings.Contains(err.Error(), "_annotations_size")
+}
+
+// isLabelsSizeError returns true if the error is a violation of the constraint
+// that limits the size of labels
+func isLabelsSizeError(err error) bool {
+	return strings.Contains(err.Error(), "_labels_size")
+}
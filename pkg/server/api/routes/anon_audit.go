@@ -0,0 +1,45 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/anonaudit"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// AnonAudit reports the ready images that weren't anonymised with the current
+// anonymisation spec of their family
+type AnonAudit struct {
+	ImageStore store.ImageStore
+	Specs      anonaudit.Specs
+}
+
+// List returns every stale image. It's evaluated afresh from the images and
+// specs, so it doesn't lag behind the auditor's checks.
+func (a AnonAudit) List(w http.ResponseWriter, r *http.Request) error {
+	hashes, err := a.Specs.ReadHashes()
+	if err != nil {
+		return errors.Wrap(err, "failed to read anonymisation specs")
+	}
+
+	images, err := a.ImageStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list images")
+	}
+
+	stale := anonaudit.Evaluate(a.Specs, hashes, images)
+
+	// Build a slice of pointers to our images, because this is what jsonapi wants
+	_stale := make([]*models.StaleImage, 0)
+	for i := range stale {
+		_stale = append(_stale, &stale[i])
+	}
+
+	return errors.Wrap(
+		marshalMany(r, w, _stale),
+		"failed to marshal stale images",
+	)
+}
@@ -0,0 +1,79 @@
+package routes
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/anonaudit"
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// writeAnonSpec writes the default family's anonymisation spec to a temporary
+// directory, which the caller removes
+func writeAnonSpec(t *testing.T, anon, policy string) (anonaudit.Specs, string) {
+	dir, err := ioutil.TempDir("", "draupnir-anon-spec")
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, "default.sql")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(anon), 0644))
+
+	return anonaudit.Specs{"default": {Family: "default", Path: path, Policy: policy}}, dir
+}
+
+func TestAnonAuditList(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/anon_audit", nil)
+
+	specs, dir := writeAnonSpec(t, "UPDATE users SET email = NULL;", anonaudit.PolicyReport)
+	defer os.RemoveAll(dir)
+
+	routeSet := AnonAudit{
+		ImageStore: FakeImageStore{
+			_List: func() ([]models.Image, error) {
+				return []models.Image{
+					{ID: 1, Ready: true, Anon: "UPDATE users SET email = 'x';"},
+					{ID: 2, Ready: true, Anon: "UPDATE users SET email = NULL;"},
+				}, nil
+			},
+		},
+		Specs: specs,
+	}
+	err := routeSet.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Len(t, response.Data, 1)
+	assert.Equal(t, "stale_images", response.Data[0].Type)
+	assert.Equal(t, "1", response.Data[0].ID)
+	assert.Equal(t, "default", response.Data[0].Attributes["family"])
+	assert.Equal(t, anonaudit.Hash("UPDATE users SET email = NULL;"), response.Data[0].Attributes["spec_hash"])
+	assert.Equal(t, "report", response.Data[0].Attributes["policy"])
+}
+
+func TestAnonAuditListWithoutSpecs(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/anon_audit", nil)
+
+	routeSet := AnonAudit{
+		ImageStore: FakeImageStore{
+			_List: func() ([]models.Image, error) {
+				return []models.Image{{ID: 1, Ready: true}}, nil
+			},
+		},
+	}
+	err := routeSet.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Empty(t, response.Data)
+}
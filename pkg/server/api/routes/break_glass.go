@@ -0,0 +1,283 @@
+package routes
+
+import (
+	"database/sql"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/audit"
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+const (
+	// DefaultBreakGlassGrantLifetime is how long break-glass grants last,
+	// unless they're created with another lifetime
+	DefaultBreakGlassGrantLifetime = time.Hour
+	// MaxBreakGlassGrantLifetime is the longest that break-glass grants can
+	// last. Access that's needed for longer must be granted again, with a
+	// reason that's recorded again.
+	MaxBreakGlassGrantLifetime = 8 * time.Hour
+)
+
+// BreakGlass lets admins grant users time-boxed access to the uploads of images
+// that haven't been finalised, and lets those users read them
+type BreakGlass struct {
+	ImageStore store.ImageStore
+	Executor   exec.Executor
+	Audit      audit.BreakGlass
+}
+
+// CreateBreakGlassGrantRequest names the user to grant access to the image's
+// upload, and why. ValidFor, e.g. "2h", is how long the grant lasts, which
+// defaults to DefaultBreakGlassGrantLifetime.
+type CreateBreakGlassGrantRequest struct {
+	UserEmail string `jsonapi:"attr,user_email"`
+	ImageID   int    `jsonapi:"attr,image_id"`
+	Reason    string `jsonapi:"attr,reason"`
+	ValidFor  string `jsonapi:"attr,valid_for"`
+}
+
+// Create grants a user access to the upload of an image that hasn't been
+// finalised. Only admins can grant access, and they must give a reason.
+func (b BreakGlass) Create(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	req := CreateBreakGlassGrantRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if req.UserEmail == "" {
+		api.InvalidBreakGlassGrantError("user_email must name the user to grant access to").Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if strings.TrimSpace(req.Reason) == "" {
+		api.InvalidBreakGlassGrantError("reason must say why access is needed").Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	validFor := DefaultBreakGlassGrantLifetime
+	if req.ValidFor != "" {
+		validFor, err = time.ParseDuration(req.ValidFor)
+		if err != nil || validFor <= 0 || validFor > MaxBreakGlassGrantLifetime {
+			api.InvalidBreakGlassGrantError("valid_for must be a positive duration of at most 8h").Render(w, http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	image, err := b.ImageStore.Get(req.ImageID)
+	if err != nil {
+		logger.With("image", req.ImageID).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if image.Ready {
+		api.UploadFinalisedError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	now := time.Now()
+	grant, err := b.Audit.Grant(models.BreakGlassGrant{
+		UserEmail: req.UserEmail,
+		ImageID:   image.ID,
+		Reason:    req.Reason,
+		GrantedBy: email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(validFor),
+	})
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return errors.Wrap(
+		marshalOne(r, w, &grant),
+		"failed to marshal break-glass grant",
+	)
+}
+
+// List returns every break-glass grant, including those that have been revoked
+// or have expired, so that admins can review who was given access and why
+func (b BreakGlass) List(w http.ResponseWriter, r *http.Request) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	grants, err := b.Audit.Store.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list break-glass grants")
+	}
+
+	payload := make([]*models.BreakGlassGrant, len(grants))
+	for i := range grants {
+		payload[i] = &grants[i]
+	}
+
+	return errors.Wrap(
+		marshalMany(r, w, payload),
+		"failed to marshal break-glass grants",
+	)
+}
+
+// Destroy revokes a break-glass grant before it expires
+func (b BreakGlass) Destroy(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	// Grants that have already been revoked, or have expired, can't be revoked
+	// again, so that the record of when access ended isn't overwritten
+	grant, err := b.Audit.Revoke(id, email, time.Now())
+	if err == sql.ErrNoRows {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to revoke break-glass grant")
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &grant),
+		"failed to marshal break-glass grant",
+	)
+}
+
+// UploadFile returns a file from the upload of an image that hasn't been
+// finalised, by its path relative to the root of the upload. The user must have
+// an active break-glass grant for the image, and every read is audited.
+func (b BreakGlass) UploadFile(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	// Even admins need a grant, so that every read of raw data has a reason
+	grant, err := b.Audit.Authorise(email, id, time.Now())
+	if err == sql.ErrNoRows {
+		logger.With("image", id).Info("denied access to image upload without a break-glass grant")
+		api.BreakGlassGrantRequiredError.Render(w, http.StatusForbidden)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to check break-glass grants")
+	}
+
+	image, err := b.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if image.Ready {
+		api.UploadFinalisedError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	name := mux.Vars(r)["path"]
+	if !isUploadPath(name) {
+		api.ImageFileNotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	// Reads are recorded before they're made, so that they're recorded even
+	// if they fail part way through
+	ipaddr, err := middleware.GetUserIPAddress(r)
+	if err != nil {
+		return err
+	}
+	b.Audit.Accessed(grant, name, ipaddr)
+
+	file, err := b.Executor.ReadImageUploadFile(r.Context(), image.ID, name)
+	if err == exec.ErrImageFileNotFound {
+		api.ImageFileNotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read image upload file")
+	}
+
+	// The file holds data that hasn't been anonymised, so mustn't be kept by
+	// anything between us and the user
+	w.Header().Set("Cache-Control", "no-store")
+	return errors.Wrap(
+		marshalOne(r, w, &file),
+		"failed to marshal image upload file",
+	)
+}
+
+// isUploadPath reports whether the path is relative, and stays within the root
+// of the upload. draupnir-upload-file checks this too, after resolving
+// symlinks.
+func isUploadPath(name string) bool {
+	if name == "" || path.IsAbs(name) {
+		return false
+	}
+	cleaned := path.Clean(name)
+	return cleaned != "." && cleaned != ".." && !strings.HasPrefix(cleaned, "../")
+}
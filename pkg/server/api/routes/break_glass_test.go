@@ -0,0 +1,346 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/audit"
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+func asUploadUser(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), middleware.AuthUserKey, auth.UPLOAD_USER_EMAIL))
+}
+
+func TestCreateBreakGlassGrant(t *testing.T) {
+	req, recorder, logs := createRequest(t, "POST", "/admin/break_glass_grants", bytes.NewBufferString(
+		`{"data": {"type": "break_glass_grants", "attributes": {
+			"user_email": "test@draupnir", "image_id": 3, "reason": "INC-123: backup fails to start", "valid_for": "2h"
+		}}}`,
+	))
+	req = asUploadUser(req)
+
+	logger, _ := NewFakeLogger()
+	routeSet := BreakGlass{
+		ImageStore: FakeImageStore{
+			_Get: func(id int) (models.Image, error) {
+				return models.Image{ID: id, Ready: false}, nil
+			},
+		},
+		Audit: audit.BreakGlass{
+			Logger: logger,
+			Store: FakeBreakGlassGrantStore{
+				_Create: func(grant models.BreakGlassGrant) (models.BreakGlassGrant, error) {
+					assert.Equal(t, "test@draupnir", grant.UserEmail)
+					assert.Equal(t, 3, grant.ImageID)
+					assert.Equal(t, "INC-123: backup fails to start", grant.Reason)
+					assert.Equal(t, auth.UPLOAD_USER_EMAIL, grant.GrantedBy)
+					assert.Equal(t, 2*time.Hour, grant.ExpiresAt.Sub(grant.CreatedAt))
+					grant.ID = 1
+					return grant, nil
+				},
+			},
+		},
+	}
+
+	err := routeSet.Create(recorder, req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, "break_glass_grants", response.Data.Type)
+	assert.Equal(t, "1", response.Data.ID)
+	assert.Equal(t, "INC-123: backup fails to start", response.Data.Attributes["reason"])
+	assert.Empty(t, logs.String(), "grants are logged by the audit logger")
+}
+
+func TestCreateBreakGlassGrantValidation(t *testing.T) {
+	testCases := []struct {
+		name           string
+		attributes     string
+		ready          bool
+		expectedStatus int
+		expectedError  api.Error
+	}{
+		{
+			"without a reason",
+			`"user_email": "test@draupnir", "image_id": 3, "reason": "  "`,
+			false,
+			http.StatusBadRequest,
+			api.InvalidBreakGlassGrantError("reason must say why access is needed"),
+		},
+		{
+			"without a user",
+			`"image_id": 3, "reason": "INC-123"`,
+			false,
+			http.StatusBadRequest,
+			api.InvalidBreakGlassGrantError("user_email must name the user to grant access to"),
+		},
+		{
+			"for too long",
+			`"user_email": "test@draupnir", "image_id": 3, "reason": "INC-123", "valid_for": "24h"`,
+			false,
+			http.StatusBadRequest,
+			api.InvalidBreakGlassGrantError("valid_for must be a positive duration of at most 8h"),
+		},
+		{
+			"to a finalised image",
+			`"user_email": "test@draupnir", "image_id": 3, "reason": "INC-123"`,
+			true,
+			http.StatusUnprocessableEntity,
+			api.UploadFinalisedError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "POST", "/admin/break_glass_grants", bytes.NewBufferString(
+				`{"data": {"type": "break_glass_grants", "attributes": {`+tc.attributes+`}}}`,
+			))
+			req = asUploadUser(req)
+
+			routeSet := BreakGlass{
+				ImageStore: FakeImageStore{
+					_Get: func(id int) (models.Image, error) {
+						return models.Image{ID: id, Ready: tc.ready}, nil
+					},
+				},
+			}
+
+			err := routeSet.Create(recorder, req)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expectedStatus, recorder.Code)
+
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+			assert.Equal(t, tc.expectedError, response)
+		})
+	}
+}
+
+func TestBreakGlassGrantsRequireAdmin(t *testing.T) {
+	routeSet := BreakGlass{}
+
+	for _, handler := range []func(http.ResponseWriter, *http.Request) error{
+		routeSet.Create,
+		routeSet.List,
+		routeSet.Destroy,
+	} {
+		req, recorder, _ := createRequest(t, "POST", "/admin/break_glass_grants", bytes.NewBufferString(
+			`{"data": {"type": "break_glass_grants", "attributes": {"user_email": "test@draupnir", "image_id": 3, "reason": "INC-123"}}}`,
+		))
+
+		err := handler(recorder, req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+		var response api.Error
+		decodeJSON(t, recorder.Body, &response)
+		assert.Equal(t, api.ForbiddenError, response)
+	}
+}
+
+func TestListBreakGlassGrants(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/admin/break_glass_grants", nil)
+	req = asUploadUser(req)
+
+	revokedAt := time.Date(2017, 5, 2, 13, 0, 0, 0, time.UTC)
+	routeSet := BreakGlass{
+		Audit: audit.BreakGlass{
+			Store: FakeBreakGlassGrantStore{
+				_List: func() ([]models.BreakGlassGrant, error) {
+					return []models.BreakGlassGrant{
+						{ID: 2, UserEmail: "test@draupnir", ImageID: 3, Reason: "INC-124"},
+						{ID: 1, UserEmail: "test@draupnir", ImageID: 3, Reason: "INC-123", RevokedAt: &revokedAt, RevokedBy: models.BreakGlassExpiry},
+					}, nil
+				},
+			},
+		},
+	}
+
+	err := routeSet.List(recorder, req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+	if assert.Len(t, response.Data, 2) {
+		assert.Equal(t, "2", response.Data[0].ID)
+		assert.Equal(t, models.BreakGlassExpiry, response.Data[1].Attributes["revoked_by"])
+	}
+}
+
+func TestDestroyBreakGlassGrant(t *testing.T) {
+	testCases := []struct {
+		name           string
+		revokeErr      error
+		expectedStatus int
+	}{
+		{"active grant", nil, http.StatusOK},
+		{"revoked or expired grant", sql.ErrNoRows, http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "DELETE", "/admin/break_glass_grants/1", nil)
+			req = asUploadUser(req)
+
+			logger, _ := NewFakeLogger()
+			routeSet := BreakGlass{
+				Audit: audit.BreakGlass{
+					Logger: logger,
+					Store: FakeBreakGlassGrantStore{
+						_Revoke: func(id int, revokedBy string, now time.Time) (models.BreakGlassGrant, error) {
+							assert.Equal(t, 1, id)
+							assert.Equal(t, auth.UPLOAD_USER_EMAIL, revokedBy)
+							return models.BreakGlassGrant{ID: id, RevokedAt: &now, RevokedBy: revokedBy}, tc.revokeErr
+						},
+					},
+				},
+			}
+
+			errorHandler := FakeErrorHandler{}
+			router := mux.NewRouter()
+			router.HandleFunc("/admin/break_glass_grants/{id}", errorHandler.Handle(routeSet.Destroy))
+			router.ServeHTTP(recorder, req)
+
+			assert.Nil(t, errorHandler.Error)
+			assert.Equal(t, tc.expectedStatus, recorder.Code)
+		})
+	}
+}
+
+func TestImageUploadFile(t *testing.T) {
+	testCases := []struct {
+		name           string
+		path           string
+		activeErr      error
+		ready          bool
+		readErr        error
+		expectedStatus int
+		expectedError  *api.Error
+		expectedAudit  bool
+	}{
+		{"with a grant", "global/pg_control", nil, false, nil, http.StatusOK, nil, true},
+		{"without a grant", "global/pg_control", sql.ErrNoRows, false, nil, http.StatusForbidden, &api.BreakGlassGrantRequiredError, false},
+		{"finalised image", "global/pg_control", nil, true, nil, http.StatusUnprocessableEntity, &api.UploadFinalisedError, false},
+		{"missing file", "global/pg_control", nil, false, exec.ErrImageFileNotFound, http.StatusNotFound, &api.ImageFileNotFoundError, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "GET", "/images/3/upload/files/"+tc.path, nil)
+
+			auditLogger, auditLogs := NewFakeLogger()
+			routeSet := BreakGlass{
+				ImageStore: FakeImageStore{
+					_Get: func(id int) (models.Image, error) {
+						return models.Image{ID: id, Ready: tc.ready}, nil
+					},
+				},
+				Executor: FakeExecutor{
+					_ReadImageUploadFile: func(ctx context.Context, id int, path string) (models.ImageFile, error) {
+						assert.Equal(t, 3, id)
+						assert.Equal(t, "global/pg_control", path)
+						return models.ImageFile{ID: path, ImageID: id, Content: "control"}, tc.readErr
+					},
+				},
+				Audit: audit.BreakGlass{
+					Logger: auditLogger,
+					Store: FakeBreakGlassGrantStore{
+						_Active: func(userEmail string, imageID int, now time.Time) (models.BreakGlassGrant, error) {
+							assert.Equal(t, "test@draupnir", userEmail)
+							assert.Equal(t, 3, imageID)
+							return models.BreakGlassGrant{ID: 7, UserEmail: userEmail, ImageID: imageID}, tc.activeErr
+						},
+					},
+				},
+			}
+
+			errorHandler := FakeErrorHandler{}
+			router := mux.NewRouter()
+			router.HandleFunc("/images/{id}/upload/files/{path:.+}", errorHandler.Handle(routeSet.UploadFile))
+			router.ServeHTTP(recorder, req)
+
+			assert.Nil(t, errorHandler.Error)
+			assert.Equal(t, tc.expectedStatus, recorder.Code)
+
+			if tc.expectedAudit {
+				assert.Contains(t, auditLogs.String(), "Break-glass access used")
+				assert.Contains(t, auditLogs.String(), "break_glass_grant=7")
+			} else {
+				assert.NotContains(t, auditLogs.String(), "Break-glass access used")
+			}
+
+			if tc.expectedError != nil {
+				var response api.Error
+				decodeJSON(t, recorder.Body, &response)
+				assert.Equal(t, *tc.expectedError, response)
+				return
+			}
+
+			var response jsonapi.OnePayload
+			decodeJSON(t, recorder.Body, &response)
+			assert.Equal(t, "image_files", response.Data.Type)
+			assert.Equal(t, "control", response.Data.Attributes["content"])
+			assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+		})
+	}
+}
+
+// The server's router cleans paths that contain .., and redirects to the
+// cleaned path, so this is only reachable by a router that doesn't
+func TestImageUploadFileOutsideOfUpload(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images/3/upload/files/global/../../secret", nil)
+
+	auditLogger, auditLogs := NewFakeLogger()
+	routeSet := BreakGlass{
+		ImageStore: FakeImageStore{
+			_Get: func(id int) (models.Image, error) {
+				return models.Image{ID: id}, nil
+			},
+		},
+		Audit: audit.BreakGlass{
+			Logger: auditLogger,
+			Store: FakeBreakGlassGrantStore{
+				_Active: func(userEmail string, imageID int, now time.Time) (models.BreakGlassGrant, error) {
+					return models.BreakGlassGrant{ID: 7, UserEmail: userEmail, ImageID: imageID}, nil
+				},
+			},
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter().SkipClean(true)
+	router.HandleFunc("/images/{id}/upload/files/{path:.+}", errorHandler.Handle(routeSet.UploadFile))
+	router.ServeHTTP(recorder, req)
+
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.NotContains(t, auditLogs.String(), "Break-glass access used")
+}
+
+func TestIsUploadPath(t *testing.T) {
+	assert.True(t, isUploadPath("backup_label"))
+	assert.True(t, isUploadPath("global/pg_control"))
+	assert.True(t, isUploadPath("base/./1/1259"))
+	assert.False(t, isUploadPath(""))
+	assert.False(t, isUploadPath("."))
+	assert.False(t, isUploadPath("/etc/passwd"))
+	assert.False(t, isUploadPath(".."))
+	assert.False(t, isUploadPath("../1/backup_label"))
+	assert.False(t, isUploadPath("global/../../secret"))
+}
@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// writeCacheable writes the payload written by marshal with an ETag of its
+// contents, and a Last-Modified of lastModified unless it's zero. If the
+// request's If-None-Match matches the ETag, 304 Not Modified is written instead,
+// so that clients can revalidate their cached copy without downloading it
+// again.
+//
+// If-Modified-Since isn't honoured, as a list's Last-Modified doesn't change
+// when a resource is removed from it.
+func writeCacheable(w http.ResponseWriter, r *http.Request, lastModified time.Time, marshal func(io.Writer) error) error {
+	var body bytes.Buffer
+	if err := marshal(&body); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(body.Bytes())
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:16]))
+
+	// Responses depend on the user, and must be revalidated before they're reused
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	_, err := body.WriteTo(w)
+	return err
+}
+
+// etagMatches reports whether an If-None-Match header matches the ETag, using
+// the weak comparison that RFC 7232 requires for If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// latestImageUpdate returns the time at which the most recently updated of the
+// images was updated
+func latestImageUpdate(images []*models.Image) time.Time {
+	var latest time.Time
+	for _, image := range images {
+		if image.UpdatedAt.After(latest) {
+			latest = image.UpdatedAt
+		}
+	}
+	return latest
+}
+
+// latestInstanceUpdate behaves like latestImageUpdate
+func latestInstanceUpdate(instances []*models.Instance) time.Time {
+	var latest time.Time
+	for _, instance := range instances {
+		if instance.UpdatedAt.After(latest) {
+			latest = instance.UpdatedAt
+		}
+	}
+	return latest
+}
@@ -0,0 +1,182 @@
+package routes
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+const (
+	// DefaultCleanupTokenLifetime is how long cleanup tokens last, unless
+	// they're created with another lifetime
+	DefaultCleanupTokenLifetime = 24 * time.Hour
+	// MaxCleanupTokenLifetime is the longest that cleanup tokens can last
+	MaxCleanupTokenLifetime = 7 * 24 * time.Hour
+)
+
+// CreateCleanupTokenRequest lists the instances that a cleanup token destroys.
+// ValidFor, e.g. "12h", is how long it lasts, which defaults to
+// DefaultCleanupTokenLifetime.
+type CreateCleanupTokenRequest struct {
+	InstanceIDs []string `jsonapi:"attr,instance_ids"`
+	ValidFor    string   `jsonapi:"attr,valid_for"`
+}
+
+// UseCleanupTokenRequest holds the secret of a cleanup token
+type UseCleanupTokenRequest struct {
+	Token string `jsonapi:"attr,token"`
+}
+
+// CreateCleanupToken creates a cleanup token for some of the user's instances.
+// The token's secret is only ever returned in the response.
+func (i Instances) CreateCleanupToken(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	req := CreateCleanupTokenRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if len(req.InstanceIDs) == 0 {
+		api.InvalidCleanupTokenRequestError("instance_ids must list at least one instance").Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	validFor := DefaultCleanupTokenLifetime
+	if req.ValidFor != "" {
+		validFor, err = time.ParseDuration(req.ValidFor)
+		if err != nil || validFor <= 0 || validFor > MaxCleanupTokenLifetime {
+			api.InvalidCleanupTokenRequestError("valid_for must be a positive duration of at most 168h").Render(w, http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	// Users can only hand out the destruction of their own instances
+	instanceIDs := make([]string, 0, len(req.InstanceIDs))
+	for _, instanceID := range req.InstanceIDs {
+		id, err := strconv.Atoi(instanceID)
+		if err != nil {
+			api.NotFoundError.Render(w, http.StatusNotFound)
+			return nil
+		}
+
+		instance, err := i.InstanceStore.Get(id)
+		if err != nil {
+			logger.With("instance", id).Info(err.Error())
+			api.NotFoundError.Render(w, http.StatusNotFound)
+			return nil
+		}
+
+		if !auth.IsAdmin(email) && email != instance.UserEmail {
+			api.NotFoundError.Render(w, http.StatusNotFound)
+			return nil
+		}
+		if instance.StaticName != "" {
+			api.StaticInstanceError.Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+		instanceIDs = append(instanceIDs, strconv.Itoa(instance.ID))
+	}
+
+	secret, err := models.NewCleanupTokenSecret()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate cleanup token")
+	}
+
+	now := time.Now()
+	token, err := i.CleanupTokenStore.Create(models.CleanupToken{
+		UserEmail:   email,
+		InstanceIDs: instanceIDs,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(validFor),
+	}, models.HashCleanupToken(secret))
+	if err != nil {
+		return errors.Wrap(err, "failed to create cleanup token")
+	}
+	token.Token = secret
+
+	logger.With("cleanup_token", token.ID).With("instances", instanceIDs).Info("created cleanup token")
+
+	w.WriteHeader(http.StatusCreated)
+	return errors.Wrap(
+		marshalOne(r, w, &token),
+		"failed to marshal cleanup token",
+	)
+}
+
+// UseCleanupToken destroys the instances of a cleanup token, which can't be
+// used again. It's authenticated by the token alone, so that whoever holds it
+// can use it without credentials of their own.
+func (i Instances) UseCleanupToken(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	req := UseCleanupTokenRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	token, err := i.CleanupTokenStore.Use(models.HashCleanupToken(req.Token), time.Now())
+	if err == sql.ErrNoRows {
+		api.InvalidCleanupTokenError.Render(w, http.StatusUnauthorized)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to use cleanup token")
+	}
+
+	logger = logger.With("cleanup_token", token.ID).With("user", token.UserEmail)
+
+	// Instances that fail to be destroyed don't stop us destroying the rest.
+	// They'll still expire, if instances have a TTL.
+	token.DestroyedInstanceIDs = []string{}
+	var destroyErr error
+	for _, instanceID := range token.InstanceIDs {
+		id, _ := strconv.Atoi(instanceID)
+		instance, err := i.InstanceStore.Get(id)
+		if err != nil {
+			logger.With("instance", id).Info("instance has already been destroyed")
+			continue
+		}
+
+		if err := i.destroy(r.Context(), logger, instance); err != nil {
+			logger.With("instance", id).With("error", err).Error("failed to destroy instance with cleanup token")
+			destroyErr = err
+			continue
+		}
+		token.DestroyedInstanceIDs = append(token.DestroyedInstanceIDs, instanceID)
+	}
+	if destroyErr != nil {
+		return destroyErr
+	}
+
+	logger.With("instances", token.DestroyedInstanceIDs).Info("used cleanup token")
+
+	return errors.Wrap(
+		marshalOne(r, w, &token),
+		"failed to marshal cleanup token",
+	)
+}
@@ -0,0 +1,170 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+)
+
+func TestCreateCleanupToken(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/cleanup_tokens", bytes.NewBufferString(
+		`{"data": {"type": "cleanup_tokens", "attributes": {"instance_ids": ["1", "2"], "valid_for": "2h"}}}`,
+	))
+
+	var hash string
+	routeSet := Instances{
+		InstanceStore: FakeInstanceStore{
+			_Get: func(id int) (models.Instance, error) {
+				return models.Instance{ID: id, UserEmail: "test@draupnir"}, nil
+			},
+		},
+		CleanupTokenStore: FakeCleanupTokenStore{
+			_Create: func(token models.CleanupToken, h string) (models.CleanupToken, error) {
+				assert.Equal(t, "test@draupnir", token.UserEmail)
+				assert.Equal(t, []string{"1", "2"}, token.InstanceIDs)
+				assert.Equal(t, 2*time.Hour, token.ExpiresAt.Sub(token.CreatedAt))
+				assert.Equal(t, "", token.Token, "the secret isn't stored")
+				hash = h
+				token.ID = 1
+				return token, nil
+			},
+		},
+	}
+
+	err := routeSet.CreateCleanupToken(recorder, req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	secret := response.Data.Attributes["token"].(string)
+	assert.Contains(t, secret, models.CleanupTokenPrefix)
+	assert.Equal(t, models.HashCleanupToken(secret), hash)
+}
+
+func TestCreateCleanupTokenForAnotherUsersInstance(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/cleanup_tokens", bytes.NewBufferString(
+		`{"data": {"type": "cleanup_tokens", "attributes": {"instance_ids": ["1", "2"]}}}`,
+	))
+
+	routeSet := Instances{
+		InstanceStore: FakeInstanceStore{
+			_Get: func(id int) (models.Instance, error) {
+				if id == 2 {
+					return models.Instance{ID: id, UserEmail: "other@draupnir"}, nil
+				}
+				return models.Instance{ID: id, UserEmail: "test@draupnir"}, nil
+			},
+		},
+	}
+
+	err := routeSet.CreateCleanupToken(recorder, req)
+	assert.Nil(t, err)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+}
+
+func TestCreateCleanupTokenInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		attributes string
+		detail     string
+	}{
+		{`"instance_ids": []`, "instance_ids must list at least one instance"},
+		{`"instance_ids": ["1"], "valid_for": "1y"`, "valid_for must be a positive duration of at most 168h"},
+		{`"instance_ids": ["1"], "valid_for": "169h"`, "valid_for must be a positive duration of at most 168h"},
+	} {
+		req, recorder, _ := createRequest(t, "POST", "/cleanup_tokens", bytes.NewBufferString(
+			`{"data": {"type": "cleanup_tokens", "attributes": {`+tc.attributes+`}}}`,
+		))
+
+		err := Instances{}.CreateCleanupToken(recorder, req)
+		assert.Nil(t, err)
+
+		var response api.Error
+		decodeJSON(t, recorder.Body, &response)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Equal(t, api.InvalidCleanupTokenRequestError(tc.detail), response)
+	}
+}
+
+func TestUseCleanupToken(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/cleanup_tokens/use", bytes.NewBufferString(
+		`{"data": {"type": "cleanup_tokens", "attributes": {"token": "dct_secret"}}}`,
+	))
+
+	destroyed := []int{}
+	var jobs []models.Job
+	routeSet := Instances{
+		InstanceStore: FakeInstanceStore{
+			_Get: func(id int) (models.Instance, error) {
+				// Instance 2 has already been destroyed
+				if id == 2 {
+					return models.Instance{}, sql.ErrNoRows
+				}
+				return models.Instance{ID: id, UserEmail: "ci@draupnir"}, nil
+			},
+			_Destroy: func(instance models.Instance) error {
+				destroyed = append(destroyed, instance.ID)
+				return nil
+			},
+		},
+		Executor: FakeExecutor{
+			_DestroyInstance: func(ctx context.Context, instanceID int) error {
+				return nil
+			},
+		},
+		ApplyWhitelist: func(string) {},
+		JobStore:       recordJobs(&jobs),
+		CleanupTokenStore: FakeCleanupTokenStore{
+			_Use: func(hash string, now time.Time) (models.CleanupToken, error) {
+				assert.Equal(t, models.HashCleanupToken("dct_secret"), hash)
+				return models.CleanupToken{ID: 1, UserEmail: "ci@draupnir", InstanceIDs: []string{"1", "2", "3"}, UsedAt: &now}, nil
+			},
+		},
+	}
+
+	err := routeSet.UseCleanupToken(recorder, req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []int{1, 3}, destroyed)
+	assert.Len(t, jobs, 2)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, []interface{}{"1", "3"}, response.Data.Attributes["destroyed_instance_ids"])
+	assert.Nil(t, response.Data.Attributes["token"])
+}
+
+func TestUseCleanupTokenInvalid(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/cleanup_tokens/use", bytes.NewBufferString(
+		`{"data": {"type": "cleanup_tokens", "attributes": {"token": "dct_used"}}}`,
+	))
+
+	routeSet := Instances{
+		CleanupTokenStore: FakeCleanupTokenStore{
+			_Use: func(hash string, now time.Time) (models.CleanupToken, error) {
+				return models.CleanupToken{}, sql.ErrNoRows
+			},
+		},
+	}
+
+	err := routeSet.UseCleanupToken(recorder, req)
+	assert.Nil(t, err)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, api.InvalidCleanupTokenError, response)
+}
@@ -0,0 +1,421 @@
+package routes
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// DEVICE_AUTHORIZATION_EXPIRY is how long the user has to enter the code and
+// sign in, and DEVICE_POLL_INTERVAL how often the client may poll for the token
+// meanwhile
+const DEVICE_AUTHORIZATION_EXPIRY = 10 * time.Minute
+const DEVICE_POLL_INTERVAL = 5 * time.Second
+
+// deviceCSRFCookie holds the token that the confirmation page submits, so that
+// other sites can't approve a code on the user's behalf
+const deviceCSRFCookie = "draupnir_device_csrf"
+
+// The results of polling a device authorization
+const (
+	deviceUnknown  = "unknown"
+	deviceSlowDown = "slow_down"
+	devicePending  = "pending"
+	deviceApproved = "approved"
+)
+
+// DeviceAuthorizations keeps track of the device authorizations that are in
+// progress, keyed by their device code.
+//
+// Once the user enters an authorization's user code, it's approved with the
+// state of the OAuth flow that the user is sent through, and its token is
+// delivered through OAuthCallbacks like that of any other flow.
+type DeviceAuthorizations struct {
+	mutex    sync.Mutex
+	pending  map[string]*pendingDeviceAuthorization
+	interval time.Duration
+}
+
+type pendingDeviceAuthorization struct {
+	userCode string
+	// state is that of the user's OAuth flow, and is empty until they enter the
+	// user code
+	state     string
+	expiresAt time.Time
+	polledAt  time.Time
+}
+
+func NewDeviceAuthorizations() *DeviceAuthorizations {
+	return &DeviceAuthorizations{
+		pending:  make(map[string]*pendingDeviceAuthorization),
+		interval: DEVICE_POLL_INTERVAL,
+	}
+}
+
+// Create starts tracking a new authorization, returning its device and user
+// codes
+func (d *DeviceAuthorizations) Create(now time.Time) (string, string, error) {
+	deviceCode, err := models.NewDeviceCode()
+	if err != nil {
+		return "", "", err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// User codes are short enough that they could collide with one that's
+	// already pending, in which case the user couldn't tell them apart
+	var userCode string
+	for userCode == "" || d.findLocked(userCode, now) != nil {
+		if userCode, err = models.NewUserCode(); err != nil {
+			return "", "", err
+		}
+	}
+
+	d.pending[deviceCode] = &pendingDeviceAuthorization{
+		userCode:  userCode,
+		expiresAt: now.Add(DEVICE_AUTHORIZATION_EXPIRY),
+	}
+	return deviceCode, userCode, nil
+}
+
+// findLocked returns the unexpired authorization with the given user code, or
+// nil if there is none. The mutex must be held.
+func (d *DeviceAuthorizations) findLocked(userCode string, now time.Time) *pendingDeviceAuthorization {
+	for _, authorization := range d.pending {
+		if authorization.userCode == userCode && !now.After(authorization.expiresAt) {
+			return authorization
+		}
+	}
+	return nil
+}
+
+// Pending reports whether there's an unexpired authorization with the given
+// user code that hasn't been approved yet
+func (d *DeviceAuthorizations) Pending(userCode string, now time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	authorization := d.findLocked(userCode, now)
+	return authorization != nil && authorization.state == ""
+}
+
+// Approve records the state of the OAuth flow that the user was sent through
+// after entering the user code. It returns false if there's no pending
+// authorization with the code, so each code can only be used once.
+func (d *DeviceAuthorizations) Approve(userCode, state string, now time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	authorization := d.findLocked(userCode, now)
+	if authorization == nil || authorization.state != "" {
+		return false
+	}
+	authorization.state = state
+	return true
+}
+
+// Poll returns the state of the authorization's OAuth flow, along with whether
+// it's been approved, is still pending, is being polled too often or doesn't
+// exist
+func (d *DeviceAuthorizations) Poll(deviceCode string, now time.Time) (string, string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	authorization, ok := d.pending[deviceCode]
+	if !ok || now.After(authorization.expiresAt) {
+		return "", deviceUnknown
+	}
+
+	// Allow for polls being delayed by the network, so that clients that wait
+	// exactly the interval aren't told to slow down
+	polledAt := authorization.polledAt
+	authorization.polledAt = now
+	if now.Sub(polledAt) < d.interval-time.Second {
+		return "", deviceSlowDown
+	}
+
+	if authorization.state == "" {
+		return "", devicePending
+	}
+	return authorization.state, deviceApproved
+}
+
+// Remove stops tracking an authorization
+func (d *DeviceAuthorizations) Remove(deviceCode string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.pending, deviceCode)
+}
+
+// Len returns the number of authorizations that are in progress
+func (d *DeviceAuthorizations) Len() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return len(d.pending)
+}
+
+// Expire removes every authorization that expired before the given time,
+// returning the number that were removed
+func (d *DeviceAuthorizations) Expire(now time.Time) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	expired := 0
+	for deviceCode, authorization := range d.pending {
+		if now.After(authorization.expiresAt) {
+			delete(d.pending, deviceCode)
+			expired++
+		}
+	}
+
+	return expired
+}
+
+// Start periodically removes expired authorizations, until the context is
+// cancelled
+func (d *DeviceAuthorizations) Start(ctx context.Context, logger log.Logger, interval time.Duration) error {
+	for {
+		select {
+		case <-time.After(interval):
+			if expired := d.Expire(time.Now()); expired > 0 {
+				logger.With("count", expired).Info("Removed expired device authorizations")
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// CreateDeviceAuthorization starts the device authorization grant, for clients
+// that can't open a browser on the user's machine. The client shows the user
+// code and verification URI to the user, then polls CreateDeviceToken with the
+// device code until the user has entered the code on another device and signed
+// in.
+func (a AccessTokens) CreateDeviceAuthorization(w http.ResponseWriter, r *http.Request) error {
+	deviceCode, userCode, err := a.Devices.Create(time.Now())
+	if err != nil {
+		return errors.Wrap(err, "failed to create device authorization")
+	}
+
+	authorization := models.DeviceAuthorization{
+		ID:                      deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         a.VerificationURL,
+		VerificationURIComplete: a.VerificationURL + "?" + url.Values{"user_code": {userCode}}.Encode(),
+		ExpiresIn:               int(DEVICE_AUTHORIZATION_EXPIRY / time.Second),
+		Interval:                int(a.Devices.interval / time.Second),
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	return errors.Wrap(
+		marshalOne(r, w, &authorization),
+		"failed to marshal device authorization",
+	)
+}
+
+type createDeviceTokenRequest struct {
+	DeviceCode string `jsonapi:"attr,device_code"`
+}
+
+// CreateDeviceToken returns the access token of a device authorization, once
+// the user has signed in. Until then, it returns an error whose code tells the
+// client whether to keep polling.
+func (a AccessTokens) CreateDeviceToken(w http.ResponseWriter, r *http.Request) error {
+	var req createDeviceTokenRequest
+
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil || req.DeviceCode == "" {
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	state, status := a.Devices.Poll(req.DeviceCode, time.Now())
+	switch status {
+	case deviceUnknown:
+		api.ExpiredDeviceCodeError.Render(w, http.StatusBadRequest)
+		return nil
+	case deviceSlowDown:
+		api.SlowDownError.Render(w, http.StatusBadRequest)
+		return nil
+	case devicePending:
+		api.AuthorizationPendingError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	// The user's OAuth flow is garbage collected if nobody collects its outcome
+	// in time
+	callback := a.Callbacks.Lookup(state)
+	if callback == nil {
+		a.Devices.Remove(req.DeviceCode)
+		api.ExpiredDeviceCodeError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	var outcome OAuthCallback
+	select {
+	case outcome = <-callback:
+	default:
+		// The user has entered the code, but hasn't finished signing in
+		api.AuthorizationPendingError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	a.Devices.Remove(req.DeviceCode)
+
+	if outcome.Error != nil {
+		a.Callbacks.Finish(state, oauthFlowFailed)
+		logger.With("error", outcome.Error.Error()).Info("device authorization failed")
+		api.DeviceAccessDeniedError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+	a.Callbacks.Finish(state, oauthFlowCompleted)
+
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(outcome.Token)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode access token")
+	}
+	return nil
+}
+
+// devicePage is rendered by the verification page, asking for the user code
+// if UserCode is empty, and otherwise asking the user to confirm it
+type devicePage struct {
+	UserCode  string
+	CSRFToken string
+	Error     string
+}
+
+var deviceTemplate = template.Must(template.New("device").Parse(`<h1>Sign in to draupnir</h1>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+{{if .UserCode}}
+<p>Only continue if you're signing in to draupnir on another device, and it's showing this code:</p>
+<h2>{{.UserCode}}</h2>
+<form method="post">
+  <input type="hidden" name="user_code" value="{{.UserCode}}">
+  <input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+  <button type="submit">Continue</button>
+</form>
+{{else}}
+<p>Enter the code shown on your other device:</p>
+<form method="get">
+  <input type="text" name="user_code" autocomplete="off" autofocus>
+  <button type="submit">Next</button>
+</form>
+{{end}}`))
+
+func renderDevicePage(w http.ResponseWriter, status int, page devicePage) error {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(status)
+	return errors.Wrap(deviceTemplate.Execute(w, page), "failed to render device page")
+}
+
+// Device is the verification page, where users enter the user code of a device
+// authorization in a browser. Entering the code, or following the complete
+// verification URI, only shows the code to confirm: as codes can be shared
+// with anyone, users are asked to check it against the one their device shows
+// before signing in.
+func (a AccessTokens) Device(w http.ResponseWriter, r *http.Request) error {
+	r.ParseForm()
+	typed := r.Form.Get("user_code")
+	if typed == "" {
+		return renderDevicePage(w, http.StatusOK, devicePage{})
+	}
+
+	userCode := models.NormaliseUserCode(typed)
+	if userCode == "" || !a.Devices.Pending(userCode, time.Now()) {
+		return renderDevicePage(w, http.StatusOK, devicePage{
+			Error: "That code is invalid or has expired. Check it and try again.",
+		})
+	}
+
+	csrfToken, err := randomToken()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate csrf token")
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCSRFCookie,
+		Value:    csrfToken,
+		Path:     r.URL.Path,
+		MaxAge:   int(DEVICE_AUTHORIZATION_EXPIRY / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return renderDevicePage(w, http.StatusOK, devicePage{UserCode: userCode, CSRFToken: csrfToken})
+}
+
+// ApproveDevice is submitted by the verification page once the user has
+// confirmed the code, and sends them through the same OAuth flow as
+// Authenticate. Its token is delivered to the device when it next polls.
+func (a AccessTokens) ApproveDevice(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	r.ParseForm()
+
+	cookie, err := r.Cookie(deviceCSRFCookie)
+	csrfToken := r.PostForm.Get("csrf_token")
+	if err != nil || csrfToken == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(csrfToken)) != 1 {
+		return renderDevicePage(w, http.StatusForbidden, devicePage{
+			Error: "Your session has expired. Enter the code again.",
+		})
+	}
+
+	userCode := models.NormaliseUserCode(r.PostForm.Get("user_code"))
+
+	state, err := randomToken()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate oauth state")
+	}
+
+	// The flow is registered before the authorization is approved, so that the
+	// device never polls an approved authorization without a flow to wait on
+	a.Callbacks.Register(state)
+	if !a.Devices.Approve(userCode, state, time.Now()) {
+		a.Callbacks.Finish(state, oauthFlowAbandoned)
+		return renderDevicePage(w, http.StatusBadRequest, devicePage{
+			Error: "That code is invalid or has expired. Check it and try again.",
+		})
+	}
+
+	logger.With("user_code", userCode).Info("device authorization approved")
+
+	w.Header().Add("Location", a.Client.AuthCodeURL(state, oauth2.AccessTypeOffline))
+	w.WriteHeader(http.StatusFound)
+	return nil
+}
+
+// randomToken returns a random, URL safe token
+func randomToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
@@ -0,0 +1,191 @@
+package routes
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+)
+
+func newDeviceRouteSet() AccessTokens {
+	devices := NewDeviceAuthorizations()
+	// Tests poll as often as they like
+	devices.interval = 0
+
+	return AccessTokens{
+		Callbacks:       NewOAuthCallbacks(),
+		Client:          auth.FakeOauthConfig(),
+		Devices:         devices,
+		VerificationURL: "https://draupnir.org/device",
+	}
+}
+
+func pollDeviceToken(t *testing.T, routeSet AccessTokens, deviceCode string) *http.Response {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayloadWithoutIncluded(body, &createDeviceTokenRequest{DeviceCode: deviceCode})
+	req, recorder, _ := createRequest(t, "POST", "/access_tokens/device/token", body)
+
+	assert.Nil(t, routeSet.CreateDeviceToken(recorder, req))
+	return recorder.Result()
+}
+
+// approveDevice confirms the user code on the verification page, returning the
+// state of the OAuth flow that the user is redirected to
+func approveDevice(t *testing.T, routeSet AccessTokens, userCode string) string {
+	req, recorder, _ := createRequest(t, "GET", "/device?user_code="+strings.ToLower(userCode), nil)
+	assert.Nil(t, routeSet.Device(recorder, req))
+	assert.Contains(t, recorder.Body.String(), userCode)
+
+	cookies := recorder.Result().Cookies()
+	assert.Len(t, cookies, 1)
+
+	form := url.Values{"user_code": {userCode}, "csrf_token": {cookies[0].Value}}
+	req, recorder, _ = createRequest(t, "POST", "/device", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookies[0])
+	assert.Nil(t, routeSet.ApproveDevice(recorder, req))
+	assert.Equal(t, http.StatusFound, recorder.Code)
+
+	redirect, err := url.Parse(recorder.Header().Get("Location"))
+	assert.Nil(t, err)
+	assert.Equal(t, "offline", redirect.Query().Get("access_type"))
+	return redirect.Query().Get("state")
+}
+
+func TestDeviceAuthorizationFlow(t *testing.T) {
+	routeSet := newDeviceRouteSet()
+
+	req, recorder, _ := createRequest(t, "POST", "/access_tokens/device", nil)
+	assert.Nil(t, routeSet.CreateDeviceAuthorization(recorder, req))
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var authorization models.DeviceAuthorization
+	assert.Nil(t, jsonapi.UnmarshalPayload(recorder.Body, &authorization))
+	assert.NotEmpty(t, authorization.ID)
+	assert.Regexp(t, "^[B-Z]{4}-[B-Z]{4}$", authorization.UserCode)
+	assert.Equal(t, "https://draupnir.org/device", authorization.VerificationURI)
+	assert.Equal(t, "https://draupnir.org/device?user_code="+authorization.UserCode, authorization.VerificationURIComplete)
+	assert.Equal(t, 600, authorization.ExpiresIn)
+
+	// Until the user enters the code, and after they have until they finish
+	// signing in, the client is told to keep polling
+	var response api.Error
+	resp := pollDeviceToken(t, routeSet, authorization.ID)
+	decodeJSON(t, resp.Body, &response)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, api.AuthorizationPendingError, response)
+
+	state := approveDevice(t, routeSet, authorization.UserCode)
+	assert.NotEmpty(t, state)
+
+	resp = pollDeviceToken(t, routeSet, authorization.ID)
+	decodeJSON(t, resp.Body, &response)
+	assert.Equal(t, api.AuthorizationPendingError, response)
+
+	// The OAuth callback delivers the token
+	routeSet.Callbacks.Lookup(state) <- OAuthCallback{Token: oauth2.Token{RefreshToken: "the-refresh-token"}}
+
+	var token oauth2.Token
+	resp = pollDeviceToken(t, routeSet, authorization.ID)
+	decodeJSON(t, resp.Body, &token)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "the-refresh-token", token.RefreshToken)
+	assert.Equal(t, 0, routeSet.Devices.Len())
+	assert.Equal(t, 0, routeSet.Callbacks.Len())
+
+	// The device code can only be used once
+	resp = pollDeviceToken(t, routeSet, authorization.ID)
+	decodeJSON(t, resp.Body, &response)
+	assert.Equal(t, api.ExpiredDeviceCodeError, response)
+}
+
+func TestDeviceAuthorizationWithFailedSignIn(t *testing.T) {
+	routeSet := newDeviceRouteSet()
+	deviceCode, userCode, err := routeSet.Devices.Create(time.Now())
+	assert.Nil(t, err)
+
+	state := approveDevice(t, routeSet, userCode)
+	routeSet.Callbacks.Lookup(state) <- OAuthCallback{Error: errors.New("access_denied")}
+
+	var response api.Error
+	resp := pollDeviceToken(t, routeSet, deviceCode)
+	decodeJSON(t, resp.Body, &response)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, api.DeviceAccessDeniedError, response)
+	assert.Equal(t, 0, routeSet.Callbacks.Len())
+}
+
+func TestDeviceTokenPolledTooOften(t *testing.T) {
+	routeSet := newDeviceRouteSet()
+	routeSet.Devices.interval = DEVICE_POLL_INTERVAL
+	deviceCode, _, err := routeSet.Devices.Create(time.Now())
+	assert.Nil(t, err)
+
+	var response api.Error
+	decodeJSON(t, pollDeviceToken(t, routeSet, deviceCode).Body, &response)
+	assert.Equal(t, api.AuthorizationPendingError, response)
+
+	decodeJSON(t, pollDeviceToken(t, routeSet, deviceCode).Body, &response)
+	assert.Equal(t, api.SlowDownError, response)
+}
+
+func TestApproveDeviceWithoutCSRFToken(t *testing.T) {
+	routeSet := newDeviceRouteSet()
+	_, userCode, err := routeSet.Devices.Create(time.Now())
+	assert.Nil(t, err)
+
+	// Another site could submit the form, but can't read or send the cookie
+	form := url.Values{"user_code": {userCode}, "csrf_token": {"forged"}}
+	req, recorder, _ := createRequest(t, "POST", "/device", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	assert.Nil(t, routeSet.ApproveDevice(recorder, req))
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.True(t, routeSet.Devices.Pending(userCode, time.Now()))
+	assert.Equal(t, 0, routeSet.Callbacks.Len())
+}
+
+func TestDeviceWithUnknownUserCode(t *testing.T) {
+	routeSet := newDeviceRouteSet()
+
+	req, recorder, _ := createRequest(t, "GET", "/device?user_code=BCDF-GHJK", nil)
+	assert.Nil(t, routeSet.Device(recorder, req))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "invalid or has expired")
+	assert.Empty(t, recorder.Result().Cookies())
+}
+
+func TestDeviceAuthorizationsExpire(t *testing.T) {
+	devices := NewDeviceAuthorizations()
+	deviceCode, userCode, err := devices.Create(time.Now())
+	assert.Nil(t, err)
+
+	expiry := time.Now().Add(DEVICE_AUTHORIZATION_EXPIRY + time.Second)
+	assert.False(t, devices.Pending(userCode, expiry))
+	assert.False(t, devices.Approve(userCode, "foo", expiry))
+	_, status := devices.Poll(deviceCode, expiry)
+	assert.Equal(t, deviceUnknown, status)
+
+	assert.Equal(t, 0, devices.Expire(time.Now()))
+	assert.Equal(t, 1, devices.Expire(expiry))
+	assert.Equal(t, 0, devices.Len())
+}
+
+func TestNormaliseUserCode(t *testing.T) {
+	assert.Equal(t, "BCDF-GHJK", models.NormaliseUserCode("bcdf ghjk"))
+	assert.Equal(t, "BCDF-GHJK", models.NormaliseUserCode("BCDFGHJK"))
+	assert.Equal(t, "", models.NormaliseUserCode("BCDF-GHJ"))
+	assert.Equal(t, "", models.NormaliseUserCode("ABCD-EFGH"))
+}
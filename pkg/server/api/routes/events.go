@@ -0,0 +1,130 @@
+package routes
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// defaultKeepAlive is how often a comment is sent down idle event streams, so
+// that proxies don't close them
+const defaultKeepAlive = 30 * time.Second
+
+// Events streams changes to images and instances as server-sent events, so
+// that clients can watch them rather than polling
+type Events struct {
+	Broker *events.Broker
+	// KeepAlive is how often a comment is sent down idle streams. It defaults to
+	// 30 seconds.
+	KeepAlive time.Duration
+}
+
+// Images streams changes to every image
+func (e Events) Images(w http.ResponseWriter, r *http.Request) error {
+	return e.stream(w, r, func(event events.Event) interface{} {
+		if event.Image == nil {
+			return nil
+		}
+		return event.Image
+	})
+}
+
+// Instances streams changes to the user's instances
+func (e Events) Instances(w http.ResponseWriter, r *http.Request) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	return e.stream(w, r, func(event events.Event) interface{} {
+		// As when listing instances, users can only see their own
+		if event.Instance == nil || event.Instance.UserEmail != email {
+			return nil
+		}
+		return event.Instance
+	})
+}
+
+// stream writes each event's resource, as returned by resource, until the
+// client disconnects. Events for which resource returns nil are skipped.
+//
+// If the client falls too far behind, the stream is ended: it should list the
+// resources again before watching them again, as it will have missed events.
+func (e Events) stream(w http.ResponseWriter, r *http.Request, resource func(events.Event) interface{}) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("response can't be streamed")
+	}
+
+	subscription, unsubscribe := e.Broker.Subscribe()
+	defer unsubscribe()
+
+	// Send the headers straight away, so that the client knows that it's
+	// subscribed
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	interval := e.KeepAlive
+	if interval == 0 {
+		interval = defaultKeepAlive
+	}
+	keepAlive := time.NewTicker(interval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event, ok := <-subscription:
+			if !ok {
+				return nil
+			}
+
+			eventType, ok := streamedType(event.Type)
+			if !ok {
+				continue
+			}
+
+			payload := resource(event)
+			if payload == nil {
+				continue
+			}
+
+			var data bytes.Buffer
+			if err := jsonapi.MarshalOnePayload(&data, payload); err != nil {
+				return errors.Wrap(err, "failed to marshal event")
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, bytes.TrimSpace(data.Bytes()))
+			flusher.Flush()
+		}
+	}
+}
+
+// streamedType returns the type that an event is streamed as, and false if it
+// isn't streamed. Streams only have the created, updated and destroyed events
+// that clients have always understood, so images that are finalised are
+// streamed as updated, and failed finalisations, which don't change the image,
+// aren't streamed.
+func streamedType(eventType string) (string, bool) {
+	switch eventType {
+	case events.Finalised:
+		return events.Updated, true
+	case events.FinalisationFailed:
+		return "", false
+	default:
+		return eventType, true
+	}
+}
@@ -0,0 +1,113 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+// watch serves the route, and returns a reader of its event stream once the
+// route has subscribed to events
+func watch(t *testing.T, route func(http.ResponseWriter, *http.Request) error) (*bufio.Reader, func()) {
+	errorHandler := FakeErrorHandler{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger, _ := NewFakeLogger()
+		ctx := context.WithValue(r.Context(), middleware.LoggerKey, &logger)
+		ctx = context.WithValue(ctx, middleware.AuthUserKey, "test@draupnir")
+		errorHandler.Handle(route)(w, r.WithContext(ctx))
+	}))
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	return bufio.NewReader(resp.Body), func() {
+		resp.Body.Close()
+		server.Close()
+		assert.Nil(t, errorHandler.Error)
+	}
+}
+
+// readEvent reads the next event from the stream, skipping comments
+func readEvent(t *testing.T, stream *bufio.Reader) []string {
+	var lines []string
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, ":"):
+		case line == "" && len(lines) > 0:
+			return lines
+		case line != "":
+			lines = append(lines, line)
+		}
+	}
+}
+
+func TestEventsImages(t *testing.T) {
+	broker := events.NewBroker()
+	stream, done := watch(t, Events{Broker: broker}.Images)
+	defer done()
+
+	broker.Publish(events.InstanceEvent(events.Created, models.Instance{ID: 1, UserEmail: "test@draupnir"}))
+	broker.Publish(events.ImageEvent(events.Updated, models.Image{ID: 2, Ready: true}))
+
+	lines := readEvent(t, stream)
+	assert.Equal(t, "event: updated", lines[0])
+	assert.Contains(t, lines[1], `data: {"data":{"type":"images","id":"2"`)
+	assert.Contains(t, lines[1], `"ready":true`)
+}
+
+func TestEventsImagesFinalised(t *testing.T) {
+	broker := events.NewBroker()
+	stream, done := watch(t, Events{Broker: broker}.Images)
+	defer done()
+
+	broker.Publish(events.FinalisationFailedEvent(models.Image{ID: 1}, errors.New("anonymisation failed")))
+	broker.Publish(events.ImageEvent(events.Finalised, models.Image{ID: 2, Ready: true}))
+
+	lines := readEvent(t, stream)
+	assert.Equal(t, "event: updated", lines[0], "finalised images are streamed as updated")
+	assert.Contains(t, lines[1], `data: {"data":{"type":"images","id":"2"`)
+}
+
+func TestEventsInstances(t *testing.T) {
+	broker := events.NewBroker()
+	stream, done := watch(t, Events{Broker: broker}.Instances)
+	defer done()
+
+	broker.Publish(events.InstanceEvent(events.Created, models.Instance{ID: 1, UserEmail: "otheruser@draupnir"}))
+	broker.Publish(events.ImageEvent(events.Created, models.Image{ID: 1}))
+	broker.Publish(events.InstanceEvent(events.Destroyed, models.Instance{ID: 2, UserEmail: "test@draupnir"}))
+
+	lines := readEvent(t, stream)
+	assert.Equal(t, "event: destroyed", lines[0])
+	assert.Contains(t, lines[1], `data: {"data":{"type":"instances","id":"2"`)
+}
+
+func TestEventsKeepAlive(t *testing.T) {
+	stream, done := watch(t, Events{Broker: events.NewBroker(), KeepAlive: time.Millisecond}.Images)
+	defer done()
+
+	line, err := stream.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, ": keep-alive\n", line)
+}
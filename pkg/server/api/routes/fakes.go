@@ -7,13 +7,16 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/prometheus/common/log"
 	"golang.org/x/net/context"
 
+	"github.com/gocardless/draupnir/pkg/exec"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
 )
 
 func NewFakeLogger() (log.Logger, *bytes.Buffer) {
@@ -24,16 +27,23 @@ func NewFakeLogger() (log.Logger, *bytes.Buffer) {
 
 type FakeImageStore struct {
 	_List        func() ([]models.Image, error)
+	_ListPage    func(store.ImageFilter, store.Sort, store.Page) ([]models.Image, bool, error)
 	_Get         func(int) (models.Image, error)
 	_Create      func(models.Image) (models.Image, error)
 	_Destroy     func(models.Image) error
 	_MarkAsReady func(models.Image) (models.Image, error)
+	_Annotate    func(models.Image, models.Annotations) (models.Image, error)
+	_Label       func(models.Image, models.Labels) (models.Image, error)
 }
 
 func (s FakeImageStore) List() ([]models.Image, error) {
 	return s._List()
 }
 
+func (s FakeImageStore) ListPage(filter store.ImageFilter, sort store.Sort, page store.Page) ([]models.Image, bool, error) {
+	return s._ListPage(filter, sort, page)
+}
+
 func (s FakeImageStore) Get(id int) (models.Image, error) {
 	return s._Get(id)
 }
@@ -50,11 +60,25 @@ func (s FakeImageStore) MarkAsReady(image models.Image) (models.Image, error) {
 	return s._MarkAsReady(image)
 }
 
+func (s FakeImageStore) Annotate(image models.Image, patch models.Annotations) (models.Image, error) {
+	return s._Annotate(image, patch)
+}
+
+func (s FakeImageStore) Label(image models.Image, patch models.Labels) (models.Image, error) {
+	return s._Label(image, patch)
+}
+
 type FakeInstanceStore struct {
-	_Create  func(models.Instance) (models.Instance, error)
-	_List    func() ([]models.Instance, error)
-	_Get     func(int) (models.Instance, error)
-	_Destroy func(instance models.Instance) error
+	_Create         func(models.Instance) (models.Instance, error)
+	_List           func() ([]models.Instance, error)
+	_ListPage       func(store.InstanceFilter, store.Sort, store.Page) ([]models.Instance, bool, error)
+	_Get            func(int) (models.Instance, error)
+	_Destroy        func(instance models.Instance) error
+	_MarkAsPromoted func(instance models.Instance) (models.Instance, error)
+	_Annotate       func(instance models.Instance, patch models.Annotations) (models.Instance, error)
+	_Label          func(instance models.Instance, patch models.Labels) (models.Instance, error)
+	_Extend         func(instance models.Instance, expiresAt time.Time) (models.Instance, error)
+	_Count          func(userEmail string) ([]models.InstanceCount, error)
 }
 
 func (s FakeInstanceStore) Create(image models.Instance) (models.Instance, error) {
@@ -65,6 +89,10 @@ func (s FakeInstanceStore) List() ([]models.Instance, error) {
 	return s._List()
 }
 
+func (s FakeInstanceStore) ListPage(filter store.InstanceFilter, sort store.Sort, page store.Page) ([]models.Instance, bool, error) {
+	return s._ListPage(filter, sort, page)
+}
+
 func (s FakeInstanceStore) Get(id int) (models.Instance, error) {
 	return s._Get(id)
 }
@@ -73,6 +101,26 @@ func (s FakeInstanceStore) Destroy(instance models.Instance) error {
 	return s._Destroy(instance)
 }
 
+func (s FakeInstanceStore) MarkAsPromoted(instance models.Instance) (models.Instance, error) {
+	return s._MarkAsPromoted(instance)
+}
+
+func (s FakeInstanceStore) Annotate(instance models.Instance, patch models.Annotations) (models.Instance, error) {
+	return s._Annotate(instance, patch)
+}
+
+func (s FakeInstanceStore) Label(instance models.Instance, patch models.Labels) (models.Instance, error) {
+	return s._Label(instance, patch)
+}
+
+func (s FakeInstanceStore) Extend(instance models.Instance, expiresAt time.Time) (models.Instance, error) {
+	return s._Extend(instance, expiresAt)
+}
+
+func (s FakeInstanceStore) Count(userEmail string) ([]models.InstanceCount, error) {
+	return s._Count(userEmail)
+}
+
 type FakeWhitelistedAddressStore struct {
 	_Create func(models.WhitelistedAddress) (models.WhitelistedAddress, error)
 	_List   func() ([]models.WhitelistedAddress, error)
@@ -86,25 +134,374 @@ func (s FakeWhitelistedAddressStore) List() ([]models.WhitelistedAddress, error)
 	return s._List()
 }
 
+type FakeBakeSpanStore struct {
+	_Create func(models.BakeSpan) (models.BakeSpan, error)
+	_Finish func(models.BakeSpan) (models.BakeSpan, error)
+	_List   func(imageID int) ([]models.BakeSpan, error)
+}
+
+func (s FakeBakeSpanStore) Create(span models.BakeSpan) (models.BakeSpan, error) {
+	return s._Create(span)
+}
+
+func (s FakeBakeSpanStore) Finish(span models.BakeSpan) (models.BakeSpan, error) {
+	return s._Finish(span)
+}
+
+func (s FakeBakeSpanStore) List(imageID int) ([]models.BakeSpan, error) {
+	return s._List(imageID)
+}
+
+type FakeProxySessionStore struct {
+	_Create func(models.ProxySession) (models.ProxySession, error)
+	_End    func(models.ProxySession) (models.ProxySession, error)
+}
+
+func (s FakeProxySessionStore) Create(session models.ProxySession) (models.ProxySession, error) {
+	return s._Create(session)
+}
+
+func (s FakeProxySessionStore) End(session models.ProxySession) (models.ProxySession, error) {
+	return s._End(session)
+}
+
+type FakeCleanupTokenStore struct {
+	_Create func(models.CleanupToken, string) (models.CleanupToken, error)
+	_Use    func(string, time.Time) (models.CleanupToken, error)
+}
+
+func (s FakeCleanupTokenStore) Create(token models.CleanupToken, hash string) (models.CleanupToken, error) {
+	return s._Create(token, hash)
+}
+
+func (s FakeCleanupTokenStore) Use(hash string, now time.Time) (models.CleanupToken, error) {
+	return s._Use(hash, now)
+}
+
+type FakeBreakGlassGrantStore struct {
+	_Create        func(models.BreakGlassGrant) (models.BreakGlassGrant, error)
+	_List          func() ([]models.BreakGlassGrant, error)
+	_Active        func(string, int, time.Time) (models.BreakGlassGrant, error)
+	_Revoke        func(int, string, time.Time) (models.BreakGlassGrant, error)
+	_RevokeExpired func(time.Time) ([]models.BreakGlassGrant, error)
+}
+
+func (s FakeBreakGlassGrantStore) Create(grant models.BreakGlassGrant) (models.BreakGlassGrant, error) {
+	return s._Create(grant)
+}
+
+func (s FakeBreakGlassGrantStore) List() ([]models.BreakGlassGrant, error) {
+	return s._List()
+}
+
+func (s FakeBreakGlassGrantStore) Active(userEmail string, imageID int, now time.Time) (models.BreakGlassGrant, error) {
+	return s._Active(userEmail, imageID, now)
+}
+
+func (s FakeBreakGlassGrantStore) Revoke(id int, revokedBy string, now time.Time) (models.BreakGlassGrant, error) {
+	return s._Revoke(id, revokedBy, now)
+}
+
+func (s FakeBreakGlassGrantStore) RevokeExpired(now time.Time) ([]models.BreakGlassGrant, error) {
+	return s._RevokeExpired(now)
+}
+
+type FakeAccessRequestStore struct {
+	_Create func(models.AccessRequest) (models.AccessRequest, error)
+	_Get    func(int) (models.AccessRequest, error)
+	_List   func() ([]models.AccessRequest, error)
+	_Decide func(int, string, string, time.Time, *time.Time) (models.AccessRequest, error)
+	_Active func(string, string, time.Time) (models.AccessRequest, error)
+}
+
+func (s FakeAccessRequestStore) Create(request models.AccessRequest) (models.AccessRequest, error) {
+	return s._Create(request)
+}
+
+func (s FakeAccessRequestStore) Get(id int) (models.AccessRequest, error) {
+	return s._Get(id)
+}
+
+func (s FakeAccessRequestStore) List() ([]models.AccessRequest, error) {
+	return s._List()
+}
+
+func (s FakeAccessRequestStore) Decide(id int, status, decidedBy string, decidedAt time.Time, expiresAt *time.Time) (models.AccessRequest, error) {
+	return s._Decide(id, status, decidedBy, decidedAt, expiresAt)
+}
+
+func (s FakeAccessRequestStore) Active(userEmail, family string, now time.Time) (models.AccessRequest, error) {
+	return s._Active(userEmail, family, now)
+}
+
+type FakeWebhookDeliveryStore struct {
+	_Create      func(models.WebhookDelivery) (models.WebhookDelivery, error)
+	_Update      func(models.WebhookDelivery) (models.WebhookDelivery, error)
+	_ListPending func() ([]models.WebhookDelivery, error)
+	_ListPage    func(store.WebhookDeliveryFilter, store.Page) ([]models.WebhookDelivery, bool, error)
+}
+
+func (s FakeWebhookDeliveryStore) Create(delivery models.WebhookDelivery) (models.WebhookDelivery, error) {
+	return s._Create(delivery)
+}
+
+func (s FakeWebhookDeliveryStore) Update(delivery models.WebhookDelivery) (models.WebhookDelivery, error) {
+	return s._Update(delivery)
+}
+
+func (s FakeWebhookDeliveryStore) ListPending() ([]models.WebhookDelivery, error) {
+	return s._ListPending()
+}
+
+func (s FakeWebhookDeliveryStore) ListPage(filter store.WebhookDeliveryFilter, page store.Page) ([]models.WebhookDelivery, bool, error) {
+	return s._ListPage(filter, page)
+}
+
+type FakeInstanceGroupStore struct {
+	_Create  func(models.InstanceGroup) (models.InstanceGroup, error)
+	_List    func() ([]models.InstanceGroup, error)
+	_Get     func(int) (models.InstanceGroup, error)
+	_Extend  func(models.InstanceGroup, time.Time) (models.InstanceGroup, error)
+	_Destroy func(models.InstanceGroup) error
+}
+
+func (s FakeInstanceGroupStore) Create(group models.InstanceGroup) (models.InstanceGroup, error) {
+	return s._Create(group)
+}
+
+func (s FakeInstanceGroupStore) List() ([]models.InstanceGroup, error) {
+	return s._List()
+}
+
+func (s FakeInstanceGroupStore) Get(id int) (models.InstanceGroup, error) {
+	return s._Get(id)
+}
+
+func (s FakeInstanceGroupStore) Extend(group models.InstanceGroup, expiresAt time.Time) (models.InstanceGroup, error) {
+	return s._Extend(group, expiresAt)
+}
+
+func (s FakeInstanceGroupStore) Destroy(group models.InstanceGroup) error {
+	return s._Destroy(group)
+}
+
+type FakeSearchStore struct {
+	_Search func(query string, userEmail string, page store.Page) ([]models.SearchResult, bool, error)
+}
+
+func (s FakeSearchStore) Search(query string, userEmail string, page store.Page) ([]models.SearchResult, bool, error) {
+	return s._Search(query, userEmail, page)
+}
+
+type FakeJobStore struct {
+	_Create      func(models.Job) (models.Job, error)
+	_Start       func(models.Job) (models.Job, error)
+	_Finish      func(models.Job) (models.Job, error)
+	_Get         func(id int) (models.Job, error)
+	_ListRunning func() ([]models.Job, error)
+	_Latest      func(kind string, resourceID int) (models.Job, error)
+}
+
+func (s FakeJobStore) Create(job models.Job) (models.Job, error) {
+	return s._Create(job)
+}
+
+func (s FakeJobStore) Start(job models.Job) (models.Job, error) {
+	return s._Start(job)
+}
+
+func (s FakeJobStore) Finish(job models.Job) (models.Job, error) {
+	return s._Finish(job)
+}
+
+func (s FakeJobStore) Get(id int) (models.Job, error) {
+	return s._Get(id)
+}
+
+func (s FakeJobStore) ListRunning() ([]models.Job, error) {
+	return s._ListRunning()
+}
+
+func (s FakeJobStore) Latest(kind string, resourceID int) (models.Job, error) {
+	return s._Latest(kind, resourceID)
+}
+
+type FakeImageManifestStore struct {
+	_Create func(models.ImageManifest) (models.ImageManifest, error)
+	_Get    func(imageID int) (models.ImageManifest, error)
+}
+
+func (s FakeImageManifestStore) Create(manifest models.ImageManifest) (models.ImageManifest, error) {
+	return s._Create(manifest)
+}
+
+func (s FakeImageManifestStore) Get(imageID int) (models.ImageManifest, error) {
+	return s._Get(imageID)
+}
+
+type FakeLeaseStore struct {
+	_Acquire       func(models.Lease) (bool, error)
+	_Renew         func(string, time.Time) error
+	_Bind          func(string, string, string, int) error
+	_Release       func(string, string, string) error
+	_List          func(string) ([]models.Lease, error)
+	_DeleteExpired func(time.Time) (int64, error)
+}
+
+func (s FakeLeaseStore) Acquire(lease models.Lease) (bool, error) {
+	return s._Acquire(lease)
+}
+
+func (s FakeLeaseStore) Renew(owner string, expiresAt time.Time) error {
+	return s._Renew(owner, expiresAt)
+}
+
+func (s FakeLeaseStore) Bind(kind, value, owner string, instanceID int) error {
+	return s._Bind(kind, value, owner, instanceID)
+}
+
+func (s FakeLeaseStore) Release(kind, value, owner string) error {
+	return s._Release(kind, value, owner)
+}
+
+func (s FakeLeaseStore) List(kind string) ([]models.Lease, error) {
+	return s._List(kind)
+}
+
+func (s FakeLeaseStore) DeleteExpired(now time.Time) (int64, error) {
+	return s._DeleteExpired(now)
+}
+
+type FakeSchemaStore struct {
+	_AppliedMigrations func() ([]string, error)
+	_Tables            func() ([]models.TableStats, error)
+	_Indexes           func() ([]models.IndexStats, error)
+	_Vacuum            func(string, bool) error
+}
+
+func (s FakeSchemaStore) AppliedMigrations() ([]string, error) {
+	return s._AppliedMigrations()
+}
+
+func (s FakeSchemaStore) Tables() ([]models.TableStats, error) {
+	return s._Tables()
+}
+
+func (s FakeSchemaStore) Indexes() ([]models.IndexStats, error) {
+	return s._Indexes()
+}
+
+func (s FakeSchemaStore) Vacuum(ctx context.Context, table string, analyze bool) error {
+	return s._Vacuum(table, analyze)
+}
+
+type FakeSpanExporter struct {
+	_Export func(models.BakeSpan) error
+}
+
+func (e FakeSpanExporter) Export(ctx context.Context, span models.BakeSpan) error {
+	return e._Export(span)
+}
+
+type FakeIdentityVerifier struct {
+	_Verify func(string) (string, error)
+}
+
+func (v FakeIdentityVerifier) Verify(ctx context.Context, token string) (string, error) {
+	return v._Verify(token)
+}
+
 type FakeExecutor struct {
 	_CreateBtrfsSubvolume        func(ctx context.Context, id int) error
+	_CreateShardUploadSlots      func(ctx context.Context, id int, shards []string) error
+	_CreateWorkerUploadSlots     func(ctx context.Context, id int, workers []string) error
+	_ImageUploadSize             func(ctx context.Context, id int) (int64, error)
+	_AppendImageUpload           func(ctx context.Context, id int, offset int64, r io.Reader) (int64, error)
 	_FinaliseImage               func(ctx context.Context, image models.Image) error
-	_CreateInstance              func(ctx context.Context, imageID int, instanceID int, port int) error
+	_ResetImage                  func(ctx context.Context, id int) error
+	_CreateInstance              func(ctx context.Context, imageID int, instanceID int, port int, address string, schemaOnly bool) error
+	_SnapshotImageBase           func(ctx context.Context, id int) error
+	_HasImageBase                func(ctx context.Context, id int) (bool, error)
+	_CreateStandbyInstance       func(ctx context.Context, imageID int, instanceID int, port int) error
+	_PromoteInstance             func(ctx context.Context, instance models.Instance, anon string) error
+	_RestartInstance             func(ctx context.Context, instance models.Instance) error
+	_RotateInstanceCredentials   func(ctx context.Context, instance models.Instance) error
+	_RunMaintenance              func(ctx context.Context, instance models.Instance, operation exec.MaintenanceOperation) (string, error)
 	_RetrieveInstanceCredentials func(ctx context.Context, id int) (map[string][]byte, error)
 	_DestroyImage                func(ctx context.Context, id int) error
 	_DestroyInstance             func(ctx context.Context, id int) error
+	_RetrieveImageDiskUsage      func(ctx context.Context, id int) (models.DiskUsage, error)
+	_RetrieveInstanceDiskUsage   func(ctx context.Context, id int) (models.DiskUsage, error)
+	_RetrievePoolUsage           func(ctx context.Context) (models.PoolUsage, error)
+	_InspectImageUpload          func(ctx context.Context, id int) (models.ImageInspection, error)
+	_InspectImageSnapshot        func(ctx context.Context, id int) (models.ImageInspection, error)
+	_RetrieveImageSettings       func(ctx context.Context, id int) ([]models.CloneSetting, error)
+	_ReadImageFile               func(ctx context.Context, id int, name string) (models.ImageFile, error)
+	_ReadImageUploadFile         func(ctx context.Context, id int, path string) (models.ImageFile, error)
+	_SendImage                   func(ctx context.Context, id int, parentID int, w io.Writer) error
+	_ReceiveImageStream          func(ctx context.Context, id int, r io.Reader) error
+	_InspectInstanceActivity     func(ctx context.Context, instance models.Instance) (models.InstanceActivity, error)
+	_StreamInstanceLog           func(ctx context.Context, id int, lines int, follow bool, w io.Writer) error
 }
 
 func (e FakeExecutor) CreateBtrfsSubvolume(ctx context.Context, id int) error {
 	return e._CreateBtrfsSubvolume(ctx, id)
 }
 
+func (e FakeExecutor) CreateShardUploadSlots(ctx context.Context, id int, shards []string) error {
+	return e._CreateShardUploadSlots(ctx, id, shards)
+}
+
+func (e FakeExecutor) CreateWorkerUploadSlots(ctx context.Context, id int, workers []string) error {
+	return e._CreateWorkerUploadSlots(ctx, id, workers)
+}
+
+func (e FakeExecutor) ImageUploadSize(ctx context.Context, id int) (int64, error) {
+	return e._ImageUploadSize(ctx, id)
+}
+
+func (e FakeExecutor) AppendImageUpload(ctx context.Context, id int, offset int64, r io.Reader) (int64, error) {
+	return e._AppendImageUpload(ctx, id, offset, r)
+}
+
 func (e FakeExecutor) FinaliseImage(ctx context.Context, image models.Image) error {
 	return e._FinaliseImage(ctx, image)
 }
 
-func (e FakeExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int) error {
-	return e._CreateInstance(ctx, imageID, instanceID, port)
+func (e FakeExecutor) ResetImage(ctx context.Context, id int) error {
+	return e._ResetImage(ctx, id)
+}
+
+func (e FakeExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int, address string, schemaOnly bool) error {
+	return e._CreateInstance(ctx, imageID, instanceID, port, address, schemaOnly)
+}
+
+func (e FakeExecutor) SnapshotImageBase(ctx context.Context, id int) error {
+	return e._SnapshotImageBase(ctx, id)
+}
+
+func (e FakeExecutor) HasImageBase(ctx context.Context, id int) (bool, error) {
+	return e._HasImageBase(ctx, id)
+}
+
+func (e FakeExecutor) CreateStandbyInstance(ctx context.Context, imageID int, instanceID int, port int) error {
+	return e._CreateStandbyInstance(ctx, imageID, instanceID, port)
+}
+
+func (e FakeExecutor) PromoteInstance(ctx context.Context, instance models.Instance, anon string) error {
+	return e._PromoteInstance(ctx, instance, anon)
+}
+
+func (e FakeExecutor) RestartInstance(ctx context.Context, instance models.Instance) error {
+	return e._RestartInstance(ctx, instance)
+}
+
+func (e FakeExecutor) RotateInstanceCredentials(ctx context.Context, instance models.Instance) error {
+	return e._RotateInstanceCredentials(ctx, instance)
+}
+
+func (e FakeExecutor) RunMaintenance(ctx context.Context, instance models.Instance, operation exec.MaintenanceOperation) (string, error) {
+	return e._RunMaintenance(ctx, instance, operation)
 }
 
 func (e FakeExecutor) RetrieveInstanceCredentials(ctx context.Context, id int) (map[string][]byte, error) {
@@ -119,6 +516,54 @@ func (e FakeExecutor) DestroyInstance(ctx context.Context, id int) error {
 	return e._DestroyInstance(ctx, id)
 }
 
+func (e FakeExecutor) RetrieveImageDiskUsage(ctx context.Context, id int) (models.DiskUsage, error) {
+	return e._RetrieveImageDiskUsage(ctx, id)
+}
+
+func (e FakeExecutor) RetrieveInstanceDiskUsage(ctx context.Context, id int) (models.DiskUsage, error) {
+	return e._RetrieveInstanceDiskUsage(ctx, id)
+}
+
+func (e FakeExecutor) RetrievePoolUsage(ctx context.Context) (models.PoolUsage, error) {
+	return e._RetrievePoolUsage(ctx)
+}
+
+func (e FakeExecutor) InspectImageUpload(ctx context.Context, id int) (models.ImageInspection, error) {
+	return e._InspectImageUpload(ctx, id)
+}
+
+func (e FakeExecutor) InspectImageSnapshot(ctx context.Context, id int) (models.ImageInspection, error) {
+	return e._InspectImageSnapshot(ctx, id)
+}
+
+func (e FakeExecutor) RetrieveImageSettings(ctx context.Context, id int) ([]models.CloneSetting, error) {
+	return e._RetrieveImageSettings(ctx, id)
+}
+
+func (e FakeExecutor) ReadImageFile(ctx context.Context, id int, name string) (models.ImageFile, error) {
+	return e._ReadImageFile(ctx, id, name)
+}
+
+func (e FakeExecutor) ReadImageUploadFile(ctx context.Context, id int, path string) (models.ImageFile, error) {
+	return e._ReadImageUploadFile(ctx, id, path)
+}
+
+func (e FakeExecutor) SendImage(ctx context.Context, id int, parentID int, w io.Writer) error {
+	return e._SendImage(ctx, id, parentID, w)
+}
+
+func (e FakeExecutor) ReceiveImageStream(ctx context.Context, id int, r io.Reader) error {
+	return e._ReceiveImageStream(ctx, id, r)
+}
+
+func (e FakeExecutor) InspectInstanceActivity(ctx context.Context, instance models.Instance) (models.InstanceActivity, error) {
+	return e._InspectInstanceActivity(ctx, instance)
+}
+
+func (e FakeExecutor) StreamInstanceLog(ctx context.Context, id int, lines int, follow bool, w io.Writer) error {
+	return e._StreamInstanceLog(ctx, id, lines, follow, w)
+}
+
 type FakeErrorHandler struct {
 	Error error
 }
@@ -0,0 +1,157 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/faults"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// Faults lets operators inject failures into the server, to test how clients
+// cope with it misbehaving. The routes are only served if fault injection is
+// enabled.
+type Faults struct {
+	Injector *faults.Injector
+}
+
+// CreateFaultRequest describes a fault to inject. Duration, e.g. "10m", is how
+// long the fault lasts; it lasts until it's removed if it's empty.
+type CreateFaultRequest struct {
+	Target    string  `jsonapi:"attr,target"`
+	Match     string  `jsonapi:"attr,match"`
+	Method    string  `jsonapi:"attr,method"`
+	ErrorRate float64 `jsonapi:"attr,error_rate"`
+	Status    int     `jsonapi:"attr,status"`
+	Latency   string  `jsonapi:"attr,latency"`
+	Duration  string  `jsonapi:"attr,duration"`
+}
+
+// List returns the faults that are being injected
+func (f Faults) List(w http.ResponseWriter, r *http.Request) error {
+	if !f.authorise(w, r) {
+		return nil
+	}
+
+	list := f.Injector.List()
+
+	// Build a slice of pointers to our faults, because this is what jsonapi wants
+	_faults := make([]*models.Fault, 0, len(list))
+	for i := range list {
+		_faults = append(_faults, &list[i])
+	}
+
+	return errors.Wrap(
+		marshalMany(r, w, _faults),
+		"failed to marshal faults",
+	)
+}
+
+// Create starts injecting a fault
+func (f Faults) Create(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	if !f.authorise(w, r) {
+		return nil
+	}
+
+	req := CreateFaultRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	var duration time.Duration
+	if req.Duration != "" {
+		duration, err = time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			api.InvalidFaultError("duration must be a positive duration, e.g. 10m").Render(w, http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	fault, err := f.Injector.Add(models.Fault{
+		Target:    req.Target,
+		Match:     req.Match,
+		Method:    req.Method,
+		ErrorRate: req.ErrorRate,
+		Status:    req.Status,
+		Latency:   req.Latency,
+	}, duration)
+	if err != nil {
+		api.InvalidFaultError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	logger.With("fault", fault.ID).With("target", fault.Target).With("match", fault.Match).
+		With("error_rate", fault.ErrorRate).With("latency", fault.Latency).Warn("injecting fault")
+
+	w.WriteHeader(http.StatusCreated)
+	return errors.Wrap(
+		marshalOne(r, w, &fault),
+		"failed to marshal fault",
+	)
+}
+
+// Destroy stops injecting a fault
+func (f Faults) Destroy(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	if !f.authorise(w, r) {
+		return nil
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || !f.Injector.Remove(id) {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	logger.With("fault", id).Info("removed fault")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Clear stops injecting every fault
+func (f Faults) Clear(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	if !f.authorise(w, r) {
+		return nil
+	}
+
+	f.Injector.Clear()
+
+	logger.Info("removed all faults")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// authorise renders an error unless the request was made by the upload user,
+// returning whether it was
+func (f Faults) authorise(w http.ResponseWriter, r *http.Request) bool {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil || !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return false
+	}
+	return true
+}
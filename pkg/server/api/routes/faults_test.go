@@ -0,0 +1,102 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/faults"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+func faultRequest(t *testing.T, method, path, body, user string) (*http.Request, *httptest.ResponseRecorder) {
+	req, recorder, _ := createRequest(t, method, path, bytes.NewBufferString(body))
+	return req.WithContext(context.WithValue(req.Context(), middleware.AuthUserKey, user)), recorder
+}
+
+func TestFaultsCreate(t *testing.T) {
+	req, recorder := faultRequest(t, "POST", "/admin/faults", `{"data": {"type": "faults", "attributes": {
+		"target": "route",
+		"match": "/instances",
+		"method": "POST",
+		"error_rate": 0.25,
+		"latency": "2s",
+		"duration": "10m"
+	}}}`, auth.UPLOAD_USER_EMAIL)
+
+	injector := faults.NewInjector()
+	routeSet := Faults{Injector: injector}
+
+	err := routeSet.Create(recorder, req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, "1", response.Data.ID)
+	assert.Equal(t, 0.25, response.Data.Attributes["error_rate"])
+	assert.Equal(t, float64(503), response.Data.Attributes["status"])
+	assert.NotNil(t, response.Data.Attributes["expires_at"])
+
+	assert.Len(t, injector.List(), 1)
+}
+
+func TestFaultsCreateInvalid(t *testing.T) {
+	req, recorder := faultRequest(t, "POST", "/admin/faults", `{"data": {"type": "faults", "attributes": {
+		"target": "route",
+		"match": "*",
+		"error_rate": 2
+	}}}`, auth.UPLOAD_USER_EMAIL)
+
+	err := Faults{Injector: faults.NewInjector()}.Create(recorder, req)
+	assert.Nil(t, err)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.InvalidFaultError("error_rate must be between 0 and 1"), response)
+}
+
+func TestFaultsForbidden(t *testing.T) {
+	req, recorder := faultRequest(t, "GET", "/admin/faults", "", "test@draupnir")
+
+	err := Faults{Injector: faults.NewInjector()}.List(recorder, req)
+	assert.Nil(t, err)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, api.ForbiddenError, response)
+}
+
+func TestFaultsDestroy(t *testing.T) {
+	injector := faults.NewInjector()
+	fault, err := injector.Add(models.Fault{Target: models.FaultExecutor, Match: "*", ErrorRate: 1}, 0)
+	assert.Nil(t, err)
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Faults{Injector: injector}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/faults/{id}", errorHandler.Handle(routeSet.Destroy))
+
+	req, recorder := faultRequest(t, "DELETE", "/admin/faults/1", "", auth.UPLOAD_USER_EMAIL)
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Empty(t, injector.List())
+
+	// It's already been removed
+	req, recorder = faultRequest(t, "DELETE", "/admin/faults/1", "", auth.UPLOAD_USER_EMAIL)
+	router.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, 1, fault.ID)
+	assert.Nil(t, errorHandler.Error)
+}
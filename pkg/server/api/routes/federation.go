@@ -0,0 +1,30 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// Federation lists the servers that accept the same credentials as this one,
+// so that clients can be configured for all of them from any one of them
+type Federation struct {
+	Servers []models.FederatedServer
+}
+
+// List returns every federated server. It doesn't require authentication, as
+// clients use it to discover servers before they've authenticated with them.
+func (f Federation) List(w http.ResponseWriter, r *http.Request) error {
+	// Build a slice of pointers to our servers, because this is what jsonapi wants
+	servers := make([]*models.FederatedServer, 0)
+	for i := range f.Servers {
+		servers = append(servers, &f.Servers[i])
+	}
+
+	return errors.Wrap(
+		marshalMany(r, w, servers),
+		"failed to marshal federated servers",
+	)
+}
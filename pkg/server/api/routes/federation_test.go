@@ -0,0 +1,46 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestFederationList(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/federation", nil)
+
+	routeSet := Federation{
+		Servers: []models.FederatedServer{
+			{Name: "staging", Domain: "draupnir-staging.example.com"},
+			{Name: "production", Domain: "infra.example.com/draupnir"},
+		},
+	}
+	err := routeSet.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Len(t, response.Data, 2)
+	assert.Equal(t, "federated_servers", response.Data[0].Type)
+	assert.Equal(t, "staging", response.Data[0].ID)
+	assert.Equal(t, "infra.example.com/draupnir", response.Data[1].Attributes["domain"])
+}
+
+func TestFederationListWhenNotFederated(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/federation", nil)
+
+	err := Federation{}.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Empty(t, response.Data)
+}
@@ -0,0 +1,166 @@
+package routes
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// filterParamPattern matches JSON:API filter query parameters, e.g.
+// filter[ready]
+var filterParamPattern = regexp.MustCompile(`^filter\[(.+)\]$`)
+
+// labelFilterPrefix prefixes the keys of label filters, e.g. filter[labels.team]
+const labelFilterPrefix = "labels."
+
+// parseFilters extracts the filter[...] query parameters, rejecting any that
+// aren't in allowed. Allowed names that end in "." allow any name that starts
+// with them. Returning an unfiltered list for a filter that we don't understand
+// would be worse than returning an error.
+func parseFilters(query url.Values, allowed ...string) (map[string]string, error) {
+	filters := make(map[string]string)
+
+	for param, values := range query {
+		match := filterParamPattern.FindStringSubmatch(param)
+		if match == nil {
+			continue
+		}
+
+		name := match[1]
+		if !containsFilter(allowed, name) {
+			return nil, fmt.Errorf("unknown filter: %s", name)
+		}
+		filters[name] = values[0]
+	}
+
+	return filters, nil
+}
+
+func containsFilter(allowed []string, name string) bool {
+	for _, a := range allowed {
+		if strings.HasSuffix(a, ".") {
+			if strings.HasPrefix(name, a) && name != a {
+				return true
+			}
+		} else if a == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLabelFilters returns the labels selected by filter[labels.KEY], keyed by
+// KEY
+func parseLabelFilters(filters map[string]string) map[string]string {
+	var labels map[string]string
+	for name, value := range filters {
+		if !strings.HasPrefix(name, labelFilterPrefix) {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[strings.TrimPrefix(name, labelFilterPrefix)] = value
+	}
+	return labels
+}
+
+// parseImageFilter selects images with filter[ready], and by their labels with
+// filter[labels.KEY]
+func parseImageFilter(query url.Values) (store.ImageFilter, error) {
+	var filter store.ImageFilter
+
+	filters, err := parseFilters(query, "ready", labelFilterPrefix)
+	if err != nil {
+		return filter, err
+	}
+	filter.Labels = parseLabelFilters(filters)
+
+	if value, ok := filters["ready"]; ok {
+		ready, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("filter[ready] must be true or false")
+		}
+		filter.Ready = &ready
+	}
+
+	return filter, nil
+}
+
+// parseInstanceFilter selects instances with filter[image_id], filter[user],
+// filter[static] and filter[labels.KEY]. The user may be given as "me", meaning
+// the authenticated user, who is also selected if no user is given, unless
+// static instances, which are shared, are selected. Instances can also be
+// selected by status, with a comma separated list of statuses in the status
+// parameter.
+func parseInstanceFilter(query url.Values, email string) (store.InstanceFilter, error) {
+	filter := store.InstanceFilter{UserEmail: email}
+
+	filters, err := parseFilters(query, "image_id", "user", "static", labelFilterPrefix)
+	if err != nil {
+		return filter, err
+	}
+	filter.Labels = parseLabelFilters(filters)
+
+	if value, ok := filters["image_id"]; ok {
+		filter.ImageID, err = strconv.Atoi(value)
+		if err != nil {
+			return filter, fmt.Errorf("filter[image_id] must be an integer")
+		}
+	}
+
+	if value, ok := filters["static"]; ok {
+		filter.Static, err = strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("filter[static] must be true or false")
+		}
+		if filter.Static {
+			filter.UserEmail = ""
+		}
+	}
+
+	if user := filters["user"]; user == "me" {
+		filter.UserEmail = email
+	} else if user != "" {
+		filter.UserEmail = user
+	}
+
+	if value := query.Get("status"); value != "" {
+		for _, status := range strings.Split(value, ",") {
+			if !models.ContainsString(models.InstanceStatuses, status) {
+				return filter, fmt.Errorf("unknown status: %s", status)
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+
+	return filter, nil
+}
+
+// parseSort extracts the JSON:API sort query parameter, a comma separated list
+// of fields that are each prefixed with - to sort in descending order, e.g.
+// sort=-created_at,id. Fields that aren't in allowed are rejected.
+func parseSort(query url.Values, allowed []string) (store.Sort, error) {
+	var sort store.Sort
+
+	value := query.Get("sort")
+	if value == "" {
+		return sort, nil
+	}
+
+	for _, field := range strings.Split(value, ",") {
+		descending := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		if !models.ContainsString(allowed, field) {
+			return nil, fmt.Errorf("cannot sort by %s, only by %s", field, strings.Join(allowed, ", "))
+		}
+		sort = append(sort, store.SortField{Field: field, Descending: descending})
+	}
+
+	return sort, nil
+}
@@ -0,0 +1,125 @@
+package routes
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+func TestImageFilter(t *testing.T) {
+	ready, unready := true, false
+
+	testCases := []struct {
+		name          string
+		query         string
+		expected      store.ImageFilter
+		expectedError string
+	}{
+		{"no filter", "", store.ImageFilter{}, ""},
+		{"only ready images", "filter[ready]=true", store.ImageFilter{Ready: &ready}, ""},
+		{"only unready images", "filter[ready]=false", store.ImageFilter{Ready: &unready}, ""},
+		{"pagination isn't a filter", "page[size]=10", store.ImageFilter{}, ""},
+		{"invalid value", "filter[ready]=yes", store.ImageFilter{}, "filter[ready] must be true or false"},
+		{"unknown filter", "filter[user]=me", store.ImageFilter{}, "unknown filter: user"},
+		{
+			"labels", "filter[labels.cluster]=payments-eu&filter[labels.anon_version]=3&filter[ready]=true",
+			store.ImageFilter{Ready: &ready, Labels: map[string]string{"cluster": "payments-eu", "anon_version": "3"}}, "",
+		},
+		{"empty label value", "filter[labels.cluster]=", store.ImageFilter{Labels: map[string]string{"cluster": ""}}, ""},
+		{"label without key", "filter[labels.]=payments", store.ImageFilter{}, "unknown filter: labels."},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			assert.Nil(t, err)
+
+			filter, err := parseImageFilter(query)
+
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expected, filter)
+			}
+		})
+	}
+}
+
+func TestInstanceFilter(t *testing.T) {
+	testCases := []struct {
+		name          string
+		query         string
+		expected      store.InstanceFilter
+		expectedError string
+	}{
+		{"no filter", "", store.InstanceFilter{UserEmail: "test@draupnir"}, ""},
+		{"image", "filter[image_id]=4", store.InstanceFilter{UserEmail: "test@draupnir", ImageID: 4}, ""},
+		{"me", "filter[user]=me&filter[image_id]=4", store.InstanceFilter{UserEmail: "test@draupnir", ImageID: 4}, ""},
+		{"user by email", "filter[user]=test@draupnir", store.InstanceFilter{UserEmail: "test@draupnir"}, ""},
+		{"other user", "filter[user]=other@draupnir", store.InstanceFilter{UserEmail: "other@draupnir"}, ""},
+		{"invalid image ID", "filter[image_id]=four", store.InstanceFilter{}, "filter[image_id] must be an integer"},
+		{"unknown filter", "filter[ready]=true", store.InstanceFilter{}, "unknown filter: ready"},
+		{"status", "status=running", store.InstanceFilter{UserEmail: "test@draupnir", Statuses: []string{"running"}}, ""},
+		{"statuses", "status=standby,running", store.InstanceFilter{UserEmail: "test@draupnir", Statuses: []string{"standby", "running"}}, ""},
+		{"unknown status", "status=stopped", store.InstanceFilter{}, "unknown status: stopped"},
+		{"labels", "filter[labels.team]=payments", store.InstanceFilter{UserEmail: "test@draupnir", Labels: map[string]string{"team": "payments"}}, ""},
+		{"static", "filter[static]=true", store.InstanceFilter{Static: true}, ""},
+		{"my static", "filter[static]=true&filter[user]=me", store.InstanceFilter{UserEmail: "test@draupnir", Static: true}, ""},
+		{"not static", "filter[static]=false", store.InstanceFilter{UserEmail: "test@draupnir"}, ""},
+		{"invalid static", "filter[static]=yes", store.InstanceFilter{}, "filter[static] must be true or false"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			assert.Nil(t, err)
+
+			filter, err := parseInstanceFilter(query, "test@draupnir")
+
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expected, filter)
+			}
+		})
+	}
+}
+
+func TestSort(t *testing.T) {
+	testCases := []struct {
+		name          string
+		query         string
+		expected      store.Sort
+		expectedError string
+	}{
+		{"no sort", "", nil, ""},
+		{"ascending", "sort=created_at", store.Sort{{Field: "created_at"}}, ""},
+		{"descending", "sort=-created_at", store.Sort{{Field: "created_at", Descending: true}}, ""},
+		{
+			"several fields", "sort=-expires_at,id",
+			store.Sort{{Field: "expires_at", Descending: true}, {Field: "id"}}, "",
+		},
+		{"unknown field", "sort=hostname", nil, "cannot sort by hostname, only by id, image_id, created_at, updated_at, expires_at"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			assert.Nil(t, err)
+
+			sort, err := parseSort(query, store.InstanceSortFields)
+
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tc.expected, sort)
+			}
+		})
+	}
+}
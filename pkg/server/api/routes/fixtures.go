@@ -8,10 +8,21 @@ var listImagesFixture = jsonapi.ManyPayload{
 			Type: "images",
 			ID:   "1",
 			Attributes: map[string]interface{}{
-				"backed_up_at": "2016-01-01T12:33:44Z",
-				"created_at":   "2016-01-01T12:33:44Z",
-				"ready":        false,
-				"updated_at":   "2016-01-01T12:33:44Z",
+				"backed_up_at":      "2016-01-01T12:33:44Z",
+				"created_at":        "2016-01-01T12:33:44Z",
+				"ready":             false,
+				"annotations":       nil,
+				"labels":            nil,
+				"shards":            nil,
+				"backup_checksum":   "",
+				"backup_lsn":        "",
+				"snapshot_checksum": "",
+				"drop_databases":    nil,
+				"rename_databases":  nil,
+				"workers":           nil,
+				"encoding":          "",
+				"locale":            "",
+				"updated_at":        "2016-01-01T12:33:44Z",
 			},
 		},
 	},
@@ -22,23 +33,48 @@ var createImageFixture = jsonapi.OnePayload{
 		Type: "images",
 		ID:   "1",
 		Attributes: map[string]interface{}{
-			"backed_up_at": "2016-01-01T12:33:44Z",
-			"created_at":   "2016-01-01T12:33:44Z",
-			"ready":        false,
-			"updated_at":   "2016-01-01T12:33:44Z",
+			"backed_up_at":      "2016-01-01T12:33:44Z",
+			"created_at":        "2016-01-01T12:33:44Z",
+			"ready":             false,
+			"annotations":       nil,
+			"labels":            nil,
+			"shards":            nil,
+			"backup_checksum":   "",
+			"backup_lsn":        "",
+			"snapshot_checksum": "",
+			"drop_databases":    nil,
+			"rename_databases":  nil,
+			"workers":           nil,
+			"encoding":          "",
+			"locale":            "",
+			"updated_at":        "2016-01-01T12:33:44Z",
 		},
 	},
 }
 
+// emptyChecksum is the SHA-256 of nothing, used as the checksum of images
+const emptyChecksum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
 var doneImageFixture = jsonapi.OnePayload{
 	Data: &jsonapi.Node{
 		Type: "images",
 		ID:   "1",
 		Attributes: map[string]interface{}{
-			"backed_up_at": "2016-01-01T12:33:44Z",
-			"created_at":   "2016-01-01T12:33:44Z",
-			"ready":        true,
-			"updated_at":   "2016-01-01T12:33:44Z",
+			"backed_up_at":      "2016-01-01T12:33:44Z",
+			"created_at":        "2016-01-01T12:33:44Z",
+			"ready":             true,
+			"annotations":       nil,
+			"labels":            nil,
+			"shards":            nil,
+			"backup_checksum":   "",
+			"backup_lsn":        "",
+			"snapshot_checksum": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+			"drop_databases":    nil,
+			"rename_databases":  nil,
+			"workers":           nil,
+			"encoding":          "",
+			"locale":            "",
+			"updated_at":        "2016-01-01T12:33:44Z",
 		},
 	},
 }
@@ -48,10 +84,50 @@ var getImageFixture = jsonapi.OnePayload{
 		Type: "images",
 		ID:   "1",
 		Attributes: map[string]interface{}{
-			"backed_up_at": "2016-01-01T12:33:44Z",
-			"created_at":   "2016-01-01T12:33:44Z",
-			"ready":        false,
-			"updated_at":   "2016-01-01T12:33:44Z",
+			"backed_up_at":      "2016-01-01T12:33:44Z",
+			"created_at":        "2016-01-01T12:33:44Z",
+			"ready":             false,
+			"annotations":       nil,
+			"labels":            nil,
+			"shards":            nil,
+			"backup_checksum":   "",
+			"backup_lsn":        "",
+			"snapshot_checksum": "",
+			"drop_databases":    nil,
+			"rename_databases":  nil,
+			"workers":           nil,
+			"encoding":          "",
+			"locale":            "",
+			"updated_at":        "2016-01-01T12:33:44Z",
+		},
+	},
+}
+
+var imageTimelineFixture = jsonapi.ManyPayload{
+	Data: []*jsonapi.Node{
+		{
+			Type: "bake_spans",
+			ID:   "1",
+			Attributes: map[string]interface{}{
+				"image_id":    float64(1),
+				"phase":       "finalise",
+				"started_at":  "2016-01-01T12:33:44Z",
+				"finished_at": "2016-01-01T13:33:44Z",
+				"error":       "",
+				"error_class": "",
+			},
+		},
+		{
+			Type: "bake_spans",
+			ID:   "2",
+			Attributes: map[string]interface{}{
+				"image_id":    float64(1),
+				"phase":       "inspect_snapshot",
+				"started_at":  "2016-01-01T13:33:44Z",
+				"finished_at": nil,
+				"error":       "",
+				"error_class": "",
+			},
 		},
 	},
 }
@@ -61,11 +137,21 @@ var createInstanceFixture = jsonapi.OnePayload{
 		Type: "instances",
 		ID:   "1",
 		Attributes: map[string]interface{}{
-			"image_id":   float64(1),
-			"hostname":   "draupnir-server.example.com",
-			"created_at": "2016-01-01T12:33:44Z",
-			"updated_at": "2016-01-01T12:33:44Z",
-			"port":       float64(0),
+			"image_id":       float64(1),
+			"hostname":       "draupnir-server.example.com",
+			"created_at":     "2016-01-01T12:33:44Z",
+			"updated_at":     "2016-01-01T12:33:44Z",
+			"port":           float64(0),
+			"address":        "",
+			"annotations":    nil,
+			"labels":         nil,
+			"shard_dsns":     nil,
+			"standby":        false,
+			"schema_only":    false,
+			"static_name":    "",
+			"proxy_required": false,
+			"expires_at":     nil,
+			"status":         "running",
 		},
 		Relationships: relationshipsFixture,
 	},
@@ -78,11 +164,21 @@ var listInstancesFixture = jsonapi.ManyPayload{
 			Type: "instances",
 			ID:   "1",
 			Attributes: map[string]interface{}{
-				"image_id":   float64(1),
-				"hostname":   "draupnir-server.example.com",
-				"created_at": "2016-01-01T12:33:44Z",
-				"port":       float64(5432),
-				"updated_at": "2016-01-01T12:33:44Z",
+				"image_id":       float64(1),
+				"hostname":       "draupnir-server.example.com",
+				"created_at":     "2016-01-01T12:33:44Z",
+				"port":           float64(5432),
+				"address":        "",
+				"annotations":    nil,
+				"labels":         nil,
+				"shard_dsns":     nil,
+				"standby":        false,
+				"schema_only":    false,
+				"static_name":    "",
+				"proxy_required": false,
+				"expires_at":     nil,
+				"status":         "running",
+				"updated_at":     "2016-01-01T12:33:44Z",
 			},
 		},
 	},
@@ -93,11 +189,21 @@ var getInstanceFixture = jsonapi.OnePayload{
 		Type: "instances",
 		ID:   "1",
 		Attributes: map[string]interface{}{
-			"image_id":   float64(1),
-			"hostname":   "draupnir-server.example.com",
-			"created_at": "2016-01-01T12:33:44Z",
-			"port":       float64(5432),
-			"updated_at": "2016-01-01T12:33:44Z",
+			"image_id":       float64(1),
+			"hostname":       "draupnir-server.example.com",
+			"created_at":     "2016-01-01T12:33:44Z",
+			"port":           float64(5432),
+			"address":        "",
+			"annotations":    nil,
+			"labels":         nil,
+			"shard_dsns":     nil,
+			"standby":        false,
+			"schema_only":    false,
+			"static_name":    "",
+			"proxy_required": false,
+			"expires_at":     nil,
+			"status":         "running",
+			"updated_at":     "2016-01-01T12:33:44Z",
 		},
 		Relationships: relationshipsFixture,
 	},
@@ -122,3 +228,30 @@ var relationshipsFixture = map[string]interface{}{
 		},
 	},
 }
+
+var instanceStorageReportFixture = jsonapi.OnePayload{
+	Data: &jsonapi.Node{
+		Type: "instance_storage_reports",
+		ID:   "1",
+		Attributes: map[string]interface{}{
+			"image_id":        float64(1),
+			"total_bytes":     float64(4096),
+			"exclusive_bytes": float64(1024),
+			"shared_bytes":    float64(3072),
+			"divergence":      float64(0.25),
+		},
+	},
+}
+
+var imageStorageReportFixture = jsonapi.OnePayload{
+	Data: &jsonapi.Node{
+		Type: "image_storage_reports",
+		ID:   "1",
+		Attributes: map[string]interface{}{
+			"image_bytes":              float64(4096),
+			"instance_count":           float64(2),
+			"instance_exclusive_bytes": float64(3072),
+			"max_divergence":           float64(0.5),
+		},
+	},
+}
@@ -0,0 +1,40 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// Freshness reports whether each image family meets its freshness SLA
+type Freshness struct {
+	ImageStore store.ImageStore
+	SLAs       []freshness.SLA
+}
+
+// List returns the current status of every configured SLA. It's evaluated
+// afresh from the images, so it doesn't lag behind the monitor's checks.
+func (f Freshness) List(w http.ResponseWriter, r *http.Request) error {
+	images, err := f.ImageStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list images")
+	}
+
+	statuses := freshness.Evaluate(f.SLAs, images, time.Now())
+
+	// Build a slice of pointers to our statuses, because this is what jsonapi wants
+	_statuses := make([]*models.FreshnessStatus, 0)
+	for i := range statuses {
+		_statuses = append(_statuses, &statuses[i])
+	}
+
+	return errors.Wrap(
+		marshalMany(r, w, _statuses),
+		"failed to marshal freshness statuses",
+	)
+}
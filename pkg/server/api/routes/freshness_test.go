@@ -0,0 +1,64 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestFreshnessList(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/freshness", nil)
+
+	routeSet := Freshness{
+		ImageStore: FakeImageStore{
+			_List: func() ([]models.Image, error) {
+				return []models.Image{
+					{ID: 1, Ready: true, BackedUpAt: time.Now().Add(-48 * time.Hour)},
+					{ID: 2, Ready: true, BackedUpAt: time.Now().Add(-time.Hour), Annotations: models.Annotations{"draupnir/family": "analytics"}},
+				}, nil
+			},
+		},
+		SLAs: []freshness.SLA{
+			{Family: "default", MaxAge: 36 * time.Hour},
+			{Family: "analytics", MaxAge: 36 * time.Hour},
+		},
+	}
+	err := routeSet.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Len(t, response.Data, 2)
+	assert.Equal(t, "freshness_statuses", response.Data[0].Type)
+	assert.Equal(t, "default", response.Data[0].ID)
+	assert.Equal(t, false, response.Data[0].Attributes["met"])
+	assert.Equal(t, float64(1), response.Data[0].Attributes["latest_image_id"])
+	assert.Equal(t, "analytics", response.Data[1].ID)
+	assert.Equal(t, true, response.Data[1].Attributes["met"])
+}
+
+func TestFreshnessListWithoutSLAs(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/freshness", nil)
+
+	routeSet := Freshness{
+		ImageStore: FakeImageStore{
+			_List: func() ([]models.Image, error) { return []models.Image{}, nil },
+		},
+	}
+	err := routeSet.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Empty(t, response.Data)
+}
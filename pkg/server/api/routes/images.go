@@ -1,27 +1,124 @@
 package routes
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/gocardless/draupnir/pkg/canary"
+	"github.com/gocardless/draupnir/pkg/events"
 	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/guardrail"
+	"github.com/gocardless/draupnir/pkg/jobs"
+	"github.com/gocardless/draupnir/pkg/manifest"
 	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/reclaim"
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
 	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/gocardless/draupnir/pkg/tracing"
+	"github.com/gocardless/draupnir/pkg/version"
 	"github.com/google/jsonapi"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
 )
 
+// The outcomes of finalising an image, used to label the
+// imageFinalisationDuration metric
+const (
+	imageFinalisationSucceeded = "succeeded"
+	imageFinalisationFailed    = "failed"
+)
+
+var imageFinalisationDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "draupnir_image_finalisation_duration_seconds",
+		Help:    "Time taken to finalise images, from the end of their upload until they're ready, by outcome",
+		Buckets: []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200},
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(imageFinalisationDuration)
+}
+
 type Images struct {
 	ImageStore    store.ImageStore
 	InstanceStore store.InstanceStore
 	Executor      exec.Executor
+	// StandbyEnabled causes the base backup of each unsharded image to be
+	// preserved before it is finalised, so that standby instances can replay
+	// WAL onto it
+	StandbyEnabled bool
+	// BakeSpanStore records the phases of each image's finalisation, which can
+	// take hours for large images
+	BakeSpanStore store.BakeSpanStore
+	// SpanExporter, if set, also sends each finished phase to a tracing system
+	SpanExporter tracing.Exporter
+	// JobStore records finalisations and destroys while they run, so that they
+	// can be recovered if the server dies part way through them
+	JobStore store.JobStore
+	// Workers run finalisations and destroys that are requested with Prefer:
+	// respond-async in the background
+	Workers *jobs.Workers
+	// Events is sent every change to an image, and to the instances destroyed
+	// along with it
+	Events *events.Broker
+	// ManifestSigner, if set, signs a manifest for each image as it is
+	// finalised, which is stored in ManifestStore
+	ManifestSigner *manifest.Signer
+	ManifestStore  store.ImageManifestStore
+	// Guardrail, if enabled, scans each image's settings for references to
+	// production once it's finalised, before it's marked as ready
+	Guardrail guardrail.Scanner
+	// Canary causes each image to be marked as pending a canary once it's ready,
+	// which a canary.Runner then runs
+	Canary bool
+	// Quota limits the images that each uploader can create
+	Quota ImageQuota
+}
+
+// ImageQuota limits the images that each uploader can create, so that a
+// misconfigured backup pipeline can't fill the pool with half-uploaded images.
+// The zero value doesn't limit them.
+type ImageQuota struct {
+	// MaxInProgress is the number of images that aren't ready yet that each
+	// uploader can have, or zero for no limit
+	MaxInProgress int
+	// Cooldown is how long each uploader must wait between creating images
+	Cooldown time.Duration
+}
+
+// usage returns how many of the uploader's images aren't ready, and how long
+// remains of their cooldown
+func (q ImageQuota) usage(images []models.Image, uploader string, now time.Time) (int, time.Duration) {
+	inProgress := 0
+	var wait time.Duration
+	for _, image := range images {
+		if image.Uploader != uploader {
+			continue
+		}
+		if !image.Ready {
+			inProgress++
+		}
+		if remaining := image.CreatedAt.Add(q.Cooldown).Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+	return inProgress, wait
 }
 
 func (i Images) Get(w http.ResponseWriter, r *http.Request) error {
@@ -44,7 +141,9 @@ func (i Images) Get(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	err = jsonapi.MarshalOnePayload(w, &image)
+	err = writeCacheable(w, r, image.UpdatedAt, func(body io.Writer) error {
+		return marshalOne(r, body, &image)
+	})
 	if err != nil {
 		return errors.Wrap(err, "failed to marshal payload")
 	}
@@ -53,19 +152,39 @@ func (i Images) Get(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (i Images) List(w http.ResponseWriter, r *http.Request) error {
-	images, err := i.ImageStore.List()
+	filter, err := parseImageFilter(r.URL.Query())
+	if err != nil {
+		api.InvalidFilterError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	sort, err := parseSort(r.URL.Query(), store.ImageSortFields)
+	if err != nil {
+		api.InvalidSortError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	page, err := parseOptionalPage(r.URL.Query())
+	if err != nil {
+		api.InvalidPaginationError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	images, more, err := i.ImageStore.ListPage(filter, sort, page)
 	if err != nil {
 		return errors.Wrap(err, "failed to get images")
 	}
 
 	// Build a slice of pointers to our images, because this is what jsonapi wants
-	_images := make([]*models.Image, 0)
+	_images := make([]*models.Image, 0, len(images))
 	for i := range images {
 		_images = append(_images, &images[i])
 	}
 
 	return errors.Wrap(
-		jsonapi.MarshalManyPayload(w, _images),
+		writeCacheable(w, r, latestImageUpdate(_images), func(body io.Writer) error {
+			return marshalPage(r, body, _images, paginationLinks(r, page, more))
+		}),
 		"failed to marshal images",
 	)
 }
@@ -73,6 +192,171 @@ func (i Images) List(w http.ResponseWriter, r *http.Request) error {
 type CreateImageRequest struct {
 	BackedUpAt time.Time `jsonapi:"attr,backed_up_at,iso8601"`
 	Anon       string    `jsonapi:"attr,anonymisation_script"`
+	// Shards, if provided, are the names of the source databases that make up
+	// the image. An upload slot is created for each of them.
+	Shards []string `jsonapi:"attr,shards"`
+	// Workers, if provided, make the image a distributed cluster, mapping the
+	// name of each worker to the host:port that the coordinator knows it by. An
+	// upload slot is created for each of them.
+	Workers models.WorkerNodes `jsonapi:"attr,workers"`
+	// BackupChecksum and BackupLSN, if provided, describe the source's base
+	// backup. The upload is checked against them before the image is finalised.
+	BackupChecksum string `jsonapi:"attr,backup_checksum"`
+	BackupLSN      string `jsonapi:"attr,backup_lsn"`
+	// DropDatabases, RenameDatabases, Encoding and Locale adjust the databases
+	// in the image when it is finalised, so that irrelevant databases don't take
+	// up space and every database has the settings that developers expect
+	DropDatabases   []string               `jsonapi:"attr,drop_databases"`
+	RenameDatabases models.DatabaseRenames `jsonapi:"attr,rename_databases"`
+	Encoding        string                 `jsonapi:"attr,encoding"`
+	Locale          string                 `jsonapi:"attr,locale"`
+}
+
+var (
+	// checksumPattern matches a hex encoded SHA-256
+	checksumPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	// lsnPattern matches a Postgres LSN, as it appears in a backup_label
+	lsnPattern = regexp.MustCompile(`^[0-9A-F]{1,8}/[0-9A-F]{1,8}$`)
+	// databaseNamePattern matches database names that can be safely quoted in
+	// the finalisation script
+	databaseNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_$-]{0,62}$`)
+	encodingPattern     = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	localePattern       = regexp.MustCompile(`^[A-Za-z0-9_.@-]+$`)
+)
+
+// validateFinaliseOptions checks that the databases to drop and rename have
+// valid names, that no database is both dropped and renamed or renamed onto
+// another, and that the encoding and locale look like valid settings
+func validateFinaliseOptions(req CreateImageRequest) error {
+	isReserved := func(name string) bool {
+		switch name {
+		case "postgres", "template0", "template1":
+			return true
+		}
+		return false
+	}
+
+	dropped := make(map[string]bool)
+	for _, name := range req.DropDatabases {
+		if !databaseNamePattern.MatchString(name) || isReserved(name) {
+			return fmt.Errorf("can't drop database %q", name)
+		}
+		dropped[name] = true
+	}
+
+	targets := make(map[string]bool)
+	for from, value := range req.RenameDatabases {
+		to, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("the new name of database %q must be a string", from)
+		}
+
+		for _, name := range []string{from, to} {
+			if !databaseNamePattern.MatchString(name) || isReserved(name) {
+				return fmt.Errorf("can't rename database %q to %q", from, to)
+			}
+		}
+
+		if dropped[from] || dropped[to] || targets[to] {
+			return fmt.Errorf("database %q can't be renamed to %q, as it conflicts with another drop or rename", from, to)
+		}
+		if _, ok := req.RenameDatabases[to]; ok {
+			return fmt.Errorf("database %q can't be renamed to %q, as that database is also renamed", from, to)
+		}
+		targets[to] = true
+	}
+
+	if req.Encoding != "" && !encodingPattern.MatchString(req.Encoding) {
+		return fmt.Errorf("invalid encoding: %q", req.Encoding)
+	}
+
+	if req.Locale != "" && !localePattern.MatchString(req.Locale) {
+		return fmt.Errorf("invalid locale: %q", req.Locale)
+	}
+
+	return nil
+}
+
+// shardNamePattern matches names that are safe to use both as a database name
+// and as a directory name in the upload subvolume
+var shardNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+func validShards(shards []string) bool {
+	seen := make(map[string]bool)
+	for _, shard := range shards {
+		if !shardNamePattern.MatchString(shard) || seen[shard] {
+			return false
+		}
+		switch shard {
+		case "postgres", "template0", "template1":
+			return false
+		}
+		seen[shard] = true
+	}
+	return true
+}
+
+// workerHostPattern matches the hosts that workers can be known by in the
+// coordinator's pg_dist_node, which are interpolated into the finalisation
+// script
+var workerHostPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.-]{0,252}$`)
+
+// validateWorkers checks that each worker of a distributed image has a name
+// that's safe to use as a directory name, and a distinct host:port. The
+// workers must all be finalised in the same way as the coordinator, so
+// distributed images can't be sharded, checked against a single base backup,
+// or have their databases dropped, renamed or converted.
+func validateWorkers(req CreateImageRequest) error {
+	if len(req.Workers) == 0 {
+		return nil
+	}
+
+	addresses := make(map[string]bool)
+	for name, value := range req.Workers {
+		if !shardNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid worker name: %q", name)
+		}
+
+		address, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("the address of worker %q must be a string", name)
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || !workerHostPattern.MatchString(host) {
+			return fmt.Errorf("the address of worker %q must be a host:port", name)
+		}
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return fmt.Errorf("the address of worker %q must be a host:port", name)
+		}
+		if addresses[address] {
+			return fmt.Errorf("workers can't share the address %q", address)
+		}
+		addresses[address] = true
+	}
+
+	switch {
+	case len(req.Shards) > 0:
+		return errors.New("distributed images can't be sharded")
+	case req.BackupChecksum != "" || req.BackupLSN != "":
+		return errors.New("distributed images can't be checked against a base backup")
+	case len(req.DropDatabases) > 0 || len(req.RenameDatabases) > 0 || req.Encoding != "" || req.Locale != "":
+		return errors.New("the databases of distributed images can't be dropped, renamed or converted")
+	}
+	return nil
+}
+
+// matchesBackup returns true if the upload matches the checksum and LSN of the
+// base backup that were given when the image was created, if any
+func matchesBackup(image models.Image, upload models.ImageInspection) bool {
+	if image.BackupChecksum != "" && image.BackupChecksum != upload.Checksum {
+		return false
+	}
+
+	if image.BackupLSN != "" && image.BackupLSN != upload.StartLSN {
+		return false
+	}
+
+	return true
 }
 
 func (i Images) Create(w http.ResponseWriter, r *http.Request) error {
@@ -81,6 +365,11 @@ func (i Images) Create(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	uploader, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
 	req := CreateImageRequest{}
 	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
 		logger.Info(err.Error())
@@ -88,7 +377,78 @@ func (i Images) Create(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	image := models.NewImage(req.BackedUpAt, req.Anon)
+	if !validShards(req.Shards) {
+		logger.With("shards", req.Shards).Info("invalid shard names")
+		api.InvalidShardsError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	req.BackupChecksum = strings.ToLower(req.BackupChecksum)
+	req.BackupLSN = strings.ToUpper(req.BackupLSN)
+
+	if req.BackupChecksum != "" && !checksumPattern.MatchString(req.BackupChecksum) {
+		api.InvalidBackupChecksumError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	// Sharded images are uploaded as logical dumps, which have no backup_label
+	if req.BackupLSN != "" && (len(req.Shards) > 0 || !lsnPattern.MatchString(req.BackupLSN)) {
+		api.InvalidBackupLSNError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if err := validateFinaliseOptions(req); err != nil {
+		api.InvalidFinaliseOptionsError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if err := validateWorkers(req); err != nil {
+		api.InvalidWorkersError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if i.Quota.MaxInProgress > 0 || i.Quota.Cooldown > 0 {
+		images, err := i.ImageStore.List()
+		if err != nil {
+			return errors.Wrap(err, "failed to list images")
+		}
+
+		inProgress, wait := i.Quota.usage(images, uploader, time.Now())
+		if i.Quota.MaxInProgress > 0 && inProgress >= i.Quota.MaxInProgress {
+			logger.With("uploader", uploader).With("in_progress", inProgress).Info("image quota exceeded")
+			api.ImageQuotaExceededError(fmt.Sprintf(
+				"%s already has %d images that aren't ready, which is the most allowed. Finalise or destroy one of them before creating another.",
+				uploader, inProgress,
+			)).Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+		if wait > 0 {
+			// Round up, so that a client that waits for Retry-After isn't rejected again
+			seconds := int((wait + time.Second - 1) / time.Second)
+			logger.With("uploader", uploader).With("retry_after", seconds).Info("image creation cooling down")
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			api.ImageCooldownError(fmt.Sprintf(
+				"%s can only create an image every %s. Try again in %ds.", uploader, i.Quota.Cooldown, seconds,
+			)).Render(w, http.StatusTooManyRequests)
+			return nil
+		}
+	}
+
+	image := models.NewImage(req.BackedUpAt, req.Anon, req.Shards)
+	image.Uploader = uploader
+	image.BackupChecksum = req.BackupChecksum
+	image.BackupLSN = req.BackupLSN
+	image.Encoding = req.Encoding
+	image.Locale = req.Locale
+	if req.DropDatabases != nil {
+		image.DropDatabases = req.DropDatabases
+	}
+	if req.RenameDatabases != nil {
+		image.RenameDatabases = req.RenameDatabases
+	}
+	if req.Workers != nil {
+		image.Workers = req.Workers
+	}
 	image, err = i.ImageStore.Create(image)
 	if err != nil {
 		return errors.Wrap(err, "failed to create new image")
@@ -98,20 +458,94 @@ func (i Images) Create(w http.ResponseWriter, r *http.Request) error {
 		return errors.Wrap(err, "failed to create btrfs subvolume")
 	}
 
+	if image.IsSharded() {
+		if err := i.Executor.CreateShardUploadSlots(r.Context(), image.ID, image.Shards); err != nil {
+			return errors.Wrap(err, "failed to create shard upload slots")
+		}
+	}
+
+	if image.IsDistributed() {
+		if err := i.Executor.CreateWorkerUploadSlots(r.Context(), image.ID, image.Workers.Names()); err != nil {
+			return errors.Wrap(err, "failed to create worker upload slots")
+		}
+	}
+
+	i.Events.Publish(events.ImageEvent(events.Created, image))
+
 	w.WriteHeader(http.StatusCreated)
-	if err := jsonapi.MarshalOnePayload(w, &image); err != nil {
+	if err := marshalOne(r, w, &image); err != nil {
 		return errors.Wrap(err, "failed to marshal image")
 	}
 
 	return nil
 }
 
-func (i Images) Done(w http.ResponseWriter, r *http.Request) error {
+// UploadOffsetHeader holds the number of bytes of an image's tarball that the
+// server has received, from which an upload should resume
+const UploadOffsetHeader = "Upload-Offset"
+
+// UploadOffset reports how much of the image's tarball has been uploaded, so
+// that an interrupted upload can be resumed
+func (i Images) UploadOffset(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	size, err := i.Executor.ImageUploadSize(r.Context(), image.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to get image upload size")
+	}
+
+	w.Header().Set(UploadOffsetHeader, strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// Upload streams the request body onto the end of the image's tarball, as an
+// alternative to uploading it over SSH. The Upload-Offset header must match the
+// size of the upload so far, so that a client that resumes an upload can't
+// duplicate or skip any of it. As over SSH, only the upload user can upload.
+func (i Images) Upload(w http.ResponseWriter, r *http.Request) error {
 	logger, err := middleware.GetLogger(r)
 	if err != nil {
 		return err
 	}
 
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		logger.Info(err.Error())
@@ -126,27 +560,48 @@ func (i Images) Done(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	if !image.Ready {
-		err = i.Executor.FinaliseImage(r.Context(), image)
-		if err != nil {
-			return errors.Wrap(err, "failed to finalise image")
-		}
+	offset, err := strconv.ParseInt(r.Header.Get(UploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		api.InvalidUploadOffsetError.Render(w, http.StatusBadRequest)
+		return nil
+	}
 
-		image, err = i.ImageStore.MarkAsReady(image)
-		if err != nil {
-			return errors.Wrap(err, "failed to mark image as ready")
-		}
+	if image.Ready || image.IsSharded() || image.IsDistributed() {
+		api.ImageUploadUnavailableError.Render(w, http.StatusUnprocessableEntity)
+		return nil
 	}
 
-	w.WriteHeader(http.StatusOK)
+	size, err := i.Executor.AppendImageUpload(r.Context(), image.ID, offset, r.Body)
+	switch err {
+	case nil:
+	case exec.ErrImageStarted:
+		api.ImageUploadUnavailableError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	case exec.ErrUploadOffsetMismatch:
+		logger.With("offset", offset).With("size", size).Info("upload offset mismatch")
+		w.Header().Set(UploadOffsetHeader, strconv.FormatInt(size, 10))
+		api.UploadConflictError(fmt.Sprintf("the upload is %d bytes, but Upload-Offset was %d", size, offset)).
+			Render(w, http.StatusConflict)
+		return nil
+	case exec.ErrUploadInProgress:
+		api.UploadConflictError(err.Error()).Render(w, http.StatusConflict)
+		return nil
+	default:
+		return errors.Wrap(err, "failed to append to image upload")
+	}
 
-	return errors.Wrap(
-		jsonapi.MarshalOnePayload(w, &image),
-		"failed to marshal image",
-	)
+	w.Header().Set(UploadOffsetHeader, strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
 }
 
-func (i Images) Destroy(w http.ResponseWriter, r *http.Request) error {
+// ReceiveStream receives the image's upload from the request body, a btrfs send
+// stream of the subvolume holding its data directory, as an alternative to
+// uploading a tarball. The stream keeps the sender's reflinks and compression,
+// and isn't copied again when it's extracted. Streams can't be resumed, so the
+// upload must be empty. Only the upload user can send streams, as btrfs
+// receive runs as root.
+func (i Images) ReceiveStream(w http.ResponseWriter, r *http.Request) error {
 	logger, err := middleware.GetLogger(r)
 	if err != nil {
 		return err
@@ -157,6 +612,11 @@ func (i Images) Destroy(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
 	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
 		logger.Info(err.Error())
@@ -171,43 +631,923 @@ func (i Images) Destroy(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	if email == auth.UPLOAD_USER_EMAIL {
-		// Destroy all instances of this image, if there are any
-		instances, err := i.InstanceStore.List()
-		for _, instance := range instances {
-			if instance.ImageID != id {
-				continue
-			}
-			logger.With("instance", instance.ID).Info("destroying instance")
-			err = i.InstanceStore.Destroy(instance)
-			if err == nil {
-				err = i.Executor.DestroyInstance(r.Context(), instance.ID)
-			}
-			if err != nil {
-				return errors.Wrap(err, "failed to destroy instance")
-			}
-		}
+	if image.Ready || image.IsSharded() || image.IsDistributed() {
+		api.ImageUploadUnavailableError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	err = i.Executor.ReceiveImageStream(r.Context(), image.ID, r.Body)
+	switch err {
+	case nil:
+	case exec.ErrImageStarted:
+		api.ImageUploadUnavailableError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	case exec.ErrInvalidImageStream:
+		api.InvalidImageStreamError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	case exec.ErrUploadNotEmpty, exec.ErrUploadInProgress:
+		api.UploadConflictError(err.Error()).Render(w, http.StatusConflict)
+		return nil
+	default:
+		return errors.Wrap(err, "failed to receive image stream")
 	}
 
-	logger.With("image", id).Info("destroying image")
-	err = i.ImageStore.Destroy(image)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Done finalises the image, if it isn't ready already. With Prefer:
+// respond-async, it's finalised in the background, and an operation that can be
+// polled is returned straight away.
+func (i Images) Done(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
 	if err != nil {
-		match, err := regexp.MatchString("instances_image_id_fkey", err.Error())
-		if err == nil && match == true {
-			logger.With("image", id).Info("cannot destroy image with instances")
-			api.CannotDeleteImageWithInstancesError.Render(w, http.StatusUnprocessableEntity)
-			return nil
-		}
+		return err
+	}
 
-		return errors.Wrap(err, "failed to destroy image")
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
 	}
 
-	err = i.Executor.DestroyImage(r.Context(), id)
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return errors.Wrap(err, "failed to destroy image")
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
 
-	return nil
+	if !image.Ready {
+		previous, err := i.JobStore.Latest(models.JobFinaliseImage, image.ID)
+		if err != nil && err != sql.ErrNoRows {
+			return errors.Wrap(err, "failed to get previous finalisation")
+		}
+		switch previous.Status {
+		case models.JobInterrupted:
+			api.InterruptedFinalisationError(previous.Error).Render(w, http.StatusUnprocessableEntity)
+			return nil
+		case models.JobQueued, models.JobRunning:
+			api.OperationInProgressError.Render(w, http.StatusConflict)
+			return nil
+		}
+
+		if respondAsync(r) {
+			job, err := i.Workers.Submit(logger, models.NewQueuedJob(models.JobFinaliseImage, image.ID, email), func(ctx context.Context) error {
+				_, err := i.finaliseUpload(ctx, logger, image)
+				return err
+			})
+			return renderOperation(w, r, job, err)
+		}
+
+		ctx := r.Context()
+		err = jobs.Run(logger, i.JobStore, models.JobFinaliseImage, image.ID, func() (err error) {
+			image, err = i.finaliseUpload(ctx, logger, image)
+			return err
+		})
+		if errors.Cause(err) == errBackupMismatch {
+			api.BackupMismatchError.Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+		if blocked, ok := errors.Cause(err).(guardrail.BlockedError); ok {
+			api.ProductionReferencesError(blocked.Error()).Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+		// Failures caused by the image's anonymisation script or finalise options
+		// are reported to the user, who can fix them and upload the image again
+		if failed, ok := errors.Cause(err).(exec.BakeError); ok && failed.IsUserError() {
+			api.FinalisationFailedError(failed.Error()).Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	return errors.Wrap(
+		marshalOne(r, w, &image),
+		"failed to marshal image",
+	)
+}
+
+// errBackupMismatch is returned by finaliseUpload if the image's upload doesn't
+// match its base backup
+var errBackupMismatch = errors.New("image upload does not match its base backup")
+
+// finaliseUpload checks the image's upload against its base backup, if it has
+// one, and then finalises it, telling anything watching for changes once it's
+// ready. Failures are published too, unless the finalisation was interrupted
+// by the server stopping.
+func (i Images) finaliseUpload(ctx context.Context, logger log.Logger, image models.Image) (_ models.Image, err error) {
+	defer func() {
+		if err != nil && ctx.Err() == nil {
+			i.Events.Publish(events.FinalisationFailedEvent(image, err))
+		}
+	}()
+
+	if image.BackupChecksum != "" || image.BackupLSN != "" {
+		var upload models.ImageInspection
+		err := i.bakePhase(ctx, logger, image.ID, models.BakePhaseInspectUpload, func() (err error) {
+			upload, err = i.Executor.InspectImageUpload(ctx, image.ID)
+			return err
+		})
+		if err != nil {
+			return image, errors.Wrap(err, "failed to inspect image upload")
+		}
+
+		if !matchesBackup(image, upload) {
+			logger.
+				With("checksum", upload.Checksum).
+				With("start_lsn", upload.StartLSN).
+				Warn("image upload does not match its base backup")
+			return image, errBackupMismatch
+		}
+	}
+
+	start := time.Now()
+	finalised, err := i.finalise(ctx, logger, image)
+	outcome := imageFinalisationSucceeded
+	if err != nil {
+		outcome = imageFinalisationFailed
+	}
+	imageFinalisationDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return finalised, err
+	}
+
+	i.Events.Publish(events.ImageEvent(events.Finalised, finalised))
+	return finalised, nil
+}
+
+// finalise runs the phases of the image's bake that modify it, returning the
+// image once it's ready
+func (i Images) finalise(ctx context.Context, logger log.Logger, image models.Image) (models.Image, error) {
+	// Sharded images are restored from logical dumps, so there's nothing to
+	// replay WAL onto, and distributed images have a base backup for each node
+	if i.StandbyEnabled && !image.IsSharded() && !image.IsDistributed() {
+		err := i.bakePhase(ctx, logger, image.ID, models.BakePhaseSnapshotBase, func() error {
+			return i.Executor.SnapshotImageBase(ctx, image.ID)
+		})
+		if err != nil {
+			return image, errors.Wrap(err, "failed to snapshot image base")
+		}
+	}
+
+	err := i.bakePhase(ctx, logger, image.ID, models.BakePhaseFinalise, func() error {
+		return i.Executor.FinaliseImage(ctx, image)
+	})
+	if err != nil {
+		return image, errors.Wrap(err, "failed to finalise image")
+	}
+
+	// Blocked images are left unready, as they've already been anonymised and
+	// can't be finalised again
+	if i.Guardrail.Enabled() {
+		err = i.bakePhase(ctx, logger, image.ID, models.BakePhaseScanSettings, func() error {
+			return scanImageSettings(ctx, logger, i.Executor, i.Guardrail, image.ID)
+		})
+		if err != nil {
+			return image, errors.Wrap(err, "failed to scan image settings")
+		}
+	}
+
+	var snapshot models.ImageInspection
+	err = i.bakePhase(ctx, logger, image.ID, models.BakePhaseInspectSnapshot, func() (err error) {
+		snapshot, err = i.Executor.InspectImageSnapshot(ctx, image.ID)
+		return err
+	})
+	if err != nil {
+		return image, errors.Wrap(err, "failed to inspect image snapshot")
+	}
+	image.SnapshotChecksum = snapshot.Checksum
+
+	// The manifest is stored before the image is marked as ready, so that no
+	// one can use a ready image that should have a manifest but doesn't
+	if i.ManifestSigner != nil {
+		err = i.bakePhase(ctx, logger, image.ID, models.BakePhaseSignManifest, func() error {
+			signed, err := i.ManifestSigner.Sign(image, version.Version, time.Now())
+			if err != nil {
+				return err
+			}
+			_, err = i.ManifestStore.Create(signed)
+			return err
+		})
+		if err != nil {
+			return image, errors.Wrap(err, "failed to sign image manifest")
+		}
+	}
+
+	err = i.bakePhase(ctx, logger, image.ID, models.BakePhaseMarkAsReady, func() (err error) {
+		image, err = i.ImageStore.MarkAsReady(image)
+		return err
+	})
+	if err != nil {
+		return image, errors.Wrap(err, "failed to mark image as ready")
+	}
+
+	// The image is ready regardless, so failing to mark it doesn't fail the
+	// finalisation: it just goes without a canary
+	if i.Canary {
+		pending, err := i.ImageStore.Annotate(image, models.Annotations{
+			canary.StatusAnnotation: canary.StatusPending,
+		})
+		if err != nil {
+			logger.With("image", image.ID).With("error", err).Warn("failed to mark image as pending a canary")
+		} else {
+			image = pending
+		}
+	}
+
+	return image, nil
+}
+
+// scanImageSettings checks the image's settings for references to production,
+// logging each one that's found. It returns a guardrail.BlockedError if the
+// scanner blocks them.
+func scanImageSettings(ctx context.Context, logger log.Logger, executor exec.Executor, scanner guardrail.Scanner, imageID int) error {
+	settings, err := executor.RetrieveImageSettings(ctx, imageID)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve image settings")
+	}
+
+	findings, err := scanner.Check(settings)
+	for _, finding := range findings {
+		logger.
+			With("image", imageID).
+			With("source", finding.Source).
+			With("setting", finding.Name).
+			Warnf("image setting %s", finding.Reason)
+	}
+
+	return err
+}
+
+// bakePhase runs a phase of an image's bake, recording a span of when it
+// started and finished. Failing to record the span doesn't fail the phase, as
+// the bake itself is more important than our record of it.
+func (i Images) bakePhase(ctx context.Context, logger log.Logger, imageID int, phase string, run func() error) error {
+	logger = logger.With("image", imageID).With("phase", phase)
+
+	span, err := i.BakeSpanStore.Create(models.NewBakeSpan(imageID, phase))
+	if err != nil {
+		logger.With("error", err).Warn("failed to record start of bake phase")
+	}
+
+	phaseErr := run()
+
+	span = span.Finish(phaseErr)
+	if span.ID != 0 {
+		if _, err := i.BakeSpanStore.Finish(span); err != nil {
+			logger.With("error", err).Warn("failed to record end of bake phase")
+		}
+	}
+
+	if i.SpanExporter != nil {
+		if err := i.SpanExporter.Export(ctx, span); err != nil {
+			logger.With("error", err).Warn("failed to export bake phase")
+		}
+	}
+
+	return phaseErr
+}
+
+// Timeline lists the phases of the image's bake, in the order they started
+func (i Images) Timeline(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	spans, err := i.BakeSpanStore.List(image.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to get bake spans")
+	}
+
+	// Build a slice of pointers to our spans, because this is what jsonapi wants
+	_spans := make([]*models.BakeSpan, 0)
+	for i := range spans {
+		_spans = append(_spans, &spans[i])
+	}
+
+	return errors.Wrap(
+		marshalMany(r, w, _spans),
+		"failed to marshal bake spans",
+	)
+}
+
+// Manifest gets the image's signed manifest, which clients can verify against
+// the signer's public key
+func (i Images) Manifest(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if i.ManifestStore == nil {
+		api.ManifestNotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	imageManifest, err := i.ManifestStore.Get(image.ID)
+	if err == sql.ErrNoRows {
+		api.ManifestNotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to get image manifest")
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &imageManifest),
+		"failed to marshal image manifest",
+	)
+}
+
+// File returns one of the files in a ready image's snapshot, so that users can
+// sanity-check its contents. Only models.ImageFileNames can be read.
+func (i Images) File(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	name := mux.Vars(r)["path"]
+	if !models.IsImageFileName(name) {
+		api.ImageFileNotAllowedError(
+			"only these files can be read from images: "+strings.Join(models.ImageFileNames, ", "),
+		).Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	if !image.Ready {
+		api.UnreadyImageError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	file, err := i.Executor.ReadImageFile(r.Context(), image.ID, name)
+	if err == exec.ErrImageFileNotFound {
+		api.ImageFileNotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read image file")
+	}
+
+	// Snapshots are read-only, so the file only changes if the image is
+	// destroyed and its ID reused
+	return errors.Wrap(
+		writeCacheable(w, r, time.Time{}, func(body io.Writer) error {
+			return marshalOne(r, body, &file)
+		}),
+		"failed to marshal image file",
+	)
+}
+
+// SendParentHeader names the image that a send stream is relative to. It's
+// absent from full streams.
+const SendParentHeader = "Draupnir-Send-Parent"
+
+// Send streams the image's snapshot as a btrfs send stream, for btrfs receive
+// to recreate on another host, e.g. to replicate images to another region.
+// The client lists the images that it already has in the parents parameter,
+// and if one of them is an earlier image of the same family, the stream only
+// holds the differences from it.
+func (i Images) Send(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if !image.Ready {
+		api.UnreadyImageError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	var parentIDs []int
+	if param := r.URL.Query().Get("parents"); param != "" {
+		for _, value := range strings.Split(param, ",") {
+			parentID, err := strconv.Atoi(value)
+			if err != nil {
+				logger.Info(err.Error())
+				api.BadImageIDError.Render(w, http.StatusBadRequest)
+				return nil
+			}
+			parentIDs = append(parentIDs, parentID)
+		}
+	}
+
+	// Images that don't exist any more can't be sent relative to
+	var candidates []models.Image
+	for _, parentID := range parentIDs {
+		if candidate, err := i.ImageStore.Get(parentID); err == nil {
+			candidates = append(candidates, candidate)
+		}
+	}
+	parent, ok := SendParent(image, candidates)
+
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		return errors.New("response can't be streamed")
+	}
+
+	// The stream is written as it's produced, so once the headers are sent, a
+	// failure can only cut it short. btrfs receive rejects truncated streams.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if ok {
+		w.Header().Set(SendParentHeader, strconv.Itoa(parent.ID))
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	logger.With("image", image.ID).With("parent", parent.ID).Info("sending image")
+	return errors.Wrap(i.Executor.SendImage(r.Context(), image.ID, parent.ID, w), "failed to send image")
+}
+
+// SendParent returns the image that a send stream of the image should be
+// relative to: the most recently backed up of the candidates that's ready, of
+// the same family, and was backed up before it
+func SendParent(image models.Image, candidates []models.Image) (models.Image, bool) {
+	var parent models.Image
+	found := false
+
+	for _, candidate := range candidates {
+		if !candidate.Ready || candidate.ID == image.ID {
+			continue
+		}
+		if freshness.Family(candidate) != freshness.Family(image) || !candidate.BackedUpAt.Before(image.BackedUpAt) {
+			continue
+		}
+		if !found || candidate.BackedUpAt.After(parent.BackedUpAt) {
+			parent, found = candidate, true
+		}
+	}
+
+	return parent, found
+}
+
+// Annotate patches the image's annotations and labels
+func (i Images) Annotate(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	patch, ok := parseAnnotationsPatch(w, r, logger)
+	if !ok {
+		return nil
+	}
+
+	image, err = i.ImageStore.Annotate(image, patch.Annotations)
+	if err != nil {
+		if isAnnotationsSizeError(err) {
+			logger.Info(err.Error())
+			api.AnnotationsTooLargeError.Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+		return errors.Wrap(err, "failed to annotate image")
+	}
+
+	if patch.Labels != nil {
+		image, err = i.ImageStore.Label(image, patch.Labels)
+		if err != nil {
+			if isLabelsSizeError(err) {
+				logger.Info(err.Error())
+				api.LabelsTooLargeError.Render(w, http.StatusUnprocessableEntity)
+				return nil
+			}
+			return errors.Wrap(err, "failed to label image")
+		}
+	}
+
+	i.Events.Publish(events.ImageEvent(events.Updated, image))
+
+	return errors.Wrap(
+		marshalOne(r, w, &image),
+		"failed to marshal image",
+	)
+}
+
+func (i Images) Destroy(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if respondAsync(r) {
+		// Only the upload user's destroys also destroy the image's instances,
+		// so others can be refused without waiting for the operation
+		if !auth.IsAdmin(email) {
+			instances, err := i.InstanceStore.List()
+			if err != nil {
+				return errors.Wrap(err, "failed to list instances")
+			}
+			for _, instance := range instances {
+				if instance.ImageID == id {
+					api.CannotDeleteImageWithInstancesError.Render(w, http.StatusUnprocessableEntity)
+					return nil
+				}
+			}
+		}
+
+		job, err := i.Workers.Submit(logger, models.NewQueuedJob(models.JobDestroyImage, id, email), func(ctx context.Context) error {
+			// The operation is itself the record of the image's destroy
+			return i.destroy(ctx, logger, image, auth.IsAdmin(email), func(run func() error) error {
+				return run()
+			})
+		})
+		return renderOperation(w, r, job, err)
+	}
+
+	err = i.destroy(r.Context(), logger, image, auth.IsAdmin(email), func(run func() error) error {
+		return jobs.Run(logger, i.JobStore, models.JobDestroyImage, id, run)
+	})
+	if err == errImageHasInstances {
+		logger.With("image", id).Info("cannot destroy image with instances")
+		api.CannotDeleteImageWithInstancesError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// errImageHasInstances is returned by destroy if the image still has instances
+var errImageHasInstances = errors.New("cannot destroy an image with instances")
+
+// destroy destroys the image, after destroying its instances if
+// destroyInstances is set, and tells anything watching for changes. record
+// records the image's destroy as a job while it runs.
+func (i Images) destroy(ctx context.Context, logger log.Logger, image models.Image, destroyInstances bool, record func(run func() error) error) error {
+	if destroyInstances {
+		instances, err := i.InstanceStore.List()
+		if err != nil {
+			return errors.Wrap(err, "failed to list instances")
+		}
+		for _, instance := range instances {
+			if instance.ImageID != image.ID {
+				continue
+			}
+			logger.With("instance", instance.ID).Info("destroying instance")
+			err = jobs.Run(logger, i.JobStore, models.JobDestroyInstance, instance.ID, func() error {
+				err := i.InstanceStore.Destroy(instance)
+				if err != nil {
+					return err
+				}
+				return i.Executor.DestroyInstance(ctx, instance.ID)
+			})
+			if err != nil {
+				return errors.Wrap(err, "failed to destroy instance")
+			}
+			i.Events.Publish(events.InstanceEvent(events.Destroyed, instance))
+		}
+	}
+
+	logger.With("image", image.ID).Info("destroying image")
+	// The image is removed from the database before its files, so that if we're
+	// interrupted the files can be cleaned up when the server next starts
+	err := record(func() error {
+		err := i.ImageStore.Destroy(image)
+		if err != nil {
+			return err
+		}
+		return i.Executor.DestroyImage(ctx, image.ID)
+	})
+	if err != nil {
+		match, matchErr := regexp.MatchString("instances_image_id_fkey", err.Error())
+		if matchErr == nil && match == true {
+			return errImageHasInstances
+		}
+
+		return errors.Wrap(err, "failed to destroy image")
+	}
+
+	i.Events.Publish(events.ImageEvent(events.Destroyed, image))
+	return nil
+}
+
+// PruneImagesRequest selects the images to prune. OlderThan, e.g. "720h",
+// prunes images backed up longer ago than it, and KeepLast keeps the newest
+// images; at least one of them must be given. DryRun returns the images that
+// would be pruned without destroying them.
+type PruneImagesRequest struct {
+	OlderThan string `jsonapi:"attr,older_than"`
+	KeepLast  int    `jsonapi:"attr,keep_last"`
+	DryRun    bool   `jsonapi:"attr,dry_run"`
+}
+
+// Prune destroys old images in bulk, skipping those that are pinned or still
+// have instances, and returns the images that it destroyed. Only the upload
+// user can prune images.
+func (i Images) Prune(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	req := PruneImagesRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	policy := reclaim.PrunePolicy{KeepLast: req.KeepLast}
+	if req.OlderThan != "" {
+		policy.OlderThan, err = time.ParseDuration(req.OlderThan)
+		if err != nil || policy.OlderThan <= 0 {
+			api.InvalidPruneError("older_than must be a positive duration, e.g. 720h").Render(w, http.StatusBadRequest)
+			return nil
+		}
+	}
+	if req.KeepLast < 0 {
+		api.InvalidPruneError("keep_last must not be negative").Render(w, http.StatusBadRequest)
+		return nil
+	}
+	if policy.OlderThan == 0 && policy.KeepLast == 0 {
+		api.InvalidPruneError("older_than or keep_last must be given").Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	images, err := i.ImageStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to get images")
+	}
+
+	instances, err := i.InstanceStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list instances")
+	}
+
+	pruned := policy.Images(images, instances, time.Now())
+
+	// Build a slice of pointers to our images, because this is what jsonapi wants
+	_images := make([]*models.Image, 0, len(pruned))
+	for idx := range pruned {
+		image := pruned[idx]
+		_images = append(_images, &pruned[idx])
+
+		if req.DryRun {
+			continue
+		}
+
+		logger.With("image", image.ID).Info("pruning image")
+		// As when destroying a single image, the image is removed from the
+		// database before its files
+		err = jobs.Run(logger, i.JobStore, models.JobDestroyImage, image.ID, func() error {
+			err := i.ImageStore.Destroy(image)
+			if err != nil {
+				return err
+			}
+			return i.Executor.DestroyImage(r.Context(), image.ID)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to prune image %d", image.ID)
+		}
+
+		i.Events.Publish(events.ImageEvent(events.Destroyed, image))
+	}
+
+	return errors.Wrap(
+		marshalMany(r, w, _images),
+		"failed to marshal images",
+	)
+}
+
+// Verify checksums the image's snapshot and compares it to the checksum taken
+// when the image was finalised, to detect corruption or tampering. It also
+// checks that the snapshot is read-only.
+func (i Images) Verify(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if !image.Ready {
+		api.UnreadyImageError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	snapshot, err := i.Executor.InspectImageSnapshot(r.Context(), image.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to inspect image snapshot")
+	}
+
+	verification := models.NewImageVerification(image, snapshot)
+	if !verification.Verified {
+		logger.
+			With("image", image.ID).
+			With("expected_checksum", verification.ExpectedChecksum).
+			With("checksum", verification.Checksum).
+			With("read_only", verification.ReadOnly).
+			Warn("image failed verification")
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &verification),
+		"failed to marshal image verification",
+	)
+}
+
+// Storage aggregates the storage reports of every instance of the image, so
+// that it's possible to see how much space the image is consuming in total.
+// Like Instances.Storage, users only see their own instances, and admins see
+// everyone's.
+func (i Images) Storage(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(id)
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	imageUsage, err := i.Executor.RetrieveImageDiskUsage(r.Context(), image.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve image disk usage")
+	}
+
+	instances, err := i.InstanceStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list instances")
+	}
+
+	reports := make([]models.InstanceStorageReport, 0)
+	for _, instance := range instances {
+		if instance.ImageID != image.ID {
+			continue
+		}
+		if !auth.IsAdmin(email) && email != instance.UserEmail {
+			continue
+		}
+
+		usage, err := i.Executor.RetrieveInstanceDiskUsage(r.Context(), instance.ID)
+		if err != nil {
+			// The instance may be in the middle of being created or destroyed, so
+			// don't let it prevent us from reporting on the others.
+			logger.With("instance", instance.ID).Info(
+				errors.Wrap(err, "failed to retrieve instance disk usage"),
+			)
+			continue
+		}
+
+		reports = append(reports, models.NewInstanceStorageReport(instance, usage))
+	}
+
+	report := models.NewImageStorageReport(image.ID, imageUsage, reports)
+
+	return errors.Wrap(
+		marshalOne(r, w, &report),
+		"failed to marshal storage report",
+	)
 }
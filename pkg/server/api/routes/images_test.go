@@ -3,17 +3,29 @@ package routes
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/gocardless/draupnir/pkg/canary"
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/guardrail"
+	"github.com/gocardless/draupnir/pkg/jobs"
+	"github.com/gocardless/draupnir/pkg/manifest"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
 	"github.com/google/jsonapi"
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
@@ -60,7 +72,13 @@ func TestListImages(t *testing.T) {
 	req, recorder, _ := createRequest(t, "GET", "/images", nil)
 
 	store := FakeImageStore{
-		_List: func() ([]models.Image, error) {
+		_ListPage: func(filter store.ImageFilter, sort store.Sort, page store.Page) ([]models.Image, bool, error) {
+			assert.Equal(t, store.ImageFilter{}, filter)
+			assert.Empty(t, sort)
+			// Without page parameters, the whole list is returned, as it was
+			// before it was paginated
+			assert.Equal(t, store.Page{}, page)
+
 			return []models.Image{
 				models.Image{
 					ID:         1,
@@ -69,7 +87,7 @@ func TestListImages(t *testing.T) {
 					CreatedAt:  timestamp(),
 					UpdatedAt:  timestamp(),
 				},
-			}, nil
+			}, false, nil
 		},
 	}
 
@@ -84,6 +102,81 @@ func TestListImages(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestListImagesPaginated(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images?filter[ready]=true&sort=-backed_up_at&page[size]=2", nil)
+
+	store := FakeImageStore{
+		_ListPage: func(filter store.ImageFilter, sort store.Sort, page store.Page) ([]models.Image, bool, error) {
+			if assert.NotNil(t, filter.Ready) {
+				assert.True(t, *filter.Ready)
+			}
+			assert.Equal(t, store.Sort{{Field: "backed_up_at", Descending: true}}, sort)
+			assert.Equal(t, store.Page{Number: 1, Size: 2}, page)
+			return []models.Image{{ID: 1, Ready: true}, {ID: 2, Ready: true}}, true, nil
+		},
+	}
+
+	err := Images{ImageStore: store}.List(recorder, req)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, response.Data, 2)
+	if assert.NotNil(t, response.Links) {
+		assert.Equal(t, map[string]string{
+			"next": "/images?filter%5Bready%5D=true&page%5Bnumber%5D=2&page%5Bsize%5D=2&sort=-backed_up_at",
+		}, *response.Links)
+	}
+}
+
+func TestListImagesPageNumberUsesDefaultSize(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images?page[number]=2", nil)
+
+	store := FakeImageStore{
+		_ListPage: func(filter store.ImageFilter, sort store.Sort, page store.Page) ([]models.Image, bool, error) {
+			assert.Equal(t, store.Page{Number: 2, Size: DEFAULT_PAGE_SIZE}, page)
+			return []models.Image{}, false, nil
+		},
+	}
+
+	err := Images{ImageStore: store}.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestListImagesNotModified(t *testing.T) {
+	store := FakeImageStore{
+		_ListPage: func(store.ImageFilter, store.Sort, store.Page) ([]models.Image, bool, error) {
+			return []models.Image{{ID: 1, BackedUpAt: timestamp(), CreatedAt: timestamp(), UpdatedAt: timestamp()}}, false, nil
+		},
+	}
+	handler := Images{ImageStore: store}.List
+
+	req, recorder, _ := createRequest(t, "GET", "/images", nil)
+	assert.Nil(t, handler(recorder, req))
+
+	etag := recorder.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, timestamp().UTC().Format(http.TimeFormat), recorder.Header().Get("Last-Modified"))
+
+	req, recorder, _ = createRequest(t, "GET", "/images", nil)
+	req.Header.Set("If-None-Match", etag)
+	assert.Nil(t, handler(recorder, req))
+
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+	assert.Equal(t, etag, recorder.Header().Get("ETag"))
+	assert.Equal(t, 0, recorder.Body.Len())
+
+	req, recorder, _ = createRequest(t, "GET", "/images", nil)
+	req.Header.Set("If-None-Match", `"stale"`)
+	assert.Nil(t, handler(recorder, req))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
 func TestCreateImage(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
 	request := CreateImageRequest{
@@ -121,6 +214,94 @@ func TestCreateImage(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestCreateImageRecordsUploader(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &CreateImageRequest{BackedUpAt: timestamp()})
+	req, recorder, _ := createRequest(t, "POST", "/images", body)
+
+	store := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{
+				// Another uploader's images don't count towards the quota
+				{ID: 1, Uploader: "other@draupnir", CreatedAt: time.Now()},
+				// Nor do ready images
+				{ID: 2, Uploader: "test@draupnir", Ready: true, CreatedAt: time.Now().Add(-time.Hour)},
+			}, nil
+		},
+		_Create: func(image models.Image) (models.Image, error) {
+			assert.Equal(t, "test@draupnir", image.Uploader)
+			image.ID = 3
+			return image, nil
+		},
+	}
+	executor := FakeExecutor{
+		_CreateBtrfsSubvolume: func(context.Context, int) error { return nil },
+	}
+
+	routeSet := Images{
+		ImageStore: store,
+		Executor:   executor,
+		Quota:      ImageQuota{MaxInProgress: 1, Cooldown: 10 * time.Minute},
+	}
+	err := routeSet.Create(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+}
+
+func TestImageCreateReturnsErrorWhenQuotaExceeded(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &CreateImageRequest{BackedUpAt: timestamp()})
+	req, recorder, logs := createRequest(t, "POST", "/images", body)
+
+	store := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{
+				{ID: 1, Uploader: "test@draupnir", CreatedAt: time.Now().Add(-2 * time.Hour)},
+				{ID: 2, Uploader: "test@draupnir", CreatedAt: time.Now().Add(-time.Hour)},
+			}, nil
+		},
+	}
+
+	routeSet := Images{ImageStore: store, Quota: ImageQuota{MaxInProgress: 2}}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, "Image Quota Exceeded", response.Title)
+	assert.Contains(t, response.Detail, "test@draupnir already has 2 images that aren't ready")
+	assert.Contains(t, logs.String(), "image quota exceeded")
+}
+
+func TestImageCreateReturnsErrorWhenCoolingDown(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &CreateImageRequest{BackedUpAt: timestamp()})
+	req, recorder, _ := createRequest(t, "POST", "/images", body)
+
+	store := FakeImageStore{
+		_List: func() ([]models.Image, error) {
+			return []models.Image{
+				{ID: 1, Uploader: "test@draupnir", Ready: true, CreatedAt: time.Now().Add(-9*time.Minute - 30*time.Second)},
+			}, nil
+		},
+	}
+
+	routeSet := Images{ImageStore: store, Quota: ImageQuota{Cooldown: 10 * time.Minute}}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "30", recorder.Header().Get("Retry-After"))
+	assert.Equal(t, "Image Creation Cooling Down", response.Title)
+	assert.Equal(t, "test@draupnir can only create an image every 10m0s. Try again in 30s.", response.Detail)
+}
+
 func TestImageCreateReturnsErrorWithInvalidPayload(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
 	payload := map[string]string{"this is": "not a valid JSON API request payload"}
@@ -177,175 +358,1481 @@ func TestImageCreateReturnsErrorWhenSubvolumeCreationFails(t *testing.T) {
 	assert.Equal(t, "failed to create btrfs subvolume: some btrfs error", err.Error())
 }
 
-func TestImageDone(t *testing.T) {
-	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
-
-	image := models.Image{
-		ID:         1,
+func TestCreateShardedImage(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageRequest{
 		BackedUpAt: timestamp(),
-		Ready:      false,
-		CreatedAt:  timestamp(),
-		UpdatedAt:  timestamp(),
+		Anon:       "SELECT * FROM foo;",
+		Shards:     []string{"payments_eu", "payments_us"},
 	}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/images", body)
 
-	store := FakeImageStore{
-		_Get: func(id int) (models.Image, error) {
+	var slots []string
+	executor := FakeExecutor{
+		_CreateBtrfsSubvolume: func(ctx context.Context, id int) error { return nil },
+		_CreateShardUploadSlots: func(ctx context.Context, id int, shards []string) error {
 			assert.Equal(t, 1, id)
-
-			return image, nil
-		},
-		_MarkAsReady: func(i models.Image) (models.Image, error) {
-			assert.Equal(t, image, i)
-
-			i.Ready = true
-			return i, nil
+			slots = shards
+			return nil
 		},
 	}
 
-	executor := FakeExecutor{
-		_FinaliseImage: func(ctx context.Context, i models.Image) error {
-			assert.Equal(t, image, i)
-
-			return nil
+	store := FakeImageStore{
+		_Create: func(image models.Image) (models.Image, error) {
+			image.ID = 1
+			return image, nil
 		},
 	}
 
-	errorHandler := FakeErrorHandler{}
 	routeSet := Images{ImageStore: store, Executor: executor}
-	router := mux.NewRouter()
-	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
-	router.ServeHTTP(recorder, req)
+	err := routeSet.Create(recorder, req)
 
-	var response jsonapi.OnePayload
-	decodeJSON(t, recorder.Body, &response)
+	var image models.Image
+	assert.Nil(t, jsonapi.UnmarshalPayload(recorder.Body, &image))
 
-	assert.Equal(t, http.StatusOK, recorder.Code)
-	assert.Equal(t, doneImageFixture, response)
-	assert.Nil(t, errorHandler.Error)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, []string{"payments_eu", "payments_us"}, image.Shards)
+	assert.Equal(t, []string{"payments_eu", "payments_us"}, slots)
 }
 
-func TestImageDoneWithNonNumericID(t *testing.T) {
-	req, recorder, logs := createRequest(t, "POST", "/images/bad_id/done", nil)
+func TestImageCreateReturnsErrorWithInvalidShards(t *testing.T) {
+	testCases := []struct {
+		name   string
+		shards []string
+	}{
+		{"uppercase", []string{"Payments"}},
+		{"path traversal", []string{"../payments"}},
+		{"duplicate", []string{"payments", "payments"}},
+		{"reserved", []string{"postgres"}},
+	}
 
-	errorHandler := FakeErrorHandler{}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := bytes.NewBuffer([]byte{})
+			request := CreateImageRequest{
+				BackedUpAt: timestamp(),
+				Anon:       "SELECT * FROM foo;",
+				Shards:     tc.shards,
+			}
+			jsonapi.MarshalOnePayload(body, &request)
+			req, recorder, _ := createRequest(t, "POST", "/images", body)
 
-	router := mux.NewRouter()
-	router.HandleFunc("/images/{id}/done", errorHandler.Handle(Images{}.Done))
-	router.ServeHTTP(recorder, req)
+			err := Images{}.Create(recorder, req)
 
-	var response api.Error
-	decodeJSON(t, recorder.Body, &response)
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
 
-	assert.Equal(t, http.StatusNotFound, recorder.Code)
-	assert.Equal(t, api.NotFoundError, response)
-	assert.Contains(t, logs.String(), "invalid syntax")
-	assert.Nil(t, errorHandler.Error)
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+			assert.Equal(t, api.InvalidShardsError, response)
+		})
+	}
 }
 
-func TestImageDestroy(t *testing.T) {
-	req, recorder, logs := createRequest(t, "DELETE", "/images/1", nil)
-
-	image := models.Image{
-		ID:         1,
+func TestCreateDistributedImage(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageRequest{
 		BackedUpAt: timestamp(),
-		Ready:      false,
-		CreatedAt:  timestamp(),
-		UpdatedAt:  timestamp(),
+		Anon:       "SELECT * FROM foo;",
+		Workers:    models.WorkerNodes{"worker_b": "citus-worker-2:5432", "worker_a": "citus-worker-1:5432"},
 	}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/images", body)
 
-	store := FakeImageStore{
-		_Get: func(id int) (models.Image, error) {
+	var slots []string
+	executor := FakeExecutor{
+		_CreateBtrfsSubvolume: func(ctx context.Context, id int) error { return nil },
+		_CreateWorkerUploadSlots: func(ctx context.Context, id int, workers []string) error {
 			assert.Equal(t, 1, id)
-
-			return image, nil
-		},
-		_Destroy: func(i models.Image) error {
-			assert.Equal(t, image, i)
+			slots = workers
 			return nil
 		},
 	}
 
-	executor := FakeExecutor{
-		_DestroyImage: func(ctx context.Context, imageID int) error {
-			assert.Equal(t, 1, imageID)
-			return nil
+	store := FakeImageStore{
+		_Create: func(image models.Image) (models.Image, error) {
+			image.ID = 1
+			return image, nil
 		},
 	}
 
-	errorHandler := FakeErrorHandler{}
-
-	router := mux.NewRouter()
 	routeSet := Images{ImageStore: store, Executor: executor}
-	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
-	router.ServeHTTP(recorder, req)
+	err := routeSet.Create(recorder, req)
 
-	assert.Equal(t, http.StatusNoContent, recorder.Code)
-	assert.Equal(t, 0, len(recorder.Body.Bytes()))
-	assert.Contains(t, logs.String(), "destroying image")
-	assert.Nil(t, errorHandler.Error)
-}
+	var image models.Image
+	assert.Nil(t, jsonapi.UnmarshalPayload(recorder.Body, &image))
 
-func TestImageDestroyFromUploadUser(t *testing.T) {
-	req, recorder, logs := createRequest(t, "DELETE", "/images/1", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Equal(t, models.WorkerNodes{"worker_a": "citus-worker-1:5432", "worker_b": "citus-worker-2:5432"}, image.Workers)
+	assert.Equal(t, []string{"worker_a", "worker_b"}, slots)
+}
 
-	image := models.Image{
-		ID:         1,
-		BackedUpAt: timestamp(),
-		Ready:      false,
-		CreatedAt:  timestamp(),
-		UpdatedAt:  timestamp(),
+func TestImageCreateReturnsErrorWithInvalidWorkers(t *testing.T) {
+	testCases := []struct {
+		name    string
+		request CreateImageRequest
+	}{
+		{"uppercase name", CreateImageRequest{Workers: models.WorkerNodes{"Worker": "citus-worker-1:5432"}}},
+		{"path traversal", CreateImageRequest{Workers: models.WorkerNodes{"../worker": "citus-worker-1:5432"}}},
+		{"missing port", CreateImageRequest{Workers: models.WorkerNodes{"worker_a": "citus-worker-1"}}},
+		{"quoted host", CreateImageRequest{Workers: models.WorkerNodes{"worker_a": "citus'worker:5432"}}},
+		{"shared address", CreateImageRequest{Workers: models.WorkerNodes{
+			"worker_a": "citus-worker-1:5432", "worker_b": "citus-worker-1:5432",
+		}}},
+		{"sharded", CreateImageRequest{
+			Workers: models.WorkerNodes{"worker_a": "citus-worker-1:5432"},
+			Shards:  []string{"payments"},
+		}},
+		{"renamed databases", CreateImageRequest{
+			Workers:         models.WorkerNodes{"worker_a": "citus-worker-1:5432"},
+			RenameDatabases: models.DatabaseRenames{"payments_production": "payments"},
+		}},
 	}
 
-	imageStore := FakeImageStore{
-		_Get: func(id int) (models.Image, error) {
-			assert.Equal(t, 1, id)
-			return image, nil
-		},
-		_Destroy: func(i models.Image) error {
-			assert.Equal(t, image, i)
-			return nil
-		},
-	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := bytes.NewBuffer([]byte{})
+			tc.request.BackedUpAt = timestamp()
+			jsonapi.MarshalOnePayload(body, &tc.request)
+			req, recorder, _ := createRequest(t, "POST", "/images", body)
 
-	destroyedImages := make([]int, 0)
+			err := Images{}.Create(recorder, req)
 
-	instanceStore := FakeInstanceStore{
-		_List: func() ([]models.Instance, error) {
-			return []models.Instance{
-				models.Instance{ID: 1, ImageID: 1},
-				models.Instance{ID: 2, ImageID: 2},
-				models.Instance{ID: 3, ImageID: 1},
-			}, nil
-		},
-		_Destroy: func(instance models.Instance) error {
-			destroyedImages = append(destroyedImages, instance.ID)
-			return nil
-		},
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+			assert.Equal(t, "Invalid Workers", response.Title)
+		})
 	}
+}
 
-	executor := FakeExecutor{
-		_DestroyImage: func(ctx context.Context, imageID int) error {
-			assert.Equal(t, 1, imageID)
-			return nil
+func TestImageCreateReturnsErrorWithInvalidBackup(t *testing.T) {
+	testCases := []struct {
+		name     string
+		request  CreateImageRequest
+		expected api.Error
+	}{
+		{
+			"short checksum",
+			CreateImageRequest{BackupChecksum: "abc123"},
+			api.InvalidBackupChecksumError,
 		},
-		_DestroyInstance: func(context.Context, int) error {
-			return nil
+		{
+			"malformed LSN",
+			CreateImageRequest{BackupLSN: "9000028"},
+			api.InvalidBackupLSNError,
 		},
-	}
-
-	authenticator := auth.FakeAuthenticator{
-		MockAuthenticateRequest: func(r *http.Request) (string, string, error) {
-			return auth.UPLOAD_USER_EMAIL, "", nil
+		{
+			"LSN of sharded image",
+			CreateImageRequest{BackupLSN: "0/9000028", Shards: []string{"payments"}},
+			api.InvalidBackupLSNError,
 		},
 	}
 
-	errorHandler := FakeErrorHandler{}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := bytes.NewBuffer([]byte{})
+			tc.request.BackedUpAt = timestamp()
+			jsonapi.MarshalOnePayload(body, &tc.request)
+			req, recorder, _ := createRequest(t, "POST", "/images", body)
 
-	router := mux.NewRouter()
-	routeSet := Images{
-		ImageStore:    imageStore,
-		InstanceStore: instanceStore,
-		Executor:      executor,
+			err := Images{}.Create(recorder, req)
+
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+			assert.Equal(t, tc.expected, response)
+		})
+	}
+}
+
+func TestCreateImageWithFinaliseOptions(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateImageRequest{
+		BackedUpAt:      timestamp(),
+		Anon:            "SELECT * FROM foo;",
+		DropDatabases:   []string{"reporting"},
+		RenameDatabases: models.DatabaseRenames{"app_production": "app"},
+		Encoding:        "UTF8",
+		Locale:          "en_GB.UTF-8",
+	}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/images", body)
+
+	executor := FakeExecutor{
+		_CreateBtrfsSubvolume: func(ctx context.Context, id int) error { return nil },
+	}
+
+	store := FakeImageStore{
+		_Create: func(image models.Image) (models.Image, error) {
+			assert.Equal(t, []string{"reporting"}, image.DropDatabases)
+			assert.Equal(t, models.DatabaseRenames{"app_production": "app"}, image.RenameDatabases)
+			assert.Equal(t, "UTF8", image.Encoding)
+			assert.Equal(t, "en_GB.UTF-8", image.Locale)
+
+			image.ID = 1
+			return image, nil
+		},
+	}
+
+	err := Images{ImageStore: store, Executor: executor}.Create(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+}
+
+func TestImageCreateReturnsErrorWithInvalidFinaliseOptions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		request CreateImageRequest
+		detail  string
+	}{
+		{
+			"drop reserved database",
+			CreateImageRequest{DropDatabases: []string{"postgres"}},
+			"can't drop database \"postgres\"",
+		},
+		{
+			"drop database with quotes",
+			CreateImageRequest{DropDatabases: []string{`app"; DROP DATABASE payments; --`}},
+			"can't drop database \"app\\\"; DROP DATABASE payments; --\"",
+		},
+		{
+			"rename to non-string",
+			CreateImageRequest{RenameDatabases: models.DatabaseRenames{"app": float64(1)}},
+			"the new name of database \"app\" must be a string",
+		},
+		{
+			"rename template",
+			CreateImageRequest{RenameDatabases: models.DatabaseRenames{"template1": "app"}},
+			"can't rename database \"template1\" to \"app\"",
+		},
+		{
+			"rename dropped database",
+			CreateImageRequest{
+				DropDatabases:   []string{"app"},
+				RenameDatabases: models.DatabaseRenames{"app": "application"},
+			},
+			"database \"app\" can't be renamed to \"application\", as it conflicts with another drop or rename",
+		},
+		{
+			"rename onto renamed database",
+			CreateImageRequest{RenameDatabases: models.DatabaseRenames{"app": "payments", "payments": "payments_old"}},
+			"",
+		},
+		{
+			"invalid encoding",
+			CreateImageRequest{Encoding: "UTF-8; rm -rf /"},
+			"invalid encoding: \"UTF-8; rm -rf /\"",
+		},
+		{
+			"invalid locale",
+			CreateImageRequest{Locale: "en_GB UTF-8"},
+			"invalid locale: \"en_GB UTF-8\"",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := bytes.NewBuffer([]byte{})
+			tc.request.BackedUpAt = timestamp()
+			jsonapi.MarshalOnePayload(body, &tc.request)
+			req, recorder, _ := createRequest(t, "POST", "/images", body)
+
+			err := Images{}.Create(recorder, req)
+
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusBadRequest, recorder.Code)
+			assert.Equal(t, "Invalid Finalise Options", response.Title)
+			if tc.detail != "" {
+				assert.Equal(t, tc.detail, response.Detail)
+			}
+		})
+	}
+}
+
+func TestImageUploadOffset(t *testing.T) {
+	req, recorder, _ := createRequest(t, "HEAD", "/images/1/upload", nil)
+	req = asUploadUser(req)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_ImageUploadSize: func(ctx context.Context, id int) (int64, error) {
+			assert.Equal(t, 1, id)
+			return 1024, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/upload", errorHandler.Handle(routeSet.UploadOffset))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "1024", recorder.Header().Get("Upload-Offset"))
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageUpload(t *testing.T) {
+	testCases := []struct {
+		name           string
+		offset         string
+		image          models.Image
+		appendErr      error
+		expectedStatus int
+		expectedError  *api.Error
+		expectedOffset string
+	}{
+		{
+			name:           "appends to the upload",
+			offset:         "1024",
+			image:          models.Image{ID: 1},
+			expectedStatus: http.StatusNoContent,
+			expectedOffset: "1029",
+		},
+		{
+			name:           "missing offset",
+			offset:         "",
+			image:          models.Image{ID: 1},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  &api.InvalidUploadOffsetError,
+		},
+		{
+			name:           "negative offset",
+			offset:         "-1",
+			image:          models.Image{ID: 1},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  &api.InvalidUploadOffsetError,
+		},
+		{
+			name:           "ready image",
+			offset:         "0",
+			image:          models.Image{ID: 1, Ready: true},
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  &api.ImageUploadUnavailableError,
+		},
+		{
+			name:           "sharded image",
+			offset:         "0",
+			image:          models.Image{ID: 1, Shards: []string{"payments"}},
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  &api.ImageUploadUnavailableError,
+		},
+		{
+			name:           "started image",
+			offset:         "1024",
+			image:          models.Image{ID: 1},
+			appendErr:      exec.ErrImageStarted,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  &api.ImageUploadUnavailableError,
+		},
+		{
+			name:           "offset mismatch",
+			offset:         "1024",
+			image:          models.Image{ID: 1},
+			appendErr:      exec.ErrUploadOffsetMismatch,
+			expectedStatus: http.StatusConflict,
+			expectedError:  errorPtr(api.UploadConflictError("the upload is 2048 bytes, but Upload-Offset was 1024")),
+			expectedOffset: "2048",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "PATCH", "/images/1/upload", bytes.NewBufferString("hello"))
+			req = asUploadUser(req)
+			req.Header.Set("Upload-Offset", tc.offset)
+
+			store := FakeImageStore{
+				_Get: func(id int) (models.Image, error) {
+					return tc.image, nil
+				},
+			}
+
+			executor := FakeExecutor{
+				_AppendImageUpload: func(ctx context.Context, id int, offset int64, r io.Reader) (int64, error) {
+					assert.Equal(t, 1, id)
+					assert.Equal(t, int64(1024), offset)
+					if tc.appendErr != nil {
+						return 2048, tc.appendErr
+					}
+
+					body, err := ioutil.ReadAll(r)
+					assert.Nil(t, err)
+					assert.Equal(t, "hello", string(body))
+					return offset + int64(len(body)), nil
+				},
+			}
+
+			errorHandler := FakeErrorHandler{}
+			routeSet := Images{ImageStore: store, Executor: executor}
+			router := mux.NewRouter()
+			router.HandleFunc("/images/{id}/upload", errorHandler.Handle(routeSet.Upload))
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, tc.expectedStatus, recorder.Code)
+			assert.Equal(t, tc.expectedOffset, recorder.Header().Get("Upload-Offset"))
+			assert.Nil(t, errorHandler.Error)
+
+			if tc.expectedError != nil {
+				var response api.Error
+				decodeJSON(t, recorder.Body, &response)
+				assert.Equal(t, *tc.expectedError, response)
+			}
+		})
+	}
+}
+
+func TestImageUploadForbidden(t *testing.T) {
+	executor := FakeExecutor{
+		_ImageUploadSize: func(ctx context.Context, id int) (int64, error) {
+			t.Fatal("upload size was read")
+			return 0, nil
+		},
+		_AppendImageUpload: func(ctx context.Context, id int, offset int64, r io.Reader) (int64, error) {
+			t.Fatal("upload was appended to")
+			return 0, nil
+		},
+	}
+	routeSet := Images{ImageStore: FakeImageStore{}, Executor: executor}
+
+	for _, tc := range []struct {
+		method  string
+		handler func(http.ResponseWriter, *http.Request) error
+	}{
+		{"HEAD", routeSet.UploadOffset},
+		{"PATCH", routeSet.Upload},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, tc.method, "/images/1/upload", bytes.NewBufferString("hello"))
+			req.Header.Set("Upload-Offset", "0")
+
+			errorHandler := FakeErrorHandler{}
+			router := mux.NewRouter()
+			router.HandleFunc("/images/{id}/upload", errorHandler.Handle(tc.handler))
+			router.ServeHTTP(recorder, req)
+
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+
+			assert.Equal(t, http.StatusForbidden, recorder.Code)
+			assert.Equal(t, api.ForbiddenError, response)
+			assert.Nil(t, errorHandler.Error)
+		})
+	}
+}
+
+func TestImageReceiveStream(t *testing.T) {
+	testCases := []struct {
+		name           string
+		image          models.Image
+		receiveErr     error
+		expectedStatus int
+		expectedError  *api.Error
+	}{
+		{
+			name:           "receives the stream",
+			image:          models.Image{ID: 1},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "ready image",
+			image:          models.Image{ID: 1, Ready: true},
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  &api.ImageUploadUnavailableError,
+		},
+		{
+			name:           "distributed image",
+			image:          models.Image{ID: 1, Workers: models.WorkerNodes{"worker_a": "citus-worker-1:5432"}},
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  &api.ImageUploadUnavailableError,
+		},
+		{
+			name:           "started image",
+			image:          models.Image{ID: 1},
+			receiveErr:     exec.ErrImageStarted,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  &api.ImageUploadUnavailableError,
+		},
+		{
+			name:           "invalid stream",
+			image:          models.Image{ID: 1},
+			receiveErr:     exec.ErrInvalidImageStream,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  &api.InvalidImageStreamError,
+		},
+		{
+			name:           "upload not empty",
+			image:          models.Image{ID: 1},
+			receiveErr:     exec.ErrUploadNotEmpty,
+			expectedStatus: http.StatusConflict,
+			expectedError:  errorPtr(api.UploadConflictError(exec.ErrUploadNotEmpty.Error())),
+		},
+		{
+			name:           "stream in progress",
+			image:          models.Image{ID: 1},
+			receiveErr:     exec.ErrUploadInProgress,
+			expectedStatus: http.StatusConflict,
+			expectedError:  errorPtr(api.UploadConflictError(exec.ErrUploadInProgress.Error())),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "PUT", "/images/1/btrfs_stream", bytes.NewBufferString("stream"))
+			req = asUploadUser(req)
+
+			store := FakeImageStore{
+				_Get: func(id int) (models.Image, error) {
+					return tc.image, nil
+				},
+			}
+
+			executor := FakeExecutor{
+				_ReceiveImageStream: func(ctx context.Context, id int, r io.Reader) error {
+					assert.Equal(t, 1, id)
+					if tc.receiveErr != nil {
+						return tc.receiveErr
+					}
+
+					body, err := ioutil.ReadAll(r)
+					assert.Nil(t, err)
+					assert.Equal(t, "stream", string(body))
+					return nil
+				},
+			}
+
+			errorHandler := FakeErrorHandler{}
+			routeSet := Images{ImageStore: store, Executor: executor}
+			router := mux.NewRouter()
+			router.HandleFunc("/images/{id}/btrfs_stream", errorHandler.Handle(routeSet.ReceiveStream))
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, tc.expectedStatus, recorder.Code)
+			assert.Nil(t, errorHandler.Error)
+
+			if tc.expectedError != nil {
+				var response api.Error
+				decodeJSON(t, recorder.Body, &response)
+				assert.Equal(t, *tc.expectedError, response)
+			}
+		})
+	}
+}
+
+func TestImageReceiveStreamForbidden(t *testing.T) {
+	req, recorder, _ := createRequest(t, "PUT", "/images/1/btrfs_stream", bytes.NewBufferString("stream"))
+
+	executor := FakeExecutor{
+		_ReceiveImageStream: func(ctx context.Context, id int, r io.Reader) error {
+			t.Fatal("stream was received")
+			return nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: FakeImageStore{}, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/btrfs_stream", errorHandler.Handle(routeSet.ReceiveStream))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, api.ForbiddenError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func errorPtr(err api.Error) *api.Error {
+	return &err
+}
+
+func TestImageDone(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	image := models.Image{
+		ID:         1,
+		BackedUpAt: timestamp(),
+		Ready:      false,
+		CreatedAt:  timestamp(),
+		UpdatedAt:  timestamp(),
+	}
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			assert.Equal(t, 1, id)
+
+			return image, nil
+		},
+		_MarkAsReady: func(i models.Image) (models.Image, error) {
+			assert.Equal(t, image.ID, i.ID)
+			assert.Equal(t, emptyChecksum, i.SnapshotChecksum)
+
+			i.Ready = true
+			return i, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_FinaliseImage: func(ctx context.Context, i models.Image) error {
+			assert.Equal(t, image, i)
+
+			return nil
+		},
+		_InspectImageSnapshot: func(ctx context.Context, id int) (models.ImageInspection, error) {
+			assert.Equal(t, 1, id)
+			return models.ImageInspection{Checksum: emptyChecksum, ReadOnly: true}, nil
+		},
+	}
+
+	var spans []models.BakeSpan
+	var jobs []models.Job
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{
+		ImageStore:    store,
+		Executor:      executor,
+		BakeSpanStore: recordBakeSpans(&spans),
+		JobStore:      recordJobs(&jobs),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, doneImageFixture, response)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, []string{"finalise", "inspect_snapshot", "mark_as_ready"}, bakePhases(spans))
+	assert.Equal(t, 1, len(jobs))
+	assert.Equal(t, models.JobFinaliseImage, jobs[0].Kind)
+	assert.Equal(t, models.JobSucceeded, jobs[0].Status)
+}
+
+func TestImageDoneMarksImagePendingCanary(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	image := models.Image{ID: 1, BackedUpAt: timestamp(), CreatedAt: timestamp(), UpdatedAt: timestamp()}
+
+	var annotated bool
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return image, nil
+		},
+		_MarkAsReady: func(i models.Image) (models.Image, error) {
+			i.Ready = true
+			return i, nil
+		},
+		_Annotate: func(i models.Image, patch models.Annotations) (models.Image, error) {
+			assert.True(t, i.Ready, "the image is marked as pending once it's ready")
+			assert.Equal(t, models.Annotations{canary.StatusAnnotation: canary.StatusPending}, patch)
+
+			annotated = true
+			i.Annotations = patch
+			return i, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_FinaliseImage: func(ctx context.Context, i models.Image) error {
+			return nil
+		},
+		_InspectImageSnapshot: func(ctx context.Context, id int) (models.ImageInspection, error) {
+			return models.ImageInspection{Checksum: emptyChecksum, ReadOnly: true}, nil
+		},
+	}
+
+	var spans []models.BakeSpan
+	var jobs []models.Job
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{
+		ImageStore:    store,
+		Executor:      executor,
+		BakeSpanStore: recordBakeSpans(&spans),
+		JobStore:      recordJobs(&jobs),
+		Canary:        true,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.True(t, annotated)
+	assert.Equal(t, map[string]interface{}{canary.StatusAnnotation: canary.StatusPending}, response.Data.Attributes["annotations"])
+}
+
+func TestImageDoneSignsManifest(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	image := models.Image{ID: 1, BackedUpAt: timestamp(), Anon: "SELECT 1;"}
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return image, nil
+		},
+		_MarkAsReady: func(i models.Image) (models.Image, error) {
+			i.Ready = true
+			return i, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_FinaliseImage: func(ctx context.Context, i models.Image) error {
+			return nil
+		},
+		_InspectImageSnapshot: func(ctx context.Context, id int) (models.ImageInspection, error) {
+			return models.ImageInspection{Checksum: emptyChecksum, ReadOnly: true}, nil
+		},
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signed []models.ImageManifest
+	manifestStore := FakeImageManifestStore{
+		_Create: func(m models.ImageManifest) (models.ImageManifest, error) {
+			signed = append(signed, m)
+			return m, nil
+		},
+	}
+
+	var spans []models.BakeSpan
+	var jobs []models.Job
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{
+		ImageStore:     store,
+		Executor:       executor,
+		BakeSpanStore:  recordBakeSpans(&spans),
+		JobStore:       recordJobs(&jobs),
+		ManifestSigner: &manifest.Signer{Identity: "draupnir-test", Key: privateKey},
+		ManifestStore:  manifestStore,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, []string{"finalise", "inspect_snapshot", "sign_manifest", "mark_as_ready"}, bakePhases(spans))
+
+	assert.Equal(t, 1, len(signed))
+	assert.Equal(t, 1, signed[0].ImageID)
+	assert.Equal(t, emptyChecksum, signed[0].ContentHash)
+	assert.Equal(t, "draupnir-test", signed[0].Signer)
+	assert.Nil(t, manifest.Verify(signed[0], publicKey))
+}
+
+func TestImageManifest(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images/1/manifest", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			assert.Equal(t, 1, id)
+			return models.Image{ID: 1}, nil
+		},
+	}
+
+	manifestStore := FakeImageManifestStore{
+		_Get: func(imageID int) (models.ImageManifest, error) {
+			assert.Equal(t, 1, imageID)
+			return models.ImageManifest{
+				ImageID:      1,
+				Version:      1,
+				ContentHash:  emptyChecksum,
+				AnonHash:     "17db4fd369edb9244b9f91d9aeed145c3d04ad8ba6e95d06247f07a63527d11a",
+				BakerVersion: "1.0.0",
+				Signer:       "draupnir-test",
+				KeyID:        "0123456789abcdef",
+				SignedAt:     timestamp(),
+				Signature:    "c2lnbmF0dXJl",
+			}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, ManifestStore: manifestStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/manifest", errorHandler.Handle(routeSet.Manifest))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, "image_manifests", response.Data.Type)
+	assert.Equal(t, "1", response.Data.ID)
+	assert.Equal(t, "draupnir-test", response.Data.Attributes["signer"])
+	assert.Equal(t, "c2lnbmF0dXJl", response.Data.Attributes["signature"])
+}
+
+func TestImageManifestNotFound(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images/1/manifest", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1}, nil
+		},
+	}
+
+	manifestStore := FakeImageManifestStore{
+		_Get: func(imageID int) (models.ImageManifest, error) {
+			return models.ImageManifest{}, sql.ErrNoRows
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, ManifestStore: manifestStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/manifest", errorHandler.Handle(routeSet.Manifest))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.ManifestNotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+// recordBakeSpans returns a bake span store that appends each finished span to
+// spans
+func recordBakeSpans(spans *[]models.BakeSpan) FakeBakeSpanStore {
+	return FakeBakeSpanStore{
+		_Create: func(span models.BakeSpan) (models.BakeSpan, error) {
+			span.ID = len(*spans) + 1
+			return span, nil
+		},
+		_Finish: func(span models.BakeSpan) (models.BakeSpan, error) {
+			*spans = append(*spans, span)
+			return span, nil
+		},
+	}
+}
+
+// recordJobs returns a job store with no previous jobs, that appends each
+// finished job to jobs
+func recordJobs(jobs *[]models.Job) FakeJobStore {
+	return FakeJobStore{
+		_Create: func(job models.Job) (models.Job, error) {
+			job.ID = len(*jobs) + 1
+			return job, nil
+		},
+		_Finish: func(job models.Job) (models.Job, error) {
+			*jobs = append(*jobs, job)
+			return job, nil
+		},
+		_Latest: func(kind string, resourceID int) (models.Job, error) {
+			return models.Job{}, sql.ErrNoRows
+		},
+	}
+}
+
+// startWorkers returns workers that run operations, recording their jobs as
+// they finish. wait waits for n operations to finish, and stops the workers.
+func startWorkers(recorded *[]models.Job) (*jobs.Workers, func(n int)) {
+	finished := make(chan models.Job, 10)
+	store := FakeJobStore{
+		_Create: func(job models.Job) (models.Job, error) {
+			job.ID = 10
+			return job, nil
+		},
+		_Start: func(job models.Job) (models.Job, error) {
+			return job, nil
+		},
+		_Finish: func(job models.Job) (models.Job, error) {
+			finished <- job
+			return job, nil
+		},
+		_Latest: func(kind string, resourceID int) (models.Job, error) {
+			return models.Job{}, sql.ErrNoRows
+		},
+	}
+
+	logger, _ := NewFakeLogger()
+	workers := jobs.NewWorkers(logger, store, 1, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	go workers.Start(ctx)
+
+	return workers, func(n int) {
+		for i := 0; i < n; i++ {
+			*recorded = append(*recorded, <-finished)
+		}
+		cancel()
+	}
+}
+
+func bakePhases(spans []models.BakeSpan) []string {
+	phases := []string{}
+	for _, span := range spans {
+		phases = append(phases, span.Phase)
+	}
+	return phases
+}
+
+func TestImageDoneRecordsFailedPhase(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, BackedUpAt: timestamp()}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_FinaliseImage: func(ctx context.Context, i models.Image) error {
+			return errors.New("exit status 1")
+		},
+	}
+
+	var spans []models.BakeSpan
+	var exported []models.BakeSpan
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{
+		ImageStore:    store,
+		Executor:      executor,
+		BakeSpanStore: recordBakeSpans(&spans),
+		SpanExporter:  FakeSpanExporter{_Export: func(span models.BakeSpan) error { exported = append(exported, span); return nil }},
+		JobStore:      recordJobs(&[]models.Job{}),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	assert.EqualError(t, errorHandler.Error, "failed to finalise image: exit status 1")
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "finalise", spans[0].Phase)
+	assert.Equal(t, "exit status 1", spans[0].Error)
+	assert.NotNil(t, spans[0].FinishedAt)
+	assert.Equal(t, spans, exported)
+}
+
+func TestImageDoneWhenSpansCantBeRecorded(t *testing.T) {
+	req, recorder, logs := createRequest(t, "POST", "/images/1/done", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, BackedUpAt: timestamp()}, nil
+		},
+		_MarkAsReady: func(i models.Image) (models.Image, error) {
+			i.Ready = true
+			return i, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_FinaliseImage: func(ctx context.Context, i models.Image) error { return nil },
+		_InspectImageSnapshot: func(ctx context.Context, id int) (models.ImageInspection, error) {
+			return models.ImageInspection{Checksum: emptyChecksum, ReadOnly: true}, nil
+		},
+	}
+
+	spanStore := FakeBakeSpanStore{
+		_Create: func(span models.BakeSpan) (models.BakeSpan, error) {
+			return span, errors.New("connection refused")
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, Executor: executor, BakeSpanStore: spanStore, JobStore: recordJobs(&[]models.Job{})}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.Contains(t, logs.String(), "failed to record start of bake phase")
+}
+
+func TestImageTimeline(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images/1/timeline", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			assert.Equal(t, 1, id)
+			return models.Image{ID: 1}, nil
+		},
+	}
+
+	finishedAt := timestamp().Add(time.Hour)
+	spanStore := FakeBakeSpanStore{
+		_List: func(imageID int) ([]models.BakeSpan, error) {
+			assert.Equal(t, 1, imageID)
+			return []models.BakeSpan{
+				{ID: 1, ImageID: 1, Phase: "finalise", StartedAt: timestamp(), FinishedAt: &finishedAt},
+				{ID: 2, ImageID: 1, Phase: "inspect_snapshot", StartedAt: finishedAt},
+			}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, BakeSpanStore: spanStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/timeline", errorHandler.Handle(routeSet.Timeline))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, imageTimelineFixture, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageDoneWithStandbyEnabled(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	image := models.Image{ID: 1, BackedUpAt: timestamp(), Ready: false}
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return image, nil
+		},
+		_MarkAsReady: func(i models.Image) (models.Image, error) {
+			i.Ready = true
+			return i, nil
+		},
+	}
+
+	var snapshotted bool
+	executor := FakeExecutor{
+		_SnapshotImageBase: func(ctx context.Context, id int) error {
+			assert.Equal(t, 1, id)
+			snapshotted = true
+			return nil
+		},
+		_FinaliseImage: func(ctx context.Context, i models.Image) error {
+			assert.True(t, snapshotted, "base is snapshotted before finalisation")
+			return nil
+		},
+		_InspectImageSnapshot: func(ctx context.Context, id int) (models.ImageInspection, error) {
+			return models.ImageInspection{Checksum: emptyChecksum, ReadOnly: true}, nil
+		},
+	}
+
+	var spans []models.BakeSpan
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{
+		ImageStore:     store,
+		Executor:       executor,
+		StandbyEnabled: true,
+		BakeSpanStore:  recordBakeSpans(&spans),
+		JobStore:       recordJobs(&[]models.Job{}),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, snapshotted)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, []string{"snapshot_base", "finalise", "inspect_snapshot", "mark_as_ready"}, bakePhases(spans))
+}
+
+func TestImageDoneWithBackupMismatch(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	image := models.Image{ID: 1, BackedUpAt: timestamp(), BackupChecksum: emptyChecksum, BackupLSN: "0/9000028"}
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return image, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_InspectImageUpload: func(ctx context.Context, id int) (models.ImageInspection, error) {
+			assert.Equal(t, 1, id)
+			return models.ImageInspection{Checksum: emptyChecksum, StartLSN: "0/8000028"}, nil
+		},
+	}
+
+	var spans []models.BakeSpan
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{
+		ImageStore:    store,
+		Executor:      executor,
+		BakeSpanStore: recordBakeSpans(&spans),
+		JobStore:      recordJobs(&[]models.Job{}),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.BackupMismatchError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageDoneBlockedByGuardrail(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, BackedUpAt: timestamp()}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_FinaliseImage: func(ctx context.Context, i models.Image) error {
+			return nil
+		},
+		_RetrieveImageSettings: func(ctx context.Context, id int) ([]models.CloneSetting, error) {
+			assert.Equal(t, 1, id)
+			return []models.CloneSetting{
+				{Source: "foreign_server", Name: "app.payments", Value: "host=db.prod.example.com"},
+			}, nil
+		},
+	}
+
+	var spans []models.BakeSpan
+	var jobs []models.Job
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{
+		ImageStore:    store,
+		Executor:      executor,
+		BakeSpanStore: recordBakeSpans(&spans),
+		JobStore:      recordJobs(&jobs),
+		Guardrail:     guardrail.Scanner{Mode: guardrail.ModeBlock, ProductionHosts: []string{"*.prod.example.com"}},
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.ProductionReferencesError(
+		"image refers to production: foreign_server app.payments refers to production host db.prod.example.com",
+	), response)
+	assert.Nil(t, errorHandler.Error)
+	// The image isn't marked as ready
+	assert.Equal(t, []string{"finalise", "scan_settings"}, bakePhases(spans))
+	assert.Equal(t, models.JobFailed, jobs[0].Status)
+}
+
+func TestImageDoneWithFailedAnonymisation(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, BackedUpAt: timestamp()}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_FinaliseImage: func(ctx context.Context, i models.Image) error {
+			return exec.BakeError{Result: exec.BakeResult{
+				Phase:       "anonymise",
+				ExitCode:    3,
+				ErrorClass:  exec.ErrorClassAnonymisation,
+				Diagnostics: "line 110: psql failed with exit code 3",
+			}}
+		},
+	}
+
+	var spans []models.BakeSpan
+	var jobs []models.Job
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{
+		ImageStore:    store,
+		Executor:      executor,
+		BakeSpanStore: recordBakeSpans(&spans),
+		JobStore:      recordJobs(&jobs),
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.FinalisationFailedError(
+		"anonymisation error during anonymise (exit code 3): line 110: psql failed with exit code 3",
+	), response)
+	assert.Nil(t, errorHandler.Error)
+	// The error's class is recorded against the span and job that it failed
+	assert.Equal(t, []string{"finalise"}, bakePhases(spans))
+	assert.Equal(t, exec.ErrorClassAnonymisation, spans[0].ErrorClass)
+	assert.Equal(t, models.JobFailed, jobs[0].Status)
+	assert.Equal(t, exec.ErrorClassAnonymisation, jobs[0].ErrorClass)
+}
+
+func TestImageDoneAfterInterruptedFinalisation(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, BackedUpAt: timestamp()}, nil
+		},
+	}
+
+	jobStore := FakeJobStore{
+		_Latest: func(kind string, resourceID int) (models.Job, error) {
+			assert.Equal(t, models.JobFinaliseImage, kind)
+			assert.Equal(t, 1, resourceID)
+			return models.NewJob(kind, resourceID).Interrupt("server stopped"), nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, Executor: FakeExecutor{}, JobStore: jobStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.InterruptedFinalisationError("server stopped"), response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageDoneAsync(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+	req.Header.Set("Prefer", "respond-async")
+
+	image := models.Image{ID: 1, BackedUpAt: timestamp()}
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return image, nil
+		},
+		_MarkAsReady: func(i models.Image) (models.Image, error) {
+			i.Ready = true
+			return i, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_FinaliseImage: func(ctx context.Context, i models.Image) error {
+			return nil
+		},
+		_InspectImageSnapshot: func(ctx context.Context, id int) (models.ImageInspection, error) {
+			return models.ImageInspection{Checksum: emptyChecksum, ReadOnly: true}, nil
+		},
+	}
+
+	var recorded []models.Job
+	workers, wait := startWorkers(&recorded)
+
+	var spans []models.BakeSpan
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{
+		ImageStore:    store,
+		Executor:      executor,
+		BakeSpanStore: recordBakeSpans(&spans),
+		JobStore:      workers.JobStore,
+		Workers:       workers,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Equal(t, "respond-async", recorder.Header().Get("Preference-Applied"))
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, "operations", response.Data.Type)
+	assert.Equal(t, "10", response.Data.ID)
+	assert.Equal(t, models.JobQueued, response.Data.Attributes["status"])
+	assert.Equal(t, "images", response.Data.Attributes["resource_type"])
+
+	wait(1)
+	assert.Equal(t, models.JobFinaliseImage, recorded[0].Kind)
+	assert.Equal(t, models.JobSucceeded, recorded[0].Status)
+	assert.Equal(t, "test@draupnir", recorded[0].UserEmail)
+	assert.Equal(t, []string{"finalise", "inspect_snapshot", "mark_as_ready"}, bakePhases(spans))
+}
+
+func TestImageDoneWhileFinalising(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/done", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, BackedUpAt: timestamp()}, nil
+		},
+	}
+
+	jobStore := FakeJobStore{
+		_Latest: func(kind string, resourceID int) (models.Job, error) {
+			return models.NewQueuedJob(kind, resourceID, "test@draupnir"), nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, Executor: FakeExecutor{}, JobStore: jobStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(routeSet.Done))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusConflict, recorder.Code)
+	assert.Equal(t, api.OperationInProgressError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageDoneWithNonNumericID(t *testing.T) {
+	req, recorder, logs := createRequest(t, "POST", "/images/bad_id/done", nil)
+
+	errorHandler := FakeErrorHandler{}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/done", errorHandler.Handle(Images{}.Done))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Contains(t, logs.String(), "invalid syntax")
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageDestroy(t *testing.T) {
+	req, recorder, logs := createRequest(t, "DELETE", "/images/1", nil)
+
+	image := models.Image{
+		ID:         1,
+		BackedUpAt: timestamp(),
+		Ready:      false,
+		CreatedAt:  timestamp(),
+		UpdatedAt:  timestamp(),
+	}
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			assert.Equal(t, 1, id)
+
+			return image, nil
+		},
+		_Destroy: func(i models.Image) error {
+			assert.Equal(t, image, i)
+			return nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_DestroyImage: func(ctx context.Context, imageID int) error {
+			assert.Equal(t, 1, imageID)
+			return nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+
+	router := mux.NewRouter()
+	var jobs []models.Job
+	routeSet := Images{ImageStore: store, Executor: executor, JobStore: recordJobs(&jobs)}
+	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, 0, len(recorder.Body.Bytes()))
+	assert.Contains(t, logs.String(), "destroying image")
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, 1, len(jobs))
+	assert.Equal(t, models.JobDestroyImage, jobs[0].Kind)
+	assert.Equal(t, models.JobSucceeded, jobs[0].Status)
+}
+
+func TestImageDestroyFromUploadUser(t *testing.T) {
+	req, recorder, logs := createRequest(t, "DELETE", "/images/1", nil)
+
+	image := models.Image{
+		ID:         1,
+		BackedUpAt: timestamp(),
+		Ready:      false,
+		CreatedAt:  timestamp(),
+		UpdatedAt:  timestamp(),
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			assert.Equal(t, 1, id)
+			return image, nil
+		},
+		_Destroy: func(i models.Image) error {
+			assert.Equal(t, image, i)
+			return nil
+		},
+	}
+
+	destroyedImages := make([]int, 0)
+
+	instanceStore := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{
+				models.Instance{ID: 1, ImageID: 1},
+				models.Instance{ID: 2, ImageID: 2},
+				models.Instance{ID: 3, ImageID: 1},
+			}, nil
+		},
+		_Destroy: func(instance models.Instance) error {
+			destroyedImages = append(destroyedImages, instance.ID)
+			return nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_DestroyImage: func(ctx context.Context, imageID int) error {
+			assert.Equal(t, 1, imageID)
+			return nil
+		},
+		_DestroyInstance: func(context.Context, int) error {
+			return nil
+		},
+	}
+
+	authenticator := auth.FakeAuthenticator{
+		MockAuthenticateRequest: func(r *http.Request) (string, string, error) {
+			return auth.UPLOAD_USER_EMAIL, "", nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+
+	router := mux.NewRouter()
+	routeSet := Images{
+		ImageStore:    imageStore,
+		InstanceStore: instanceStore,
+		Executor:      executor,
+		JobStore:      recordJobs(&[]models.Job{}),
 	}
 	route := chain.New(errorHandler.Handle).
 		Add(middleware.Authenticate(authenticator)).
@@ -361,6 +1848,103 @@ func TestImageDestroyFromUploadUser(t *testing.T) {
 	assert.Nil(t, errorHandler.Error)
 }
 
+func TestImageStorage(t *testing.T) {
+	req, recorder, logs := createRequest(t, "GET", "/images/1/storage", nil)
+	req = asUploadUser(req)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			assert.Equal(t, 1, id)
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	instanceStore := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{
+				models.Instance{ID: 1, ImageID: 1},
+				models.Instance{ID: 2, ImageID: 2},
+				models.Instance{ID: 3, ImageID: 1},
+				models.Instance{ID: 4, ImageID: 1},
+			}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_RetrieveImageDiskUsage: func(ctx context.Context, id int) (models.DiskUsage, error) {
+			assert.Equal(t, 1, id)
+			return models.DiskUsage{TotalBytes: 4096, ExclusiveBytes: 0, SharedBytes: 4096}, nil
+		},
+		_RetrieveInstanceDiskUsage: func(ctx context.Context, id int) (models.DiskUsage, error) {
+			switch id {
+			case 1:
+				return models.DiskUsage{TotalBytes: 4096, ExclusiveBytes: 1024, SharedBytes: 3072}, nil
+			case 3:
+				return models.DiskUsage{TotalBytes: 4096, ExclusiveBytes: 2048, SharedBytes: 2048}, nil
+			default:
+				return models.DiskUsage{}, errors.New("no such subvolume")
+			}
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: imageStore, InstanceStore: instanceStore, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/storage", errorHandler.Handle(routeSet.Storage))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, imageStorageReportFixture, response)
+	assert.Contains(t, logs.String(), "no such subvolume")
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageStorageOnlyReportsOwnInstances(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images/1/storage", nil)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	instanceStore := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{
+				models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"},
+				models.Instance{ID: 2, ImageID: 1, UserEmail: "otheruser@draupnir"},
+			}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_RetrieveImageDiskUsage: func(ctx context.Context, id int) (models.DiskUsage, error) {
+			return models.DiskUsage{TotalBytes: 4096, SharedBytes: 4096}, nil
+		},
+		_RetrieveInstanceDiskUsage: func(ctx context.Context, id int) (models.DiskUsage, error) {
+			assert.Equal(t, 1, id, "another user's instance was inspected")
+			return models.DiskUsage{TotalBytes: 4096, ExclusiveBytes: 1024, SharedBytes: 3072}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: imageStore, InstanceStore: instanceStore, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/storage", errorHandler.Handle(routeSet.Storage))
+	router.ServeHTTP(recorder, req)
+
+	var response models.ImageStorageReport
+	assert.Nil(t, jsonapi.UnmarshalPayload(recorder.Body, &response))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, 1, response.InstanceCount)
+	assert.Equal(t, int64(1024), response.InstanceExclusiveBytes)
+	assert.Nil(t, errorHandler.Error)
+}
+
 func timestamp() time.Time {
 	loc, err := time.LoadLocation("UTC")
 	if err != nil {
@@ -368,3 +1952,499 @@ func timestamp() time.Time {
 	}
 	return time.Date(2016, 1, 1, 12, 33, 44, 567000000, loc)
 }
+
+func TestImageAnnotate(t *testing.T) {
+	body := bytes.NewBufferString(`{"data": {"type": "images", "attributes": {"annotations": {"cursor": "42", "stale": null}}}}`)
+	req, recorder, _ := createRequest(t, "PATCH", "/images/1", body)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			assert.Equal(t, 1, id)
+			return models.Image{ID: 1, Annotations: models.Annotations{"stale": "yes"}}, nil
+		},
+		_Annotate: func(image models.Image, patch models.Annotations) (models.Image, error) {
+			assert.Equal(t, models.Annotations{"cursor": "42", "stale": nil}, patch)
+			image.Annotations = models.Annotations{"cursor": "42"}
+			return image, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Annotate))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, map[string]interface{}{"cursor": "42"}, response.Data.Attributes["annotations"])
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageAnnotateWithInvalidAnnotations(t *testing.T) {
+	body := bytes.NewBufferString(`{"data": {"type": "images", "attributes": {"annotations": {"cursor": 42}}}}`)
+	req, recorder, _ := createRequest(t, "PATCH", "/images/1", body)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Annotate))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.InvalidAnnotationsError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageAnnotateWhenTooLarge(t *testing.T) {
+	body := bytes.NewBufferString(`{"data": {"type": "images", "attributes": {"annotations": {"cursor": "42"}}}}`)
+	req, recorder, _ := createRequest(t, "PATCH", "/images/1", body)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1}, nil
+		},
+		_Annotate: func(image models.Image, patch models.Annotations) (models.Image, error) {
+			return image, errors.New(`pq: new row for relation "images" violates check constraint "images_annotations_size"`)
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Annotate))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.AnnotationsTooLargeError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageLabel(t *testing.T) {
+	body := bytes.NewBufferString(`{"data": {"type": "images", "attributes": {"labels": {"cluster": "payments-eu", "anon_version": null}}}}`)
+	req, recorder, _ := createRequest(t, "PATCH", "/images/1", body)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Labels: models.Labels{"anon_version": "2"}}, nil
+		},
+		_Annotate: func(image models.Image, patch models.Annotations) (models.Image, error) {
+			assert.Empty(t, patch)
+			return image, nil
+		},
+		_Label: func(image models.Image, patch models.Labels) (models.Image, error) {
+			assert.Equal(t, models.Labels{"cluster": "payments-eu", "anon_version": nil}, patch)
+			image.Labels = models.Labels{"cluster": "payments-eu"}
+			return image, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Annotate))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, map[string]interface{}{"cluster": "payments-eu"}, response.Data.Attributes["labels"])
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageLabelWithInvalidLabels(t *testing.T) {
+	for _, labels := range []string{`{"cluster": 42}`, `{"cluster": "payments eu"}`, `{"": "payments"}`} {
+		body := bytes.NewBufferString(`{"data": {"type": "images", "attributes": {"labels": ` + labels + `}}}`)
+		req, recorder, _ := createRequest(t, "PATCH", "/images/1", body)
+
+		store := FakeImageStore{
+			_Get: func(id int) (models.Image, error) {
+				return models.Image{ID: 1}, nil
+			},
+		}
+
+		errorHandler := FakeErrorHandler{}
+		routeSet := Images{ImageStore: store}
+		router := mux.NewRouter()
+		router.HandleFunc("/images/{id}", errorHandler.Handle(routeSet.Annotate))
+		router.ServeHTTP(recorder, req)
+
+		var response api.Error
+		decodeJSON(t, recorder.Body, &response)
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, labels)
+		assert.Equal(t, api.InvalidLabelsError, response)
+		assert.Nil(t, errorHandler.Error)
+	}
+}
+
+func TestImageVerify(t *testing.T) {
+	testCases := []struct {
+		name     string
+		snapshot models.ImageInspection
+		verified bool
+	}{
+		{"intact", models.ImageInspection{Checksum: emptyChecksum, ReadOnly: true}, true},
+		{"modified", models.ImageInspection{Checksum: "0a1b2c", ReadOnly: true}, false},
+		{"writable", models.ImageInspection{Checksum: emptyChecksum, ReadOnly: false}, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "POST", "/images/1/verify", nil)
+
+			store := FakeImageStore{
+				_Get: func(id int) (models.Image, error) {
+					return models.Image{ID: 1, Ready: true, SnapshotChecksum: emptyChecksum}, nil
+				},
+			}
+
+			executor := FakeExecutor{
+				_InspectImageSnapshot: func(ctx context.Context, id int) (models.ImageInspection, error) {
+					assert.Equal(t, 1, id)
+					return tc.snapshot, nil
+				},
+			}
+
+			errorHandler := FakeErrorHandler{}
+			routeSet := Images{ImageStore: store, Executor: executor}
+			router := mux.NewRouter()
+			router.HandleFunc("/images/{id}/verify", errorHandler.Handle(routeSet.Verify))
+			router.ServeHTTP(recorder, req)
+
+			var response jsonapi.OnePayload
+			decodeJSON(t, recorder.Body, &response)
+
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, "image_verifications", response.Data.Type)
+			assert.Equal(t, tc.verified, response.Data.Attributes["verified"])
+			assert.Nil(t, errorHandler.Error)
+		})
+	}
+}
+
+func TestImageFile(t *testing.T) {
+	testCases := []struct {
+		name           string
+		path           string
+		ready          bool
+		readErr        error
+		expectedStatus int
+		expectedError  *api.Error
+	}{
+		{"allowed file", "PG_VERSION", true, nil, http.StatusOK, nil},
+		{"missing file", "backup_label", true, exec.ErrImageFileNotFound, http.StatusNotFound, &api.ImageFileNotFoundError},
+		{"unready image", "PG_VERSION", false, nil, http.StatusUnprocessableEntity, &api.UnreadyImageError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "GET", "/images/1/files/"+tc.path, nil)
+
+			store := FakeImageStore{
+				_Get: func(id int) (models.Image, error) {
+					return models.Image{ID: 1, Ready: tc.ready}, nil
+				},
+			}
+
+			executor := FakeExecutor{
+				_ReadImageFile: func(ctx context.Context, id int, name string) (models.ImageFile, error) {
+					assert.Equal(t, 1, id)
+					assert.Equal(t, tc.path, name)
+					return models.ImageFile{ID: name, ImageID: id, Content: "11\n"}, tc.readErr
+				},
+			}
+
+			errorHandler := FakeErrorHandler{}
+			routeSet := Images{ImageStore: store, Executor: executor}
+			router := mux.NewRouter()
+			router.HandleFunc("/images/{id}/files/{path}", errorHandler.Handle(routeSet.File))
+			router.ServeHTTP(recorder, req)
+
+			assert.Equal(t, tc.expectedStatus, recorder.Code)
+			assert.Nil(t, errorHandler.Error)
+
+			if tc.expectedError != nil {
+				var response api.Error
+				decodeJSON(t, recorder.Body, &response)
+				assert.Equal(t, *tc.expectedError, response)
+				return
+			}
+
+			var response jsonapi.OnePayload
+			decodeJSON(t, recorder.Body, &response)
+			assert.Equal(t, "image_files", response.Data.Type)
+			assert.Equal(t, "PG_VERSION", response.Data.ID)
+			assert.Equal(t, "11\n", response.Data.Attributes["content"])
+			assert.NotEmpty(t, recorder.Header().Get("ETag"))
+		})
+	}
+}
+
+func TestImageFileNotAllowed(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/images/1/files/.draupnir-connections", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store, Executor: FakeExecutor{}}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/files/{path}", errorHandler.Handle(routeSet.File))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, "Image File Not Allowed", response.Title)
+	assert.Contains(t, response.Detail, "PG_VERSION, backup_label")
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestImageVerifyWhenUnready(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/images/1/verify", nil)
+
+	store := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: false}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Images{ImageStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/images/{id}/verify", errorHandler.Handle(routeSet.Verify))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.UnreadyImageError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func pruneRequest(t *testing.T, body, user string) (*http.Request, *httptest.ResponseRecorder) {
+	req, recorder, _ := createRequest(t, "POST", "/images/prune", bytes.NewBufferString(body))
+	return req.WithContext(context.WithValue(req.Context(), middleware.AuthUserKey, user)), recorder
+}
+
+func TestImagePrune(t *testing.T) {
+	now := time.Now()
+	images := []models.Image{
+		{ID: 1, Ready: true, BackedUpAt: now.Add(-60 * 24 * time.Hour)},
+		{ID: 2, Ready: true, BackedUpAt: now.Add(-45 * 24 * time.Hour)},
+		{ID: 3, Ready: true, BackedUpAt: now.Add(-40 * 24 * time.Hour)},
+		{ID: 4, Ready: true, BackedUpAt: now.Add(-24 * time.Hour)},
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		destroyed := []int{}
+		imageStore := FakeImageStore{
+			_List: func() ([]models.Image, error) {
+				return images, nil
+			},
+			_Destroy: func(image models.Image) error {
+				destroyed = append(destroyed, image.ID)
+				return nil
+			},
+		}
+		instanceStore := FakeInstanceStore{
+			_List: func() ([]models.Instance, error) {
+				return []models.Instance{{ID: 1, ImageID: 2}}, nil
+			},
+		}
+		executor := FakeExecutor{
+			_DestroyImage: func(ctx context.Context, imageID int) error {
+				return nil
+			},
+		}
+
+		req, recorder := pruneRequest(t, fmt.Sprintf(`{"data": {"type": "prune_images_requests", "attributes": {
+			"older_than": "720h",
+			"dry_run": %t
+		}}}`, dryRun), auth.UPLOAD_USER_EMAIL)
+
+		var jobs []models.Job
+		routeSet := Images{ImageStore: imageStore, InstanceStore: instanceStore, Executor: executor, JobStore: recordJobs(&jobs)}
+		err := routeSet.Prune(recorder, req)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		var response jsonapi.ManyPayload
+		decodeJSON(t, recorder.Body, &response)
+		pruned := []string{}
+		for _, image := range response.Data {
+			pruned = append(pruned, image.ID)
+		}
+		// Image 2 has an instance, and image 4 is too new
+		assert.Equal(t, []string{"1", "3"}, pruned)
+
+		if dryRun {
+			assert.Empty(t, destroyed)
+			assert.Empty(t, jobs)
+		} else {
+			assert.Equal(t, []int{1, 3}, destroyed)
+			assert.Len(t, jobs, 2)
+		}
+	}
+}
+
+func TestImagePruneInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		attributes string
+		detail     string
+	}{
+		{`"dry_run": true`, "older_than or keep_last must be given"},
+		{`"older_than": "a month"`, "older_than must be a positive duration, e.g. 720h"},
+		{`"keep_last": -1`, "keep_last must not be negative"},
+	} {
+		req, recorder := pruneRequest(t, `{"data": {"type": "prune_images_requests", "attributes": {`+tc.attributes+`}}}`, auth.UPLOAD_USER_EMAIL)
+
+		err := Images{}.Prune(recorder, req)
+		assert.Nil(t, err)
+
+		var response api.Error
+		decodeJSON(t, recorder.Body, &response)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Equal(t, api.InvalidPruneError(tc.detail), response)
+	}
+}
+
+func TestImagePruneForbidden(t *testing.T) {
+	req, recorder := pruneRequest(t, `{"data": {"type": "prune_images_requests", "attributes": {"keep_last": 1}}}`, "test@draupnir")
+
+	err := Images{}.Prune(recorder, req)
+	assert.Nil(t, err)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, api.ForbiddenError, response)
+}
+
+func TestImageSend(t *testing.T) {
+	now := time.Now()
+	payments := models.Annotations{"draupnir/family": "payments"}
+	images := map[int]models.Image{
+		2: {ID: 2, Ready: true, BackedUpAt: now.Add(-48 * time.Hour), Annotations: payments},
+		3: {ID: 3, Ready: true, BackedUpAt: now.Add(-24 * time.Hour), Annotations: payments},
+		4: {ID: 4, Ready: true, BackedUpAt: now.Add(-12 * time.Hour), Annotations: models.Annotations{"draupnir/family": "ledger"}},
+		5: {ID: 5, Ready: true, BackedUpAt: now, Annotations: payments},
+		6: {ID: 6, Ready: true, BackedUpAt: now.Add(24 * time.Hour), Annotations: payments},
+		7: {ID: 7, Ready: false, BackedUpAt: now.Add(-1 * time.Hour), Annotations: payments},
+	}
+
+	testCases := []struct {
+		name           string
+		query          string
+		expectedParent int
+	}{
+		{"without parents", "", 0},
+		{"with the latest earlier image of the family", "?parents=2,3,4,6,7,99", 3},
+		{"without an earlier image of the family", "?parents=4,6", 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "GET", "/images/5/send"+tc.query, nil)
+			req = req.WithContext(context.WithValue(req.Context(), middleware.AuthUserKey, auth.UPLOAD_USER_EMAIL))
+
+			routeSet := Images{
+				ImageStore: FakeImageStore{
+					_Get: func(id int) (models.Image, error) {
+						image, ok := images[id]
+						if !ok {
+							return image, sql.ErrNoRows
+						}
+						return image, nil
+					},
+				},
+				Executor: FakeExecutor{
+					_SendImage: func(ctx context.Context, id int, parentID int, w io.Writer) error {
+						assert.Equal(t, 5, id)
+						assert.Equal(t, tc.expectedParent, parentID)
+						_, err := io.WriteString(w, "btrfs-stream")
+						return err
+					},
+				},
+			}
+
+			errorHandler := FakeErrorHandler{}
+			router := mux.NewRouter()
+			router.HandleFunc("/images/{id}/send", errorHandler.Handle(routeSet.Send))
+			router.ServeHTTP(recorder, req)
+
+			assert.Nil(t, errorHandler.Error)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, "application/octet-stream", recorder.Header().Get("Content-Type"))
+			assert.Equal(t, "btrfs-stream", recorder.Body.String())
+			if tc.expectedParent == 0 {
+				assert.Equal(t, "", recorder.Header().Get(SendParentHeader))
+			} else {
+				assert.Equal(t, fmt.Sprintf("%d", tc.expectedParent), recorder.Header().Get(SendParentHeader))
+			}
+		})
+	}
+}
+
+func TestImageSendErrors(t *testing.T) {
+	testCases := []struct {
+		name           string
+		user           string
+		query          string
+		ready          bool
+		expectedStatus int
+		expectedError  api.Error
+	}{
+		{"another user", "test@draupnir", "", true, http.StatusForbidden, api.ForbiddenError},
+		{"unready image", auth.UPLOAD_USER_EMAIL, "", false, http.StatusUnprocessableEntity, api.UnreadyImageError},
+		{"invalid parents", auth.UPLOAD_USER_EMAIL, "?parents=a", true, http.StatusBadRequest, api.BadImageIDError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "GET", "/images/1/send"+tc.query, nil)
+			req = req.WithContext(context.WithValue(req.Context(), middleware.AuthUserKey, tc.user))
+
+			routeSet := Images{
+				ImageStore: FakeImageStore{
+					_Get: func(id int) (models.Image, error) {
+						return models.Image{ID: 1, Ready: tc.ready}, nil
+					},
+				},
+			}
+
+			errorHandler := FakeErrorHandler{}
+			router := mux.NewRouter()
+			router.HandleFunc("/images/{id}/send", errorHandler.Handle(routeSet.Send))
+			router.ServeHTTP(recorder, req)
+
+			assert.Nil(t, errorHandler.Error)
+			assert.Equal(t, tc.expectedStatus, recorder.Code)
+
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+			assert.Equal(t, tc.expectedError, response)
+		})
+	}
+}
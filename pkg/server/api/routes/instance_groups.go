@@ -0,0 +1,430 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	promlog "github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/guardrail"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// MaxInstanceGroupSize is the most instances that a group can be created with
+const MaxInstanceGroupSize = 10
+
+// CreateInstanceGroupRequest lists the images to create a group's instances
+// from, either by ID or as the image families whose latest ready images
+// should be used. Each entry creates one instance.
+type CreateInstanceGroupRequest struct {
+	ImageIDs []string `jsonapi:"attr,image_ids"`
+	Families []string `jsonapi:"attr,families"`
+}
+
+// CreateGroup creates an instance from each of the requested images. Either
+// every instance is created, or those that were created are destroyed again.
+func (i Instances) CreateGroup(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	req := CreateInstanceGroupRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	size := len(req.ImageIDs) + len(req.Families)
+	if size == 0 {
+		api.InvalidInstanceGroupError("image_ids or families must list at least one image").Render(w, http.StatusBadRequest)
+		return nil
+	}
+	if size > MaxInstanceGroupSize {
+		api.InvalidInstanceGroupError("groups can have at most 10 instances").Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	images := make([]models.Image, 0, size)
+	for _, imageID := range req.ImageIDs {
+		id, err := strconv.Atoi(imageID)
+		if err != nil {
+			logger.Info(err.Error())
+			api.BadImageIDError.Render(w, http.StatusBadRequest)
+			return nil
+		}
+
+		image, err := i.ImageStore.Get(id)
+		if err != nil {
+			api.ImageNotFoundError.Render(w, http.StatusNotFound)
+			return nil
+		}
+		images = append(images, image)
+	}
+
+	if len(req.Families) > 0 {
+		all, err := i.ImageStore.List()
+		if err != nil {
+			return errors.Wrap(err, "failed to get images")
+		}
+
+		latest := freshness.Latest(all)
+		for _, family := range req.Families {
+			image, ok := latest[family]
+			if !ok {
+				api.NoReadyImageError(family).Render(w, http.StatusUnprocessableEntity)
+				return nil
+			}
+			images = append(images, image)
+		}
+	}
+
+	// Every image is checked before any instance is created, so that we rarely
+	// have to roll back
+	for _, image := range images {
+		if !image.Ready {
+			api.UnreadyImageError.Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+
+		if ok, err := i.checkAccess(w, logger, email, image); !ok {
+			return err
+		}
+
+		stale, err := i.AnonSpecs.Blocks(image)
+		if err != nil {
+			return errors.Wrap(err, "failed to check image anonymisation")
+		}
+		if stale {
+			api.StaleAnonymisationError(freshness.Family(image)).Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+
+		if i.Guardrail.Enabled() {
+			err = scanImageSettings(r.Context(), logger, i.Executor, i.Guardrail, image.ID)
+			if blocked, ok := errors.Cause(err).(guardrail.BlockedError); ok {
+				api.ProductionReferencesError(blocked.Error()).Render(w, http.StatusUnprocessableEntity)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if ok, err := i.checkQuota(w, logger, email, len(images)); !ok {
+		return err
+	}
+
+	// The instances share a creation time, so that they expire together
+	now := time.Now()
+	instances := make([]models.Instance, 0, len(images))
+	for _, image := range images {
+		instance, err := i.launch(r, logger, email, image, false, false, now)
+		if instance.ID != 0 {
+			instances = append(instances, instance)
+		}
+		if err == nil && !instance.ProxyRequired {
+			err = i.attachCredentials(r, &instances[len(instances)-1])
+		}
+		if err != nil {
+			i.rollBack(logger, instances)
+			if err == errImageDestroyed {
+				api.ImageNotFoundError.Render(w, http.StatusNotFound)
+				return nil
+			}
+			return err
+		}
+	}
+
+	group, err := i.InstanceGroupStore.Create(models.NewInstanceGroup(email, instances))
+	if err != nil {
+		i.rollBack(logger, instances)
+		return errors.Wrap(err, "failed to create instance group")
+	}
+
+	logger.With("instance_group", group.ID).With("instances", group.InstanceIDs).Info("created instance group")
+
+	w.WriteHeader(http.StatusCreated)
+	return errors.Wrap(
+		marshalOne(r, w, &group),
+		"failed to marshal instance group",
+	)
+}
+
+// rollBack destroys the instances of a group that couldn't be created. It
+// doesn't use the request's context, so that the instances are still destroyed
+// if the client has gone away.
+func (i Instances) rollBack(logger promlog.Logger, instances []models.Instance) {
+	for _, instance := range instances {
+		if err := i.destroy(context.Background(), logger, instance); err != nil {
+			logger.With("instance", instance.ID).With("error", err).Error("failed to roll back instance group")
+		}
+	}
+}
+
+// ListGroups lists the user's instance groups that still have instances,
+// without their instances' credentials
+func (i Instances) ListGroups(w http.ResponseWriter, r *http.Request) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	groups, err := i.InstanceGroupStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to get instance groups")
+	}
+
+	instances, err := i.InstanceStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to get instances")
+	}
+
+	byID := map[string]*models.Instance{}
+	for idx, instance := range instances {
+		byID[strconv.Itoa(instance.ID)] = &instances[idx]
+	}
+
+	_groups := make([]*models.InstanceGroup, 0)
+	for idx, group := range groups {
+		if group.UserEmail != email {
+			continue
+		}
+
+		groups[idx].Instances = make([]*models.Instance, 0, len(group.InstanceIDs))
+		for _, instanceID := range group.InstanceIDs {
+			if instance, ok := byID[instanceID]; ok {
+				groups[idx].Instances = append(groups[idx].Instances, instance)
+			}
+		}
+
+		if len(groups[idx].Instances) > 0 {
+			_groups = append(_groups, &groups[idx])
+		}
+	}
+
+	return errors.Wrap(
+		marshalMany(r, w, _groups),
+		"failed to marshal instance groups",
+	)
+}
+
+// GetGroup returns the instance group, with the credentials of its instances
+func (i Instances) GetGroup(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	group, ok := i.getGroup(w, r, logger, email, false)
+	if !ok {
+		return nil
+	}
+
+	instances, err := i.groupInstances(group)
+	if err != nil {
+		return err
+	}
+
+	for idx := range instances {
+		instance := &instances[idx]
+		if len(i.Policies) > 0 {
+			image, err := i.ImageStore.Get(instance.ImageID)
+			if err != nil {
+				return errors.Wrap(err, "failed to get image")
+			}
+			_, instance.ProxyRequired = i.Policies.For(image)
+		}
+
+		if !instance.ProxyRequired {
+			if err := i.attachCredentials(r, instance); err != nil {
+				return err
+			}
+		}
+		group.Instances = append(group.Instances, instance)
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &group),
+		"failed to marshal instance group",
+	)
+}
+
+// ExtendGroup extends the expiry of every instance in the group, so that they
+// still expire together
+func (i Instances) ExtendGroup(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	group, ok := i.getGroup(w, r, logger, email, false)
+	if !ok {
+		return nil
+	}
+
+	req := ExtendInstanceRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	by, err := time.ParseDuration(req.By)
+	if err != nil || by <= 0 {
+		api.InvalidExtensionError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if group.ExpiresAt == nil {
+		api.InstanceNeverExpiresError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	from := time.Now()
+	if group.ExpiresAt.After(from) {
+		from = *group.ExpiresAt
+	}
+	expiresAt := from.Add(by)
+
+	instances, err := i.groupInstances(group)
+	if err != nil {
+		return err
+	}
+
+	logger.With("instance_group", group.ID).With("by", by).Info("extending instance group")
+	for idx := range instances {
+		instance, err := i.InstanceStore.Extend(instances[idx], expiresAt)
+		if err != nil {
+			return errors.Wrap(err, "failed to extend instance")
+		}
+		i.Events.Publish(events.InstanceEvent(events.Updated, instance))
+		group.Instances = append(group.Instances, &instance)
+	}
+
+	group, err = i.InstanceGroupStore.Extend(group, expiresAt)
+	if err != nil {
+		return errors.Wrap(err, "failed to extend instance group")
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &group),
+		"failed to marshal instance group",
+	)
+}
+
+// DestroyGroup destroys every instance in the group, and then the group. If
+// any instance can't be destroyed, the group is kept so that it can be
+// destroyed again.
+func (i Instances) DestroyGroup(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	group, ok := i.getGroup(w, r, logger, email, true)
+	if !ok {
+		return nil
+	}
+
+	instances, err := i.groupInstances(group)
+	if err != nil {
+		return err
+	}
+
+	logger = logger.With("instance_group", group.ID)
+	var destroyErr error
+	for _, instance := range instances {
+		if err := i.destroy(r.Context(), logger, instance); err != nil {
+			logger.With("instance", instance.ID).With("error", err).Error("failed to destroy instance in group")
+			destroyErr = err
+		}
+	}
+	if destroyErr != nil {
+		return destroyErr
+	}
+
+	if err := i.InstanceGroupStore.Destroy(group); err != nil {
+		return errors.Wrap(err, "failed to destroy instance group")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// getGroup returns the group named by the request's path if it belongs to the
+// user, or to anyone if allowAdmin is set and the user is an admin. Otherwise
+// it renders a 404.
+func (i Instances) getGroup(w http.ResponseWriter, r *http.Request, logger promlog.Logger, email string, allowAdmin bool) (models.InstanceGroup, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return models.InstanceGroup{}, false
+	}
+
+	group, err := i.InstanceGroupStore.Get(id)
+	if err != nil {
+		logger.With("instance_group", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return models.InstanceGroup{}, false
+	}
+
+	if email != group.UserEmail && !(allowAdmin && auth.IsAdmin(email)) {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return models.InstanceGroup{}, false
+	}
+
+	return group, true
+}
+
+// groupInstances returns the group's instances that haven't been destroyed,
+// e.g. by expiring
+func (i Instances) groupInstances(group models.InstanceGroup) ([]models.Instance, error) {
+	instances := make([]models.Instance, 0, len(group.InstanceIDs))
+	for _, instanceID := range group.InstanceIDs {
+		id, _ := strconv.Atoi(instanceID)
+		instance, err := i.InstanceStore.Get(id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return instances, errors.Wrap(err, "failed to get instance")
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
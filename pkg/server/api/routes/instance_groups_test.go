@@ -0,0 +1,316 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// instanceGroupRouteSet creates instances with sequential IDs from the images,
+// recording the IDs of those it destroys
+func instanceGroupRouteSet(t *testing.T, images []models.Image, destroyed *[]int) Instances {
+	var created []models.Instance
+
+	return Instances{
+		InstanceStore: FakeInstanceStore{
+			_Create: func(instance models.Instance) (models.Instance, error) {
+				instance.ID = len(created) + 1
+				created = append(created, instance)
+				return instance, nil
+			},
+			_Destroy: func(instance models.Instance) error {
+				*destroyed = append(*destroyed, instance.ID)
+				return nil
+			},
+		},
+		ImageStore: FakeImageStore{
+			_Get: func(id int) (models.Image, error) {
+				for _, image := range images {
+					if image.ID == id {
+						return image, nil
+					}
+				}
+				return models.Image{}, sql.ErrNoRows
+			},
+			_List: func() ([]models.Image, error) {
+				return images, nil
+			},
+		},
+		WhitelistedAddressStore: FakeWhitelistedAddressStore{
+			_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+				return addr, nil
+			},
+		},
+		Executor: FakeExecutor{
+			_CreateInstance: func(ctx context.Context, imageID, instanceID, port int, address string, schemaOnly bool) error {
+				return nil
+			},
+			_DestroyInstance: func(ctx context.Context, instanceID int) error {
+				return nil
+			},
+			_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+				return fakeCredentialsMap, nil
+			},
+		},
+		ApplyWhitelist:  func(string) {},
+		MinInstancePort: 5432,
+		MaxInstancePort: 5435,
+		Ledger:          fakeLedger(t, models.LeasePort),
+		JobStore:        recordJobs(&[]models.Job{}),
+		TTL:             24 * time.Hour,
+	}
+}
+
+var instanceGroupImages = []models.Image{
+	{ID: 1, Ready: true, BackedUpAt: timestamp(), Annotations: models.Annotations{freshness.FamilyAnnotation: "payments"}},
+	{ID: 2, Ready: true, BackedUpAt: timestamp(), Annotations: models.Annotations{freshness.FamilyAnnotation: "ledger"}},
+	{ID: 3, Ready: false, BackedUpAt: timestamp().Add(time.Hour), Annotations: models.Annotations{freshness.FamilyAnnotation: "ledger"}},
+}
+
+func TestInstanceGroupCreate(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/instance_groups", bytes.NewBufferString(
+		`{"data": {"type": "instance_groups", "attributes": {"families": ["payments", "ledger"]}}}`,
+	))
+
+	var destroyed []int
+	routeSet := instanceGroupRouteSet(t, instanceGroupImages, &destroyed)
+	routeSet.InstanceGroupStore = FakeInstanceGroupStore{
+		_Create: func(group models.InstanceGroup) (models.InstanceGroup, error) {
+			assert.Equal(t, "test@draupnir", group.UserEmail)
+			assert.Equal(t, []string{"1", "2"}, group.InstanceIDs)
+			if assert.NotNil(t, group.ExpiresAt) {
+				assert.Equal(t, group.CreatedAt.Add(24*time.Hour), *group.ExpiresAt)
+			}
+			// The instances expire together
+			assert.Equal(t, group.Instances[0].ExpiresAt, group.Instances[1].ExpiresAt)
+			assert.Equal(t, 1, group.Instances[0].ImageID)
+			assert.Equal(t, 2, group.Instances[1].ImageID)
+			group.ID = 1
+			return group, nil
+		},
+	}
+
+	err := routeSet.CreateGroup(recorder, req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Empty(t, destroyed)
+
+	var group models.InstanceGroup
+	assert.Nil(t, jsonapi.UnmarshalPayload(recorder.Body, &group))
+	assert.Equal(t, 1, group.ID)
+	if assert.Len(t, group.Instances, 2) {
+		assert.NotNil(t, group.Instances[0].Credentials)
+		assert.NotNil(t, group.Instances[1].Credentials)
+	}
+}
+
+func TestInstanceGroupCreateRollsBack(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/instance_groups", bytes.NewBufferString(
+		`{"data": {"type": "instance_groups", "attributes": {"image_ids": ["1", "2"]}}}`,
+	))
+
+	var destroyed []int
+	routeSet := instanceGroupRouteSet(t, instanceGroupImages, &destroyed)
+	executor := routeSet.Executor.(FakeExecutor)
+	executor._CreateInstance = func(ctx context.Context, imageID, instanceID, port int, address string, schemaOnly bool) error {
+		if instanceID == 2 {
+			return errors.New("out of space")
+		}
+		return nil
+	}
+	routeSet.Executor = executor
+
+	err := routeSet.CreateGroup(recorder, req)
+	assert.EqualError(t, err, "failed to create instance: out of space")
+	assert.Equal(t, []int{1, 2}, destroyed)
+}
+
+func TestInstanceGroupCreateErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		body   string
+		status int
+		err    api.Error
+	}{
+		{
+			"without images",
+			`{"data": {"type": "instance_groups", "attributes": {}}}`,
+			http.StatusBadRequest,
+			api.InvalidInstanceGroupError("image_ids or families must list at least one image"),
+		},
+		{
+			"with a family without a ready image",
+			`{"data": {"type": "instance_groups", "attributes": {"families": ["payments", "reporting"]}}}`,
+			http.StatusUnprocessableEntity,
+			api.NoReadyImageError("reporting"),
+		},
+		{
+			"with an unready image",
+			`{"data": {"type": "instance_groups", "attributes": {"image_ids": ["1", "3"]}}}`,
+			http.StatusUnprocessableEntity,
+			api.UnreadyImageError,
+		},
+		{
+			"with a missing image",
+			`{"data": {"type": "instance_groups", "attributes": {"image_ids": ["1", "4"]}}}`,
+			http.StatusNotFound,
+			api.ImageNotFoundError,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "POST", "/instance_groups", bytes.NewBufferString(tc.body))
+
+			var destroyed []int
+			routeSet := instanceGroupRouteSet(t, instanceGroupImages, &destroyed)
+			err := routeSet.CreateGroup(recorder, req)
+			assert.Nil(t, err)
+
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+			assert.Equal(t, tc.status, recorder.Code)
+			assert.Equal(t, tc.err, response)
+			assert.Empty(t, destroyed)
+		})
+	}
+}
+
+// fakeInstanceGroup is a group of instances 1 and 2, of which only instance 1
+// still exists
+func fakeInstanceGroup(expiresAt *time.Time) (FakeInstanceGroupStore, FakeInstanceStore) {
+	groups := FakeInstanceGroupStore{
+		_Get: func(id int) (models.InstanceGroup, error) {
+			return models.InstanceGroup{
+				ID:          id,
+				UserEmail:   "test@draupnir",
+				InstanceIDs: []string{"1", "2"},
+				CreatedAt:   timestamp(),
+				ExpiresAt:   expiresAt,
+			}, nil
+		},
+	}
+
+	instances := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			if id != 1 {
+				return models.Instance{}, sql.ErrNoRows
+			}
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir", ExpiresAt: expiresAt}, nil
+		},
+	}
+
+	return groups, instances
+}
+
+func TestInstanceGroupGet(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instance_groups/1", nil)
+
+	var destroyed []int
+	routeSet := instanceGroupRouteSet(t, instanceGroupImages, &destroyed)
+	routeSet.InstanceGroupStore, routeSet.InstanceStore = fakeInstanceGroup(nil)
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instance_groups/{id}", errorHandler.Handle(routeSet.GetGroup)).Methods("GET")
+	router.ServeHTTP(recorder, req)
+
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var group models.InstanceGroup
+	assert.Nil(t, jsonapi.UnmarshalPayload(recorder.Body, &group))
+	assert.Equal(t, []string{"1", "2"}, group.InstanceIDs)
+	if assert.Len(t, group.Instances, 1) {
+		assert.Equal(t, 1, group.Instances[0].ID)
+		assert.NotNil(t, group.Instances[0].Credentials)
+	}
+}
+
+func TestInstanceGroupGetFromWrongUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instance_groups/1", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.AuthUserKey, "other@draupnir"))
+
+	var destroyed []int
+	routeSet := instanceGroupRouteSet(t, instanceGroupImages, &destroyed)
+	routeSet.InstanceGroupStore, routeSet.InstanceStore = fakeInstanceGroup(nil)
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instance_groups/{id}", errorHandler.Handle(routeSet.GetGroup)).Methods("GET")
+	router.ServeHTTP(recorder, req)
+
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestInstanceGroupExtend(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/instance_groups/1/extend", bytes.NewBufferString(
+		`{"data": {"type": "instance_groups", "attributes": {"by": "4h"}}}`,
+	))
+
+	expiresAt := time.Now().Add(time.Hour)
+	var destroyed []int
+	routeSet := instanceGroupRouteSet(t, instanceGroupImages, &destroyed)
+	groups, instances := fakeInstanceGroup(&expiresAt)
+
+	var extended []int
+	instances._Extend = func(instance models.Instance, to time.Time) (models.Instance, error) {
+		assert.Equal(t, expiresAt.Add(4*time.Hour), to)
+		extended = append(extended, instance.ID)
+		instance.ExpiresAt = &to
+		return instance, nil
+	}
+	groups._Extend = func(group models.InstanceGroup, to time.Time) (models.InstanceGroup, error) {
+		assert.Equal(t, expiresAt.Add(4*time.Hour), to)
+		group.ExpiresAt = &to
+		return group, nil
+	}
+	routeSet.InstanceGroupStore, routeSet.InstanceStore = groups, instances
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instance_groups/{id}/extend", errorHandler.Handle(routeSet.ExtendGroup)).Methods("POST")
+	router.ServeHTTP(recorder, req)
+
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, []int{1}, extended)
+}
+
+func TestInstanceGroupDestroy(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/instance_groups/1", nil)
+
+	var destroyed []int
+	routeSet := instanceGroupRouteSet(t, instanceGroupImages, &destroyed)
+	groups, instances := fakeInstanceGroup(nil)
+
+	groupDestroyed := false
+	groups._Destroy = func(group models.InstanceGroup) error {
+		groupDestroyed = true
+		return nil
+	}
+	instances._Destroy = routeSet.InstanceStore.(FakeInstanceStore)._Destroy
+	routeSet.InstanceGroupStore, routeSet.InstanceStore = groups, instances
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instance_groups/{id}", errorHandler.Handle(routeSet.DestroyGroup)).Methods("DELETE")
+	router.ServeHTTP(recorder, req)
+
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, []int{1}, destroyed)
+	assert.True(t, groupDestroyed)
+}
@@ -1,8 +1,12 @@
 package routes
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
 	"log"
-	"math/rand"
+	"net"
 	"net/http"
 	"regexp"
 	"strconv"
@@ -10,7 +14,14 @@ import (
 
 	"github.com/pkg/errors"
 
+	"github.com/gocardless/draupnir/pkg/anonaudit"
+	"github.com/gocardless/draupnir/pkg/audit"
+	"github.com/gocardless/draupnir/pkg/events"
 	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/guardrail"
+	"github.com/gocardless/draupnir/pkg/jobs"
+	"github.com/gocardless/draupnir/pkg/ledger"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
@@ -18,6 +29,7 @@ import (
 	"github.com/gocardless/draupnir/pkg/store"
 	"github.com/google/jsonapi"
 	"github.com/gorilla/mux"
+	promlog "github.com/prometheus/common/log"
 )
 
 type Instances struct {
@@ -28,10 +40,176 @@ type Instances struct {
 	Executor                exec.Executor
 	MinInstancePort         uint16
 	MaxInstancePort         uint16
+	// Ledger reserves each instance's port or address, so that servers sharing
+	// the database never give two instances the same one
+	Ledger ledger.Ledger
+	// StandbyEnabled allows standby instances to be created, which requires a
+	// restore command to be configured
+	StandbyEnabled bool
+	// JobStore records destroys while they run, so that they can be recovered if
+	// the server dies part way through them
+	JobStore store.JobStore
+	// Workers run destroys that are requested with Prefer: respond-async in the
+	// background
+	Workers *jobs.Workers
+	// Events is sent every change to an instance
+	Events *events.Broker
+	// AddressPool, if set, is the subnet from which each instance other than
+	// standby instances is given its own IP address alias, on which it listens
+	// on the standard Postgres port
+	AddressPool *net.IPNet
+	// Guardrail, if enabled, scans the image's settings for references to
+	// production before each instance other than standby instances is created.
+	// Standby instances replay WAL from production by design.
+	Guardrail guardrail.Scanner
+	// AnonSpecs are the current anonymisation specs of image families, which
+	// stop instances being created from images that weren't anonymised with
+	// them, if the family's policy is to block them
+	AnonSpecs anonaudit.Specs
+	// Policies are those of the regulated image families, whose instances can
+	// only be connected to through the proxy
+	Policies audit.Policies
+	// Audit records each session through the proxy
+	Audit audit.Recorder
+	// Access authorises the creation of instances of restricted families, which
+	// is only allowed for users whose access requests have been approved
+	Access audit.AccessRequests
+	// TTL, if set, is how long instances last before they're destroyed, unless
+	// they're extended
+	TTL time.Duration
+	// CleanupTokenStore stores the tokens that hand out the destruction of
+	// instances, e.g. to a CI job's teardown step
+	CleanupTokenStore store.CleanupTokenStore
+	// InstanceGroupStore stores which instances were created together
+	InstanceGroupStore store.InstanceGroupStore
+	// Quota limits the instances that each user, and everyone together, can have
+	Quota InstanceQuota
 }
 
+// InstanceQuota limits the instances that can exist, so that one user can't
+// exhaust the host with clones. The zero value doesn't limit them. Admins
+// aren't limited, so that they can always create instances, e.g. to
+// investigate an incident while the quota is used up.
+type InstanceQuota struct {
+	// MaxPerUser is the number of instances that each user can have, or zero
+	// for no limit
+	MaxPerUser int
+	// MaxTotal is the number of instances that can exist, or zero for no limit
+	MaxTotal int
+	// Overrides replace MaxPerUser for the users that they name
+	Overrides map[string]int
+}
+
+// limit returns the number of instances that the user can have, or zero for
+// no limit
+func (q InstanceQuota) limit(email string) int {
+	if auth.IsAdmin(email) {
+		return 0
+	}
+	if max, ok := q.Overrides[email]; ok {
+		return max
+	}
+	return q.MaxPerUser
+}
+
+// exceeded returns why the user can't create count more instances, or an empty
+// string if they can
+func (q InstanceQuota) exceeded(instances []models.Instance, email string, count int) string {
+	if auth.IsAdmin(email) {
+		return ""
+	}
+
+	owned := 0
+	for _, instance := range instances {
+		if instance.UserEmail == email {
+			owned++
+		}
+	}
+
+	if max := q.limit(email); max > 0 && owned+count > max {
+		return fmt.Sprintf(
+			"%s already has %d of the %d instances that they're allowed. Destroy one of them before creating another.",
+			email, owned, max,
+		)
+	}
+	if q.MaxTotal > 0 && len(instances)+count > q.MaxTotal {
+		return fmt.Sprintf(
+			"There are already %d of the %d instances that the server allows. Try again once some have been destroyed.",
+			len(instances), q.MaxTotal,
+		)
+	}
+	return ""
+}
+
+// checkQuota renders an error and returns false if the user can't create count
+// more instances
+func (i Instances) checkQuota(w http.ResponseWriter, logger promlog.Logger, email string, count int) (bool, error) {
+	if i.Quota.MaxPerUser == 0 && i.Quota.MaxTotal == 0 && len(i.Quota.Overrides) == 0 {
+		return true, nil
+	}
+
+	instances, err := i.InstanceStore.List()
+	if err != nil {
+		return false, errors.Wrap(err, "failed to list instances")
+	}
+
+	if reason := i.Quota.exceeded(instances, email, count); reason != "" {
+		logger.With("user", email).With("instances", len(instances)).Info("instance quota exceeded")
+		api.InstanceQuotaExceededError(reason).Render(w, http.StatusForbidden)
+		return false, nil
+	}
+	return true, nil
+}
+
+// checkAccess renders an error and returns false if the image's family is
+// restricted and the user hasn't been approved access to it. Access is only
+// checked when instances are created, so instances outlive the access that
+// they were created with until they expire or are destroyed.
+func (i Instances) checkAccess(w http.ResponseWriter, logger promlog.Logger, email string, image models.Image) (bool, error) {
+	policy, ok := i.Policies.For(image)
+	if !ok || !policy.Restricted() {
+		return true, nil
+	}
+
+	request, err := i.Access.Authorise(email, policy.Family, time.Now())
+	if err == sql.ErrNoRows {
+		logger.With("user", email).With("family", policy.Family).Info("access to restricted family required")
+		api.AccessRequiredError(policy.Family).Render(w, http.StatusForbidden)
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to check access to restricted family")
+	}
+
+	logger.With("user", email).With("access_request", request.ID).Info("access to restricted family authorised")
+	return true, nil
+}
+
+// aliasedInstancePort is the port that instances with their own address
+// listen on
+const aliasedInstancePort = 5432
+
 type CreateInstanceRequest struct {
 	ImageID string `jsonapi:"attr,image_id"`
+	Standby bool   `jsonapi:"attr,standby"`
+	// SchemaOnly instances have their tables truncated, other than those that
+	// the server is configured to keep. It's omitted when it isn't set, so that
+	// servers that don't support it only see it when it's asked for.
+	SchemaOnly bool `jsonapi:"attr,schema_only,omitempty"`
+}
+
+// ExtendInstanceRequest is the body of a request to extend an instance's
+// expiry by a duration, such as "4h"
+type ExtendInstanceRequest struct {
+	By string `jsonapi:"attr,by"`
+}
+
+// MaintenanceRequest is the body of a request to run a maintenance operation.
+// Arguments are given as strings, such as {"table": "payments"}.
+type MaintenanceRequest struct {
+	Operation string                 `jsonapi:"attr,operation"`
+	Database  string                 `jsonapi:"attr,database"`
+	Arguments map[string]interface{} `jsonapi:"attr,arguments"`
 }
 
 func (i Instances) Create(w http.ResponseWriter, r *http.Request) error {
@@ -59,6 +237,11 @@ func (i Instances) Create(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	if req.Standby && req.SchemaOnly {
+		api.SchemaOnlyStandbyError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
 	image, err := i.ImageStore.Get(imageID)
 	if err != nil {
 		api.ImageNotFoundError.Render(w, http.StatusNotFound)
@@ -70,47 +253,171 @@ func (i Instances) Create(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	if ok, err := i.checkAccess(w, logger, email, image); !ok {
+		return err
+	}
+
+	stale, err := i.AnonSpecs.Blocks(image)
+	if err != nil {
+		return errors.Wrap(err, "failed to check image anonymisation")
+	}
+	if stale {
+		api.StaleAnonymisationError(freshness.Family(image)).Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	if req.Standby {
+		available := i.StandbyEnabled && !image.IsSharded() && !image.IsDistributed()
+		if available {
+			available, err = i.Executor.HasImageBase(r.Context(), imageID)
+			if err != nil {
+				return errors.Wrap(err, "failed to check for image base")
+			}
+		}
+
+		if !available {
+			api.StandbyUnavailableError.Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+	}
+
+	// This catches images that were finalised before the guardrail was enabled,
+	// or with a more lenient policy
+	if i.Guardrail.Enabled() && !req.Standby {
+		err = scanImageSettings(r.Context(), logger, i.Executor, i.Guardrail, imageID)
+		if blocked, ok := errors.Cause(err).(guardrail.BlockedError); ok {
+			api.ProductionReferencesError(blocked.Error()).Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if ok, err := i.checkQuota(w, logger, email, 1); !ok {
+		return err
+	}
+
+	instance, err := i.launch(r, logger, email, image, req.Standby, req.SchemaOnly, time.Now())
+	if err == errImageDestroyed {
+		api.ImageNotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Instances of regulated images can only be connected to through the proxy,
+	// so they're sent without credentials, and the user's address isn't
+	// whitelisted
+	if instance.ProxyRequired {
+		w.WriteHeader(http.StatusCreated)
+		return errors.Wrap(marshalOne(r, w, &instance), "failed to marshal instance")
+	}
+
+	if err := i.attachCredentials(r, &instance); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	err = marshalOne(r, w, &instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal instance")
+	}
+
+	return nil
+}
+
+// errImageDestroyed is returned by launch if the image was destroyed before
+// the instance could be recorded
+var errImageDestroyed = errors.New("image was destroyed")
+
+// launch records and creates an instance of the image for the user, created at
+// now, which expires after the TTL if there is one. The image must already have
+// been checked. Once the instance is recorded it's returned even if creating it
+// fails, so that it can be destroyed.
+func (i Instances) launch(r *http.Request, logger promlog.Logger, email string, image models.Image, standby bool, schemaOnly bool, now time.Time) (models.Instance, error) {
 	refreshToken, ok := r.Context().Value(middleware.RefreshTokenKey).(string)
 	if !ok {
 		log.Fatal("Access token key is missing from context")
 	}
 
-	instance := models.NewInstance(imageID, email, refreshToken)
-	port, err := generateRandomFreePort(i.InstanceStore, i.MinInstancePort, i.MaxInstancePort)
-	if err != nil {
-		return err
+	instance := models.NewInstance(image.ID, email, refreshToken)
+	instance.CreatedAt, instance.UpdatedAt = now, now
+	instance.Standby = standby
+	instance.SchemaOnly = schemaOnly
+	_, instance.ProxyRequired = i.Policies.For(image)
+	if i.TTL > 0 {
+		expiresAt := instance.CreatedAt.Add(i.TTL)
+		instance.ExpiresAt = &expiresAt
+	}
+
+	// The lease expires if we die before it's bound to the instance
+	var leaseKind, leaseValue string
+	if i.AddressPool != nil && !instance.Standby {
+		address, err := i.Ledger.ReserveAddress(i.AddressPool)
+		if err != nil {
+			return models.Instance{}, err
+		}
+		instance.Address = address
+		instance.Port = aliasedInstancePort
+		leaseKind, leaseValue = models.LeaseAddress, address
+	} else {
+		port, err := i.Ledger.ReservePort(i.MinInstancePort, i.MaxInstancePort)
+		if err != nil {
+			return models.Instance{}, err
+		}
+		instance.Port = port
+		leaseKind, leaseValue = models.LeasePort, strconv.Itoa(int(port))
 	}
-	instance.Port = port
 
-	instance, err = i.InstanceStore.Create(instance)
+	instance, err := i.InstanceStore.Create(instance)
 
 	if err != nil {
-		match, err := regexp.MatchString("instances_image_id_fkey", err.Error())
-		if err == nil && match == true {
+		if releaseErr := i.Ledger.Release(leaseKind, leaseValue); releaseErr != nil {
+			logger.With("error", releaseErr).Warn("failed to release lease")
+		}
+
+		match, matchErr := regexp.MatchString("instances_image_id_fkey", err.Error())
+		if matchErr == nil && match {
 			logger.Info(err.Error())
-			api.ImageNotFoundError.Render(w, http.StatusNotFound)
-			return nil
+			return models.Instance{}, errImageDestroyed
 		}
 
-		return errors.Wrap(err, "failed to create instance")
+		return models.Instance{}, errors.Wrap(err, "failed to create instance")
 	}
 
-	ipaddr, err := middleware.GetUserIPAddress(r)
+	// From here on, the lease lasts until the instance is destroyed
+	if err := i.Ledger.Bind(leaseKind, leaseValue, instance.ID); err != nil {
+		return instance, err
+	}
+
+	if instance.Standby {
+		err = i.Executor.CreateStandbyInstance(r.Context(), image.ID, instance.ID, int(instance.Port))
+	} else {
+		err = i.Executor.CreateInstance(r.Context(), image.ID, instance.ID, int(instance.Port), instance.Address, instance.SchemaOnly)
+	}
 	if err != nil {
-		return err
+		return instance, errors.Wrap(err, "failed to create instance")
 	}
 
-	if err := i.Executor.CreateInstance(r.Context(), imageID, instance.ID, int(instance.Port)); err != nil {
-		return errors.Wrap(err, "failed to create instance")
+	// Publish the instance before its credentials are attached, as they're only
+	// for the user who created it
+	i.Events.Publish(events.InstanceEvent(events.Created, instance))
+	return instance, nil
+}
+
+// attachCredentials sets the instance's credentials, and whitelists the
+// address that the request came from so that they can be used
+func (i Instances) attachCredentials(r *http.Request, instance *models.Instance) error {
+	ipaddr, err := middleware.GetUserIPAddress(r)
+	if err != nil {
+		return err
 	}
 
 	files, err := i.Executor.RetrieveInstanceCredentials(r.Context(), instance.ID)
 	if err != nil {
-		logger.With("instance", instance.ID).Info(
-			errors.Wrap(err, "failed to retrieve instance credentials"),
-		)
-		api.InternalServerError.Render(w, http.StatusInternalServerError)
-		return nil
+		return errors.Wrap(err, "failed to retrieve instance credentials")
 	}
 
 	creds := models.NewInstanceCredentials(
@@ -120,19 +427,12 @@ func (i Instances) Create(w http.ResponseWriter, r *http.Request) error {
 	instance.Credentials = &creds
 
 	// Add the user's IP address to the whitelist
-	address := models.NewWhitelistedAddress(ipaddr, &instance)
+	address := models.NewWhitelistedAddress(ipaddr, instance)
 	address, err = i.WhitelistedAddressStore.Create(address)
 	if err != nil {
 		return errors.Wrap(err, "failed to record whitelisted IP address")
 	}
 	i.ApplyWhitelist("api")
-
-	w.WriteHeader(http.StatusCreated)
-	err = jsonapi.MarshalOnePayload(w, &instance)
-	if err != nil {
-		return errors.Wrap(err, "failed to marshal instance")
-	}
-
 	return nil
 }
 
@@ -142,26 +442,77 @@ func (i Instances) List(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	instances, err := i.InstanceStore.List()
+	filter, err := parseInstanceFilter(r.URL.Query(), email)
 	if err != nil {
-		return errors.Wrap(err, "failed to get instances")
+		api.InvalidFilterError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
 	}
 
-	// Build a slice of pointers to our images, because this is what jsonapi wants
-	// At the same time, filter out instances that don't belong to this user
-	_instances := make([]*models.Instance, 0)
-	for idx, instance := range instances {
-		if instance.UserEmail == email {
-			_instances = append(_instances, &instances[idx])
+	sort, err := parseSort(r.URL.Query(), store.InstanceSortFields)
+	if err != nil {
+		api.InvalidSortError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	page, err := parseOptionalPage(r.URL.Query())
+	if err != nil {
+		api.InvalidPaginationError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	// Users can only list their own instances, and the static instances that
+	// everyone shares, so there are none belonging to anyone else to list
+	instances := []models.Instance{}
+	more := false
+	if filter.UserEmail == email || filter.Static {
+		instances, more, err = i.InstanceStore.ListPage(filter, sort, page)
+		if err != nil {
+			return errors.Wrap(err, "failed to get instances")
 		}
 	}
 
+	// Build a slice of pointers to our instances, because this is what jsonapi
+	// wants
+	_instances := make([]*models.Instance, 0, len(instances))
+	for idx := range instances {
+		_instances = append(_instances, &instances[idx])
+	}
+
 	return errors.Wrap(
-		jsonapi.MarshalManyPayload(w, _instances),
+		writeCacheable(w, r, latestInstanceUpdate(_instances), func(body io.Writer) error {
+			return marshalPage(r, body, _instances, paginationLinks(r, page, more))
+		}),
 		"failed to marshal instances",
 	)
 }
 
+// Summary counts the instances by status and by owner, so that dashboards
+// don't have to list every instance. Like List, it only counts the user's own
+// instances, except for the upload user, who can see everyone's.
+func (i Instances) Summary(w http.ResponseWriter, r *http.Request) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	owner := email
+	if auth.IsAdmin(email) {
+		owner = ""
+	}
+
+	counts, err := i.InstanceStore.Count(owner)
+	if err != nil {
+		return errors.Wrap(err, "failed to count instances")
+	}
+
+	_counts := make([]*models.InstanceCount, 0, len(counts))
+	for idx := range counts {
+		_counts = append(_counts, &counts[idx])
+	}
+
+	return errors.Wrap(marshalMany(r, w, _counts), "failed to marshal instance counts")
+}
+
 func (i Instances) Get(w http.ResponseWriter, r *http.Request) error {
 	logger, err := middleware.GetLogger(r)
 	if err != nil {
@@ -187,41 +538,39 @@ func (i Instances) Get(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	if email != instance.UserEmail {
+	// Static instances are shared by everyone
+	if email != instance.UserEmail && instance.StaticName == "" {
 		api.NotFoundError.Render(w, http.StatusNotFound)
 		return nil
 	}
 
-	ipaddr, err := middleware.GetUserIPAddress(r)
-	if err != nil {
-		return err
+	if len(i.Policies) > 0 {
+		image, err := i.ImageStore.Get(instance.ImageID)
+		if err != nil {
+			return errors.Wrap(err, "failed to get image")
+		}
+		_, instance.ProxyRequired = i.Policies.For(image)
 	}
 
-	files, err := i.Executor.RetrieveInstanceCredentials(r.Context(), instance.ID)
-	if err != nil {
-		logger.With("instance", id).Info(
-			errors.Wrap(err, "failed to retrieve instance credentials"),
+	// As when creating them, instances of regulated images are sent without
+	// credentials
+	if instance.ProxyRequired {
+		return errors.Wrap(
+			writeCacheable(w, r, instance.UpdatedAt, func(body io.Writer) error {
+				return marshalOne(r, body, &instance)
+			}),
+			"failed to marshal instance",
 		)
-		api.InternalServerError.Render(w, http.StatusInternalServerError)
-		return nil
 	}
 
-	creds := models.NewInstanceCredentials(
-		instance.ID,
-		string(files["ca.crt"]), string(files["client.crt"]), string(files["client.key"]),
-	)
-	instance.Credentials = &creds
-
-	// Add the user's IP address to the whitelist
-	address := models.NewWhitelistedAddress(ipaddr, &instance)
-	address, err = i.WhitelistedAddressStore.Create(address)
-	if err != nil {
-		return errors.Wrap(err, "failed to record whitelisted IP address")
+	if err := i.attachCredentials(r, &instance); err != nil {
+		return err
 	}
-	i.ApplyWhitelist("api")
 
 	return errors.Wrap(
-		jsonapi.MarshalOnePayload(w, &instance),
+		writeCacheable(w, r, instance.UpdatedAt, func(body io.Writer) error {
+			return marshalOne(r, body, &instance)
+		}),
 		"failed to marshal instance",
 	)
 }
@@ -251,58 +600,573 @@ func (i Instances) Destroy(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	if email != auth.UPLOAD_USER_EMAIL && email != instance.UserEmail {
+	// Everyone can see static instances, so they're told why they can't
+	// change them rather than that they don't exist
+	if instance.StaticName != "" {
+		api.StaticInstanceError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	if !auth.IsAdmin(email) && email != instance.UserEmail {
 		api.NotFoundError.Render(w, http.StatusNotFound)
 		return nil
 	}
 
-	logger.With("instance", id).Info("destroying instance")
-	err = i.InstanceStore.Destroy(instance)
-	if err != nil {
-		return errors.Wrap(err, "failed to destroy instance")
+	if respondAsync(r) {
+		job, err := i.Workers.Submit(logger, models.NewQueuedJob(models.JobDestroyInstance, instance.ID, email), func(ctx context.Context) error {
+			// The operation is itself the record of the instance's destroy
+			return i.destroyUnrecorded(ctx, logger, instance)
+		})
+		return renderOperation(w, r, job, err)
+	}
+
+	if err := i.destroy(r.Context(), logger, instance); err != nil {
+		return err
 	}
 
-	err = i.Executor.DestroyInstance(r.Context(), instance.ID)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// destroy destroys the instance, recording it as a job while it runs, and tells
+// anything watching for changes
+func (i Instances) destroy(ctx context.Context, logger promlog.Logger, instance models.Instance) error {
+	return jobs.Run(logger, i.JobStore, models.JobDestroyInstance, instance.ID, func() error {
+		return i.destroyUnrecorded(ctx, logger, instance)
+	})
+}
+
+// destroyUnrecorded destroys the instance without recording it as a job, for
+// operations, which are already recorded as one
+func (i Instances) destroyUnrecorded(ctx context.Context, logger promlog.Logger, instance models.Instance) error {
+	logger.With("instance", instance.ID).Info("destroying instance")
+	// The instance is removed from the database before its files, so that if
+	// we're interrupted the files can be cleaned up when the server next starts
+	err := i.InstanceStore.Destroy(instance)
+	if err == nil {
+		err = i.Executor.DestroyInstance(ctx, instance.ID)
+	}
 	if err != nil {
 		return errors.Wrap(err, "failed to destroy instance")
 	}
 
+	i.Events.Publish(events.InstanceEvent(events.Destroyed, instance))
+
 	// Destroying the instance will cascade and destroy any linked whitelisted
 	// addresses. Trigger the whitelist reconciler in order to clean up the
 	// obsolete rule.
 	i.ApplyWhitelist("api")
-
-	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
-func generateRandomFreePort(store store.InstanceStore, minPort uint16, maxPort uint16) (uint16, error) {
-	attempts := 0
-	port := uint16(0)
-	portAvailable := false
+// Annotate patches the instance's annotations and labels
+func (i Instances) Annotate(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
 
-GetNewPort:
-	for !portAvailable {
-		attempts++
-		if attempts >= 100 {
-			return port, errors.Errorf("No free port found after %d attempts", attempts)
-		}
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
 
-		rand.Seed(time.Now().Unix() + int64(time.Now().Nanosecond()))
-		port = minPort + uint16(rand.Intn(int(maxPort-minPort)))
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
 
-		instances, err := store.List()
-		if err != nil {
-			return port, errors.Wrap(err, "failed to list instances to determine free port")
+	instance, err := i.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if instance.StaticName != "" {
+		api.StaticInstanceError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	if email != instance.UserEmail {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	patch, ok := parseAnnotationsPatch(w, r, logger)
+	if !ok {
+		return nil
+	}
+
+	instance, err = i.InstanceStore.Annotate(instance, patch.Annotations)
+	if err != nil {
+		if isAnnotationsSizeError(err) {
+			logger.With("instance", id).Info(err.Error())
+			api.AnnotationsTooLargeError.Render(w, http.StatusUnprocessableEntity)
+			return nil
 		}
+		return errors.Wrap(err, "failed to annotate instance")
+	}
 
-		for _, instance := range instances {
-			if instance.Port == port {
-				goto GetNewPort
+	if patch.Labels != nil {
+		instance, err = i.InstanceStore.Label(instance, patch.Labels)
+		if err != nil {
+			if isLabelsSizeError(err) {
+				logger.With("instance", id).Info(err.Error())
+				api.LabelsTooLargeError.Render(w, http.StatusUnprocessableEntity)
+				return nil
 			}
+			return errors.Wrap(err, "failed to label instance")
 		}
-		portAvailable = true
 	}
 
-	return port, nil
+	i.Events.Publish(events.InstanceEvent(events.Updated, instance))
+
+	return errors.Wrap(
+		marshalOne(r, w, &instance),
+		"failed to marshal instance",
+	)
+}
+
+// Promote stops a standby instance from replaying WAL and anonymises it, after
+// which it can be connected to like any other instance
+func (i Instances) Promote(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	instance, err := i.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if instance.StaticName != "" {
+		api.StaticInstanceError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	if email != instance.UserEmail {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if !instance.Standby {
+		api.InstanceNotStandbyError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(instance.ImageID)
+	if err != nil {
+		return errors.Wrap(err, "failed to get image")
+	}
+
+	logger.With("instance", id).Info("promoting instance")
+	err = i.Executor.PromoteInstance(r.Context(), instance, image.Anon)
+	if err != nil {
+		return errors.Wrap(err, "failed to promote instance")
+	}
+
+	instance, err = i.InstanceStore.MarkAsPromoted(instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to mark instance as promoted")
+	}
+
+	i.Events.Publish(events.InstanceEvent(events.Updated, instance))
+
+	return errors.Wrap(
+		marshalOne(r, w, &instance),
+		"failed to marshal instance",
+	)
+}
+
+// Extend pushes back when the instance expires, for investigations that outlast
+// its TTL. The extension is added to whichever is later of the current expiry
+// and now, so that extending an instance that's about to expire gives it the
+// whole extension.
+func (i Instances) Extend(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	instance, err := i.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if instance.StaticName != "" {
+		api.StaticInstanceError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	if email != instance.UserEmail {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	req := ExtendInstanceRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	by, err := time.ParseDuration(req.By)
+	if err != nil || by <= 0 {
+		api.InvalidExtensionError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	if instance.ExpiresAt == nil {
+		api.InstanceNeverExpiresError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	from := time.Now()
+	if instance.ExpiresAt.After(from) {
+		from = *instance.ExpiresAt
+	}
+
+	logger.With("instance", id).With("by", by).Info("extending instance")
+	instance, err = i.InstanceStore.Extend(instance, from.Add(by))
+	if err != nil {
+		return errors.Wrap(err, "failed to extend instance")
+	}
+
+	i.Events.Publish(events.InstanceEvent(events.Updated, instance))
+
+	return errors.Wrap(
+		marshalOne(r, w, &instance),
+		"failed to marshal instance",
+	)
+}
+
+// Exec runs one of the whitelisted maintenance operations against the instance,
+// and returns its output
+func (i Instances) Exec(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	instance, err := i.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if instance.StaticName != "" {
+		api.StaticInstanceError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	if email != instance.UserEmail {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	req := MaintenanceRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	operation := exec.MaintenanceOperation{
+		Name:      req.Operation,
+		Database:  req.Database,
+		Arguments: make(map[string]string, len(req.Arguments)),
+	}
+	for name, value := range req.Arguments {
+		str, ok := value.(string)
+		if !ok {
+			api.InvalidMaintenanceOperationError("arguments must be strings").Render(w, http.StatusBadRequest)
+			return nil
+		}
+		operation.Arguments[name] = str
+	}
+
+	if err := operation.Validate(); err != nil {
+		api.InvalidMaintenanceOperationError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	// A standby instance is read-only until it has been promoted
+	if instance.Standby {
+		api.InstanceIsStandbyError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	logger.With("instance", id).With("operation", operation.Name).Info("running maintenance")
+	output, err := i.Executor.RunMaintenance(r.Context(), instance, operation)
+	if err != nil {
+		if failure, ok := err.(exec.MaintenanceFailedError); ok {
+			api.MaintenanceFailedError(failure.Output).Render(w, http.StatusUnprocessableEntity)
+			return nil
+		}
+		return errors.Wrap(err, "failed to run maintenance")
+	}
+
+	result := models.MaintenanceResult{
+		ID:        instance.ID,
+		Operation: operation.Name,
+		Database:  operation.Database,
+		Output:    output,
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &result),
+		"failed to marshal maintenance result",
+	)
+}
+
+// Storage reports how much of the instance's data has diverged from the image
+// that it was created from
+func (i Instances) Storage(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	instance, err := i.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if !auth.IsAdmin(email) && email != instance.UserEmail {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	usage, err := i.Executor.RetrieveInstanceDiskUsage(r.Context(), instance.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve instance disk usage")
+	}
+
+	report := models.NewInstanceStorageReport(instance, usage)
+
+	return errors.Wrap(
+		marshalOne(r, w, &report),
+		"failed to marshal storage report",
+	)
+}
+
+// Diagnostics ranks the likely causes of the instance being slow, from what's
+// running in it, and what else is running on the host that it shares
+func (i Instances) Diagnostics(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	instance, err := i.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if !auth.IsAdmin(email) && email != instance.UserEmail {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	// Sessions with regulated instances are recorded by the proxy, which the
+	// text of their queries would be a way around
+	if len(i.Policies) > 0 {
+		image, err := i.ImageStore.Get(instance.ImageID)
+		if err != nil {
+			return errors.Wrap(err, "failed to get image")
+		}
+		_, instance.ProxyRequired = i.Policies.For(image)
+	}
+	if instance.ProxyRequired {
+		api.RegulatedInstanceDiagnosticsError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	activity, err := i.Executor.InspectInstanceActivity(r.Context(), instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to inspect instance activity")
+	}
+
+	jobs, err := i.JobStore.ListRunning()
+	if err != nil {
+		return errors.Wrap(err, "failed to list running jobs")
+	}
+
+	bakes := 0
+	for _, job := range jobs {
+		if job.Kind == models.JobFinaliseImage && job.Status == models.JobRunning {
+			bakes++
+		}
+	}
+
+	diagnostics := models.DiagnoseInstance(instance, activity, bakes)
+
+	return errors.Wrap(
+		marshalOne(r, w, &diagnostics),
+		"failed to marshal instance diagnostics",
+	)
+}
+
+// defaultLogLines is how many lines of an instance's log are sent, unless
+// more or fewer are requested
+const defaultLogLines = 100
+
+// Logs sends the end of the instance's Postgres server log as plain text. With
+// ?follow=true, lines are then sent as they're added, until the client
+// disconnects.
+func (i Instances) Logs(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	instance, err := i.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if !auth.IsAdmin(email) && email != instance.UserEmail {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	// Sessions with regulated instances are recorded by the proxy, which the log
+	// would be a way around
+	if len(i.Policies) > 0 {
+		image, err := i.ImageStore.Get(instance.ImageID)
+		if err != nil {
+			return errors.Wrap(err, "failed to get image")
+		}
+		_, instance.ProxyRequired = i.Policies.For(image)
+	}
+	if instance.ProxyRequired {
+		api.RegulatedInstanceLogsError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	lines := defaultLogLines
+	if param := r.URL.Query().Get("lines"); param != "" {
+		lines, err = strconv.Atoi(param)
+		if err != nil || lines < 0 || lines > api.MaxLogLines {
+			api.InvalidLogLinesError.Render(w, http.StatusBadRequest)
+			return nil
+		}
+	}
+	follow := r.URL.Query().Get("follow") == "true"
+
+	flusher, canFlush := w.(http.Flusher)
+	if !canFlush {
+		return errors.New("response can't be streamed")
+	}
+
+	// Once the headers are sent, a failure can only cut the log short
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return errors.Wrap(
+		i.Executor.StreamInstanceLog(r.Context(), instance.ID, lines, follow, flushWriter{w, flusher}),
+		"failed to stream instance log",
+	)
+}
+
+// flushWriter flushes each write, so that lines of a followed log are sent as
+// soon as they're written
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.flusher.Flush()
+	return n, err
 }
@@ -3,21 +3,70 @@ package routes
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
 	"testing"
-
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/anonaudit"
+	"github.com/gocardless/draupnir/pkg/audit"
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/guardrail"
+	"github.com/gocardless/draupnir/pkg/ledger"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
 	"github.com/google/jsonapi"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 )
 
+// fakeLedger returns a ledger in which the given values of the kind are already
+// leased, and every other value is free
+func fakeLedger(t *testing.T, kind string, held ...string) ledger.Ledger {
+	leases := make([]models.Lease, 0, len(held))
+	for idx, value := range held {
+		leases = append(leases, models.Lease{Kind: kind, Value: value, Owner: "other", InstanceID: idx + 1})
+	}
+
+	return ledger.Ledger{
+		Owner: "test",
+		TTL:   time.Minute,
+		Store: FakeLeaseStore{
+			_List: func(k string) ([]models.Lease, error) {
+				assert.Equal(t, kind, k)
+				return leases, nil
+			},
+			_Acquire: func(lease models.Lease) (bool, error) {
+				assert.Equal(t, kind, lease.Kind)
+				assert.Equal(t, "test", lease.Owner)
+				assert.NotNil(t, lease.ExpiresAt)
+				for _, value := range held {
+					if value == lease.Value {
+						return false, nil
+					}
+				}
+				return true, nil
+			},
+			_Bind: func(k, value, owner string, instanceID int) error {
+				assert.Equal(t, kind, k)
+				assert.Equal(t, "test", owner)
+				return nil
+			},
+		},
+	}
+}
+
 var fakeCredentialsMap = map[string][]byte{
 	"ca.crt":     []byte("-----BEGIN CERTIFICATE-----CA..."),
 	"client.crt": []byte("-----BEGIN CERTIFICATE-----client..."),
@@ -40,26 +89,7 @@ func TestInstanceCreate(t *testing.T) {
 				ImageID:   1,
 				CreatedAt: timestamp(),
 				UpdatedAt: timestamp(),
-			}, nil
-		},
-		_List: func() ([]models.Instance, error) {
-			return []models.Instance{
-				{
-					ID:        1,
-					Hostname:  "draupnir-server.example.com",
-					ImageID:   1,
-					Port:      5432,
-					CreatedAt: timestamp(),
-					UpdatedAt: timestamp(),
-				},
-				{
-					ID:        1,
-					Hostname:  "draupnir-server.example.com",
-					ImageID:   1,
-					Port:      5433,
-					CreatedAt: timestamp(),
-					UpdatedAt: timestamp(),
-				},
+				Status:    models.InstanceRunning,
 			}, nil
 		},
 	}
@@ -85,7 +115,7 @@ func TestInstanceCreate(t *testing.T) {
 	}
 
 	executor := FakeExecutor{
-		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int) error {
+		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int, address string, schemaOnly bool) error {
 			assert.Equal(t, 1, instanceID)
 			assert.Equal(t, 1, imageID)
 			return nil
@@ -104,6 +134,7 @@ func TestInstanceCreate(t *testing.T) {
 		ApplyWhitelist:          func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
 		MinInstancePort:         5432,
 		MaxInstancePort:         5435,
+		Ledger:                  fakeLedger(t, models.LeasePort, "5432", "5433"),
 	}
 	err := routeSet.Create(recorder, req)
 
@@ -116,293 +147,1651 @@ func TestInstanceCreate(t *testing.T) {
 
 }
 
-func TestInstanceCreateReturnsErrorWithUnreadyImage(t *testing.T) {
+func TestInstanceCreateWithTTL(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
 	request := CreateInstanceRequest{ImageID: "1"}
 	jsonapi.MarshalOnePayload(body, &request)
 	req, recorder, _ := createRequest(t, "POST", "/instances", body)
 
 	instanceStore := FakeInstanceStore{
-		_Create: func(image models.Instance) (models.Instance, error) {
-			return models.Instance{
-				ID:        1,
-				Hostname:  "draupnir-server.example.com",
-				ImageID:   1,
-				CreatedAt: timestamp(),
-				UpdatedAt: timestamp(),
-			}, nil
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			if assert.NotNil(t, instance.ExpiresAt) {
+				assert.Equal(t, instance.CreatedAt.Add(24*time.Hour), *instance.ExpiresAt)
+			}
+			instance.ID = 1
+			return instance, nil
 		},
 	}
 
 	imageStore := FakeImageStore{
 		_Get: func(id int) (models.Image, error) {
-			return models.Image{ID: 1, Ready: false}, nil
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	whitelistedAddressStore := FakeWhitelistedAddressStore{
+		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+			return addr, nil
 		},
 	}
 
 	executor := FakeExecutor{
-		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int) error {
+		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int, address string, schemaOnly bool) error {
 			return nil
 		},
+		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+			return fakeCredentialsMap, nil
+		},
 	}
 
 	routeSet := Instances{
-		InstanceStore: instanceStore,
-		ImageStore:    imageStore,
-		Executor:      executor,
+		InstanceStore:           instanceStore,
+		ImageStore:              imageStore,
+		WhitelistedAddressStore: whitelistedAddressStore,
+		Executor:                executor,
+		ApplyWhitelist:          func(string) {},
+		MinInstancePort:         5432,
+		MaxInstancePort:         5435,
+		Ledger:                  fakeLedger(t, models.LeasePort),
+		TTL:                     24 * time.Hour,
 	}
 	err := routeSet.Create(recorder, req)
 
-	var response api.Error
-	decodeJSON(t, recorder.Body, &response)
-
-	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
-	assert.Equal(t, api.UnreadyImageError, response)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
 	assert.Nil(t, err)
 }
 
-func TestInstanceCreateReturnsErrorWithInvalidPayload(t *testing.T) {
+func TestInstanceCreateSchemaOnly(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
-	request := map[string]string{"this is": "not a valid JSON API request payload"}
-	json.NewEncoder(body).Encode(&request)
-	req, recorder, logs := createRequest(t, "POST", "/instances", body)
+	request := CreateInstanceRequest{ImageID: "1", SchemaOnly: true}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
 
-	err := Instances{}.Create(recorder, req)
+	instanceStore := FakeInstanceStore{
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			assert.True(t, instance.SchemaOnly)
+			instance.ID = 1
+			return instance, nil
+		},
+	}
 
-	var response api.Error
+	var truncated bool
+	executor := FakeExecutor{
+		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int, address string, schemaOnly bool) error {
+			truncated = schemaOnly
+			return nil
+		},
+		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+			return fakeCredentialsMap, nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore: instanceStore,
+		ImageStore: FakeImageStore{
+			_Get: func(id int) (models.Image, error) {
+				return models.Image{ID: 1, Ready: true}, nil
+			},
+		},
+		WhitelistedAddressStore: FakeWhitelistedAddressStore{
+			_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+				return addr, nil
+			},
+		},
+		Executor:        executor,
+		ApplyWhitelist:  func(string) {},
+		MinInstancePort: 5432,
+		MaxInstancePort: 5435,
+		Ledger:          fakeLedger(t, models.LeasePort),
+	}
+	err := routeSet.Create(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.True(t, truncated)
+
+	var response jsonapi.OnePayload
 	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, true, response.Data.Attributes["schema_only"])
+}
+
+func TestInstanceCreateSchemaOnlyStandby(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1", Standby: true, SchemaOnly: true}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	err := Instances{StandbyEnabled: true}.Create(recorder, req)
 
 	assert.Nil(t, err)
 	assert.Equal(t, http.StatusBadRequest, recorder.Code)
-	assert.Equal(t, api.InvalidJSONError, response)
-	assert.Contains(t, logs.String(), "not a jsonapi representation")
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, api.SchemaOnlyStandbyError, response)
 }
 
-func TestInstanceCreateWithInvalidImageID(t *testing.T) {
+func TestInstanceCreateWithAddressPool(t *testing.T) {
 	body := bytes.NewBuffer([]byte{})
-	request := CreateInstanceRequest{ImageID: "garbage"}
+	request := CreateInstanceRequest{ImageID: "1"}
 	jsonapi.MarshalOnePayload(body, &request)
-	req, recorder, logs := createRequest(t, "POST", "/instances", body)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	instanceStore := FakeInstanceStore{
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			assert.Equal(t, "10.0.100.2", instance.Address, "the network address and 10.0.100.1 are skipped")
+			assert.Equal(t, uint16(5432), instance.Port)
+			instance.ID = 1
+			return instance, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int, address string, schemaOnly bool) error {
+			assert.Equal(t, 5432, port)
+			assert.Equal(t, "10.0.100.2", address)
+			return nil
+		},
+		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+			return fakeCredentialsMap, nil
+		},
+	}
 
+	_, pool, _ := net.ParseCIDR("10.0.100.0/24")
 	routeSet := Instances{
-		Executor: FakeExecutor{},
+		InstanceStore: instanceStore,
+		ImageStore: FakeImageStore{
+			_Get: func(id int) (models.Image, error) {
+				return models.Image{ID: 1, Ready: true}, nil
+			},
+		},
+		WhitelistedAddressStore: FakeWhitelistedAddressStore{
+			_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+				return addr, nil
+			},
+		},
+		Executor:        executor,
+		ApplyWhitelist:  func(s string) {},
+		MinInstancePort: 5432,
+		MaxInstancePort: 5435,
+		AddressPool:     pool,
+		Ledger:          fakeLedger(t, models.LeaseAddress, "10.0.100.1", "10.0.100.3"),
 	}
 	err := routeSet.Create(recorder, req)
 
-	var response api.Error
-	decodeJSON(t, recorder.Body, &response)
-
-	assert.Equal(t, http.StatusBadRequest, recorder.Code)
-	assert.Equal(t, api.BadImageIDError, response)
-	assert.Contains(t, logs.String(), "parsing \\\"garbage\\\": invalid syntax")
 	assert.Nil(t, err)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
 }
 
-func TestInstanceList(t *testing.T) {
-	req, recorder, _ := createRequest(t, "GET", "/instances", nil)
+func TestInstanceCreateReleasesLeaseWhenCreateFails(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
 
-	store := FakeInstanceStore{
-		_List: func() ([]models.Instance, error) {
-			return []models.Instance{
-				models.Instance{
-					ID:        1,
-					Hostname:  "draupnir-server.example.com",
-					ImageID:   1,
-					Port:      5432,
-					CreatedAt: timestamp(),
-					UpdatedAt: timestamp(),
-					UserEmail: "test@draupnir",
-				},
-				models.Instance{
-					ID:        2,
-					Hostname:  "draupnir-server.example.com",
-					ImageID:   1,
-					Port:      5433,
-					CreatedAt: timestamp(),
-					UpdatedAt: timestamp(),
-					UserEmail: "otheruser@draupnir",
-				},
-			}, nil
-		},
+	var released []string
+	leases := fakeLedger(t, models.LeasePort, "5432", "5433")
+	store := leases.Store.(FakeLeaseStore)
+	store._Release = func(kind, value, owner string) error {
+		assert.Equal(t, "test", owner)
+		released = append(released, kind+":"+value)
+		return nil
 	}
+	leases.Store = store
 
-	routeSet := Instances{InstanceStore: store}
-	err := routeSet.List(recorder, req)
-
-	var response jsonapi.ManyPayload
-	decodeJSON(t, recorder.Body, &response)
+	routeSet := Instances{
+		InstanceStore: FakeInstanceStore{
+			_Create: func(instance models.Instance) (models.Instance, error) {
+				return instance, errors.New("connection refused")
+			},
+		},
+		ImageStore: FakeImageStore{
+			_Get: func(id int) (models.Image, error) {
+				return models.Image{ID: 1, Ready: true}, nil
+			},
+		},
+		MinInstancePort: 5432,
+		MaxInstancePort: 5435,
+		Ledger:          leases,
+	}
+	err := routeSet.Create(recorder, req)
 
-	assert.Equal(t, http.StatusOK, recorder.Code)
-	assert.Equal(t, listInstancesFixture, response)
-	assert.Nil(t, err)
+	assert.EqualError(t, err, "failed to create instance: connection refused")
+	assert.Equal(t, []string{"port:5434"}, released)
 }
 
-func TestInstanceGet(t *testing.T) {
-	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
+func TestInstanceCreateReturnsErrorWithUnreadyImage(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
 
-	store := FakeInstanceStore{
-		_Get: func(id int) (models.Instance, error) {
+	instanceStore := FakeInstanceStore{
+		_Create: func(image models.Instance) (models.Instance, error) {
 			return models.Instance{
 				ID:        1,
 				Hostname:  "draupnir-server.example.com",
 				ImageID:   1,
-				Port:      5432,
 				CreatedAt: timestamp(),
 				UpdatedAt: timestamp(),
-				UserEmail: "test@draupnir",
 			}, nil
 		},
 	}
 
-	whitelistedAddressStore := FakeWhitelistedAddressStore{
-		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
-			assert.Equal(t, 1, addr.Instance.ID)
-			assert.Equal(t, "1.2.3.4", addr.IPAddress)
-			return models.WhitelistedAddress{
-				IPAddress: addr.IPAddress,
-				Instance:  addr.Instance,
-				CreatedAt: timestamp(),
-				UpdatedAt: timestamp(),
-			}, nil
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: false}, nil
 		},
 	}
 
 	executor := FakeExecutor{
-		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
-			assert.Equal(t, 1, id)
-			return fakeCredentialsMap, nil
+		_CreateInstance: func(ctx context.Context, instanceID int, imageID int, port int, address string, schemaOnly bool) error {
+			return nil
 		},
 	}
 
-	errorHandler := FakeErrorHandler{}
 	routeSet := Instances{
-		InstanceStore:           store,
-		WhitelistedAddressStore: whitelistedAddressStore,
-		ApplyWhitelist:          func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
-		Executor:                executor,
+		InstanceStore: instanceStore,
+		ImageStore:    imageStore,
+		Executor:      executor,
 	}
-	router := mux.NewRouter()
-	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
-	router.ServeHTTP(recorder, req)
-
-	assert.Equal(t, http.StatusOK, recorder.Code)
-	assert.Nil(t, errorHandler.Error)
+	err := routeSet.Create(recorder, req)
 
-	var response jsonapi.OnePayload
+	var response api.Error
 	decodeJSON(t, recorder.Body, &response)
 
-	assert.Equal(t, getInstanceFixture, response)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.UnreadyImageError, response)
+	assert.Nil(t, err)
 }
 
-func TestInstanceGetFromWrongUser(t *testing.T) {
-	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
+func TestInstanceCreateBlockedByGuardrail(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
 
-	store := FakeInstanceStore{
-		_Get: func(id int) (models.Instance, error) {
-			assert.Equal(t, 1, id)
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
 
-			return models.Instance{
-				ID:        1,
-				Hostname:  "draupnir-server.example.com",
-				ImageID:   1,
-				Port:      5432,
-				CreatedAt: timestamp(),
-				UpdatedAt: timestamp(),
-				UserEmail: "otheruser@draupnir",
+	// No instance is created, so the instance store isn't used
+	executor := FakeExecutor{
+		_RetrieveImageSettings: func(ctx context.Context, id int) ([]models.CloneSetting, error) {
+			assert.Equal(t, 1, id)
+			return []models.CloneSetting{
+				{Source: "postgresql.conf", Name: "primary_conninfo", Value: "'host=db port=5432 password=secret'"},
 			}, nil
 		},
 	}
 
 	routeSet := Instances{
-		InstanceStore: store,
+		InstanceStore: FakeInstanceStore{},
+		ImageStore:    imageStore,
+		Executor:      executor,
+		Guardrail:     guardrail.Scanner{Mode: guardrail.ModeBlock},
 	}
-
-	errorHandler := FakeErrorHandler{}
-	router := mux.NewRouter()
-	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
-	router.ServeHTTP(recorder, req)
+	err := routeSet.Create(recorder, req)
 
 	var response api.Error
 	decodeJSON(t, recorder.Body, &response)
 
-	assert.Equal(t, http.StatusNotFound, recorder.Code)
-	assert.Equal(t, api.NotFoundError, response)
-	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.ProductionReferencesError(
+		"image refers to production: postgresql.conf primary_conninfo contains a password",
+	), response)
+	assert.Nil(t, err)
+}
+
+func TestInstanceCreateBlockedByStaleAnonymisation(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	specs, dir := writeAnonSpec(t, "UPDATE users SET email = NULL;", anonaudit.PolicyBlock)
+	defer os.RemoveAll(dir)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true, Anon: "UPDATE users SET email = 'x';"}, nil
+		},
+	}
+
+	// No instance is created, so the instance store isn't used
+	routeSet := Instances{
+		InstanceStore: FakeInstanceStore{},
+		ImageStore:    imageStore,
+		AnonSpecs:     specs,
+	}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.StaleAnonymisationError("default"), response)
+	assert.Nil(t, err)
+}
+
+func TestInstanceCreateReturnsErrorWhenQuotaExceeded(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &CreateInstanceRequest{ImageID: "1"})
+	req, recorder, logs := createRequest(t, "POST", "/instances", body)
+
+	instanceStore := FakeInstanceStore{
+		_List: func() ([]models.Instance, error) {
+			return []models.Instance{
+				{ID: 1, UserEmail: "test@draupnir"},
+				{ID: 2, UserEmail: "test@draupnir"},
+				{ID: 3, UserEmail: "other@draupnir"},
+			}, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore: instanceStore,
+		ImageStore:    imageStore,
+		Quota:         InstanceQuota{MaxPerUser: 2},
+	}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, "Instance Quota Exceeded", response.Title)
+	assert.Contains(t, response.Detail, "test@draupnir already has 2 of the 2 instances")
+	assert.Contains(t, logs.String(), "instance quota exceeded")
+}
+
+func TestInstanceCreateRequiresAccessToRestrictedFamily(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayload(body, &CreateInstanceRequest{ImageID: "1"})
+	req, recorder, logs := createRequest(t, "POST", "/instances", body)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{
+				ID:          1,
+				Ready:       true,
+				Annotations: models.Annotations{freshness.FamilyAnnotation: "payments"},
+			}, nil
+		},
+	}
+
+	routeSet := Instances{
+		ImageStore: imageStore,
+		Policies: audit.Policies{
+			"payments": audit.Policy{Family: "payments", Approvers: []string{"approver@draupnir"}},
+		},
+		Access: audit.AccessRequests{
+			Store: FakeAccessRequestStore{
+				_Active: func(userEmail, family string, now time.Time) (models.AccessRequest, error) {
+					assert.Equal(t, "test@draupnir", userEmail)
+					assert.Equal(t, "payments", family)
+					return models.AccessRequest{}, sql.ErrNoRows
+				},
+			},
+		},
+	}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, api.AccessRequiredError("payments"), response)
+	assert.Contains(t, logs.String(), "access to restricted family required")
+}
+
+func TestInstanceQuotaExceeded(t *testing.T) {
+	instances := []models.Instance{
+		{ID: 1, UserEmail: "test@draupnir"},
+		{ID: 2, UserEmail: "ci@draupnir"},
+		{ID: 3, UserEmail: "ci@draupnir"},
+	}
+
+	quota := InstanceQuota{MaxPerUser: 1, MaxTotal: 5, Overrides: map[string]int{"ci@draupnir": 4}}
+
+	assert.Contains(t, quota.exceeded(instances, "test@draupnir", 1), "test@draupnir already has 1 of the 1 instances")
+	assert.Equal(t, "", quota.exceeded(instances, "new@draupnir", 1))
+	assert.Equal(t, "", quota.exceeded(instances, "ci@draupnir", 2), "overrides replace the per-user limit")
+	assert.Contains(t, quota.exceeded(instances, "ci@draupnir", 3), "ci@draupnir already has 2 of the 4 instances")
+	assert.Contains(t, quota.exceeded(append(instances, models.Instance{ID: 4}, models.Instance{ID: 5}), "new@draupnir", 1), "There are already 5 of the 5 instances")
+	assert.Equal(t, "", quota.exceeded(instances, auth.UPLOAD_USER_EMAIL, 10), "admins aren't limited")
+}
+
+func TestInstanceCreateReturnsErrorWithInvalidPayload(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := map[string]string{"this is": "not a valid JSON API request payload"}
+	json.NewEncoder(body).Encode(&request)
+	req, recorder, logs := createRequest(t, "POST", "/instances", body)
+
+	err := Instances{}.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.InvalidJSONError, response)
+	assert.Contains(t, logs.String(), "not a jsonapi representation")
+}
+
+func TestInstanceCreateWithInvalidImageID(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "garbage"}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, logs := createRequest(t, "POST", "/instances", body)
+
+	routeSet := Instances{
+		Executor: FakeExecutor{},
+	}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.BadImageIDError, response)
+	assert.Contains(t, logs.String(), "parsing \\\"garbage\\\": invalid syntax")
+	assert.Nil(t, err)
+}
+
+func TestInstanceList(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances", nil)
+
+	store := FakeInstanceStore{
+		_ListPage: func(filter store.InstanceFilter, sort store.Sort, page store.Page) ([]models.Instance, bool, error) {
+			// Users only list their own instances
+			assert.Equal(t, store.InstanceFilter{UserEmail: "test@draupnir"}, filter)
+			assert.Equal(t, store.Page{}, page)
+
+			return []models.Instance{
+				models.Instance{
+					ID:        1,
+					Hostname:  "draupnir-server.example.com",
+					ImageID:   1,
+					Port:      5432,
+					CreatedAt: timestamp(),
+					UpdatedAt: timestamp(),
+					UserEmail: "test@draupnir",
+					Status:    models.InstanceRunning,
+				},
+			}, false, nil
+		},
+	}
+
+	routeSet := Instances{InstanceStore: store}
+	err := routeSet.List(recorder, req)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, listInstancesFixture, response)
+	assert.Nil(t, err)
+}
+
+func TestInstanceListWithFilter(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances?filter[user]=me&filter[image_id]=2", nil)
+
+	store := FakeInstanceStore{
+		_ListPage: func(filter store.InstanceFilter, sort store.Sort, page store.Page) ([]models.Instance, bool, error) {
+			assert.Equal(t, store.InstanceFilter{UserEmail: "test@draupnir", ImageID: 2}, filter)
+			return []models.Instance{
+				models.Instance{ID: 2, ImageID: 2, UserEmail: "test@draupnir"},
+			}, false, nil
+		},
+	}
+
+	routeSet := Instances{InstanceStore: store}
+	err := routeSet.List(recorder, req)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, response.Data, 1)
+	assert.Equal(t, "2", response.Data[0].ID)
+}
+
+func TestInstanceListOfAnotherUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances?filter[user]=otheruser@draupnir", nil)
+
+	// The store isn't asked for another user's instances
+	routeSet := Instances{InstanceStore: FakeInstanceStore{}}
+	err := routeSet.List(recorder, req)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Empty(t, response.Data)
+}
+
+func TestInstanceListWithStatus(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances?status=standby,expired", nil)
+
+	store := FakeInstanceStore{
+		_ListPage: func(filter store.InstanceFilter, sort store.Sort, page store.Page) ([]models.Instance, bool, error) {
+			assert.Equal(t, []string{models.InstanceStandby, models.InstanceExpired}, filter.Statuses)
+			return []models.Instance{
+				models.Instance{ID: 2, UserEmail: "test@draupnir", Status: models.InstanceStandby},
+				models.Instance{ID: 3, UserEmail: "test@draupnir", Status: models.InstanceExpired},
+			}, false, nil
+		},
+	}
+
+	routeSet := Instances{InstanceStore: store}
+	err := routeSet.List(recorder, req)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, response.Data, 2)
+	assert.Equal(t, "2", response.Data[0].ID)
+	assert.Equal(t, "standby", response.Data[0].Attributes["status"])
+	assert.Equal(t, "3", response.Data[1].ID)
+}
+
+func TestInstanceListPaginated(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances?status=running&page[number]=2&page[size]=1", nil)
+
+	store := FakeInstanceStore{
+		_ListPage: func(filter store.InstanceFilter, sort store.Sort, page store.Page) ([]models.Instance, bool, error) {
+			assert.Equal(t, store.Page{Number: 2, Size: 1}, page)
+			return []models.Instance{
+				models.Instance{ID: 2, UserEmail: "test@draupnir", Status: models.InstanceRunning},
+			}, true, nil
+		},
+	}
+
+	routeSet := Instances{InstanceStore: store}
+	err := routeSet.List(recorder, req)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Len(t, response.Data, 1)
+	if assert.NotNil(t, response.Links) {
+		// Other query parameters, such as filters, are kept
+		assert.Equal(t, map[string]string{
+			"first": "/instances?page%5Bnumber%5D=1&page%5Bsize%5D=1&status=running",
+			"prev":  "/instances?page%5Bnumber%5D=1&page%5Bsize%5D=1&status=running",
+			"next":  "/instances?page%5Bnumber%5D=3&page%5Bsize%5D=1&status=running",
+		}, *response.Links)
+	}
+}
+
+func TestInstanceListSorted(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances?sort=-expires_at", nil)
+
+	store := FakeInstanceStore{
+		_ListPage: func(filter store.InstanceFilter, sort store.Sort, page store.Page) ([]models.Instance, bool, error) {
+			assert.Equal(t, store.Sort{{Field: "expires_at", Descending: true}}, sort)
+			return []models.Instance{}, false, nil
+		},
+	}
+
+	err := Instances{InstanceStore: store}.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+}
+
+func TestInstanceListWithInvalidSort(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances?sort=backed_up_at", nil)
+
+	err := Instances{InstanceStore: FakeInstanceStore{}}.List(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Invalid Sort", response.Title)
+}
+
+func TestInstanceListWithInvalidPage(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances?page[size]=1000", nil)
+
+	err := Instances{InstanceStore: FakeInstanceStore{}}.List(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.InvalidPaginationError("page[size] must be an integer between 1 and 500"), response)
+}
+
+func TestInstanceSummary(t *testing.T) {
+	counts := []models.InstanceCount{
+		models.NewInstanceCount(models.InstanceCountByStatus, models.InstanceRunning, 2),
+		models.NewInstanceCount(models.InstanceCountByOwner, "test@draupnir", 2),
+	}
+
+	testCases := []struct {
+		name          string
+		user          string
+		expectedOwner string
+	}{
+		{"user", "test@draupnir", "test@draupnir"},
+		{"upload user", auth.UPLOAD_USER_EMAIL, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder, _ := createRequest(t, "GET", "/instances/summary", nil)
+			req = req.WithContext(context.WithValue(req.Context(), middleware.AuthUserKey, tc.user))
+
+			store := FakeInstanceStore{
+				_Count: func(userEmail string) ([]models.InstanceCount, error) {
+					assert.Equal(t, tc.expectedOwner, userEmail)
+					return counts, nil
+				},
+			}
+
+			err := Instances{InstanceStore: store}.Summary(recorder, req)
+
+			var response jsonapi.ManyPayload
+			decodeJSON(t, recorder.Body, &response)
+
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Len(t, response.Data, 2)
+			assert.Equal(t, "status:running", response.Data[0].ID)
+			assert.Equal(t, "instance_counts", response.Data[0].Type)
+			assert.Equal(t, "running", response.Data[0].Attributes["value"])
+			assert.Equal(t, float64(2), response.Data[0].Attributes["count"])
+			assert.Equal(t, "owner", response.Data[1].Attributes["dimension"])
+		})
+	}
+}
+
+func TestInstanceListWithInvalidFilter(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances?filter[ready]=true", nil)
+
+	err := Instances{}.List(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.InvalidFilterError("unknown filter: ready"), response)
+}
+
+func TestInstanceGet(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{
+				ID:        1,
+				Hostname:  "draupnir-server.example.com",
+				ImageID:   1,
+				Port:      5432,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+				UserEmail: "test@draupnir",
+				Status:    models.InstanceRunning,
+			}, nil
+		},
+	}
+
+	whitelistedAddressStore := FakeWhitelistedAddressStore{
+		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+			assert.Equal(t, 1, addr.Instance.ID)
+			assert.Equal(t, "1.2.3.4", addr.IPAddress)
+			return models.WhitelistedAddress{
+				IPAddress: addr.IPAddress,
+				Instance:  addr.Instance,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+			}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+			assert.Equal(t, 1, id)
+			return fakeCredentialsMap, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{
+		InstanceStore:           store,
+		WhitelistedAddressStore: whitelistedAddressStore,
+		ApplyWhitelist:          func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
+		Executor:                executor,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, getInstanceFixture, response)
+}
+
+func TestInstanceGetFromWrongUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			assert.Equal(t, 1, id)
+
+			return models.Instance{
+				ID:        1,
+				Hostname:  "draupnir-server.example.com",
+				ImageID:   1,
+				Port:      5432,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+				UserEmail: "otheruser@draupnir",
+			}, nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore: store,
+	}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceDestroy(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/instances/1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{
+				ID:        1,
+				Hostname:  "draupnir-server.example.com",
+				ImageID:   1,
+				Port:      5432,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+				UserEmail: "test@draupnir",
+			}, nil
+		},
+		_Destroy: func(instance models.Instance) error {
+			return nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_DestroyInstance: func(ctx context.Context, instanceID int) error {
+			return nil
+		},
+	}
+
+	var jobs []models.Job
+	routeSet := Instances{
+		InstanceStore:  store,
+		ApplyWhitelist: func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
+		Executor:       executor,
+		JobStore:       recordJobs(&jobs),
+	}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, 0, len(recorder.Body.Bytes()))
+	assert.Equal(t, 1, len(jobs))
+	assert.Equal(t, models.JobDestroyInstance, jobs[0].Kind)
+	assert.Equal(t, models.JobSucceeded, jobs[0].Status)
+}
+
+func TestInstanceDestroyAsync(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/instances/1", nil)
+	req.Header.Set("Prefer", "respond-async")
+
+	destroyed := false
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"}, nil
+		},
+		_Destroy: func(instance models.Instance) error {
+			destroyed = true
+			return nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_DestroyInstance: func(ctx context.Context, instanceID int) error {
+			assert.Equal(t, 1, instanceID)
+			return nil
+		},
+	}
+
+	var recorded []models.Job
+	workers, wait := startWorkers(&recorded)
+
+	routeSet := Instances{
+		InstanceStore:  store,
+		ApplyWhitelist: func(s string) {},
+		Executor:       executor,
+		JobStore:       workers.JobStore,
+		Workers:        workers,
+	}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, "operations", response.Data.Type)
+	assert.Equal(t, "instances", response.Data.Attributes["resource_type"])
+
+	wait(1)
+	assert.True(t, destroyed)
+	assert.Equal(t, models.JobDestroyInstance, recorded[0].Kind)
+	assert.Equal(t, models.JobSucceeded, recorded[0].Status)
+}
+
+func TestInstanceDestroyFromWrongUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/instances/1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{
+				ID:        1,
+				Hostname:  "draupnir-server.example.com",
+				ImageID:   1,
+				Port:      5432,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+				UserEmail: "otheruser@draupnir",
+			}, nil
+		},
+		_Destroy: func(instance models.Instance) error {
+			return nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_DestroyInstance: func(ctx context.Context, instanceID int) error {
+			return nil
+		},
+	}
+
+	routeSet := Instances{InstanceStore: store, Executor: executor}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceDestroyFromUploadUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "DELETE", "/instances/1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{
+				ID:        1,
+				Hostname:  "draupnir-server.example.com",
+				ImageID:   1,
+				Port:      5432,
+				CreatedAt: timestamp(),
+				UpdatedAt: timestamp(),
+				UserEmail: "test@draupnir",
+			}, nil
+		},
+		_Destroy: func(instance models.Instance) error {
+			return nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_DestroyInstance: func(ctx context.Context, instanceID int) error {
+			return nil
+		},
+	}
+
+	authenticator := auth.FakeAuthenticator{
+		MockAuthenticateRequest: func(r *http.Request) (string, string, error) {
+			return auth.UPLOAD_USER_EMAIL, "", nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{
+		InstanceStore:  store,
+		ApplyWhitelist: func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
+		Executor:       executor,
+		JobStore:       recordJobs(&[]models.Job{}),
+	}
+	router := mux.NewRouter()
+	route := chain.New(errorHandler.Handle).
+		Add(middleware.Authenticate(authenticator)).
+		Resolve(routeSet.Destroy)
+	router.HandleFunc("/instances/{id}", route).Methods("DELETE")
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, 0, len(recorder.Body.Bytes()))
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceStorage(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/storage", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			assert.Equal(t, 1, id)
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_RetrieveInstanceDiskUsage: func(ctx context.Context, id int) (models.DiskUsage, error) {
+			assert.Equal(t, 1, id)
+			return models.DiskUsage{TotalBytes: 4096, ExclusiveBytes: 1024, SharedBytes: 3072}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/storage", errorHandler.Handle(routeSet.Storage))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, instanceStorageReportFixture, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceStorageFromWrongUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/storage", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/storage", errorHandler.Handle(routeSet.Storage))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceDiagnostics(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/diagnostics", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			assert.Equal(t, 1, id)
+			return models.Instance{ID: 1, ImageID: 1, Port: 5432, UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_InspectInstanceActivity: func(ctx context.Context, instance models.Instance) (models.InstanceActivity, error) {
+			assert.Equal(t, uint16(5432), instance.Port)
+			return models.InstanceActivity{
+				Sessions: []models.SessionActivity{
+					{PID: 10, State: "idle in transaction", Duration: 5 * time.Minute},
+					{PID: 11, State: "active", Duration: 2 * time.Minute, WaitEventType: "Lock", BlockedBy: []int{10}},
+				},
+				IOPressure: 2.5,
+			}, nil
+		},
+	}
+
+	jobs := FakeJobStore{
+		_ListRunning: func() ([]models.Job, error) {
+			return []models.Job{
+				{ID: 1, Kind: models.JobFinaliseImage, Status: models.JobRunning},
+				{ID: 2, Kind: models.JobDestroyInstance, Status: models.JobRunning},
+				// Queued finalisations aren't baking yet
+				{ID: 3, Kind: models.JobFinaliseImage, Status: models.JobQueued},
+			}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store, Executor: executor, JobStore: jobs}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/diagnostics", errorHandler.Handle(routeSet.Diagnostics))
+	router.ServeHTTP(recorder, req)
+
+	var response models.InstanceDiagnostics
+	assert.Nil(t, jsonapi.UnmarshalPayload(recorder.Body, &response))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, 1, response.ID)
+	assert.Equal(t, 1, response.ActiveQueries)
+	assert.Equal(t, 1, response.LockWaits)
+	assert.Equal(t, 2.5, response.IOPressure)
+	assert.Equal(t, 1, response.ConcurrentBakes)
+	assert.Equal(t, []string{
+		"1 session is waiting for locks, the longest for 2m0s, blocked by session 10",
+		"session 10 has been idle in a transaction for 5m0s, which holds its locks and stops vacuum cleaning up",
+		"1 image is being finalised on the host, which competes with instances for IO and CPU",
+	}, response.Causes)
+}
+
+func TestInstanceDiagnosticsOfRegulatedInstance(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/diagnostics", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"}, nil
+		},
+	}
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			assert.Equal(t, 1, id)
+			return models.Image{
+				ID:          1,
+				Ready:       true,
+				Annotations: models.Annotations{freshness.FamilyAnnotation: "payments"},
+			}, nil
+		},
+	}
+	executor := FakeExecutor{
+		_InspectInstanceActivity: func(ctx context.Context, instance models.Instance) (models.InstanceActivity, error) {
+			t.Error("the activity of a regulated instance was inspected")
+			return models.InstanceActivity{}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{
+		InstanceStore: store,
+		ImageStore:    imageStore,
+		Executor:      executor,
+		Policies:      audit.Policies{"payments": audit.Policy{Family: "payments"}},
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/diagnostics", errorHandler.Handle(routeSet.Diagnostics))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, api.RegulatedInstanceDiagnosticsError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceDiagnosticsFromWrongUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/diagnostics", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/diagnostics", errorHandler.Handle(routeSet.Diagnostics))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceLogs(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/logs?lines=2&follow=true", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			assert.Equal(t, 1, id)
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_StreamInstanceLog: func(ctx context.Context, id int, lines int, follow bool, w io.Writer) error {
+			assert.Equal(t, 1, id)
+			assert.Equal(t, 2, lines)
+			assert.True(t, follow)
+			_, err := fmt.Fprint(w, "LOG:  checkpoint starting: time\nLOG:  checkpoint complete\n")
+			return err
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/logs", errorHandler.Handle(routeSet.Logs))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "LOG:  checkpoint starting: time\nLOG:  checkpoint complete\n", recorder.Body.String())
+	assert.True(t, recorder.Flushed)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceLogsWithInvalidLines(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/logs?lines=-1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/logs", errorHandler.Handle(routeSet.Logs))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.InvalidLogLinesError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceLogsOfRegulatedInstance(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/logs", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"}, nil
+		},
+	}
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			assert.Equal(t, 1, id)
+			return models.Image{
+				ID:          1,
+				Ready:       true,
+				Annotations: models.Annotations{freshness.FamilyAnnotation: "payments"},
+			}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{
+		InstanceStore: store,
+		ImageStore:    imageStore,
+		Policies:      audit.Policies{"payments": audit.Policy{Family: "payments"}},
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/logs", errorHandler.Handle(routeSet.Logs))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, api.RegulatedInstanceLogsError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceLogsFromWrongUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/logs", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/logs", errorHandler.Handle(routeSet.Logs))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceCreateStandby(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1", Standby: true}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	instanceStore := FakeInstanceStore{
+		_Create: func(instance models.Instance) (models.Instance, error) {
+			assert.True(t, instance.Standby)
+			instance.ID = 1
+			return instance, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	whitelistedAddressStore := FakeWhitelistedAddressStore{
+		_Create: func(addr models.WhitelistedAddress) (models.WhitelistedAddress, error) {
+			return addr, nil
+		},
+	}
+
+	executor := FakeExecutor{
+		_HasImageBase: func(ctx context.Context, id int) (bool, error) {
+			assert.Equal(t, 1, id)
+			return true, nil
+		},
+		_CreateStandbyInstance: func(ctx context.Context, imageID int, instanceID int, port int) error {
+			assert.Equal(t, 1, imageID)
+			assert.Equal(t, 1, instanceID)
+			return nil
+		},
+		_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+			return fakeCredentialsMap, nil
+		},
+	}
+
+	routeSet := Instances{
+		InstanceStore:           instanceStore,
+		ImageStore:              imageStore,
+		WhitelistedAddressStore: whitelistedAddressStore,
+		Executor:                executor,
+		ApplyWhitelist:          func(s string) {},
+		MinInstancePort:         5432,
+		MaxInstancePort:         5435,
+		StandbyEnabled:          true,
+		Ledger:                  fakeLedger(t, models.LeasePort),
+	}
+	err := routeSet.Create(recorder, req)
+
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	assert.Nil(t, err)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, true, response.Data.Attributes["standby"])
+}
+
+func TestInstanceCreateStandbyWhenDisabled(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	request := CreateInstanceRequest{ImageID: "1", Standby: true}
+	jsonapi.MarshalOnePayload(body, &request)
+	req, recorder, _ := createRequest(t, "POST", "/instances", body)
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			return models.Image{ID: 1, Ready: true}, nil
+		},
+	}
+
+	routeSet := Instances{ImageStore: imageStore, StandbyEnabled: false}
+	err := routeSet.Create(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.StandbyUnavailableError, response)
+	assert.Nil(t, err)
 }
 
-func TestInstanceDestroy(t *testing.T) {
-	req, recorder, _ := createRequest(t, "DELETE", "/instances/1", nil)
+func TestInstancePromote(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/promote", nil)
 
-	store := FakeInstanceStore{
+	instanceStore := FakeInstanceStore{
 		_Get: func(id int) (models.Instance, error) {
-			return models.Instance{
-				ID:        1,
-				Hostname:  "draupnir-server.example.com",
-				ImageID:   1,
-				Port:      5432,
-				CreatedAt: timestamp(),
-				UpdatedAt: timestamp(),
-				UserEmail: "test@draupnir",
-			}, nil
+			assert.Equal(t, 1, id)
+			return models.Instance{ID: 1, ImageID: 2, UserEmail: "test@draupnir", Standby: true}, nil
 		},
-		_Destroy: func(instance models.Instance) error {
-			return nil
+		_MarkAsPromoted: func(instance models.Instance) (models.Instance, error) {
+			assert.Equal(t, 1, instance.ID)
+			instance.Standby = false
+			return instance, nil
+		},
+	}
+
+	imageStore := FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			assert.Equal(t, 2, id)
+			return models.Image{ID: 2, Ready: true, Anon: "SELECT 1;"}, nil
 		},
 	}
 
 	executor := FakeExecutor{
-		_DestroyInstance: func(ctx context.Context, instanceID int) error {
+		_PromoteInstance: func(ctx context.Context, instance models.Instance, anon string) error {
+			assert.Equal(t, 1, instance.ID)
+			assert.Equal(t, "SELECT 1;", anon)
 			return nil
 		},
 	}
 
-	routeSet := Instances{
-		InstanceStore:  store,
-		ApplyWhitelist: func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
-		Executor:       executor,
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: instanceStore, ImageStore: imageStore, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/promote", errorHandler.Handle(routeSet.Promote))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, false, response.Data.Attributes["standby"])
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstancePromoteWhenNotStandby(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/promote", nil)
+
+	instanceStore := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 2, UserEmail: "test@draupnir"}, nil
+		},
 	}
 
 	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: instanceStore}
 	router := mux.NewRouter()
-	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
+	router.HandleFunc("/instances/{id}/promote", errorHandler.Handle(routeSet.Promote))
 	router.ServeHTTP(recorder, req)
 
-	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.InstanceNotStandbyError, response)
 	assert.Nil(t, errorHandler.Error)
-	assert.Equal(t, 0, len(recorder.Body.Bytes()))
 }
 
-func TestInstanceDestroyFromWrongUser(t *testing.T) {
-	req, recorder, _ := createRequest(t, "DELETE", "/instances/1", nil)
+func TestInstancePromoteFromWrongUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/promote", nil)
+
+	instanceStore := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 2, UserEmail: "otheruser@draupnir", Standby: true}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: instanceStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/promote", errorHandler.Handle(routeSet.Promote))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceExtend(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	body := bytes.NewBufferString(`{"data": {"type": "instances", "attributes": {"by": "4h"}}}`)
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/extend", body)
+
+	instanceStore := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 2, UserEmail: "test@draupnir", ExpiresAt: &expiresAt}, nil
+		},
+		_Extend: func(instance models.Instance, extended time.Time) (models.Instance, error) {
+			assert.Equal(t, expiresAt.Add(4*time.Hour), extended)
+			instance.ExpiresAt = &extended
+			return instance, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: instanceStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/extend", errorHandler.Handle(routeSet.Extend))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, expiresAt.Add(4*time.Hour).UTC().Format(time.RFC3339), response.Data.Attributes["expires_at"])
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceExtendWhenExpired(t *testing.T) {
+	expiresAt := time.Now().Add(-time.Hour)
+
+	body := bytes.NewBufferString(`{"data": {"type": "instances", "attributes": {"by": "4h"}}}`)
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/extend", body)
+
+	instanceStore := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 2, UserEmail: "test@draupnir", ExpiresAt: &expiresAt}, nil
+		},
+		_Extend: func(instance models.Instance, extended time.Time) (models.Instance, error) {
+			// The extension starts from now, rather than the expiry
+			assert.WithinDuration(t, time.Now().Add(4*time.Hour), extended, time.Minute)
+			instance.ExpiresAt = &extended
+			return instance, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: instanceStore}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/extend", errorHandler.Handle(routeSet.Extend))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceExtendErrors(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour)
+
+	for _, tc := range []struct {
+		name     string
+		by       string
+		instance models.Instance
+		status   int
+		error    api.Error
+	}{
+		{
+			name:     "never expires",
+			by:       "4h",
+			instance: models.Instance{ID: 1, UserEmail: "test@draupnir"},
+			status:   http.StatusUnprocessableEntity,
+			error:    api.InstanceNeverExpiresError,
+		},
+		{
+			name:     "invalid duration",
+			by:       "tomorrow",
+			instance: models.Instance{ID: 1, UserEmail: "test@draupnir", ExpiresAt: &expiresAt},
+			status:   http.StatusBadRequest,
+			error:    api.InvalidExtensionError,
+		},
+		{
+			name:     "negative duration",
+			by:       "-4h",
+			instance: models.Instance{ID: 1, UserEmail: "test@draupnir", ExpiresAt: &expiresAt},
+			status:   http.StatusBadRequest,
+			error:    api.InvalidExtensionError,
+		},
+		{
+			name:     "wrong user",
+			by:       "4h",
+			instance: models.Instance{ID: 1, UserEmail: "otheruser@draupnir", ExpiresAt: &expiresAt},
+			status:   http.StatusNotFound,
+			error:    api.NotFoundError,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			body := bytes.NewBufferString(fmt.Sprintf(`{"data": {"type": "instances", "attributes": {"by": %q}}}`, tc.by))
+			req, recorder, _ := createRequest(t, "POST", "/instances/1/extend", body)
+
+			instanceStore := FakeInstanceStore{
+				_Get: func(id int) (models.Instance, error) {
+					return tc.instance, nil
+				},
+			}
+
+			errorHandler := FakeErrorHandler{}
+			routeSet := Instances{InstanceStore: instanceStore}
+			router := mux.NewRouter()
+			router.HandleFunc("/instances/{id}/extend", errorHandler.Handle(routeSet.Extend))
+			router.ServeHTTP(recorder, req)
+
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+
+			assert.Equal(t, tc.status, recorder.Code)
+			assert.Equal(t, tc.error, response)
+			assert.Nil(t, errorHandler.Error)
+		})
+	}
+}
+
+func TestInstanceAnnotate(t *testing.T) {
+	body := bytes.NewBufferString(`{"data": {"type": "instances", "attributes": {"annotations": {"verified": "abc123"}}}}`)
+	req, recorder, _ := createRequest(t, "PATCH", "/instances/1", body)
 
 	store := FakeInstanceStore{
 		_Get: func(id int) (models.Instance, error) {
-			return models.Instance{
-				ID:        1,
-				Hostname:  "draupnir-server.example.com",
-				ImageID:   1,
-				Port:      5432,
-				CreatedAt: timestamp(),
-				UpdatedAt: timestamp(),
-				UserEmail: "otheruser@draupnir",
-			}, nil
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"}, nil
 		},
-		_Destroy: func(instance models.Instance) error {
-			return nil
+		_Annotate: func(instance models.Instance, patch models.Annotations) (models.Instance, error) {
+			assert.Equal(t, models.Annotations{"verified": "abc123"}, patch)
+			instance.Annotations = patch
+			return instance, nil
 		},
 	}
 
-	executor := FakeExecutor{
-		_DestroyInstance: func(ctx context.Context, instanceID int) error {
-			return nil
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Annotate))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, map[string]interface{}{"verified": "abc123"}, response.Data.Attributes["annotations"])
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceLabelWhenTooLarge(t *testing.T) {
+	body := bytes.NewBufferString(`{"data": {"type": "instances", "attributes": {"labels": {"team": "payments"}}}}`)
+	req, recorder, _ := createRequest(t, "PATCH", "/instances/1", body)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"}, nil
+		},
+		_Annotate: func(instance models.Instance, patch models.Annotations) (models.Instance, error) {
+			return instance, nil
+		},
+		_Label: func(instance models.Instance, patch models.Labels) (models.Instance, error) {
+			assert.Equal(t, models.Labels{"team": "payments"}, patch)
+			return instance, errors.New(`pq: new row for relation "instances" violates check constraint "instances_labels_size"`)
 		},
 	}
 
-	routeSet := Instances{InstanceStore: store, Executor: executor}
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Annotate))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.LabelsTooLargeError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceAnnotateFromWrongUser(t *testing.T) {
+	body := bytes.NewBufferString(`{"data": {"type": "instances", "attributes": {"annotations": {"verified": "abc123"}}}}`)
+	req, recorder, _ := createRequest(t, "PATCH", "/instances/1", body)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
 
 	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
 	router := mux.NewRouter()
-	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Destroy)).Methods("DELETE")
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Annotate))
 	router.ServeHTTP(recorder, req)
 
 	var response api.Error
@@ -413,52 +1802,116 @@ func TestInstanceDestroyFromWrongUser(t *testing.T) {
 	assert.Nil(t, errorHandler.Error)
 }
 
-func TestInstanceDestroyFromUploadUser(t *testing.T) {
-	req, recorder, _ := createRequest(t, "DELETE", "/instances/1", nil)
+func TestInstanceExec(t *testing.T) {
+	body := bytes.NewBufferString(`{"data": {"type": "maintenance_operations", "attributes": {"operation": "vacuum_full", "database": "app", "arguments": {"table": "payments"}}}}`)
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/exec", body)
 
 	store := FakeInstanceStore{
 		_Get: func(id int) (models.Instance, error) {
-			return models.Instance{
-				ID:        1,
-				Hostname:  "draupnir-server.example.com",
-				ImageID:   1,
-				Port:      5432,
-				CreatedAt: timestamp(),
-				UpdatedAt: timestamp(),
-				UserEmail: "test@draupnir",
-			}, nil
-		},
-		_Destroy: func(instance models.Instance) error {
-			return nil
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"}, nil
 		},
 	}
 
 	executor := FakeExecutor{
-		_DestroyInstance: func(ctx context.Context, instanceID int) error {
-			return nil
+		_RunMaintenance: func(ctx context.Context, instance models.Instance, operation exec.MaintenanceOperation) (string, error) {
+			assert.Equal(t, 1, instance.ID)
+			assert.Equal(t, "vacuum_full", operation.Name)
+			assert.Equal(t, "app", operation.Database)
+			assert.Equal(t, map[string]string{"table": "payments"}, operation.Arguments)
+			return "VACUUM\n", nil
 		},
 	}
 
-	authenticator := auth.FakeAuthenticator{
-		MockAuthenticateRequest: func(r *http.Request) (string, string, error) {
-			return auth.UPLOAD_USER_EMAIL, "", nil
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store, Executor: executor}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/exec", errorHandler.Handle(routeSet.Exec))
+	router.ServeHTTP(recorder, req)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "maintenance_results", response.Data.Type)
+	assert.Equal(t, "VACUUM\n", response.Data.Attributes["output"])
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceExecWithUnknownOperation(t *testing.T) {
+	body := bytes.NewBufferString(`{"data": {"type": "maintenance_operations", "attributes": {"operation": "drop_database", "database": "app"}}}`)
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/exec", body)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"}, nil
 		},
 	}
 
 	errorHandler := FakeErrorHandler{}
-	routeSet := Instances{
-		InstanceStore:  store,
-		ApplyWhitelist: func(s string) { fmt.Printf("Whitelister trigger called: %s\n", s) },
-		Executor:       executor,
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/exec", errorHandler.Handle(routeSet.Exec))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "Invalid Maintenance Operation", response.Title)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceExecWhenOperationFails(t *testing.T) {
+	body := bytes.NewBufferString(`{"data": {"type": "maintenance_operations", "attributes": {"operation": "reindex", "database": "app", "arguments": {"table": "missing"}}}}`)
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/exec", body)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	output := "ERROR:  relation \"missing\" does not exist\n"
+	executor := FakeExecutor{
+		_RunMaintenance: func(ctx context.Context, instance models.Instance, operation exec.MaintenanceOperation) (string, error) {
+			return "", exec.MaintenanceFailedError{Output: output}
+		},
 	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store, Executor: executor}
 	router := mux.NewRouter()
-	route := chain.New(errorHandler.Handle).
-		Add(middleware.Authenticate(authenticator)).
-		Resolve(routeSet.Destroy)
-	router.HandleFunc("/instances/{id}", route).Methods("DELETE")
+	router.HandleFunc("/instances/{id}/exec", errorHandler.Handle(routeSet.Exec))
 	router.ServeHTTP(recorder, req)
 
-	assert.Equal(t, http.StatusNoContent, recorder.Code)
-	assert.Equal(t, 0, len(recorder.Body.Bytes()))
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+	assert.Equal(t, api.MaintenanceFailedError(output), response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceExecFromWrongUser(t *testing.T) {
+	body := bytes.NewBufferString(`{"data": {"type": "maintenance_operations", "attributes": {"operation": "analyze", "database": "app"}}}`)
+	req, recorder, _ := createRequest(t, "POST", "/instances/1/exec", body)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/exec", errorHandler.Handle(routeSet.Exec))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Equal(t, api.NotFoundError, response)
 	assert.Nil(t, errorHandler.Error)
 }
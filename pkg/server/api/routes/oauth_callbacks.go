@@ -0,0 +1,153 @@
+package routes
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// OAUTH_CALLBACK_EXPIRY is how long a pending OAuth flow is kept before it is
+// considered abandoned and garbage collected. This is deliberately longer than
+// OAUTH_CALLBACK_TIMEOUT, so that flows are normally removed by the request
+// that started them.
+const OAUTH_CALLBACK_EXPIRY = 2 * OAUTH_CALLBACK_TIMEOUT
+
+// The outcomes of an OAuth flow, used to label the oauthFlowsFinished metric
+const (
+	oauthFlowCompleted = "completed"
+	oauthFlowFailed    = "failed"
+	oauthFlowTimedOut  = "timed_out"
+	oauthFlowAbandoned = "abandoned"
+)
+
+var (
+	oauthFlowsStarted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "draupnir_oauth_flows_started_total",
+			Help: "Number of OAuth flows that have been started by a client",
+		},
+	)
+	oauthFlowsFinished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "draupnir_oauth_flows_finished_total",
+			Help: "Number of OAuth flows that have finished, by outcome",
+		},
+		[]string{"outcome"},
+	)
+	oauthFlowsPending = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "draupnir_oauth_flows_pending",
+			Help: "Number of OAuth flows that are in progress, and haven't yet been garbage collected",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(oauthFlowsStarted, oauthFlowsFinished, oauthFlowsPending)
+
+	// Initialise every outcome, so that each series is exported from startup
+	for _, outcome := range []string{oauthFlowCompleted, oauthFlowFailed, oauthFlowTimedOut, oauthFlowAbandoned} {
+		oauthFlowsFinished.WithLabelValues(outcome)
+	}
+}
+
+// OAuthCallbacks keeps track of the OAuth flows that are in progress, keyed by
+// the state parameter that the client provided when starting the flow.
+//
+// Flows are normally removed by the request that registered them, but any that
+// are left behind are removed once they expire, so that the set of pending
+// flows can't grow without bound.
+type OAuthCallbacks struct {
+	mutex   sync.Mutex
+	pending map[string]pendingOAuthCallback
+}
+
+type pendingOAuthCallback struct {
+	channel   chan OAuthCallback
+	expiresAt time.Time
+}
+
+func NewOAuthCallbacks() *OAuthCallbacks {
+	return &OAuthCallbacks{pending: make(map[string]pendingOAuthCallback)}
+}
+
+// Register starts tracking a flow, returning the channel through which its
+// outcome will be delivered. The channel is buffered, so that delivering the
+// outcome never blocks, even if nobody is waiting for it any more.
+func (c *OAuthCallbacks) Register(state string) chan OAuthCallback {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	channel := make(chan OAuthCallback, 1)
+	c.pending[state] = pendingOAuthCallback{
+		channel:   channel,
+		expiresAt: time.Now().Add(OAUTH_CALLBACK_EXPIRY),
+	}
+	oauthFlowsStarted.Inc()
+	oauthFlowsPending.Set(float64(len(c.pending)))
+
+	return channel
+}
+
+// Lookup returns the channel for the flow with the given state, or nil if there
+// is no such flow
+func (c *OAuthCallbacks) Lookup(state string) chan OAuthCallback {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.pending[state].channel
+}
+
+// Finish stops tracking a flow, recording its outcome
+func (c *OAuthCallbacks) Finish(state string, outcome string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.pending, state)
+	oauthFlowsFinished.WithLabelValues(outcome).Inc()
+	oauthFlowsPending.Set(float64(len(c.pending)))
+}
+
+// Len returns the number of flows that are in progress
+func (c *OAuthCallbacks) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.pending)
+}
+
+// Expire removes every flow that expired before the given time, returning the
+// number of flows that were removed
+func (c *OAuthCallbacks) Expire(now time.Time) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	expired := 0
+	for state, callback := range c.pending {
+		if now.After(callback.expiresAt) {
+			delete(c.pending, state)
+			oauthFlowsFinished.WithLabelValues(oauthFlowAbandoned).Inc()
+			expired++
+		}
+	}
+	oauthFlowsPending.Set(float64(len(c.pending)))
+
+	return expired
+}
+
+// Start periodically removes expired flows, until the context is cancelled
+func (c *OAuthCallbacks) Start(ctx context.Context, logger log.Logger, interval time.Duration) error {
+	for {
+		select {
+		case <-time.After(interval):
+			if expired := c.Expire(time.Now()); expired > 0 {
+				logger.With("count", expired).Info("Removed abandoned oauth flows")
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
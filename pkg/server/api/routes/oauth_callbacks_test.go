@@ -0,0 +1,56 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOAuthCallbacksExpire(t *testing.T) {
+	callbacks := NewOAuthCallbacks()
+	callbacks.Register("foo")
+	callbacks.Register("bar")
+
+	assert.Equal(t, 0, callbacks.Expire(time.Now()))
+	assert.Equal(t, 2, callbacks.Len())
+
+	assert.Equal(t, 2, callbacks.Expire(time.Now().Add(OAUTH_CALLBACK_EXPIRY+time.Second)))
+	assert.Equal(t, 0, callbacks.Len())
+	assert.Nil(t, callbacks.Lookup("foo"))
+}
+
+func TestOAuthCallbacksFinish(t *testing.T) {
+	callbacks := NewOAuthCallbacks()
+	callback := callbacks.Register("foo")
+
+	assert.Equal(t, callback, callbacks.Lookup("foo"))
+
+	callbacks.Finish("foo", oauthFlowCompleted)
+
+	assert.Nil(t, callbacks.Lookup("foo"))
+	assert.Equal(t, 0, callbacks.Len())
+}
+
+func TestCreateAccessTokenWhenClientDisconnects(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayloadWithoutIncluded(body, &createAccessTokenRequest{State: "foo"})
+	req, recorder, logs := createRequest(t, "POST", "/access_tokens", body)
+
+	ctx, cancel := context.WithCancel(req.Context())
+	cancel()
+	req = req.WithContext(ctx)
+
+	callbacks := NewOAuthCallbacks()
+	routeSet := AccessTokens{Callbacks: callbacks}
+	err := routeSet.Create(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Contains(t, logs.String(), "Client disconnected")
+	assert.Equal(t, 0, callbacks.Len())
+}
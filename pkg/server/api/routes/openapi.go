@@ -0,0 +1,448 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/openapi"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+// OpenAPI serves an OpenAPI document describing the API, so that clients in
+// other languages can be generated from it
+type OpenAPI struct {
+	// Router is walked for the routes to describe, so that only those that are
+	// served are described, e.g. fault injection's only when it's enabled
+	Router   *mux.Router
+	BasePath string
+}
+
+// Get returns the OpenAPI document. Like the version, it doesn't require an API
+// version or authentication, so that tools can fetch it without a client.
+func (o OpenAPI) Get(w http.ResponseWriter, r *http.Request) error {
+	doc := openapi.New(version.Version)
+	if o.BasePath != "" {
+		doc.Servers = []openapi.Server{{URL: o.BasePath}}
+	}
+
+	err := o.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		// Routes that match any method, such as the plain JSON prefix, serve the
+		// other routes in another format, so aren't described separately
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		path = openapi.PathTemplate(strings.TrimPrefix(path, o.BasePath))
+		for _, method := range methods {
+			doc.Add(method, path, endpoints[method+" "+path])
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to walk routes")
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return errors.Wrap(json.NewEncoder(w).Encode(doc), "failed to encode OpenAPI document")
+}
+
+var (
+	pageParameters = []openapi.Parameter{
+		openapi.Query("page[number]", "The page of the list to return, from 1"),
+		openapi.Query("page[size]", "How many items to return in each page"),
+	}
+	ifNoneMatch = openapi.Parameter{
+		Name:        "If-None-Match",
+		In:          "header",
+		Description: "The ETag of a cached copy, which responds with 304 Not Modified if it's still current",
+		Schema:      &openapi.Schema{Type: "string"},
+	}
+	uploadOffset = openapi.Parameter{
+		Name:        UploadOffsetHeader,
+		In:          "header",
+		Description: "The number of bytes of the upload that the server has received",
+		Required:    true,
+		Schema:      &openapi.Schema{Type: "integer"},
+	}
+)
+
+// listParameters returns the parameters of a paginated list, as well as the
+// given parameters
+func listParameters(parameters ...openapi.Parameter) []openapi.Parameter {
+	return append(parameters, pageParameters...)
+}
+
+// endpoints describes each route, keyed by its method and OpenAPI path. Routes
+// that aren't described here are still listed in the document.
+var endpoints = map[string]openapi.Endpoint{
+	// Health, version and metrics
+	"GET /health_check": {
+		ID: "healthCheck", Summary: "Check the server is healthy", Tag: "Server",
+		Public: true, Unversioned: true, Response: map[string]string{}, Plain: true,
+	},
+	"GET /version": {
+		ID: "getServerVersion", Summary: "Get the server's version and features", Tag: "Server",
+		Public: true, Unversioned: true, Response: models.ServerVersion{},
+	},
+	"GET /openapi.json": {
+		ID: "getOpenAPI", Summary: "Get this document", Tag: "Server",
+		Public: true, Unversioned: true, ResponseType: openapi.JSON,
+	},
+	"GET /metrics": {
+		ID: "getMetrics", Summary: "Get Prometheus metrics", Tag: "Server",
+		Public: true, Unversioned: true, ResponseType: openapi.PlainText,
+	},
+
+	// OAuth, for browsers
+	"GET /authenticate": {
+		ID: "authenticate", Summary: "Redirect to the OAuth provider", Tag: "Access Tokens",
+		Public: true, Unversioned: true, Status: http.StatusFound,
+		Parameters: []openapi.Parameter{openapi.Query("state", "The state that the access token is created with")},
+	},
+	"GET /oauth_callback": {
+		ID: "oauthCallback", Summary: "Complete the OAuth flow", Tag: "Access Tokens",
+		Public: true, Unversioned: true, ResponseType: openapi.HTML,
+	},
+	"GET /device": {
+		ID: "getDevicePage", Summary: "Show the page to approve a device on", Tag: "Access Tokens",
+		Public: true, Unversioned: true, ResponseType: openapi.HTML,
+		Parameters: []openapi.Parameter{openapi.Query("user_code", "The code shown by the device")},
+	},
+	"POST /device": {
+		ID: "approveDevice", Summary: "Approve a device", Tag: "Access Tokens",
+		Public: true, Unversioned: true, RequestType: "application/x-www-form-urlencoded", Status: http.StatusFound,
+	},
+
+	// Access tokens
+	"POST /access_tokens": {
+		ID: "createAccessToken", Summary: "Wait for the OAuth flow to complete, and return its token", Tag: "Access Tokens",
+		Public: true, Request: createAccessTokenRequest{}, Status: http.StatusCreated, Response: oauth2.Token{}, Plain: true,
+	},
+	"POST /access_tokens/device": {
+		ID: "createDeviceAuthorization", Summary: "Start authorising a device", Tag: "Access Tokens",
+		Public: true, Status: http.StatusCreated, Response: models.DeviceAuthorization{},
+	},
+	"POST /access_tokens/device/token": {
+		ID: "createDeviceToken", Summary: "Get a device's token once it's approved", Tag: "Access Tokens",
+		Public: true, Request: createDeviceTokenRequest{}, Status: http.StatusCreated, Response: oauth2.Token{}, Plain: true,
+	},
+	"POST /access_tokens/exchange": {
+		ID: "exchangeToken", Summary: "Exchange an identity for a service account's token", Tag: "Access Tokens",
+		Public: true, Request: exchangeTokenRequest{}, Response: oauth2.Token{}, Plain: true,
+	},
+
+	// Federation and users
+	"GET /federation": {
+		ID: "listFederatedServers", Summary: "List the servers that accept the same credentials", Tag: "Federation",
+		Public: true, Response: models.FederatedServer{}, List: true,
+	},
+	"GET /whoami": {
+		ID: "whoami", Summary: "Get the authenticated user", Tag: "Users",
+		Response: models.User{},
+	},
+
+	// Events
+	"GET /events/images": {
+		ID: "watchImages", Summary: "Stream changes to images as server-sent events", Tag: "Events",
+		ResponseType: openapi.EventStream,
+	},
+	"GET /events/instances": {
+		ID: "watchInstances", Summary: "Stream changes to your instances as server-sent events", Tag: "Events",
+		ResponseType: openapi.EventStream,
+	},
+
+	// Images
+	"GET /images": {
+		ID: "listImages", Summary: "List images", Tag: "Images",
+		Parameters: listParameters(
+			openapi.Query("filter[ready]", "Only list images that are, or aren't, ready"),
+			openapi.Query("filter[labels.KEY]", "Only list images with the label KEY set to the value"),
+			openapi.Query("sort", "A comma separated list of fields to sort by, each prefixed with - for descending order"),
+			ifNoneMatch,
+		),
+		Response: models.Image{}, List: true,
+	},
+	"POST /images": {
+		ID: "createImage", Summary: "Create an image to upload", Tag: "Images",
+		Request: CreateImageRequest{}, Status: http.StatusCreated, Response: models.Image{},
+	},
+	"POST /images/prune": {
+		ID: "pruneImages", Summary: "Destroy old images in bulk", Tag: "Images",
+		Request: PruneImagesRequest{}, Response: models.Image{}, List: true,
+	},
+	"GET /images/{id}": {
+		ID: "getImage", Summary: "Get an image", Tag: "Images",
+		Parameters: []openapi.Parameter{ifNoneMatch}, Response: models.Image{},
+	},
+	"PATCH /images/{id}": {
+		ID: "annotateImage", Summary: "Change an image's annotations and labels", Tag: "Images",
+		Request: AnnotateRequest{}, Response: models.Image{},
+	},
+	"DELETE /images/{id}": {
+		ID: "destroyImage", Summary: "Destroy an image and its instances", Tag: "Images",
+		Status: http.StatusNoContent, Async: true,
+	},
+	"HEAD /images/{id}/upload": {
+		ID: "getImageUploadOffset", Summary: "Get how much of an upload the server has received", Tag: "Images",
+		Headers: map[string]openapi.Header{UploadOffsetHeader: {Schema: &openapi.Schema{Type: "integer"}}},
+	},
+	"PATCH /images/{id}/upload": {
+		ID: "uploadImage", Summary: "Append to an image's upload, a tarball of its data directory", Tag: "Images",
+		Parameters: []openapi.Parameter{uploadOffset}, RequestType: openapi.OctetStream, Status: http.StatusNoContent,
+		Headers: map[string]openapi.Header{UploadOffsetHeader: {Schema: &openapi.Schema{Type: "integer"}}},
+	},
+	"PUT /images/{id}/btrfs_stream": {
+		ID: "uploadImageStream", Summary: "Upload an image as a btrfs send stream", Tag: "Images",
+		RequestType: openapi.OctetStream, Status: http.StatusNoContent,
+	},
+	"POST /images/{id}/done": {
+		ID: "finaliseImage", Summary: "Finalise an image, making it ready for instances", Tag: "Images",
+		Response: models.Image{}, Async: true,
+	},
+	"GET /images/{id}/storage": {
+		ID: "getImageStorage", Summary: "Report the space that an image uses", Tag: "Images",
+		Response: models.ImageStorageReport{},
+	},
+	"POST /images/{id}/verify": {
+		ID: "verifyImage", Summary: "Check an image's snapshot against the checksum taken when it was finalised", Tag: "Images",
+		Response: models.ImageVerification{},
+	},
+	"GET /images/{id}/timeline": {
+		ID: "getImageTimeline", Summary: "List the phases of an image's finalisation", Tag: "Images",
+		Response: models.BakeSpan{}, List: true,
+	},
+	"GET /images/{id}/manifest": {
+		ID: "getImageManifest", Summary: "Get what an image contains", Tag: "Images",
+		Response: models.ImageManifest{},
+	},
+	"GET /images/{id}/files/{path}": {
+		ID: "getImageFile", Summary: "Get a file of an image's data directory", Tag: "Images",
+		Parameters: []openapi.Parameter{ifNoneMatch}, Response: models.ImageFile{},
+	},
+	"GET /images/{id}/upload/files/{path}": {
+		ID: "getImageUploadFile", Summary: "Get a file of an image's upload, with break-glass access", Tag: "Break-Glass Access",
+		Parameters: []openapi.Parameter{ifNoneMatch}, Response: models.ImageFile{},
+	},
+	"GET /images/{id}/send": {
+		ID: "sendImage", Summary: "Download an image as a btrfs send stream", Tag: "Images",
+		Parameters:   []openapi.Parameter{openapi.Query("parents", "A comma separated list of images that the receiver has, to send the difference from")},
+		ResponseType: openapi.OctetStream,
+	},
+
+	// Instances
+	"GET /instances": {
+		ID: "listInstances", Summary: "List your instances", Tag: "Instances",
+		Parameters: listParameters(
+			openapi.Query("filter[image_id]", "Only list instances of the image"),
+			openapi.Query("filter[user]", "Only list the user's instances, or your own with me"),
+			openapi.Query("filter[static]", "List the static instances instead"),
+			openapi.Query("filter[labels.KEY]", "Only list instances with the label KEY set to the value"),
+			openapi.Query("status", "A comma separated list of the statuses of instances to list"),
+			openapi.Query("sort", "A comma separated list of fields to sort by, each prefixed with - for descending order"),
+			ifNoneMatch,
+		),
+		Response: models.Instance{}, List: true,
+	},
+	"POST /instances": {
+		ID: "createInstance", Summary: "Create an instance of an image", Tag: "Instances",
+		Request: CreateInstanceRequest{}, Status: http.StatusCreated, Response: models.Instance{},
+	},
+	"GET /instances/summary": {
+		ID: "summariseInstances", Summary: "Count instances by status and owner", Tag: "Instances",
+		Response: models.InstanceCount{}, List: true,
+	},
+	"GET /instances/{id}": {
+		ID: "getInstance", Summary: "Get an instance, with its credentials", Tag: "Instances",
+		Parameters: []openapi.Parameter{ifNoneMatch}, Response: models.Instance{},
+	},
+	"PATCH /instances/{id}": {
+		ID: "annotateInstance", Summary: "Change an instance's annotations and labels", Tag: "Instances",
+		Request: AnnotateRequest{}, Response: models.Instance{},
+	},
+	"DELETE /instances/{id}": {
+		ID: "destroyInstance", Summary: "Destroy an instance", Tag: "Instances",
+		Status: http.StatusNoContent, Async: true,
+	},
+	"GET /instances/{id}/storage": {
+		ID: "getInstanceStorage", Summary: "Report the space that an instance uses", Tag: "Instances",
+		Response: models.InstanceStorageReport{},
+	},
+	"GET /instances/{id}/diagnostics": {
+		ID: "getInstanceDiagnostics", Summary: "Rank the likely causes of an instance being slow", Tag: "Instances",
+		Response: models.InstanceDiagnostics{},
+	},
+	"GET /instances/{id}/logs": {
+		ID: "getInstanceLogs", Summary: "Get, or follow, an instance's postgres log", Tag: "Instances",
+		Parameters: []openapi.Parameter{
+			openapi.Query("lines", "How many lines from the end of the log to start from"),
+			openapi.Query("follow", "true to keep streaming lines as they're logged"),
+		},
+		ResponseType: openapi.PlainText,
+	},
+	"POST /instances/{id}/promote": {
+		ID: "promoteInstance", Summary: "Promote a standby instance", Tag: "Instances",
+		Response: models.Instance{},
+	},
+	"POST /instances/{id}/extend": {
+		ID: "extendInstance", Summary: "Push back when an instance expires", Tag: "Instances",
+		Request: ExtendInstanceRequest{}, Response: models.Instance{},
+	},
+	"POST /instances/{id}/exec": {
+		ID: "runMaintenance", Summary: "Run a maintenance operation against an instance", Tag: "Instances",
+		Request: MaintenanceRequest{}, Response: models.MaintenanceResult{},
+	},
+	"GET /instances/{id}/proxy": {
+		ID: "proxyInstance", Summary: "Upgrade the connection to carry the Postgres protocol to an instance", Tag: "Instances",
+		Parameters: []openapi.Parameter{{
+			Name: "Upgrade", In: "header", Required: true,
+			Schema: &openapi.Schema{Type: "string", Enum: []string{models.ProxyProtocol}},
+		}},
+		Status: http.StatusSwitchingProtocols,
+	},
+
+	// Cleanup tokens
+	"POST /cleanup_tokens": {
+		ID: "createCleanupToken", Summary: "Create a token that destroys an instance", Tag: "Cleanup Tokens",
+		Request: CreateCleanupTokenRequest{}, Status: http.StatusCreated, Response: models.CleanupToken{},
+	},
+	"POST /cleanup_tokens/use": {
+		ID: "useCleanupToken", Summary: "Destroy an instance with a cleanup token", Tag: "Cleanup Tokens",
+		Public: true, Request: UseCleanupTokenRequest{}, Response: models.CleanupToken{},
+	},
+
+	// Instance groups
+	"GET /instance_groups": {
+		ID: "listInstanceGroups", Summary: "List your instance groups", Tag: "Instance Groups",
+		Response: models.InstanceGroup{}, List: true,
+	},
+	"POST /instance_groups": {
+		ID: "createInstanceGroup", Summary: "Create instances of several images together", Tag: "Instance Groups",
+		Request: CreateInstanceGroupRequest{}, Status: http.StatusCreated, Response: models.InstanceGroup{},
+	},
+	"GET /instance_groups/{id}": {
+		ID: "getInstanceGroup", Summary: "Get an instance group, with its instances", Tag: "Instance Groups",
+		Response: models.InstanceGroup{},
+	},
+	"DELETE /instance_groups/{id}": {
+		ID: "destroyInstanceGroup", Summary: "Destroy an instance group's instances", Tag: "Instance Groups",
+		Status: http.StatusNoContent,
+	},
+	"POST /instance_groups/{id}/extend": {
+		ID: "extendInstanceGroup", Summary: "Push back when an instance group's instances expire", Tag: "Instance Groups",
+		Request: ExtendInstanceRequest{}, Response: models.InstanceGroup{},
+	},
+
+	// Freshness, audits, search and operations
+	"GET /freshness": {
+		ID: "listFreshness", Summary: "List whether each image family meets its freshness SLA", Tag: "Freshness",
+		Response: models.FreshnessStatus{}, List: true,
+	},
+	"GET /anon_audit": {
+		ID: "listStaleImages", Summary: "List images anonymised by an outdated script", Tag: "Anonymisation Audit",
+		Response: models.StaleImage{}, List: true,
+	},
+	"GET /search": {
+		ID: "search", Summary: "Search images and instances", Tag: "Search",
+		Parameters: listParameters(openapi.Query("q", "What to search for")),
+		Response:   models.SearchResult{}, List: true,
+	},
+	"GET /operations/{id}": {
+		ID: "getOperation", Summary: "Get an operation that you started", Tag: "Operations",
+		Response: models.Operation{},
+	},
+
+	// Access requests
+	"GET /access_requests": {
+		ID: "listAccessRequests", Summary: "List your access requests, and those you can approve", Tag: "Access Requests",
+		Response: models.AccessRequest{}, List: true,
+	},
+	"POST /access_requests": {
+		ID: "createAccessRequest", Summary: "Request access to a restricted image family", Tag: "Access Requests",
+		Request: CreateAccessRequestRequest{}, Status: http.StatusCreated, Response: models.AccessRequest{},
+	},
+	"GET /access_requests/{id}": {
+		ID: "getAccessRequest", Summary: "Get an access request", Tag: "Access Requests",
+		Response: models.AccessRequest{},
+	},
+	"POST /access_requests/{id}/approve": {
+		ID: "approveAccessRequest", Summary: "Approve an access request", Tag: "Access Requests",
+		Response: models.AccessRequest{},
+	},
+	"POST /access_requests/{id}/deny": {
+		ID: "denyAccessRequest", Summary: "Deny an access request", Tag: "Access Requests",
+		Response: models.AccessRequest{},
+	},
+
+	// Administration
+	"POST /admin/retention/preview": {
+		ID: "previewRetentionPolicy", Summary: "Preview what a reclamation policy would destroy", Tag: "Administration",
+		Request: RetentionPreviewRequest{}, Response: models.RetentionPreview{},
+	},
+	"GET /admin/schema": {
+		ID: "getSchemaReport", Summary: "Report the server's schema version, migrations, tables and indexes", Tag: "Administration",
+		Response: models.SchemaReport{},
+	},
+	"POST /admin/maintenance/vacuum": {
+		ID: "vacuumTables", Summary: "Vacuum the server's tables, one at a time", Tag: "Administration",
+		Request: VacuumRequest{}, Status: http.StatusNoContent,
+	},
+	"GET /admin/break_glass_grants": {
+		ID: "listBreakGlassGrants", Summary: "List break-glass grants", Tag: "Break-Glass Access",
+		Response: models.BreakGlassGrant{}, List: true,
+	},
+	"POST /admin/break_glass_grants": {
+		ID: "createBreakGlassGrant", Summary: "Grant a user access to an upload", Tag: "Break-Glass Access",
+		Request: CreateBreakGlassGrantRequest{}, Status: http.StatusCreated, Response: models.BreakGlassGrant{},
+	},
+	"DELETE /admin/break_glass_grants/{id}": {
+		ID: "revokeBreakGlassGrant", Summary: "Revoke a break-glass grant", Tag: "Break-Glass Access",
+		Response: models.BreakGlassGrant{},
+	},
+	"POST /admin/runbook/instances/{id}/restart": {
+		ID: "restartInstance", Summary: "Restart an instance's postgres", Tag: "Runbook",
+		Request: RunbookActionRequest{}, Response: models.Instance{},
+	},
+	"POST /admin/runbook/instances/{id}/rotate_credentials": {
+		ID: "rotateInstanceCredentials", Summary: "Replace an instance's certificates", Tag: "Runbook",
+		Request: RunbookActionRequest{}, Response: models.Instance{},
+	},
+	"POST /admin/runbook/operations/{id}/requeue": {
+		ID: "requeueOperation", Summary: "Run a failed operation again", Tag: "Runbook",
+		Request: RunbookActionRequest{}, Status: http.StatusAccepted, Response: models.Operation{},
+	},
+	"GET /admin/webhooks/deliveries": {
+		ID: "listWebhookDeliveries", Summary: "List deliveries to webhooks", Tag: "Webhooks",
+		Parameters: listParameters(
+			openapi.Query("filter[webhook]", "Only list deliveries to the named webhook"),
+			openapi.Query("filter[status]", "Only list deliveries that are pending, succeeded or failed"),
+		),
+		Response: models.WebhookDelivery{}, List: true,
+	},
+	"GET /admin/faults": {
+		ID: "listFaults", Summary: "List the faults being injected", Tag: "Fault Injection",
+		Response: models.Fault{}, List: true,
+	},
+	"POST /admin/faults": {
+		ID: "injectFault", Summary: "Inject a fault", Tag: "Fault Injection",
+		Request: CreateFaultRequest{}, Status: http.StatusCreated, Response: models.Fault{},
+	},
+	"DELETE /admin/faults": {
+		ID: "clearFaults", Summary: "Remove every fault", Tag: "Fault Injection",
+		Status: http.StatusNoContent,
+	},
+	"DELETE /admin/faults/{id}": {
+		ID: "removeFault", Summary: "Remove a fault", Tag: "Fault Injection",
+		Status: http.StatusNoContent,
+	},
+}
@@ -0,0 +1,110 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/server/api/openapi"
+)
+
+func TestOpenAPIGet(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {}
+
+	root := mux.NewRouter()
+	router := root.PathPrefix("/draupnir").Subrouter()
+	router.Methods("GET").Path("/images/{id}").HandlerFunc(handler)
+	router.Methods("GET").Path("/images/{id}/upload/files/{path:.+}").HandlerFunc(handler)
+	router.Methods("GET").Path("/undescribed").HandlerFunc(handler)
+	router.PathPrefix("/v2/").HandlerFunc(handler)
+
+	req := httptest.NewRequest("GET", "/draupnir/openapi.json", nil)
+	recorder := httptest.NewRecorder()
+
+	routeSet := OpenAPI{Router: root, BasePath: "/draupnir"}
+	err := routeSet.Get(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var doc openapi.Document
+	decodeJSON(t, recorder.Body, &doc)
+	assert.Equal(t, openapi.Version, doc.OpenAPI)
+	assert.Equal(t, []openapi.Server{{URL: "/draupnir"}}, doc.Servers)
+
+	paths := []string{}
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	assert.Equal(t, []string{"/images/{id}", "/images/{id}/upload/files/{path}", "/undescribed"}, paths)
+
+	assert.Equal(t, "getImage", doc.Paths["/images/{id}"]["get"].OperationID)
+	assert.Equal(t, "getImageUploadFile", doc.Paths["/images/{id}/upload/files/{path}"]["get"].OperationID)
+	assert.Contains(t, doc.Components.Schemas, "images")
+	assert.Contains(t, doc.Components.Schemas, "image_files")
+}
+
+// Every endpoint must describe models that can be reflected on, and refer only
+// to schemas that are in the document
+func TestOpenAPIEndpoints(t *testing.T) {
+	doc := openapi.New("1.0.0")
+	for key, endpoint := range endpoints {
+		parts := strings.SplitN(key, " ", 2)
+		if assert.Len(t, parts, 2, key) {
+			doc.Add(parts[0], parts[1], endpoint)
+		}
+	}
+
+	ids := map[string]string{}
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			if other, ok := ids[op.OperationID]; ok {
+				t.Errorf("%s %s has the same operation ID as %s", method, path, other)
+			}
+			ids[op.OperationID] = method + " " + path
+		}
+	}
+
+	body, err := json.Marshal(doc)
+	assert.Nil(t, err)
+
+	var refs []string
+	var walk func(interface{})
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for key, child := range v {
+				if ref, ok := child.(string); ok && key == "$ref" {
+					refs = append(refs, ref)
+				}
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	var decoded interface{}
+	assert.Nil(t, json.Unmarshal(body, &decoded))
+	walk(decoded)
+
+	assert.NotEmpty(t, refs)
+	for _, ref := range refs {
+		switch {
+		case strings.HasPrefix(ref, "#/components/schemas/"):
+			assert.Contains(t, doc.Components.Schemas, strings.TrimPrefix(ref, "#/components/schemas/"))
+		case strings.HasPrefix(ref, "#/components/parameters/"):
+			assert.Contains(t, doc.Components.Parameters, strings.TrimPrefix(ref, "#/components/parameters/"))
+		default:
+			t.Errorf("unexpected reference %s", ref)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/jobs"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// Operations are the long-running jobs that were started in the background by
+// requests with Prefer: respond-async
+type Operations struct {
+	JobStore      store.JobStore
+	BakeSpanStore store.BakeSpanStore
+}
+
+// Get returns the operation, which users other than the upload user can only
+// see if they started it
+func (o Operations) Get(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	job, err := o.JobStore.Get(id)
+	if err != nil {
+		logger.With("operation", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if !auth.IsAdmin(email) && email != job.UserEmail {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	operation := models.NewOperation(job)
+	if job.Kind == models.JobFinaliseImage && job.Status == models.JobRunning {
+		spans, err := o.BakeSpanStore.List(job.ResourceID)
+		if err != nil {
+			return errors.Wrap(err, "failed to list bake spans")
+		}
+		for _, span := range spans {
+			if span.FinishedAt == nil {
+				operation.Phase = span.Phase
+			}
+		}
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &operation),
+		"failed to marshal operation",
+	)
+}
+
+// respondAsync returns true if the client prefers that the request is handled
+// in the background, as an operation
+func respondAsync(r *http.Request) bool {
+	for _, header := range r.Header["Prefer"] {
+		for _, preference := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// renderOperation responds with the operation that was submitted as job, or the
+// error that submitting it failed with
+func renderOperation(w http.ResponseWriter, r *http.Request, job models.Job, err error) error {
+	if err == jobs.ErrQueueFull {
+		api.OperationQueueFullError.Render(w, http.StatusServiceUnavailable)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to submit operation")
+	}
+
+	operation := models.NewOperation(job)
+	w.Header().Set("Preference-Applied", "respond-async")
+	w.WriteHeader(http.StatusAccepted)
+
+	return errors.Wrap(
+		marshalOne(r, w, &operation),
+		"failed to marshal operation",
+	)
+}
@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestOperationGet(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/operations/5", nil)
+
+	jobs := FakeJobStore{
+		_Get: func(id int) (models.Job, error) {
+			assert.Equal(t, 5, id)
+			job := models.NewQueuedJob(models.JobFinaliseImage, 3, "test@draupnir").Start()
+			job.ID = id
+			return job, nil
+		},
+	}
+	spans := FakeBakeSpanStore{
+		_List: func(imageID int) ([]models.BakeSpan, error) {
+			assert.Equal(t, 3, imageID)
+			return []models.BakeSpan{
+				models.NewBakeSpan(3, models.BakePhaseInspectUpload).Finish(nil),
+				models.NewBakeSpan(3, models.BakePhaseFinalise),
+			}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Operations{JobStore: jobs, BakeSpanStore: spans}
+	router := mux.NewRouter()
+	router.HandleFunc("/operations/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var operation models.Operation
+	assert.Nil(t, jsonapi.UnmarshalPayload(recorder.Body, &operation))
+	assert.Equal(t, 5, operation.ID)
+	assert.Equal(t, models.JobFinaliseImage, operation.Kind)
+	assert.Equal(t, "images", operation.ResourceType)
+	assert.Equal(t, 3, operation.ResourceID)
+	assert.Equal(t, models.JobRunning, operation.Status)
+	assert.Equal(t, models.BakePhaseFinalise, operation.Phase)
+	assert.False(t, operation.Done())
+}
+
+func TestOperationGetFromOtherUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/operations/5", nil)
+
+	jobs := FakeJobStore{
+		_Get: func(id int) (models.Job, error) {
+			job := models.NewQueuedJob(models.JobDestroyInstance, 3, "other@draupnir").Finish(nil)
+			job.ID = id
+			return job, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Operations{JobStore: jobs}
+	router := mux.NewRouter()
+	router.HandleFunc("/operations/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
+
+func TestRespondAsync(t *testing.T) {
+	req, _, _ := createRequest(t, "DELETE", "/instances/1", nil)
+	assert.False(t, respondAsync(req))
+
+	req.Header.Add("Prefer", "return=minimal, Respond-Async")
+	assert.True(t, respondAsync(req))
+}
@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/google/jsonapi"
+
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// DEFAULT_PAGE_SIZE is the number of resources on each page of a list, unless
+// page[size] is given, which may be at most MAX_PAGE_SIZE
+const DEFAULT_PAGE_SIZE = 100
+const MAX_PAGE_SIZE = 500
+
+// parsePage extracts the page that the JSON:API page[number] and page[size]
+// query parameters select, defaulting to the first page of DEFAULT_PAGE_SIZE
+func parsePage(query url.Values) (store.Page, error) {
+	page := store.Page{Number: 1, Size: DEFAULT_PAGE_SIZE}
+
+	if value := query.Get("page[number]"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 1 {
+			return page, fmt.Errorf("page[number] must be a positive integer")
+		}
+		page.Number = number
+	}
+
+	if value := query.Get("page[size]"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 || size > MAX_PAGE_SIZE {
+			return page, fmt.Errorf("page[size] must be an integer between 1 and %d", MAX_PAGE_SIZE)
+		}
+		page.Size = size
+	}
+
+	return page, nil
+}
+
+// parseOptionalPage is like parsePage, except that it selects the whole list
+// unless page[number] or page[size] is given. Lists that were returned whole
+// before they were paginated use it, as older clients expect every item in
+// them.
+func parseOptionalPage(query url.Values) (store.Page, error) {
+	if query.Get("page[number]") == "" && query.Get("page[size]") == "" {
+		return store.Page{}, nil
+	}
+	return parsePage(query)
+}
+
+// paginationLinks returns the JSON:API links to the first, previous and next
+// pages of the list, where there are such pages, or nil if the list fits on
+// one page
+func paginationLinks(r *http.Request, page store.Page, more bool) *map[string]string {
+	links := map[string]string{}
+	if page.Number > 1 {
+		links["first"] = pageLink(r, store.Page{Number: 1, Size: page.Size})
+		links["prev"] = pageLink(r, store.Page{Number: page.Number - 1, Size: page.Size})
+	}
+	if more {
+		links["next"] = pageLink(r, store.Page{Number: page.Number + 1, Size: page.Size})
+	}
+
+	if len(links) == 0 {
+		return nil
+	}
+	return &links
+}
+
+// pageLink returns the path of the request, including any base path, with its
+// query changed to select the page. Other query parameters, such as filters,
+// are kept.
+func pageLink(r *http.Request, page store.Page) string {
+	query := r.URL.Query()
+	query.Set("page[number]", strconv.Itoa(page.Number))
+	query.Set("page[size]", strconv.Itoa(page.Size))
+	return r.URL.Path + "?" + query.Encode()
+}
+
+// marshalPage writes a page of a list, which must be a slice of pointers to
+// models, with the links to the other pages
+func marshalPage(r *http.Request, w io.Writer, models interface{}, links *map[string]string) error {
+	defer middleware.AddServerTiming(r.Context(), middleware.TimingRender, time.Now())
+
+	slice := reflect.ValueOf(models)
+	items := make([]interface{}, slice.Len())
+	for i := range items {
+		items[i] = slice.Index(i).Interface()
+	}
+
+	payload, err := jsonapi.MarshalMany(items)
+	if err != nil {
+		return err
+	}
+	payload.Links = links
+
+	return json.NewEncoder(w).Encode(payload)
+}
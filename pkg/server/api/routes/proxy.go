@@ -0,0 +1,192 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/pgproxy"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// proxyDialTimeout is how long the proxy waits to connect to an instance
+const proxyDialTimeout = 10 * time.Second
+
+// Proxy upgrades the connection to carry the Postgres protocol to the
+// instance, recording the session. This is the only way to connect to
+// instances of regulated images, whose credentials aren't sent to users.
+func (i Instances) Proxy(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	instance, err := i.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	// Static instances are shared by everyone
+	if email != instance.UserEmail && instance.StaticName == "" {
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if !strings.EqualFold(r.Header.Get("Upgrade"), models.ProxyProtocol) {
+		w.Header().Set("Upgrade", models.ProxyProtocol)
+		api.ProxyUpgradeRequiredError.Render(w, http.StatusUpgradeRequired)
+		return nil
+	}
+
+	if instance.Standby {
+		api.ProxyStandbyError.Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	image, err := i.ImageStore.Get(instance.ImageID)
+	if err != nil {
+		return errors.Wrap(err, "failed to get image")
+	}
+	policy, _ := i.Policies.For(image)
+
+	ipaddr, err := middleware.GetUserIPAddress(r)
+	if err != nil {
+		return err
+	}
+
+	files, err := i.Executor.RetrieveInstanceCredentials(r.Context(), instance.ID)
+	if err != nil {
+		return errors.Wrap(err, "failed to retrieve instance credentials")
+	}
+
+	tlsConfig, err := pgproxy.TLSConfig(files["ca.crt"], files["client.crt"], files["client.key"])
+	if err != nil {
+		return errors.Wrap(err, "invalid instance credentials")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return errors.New("response can't be hijacked")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return errors.Wrap(err, "failed to hijack connection")
+	}
+	defer conn.Close()
+
+	// The server's timeouts are for requests, not sessions
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", models.ProxyProtocol)
+	if err := rw.Flush(); err != nil {
+		logger.With("instance", id).Info(errors.Wrap(err, "failed to switch protocols").Error())
+		return nil
+	}
+
+	client := bufferedConn{Conn: conn, reader: rw.Reader}
+
+	startup, err := pgproxy.ReadStartup(client)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		return nil
+	}
+
+	dialCtx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	server, err := pgproxy.Dial(dialCtx, proxyAddress(instance), tlsConfig)
+	cancel()
+	if err != nil {
+		pgproxy.WriteError(client, "could not connect to the instance")
+		return errors.Wrap(err, "failed to connect to instance")
+	}
+
+	// Cancel requests come from clients' other connections, and aren't sessions
+	if startup.Cancel {
+		return errors.Wrap(pgproxy.Cancel(server, startup), "failed to forward cancel request")
+	}
+
+	session, err := i.Audit.Start(models.ProxySession{
+		InstanceID:      instance.ID,
+		ImageID:         image.ID,
+		Family:          freshness.Family(image),
+		UserEmail:       email,
+		ClientIPAddress: ipaddr,
+		Database:        startup.Database(),
+		StartedAt:       time.Now(),
+	})
+	if err != nil {
+		server.Close()
+		pgproxy.WriteError(client, "could not record the session")
+		return err
+	}
+
+	var relay pgproxy.Session
+	var relayErr error
+	relayed := make(chan struct{})
+	go func() {
+		defer close(relayed)
+		relayErr = relay.Relay(client, server, startup)
+	}()
+
+	if policy.MaxSessionDuration > 0 {
+		select {
+		case <-relayed:
+		case <-time.After(policy.MaxSessionDuration):
+			server.Close()
+			client.Close()
+			<-relayed
+			relayErr = fmt.Errorf("session exceeded the maximum duration of %s", policy.MaxSessionDuration)
+		}
+	} else {
+		<-relayed
+	}
+
+	session.Queries = relay.Queries()
+	_, err = i.Audit.End(session, time.Now(), relayErr)
+	return err
+}
+
+// proxyAddress is where the proxy connects to the instance from the server
+// that it's running on
+func proxyAddress(instance models.Instance) string {
+	if instance.Address != "" {
+		return net.JoinHostPort(instance.Address, strconv.Itoa(int(instance.Port)))
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(instance.Port)))
+}
+
+// bufferedConn reads from the hijacked connection through the server's buffer,
+// which may already hold the start of what the client sent
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
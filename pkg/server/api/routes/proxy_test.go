@@ -0,0 +1,288 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/audit"
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+)
+
+var regulatedPolicies = audit.Policies{"pci": {Family: "pci"}}
+
+func regulatedImageStore(t *testing.T) FakeImageStore {
+	return FakeImageStore{
+		_Get: func(id int) (models.Image, error) {
+			assert.Equal(t, 1, id)
+			return models.Image{
+				ID:          1,
+				Ready:       true,
+				Annotations: models.Annotations{freshness.FamilyAnnotation: "pci"},
+			}, nil
+		},
+	}
+}
+
+func TestInstanceGetOfRegulatedImage(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, Port: 5432, UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	// Neither the credentials nor the whitelist are touched
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{
+		InstanceStore: store,
+		ImageStore:    regulatedImageStore(t),
+		Policies:      regulatedPolicies,
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}", errorHandler.Handle(routeSet.Get))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, true, response.Data.Attributes["proxy_required"])
+	assert.Empty(t, response.Included)
+}
+
+func TestInstanceProxyRequiresUpgrade(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/proxy", nil)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "test@draupnir"}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/proxy", errorHandler.Handle(routeSet.Proxy))
+	router.ServeHTTP(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Equal(t, http.StatusUpgradeRequired, recorder.Code)
+	assert.Equal(t, models.ProxyProtocol, recorder.Header().Get("Upgrade"))
+	assert.Equal(t, api.ProxyUpgradeRequiredError, response)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceProxyFromWrongUser(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/instances/1/proxy", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", models.ProxyProtocol)
+
+	store := FakeInstanceStore{
+		_Get: func(id int) (models.Instance, error) {
+			return models.Instance{ID: 1, ImageID: 1, UserEmail: "otheruser@draupnir"}, nil
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	routeSet := Instances{InstanceStore: store}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/proxy", errorHandler.Handle(routeSet.Proxy))
+	router.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Nil(t, errorHandler.Error)
+}
+
+func TestInstanceProxy(t *testing.T) {
+	credentials, serverCertificate := generateInstanceCredentials(t)
+
+	// The instance accepts the proxy's TLS connection, and then reads whatever
+	// it's sent
+	instanceListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer instanceListener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := instanceListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.ReadFull(conn, make([]byte, 8))
+		conn.Write([]byte{'S'})
+		tlsConn := tls.Server(conn, &tls.Config{
+			Certificates: []tls.Certificate{serverCertificate},
+			ClientAuth:   tls.RequireAnyClientCert,
+		})
+		data, _ := ioutil.ReadAll(tlsConn)
+		received <- data
+	}()
+	port := instanceListener.Addr().(*net.TCPAddr).Port
+
+	sessions := make(chan models.ProxySession, 2)
+	logger, _ := NewFakeLogger()
+	routeSet := Instances{
+		InstanceStore: FakeInstanceStore{
+			_Get: func(id int) (models.Instance, error) {
+				return models.Instance{ID: 1, ImageID: 1, Port: uint16(port), UserEmail: "test@draupnir"}, nil
+			},
+		},
+		ImageStore: regulatedImageStore(t),
+		Executor: FakeExecutor{
+			_RetrieveInstanceCredentials: func(ctx context.Context, id int) (map[string][]byte, error) {
+				return credentials, nil
+			},
+		},
+		Policies: regulatedPolicies,
+		Audit: audit.Recorder{
+			Logger: logger,
+			Store: FakeProxySessionStore{
+				_Create: func(session models.ProxySession) (models.ProxySession, error) {
+					session.ID = 7
+					sessions <- session
+					return session, nil
+				},
+				_End: func(session models.ProxySession) (models.ProxySession, error) {
+					sessions <- session
+					return session, nil
+				},
+			},
+		},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/instances/{id}/proxy", errorHandler.Handle(routeSet.Proxy))
+	handled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _, _ := createRequest(t, r.Method, r.URL.String(), nil)
+		router.ServeHTTP(w, r.WithContext(req.Context()))
+		close(handled)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	io.WriteString(conn, "GET /instances/1/proxy HTTP/1.1\r\nHost: draupnir\r\nConnection: Upgrade\r\nUpgrade: draupnir-postgres\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	startup := postgresMessage(0, "\x00\x03\x00\x00user\x00draupnir\x00database\x00payments\x00\x00")
+	query := postgresMessage('Q', "SELECT 1\x00")
+	terminate := postgresMessage('X', "")
+	conn.Write(startup)
+	conn.Write(query)
+	conn.Write(terminate)
+
+	started := <-sessions
+	assert.Equal(t, 7, started.ID)
+	assert.Equal(t, 1, started.InstanceID)
+	assert.Equal(t, "pci", started.Family)
+	assert.Equal(t, "test@draupnir", started.UserEmail)
+	assert.Equal(t, "1.2.3.4", started.ClientIPAddress)
+	assert.Equal(t, "payments", started.Database)
+
+	ended := <-sessions
+	assert.Equal(t, 7, ended.ID)
+	assert.Equal(t, 1, ended.Queries)
+	assert.NotNil(t, ended.EndedAt)
+	assert.Equal(t, "", ended.Error)
+
+	select {
+	case data := <-received:
+		assert.Equal(t, string(startup)+string(query)+string(terminate), string(data))
+	case <-time.After(5 * time.Second):
+		t.Fatal("instance received nothing")
+	}
+
+	<-handled
+	assert.Nil(t, errorHandler.Error)
+}
+
+// postgresMessage builds a message of the given type, or a startup message if
+// the type is zero
+func postgresMessage(messageType byte, body string) []byte {
+	var message []byte
+	if messageType != 0 {
+		message = append(message, messageType)
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(body)+4))
+	return append(append(message, length...), body...)
+}
+
+// generateInstanceCredentials returns credentials like those that an instance
+// is created with, and the certificate that the instance presents
+func generateInstanceCredentials(t *testing.T) (map[string][]byte, tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	caTemplate := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "instance"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, &caKey.PublicKey, caKey)
+	assert.Nil(t, err)
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	clientTemplate := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "draupnir"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, &clientTemplate, &caTemplate, &clientKey.PublicKey, caKey)
+	assert.Nil(t, err)
+
+	clientKeyDER, err := x509.MarshalECPrivateKey(clientKey)
+	assert.Nil(t, err)
+
+	credentials := map[string][]byte{
+		"ca.crt":     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		"client.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientDER}),
+		"client.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: clientKeyDER}),
+	}
+	return credentials, tls.Certificate{Certificate: [][]byte{caDER}, PrivateKey: caKey}
+}
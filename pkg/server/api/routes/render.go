@@ -0,0 +1,26 @@
+package routes
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/jsonapi"
+
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// marshalOne writes the model to w as a JSON:API document. Responses are
+// written through these helpers, rather than jsonapi directly, so that the time
+// they take is given as the render phase of the request's Server-Timing.
+func marshalOne(r *http.Request, w io.Writer, model interface{}) error {
+	defer middleware.AddServerTiming(r.Context(), middleware.TimingRender, time.Now())
+	return jsonapi.MarshalOnePayload(w, model)
+}
+
+// marshalMany writes the models, a slice of pointers, to w as a JSON:API
+// document
+func marshalMany(r *http.Request, w io.Writer, models interface{}) error {
+	defer middleware.AddServerTiming(r.Context(), middleware.TimingRender, time.Now())
+	return jsonapi.MarshalManyPayload(w, models)
+}
@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/reclaim"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// Retention lets operators try out retention policies against the pool as it
+// is now, before configuring them
+type Retention struct {
+	Reclaimer reclaim.Reclaimer
+}
+
+// RetentionPreviewRequest is a candidate retention policy, with the same
+// fields as the server's reclaim configuration
+type RetentionPreviewRequest struct {
+	CriticalFreeSpace float64  `jsonapi:"attr,critical_free_space"`
+	TargetFreeSpace   float64  `jsonapi:"attr,target_free_space"`
+	CIUsers           []string `jsonapi:"attr,ci_users"`
+	InstanceMaxAge    string   `jsonapi:"attr,instance_max_age"`
+}
+
+// Preview returns the images and instances that the policy would destroy if
+// the pool's free space were checked now, without destroying anything
+func (rt Retention) Preview(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	req := RetentionPreviewRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	policy, err := req.policy()
+	if err != nil {
+		logger.Info(err.Error())
+		api.InvalidRetentionPolicyError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	plan, err := rt.Reclaimer.Preview(r.Context(), policy)
+	if err != nil {
+		return errors.Wrap(err, "failed to preview retention policy")
+	}
+
+	preview := models.RetentionPreview{
+		FreeBytes:      plan.Usage.FreeBytes,
+		TotalBytes:     plan.Usage.TotalBytes,
+		CriticallyLow:  plan.Critical,
+		InstanceIDs:    []int{},
+		ImageIDs:       []int{},
+		ReclaimedBytes: plan.ReclaimedBytes,
+		TargetReached:  plan.Reached,
+	}
+	for _, action := range plan.Actions {
+		if action.Kind == "instance" {
+			preview.InstanceIDs = append(preview.InstanceIDs, action.ID)
+		} else {
+			preview.ImageIDs = append(preview.ImageIDs, action.ID)
+		}
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &preview),
+		"failed to marshal retention preview",
+	)
+}
+
+func (req RetentionPreviewRequest) policy() (reclaim.Policy, error) {
+	policy := reclaim.Policy{
+		CriticalFreeSpace: req.CriticalFreeSpace,
+		TargetFreeSpace:   req.TargetFreeSpace,
+		CIUsers:           req.CIUsers,
+	}
+
+	for _, fraction := range []float64{policy.CriticalFreeSpace, policy.TargetFreeSpace} {
+		if fraction < 0 || fraction > 1 {
+			return policy, errors.Errorf("free space fraction %v is not between 0 and 1", fraction)
+		}
+	}
+
+	if req.InstanceMaxAge != "" {
+		maxAge, err := time.ParseDuration(req.InstanceMaxAge)
+		if err != nil {
+			return policy, err
+		}
+		policy.InstanceMaxAge = maxAge
+	}
+
+	return policy, nil
+}
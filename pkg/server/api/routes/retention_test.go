@@ -0,0 +1,95 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/reclaim"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func previewRequest(t *testing.T, body string, user string) (*http.Request, *httptest.ResponseRecorder) {
+	req, recorder, _ := createRequest(t, "POST", "/admin/retention/preview", bytes.NewBufferString(body))
+	return req.WithContext(context.WithValue(req.Context(), middleware.AuthUserKey, user)), recorder
+}
+
+func TestRetentionPreview(t *testing.T) {
+	req, recorder := previewRequest(t, `{"data": {"type": "retention_policies", "attributes": {
+		"critical_free_space": 0.2,
+		"target_free_space": 0.3,
+		"ci_users": ["ci@draupnir"],
+		"instance_max_age": "1h"
+	}}}`, auth.UPLOAD_USER_EMAIL)
+
+	old := time.Now().Add(-2 * time.Hour)
+	routeSet := Retention{
+		Reclaimer: reclaim.Reclaimer{
+			InstanceStore: FakeInstanceStore{
+				_List: func() ([]models.Instance, error) {
+					return []models.Instance{
+						{ID: 1, ImageID: 1, UserEmail: "ci@draupnir", CreatedAt: old},
+						{ID: 2, ImageID: 1, UserEmail: "ci@draupnir", CreatedAt: old.Add(time.Minute)},
+						{ID: 3, ImageID: 1, UserEmail: "ci@draupnir", CreatedAt: time.Now()},
+					}, nil
+				},
+			},
+			Executor: FakeExecutor{
+				_RetrievePoolUsage: func(ctx context.Context) (models.PoolUsage, error) {
+					return models.PoolUsage{TotalBytes: 100, FreeBytes: 15}, nil
+				},
+				_RetrieveInstanceDiskUsage: func(ctx context.Context, id int) (models.DiskUsage, error) {
+					return models.DiskUsage{ExclusiveBytes: 10}, nil
+				},
+			},
+		},
+	}
+
+	err := routeSet.Preview(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response map[string]map[string]interface{}
+	decodeJSON(t, recorder.Body, &response)
+	attributes := response["data"]["attributes"].(map[string]interface{})
+
+	// 15 bytes are free, so two 10 byte instances must be destroyed to reach 30
+	assert.Equal(t, true, attributes["critically_low"])
+	assert.Equal(t, []interface{}{1.0, 2.0}, attributes["instance_ids"])
+	assert.Equal(t, []interface{}{}, attributes["image_ids"])
+	assert.Equal(t, 20.0, attributes["reclaimed_bytes"])
+	assert.Equal(t, true, attributes["target_reached"])
+}
+
+func TestRetentionPreviewWithInvalidPolicy(t *testing.T) {
+	req, recorder := previewRequest(t, `{"data": {"type": "retention_policies", "attributes": {
+		"critical_free_space": 0.2,
+		"instance_max_age": "a day"
+	}}}`, auth.UPLOAD_USER_EMAIL)
+
+	err := Retention{}.Preview(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, api.InvalidRetentionPolicyError, response)
+}
+
+func TestRetentionPreviewFromNonUploadUser(t *testing.T) {
+	req, recorder := previewRequest(t, `{}`, "test@draupnir")
+
+	err := Retention{}.Preview(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
@@ -0,0 +1,307 @@
+package routes
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/audit"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// The actions of the runbook
+const (
+	RunbookRestart           = "restart"
+	RunbookRotateCredentials = "rotate_credentials"
+	RunbookRequeue           = "requeue"
+)
+
+// Runbook lets admins take the most common actions of the on-call runbook
+// through the API, rather than SSHing to the host. Every action must give a
+// reason and be confirmed, and is recorded in the audit log.
+type Runbook struct {
+	Images    Images
+	Instances Instances
+	Audit     audit.Runbook
+}
+
+// RunbookActionRequest says why an action is being taken. Confirm must be the
+// action's confirmation, as given by RunbookConfirmation, or the action isn't
+// taken.
+type RunbookActionRequest struct {
+	Reason  string `jsonapi:"attr,reason"`
+	Confirm string `jsonapi:"attr,confirm"`
+}
+
+// RunbookConfirmation returns the phrase that confirms the action against a
+// resource, e.g. "restart instance 12". Requests must repeat it, so that a
+// mistyped ID or a script replaying requests can't take an action by accident.
+func RunbookConfirmation(action, resource string, id int) string {
+	return fmt.Sprintf("%s %s %d", action, resource, id)
+}
+
+// RestartInstance restarts the instance's postgres, or starts it if it has
+// crashed
+func (rb Runbook) RestartInstance(w http.ResponseWriter, r *http.Request) error {
+	return rb.instanceAction(w, r, RunbookRestart, rb.Instances.Executor.RestartInstance)
+}
+
+// RotateInstanceCredentials replaces the instance's certificates, e.g. once its
+// client key has leaked. Its owner must fetch its credentials again to connect.
+func (rb Runbook) RotateInstanceCredentials(w http.ResponseWriter, r *http.Request) error {
+	return rb.instanceAction(w, r, RunbookRotateCredentials, rb.Instances.Executor.RotateInstanceCredentials)
+}
+
+// instanceAction takes the action against the instance, and responds with the
+// instance, without its credentials, which are only for its owner
+func (rb Runbook) instanceAction(w http.ResponseWriter, r *http.Request, name string, act func(context.Context, models.Instance) error) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, req, ok, err := rb.parse(w, r)
+	if err != nil || !ok {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	instance, err := rb.Instances.InstanceStore.Get(id)
+	if err != nil {
+		logger.With("instance", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if instance.Status == models.InstanceDestroying {
+		api.RunbookActionUnavailableError(fmt.Sprintf("instance %d is being destroyed", instance.ID)).
+			Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	if !confirmed(w, req, RunbookConfirmation(name, "instance", instance.ID)) {
+		return nil
+	}
+
+	action := audit.RunbookAction{
+		Name:         name,
+		ResourceType: "instances",
+		ResourceID:   instance.ID,
+		PerformedBy:  email,
+		Reason:       req.Reason,
+	}
+	err = rb.Audit.Run(action, func() error {
+		return act(r.Context(), instance)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "runbook action %s failed", name)
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &instance),
+		"failed to marshal instance",
+	)
+}
+
+// RequeueOperation runs a failed operation again, as a new operation, which is
+// returned for the caller to follow. Only the latest operation of its kind for
+// its image or instance can be requeued, and interrupted finalisations can't
+// be, as the upload may have been partially anonymised.
+func (rb Runbook) RequeueOperation(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, req, ok, err := rb.parse(w, r)
+	if err != nil || !ok {
+		return err
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		logger.Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	job, err := rb.Images.JobStore.Get(id)
+	if err != nil {
+		logger.With("operation", id).Info(err.Error())
+		api.NotFoundError.Render(w, http.StatusNotFound)
+		return nil
+	}
+
+	if job.Status != models.JobFailed && job.Status != models.JobInterrupted {
+		api.RunbookActionUnavailableError(fmt.Sprintf("operation %d is %s, and only failed operations can be requeued", job.ID, job.Status)).
+			Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	latest, err := rb.Images.JobStore.Latest(job.Kind, job.ResourceID)
+	if err != nil {
+		return errors.Wrap(err, "failed to get latest operation")
+	}
+	if latest.ID != job.ID {
+		api.RunbookActionUnavailableError(fmt.Sprintf("operation %d has been superseded by operation %d", job.ID, latest.ID)).
+			Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	run, unavailable, err := rb.requeue(logger, job)
+	if err != nil {
+		return err
+	}
+	if unavailable != "" {
+		api.RunbookActionUnavailableError(unavailable).Render(w, http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	if !confirmed(w, req, RunbookConfirmation(RunbookRequeue, "operation", job.ID)) {
+		return nil
+	}
+
+	action := audit.RunbookAction{
+		Name:         RunbookRequeue,
+		ResourceType: "operations",
+		ResourceID:   job.ID,
+		PerformedBy:  email,
+		Reason:       req.Reason,
+	}
+
+	// The requeued operation belongs to whoever started the original, so that
+	// they can follow it too
+	var requeued models.Job
+	err = rb.Audit.Run(action, func() (err error) {
+		requeued, err = rb.Images.Workers.Submit(logger, models.NewQueuedJob(job.Kind, job.ResourceID, job.UserEmail), run)
+		return err
+	})
+	return renderOperation(w, r, requeued, err)
+}
+
+// requeue returns the operation that runs the job again, or why it can't be
+// run again. As when the watchdog recovers destroys, a destroy that failed
+// after the image or instance was removed from the database only deletes its
+// files.
+func (rb Runbook) requeue(logger log.Logger, job models.Job) (func(ctx context.Context) error, string, error) {
+	switch job.Kind {
+	case models.JobFinaliseImage:
+		if job.Status == models.JobInterrupted {
+			return nil, job.Error, nil
+		}
+
+		image, err := rb.Images.ImageStore.Get(job.ResourceID)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Sprintf("image %d has been destroyed", job.ResourceID), nil
+		}
+		if err != nil {
+			return nil, "", errors.Wrap(err, "failed to get image")
+		}
+		if image.Ready {
+			return nil, fmt.Sprintf("image %d is already ready", image.ID), nil
+		}
+
+		return func(ctx context.Context) error {
+			_, err := rb.Images.finaliseUpload(ctx, logger, image)
+			return err
+		}, "", nil
+
+	case models.JobDestroyImage:
+		image, err := rb.Images.ImageStore.Get(job.ResourceID)
+		if err == sql.ErrNoRows {
+			return func(ctx context.Context) error {
+				return rb.Images.Executor.DestroyImage(ctx, job.ResourceID)
+			}, "", nil
+		}
+		if err != nil {
+			return nil, "", errors.Wrap(err, "failed to get image")
+		}
+
+		return func(ctx context.Context) error {
+			// The operation is itself the record of the image's destroy
+			return rb.Images.destroy(ctx, logger, image, true, func(run func() error) error {
+				return run()
+			})
+		}, "", nil
+
+	case models.JobDestroyInstance:
+		instance, err := rb.Instances.InstanceStore.Get(job.ResourceID)
+		if err == sql.ErrNoRows {
+			return func(ctx context.Context) error {
+				return rb.Instances.Executor.DestroyInstance(ctx, job.ResourceID)
+			}, "", nil
+		}
+		if err != nil {
+			return nil, "", errors.Wrap(err, "failed to get instance")
+		}
+
+		return func(ctx context.Context) error {
+			return rb.Instances.destroyUnrecorded(ctx, logger, instance)
+		}, "", nil
+
+	default:
+		return nil, fmt.Sprintf("%s jobs can't be requeued", job.Kind), nil
+	}
+}
+
+// parse returns the admin taking an action, and the request that they sent. It
+// renders why the action can't be taken and returns false if the user isn't an
+// admin, or the request doesn't give a reason.
+func (rb Runbook) parse(w http.ResponseWriter, r *http.Request) (string, RunbookActionRequest, bool, error) {
+	var req RunbookActionRequest
+
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return "", req, false, err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return "", req, false, err
+	}
+
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return email, req, false, nil
+	}
+
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return email, req, false, nil
+	}
+
+	if strings.TrimSpace(req.Reason) == "" {
+		api.InvalidRunbookActionError("reason must say why the action is being taken").Render(w, http.StatusBadRequest)
+		return email, req, false, nil
+	}
+
+	return email, req, true, nil
+}
+
+// confirmed reports whether the request confirms the action, rendering the
+// confirmation that it must give if it doesn't
+func confirmed(w http.ResponseWriter, req RunbookActionRequest, confirmation string) bool {
+	if req.Confirm != confirmation {
+		api.ConfirmationRequiredError(confirmation).Render(w, http.StatusPreconditionRequired)
+		return false
+	}
+	return true
+}
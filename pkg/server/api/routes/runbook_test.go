@@ -0,0 +1,383 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/audit"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+)
+
+func runbookRequest(t *testing.T, path, attributes string) (*http.Request, *httptest.ResponseRecorder) {
+	req, recorder, _ := createRequest(t, "POST", path, bytes.NewBufferString(
+		fmt.Sprintf(`{"data": {"type": "runbook_actions", "attributes": {%s}}}`, attributes),
+	))
+	return asUploadUser(req), recorder
+}
+
+func TestRunbookRestartInstance(t *testing.T) {
+	req, recorder := runbookRequest(t, "/admin/runbook/instances/12/restart", `"reason": "INC-123: postgres crashed", "confirm": "restart instance 12"`)
+
+	restarted := false
+	logger, logs := NewFakeLogger()
+	routeSet := Runbook{
+		Instances: Instances{
+			InstanceStore: FakeInstanceStore{
+				_Get: func(id int) (models.Instance, error) {
+					return models.Instance{ID: id, ImageID: 3, Status: models.InstanceRunning}, nil
+				},
+			},
+			Executor: FakeExecutor{
+				_RestartInstance: func(ctx context.Context, instance models.Instance) error {
+					assert.Equal(t, 12, instance.ID)
+					restarted = true
+					return nil
+				},
+			},
+		},
+		Audit: audit.Runbook{Logger: logger},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/runbook/instances/{id}/restart", errorHandler.Handle(routeSet.RestartInstance))
+	router.ServeHTTP(recorder, req)
+
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, restarted)
+	assert.Contains(t, logs.String(), "Runbook action succeeded")
+	assert.Contains(t, logs.String(), "INC-123: postgres crashed")
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, "instances", response.Data.Type)
+	assert.Equal(t, "12", response.Data.ID)
+}
+
+func TestRunbookRotateInstanceCredentials(t *testing.T) {
+	req, recorder := runbookRequest(t, "/admin/runbook/instances/12/rotate_credentials", `"reason": "INC-124: key leaked", "confirm": "rotate_credentials instance 12"`)
+
+	rotated := false
+	logger, _ := NewFakeLogger()
+	routeSet := Runbook{
+		Instances: Instances{
+			InstanceStore: FakeInstanceStore{
+				_Get: func(id int) (models.Instance, error) {
+					return models.Instance{ID: id, Status: models.InstanceRunning}, nil
+				},
+			},
+			Executor: FakeExecutor{
+				_RotateInstanceCredentials: func(ctx context.Context, instance models.Instance) error {
+					assert.Equal(t, 12, instance.ID)
+					rotated = true
+					return nil
+				},
+			},
+		},
+		Audit: audit.Runbook{Logger: logger},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/runbook/instances/{id}/rotate_credentials", errorHandler.Handle(routeSet.RotateInstanceCredentials))
+	router.ServeHTTP(recorder, req)
+
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, rotated)
+}
+
+func TestRunbookInstanceActionValidation(t *testing.T) {
+	testCases := []struct {
+		name           string
+		attributes     string
+		asUser         bool
+		status         string
+		getErr         error
+		expectedStatus int
+		expectedError  api.Error
+	}{
+		{
+			name:           "by a user who isn't an admin",
+			attributes:     `"reason": "INC-123", "confirm": "restart instance 12"`,
+			asUser:         true,
+			expectedStatus: http.StatusForbidden,
+			expectedError:  api.ForbiddenError,
+		},
+		{
+			name:           "without a reason",
+			attributes:     `"confirm": "restart instance 12"`,
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  api.InvalidRunbookActionError("reason must say why the action is being taken"),
+		},
+		{
+			name:           "without confirmation",
+			attributes:     `"reason": "INC-123"`,
+			expectedStatus: http.StatusPreconditionRequired,
+			expectedError:  api.ConfirmationRequiredError("restart instance 12"),
+		},
+		{
+			name:           "confirming another instance",
+			attributes:     `"reason": "INC-123", "confirm": "restart instance 13"`,
+			expectedStatus: http.StatusPreconditionRequired,
+			expectedError:  api.ConfirmationRequiredError("restart instance 12"),
+		},
+		{
+			name:           "an instance that's being destroyed",
+			attributes:     `"reason": "INC-123", "confirm": "restart instance 12"`,
+			status:         models.InstanceDestroying,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  api.RunbookActionUnavailableError("instance 12 is being destroyed"),
+		},
+		{
+			name:           "an instance that doesn't exist",
+			attributes:     `"reason": "INC-123", "confirm": "restart instance 12"`,
+			getErr:         sql.ErrNoRows,
+			expectedStatus: http.StatusNotFound,
+			expectedError:  api.NotFoundError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder := runbookRequest(t, "/admin/runbook/instances/12/restart", tc.attributes)
+			if tc.asUser {
+				req, recorder, _ = createRequest(t, "POST", "/admin/runbook/instances/12/restart", bytes.NewBufferString(
+					fmt.Sprintf(`{"data": {"type": "runbook_actions", "attributes": {%s}}}`, tc.attributes),
+				))
+			}
+
+			status := tc.status
+			if status == "" {
+				status = models.InstanceRunning
+			}
+
+			logger, _ := NewFakeLogger()
+			routeSet := Runbook{
+				Instances: Instances{
+					InstanceStore: FakeInstanceStore{
+						_Get: func(id int) (models.Instance, error) {
+							return models.Instance{ID: id, Status: status}, tc.getErr
+						},
+					},
+					Executor: FakeExecutor{
+						_RestartInstance: func(ctx context.Context, instance models.Instance) error {
+							t.Fatal("instance was restarted")
+							return nil
+						},
+					},
+				},
+				Audit: audit.Runbook{Logger: logger},
+			}
+
+			errorHandler := FakeErrorHandler{}
+			router := mux.NewRouter()
+			router.HandleFunc("/admin/runbook/instances/{id}/restart", errorHandler.Handle(routeSet.RestartInstance))
+			router.ServeHTTP(recorder, req)
+
+			assert.Nil(t, errorHandler.Error)
+			assert.Equal(t, tc.expectedStatus, recorder.Code)
+
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+			assert.Equal(t, tc.expectedError, response)
+		})
+	}
+}
+
+func TestRunbookRestartInstanceWhenItFails(t *testing.T) {
+	req, recorder := runbookRequest(t, "/admin/runbook/instances/12/restart", `"reason": "INC-123", "confirm": "restart instance 12"`)
+
+	logger, logs := NewFakeLogger()
+	routeSet := Runbook{
+		Instances: Instances{
+			InstanceStore: FakeInstanceStore{
+				_Get: func(id int) (models.Instance, error) {
+					return models.Instance{ID: id, Status: models.InstanceRunning}, nil
+				},
+			},
+			Executor: FakeExecutor{
+				_RestartInstance: func(ctx context.Context, instance models.Instance) error {
+					return errors.New("pg_ctl: could not start server")
+				},
+			},
+		},
+		Audit: audit.Runbook{Logger: logger},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/runbook/instances/{id}/restart", errorHandler.Handle(routeSet.RestartInstance))
+	router.ServeHTTP(recorder, req)
+
+	assert.EqualError(t, errorHandler.Error, "runbook action restart failed: pg_ctl: could not start server")
+	assert.Contains(t, logs.String(), "Runbook action failed")
+}
+
+func TestRunbookRequeueOperation(t *testing.T) {
+	req, recorder := runbookRequest(t, "/admin/runbook/operations/40/requeue", `"reason": "INC-125: disk was full", "confirm": "requeue operation 40"`)
+
+	var recorded []models.Job
+	workers, wait := startWorkers(&recorded)
+
+	destroyed := make(chan int, 1)
+	logger, logs := NewFakeLogger()
+	routeSet := Runbook{
+		Images: Images{
+			JobStore: FakeJobStore{
+				_Get: func(id int) (models.Job, error) {
+					return models.Job{ID: id, Kind: models.JobDestroyInstance, ResourceID: 12, Status: models.JobFailed, UserEmail: "test@draupnir"}, nil
+				},
+				_Latest: func(kind string, resourceID int) (models.Job, error) {
+					assert.Equal(t, models.JobDestroyInstance, kind)
+					assert.Equal(t, 12, resourceID)
+					return models.Job{ID: 40}, nil
+				},
+			},
+			Workers: workers,
+		},
+		Instances: Instances{
+			// The instance was removed from the database before the destroy
+			// failed, so only its files are left to delete
+			InstanceStore: FakeInstanceStore{
+				_Get: func(id int) (models.Instance, error) {
+					return models.Instance{}, sql.ErrNoRows
+				},
+			},
+			Executor: FakeExecutor{
+				_DestroyInstance: func(ctx context.Context, id int) error {
+					destroyed <- id
+					return nil
+				},
+			},
+		},
+		Audit: audit.Runbook{Logger: logger},
+	}
+
+	errorHandler := FakeErrorHandler{}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/runbook/operations/{id}/requeue", errorHandler.Handle(routeSet.RequeueOperation))
+	router.ServeHTTP(recorder, req)
+
+	assert.Nil(t, errorHandler.Error)
+	assert.Equal(t, http.StatusAccepted, recorder.Code)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, "operations", response.Data.Type)
+	assert.Equal(t, "10", response.Data.ID)
+
+	select {
+	case id := <-destroyed:
+		assert.Equal(t, 12, id)
+	case <-time.After(time.Second):
+		t.Fatal("instance wasn't destroyed")
+	}
+
+	wait(1)
+	assert.Equal(t, models.JobDestroyInstance, recorded[0].Kind)
+	assert.Equal(t, models.JobSucceeded, recorded[0].Status)
+	assert.Equal(t, "test@draupnir", recorded[0].UserEmail)
+	assert.Contains(t, logs.String(), "INC-125: disk was full")
+}
+
+func TestRunbookRequeueOperationUnavailable(t *testing.T) {
+	testCases := []struct {
+		name          string
+		job           models.Job
+		latestID      int
+		image         models.Image
+		imageErr      error
+		expectedError api.Error
+	}{
+		{
+			name:          "running operation",
+			job:           models.Job{ID: 40, Kind: models.JobFinaliseImage, ResourceID: 3, Status: models.JobRunning},
+			latestID:      40,
+			expectedError: api.RunbookActionUnavailableError("operation 40 is running, and only failed operations can be requeued"),
+		},
+		{
+			name:          "superseded operation",
+			job:           models.Job{ID: 40, Kind: models.JobFinaliseImage, ResourceID: 3, Status: models.JobFailed},
+			latestID:      41,
+			expectedError: api.RunbookActionUnavailableError("operation 40 has been superseded by operation 41"),
+		},
+		{
+			name:          "interrupted finalisation",
+			job:           models.Job{ID: 40, Kind: models.JobFinaliseImage, ResourceID: 3, Status: models.JobInterrupted, Error: "upload may be partially anonymised"},
+			latestID:      40,
+			expectedError: api.RunbookActionUnavailableError("upload may be partially anonymised"),
+		},
+		{
+			name:          "finalisation of a ready image",
+			job:           models.Job{ID: 40, Kind: models.JobFinaliseImage, ResourceID: 3, Status: models.JobFailed},
+			latestID:      40,
+			image:         models.Image{ID: 3, Ready: true},
+			expectedError: api.RunbookActionUnavailableError("image 3 is already ready"),
+		},
+		{
+			name:          "finalisation of a destroyed image",
+			job:           models.Job{ID: 40, Kind: models.JobFinaliseImage, ResourceID: 3, Status: models.JobFailed},
+			latestID:      40,
+			imageErr:      sql.ErrNoRows,
+			expectedError: api.RunbookActionUnavailableError("image 3 has been destroyed"),
+		},
+		{
+			name:          "reset",
+			job:           models.Job{ID: 40, Kind: models.JobResetImage, ResourceID: 3, Status: models.JobFailed},
+			latestID:      40,
+			expectedError: api.RunbookActionUnavailableError("reset_image jobs can't be requeued"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, recorder := runbookRequest(t, "/admin/runbook/operations/40/requeue", `"reason": "INC-125", "confirm": "requeue operation 40"`)
+
+			logger, _ := NewFakeLogger()
+			routeSet := Runbook{
+				Images: Images{
+					ImageStore: FakeImageStore{
+						_Get: func(id int) (models.Image, error) {
+							return tc.image, tc.imageErr
+						},
+					},
+					JobStore: FakeJobStore{
+						_Get: func(id int) (models.Job, error) {
+							return tc.job, nil
+						},
+						_Latest: func(kind string, resourceID int) (models.Job, error) {
+							return models.Job{ID: tc.latestID}, nil
+						},
+					},
+				},
+				Audit: audit.Runbook{Logger: logger},
+			}
+
+			errorHandler := FakeErrorHandler{}
+			router := mux.NewRouter()
+			router.HandleFunc("/admin/runbook/operations/{id}/requeue", errorHandler.Handle(routeSet.RequeueOperation))
+			router.ServeHTTP(recorder, req)
+
+			assert.Nil(t, errorHandler.Error)
+			assert.Equal(t, http.StatusUnprocessableEntity, recorder.Code)
+
+			var response api.Error
+			decodeJSON(t, recorder.Body, &response)
+			assert.Equal(t, tc.expectedError, response)
+		})
+	}
+}
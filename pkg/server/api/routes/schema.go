@@ -0,0 +1,172 @@
+package routes
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/jsonapi"
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// Schema lets operators monitor and maintain the metadata database through
+// the API
+type Schema struct {
+	SchemaStore store.SchemaStore
+	// MigrationsPath is the directory of sql-migrate migrations that the server
+	// was deployed with. Pending migrations aren't reported if it's empty.
+	MigrationsPath string
+}
+
+// VacuumRequest lists the tables to vacuum. Every table is vacuumed if it's
+// empty.
+type VacuumRequest struct {
+	Tables  []string `jsonapi:"attr,tables"`
+	Analyze bool     `jsonapi:"attr,analyze"`
+}
+
+// Get reports the schema version, pending migrations, and the state of each
+// table and index
+func (s Schema) Get(w http.ResponseWriter, r *http.Request) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	applied, err := s.SchemaStore.AppliedMigrations()
+	if err != nil {
+		return errors.Wrap(err, "failed to list applied migrations")
+	}
+
+	tables, err := s.SchemaStore.Tables()
+	if err != nil {
+		return errors.Wrap(err, "failed to get table statistics")
+	}
+
+	indexes, err := s.SchemaStore.Indexes()
+	if err != nil {
+		return errors.Wrap(err, "failed to get index statistics")
+	}
+
+	report := models.SchemaReport{
+		AppliedMigrations: len(applied),
+		Tables:            tables,
+		Indexes:           indexes,
+	}
+	if len(applied) > 0 {
+		report.ID = applied[len(applied)-1]
+	}
+
+	if s.MigrationsPath != "" {
+		report.PendingMigrations, err = pendingMigrations(s.MigrationsPath, applied)
+		if err != nil {
+			return errors.Wrap(err, "failed to list pending migrations")
+		}
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &report),
+		"failed to marshal schema report",
+	)
+}
+
+// Vacuum vacuums the requested tables, one at a time, returning once they've
+// all been vacuumed
+func (s Schema) Vacuum(w http.ResponseWriter, r *http.Request) error {
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	req := VacuumRequest{}
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil {
+		logger.Info(err.Error())
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	tables, err := s.SchemaStore.Tables()
+	if err != nil {
+		return errors.Wrap(err, "failed to list tables")
+	}
+
+	known := make(map[string]bool)
+	for _, table := range tables {
+		known[table.Name] = true
+	}
+
+	names := req.Tables
+	if len(names) == 0 {
+		for _, table := range tables {
+			names = append(names, table.Name)
+		}
+	}
+
+	// Check every table before vacuuming any, so a typo doesn't leave the
+	// request half done
+	for _, name := range names {
+		if !known[name] {
+			api.UnknownTableError(name).Render(w, http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	for _, name := range names {
+		logger.With("table", name).With("analyze", req.Analyze).Info("Vacuuming table")
+		if err := s.SchemaStore.Vacuum(r.Context(), name, req.Analyze); err != nil {
+			return errors.Wrapf(err, "failed to vacuum %s", name)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// pendingMigrations returns the migrations in path that haven't been applied,
+// named as sql-migrate names them
+func pendingMigrations(path string, applied []string) ([]string, error) {
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(map[string]bool)
+	for _, id := range applied {
+		done[id] = true
+	}
+
+	pending := []string{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".sql") {
+			continue
+		}
+		if !done[file.Name()] {
+			pending = append(pending, file.Name())
+		}
+	}
+	sort.Strings(pending)
+
+	return pending, nil
+}
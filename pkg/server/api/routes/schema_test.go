@@ -0,0 +1,154 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+func schemaRequest(t *testing.T, method, path, body, user string) (*http.Request, *httptest.ResponseRecorder) {
+	req, recorder, _ := createRequest(t, method, path, bytes.NewBufferString(body))
+	return req.WithContext(context.WithValue(req.Context(), middleware.AuthUserKey, user)), recorder
+}
+
+func fakeSchemaStore(vacuumed *[]string) FakeSchemaStore {
+	return FakeSchemaStore{
+		_AppliedMigrations: func() ([]string, error) {
+			return []string{"2016-01-01_create_images.sql", "2016-02-01_create_instances.sql"}, nil
+		},
+		_Tables: func() ([]models.TableStats, error) {
+			return []models.TableStats{
+				{Name: "images", EstimatedRows: 10, DeadRows: 2, SizeBytes: 8192},
+				{Name: "instances", EstimatedRows: 20, DeadRows: 0, SizeBytes: 16384},
+			}, nil
+		},
+		_Indexes: func() ([]models.IndexStats, error) {
+			return []models.IndexStats{
+				{Name: "images_pkey", Table: "images", SizeBytes: 4096, Scans: 5, Valid: true},
+			}, nil
+		},
+		_Vacuum: func(table string, analyze bool) error {
+			*vacuumed = append(*vacuumed, table)
+			return nil
+		},
+	}
+}
+
+func TestSchemaGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrations")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"2016-01-01_create_images.sql", "2016-02-01_create_instances.sql", "2016-03-01_add_labels.sql", "README"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0644))
+	}
+
+	req, recorder := schemaRequest(t, "GET", "/admin/schema", "", auth.UPLOAD_USER_EMAIL)
+
+	err = Schema{SchemaStore: fakeSchemaStore(nil), MigrationsPath: dir}.Get(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response map[string]map[string]interface{}
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, "2016-02-01_create_instances.sql", response["data"]["id"])
+
+	attributes := response["data"]["attributes"].(map[string]interface{})
+	assert.Equal(t, 2.0, attributes["applied_migrations"])
+	assert.Equal(t, []interface{}{"2016-03-01_add_labels.sql"}, attributes["pending_migrations"])
+
+	tables := attributes["tables"].([]interface{})
+	assert.Equal(t, 2, len(tables))
+	assert.Equal(t, "images", tables[0].(map[string]interface{})["name"])
+	assert.Equal(t, 2.0, tables[0].(map[string]interface{})["dead_rows"])
+
+	indexes := attributes["indexes"].([]interface{})
+	assert.Equal(t, true, indexes[0].(map[string]interface{})["valid"])
+}
+
+func TestSchemaGetWithoutMigrationsPath(t *testing.T) {
+	req, recorder := schemaRequest(t, "GET", "/admin/schema", "", auth.UPLOAD_USER_EMAIL)
+
+	err := Schema{SchemaStore: fakeSchemaStore(nil)}.Get(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response map[string]map[string]interface{}
+	decodeJSON(t, recorder.Body, &response)
+	attributes := response["data"]["attributes"].(map[string]interface{})
+	assert.Nil(t, attributes["pending_migrations"])
+}
+
+func TestSchemaGetFromNonUploadUser(t *testing.T) {
+	req, recorder := schemaRequest(t, "GET", "/admin/schema", "", "test@draupnir")
+
+	err := Schema{}.Get(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestSchemaVacuum(t *testing.T) {
+	req, recorder := schemaRequest(t, "POST", "/admin/maintenance/vacuum", `{"data": {"type": "vacuums", "attributes": {
+		"tables": ["instances"],
+		"analyze": true
+	}}}`, auth.UPLOAD_USER_EMAIL)
+
+	vacuumed := []string{}
+	err := Schema{SchemaStore: fakeSchemaStore(&vacuumed)}.Vacuum(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, []string{"instances"}, vacuumed)
+}
+
+func TestSchemaVacuumAllTables(t *testing.T) {
+	req, recorder := schemaRequest(t, "POST", "/admin/maintenance/vacuum", `{"data": {"type": "vacuums", "attributes": {}}}`, auth.UPLOAD_USER_EMAIL)
+
+	vacuumed := []string{}
+	err := Schema{SchemaStore: fakeSchemaStore(&vacuumed)}.Vacuum(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, []string{"images", "instances"}, vacuumed)
+}
+
+func TestSchemaVacuumUnknownTable(t *testing.T) {
+	req, recorder := schemaRequest(t, "POST", "/admin/maintenance/vacuum", `{"data": {"type": "vacuums", "attributes": {
+		"tables": ["instances", "pg_authid"]
+	}}}`, auth.UPLOAD_USER_EMAIL)
+
+	vacuumed := []string{}
+	err := Schema{SchemaStore: fakeSchemaStore(&vacuumed)}.Vacuum(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, []string{}, vacuumed)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, api.UnknownTableError("pg_authid"), response)
+}
+
+func TestSchemaVacuumFromNonUploadUser(t *testing.T) {
+	req, recorder := schemaRequest(t, "POST", "/admin/maintenance/vacuum", `{}`, "test@draupnir")
+
+	err := Schema{}.Vacuum(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+}
@@ -0,0 +1,89 @@
+package routes
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// Search finds images, and the user's own instances, by their labels, owner,
+// annotations, shard names and IDs
+type Search struct {
+	SearchStore   store.SearchStore
+	ImageStore    store.ImageStore
+	InstanceStore store.InstanceStore
+}
+
+// List returns a page of the resources that match q, most relevant first, each
+// with the image or instance that it refers to
+func (s Search) List(w http.ResponseWriter, r *http.Request) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		api.MissingSearchQueryError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	page, err := parsePage(r.URL.Query())
+	if err != nil {
+		api.InvalidPaginationError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	results, more, err := s.SearchStore.Search(query, email, page)
+	if err != nil {
+		return errors.Wrap(err, "failed to search")
+	}
+
+	// Build a slice of pointers to our results, because this is what jsonapi
+	// wants. Resources that were destroyed since they were found are dropped.
+	_results := make([]*models.SearchResult, 0, len(results))
+	for idx := range results {
+		result := &results[idx]
+		err = s.attach(result)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to get %s", result.ID)
+		}
+		_results = append(_results, result)
+	}
+
+	return errors.Wrap(
+		marshalPage(r, w, _results, paginationLinks(r, page, more)),
+		"failed to marshal search results",
+	)
+}
+
+// attach sets the image or instance that the result refers to
+func (s Search) attach(result *models.SearchResult) error {
+	switch result.ResourceType {
+	case models.SearchResultImage:
+		image, err := s.ImageStore.Get(result.ResourceID)
+		if err != nil {
+			return err
+		}
+		result.Image = &image
+	case models.SearchResultInstance:
+		instance, err := s.InstanceStore.Get(result.ResourceID)
+		if err != nil {
+			return err
+		}
+		result.Instance = &instance
+	default:
+		return errors.Errorf("unknown resource type %s", result.ResourceType)
+	}
+	return nil
+}
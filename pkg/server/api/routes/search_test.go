@@ -0,0 +1,115 @@
+package routes
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"testing"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+func TestSearchList(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/search?q=payments+eu", nil)
+
+	routeSet := Search{
+		SearchStore: FakeSearchStore{
+			_Search: func(query string, userEmail string, page store.Page) ([]models.SearchResult, bool, error) {
+				assert.Equal(t, "payments eu", query)
+				assert.Equal(t, "test@draupnir", userEmail)
+				assert.Equal(t, store.Page{Number: 1, Size: DEFAULT_PAGE_SIZE}, page)
+				return []models.SearchResult{
+					models.NewSearchResult(models.SearchResultInstance, 4, 0.6),
+					models.NewSearchResult(models.SearchResultImage, 3, 0.4),
+					models.NewSearchResult(models.SearchResultImage, 2, 0.1),
+				}, false, nil
+			},
+		},
+		ImageStore: FakeImageStore{
+			_Get: func(id int) (models.Image, error) {
+				// Image 2 was destroyed after it was found
+				if id == 2 {
+					return models.Image{}, sql.ErrNoRows
+				}
+				return models.Image{ID: id, Ready: true, Labels: models.Labels{"cluster": "payments-eu"}}, nil
+			},
+		},
+		InstanceStore: FakeInstanceStore{
+			_Get: func(id int) (models.Instance, error) {
+				return models.Instance{ID: id, ImageID: 3, UserEmail: "test@draupnir"}, nil
+			},
+		},
+	}
+	err := routeSet.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+	if assert.Len(t, response.Data, 2) {
+		assert.Equal(t, "search_results", response.Data[0].Type)
+		assert.Equal(t, "instances:4", response.Data[0].ID)
+		assert.Equal(t, "instances", response.Data[0].Attributes["resource_type"])
+		assert.Equal(t, float64(4), response.Data[0].Attributes["resource_id"])
+		assert.Contains(t, response.Data[0].Relationships, "instance")
+		assert.NotContains(t, response.Data[0].Relationships, "image")
+
+		assert.Equal(t, "images:3", response.Data[1].ID)
+		assert.Contains(t, response.Data[1].Relationships, "image")
+	}
+
+	types := []string{}
+	for _, included := range response.Included {
+		types = append(types, included.Type+":"+included.ID)
+	}
+	sort.Strings(types)
+	assert.Equal(t, []string{"images:3", "instances:4"}, types)
+}
+
+func TestSearchListWithoutQuery(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/search?q=+", nil)
+
+	err := Search{}.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, api.MissingSearchQueryError, response)
+}
+
+func TestSearchListPaginated(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/search?q=3&page[size]=1", nil)
+
+	routeSet := Search{
+		SearchStore: FakeSearchStore{
+			_Search: func(query string, userEmail string, page store.Page) ([]models.SearchResult, bool, error) {
+				assert.Equal(t, store.Page{Number: 1, Size: 1}, page)
+				return []models.SearchResult{models.NewSearchResult(models.SearchResultImage, 3, 1.2)}, true, nil
+			},
+		},
+		ImageStore: FakeImageStore{
+			_Get: func(id int) (models.Image, error) {
+				return models.Image{ID: id}, nil
+			},
+		},
+	}
+	err := routeSet.List(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Len(t, response.Data, 1)
+	if assert.NotNil(t, response.Links) {
+		assert.Contains(t, (*response.Links)["next"], "page%5Bnumber%5D=2")
+	}
+}
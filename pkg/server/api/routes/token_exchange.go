@@ -0,0 +1,99 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+)
+
+// TokenExchange exchanges cloud workload identities for tokens that
+// authenticate service accounts, so that jobs running in the cloud don't need
+// long-lived keys
+type TokenExchange struct {
+	// Verifiers verifies the identities of each provider
+	Verifiers map[string]auth.IdentityVerifier
+	// Identities maps each provider's principals to service accounts
+	Identities map[string]map[string]string
+	Tokens     auth.ExchangedTokens
+	TTL        time.Duration
+}
+
+type exchangeTokenRequest struct {
+	Provider string `jsonapi:"attr,provider"`
+	Token    string `jsonapi:"attr,token"`
+}
+
+// Exchange verifies the identity, and returns a token for the service account
+// that it's mapped to. The token is returned as both the access and refresh
+// token, as clients authenticate with the refresh token, but it can't be
+// refreshed: clients exchange their identity again once it expires.
+func (e TokenExchange) Exchange(w http.ResponseWriter, r *http.Request) error {
+	var req exchangeTokenRequest
+
+	logger, err := middleware.GetLogger(r)
+	if err != nil {
+		return err
+	}
+
+	if err := jsonapi.UnmarshalPayload(r.Body, &req); err != nil || req.Token == "" {
+		api.InvalidJSONError.Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	verifier, ok := e.Verifiers[req.Provider]
+	if !ok {
+		api.UnsupportedIdentityProviderError(req.Provider).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), TOKEN_EXCHANGE_TIMEOUT)
+	defer cancel()
+
+	principal, err := verifier.Verify(ctx, req.Token)
+	if err != nil {
+		logger.With("provider", req.Provider).With("error", err.Error()).Info("failed to verify identity")
+		api.UnauthorizedError.Render(w, http.StatusUnauthorized)
+		return nil
+	}
+
+	serviceAccount, ok := e.Identities[req.Provider][principal]
+	if !ok {
+		logger.With("provider", req.Provider).With("principal", principal).Info("identity isn't mapped to a service account")
+		api.UnmappedIdentityError(principal).Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	expiry := time.Now().Add(e.TTL)
+	exchanged, err := e.Tokens.Issue(serviceAccount, expiry)
+	if err != nil {
+		return errors.Wrap(err, "failed to issue exchanged token")
+	}
+
+	logger.
+		With("provider", req.Provider).
+		With("principal", principal).
+		With("service_account", serviceAccount).
+		Info("exchanged identity for token")
+
+	token := oauth2.Token{
+		AccessToken:  exchanged,
+		TokenType:    "Bearer",
+		RefreshToken: exchanged,
+		Expiry:       expiry,
+	}
+
+	err = json.NewEncoder(w).Encode(token)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode access token")
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+)
+
+func exchangeRequest(t *testing.T, provider, token string) (*http.Request, *httptest.ResponseRecorder, *bytes.Buffer) {
+	body := bytes.NewBuffer([]byte{})
+	jsonapi.MarshalOnePayloadWithoutIncluded(body, &exchangeTokenRequest{Provider: provider, Token: token})
+	return createRequest(t, "POST", "/access_tokens/exchange", body)
+}
+
+func fakeTokenExchange() TokenExchange {
+	return TokenExchange{
+		Verifiers: map[string]auth.IdentityVerifier{
+			"aws": FakeIdentityVerifier{
+				_Verify: func(token string) (string, error) {
+					switch token {
+					case "ci-identity":
+						return "arn:aws:iam::123456789012:role/ci", nil
+					case "other-identity":
+						return "arn:aws:iam::123456789012:role/other", nil
+					default:
+						return "", errors.New("SignatureDoesNotMatch")
+					}
+				},
+			},
+		},
+		Identities: map[string]map[string]string{
+			"aws": {"arn:aws:iam::123456789012:role/ci": "ci"},
+		},
+		Tokens: auth.NewExchangedTokens("shared-secret"),
+		TTL:    time.Hour,
+	}
+}
+
+func TestExchangeToken(t *testing.T) {
+	req, recorder, _ := exchangeRequest(t, "aws", "ci-identity")
+
+	routeSet := fakeTokenExchange()
+	err := routeSet.Exchange(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var token oauth2.Token
+	decodeJSON(t, recorder.Body, &token)
+	assert.Equal(t, token.AccessToken, token.RefreshToken)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), token.Expiry, time.Minute)
+
+	name, err := routeSet.Tokens.Verify(token.RefreshToken, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, "ci", name)
+}
+
+func TestExchangeTokenWithInvalidIdentity(t *testing.T) {
+	req, recorder, logs := exchangeRequest(t, "aws", "forged-identity")
+
+	err := fakeTokenExchange().Exchange(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, api.UnauthorizedError, response)
+	assert.Contains(t, logs.String(), "SignatureDoesNotMatch")
+}
+
+func TestExchangeTokenWithUnmappedIdentity(t *testing.T) {
+	req, recorder, _ := exchangeRequest(t, "aws", "other-identity")
+
+	err := fakeTokenExchange().Exchange(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Equal(t, api.UnmappedIdentityError("arn:aws:iam::123456789012:role/other"), response)
+}
+
+func TestExchangeTokenWithUnsupportedProvider(t *testing.T) {
+	req, recorder, _ := exchangeRequest(t, "gcp", "an-id-token")
+
+	err := fakeTokenExchange().Exchange(recorder, req)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, api.UnsupportedIdentityProviderError("gcp"), response)
+}
@@ -0,0 +1,61 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// Users describes the user that a request is authenticated as, so that they
+// can find out why they're being refused without reading the server's logs
+type Users struct {
+	ImageStore    store.ImageStore
+	InstanceStore store.InstanceStore
+	// Quota is the image quota that the Images route set enforces
+	Quota ImageQuota
+	// InstanceQuota is the instance quota that the Instances route set enforces
+	InstanceQuota InstanceQuota
+}
+
+// Whoami returns the authenticated user, their roles, and how much of their
+// quotas they've used
+func (u Users) Whoami(w http.ResponseWriter, r *http.Request) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	instances, err := u.InstanceStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list instances")
+	}
+
+	images, err := u.ImageStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list images")
+	}
+
+	user := models.User{
+		ID:                  email,
+		Roles:               auth.Roles(email),
+		MaxInstances:        u.InstanceQuota.limit(email),
+		MaxImagesInProgress: u.Quota.MaxInProgress,
+	}
+	for _, instance := range instances {
+		if instance.UserEmail == email {
+			user.Instances++
+		}
+	}
+
+	inProgress, wait := u.Quota.usage(images, email, time.Now())
+	user.ImagesInProgress = inProgress
+	user.ImageCooldown = wait.Round(time.Second).String()
+
+	return errors.Wrap(marshalOne(r, w, &user), "failed to marshal user")
+}
@@ -0,0 +1,56 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestWhoami(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/whoami", nil)
+
+	routeSet := Users{
+		InstanceStore: FakeInstanceStore{
+			_List: func() ([]models.Instance, error) {
+				return []models.Instance{
+					{ID: 1, UserEmail: "test@draupnir"},
+					{ID: 2, UserEmail: "other@draupnir"},
+					{ID: 3, UserEmail: "test@draupnir"},
+				}, nil
+			},
+		},
+		ImageStore: FakeImageStore{
+			_List: func() ([]models.Image, error) {
+				return []models.Image{
+					{ID: 1, Uploader: "test@draupnir", CreatedAt: time.Now().Add(-10 * time.Minute)},
+					{ID: 2, Uploader: "test@draupnir", Ready: true, CreatedAt: time.Now().Add(-2 * time.Hour)},
+					{ID: 3, Uploader: "other@draupnir", CreatedAt: time.Now()},
+				}, nil
+			},
+		},
+		Quota:         ImageQuota{MaxInProgress: 2, Cooldown: time.Hour},
+		InstanceQuota: InstanceQuota{MaxPerUser: 3},
+	}
+
+	err := routeSet.Whoami(recorder, req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, "users", response.Data.Type)
+	assert.Equal(t, "test@draupnir", response.Data.ID)
+
+	attributes := response.Data.Attributes
+	assert.Equal(t, []interface{}{models.RoleUser}, attributes["roles"])
+	assert.Equal(t, float64(2), attributes["instances"])
+	assert.Equal(t, float64(3), attributes["max_instances"])
+	assert.Equal(t, float64(1), attributes["images_in_progress"])
+	assert.Equal(t, float64(2), attributes["max_images_in_progress"])
+	assert.Equal(t, "50m0s", attributes["image_cooldown"])
+}
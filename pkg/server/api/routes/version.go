@@ -0,0 +1,30 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+// Version describes the server's version and the features that it supports
+type Version struct {
+	Features []string
+}
+
+// Get returns the server's version and features. It doesn't require an API
+// version or authentication, as clients use it to negotiate which version to
+// send before making any other requests.
+func (v Version) Get(w http.ResponseWriter, r *http.Request) error {
+	serverVersion := models.ServerVersion{ID: version.Version, Features: v.Features}
+	if serverVersion.Features == nil {
+		serverVersion.Features = []string{}
+	}
+
+	return errors.Wrap(
+		marshalOne(r, w, &serverVersion),
+		"failed to marshal server version",
+	)
+}
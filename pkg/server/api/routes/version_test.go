@@ -0,0 +1,32 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/version"
+)
+
+func TestVersionGet(t *testing.T) {
+	serverVersion := version.Version
+	version.Version = "1.4.0"
+	defer func() { version.Version = serverVersion }()
+
+	req, recorder, _ := createRequest(t, "GET", "/version", nil)
+
+	routeSet := Version{Features: []string{models.FeatureBakeTimeline, models.FeatureImageFiles}}
+	err := routeSet.Get(recorder, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response jsonapi.OnePayload
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, "versions", response.Data.Type)
+	assert.Equal(t, "1.4.0", response.Data.ID)
+	assert.Equal(t, []interface{}{"bake_timeline", "image_files"}, response.Data.Attributes["features"])
+}
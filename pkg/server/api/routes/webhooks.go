@@ -0,0 +1,76 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// Webhooks lets admins see what the webhooks in the server's config have been
+// sent
+type Webhooks struct {
+	DeliveryStore store.WebhookDeliveryStore
+}
+
+// ListDeliveries returns a page of the deliveries to webhooks, newest first,
+// optionally filtered by filter[webhook] and filter[status]
+func (h Webhooks) ListDeliveries(w http.ResponseWriter, r *http.Request) error {
+	email, err := middleware.GetAuthenticatedUser(r)
+	if err != nil {
+		return err
+	}
+
+	if !auth.IsAdmin(email) {
+		api.ForbiddenError.Render(w, http.StatusForbidden)
+		return nil
+	}
+
+	filter, err := parseWebhookDeliveryFilter(r)
+	if err != nil {
+		api.InvalidFilterError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	page, err := parsePage(r.URL.Query())
+	if err != nil {
+		api.InvalidPaginationError(err.Error()).Render(w, http.StatusBadRequest)
+		return nil
+	}
+
+	deliveries, more, err := h.DeliveryStore.ListPage(filter, page)
+	if err != nil {
+		return errors.Wrap(err, "failed to list webhook deliveries")
+	}
+
+	payload := make([]*models.WebhookDelivery, len(deliveries))
+	for i := range deliveries {
+		payload[i] = &deliveries[i]
+	}
+
+	return errors.Wrap(
+		marshalPage(r, w, payload, paginationLinks(r, page, more)),
+		"failed to marshal webhook deliveries",
+	)
+}
+
+func parseWebhookDeliveryFilter(r *http.Request) (store.WebhookDeliveryFilter, error) {
+	filters, err := parseFilters(r.URL.Query(), "webhook", "status")
+	if err != nil {
+		return store.WebhookDeliveryFilter{}, err
+	}
+
+	status := filters["status"]
+	statuses := []string{models.WebhookDeliveryPending, models.WebhookDeliverySucceeded, models.WebhookDeliveryFailed}
+	if status != "" && !models.ContainsString(statuses, status) {
+		return store.WebhookDeliveryFilter{}, fmt.Errorf("unknown webhook delivery status: %s", status)
+	}
+
+	return store.WebhookDeliveryFilter{Webhook: filters["webhook"], Status: status}, nil
+}
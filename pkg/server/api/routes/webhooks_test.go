@@ -0,0 +1,67 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/jsonapi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+func TestListWebhookDeliveries(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/admin/webhooks/deliveries?filter[webhook]=slack&filter[status]=failed&page[size]=1", nil)
+	req = asUploadUser(req)
+
+	routeSet := Webhooks{
+		DeliveryStore: FakeWebhookDeliveryStore{
+			_ListPage: func(filter store.WebhookDeliveryFilter, page store.Page) ([]models.WebhookDelivery, bool, error) {
+				assert.Equal(t, store.WebhookDeliveryFilter{Webhook: "slack", Status: models.WebhookDeliveryFailed}, filter)
+				assert.Equal(t, store.Page{Number: 1, Size: 1}, page)
+				return []models.WebhookDelivery{
+					{ID: 4, Webhook: "slack", Event: "image.ready", Status: models.WebhookDeliveryFailed, ResponseStatus: 500, Body: []byte(`{"text": "Image 3 is ready"}`)},
+				}, true, nil
+			},
+		},
+	}
+
+	err := routeSet.ListDeliveries(recorder, req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.NotContains(t, recorder.Body.String(), "Image 3 is ready", "bodies aren't exposed")
+
+	var response jsonapi.ManyPayload
+	decodeJSON(t, recorder.Body, &response)
+	if assert.Len(t, response.Data, 1) {
+		assert.Equal(t, "webhook_deliveries", response.Data[0].Type)
+		assert.Equal(t, "image.ready", response.Data[0].Attributes["event"])
+		assert.Equal(t, float64(500), response.Data[0].Attributes["response_status"])
+	}
+	if assert.NotNil(t, response.Links) {
+		assert.Contains(t, (*response.Links)["next"], "page%5Bnumber%5D=2")
+	}
+}
+
+func TestListWebhookDeliveriesRejectsOtherUsers(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/admin/webhooks/deliveries", nil)
+
+	err := Webhooks{}.ListDeliveries(recorder, req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	var response api.Error
+	decodeJSON(t, recorder.Body, &response)
+	assert.Equal(t, api.ForbiddenError, response)
+}
+
+func TestListWebhookDeliveriesRejectsUnknownStatus(t *testing.T) {
+	req, recorder, _ := createRequest(t, "GET", "/admin/webhooks/deliveries?filter[status]=lost", nil)
+	req = asUploadUser(req)
+
+	err := Webhooks{}.ListDeliveries(recorder, req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
@@ -5,7 +5,9 @@ import (
 	"time"
 
 	raven "github.com/getsentry/raven-go"
+	"github.com/gocardless/draupnir/pkg/events"
 	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/jobs"
 	"github.com/gocardless/draupnir/pkg/models"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
@@ -18,15 +20,19 @@ type InstanceCleaner struct {
 	logger        log.Logger
 	sentryClient  *raven.Client
 	instanceStore store.InstanceStore
+	jobStore      store.JobStore
+	events        *events.Broker
 	executor      exec.Executor
 	authenticator auth.Authenticator
 }
 
-func NewInstanceCleaner(logger log.Logger, sentryClient *raven.Client, instanceStore store.InstanceStore, executor exec.Executor, authenticator auth.Authenticator) *InstanceCleaner {
+func NewInstanceCleaner(logger log.Logger, sentryClient *raven.Client, instanceStore store.InstanceStore, jobStore store.JobStore, eventBroker *events.Broker, executor exec.Executor, authenticator auth.Authenticator) *InstanceCleaner {
 	return &InstanceCleaner{
 		logger:        logger,
 		sentryClient:  sentryClient,
 		instanceStore: instanceStore,
+		jobStore:      jobStore,
+		events:        eventBroker,
 		executor:      executor,
 		authenticator: authenticator,
 	}
@@ -39,16 +45,26 @@ func (ic *InstanceCleaner) Start(ctx context.Context, interval time.Duration) er
 	for {
 		select {
 		case <-time.After(interval):
-			ic.logger.Info("Cleaning old instances with invalid tokens")
+			ic.logger.Info("Cleaning expired instances and old instances with invalid tokens")
 			instances, err := ic.instanceStore.List()
 			if err != nil {
 				err = errors.Wrap(err, "cannot clean instances: unable to list instances")
 				ic.logger.Error(err.Error())
 				ic.sentryClient.CaptureError(err, map[string]string{})
 			} else {
+				now := time.Now()
 				for _, instance := range instances {
-					if instance.RefreshToken != "" {
-						valid, err, validityErr := ic.authenticator.IsRefreshTokenValid(instance.RefreshToken)
+					if instance.ExpiresAt != nil && !now.Before(*instance.ExpiresAt) {
+						logger := ic.logger.With("instance", instance.ID).With("user", instance.UserEmail)
+						logger.Infof("Instance expired at %s: destroying instance", instance.ExpiresAt.Format(time.RFC3339))
+						err = ic.destroyInstance(ctx, instance)
+						if err != nil {
+							err = errors.Wrap(err, "failed to destroy instance")
+							logger.Error(err.Error())
+							ic.sentryClient.CaptureError(err, map[string]string{})
+						}
+					} else if instance.RefreshToken != "" {
+						valid, err, validityErr := ic.authenticator.IsRefreshTokenValid(instance.RefreshToken.Reveal())
 						if err != nil {
 							err = errors.Wrap(err, "failed to validate token")
 							ic.logger.With("instance", instance.ID).Error(err.Error())
@@ -73,9 +89,15 @@ func (ic *InstanceCleaner) Start(ctx context.Context, interval time.Duration) er
 }
 
 func (ic *InstanceCleaner) destroyInstance(ctx context.Context, instance models.Instance) error {
-	err := ic.executor.DestroyInstance(ctx, instance.ID)
+	err := jobs.Run(ic.logger, ic.jobStore, models.JobDestroyInstance, instance.ID, func() error {
+		err := ic.executor.DestroyInstance(ctx, instance.ID)
+		if err == nil {
+			err = ic.instanceStore.Destroy(instance)
+		}
+		return err
+	})
 	if err == nil {
-		err = ic.instanceStore.Destroy(instance)
+		ic.events.Publish(events.InstanceEvent(events.Destroyed, instance))
 	}
 	return err
 }
@@ -7,6 +7,8 @@ import (
 
 	"github.com/burntsushi/toml"
 	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/redact"
 )
 
 // HTTPConfig holds Draupnir's HTTP configuration
@@ -19,29 +21,377 @@ type HTTPConfig struct {
 
 // OAuthConfig holds Draupnir's OAuth configuration
 type OAuthConfig struct {
-	RedirectURL  string `toml:"redirect_url"`
-	ClientID     string `toml:"client_id"`
-	ClientSecret string `toml:"client_secret"`
+	RedirectURL  string        `toml:"redirect_url"`
+	ClientID     string        `toml:"client_id"`
+	ClientSecret redact.Secret `toml:"client_secret"`
+}
+
+// ReclaimConfig holds the policy by which space is automatically reclaimed when
+// the pool's free space is critically low
+type ReclaimConfig struct {
+	// CriticalFreeSpace is the fraction of the pool, e.g. 0.05, below which space
+	// is reclaimed. Reclamation is disabled if it isn't set.
+	CriticalFreeSpace float64 `toml:"critical_free_space" required:"false"`
+	// TargetFreeSpace is the fraction of the pool that reclamation tries to
+	// free, which defaults to CriticalFreeSpace
+	TargetFreeSpace float64  `toml:"target_free_space" required:"false"`
+	CIUsers         []string `toml:"ci_users" required:"false"`
+	// InstanceMaxAge is the age, e.g. "24h", after which CI instances can be
+	// reclaimed
+	InstanceMaxAge string `toml:"instance_max_age" required:"false"`
+	// Interval is how often the pool's free space is checked, e.g. "1m"
+	Interval string `toml:"interval" required:"false"`
+	// NotifyCommand, if set, is run with sh for each image or instance that's
+	// reclaimed, to tell its owner
+	NotifyCommand string `toml:"notify_command" required:"false"`
+}
+
+// GuardrailConfig holds the policy by which images are scanned for references to
+// production, as they're finalised and before instances are created from them
+type GuardrailConfig struct {
+	// Mode is "warn", to log each reference, or "block", to also fail the
+	// finalisation or instance creation. Images aren't scanned if it's empty.
+	Mode string `toml:"mode" required:"false"`
+	// ProductionHosts are glob patterns, e.g. "*.prod.example.com", matched
+	// against every hostname and address in an image's settings
+	ProductionHosts []string `toml:"production_hosts" required:"false"`
+}
+
+// FreshnessConfig holds the freshness SLAs of image families, which are
+// checked continuously so that failed bakes are noticed
+type FreshnessConfig struct {
+	// Interval is how often the SLAs are checked, e.g. "5m"
+	Interval string `toml:"interval" required:"false"`
+	// NotifyCommand, if set, is run with sh each time an SLA is violated or
+	// recovers
+	NotifyCommand string         `toml:"notify_command" required:"false"`
+	SLAs          []FreshnessSLA `toml:"sla" required:"false"`
+}
+
+// FreshnessSLA requires the image family to always have a ready image that was
+// backed up less than MaxAge, e.g. "36h", ago
+type FreshnessSLA struct {
+	Family string `toml:"family"`
+	MaxAge string `toml:"max_age"`
+}
+
+// AnonAuditConfig holds the current anonymisation spec of image families,
+// against which their ready images are audited, so that images baked with an
+// older spec are noticed
+type AnonAuditConfig struct {
+	// Interval is how often the images are audited, e.g. "5m"
+	Interval string `toml:"interval" required:"false"`
+	// RebakeCommand is run with sh for each image that's found to be stale in a
+	// family whose policy is "rebake"
+	RebakeCommand string     `toml:"rebake_command" required:"false"`
+	Specs         []AnonSpec `toml:"spec" required:"false"`
+}
+
+// AnonSpec is the file holding the anonymisation script that the image family
+// should currently be anonymised with
+type AnonSpec struct {
+	Family string `toml:"family"`
+	Path   string `toml:"path"`
+	// Policy is what's done about the family's stale images: "report" (the
+	// default) flags them, "rebake" also runs the rebake command, and "block"
+	// stops instances being created from them
+	Policy string `toml:"policy" required:"false"`
+}
+
+// SyntheticDataConfig configures the padding of small or empty tables with
+// synthetic rows once images have been anonymised
+type SyntheticDataConfig struct {
+	Tables []SyntheticTable `toml:"table" required:"false"`
+}
+
+// SyntheticTable is a table of an image family that's padded with synthetic
+// rows until it has at least MinRows rows
+type SyntheticTable struct {
+	Family string `toml:"family"`
+	// Database is the database that the table is in. It defaults to the
+	// database that the anonymisation script is run against.
+	Database string `toml:"database" required:"false"`
+	// Table is the table's name, e.g. "public.payments"
+	Table   string `toml:"table"`
+	MinRows int    `toml:"min_rows"`
+	// Generator is "columns", which generates each column from its expression
+	// in Columns, or "sql", which runs the statements in SQL
+	Generator string            `toml:"generator"`
+	Columns   map[string]string `toml:"columns" required:"false"`
+	SQL       string            `toml:"sql" required:"false"`
+}
+
+// CanaryConfig configures canaries: short-lived instances of each image that
+// becomes ready, against which an application's test suite is run before anyone
+// else clones the image
+type CanaryConfig struct {
+	// TestCommand is run with sh against each canary instance, with libpq's
+	// environment variables set to connect to it. The canary fails if it exits
+	// non-zero. Canaries are disabled if it's empty.
+	TestCommand string `toml:"test_command" required:"false"`
+	// Timeout is how long, e.g. "10m", the test command can run for
+	Timeout string `toml:"timeout" required:"false"`
+	// Interval is how often ready images are checked for pending canaries, e.g.
+	// "1m"
+	Interval string `toml:"interval" required:"false"`
+}
+
+// CatalogConfig configures the registration of instances as services in a
+// service catalog, for tooling that finds them through service discovery
+type CatalogConfig struct {
+	// Kind is "consul" or "etcd". Instances aren't registered if it's empty.
+	Kind string `toml:"kind" required:"false"`
+	// URL is the address of the Consul agent, e.g. "http://localhost:8500", or
+	// of an etcd member, e.g. "http://localhost:2379"
+	URL string `toml:"url" required:"false"`
+	// Token, if set, is the Consul ACL token that instances are registered with
+	Token redact.Secret `toml:"token" required:"false"`
+	// ServiceName is the name that instances are registered under, which
+	// defaults to "draupnir-instance"
+	ServiceName string `toml:"service_name" required:"false"`
+	// Prefix is the prefix of the etcd keys that instances are stored under,
+	// which defaults to "/draupnir/services/"
+	Prefix string `toml:"prefix" required:"false"`
+	// Interval is how often the whole catalog is reconciled with the instances,
+	// e.g. "5m"
+	Interval string `toml:"interval" required:"false"`
+}
+
+// StaticInstancesConfig declares static instances: instances, with fixed names
+// and ports, of the latest ready image of a family, that the server maintains
+// and everyone shares
+type StaticInstancesConfig struct {
+	// Interval is how often the static instances are brought in line with their
+	// declarations, e.g. "1m"
+	Interval  string           `toml:"interval" required:"false"`
+	Instances []StaticInstance `toml:"instance" required:"false"`
+}
+
+// StaticInstance declares a static instance of the latest ready image of the
+// family. Its port must be outside the range that other instances' ports are
+// chosen from.
+type StaticInstance struct {
+	Name   string `toml:"name"`
+	Family string `toml:"family"`
+	Port   uint16 `toml:"port"`
+}
+
+// Webhook is an HTTP endpoint, such as a Slack incoming webhook, that's sent a
+// POST request for each of the events that it subscribes to
+type Webhook struct {
+	Name string `toml:"name"`
+	URL  string `toml:"url"`
+	// Secret, if set, is the key with which the body of each request is signed,
+	// in the Draupnir-Signature header
+	Secret redact.Secret `toml:"secret" required:"false"`
+	// Events are the events that the webhook subscribes to, of image.ready,
+	// image.failed, instance.created and instance.destroyed. It subscribes to
+	// all of them if it's empty.
+	Events []string `toml:"events" required:"false"`
+	// Format is "jsonapi", the default, or "slack"
+	Format string `toml:"format" required:"false"`
+	// MaxAttempts is how many times each event is sent before it's given up
+	// on, which defaults to 5
+	MaxAttempts int `toml:"max_attempts" required:"false"`
+}
+
+// FaultInjectionConfig enables the injection of faults through the admin API,
+// for resilience testing. It must never be enabled in production.
+type FaultInjectionConfig struct {
+	Enabled bool `toml:"enabled" required:"false"`
+}
+
+// ImageQuotaConfig limits the images that each uploader can create, so that a
+// misconfigured backup pipeline can't fill the pool with half-uploaded images
+type ImageQuotaConfig struct {
+	// MaxInProgress is the number of images that aren't ready yet that each
+	// uploader can have. It's unlimited if zero.
+	MaxInProgress int `toml:"max_in_progress" required:"false"`
+	// Cooldown is how long, e.g. "10m", each uploader must wait between creating
+	// images
+	Cooldown string `toml:"cooldown" required:"false"`
+}
+
+// InstanceQuotaConfig limits the instances that can exist, so that one user
+// can't exhaust the host's disk and memory with clones
+type InstanceQuotaConfig struct {
+	// MaxPerUser is the number of instances that each user can have. It's
+	// unlimited if zero.
+	MaxPerUser int `toml:"max_per_user" required:"false"`
+	// MaxTotal is the number of instances that can exist across all users. It's
+	// unlimited if zero.
+	MaxTotal int `toml:"max_total" required:"false"`
+	// Overrides replace MaxPerUser for the users that they name, e.g. to let a
+	// team's CI service account run more instances, or zero for no limit
+	Overrides map[string]int `toml:"overrides" required:"false"`
+}
+
+// RedactionConfig adds to what's redacted from logs, errors, audit records and
+// webhooks. Credentials, tokens and connection strings are always redacted,
+// along with the secrets in this config.
+type RedactionConfig struct {
+	// Patterns are regular expressions, each of whose matches is redacted in
+	// full, e.g. "sk_live_[A-Za-z0-9]+"
+	Patterns []string `toml:"patterns" required:"false"`
 }
 
 // Config holds all Draupnir configuration
 type Config struct {
-	DatabaseURL            string      `toml:"database_url"`
-	DataPath               string      `toml:"data_path"`
-	Environment            string      `toml:"environment"`
-	SharedSecret           string      `toml:"shared_secret"`
-	TrustedUserEmailDomain string      `toml:"trusted_user_email_domain"`
-	PublicHostname         string      `toml:"public_hostname"`
-	SentryDsn              string      `toml:"sentry_dsn" required:"false"`
-	MinInstancePort        uint16      `toml:"min_instance_port"`
-	MaxInstancePort        uint16      `toml:"max_instance_port"`
-	HTTPConfig             HTTPConfig  `toml:"http"`
-	OAuthConfig            OAuthConfig `toml:"oauth"`
-	CleanInterval          string      `toml:"clean_interval"`
-	EnableWhitelisting     bool        `toml:"enable_ip_whitelisting" required:"false"`
-	WhitelisterInterval    string      `toml:"whitelist_reconcile_interval"`
-	TrustedProxyCIDRs      []string    `toml:"trusted_proxy_cidrs" required:"false"`
-	UseXForwardedFor       bool        `toml:"use_x_forwarded_for" required:"false"`
+	DatabaseURL            redact.Secret `toml:"database_url"`
+	DataPath               string        `toml:"data_path"`
+	Environment            string        `toml:"environment"`
+	SharedSecret           redact.Secret `toml:"shared_secret"`
+	TrustedUserEmailDomain string        `toml:"trusted_user_email_domain"`
+	PublicHostname         string        `toml:"public_hostname"`
+	SentryDsn              redact.Secret `toml:"sentry_dsn" required:"false"`
+	MinInstancePort        uint16        `toml:"min_instance_port"`
+	MaxInstancePort        uint16        `toml:"max_instance_port"`
+	HTTPConfig             HTTPConfig    `toml:"http"`
+	OAuthConfig            OAuthConfig   `toml:"oauth"`
+	CleanInterval          string        `toml:"clean_interval"`
+	EnableWhitelisting     bool          `toml:"enable_ip_whitelisting" required:"false"`
+	WhitelisterInterval    string        `toml:"whitelist_reconcile_interval"`
+	TrustedProxyCIDRs      []string      `toml:"trusted_proxy_cidrs" required:"false"`
+	UseXForwardedFor       bool          `toml:"use_x_forwarded_for" required:"false"`
+	// BasePath is the path under which the API is served, for deployments that
+	// share a domain with other services (e.g. /draupnir). Empty means the API is
+	// served from the root.
+	BasePath string `toml:"base_path" required:"false"`
+	// StandbyRestoreCommand is the PostgreSQL restore_command that standby
+	// instances use to fetch WAL from the source database's archive, e.g.
+	// "cp /wal_archive/%f %p". Standby instances are disabled if it's empty.
+	StandbyRestoreCommand string `toml:"standby_restore_command" required:"false"`
+	// OTLPTracesEndpoint is the URL of an OpenTelemetry collector's OTLP/HTTP
+	// traces endpoint, e.g. "http://localhost:4318/v1/traces". If it's set, the
+	// phases of each image's bake are exported to it as spans.
+	OTLPTracesEndpoint string `toml:"otlp_traces_endpoint" required:"false"`
+	// ManifestSigningKeyPath is the path to a PEM-encoded Ed25519 private key.
+	// If it's set, a manifest is signed with it for each image as the image is
+	// finalised, naming ManifestSigner as the signer.
+	ManifestSigningKeyPath string `toml:"manifest_signing_key_path" required:"false"`
+	ManifestSigner         string `toml:"manifest_signer" required:"false"`
+	// InstanceAddressPool is a CIDR, e.g. "10.0.100.0/24", from which each
+	// instance is given its own IP address, added as an alias on
+	// InstanceAddressInterface, so that it can listen on the standard port.
+	// Instances are given their own port instead if it's empty.
+	InstanceAddressPool      string `toml:"instance_address_pool" required:"false"`
+	InstanceAddressInterface string `toml:"instance_address_interface" required:"false"`
+	// InstanceTTL, if set, is how long, e.g. "24h", instances last before
+	// they're destroyed, unless they're extended. Instances never expire if it's
+	// empty.
+	InstanceTTL string `toml:"instance_ttl" required:"false"`
+	// SchemaOnlyKeepTables names the tables, in any schema, whose rows are kept
+	// in schema-only instances, such as the table of applied migrations, e.g.
+	// ["schema_migrations"]. Every other table is truncated.
+	SchemaOnlyKeepTables []string `toml:"schema_only_keep_tables" required:"false"`
+	// LeaseTTL is how long, e.g. "1m", a server's reservation of a port or
+	// address for an instance that it's creating lasts if the server dies
+	LeaseTTL string `toml:"lease_ttl" required:"false"`
+	// MetricsInterval is how often, e.g. "1m", the gauges of instance counts and
+	// disk usage exported at /metrics are updated
+	MetricsInterval string `toml:"metrics_interval" required:"false"`
+	// OperationWorkers is how many operations, started by requests with Prefer:
+	// respond-async, run at once. Defaults to 4.
+	OperationWorkers int `toml:"operation_workers" required:"false"`
+	// MigrationsPath is the directory of the migrations that the server was
+	// deployed with. GET /admin/schema reports those that haven't been applied
+	// to the database if it's set.
+	MigrationsPath string `toml:"migrations_path" required:"false"`
+	// ReclaimConfig configures reclamation of space when the pool is almost full
+	ReclaimConfig ReclaimConfig `toml:"reclaim" required:"false"`
+	// GuardrailConfig configures scanning of images for references to production
+	GuardrailConfig GuardrailConfig `toml:"guardrail" required:"false"`
+	// FreshnessConfig configures the freshness SLAs of image families
+	FreshnessConfig FreshnessConfig `toml:"freshness" required:"false"`
+	// AnonAuditConfig configures the audit of images against the current
+	// anonymisation spec of their family
+	AnonAuditConfig AnonAuditConfig `toml:"anon_audit" required:"false"`
+	// SyntheticDataConfig configures the padding of tables with synthetic rows
+	SyntheticDataConfig SyntheticDataConfig `toml:"synthetic_data" required:"false"`
+	// CanaryConfig configures the canaries that test each image once it's ready
+	CanaryConfig CanaryConfig `toml:"canary" required:"false"`
+	// CatalogConfig configures the registration of instances in a service
+	// catalog
+	CatalogConfig CatalogConfig `toml:"catalog" required:"false"`
+	// ImageQuotaConfig limits the images that each uploader can create
+	ImageQuotaConfig ImageQuotaConfig `toml:"image_quota" required:"false"`
+	// InstanceQuotaConfig limits the instances that users can create
+	InstanceQuotaConfig InstanceQuotaConfig `toml:"instance_quota" required:"false"`
+	// RedactionConfig adds to what's redacted from the server's output
+	RedactionConfig RedactionConfig `toml:"redaction" required:"false"`
+	// StaticInstancesConfig declares the static instances that the server
+	// maintains
+	StaticInstancesConfig StaticInstancesConfig `toml:"static_instances" required:"false"`
+	// FaultInjectionConfig enables the injection of faults
+	FaultInjectionConfig FaultInjectionConfig `toml:"fault_injection" required:"false"`
+	// Federation lists the servers, usually including this one, that share this
+	// server's OAuth client, and so accept the same credentials. Clients
+	// discover them from GET /federation.
+	Federation []FederatedServer `toml:"federation" required:"false"`
+	// ServiceAccounts can authenticate with a key file rather than through
+	// OAuth, for CI jobs that run unattended
+	ServiceAccounts []ServiceAccount `toml:"service_accounts" required:"false"`
+	// TokenExchangeConfig configures the exchange of cloud workload identities
+	// for short-lived service account credentials
+	TokenExchangeConfig TokenExchangeConfig `toml:"token_exchange" required:"false"`
+	// RegulatedFamilies lists the image families whose instances can only be
+	// connected to through the server's proxy, which records each session
+	RegulatedFamilies []RegulatedFamily `toml:"regulated_families" required:"false"`
+	// Webhooks are sent events about images and instances
+	Webhooks []Webhook `toml:"webhooks" required:"false"`
+}
+
+// RegulatedFamily is the access policy of an image family holding regulated
+// data, such as cardholder data
+type RegulatedFamily struct {
+	Family string `toml:"family"`
+	// MaxSessionDuration, if set, ends sessions that last longer than it, e.g.
+	// "4h"
+	MaxSessionDuration string `toml:"max_session_duration" required:"false"`
+	// Approvers, if set, restrict the family, so that its instances can only
+	// be created by users whose access requests one of them has approved
+	Approvers []string `toml:"approvers" required:"false"`
+}
+
+// ServiceAccount is a client, such as a CI job, that authenticates with a key
+// generated by `draupnir service-accounts create-key`
+type ServiceAccount struct {
+	Name string `toml:"name"`
+	// KeySHA256 is the hex encoded SHA-256 hash of the account's key
+	KeySHA256 string `toml:"key_sha256"`
+}
+
+// TokenExchangeConfig configures POST /access_tokens/exchange, through which
+// jobs running in AWS or GCP authenticate as service accounts with their cloud
+// identities, rather than with keys
+type TokenExchangeConfig struct {
+	// TTL is how long exchanged tokens last, e.g. "1h". Defaults to 1h.
+	TTL string `toml:"ttl" required:"false"`
+	// AWSAudience, if set, must be the value of the signed Draupnir-Server-ID
+	// header of AWS identity requests
+	AWSAudience string `toml:"aws_audience" required:"false"`
+	// GCPAudience is the audience that GCP ID tokens must be issued for. GCP
+	// identities can't be exchanged unless it's set.
+	GCPAudience string              `toml:"gcp_audience" required:"false"`
+	Identities  []ExchangedIdentity `toml:"identities" required:"false"`
+}
+
+// ExchangedIdentity maps a cloud identity to the service account that it's
+// exchanged for
+type ExchangedIdentity struct {
+	// Provider is "aws" or "gcp"
+	Provider string `toml:"provider"`
+	// Principal is an IAM role's or user's ARN, or a GCP service account's
+	// email address
+	Principal      string `toml:"principal"`
+	ServiceAccount string `toml:"service_account"`
+}
+
+// FederatedServer is a draupnir server that accepts the same credentials as
+// this one
+type FederatedServer struct {
+	Name   string `toml:"name"`
+	Domain string `toml:"domain"`
 }
 
 // Load parses and validates the server config file located at `path`
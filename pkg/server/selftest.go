@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"os/signal"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/selftest"
+	"github.com/gocardless/draupnir/pkg/server/config"
+)
+
+// SelftestOptions configure the self-test
+type SelftestOptions struct {
+	Images      int
+	Instances   int
+	Concurrency int
+	Rows        int
+	// Dataset is the path of a tarball of a data directory to upload. An empty
+	// cluster is created with initdb if it's empty.
+	Dataset string
+}
+
+// RunSelftest runs the self-test against the storage and database that the
+// server is configured with, printing its report. It runs alongside the server,
+// rather than within it, and stops early if it's interrupted.
+func RunSelftest(logger log.Logger, opts SelftestOptions) error {
+	logger.With("config", ConfigFilePath).Info("Loading config file")
+	cfg, err := config.Load(ConfigFilePath)
+	if err != nil {
+		return errors.Wrap(err, "Could not load configuration")
+	}
+
+	redaction, err := createRedactionPolicy(cfg)
+	if err != nil {
+		return errors.Wrap(err, "invalid redaction configuration")
+	}
+
+	logger = redaction.Logger(log.With("environment", cfg.Environment).With("component", "selftest"))
+
+	db, err := sql.Open("postgres", cfg.DatabaseURL.Reveal())
+	if err != nil {
+		return errors.Wrap(err, "Could not connect to database")
+	}
+
+	leases, err := createLedger(cfg, logger, db)
+	if err != nil {
+		return err
+	}
+
+	dataset := selftest.InitdbDataset(selftest.DefaultInitdb)
+	if opts.Dataset != "" {
+		dataset = selftest.FileDataset(opts.Dataset)
+	}
+
+	// The self-test measures the server itself, so its images aren't padded with
+	// synthetic rows
+	runner := selftest.Runner{
+		Logger:          logger,
+		ImageStore:      createImageStore(db),
+		InstanceStore:   createInstanceStore(db, cfg),
+		JobStore:        createJobStore(db),
+		Executor:        createExecutor(cfg, nil, redaction),
+		Ledger:          leases,
+		MinInstancePort: cfg.MinInstancePort,
+		MaxInstancePort: cfg.MaxInstancePort,
+		Dataset:         dataset,
+		Images:          opts.Images,
+		Instances:       opts.Instances,
+		Concurrency:     opts.Concurrency,
+		Rows:            opts.Rows,
+	}
+
+	// Stop creating things once interrupted, but still destroy what's been
+	// created
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		select {
+		case <-interrupts:
+			logger.Warn("Interrupted, cleaning up")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	report, runErr := runner.Run(ctx)
+	if err := report.Write(os.Stdout); err != nil {
+		return err
+	}
+	return errors.Wrap(runErr, "self-test failed")
+}
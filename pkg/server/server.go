@@ -2,23 +2,49 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
 	raven "github.com/getsentry/raven-go"
+	"github.com/gocardless/draupnir/pkg/anonaudit"
+	"github.com/gocardless/draupnir/pkg/audit"
+	"github.com/gocardless/draupnir/pkg/canary"
+	"github.com/gocardless/draupnir/pkg/catalog"
+	"github.com/gocardless/draupnir/pkg/events"
 	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/faults"
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/guardrail"
+	"github.com/gocardless/draupnir/pkg/jobs"
+	"github.com/gocardless/draupnir/pkg/ledger"
+	"github.com/gocardless/draupnir/pkg/manifest"
+	"github.com/gocardless/draupnir/pkg/metrics"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/reclaim"
+	"github.com/gocardless/draupnir/pkg/redact"
 	"github.com/gocardless/draupnir/pkg/server/api/auth"
 	"github.com/gocardless/draupnir/pkg/server/api/chain"
 	"github.com/gocardless/draupnir/pkg/server/api/middleware"
 	"github.com/gocardless/draupnir/pkg/server/api/routes"
 	"github.com/gocardless/draupnir/pkg/server/config"
+	"github.com/gocardless/draupnir/pkg/static"
 	"github.com/gocardless/draupnir/pkg/store"
+	"github.com/gocardless/draupnir/pkg/synthetic"
+	"github.com/gocardless/draupnir/pkg/tracing"
 	"github.com/gocardless/draupnir/pkg/version"
+	"github.com/gocardless/draupnir/pkg/webhooks"
 	"github.com/gorilla/mux"
 	rungroup "github.com/oklog/run"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
 	"golang.org/x/oauth2"
 )
@@ -40,23 +66,76 @@ func Run(logger log.Logger) error {
 		return errors.Wrap(err, "failed to parse trusted proxes")
 	}
 
+	basePath, err := normaliseBasePath(cfg.BasePath, cfg.OAuthConfig.RedirectURL)
+	if err != nil {
+		return errors.Wrap(err, "invalid base path")
+	}
+
+	verificationURL, err := deviceVerificationURL(cfg.OAuthConfig.RedirectURL)
+	if err != nil {
+		return errors.Wrap(err, "invalid oauth redirect url")
+	}
+
 	logger.Info("Configuration successfully loaded")
 
-	logger = log.With("environment", cfg.Environment)
+	redaction, err := createRedactionPolicy(cfg)
+	if err != nil {
+		return errors.Wrap(err, "invalid redaction configuration")
+	}
+
+	// Logs are forwarded to systems that mustn't see credentials, such as those
+	// in the output of the executor's scripts, so they're redacted before
+	// they're written
+	logger = redaction.Logger(log.With("environment", cfg.Environment))
 
 	oauthConfig := createOauthConfig(cfg.OAuthConfig)
-	authenticator := createAuthenticator(cfg, oauthConfig)
-	executor := createExecutor(cfg)
+	serviceAccounts, err := createServiceAccounts(cfg.ServiceAccounts)
+	if err != nil {
+		return err
+	}
+	tokenExchange, err := createTokenExchange(cfg.TokenExchangeConfig, cfg.SharedSecret.Reveal())
+	if err != nil {
+		return errors.Wrap(err, "invalid token exchange configuration")
+	}
+	authenticator := createAuthenticator(cfg, oauthConfig, serviceAccounts, tokenExchange)
+	syntheticHook, err := createSyntheticHook(cfg.SyntheticDataConfig)
+	if err != nil {
+		return errors.Wrap(err, "invalid synthetic data configuration")
+	}
+	executor := createExecutor(cfg, syntheticHook, redaction)
+
+	// Faults are injected into the executor's operations, and into requests by
+	// the middleware below
+	var faultInjector *faults.Injector
+	if cfg.FaultInjectionConfig.Enabled {
+		logger.Warn("Fault injection is enabled")
+		faultInjector = faults.NewInjector()
+		executor = faults.Executor{Executor: executor, Injector: faultInjector}
+	}
+
+	// Injected latency counts towards the executor's time in Server-Timing
+	executor = exec.TimedExecutor{Executor: executor}
 
-	db, err := sql.Open("postgres", cfg.DatabaseURL)
+	db, err := sql.Open("postgres", cfg.DatabaseURL.Reveal())
 	if err != nil {
 		return errors.Wrap(err, "Could not connect to database")
 	}
 	imageStore := createImageStore(db)
 	instanceStore := createInstanceStore(db, cfg)
 	whitelistedAddressStore := createWhitelistedAddressStore(db)
+	bakeSpanStore := createBakeSpanStore(db)
+	jobStore := createJobStore(db)
+	imageManifestStore := createImageManifestStore(db)
+	proxySessionStore := createProxySessionStore(db)
+	cleanupTokenStore := createCleanupTokenStore(db)
+	instanceGroupStore := createInstanceGroupStore(db)
+	breakGlassGrantStore := createBreakGlassGrantStore(db)
+	accessRequestStore := createAccessRequestStore(db)
+	webhookDeliveryStore := createWebhookDeliveryStore(db)
+	schemaStore := createSchemaStore(db)
+	eventBroker := events.NewBroker()
 
-	sentryClient, err := raven.New(cfg.SentryDsn)
+	sentryClient, err := raven.New(cfg.SentryDsn.Reveal())
 	if err != nil {
 		return errors.Wrap(err, "Could not initialise sentry-raven client")
 	}
@@ -76,10 +155,101 @@ func Run(logger log.Logger) error {
 		}
 	}
 
+	standbyEnabled := cfg.StandbyRestoreCommand != ""
+
+	scanner := guardrail.Scanner{
+		Mode:            cfg.GuardrailConfig.Mode,
+		ProductionHosts: cfg.GuardrailConfig.ProductionHosts,
+	}
+	if err := scanner.Validate(); err != nil {
+		return errors.Wrap(err, "invalid guardrail configuration")
+	}
+
+	imageQuota, err := createImageQuota(cfg.ImageQuotaConfig)
+	if err != nil {
+		return err
+	}
+
+	operationWorkers := jobs.DefaultWorkers
+	if cfg.OperationWorkers > 0 {
+		operationWorkers = cfg.OperationWorkers
+	}
+	workers := jobs.NewWorkers(logger.With("component", "operations"), jobStore, operationWorkers, jobs.DefaultQueueSize)
+
 	imageRouteSet := routes.Images{
-		ImageStore:    imageStore,
-		InstanceStore: instanceStore,
-		Executor:      executor,
+		ImageStore:     imageStore,
+		InstanceStore:  instanceStore,
+		Executor:       executor,
+		StandbyEnabled: standbyEnabled,
+		BakeSpanStore:  bakeSpanStore,
+		JobStore:       jobStore,
+		Workers:        workers,
+		Events:         eventBroker,
+		ManifestStore:  imageManifestStore,
+		Guardrail:      scanner,
+		Canary:         cfg.CanaryConfig.TestCommand != "",
+		Quota:          imageQuota,
+	}
+
+	if cfg.OTLPTracesEndpoint != "" {
+		imageRouteSet.SpanExporter = tracing.NewOTLPExporter(cfg.OTLPTracesEndpoint)
+	}
+
+	if cfg.ManifestSigningKeyPath != "" {
+		if cfg.ManifestSigner == "" {
+			return errors.New("manifest_signer must be set when manifest_signing_key_path is")
+		}
+
+		imageRouteSet.ManifestSigner, err = manifest.LoadSigner(cfg.ManifestSigner, cfg.ManifestSigningKeyPath)
+		if err != nil {
+			return errors.Wrap(err, "Could not load manifest signing key")
+		}
+	}
+
+	var addressPool *net.IPNet
+	if cfg.InstanceAddressPool != "" {
+		if cfg.InstanceAddressInterface == "" {
+			return errors.New("instance_address_interface must be set when instance_address_pool is")
+		}
+
+		_, addressPool, err = net.ParseCIDR(cfg.InstanceAddressPool)
+		if err != nil {
+			return errors.Wrap(err, "invalid instance address pool")
+		}
+	}
+
+	leases, err := createLedger(cfg, logger.With("component", "ledger"), db)
+	if err != nil {
+		return err
+	}
+
+	sessionPolicies, err := createSessionPolicies(cfg.RegulatedFamilies)
+	if err != nil {
+		return err
+	}
+
+	anonAuditor, anonAuditInterval, err := createAnonAuditor(cfg.AnonAuditConfig, logger.With("component", "anon_audit"), imageStore)
+	if err != nil {
+		return err
+	}
+
+	var instanceTTL time.Duration
+	if cfg.InstanceTTL != "" {
+		instanceTTL, err = time.ParseDuration(cfg.InstanceTTL)
+		if err != nil {
+			return errors.Wrap(err, "invalid instance TTL")
+		}
+	}
+
+	instanceQuota, err := createInstanceQuota(cfg.InstanceQuotaConfig)
+	if err != nil {
+		return err
+	}
+
+	accessRequests := audit.AccessRequests{
+		Logger: logger.With("component", "audit"),
+		Store:  accessRequestStore,
+		Events: eventBroker,
 	}
 
 	instanceRouteSet := routes.Instances{
@@ -90,24 +260,188 @@ func Run(logger log.Logger) error {
 		Executor:                executor,
 		MinInstancePort:         cfg.MinInstancePort,
 		MaxInstancePort:         cfg.MaxInstancePort,
+		StandbyEnabled:          standbyEnabled,
+		JobStore:                jobStore,
+		Workers:                 workers,
+		Events:                  eventBroker,
+		AddressPool:             addressPool,
+		Guardrail:               scanner,
+		AnonSpecs:               anonAuditor.Specs,
+		Ledger:                  leases,
+		Policies:                sessionPolicies,
+		TTL:                     instanceTTL,
+		CleanupTokenStore:       cleanupTokenStore,
+		InstanceGroupStore:      instanceGroupStore,
+		Quota:                   instanceQuota,
+		Access:                  accessRequests,
+		Audit: audit.Recorder{
+			Logger:    logger.With("component", "audit"),
+			Store:     proxySessionStore,
+			Redaction: redaction,
+		},
+	}
+
+	// The reclaimer is also used to preview retention policies, so is created
+	// even if reclamation is disabled
+	reclaimer, reclaimInterval, err := createReclaimer(cfg.ReclaimConfig, logger.With("component", "reclaimer"), imageStore, instanceStore, jobStore, executor, eventBroker)
+	if err != nil {
+		return err
+	}
+
+	retentionRouteSet := routes.Retention{Reclaimer: reclaimer}
+
+	breakGlassRouteSet := routes.BreakGlass{
+		ImageStore: imageStore,
+		Executor:   executor,
+		Audit: audit.BreakGlass{
+			Logger: logger.With("component", "audit"),
+			Store:  breakGlassGrantStore,
+		},
+	}
+
+	accessRequestRouteSet := routes.AccessRequests{
+		Policies: sessionPolicies,
+		Audit:    accessRequests,
+	}
+
+	runbookRouteSet := routes.Runbook{
+		Images:    imageRouteSet,
+		Instances: instanceRouteSet,
+		Audit:     audit.Runbook{Logger: logger.With("component", "audit")},
+	}
+
+	schemaRouteSet := routes.Schema{
+		SchemaStore:    schemaStore,
+		MigrationsPath: cfg.MigrationsPath,
+	}
+
+	freshnessMonitor, freshnessInterval, err := createFreshnessMonitor(cfg.FreshnessConfig, logger.With("component", "freshness"), imageStore)
+	if err != nil {
+		return err
+	}
+
+	canaryRunner, canaryInterval, err := createCanaryRunner(cfg, logger.With("component", "canary"), imageStore, instanceStore, jobStore, executor, leases, eventBroker)
+	if err != nil {
+		return err
+	}
+
+	registrar, catalogInterval, err := createRegistrar(cfg.CatalogConfig, logger.With("component", "catalog"), instanceStore, eventBroker)
+	if err != nil {
+		return err
+	}
+
+	staticReconciler, staticInterval, err := createStaticReconciler(cfg, logger.With("component", "static_instances"), imageStore, instanceStore, jobStore, executor, eventBroker, anonAuditor.Specs)
+	if err != nil {
+		return err
+	}
+
+	webhookDispatcher, err := createWebhookDispatcher(cfg.Webhooks, logger.With("component", "webhooks"), webhookDeliveryStore, eventBroker, redaction)
+	if err != nil {
+		return err
+	}
+
+	webhooksRouteSet := routes.Webhooks{DeliveryStore: webhookDeliveryStore}
+
+	freshnessRouteSet := routes.Freshness{ImageStore: imageStore, SLAs: freshnessMonitor.SLAs}
+
+	anonAuditRouteSet := routes.AnonAudit{ImageStore: imageStore, Specs: anonAuditor.Specs}
+
+	operationRouteSet := routes.Operations{JobStore: jobStore, BakeSpanStore: bakeSpanStore}
+
+	searchRouteSet := routes.Search{
+		SearchStore:   store.DBSearchStore{DB: db},
+		ImageStore:    imageStore,
+		InstanceStore: instanceStore,
+	}
+
+	federationRouteSet := routes.Federation{}
+	for _, server := range cfg.Federation {
+		federationRouteSet.Servers = append(federationRouteSet.Servers, models.FederatedServer{
+			Name:   server.Name,
+			Domain: server.Domain,
+		})
+	}
+
+	eventRouteSet := routes.Events{Broker: eventBroker}
+
+	userRouteSet := routes.Users{
+		ImageStore:    imageStore,
+		InstanceStore: instanceStore,
+		Quota:         imageQuota,
+		InstanceQuota: instanceQuota,
+	}
+
+	versionRouteSet := routes.Version{Features: []string{
+		models.FeatureResumableUploads,
+		models.FeatureBakeTimeline,
+		models.FeatureBakeErrorClasses,
+		models.FeatureImageManifests,
+		models.FeatureImageFiles,
+		models.FeatureConditionalRequests,
+		models.FeatureEvents,
+		models.FeatureFederation,
+		models.FeatureFreshness,
+		models.FeaturePlainJSON,
+		models.FeatureInstanceProxy,
+		models.FeatureInstanceExpiry,
+		models.FeatureImagePrune,
+		models.FeatureCleanupTokens,
+		models.FeatureInstanceGroups,
+		models.FeatureWhoami,
+		models.FeatureImageSend,
+		models.FeatureInstanceDiagnostics,
+		models.FeatureAnonAudit,
+		models.FeatureInstanceLogs,
+		models.FeatureDeviceAuthorization,
+		models.FeatureInstanceStatus,
+		models.FeaturePagination,
+		models.FeatureSorting,
+		models.FeatureBreakGlass,
+		models.FeatureLabels,
+		models.FeatureSchemaOnlyInstances,
+		models.FeatureSearch,
+		models.FeatureOperations,
+		models.FeatureStaticInstances,
+		models.FeatureDistributedImages,
+		models.FeatureWebhooks,
+		models.FeatureAccessRequests,
+		models.FeatureBtrfsStreamUpload,
+		models.FeatureRunbook,
+		models.FeatureOpenAPI,
+	}}
+	if standbyEnabled {
+		versionRouteSet.Features = append(versionRouteSet.Features, models.FeatureStandbyInstances)
+	}
+	if len(tokenExchange.Identities) > 0 {
+		versionRouteSet.Features = append(versionRouteSet.Features, models.FeatureTokenExchange)
 	}
 
 	accessTokenRouteSet := routes.AccessTokens{
-		Callbacks: make(map[string]chan routes.OAuthCallback),
-		Client:    &oauthConfig,
+		Callbacks:       routes.NewOAuthCallbacks(),
+		Client:          &oauthConfig,
+		Devices:         routes.NewDeviceAuthorizations(),
+		VerificationURL: verificationURL,
 	}
 
-	router := mux.NewRouter()
+	rootRouter := mux.NewRouter()
+
+	// All routes are registered relative to the base path, so that the API can
+	// be served from somewhere other than the root of the domain.
+	router := rootRouter
+	if basePath != "" {
+		router = rootRouter.PathPrefix(basePath).Subrouter()
+	}
 
-	// Every request will be logged, and any error raised in serving the request
-	// will also be logged.
+	// Every request will be logged and counted in metrics, and any error raised
+	// in serving the request will also be logged.
 	rootHandler := chain.
 		New(middleware.NewErrorHandler(logger)).
 		Add(middleware.RecordUserIPAddress(logger, trustedProxies, cfg.UseXForwardedFor)).
-		Add(middleware.NewRequestLogger(logger))
+		Add(middleware.NewRequestLogger(logger)).
+		Add(middleware.RecordMetrics)
 
 	rootHandler = rootHandler.
-		Add(middleware.NewSentryReporter(sentryClient))
+		Add(middleware.NewSentryReporter(sentryClient, redaction))
 
 	// Healthcheck
 	// We don't enforce a particular API version on this route, because it should
@@ -119,6 +453,35 @@ func Run(logger log.Logger) error {
 			Resolve(routes.HealthCheck),
 	)
 
+	// Version
+	// Clients negotiate the API version that they send from this, so it can't
+	// require one. Like the healthcheck, it doesn't require authentication.
+	router.Methods("GET").Path("/version").HandlerFunc(
+		rootHandler.
+			Add(middleware.DefaultErrorRenderer).
+			Add(middleware.WithVersion).
+			Add(middleware.AsJSON).
+			Resolve(versionRouteSet.Get),
+	)
+
+	// OpenAPI
+	// Like the version, this describes the API to tools that don't speak it yet,
+	// so it doesn't require an API version or authentication. It describes the
+	// routes registered on the router when it's requested, so every route.
+	openAPIRouteSet := routes.OpenAPI{Router: rootRouter, BasePath: basePath}
+	router.Methods("GET").Path("/openapi.json").HandlerFunc(
+		rootHandler.
+			Add(middleware.DefaultErrorRenderer).
+			Add(middleware.WithVersion).
+			Add(middleware.AsJSON).
+			Resolve(openAPIRouteSet.Get),
+	)
+
+	// Metrics
+	// Like the healthcheck, these are intended to be scraped by monitoring, so
+	// they don't require authentication or an API version.
+	router.Methods("GET").Path("/metrics").Handler(promhttp.Handler())
+
 	// OAuth
 	// These routes are a bit special, because they don't accept or return JSON.
 	// They're intended to be used through a web browser.
@@ -133,18 +496,56 @@ func Run(logger log.Logger) error {
 			Resolve(accessTokenRouteSet.Callback),
 	)
 
+	// Users of clients that can't open a browser enter their device's code here
+	router.Methods("GET").Path("/device").HandlerFunc(
+		rootHandler.
+			Add(routes.OauthErrorRenderer).
+			Resolve(accessTokenRouteSet.Device),
+	)
+
+	router.Methods("POST").Path("/device").HandlerFunc(
+		rootHandler.
+			Add(routes.OauthErrorRenderer).
+			Resolve(accessTokenRouteSet.ApproveDevice),
+	)
+
 	// Core API routes
 	// These routes all accept and return JSON, and will enforce that the client
 	// sends a compatible API version header.
 	defaultChain := rootHandler.
+		Add(middleware.RecordServerTiming).
 		Add(middleware.DefaultErrorRenderer).
 		Add(middleware.WithVersion).
 		Add(middleware.AsJSON).
 		Add(middleware.CheckAPIVersion(version.Version)).
 		Add(middleware.Authenticate(authenticator))
 
+	// Faults are managed through routes that they aren't injected into, so that
+	// they can always be removed
+	if faultInjector != nil {
+		faultRouteSet := routes.Faults{Injector: faultInjector}
+
+		router.Methods("GET").Path("/admin/faults").HandlerFunc(
+			defaultChain.Resolve(faultRouteSet.List),
+		)
+
+		router.Methods("POST").Path("/admin/faults").HandlerFunc(
+			defaultChain.Resolve(faultRouteSet.Create),
+		)
+
+		router.Methods("DELETE").Path("/admin/faults").HandlerFunc(
+			defaultChain.Resolve(faultRouteSet.Clear),
+		)
+
+		router.Methods("DELETE").Path("/admin/faults/{id}").HandlerFunc(
+			defaultChain.Resolve(faultRouteSet.Destroy),
+		)
+
+		defaultChain = defaultChain.Add(faults.Middleware(faultInjector, basePath))
+	}
+
 	// Access Tokens
-	// This route is hit before the user is authenticated, so we don't use the
+	// These routes are hit before the user is authenticated, so we don't use the
 	// Authenticate middleware
 	router.Methods("POST").Path("/access_tokens").HandlerFunc(
 		rootHandler.
@@ -155,6 +556,66 @@ func Run(logger log.Logger) error {
 			Resolve(accessTokenRouteSet.Create),
 	)
 
+	router.Methods("POST").Path("/access_tokens/device").HandlerFunc(
+		rootHandler.
+			Add(middleware.DefaultErrorRenderer).
+			Add(middleware.WithVersion).
+			Add(middleware.AsJSON).
+			Add(middleware.CheckAPIVersion(version.Version)).
+			Resolve(accessTokenRouteSet.CreateDeviceAuthorization),
+	)
+
+	router.Methods("POST").Path("/access_tokens/device/token").HandlerFunc(
+		rootHandler.
+			Add(middleware.DefaultErrorRenderer).
+			Add(middleware.WithVersion).
+			Add(middleware.AsJSON).
+			Add(middleware.CheckAPIVersion(version.Version)).
+			Resolve(accessTokenRouteSet.CreateDeviceToken),
+	)
+
+	router.Methods("POST").Path("/access_tokens/exchange").HandlerFunc(
+		rootHandler.
+			Add(middleware.DefaultErrorRenderer).
+			Add(middleware.WithVersion).
+			Add(middleware.AsJSON).
+			Add(middleware.CheckAPIVersion(version.Version)).
+			Resolve(tokenExchange.Exchange),
+	)
+
+	// Cleanup tokens are their own credentials, so using one doesn't use the
+	// Authenticate middleware
+	router.Methods("POST").Path("/cleanup_tokens/use").HandlerFunc(
+		rootHandler.
+			Add(middleware.DefaultErrorRenderer).
+			Add(middleware.WithVersion).
+			Add(middleware.AsJSON).
+			Add(middleware.CheckAPIVersion(version.Version)).
+			Resolve(instanceRouteSet.UseCleanupToken),
+	)
+
+	// Federation
+	// Clients discover the servers that accept their credentials before they've
+	// authenticated, so this route doesn't use the Authenticate middleware
+	router.Methods("GET").Path("/federation").HandlerFunc(
+		rootHandler.
+			Add(middleware.DefaultErrorRenderer).
+			Add(middleware.WithVersion).
+			Add(middleware.AsJSON).
+			Add(middleware.CheckAPIVersion(version.Version)).
+			Resolve(federationRouteSet.List),
+	)
+
+	// Events
+	// These stream server-sent events until the client disconnects
+	router.Methods("GET").Path("/events/images").HandlerFunc(
+		defaultChain.Resolve(eventRouteSet.Images),
+	)
+
+	router.Methods("GET").Path("/events/instances").HandlerFunc(
+		defaultChain.Resolve(eventRouteSet.Instances),
+	)
+
 	// Images
 	router.Methods("GET").Path("/images").HandlerFunc(
 		defaultChain.Resolve(imageRouteSet.List),
@@ -164,18 +625,88 @@ func Run(logger log.Logger) error {
 		defaultChain.Resolve(imageRouteSet.Create),
 	)
 
+	router.Methods("POST").Path("/images/prune").HandlerFunc(
+		defaultChain.Resolve(imageRouteSet.Prune),
+	)
+
 	router.Methods("GET").Path("/images/{id}").HandlerFunc(
 		defaultChain.Resolve(imageRouteSet.Get),
 	)
 
+	router.Methods("HEAD").Path("/images/{id}/upload").HandlerFunc(
+		defaultChain.Resolve(imageRouteSet.UploadOffset),
+	)
+
+	router.Methods("PATCH").Path("/images/{id}/upload").HandlerFunc(
+		defaultChain.Resolve(imageRouteSet.Upload),
+	)
+
+	router.Methods("PUT").Path("/images/{id}/btrfs_stream").HandlerFunc(
+		defaultChain.Resolve(imageRouteSet.ReceiveStream),
+	)
+
 	router.Methods("POST").Path("/images/{id}/done").HandlerFunc(
 		defaultChain.Resolve(imageRouteSet.Done),
 	)
 
+	router.Methods("PATCH").Path("/images/{id}").HandlerFunc(
+		defaultChain.Resolve(imageRouteSet.Annotate),
+	)
+
 	router.Methods("DELETE").Path("/images/{id}").HandlerFunc(
 		defaultChain.Resolve(imageRouteSet.Destroy),
 	)
 
+	router.Methods("GET").Path("/images/{id}/storage").HandlerFunc(
+		defaultChain.Resolve(imageRouteSet.Storage),
+	)
+
+	router.Methods("POST").Path("/images/{id}/verify").HandlerFunc(
+		defaultChain.Resolve(imageRouteSet.Verify),
+	)
+
+	router.Methods("GET").Path("/images/{id}/timeline").HandlerFunc(
+		defaultChain.Resolve(imageRouteSet.Timeline),
+	)
+
+	router.Methods("GET").Path("/images/{id}/manifest").HandlerFunc(
+		defaultChain.Resolve(imageRouteSet.Manifest),
+	)
+
+	router.Methods("GET").Path("/images/{id}/files/{path}").HandlerFunc(
+		defaultChain.Resolve(imageRouteSet.File),
+	)
+
+	router.Methods("GET").Path("/images/{id}/send").HandlerFunc(
+		defaultChain.Resolve(imageRouteSet.Send),
+	)
+
+	// Unlike the files of a snapshot, a file of an upload can be anywhere in it,
+	// so its path can contain slashes
+	router.Methods("GET").Path("/images/{id}/upload/files/{path:.+}").HandlerFunc(
+		defaultChain.Resolve(breakGlassRouteSet.UploadFile),
+	)
+
+	// Freshness
+	router.Methods("GET").Path("/freshness").HandlerFunc(
+		defaultChain.Resolve(freshnessRouteSet.List),
+	)
+
+	// Anonymisation audit
+	router.Methods("GET").Path("/anon_audit").HandlerFunc(
+		defaultChain.Resolve(anonAuditRouteSet.List),
+	)
+
+	// Operations
+	router.Methods("GET").Path("/operations/{id}").HandlerFunc(
+		defaultChain.Resolve(operationRouteSet.Get),
+	)
+
+	// Search
+	router.Methods("GET").Path("/search").HandlerFunc(
+		defaultChain.Resolve(searchRouteSet.List),
+	)
+
 	// Instances
 	router.Methods("GET").Path("/instances").HandlerFunc(
 		defaultChain.Resolve(instanceRouteSet.List),
@@ -185,10 +716,19 @@ func Run(logger log.Logger) error {
 		defaultChain.Resolve(instanceRouteSet.Create),
 	)
 
+	// This must be registered before /instances/{id}, which would match it
+	router.Methods("GET").Path("/instances/summary").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.Summary),
+	)
+
 	router.Methods("GET").Path("/instances/{id}").HandlerFunc(
 		defaultChain.Resolve(instanceRouteSet.Get),
 	)
 
+	router.Methods("PATCH").Path("/instances/{id}").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.Annotate),
+	)
+
 	router.Methods("DELETE").Path("/instances/{id}").HandlerFunc(
 		defaultChain.Resolve(instanceRouteSet.Destroy),
 	)
@@ -197,48 +737,194 @@ func Run(logger log.Logger) error {
 		defaultChain.Resolve(instanceRouteSet.Destroy),
 	)
 
-	var g rungroup.Group
+	router.Methods("GET").Path("/instances/{id}/storage").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.Storage),
+	)
 
-	if cfg.HTTPConfig.SecureListenAddress != "" {
-		// The default server for draupnir which will listen on TLS
-		server := http.Server{
-			Addr:    cfg.HTTPConfig.SecureListenAddress,
-			Handler: router,
-		}
+	router.Methods("GET").Path("/instances/{id}/diagnostics").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.Diagnostics),
+	)
 
-		g.Add(
-			func() error {
-				return server.ListenAndServeTLS(cfg.HTTPConfig.TLSCertificatePath, cfg.HTTPConfig.TLSPrivateKeyPath)
-			},
-			func(error) { server.Shutdown(context.Background()) },
-		)
-	}
+	router.Methods("GET").Path("/instances/{id}/logs").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.Logs),
+	)
 
-	if cfg.HTTPConfig.InsecureListenAddress != "" {
-		// If configured, then allow connections via a non-TLS port.
-		serverInsecure := http.Server{
-			Addr:    cfg.HTTPConfig.InsecureListenAddress,
-			Handler: router,
-		}
+	router.Methods("POST").Path("/instances/{id}/promote").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.Promote),
+	)
 
-		g.Add(
-			func() error { return serverInsecure.ListenAndServe() },
-			func(error) { serverInsecure.Shutdown(context.Background()) },
-		)
-	}
+	router.Methods("POST").Path("/instances/{id}/extend").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.Extend),
+	)
 
-	if cfg.HTTPConfig.SecureListenAddress == "" && cfg.HTTPConfig.InsecureListenAddress == "" {
-		return errors.New("Neither a secure or insecure listen was address specified")
-	}
+	router.Methods("POST").Path("/instances/{id}/exec").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.Exec),
+	)
 
-	{
-		// We clean out old instances that have invalid tokens periodically as access
-		// to the PostgreSQL instances only relies on certificate authentication. This
-		// means that is situations, such as a user being offboarded, they will lose
-		// access to the draupnir, but not their instances.
+	// This upgrades the connection to carry the Postgres protocol to the
+	// instance, for as long as the session lasts
+	router.Methods("GET").Path("/instances/{id}/proxy").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.Proxy),
+	)
+
+	// Cleanup tokens
+	router.Methods("POST").Path("/cleanup_tokens").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.CreateCleanupToken),
+	)
+
+	// Instance groups
+	router.Methods("GET").Path("/instance_groups").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.ListGroups),
+	)
+
+	router.Methods("POST").Path("/instance_groups").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.CreateGroup),
+	)
+
+	router.Methods("GET").Path("/instance_groups/{id}").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.GetGroup),
+	)
+
+	router.Methods("DELETE").Path("/instance_groups/{id}").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.DestroyGroup),
+	)
+
+	router.Methods("POST").Path("/instance_groups/{id}/extend").HandlerFunc(
+		defaultChain.Resolve(instanceRouteSet.ExtendGroup),
+	)
+
+	router.Methods("GET").Path("/whoami").HandlerFunc(
+		defaultChain.Resolve(userRouteSet.Whoami),
+	)
+
+	router.Methods("POST").Path("/admin/retention/preview").HandlerFunc(
+		defaultChain.Resolve(retentionRouteSet.Preview),
+	)
+
+	router.Methods("GET").Path("/admin/schema").HandlerFunc(
+		defaultChain.Resolve(schemaRouteSet.Get),
+	)
+
+	router.Methods("POST").Path("/admin/maintenance/vacuum").HandlerFunc(
+		defaultChain.Resolve(schemaRouteSet.Vacuum),
+	)
+
+	// Break-glass grants
+	router.Methods("GET").Path("/admin/break_glass_grants").HandlerFunc(
+		defaultChain.Resolve(breakGlassRouteSet.List),
+	)
+
+	router.Methods("POST").Path("/admin/break_glass_grants").HandlerFunc(
+		defaultChain.Resolve(breakGlassRouteSet.Create),
+	)
+
+	router.Methods("DELETE").Path("/admin/break_glass_grants/{id}").HandlerFunc(
+		defaultChain.Resolve(breakGlassRouteSet.Destroy),
+	)
+
+	// Runbook
+	router.Methods("POST").Path("/admin/runbook/instances/{id}/restart").HandlerFunc(
+		defaultChain.Resolve(runbookRouteSet.RestartInstance),
+	)
+
+	router.Methods("POST").Path("/admin/runbook/instances/{id}/rotate_credentials").HandlerFunc(
+		defaultChain.Resolve(runbookRouteSet.RotateInstanceCredentials),
+	)
+
+	router.Methods("POST").Path("/admin/runbook/operations/{id}/requeue").HandlerFunc(
+		defaultChain.Resolve(runbookRouteSet.RequeueOperation),
+	)
+
+	// Access requests
+	router.Methods("GET").Path("/access_requests").HandlerFunc(
+		defaultChain.Resolve(accessRequestRouteSet.List),
+	)
+
+	router.Methods("POST").Path("/access_requests").HandlerFunc(
+		defaultChain.Resolve(accessRequestRouteSet.Create),
+	)
+
+	router.Methods("GET").Path("/access_requests/{id}").HandlerFunc(
+		defaultChain.Resolve(accessRequestRouteSet.Get),
+	)
+
+	router.Methods("POST").Path("/access_requests/{id}/approve").HandlerFunc(
+		defaultChain.Resolve(accessRequestRouteSet.Approve),
+	)
+
+	router.Methods("POST").Path("/access_requests/{id}/deny").HandlerFunc(
+		defaultChain.Resolve(accessRequestRouteSet.Deny),
+	)
+
+	// Webhooks
+	router.Methods("GET").Path("/admin/webhooks/deliveries").HandlerFunc(
+		defaultChain.Resolve(webhooksRouteSet.ListDeliveries),
+	)
+
+	// Plain JSON
+	// Every route is also served beneath /v2 as plain JSON, rather than JSON:API,
+	// for scripts. Requests are handled by the routes above.
+	router.PathPrefix(middleware.PlainJSONPrefix + "/").Handler(
+		middleware.PlainJSON(basePath, rootRouter),
+	)
+
+	// Clean up after any finalisations or destroys that were interrupted by the
+	// previous server process dying. This must finish before we serve requests,
+	// so that we don't mistake new jobs for interrupted ones.
+	watchdog := jobs.Watchdog{
+		Logger:        logger.With("component", "watchdog"),
+		JobStore:      jobStore,
+		ImageStore:    imageStore,
+		InstanceStore: instanceStore,
+		BakeSpanStore: bakeSpanStore,
+		Executor:      executor,
+	}
+	if err := watchdog.Recover(context.Background()); err != nil {
+		return errors.Wrap(err, "failed to recover interrupted jobs")
+	}
+
+	var g rungroup.Group
+
+	if cfg.HTTPConfig.SecureListenAddress != "" {
+		// The default server for draupnir which will listen on TLS
+		server := http.Server{
+			Addr:    cfg.HTTPConfig.SecureListenAddress,
+			Handler: rootRouter,
+		}
+
+		g.Add(
+			func() error {
+				return server.ListenAndServeTLS(cfg.HTTPConfig.TLSCertificatePath, cfg.HTTPConfig.TLSPrivateKeyPath)
+			},
+			func(error) { server.Shutdown(context.Background()) },
+		)
+	}
+
+	if cfg.HTTPConfig.InsecureListenAddress != "" {
+		// If configured, then allow connections via a non-TLS port.
+		serverInsecure := http.Server{
+			Addr:    cfg.HTTPConfig.InsecureListenAddress,
+			Handler: rootRouter,
+		}
+
+		g.Add(
+			func() error { return serverInsecure.ListenAndServe() },
+			func(error) { serverInsecure.Shutdown(context.Background()) },
+		)
+	}
+
+	if cfg.HTTPConfig.SecureListenAddress == "" && cfg.HTTPConfig.InsecureListenAddress == "" {
+		return errors.New("Neither a secure or insecure listen was address specified")
+	}
+
+	{
+		// We clean out old instances that have invalid tokens periodically as access
+		// to the PostgreSQL instances only relies on certificate authentication. This
+		// means that is situations, such as a user being offboarded, they will lose
+		// access to the draupnir, but not their instances.
 		logger = logger.With("component", "cleaner")
 
-		instanceCleaner := NewInstanceCleaner(logger, sentryClient, instanceStore, executor, authenticator)
+		instanceCleaner := NewInstanceCleaner(logger, sentryClient, instanceStore, jobStore, eventBroker, executor, authenticator)
 		cleanInterval, err := time.ParseDuration(cfg.CleanInterval)
 		if err != nil {
 			return errors.Wrap(err, "invalid clean interval")
@@ -252,6 +938,33 @@ func Run(logger log.Logger) error {
 		)
 	}
 
+	{
+		// Clients start an OAuth flow by creating an access token, and normally
+		// finish it shortly after. Any flows that are left behind are periodically
+		// garbage collected.
+		callbacksCtx, callbacksCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error {
+				return accessTokenRouteSet.Callbacks.Start(callbacksCtx, logger.With("component", "oauth_callbacks"), time.Minute)
+			},
+			func(error) { callbacksCancel() },
+		)
+	}
+
+	{
+		// Device authorizations that the user never enters the code of are left
+		// behind once they expire, and are garbage collected like OAuth flows
+		devicesCtx, devicesCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error {
+				return accessTokenRouteSet.Devices.Start(devicesCtx, logger.With("component", "device_authorizations"), time.Minute)
+			},
+			func(error) { devicesCancel() },
+		)
+	}
+
 	if cfg.EnableWhitelisting {
 		whitelisterInterval, err := time.ParseDuration(cfg.WhitelisterInterval)
 		if err != nil {
@@ -266,6 +979,141 @@ func Run(logger log.Logger) error {
 		)
 	}
 
+	if cfg.ReclaimConfig.CriticalFreeSpace > 0 {
+		// Reclaim space by destroying the least valuable instances and images when
+		// the pool is almost full, rather than letting the host grind to a halt
+		reclaimerCtx, reclaimerCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return reclaimer.Start(reclaimerCtx, reclaimInterval) },
+			func(error) { reclaimerCancel() },
+		)
+	}
+
+	{
+		// Run the operations that requests started in the background. Those still
+		// queued when we stop are failed by the watchdog when we next start.
+		workersCtx, workersCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return workers.Start(workersCtx) },
+			func(error) { workersCancel() },
+		)
+	}
+
+	{
+		// Update the gauges of instance counts and disk usage, which aren't
+		// updated as requests are served
+		metricsInterval := metrics.DefaultInterval
+		if cfg.MetricsInterval != "" {
+			metricsInterval, err = time.ParseDuration(cfg.MetricsInterval)
+			if err != nil {
+				return errors.Wrap(err, "invalid metrics interval")
+			}
+		}
+
+		collector := metrics.Collector{
+			Logger:        logger.With("component", "metrics"),
+			ImageStore:    imageStore,
+			InstanceStore: instanceStore,
+			Executor:      executor,
+		}
+		metricsCtx, metricsCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return collector.Start(metricsCtx, metricsInterval) },
+			func(error) { metricsCancel() },
+		)
+	}
+
+	{
+		// Record break-glass grants as revoked once they expire. They stop giving
+		// access when they expire regardless, so this needn't run often.
+		breakGlassCtx, breakGlassCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return breakGlassRouteSet.Audit.Start(breakGlassCtx, time.Minute) },
+			func(error) { breakGlassCancel() },
+		)
+	}
+
+	{
+		// Renew the leases of instances that we're creating, and remove those
+		// of servers that died part way through creating one
+		ledgerCtx, ledgerCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return leases.Start(ledgerCtx) },
+			func(error) { ledgerCancel() },
+		)
+	}
+
+	if len(freshnessMonitor.SLAs) > 0 {
+		// Check that each image family has a recent enough image, so that we
+		// notice failed bakes before the developers using the images do
+		freshnessCtx, freshnessCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return freshnessMonitor.Start(freshnessCtx, freshnessInterval) },
+			func(error) { freshnessCancel() },
+		)
+	}
+
+	if len(anonAuditor.Specs) > 0 {
+		// Flag the images that weren't anonymised with their family's current
+		// spec, so that they don't keep serving under-masked data unnoticed
+		anonAuditCtx, anonAuditCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return anonAuditor.Start(anonAuditCtx, anonAuditInterval) },
+			func(error) { anonAuditCancel() },
+		)
+	}
+
+	if imageRouteSet.Canary {
+		// Test each image with a canary instance once it's ready, so that broken
+		// bakes are flagged before anyone clones them
+		canaryCtx, canaryCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return canaryRunner.Start(canaryCtx, canaryInterval) },
+			func(error) { canaryCancel() },
+		)
+	}
+
+	if len(staticReconciler.Declarations) > 0 {
+		// Keep each static instance on the latest ready image of its family, so
+		// that teams sharing one don't have to replace it themselves
+		staticCtx, staticCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return staticReconciler.Start(staticCtx, staticInterval) },
+			func(error) { staticCancel() },
+		)
+	}
+
+	if cfg.CatalogConfig.Kind != "" {
+		// Register instances in the service catalog, so that tooling built on
+		// service discovery can find them
+		catalogCtx, catalogCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return registrar.Start(catalogCtx, catalogInterval) },
+			func(error) { catalogCancel() },
+		)
+	}
+
+	if len(webhookDispatcher.Webhooks) > 0 {
+		// Send the configured webhooks the events they subscribe to, so that
+		// Slack channels and test pipelines hear about fresh images
+		webhooksCtx, webhooksCancel := context.WithCancel(context.Background())
+
+		g.Add(
+			func() error { return webhookDispatcher.Start(webhooksCtx) },
+			func(error) { webhooksCancel() },
+		)
+	}
+
 	if err := g.Run(); err != nil {
 		return errors.Wrap(err, "could not start HTTP servers")
 	}
@@ -275,7 +1123,7 @@ func Run(logger log.Logger) error {
 func createOauthConfig(c config.OAuthConfig) oauth2.Config {
 	return oauth2.Config{
 		ClientID:     c.ClientID,
-		ClientSecret: c.ClientSecret,
+		ClientSecret: c.ClientSecret.Reveal(),
 		Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email"},
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  "https://accounts.google.com/o/oauth2/v2/auth",
@@ -285,6 +1133,41 @@ func createOauthConfig(c config.OAuthConfig) oauth2.Config {
 	}
 }
 
+// normaliseBasePath returns the base path in the form /a/b, or an empty string
+// if the API is served from the root. The OAuth redirect URL must point at the
+// callback route beneath the base path, otherwise the OAuth flow can never
+// complete.
+func normaliseBasePath(basePath, redirectURL string) (string, error) {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return "", nil
+	}
+	basePath = "/" + basePath
+
+	redirect, err := url.Parse(redirectURL)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse oauth redirect url")
+	}
+	if !strings.HasPrefix(redirect.Path, basePath+"/") {
+		return "", fmt.Errorf("oauth redirect url %s is not beneath base path %s", redirectURL, basePath)
+	}
+
+	return basePath, nil
+}
+
+// deviceVerificationURL returns the URL of the page where users enter the codes
+// of device authorizations, which is served beside the OAuth callback
+func deviceVerificationURL(redirectURL string) (string, error) {
+	redirect, err := url.Parse(redirectURL)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse oauth redirect url")
+	}
+
+	redirect.Path = redirect.Path[:strings.LastIndex(redirect.Path, "/")+1] + "device"
+	redirect.RawQuery = ""
+	return redirect.String(), nil
+}
+
 func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
 	var trusted []*net.IPNet
 
@@ -300,11 +1183,13 @@ func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
 	return trusted, nil
 }
 
-func createAuthenticator(c config.Config, oauthConfig oauth2.Config) auth.Authenticator {
+func createAuthenticator(c config.Config, oauthConfig oauth2.Config, serviceAccounts map[string]string, tokenExchange routes.TokenExchange) auth.Authenticator {
 	authenticator := auth.GoogleAuthenticator{
 		OAuthClient:            auth.GoogleOAuthClient{Config: &oauthConfig},
-		SharedSecret:           c.SharedSecret,
+		SharedSecret:           c.SharedSecret.Reveal(),
 		TrustedUserEmailDomain: c.TrustedUserEmailDomain,
+		ServiceAccounts:        serviceAccounts,
+		ExchangedTokens:        tokenExchange.Tokens,
 	}
 	if c.Environment == "test" {
 		authenticator.OAuthClient = auth.IntegrationTestOAuthClient{}
@@ -312,6 +1197,120 @@ func createAuthenticator(c config.Config, oauthConfig oauth2.Config) auth.Authen
 	return authenticator
 }
 
+// createServiceAccounts maps the hash of each service account's key to its
+// name
+func createServiceAccounts(accounts []config.ServiceAccount) (map[string]string, error) {
+	hashes := map[string]string{}
+	names := map[string]bool{}
+
+	for _, account := range accounts {
+		if account.Name == "" {
+			return nil, errors.New("invalid service account: it has no name")
+		}
+		if names[account.Name] {
+			return nil, fmt.Errorf("invalid service account %s: it's configured more than once", account.Name)
+		}
+		names[account.Name] = true
+
+		hash := strings.ToLower(account.KeySHA256)
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("invalid service account %s: key_sha256 must be a hex encoded SHA-256 hash", account.Name)
+		}
+		if _, ok := hashes[hash]; ok {
+			return nil, fmt.Errorf("invalid service account %s: its key is shared with another account", account.Name)
+		}
+		hashes[hash] = account.Name
+	}
+
+	return hashes, nil
+}
+
+// createTokenExchange returns the route set that exchanges cloud identities
+// for service account tokens. Exchanged tokens aren't accepted, and every
+// exchange is rejected, if no identities are configured.
+func createTokenExchange(c config.TokenExchangeConfig, sharedSecret string) (routes.TokenExchange, error) {
+	exchange := routes.TokenExchange{
+		Verifiers: map[string]auth.IdentityVerifier{},
+		Identities: map[string]map[string]string{
+			models.IdentityProviderAWS: {},
+			models.IdentityProviderGCP: {},
+		},
+		TTL: time.Hour,
+	}
+
+	if len(c.Identities) == 0 {
+		return routes.TokenExchange{}, nil
+	}
+
+	if c.TTL != "" {
+		ttl, err := time.ParseDuration(c.TTL)
+		if err != nil || ttl <= 0 {
+			return exchange, fmt.Errorf("ttl must be a positive duration, e.g. 1h: %q", c.TTL)
+		}
+		exchange.TTL = ttl
+	}
+
+	for _, identity := range c.Identities {
+		principals, ok := exchange.Identities[identity.Provider]
+		if !ok {
+			return exchange, fmt.Errorf("unknown identity provider %q: it must be aws or gcp", identity.Provider)
+		}
+		if identity.Principal == "" || identity.ServiceAccount == "" {
+			return exchange, errors.New("identities must have a principal and a service_account")
+		}
+		if _, ok := principals[identity.Principal]; ok {
+			return exchange, fmt.Errorf("identity %s is configured more than once", identity.Principal)
+		}
+		if identity.Provider == models.IdentityProviderGCP && c.GCPAudience == "" {
+			return exchange, errors.New("gcp_audience must be set to exchange GCP identities")
+		}
+		principals[identity.Principal] = identity.ServiceAccount
+	}
+
+	client := &http.Client{Timeout: routes.TOKEN_EXCHANGE_TIMEOUT}
+	if len(exchange.Identities[models.IdentityProviderAWS]) > 0 {
+		exchange.Verifiers[models.IdentityProviderAWS] = auth.AWSVerifier{Audience: c.AWSAudience, Client: client}
+	}
+	if len(exchange.Identities[models.IdentityProviderGCP]) > 0 {
+		exchange.Verifiers[models.IdentityProviderGCP] = auth.GCPVerifier{Audience: c.GCPAudience, Client: client}
+	}
+	exchange.Tokens = auth.NewExchangedTokens(sharedSecret)
+
+	return exchange, nil
+}
+
+// createSessionPolicies returns the policies of the regulated image families
+func createSessionPolicies(families []config.RegulatedFamily) (audit.Policies, error) {
+	policies := audit.Policies{}
+
+	for _, family := range families {
+		if family.Family == "" {
+			return nil, errors.New("regulated families must have a family")
+		}
+		if _, ok := policies[family.Family]; ok {
+			return nil, fmt.Errorf("duplicate policy for regulated family %s", family.Family)
+		}
+
+		policy := audit.Policy{Family: family.Family}
+		if family.MaxSessionDuration != "" {
+			duration, err := time.ParseDuration(family.MaxSessionDuration)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid max session duration for regulated family %s", family.Family)
+			}
+			policy.MaxSessionDuration = duration
+		}
+		for _, approver := range family.Approvers {
+			if approver == "" {
+				return nil, fmt.Errorf("empty approver for regulated family %s", family.Family)
+			}
+		}
+		policy.Approvers = family.Approvers
+		policies[family.Family] = policy
+	}
+
+	return policies, nil
+}
+
 func createImageStore(db *sql.DB) store.ImageStore {
 	return store.DBImageStore{DB: db}
 }
@@ -324,6 +1323,497 @@ func createWhitelistedAddressStore(db *sql.DB) store.WhitelistedAddressStore {
 	return store.DBWhitelistedAddressStore{DB: db}
 }
 
-func createExecutor(c config.Config) exec.Executor {
-	return exec.OSExecutor{DataPath: c.DataPath}
+func createBakeSpanStore(db *sql.DB) store.BakeSpanStore {
+	return store.DBBakeSpanStore{DB: db}
+}
+
+func createJobStore(db *sql.DB) store.JobStore {
+	return store.DBJobStore{DB: db}
+}
+
+func createImageManifestStore(db *sql.DB) store.ImageManifestStore {
+	return store.DBImageManifestStore{DB: db}
+}
+
+func createProxySessionStore(db *sql.DB) store.ProxySessionStore {
+	return store.DBProxySessionStore{DB: db}
+}
+
+func createCleanupTokenStore(db *sql.DB) store.CleanupTokenStore {
+	return store.DBCleanupTokenStore{DB: db}
+}
+
+func createBreakGlassGrantStore(db *sql.DB) store.BreakGlassGrantStore {
+	return store.DBBreakGlassGrantStore{DB: db}
+}
+
+func createAccessRequestStore(db *sql.DB) store.AccessRequestStore {
+	return store.DBAccessRequestStore{DB: db}
+}
+
+func createWebhookDeliveryStore(db *sql.DB) store.WebhookDeliveryStore {
+	return store.DBWebhookDeliveryStore{DB: db}
+}
+
+func createInstanceGroupStore(db *sql.DB) store.InstanceGroupStore {
+	return store.DBInstanceGroupStore{DB: db}
+}
+
+func createSchemaStore(db *sql.DB) store.SchemaStore {
+	return store.DBSchemaStore{DB: db}
+}
+
+func createReclaimer(c config.ReclaimConfig, logger log.Logger, imageStore store.ImageStore, instanceStore store.InstanceStore, jobStore store.JobStore, executor exec.Executor, eventBroker *events.Broker) (reclaim.Reclaimer, time.Duration, error) {
+	interval := time.Minute
+	if c.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(c.Interval)
+		if err != nil {
+			return reclaim.Reclaimer{}, 0, errors.Wrap(err, "invalid reclaim interval")
+		}
+	}
+
+	var maxAge time.Duration
+	if c.InstanceMaxAge != "" {
+		var err error
+		maxAge, err = time.ParseDuration(c.InstanceMaxAge)
+		if err != nil {
+			return reclaim.Reclaimer{}, 0, errors.Wrap(err, "invalid reclaim instance max age")
+		}
+	}
+
+	reclaimer := reclaim.Reclaimer{
+		Logger: logger,
+		Policy: reclaim.Policy{
+			CriticalFreeSpace: c.CriticalFreeSpace,
+			TargetFreeSpace:   c.TargetFreeSpace,
+			CIUsers:           c.CIUsers,
+			InstanceMaxAge:    maxAge,
+		},
+		ImageStore:    imageStore,
+		InstanceStore: instanceStore,
+		JobStore:      jobStore,
+		Executor:      executor,
+		Events:        eventBroker,
+	}
+	if c.NotifyCommand != "" {
+		reclaimer.Notify = reclaim.CommandNotifier(c.NotifyCommand)
+	}
+
+	return reclaimer, interval, nil
+}
+
+func createImageQuota(c config.ImageQuotaConfig) (routes.ImageQuota, error) {
+	if c.MaxInProgress < 0 {
+		return routes.ImageQuota{}, errors.New("image quota max_in_progress must not be negative")
+	}
+
+	var cooldown time.Duration
+	if c.Cooldown != "" {
+		var err error
+		cooldown, err = time.ParseDuration(c.Cooldown)
+		if err != nil {
+			return routes.ImageQuota{}, errors.Wrap(err, "invalid image quota cooldown")
+		}
+	}
+
+	return routes.ImageQuota{MaxInProgress: c.MaxInProgress, Cooldown: cooldown}, nil
+}
+
+func createInstanceQuota(c config.InstanceQuotaConfig) (routes.InstanceQuota, error) {
+	if c.MaxPerUser < 0 || c.MaxTotal < 0 {
+		return routes.InstanceQuota{}, errors.New("instance quota max_per_user and max_total must not be negative")
+	}
+	for user, max := range c.Overrides {
+		if max < 0 {
+			return routes.InstanceQuota{}, fmt.Errorf("instance quota override for %s must not be negative", user)
+		}
+	}
+
+	return routes.InstanceQuota{MaxPerUser: c.MaxPerUser, MaxTotal: c.MaxTotal, Overrides: c.Overrides}, nil
+}
+
+func createLedger(cfg config.Config, logger log.Logger, db *sql.DB) (ledger.Ledger, error) {
+	ttl := ledger.DefaultTTL
+	if cfg.LeaseTTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(cfg.LeaseTTL)
+		if err != nil {
+			return ledger.Ledger{}, errors.Wrap(err, "invalid lease TTL")
+		}
+	}
+
+	owner := ledger.NewOwner()
+	logger.With("owner", owner).Info("Reserving instance resources")
+
+	return ledger.Ledger{
+		Logger: logger,
+		Store:  store.DBLeaseStore{DB: db},
+		Owner:  owner,
+		TTL:    ttl,
+	}, nil
+}
+
+func createFreshnessMonitor(c config.FreshnessConfig, logger log.Logger, imageStore store.ImageStore) (*freshness.Monitor, time.Duration, error) {
+	interval := 5 * time.Minute
+	if c.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(c.Interval)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "invalid freshness interval")
+		}
+	}
+
+	monitor := &freshness.Monitor{
+		Logger:     logger,
+		ImageStore: imageStore,
+	}
+
+	families := map[string]bool{}
+	for _, sla := range c.SLAs {
+		if sla.Family == "" {
+			return nil, 0, errors.New("freshness SLAs must have a family")
+		}
+		if families[sla.Family] {
+			return nil, 0, fmt.Errorf("duplicate freshness SLA for family %s", sla.Family)
+		}
+		families[sla.Family] = true
+
+		maxAge, err := time.ParseDuration(sla.MaxAge)
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "invalid max age for freshness SLA of family %s", sla.Family)
+		}
+
+		monitor.SLAs = append(monitor.SLAs, freshness.SLA{Family: sla.Family, MaxAge: maxAge})
+	}
+
+	if c.NotifyCommand != "" {
+		monitor.Notify = freshness.CommandNotifier(c.NotifyCommand)
+	}
+
+	return monitor, interval, nil
+}
+
+func createAnonAuditor(c config.AnonAuditConfig, logger log.Logger, imageStore store.ImageStore) (*anonaudit.Auditor, time.Duration, error) {
+	interval := 5 * time.Minute
+	if c.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(c.Interval)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "invalid anonymisation audit interval")
+		}
+	}
+
+	auditor := &anonaudit.Auditor{
+		Logger:     logger,
+		Specs:      anonaudit.Specs{},
+		ImageStore: imageStore,
+	}
+
+	for _, spec := range c.Specs {
+		if spec.Family == "" {
+			return nil, 0, errors.New("anonymisation specs must have a family")
+		}
+		if _, ok := auditor.Specs[spec.Family]; ok {
+			return nil, 0, fmt.Errorf("duplicate anonymisation spec for family %s", spec.Family)
+		}
+		if spec.Path == "" {
+			return nil, 0, fmt.Errorf("anonymisation spec of family %s must have a path", spec.Family)
+		}
+
+		policy := spec.Policy
+		switch policy {
+		case "":
+			policy = anonaudit.PolicyReport
+		case anonaudit.PolicyReport, anonaudit.PolicyBlock:
+		case anonaudit.PolicyRebake:
+			if c.RebakeCommand == "" {
+				return nil, 0, fmt.Errorf("anonymisation spec of family %s has the rebake policy, but no rebake command is configured", spec.Family)
+			}
+		default:
+			return nil, 0, fmt.Errorf("invalid policy for anonymisation spec of family %s: %s", spec.Family, policy)
+		}
+
+		auditor.Specs[spec.Family] = anonaudit.Spec{Family: spec.Family, Path: spec.Path, Policy: policy}
+	}
+
+	// Fail now, rather than on the first audit, if a spec can't be read
+	if _, err := auditor.Specs.ReadHashes(); err != nil {
+		return nil, 0, err
+	}
+
+	if c.RebakeCommand != "" {
+		auditor.Rebake = anonaudit.CommandRebaker(c.RebakeCommand)
+	}
+
+	return auditor, interval, nil
+}
+
+func createCanaryRunner(cfg config.Config, logger log.Logger, imageStore store.ImageStore, instanceStore store.InstanceStore, jobStore store.JobStore, executor exec.Executor, leases ledger.Ledger, eventBroker *events.Broker) (canary.Runner, time.Duration, error) {
+	c := cfg.CanaryConfig
+
+	interval := time.Minute
+	if c.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(c.Interval)
+		if err != nil {
+			return canary.Runner{}, 0, errors.Wrap(err, "invalid canary interval")
+		}
+	}
+
+	timeout := canary.DefaultTimeout
+	if c.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(c.Timeout)
+		if err != nil {
+			return canary.Runner{}, 0, errors.Wrap(err, "invalid canary timeout")
+		}
+	}
+
+	return canary.Runner{
+		Logger:          logger,
+		ImageStore:      imageStore,
+		InstanceStore:   instanceStore,
+		JobStore:        jobStore,
+		Executor:        executor,
+		Ledger:          leases,
+		MinInstancePort: cfg.MinInstancePort,
+		MaxInstancePort: cfg.MaxInstancePort,
+		Events:          eventBroker,
+		Test:            canary.CommandTest(c.TestCommand),
+		Timeout:         timeout,
+	}, interval, nil
+}
+
+func createStaticReconciler(cfg config.Config, logger log.Logger, imageStore store.ImageStore, instanceStore store.InstanceStore, jobStore store.JobStore, executor exec.Executor, eventBroker *events.Broker, anonSpecs anonaudit.Specs) (static.Reconciler, time.Duration, error) {
+	c := cfg.StaticInstancesConfig
+
+	interval := static.DefaultInterval
+	if c.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(c.Interval)
+		if err != nil {
+			return static.Reconciler{}, 0, errors.Wrap(err, "invalid static instances interval")
+		}
+	}
+
+	reconciler := static.Reconciler{
+		Logger:        logger,
+		ImageStore:    imageStore,
+		InstanceStore: instanceStore,
+		JobStore:      jobStore,
+		Executor:      executor,
+		Events:        eventBroker,
+		AnonSpecs:     anonSpecs,
+	}
+
+	names := map[string]bool{}
+	ports := map[uint16]bool{}
+	for _, instance := range c.Instances {
+		if instance.Name == "" {
+			return static.Reconciler{}, 0, errors.New("static instances must have a name")
+		}
+		if names[instance.Name] {
+			return static.Reconciler{}, 0, fmt.Errorf("duplicate static instance %s", instance.Name)
+		}
+		names[instance.Name] = true
+
+		if instance.Family == "" {
+			return static.Reconciler{}, 0, fmt.Errorf("static instance %s must have a family", instance.Name)
+		}
+
+		// Other instances' ports are chosen from the range, and instances with
+		// their own addresses listen on 5432, so static instances can't use
+		// them
+		switch {
+		case instance.Port == 0:
+			return static.Reconciler{}, 0, fmt.Errorf("static instance %s must have a port", instance.Name)
+		case ports[instance.Port]:
+			return static.Reconciler{}, 0, fmt.Errorf("static instance %s has the same port as another", instance.Name)
+		case instance.Port >= cfg.MinInstancePort && instance.Port <= cfg.MaxInstancePort:
+			return static.Reconciler{}, 0, fmt.Errorf("port of static instance %s is between min_instance_port and max_instance_port", instance.Name)
+		case instance.Port == 5432 && cfg.InstanceAddressPool != "":
+			return static.Reconciler{}, 0, fmt.Errorf("static instance %s can't use port 5432 when instance_address_pool is set", instance.Name)
+		}
+		ports[instance.Port] = true
+
+		reconciler.Declarations = append(reconciler.Declarations, static.Declaration{
+			Name:   instance.Name,
+			Family: instance.Family,
+			Port:   instance.Port,
+		})
+	}
+
+	return reconciler, interval, nil
+}
+
+func createRegistrar(c config.CatalogConfig, logger log.Logger, instanceStore store.InstanceStore, eventBroker *events.Broker) (catalog.Registrar, time.Duration, error) {
+	interval := 5 * time.Minute
+	if c.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(c.Interval)
+		if err != nil {
+			return catalog.Registrar{}, 0, errors.Wrap(err, "invalid catalog interval")
+		}
+	}
+
+	registrar := catalog.Registrar{
+		Logger:        logger,
+		ServiceName:   c.ServiceName,
+		InstanceStore: instanceStore,
+		Events:        eventBroker,
+	}
+	if registrar.ServiceName == "" {
+		registrar.ServiceName = catalog.DefaultServiceName
+	}
+
+	if c.Kind != "" && c.URL == "" {
+		return catalog.Registrar{}, 0, errors.New("catalog url must be set when catalog kind is")
+	}
+
+	switch c.Kind {
+	case "":
+	case "consul":
+		registrar.Catalog = catalog.NewConsul(c.URL, c.Token.Reveal())
+	case "etcd":
+		prefix := c.Prefix
+		if prefix == "" {
+			prefix = catalog.DefaultEtcdPrefix
+		}
+		registrar.Catalog = catalog.NewEtcd(c.URL, prefix)
+	default:
+		return catalog.Registrar{}, 0, fmt.Errorf("invalid catalog kind %q, must be consul or etcd", c.Kind)
+	}
+
+	return registrar, interval, nil
+}
+
+func createWebhookDispatcher(c []config.Webhook, logger log.Logger, deliveryStore store.WebhookDeliveryStore, eventBroker *events.Broker, redaction redact.Policy) (webhooks.Dispatcher, error) {
+	dispatcher := webhooks.Dispatcher{
+		Logger:    logger,
+		Store:     deliveryStore,
+		Events:    eventBroker,
+		Client:    &http.Client{Timeout: 10 * time.Second},
+		Redaction: redaction,
+	}
+
+	names := map[string]bool{}
+	for _, webhook := range c {
+		if webhook.Name == "" {
+			return webhooks.Dispatcher{}, errors.New("webhooks must have a name")
+		}
+		if names[webhook.Name] {
+			return webhooks.Dispatcher{}, fmt.Errorf("duplicate webhook %s", webhook.Name)
+		}
+		names[webhook.Name] = true
+
+		if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return webhooks.Dispatcher{}, fmt.Errorf("webhook %s must have an http or https url", webhook.Name)
+		}
+		for _, event := range webhook.Events {
+			if !webhooks.ValidEvent(event) {
+				return webhooks.Dispatcher{}, fmt.Errorf("webhook %s has invalid event %q, must be one of %s", webhook.Name, event, strings.Join(webhooks.Events, ", "))
+			}
+		}
+		switch webhook.Format {
+		case "", webhooks.FormatJSONAPI, webhooks.FormatSlack:
+		default:
+			return webhooks.Dispatcher{}, fmt.Errorf("webhook %s has invalid format %q, must be jsonapi or slack", webhook.Name, webhook.Format)
+		}
+		if webhook.MaxAttempts < 0 {
+			return webhooks.Dispatcher{}, fmt.Errorf("max_attempts of webhook %s must not be negative", webhook.Name)
+		}
+
+		dispatcher.Webhooks = append(dispatcher.Webhooks, webhooks.Webhook{
+			Name:        webhook.Name,
+			URL:         webhook.URL,
+			Secret:      webhook.Secret.Reveal(),
+			Events:      webhook.Events,
+			Format:      webhook.Format,
+			MaxAttempts: webhook.MaxAttempts,
+		})
+	}
+
+	return dispatcher, nil
+}
+
+// createRedactionPolicy redacts the secrets in the config, along with the
+// patterns that it adds, on top of the credentials that are always redacted
+func createRedactionPolicy(cfg config.Config) (redact.Policy, error) {
+	policy := redact.Policy{
+		Secrets: []redact.Secret{
+			cfg.DatabaseURL,
+			cfg.SharedSecret,
+			cfg.SentryDsn,
+			cfg.OAuthConfig.ClientSecret,
+			cfg.CatalogConfig.Token,
+		},
+	}
+	for _, webhook := range cfg.Webhooks {
+		// The URLs of Slack's incoming webhooks are credentials in themselves
+		policy.Secrets = append(policy.Secrets, webhook.Secret, redact.Secret(webhook.URL))
+	}
+
+	for _, pattern := range cfg.RedactionConfig.Patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return redact.Policy{}, errors.Wrapf(err, "invalid pattern %q", pattern)
+		}
+		policy.Patterns = append(policy.Patterns, compiled)
+	}
+
+	return policy, nil
+}
+
+func createExecutor(c config.Config, syntheticHook synthetic.Hook, redaction redact.Policy) exec.Executor {
+	return exec.OSExecutor{
+		DataPath:                 c.DataPath,
+		StandbyRestoreCommand:    c.StandbyRestoreCommand,
+		InstanceAddressInterface: c.InstanceAddressInterface,
+		SyntheticHook:            syntheticHook,
+		SchemaOnlyKeepTables:     c.SchemaOnlyKeepTables,
+		Redaction:                redaction,
+	}
+}
+
+// createSyntheticHook returns the hook that pads the configured tables with
+// synthetic rows, or nil if there are none
+func createSyntheticHook(c config.SyntheticDataConfig) (synthetic.Hook, error) {
+	if len(c.Tables) == 0 {
+		return nil, nil
+	}
+
+	padder := synthetic.Padder{}
+	for _, table := range c.Tables {
+		if table.Family == "" || table.Table == "" {
+			return nil, errors.New("synthetic tables must have a family and a table")
+		}
+		if table.MinRows <= 0 {
+			return nil, fmt.Errorf("synthetic table %s must have a positive min_rows", table.Table)
+		}
+
+		padded := synthetic.Table{
+			Family:   table.Family,
+			Database: table.Database,
+			Name:     table.Table,
+			MinRows:  table.MinRows,
+		}
+		switch table.Generator {
+		case "columns":
+			if len(table.Columns) == 0 {
+				return nil, fmt.Errorf("synthetic table %s must have columns to generate", table.Table)
+			}
+			padded.Generator = synthetic.Columns(table.Columns)
+		case "sql":
+			if strings.TrimSpace(table.SQL) == "" {
+				return nil, fmt.Errorf("synthetic table %s must have sql to run", table.Table)
+			}
+			padded.Generator = synthetic.SQL(table.SQL)
+		default:
+			return nil, fmt.Errorf("invalid generator %q for synthetic table %s, must be columns or sql", table.Generator, table.Table)
+		}
+		padder.Tables = append(padder.Tables, padded)
+	}
+
+	return padder, nil
 }
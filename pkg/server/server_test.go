@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormaliseBasePath(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		basePath    string
+		redirectURL string
+		expected    string
+		err         string
+	}{
+		{"empty", "", "https://draupnir.example.com/oauth_callback", "", ""},
+		{"root", "/", "https://draupnir.example.com/oauth_callback", "", ""},
+		{"without slashes", "draupnir", "https://example.com/draupnir/oauth_callback", "/draupnir", ""},
+		{"with slashes", "/draupnir/", "https://example.com/draupnir/oauth_callback", "/draupnir", ""},
+		{"repeated slashes", "//x", "https://example.com/x/oauth_callback", "/x", ""},
+		{
+			"redirect outside base path", "/draupnir", "https://example.com/oauth_callback", "",
+			"oauth redirect url https://example.com/oauth_callback is not beneath base path /draupnir",
+		},
+		{
+			"redirect to a sibling path", "/draupnir", "https://example.com/draupnir-staging/oauth_callback", "",
+			"oauth redirect url https://example.com/draupnir-staging/oauth_callback is not beneath base path /draupnir",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			basePath, err := normaliseBasePath(tc.basePath, tc.redirectURL)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, basePath)
+		})
+	}
+}
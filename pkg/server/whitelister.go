@@ -22,9 +22,12 @@ var (
 )
 
 type RuleEntry struct {
-	IPNet     string
-	Port      uint16
-	UserEmail string
+	IPNet string
+	// Destination is the instance's own address, if it has one. Otherwise the
+	// rule applies to every destination address.
+	Destination string
+	Port        uint16
+	UserEmail   string
 }
 
 type reconcileRequest struct {
@@ -122,7 +125,7 @@ func (iw *IPAddressWhitelister) reconcile(ipt *iptables.IPTables, request reconc
 
 	var desired []RuleEntry
 	for _, a := range whitelist {
-		desired = append(desired, RuleEntry{a.IPAddress, a.Instance.Port, a.Instance.UserEmail})
+		desired = append(desired, RuleEntry{a.IPAddress, a.Instance.Address, a.Instance.Port, a.Instance.UserEmail})
 	}
 
 	// Build up a list of existing rules
@@ -144,6 +147,7 @@ func (iw *IPAddressWhitelister) reconcile(ipt *iptables.IPTables, request reconc
 		logger.
 			With("user_email", rule.UserEmail).
 			With("ip_address", rule.IPNet).
+			With("destination", rule.Destination).
 			With("port", rule.Port).
 			Info("Added rule to whitelist chain")
 	}
@@ -156,6 +160,7 @@ func (iw *IPAddressWhitelister) reconcile(ipt *iptables.IPTables, request reconc
 		logger.
 			With("user_email", rule.UserEmail).
 			With("ip_address", rule.IPNet).
+			With("destination", rule.Destination).
 			With("port", rule.Port).
 			Info("Removed rule from whitelist chain")
 	}
@@ -220,7 +225,12 @@ func retrieveExistingRules(ipt *iptables.IPTables) ([]RuleEntry, error) {
 			return nil, err
 		}
 
-		existing = append(existing, RuleEntry{s.Source.IP.String(), uint16(dstPort), userEmail[1]})
+		destination := ""
+		if s.Destination != nil && !s.Destination.IP.IsUnspecified() {
+			destination = s.Destination.IP.String()
+		}
+
+		existing = append(existing, RuleEntry{s.Source.IP.String(), destination, uint16(dstPort), userEmail[1]})
 	}
 
 	return existing, nil
@@ -230,14 +240,20 @@ func retrieveExistingRules(ipt *iptables.IPTables) ([]RuleEntry, error) {
 func buildRuleString(rule RuleEntry) []string {
 	port := strconv.FormatUint(uint64(rule.Port), 10)
 	comment := fmt.Sprintf("user: %s", rule.UserEmail)
-	return []string{
+	spec := []string{
 		"-p", "tcp",
 		"-m", "state", "--state", "NEW",
 		"-s", rule.IPNet,
+	}
+	if rule.Destination != "" {
+		spec = append(spec, "-d", rule.Destination)
+	}
+	return append(
+		spec,
 		"--dport", port,
 		"-m", "comment", "--comment", comment,
 		"-j", "ACCEPT",
-	}
+	)
 }
 
 // Return the elements which are in slice a, but not slice b
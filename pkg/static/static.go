@@ -0,0 +1,202 @@
+// Package static maintains static instances: instances declared in the
+// server's config, with fixed names and ports, that are shared by everyone,
+// such as a team's staging database. Each is kept on the latest ready image of
+// its family, and is replaced with an instance of the family's next image once
+// that's ready.
+//
+// Static instances belong to the upload user and have no refresh token, so
+// they're never cleaned up, and can't be changed through the API.
+package static
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/anonaudit"
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/jobs"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/server/api/middleware"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// DefaultInterval is how often static instances are reconciled, unless
+// configured otherwise
+const DefaultInterval = time.Minute
+
+// Declaration declares a static instance of the latest ready image of Family,
+// listening on Port. Ports must be outside the range that other instances'
+// ports are chosen from.
+type Declaration struct {
+	Name   string
+	Family string
+	Port   uint16
+}
+
+// Reconciler creates and replaces the static instances so that they match
+// their declarations, and destroys those that are no longer declared
+type Reconciler struct {
+	Logger        log.Logger
+	Declarations  []Declaration
+	ImageStore    store.ImageStore
+	InstanceStore store.InstanceStore
+	JobStore      store.JobStore
+	Executor      exec.Executor
+	Events        *events.Broker
+	// AnonSpecs stop static instances moving onto images that instances can't
+	// be created from, because they're stale
+	AnonSpecs anonaudit.Specs
+}
+
+// Start reconciles the static instances immediately, and then every interval
+// until the context is done
+func (r Reconciler) Start(ctx context.Context, interval time.Duration) error {
+	// The exec package logs with the logger in the context
+	ctx = context.WithValue(ctx, middleware.LoggerKey, &r.Logger)
+
+	for {
+		if err := r.Reconcile(ctx); err != nil {
+			r.Logger.With("error", err).Error("failed to reconcile static instances")
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Reconcile brings each static instance in line with its declaration. Failing
+// to create or destroy one is logged, and retried when it's next reconciled,
+// but doesn't stop the others from being reconciled.
+func (r Reconciler) Reconcile(ctx context.Context) error {
+	images, err := r.ImageStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list images")
+	}
+
+	instances, err := r.InstanceStore.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list instances")
+	}
+
+	existing := map[string]models.Instance{}
+	for _, instance := range instances {
+		if instance.StaticName != "" {
+			existing[instance.StaticName] = instance
+		}
+	}
+
+	latest := freshness.Latest(images)
+	declared := map[string]bool{}
+	for _, declaration := range r.Declarations {
+		declared[declaration.Name] = true
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		logger := r.Logger.With("static_instance", declaration.Name)
+		instance, exists := existing[declaration.Name]
+
+		image, ok := latest[declaration.Family]
+		if !ok {
+			if !exists {
+				logger.With("family", declaration.Family).Warn("no ready image to create static instance from")
+			}
+			continue
+		}
+		if exists && instance.ImageID == image.ID && instance.Port == declaration.Port {
+			continue
+		}
+
+		stale, err := r.AnonSpecs.Blocks(image)
+		if err != nil {
+			logger.With("error", err).Error("failed to check image anonymisation")
+			continue
+		}
+		if stale {
+			logger.With("image", image.ID).Warn("latest image is stale, so static instance isn't moved onto it")
+			continue
+		}
+
+		// The port is fixed, so the old instance has to go before its
+		// replacement can listen on it
+		if exists {
+			logger.With("instance", instance.ID).With("image", image.ID).Info("replacing static instance")
+			if err := r.destroy(logger, instance); err != nil {
+				logger.With("instance", instance.ID).With("error", err).Error("failed to destroy static instance")
+				continue
+			}
+		}
+
+		if err := r.create(ctx, logger, declaration, image); err != nil {
+			logger.With("image", image.ID).With("error", err).Error("failed to create static instance")
+		}
+	}
+
+	for name, instance := range existing {
+		if declared[name] {
+			continue
+		}
+
+		logger := r.Logger.With("static_instance", name)
+		logger.With("instance", instance.ID).Info("destroying static instance that's no longer declared")
+		if err := r.destroy(logger, instance); err != nil {
+			logger.With("instance", instance.ID).With("error", err).Error("failed to destroy static instance")
+		}
+	}
+
+	return nil
+}
+
+// create records and creates the static instance. If creating it fails, the
+// record is destroyed, so that it's created again when it's next reconciled.
+func (r Reconciler) create(ctx context.Context, logger log.Logger, declaration Declaration, image models.Image) error {
+	instance := models.NewInstance(image.ID, auth.UPLOAD_USER_EMAIL, "")
+	instance.StaticName = declaration.Name
+	instance.Port = declaration.Port
+
+	instance, err := r.InstanceStore.Create(instance)
+	if err != nil {
+		return errors.Wrap(err, "failed to record static instance")
+	}
+
+	logger = logger.With("instance", instance.ID)
+	if err := r.Executor.CreateInstance(ctx, image.ID, instance.ID, int(instance.Port), "", false); err != nil {
+		if destroyErr := r.destroy(logger, instance); destroyErr != nil {
+			logger.With("error", destroyErr).Error("failed to destroy static instance")
+		}
+		return errors.Wrap(err, "failed to create static instance")
+	}
+
+	logger.With("image", image.ID).Info("created static instance")
+	r.Events.Publish(events.InstanceEvent(events.Created, instance))
+	return nil
+}
+
+// destroy destroys the static instance. It isn't cancelled with the context,
+// so that instances aren't left behind when the server stops.
+func (r Reconciler) destroy(logger log.Logger, instance models.Instance) error {
+	ctx := context.WithValue(context.Background(), middleware.LoggerKey, &logger)
+
+	err := jobs.Run(logger, r.JobStore, models.JobDestroyInstance, instance.ID, func() error {
+		err := r.InstanceStore.Destroy(instance)
+		if err != nil {
+			return err
+		}
+		return r.Executor.DestroyInstance(ctx, instance.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	r.Events.Publish(events.InstanceEvent(events.Destroyed, instance))
+	return nil
+}
@@ -0,0 +1,191 @@
+package static
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/exec"
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/server/api/auth"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// The stores and executor embed their interfaces, so that calling anything we
+// haven't faked panics
+type fakeImageStore struct {
+	store.ImageStore
+	images []models.Image
+}
+
+func (s fakeImageStore) List() ([]models.Image, error) {
+	return s.images, nil
+}
+
+type fakeInstanceStore struct {
+	store.InstanceStore
+	instances map[int]models.Instance
+}
+
+func (s fakeInstanceStore) Create(instance models.Instance) (models.Instance, error) {
+	instance.ID = len(s.instances) + 10
+	s.instances[instance.ID] = instance
+	return instance, nil
+}
+
+func (s fakeInstanceStore) List() ([]models.Instance, error) {
+	instances := []models.Instance{}
+	for _, instance := range s.instances {
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+func (s fakeInstanceStore) Destroy(instance models.Instance) error {
+	delete(s.instances, instance.ID)
+	return nil
+}
+
+type fakeJobStore struct {
+	store.JobStore
+}
+
+func (s fakeJobStore) Create(job models.Job) (models.Job, error) {
+	return job, nil
+}
+
+type fakeExecutor struct {
+	exec.Executor
+	created   *[]int
+	destroyed *[]int
+}
+
+func (e fakeExecutor) CreateInstance(ctx context.Context, imageID int, instanceID int, port int, address string, schemaOnly bool) error {
+	*e.created = append(*e.created, instanceID)
+	return nil
+}
+
+func (e fakeExecutor) DestroyInstance(ctx context.Context, id int) error {
+	*e.destroyed = append(*e.destroyed, id)
+	return nil
+}
+
+func newReconciler(images []models.Image, instances map[int]models.Instance, declarations ...Declaration) (Reconciler, *[]int, *[]int, *bytes.Buffer) {
+	var logs bytes.Buffer
+	logger := log.NewLogger(&logs)
+
+	created, destroyed := []int{}, []int{}
+	return Reconciler{
+		Logger:        logger,
+		Declarations:  declarations,
+		ImageStore:    fakeImageStore{images: images},
+		InstanceStore: fakeInstanceStore{instances: instances},
+		JobStore:      fakeJobStore{},
+		Executor:      fakeExecutor{created: &created, destroyed: &destroyed},
+	}, &created, &destroyed, &logs
+}
+
+func familyImage(id int, family string, backedUpAt time.Time) models.Image {
+	return models.Image{
+		ID:          id,
+		Ready:       true,
+		BackedUpAt:  backedUpAt,
+		Annotations: models.Annotations{freshness.FamilyAnnotation: family},
+	}
+}
+
+func TestReconcileCreatesStaticInstances(t *testing.T) {
+	now := time.Now()
+	unready := familyImage(3, "payments", now)
+	unready.Ready = false
+	images := []models.Image{
+		familyImage(1, "payments", now.Add(-48*time.Hour)),
+		familyImage(2, "payments", now.Add(-24*time.Hour)),
+		unready,
+	}
+	instances := map[int]models.Instance{}
+
+	reconciler, created, destroyed, logs := newReconciler(
+		images, instances,
+		Declaration{Name: "payments-staging", Family: "payments", Port: 7001},
+		Declaration{Name: "ledger-staging", Family: "ledger", Port: 7002},
+	)
+
+	assert.Nil(t, reconciler.Reconcile(context.Background()))
+
+	assert.Equal(t, []int{10}, *created)
+	assert.Empty(t, *destroyed)
+	if assert.Contains(t, instances, 10) {
+		instance := instances[10]
+		assert.Equal(t, "payments-staging", instance.StaticName)
+		assert.Equal(t, 2, instance.ImageID, "the instance is of the latest ready image")
+		assert.Equal(t, uint16(7001), instance.Port)
+		assert.Equal(t, auth.UPLOAD_USER_EMAIL, instance.UserEmail)
+		assert.Equal(t, "", instance.RefreshToken.Reveal())
+		assert.Nil(t, instance.ExpiresAt)
+	}
+	assert.Contains(t, logs.String(), "no ready image to create static instance from")
+}
+
+func TestReconcileLeavesUpToDateInstances(t *testing.T) {
+	images := []models.Image{familyImage(1, "payments", time.Now())}
+	instances := map[int]models.Instance{
+		4: {ID: 4, ImageID: 1, Port: 7001, StaticName: "payments-staging"},
+	}
+
+	reconciler, created, destroyed, _ := newReconciler(
+		images, instances,
+		Declaration{Name: "payments-staging", Family: "payments", Port: 7001},
+	)
+
+	assert.Nil(t, reconciler.Reconcile(context.Background()))
+
+	assert.Empty(t, *created)
+	assert.Empty(t, *destroyed)
+	assert.Contains(t, instances, 4)
+}
+
+func TestReconcileReplacesInstancesOfOlderImages(t *testing.T) {
+	now := time.Now()
+	images := []models.Image{
+		familyImage(1, "payments", now.Add(-24*time.Hour)),
+		familyImage(2, "payments", now),
+	}
+	instances := map[int]models.Instance{
+		4: {ID: 4, ImageID: 1, Port: 7001, StaticName: "payments-staging"},
+	}
+
+	reconciler, created, destroyed, _ := newReconciler(
+		images, instances,
+		Declaration{Name: "payments-staging", Family: "payments", Port: 7001},
+	)
+
+	assert.Nil(t, reconciler.Reconcile(context.Background()))
+
+	assert.Equal(t, []int{4}, *destroyed)
+	assert.Equal(t, []int{10}, *created)
+	assert.NotContains(t, instances, 4)
+	assert.Equal(t, 2, instances[10].ImageID)
+	assert.Equal(t, "payments-staging", instances[10].StaticName)
+}
+
+func TestReconcileDestroysUndeclaredInstances(t *testing.T) {
+	images := []models.Image{familyImage(1, "payments", time.Now())}
+	instances := map[int]models.Instance{
+		4: {ID: 4, ImageID: 1, Port: 7001, StaticName: "payments-staging"},
+		5: {ID: 5, ImageID: 1, Port: 6001, UserEmail: "test@draupnir"},
+	}
+
+	reconciler, created, destroyed, _ := newReconciler(images, instances)
+
+	assert.Nil(t, reconciler.Reconcile(context.Background()))
+
+	assert.Empty(t, *created)
+	assert.Equal(t, []int{4}, *destroyed)
+	assert.Contains(t, instances, 5, "instances that aren't static are left alone")
+}
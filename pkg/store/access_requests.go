@@ -0,0 +1,152 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+type AccessRequestStore interface {
+	Create(models.AccessRequest) (models.AccessRequest, error)
+	// Get returns the request. It returns sql.ErrNoRows if there's no such
+	// request.
+	Get(id int) (models.AccessRequest, error)
+	// List returns every request, including those that have been decided and
+	// whose access has expired, newest first
+	List() ([]models.AccessRequest, error)
+	// Decide sets the status of the request, if it's still pending, and
+	// returns it. ExpiresAt is only set for requests that are approved. It
+	// returns sql.ErrNoRows if there's no such request, or it's already been
+	// decided.
+	Decide(id int, status, decidedBy string, decidedAt time.Time, expiresAt *time.Time) (models.AccessRequest, error)
+	// Active returns the user's approved request for the family that gives
+	// access at now. It returns sql.ErrNoRows if the user has no such request.
+	Active(userEmail, family string, now time.Time) (models.AccessRequest, error)
+}
+
+type DBAccessRequestStore struct {
+	DB *sql.DB
+}
+
+const accessRequestColumns = `id, user_email, family, reason, valid_for, status, decided_by, decided_at, expires_at, created_at`
+
+func (s DBAccessRequestStore) Create(request models.AccessRequest) (models.AccessRequest, error) {
+	row := s.DB.QueryRow(
+		`INSERT INTO access_requests (user_email, family, reason, valid_for, status, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING id`,
+		request.UserEmail,
+		request.Family,
+		request.Reason,
+		request.ValidFor,
+		request.Status,
+		request.CreatedAt,
+	)
+
+	err := row.Scan(&request.ID)
+
+	return request, err
+}
+
+func (s DBAccessRequestStore) Get(id int) (models.AccessRequest, error) {
+	row := s.DB.QueryRow(
+		`SELECT `+accessRequestColumns+`
+		 FROM access_requests
+		 WHERE id = $1`,
+		id,
+	)
+
+	return scanAccessRequest(row)
+}
+
+func (s DBAccessRequestStore) List() ([]models.AccessRequest, error) {
+	rows, err := s.DB.Query(
+		`SELECT ` + accessRequestColumns + `
+		 FROM access_requests
+		 ORDER BY id DESC`,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanAccessRequests(rows)
+}
+
+func (s DBAccessRequestStore) Decide(id int, status, decidedBy string, decidedAt time.Time, expiresAt *time.Time) (models.AccessRequest, error) {
+	row := s.DB.QueryRow(
+		`UPDATE access_requests
+		 SET status = $2, decided_by = $3, decided_at = $4, expires_at = $5
+		 WHERE id = $1 AND status = $6
+		 RETURNING `+accessRequestColumns,
+		id,
+		status,
+		decidedBy,
+		decidedAt,
+		expiresAt,
+		models.AccessRequestPending,
+	)
+
+	return scanAccessRequest(row)
+}
+
+func (s DBAccessRequestStore) Active(userEmail, family string, now time.Time) (models.AccessRequest, error) {
+	row := s.DB.QueryRow(
+		`SELECT `+accessRequestColumns+`
+		 FROM access_requests
+		 WHERE user_email = $1 AND family = $2 AND status = $3 AND expires_at > $4
+		 ORDER BY expires_at DESC
+		 LIMIT 1`,
+		userEmail,
+		family,
+		models.AccessRequestApproved,
+		now,
+	)
+
+	return scanAccessRequest(row)
+}
+
+func scanAccessRequest(row *sql.Row) (models.AccessRequest, error) {
+	var request models.AccessRequest
+	err := row.Scan(
+		&request.ID,
+		&request.UserEmail,
+		&request.Family,
+		&request.Reason,
+		&request.ValidFor,
+		&request.Status,
+		&request.DecidedBy,
+		&request.DecidedAt,
+		&request.ExpiresAt,
+		&request.CreatedAt,
+	)
+	return request, err
+}
+
+func scanAccessRequests(rows *sql.Rows) ([]models.AccessRequest, error) {
+	defer rows.Close()
+
+	requests := make([]models.AccessRequest, 0)
+	for rows.Next() {
+		var request models.AccessRequest
+		err := rows.Scan(
+			&request.ID,
+			&request.UserEmail,
+			&request.Family,
+			&request.Reason,
+			&request.ValidFor,
+			&request.Status,
+			&request.DecidedBy,
+			&request.DecidedAt,
+			&request.ExpiresAt,
+			&request.CreatedAt,
+		)
+		if err != nil {
+			return requests, err
+		}
+		requests = append(requests, request)
+	}
+
+	return requests, rows.Err()
+}
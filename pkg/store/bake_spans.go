@@ -0,0 +1,87 @@
+package store
+
+import (
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+type BakeSpanStore interface {
+	Create(models.BakeSpan) (models.BakeSpan, error)
+	Finish(models.BakeSpan) (models.BakeSpan, error)
+	List(imageID int) ([]models.BakeSpan, error)
+}
+
+type DBBakeSpanStore struct {
+	DB *sql.DB
+}
+
+func (s DBBakeSpanStore) Create(span models.BakeSpan) (models.BakeSpan, error) {
+	row := s.DB.QueryRow(
+		`INSERT INTO bake_spans (image_id, phase, started_at)
+		 VALUES ($1, $2, $3)
+		 RETURNING id`,
+		span.ImageID,
+		span.Phase,
+		span.StartedAt,
+	)
+
+	err := row.Scan(&span.ID)
+
+	return span, err
+}
+
+// Finish records the span's finish time and error
+func (s DBBakeSpanStore) Finish(span models.BakeSpan) (models.BakeSpan, error) {
+	_, err := s.DB.Exec(
+		`UPDATE bake_spans
+		 SET finished_at = $2, error = $3, error_class = $4
+		 WHERE id = $1`,
+		span.ID,
+		span.FinishedAt,
+		span.Error,
+		span.ErrorClass,
+	)
+
+	return span, err
+}
+
+// List returns the image's spans in the order that they started
+func (s DBBakeSpanStore) List(imageID int) ([]models.BakeSpan, error) {
+	spans := make([]models.BakeSpan, 0)
+
+	rows, err := s.DB.Query(
+		`SELECT id, image_id, phase, started_at, finished_at, error, error_class
+		 FROM bake_spans
+		 WHERE image_id = $1
+		 ORDER BY started_at ASC, id ASC`,
+		imageID,
+	)
+	if err != nil {
+		return spans, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var span models.BakeSpan
+
+		err = rows.Scan(
+			&span.ID,
+			&span.ImageID,
+			&span.Phase,
+			&span.StartedAt,
+			&span.FinishedAt,
+			&span.Error,
+			&span.ErrorClass,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		spans = append(spans, span)
+	}
+
+	return spans, rows.Err()
+}
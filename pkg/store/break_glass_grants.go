@@ -0,0 +1,151 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+type BreakGlassGrantStore interface {
+	Create(models.BreakGlassGrant) (models.BreakGlassGrant, error)
+	// List returns every grant, including those that have been revoked or
+	// have expired, newest first
+	List() ([]models.BreakGlassGrant, error)
+	// Active returns the user's grant for the image that is active at now. It
+	// returns sql.ErrNoRows if the user has no such grant.
+	Active(userEmail string, imageID int, now time.Time) (models.BreakGlassGrant, error)
+	// Revoke revokes the grant, if it's still active at now, and returns it. It
+	// returns sql.ErrNoRows if there's no such grant, or it's no longer active.
+	Revoke(id int, revokedBy string, now time.Time) (models.BreakGlassGrant, error)
+	// RevokeExpired marks the grants that expired before now as revoked by
+	// models.BreakGlassExpiry, and returns them
+	RevokeExpired(now time.Time) ([]models.BreakGlassGrant, error)
+}
+
+type DBBreakGlassGrantStore struct {
+	DB *sql.DB
+}
+
+const breakGlassGrantColumns = `id, user_email, image_id, reason, granted_by, created_at, expires_at, revoked_at, revoked_by`
+
+func (s DBBreakGlassGrantStore) Create(grant models.BreakGlassGrant) (models.BreakGlassGrant, error) {
+	row := s.DB.QueryRow(
+		`INSERT INTO break_glass_grants (user_email, image_id, reason, granted_by, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING id`,
+		grant.UserEmail,
+		grant.ImageID,
+		grant.Reason,
+		grant.GrantedBy,
+		grant.CreatedAt,
+		grant.ExpiresAt,
+	)
+
+	err := row.Scan(&grant.ID)
+
+	return grant, err
+}
+
+func (s DBBreakGlassGrantStore) List() ([]models.BreakGlassGrant, error) {
+	rows, err := s.DB.Query(
+		`SELECT ` + breakGlassGrantColumns + `
+		 FROM break_glass_grants
+		 ORDER BY id DESC`,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanBreakGlassGrants(rows)
+}
+
+func (s DBBreakGlassGrantStore) Active(userEmail string, imageID int, now time.Time) (models.BreakGlassGrant, error) {
+	row := s.DB.QueryRow(
+		`SELECT `+breakGlassGrantColumns+`
+		 FROM break_glass_grants
+		 WHERE user_email = $1 AND image_id = $2 AND revoked_at IS NULL AND expires_at > $3
+		 ORDER BY expires_at DESC
+		 LIMIT 1`,
+		userEmail,
+		imageID,
+		now,
+	)
+
+	return scanBreakGlassGrant(row)
+}
+
+func (s DBBreakGlassGrantStore) Revoke(id int, revokedBy string, now time.Time) (models.BreakGlassGrant, error) {
+	row := s.DB.QueryRow(
+		`UPDATE break_glass_grants
+		 SET revoked_at = $3, revoked_by = $2
+		 WHERE id = $1 AND revoked_at IS NULL AND expires_at > $3
+		 RETURNING `+breakGlassGrantColumns,
+		id,
+		revokedBy,
+		now,
+	)
+
+	return scanBreakGlassGrant(row)
+}
+
+func (s DBBreakGlassGrantStore) RevokeExpired(now time.Time) ([]models.BreakGlassGrant, error) {
+	// Expired grants are revoked as of when they expired, rather than when
+	// they were found to have expired
+	rows, err := s.DB.Query(
+		`UPDATE break_glass_grants
+		 SET revoked_at = expires_at, revoked_by = $1
+		 WHERE revoked_at IS NULL AND expires_at <= $2
+		 RETURNING `+breakGlassGrantColumns,
+		models.BreakGlassExpiry,
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanBreakGlassGrants(rows)
+}
+
+func scanBreakGlassGrant(row *sql.Row) (models.BreakGlassGrant, error) {
+	var grant models.BreakGlassGrant
+	err := row.Scan(
+		&grant.ID,
+		&grant.UserEmail,
+		&grant.ImageID,
+		&grant.Reason,
+		&grant.GrantedBy,
+		&grant.CreatedAt,
+		&grant.ExpiresAt,
+		&grant.RevokedAt,
+		&grant.RevokedBy,
+	)
+	return grant, err
+}
+
+func scanBreakGlassGrants(rows *sql.Rows) ([]models.BreakGlassGrant, error) {
+	defer rows.Close()
+
+	grants := make([]models.BreakGlassGrant, 0)
+	for rows.Next() {
+		var grant models.BreakGlassGrant
+		err := rows.Scan(
+			&grant.ID,
+			&grant.UserEmail,
+			&grant.ImageID,
+			&grant.Reason,
+			&grant.GrantedBy,
+			&grant.CreatedAt,
+			&grant.ExpiresAt,
+			&grant.RevokedAt,
+			&grant.RevokedBy,
+		)
+		if err != nil {
+			return grants, err
+		}
+		grants = append(grants, grant)
+	}
+
+	return grants, rows.Err()
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/lib/pq"
+)
+
+type CleanupTokenStore interface {
+	// Create stores the token by the hash of its secret
+	Create(token models.CleanupToken, hash string) (models.CleanupToken, error)
+	// Use marks the token with the hash as used, and returns it. It returns
+	// sql.ErrNoRows if there's no such token, or it's expired or already been
+	// used, so that each token can only be used once.
+	Use(hash string, now time.Time) (models.CleanupToken, error)
+}
+
+type DBCleanupTokenStore struct {
+	DB *sql.DB
+}
+
+func (s DBCleanupTokenStore) Create(token models.CleanupToken, hash string) (models.CleanupToken, error) {
+	row := s.DB.QueryRow(
+		`INSERT INTO cleanup_tokens (token_hash, user_email, instance_ids, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING id`,
+		hash,
+		token.UserEmail,
+		pq.Array(token.InstanceIDs),
+		token.CreatedAt,
+		token.ExpiresAt,
+	)
+
+	err := row.Scan(&token.ID)
+
+	return token, err
+}
+
+func (s DBCleanupTokenStore) Use(hash string, now time.Time) (models.CleanupToken, error) {
+	var token models.CleanupToken
+
+	row := s.DB.QueryRow(
+		`UPDATE cleanup_tokens
+		 SET used_at = $2
+		 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+		 RETURNING id, user_email, instance_ids, created_at, expires_at, used_at`,
+		hash,
+		now,
+	)
+
+	err := row.Scan(
+		&token.ID,
+		&token.UserEmail,
+		pq.Array(&token.InstanceIDs),
+		&token.CreatedAt,
+		&token.ExpiresAt,
+		&token.UsedAt,
+	)
+
+	return token, err
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+type ImageManifestStore interface {
+	// Create stores the image's manifest, replacing any that it already has, as
+	// an image that is finalised again is signed again
+	Create(models.ImageManifest) (models.ImageManifest, error)
+	// Get returns the image's manifest, or sql.ErrNoRows if it doesn't have one
+	Get(imageID int) (models.ImageManifest, error)
+}
+
+type DBImageManifestStore struct {
+	DB *sql.DB
+}
+
+func (s DBImageManifestStore) Create(manifest models.ImageManifest) (models.ImageManifest, error) {
+	_, err := s.DB.Exec(
+		`INSERT INTO image_manifests (
+		   image_id, version, content_hash, anon_hash, baker_version, signer,
+		   key_id, signed_at, signature
+		 )
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		 ON CONFLICT (image_id) DO UPDATE SET
+		   version = EXCLUDED.version,
+		   content_hash = EXCLUDED.content_hash,
+		   anon_hash = EXCLUDED.anon_hash,
+		   baker_version = EXCLUDED.baker_version,
+		   signer = EXCLUDED.signer,
+		   key_id = EXCLUDED.key_id,
+		   signed_at = EXCLUDED.signed_at,
+		   signature = EXCLUDED.signature`,
+		manifest.ImageID,
+		manifest.Version,
+		manifest.ContentHash,
+		manifest.AnonHash,
+		manifest.BakerVersion,
+		manifest.Signer,
+		manifest.KeyID,
+		manifest.SignedAt,
+		manifest.Signature,
+	)
+
+	return manifest, err
+}
+
+func (s DBImageManifestStore) Get(imageID int) (models.ImageManifest, error) {
+	var manifest models.ImageManifest
+
+	row := s.DB.QueryRow(
+		`SELECT image_id, version, content_hash, anon_hash, baker_version, signer,
+		   key_id, signed_at, signature
+		 FROM image_manifests
+		 WHERE image_id = $1`,
+		imageID,
+	)
+
+	err := row.Scan(
+		&manifest.ImageID,
+		&manifest.Version,
+		&manifest.ContentHash,
+		&manifest.AnonHash,
+		&manifest.BakerVersion,
+		&manifest.Signer,
+		&manifest.KeyID,
+		&manifest.SignedAt,
+		&manifest.Signature,
+	)
+
+	return manifest, err
+}
@@ -4,15 +4,27 @@ import (
 	"database/sql"
 
 	"github.com/gocardless/draupnir/pkg/models"
-	_ "github.com/lib/pq" // used to setup the PG driver
+	"github.com/lib/pq"
 )
 
 type ImageStore interface {
 	List() ([]models.Image, error)
+	ListPage(filter ImageFilter, sort Sort, page Page) ([]models.Image, bool, error)
 	Create(models.Image) (models.Image, error)
 	Get(id int) (models.Image, error)
 	Destroy(image models.Image) error
 	MarkAsReady(models.Image) (models.Image, error)
+	Annotate(image models.Image, patch models.Annotations) (models.Image, error)
+	Label(image models.Image, patch models.Labels) (models.Image, error)
+}
+
+// ImageFilter selects the images that ListPage returns. Fields with their zero
+// value don't filter the list.
+type ImageFilter struct {
+	// Ready, if set, selects images that are, or aren't, ready
+	Ready *bool
+	// Labels selects images that have each of the labels, with the same value
+	Labels map[string]string
 }
 
 type DBImageStore struct {
@@ -20,10 +32,45 @@ type DBImageStore struct {
 }
 
 func (s DBImageStore) List() ([]models.Image, error) {
+	return s.list(`ORDER BY id ASC`)
+}
+
+// ListPage returns a page of the images that match the filter, in the order
+// given by the sort, and whether there's another page after it
+func (s DBImageStore) ListPage(filter ImageFilter, sort Sort, page Page) ([]models.Image, bool, error) {
+	orderBy, err := sort.orderBy("images", ImageSortFields)
+	if err != nil {
+		return nil, false, err
+	}
+
+	images, err := s.list(
+		`WHERE ($1::boolean IS NULL OR ready = $1)
+		 AND labels @> $2
+		 `+orderBy+`
+		 LIMIT $3 OFFSET $4`,
+		filter.Ready,
+		labelSelector(filter.Labels),
+		page.limit(),
+		page.offset(),
+	)
+	if err != nil {
+		return images, false, err
+	}
+
+	n, more := page.more(len(images))
+	return images[:n], more, nil
+}
+
+// list returns the images selected by the clauses that follow FROM
+func (s DBImageStore) list(clauses string, args ...interface{}) ([]models.Image, error) {
 	images := make([]models.Image, 0)
 
 	rows, err := s.DB.Query(
-		`SELECT id, backed_up_at, ready, created_at, updated_at FROM images ORDER BY id ASC`,
+		`SELECT id, backed_up_at, ready, created_at, updated_at, shards, annotations,
+		        backup_checksum, backup_lsn, snapshot_checksum, drop_databases, rename_databases, encoding, locale, uploader, labels, workers
+		 FROM images
+		 `+clauses,
+		args...,
 	)
 	if err != nil {
 		return images, err
@@ -39,6 +86,18 @@ func (s DBImageStore) List() ([]models.Image, error) {
 			&image.Ready,
 			&image.CreatedAt,
 			&image.UpdatedAt,
+			pq.Array(&image.Shards),
+			annotations(&image.Annotations),
+			&image.BackupChecksum,
+			&image.BackupLSN,
+			&image.SnapshotChecksum,
+			pq.Array(&image.DropDatabases),
+			databaseRenames(&image.RenameDatabases),
+			&image.Encoding,
+			&image.Locale,
+			&image.Uploader,
+			labels(&image.Labels),
+			workerNodes(&image.Workers),
 		)
 
 		if err != nil {
@@ -55,7 +114,8 @@ func (s DBImageStore) Get(id int) (models.Image, error) {
 	image := models.Image{}
 
 	row := s.DB.QueryRow(
-		`SELECT id, backed_up_at, ready, anon, created_at, updated_at
+		`SELECT id, backed_up_at, ready, anon, created_at, updated_at, shards, annotations,
+		        backup_checksum, backup_lsn, snapshot_checksum, drop_databases, rename_databases, encoding, locale, uploader, labels, workers
 		FROM images
 		WHERE id = $1`,
 		id,
@@ -67,6 +127,18 @@ func (s DBImageStore) Get(id int) (models.Image, error) {
 		&image.Anon,
 		&image.CreatedAt,
 		&image.UpdatedAt,
+		pq.Array(&image.Shards),
+		annotations(&image.Annotations),
+		&image.BackupChecksum,
+		&image.BackupLSN,
+		&image.SnapshotChecksum,
+		pq.Array(&image.DropDatabases),
+		databaseRenames(&image.RenameDatabases),
+		&image.Encoding,
+		&image.Locale,
+		&image.Uploader,
+		labels(&image.Labels),
+		workerNodes(&image.Workers),
 	)
 	if err != nil {
 		return image, err
@@ -77,14 +149,27 @@ func (s DBImageStore) Get(id int) (models.Image, error) {
 
 func (s DBImageStore) Create(image models.Image) (models.Image, error) {
 	row := s.DB.QueryRow(
-		`INSERT INTO images (backed_up_at, ready, anon, created_at, updated_at)
-		 VALUES ($1, $2, $3, $4, $5)
-		 RETURNING id, backed_up_at, ready, created_at, updated_at`,
+		`INSERT INTO images (backed_up_at, ready, anon, created_at, updated_at, shards, annotations,
+		                     backup_checksum, backup_lsn, drop_databases, rename_databases, encoding, locale, uploader, labels, workers)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		 RETURNING id, backed_up_at, ready, created_at, updated_at, shards, annotations,
+		           backup_checksum, backup_lsn, snapshot_checksum, drop_databases, rename_databases, encoding, locale, uploader, labels, workers`,
 		image.BackedUpAt,
 		image.Ready,
 		image.Anon,
 		image.CreatedAt,
 		image.UpdatedAt,
+		pq.Array(image.Shards),
+		annotations(&image.Annotations),
+		image.BackupChecksum,
+		image.BackupLSN,
+		pq.Array(image.DropDatabases),
+		databaseRenames(&image.RenameDatabases),
+		image.Encoding,
+		image.Locale,
+		image.Uploader,
+		labels(&image.Labels),
+		workerNodes(&image.Workers),
 	)
 
 	err := row.Scan(
@@ -93,6 +178,18 @@ func (s DBImageStore) Create(image models.Image) (models.Image, error) {
 		&image.Ready,
 		&image.CreatedAt,
 		&image.UpdatedAt,
+		pq.Array(&image.Shards),
+		annotations(&image.Annotations),
+		&image.BackupChecksum,
+		&image.BackupLSN,
+		&image.SnapshotChecksum,
+		pq.Array(&image.DropDatabases),
+		databaseRenames(&image.RenameDatabases),
+		&image.Encoding,
+		&image.Locale,
+		&image.Uploader,
+		labels(&image.Labels),
+		workerNodes(&image.Workers),
 	)
 	if err != nil {
 		return image, err
@@ -104,12 +201,15 @@ func (s DBImageStore) MarkAsReady(image models.Image) (models.Image, error) {
 	row := s.DB.QueryRow(
 		`UPDATE images
 		 SET ready = TRUE,
+				 snapshot_checksum = $3,
 				 updated_at = now()
 		 WHERE id = $1
 		 AND ready = $2
-		 RETURNING id, backed_up_at, ready, created_at, updated_at`,
+		 RETURNING id, backed_up_at, ready, created_at, updated_at, shards, annotations,
+		           backup_checksum, backup_lsn, snapshot_checksum, drop_databases, rename_databases, encoding, locale, uploader, labels, workers`,
 		image.ID,
 		image.Ready,
+		image.SnapshotChecksum,
 	)
 
 	err := row.Scan(
@@ -118,6 +218,18 @@ func (s DBImageStore) MarkAsReady(image models.Image) (models.Image, error) {
 		&image.Ready,
 		&image.CreatedAt,
 		&image.UpdatedAt,
+		pq.Array(&image.Shards),
+		annotations(&image.Annotations),
+		&image.BackupChecksum,
+		&image.BackupLSN,
+		&image.SnapshotChecksum,
+		pq.Array(&image.DropDatabases),
+		databaseRenames(&image.RenameDatabases),
+		&image.Encoding,
+		&image.Locale,
+		&image.Uploader,
+		labels(&image.Labels),
+		workerNodes(&image.Workers),
 	)
 	if err != nil {
 		return image, err
@@ -125,6 +237,46 @@ func (s DBImageStore) MarkAsReady(image models.Image) (models.Image, error) {
 	return image, nil
 }
 
+// Annotate applies the patch to the image's annotations, setting those with
+// string values and removing those with null values
+func (s DBImageStore) Annotate(image models.Image, patch models.Annotations) (models.Image, error) {
+	row := s.DB.QueryRow(
+		`UPDATE images
+		 SET annotations = jsonb_strip_nulls(annotations || $2),
+				 updated_at = now()
+		 WHERE id = $1
+		 RETURNING annotations, updated_at`,
+		image.ID,
+		annotations(&patch),
+	)
+
+	err := row.Scan(annotations(&image.Annotations), &image.UpdatedAt)
+	if err != nil {
+		return image, err
+	}
+	return image, nil
+}
+
+// Label applies the patch to the image's labels, setting those with string
+// values and removing those with null values
+func (s DBImageStore) Label(image models.Image, patch models.Labels) (models.Image, error) {
+	row := s.DB.QueryRow(
+		`UPDATE images
+		 SET labels = jsonb_strip_nulls(labels || $2),
+				 updated_at = now()
+		 WHERE id = $1
+		 RETURNING labels, updated_at`,
+		image.ID,
+		labels(&patch),
+	)
+
+	err := row.Scan(labels(&image.Labels), &image.UpdatedAt)
+	if err != nil {
+		return image, err
+	}
+	return image, nil
+}
+
 func (s DBImageStore) Destroy(image models.Image) error {
 	_, err := s.DB.Exec("DELETE FROM images WHERE id = $1", image.ID)
 	return err
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/lib/pq"
+)
+
+// InstanceGroupStore stores which instances were created together. The
+// instances themselves are stored by the InstanceStore, so groups are returned
+// without them.
+type InstanceGroupStore interface {
+	Create(group models.InstanceGroup) (models.InstanceGroup, error)
+	List() ([]models.InstanceGroup, error)
+	Get(id int) (models.InstanceGroup, error)
+	// Extend sets when the group expires
+	Extend(group models.InstanceGroup, expiresAt time.Time) (models.InstanceGroup, error)
+	Destroy(group models.InstanceGroup) error
+}
+
+type DBInstanceGroupStore struct {
+	DB *sql.DB
+}
+
+func (s DBInstanceGroupStore) Create(group models.InstanceGroup) (models.InstanceGroup, error) {
+	row := s.DB.QueryRow(
+		`INSERT INTO instance_groups (user_email, instance_ids, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4)
+		 RETURNING id`,
+		group.UserEmail,
+		pq.Array(group.InstanceIDs),
+		group.CreatedAt,
+		group.ExpiresAt,
+	)
+
+	err := row.Scan(&group.ID)
+
+	return group, err
+}
+
+func (s DBInstanceGroupStore) List() ([]models.InstanceGroup, error) {
+	groups := make([]models.InstanceGroup, 0)
+
+	rows, err := s.DB.Query(
+		`SELECT id, user_email, instance_ids, created_at, expires_at
+		 FROM instance_groups
+		 ORDER BY id ASC`,
+	)
+	if err != nil {
+		return groups, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var group models.InstanceGroup
+		err = rows.Scan(
+			&group.ID,
+			&group.UserEmail,
+			pq.Array(&group.InstanceIDs),
+			&group.CreatedAt,
+			&group.ExpiresAt,
+		)
+		if err != nil {
+			return groups, err
+		}
+
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+func (s DBInstanceGroupStore) Get(id int) (models.InstanceGroup, error) {
+	var group models.InstanceGroup
+
+	row := s.DB.QueryRow(
+		`SELECT id, user_email, instance_ids, created_at, expires_at
+		 FROM instance_groups
+		 WHERE id = $1`,
+		id,
+	)
+
+	err := row.Scan(
+		&group.ID,
+		&group.UserEmail,
+		pq.Array(&group.InstanceIDs),
+		&group.CreatedAt,
+		&group.ExpiresAt,
+	)
+
+	return group, err
+}
+
+func (s DBInstanceGroupStore) Extend(group models.InstanceGroup, expiresAt time.Time) (models.InstanceGroup, error) {
+	row := s.DB.QueryRow(
+		`UPDATE instance_groups
+		 SET expires_at = $2
+		 WHERE id = $1
+		 RETURNING expires_at`,
+		group.ID,
+		expiresAt,
+	)
+
+	err := row.Scan(&group.ExpiresAt)
+	return group, err
+}
+
+func (s DBInstanceGroupStore) Destroy(group models.InstanceGroup) error {
+	_, err := s.DB.Exec("DELETE FROM instance_groups WHERE id = $1", group.ID)
+	return err
+}
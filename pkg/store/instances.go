@@ -2,16 +2,56 @@ package store
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/gocardless/draupnir/pkg/models"
-	_ "github.com/lib/pq" // used to setup the PG driver
+	"github.com/lib/pq"
 )
 
 type InstanceStore interface {
 	Create(models.Instance) (models.Instance, error)
 	List() ([]models.Instance, error)
+	ListPage(filter InstanceFilter, sort Sort, page Page) ([]models.Instance, bool, error)
 	Get(id int) (models.Instance, error)
 	Destroy(instance models.Instance) error
+	MarkAsPromoted(instance models.Instance) (models.Instance, error)
+	Annotate(instance models.Instance, patch models.Annotations) (models.Instance, error)
+	Label(instance models.Instance, patch models.Labels) (models.Instance, error)
+	// Extend sets when the instance expires
+	Extend(instance models.Instance, expiresAt time.Time) (models.Instance, error)
+	// Count counts the instances by status and by owner. If userEmail isn't
+	// empty, only that user's instances are counted.
+	Count(userEmail string) ([]models.InstanceCount, error)
+}
+
+// instanceStatus is the SQL expression for the status of a row of the
+// instances table, which must be named instances
+const instanceStatus = `CASE
+	WHEN EXISTS (
+		SELECT 1 FROM jobs
+		WHERE jobs.kind = '` + models.JobDestroyInstance + `'
+		AND jobs.resource_id = instances.id
+		AND jobs.status = '` + models.JobRunning + `'
+	) THEN '` + models.InstanceDestroying + `'
+	WHEN instances.expires_at <= now() THEN '` + models.InstanceExpired + `'
+	WHEN instances.standby THEN '` + models.InstanceStandby + `'
+	ELSE '` + models.InstanceRunning + `'
+END`
+
+// InstanceFilter selects the instances that ListPage returns. Fields with their
+// zero value don't filter the list.
+type InstanceFilter struct {
+	// UserEmail selects the user's instances
+	UserEmail string
+	// ImageID selects instances of the image
+	ImageID int
+	// Statuses selects instances with any of the statuses
+	Statuses []string
+	// Labels selects instances that have each of the labels, with the same
+	// value
+	Labels map[string]string
+	// Static selects static instances
+	Static bool
 }
 
 type DBInstanceStore struct {
@@ -21,30 +61,91 @@ type DBInstanceStore struct {
 
 func (s DBInstanceStore) Create(instance models.Instance) (models.Instance, error) {
 	row := s.DB.QueryRow(
-		`INSERT INTO instances (image_id, port, created_at, updated_at, user_email, refresh_token)
-		 VALUES ($1, $2, $3, $4, $5, $6)
-		 RETURNING id`,
+		`WITH instance AS (
+			 INSERT INTO instances (image_id, port, created_at, updated_at, user_email, refresh_token, standby, annotations, address, expires_at, labels, schema_only, static_name)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, $11, $12, NULLIF($13, ''))
+			 RETURNING id, image_id
+		 )
+		 SELECT instance.id, images.shards
+		 FROM instance
+		 JOIN images ON images.id = instance.image_id`,
 		instance.ImageID,
 		instance.Port,
 		instance.CreatedAt,
 		instance.UpdatedAt,
 		instance.UserEmail,
 		instance.RefreshToken,
+		instance.Standby,
+		annotations(&instance.Annotations),
+		instance.Address,
+		instance.ExpiresAt,
+		labels(&instance.Labels),
+		instance.SchemaOnly,
+		instance.StaticName,
 	)
 
-	err := row.Scan(&instance.ID)
-	instance.Hostname = s.PublicHostname
+	var shards []string
+	err := row.Scan(&instance.ID, pq.Array(&shards))
+	s.setConnectionDetails(&instance, shards)
+
+	instance.Status = models.InstanceRunning
+	if instance.Standby {
+		instance.Status = models.InstanceStandby
+	}
 
 	return instance, err
 }
 
 func (s DBInstanceStore) List() ([]models.Instance, error) {
+	return s.list(`ORDER BY instances.id ASC`)
+}
+
+// ListPage returns a page of the instances that match the filter, in the order
+// given by the sort, and whether there's another page after it
+func (s DBInstanceStore) ListPage(filter InstanceFilter, sort Sort, page Page) ([]models.Instance, bool, error) {
+	orderBy, err := sort.orderBy("instances", InstanceSortFields)
+	if err != nil {
+		return nil, false, err
+	}
+
+	instances, err := s.list(
+		`WHERE ($1 = '' OR user_email = $1)
+		 AND ($2 = 0 OR image_id = $2)
+		 AND (array_length($3::text[], 1) IS NULL OR (`+instanceStatus+`) = ANY($3))
+		 AND instances.labels @> $4
+		 AND (NOT $7 OR static_name IS NOT NULL)
+		 `+orderBy+`
+		 LIMIT $5 OFFSET $6`,
+		filter.UserEmail,
+		filter.ImageID,
+		pq.Array(filter.Statuses),
+		labelSelector(filter.Labels),
+		page.limit(),
+		page.offset(),
+		filter.Static,
+	)
+	if err != nil {
+		return instances, false, err
+	}
+
+	n, more := page.more(len(instances))
+	return instances[:n], more, nil
+}
+
+// list returns the instances selected by the clauses that follow the join with
+// their images
+func (s DBInstanceStore) list(clauses string, args ...interface{}) ([]models.Instance, error) {
 	instances := make([]models.Instance, 0)
 
 	rows, err := s.DB.Query(
-		`SELECT id, image_id, port, created_at, updated_at, user_email, refresh_token
+		`SELECT instances.id, image_id, port, instances.created_at, instances.updated_at,
+		        user_email, refresh_token, standby, schema_only, instances.annotations, instances.labels,
+		        COALESCE(address, ''), instances.expires_at, COALESCE(static_name, ''), images.shards,
+		        `+instanceStatus+`
 		 FROM instances
-		 ORDER BY id ASC`,
+		 JOIN images ON images.id = instances.image_id
+		 `+clauses,
+		args...,
 	)
 	if err != nil {
 		return instances, err
@@ -53,6 +154,7 @@ func (s DBInstanceStore) List() ([]models.Instance, error) {
 	defer rows.Close()
 
 	var instance models.Instance
+	var shards []string
 	for rows.Next() {
 		err = rows.Scan(
 			&instance.ID,
@@ -62,13 +164,22 @@ func (s DBInstanceStore) List() ([]models.Instance, error) {
 			&instance.UpdatedAt,
 			&instance.UserEmail,
 			&instance.RefreshToken,
+			&instance.Standby,
+			&instance.SchemaOnly,
+			annotations(&instance.Annotations),
+			labels(&instance.Labels),
+			&instance.Address,
+			&instance.ExpiresAt,
+			&instance.StaticName,
+			pq.Array(&shards),
+			&instance.Status,
 		)
 
 		if err != nil {
 			return instances, err
 		}
 
-		instance.Hostname = s.PublicHostname
+		s.setConnectionDetails(&instance, shards)
 		instances = append(instances, instance)
 	}
 
@@ -79,11 +190,15 @@ func (s DBInstanceStore) Get(id int) (models.Instance, error) {
 	instance := models.Instance{}
 
 	row := s.DB.QueryRow(
-		`SELECT id, image_id, port, created_at, updated_at, user_email
+		`SELECT instances.id, image_id, port, instances.created_at, instances.updated_at,
+		        user_email, standby, schema_only, instances.annotations, instances.labels, COALESCE(address, ''),
+		        instances.expires_at, COALESCE(static_name, ''), images.shards, `+instanceStatus+`
 		 FROM instances
-		 WHERE id = $1`,
+		 JOIN images ON images.id = instances.image_id
+		 WHERE instances.id = $1`,
 		id,
 	)
+	var shards []string
 	err := row.Scan(
 		&instance.ID,
 		&instance.ImageID,
@@ -91,12 +206,21 @@ func (s DBInstanceStore) Get(id int) (models.Instance, error) {
 		&instance.CreatedAt,
 		&instance.UpdatedAt,
 		&instance.UserEmail,
+		&instance.Standby,
+		&instance.SchemaOnly,
+		annotations(&instance.Annotations),
+		labels(&instance.Labels),
+		&instance.Address,
+		&instance.ExpiresAt,
+		&instance.StaticName,
+		pq.Array(&shards),
+		&instance.Status,
 	)
 	if err != nil {
 		return instance, err
 	}
 
-	instance.Hostname = s.PublicHostname
+	s.setConnectionDetails(&instance, shards)
 	return instance, nil
 }
 
@@ -104,3 +228,142 @@ func (s DBInstanceStore) Destroy(instance models.Instance) error {
 	_, err := s.DB.Exec("DELETE FROM instances WHERE id = $1", instance.ID)
 	return err
 }
+
+func (s DBInstanceStore) MarkAsPromoted(instance models.Instance) (models.Instance, error) {
+	row := s.DB.QueryRow(
+		`UPDATE instances
+		 SET standby = FALSE,
+				 updated_at = now()
+		 WHERE id = $1
+		 AND standby = TRUE
+		 RETURNING standby, updated_at, `+instanceStatus+``,
+		instance.ID,
+	)
+
+	err := row.Scan(&instance.Standby, &instance.UpdatedAt, &instance.Status)
+	if err != nil {
+		return instance, err
+	}
+	return instance, nil
+}
+
+// Annotate applies the patch to the instance's annotations, setting those with
+// string values and removing those with null values
+func (s DBInstanceStore) Annotate(instance models.Instance, patch models.Annotations) (models.Instance, error) {
+	row := s.DB.QueryRow(
+		`UPDATE instances
+		 SET annotations = jsonb_strip_nulls(annotations || $2),
+				 updated_at = now()
+		 WHERE id = $1
+		 RETURNING annotations, updated_at, `+instanceStatus+``,
+		instance.ID,
+		annotations(&patch),
+	)
+
+	err := row.Scan(annotations(&instance.Annotations), &instance.UpdatedAt, &instance.Status)
+	if err != nil {
+		return instance, err
+	}
+	return instance, nil
+}
+
+// Label applies the patch to the instance's labels, setting those with string
+// values and removing those with null values
+func (s DBInstanceStore) Label(instance models.Instance, patch models.Labels) (models.Instance, error) {
+	row := s.DB.QueryRow(
+		`UPDATE instances
+		 SET labels = jsonb_strip_nulls(labels || $2),
+				 updated_at = now()
+		 WHERE id = $1
+		 RETURNING labels, updated_at, `+instanceStatus+``,
+		instance.ID,
+		labels(&patch),
+	)
+
+	err := row.Scan(labels(&instance.Labels), &instance.UpdatedAt, &instance.Status)
+	if err != nil {
+		return instance, err
+	}
+	return instance, nil
+}
+
+func (s DBInstanceStore) Extend(instance models.Instance, expiresAt time.Time) (models.Instance, error) {
+	row := s.DB.QueryRow(
+		`UPDATE instances
+		 SET expires_at = $2,
+				 updated_at = now()
+		 WHERE id = $1
+		 RETURNING expires_at, updated_at, `+instanceStatus+``,
+		instance.ID,
+		expiresAt,
+	)
+
+	err := row.Scan(&instance.ExpiresAt, &instance.UpdatedAt, &instance.Status)
+	if err != nil {
+		return instance, err
+	}
+	return instance, nil
+}
+
+// Count aggregates in the database, in a single pass over the instances, so
+// that counting doesn't need every instance to be read. Every status is
+// counted, even if no instance has it, followed by each owner in order of
+// email address.
+func (s DBInstanceStore) Count(userEmail string) ([]models.InstanceCount, error) {
+	rows, err := s.DB.Query(
+		`WITH statuses AS (
+			 SELECT COALESCE(user_email, '') AS user_email, `+instanceStatus+` AS status
+			 FROM instances
+			 WHERE $1 = '' OR user_email = $1
+		 )
+		 SELECT status, user_email, count(*)
+		 FROM statuses
+		 GROUP BY GROUPING SETS ((status), (user_email))
+		 ORDER BY user_email NULLS FIRST, status`,
+		userEmail,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	byStatus := make(map[string]int)
+	var byOwner []models.InstanceCount
+	for rows.Next() {
+		var status, owner sql.NullString
+		var count int
+		if err := rows.Scan(&status, &owner, &count); err != nil {
+			return nil, err
+		}
+
+		if owner.Valid {
+			byOwner = append(byOwner, models.NewInstanceCount(models.InstanceCountByOwner, owner.String, count))
+		} else {
+			byStatus[status.String] = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	counts := make([]models.InstanceCount, 0, len(models.InstanceStatuses)+len(byOwner))
+	for _, status := range models.InstanceStatuses {
+		counts = append(counts, models.NewInstanceCount(models.InstanceCountByStatus, status, byStatus[status]))
+	}
+	return append(counts, byOwner...), nil
+}
+
+// setConnectionDetails populates the fields of the instance that describe how
+// to connect to it, which are derived from our configuration and the image
+func (s DBInstanceStore) setConnectionDetails(instance *models.Instance, shards []string) {
+	instance.Hostname = s.PublicHostname
+	if instance.Address != "" {
+		instance.Hostname = instance.Address
+	}
+
+	instance.ShardDSNs = make([]string, 0, len(shards))
+	for _, shard := range shards {
+		instance.ShardDSNs = append(instance.ShardDSNs, models.ShardDSN(instance.Hostname, instance.Port, shard))
+	}
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+type JobStore interface {
+	Create(models.Job) (models.Job, error)
+	// Start records that a queued job is running
+	Start(models.Job) (models.Job, error)
+	Finish(models.Job) (models.Job, error)
+	Get(id int) (models.Job, error)
+	// ListRunning returns the jobs that haven't finished, including those that
+	// are queued, oldest first
+	ListRunning() ([]models.Job, error)
+	// Latest returns the most recent job of the kind for the resource, or
+	// sql.ErrNoRows if there hasn't been one
+	Latest(kind string, resourceID int) (models.Job, error)
+}
+
+type DBJobStore struct {
+	DB *sql.DB
+}
+
+func (s DBJobStore) Create(job models.Job) (models.Job, error) {
+	row := s.DB.QueryRow(
+		`INSERT INTO jobs (kind, resource_id, status, user_email, started_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 RETURNING id`,
+		job.Kind,
+		job.ResourceID,
+		job.Status,
+		job.UserEmail,
+		job.StartedAt,
+	)
+
+	err := row.Scan(&job.ID)
+
+	return job, err
+}
+
+func (s DBJobStore) Start(job models.Job) (models.Job, error) {
+	_, err := s.DB.Exec(
+		`UPDATE jobs SET status = $2, started_at = $3 WHERE id = $1`,
+		job.ID,
+		job.Status,
+		job.StartedAt,
+	)
+
+	return job, err
+}
+
+// Finish records the job's status, error, error class and finish time
+func (s DBJobStore) Finish(job models.Job) (models.Job, error) {
+	_, err := s.DB.Exec(
+		`UPDATE jobs
+		 SET status = $2, error = $3, error_class = $4, finished_at = $5
+		 WHERE id = $1`,
+		job.ID,
+		job.Status,
+		job.Error,
+		job.ErrorClass,
+		job.FinishedAt,
+	)
+
+	return job, err
+}
+
+func (s DBJobStore) Get(id int) (models.Job, error) {
+	row := s.DB.QueryRow(
+		`SELECT id, kind, resource_id, status, error, error_class, user_email, started_at, finished_at
+		 FROM jobs
+		 WHERE id = $1`,
+		id,
+	)
+
+	return scanJob(row)
+}
+
+func (s DBJobStore) ListRunning() ([]models.Job, error) {
+	jobs := make([]models.Job, 0)
+
+	rows, err := s.DB.Query(
+		`SELECT id, kind, resource_id, status, error, error_class, user_email, started_at, finished_at
+		 FROM jobs
+		 WHERE status IN ($1, $2)
+		 ORDER BY started_at ASC, id ASC`,
+		models.JobQueued,
+		models.JobRunning,
+	)
+	if err != nil {
+		return jobs, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+func (s DBJobStore) Latest(kind string, resourceID int) (models.Job, error) {
+	row := s.DB.QueryRow(
+		`SELECT id, kind, resource_id, status, error, error_class, user_email, started_at, finished_at
+		 FROM jobs
+		 WHERE kind = $1 AND resource_id = $2
+		 ORDER BY started_at DESC, id DESC
+		 LIMIT 1`,
+		kind,
+		resourceID,
+	)
+
+	return scanJob(row)
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row scanner) (models.Job, error) {
+	var job models.Job
+
+	err := row.Scan(
+		&job.ID,
+		&job.Kind,
+		&job.ResourceID,
+		&job.Status,
+		&job.Error,
+		&job.ErrorClass,
+		&job.UserEmail,
+		&job.StartedAt,
+		&job.FinishedAt,
+	)
+
+	return job, err
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// annotations adapts annotations to and from a jsonb column, in the same way
+// that pq.Array does for arrays
+func annotations(a *models.Annotations) jsonObject {
+	return jsonObject{(*map[string]interface{})(a)}
+}
+
+// labels adapts labels to and from a jsonb column
+func labels(l *models.Labels) jsonObject {
+	return jsonObject{(*map[string]interface{})(l)}
+}
+
+// labelSelector adapts the labels that a list is filtered by to a jsonb value,
+// which the labels of a resource contain if it has every one of them
+func labelSelector(selector map[string]string) jsonObject {
+	object := make(map[string]interface{}, len(selector))
+	for key, value := range selector {
+		object[key] = value
+	}
+	return jsonObject{&object}
+}
+
+// databaseRenames adapts database renames to and from a jsonb column
+func databaseRenames(r *models.DatabaseRenames) jsonObject {
+	return jsonObject{(*map[string]interface{})(r)}
+}
+
+// workerNodes adapts the workers of a distributed image to and from a jsonb
+// column
+func workerNodes(w *models.WorkerNodes) jsonObject {
+	return jsonObject{(*map[string]interface{})(w)}
+}
+
+// jsonObject adapts a map to and from a jsonb column containing an object
+type jsonObject struct {
+	object *map[string]interface{}
+}
+
+func (j jsonObject) Scan(src interface{}) error {
+	var data []byte
+	switch src := src.(type) {
+	case []byte:
+		data = src
+	case string:
+		data = []byte(src)
+	default:
+		return fmt.Errorf("cannot scan %T into a JSON object", src)
+	}
+
+	*j.object = map[string]interface{}{}
+	return json.Unmarshal(data, j.object)
+}
+
+func (j jsonObject) Value() (driver.Value, error) {
+	if *j.object == nil {
+		return "{}", nil
+	}
+
+	data, err := json.Marshal(*j.object)
+	return string(data), err
+}
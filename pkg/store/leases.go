@@ -0,0 +1,150 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+type LeaseStore interface {
+	// Acquire records the lease, unless the resource is already leased by a
+	// lease that hasn't expired. It returns whether the lease was acquired.
+	Acquire(models.Lease) (bool, error)
+	// Renew extends the owner's unbound leases until expiresAt
+	Renew(owner string, expiresAt time.Time) error
+	// Bind binds the owner's lease to the instance, so that it no longer expires
+	Bind(kind, value, owner string, instanceID int) error
+	// Release removes the owner's lease, if it still holds it
+	Release(kind, value, owner string) error
+	// List returns the leases of the kind, including expired ones
+	List(kind string) ([]models.Lease, error)
+	// DeleteExpired removes leases that expired before now, returning how many
+	// were removed
+	DeleteExpired(now time.Time) (int64, error)
+}
+
+type DBLeaseStore struct {
+	DB *sql.DB
+}
+
+func (s DBLeaseStore) Acquire(lease models.Lease) (bool, error) {
+	// An expired lease is taken over rather than deleted first, so that two
+	// servers racing for it can't both acquire it
+	result, err := s.DB.Exec(
+		`INSERT INTO resource_leases (kind, value, owner, instance_id, expires_at, heartbeat_at, created_at)
+		 VALUES ($1, $2, $3, NULL, $4, $5, $6)
+		 ON CONFLICT (kind, value) DO UPDATE
+		 SET owner = EXCLUDED.owner, expires_at = EXCLUDED.expires_at,
+		     heartbeat_at = EXCLUDED.heartbeat_at, created_at = EXCLUDED.created_at
+		 WHERE resource_leases.instance_id IS NULL AND resource_leases.expires_at <= EXCLUDED.heartbeat_at`,
+		lease.Kind,
+		lease.Value,
+		lease.Owner,
+		lease.ExpiresAt,
+		lease.HeartbeatAt,
+		lease.CreatedAt,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	acquired, err := result.RowsAffected()
+	return acquired > 0, err
+}
+
+func (s DBLeaseStore) Renew(owner string, expiresAt time.Time) error {
+	_, err := s.DB.Exec(
+		`UPDATE resource_leases
+		 SET expires_at = $2, heartbeat_at = now()
+		 WHERE owner = $1 AND instance_id IS NULL`,
+		owner,
+		expiresAt,
+	)
+
+	return err
+}
+
+func (s DBLeaseStore) Bind(kind, value, owner string, instanceID int) error {
+	result, err := s.DB.Exec(
+		`UPDATE resource_leases
+		 SET instance_id = $4, expires_at = NULL, heartbeat_at = now()
+		 WHERE kind = $1 AND value = $2 AND owner = $3`,
+		kind,
+		value,
+		owner,
+		instanceID,
+	)
+	if err != nil {
+		return err
+	}
+
+	bound, err := result.RowsAffected()
+	if err == nil && bound == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+func (s DBLeaseStore) Release(kind, value, owner string) error {
+	_, err := s.DB.Exec(
+		`DELETE FROM resource_leases
+		 WHERE kind = $1 AND value = $2 AND owner = $3`,
+		kind,
+		value,
+		owner,
+	)
+
+	return err
+}
+
+func (s DBLeaseStore) List(kind string) ([]models.Lease, error) {
+	leases := make([]models.Lease, 0)
+
+	rows, err := s.DB.Query(
+		`SELECT kind, value, owner, COALESCE(instance_id, 0), expires_at, heartbeat_at, created_at
+		 FROM resource_leases
+		 WHERE kind = $1
+		 ORDER BY value ASC`,
+		kind,
+	)
+	if err != nil {
+		return leases, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var lease models.Lease
+		err := rows.Scan(
+			&lease.Kind,
+			&lease.Value,
+			&lease.Owner,
+			&lease.InstanceID,
+			&lease.ExpiresAt,
+			&lease.HeartbeatAt,
+			&lease.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		leases = append(leases, lease)
+	}
+
+	return leases, rows.Err()
+}
+
+func (s DBLeaseStore) DeleteExpired(now time.Time) (int64, error) {
+	result, err := s.DB.Exec(
+		`DELETE FROM resource_leases
+		 WHERE instance_id IS NULL AND expires_at <= $1`,
+		now,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
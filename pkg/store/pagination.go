@@ -0,0 +1,85 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// Page selects a page of a list by its 1-indexed number and the number of
+// items on each page. The zero value, which has no size, selects the whole
+// list.
+type Page struct {
+	Number int
+	Size   int
+}
+
+func (p Page) offset() int {
+	if p.Size == 0 {
+		return 0
+	}
+	return (p.Number - 1) * p.Size
+}
+
+// limit is the number of rows to select for the page: one more than its size,
+// so that whether there's another page can be told without counting them all.
+// It's NULL, which Postgres treats as no limit, for the whole list.
+func (p Page) limit() sql.NullInt64 {
+	if p.Size == 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(p.Size + 1), Valid: true}
+}
+
+// more returns how many of the n rows that were selected for the page are on
+// it, and whether there's another page after it
+func (p Page) more(n int) (int, bool) {
+	if p.Size == 0 {
+		return n, false
+	}
+	if n > p.Size {
+		return p.Size, true
+	}
+	return n, false
+}
+
+// The fields that lists of images and instances can be sorted by, which are
+// columns of the images and instances tables
+var (
+	ImageSortFields    = []string{"id", "backed_up_at", "created_at", "updated_at"}
+	InstanceSortFields = []string{"id", "image_id", "created_at", "updated_at", "expires_at"}
+)
+
+// SortField orders a list by one of its fields
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// Sort orders a list by each of its fields in turn. Lists are finally ordered by
+// ID, so that their order, and so their pages, are stable.
+type Sort []SortField
+
+// orderBy returns the ORDER BY clause for the sort, with the fields qualified
+// by the table. Fields that aren't among those allowed are an error, as they're
+// interpolated into the query. Missing values, such as the expiry of instances
+// that never expire, are sorted last in either direction.
+func (s Sort) orderBy(table string, allowed []string) (string, error) {
+	terms := make([]string, 0, len(s)+1)
+	for _, field := range s {
+		if !models.ContainsString(allowed, field.Field) {
+			return "", fmt.Errorf("cannot sort %s by %s", table, field.Field)
+		}
+
+		direction := "ASC"
+		if field.Descending {
+			direction = "DESC"
+		}
+		terms = append(terms, fmt.Sprintf("%s.%s %s NULLS LAST", table, field.Field, direction))
+	}
+
+	terms = append(terms, table+".id ASC")
+	return "ORDER BY " + strings.Join(terms, ", "), nil
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+type ProxySessionStore interface {
+	Create(models.ProxySession) (models.ProxySession, error)
+	// End records the session's end time, query count and error
+	End(models.ProxySession) (models.ProxySession, error)
+}
+
+type DBProxySessionStore struct {
+	DB *sql.DB
+}
+
+func (s DBProxySessionStore) Create(session models.ProxySession) (models.ProxySession, error) {
+	row := s.DB.QueryRow(
+		`INSERT INTO proxy_sessions (instance_id, image_id, family, user_email, client_ip_address, database, started_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 RETURNING id`,
+		session.InstanceID,
+		session.ImageID,
+		session.Family,
+		session.UserEmail,
+		session.ClientIPAddress,
+		session.Database,
+		session.StartedAt,
+	)
+
+	err := row.Scan(&session.ID)
+
+	return session, err
+}
+
+func (s DBProxySessionStore) End(session models.ProxySession) (models.ProxySession, error) {
+	_, err := s.DB.Exec(
+		`UPDATE proxy_sessions
+		 SET queries = $2, ended_at = $3, error = $4
+		 WHERE id = $1`,
+		session.ID,
+		session.Queries,
+		session.EndedAt,
+		session.Error,
+	)
+
+	return session, err
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// SchemaStore inspects and maintains the metadata database itself, rather than
+// the records in it
+type SchemaStore interface {
+	// AppliedMigrations returns the IDs of the migrations that sql-migrate has
+	// applied, in the order they were applied
+	AppliedMigrations() ([]string, error)
+	Tables() ([]models.TableStats, error)
+	Indexes() ([]models.IndexStats, error)
+	// Vacuum vacuums the table, and analyzes it too if analyze is set
+	Vacuum(ctx context.Context, table string, analyze bool) error
+}
+
+type DBSchemaStore struct {
+	DB *sql.DB
+}
+
+func (s DBSchemaStore) AppliedMigrations() ([]string, error) {
+	migrations := make([]string, 0)
+
+	rows, err := s.DB.Query(`SELECT id FROM gorp_migrations ORDER BY id ASC`)
+	if err != nil {
+		return migrations, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return migrations, err
+		}
+		migrations = append(migrations, id)
+	}
+
+	return migrations, rows.Err()
+}
+
+func (s DBSchemaStore) Tables() ([]models.TableStats, error) {
+	tables := make([]models.TableStats, 0)
+
+	rows, err := s.DB.Query(
+		`SELECT relname, n_live_tup, n_dead_tup, pg_total_relation_size(relid),
+		        GREATEST(last_vacuum, last_autovacuum),
+		        GREATEST(last_analyze, last_autoanalyze)
+		 FROM pg_stat_user_tables
+		 WHERE schemaname = 'public'
+		 ORDER BY relname ASC`,
+	)
+	if err != nil {
+		return tables, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var table models.TableStats
+		var lastVacuum, lastAnalyze pq.NullTime
+		err := rows.Scan(
+			&table.Name,
+			&table.EstimatedRows,
+			&table.DeadRows,
+			&table.SizeBytes,
+			&lastVacuum,
+			&lastAnalyze,
+		)
+		if err != nil {
+			return tables, err
+		}
+		if lastVacuum.Valid {
+			table.LastVacuum = &lastVacuum.Time
+		}
+		if lastAnalyze.Valid {
+			table.LastAnalyze = &lastAnalyze.Time
+		}
+		tables = append(tables, table)
+	}
+
+	return tables, rows.Err()
+}
+
+func (s DBSchemaStore) Indexes() ([]models.IndexStats, error) {
+	indexes := make([]models.IndexStats, 0)
+
+	rows, err := s.DB.Query(
+		`SELECT s.indexrelname, s.relname, pg_relation_size(s.indexrelid), s.idx_scan, i.indisvalid
+		 FROM pg_stat_user_indexes s
+		 JOIN pg_index i ON i.indexrelid = s.indexrelid
+		 WHERE s.schemaname = 'public'
+		 ORDER BY s.relname ASC, s.indexrelname ASC`,
+	)
+	if err != nil {
+		return indexes, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var index models.IndexStats
+		err := rows.Scan(&index.Name, &index.Table, &index.SizeBytes, &index.Scans, &index.Valid)
+		if err != nil {
+			return indexes, err
+		}
+		indexes = append(indexes, index)
+	}
+
+	return indexes, rows.Err()
+}
+
+// Vacuum can't be run inside a transaction, or with the table name as a
+// parameter, so callers must check that the table exists first
+func (s DBSchemaStore) Vacuum(ctx context.Context, table string, analyze bool) error {
+	command := "VACUUM"
+	if analyze {
+		command = "VACUUM ANALYZE"
+	}
+
+	_, err := s.DB.ExecContext(ctx, fmt.Sprintf("%s public.%s", command, pq.QuoteIdentifier(table)))
+	return err
+}
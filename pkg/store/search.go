@@ -0,0 +1,111 @@
+package store
+
+import (
+	"database/sql"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// SearchStore finds images and instances by their labels, owner, annotations,
+// shard names and IDs
+type SearchStore interface {
+	// Search returns a page of the images, and of the user's instances, that
+	// match the query, most relevant first, and whether there's another page
+	// after it
+	Search(query string, userEmail string, page Page) ([]models.SearchResult, bool, error)
+}
+
+type DBSearchStore struct {
+	DB *sql.DB
+}
+
+// searchIDBonus is added to the rank of resources whose ID is the whole query,
+// which is more than any text match can rank, so that they come first
+const searchIDBonus = 1
+
+// Search matches each word of the query as a prefix of the words of the
+// resources' search vectors, which are indexed. Labels and shard names rank
+// above owners, and owners above annotations.
+func (s DBSearchStore) Search(query string, userEmail string, page Page) ([]models.SearchResult, bool, error) {
+	results := make([]models.SearchResult, 0)
+
+	// IDs are serial, so no resource has the ID 0
+	id, err := strconv.Atoi(strings.TrimSpace(query))
+	if err != nil || id < 1 {
+		id = 0
+	}
+
+	terms := searchTerms(query)
+	if terms == "" && id == 0 {
+		return results, false, nil
+	}
+
+	rows, err := s.DB.Query(
+		`WITH query AS (SELECT to_tsquery('simple', $1) AS terms)
+		 SELECT kind, id, score FROM (
+		   SELECT '`+models.SearchResultImage+`' AS kind, images.id, images.updated_at,
+		          ts_rank(image_search_vector(shards, uploader, labels, annotations), query.terms)
+		            + CASE WHEN images.id = $2 THEN $3 ELSE 0 END AS score
+		   FROM images, query
+		   WHERE image_search_vector(shards, uploader, labels, annotations) @@ query.terms
+		   OR images.id = $2
+		   UNION ALL
+		   SELECT '`+models.SearchResultInstance+`', instances.id, instances.updated_at,
+		          ts_rank(instance_search_vector(user_email, labels, annotations), query.terms)
+		            + CASE WHEN instances.id = $2 THEN $3 ELSE 0 END
+		   FROM instances, query
+		   WHERE user_email = $4
+		   AND (instance_search_vector(user_email, labels, annotations) @@ query.terms OR instances.id = $2)
+		 ) AS results
+		 ORDER BY score DESC, updated_at DESC, kind ASC, id ASC
+		 LIMIT $5 OFFSET $6`,
+		terms,
+		id,
+		searchIDBonus,
+		userEmail,
+		page.limit(),
+		page.offset(),
+	)
+	if err != nil {
+		return results, false, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind string
+		var resourceID int
+		var score float64
+		if err := rows.Scan(&kind, &resourceID, &score); err != nil {
+			return results, false, err
+		}
+		results = append(results, models.NewSearchResult(kind, resourceID, score))
+	}
+	if err := rows.Err(); err != nil {
+		return results, false, err
+	}
+
+	n, more := page.more(len(results))
+	return results[:n], more, nil
+}
+
+// searchTermPattern matches the characters that can't be part of a search
+// term, which include every operator of tsquery's syntax
+var searchTermPattern = regexp.MustCompile(`[^A-Za-z0-9_.@-]+`)
+
+// searchTerms returns the tsquery that matches resources with a word starting
+// with each word of the query, e.g. "pay eu" becomes "pay:* & eu:*". It's
+// empty if the query has no words.
+func searchTerms(query string) string {
+	terms := make([]string, 0)
+	for _, word := range strings.Fields(query) {
+		word = strings.Trim(searchTermPattern.ReplaceAllString(word, ""), ".-")
+		if word != "" {
+			terms = append(terms, word+":*")
+		}
+	}
+	return strings.Join(terms, " & ")
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"database/sql"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	_ "github.com/lib/pq" // used to setup the PG driver
+)
+
+type WebhookDeliveryStore interface {
+	Create(models.WebhookDelivery) (models.WebhookDelivery, error)
+	// Update records the outcome of the delivery's latest attempt: its status,
+	// attempts, response status, error and update time
+	Update(models.WebhookDelivery) (models.WebhookDelivery, error)
+	// ListPending returns the deliveries that haven't succeeded or run out of
+	// attempts, oldest first
+	ListPending() ([]models.WebhookDelivery, error)
+	// ListPage returns a page of the deliveries that match the filter, newest
+	// first, and whether there's another page after it
+	ListPage(filter WebhookDeliveryFilter, page Page) ([]models.WebhookDelivery, bool, error)
+}
+
+// WebhookDeliveryFilter selects the deliveries that ListPage returns. Fields
+// with their zero value don't filter the list.
+type WebhookDeliveryFilter struct {
+	// Webhook selects deliveries to the webhook with the name
+	Webhook string
+	// Status selects deliveries with the status
+	Status string
+}
+
+type DBWebhookDeliveryStore struct {
+	DB *sql.DB
+}
+
+const webhookDeliveryColumns = `id, webhook, event, resource_type, resource_id, status, attempts, response_status, error, body, created_at, updated_at`
+
+func (s DBWebhookDeliveryStore) Create(delivery models.WebhookDelivery) (models.WebhookDelivery, error) {
+	row := s.DB.QueryRow(
+		`INSERT INTO webhook_deliveries (webhook, event, resource_type, resource_id, status, attempts, body, created_at, updated_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		 RETURNING id`,
+		delivery.Webhook,
+		delivery.Event,
+		delivery.ResourceType,
+		delivery.ResourceID,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.Body,
+		delivery.CreatedAt,
+		delivery.UpdatedAt,
+	)
+
+	err := row.Scan(&delivery.ID)
+
+	return delivery, err
+}
+
+func (s DBWebhookDeliveryStore) Update(delivery models.WebhookDelivery) (models.WebhookDelivery, error) {
+	_, err := s.DB.Exec(
+		`UPDATE webhook_deliveries
+		 SET status = $2, attempts = $3, response_status = $4, error = $5, updated_at = $6
+		 WHERE id = $1`,
+		delivery.ID,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.ResponseStatus,
+		delivery.Error,
+		delivery.UpdatedAt,
+	)
+
+	return delivery, err
+}
+
+func (s DBWebhookDeliveryStore) ListPending() ([]models.WebhookDelivery, error) {
+	rows, err := s.DB.Query(
+		`SELECT `+webhookDeliveryColumns+`
+		 FROM webhook_deliveries
+		 WHERE status = $1
+		 ORDER BY id ASC`,
+		models.WebhookDeliveryPending,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanWebhookDeliveries(rows)
+}
+
+func (s DBWebhookDeliveryStore) ListPage(filter WebhookDeliveryFilter, page Page) ([]models.WebhookDelivery, bool, error) {
+	rows, err := s.DB.Query(
+		`SELECT `+webhookDeliveryColumns+`
+		 FROM webhook_deliveries
+		 WHERE ($1 = '' OR webhook = $1)
+		 AND ($2 = '' OR status = $2)
+		 ORDER BY id DESC
+		 LIMIT $3 OFFSET $4`,
+		filter.Webhook,
+		filter.Status,
+		page.limit(),
+		page.offset(),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	deliveries, err := scanWebhookDeliveries(rows)
+	if err != nil {
+		return deliveries, false, err
+	}
+
+	n, more := page.more(len(deliveries))
+	return deliveries[:n], more, nil
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]models.WebhookDelivery, error) {
+	defer rows.Close()
+
+	deliveries := make([]models.WebhookDelivery, 0)
+	for rows.Next() {
+		var delivery models.WebhookDelivery
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.Webhook,
+			&delivery.Event,
+			&delivery.ResourceType,
+			&delivery.ResourceID,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.ResponseStatus,
+			&delivery.Error,
+			&delivery.Body,
+			&delivery.CreatedAt,
+			&delivery.UpdatedAt,
+		)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
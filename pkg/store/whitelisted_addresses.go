@@ -44,6 +44,7 @@ func (s DBWhitelistedAddressStore) List() ([]models.WhitelistedAddress, error) {
 		   whitelisted_addresses.updated_at,
 		   instances.id AS instance_id,
 		   instances.port AS instance_port,
+		   COALESCE(instances.address, '') AS instance_address,
 		   instances.user_email AS instance_user_email
 		 FROM whitelisted_addresses
 		 JOIN instances ON instances.id = whitelisted_addresses.instance_id
@@ -57,8 +58,8 @@ func (s DBWhitelistedAddressStore) List() ([]models.WhitelistedAddress, error) {
 
 	for rows.Next() {
 		var address models.WhitelistedAddress
-		// The instance struct is only populated with the 3 fields that we need: ID,
-		// port and user email. Other fields will be left at their 'zero value', but
+		// The instance struct is only populated with the 4 fields that we need: ID,
+		// port, address and user email. Other fields will be left at their 'zero value', but
 		// ignored in the code that calls this.
 		var instance models.Instance
 
@@ -68,6 +69,7 @@ func (s DBWhitelistedAddressStore) List() ([]models.WhitelistedAddress, error) {
 			&address.UpdatedAt,
 			&instance.ID,
 			&instance.Port,
+			&instance.Address,
 			&instance.UserEmail,
 		)
 
@@ -0,0 +1,131 @@
+// Package synthetic pads the tables of images with synthetic rows once they've
+// been anonymised, so that performance tests run against realistic volumes of
+// data even where production data was excluded from the image.
+package synthetic
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// Hook returns the psql script that's run against an image after it has been
+// anonymised. An empty script means there's nothing to run. Scripts must be
+// deterministic, so that every finalisation of an image produces the same rows.
+type Hook interface {
+	Script(image models.Image) (string, error)
+}
+
+// Generator returns the statements that insert rows into a table. They're run
+// with the psql variables first and last set to the numbers of the first and
+// last rows to insert, which continue on from the rows that the table already
+// has, and with the session's random seed set for the image.
+type Generator interface {
+	Statements(table string) (string, error)
+}
+
+// Table is a table of an image family that's padded to at least MinRows rows
+type Table struct {
+	Family string
+	// Database is the database that the table is in. The table is looked for
+	// in the database that the script is run against, which is each shard of a
+	// sharded image, if it's empty.
+	Database string
+	// Name is the table's name, which can be qualified by its schema
+	Name      string
+	MinRows   int
+	Generator Generator
+}
+
+// Padder is a Hook that pads each table of the image's family that has fewer
+// than its minimum number of rows. Tables are padded in the order given.
+type Padder struct {
+	Tables []Table
+}
+
+// Script returns the script that pads the tables of the image's family
+func (p Padder) Script(image models.Image) (string, error) {
+	var script strings.Builder
+	family := freshness.Family(image)
+
+	for _, table := range p.Tables {
+		if table.Family != family {
+			continue
+		}
+
+		statements, err := table.Generator.Statements(table.Name)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to generate synthetic rows for %s", table.Name)
+		}
+
+		if table.Database != "" {
+			fmt.Fprintf(&script, "\\connect \"%s\"\n", table.Database)
+		}
+		fmt.Fprintf(&script, "SELECT setseed(%f);\n", Seed(image.ID, table))
+		fmt.Fprintf(
+			&script,
+			"SELECT count(*) + 1 AS first, %d AS last, count(*) < %d AS pad FROM %s \\gset\n",
+			table.MinRows, table.MinRows, table.Name,
+		)
+		fmt.Fprintf(&script, "\\if :pad\n%s\n\\endif\n", strings.TrimSpace(statements))
+	}
+
+	return script.String(), nil
+}
+
+// Seed returns the random seed, between -1 and 1, with which the image's table
+// is padded. Each table of each image has its own seed, so that tables aren't
+// padded with the same values as each other.
+func Seed(imageID int, table Table) float64 {
+	hash := fnv.New32a()
+	fmt.Fprintf(hash, "%d/%s/%s", imageID, table.Database, table.Name)
+	return float64(hash.Sum32())/float64(1<<31) - 1
+}
+
+// Columns generates rows from a SQL expression for each column, e.g.
+// "md5(n::text)", in which n is the number of the row. Columns that aren't
+// given take their defaults.
+type Columns map[string]string
+
+// Statements returns an INSERT of the rows numbered first to last
+func (c Columns) Statements(table string) (string, error) {
+	if len(c) == 0 {
+		return "", errors.New("no columns to generate")
+	}
+
+	// Columns are sorted so that the script is deterministic
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	expressions := make([]string, len(names))
+	for i, name := range names {
+		expressions[i] = c[name]
+	}
+
+	return fmt.Sprintf(
+		"INSERT INTO %s (%s) SELECT %s FROM generate_series(:first, :last) AS n;",
+		table, strings.Join(names, ", "), strings.Join(expressions, ", "),
+	), nil
+}
+
+// SQL generates rows with statements written by hand, for tables whose rows
+// can't be generated a column at a time, e.g. because they reference rows of
+// other tables. The statements must insert the rows numbered :first to :last.
+type SQL string
+
+// Statements returns the statements as they were written
+func (s SQL) Statements(table string) (string, error) {
+	if strings.TrimSpace(string(s)) == "" {
+		return "", errors.New("no statements to run")
+	}
+	return string(s), nil
+}
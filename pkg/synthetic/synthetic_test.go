@@ -0,0 +1,89 @@
+package synthetic
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gocardless/draupnir/pkg/freshness"
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+func TestPadderScript(t *testing.T) {
+	payments := Table{
+		Family:   "payments",
+		Database: "app",
+		Name:     "public.payments",
+		MinRows:  1000,
+		Generator: Columns{
+			"reference": "md5(n::text)",
+			"amount":    "(random() * 10000)::int",
+		},
+	}
+	events := Table{
+		Family:    "payments",
+		Name:      "events",
+		MinRows:   10,
+		Generator: SQL("INSERT INTO events (id) SELECT generate_series(:first, :last);"),
+	}
+	reports := Table{
+		Family:    "reporting",
+		Name:      "reports",
+		MinRows:   10,
+		Generator: SQL("INSERT INTO reports (id) SELECT generate_series(:first, :last);"),
+	}
+	padder := Padder{Tables: []Table{payments, events, reports}}
+
+	image := models.Image{
+		ID:          3,
+		Annotations: models.Annotations{freshness.FamilyAnnotation: "payments"},
+	}
+	script, err := padder.Script(image)
+	assert.Nil(t, err)
+
+	expected := fmt.Sprintf(`\connect "app"
+SELECT setseed(%f);
+SELECT count(*) + 1 AS first, 1000 AS last, count(*) < 1000 AS pad FROM public.payments \gset
+\if :pad
+INSERT INTO public.payments (amount, reference) SELECT (random() * 10000)::int, md5(n::text) FROM generate_series(:first, :last) AS n;
+\endif
+SELECT setseed(%f);
+SELECT count(*) + 1 AS first, 10 AS last, count(*) < 10 AS pad FROM events \gset
+\if :pad
+INSERT INTO events (id) SELECT generate_series(:first, :last);
+\endif
+`, Seed(3, payments), Seed(3, events))
+	assert.Equal(t, expected, script)
+
+	again, err := padder.Script(image)
+	assert.Nil(t, err)
+	assert.Equal(t, script, again)
+
+	// Images of families without tables have nothing to pad
+	script, err = padder.Script(models.Image{ID: 4})
+	assert.Nil(t, err)
+	assert.Equal(t, "", script)
+}
+
+func TestSeed(t *testing.T) {
+	table := Table{Database: "app", Name: "payments"}
+
+	seed := Seed(3, table)
+	assert.True(t, seed >= -1 && seed <= 1)
+	assert.Equal(t, seed, Seed(3, table))
+	assert.NotEqual(t, seed, Seed(4, table))
+	assert.NotEqual(t, seed, Seed(3, Table{Database: "app", Name: "refunds"}))
+}
+
+func TestGeneratorErrors(t *testing.T) {
+	_, err := Columns{}.Statements("payments")
+	assert.NotNil(t, err)
+
+	_, err = SQL(" ").Statements("payments")
+	assert.NotNil(t, err)
+
+	padder := Padder{Tables: []Table{{Family: freshness.DefaultFamily, Name: "payments", MinRows: 1, Generator: Columns{}}}}
+	_, err = padder.Script(models.Image{ID: 1})
+	assert.EqualError(t, err, "failed to generate synthetic rows for payments: no columns to generate")
+}
@@ -0,0 +1,183 @@
+// Package tracing exports the spans of image bakes to external tracing
+// systems, in addition to the copy that's persisted in Draupnir's database.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+)
+
+// Exporter sends finished bake spans to a tracing system
+type Exporter interface {
+	Export(ctx context.Context, span models.BakeSpan) error
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector, using the JSON
+// encoding of OTLP over HTTP.
+//
+// Every span of an image's bake belongs to the same trace, whose ID is derived
+// from the image's ID, so that bakes that span several server processes (e.g.
+// because the server restarted and the bake was retried) appear as one trace.
+type OTLPExporter struct {
+	// Endpoint is the collector's traces URL, e.g.
+	// http://localhost:4318/v1/traces
+	Endpoint    string
+	ServiceName string
+	Client      *http.Client
+}
+
+func NewOTLPExporter(endpoint string) OTLPExporter {
+	return OTLPExporter{
+		Endpoint:    endpoint,
+		ServiceName: "draupnir",
+		Client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e OTLPExporter) Export(ctx context.Context, span models.BakeSpan) error {
+	var payload bytes.Buffer
+	err := json.NewEncoder(&payload).Encode(e.request(span))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.Endpoint, &payload)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OTLP collector responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+// The types below are the subset of the OTLP JSON encoding that we need. See
+// https://github.com/open-telemetry/opentelemetry-proto
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string             `json:"key"`
+	Value otlpAttributeValue `json:"value"`
+}
+
+type otlpAttributeValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+func (e OTLPExporter) request(span models.BakeSpan) otlpRequest {
+	end := span.StartedAt
+	if span.FinishedAt != nil {
+		end = *span.FinishedAt
+	}
+
+	status := otlpStatus{Code: otlpStatusOK}
+	if span.Error != "" {
+		status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: []otlpAttribute{stringAttribute("service.name", e.ServiceName)},
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: "github.com/gocardless/draupnir"},
+						Spans: []otlpSpan{
+							{
+								TraceID:           hashID(fmt.Sprintf("image-%d", span.ImageID), 16),
+								SpanID:            hashID(fmt.Sprintf("bake-span-%d", span.ID), 8),
+								Name:              span.Phase,
+								Kind:              otlpSpanKindInternal,
+								StartTimeUnixNano: strconv.FormatInt(span.StartedAt.UnixNano(), 10),
+								EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+								Attributes:        []otlpAttribute{intAttribute("draupnir.image_id", span.ImageID)},
+								Status:            status,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// hashID derives a stable trace or span ID of the given number of bytes
+func hashID(seed string, length int) string {
+	sum := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(sum[:length])
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAttributeValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int) otlpAttribute {
+	// OTLP's JSON encoding represents 64 bit integers as strings
+	str := strconv.Itoa(value)
+	return otlpAttribute{Key: key, Value: otlpAttributeValue{IntValue: &str}}
+}
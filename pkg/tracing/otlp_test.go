@@ -0,0 +1,61 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var received otlpRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer server.Close()
+
+	started := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+	finished := started.Add(time.Hour)
+	span := models.BakeSpan{
+		ID:         7,
+		ImageID:    3,
+		Phase:      models.BakePhaseFinalise,
+		StartedAt:  started,
+		FinishedAt: &finished,
+		Error:      "exit status 1",
+	}
+
+	err := NewOTLPExporter(server.URL+"/v1/traces").Export(context.Background(), span)
+	assert.Nil(t, err)
+
+	exported := received.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assert.Equal(t, "finalise", exported.Name)
+	assert.Equal(t, "1493640000000000000", exported.StartTimeUnixNano)
+	assert.Equal(t, "1493643600000000000", exported.EndTimeUnixNano)
+	assert.Equal(t, otlpStatus{Code: otlpStatusError, Message: "exit status 1"}, exported.Status)
+	assert.Len(t, exported.TraceID, 32)
+	assert.Len(t, exported.SpanID, 16)
+
+	// Every span of an image's bake belongs to the same trace
+	other := NewOTLPExporter("").request(models.BakeSpan{ID: 8, ImageID: 3, StartedAt: started})
+	assert.Equal(t, exported.TraceID, other.ResourceSpans[0].ScopeSpans[0].Spans[0].TraceID)
+	assert.NotEqual(t, exported.SpanID, other.ResourceSpans[0].ScopeSpans[0].Spans[0].SpanID)
+}
+
+func TestOTLPExporterWhenCollectorFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	err := NewOTLPExporter(server.URL).Export(context.Background(), models.BakeSpan{})
+
+	assert.EqualError(t, err, "OTLP collector responded with 503 Service Unavailable")
+}
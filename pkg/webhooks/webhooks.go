@@ -0,0 +1,464 @@
+// Package webhooks notifies HTTP endpoints, such as Slack's incoming webhooks or
+// the triggers of test pipelines, when images become ready or fail to finalise,
+// when instances are created or destroyed, and when access to a restricted
+// image family is requested, approved or denied.
+//
+// Each delivery is recorded before it's sent, and retried with exponential
+// backoff until the webhook accepts it or it runs out of attempts. Deliveries
+// that are pending when the server stops are resumed when it next starts.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/jsonapi"
+	"github.com/prometheus/common/log"
+
+	"github.com/gocardless/draupnir/pkg/events"
+	"github.com/gocardless/draupnir/pkg/models"
+	"github.com/gocardless/draupnir/pkg/redact"
+	"github.com/gocardless/draupnir/pkg/store"
+)
+
+// The events that webhooks can subscribe to
+const (
+	ImageReady        = "image.ready"
+	ImageFailed       = "image.failed"
+	InstanceCreated   = "instance.created"
+	InstanceDestroyed = "instance.destroyed"
+	// AccessRequestCreated is sent when a user requests access to a restricted
+	// family, so that the family's approvers can decide it
+	AccessRequestCreated  = "access_request.created"
+	AccessRequestApproved = "access_request.approved"
+	AccessRequestDenied   = "access_request.denied"
+)
+
+// Events are all the events that webhooks can subscribe to
+var Events = []string{
+	ImageReady,
+	ImageFailed,
+	InstanceCreated,
+	InstanceDestroyed,
+	AccessRequestCreated,
+	AccessRequestApproved,
+	AccessRequestDenied,
+}
+
+// The formats of the bodies that webhooks are sent
+const (
+	// FormatJSONAPI sends the image or instance as a JSON:API document, with
+	// the event in its meta
+	FormatJSONAPI = "jsonapi"
+	// FormatSlack sends a message for a Slack incoming webhook
+	FormatSlack = "slack"
+)
+
+// The headers that are sent with each delivery
+const (
+	// SignatureHeader holds the time that the delivery was sent and the
+	// signature of the body, as t=<unix time>,v1=<signature>
+	SignatureHeader = "Draupnir-Signature"
+	EventHeader     = "Draupnir-Event"
+	// DeliveryHeader holds the ID of the delivery, which is the same each time
+	// it's retried
+	DeliveryHeader = "Draupnir-Delivery"
+)
+
+const (
+	// DefaultMaxAttempts is how many times each delivery is attempted, unless
+	// the webhook is configured otherwise
+	DefaultMaxAttempts = 5
+	// DefaultBackoff is how long a delivery waits before it's first retried.
+	// The wait doubles with each retry after that.
+	DefaultBackoff = 10 * time.Second
+)
+
+// ValidEvent reports whether webhooks can subscribe to the event
+func ValidEvent(event string) bool {
+	for _, valid := range Events {
+		if valid == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhook is an endpoint that's sent the events it subscribes to
+type Webhook struct {
+	Name string
+	URL  string
+	// Secret, if set, is the key with which the body of each delivery is
+	// signed, so that the webhook can check that it came from this server
+	Secret string
+	// Events are the events that the webhook subscribes to, or empty to
+	// subscribe to all of them
+	Events      []string
+	Format      string
+	MaxAttempts int
+}
+
+// Subscribes reports whether the webhook is sent the event
+func (w Webhook) Subscribes(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, subscribed := range w.Events {
+		if subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (w Webhook) maxAttempts() int {
+	if w.MaxAttempts == 0 {
+		return DefaultMaxAttempts
+	}
+	return w.MaxAttempts
+}
+
+// EventName returns the webhook event for the change that was published, or ""
+// if webhooks aren't sent for it
+func EventName(event events.Event) string {
+	switch {
+	case event.Image != nil && event.Type == events.Finalised:
+		return ImageReady
+	case event.Image != nil && event.Type == events.FinalisationFailed:
+		return ImageFailed
+	case event.Instance != nil && event.Type == events.Created:
+		return InstanceCreated
+	case event.Instance != nil && event.Type == events.Destroyed:
+		return InstanceDestroyed
+	case event.AccessRequest != nil && event.Type == events.Created:
+		return AccessRequestCreated
+	case event.AccessRequest != nil && event.AccessRequest.Status == models.AccessRequestApproved:
+		return AccessRequestApproved
+	case event.AccessRequest != nil && event.AccessRequest.Status == models.AccessRequestDenied:
+		return AccessRequestDenied
+	default:
+		return ""
+	}
+}
+
+// Sign returns the hex encoded HMAC-SHA256, keyed with the secret, of the unix
+// time that the body was sent at, a full stop and the body. Including the time
+// lets webhooks reject deliveries that are replayed long after they were sent.
+func Sign(secret string, sentAt time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", sentAt.Unix())
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// payload is the body of deliveries in FormatJSONAPI
+type payload struct {
+	Data *jsonapi.Node `json:"data"`
+	Meta payloadMeta   `json:"meta"`
+}
+
+type payloadMeta struct {
+	Event string `json:"event"`
+	// Error is why the image couldn't be finalised, for image.failed
+	Error string `json:"error,omitempty"`
+}
+
+// Body returns the body of deliveries of the event in the format
+func Body(format, name string, event events.Event) ([]byte, error) {
+	if format == FormatSlack {
+		return json.Marshal(map[string]string{"text": slackText(name, event)})
+	}
+
+	var resource interface{}
+	if event.Image != nil {
+		resource = event.Image
+	} else if event.AccessRequest != nil {
+		resource = event.AccessRequest
+	} else {
+		// Credentials are only for the user who created the instance
+		instance := *event.Instance
+		instance.Credentials = nil
+		resource = &instance
+	}
+
+	document, err := jsonapi.MarshalOne(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(payload{
+		Data: document.Data,
+		Meta: payloadMeta{Event: name, Error: event.Error},
+	})
+}
+
+func slackText(name string, event events.Event) string {
+	switch name {
+	case ImageReady:
+		return fmt.Sprintf("Image %d is ready", event.Image.ID)
+	case ImageFailed:
+		return fmt.Sprintf("Image %d failed to finalise: %s", event.Image.ID, event.Error)
+	case InstanceCreated:
+		return fmt.Sprintf("Instance %d of image %d was created for %s", event.Instance.ID, event.Instance.ImageID, event.Instance.UserEmail)
+	case InstanceDestroyed:
+		return fmt.Sprintf("Instance %d of image %d was destroyed", event.Instance.ID, event.Instance.ImageID)
+	case AccessRequestCreated:
+		request := event.AccessRequest
+		return fmt.Sprintf(
+			"%s requested access to %s for %s: %s. Approve it with `draupnir access-requests approve %d`, or deny it with `draupnir access-requests deny %d`",
+			request.UserEmail, request.Family, request.ValidFor, request.Reason, request.ID, request.ID,
+		)
+	default:
+		request := event.AccessRequest
+		return fmt.Sprintf("%s's request %d for access to %s was %s by %s", request.UserEmail, request.ID, request.Family, request.Status, request.DecidedBy)
+	}
+}
+
+// Dispatcher records and sends a delivery to each webhook that subscribes to
+// each event that's published
+type Dispatcher struct {
+	Logger   log.Logger
+	Webhooks []Webhook
+	Store    store.WebhookDeliveryStore
+	Events   *events.Broker
+	Client   *http.Client
+	// Backoff is how long deliveries wait before they're first retried. It
+	// defaults to DefaultBackoff.
+	Backoff time.Duration
+	// Redaction is applied to each body before it's recorded and sent, and to
+	// the errors that deliveries fail with, which can include the webhook's URL
+	Redaction redact.Policy
+}
+
+// Start resumes the deliveries that were pending when the server last stopped,
+// and then sends deliveries of the events that are published until the context
+// is done. Deliveries that are in progress then are left pending.
+func (d Dispatcher) Start(ctx context.Context) error {
+	var inProgress sync.WaitGroup
+	defer inProgress.Wait()
+
+	d.resume(ctx, &inProgress)
+
+	for {
+		subscription, unsubscribe := d.Events.Subscribe()
+		d.follow(ctx, subscription, &inProgress)
+		unsubscribe()
+
+		if ctx.Err() != nil {
+			return nil
+		}
+		// Events that were missed can't be recovered, as they aren't stored
+		d.Logger.Warn("fell behind events, so webhooks weren't sent some of them")
+	}
+}
+
+func (d Dispatcher) follow(ctx context.Context, subscription <-chan events.Event, inProgress *sync.WaitGroup) {
+	for {
+		select {
+		case event, ok := <-subscription:
+			if !ok {
+				return
+			}
+			d.dispatch(ctx, event, inProgress)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dispatch records a delivery of the event to each webhook that subscribes to
+// it, and sends them in the background
+func (d Dispatcher) dispatch(ctx context.Context, event events.Event, inProgress *sync.WaitGroup) {
+	name := EventName(event)
+	if name == "" {
+		return
+	}
+
+	var resourceType string
+	var resourceID int
+	switch {
+	case event.Image != nil:
+		resourceType, resourceID = "images", event.Image.ID
+	case event.AccessRequest != nil:
+		resourceType, resourceID = "access_requests", event.AccessRequest.ID
+	default:
+		resourceType, resourceID = "instances", event.Instance.ID
+	}
+
+	for _, webhook := range d.Webhooks {
+		if !webhook.Subscribes(name) {
+			continue
+		}
+
+		logger := d.Logger.With("webhook", webhook.Name).With("event", name)
+		body, err := Body(webhook.Format, name, event)
+		if err != nil {
+			logger.With("error", err).Error("failed to build webhook body")
+			continue
+		}
+		body = []byte(d.Redaction.String(string(body)))
+
+		now := time.Now()
+		delivery, err := d.Store.Create(models.WebhookDelivery{
+			Webhook:      webhook.Name,
+			Event:        name,
+			ResourceType: resourceType,
+			ResourceID:   resourceID,
+			Status:       models.WebhookDeliveryPending,
+			Body:         body,
+			CreatedAt:    now,
+			UpdatedAt:    now,
+		})
+		if err != nil {
+			logger.With("error", err).Error("failed to record webhook delivery")
+			continue
+		}
+
+		inProgress.Add(1)
+		go func(webhook Webhook) {
+			defer inProgress.Done()
+			d.deliver(ctx, webhook, delivery)
+		}(webhook)
+	}
+}
+
+// resume sends the deliveries that were pending when the server last stopped.
+// Those to webhooks that are no longer configured are marked as failed.
+func (d Dispatcher) resume(ctx context.Context, inProgress *sync.WaitGroup) {
+	pending, err := d.Store.ListPending()
+	if err != nil {
+		d.Logger.With("error", err).Error("failed to list pending webhook deliveries")
+		return
+	}
+
+	webhooks := map[string]Webhook{}
+	for _, webhook := range d.Webhooks {
+		webhooks[webhook.Name] = webhook
+	}
+
+	for _, delivery := range pending {
+		webhook, ok := webhooks[delivery.Webhook]
+		if !ok {
+			delivery.Status = models.WebhookDeliveryFailed
+			delivery.Error = "webhook is no longer configured"
+			d.update(delivery)
+			continue
+		}
+
+		inProgress.Add(1)
+		go func(delivery models.WebhookDelivery) {
+			defer inProgress.Done()
+			d.deliver(ctx, webhook, delivery)
+		}(delivery)
+	}
+}
+
+// deliver sends the delivery until the webhook accepts it or it runs out of
+// attempts, recording the outcome of each attempt
+func (d Dispatcher) deliver(ctx context.Context, webhook Webhook, delivery models.WebhookDelivery) {
+	backoff := d.Backoff
+	if backoff == 0 {
+		backoff = DefaultBackoff
+	}
+
+	for {
+		// Deliveries are resumed with the attempts they had left, which may be
+		// none if the webhook's max_attempts has been lowered since
+		if delivery.Attempts >= webhook.maxAttempts() {
+			delivery.Status = models.WebhookDeliveryFailed
+			d.update(delivery)
+			return
+		}
+
+		if delivery.Attempts > 0 {
+			select {
+			case <-time.After(backoff << uint(delivery.Attempts-1)):
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		status, err := d.send(ctx, webhook, delivery)
+		if ctx.Err() != nil {
+			// The attempt was cut short by the server stopping, so it doesn't
+			// count, and the delivery is resumed when it next starts
+			return
+		}
+
+		delivery.Attempts++
+		delivery.ResponseStatus = status
+		delivery.Error = ""
+		delivery.Status = models.WebhookDeliverySucceeded
+		if err != nil {
+			d.Logger.
+				With("webhook", webhook.Name).
+				With("delivery", delivery.ID).
+				With("attempts", delivery.Attempts).
+				With("error", err).
+				Warn("failed to deliver webhook")
+
+			delivery.Error = d.Redaction.String(err.Error())
+			delivery.Status = models.WebhookDeliveryPending
+			if delivery.Attempts >= webhook.maxAttempts() {
+				delivery.Status = models.WebhookDeliveryFailed
+			}
+		}
+
+		d.update(delivery)
+		if delivery.Status != models.WebhookDeliveryPending {
+			return
+		}
+	}
+}
+
+// send makes one attempt at the delivery, returning the status of the
+// webhook's response, if it responded. Responses other than 2xx are errors.
+func (d Dispatcher) send(ctx context.Context, webhook Webhook, delivery models.WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(delivery.ID))
+	if webhook.Secret != "" {
+		sentAt := time.Now()
+		req.Header.Set(SignatureHeader, fmt.Sprintf("t=%d,v1=%s", sentAt.Unix(), Sign(webhook.Secret, sentAt, delivery.Body)))
+	}
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Reading the body lets the connection be reused
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// update records the outcome of the delivery's latest attempt. Failing to
+// record it is logged, as the delivery has been made, or given up on, either
+// way.
+func (d Dispatcher) update(delivery models.WebhookDelivery) {
+	delivery.UpdatedAt = time.Now()
+	if _, err := d.Store.Update(delivery); err != nil {
+		d.Logger.With("delivery", delivery.ID).With("error", err).Error("failed to record webhook delivery")
+	}
+}
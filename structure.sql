@@ -16,10 +16,184 @@ SET xmloption = content;
 SET client_min_messages = warning;
 SET row_security = off;
 
+--
+-- Name: image_search_vector(text[], text, jsonb, jsonb); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION public.image_search_vector(shards text[], uploader text, labels jsonb, annotations jsonb) RETURNS tsvector
+    LANGUAGE sql IMMUTABLE
+    AS $$
+  SELECT setweight(array_to_tsvector(shards), 'A')
+    || setweight(to_tsvector('simple', labels::text), 'A')
+    || setweight(to_tsvector('simple', coalesce(uploader, '')), 'B')
+    || setweight(to_tsvector('simple', annotations::text), 'C')
+$$;
+
+
+--
+-- Name: instance_search_vector(text, jsonb, jsonb); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION public.instance_search_vector(user_email text, labels jsonb, annotations jsonb) RETURNS tsvector
+    LANGUAGE sql IMMUTABLE
+    AS $$
+  SELECT setweight(to_tsvector('simple', labels::text), 'A')
+    || setweight(to_tsvector('simple', coalesce(user_email, '')), 'B')
+    || setweight(to_tsvector('simple', annotations::text), 'C')
+$$;
+
+
 SET default_tablespace = '';
 
 SET default_with_oids = false;
 
+--
+-- Name: access_requests; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.access_requests (
+    id integer NOT NULL,
+    user_email text NOT NULL,
+    family text NOT NULL,
+    reason text NOT NULL,
+    valid_for text NOT NULL,
+    status text NOT NULL,
+    decided_by text DEFAULT ''::text NOT NULL,
+    decided_at timestamp with time zone,
+    expires_at timestamp with time zone,
+    created_at timestamp with time zone NOT NULL,
+    CONSTRAINT access_requests_reason_check CHECK ((reason <> ''::text))
+);
+
+
+--
+-- Name: access_requests_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.access_requests_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: access_requests_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.access_requests_id_seq OWNED BY public.access_requests.id;
+
+
+--
+-- Name: bake_spans; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.bake_spans (
+    id integer NOT NULL,
+    image_id integer NOT NULL,
+    phase text NOT NULL,
+    started_at timestamp with time zone NOT NULL,
+    finished_at timestamp with time zone,
+    error text DEFAULT ''::text NOT NULL,
+    error_class text DEFAULT ''::text NOT NULL
+);
+
+
+--
+-- Name: bake_spans_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.bake_spans_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: bake_spans_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.bake_spans_id_seq OWNED BY public.bake_spans.id;
+
+
+--
+-- Name: break_glass_grants; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.break_glass_grants (
+    id integer NOT NULL,
+    user_email text NOT NULL,
+    image_id integer NOT NULL,
+    reason text NOT NULL,
+    granted_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    revoked_at timestamp with time zone,
+    revoked_by text DEFAULT ''::text NOT NULL,
+    CONSTRAINT break_glass_grants_reason_check CHECK ((reason <> ''::text))
+);
+
+
+--
+-- Name: break_glass_grants_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.break_glass_grants_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: break_glass_grants_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.break_glass_grants_id_seq OWNED BY public.break_glass_grants.id;
+
+
+--
+-- Name: cleanup_tokens; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.cleanup_tokens (
+    id integer NOT NULL,
+    token_hash text NOT NULL,
+    user_email text NOT NULL,
+    instance_ids integer[] NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    used_at timestamp with time zone
+);
+
+
+--
+-- Name: cleanup_tokens_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.cleanup_tokens_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: cleanup_tokens_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.cleanup_tokens_id_seq OWNED BY public.cleanup_tokens.id;
+
+
 --
 -- Name: gorp_migrations; Type: TABLE; Schema: public; Owner: -
 --
@@ -30,6 +204,23 @@ CREATE TABLE public.gorp_migrations (
 );
 
 
+--
+-- Name: image_manifests; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.image_manifests (
+    image_id integer NOT NULL,
+    version integer NOT NULL,
+    content_hash text NOT NULL,
+    anon_hash text NOT NULL,
+    baker_version text NOT NULL,
+    signer text NOT NULL,
+    key_id text NOT NULL,
+    signed_at timestamp with time zone NOT NULL,
+    signature text NOT NULL
+);
+
+
 --
 -- Name: images; Type: TABLE; Schema: public; Owner: -
 --
@@ -40,7 +231,21 @@ CREATE TABLE public.images (
     ready boolean DEFAULT false NOT NULL,
     created_at timestamp with time zone NOT NULL,
     updated_at timestamp with time zone NOT NULL,
-    anon text
+    anon text,
+    shards text[] DEFAULT '{}'::text[] NOT NULL,
+    annotations jsonb DEFAULT '{}'::jsonb NOT NULL,
+    backup_checksum text DEFAULT ''::text NOT NULL,
+    backup_lsn text DEFAULT ''::text NOT NULL,
+    snapshot_checksum text DEFAULT ''::text NOT NULL,
+    drop_databases text[] DEFAULT '{}'::text[] NOT NULL,
+    rename_databases jsonb DEFAULT '{}'::jsonb NOT NULL,
+    encoding text DEFAULT ''::text NOT NULL,
+    locale text DEFAULT ''::text NOT NULL,
+    uploader text DEFAULT ''::text NOT NULL,
+    labels jsonb DEFAULT '{}'::jsonb NOT NULL,
+    workers jsonb DEFAULT '{}'::jsonb NOT NULL,
+    CONSTRAINT images_annotations_size CHECK (((jsonb_typeof(annotations) = 'object'::text) AND (octet_length((annotations)::text) <= 16384))),
+    CONSTRAINT images_labels_size CHECK (((jsonb_typeof(labels) = 'object'::text) AND (octet_length((labels)::text) <= 16384)))
 );
 
 
@@ -64,6 +269,39 @@ CREATE SEQUENCE public.images_id_seq
 ALTER SEQUENCE public.images_id_seq OWNED BY public.images.id;
 
 
+--
+-- Name: instance_groups; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.instance_groups (
+    id integer NOT NULL,
+    user_email text NOT NULL,
+    instance_ids integer[] NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    expires_at timestamp with time zone
+);
+
+
+--
+-- Name: instance_groups_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.instance_groups_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: instance_groups_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.instance_groups_id_seq OWNED BY public.instance_groups.id;
+
+
 --
 -- Name: instances; Type: TABLE; Schema: public; Owner: -
 --
@@ -75,7 +313,16 @@ CREATE TABLE public.instances (
     updated_at timestamp with time zone NOT NULL,
     port integer NOT NULL,
     user_email text,
-    refresh_token text
+    refresh_token text,
+    standby boolean DEFAULT false NOT NULL,
+    annotations jsonb DEFAULT '{}'::jsonb NOT NULL,
+    address text,
+    expires_at timestamp with time zone,
+    labels jsonb DEFAULT '{}'::jsonb NOT NULL,
+    schema_only boolean DEFAULT false NOT NULL,
+    static_name text,
+    CONSTRAINT instances_annotations_size CHECK (((jsonb_typeof(annotations) = 'object'::text) AND (octet_length((annotations)::text) <= 16384))),
+    CONSTRAINT instances_labels_size CHECK (((jsonb_typeof(labels) = 'object'::text) AND (octet_length((labels)::text) <= 16384)))
 );
 
 
@@ -99,6 +346,137 @@ CREATE SEQUENCE public.instances_id_seq
 ALTER SEQUENCE public.instances_id_seq OWNED BY public.instances.id;
 
 
+--
+-- Name: jobs; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.jobs (
+    id integer NOT NULL,
+    kind text NOT NULL,
+    resource_id integer NOT NULL,
+    status text NOT NULL,
+    error text DEFAULT ''::text NOT NULL,
+    started_at timestamp with time zone NOT NULL,
+    finished_at timestamp with time zone,
+    error_class text DEFAULT ''::text NOT NULL,
+    user_email text DEFAULT ''::text NOT NULL
+);
+
+
+--
+-- Name: jobs_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.jobs_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: jobs_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.jobs_id_seq OWNED BY public.jobs.id;
+
+
+--
+-- Name: proxy_sessions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.proxy_sessions (
+    id integer NOT NULL,
+    instance_id integer NOT NULL,
+    image_id integer NOT NULL,
+    family text NOT NULL,
+    user_email text NOT NULL,
+    client_ip_address text NOT NULL,
+    database text DEFAULT ''::text NOT NULL,
+    queries integer DEFAULT 0 NOT NULL,
+    started_at timestamp with time zone NOT NULL,
+    ended_at timestamp with time zone,
+    error text DEFAULT ''::text NOT NULL
+);
+
+
+--
+-- Name: proxy_sessions_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.proxy_sessions_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: proxy_sessions_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.proxy_sessions_id_seq OWNED BY public.proxy_sessions.id;
+
+
+--
+-- Name: resource_leases; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.resource_leases (
+    kind text NOT NULL,
+    value text NOT NULL,
+    owner text NOT NULL,
+    instance_id integer,
+    expires_at timestamp with time zone,
+    heartbeat_at timestamp with time zone NOT NULL,
+    created_at timestamp with time zone NOT NULL
+);
+
+
+--
+-- Name: webhook_deliveries; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.webhook_deliveries (
+    id integer NOT NULL,
+    webhook text NOT NULL,
+    event text NOT NULL,
+    resource_type text NOT NULL,
+    resource_id integer NOT NULL,
+    status text NOT NULL,
+    attempts integer DEFAULT 0 NOT NULL,
+    response_status integer DEFAULT 0 NOT NULL,
+    error text DEFAULT ''::text NOT NULL,
+    body bytea NOT NULL,
+    created_at timestamp with time zone NOT NULL,
+    updated_at timestamp with time zone NOT NULL
+);
+
+
+--
+-- Name: webhook_deliveries_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public.webhook_deliveries_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: webhook_deliveries_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public.webhook_deliveries_id_seq OWNED BY public.webhook_deliveries.id;
+
+
 --
 -- Name: whitelisted_addresses; Type: TABLE; Schema: public; Owner: -
 --
@@ -111,6 +489,34 @@ CREATE TABLE public.whitelisted_addresses (
 );
 
 
+--
+-- Name: access_requests id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.access_requests ALTER COLUMN id SET DEFAULT nextval('public.access_requests_id_seq'::regclass);
+
+
+--
+-- Name: bake_spans id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.bake_spans ALTER COLUMN id SET DEFAULT nextval('public.bake_spans_id_seq'::regclass);
+
+
+--
+-- Name: break_glass_grants id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.break_glass_grants ALTER COLUMN id SET DEFAULT nextval('public.break_glass_grants_id_seq'::regclass);
+
+
+--
+-- Name: cleanup_tokens id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.cleanup_tokens ALTER COLUMN id SET DEFAULT nextval('public.cleanup_tokens_id_seq'::regclass);
+
+
 --
 -- Name: images id; Type: DEFAULT; Schema: public; Owner: -
 --
@@ -118,6 +524,13 @@ CREATE TABLE public.whitelisted_addresses (
 ALTER TABLE ONLY public.images ALTER COLUMN id SET DEFAULT nextval('public.images_id_seq'::regclass);
 
 
+--
+-- Name: instance_groups id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.instance_groups ALTER COLUMN id SET DEFAULT nextval('public.instance_groups_id_seq'::regclass);
+
+
 --
 -- Name: instances id; Type: DEFAULT; Schema: public; Owner: -
 --
@@ -125,6 +538,67 @@ ALTER TABLE ONLY public.images ALTER COLUMN id SET DEFAULT nextval('public.image
 ALTER TABLE ONLY public.instances ALTER COLUMN id SET DEFAULT nextval('public.instances_id_seq'::regclass);
 
 
+--
+-- Name: jobs id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.jobs ALTER COLUMN id SET DEFAULT nextval('public.jobs_id_seq'::regclass);
+
+
+--
+-- Name: proxy_sessions id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.proxy_sessions ALTER COLUMN id SET DEFAULT nextval('public.proxy_sessions_id_seq'::regclass);
+
+
+--
+-- Name: webhook_deliveries id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.webhook_deliveries ALTER COLUMN id SET DEFAULT nextval('public.webhook_deliveries_id_seq'::regclass);
+
+
+--
+-- Name: access_requests access_requests_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.access_requests
+    ADD CONSTRAINT access_requests_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: bake_spans bake_spans_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.bake_spans
+    ADD CONSTRAINT bake_spans_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: break_glass_grants break_glass_grants_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.break_glass_grants
+    ADD CONSTRAINT break_glass_grants_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: cleanup_tokens cleanup_tokens_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.cleanup_tokens
+    ADD CONSTRAINT cleanup_tokens_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: cleanup_tokens cleanup_tokens_token_hash_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.cleanup_tokens
+    ADD CONSTRAINT cleanup_tokens_token_hash_key UNIQUE (token_hash);
+
+
 --
 -- Name: gorp_migrations gorp_migrations_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -133,6 +607,14 @@ ALTER TABLE ONLY public.gorp_migrations
     ADD CONSTRAINT gorp_migrations_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: image_manifests image_manifests_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.image_manifests
+    ADD CONSTRAINT image_manifests_pkey PRIMARY KEY (image_id);
+
+
 --
 -- Name: images images_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -141,6 +623,22 @@ ALTER TABLE ONLY public.images
     ADD CONSTRAINT images_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: instance_groups instance_groups_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.instance_groups
+    ADD CONSTRAINT instance_groups_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: instances instances_address_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.instances
+    ADD CONSTRAINT instances_address_key UNIQUE (address);
+
+
 --
 -- Name: instances instances_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -149,6 +647,46 @@ ALTER TABLE ONLY public.instances
     ADD CONSTRAINT instances_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: instances instances_static_name_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.instances
+    ADD CONSTRAINT instances_static_name_key UNIQUE (static_name);
+
+
+--
+-- Name: jobs jobs_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.jobs
+    ADD CONSTRAINT jobs_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: proxy_sessions proxy_sessions_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.proxy_sessions
+    ADD CONSTRAINT proxy_sessions_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: resource_leases resource_leases_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.resource_leases
+    ADD CONSTRAINT resource_leases_pkey PRIMARY KEY (kind, value);
+
+
+--
+-- Name: webhook_deliveries webhook_deliveries_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.webhook_deliveries
+    ADD CONSTRAINT webhook_deliveries_pkey PRIMARY KEY (id);
+
+
 --
 -- Name: whitelisted_addresses whitelisted_addresses_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -157,6 +695,106 @@ ALTER TABLE ONLY public.whitelisted_addresses
     ADD CONSTRAINT whitelisted_addresses_pkey PRIMARY KEY (ip_address, instance_id);
 
 
+--
+-- Name: access_requests_user_email_family_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX access_requests_user_email_family_idx ON public.access_requests USING btree (user_email, family);
+
+
+--
+-- Name: bake_spans_image_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX bake_spans_image_id_idx ON public.bake_spans USING btree (image_id);
+
+
+--
+-- Name: break_glass_grants_user_email_image_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX break_glass_grants_user_email_image_id_idx ON public.break_glass_grants USING btree (user_email, image_id);
+
+
+--
+-- Name: images_labels_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX images_labels_idx ON public.images USING gin (labels jsonb_path_ops);
+
+
+--
+-- Name: images_search_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX images_search_idx ON public.images USING gin (public.image_search_vector(shards, uploader, labels, annotations));
+
+
+--
+-- Name: instances_labels_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX instances_labels_idx ON public.instances USING gin (labels jsonb_path_ops);
+
+
+--
+-- Name: instances_search_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX instances_search_idx ON public.instances USING gin (public.instance_search_vector(user_email, labels, annotations));
+
+
+--
+-- Name: jobs_kind_resource_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX jobs_kind_resource_id_idx ON public.jobs USING btree (kind, resource_id);
+
+
+--
+-- Name: jobs_status_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX jobs_status_idx ON public.jobs USING btree (status);
+
+
+--
+-- Name: proxy_sessions_instance_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX proxy_sessions_instance_id_idx ON public.proxy_sessions USING btree (instance_id);
+
+
+--
+-- Name: resource_leases_owner_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX resource_leases_owner_idx ON public.resource_leases USING btree (owner);
+
+
+--
+-- Name: webhook_deliveries_status_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX webhook_deliveries_status_idx ON public.webhook_deliveries USING btree (status);
+
+
+--
+-- Name: bake_spans bake_spans_image_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.bake_spans
+    ADD CONSTRAINT bake_spans_image_id_fkey FOREIGN KEY (image_id) REFERENCES public.images(id) ON DELETE CASCADE;
+
+
+--
+-- Name: image_manifests image_manifests_image_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.image_manifests
+    ADD CONSTRAINT image_manifests_image_id_fkey FOREIGN KEY (image_id) REFERENCES public.images(id) ON DELETE CASCADE;
+
+
 --
 -- Name: instances instances_image_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
 --
@@ -165,6 +803,14 @@ ALTER TABLE ONLY public.instances
     ADD CONSTRAINT instances_image_id_fkey FOREIGN KEY (image_id) REFERENCES public.images(id);
 
 
+--
+-- Name: resource_leases resource_leases_instance_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.resource_leases
+    ADD CONSTRAINT resource_leases_instance_id_fkey FOREIGN KEY (instance_id) REFERENCES public.instances(id) ON DELETE CASCADE;
+
+
 --
 -- Name: whitelisted_addresses whitelisted_addresses_instance_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
 --